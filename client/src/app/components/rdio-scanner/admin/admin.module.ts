@@ -30,6 +30,7 @@ import { RdioScannerAdminDownstreamsComponent } from './config/downstreams/downs
 import { RdioScannerAdminGroupsComponent } from './config/groups/groups.component';
 import { RdioScannerAdminOptionsComponent } from './config/options/options.component';
 import { RdioScannerAdminSystemsSelectComponent } from './config/systems/select/select.component';
+import { RdioScannerAdminSiteComponent } from './config/systems/site/site.component';
 import { RdioScannerAdminSystemComponent } from './config/systems/system/system.component';
 import { RdioScannerAdminSystemsComponent } from './config/systems/systems.component';
 import { RdioScannerAdminTalkgroupComponent } from './config/systems/talkgroup/talkgroup.component';
@@ -60,6 +61,7 @@ import { RdioScannerAdminPasswordComponent } from './tools/password/password.com
         RdioScannerAdminLogsComponent,
         RdioScannerAdminOptionsComponent,
         RdioScannerAdminPasswordComponent,
+        RdioScannerAdminSiteComponent,
         RdioScannerAdminSystemComponent,
         RdioScannerAdminSystemsComponent,
         RdioScannerAdminSystemsSelectComponent,
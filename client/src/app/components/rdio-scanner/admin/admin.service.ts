@@ -37,6 +37,7 @@ export interface Access {
             id: number;
         }[] | number[] | '*';
     }[] | number[] | '*';
+    tier?: string;
 }
 
 export interface AdminEvent {
@@ -48,10 +49,14 @@ export interface AdminEvent {
 
 export interface ApiKey {
     _id?: string;
+    certificate?: string;
     disabled?: boolean;
     ident?: string;
     key?: string;
+    lastUsed?: string;
     order?: number;
+    revoked?: string;
+    scopes?: ('downstream' | 'read' | 'upload')[];
     systems?: {
         id: number;
         talkgroups: number[] | '*';
@@ -69,6 +74,14 @@ export interface Config {
     tags?: Tag[];
 }
 
+export interface ConfigBundle {
+    config: Config;
+    dateTime: string;
+    format: 'rdio-scanner-config';
+    server: string;
+    version: number;
+}
+
 export interface DirWatch {
     _id?: string;
     delay?: number;
@@ -88,7 +101,9 @@ export interface Downstream {
     _id?: string;
     apiKey?: string;
     disabled?: boolean;
+    groups?: number[];
     order?: number;
+    schedule?: string;
     systems?: {
         id?: number;
         id_as?: number;
@@ -97,6 +112,7 @@ export interface Downstream {
             id_as?: number;
         }[] | number[] | '*';
     }[] | number[] | '*';
+    tags?: number[];
     url?: string;
 }
 
@@ -129,20 +145,57 @@ export interface LogsQueryOptions {
 }
 
 export interface Options {
+    adminEmail?: string;
     afsSystems?: string;
+    audioBitrate?: number;
+    audioCodec?: 'aac' | 'opus';
     audioConversion?: 0 | 1 | 2 | 3;
+    audioCues?: boolean;
+    autoLearnUnits?: boolean;
+    autoMuteDuration?: number;
+    autoMuteMinCalls?: number;
+    autoMuteRate?: number;
     autoPopulate?: boolean;
+    backupAudio?: boolean;
+    backupKeep?: number;
+    backupSchedule?: string;
     branding?: string;
+    clientBufferSize?: number;
+    clientCallQueue?: number;
+    coldStorageDays?: number;
+    digestEmail?: string;
+    digestSchedule?: string;
+    digestTemplate?: string;
+    digestWebhook?: string;
     dimmerDelay?: number;
     disableDuplicateDetection?: boolean;
+    duplicateDetectionMode?: 'drop' | 'merge';
     duplicateDetectionTimeFrame?: number;
     email?: string;
+    errorMessage?: string;
+    ingestPipeline?: string;
     keypadBeeps?: string;
+    liveCaptions?: boolean;
+    maintenance?: boolean;
+    maintenanceMessage?: string;
     maxClients?: number;
     playbackGoesLive?: boolean;
     pruneDays?: number;
+    registration?: boolean;
+    registrationEmail?: string;
+    registrationMax?: number;
+    retentionCompliance?: boolean;
     searchPatchedTalkgroups?: boolean;
+    shareLinks?: boolean;
     showListenersCount?: boolean;
+    showOccupancy?: boolean;
+    slowClientPolicy?: 'disconnect' | 'drop' | 'metadata';
+    smtpFrom?: string;
+    smtpHost?: string;
+    smtpPassword?: string;
+    smtpPort?: number;
+    smtpTls?: 'none' | 'starttls' | 'tls';
+    smtpUsername?: string;
     sortTalkgroups?: boolean;
     tagsToggle?: boolean;
     time12hFormat?: boolean;
@@ -150,29 +203,45 @@ export interface Options {
 
 export interface System {
     _id?: number;
+    audioNormalization?: '' | 'agc' | 'ebu' | 'loud' | 'none';
     autoPopulate?: boolean;
     blacklists?: string;
     id?: number;
     label?: string;
     led?: string | null;
+    metadataFields?: string;
     order?: number | null;
+    sites?: Site[];
     talkgroups?: Talkgroup[];
     units?: Unit[];
 }
 
+export interface Site {
+    id?: number | null;
+    label?: string;
+    order?: number;
+}
+
 export interface Tag {
     _id?: number;
     label?: string;
+    maxDays?: number;
+    minDays?: number;
 }
 
 export interface Talkgroup {
+    delay?: number;
     frequency?: number | null;
     groupId?: number;
+    hideEncrypted?: boolean;
+    hidden?: boolean;
     id?: number;
     label?: string;
     led?: string | null;
+    muteAlerts?: boolean;
     name?: string;
     order?: number;
+    site?: number;
     tagId?: number;
 }
 
@@ -184,10 +253,12 @@ export interface Unit {
 
 enum url {
     config = 'config',
+    configBundle = 'config-bundle',
     login = 'login',
     logout = 'logout',
     logs = 'logs',
     password = 'password',
+    passwordReset = 'password-reset',
 }
 
 const SESSION_STORAGE_KEY = 'rdio-scanner-admin-token';
@@ -257,6 +328,54 @@ export class RdioScannerAdminService implements OnDestroy {
         }
     }
 
+    async getPasswordReset(): Promise<boolean> {
+        try {
+            const res = await firstValueFrom(this.ngHttpClient.get<{ enabled: boolean }>(
+                this.getUrl(url.passwordReset),
+                { responseType: 'json' },
+            ));
+
+            return !!res.enabled;
+
+        } catch (error) {
+            return false;
+        }
+    }
+
+    async requestPasswordReset(): Promise<boolean> {
+        try {
+            await firstValueFrom(this.ngHttpClient.post(
+                this.getUrl(url.passwordReset),
+                {},
+                { responseType: 'text' },
+            ));
+
+            return true;
+
+        } catch (error) {
+            this.errorHandler(error);
+
+            return false;
+        }
+    }
+
+    async resetPassword(code: string, newPassword: string): Promise<boolean> {
+        try {
+            await firstValueFrom(this.ngHttpClient.post(
+                this.getUrl(url.passwordReset),
+                { code, newPassword },
+                { responseType: 'text' },
+            ));
+
+            return true;
+
+        } catch (error) {
+            this.errorHandler(error);
+
+            return false;
+        }
+    }
+
     async getConfig(): Promise<Config> {
         try {
             const res = await firstValueFrom(this.ngHttpClient.get<{
@@ -289,6 +408,20 @@ export class RdioScannerAdminService implements OnDestroy {
         return {};
     }
 
+    async getConfigBundle(): Promise<ConfigBundle | undefined> {
+        try {
+            return await firstValueFrom(this.ngHttpClient.get<ConfigBundle>(
+                this.getUrl(url.configBundle),
+                { headers: this.getHeaders(), responseType: 'json' },
+            ));
+
+        } catch (error) {
+            this.errorHandler(error);
+        }
+
+        return undefined;
+    }
+
     getLeds(): string[] {
         return ['blue', 'cyan', 'green', 'magenta', 'orange', 'red', 'white', 'yellow'];
     }
@@ -310,14 +443,15 @@ export class RdioScannerAdminService implements OnDestroy {
         }
     }
 
-    async login(password: string): Promise<boolean> {
+    async login(password: string, username?: string): Promise<boolean> {
         try {
             const res = await firstValueFrom(this.ngHttpClient.post<{
                 passwordNeedChange: boolean,
+                role?: string,
                 token: string
             }>(
                 this.getUrl(url.login),
-                { password },
+                { password, username },
                 { headers: this.getHeaders(), responseType: 'json' },
             ));
 
@@ -390,16 +524,21 @@ export class RdioScannerAdminService implements OnDestroy {
             limit: [access?.limit],
             order: [access?.order],
             systems: [access?.systems, Validators.required],
+            tier: [access?.tier],
         });
     }
 
     newApiKeyForm(apiKey?: ApiKey): FormGroup {
         return this.ngFormBuilder.group({
             _id: [apiKey?._id],
+            certificate: [apiKey?.certificate],
             disabled: [apiKey?.disabled],
             ident: [apiKey?.ident, Validators.required],
             key: [apiKey?.key, [Validators.required, this.validateApiKey()]],
+            lastUsed: [apiKey?.lastUsed],
             order: [apiKey?.order],
+            revoked: [apiKey?.revoked],
+            scopes: [apiKey?.scopes],
             systems: [apiKey?.systems, Validators.required],
         });
     }
@@ -439,8 +578,11 @@ export class RdioScannerAdminService implements OnDestroy {
             _id: [downstream?._id],
             apiKey: [downstream?.apiKey, [Validators.required, this.validateApiKey()]],
             disabled: [downstream?.disabled],
+            groups: [downstream?.groups || []],
             order: [downstream?.order],
+            schedule: [downstream?.schedule, this.validateSchedule()],
             systems: [downstream?.systems, Validators.required],
+            tags: [downstream?.tags || []],
             url: [downstream?.url, [Validators.required, this.validateUrl(), this.validateDownstreamUrl()]],
         });
     }
@@ -456,32 +598,50 @@ export class RdioScannerAdminService implements OnDestroy {
         return this.ngFormBuilder.group({
             _id: [tag?._id],
             label: [tag?.label, Validators.required],
+            maxDays: [tag?.maxDays || 0, Validators.min(0)],
+            minDays: [tag?.minDays || 0, Validators.min(0)],
         });
     }
 
     newSystemForm(system?: System): FormGroup {
         return this.ngFormBuilder.group({
             _id: [system?._id],
+            audioNormalization: [system?.audioNormalization || ''],
             autoPopulate: [system?.autoPopulate],
             blacklists: [system?.blacklists, this.validateBlacklists()],
             id: [system?.id, [Validators.required, Validators.min(1), this.validateId()]],
             label: [system?.label, Validators.required],
             led: [system?.led],
+            metadataFields: [system?.metadataFields || ''],
             order: [system?.order],
+            sites: this.ngFormBuilder.array(system?.sites?.map((site) => this.newSiteForm(site)) || []),
             talkgroups: this.ngFormBuilder.array(system?.talkgroups?.map((talkgroup) => this.newTalkgroupForm(talkgroup)) || []),
             units: this.ngFormBuilder.array(system?.units?.map((unit) => this.newUnitForm(unit)) || []),
         });
     }
 
+    newSiteForm(site?: Site): FormGroup {
+        return this.ngFormBuilder.group({
+            id: [site?.id, [Validators.required, Validators.min(1), this.validateId()]],
+            label: [site?.label, Validators.required],
+            order: [site?.order],
+        });
+    }
+
     newTalkgroupForm(talkgroup?: Talkgroup): FormGroup {
         return this.ngFormBuilder.group({
+            delay: [talkgroup?.delay || 0, [Validators.required, Validators.min(0)]],
             frequency: [talkgroup?.frequency, Validators.min(0)],
             groupId: [talkgroup?.groupId, [Validators.required, this.validateGroup()]],
-            id: [talkgroup?.id, [Validators.required, Validators.min(1), this.validateId()]],
+            hideEncrypted: [talkgroup?.hideEncrypted || false],
+            hidden: [talkgroup?.hidden || false],
+            id: [talkgroup?.id, [Validators.required, Validators.min(1), this.validateTalkgroupId()]],
             label: [talkgroup?.label, Validators.required],
             led: [talkgroup?.led],
+            muteAlerts: [talkgroup?.muteAlerts || false],
             name: [talkgroup?.name, Validators.required],
             order: [talkgroup?.order],
+            site: [talkgroup?.site || 0, [Validators.required, Validators.min(0)]],
             tagId: [talkgroup?.tagId, [Validators.required, this.validateTag()]],
         });
     }
@@ -496,20 +656,57 @@ export class RdioScannerAdminService implements OnDestroy {
 
     newOptionsForm(options?: Options): FormGroup {
         return this.ngFormBuilder.group({
+            adminEmail: [options?.adminEmail, Validators.email],
             afsSystems: [options?.afsSystems, this.validateAfsSystems()],
+            audioBitrate: [options?.audioBitrate, [Validators.required, Validators.min(6), Validators.max(320)]],
+            audioCodec: [options?.audioCodec],
             audioConversion: [options?.audioConversion],
+            audioCues: [options?.audioCues],
+            autoLearnUnits: [options?.autoLearnUnits],
+            autoMuteDuration: [options?.autoMuteDuration, Validators.min(1)],
+            autoMuteMinCalls: [options?.autoMuteMinCalls, Validators.min(1)],
+            autoMuteRate: [options?.autoMuteRate, Validators.min(0)],
             autoPopulate: [options?.autoPopulate],
+            backupAudio: [options?.backupAudio],
+            backupKeep: [options?.backupKeep, [Validators.required, Validators.min(0)]],
+            backupSchedule: [options?.backupSchedule],
             branding: [options?.branding],
+            clientBufferSize: [options?.clientBufferSize, [Validators.required, Validators.min(64)]],
+            clientCallQueue: [options?.clientCallQueue, [Validators.required, Validators.min(1)]],
+            coldStorageDays: [options?.coldStorageDays, [Validators.required, Validators.min(0)]],
+            digestEmail: [options?.digestEmail],
+            digestSchedule: [options?.digestSchedule],
+            digestTemplate: [options?.digestTemplate],
+            digestWebhook: [options?.digestWebhook],
             dimmerDelay: [options?.dimmerDelay, [Validators.required, Validators.min(0)]],
             disableDuplicateDetection: [options?.disableDuplicateDetection],
+            duplicateDetectionMode: [options?.duplicateDetectionMode],
             duplicateDetectionTimeFrame: [options?.duplicateDetectionTimeFrame, [Validators.required, Validators.min(0)]],
             email: [options?.email],
+            errorMessage: [options?.errorMessage],
+            ingestPipeline: [options?.ingestPipeline, Validators.required],
             keypadBeeps: [options?.keypadBeeps, Validators.required],
+            liveCaptions: [options?.liveCaptions],
+            maintenance: [options?.maintenance],
+            maintenanceMessage: [options?.maintenanceMessage],
             maxClients: [options?.maxClients, [Validators.required, Validators.min(1)]],
             playbackGoesLive: [options?.playbackGoesLive],
             pruneDays: [options?.pruneDays, [Validators.required, Validators.min(0)]],
+            registration: [options?.registration],
+            registrationEmail: [options?.registrationEmail],
+            registrationMax: [options?.registrationMax, [Validators.required, Validators.min(0)]],
+            retentionCompliance: [options?.retentionCompliance],
 			searchPatchedTalkgroups: [options?.searchPatchedTalkgroups],
+			shareLinks: [options?.shareLinks],
 			showListenersCount: [options?.showListenersCount],
+			showOccupancy: [options?.showOccupancy],
+            slowClientPolicy: [options?.slowClientPolicy],
+            smtpFrom: [options?.smtpFrom],
+            smtpHost: [options?.smtpHost],
+            smtpPassword: [options?.smtpPassword],
+            smtpPort: [options?.smtpPort, [Validators.required, Validators.min(1), Validators.max(65535)]],
+            smtpTls: [options?.smtpTls],
+            smtpUsername: [options?.smtpUsername],
             sortTalkgroups: [options?.sortTalkgroups],
             tagsToggle: [options?.tagsToggle],
             time12hFormat: [options?.time12hFormat],
@@ -576,6 +773,14 @@ export class RdioScannerAdminService implements OnDestroy {
 
             this.configWebSocketClose();
 
+        } else if (error.status === 403) {
+            this.matSnackBar.open('Your admin role does not allow this action', '', { duration: 5000 });
+
+        } else if (error.status === 429) {
+            const retryAfter = error.headers.get('Retry-After');
+
+            this.matSnackBar.open(`Too many login attempts, retry in ${retryAfter || 'a few'} seconds`, '', { duration: 5000 });
+
         } else {
             this.matSnackBar.open(error.message, '', { duration: 5000 });
         }
@@ -757,6 +962,38 @@ export class RdioScannerAdminService implements OnDestroy {
         };
     }
 
+    private validateTalkgroupId(): ValidatorFn {
+        return (control: AbstractControl): ValidationErrors | null => {
+            if (control.value === null || typeof control.value !== 'number') {
+                return null;
+            }
+
+            const site = control.parent?.get('site')?.value || 0;
+
+            const talkgroups: Talkgroup[] = control.parent?.parent?.getRawValue() || [];
+
+            const count = talkgroups.reduce((c, t) => c += t.id === control.value && (t.site || 0) === site ? 1 : 0, 0);
+
+            return count > 1 ? { duplicate: true } : null;
+        };
+    }
+
+    private validateSchedule(): ValidatorFn {
+        return (control: AbstractControl): ValidationErrors | null => {
+            if (typeof control.value !== 'string' || !control.value.trim().length) {
+                return null;
+            }
+
+            const day = '(sun|mon|tue|wed|thu|fri|sat)';
+
+            const time = '([01]?\\d|2[0-3]):[0-5]\\d|24:00';
+
+            const window = new RegExp(`^(${day}(-${day})?)?\\s*((${time})-(${time}))?$`, 'i');
+
+            return control.value.split(',').every((w: string) => window.test(w.trim())) ? null : { invalid: true };
+        };
+    }
+
     private validateUrl(): ValidatorFn {
         return (control: AbstractControl): ValidationErrors | null => {
             if (typeof control.value !== 'string' || !control.value.length) {
@@ -20,7 +20,7 @@
 import { ChangeDetectionStrategy, ChangeDetectorRef, Component, OnDestroy, OnInit, QueryList, ViewChildren, ViewEncapsulation } from '@angular/core';
 import { FormArray, FormControl, FormGroup } from '@angular/forms';
 import { MatExpansionPanel } from '@angular/material/expansion';
-import { AdminEvent, RdioScannerAdminService, Config } from '../admin.service';
+import { AdminEvent, RdioScannerAdminService, Config, Group, Tag } from '../admin.service';
 
 @Component({
     changeDetection: ChangeDetectionStrategy.OnPush,
@@ -117,6 +117,16 @@ export class RdioScannerAdminConfigComponent implements OnDestroy, OnInit {
         });
 
         this.groups.valueChanges.subscribe(() => {
+            const ids = this.groups.getRawValue().map((group: Group) => group._id);
+
+            this.downstreams.controls.forEach((downstream) => {
+                const control = downstream.get('groups') as FormControl;
+
+                if (control.value?.some((id: number) => !ids.includes(id))) {
+                    control.setValue(control.value.filter((id: number) => ids.includes(id)));
+                }
+            });
+
             this.systems.controls.forEach((system) => {
                 const talkgroups = system.get('talkgroups') as FormArray;
 
@@ -133,6 +143,16 @@ export class RdioScannerAdminConfigComponent implements OnDestroy, OnInit {
         });
 
         this.tags.valueChanges.subscribe(() => {
+            const ids = this.tags.getRawValue().map((tag: Tag) => tag._id);
+
+            this.downstreams.controls.forEach((downstream) => {
+                const control = downstream.get('tags') as FormControl;
+
+                if (control.value?.some((id: number) => !ids.includes(id))) {
+                    control.setValue(control.value.filter((id: number) => ids.includes(id)));
+                }
+            });
+
             this.systems.controls.forEach((system) => {
                 const talkgroups = system.get('talkgroups') as FormArray;
 
@@ -22,7 +22,7 @@ import { Component, Input, QueryList, ViewChildren } from '@angular/core';
 import { MatDialog } from '@angular/material/dialog';
 import { FormArray, FormGroup } from '@angular/forms';
 import { MatExpansionPanel } from '@angular/material/expansion';
-import { RdioScannerAdminService } from '../../admin.service';
+import { Group, RdioScannerAdminService, Tag } from '../../admin.service';
 import { RdioScannerAdminSystemsSelectComponent } from '../systems/select/select.component';
 
 @Component({
@@ -37,6 +37,14 @@ export class RdioScannerAdminDownstreamsComponent {
             .sort((a, b) => a.value.order - b.value.order) as FormGroup[];
     }
 
+    get groups(): Group[] {
+        return this.form?.root.get('groups')?.value as Group[];
+    }
+
+    get tags(): Tag[] {
+        return this.form?.root.get('tags')?.value as Tag[];
+    }
+
     @ViewChildren(MatExpansionPanel) private panels: QueryList<MatExpansionPanel> | undefined;
 
     constructor(private adminService: RdioScannerAdminService, private matDialog: MatDialog) { }
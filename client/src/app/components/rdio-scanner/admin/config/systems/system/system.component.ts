@@ -40,6 +40,13 @@ export class RdioScannerAdminSystemComponent {
 
     leds = this.adminService.getLeds();
 
+    get sites(): FormGroup[] {
+        const sites = this.form.get('sites') as FormArray;
+
+        return sites.controls
+            .sort((a, b) => (a.value.order || 0) - (b.value.order || 0)) as FormGroup[];
+    }
+
     get talkgroups(): FormGroup[] {
         const talkgroups = this.form.get('talkgroups') as FormArray;
 
@@ -58,6 +65,14 @@ export class RdioScannerAdminSystemComponent {
 
     constructor(private adminService: RdioScannerAdminService) { }
 
+    addSite(): void {
+        const sites = this.form.get('sites') as FormArray;
+
+        sites.insert(0, this.adminService.newSiteForm());
+
+        this.form.markAsDirty();
+    }
+
     addTalkgroup(): void {
         const talkgroups = this.form.get('talkgroups') as FormArray;
 
@@ -104,6 +119,14 @@ export class RdioScannerAdminSystemComponent {
         }
     }
 
+    removeSite(index: number): void {
+        const sites = this.form.get('sites') as FormArray;
+
+        sites.removeAt(index);
+
+        sites.markAsDirty();
+    }
+
     removeTalkgroup(index: number): void {
         const talkgroups = this.form.get('talkgroups') as FormArray;
 
@@ -17,7 +17,7 @@
  * ****************************************************************************
  */
 
-import { Component, EventEmitter, Output } from '@angular/core';
+import { Component, EventEmitter, OnInit, Output } from '@angular/core';
 import { FormBuilder, Validators } from '@angular/forms';
 import { RdioScannerAdminService } from '../admin.service';
 
@@ -26,20 +26,71 @@ import { RdioScannerAdminService } from '../admin.service';
     styleUrls: ['./login.component.scss'],
     templateUrl: './login.component.html',
 })
-export class RdioScannerAdminLoginComponent {
+export class RdioScannerAdminLoginComponent implements OnInit {
     @Output() loggedIn = new EventEmitter<void>();
 
     form = this.formBuilder.group({
         password: [null, Validators.required],
+        username: [null],
     });
 
     message = '';
 
+    resetForm = this.formBuilder.group({
+        code: [null, Validators.required],
+        newPassword: [null, Validators.required],
+    });
+
+    resetting = false;
+
+    resettable = false;
+
     constructor(
         private adminService: RdioScannerAdminService,
         private formBuilder: FormBuilder,
     ) { }
 
+    async ngOnInit(): Promise<void> {
+        this.resettable = await this.adminService.getPasswordReset();
+    }
+
+    async requestReset(): Promise<void> {
+        this.form.disable();
+
+        if (await this.adminService.requestPasswordReset()) {
+            this.resetting = true;
+            this.message = '';
+        }
+
+        this.form.enable();
+    }
+
+    async reset(): Promise<void> {
+        const code = this.resetForm.get('code')?.value;
+        const newPassword = this.resetForm.get('newPassword')?.value;
+
+        if (!code || !newPassword) {
+            return;
+        }
+
+        this.resetForm.disable();
+
+        const reset = await this.adminService.resetPassword(code, newPassword);
+
+        this.resetForm.enable();
+        this.resetForm.reset();
+
+        if (reset) {
+            this.resetting = false;
+            this.message = '';
+
+            await this.login(newPassword);
+
+        } else {
+            this.message = 'Invalid reset code';
+        }
+    }
+
     async login(password = this.form.get('password')?.value): Promise<void> {
         if (!password) {
             return;
@@ -47,7 +98,7 @@ export class RdioScannerAdminLoginComponent {
 
         this.form.disable();
 
-        const loggedIn = await this.adminService.login(password);
+        const loggedIn = await this.adminService.login(password, this.form.get('username')?.value || undefined);
 
         if (loggedIn) {
             this.loggedIn.emit();
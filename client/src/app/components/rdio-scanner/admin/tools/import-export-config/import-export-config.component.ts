@@ -37,27 +37,13 @@ export class RdioScannerAdminImportExportConfigComponent {
     ) { }
 
     async export(): Promise<void> {
-        const config = await this.adminService.getConfig();
-
-        const file = encodeURIComponent(JSON.stringify(config)).replace(/%([0-9A-F]{2})/g, (_, c) => {
-            return String.fromCharCode(parseInt(c, 16));
-        });
-        const fileName = 'rdio-scanner.json';
-        const fileType = 'application/json';
-        const fileUri = `data:${fileType};base64,${window.btoa(file)}`;
-
-        const el = this.document.createElement('a');
-
-        el.style.display = 'none';
-
-        el.setAttribute('href', fileUri);
-        el.setAttribute('download', fileName);
+        this.download(await this.adminService.getConfig(), 'rdio-scanner.json');
+    }
 
-        this.document.body.appendChild(el);
+    async exportBundle(): Promise<void> {
+        const bundle = await this.adminService.getConfigBundle();
 
-        el.click();
-
-        this.document.body.removeChild(el);
+        if (bundle) this.download(bundle, `rdio-scanner-config-${bundle.dateTime.slice(0, 10).replace(/-/g, '')}.json`);
     }
 
     async import(event: Event): Promise<void> {
@@ -77,7 +63,10 @@ export class RdioScannerAdminImportExportConfigComponent {
                     return '%' + ('00' + c.charCodeAt(0).toString(16)).slice(-2)
                 }).join(''));
 
-                this.config.emit(JSON.parse(res));
+                const data = JSON.parse(res);
+
+                // the sections of a bundle are reviewed like a configuration
+                this.config.emit(data?.format === 'rdio-scanner-config' ? data.config : data);
 
             } catch (error) {
                 this.matSnackBar.open(error as string, '', { duration: 5000 });
@@ -86,4 +75,25 @@ export class RdioScannerAdminImportExportConfigComponent {
 
         reader.readAsBinaryString(file);
     }
+
+    private download(data: unknown, fileName: string): void {
+        const file = encodeURIComponent(JSON.stringify(data)).replace(/%([0-9A-F]{2})/g, (_, c) => {
+            return String.fromCharCode(parseInt(c, 16));
+        });
+        const fileType = 'application/json';
+        const fileUri = `data:${fileType};base64,${window.btoa(file)}`;
+
+        const el = this.document.createElement('a');
+
+        el.style.display = 'none';
+
+        el.setAttribute('href', fileUri);
+        el.setAttribute('download', fileName);
+
+        this.document.body.appendChild(el);
+
+        el.click();
+
+        this.document.body.removeChild(el);
+    }
 }
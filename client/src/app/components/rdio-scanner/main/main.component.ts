@@ -18,9 +18,9 @@
  */
 
 import { ChangeDetectorRef, Component, EventEmitter, OnDestroy, OnInit, Output, ViewChild } from '@angular/core';
-import { FormBuilder } from '@angular/forms';
+import { FormBuilder, Validators } from '@angular/forms';
 import { MatInput } from '@angular/material/input';
-import { MatSnackBar } from '@angular/material/snack-bar';
+import { MatSnackBar, MatSnackBarRef, TextOnlySnackBar } from '@angular/material/snack-bar';
 import { Subscription, timer } from 'rxjs';
 import packageInfo from '../../../../../package.json';
 import {
@@ -29,6 +29,7 @@ import {
     RdioScannerCall,
     RdioScannerConfig,
     RdioScannerEvent,
+    RdioScannerIncident,
     RdioScannerLivefeedMap,
     RdioScannerLivefeedMode,
 } from '../rdio-scanner';
@@ -47,18 +48,29 @@ export class RdioScannerMainComponent implements OnDestroy, OnInit {
     auth = false;
     authForm = this.ngFormBuilder.group({ password: [] });
 
+    registering = false;
+    registration = false;
+    registrationForm = this.ngFormBuilder.group({
+        email: ['', [Validators.required, Validators.email, Validators.maxLength(255)]],
+        message: ['', [Validators.maxLength(1000)]],
+        name: ['', [Validators.maxLength(255)]],
+    });
+
     avoided = false;
 
     branding = '';
 
     call: RdioScannerCall | undefined;
+    callCaption = '';
     callDate: Date | undefined;
     callError = '0';
     callFrequency: string = this.formatFrequency(0);
     callHistory: RdioScannerCall[] = new Array<RdioScannerCall>(5);
+    callMetadata = '';
     callPrevious: RdioScannerCall | undefined;
     callProgress = new Date(0, 0, 0, 0, 0, 0);
     callQueue = 0;
+    callSite = '';
     callSpike = '0';
     callSystem = 'System';
     callTag = 'Tag';
@@ -91,6 +103,10 @@ export class RdioScannerMainComponent implements OnDestroy, OnInit {
     holdSys = false;
     holdTg = false;
 
+    incidents: RdioScannerIncident[] = [];
+
+    latency = 0;
+
     ledStyle = '';
 
     linked = false;
@@ -105,6 +121,8 @@ export class RdioScannerMainComponent implements OnDestroy, OnInit {
 
     patched = false;
 
+    pinned = false;
+
     playbackMode = false;
 
     replayOffset = 0;
@@ -114,6 +132,10 @@ export class RdioScannerMainComponent implements OnDestroy, OnInit {
 
     timeFormat = 'HH:mm';
 
+    get showLatency(): boolean {
+        return this.latency >= 500;
+    }
+
     get showListenersCount(): boolean {
         return this.config?.showListenersCount || false;
     }
@@ -128,6 +150,8 @@ export class RdioScannerMainComponent implements OnDestroy, OnInit {
 
     private clockTimer: Subscription | undefined;
 
+    private closedSnackBar: MatSnackBarRef<TextOnlySnackBar> | undefined;
+
     private config: RdioScannerConfig | undefined;
 
     private dimmerTimer: Subscription | undefined;
@@ -148,7 +172,7 @@ export class RdioScannerMainComponent implements OnDestroy, OnInit {
     }
 
     authFocus(): void {
-        if (this.auth && this.authPassword instanceof MatInput) {
+        if (this.auth && !this.registering && this.authPassword instanceof MatInput) {
             this.authPassword.focus();
         }
     }
@@ -229,6 +253,15 @@ export class RdioScannerMainComponent implements OnDestroy, OnInit {
         }
     }
 
+    incidentPlay(incident: RdioScannerIncident): void {
+        if (this.auth) {
+            this.authFocus();
+
+        } else if (incident.calls.length) {
+            this.rdioScannerService.loadAndPlay(incident.calls[incident.calls.length - 1]);
+        }
+    }
+
     livefeed(): void {
         if (this.auth) {
             this.authFocus();
@@ -272,6 +305,39 @@ export class RdioScannerMainComponent implements OnDestroy, OnInit {
         }
     }
 
+    async register(): Promise<void> {
+        if (this.registrationForm.invalid) {
+            return;
+        }
+
+        this.registrationForm.disable();
+
+        const status = await this.rdioScannerService.requestRegistration(this.registrationForm.getRawValue());
+
+        this.registrationForm.enable();
+
+        switch (status) {
+            case 202:
+                this.matSnackBar.open('Your request is sent, you will receive your unlock code by email once approved.', '', { duration: 10000 });
+                this.registrationForm.reset();
+                this.toggleRegistration(false);
+                break;
+
+            case 429:
+                this.matSnackBar.open('Too many requests, try again later.', '', { duration: 5000 });
+                break;
+
+            case 503:
+                this.matSnackBar.open('Too many pending requests, try again later.', '', { duration: 5000 });
+                break;
+
+            default:
+                this.matSnackBar.open('Your request could not be sent.', '', { duration: 5000 });
+        }
+
+        this.ngChangeDetectorRef.detectChanges();
+    }
+
     replay(): void {
         if (this.auth) {
             this.authFocus();
@@ -364,6 +430,14 @@ export class RdioScannerMainComponent implements OnDestroy, OnInit {
         this.rdioScannerService.stop();
     }
 
+    toggleRegistration(registering = !this.registering): void {
+        this.registering = registering;
+
+        if (!registering) {
+            this.authFocus();
+        }
+    }
+
     private eventHandler(event: RdioScannerEvent): void {
         if ('auth' in event && event.auth) {
             const password = this.rdioScannerService.readPin();
@@ -380,6 +454,12 @@ export class RdioScannerMainComponent implements OnDestroy, OnInit {
 
                 this.authForm.reset();
 
+                this.rdioScannerService.getRegistration().then((registration) => {
+                    this.registration = registration;
+
+                    this.ngChangeDetectorRef.detectChanges();
+                });
+
                 if (this.authForm.disabled) {
                     this.authForm.enable();
                 }
@@ -438,8 +518,26 @@ export class RdioScannerMainComponent implements OnDestroy, OnInit {
             this.holdTg = event.holdTg || false;
         }
 
+        if ('incidents' in event) {
+            this.incidents = event.incidents || [];
+        }
+
+        if ('latency' in event) {
+            this.latency = event.latency || 0;
+        }
+
         if ('linked' in event) {
             this.linked = event.linked || false;
+
+            if (this.linked) {
+                this.closedSnackBar?.dismiss();
+                this.closedSnackBar = undefined;
+            }
+        }
+
+        // tells why the server closed the link, until it is back
+        if (event.closed) {
+            this.closedSnackBar = this.matSnackBar.open(event.closed, '', { panelClass: 'snackbar-white' });
         }
 
         if ('listeners' in event) {
@@ -458,6 +556,26 @@ export class RdioScannerMainComponent implements OnDestroy, OnInit {
             this.callQueue = event.queue || 0;
         }
 
+        if ('retrieving' in event && typeof event.retrieving === 'number') {
+            this.matSnackBar.open('The audio of this call is being retrieved from the cold storage, try again soon.', '', { duration: 5000 });
+        }
+
+        if ('share' in event && event.share) {
+            const url = event.share.url;
+
+            if (!url) {
+                this.matSnackBar.open('This call cannot be shared.', '', { duration: 5000 });
+
+            } else if (navigator.clipboard) {
+                navigator.clipboard.writeText(url)
+                    .then(() => this.matSnackBar.open('The share link is copied to the clipboard.', '', { duration: 5000 }))
+                    .catch(() => this.matSnackBar.open(url, 'Close'));
+
+            } else {
+                this.matSnackBar.open(url, 'Close');
+            }
+        }
+
         if ('time' in event && typeof event.time === 'number') {
             this.callTime = event.time;
 
@@ -542,6 +660,14 @@ export class RdioScannerMainComponent implements OnDestroy, OnInit {
 
             this.callSystem = this.call.systemData?.label || `${this.call.system}`;
 
+            this.callSite = this.call.site
+                ? this.call.systemData?.sites?.find((site) => site.id === this.call?.site)?.label || `${this.call.site}`
+                : '';
+
+            this.callCaption = this.call.captions?.find((caption) => caption.start <= time && time < caption.end)?.text || '';
+
+            this.callMetadata = Object.entries(this.call.metadata || {}).map(([key, value]) => `${key}: ${value}`).join(' ');
+
             this.callTag = this.call.talkgroupData?.tag || '';
 
             this.callTalkgroup = this.call.talkgroupData?.label || `${isAfs ? this.formatAfs(this.call.talkgroup) : this.call.talkgroup}`;
@@ -594,6 +720,9 @@ export class RdioScannerMainComponent implements OnDestroy, OnInit {
 
                 this.callHistory.unshift(this.callPrevious);
             }
+
+        } else {
+            this.callCaption = '';
         }
 
         const call = this.call || this.callPrevious;
@@ -609,6 +738,8 @@ export class RdioScannerMainComponent implements OnDestroy, OnInit {
                 this.avoided = this.rdioScannerService.isAvoided(call);
                 this.patched = false;
             }
+
+            this.pinned = this.incidents.some((incident) => incident.system === call.system && incident.talkgroups.includes(call.talkgroup));
         }
 
         const colors = ['blue', 'cyan', 'green', 'magenta', 'orange', 'red', 'white', 'yellow'];
@@ -20,6 +20,7 @@
 import { DOCUMENT } from '@angular/common';
 import { EventEmitter, Inject, Injectable, OnDestroy } from '@angular/core';
 import { Router } from '@angular/router';
+import { SwPush } from '@angular/service-worker';
 import { interval, Subscription, timer } from 'rxjs';
 import { takeWhile } from 'rxjs/operators';
 import { AppUpdateService } from '../../shared/update/update.service';
@@ -27,16 +28,27 @@ import {
     RdioScannerAvoidOptions,
     RdioScannerBeepStyle,
     RdioScannerCall,
+    RdioScannerCapabilities,
+    RdioScannerCaption,
     RdioScannerCategory,
     RdioScannerCategoryStatus,
     RdioScannerCategoryType,
     RdioScannerConfig,
+    RdioScannerCues,
     RdioScannerEvent,
+    RdioScannerIncident,
     RdioScannerLivefeed,
     RdioScannerLivefeedMap,
     RdioScannerLivefeedMode,
+    RdioScannerOccupancy,
+    RdioScannerOccupancyState,
     RdioScannerPlaybackList,
+    RdioScannerRegistration,
     RdioScannerSearchOptions,
+    RdioScannerSites,
+    RdioScannerSubscription,
+    RdioScannerSystem,
+    RdioScannerTalkgroup,
 } from './rdio-scanner';
 
 declare global {
@@ -47,26 +59,46 @@ declare global {
 
 enum WebsocketCallFlag {
     Download = 'd',
+    Metadata = 'm',
     Play = 'p',
 }
 
 enum WebsocketCommand {
     Call = 'CAL',
+    Captions = 'CAP',
     Config = 'CFG',
+    ConfigDelta = 'CFD',
+    Cue = 'CUE',
     Expired = 'XPR',
+    Incidents = 'INC',
+    Kick = 'KCK',
+    Kiosk = 'KSK',
+    Latency = 'LAT',
     ListCall = 'LCL',
     ListenersCount = 'LSC',
     LivefeedMap = 'LFM',
     Max = 'MAX',
+    NowPlaying = 'NPL',
+    Occupancy = 'OCC',
     Pin = 'PIN',
+    Share = 'SHR',
+    Sites = 'SIT',
+    Subscriptions = 'SUB',
+    Sync = 'SYN',
+    Transcript = 'TRN',
     Version = 'VER',
 }
 
 @Injectable()
 export class RdioScannerService implements OnDestroy {
+    static LOCAL_STORAGE_KEY_CUES = 'rdio-scanner-cues';
+    static LOCAL_STORAGE_KEY_KIOSK = 'rdio-scanner-kiosk';
     static LOCAL_STORAGE_KEY_LEGACY = 'rdio-scanner';
     static LOCAL_STORAGE_KEY_LFM = 'rdio-scanner-lfm';
+    static LOCAL_STORAGE_KEY_METADATA = 'rdio-scanner-metadata';
     static LOCAL_STORAGE_KEY_PIN = 'rdio-scanner-pin';
+    static LOCAL_STORAGE_KEY_SITES = 'rdio-scanner-sites';
+    static WEBSOCKET_PROTOCOL_V2 = 'rdio-scanner.v2';
 
     event = new EventEmitter<RdioScannerEvent>();
 
@@ -83,26 +115,43 @@ export class RdioScannerService implements OnDestroy {
 
     private categories: RdioScannerCategory[] = [];
 
+    private cueBuffers = new Map<string, AudioBuffer[]>();
+    private cuePending = new Map<string, ((buffers: AudioBuffer[]) => void)[]>();
+    private cueSource: AudioBufferSourceNode | undefined;
+    private cues: RdioScannerCues = { speech: false, tones: '' };
+
     private config: RdioScannerConfig = {
         dimmerDelay: false,
         groups: {},
         keypadBeeps: false,
+        liveCaptions: false,
         playbackGoesLive: false,
         showListenersCount: false,
+        showOccupancy: false,
         systems: [],
         tags: {},
         tagsToggle: false,
         time12hFormat: false,
     };
 
+    private incidents: RdioScannerIncident[] = [];
+
     private instanceId = 'default';
 
+    private kioskToken: string | undefined;
+
     private livefeedMap = {} as RdioScannerLivefeedMap;
     private livefeedMapPriorToHoldSystem: RdioScannerLivefeedMap | undefined;
     private livefeedMapPriorToHoldTalkgroup: RdioScannerLivefeedMap | undefined;
     private livefeedMode = RdioScannerLivefeedMode.Offline;
     private livefeedPaused = false;
 
+    private metadataOnly = false;
+
+    private sites: RdioScannerSites = {};
+
+    private occupancy: RdioScannerOccupancy = {};
+
     private playbackList: RdioScannerPlaybackList | undefined;
     private playbackPending: number | undefined;
     private playbackRefreshing = false;
@@ -111,8 +160,13 @@ export class RdioScannerService implements OnDestroy {
 
     private websocket: WebSocket | undefined;
 
+    private websocketConfig: { [key: string]: unknown } | undefined;
+
+    private websocketSeq = 0;
+
     constructor(
         appUpdateService: AppUpdateService,
+        private ngSwPush: SwPush,
         private router: Router,
         @Inject(DOCUMENT) private document: Document,
     ) {
@@ -120,8 +174,16 @@ export class RdioScannerService implements OnDestroy {
 
         this.initializeInstanceId();
 
+        this.initializeKiosk();
+
+        this.initializeMetadata();
+
+        this.readCues();
+
         this.readLivefeedMap();
 
+        this.readSites();
+
         this.openWebsocket();
     }
 
@@ -269,6 +331,42 @@ export class RdioScannerService implements OnDestroy {
         this.stop();
     }
 
+    async getPushSubscription(vapidPublicKey: string): Promise<string | undefined> {
+        if (!this.ngSwPush.isEnabled || !vapidPublicKey) {
+            return undefined;
+        }
+
+        try {
+            const subscription = await this.ngSwPush.requestSubscription({ serverPublicKey: vapidPublicKey });
+
+            return JSON.stringify(subscription.toJSON());
+
+        } catch (error) {
+            console.error(error);
+
+            return undefined;
+        }
+    }
+
+    async getCapabilities(): Promise<RdioScannerCapabilities | undefined> {
+        try {
+            const res = await fetch(new URL('api/capabilities', document.baseURI).href);
+
+            return res.ok ? await res.json() : undefined;
+
+        } catch (error) {
+            return undefined;
+        }
+    }
+
+    async getRegistration(): Promise<boolean> {
+        return (await this.getCapabilities())?.registration === true;
+    }
+
+    getSubscriptions(): void {
+        this.sendtoWebsocket(WebsocketCommand.Subscriptions);
+    }
+
     holdSystem(options?: { resubscribe?: boolean }): void {
         const call = this.call || this.callPrevious;
 
@@ -471,6 +569,12 @@ export class RdioScannerService implements OnDestroy {
 
             this.call = call;
 
+        } else if (call?.id && !call.audio) {
+            // a call of the metadata only mode, its audio is fetched first
+            this.loadAndPlay(call.id);
+
+            return;
+
         } else if (this.call) {
             return;
 
@@ -493,8 +597,12 @@ export class RdioScannerService implements OnDestroy {
             arrayBufferView[i] = this.call.audio.data[i];
         }
 
-        this.audioContext?.decodeAudioData(arrayBuffer, (buffer) => {
-            if (!this.audioContext || this.audioSource || !this.call) {
+        const call = this.call;
+
+        this.audioContext?.decodeAudioData(arrayBuffer, async (buffer) => {
+            await this.playCue(call);
+
+            if (!this.audioContext || this.audioSource || this.call !== call) {
                 return;
             }
 
@@ -506,6 +614,10 @@ export class RdioScannerService implements OnDestroy {
 
             this.event.emit({ call: this.call, queue });
 
+            if (this.kioskToken) {
+                this.sendtoWebsocket(WebsocketCommand.NowPlaying, this.call.id);
+            }
+
             interval(500).pipe(takeWhile(() => !!this.call)).subscribe(() => {
                 if (this.audioContext && !isNaN(this.audioContext.currentTime)) {
                     if (isNaN(this.audioSourceStartTime)) {
@@ -556,6 +668,21 @@ export class RdioScannerService implements OnDestroy {
         return pin ? window.atob(pin) : undefined;
     }
 
+    async requestRegistration(registration: RdioScannerRegistration): Promise<number> {
+        try {
+            const res = await fetch(new URL('api/registration', document.baseURI).href, {
+                body: JSON.stringify(registration),
+                headers: { 'Content-Type': 'application/json' },
+                method: 'POST',
+            });
+
+            return res.status;
+
+        } catch (error) {
+            return 0;
+        }
+    }
+
     savePin(pin: string): void {
         window?.localStorage?.setItem(RdioScannerService.LOCAL_STORAGE_KEY_PIN, window.btoa(pin));
     }
@@ -564,6 +691,18 @@ export class RdioScannerService implements OnDestroy {
         this.sendtoWebsocket(WebsocketCommand.ListCall, options);
     }
 
+    share(id: number): void {
+        if (!id) {
+            return;
+        }
+
+        this.sendtoWebsocket(WebsocketCommand.Share, id);
+    }
+
+    setSubscriptions(subscriptions: RdioScannerSubscription[]): void {
+        this.sendtoWebsocket(WebsocketCommand.Subscriptions, subscriptions);
+    }
+
     skip(options?: { delay?: boolean }): void {
         const play = () => {
             if (this.livefeedMode === RdioScannerLivefeedMode.Playback) {
@@ -607,10 +746,42 @@ export class RdioScannerService implements OnDestroy {
 
         this.event.emit({ livefeedMode: this.livefeedMode });
 
-        this.sendtoWebsocket(WebsocketCommand.LivefeedMap, lfm);
+        this.sendtoWebsocket(WebsocketCommand.LivefeedMap, lfm, this.metadataOnly ? WebsocketCallFlag.Metadata : undefined);
+
+        this.sendtoWebsocket(WebsocketCommand.Sites, this.sites);
+    }
+
+    setCues(cues: RdioScannerCues): void {
+        this.cues = { speech: cues.speech === true, tones: cues.tones };
+
+        window?.localStorage?.setItem(RdioScannerService.LOCAL_STORAGE_KEY_CUES, JSON.stringify(this.cues));
+
+        this.event.emit({ cues: { ...this.cues } });
+    }
+
+    setSite(system: number, site?: number): void {
+        if (typeof site === 'number' && site > 0) {
+            this.sites[system] = site;
+
+        } else {
+            delete this.sites[system];
+        }
+
+        window?.localStorage?.setItem(`${RdioScannerService.LOCAL_STORAGE_KEY_SITES}-${this.instanceId}`, JSON.stringify(this.sites));
+
+        this.event.emit({ sites: { ...this.sites } });
+
+        this.sendtoWebsocket(WebsocketCommand.Sites, this.sites);
     }
 
     stop(options?: { emit?: boolean }): void {
+        // the cue ends by itself, letting its call see it was stopped
+        if (this.cueSource) {
+            this.cueSource.stop();
+            this.cueSource.disconnect();
+            this.cueSource = undefined;
+        }
+
         if (this.audioSource) {
             this.audioSource.onended = null;
             this.audioSource.stop();
@@ -627,6 +798,10 @@ export class RdioScannerService implements OnDestroy {
 
         if (typeof options?.emit !== 'boolean' || options.emit) {
             this.event.emit({ call: this.call });
+
+            if (this.kioskToken) {
+                this.sendtoWebsocket(WebsocketCommand.NowPlaying);
+            }
         }
     }
 
@@ -845,15 +1020,49 @@ export class RdioScannerService implements OnDestroy {
         this.instanceId = this.router.parseUrl(this.router.url).queryParams['id'] || this.instanceId;
     }
 
+    private initializeKiosk(): void {
+        const token = this.router.parseUrl(this.router.url).queryParams['kiosk'];
+
+        if (typeof token === 'string' && token.length) {
+            window?.localStorage?.setItem(RdioScannerService.LOCAL_STORAGE_KEY_KIOSK, token);
+        }
+
+        this.kioskToken = window?.localStorage?.getItem(RdioScannerService.LOCAL_STORAGE_KEY_KIOSK) || undefined;
+    }
+
+    private initializeMetadata(): void {
+        const metadata = this.router.parseUrl(this.router.url).queryParams['metadata'];
+
+        if (metadata === 'on') {
+            window?.localStorage?.setItem(RdioScannerService.LOCAL_STORAGE_KEY_METADATA, metadata);
+
+        } else if (metadata === 'off') {
+            window?.localStorage?.removeItem(RdioScannerService.LOCAL_STORAGE_KEY_METADATA);
+        }
+
+        this.metadataOnly = window?.localStorage?.getItem(RdioScannerService.LOCAL_STORAGE_KEY_METADATA) === 'on';
+    }
+
     private openWebsocket(): void {
         const websocketUrl = window.location.href.replace(/^http/, 'ws');
 
-        this.websocket = new WebSocket(websocketUrl);
+        // servers that don't know the second protocol answer with the first one
+        this.websocket = new WebSocket(websocketUrl, [RdioScannerService.WEBSOCKET_PROTOCOL_V2]);
+
+        this.websocket.binaryType = 'arraybuffer';
+
+        this.websocketConfig = undefined;
+
+        this.websocketSeq = 0;
 
         this.websocket.onclose = (ev: CloseEvent) => {
-            this.event.emit({ linked: false });
+            this.event.emit(ev.reason ? { closed: ev.reason, linked: false } : { linked: false });
+
+            // the server asks to try again later during a maintenance
+            if (ev.code === 1013) {
+                timer(30000).subscribe(() => this.reconnectWebsocket());
 
-            if (ev.code !== 1000) {
+            } else if (ev.code !== 1000) {
                 timer(2000).subscribe(() => this.reconnectWebsocket());
             }
         };
@@ -862,7 +1071,9 @@ export class RdioScannerService implements OnDestroy {
             this.event.emit({ linked: true });
 
             if (this.websocket instanceof WebSocket) {
-                this.websocket.onmessage = (ev: MessageEvent) => this.parseWebsocketMessage(ev.data);
+                this.websocket.onmessage = (ev: MessageEvent) => ev.data instanceof ArrayBuffer
+                    ? this.parseWebsocketFrame(ev.data)
+                    : this.parseWebsocketMessage(ev.data);
             }
 
             this.sendtoWebsocket(WebsocketCommand.Version);
@@ -870,22 +1081,99 @@ export class RdioScannerService implements OnDestroy {
         };
     }
 
-    private parseWebsocketMessage(message: string): void {
+    private mergeConfigDelta(delta: {
+        set?: { [key: string]: unknown },
+        systems?: { order?: number[], remove?: number[], set?: RdioScannerSystem[] },
+        unset?: string[],
+    }): { [key: string]: unknown } {
+        const config = { ...this.websocketConfig, ...delta.set };
+
+        delta.unset?.forEach((key) => delete config[key]);
+
+        if (delta.systems) {
+            const systems = new Map<number, RdioScannerSystem>();
+
+            (Array.isArray(config['systems']) ? config['systems'] as RdioScannerSystem[] : [])
+                .forEach((system) => systems.set(system.id, system));
+
+            delta.systems.remove?.forEach((id) => systems.delete(id));
+
+            delta.systems.set?.forEach((system) => systems.set(system.id, system));
+
+            config['systems'] = (delta.systems.order || [])
+                .map((id) => systems.get(id))
+                .filter((system) => !!system);
+        }
+
+        return config;
+    }
+
+    // the calls of the second protocol come as the length of their json
+    // header on 4 bytes, the header, then the raw audio
+    private parseWebsocketFrame(frame: ArrayBuffer): void {
         try {
-            message = JSON.parse(message);
+            const length = new DataView(frame).getUint32(0);
+
+            const message = JSON.parse(new TextDecoder().decode(new Uint8Array(frame, 4, length)));
+
+            if (Array.isArray(message) && message[1] !== null && typeof message[1] === 'object') {
+                message[1].audio = { data: Array.from(new Uint8Array(frame, 4 + length)), type: 'Buffer' };
+            }
+
+            this.parseWebsocketMessage(message);
 
         } catch (error) {
-            console.warn(`Invalid control message received, ${error}`);
+            console.warn(`Invalid binary message received, ${error}`);
+        }
+    }
+
+    private parseWebsocketMessage(message: string): void {
+        if (typeof message === 'string') {
+            try {
+                message = JSON.parse(message);
+
+            } catch (error) {
+                console.warn(`Invalid control message received, ${error}`);
+            }
         }
 
         if (Array.isArray(message)) {
+            const seq = message[3];
+
+            if (typeof seq === 'number') {
+                if (this.websocketSeq > 0 && seq !== this.websocketSeq + 1) {
+                    console.warn(`Out of sequence message, expected ${this.websocketSeq + 1} got ${seq}, resyncing`);
+
+                    this.sendtoWebsocket(WebsocketCommand.Sync, this.websocketSeq);
+                }
+
+                this.websocketSeq = seq;
+            }
+
             switch (message[0]) {
                 case WebsocketCommand.Call:
                     if (message[1] !== null) {
                         const call: RdioScannerCall = message[1];
                         const flag: string = message[2];
 
-                        if (flag === WebsocketCallFlag.Download) {
+                        if (call.cold) {
+                            if (call.id === this.playbackPending) {
+                                this.playbackPending = undefined;
+                            }
+
+                            this.event.emit({ playbackPending: this.playbackPending, retrieving: call.id });
+
+                        } else if (flag === WebsocketCallFlag.Metadata) {
+                            // shown until the next one, unless a call is playing
+                            if (!this.audioSource) {
+                                this.stop({ emit: false });
+
+                                this.call = this.transformCall(call);
+
+                                this.event.emit({ call: this.call });
+                            }
+
+                        } else if (flag === WebsocketCallFlag.Download) {
                             this.download(message[1]);
 
                         } else if (flag === WebsocketCallFlag.Play && call.id === this.playbackPending) {
@@ -903,14 +1191,18 @@ export class RdioScannerService implements OnDestroy {
                 case WebsocketCommand.Config: {
                     const config = message[1];
 
+                    this.websocketConfig = config;
+
                     this.config = {
                         branding: typeof config.branding === 'string' ? config.branding : '',
                         dimmerDelay: typeof config.dimmerDelay === 'number' ? config.dimmerDelay : 5000,
                         email: typeof config.email === 'string' ? config.email : '',
                         groups: typeof config.groups !== null && typeof config.groups === 'object' ? config.groups : {},
                         keypadBeeps: config.keypadBeeps !== null && typeof config.keypadBeeps === 'object' ? config.keypadBeeps : {},
+                        liveCaptions: typeof config.liveCaptions === 'boolean' ? config.liveCaptions : false,
                         playbackGoesLive: typeof config.playbackGoesLive === 'boolean' ? config.playbackGoesLive : false,
                         showListenersCount: typeof config.showListenersCount === 'boolean' ? config.showListenersCount : false,
+                        showOccupancy: typeof config.showOccupancy === 'boolean' ? config.showOccupancy : false,
                         systems: Array.isArray(config.systems) ? config.systems.slice() : [],
                         tags: typeof config.tags !== null && typeof config.tags === 'object' ? config.tags : {},
                         tagsToggle: typeof config.tagsToggle === 'boolean' ? config.tagsToggle : false,
@@ -921,8 +1213,27 @@ export class RdioScannerService implements OnDestroy {
                         this.config['afs'] = config.afs;
                     }
 
+                    if (config.audioCues !== null && typeof config.audioCues === 'object') {
+                        this.config['audioCues'] = { speech: config.audioCues.speech === true };
+                    }
+
+                    // the spoken talkgroups may have been renamed
+                    this.cueBuffers.clear();
+
+                    if (config.share === true) {
+                        this.config['share'] = true;
+                    }
+
+                    if (typeof config.subscriptions === 'number' && config.subscriptions > 0) {
+                        this.config['subscriptions'] = config.subscriptions;
+                    }
+
                     this.rebuildLivefeedMap();
 
+                    if (!this.config.showOccupancy) {
+                        this.occupancy = {};
+                    }
+
                     if (this.livefeedMode === RdioScannerLivefeedMode.Online) {
                         this.startLivefeed();
                     }
@@ -934,16 +1245,72 @@ export class RdioScannerService implements OnDestroy {
                         holdSys: !!this.livefeedMapPriorToHoldSystem,
                         holdTg: !!this.livefeedMapPriorToHoldTalkgroup,
                         map: this.livefeedMap,
+                        cues: { ...this.cues },
+                        occupancy: this.occupancy,
+                        sites: { ...this.sites },
                     });
 
+                    if (this.kioskToken) {
+                        this.sendtoWebsocket(WebsocketCommand.Kiosk, this.kioskToken);
+                    }
+
                     break;
                 }
 
+                case WebsocketCommand.ConfigDelta:
+                    if (this.websocketConfig && message[1] !== null && typeof message[1] === 'object') {
+                        this.parseWebsocketMessage(JSON.stringify([WebsocketCommand.Config, this.mergeConfigDelta(message[1])]));
+
+                    } else {
+                        this.sendtoWebsocket(WebsocketCommand.Config);
+                    }
+
+                    break;
+
+                case WebsocketCommand.Cue:
+                    if (message[1] !== null && typeof message[1] === 'object' && typeof message[1].key === 'string') {
+                        this.parseCue(message[1]);
+                    }
+
+                    break;
+
                 case WebsocketCommand.Expired:
                     this.event.emit({ auth: true, expired: true });
 
                     break;
 
+                case WebsocketCommand.Incidents:
+                    if (Array.isArray(message[1])) {
+                        this.incidents = message[1];
+
+                        this.event.emit({ incidents: this.incidents.map((incident) => this.transformIncident(incident)) });
+                    }
+
+                    break;
+
+                case WebsocketCommand.Kick:
+                    // the server closes the connection right after, the access
+                    // code must be entered again once the page is reloaded
+                    this.clearPin();
+
+                    break;
+
+                case WebsocketCommand.Kiosk:
+                    if (message[1]?.paired === false && this.kioskToken) {
+                        window?.localStorage?.removeItem(RdioScannerService.LOCAL_STORAGE_KEY_KIOSK);
+
+                        this.kioskToken = undefined;
+                    }
+
+                    break;
+
+                case WebsocketCommand.Latency:
+                    if (typeof message[1] === 'number') {
+                        this.event.emit({ latency: message[1] });
+                    }
+
+                    break;
+
                 case WebsocketCommand.ListCall:
                     this.playbackList = message[1];
 
@@ -969,11 +1336,89 @@ export class RdioScannerService implements OnDestroy {
 
                     break;
 
+                case WebsocketCommand.Occupancy:
+                    if (Array.isArray(message[1])) {
+                        // the whole state comes with the config, the changes after
+                        const occupancy: RdioScannerOccupancy = message[2] === 'all' ? {} : { ...this.occupancy };
+
+                        message[1].forEach((state: RdioScannerOccupancyState) => {
+                            occupancy[state.system] = { ...occupancy[state.system] };
+
+                            if (state.busy || state.calls > 0) {
+                                occupancy[state.system][state.talkgroup] = state;
+
+                            } else {
+                                delete occupancy[state.system][state.talkgroup];
+                            }
+                        });
+
+                        this.occupancy = occupancy;
+
+                        this.event.emit({ occupancy: this.occupancy });
+                    }
+
+                    break;
+
                 case WebsocketCommand.Pin:
                     this.event.emit({ auth: true });
 
                     break;
 
+                case WebsocketCommand.Share:
+                    if (message[1] !== null && typeof message[1] === 'object' && typeof message[1].id === 'number') {
+                        const code = message[1].code;
+                        const uuid = message[1].uuid;
+
+                        this.event.emit({
+                            share: {
+                                id: message[1].id,
+                                url: typeof uuid === 'string'
+                                    ? new URL(`call/${uuid}`, document.baseURI).href
+                                    : typeof code === 'string' ? new URL(`c/${code}`, document.baseURI).href : undefined,
+                            },
+                        });
+                    }
+
+                    break;
+
+                case WebsocketCommand.Subscriptions:
+                    if (message[1] !== null && typeof message[1] === 'object') {
+                        this.event.emit({ subscriptions: message[1] });
+                    }
+
+                    break;
+
+                case WebsocketCommand.Captions: {
+                    const data = message[1];
+
+                    if (this.config.liveCaptions && data !== null && typeof data === 'object' && Array.isArray(data.segments)) {
+                        const captions: RdioScannerCaption[] = data.segments.filter((segment: RdioScannerCaption) =>
+                            typeof segment?.start === 'number' && typeof segment?.end === 'number' && typeof segment?.text === 'string');
+
+                        [this.call, this.callPrevious, ...this.callQueue]
+                            .filter((call) => call?.id === data.id)
+                            .forEach((call) => (call as RdioScannerCall).captions = captions);
+
+                        this.event.emit({ captions: { id: data.id, captions } });
+                    }
+
+                    break;
+                }
+
+                case WebsocketCommand.Transcript: {
+                    const data = message[1];
+
+                    if (data !== null && typeof data === 'object' && typeof data.transcript === 'string') {
+                        [this.call, this.callPrevious, ...this.callQueue]
+                            .filter((call) => call?.id === data.id)
+                            .forEach((call) => (call as RdioScannerCall).transcript = data.transcript);
+
+                        this.event.emit({ transcript: { id: data.id, transcript: data.transcript } });
+                    }
+
+                    break;
+                }
+
                 case WebsocketCommand.Version: {
                     const data = message[1];
 
@@ -1000,6 +1445,103 @@ export class RdioScannerService implements OnDestroy {
         }
     }
 
+    private async parseCue(cue: { key: string; speech?: string; tone?: string }): Promise<void> {
+        const buffers: AudioBuffer[] = [];
+
+        for (const audio of [cue.tone, cue.speech]) {
+            if (typeof audio !== 'string' || !this.audioContext) {
+                continue;
+            }
+
+            try {
+                const data = Uint8Array.from(window.atob(audio), (c) => c.charCodeAt(0));
+
+                buffers.push(await this.audioContext.decodeAudioData(data.buffer));
+
+            } catch (error) {
+                console.warn(`Invalid audio cue received, ${error}`);
+            }
+        }
+
+        this.cueBuffers.set(cue.key, buffers);
+
+        this.cuePending.get(cue.key)?.forEach((resolve) => resolve(buffers));
+        this.cuePending.delete(cue.key);
+    }
+
+    // playCue plays the tone and the spoken talkgroup of the call, asking the
+    // server for them the first time, resolving once they played or when the
+    // server did not answer in time
+    private playCue(call: RdioScannerCall): Promise<void> {
+        const cueTimeout = 3000;
+
+        if (!this.config.audioCues || (!this.cues.tones && !this.cues.speech) || !this.audioContext) {
+            return Promise.resolve();
+        }
+
+        const speech = this.cues.speech && this.config.audioCues.speech;
+
+        const key = [this.cues.tones, speech, call.system, call.talkgroup, call.priority || 0, !!call.emergency].join(':');
+
+        const getBuffers = (): Promise<AudioBuffer[]> => {
+            const buffers = this.cueBuffers.get(key);
+
+            if (buffers) {
+                return Promise.resolve(buffers);
+            }
+
+            return new Promise((resolve) => {
+                const timeout = window.setTimeout(() => resolve([]), cueTimeout);
+
+                const pending = this.cuePending.get(key) || [];
+
+                pending.push((buffers) => {
+                    window.clearTimeout(timeout);
+
+                    resolve(buffers);
+                });
+
+                if (pending.length === 1) {
+                    this.sendtoWebsocket(WebsocketCommand.Cue, {
+                        emergency: !!call.emergency,
+                        key,
+                        priority: call.priority || 0,
+                        speech,
+                        system: call.system,
+                        talkgroup: call.talkgroup,
+                        tones: this.cues.tones,
+                    });
+                }
+
+                this.cuePending.set(key, pending);
+            });
+        };
+
+        return getBuffers().then((buffers) => new Promise((resolve) => {
+            const next = (index: number, previous?: AudioBufferSourceNode): void => {
+                if (previous && this.cueSource === previous) {
+                    this.cueSource = undefined;
+                }
+
+                if (index >= buffers.length || !this.audioContext || this.call !== call) {
+                    resolve();
+
+                    return;
+                }
+
+                const source = this.audioContext.createBufferSource();
+                source.buffer = buffers[index];
+                source.connect(this.audioContext.destination);
+                source.onended = () => next(index + 1, source);
+                source.start();
+
+                this.cueSource = source;
+            };
+
+            next(0);
+        }));
+    }
+
     private playbackNextCall(): void {
         if (this.call || this.livefeedMode !== RdioScannerLivefeedMode.Playback || !this.playbackList || this.playbackPending) {
             return;
@@ -1063,6 +1605,35 @@ export class RdioScannerService implements OnDestroy {
         }
     }
 
+    private readCues(): void {
+        try {
+            const cues = JSON.parse(window?.localStorage?.getItem(RdioScannerService.LOCAL_STORAGE_KEY_CUES) || '{}');
+
+            if (cues !== null && typeof cues === 'object') {
+                this.cues = {
+                    speech: cues.speech === true,
+                    tones: cues.tones === 'priority' || cues.tones === 'system' ? cues.tones : '',
+                };
+            }
+
+        } catch (error) {
+            this.cues = { speech: false, tones: '' };
+        }
+    }
+
+    private readSites(): void {
+        try {
+            const sites = JSON.parse(window?.localStorage?.getItem(`${RdioScannerService.LOCAL_STORAGE_KEY_SITES}-${this.instanceId}`) || '{}');
+
+            if (sites !== null && typeof sites === 'object') {
+                this.sites = sites;
+            }
+
+        } catch (error) {
+            this.sites = {};
+        }
+    }
+
     private readLivefeedMap(): void {
         try {
             let lfm: { [key: number]: { [key: number]: boolean } } = {};
@@ -1197,7 +1768,12 @@ export class RdioScannerService implements OnDestroy {
             call.systemData = this.config.systems.find((system) => system.id === call.system);
 
             if (Array.isArray(call.systemData?.talkgroups)) {
-                call.talkgroupData = call.systemData?.talkgroups.find((talkgroup) => talkgroup.id === call.talkgroup);
+                // the talkgroup of the call site first, then the one for all sites
+                const talkgroups = call.systemData?.talkgroups.filter((talkgroup) => talkgroup.id === call.talkgroup) || [];
+
+                call.talkgroupData = talkgroups.find((talkgroup) => (talkgroup.site || 0) === (call.site || 0))
+                    || talkgroups.find((talkgroup) => !talkgroup.site)
+                    || talkgroups[0];
             }
 
             if (call.talkgroupData?.frequency) {
@@ -1207,4 +1783,16 @@ export class RdioScannerService implements OnDestroy {
 
         return call;
     }
+
+    private transformIncident(incident: RdioScannerIncident): RdioScannerIncident {
+        if (incident && Array.isArray(this.config?.systems)) {
+            incident.systemData = this.config.systems.find((system) => system.id === incident.system);
+
+            incident.talkgroupsData = incident.talkgroups
+                .map((id) => incident.systemData?.talkgroups.find((talkgroup) => talkgroup.id === id))
+                .filter((talkgroup) => !!talkgroup) as RdioScannerTalkgroup[];
+        }
+
+        return incident;
+    }
 }
@@ -42,23 +42,36 @@ export enum RdioScannerBeepStyle {
 }
 
 export interface RdioScannerCall {
+    captions?: RdioScannerCaption[];
     audio?: {
         type: 'Buffer';
         data: number[];
     };
     audioName?: string;
     audioType?: string;
+    cold?: boolean;
     dateTime: Date;
+    duration?: number;
+    emergency?: boolean;
+    encrypted?: boolean;
     frequencies?: RdioScannerCallFrequency[];
     frequency?: number;
     id: number;
+    latitude?: number;
+    longitude?: number;
+    metadata?: { [key: string]: string };
+    mode?: 'fdma' | 'tdma';
     patches: number[];
+    priority?: number;
+    site?: number;
     source?: number;
     sources?: RdioScannerCallSource[];
     system: number;
     talkgroup: number;
     talkgroupData?: RdioScannerTalkgroup;
     systemData?: RdioScannerSystem;
+    transcript?: string;
+    uuid?: string;
 }
 
 export interface RdioScannerCallFrequency {
@@ -70,10 +83,34 @@ export interface RdioScannerCallFrequency {
 }
 
 export interface RdioScannerCallSource {
+    latitude?: number;
+    longitude?: number;
     pos?: number;
     src?: number;
 }
 
+export interface RdioScannerCapabilities {
+    audioCues: boolean;
+    download: boolean;
+    events: boolean;
+    hls: boolean;
+    liveCaptions: boolean;
+    oidc: boolean;
+    registration: boolean;
+    replay: boolean;
+    share: boolean;
+    streams: boolean;
+    subscriptions: string[];
+    transcription: boolean;
+    version: string;
+}
+
+export interface RdioScannerCaption {
+    end: number;
+    start: number;
+    text: string;
+}
+
 export interface RdioScannerCategory {
     label: string;
     status: RdioScannerCategoryStatus;
@@ -93,37 +130,71 @@ export enum RdioScannerCategoryType {
 
 export interface RdioScannerConfig {
     afs?: string;
+    audioCues?: { speech: boolean };
     branding?: string;
     dimmerDelay: number | false;
+    download?: boolean;
     email?: string;
     groups: { [key: string]: { [key: number]: number[] } };
     keypadBeeps: RdioScannerKeypadBeeps | false;
+    liveCaptions: boolean;
     playbackGoesLive: boolean;
+    share?: boolean;
     showListenersCount: boolean;
+    showOccupancy: boolean;
+    subscriptions?: number;
     systems: RdioScannerSystem[];
     tags: { [key: string]: { [key: number]: number[] } };
     tagsToggle: boolean;
     time12hFormat: boolean;
 }
 
+export interface RdioScannerCues {
+    speech: boolean;
+    tones: '' | 'priority' | 'system';
+}
+
 export interface RdioScannerEvent {
     auth?: boolean;
     categories?: RdioScannerCategory[];
     call?: RdioScannerCall;
+    captions?: { id: number; captions: RdioScannerCaption[]; };
+    closed?: string;
     config?: RdioScannerConfig;
+    cues?: RdioScannerCues;
     expired?: boolean;
     holdSys?: boolean;
     holdTg?: boolean;
+    incidents?: RdioScannerIncident[];
+    latency?: number;
     linked?: boolean;
     listeners?: number;
     livefeedMode?: RdioScannerLivefeedMode;
     map?: RdioScannerLivefeedMap;
+    occupancy?: RdioScannerOccupancy;
     pause?: boolean;
     playbackList?: RdioScannerPlaybackList;
     playbackPending?: number;
     queue?: number;
+    retrieving?: number;
+    share?: { id: number; url?: string; };
+    sites?: RdioScannerSites;
+    subscriptions?: RdioScannerSubscriptions;
     time?: number;
     tooMany?: boolean;
+    transcript?: { id: number; transcript: string; };
+}
+
+export interface RdioScannerIncident {
+    calls: number[];
+    createdAt: string;
+    expires?: string;
+    id: number;
+    label: string;
+    system: number;
+    systemData?: RdioScannerSystem;
+    talkgroups: number[];
+    talkgroupsData?: RdioScannerTalkgroup[];
 }
 
 export interface RdioScannerKeypadBeeps {
@@ -144,6 +215,19 @@ export interface RdioScannerLivefeedMap {
     };
 }
 
+export interface RdioScannerOccupancy {
+    [key: number]: {
+        [key: number]: RdioScannerOccupancyState;
+    };
+}
+
+export interface RdioScannerOccupancyState {
+    busy: boolean;
+    calls: number;
+    system: number;
+    talkgroup: number;
+}
+
 export enum RdioScannerLivefeedMode {
     Offline = 'offline',
     Online = 'online',
@@ -158,15 +242,55 @@ export interface RdioScannerPlaybackList {
     results: RdioScannerCall[];
 }
 
+export interface RdioScannerRegistration {
+    email: string;
+    message?: string;
+    name?: string;
+}
+
 export interface RdioScannerSearchOptions {
     date?: Date;
     group?: string;
     limit: number;
+    maxDuration?: number;
+    metadata?: { [key: string]: string };
+    minDuration?: number;
     offset: number;
+    site?: number;
     sort: number;
     system?: number;
     tag?: string;
     talkgroup?: number;
+    text?: string;
+    unit?: number | string;
+}
+
+export interface RdioScannerSite {
+    id: number;
+    label: string;
+    order?: number;
+}
+
+export interface RdioScannerSites {
+    [key: number]: number;
+}
+
+export interface RdioScannerSubscription {
+    _id?: number;
+    action: 'apns' | 'email' | 'fcm' | 'webpush';
+    address: string;
+    createdAt?: string;
+    system: number;
+    talkgroup: number;
+}
+
+export interface RdioScannerSubscriptions {
+    actions: string[];
+    cooldown: number;
+    error?: string;
+    max: number;
+    subscriptions: RdioScannerSubscription[];
+    vapidPublicKey?: string;
 }
 
 export interface RdioScannerSystem {
@@ -174,6 +298,7 @@ export interface RdioScannerSystem {
     label: string;
     led?: 'blue' | 'cyan' | 'green' | 'magenta' | 'orange' | 'red' | 'white' | 'yellow';
     order?: number;
+    sites?: RdioScannerSite[];
     talkgroups: RdioScannerTalkgroup[];
     units: RdioScannerUnit[];
 }
@@ -185,6 +310,7 @@ export interface RdioScannerTalkgroup {
     label: string;
     led?: 'blue' | 'cyan' | 'green' | 'magenta' | 'orange' | 'red' | 'white' | 'yellow';
     name: string;
+    site?: number;
     tag: string;
 }
 
@@ -28,6 +28,7 @@ import {
     RdioScannerLivefeedMode,
     RdioScannerPlaybackList,
     RdioScannerSearchOptions,
+    RdioScannerSite,
     RdioScannerSystem,
     RdioScannerTalkgroup,
 } from '../rdio-scanner';
@@ -42,13 +43,21 @@ export class RdioScannerSearchComponent implements OnDestroy {
     call: RdioScannerCall | undefined;
     callPending: number | undefined;
 
+    downloadable = true;
+
     form = this.ngFormBuilder.group({
         date: [null],
         group: [-1],
+        maxDuration: [null],
+        metadata: [''],
+        minDuration: [null],
+        site: [-1],
         sort: [-1],
         system: [-1],
         tag: [-1],
         talkgroup: [-1],
+        text: [''],
+        unit: [''],
     });
 
     livefeedOnline = false;
@@ -57,6 +66,7 @@ export class RdioScannerSearchComponent implements OnDestroy {
     playbackList: RdioScannerPlaybackList | undefined;
 
     optionsGroup: string[] = [];
+    optionsSite: RdioScannerSite[] = [];
     optionsSystem: string[] = [];
     optionsTag: string[] = [];
     optionsTalkgroup: string[] = [];
@@ -66,6 +76,8 @@ export class RdioScannerSearchComponent implements OnDestroy {
     results = new BehaviorSubject(new Array<RdioScannerCall | null>(10));
     resultsPending = false;
 
+    shareable = false;
+
     time12h = false;
 
     private config: RdioScannerConfig | undefined;
@@ -170,8 +182,11 @@ export class RdioScannerSearchComponent implements OnDestroy {
             })
             .sort((a, b) => a.localeCompare(b))
 
+        this.optionsSite = selectedSystem?.sites || [];
+
         this.form.patchValue({
             group: selectedGroup ? this.optionsGroup.findIndex((group) => group === selectedGroup) : -1,
+            site: this.optionsSite.some((site) => site.id === this.form.value.site) ? this.form.value.site : -1,
             system: selectedSystem ? this.optionsSystem.findIndex((system) => system === selectedSystem.label) : -1,
             tag: selectedTag ? this.optionsTag.findIndex((tag) => tag === selectedTag) : -1,
             talkgroup: selectedTalkgroup ? this.optionsTalkgroup.findIndex((talkgroup) => talkgroup === selectedTalkgroup.label) : -1,
@@ -205,10 +220,16 @@ export class RdioScannerSearchComponent implements OnDestroy {
         this.form.reset({
             date: null,
             group: -1,
+            maxDuration: null,
+            metadata: '',
+            minDuration: null,
+            site: -1,
             sort: -1,
             system: -1,
             tag: -1,
             talkgroup: -1,
+            text: '',
+            unit: '',
         });
 
         this.paginator?.firstPage();
@@ -245,11 +266,39 @@ export class RdioScannerSearchComponent implements OnDestroy {
             }
         }
 
+        if (typeof this.form.value.maxDuration === 'number' && this.form.value.maxDuration > 0) {
+            options.maxDuration = this.form.value.maxDuration;
+        }
+
+        if (typeof this.form.value.metadata === 'string' && this.form.value.metadata.trim().length) {
+            const metadata = this.form.value.metadata.split(',').reduce((m: { [key: string]: string }, field: string) => {
+                const [key, ...value] = field.split('=');
+
+                if (key.trim().length && value.join('=').trim().length) {
+                    m[key.trim()] = value.join('=').trim();
+                }
+
+                return m;
+            }, {});
+
+            if (Object.keys(metadata).length) {
+                options.metadata = metadata;
+            }
+        }
+
+        if (typeof this.form.value.minDuration === 'number' && this.form.value.minDuration > 0) {
+            options.minDuration = this.form.value.minDuration;
+        }
+
         if (this.form.value.system >= 0) {
             const system = this.getSelectedSystem();
 
             if (system) {
                 options.system = system.id;
+
+                if (this.form.value.site > 0) {
+                    options.site = this.form.value.site;
+                }
             }
         }
 
@@ -269,6 +318,16 @@ export class RdioScannerSearchComponent implements OnDestroy {
             }
         }
 
+        if (typeof this.form.value.text === 'string' && this.form.value.text.trim().length) {
+            options.text = this.form.value.text.trim();
+        }
+
+        if (typeof this.form.value.unit === 'string' && this.form.value.unit.trim().length) {
+            const unit = this.form.value.unit.trim();
+
+            options.unit = /^[0-9]+$/.test(unit) ? +unit : unit;
+        }
+
         this.resultsPending = true;
 
         this.form.disable();
@@ -276,6 +335,10 @@ export class RdioScannerSearchComponent implements OnDestroy {
         this.rdioScannerService.searchCalls(options);
     }
 
+    share(id: number): void {
+        this.rdioScannerService.share(id);
+    }
+
     stop(): void {
         if (this.livefeedPlayback) {
             this.rdioScannerService.stopPlaybackMode();
@@ -310,6 +373,10 @@ export class RdioScannerSearchComponent implements OnDestroy {
 
             this.callPending = undefined;
 
+            this.downloadable = this.config?.download !== false;
+
+            this.shareable = this.downloadable && this.config?.share === true;
+
             this.optionsGroup = Object.keys(this.config?.groups || []).sort((a, b) => a.localeCompare(b));
             this.optionsSystem = (this.config?.systems || []).map((system) => system.label);
             this.optionsTag = Object.keys(this.config?.tags || []).sort((a, b) => a.localeCompare(b));
@@ -348,6 +415,10 @@ export class RdioScannerSearchComponent implements OnDestroy {
         return this.optionsGroup[this.form.value.group];
     }
 
+    getSiteLabel(call: RdioScannerCall): string {
+        return call.systemData?.sites?.find((site) => site.id === call.site)?.label || `${call.site}`;
+    }
+
     private getSelectedSystem(): RdioScannerSystem | undefined {
         return this.config?.systems.find((system) => system.label === this.optionsSystem[this.form.value.system]);
     }
@@ -23,8 +23,11 @@ import {
     RdioScannerBeepStyle,
     RdioScannerCategory,
     RdioScannerCategoryStatus,
+    RdioScannerCues,
     RdioScannerEvent,
     RdioScannerLivefeedMap,
+    RdioScannerOccupancy,
+    RdioScannerSites,
     RdioScannerSystem,
 } from '../rdio-scanner';
 import { RdioScannerService } from '../rdio-scanner.service';
@@ -38,10 +41,18 @@ import { RdioScannerService } from '../rdio-scanner.service';
     templateUrl: './select.component.html',
 })
 export class RdioScannerSelectComponent implements OnDestroy {
+    audioCues: { speech: boolean } | undefined;
+
     categories: RdioScannerCategory[] | undefined;
 
+    cues: RdioScannerCues = { speech: false, tones: '' };
+
     map: RdioScannerLivefeedMap = {};
 
+    occupancy: RdioScannerOccupancy = {};
+
+    sites: RdioScannerSites = {};
+
     systems: RdioScannerSystem[] | undefined;
 
     tagsToggle: boolean | undefined;
@@ -74,6 +85,20 @@ export class RdioScannerSelectComponent implements OnDestroy {
         this.eventSubscription.unsubscribe();
     }
 
+    selectCues(cues: Partial<RdioScannerCues>): void {
+        const next = { ...this.cues, ...cues };
+
+        this.rdioScannerService.beep(next.tones || next.speech ? RdioScannerBeepStyle.Activate : RdioScannerBeepStyle.Deactivate);
+
+        this.rdioScannerService.setCues(next);
+    }
+
+    selectSite(system: RdioScannerSystem, site?: number): void {
+        this.rdioScannerService.beep(site ? RdioScannerBeepStyle.Activate : RdioScannerBeepStyle.Deactivate);
+
+        this.rdioScannerService.setSite(system.id, site);
+    }
+
     toggle(category: RdioScannerCategory): void {
         if (category.status == RdioScannerCategoryStatus.On)
             this.rdioScannerService.beep(RdioScannerBeepStyle.Deactivate);
@@ -85,10 +110,14 @@ export class RdioScannerSelectComponent implements OnDestroy {
 
     private eventHandler(event: RdioScannerEvent): void {
         if (event.config) {
+            this.audioCues = event.config.audioCues;
             this.tagsToggle = event.config.tagsToggle;
             this.systems = event.config.systems;
         }
         if (event.categories) this.categories = event.categories;
+        if (event.cues) this.cues = event.cues;
         if (event.map) this.map = event.map;
+        if (event.occupancy) this.occupancy = event.occupancy;
+        if (event.sites) this.sites = event.sites;
     }
 }
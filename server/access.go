@@ -32,6 +32,7 @@ type Access struct {
 	Limit      any    `json:"limit"`
 	Order      any    `json:"order"`
 	Systems    any    `json:"systems"`
+	Tier       any    `json:"tier"`
 }
 
 func NewAccess() *Access {
@@ -80,6 +81,13 @@ func (access *Access) FromMap(m map[string]any) *Access {
 		access.Systems = v
 	}
 
+	switch v := m["tier"].(type) {
+	case string:
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			access.Tier = v
+		}
+	}
+
 	return access
 }
 
@@ -132,8 +140,9 @@ func (access *Access) HasExpired() bool {
 }
 
 type Accesses struct {
-	List  []*Access
-	mutex sync.Mutex
+	List     []*Access
+	external bool
+	mutex    sync.Mutex
 }
 
 func NewAccesses() *Accesses {
@@ -155,6 +164,7 @@ func (accesses *Accesses) Add(access *Access) (*Accesses, bool) {
 			a.Ident = access.Ident
 			a.Limit = access.Limit
 			a.Systems = access.Systems
+			a.Tier = access.Tier
 			added = false
 		}
 	}
@@ -197,11 +207,26 @@ func (accesses *Accesses) GetAccess(code string) (access *Access, ok bool) {
 	return nil, false
 }
 
+// GetIdentAccess returns an unexpired access of the ident which gives access
+// to the call.
+func (accesses *Accesses) GetIdentAccess(ident string, call *Call) (*Access, bool) {
+	accesses.mutex.Lock()
+	defer accesses.mutex.Unlock()
+
+	for _, access := range accesses.List {
+		if access.Ident == ident && !access.HasExpired() && access.HasAccess(call) {
+			return access, true
+		}
+	}
+
+	return nil, false
+}
+
 func (accesses *Accesses) IsRestricted() bool {
 	accesses.mutex.Lock()
 	defer accesses.mutex.Unlock()
 
-	return len(accesses.List) > 0
+	return accesses.external || len(accesses.List) > 0
 }
 
 func (accesses *Accesses) Read(db *Database) error {
@@ -214,6 +239,7 @@ func (accesses *Accesses) Read(db *Database) error {
 		rows       *sql.Rows
 		systems    string
 		t          time.Time
+		tier       sql.NullString
 	)
 
 	accesses.mutex.Lock()
@@ -225,17 +251,21 @@ func (accesses *Accesses) Read(db *Database) error {
 		return fmt.Errorf("accesses.read: %v", err)
 	}
 
-	if rows, err = db.Sql.Query("select `_id`, `code`, `expiration`, `ident`, `limit`, `order`, `systems` from `rdioScannerAccesses`"); err != nil {
+	if rows, err = db.Sql.Query("select `_id`, `code`, `expiration`, `ident`, `limit`, `order`, `systems`, `tier` from `rdioScannerAccesses`"); err != nil {
 		return formatError(err)
 	}
 
 	for rows.Next() {
 		access := &Access{}
 
-		if err = rows.Scan(&id, &access.Code, &expiration, &access.Ident, &limit, &order, &systems); err != nil {
+		if err = rows.Scan(&id, &access.Code, &expiration, &access.Ident, &limit, &order, &systems, &tier); err != nil {
 			break
 		}
 
+		if tier.Valid && len(tier.String) > 0 {
+			access.Tier = tier.String
+		}
+
 		if id.Valid && id.Float64 > 0 {
 			access.Id = uint(id.Float64)
 		}
@@ -336,15 +366,7 @@ func (accesses *Accesses) Write(db *Database) error {
 	}
 
 	if len(rowIds) > 0 {
-		// Build parameterized IN clause to prevent SQL injection
-		placeholders := make([]string, len(rowIds))
-		args := make([]any, len(rowIds))
-		for i, id := range rowIds {
-			placeholders[i] = "?"
-			args[i] = id
-		}
-		q := fmt.Sprintf("delete from `rdioScannerAccesses` where `_id` in (%s)", strings.Join(placeholders, ","))
-		if _, err = db.Sql.Exec(q, args...); err != nil {
+		if _, err = db.Delete("rdioScannerAccesses").Where(SqlIn("_id", rowIds)).Exec(); err != nil {
 			return formatError(err)
 		}
 	}
@@ -362,11 +384,11 @@ func (accesses *Accesses) Write(db *Database) error {
 		}
 
 		if count == 0 {
-			if _, err = db.Sql.Exec("insert into `rdioScannerAccesses` (`_id`, `code`, `expiration`, `ident`, `limit`, `order`, `systems`) values (?, ?, ?, ?, ?, ?, ?)", access.Id, access.Code, access.Expiration, access.Ident, access.Limit, access.Order, systems); err != nil {
+			if _, err = db.Sql.Exec("insert into `rdioScannerAccesses` (`_id`, `code`, `expiration`, `ident`, `limit`, `order`, `systems`, `tier`) values (?, ?, ?, ?, ?, ?, ?, ?)", access.Id, access.Code, access.Expiration, access.Ident, access.Limit, access.Order, systems, access.Tier); err != nil {
 				break
 			}
 
-		} else if _, err = db.Sql.Exec("update `rdioScannerAccesses` set `_id` = ?, `code` = ?, `expiration` = ?, `ident` = ?, `limit` = ?, `order` = ?, `systems` = ? where `_id` = ?", access.Id, access.Code, access.Expiration, access.Ident, access.Limit, access.Order, systems, access.Id); err != nil {
+		} else if _, err = db.Sql.Exec("update `rdioScannerAccesses` set `_id` = ?, `code` = ?, `expiration` = ?, `ident` = ?, `limit` = ?, `order` = ?, `systems` = ?, `tier` = ? where `_id` = ?", access.Id, access.Code, access.Expiration, access.Ident, access.Limit, access.Order, systems, access.Tier, access.Id); err != nil {
 			break
 		}
 	}
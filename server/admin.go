@@ -16,6 +16,10 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -32,38 +36,40 @@ import (
 )
 
 type Admin struct {
-	Attempts         AdminLoginAttempts
-	AttemptsMax      uint
-	AttemptsMaxDelay time.Duration
-	Broadcast        chan *[]byte
-	Conns            map[*websocket.Conn]bool
-	Controller       *Controller
-	Register         chan *websocket.Conn
-	Tokens           []string
-	Unregister       chan *websocket.Conn
-	mutex            sync.Mutex
-	running          bool
+	Broadcast  chan *[]byte
+	Conns      map[*websocket.Conn]bool
+	Controller *Controller
+	Register   chan *websocket.Conn
+	Tokens     []string
+	Unregister chan *websocket.Conn
+	mutex      sync.Mutex
+	reset      *adminPasswordReset
+	resetMutex sync.Mutex
+	running    bool
 }
 
-type AdminLoginAttempt struct {
-	Count uint
-	Date  time.Time
-}
+const (
+	adminResetAttempts = 5
+	adminResetTtl      = 15 * time.Minute
+)
 
-type AdminLoginAttempts map[string]*AdminLoginAttempt
+// adminPasswordReset is the pending reset of the admin password, of which
+// only the hash of the emailed code is kept.
+type adminPasswordReset struct {
+	attempts uint
+	expires  time.Time
+	hash     [sha256.Size]byte
+}
 
 func NewAdmin(controller *Controller) *Admin {
 	return &Admin{
-		Attempts:         AdminLoginAttempts{},
-		AttemptsMax:      uint(3),
-		AttemptsMaxDelay: time.Duration(time.Duration.Minutes(10)),
-		Broadcast:        make(chan *[]byte),
-		Conns:            make(map[*websocket.Conn]bool),
-		Controller:       controller,
-		Register:         make(chan *websocket.Conn),
-		Tokens:           []string{},
-		Unregister:       make(chan *websocket.Conn),
-		mutex:            sync.Mutex{},
+		Broadcast:  make(chan *[]byte),
+		Conns:      make(map[*websocket.Conn]bool),
+		Controller: controller,
+		Register:   make(chan *websocket.Conn),
+		Tokens:     []string{},
+		Unregister: make(chan *websocket.Conn),
+		mutex:      sync.Mutex{},
 	}
 }
 
@@ -124,6 +130,14 @@ func (admin *Admin) ConfigHandler(w http.ResponseWriter, r *http.Request) {
 		admin.Register <- conn
 
 		go func() {
+			defer admin.Controller.Recover("admin.reader")
+
+			defer func() {
+				admin.Unregister <- conn
+
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(1000, ""))
+			}()
+
 			conn.SetReadDeadline(time.Time{})
 
 			for {
@@ -136,10 +150,6 @@ func (admin *Admin) ConfigHandler(w http.ResponseWriter, r *http.Request) {
 					break
 				}
 			}
-
-			admin.Unregister <- conn
-
-			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(1000, ""))
 		}()
 
 	} else {
@@ -147,9 +157,7 @@ func (admin *Admin) ConfigHandler(w http.ResponseWriter, r *http.Request) {
 			admin.Controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("admin.confighandler.put: %s", err.Error()))
 		}
 
-		t := admin.GetAuthorization(r)
-		if !admin.ValidateToken(t) {
-			w.WriteHeader(http.StatusUnauthorized)
+		if !admin.Authorize(w, r, adminWriteRole(r)) {
 			return
 		}
 
@@ -168,126 +176,285 @@ func (admin *Admin) ConfigHandler(w http.ResponseWriter, r *http.Request) {
 			admin.mutex.Lock()
 			defer admin.mutex.Unlock()
 
-			admin.Controller.Dirwatches.Stop()
+			admin.applyConfig(m)
 
-			switch v := m["access"].(type) {
-			case []any:
-				admin.Controller.Accesses.FromMap(v)
-				err := admin.Controller.Accesses.Write(admin.Controller.Database)
-				if err != nil {
-					logError(err)
-				} else {
-					err = admin.Controller.Accesses.Read(admin.Controller.Database)
-					if err != nil {
-						logError(err)
-					}
-				}
+			if _, err := admin.Controller.ConfigVersions.Snapshot(admin.author(r), "configuration changed"); err != nil {
+				logError(err)
 			}
 
-			switch v := m["apiKeys"].(type) {
-			case []any:
-				admin.Controller.Apikeys.FromMap(v)
-				err = admin.Controller.Apikeys.Write(admin.Controller.Database)
-				if err != nil {
-					logError(err)
-				} else {
-					err = admin.Controller.Apikeys.Read(admin.Controller.Database)
-					if err != nil {
-						logError(err)
-					}
-				}
+			admin.SendConfig(w)
+
+			admin.Controller.Logs.LogEvent(LogLevelWarn, "configuration changed")
+
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// applyConfig saves the sections of the configuration found in m, as sent
+// by the admin dashboard or kept in a version. It must be called with the
+// admin mutex held.
+func (admin *Admin) applyConfig(m map[string]any) {
+	var err error
+
+	logError := func(err error) {
+		admin.Controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("admin.applyconfig: %s", err.Error()))
+	}
+
+	admin.Controller.Dirwatches.Stop()
+
+	switch v := m["access"].(type) {
+	case []any:
+		admin.Controller.Accesses.FromMap(v)
+		err = admin.Controller.Accesses.Write(admin.Controller.Database)
+		if err != nil {
+			logError(err)
+		} else {
+			err = admin.Controller.Accesses.Read(admin.Controller.Database)
+			if err != nil {
+				logError(err)
 			}
+		}
+	}
 
-			switch v := m["dirWatch"].(type) {
-			case []any:
-				admin.Controller.Dirwatches.FromMap(v)
-				err = admin.Controller.Dirwatches.Write(admin.Controller.Database)
-				if err != nil {
-					logError(err)
-				} else {
-					err = admin.Controller.Dirwatches.Read(admin.Controller.Database)
-					if err != nil {
-						logError(err)
-					}
-				}
+	switch v := m["alerts"].(type) {
+	case []any:
+		admin.Controller.Alerts.FromMap(v)
+		err = admin.Controller.Alerts.Write(admin.Controller.Database)
+		if err != nil {
+			logError(err)
+		} else {
+			err = admin.Controller.Alerts.Read(admin.Controller.Database)
+			if err != nil {
+				logError(err)
 			}
+		}
+	}
 
-			switch v := m["downstreams"].(type) {
-			case []any:
-				admin.Controller.Downstreams.FromMap(v)
-				err = admin.Controller.Downstreams.Write(admin.Controller.Database)
-				if err != nil {
-					logError(err)
-				} else {
-					err = admin.Controller.Downstreams.Read(admin.Controller.Database)
-					if err != nil {
-						logError(err)
-					}
-				}
+	switch v := m["apiKeys"].(type) {
+	case []any:
+		admin.Controller.Apikeys.FromMap(v)
+		err = admin.Controller.Apikeys.Write(admin.Controller.Database)
+		if err != nil {
+			logError(err)
+		} else {
+			err = admin.Controller.Apikeys.Read(admin.Controller.Database)
+			if err != nil {
+				logError(err)
 			}
+		}
+	}
 
-			switch v := m["groups"].(type) {
-			case []any:
-				admin.Controller.Groups.FromMap(v)
-				err = admin.Controller.Groups.Write(admin.Controller.Database)
-				if err != nil {
-					logError(err)
-				} else {
-					err = admin.Controller.Groups.Read(admin.Controller.Database)
-					if err != nil {
-						logError(err)
-					}
-				}
+	switch v := m["broadcastify"].(type) {
+	case []any:
+		admin.Controller.Broadcastify.FromMap(v)
+		err = admin.Controller.Broadcastify.Write(admin.Controller.Database)
+		if err != nil {
+			logError(err)
+		} else {
+			err = admin.Controller.Broadcastify.Read(admin.Controller.Database)
+			if err != nil {
+				logError(err)
 			}
+		}
+	}
 
-			switch v := m["options"].(type) {
-			case map[string]any:
-				admin.Controller.Options.FromMap(v)
-				err = admin.Controller.Options.Write(admin.Controller.Database)
-				if err != nil {
-					logError(err)
-				}
+	switch v := m["dirWatch"].(type) {
+	case []any:
+		admin.Controller.Dirwatches.FromMap(v)
+		err = admin.Controller.Dirwatches.Write(admin.Controller.Database)
+		if err != nil {
+			logError(err)
+		} else {
+			err = admin.Controller.Dirwatches.Read(admin.Controller.Database)
+			if err != nil {
+				logError(err)
 			}
+		}
+	}
 
-			switch v := m["systems"].(type) {
-			case []any:
-				admin.Controller.Systems.FromMap(v)
-				err = admin.Controller.Systems.Write(admin.Controller.Database)
-				if err != nil {
-					logError(err)
-				} else {
-					err = admin.Controller.Systems.Read(admin.Controller.Database)
-					if err != nil {
-						logError(err)
-					}
-				}
+	switch v := m["downstreams"].(type) {
+	case []any:
+		admin.Controller.Downstreams.FromMap(v)
+		err = admin.Controller.Downstreams.Write(admin.Controller.Database)
+		if err != nil {
+			logError(err)
+		} else {
+			err = admin.Controller.Downstreams.Read(admin.Controller.Database)
+			if err != nil {
+				logError(err)
 			}
+		}
+	}
 
-			switch v := m["tags"].(type) {
-			case []any:
-				admin.Controller.Tags.FromMap(v)
-				err = admin.Controller.Tags.Write(admin.Controller.Database)
-				if err != nil {
-					logError(err)
-				} else {
-					err = admin.Controller.Tags.Read(admin.Controller.Database)
-					if err != nil {
-						logError(err)
-					}
-				}
+	switch v := m["groups"].(type) {
+	case []any:
+		admin.Controller.Groups.FromMap(v)
+		err = admin.Controller.Groups.Write(admin.Controller.Database)
+		if err != nil {
+			logError(err)
+		} else {
+			err = admin.Controller.Groups.Read(admin.Controller.Database)
+			if err != nil {
+				logError(err)
 			}
+		}
+	}
 
-			admin.Controller.EmitConfig()
-			admin.Controller.Dirwatches.Start(admin.Controller)
+	switch v := m["openmhz"].(type) {
+	case []any:
+		admin.Controller.Openmhz.FromMap(v)
+		err = admin.Controller.Openmhz.Write(admin.Controller.Database)
+		if err != nil {
+			logError(err)
+		} else {
+			err = admin.Controller.Openmhz.Read(admin.Controller.Database)
+			if err != nil {
+				logError(err)
+			}
+		}
+	}
 
-			admin.SendConfig(w)
+	switch v := m["radioReference"].(type) {
+	case []any:
+		admin.Controller.RadioReference.FromMap(v)
+		err = admin.Controller.RadioReference.Write(admin.Controller.Database)
+		if err != nil {
+			logError(err)
+		} else {
+			err = admin.Controller.RadioReference.Read(admin.Controller.Database)
+			if err != nil {
+				logError(err)
+			}
+		}
+	}
 
-			admin.Controller.Logs.LogEvent(LogLevelWarn, "configuration changed")
+	switch v := m["options"].(type) {
+	case map[string]any:
+		admin.Controller.Options.FromMap(v)
+		err = admin.Controller.Options.Write(admin.Controller.Database)
+		if err != nil {
+			logError(err)
+		}
+	}
 
-		default:
-			w.WriteHeader(http.StatusMethodNotAllowed)
+	switch v := m["publishers"].(type) {
+	case []any:
+		admin.Controller.Publishers.FromMap(v)
+		err = admin.Controller.Publishers.Write(admin.Controller.Database)
+		if err != nil {
+			logError(err)
+		} else {
+			err = admin.Controller.Publishers.Read(admin.Controller.Database)
+			if err != nil {
+				logError(err)
+			}
 		}
 	}
+
+	switch v := m["retentions"].(type) {
+	case []any:
+		admin.Controller.Retentions.FromMap(v)
+		err = admin.Controller.Retentions.Write(admin.Controller.Database)
+		if err != nil {
+			logError(err)
+		} else {
+			err = admin.Controller.Retentions.Read(admin.Controller.Database)
+			if err != nil {
+				logError(err)
+			}
+		}
+	}
+
+	switch v := m["streams"].(type) {
+	case []any:
+		admin.Controller.Streams.FromMap(v)
+		err = admin.Controller.Streams.Write(admin.Controller.Database)
+		if err != nil {
+			logError(err)
+		} else {
+			err = admin.Controller.Streams.Read(admin.Controller.Database)
+			if err != nil {
+				logError(err)
+			}
+		}
+	}
+
+	switch v := m["transcribers"].(type) {
+	case []any:
+		admin.Controller.Transcribers.FromMap(v)
+		err = admin.Controller.Transcribers.Write(admin.Controller.Database)
+		if err != nil {
+			logError(err)
+		} else {
+			err = admin.Controller.Transcribers.Read(admin.Controller.Database)
+			if err != nil {
+				logError(err)
+			}
+		}
+	}
+
+	switch v := m["systems"].(type) {
+	case []any:
+		admin.Controller.Systems.FromMap(v)
+		err = admin.Controller.Systems.Write(admin.Controller.Database)
+		if err != nil {
+			logError(err)
+		} else {
+			err = admin.Controller.Systems.Read(admin.Controller.Database)
+			if err != nil {
+				logError(err)
+			}
+		}
+	}
+
+	switch v := m["tags"].(type) {
+	case []any:
+		admin.Controller.Tags.FromMap(v)
+		err = admin.Controller.Tags.Write(admin.Controller.Database)
+		if err != nil {
+			logError(err)
+		} else {
+			err = admin.Controller.Tags.Read(admin.Controller.Database)
+			if err != nil {
+				logError(err)
+			}
+		}
+	}
+
+	switch v := m["tiers"].(type) {
+	case []any:
+		admin.Controller.Tiers.FromMap(v)
+		err = admin.Controller.Tiers.Write(admin.Controller.Database)
+		if err != nil {
+			logError(err)
+		} else {
+			err = admin.Controller.Tiers.Read(admin.Controller.Database)
+			if err != nil {
+				logError(err)
+			}
+		}
+	}
+
+	admin.Controller.EmitConfig()
+
+	// the dirwatches only run once the server is started, not while it
+	// imports a configuration bundle from the command line, nor while it
+	// is the standby of another instance
+	if admin.Controller.running && !admin.Controller.Replication.Standby() {
+		admin.Controller.Dirwatches.Start(admin.Controller)
+	}
+}
+
+// author returns who makes the request, for the logs and the versions of
+// the configuration.
+func (admin *Admin) author(r *http.Request) string {
+	if user, ok := admin.GetTokenUser(admin.GetAuthorization(r)); ok && len(user.Username) > 0 {
+		return user.Username
+	}
+
+	return "admin"
 }
 
 func (admin *Admin) GetAuthorization(r *http.Request) string {
@@ -298,34 +465,45 @@ func (admin *Admin) GetConfig() map[string]any {
 	systems := []map[string]any{}
 	for _, system := range admin.Controller.Systems.List {
 		systems = append(systems, map[string]any{
-			"_id":          system.RowId,
-			"autoPopulate": system.AutoPopulate,
-			"blacklists":   system.Blacklists,
-			"id":           system.Id,
-			"label":        system.Label,
-			"led":          system.Led,
-			"order":        system.Order,
-			"talkgroups":   system.Talkgroups.List,
-			"units":        system.Units.List,
+			"_id":                system.RowId,
+			"audioNormalization": system.AudioNormalization,
+			"autoPopulate":       system.AutoPopulate,
+			"blacklists":         system.Blacklists,
+			"id":                 system.Id,
+			"label":              system.Label,
+			"led":                system.Led,
+			"metadataFields":     system.MetadataFields,
+			"order":              system.Order,
+			"qosWeight":          system.QosWeight,
+			"sites":              system.Sites.List,
+			"talkgroups":         system.Talkgroups.List,
+			"units":              system.Units.List,
 		})
 	}
 
 	return map[string]any{
-		"access":      admin.Controller.Accesses.List,
-		"apiKeys":     admin.Controller.Apikeys.List,
-		"dirWatch":    admin.Controller.Dirwatches.List,
-		"downstreams": admin.Controller.Downstreams.List,
-		"groups":      admin.Controller.Groups.List,
-		"options":     admin.Controller.Options,
-		"systems":     systems,
-		"tags":        admin.Controller.Tags.List,
+		"access":         admin.Controller.Accesses.List,
+		"alerts":         admin.Controller.Alerts.List,
+		"apiKeys":        admin.Controller.Apikeys.List,
+		"broadcastify":   admin.Controller.Broadcastify.List,
+		"dirWatch":       admin.Controller.Dirwatches.List,
+		"downstreams":    admin.Controller.Downstreams.List,
+		"groups":         admin.Controller.Groups.List,
+		"openmhz":        admin.Controller.Openmhz.List,
+		"options":        admin.Controller.Options,
+		"publishers":     admin.Controller.Publishers.List,
+		"radioReference": admin.Controller.RadioReference.List,
+		"retentions":     admin.Controller.Retentions.List,
+		"streams":        admin.Controller.Streams.List,
+		"systems":        systems,
+		"tags":           admin.Controller.Tags.List,
+		"tiers":          admin.Controller.Tiers.List,
+		"transcribers":   admin.Controller.Transcribers.List,
 	}
 }
 
 func (admin *Admin) LogsHandler(w http.ResponseWriter, r *http.Request) {
-	t := admin.GetAuthorization(r)
-	if !admin.ValidateToken(t) {
-		w.WriteHeader(http.StatusUnauthorized)
+	if !admin.Authorize(w, r, AdminRoleViewer) {
 		return
 	}
 
@@ -377,68 +555,63 @@ func (admin *Admin) LoginHandler(w http.ResponseWriter, r *http.Request) {
 
 		remoteAddr := GetRemoteAddr(r)
 
-		attempt := admin.Attempts[remoteAddr]
-
-		if attempt == nil {
-			admin.Attempts[remoteAddr] = &AdminLoginAttempt{
-				Count: 1,
-				Date:  time.Now(),
-			}
-			attempt = admin.Attempts[remoteAddr]
-		} else {
-			attempt.Count++
-			attempt.Date = time.Now()
+		if ok, wait := admin.Controller.Logins.Allow(LoginKindAdmin, remoteAddr); !ok {
+			loginRetryAfter(w, wait)
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
 		}
 
-		if attempt.Count > admin.AttemptsMax || time.Since(attempt.Date) < admin.AttemptsMaxDelay {
-			if attempt.Count == admin.AttemptsMax+1 {
-				admin.Controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("too many login attempts for ip=\"%v\"", remoteAddr))
-			}
+		var (
+			ok       bool
+			user     *AdminUser
+			username string
+		)
 
-			w.WriteHeader(http.StatusUnauthorized)
-			return
+		switch v := m["username"].(type) {
+		case string:
+			username = strings.TrimSpace(v)
 		}
 
-		ok := false
-
 		switch v := m["password"].(type) {
 		case string:
-			if len(v) > 0 {
-				if err := bcrypt.CompareHashAndPassword([]byte(admin.Controller.Options.adminPassword), []byte(v)); err == nil {
+			if len(v) > 0 && !admin.Controller.Config.OidcOnly {
+				if len(username) > 0 {
+					user, ok = admin.Controller.Users.Authenticate(username, v)
+				} else if err := bcrypt.CompareHashAndPassword([]byte(admin.Controller.Options.adminPassword), []byte(v)); err == nil {
 					ok = true
 				}
 			}
 		}
 
 		if !ok {
-			admin.Controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("invalid login attempt for ip %v", remoteAddr))
+			if len(username) > 0 {
+				admin.Controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("invalid login attempt for user %s from ip %v", username, remoteAddr))
+			} else {
+				admin.Controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("invalid login attempt for ip %v", remoteAddr))
+			}
+			if locked, until := admin.Controller.Logins.Fail(LoginKindAdmin, remoteAddr); locked {
+				admin.Controller.Logs.LogEvent(LogLevelWarn, loginLockedMessage(LoginKindAdmin, remoteAddr, until))
+			}
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
-		id, err := uuid.NewRandom()
-
-		if err != nil {
-			w.WriteHeader(http.StatusExpectationFailed)
-			return
-		}
-
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{ID: id.String()})
-		sToken, err := token.SignedString([]byte(admin.Controller.Options.secret))
+		admin.Controller.Logins.Succeed(LoginKindAdmin, remoteAddr)
 
+		sToken, err := admin.NewToken(user)
 		if err != nil {
 			w.WriteHeader(http.StatusExpectationFailed)
 			return
 		}
 
-		if len(admin.Tokens) < 5 {
-			admin.Tokens = append(admin.Tokens, sToken)
-		} else {
-			admin.Tokens = append(admin.Tokens[1:], sToken)
+		role := AdminRoleSuperadmin
+		if user != nil {
+			role = user.Role
 		}
 
 		b, err := json.Marshal(map[string]any{
-			"passwordNeedChange": true,
+			"passwordNeedChange": user == nil,
+			"role":               role,
 			"token":              sToken,
 		})
 		if err != nil {
@@ -446,12 +619,6 @@ func (admin *Admin) LoginHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		for k, v := range admin.Attempts {
-			if time.Since(v.Date) > admin.AttemptsMaxDelay {
-				delete(admin.Attempts, k)
-			}
-		}
-
 		w.Write(b)
 
 	default:
@@ -492,8 +659,8 @@ func (admin *Admin) PasswordHandler(w http.ResponseWriter, r *http.Request) {
 			admin.Controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("admin.passwordhandler.post: %s", err.Error()))
 		}
 
-		t := admin.GetAuthorization(r)
-		if !admin.ValidateToken(t) {
+		user, ok := admin.GetTokenUser(admin.GetAuthorization(r))
+		if !ok {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
@@ -518,6 +685,32 @@ func (admin *Admin) PasswordHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// users change their own password, the current one being required
+		if len(user.Username) > 0 {
+			current, _ := currentPassword.(string)
+
+			if _, ok := admin.Controller.Users.Authenticate(user.Username, current); !ok || len(newPassword) == 0 {
+				logError(fmt.Errorf("unable to change password of user %s, current password is invalid", user.Username))
+				w.WriteHeader(http.StatusExpectationFailed)
+				return
+			}
+
+			if err = admin.Controller.Users.Save(admin.Controller.Database, user, newPassword); err != nil {
+				logError(err)
+				w.WriteHeader(http.StatusExpectationFailed)
+				return
+			}
+
+			admin.Controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("password changed for user %s.", user.Username))
+
+			if b, err = json.Marshal(map[string]any{"passwordNeedChange": false}); err == nil {
+				w.Write(b)
+			} else {
+				w.WriteHeader(http.StatusExpectationFailed)
+			}
+			return
+		}
+
 		if err = admin.ChangePassword(currentPassword, newPassword); err != nil {
 			logError(errors.New("unable to change admin password, current password is invalid"))
 			w.WriteHeader(http.StatusExpectationFailed)
@@ -535,6 +728,157 @@ func (admin *Admin) PasswordHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// PasswordResetHandler resets the admin password with a code emailed to the
+// admin email, ie: {} to get the code then {"code": "...", "newPassword":
+// "..."}. A code expires after 15 minutes or 5 wrong attempts, and the
+// requests are throttled per ip like the logins.
+func (admin *Admin) PasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		controller = admin.Controller
+		options    = admin.Controller.Options
+	)
+
+	enabled := !controller.Config.OidcOnly && len(options.AdminEmail) > 0 && controller.Mailer.Enabled()
+
+	switch r.Method {
+	case http.MethodGet:
+		if b, err := json.Marshal(map[string]any{"enabled": enabled}); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+
+	case http.MethodPost:
+		if !enabled {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		m := map[string]any{}
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		remoteAddr := GetRemoteAddr(r)
+
+		if ok, wait := controller.Logins.Allow(LoginKindPasswordReset, remoteAddr); !ok {
+			loginRetryAfter(w, wait)
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		code, _ := m["code"].(string)
+
+		if len(code) == 0 {
+			if err := admin.requestPasswordReset(r, remoteAddr); err != nil {
+				controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("admin.passwordresethandler: %v", err))
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+
+			controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("admin password reset requested from ip %s", remoteAddr))
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		newPassword, _ := m["newPassword"].(string)
+		if len(newPassword) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if !admin.redeemPasswordReset(code) {
+			controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("invalid admin password reset code from ip %s", remoteAddr))
+			if locked, until := controller.Logins.Fail(LoginKindPasswordReset, remoteAddr); locked {
+				controller.Logs.LogEvent(LogLevelWarn, loginLockedMessage(LoginKindPasswordReset, remoteAddr, until))
+			}
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		controller.Logins.Succeed(LoginKindPasswordReset, remoteAddr)
+
+		if err := admin.ChangePassword(nil, newPassword); err != nil {
+			controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("admin.passwordresethandler: %v", err))
+			w.WriteHeader(http.StatusExpectationFailed)
+			return
+		}
+
+		// the sessions of the admin password end with it
+		admin.revokeTokens("")
+
+		controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("admin password reset from ip %s", remoteAddr))
+
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// requestPasswordReset emails a new reset code to the admin email, replacing
+// the pending one.
+func (admin *Admin) requestPasswordReset(r *http.Request, remoteAddr string) error {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+
+	code := base32.StdEncoding.EncodeToString(b)
+
+	admin.resetMutex.Lock()
+	admin.reset = &adminPasswordReset{expires: time.Now().Add(adminResetTtl), hash: sha256.Sum256([]byte(code))}
+	admin.resetMutex.Unlock()
+
+	text := fmt.Sprintf("A reset of the admin password was requested from ip %s.\n\nYour reset code is %s\n\nIt expires in %d minutes. Ignore this email if you did not request it.\n\n%s/admin", remoteAddr, code, int(adminResetTtl.Minutes()), requestBaseUrl(r))
+
+	return admin.Controller.Mailer.SendMail([]string{admin.Controller.Options.AdminEmail}, "Rdio Scanner admin password reset", text)
+}
+
+// redeemPasswordReset tells if the code is the one of the pending reset,
+// which is then used up. A wrong code counts against the pending reset.
+func (admin *Admin) redeemPasswordReset(code string) bool {
+	hash := sha256.Sum256([]byte(strings.ToUpper(strings.Join(strings.Fields(code), ""))))
+
+	admin.resetMutex.Lock()
+	defer admin.resetMutex.Unlock()
+
+	reset := admin.reset
+	if reset == nil {
+		return false
+	}
+
+	if time.Now().After(reset.expires) {
+		admin.reset = nil
+		return false
+	}
+
+	if subtle.ConstantTimeCompare(hash[:], reset.hash[:]) == 1 {
+		admin.reset = nil
+		return true
+	}
+
+	if reset.attempts++; reset.attempts >= adminResetAttempts {
+		admin.reset = nil
+	}
+
+	return false
+}
+
+// revokeTokens ends the sessions of a token subject, the empty one being the
+// admin password.
+func (admin *Admin) revokeTokens(subject string) {
+	tokens := []string{}
+	for _, t := range admin.Tokens {
+		if admin.getTokenSubject(t) != subject {
+			tokens = append(tokens, t)
+		}
+	}
+	admin.Tokens = tokens
+}
+
 func (admin *Admin) SendConfig(w http.ResponseWriter) {
 	var m map[string]any
 	_, docker := os.LookupEnv("DOCKER")
@@ -601,9 +945,7 @@ func (admin *Admin) UserAddHandler(w http.ResponseWriter, r *http.Request) {
 			admin.Controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("admin.useraddhandler.post: %s", err.Error()))
 		}
 
-		t := admin.GetAuthorization(r)
-		if !admin.ValidateToken(t) {
-			w.WriteHeader(http.StatusUnauthorized)
+		if !admin.Authorize(w, r, AdminRoleConfigEditor) {
 			return
 		}
 
@@ -641,9 +983,7 @@ func (admin *Admin) UserRemoveHandler(w http.ResponseWriter, r *http.Request) {
 			admin.Controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("admin.userremovehandler.post: %s", err.Error()))
 		}
 
-		t := admin.GetAuthorization(r)
-		if !admin.ValidateToken(t) {
-			w.WriteHeader(http.StatusUnauthorized)
+		if !admin.Authorize(w, r, AdminRoleConfigEditor) {
 			return
 		}
 
@@ -674,7 +1014,69 @@ func (admin *Admin) UserRemoveHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+type adminTokenClaims struct {
+	jwt.RegisteredClaims
+	Role string `json:"role,omitempty"`
+}
+
+// NewToken issues an admin token for the user, nil standing for the admin
+// password or an openid connect admin. Each user keeps its last 5 tokens.
+func (admin *Admin) NewToken(user *AdminUser) (string, error) {
+	if user != nil {
+		return admin.newToken(user.Username, "")
+	}
+
+	return admin.newToken("", "")
+}
+
+// NewOidcToken returns the token of an admin authenticated by the identity
+// provider, the token carrying the role its groups map to.
+func (admin *Admin) NewOidcToken(ident string, role string) (string, error) {
+	return admin.newToken(ident, role)
+}
+
+func (admin *Admin) newToken(subject string, role string) (string, error) {
+	const maxTokens = 5
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return "", err
+	}
+
+	claims := adminTokenClaims{RegisteredClaims: jwt.RegisteredClaims{ID: id.String(), Subject: subject}, Role: role}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+
+	sToken, err := token.SignedString([]byte(admin.Controller.Options.secret))
+	if err != nil {
+		return "", err
+	}
+
+	count := 0
+	for i := len(admin.Tokens) - 1; i >= 0; i-- {
+		if admin.getTokenSubject(admin.Tokens[i]) != claims.Subject {
+			continue
+		}
+		if count++; count >= maxTokens {
+			admin.Tokens = append(admin.Tokens[:i], admin.Tokens[i+1:]...)
+		}
+	}
+
+	admin.Tokens = append(admin.Tokens, sToken)
+
+	return sToken, nil
+}
+
 func (admin *Admin) ValidateToken(sToken string) bool {
+	_, ok := admin.GetTokenUser(sToken)
+
+	return ok
+}
+
+// GetTokenUser returns the user of a valid token. The role is looked up on
+// every request so that disabling a user or changing its role takes effect
+// on its current sessions.
+func (admin *Admin) GetTokenUser(sToken string) (*AdminUser, bool) {
 	found := false
 	for _, t := range admin.Tokens {
 		if t == sToken {
@@ -683,19 +1085,62 @@ func (admin *Admin) ValidateToken(sToken string) bool {
 		}
 	}
 	if !found {
-		return false
+		return nil, false
 	}
 
-	token, err := jwt.Parse(sToken, func(token *jwt.Token) (any, error) {
+	claims := &adminTokenClaims{}
+
+	token, err := jwt.ParseWithClaims(sToken, claims, func(token *jwt.Token) (any, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
 
 		return []byte(admin.Controller.Options.secret), nil
 	})
-	if err != nil {
+	if err != nil || !token.Valid {
+		return nil, false
+	}
+
+	if len(claims.Subject) == 0 {
+		return &AdminUser{Role: AdminRoleSuperadmin}, true
+	}
+
+	// openid connect admins are not users, their role comes with the token
+	if len(claims.Role) > 0 {
+		return &AdminUser{Role: claims.Role, Username: claims.Subject}, true
+	}
+
+	if user, ok := admin.Controller.Users.GetUser(claims.Subject); ok && !user.Disabled {
+		return user, true
+	}
+
+	return nil, false
+}
+
+// Authorize checks that the request carries the token of a user with at
+// least the given role, and writes the error status when it doesn't.
+func (admin *Admin) Authorize(w http.ResponseWriter, r *http.Request, role string) bool {
+	user, ok := admin.GetTokenUser(admin.GetAuthorization(r))
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+
+	if !user.HasRole(role) {
+		admin.Controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("admin: %s %s denied to user %s with role %s, ip %s", r.Method, r.URL.Path, user.Username, user.Role, GetRemoteAddr(r)))
+		w.WriteHeader(http.StatusForbidden)
 		return false
 	}
 
-	return token.Valid
+	return true
+}
+
+func (admin *Admin) getTokenSubject(sToken string) string {
+	claims := &jwt.RegisteredClaims{}
+
+	if _, _, err := jwt.NewParser().ParseUnverified(sToken, claims); err != nil {
+		return ""
+	}
+
+	return claims.Subject
 }
@@ -0,0 +1,126 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAdminPasswordResetHandler(t *testing.T) {
+	port, messages := newTestSmtpServer(t)
+
+	controller := newTestController(t, nil)
+
+	post := func(body string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/api/admin/password-reset", strings.NewReader(body))
+		controller.Admin.PasswordResetHandler(w, r)
+		return w.Code
+	}
+
+	// without an admin email nor a smtp server
+	if status := post(`{}`); status != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", status, http.StatusNotFound)
+	}
+
+	controller.Options.AdminEmail = "admin@example.com"
+	controller.Options.SmtpFrom = "scanner@example.com"
+	controller.Options.SmtpHost = "127.0.0.1"
+	controller.Options.SmtpPort = port
+	controller.Options.SmtpTls = SmtpTlsNone
+
+	token, err := controller.Admin.NewToken(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status := post(`{}`); status != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d", status, http.StatusAccepted)
+	}
+
+	message := <-messages
+	if strings.Join(message.rcpts, ",") != "admin@example.com" {
+		t.Errorf("recipients = %v", message.rcpts)
+	}
+
+	code := regexp.MustCompile(`reset code is ([A-Z2-7=]+)`).FindStringSubmatch(message.data)
+	if code == nil {
+		t.Fatalf("no code in %q", message.data)
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"no password", `{"code": "` + code[1] + `"}`, http.StatusBadRequest},
+		{"wrong code", `{"code": "AAAAAAAAAAAAAAAA", "newPassword": "new password"}`, http.StatusUnauthorized},
+		{"valid code", `{"code": " ` + strings.ToLower(code[1]) + ` ", "newPassword": "new password"}`, http.StatusOK},
+		{"used code", `{"code": "` + code[1] + `", "newPassword": "other password"}`, http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if status := post(test.body); status != test.status {
+				t.Errorf("status = %d, want %d", status, test.status)
+			}
+		})
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(controller.Options.adminPassword), []byte("new password")); err != nil {
+		t.Errorf("the admin password was not reset: %v", err)
+	}
+
+	if controller.Admin.ValidateToken(token) {
+		t.Error("the session of the admin password outlived the reset")
+	}
+}
+
+func TestAdminRedeemPasswordReset(t *testing.T) {
+	admin := NewAdmin(&Controller{})
+
+	if admin.redeemPasswordReset("") {
+		t.Fatal("redeemed without a pending reset")
+	}
+
+	admin.reset = &adminPasswordReset{expires: time.Now().Add(adminResetTtl), hash: sha256.Sum256([]byte("CODE"))}
+	for i := 0; i < adminResetAttempts; i++ {
+		if admin.redeemPasswordReset("WRONG") {
+			t.Fatal("redeemed a wrong code")
+		}
+	}
+	if admin.redeemPasswordReset("CODE") {
+		t.Error("redeemed after the wrong attempts")
+	}
+
+	admin.reset = &adminPasswordReset{expires: time.Now().Add(-time.Second), hash: sha256.Sum256([]byte("CODE"))}
+	if admin.redeemPasswordReset("CODE") {
+		t.Error("redeemed an expired code")
+	}
+
+	admin.reset = &adminPasswordReset{expires: time.Now().Add(adminResetTtl), hash: sha256.Sum256([]byte("CODE"))}
+	if !admin.redeemPasswordReset("code") {
+		t.Error("did not redeem the code")
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import "testing"
+
+func TestAlertMatchEmergency(t *testing.T) {
+	tests := []struct {
+		name    string
+		trigger string
+		call    *Call
+		want    bool
+	}{
+		{"emergency", AlertTriggerEmergency, &Call{Emergency: true}, true},
+		{"routine", AlertTriggerEmergency, &Call{}, false},
+		{"call trigger", AlertTriggerCall, &Call{}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			alert := &Alert{Trigger: test.trigger}
+
+			if _, _, ok := alert.Match(test.call, "", nil); ok != test.want {
+				t.Errorf("got %v, want %v", ok, test.want)
+			}
+		})
+	}
+}
@@ -16,12 +16,22 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"mime"
 	"mime/multipart"
 	"net/http"
+	"path"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Api struct {
@@ -32,7 +42,69 @@ func NewApi(controller *Controller) *Api {
 	return &Api{Controller: controller}
 }
 
+// CallAudioHandler serves the audio of a call on /api/call/{id}/audio, with
+// range requests so players can seek. The listeners of a restricted instance
+// pass their access code as the code query parameter or as the basic auth
+// password, or an API key with the read scope.
+func (api *Api) CallAudioHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	p := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/call/"), "/"), "/")
+	if len(p) != 2 || p[1] != "audio" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	id, err := strconv.ParseUint(p[0], 10, 64)
+	if err != nil || id == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	call, err := api.Controller.Calls.GetCall(uint(id), api.Controller.Database)
+	if errors.Is(err, ErrCallNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		api.Controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("api.callaudio: %v", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if api.Controller.Blackouts.IsBlackedOut(call) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if status := api.authorizeCall(w, r, call); status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+
+	if call.Cold {
+		api.Controller.ColdStorage.ReplyRetrieving(w, call)
+		return
+	}
+
+	if len(call.Audio) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+
+	api.serveAudio(w, r, call)
+}
+
 func (api *Api) CallUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if api.Controller.Replication.Standby() {
+		api.exitWithUploadError(w, http.StatusServiceUnavailable, "Standby instance, upload to the primary")
+		return
+	}
+
 	switch r.Method {
 	case http.MethodPost:
 		var (
@@ -42,12 +114,12 @@ func (api *Api) CallUploadHandler(w http.ResponseWriter, r *http.Request) {
 
 		mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
 		if err != nil {
-			api.exitWithError(w, http.StatusBadRequest, "Invalid content-type")
+			api.exitWithUploadError(w, http.StatusBadRequest, "Invalid content-type")
 			return
 		}
 
 		if !strings.HasPrefix(mediaType, "multipart/") {
-			api.exitWithError(w, http.StatusBadRequest, "Not a multipart content")
+			api.exitWithUploadError(w, http.StatusBadRequest, "Not a multipart content")
 			return
 		}
 
@@ -58,13 +130,13 @@ func (api *Api) CallUploadHandler(w http.ResponseWriter, r *http.Request) {
 			if err == io.EOF {
 				break
 			} else if err != nil {
-				api.exitWithError(w, http.StatusExpectationFailed, fmt.Sprintf("multipart: %s\n", err.Error()))
+				api.exitWithUploadError(w, http.StatusExpectationFailed, fmt.Sprintf("multipart: %s\n", err.Error()))
 				return
 			}
 
 			b, err := io.ReadAll(p)
 			if err != nil {
-				api.exitWithError(w, http.StatusExpectationFailed, fmt.Sprintf("ioread: %s\n", err.Error()))
+				api.exitWithUploadError(w, http.StatusExpectationFailed, fmt.Sprintf("ioread: %s\n", err.Error()))
 				return
 			}
 
@@ -77,9 +149,9 @@ func (api *Api) CallUploadHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if ok, err := call.IsValid(); ok {
-			api.HandleCall(key, call, w)
+			api.HandleCall(key, VerifiedClientCertificate(r), call, w)
 		} else {
-			api.exitWithError(w, http.StatusExpectationFailed, fmt.Sprintf("Incomplete call data: %s\n", err.Error()))
+			api.exitWithUploadError(w, http.StatusExpectationFailed, fmt.Sprintf("Incomplete call data: %s\n", err.Error()))
 		}
 
 	default:
@@ -88,20 +160,35 @@ func (api *Api) CallUploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (api *Api) HandleCall(key string, call *Call, w http.ResponseWriter) {
+// HandleCall ingests an uploaded call, the key being given the upload or the
+// downstream scope by the admin. Nothing the uploader sends decides which
+// scope applies. A verified client certificate matching a key stands for the
+// key, which is refused alone with ssl_client_cert_required.
+func (api *Api) HandleCall(key string, cert *x509.Certificate, call *Call, w http.ResponseWriter) {
 	msg := []byte(fmt.Sprintf("Invalid API key for system %v talkgroup %v.\n", call.System, call.Talkgroup))
 
-	if apikey, ok := api.Controller.Apikeys.GetApikey(key); ok {
-		if apikey.HasAccess(call) {
+	if apikey, ok := api.uploadApikey(key, cert); ok {
+		if apikey.CanUpload() && apikey.HasAccess(call) {
+			if err := api.Controller.Apikeys.Used(apikey, api.Controller.Database); err != nil {
+				api.Controller.Logs.LogEvent(LogLevelError, err.Error())
+			}
+
+			if api.Controller.Backpressure.Refuse(w) {
+				api.Controller.Metrics.CallRejected("backpressure")
+				return
+			}
+
 			api.Controller.Ingest <- call
 
 		} else {
+			api.Controller.Metrics.UploadError()
 			w.WriteHeader(http.StatusUnauthorized)
 			w.Write(msg)
 			return
 		}
 
 	} else {
+		api.Controller.Metrics.UploadError()
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write(msg)
 		return
@@ -110,7 +197,26 @@ func (api *Api) HandleCall(key string, call *Call, w http.ResponseWriter) {
 	w.Write([]byte("Call imported successfully.\n"))
 }
 
+// uploadApikey returns the key of an upload, looked up from the client
+// certificate first.
+func (api *Api) uploadApikey(key string, cert *x509.Certificate) (*Apikey, bool) {
+	if apikey, ok := api.Controller.Apikeys.GetApikeyByCertificate(cert); ok {
+		return apikey, true
+	}
+
+	if api.Controller.Config.SslClientRequire {
+		return nil, false
+	}
+
+	return api.Controller.Apikeys.GetApikey(key)
+}
+
 func (api *Api) TrunkRecorderCallUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if api.Controller.Replication.Standby() {
+		api.exitWithUploadError(w, http.StatusServiceUnavailable, "Standby instance, upload to the primary")
+		return
+	}
+
 	switch r.Method {
 	case http.MethodPost:
 		var (
@@ -120,12 +226,12 @@ func (api *Api) TrunkRecorderCallUploadHandler(w http.ResponseWriter, r *http.Re
 
 		mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
 		if err != nil {
-			api.exitWithError(w, http.StatusBadRequest, "Invalid content-type")
+			api.exitWithUploadError(w, http.StatusBadRequest, "Invalid content-type")
 			return
 		}
 
 		if !strings.HasPrefix(mediaType, "multipart/") {
-			api.exitWithError(w, http.StatusBadRequest, "Not a multipart content")
+			api.exitWithUploadError(w, http.StatusBadRequest, "Not a multipart content")
 			return
 		}
 
@@ -138,13 +244,13 @@ func (api *Api) TrunkRecorderCallUploadHandler(w http.ResponseWriter, r *http.Re
 			if err == io.EOF {
 				break
 			} else if err != nil {
-				api.exitWithError(w, http.StatusExpectationFailed, fmt.Sprintf("multipart: %s", err.Error()))
+				api.exitWithUploadError(w, http.StatusExpectationFailed, fmt.Sprintf("multipart: %s", err.Error()))
 				return
 			}
 
 			b, err := io.ReadAll(p)
 			if err != nil {
-				api.exitWithError(w, http.StatusExpectationFailed, fmt.Sprintf("ioread: %s", err.Error()))
+				api.exitWithUploadError(w, http.StatusExpectationFailed, fmt.Sprintf("ioread: %s", err.Error()))
 				return
 			}
 
@@ -153,7 +259,7 @@ func (api *Api) TrunkRecorderCallUploadHandler(w http.ResponseWriter, r *http.Re
 				key = string(b)
 			case "meta":
 				if err := ParseTrunkRecorderMeta(call, b); err != nil {
-					api.exitWithError(w, http.StatusExpectationFailed, "Invalid call data")
+					api.exitWithUploadError(w, http.StatusExpectationFailed, "Invalid call data")
 					return
 				}
 			default:
@@ -166,10 +272,10 @@ func (api *Api) TrunkRecorderCallUploadHandler(w http.ResponseWriter, r *http.Re
 		}
 
 		if ok, err := call.IsValid(); ok {
-			api.HandleCall(key, call, w)
+			api.HandleCall(key, VerifiedClientCertificate(r), call, w)
 
 		} else {
-			api.exitWithError(w, http.StatusExpectationFailed, fmt.Sprintf("Incomplete call data: %s\n", err.Error()))
+			api.exitWithUploadError(w, http.StatusExpectationFailed, fmt.Sprintf("Incomplete call data: %s\n", err.Error()))
 		}
 
 	default:
@@ -178,9 +284,412 @@ func (api *Api) TrunkRecorderCallUploadHandler(w http.ResponseWriter, r *http.Re
 	}
 }
 
+// CallsHandler lists the most recent calls the API key has access to, or
+// returns a single call with its audio when an id is given, optionally
+// trimmed to a time slice with start and length, or as the bare audio with
+// format=audio. It requires a key with the read scope, passed in the X-Api-Key header or the key query
+// parameter.
+func (api *Api) CallsHandler(w http.ResponseWriter, r *http.Request) {
+	const (
+		defaultLimit = 50
+		maxLimit     = 500
+
+		// streamed results are flushed every streamChunk calls, each flush
+		// giving the client streamWriteWait more to read
+		streamChunk     = 200
+		streamWriteWait = 30 * time.Second
+	)
+
+	switch r.Method {
+	case http.MethodGet:
+		var (
+			db    = api.Controller.Database
+			desc  = true
+			err   error
+			key   = r.Header.Get("X-Api-Key")
+			limit = defaultLimit
+			query = r.URL.Query()
+			rows  *sql.Rows
+		)
+
+		if len(key) == 0 {
+			key = query.Get("key")
+		}
+
+		apikey, ok := api.Controller.Apikeys.GetApikey(key)
+		if !ok || !apikey.HasScope(ApikeyScopeRead) {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("Invalid API key.\n"))
+			return
+		}
+
+		if err = api.Controller.Apikeys.Used(apikey, db); err != nil {
+			api.Controller.Logs.LogEvent(LogLevelError, err.Error())
+		}
+
+		if i, err := strconv.Atoi(query.Get("id")); err == nil && i > 0 {
+			call, err := api.Controller.Calls.GetCall(uint(i), db)
+			if err != nil || !apikey.HasAccess(call) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			if call.Cold {
+				api.Controller.ColdStorage.ReplyRetrieving(w, call)
+				return
+			}
+
+			if len(query.Get("start")) > 0 || len(query.Get("length")) > 0 {
+				if status, err := api.sliceCall(call, query.Get("start"), query.Get("length")); err != nil {
+					w.WriteHeader(status)
+					w.Write([]byte(fmt.Sprintf("%v\n", err)))
+					return
+				}
+			}
+
+			if query.Get("format") == "audio" {
+				api.serveAudio(w, r, call)
+				return
+			}
+
+			if b, err := json.Marshal(call); err == nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write(b)
+			} else {
+				w.WriteHeader(http.StatusExpectationFailed)
+			}
+			return
+		}
+
+		q := db.Select("rdioScannerCalls", "id", "dateTime", "duration", "system", "talkgroup", "transcript").Where(apikey.sqlCondition())
+
+		if i, err := strconv.Atoi(query.Get("system")); err == nil && i > 0 {
+			q.Where(SqlWhere("`system` = ?", i))
+		}
+
+		if i, err := strconv.Atoi(query.Get("talkgroup")); err == nil && i > 0 {
+			q.Where(SqlWhere("`talkgroup` = ?", i))
+		}
+
+		if unit := searchUnit(query.Get("unit")); unit != nil {
+			system, _ := strconv.Atoi(query.Get("system"))
+			if system < 0 {
+				system = 0
+			}
+			q.Where(api.Controller.Systems.sqlUnitCondition(unit, uint(system)))
+		}
+
+		for _, bound := range []struct {
+			param string
+			op    string
+		}{
+			{"after", ">"},
+			{"before", "<"},
+		} {
+			if v := query.Get(bound.param); len(v) > 0 {
+				if t, err := time.Parse(time.RFC3339, v); err == nil {
+					q.Where(SqlWhere(fmt.Sprintf("`dateTime` %s ?", bound.op), t))
+				} else {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+			}
+		}
+
+		if query.Get("sort") == "asc" {
+			desc = false
+		}
+
+		// exports stream the calls as newline delimited json, one call per
+		// line as they are read, without the limit of the regular listing
+		stream := query.Get("format") == "ndjson" || strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+
+		if i, err := strconv.Atoi(query.Get("limit")); err == nil && i > 0 {
+			if stream {
+				limit = i
+			} else {
+				limit = int(math.Min(float64(i), maxLimit))
+			}
+		} else if stream {
+			limit = 0
+		}
+
+		q.OrderBy("dateTime", desc)
+		if limit > 0 {
+			q.Limit(uint(limit))
+		}
+
+		if rows, err = q.Query(); err != nil {
+			api.Controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("api.calls: %v", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		var (
+			count   int
+			encoder *json.Encoder
+			flusher http.Flusher
+			results = []CallsSearchResult{}
+		)
+
+		if stream {
+			encoder = json.NewEncoder(w)
+			flusher, _ = w.(http.Flusher)
+
+			extendWriteDeadline(r, streamWriteWait)
+
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(http.StatusOK)
+		}
+
+		for rows.Next() {
+			var (
+				dateTime   any
+				duration   sql.NullFloat64
+				result     = CallsSearchResult{}
+				transcript sql.NullString
+			)
+
+			if err = rows.Scan(&result.Id, &dateTime, &duration, &result.System, &result.Talkgroup, &transcript); err != nil {
+				break
+			}
+
+			if result.DateTime, err = db.ParseDateTime(dateTime); err != nil {
+				err = nil
+				continue
+			}
+
+			if duration.Valid && duration.Float64 > 0 {
+				result.Duration = duration.Float64 / 1000
+			}
+
+			if transcript.Valid {
+				result.Transcript = transcript.String
+			}
+
+			if !stream {
+				results = append(results, result)
+				continue
+			}
+
+			if err = encoder.Encode(result); err != nil {
+				break
+			}
+
+			if count++; count%streamChunk == 0 {
+				extendWriteDeadline(r, streamWriteWait)
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+		}
+
+		rows.Close()
+
+		if stream {
+			// the status is sent already, a failure ends the stream early
+			if err != nil {
+				api.Controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("api.calls: stream ended after %d calls: %v", count, err))
+			}
+			return
+		}
+
+		if err != nil {
+			api.Controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("api.calls: %v", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if b, err := json.Marshal(results); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Unsupported method\n"))
+	}
+}
+
+// authorizeCall tells whether the request may get the call, returning the
+// http status to reply with. The access codes count against the login rate
+// limit as on the websocket, the Retry-After header being set when locked.
+func (api *Api) authorizeCall(w http.ResponseWriter, r *http.Request, call *Call) int {
+	controller := api.Controller
+
+	key := r.Header.Get("X-Api-Key")
+	if len(key) == 0 {
+		key = r.URL.Query().Get("key")
+	}
+
+	if len(key) > 0 {
+		apikey, ok := controller.Apikeys.GetApikey(key)
+		if !ok || !apikey.HasScope(ApikeyScopeRead) {
+			return http.StatusUnauthorized
+		}
+
+		if err := controller.Apikeys.Used(apikey, controller.Database); err != nil {
+			controller.Logs.LogEvent(LogLevelError, err.Error())
+		}
+
+		if !apikey.HasAccess(call) {
+			return http.StatusNotFound
+		}
+
+		return http.StatusOK
+	}
+
+	if !controller.Accesses.IsRestricted() {
+		return http.StatusOK
+	}
+
+	code := r.URL.Query().Get("code")
+	if _, password, ok := r.BasicAuth(); ok {
+		code = password
+	}
+
+	if len(code) == 0 {
+		return http.StatusUnauthorized
+	}
+
+	remoteAddr := GetRemoteAddr(r)
+
+	if ok, wait := controller.Logins.Allow(LoginKindAccess, remoteAddr); !ok {
+		loginRetryAfter(w, wait)
+		return http.StatusTooManyRequests
+	}
+
+	access, ok := controller.GetListenerAccess(code)
+	if !ok || access.HasExpired() {
+		if locked, until := controller.Logins.Fail(LoginKindAccess, remoteAddr); locked {
+			controller.Logs.LogEvent(LogLevelWarn, loginLockedMessage(LoginKindAccess, remoteAddr, until))
+		}
+		return http.StatusUnauthorized
+	}
+
+	controller.Logins.Succeed(LoginKindAccess, remoteAddr)
+
+	if !access.HasAccess(call) {
+		return http.StatusNotFound
+	}
+
+	// a direct link is a download, which the tier may not allow
+	if tier, ok := controller.Tiers.GetTier(access.Tier); ok {
+		if !tier.IsAvailable(call) {
+			return http.StatusNotFound
+		}
+		if !tier.Download {
+			return http.StatusForbidden
+		}
+	}
+
+	return http.StatusOK
+}
+
 func (api *Api) exitWithError(w http.ResponseWriter, status int, message string) {
 	api.Controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("api: %s", message))
 
 	w.WriteHeader(status)
 	w.Write([]byte(fmt.Sprintf("%s\n", message)))
 }
+
+// exitWithUploadError refuses an upload, counted by the upload errors of
+// the metrics.
+func (api *Api) exitWithUploadError(w http.ResponseWriter, status int, message string) {
+	api.Controller.Metrics.UploadError()
+
+	api.exitWithError(w, status, message)
+}
+
+// serveAudio writes the audio of the call, answering the range and the
+// conditional requests on its etag.
+func (api *Api) serveAudio(w http.ResponseWriter, r *http.Request, call *Call) {
+	if audioType, ok := call.AudioType.(string); ok && len(audioType) > 0 {
+		w.Header().Set("Content-Type", audioType)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+
+	name := ""
+	if audioName, ok := call.AudioName.(string); ok && len(audioName) > 0 {
+		name = audioName
+		w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", audioName))
+	}
+
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sha256.Sum224(call.Audio)))
+
+	http.ServeContent(w, r, name, call.DateTime, bytes.NewReader(call.Audio))
+}
+
+// sliceCall trims the audio of the call to the time slice given in seconds,
+// a negative start counting from the end of the call, ie: start=-20 for the
+// last 20 seconds. The slice lasts until the end of the call unless a length
+// is given. It returns the http status to reply with on error.
+func (api *Api) sliceCall(call *Call, start string, length string) (int, error) {
+	var (
+		from     float64
+		duration = call.Duration
+		ffmpeg   = api.Controller.FFMpeg
+		options  = api.Controller.Options
+		to       time.Duration
+	)
+
+	if len(start) > 0 {
+		f, err := strconv.ParseFloat(start, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return http.StatusBadRequest, fmt.Errorf("invalid start %q", start)
+		}
+		from = f
+	}
+
+	if duration <= 0 {
+		d, err := ffmpeg.Duration(call.Audio)
+		if err != nil {
+			return http.StatusServiceUnavailable, err
+		}
+		duration = d
+	}
+
+	offset := time.Duration(from * float64(time.Second))
+	if offset < 0 {
+		offset += duration
+		if offset < 0 {
+			offset = 0
+		}
+	}
+
+	to = duration
+
+	if len(length) > 0 {
+		f, err := strconv.ParseFloat(length, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) || f <= 0 {
+			return http.StatusBadRequest, fmt.Errorf("invalid length %q", length)
+		}
+		if d := offset + time.Duration(f*float64(time.Second)); d < to {
+			to = d
+		}
+	}
+
+	if offset >= to {
+		return http.StatusRequestedRangeNotSatisfiable, fmt.Errorf("start beyond the %.1f seconds of the call", duration.Seconds())
+	}
+
+	audio, audioType, ext, err := ffmpeg.Slice(call.Audio, offset, to-offset, options.AudioCodec, options.AudioBitrate)
+	if err != nil {
+		return http.StatusServiceUnavailable, err
+	}
+
+	call.Audio = audio
+	call.AudioType = audioType
+
+	switch v := call.AudioName.(type) {
+	case string:
+		call.AudioName = fmt.Sprintf("%v%s", strings.TrimSuffix(v, path.Ext(v)), ext)
+	}
+
+	call.Slice(offset, to)
+
+	return http.StatusOK, nil
+}
@@ -16,22 +16,43 @@
 package main
 
 import (
+	"crypto/x509"
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+const (
+	ApikeyScopeDownstream = "downstream"
+	ApikeyScopeRead       = "read"
+	ApikeyScopeUpload     = "upload"
+)
+
+// the last use of a key is saved at most once per period
+const apikeyLastUsedPeriod = time.Minute
+
+// Apikey is the key of a recorder or of an upstream instance. The
+// certificate, the common name or the SHA-256 fingerprint of a client
+// certificate verified by the ssl listener, stands for the key itself.
 type Apikey struct {
-	Id       any    `json:"_id"`
-	Disabled bool   `json:"disabled"`
-	Ident    string `json:"ident"`
-	Key      string `json:"key"`
-	Order    any    `json:"order"`
-	Systems  any    `json:"systems"`
+	Id          any    `json:"_id"`
+	Certificate string `json:"certificate"`
+	Disabled    bool   `json:"disabled"`
+	Ident       string `json:"ident"`
+	Key         string `json:"key"`
+	LastUsed    any    `json:"lastUsed"`
+	Order       any    `json:"order"`
+	Revoked     any    `json:"revoked"`
+	Scopes      any    `json:"scopes"`
+	Systems     any    `json:"systems"`
+	saved       time.Time
 }
 
 func (apikey *Apikey) FromMap(m map[string]any) *Apikey {
@@ -40,6 +61,11 @@ func (apikey *Apikey) FromMap(m map[string]any) *Apikey {
 		apikey.Id = uint(v)
 	}
 
+	switch v := m["certificate"].(type) {
+	case string:
+		apikey.Certificate = strings.TrimSpace(v)
+	}
+
 	switch v := m["disabled"].(type) {
 	case bool:
 		apikey.Disabled = v
@@ -60,6 +86,18 @@ func (apikey *Apikey) FromMap(m map[string]any) *Apikey {
 		apikey.Order = uint(v)
 	}
 
+	switch v := m["scopes"].(type) {
+	case []any:
+		scopes := []any{}
+		for _, scope := range v {
+			switch scope {
+			case ApikeyScopeDownstream, ApikeyScopeRead, ApikeyScopeUpload:
+				scopes = append(scopes, scope)
+			}
+		}
+		apikey.Scopes = scopes
+	}
+
 	switch v := m["systems"].(type) {
 	case []any:
 		if b, err := json.Marshal(v); err == nil {
@@ -110,6 +148,37 @@ func (apikey *Apikey) HasAccess(call *Call) bool {
 	return false
 }
 
+// HasScope tells whether the key can be used for the operation. Keys without
+// scopes predate them and keep working for uploads, from recorders as well as
+// from downstream instances.
+func (apikey *Apikey) HasScope(scope string) bool {
+	switch v := apikey.Scopes.(type) {
+	case []any:
+		if len(v) > 0 {
+			for _, f := range v {
+				if f == scope {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	return scope != ApikeyScopeRead
+}
+
+// CanUpload tells whether the key may upload calls, either from a recorder
+// or relayed by an upstream instance.
+func (apikey *Apikey) CanUpload() bool {
+	return apikey.HasScope(ApikeyScopeUpload) || apikey.HasScope(ApikeyScopeDownstream)
+}
+
+// sqlCondition restricts a query on the calls to the systems and
+// talkgroups the key gives access to.
+func (apikey *Apikey) sqlCondition() *SqlCondition {
+	return sqlScope(apikey.Systems)
+}
+
 type Apikeys struct {
 	List  []*Apikey
 	mutex sync.Mutex
@@ -126,6 +195,8 @@ func (apikeys *Apikeys) FromMap(f []any) *Apikeys {
 	apikeys.mutex.Lock()
 	defer apikeys.mutex.Unlock()
 
+	previous := apikeys.List
+
 	apikeys.List = []*Apikey{}
 
 	for _, r := range f {
@@ -133,6 +204,17 @@ func (apikeys *Apikeys) FromMap(f []any) *Apikeys {
 		case map[string]any:
 			apikey := &Apikey{}
 			apikey.FromMap(m)
+
+			// usage and revocation are not edited from the config
+			for _, p := range previous {
+				if p.Id != nil && p.Id == apikey.Id {
+					apikey.LastUsed = p.LastUsed
+					apikey.Revoked = p.Revoked
+					apikey.saved = p.saved
+					break
+				}
+			}
+
 			apikeys.List = append(apikeys.List, apikey)
 		}
 	}
@@ -145,20 +227,80 @@ func (apikeys *Apikeys) GetApikey(key string) (apikey *Apikey, ok bool) {
 	defer apikeys.mutex.Unlock()
 
 	for _, apikey := range apikeys.List {
-		if apikey.Key == key && !apikey.Disabled {
+		if apikey.Key == key && !apikey.Disabled && apikey.Revoked == nil {
 			return apikey, true
 		}
 	}
 	return nil, false
 }
 
+// GetApikeyByCertificate returns the key the client certificate stands for,
+// matched on its common name or on its SHA-256 fingerprint. The certificate
+// must have been verified against the client CA beforehand.
+func (apikeys *Apikeys) GetApikeyByCertificate(cert *x509.Certificate) (apikey *Apikey, ok bool) {
+	if cert == nil {
+		return nil, false
+	}
+
+	fingerprint := CertificateFingerprint(cert)
+
+	apikeys.mutex.Lock()
+	defer apikeys.mutex.Unlock()
+
+	for _, apikey := range apikeys.List {
+		if len(apikey.Certificate) == 0 || apikey.Disabled || apikey.Revoked != nil {
+			continue
+		}
+
+		if apikey.Certificate == cert.Subject.CommonName || normalizeFingerprint(apikey.Certificate) == fingerprint {
+			return apikey, true
+		}
+	}
+	return nil, false
+}
+
+// Revoke permanently invalidates the key, which unlike a disabled key can't
+// be enabled back.
+func (apikeys *Apikeys) Revoke(id uint, db *Database) (*Apikey, error) {
+	var apikey *Apikey
+
+	apikeys.mutex.Lock()
+
+	for _, a := range apikeys.List {
+		if a.Id == id {
+			apikey = a
+			break
+		}
+	}
+
+	if apikey == nil {
+		apikeys.mutex.Unlock()
+		return nil, nil
+	}
+
+	apikey.Disabled = true
+	apikey.Revoked = time.Now().UTC()
+
+	apikeys.mutex.Unlock()
+
+	if err := apikeys.Write(db); err != nil {
+		return nil, fmt.Errorf("apikeys.revoke: %v", err)
+	}
+
+	return apikey, nil
+}
+
 func (apikeys *Apikeys) Read(db *Database) error {
 	var (
-		err     error
-		id      sql.NullFloat64
-		order   sql.NullFloat64
-		rows    *sql.Rows
-		systems string
+		certificate sql.NullString
+		err         error
+		id          sql.NullFloat64
+		lastUsed    any
+		order       sql.NullFloat64
+		revoked     any
+		rows        *sql.Rows
+		scopes      sql.NullString
+		systems     string
 	)
 
 	apikeys.mutex.Lock()
@@ -170,17 +312,37 @@ func (apikeys *Apikeys) Read(db *Database) error {
 		return fmt.Errorf("apikeys.read: %v", err)
 	}
 
-	if rows, err = db.Sql.Query("select `_id`, `disabled`, `ident`, `key`, `order`, `systems` from `rdioScannerApiKeys`"); err != nil {
+	if rows, err = db.Sql.Query("select `_id`, `certificate`, `disabled`, `ident`, `key`, `lastUsed`, `order`, `revoked`, `scopes`, `systems` from `rdioScannerApiKeys`"); err != nil {
 		return formatError(err)
 	}
 
 	for rows.Next() {
 		apikey := &Apikey{}
 
-		if err = rows.Scan(&id, &apikey.Disabled, &apikey.Ident, &apikey.Key, &order, &systems); err != nil {
+		if err = rows.Scan(&id, &certificate, &apikey.Disabled, &apikey.Ident, &apikey.Key, &lastUsed, &order, &revoked, &scopes, &systems); err != nil {
 			break
 		}
 
+		if certificate.Valid {
+			apikey.Certificate = certificate.String
+		}
+
+		if t, err := db.ParseDateTime(lastUsed); err == nil {
+			apikey.LastUsed = t
+			apikey.saved = t
+		}
+
+		if t, err := db.ParseDateTime(revoked); err == nil {
+			apikey.Revoked = t
+		}
+
+		if scopes.Valid && len(scopes.String) > 0 {
+			var f any
+			if err := json.Unmarshal([]byte(scopes.String), &f); err == nil {
+				apikey.Scopes = f
+			}
+		}
+
 		if id.Valid && id.Float64 > 0 {
 			apikey.Id = uint(id.Float64)
 		}
@@ -213,12 +375,37 @@ func (apikeys *Apikeys) Read(db *Database) error {
 	return nil
 }
 
+// Used records the last use of the key.
+func (apikeys *Apikeys) Used(apikey *Apikey, db *Database) error {
+	apikeys.mutex.Lock()
+
+	now := time.Now().UTC()
+
+	apikey.LastUsed = now
+
+	if now.Sub(apikey.saved) < apikeyLastUsedPeriod {
+		apikeys.mutex.Unlock()
+		return nil
+	}
+
+	apikey.saved = now
+
+	apikeys.mutex.Unlock()
+
+	if _, err := db.Sql.Exec("update `rdioScannerApiKeys` set `lastUsed` = ? where `_id` = ?", now, apikey.Id); err != nil {
+		return fmt.Errorf("apikeys.used: %v", err)
+	}
+
+	return nil
+}
+
 func (apikeys *Apikeys) Write(db *Database) error {
 	var (
 		count   uint
 		err     error
 		rows    *sql.Rows
 		rowIds  = []uint{}
+		scopes  any
 		systems any
 	)
 
@@ -257,37 +444,45 @@ func (apikeys *Apikeys) Write(db *Database) error {
 	}
 
 	if len(rowIds) > 0 {
-		// Build parameterized IN clause to prevent SQL injection
-		placeholders := make([]string, len(rowIds))
-		args := make([]any, len(rowIds))
-		for i, id := range rowIds {
-			placeholders[i] = "?"
-			args[i] = id
-		}
-		q := fmt.Sprintf("delete from `rdioScannerApikeys` where `_id` in (%s)", strings.Join(placeholders, ","))
-		if _, err = db.Sql.Exec(q, args...); err != nil {
+		if _, err = db.Delete("rdioScannerApiKeys").Where(SqlIn("_id", rowIds)).Exec(); err != nil {
 			return formatError(err)
 		}
 	}
 
 	for _, apikey := range apikeys.List {
-		switch apikey.Systems {
-		case "*":
-			systems = `"*"`
+		switch v := apikey.Systems.(type) {
+		case []any:
+			if b, err := json.Marshal(v); err == nil {
+				systems = string(b)
+			}
+		case string:
+			if v == "*" {
+				systems = `"*"`
+			} else {
+				systems = v
+			}
 		default:
 			systems = apikey.Systems
 		}
 
+		scopes = nil
+		switch v := apikey.Scopes.(type) {
+		case []any:
+			if b, err := json.Marshal(v); err == nil {
+				scopes = string(b)
+			}
+		}
+
 		if err = db.Sql.QueryRow("select count(*) from `rdioScannerApiKeys` where `_id` = ?", apikey.Id).Scan(&count); err != nil {
 			break
 		}
 
 		if count == 0 {
-			if _, err = db.Sql.Exec("insert into `rdioScannerApiKeys` (`_id`, `disabled`, `ident`, `key`, `order`, `systems`) values (?, ?, ?, ?, ?, ?)", apikey.Id, apikey.Disabled, apikey.Ident, apikey.Key, apikey.Order, systems); err != nil {
+			if _, err = db.Sql.Exec("insert into `rdioScannerApiKeys` (`_id`, `certificate`, `disabled`, `ident`, `key`, `order`, `revoked`, `scopes`, `systems`) values (?, ?, ?, ?, ?, ?, ?, ?, ?)", apikey.Id, apikey.Certificate, apikey.Disabled, apikey.Ident, apikey.Key, apikey.Order, apikey.Revoked, scopes, systems); err != nil {
 				break
 			}
 
-		} else if _, err = db.Sql.Exec("update `rdioScannerApiKeys` set `_id` = ?, `disabled` = ?, `ident` = ?, `key` = ?, `order` = ?, `systems` = ? where `_id` = ?", apikey.Id, apikey.Disabled, apikey.Ident, apikey.Key, apikey.Order, systems, apikey.Id); err != nil {
+		} else if _, err = db.Sql.Exec("update `rdioScannerApiKeys` set `_id` = ?, `certificate` = ?, `disabled` = ?, `ident` = ?, `key` = ?, `order` = ?, `revoked` = ?, `scopes` = ?, `systems` = ? where `_id` = ?", apikey.Id, apikey.Certificate, apikey.Disabled, apikey.Ident, apikey.Key, apikey.Order, apikey.Revoked, scopes, systems, apikey.Id); err != nil {
 			break
 		}
 	}
@@ -298,3 +493,102 @@ func (apikeys *Apikeys) Write(db *Database) error {
 
 	return nil
 }
+
+func (admin *Admin) ApikeysHandler(w http.ResponseWriter, r *http.Request) {
+	if !admin.Authorize(w, r, adminWriteRole(r)) {
+		return
+	}
+
+	apikeys := admin.Controller.Apikeys
+	logs := admin.Controller.Logs
+
+	switch r.Method {
+	case http.MethodDelete:
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil || id < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		apikey, err := apikeys.Revoke(uint(id), admin.Controller.Database)
+		if err != nil {
+			logs.LogEvent(LogLevelError, err.Error())
+			w.WriteHeader(http.StatusExpectationFailed)
+			return
+		}
+
+		if apikey == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		logs.LogEvent(LogLevelWarn, fmt.Sprintf("apikey: %s revoked by admin from ip %s", apikey.Ident, GetRemoteAddr(r)))
+
+		admin.BroadcastConfig()
+
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodGet:
+		apikeys.mutex.Lock()
+		b, err := json.Marshal(apikeys.List)
+		apikeys.mutex.Unlock()
+
+		if err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+
+	case http.MethodPost:
+		m := map[string]any{}
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		apikey := (&Apikey{}).FromMap(m)
+		apikey.Id = nil
+		apikey.Key = uuid.New().String()
+
+		if len(apikey.Ident) == 0 || apikey.Systems == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		apikeys.mutex.Lock()
+		apikey.Order = uint(len(apikeys.List) + 1)
+		apikeys.List = append(apikeys.List, apikey)
+		apikeys.mutex.Unlock()
+
+		if err := apikeys.Write(admin.Controller.Database); err != nil {
+			logs.LogEvent(LogLevelError, err.Error())
+			w.WriteHeader(http.StatusExpectationFailed)
+			return
+		}
+
+		if err := apikeys.Read(admin.Controller.Database); err != nil {
+			logs.LogEvent(LogLevelError, err.Error())
+			w.WriteHeader(http.StatusExpectationFailed)
+			return
+		}
+
+		logs.LogEvent(LogLevelInfo, fmt.Sprintf("apikey: %s created by admin from ip %s", apikey.Ident, GetRemoteAddr(r)))
+
+		admin.BroadcastConfig()
+
+		if created, ok := apikeys.GetApikey(apikey.Key); ok {
+			apikey = created
+		}
+
+		if b, err := json.Marshal(apikey); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
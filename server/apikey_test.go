@@ -0,0 +1,48 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import "testing"
+
+func TestApikeyScopes(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes any
+		read   bool
+		upload bool
+	}{
+		{"no scopes", nil, false, true},
+		{"empty scopes", []any{}, false, true},
+		{"read", []any{ApikeyScopeRead}, true, false},
+		{"upload", []any{ApikeyScopeUpload}, false, true},
+		{"downstream", []any{ApikeyScopeDownstream}, false, true},
+		{"read and upload", []any{ApikeyScopeRead, ApikeyScopeUpload}, true, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			apikey := &Apikey{Scopes: test.scopes}
+
+			if got := apikey.HasScope(ApikeyScopeRead); got != test.read {
+				t.Errorf("read scope is %v, want %v", got, test.read)
+			}
+
+			if got := apikey.CanUpload(); got != test.upload {
+				t.Errorf("upload is %v, want %v", got, test.upload)
+			}
+		})
+	}
+}
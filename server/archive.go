@@ -0,0 +1,675 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ArchiveFormatTar = "tar"
+	ArchiveFormatZip = "zip"
+)
+
+const (
+	archiveBatch    = 100
+	archiveManifest = "manifest.csv"
+	archivePrefix   = "rdio-scanner-archive-"
+	archiveS3Prefix = "archives/"
+
+	// the archives are removed from the archive directory past the retention
+	archiveRetention = 7 * 24 * time.Hour
+)
+
+var archiveManifestColumns = []string{"file", "id", "dateTime", "duration", "system", "systemLabel", "talkgroup", "talkgroupLabel", "talkgroupName", "site", "frequency", "source", "emergency", "encrypted", "sha256", "transcript"}
+
+var archiveNameRegexp = regexp.MustCompile(`^` + archivePrefix + `[0-9]+\.(tar|zip)$`)
+
+// Archives writes the audio of the calls of a system over a date range, some
+// talkgroups only if asked, to a zip or a tar file along with a csv manifest
+// of their metadata, for the public records requests and the offline
+// analysis. The archives are written by a job to the archive directory, to be
+// downloaded by the admins, and uploaded to the s3 bucket when asked.
+type Archives struct {
+	Controller *Controller
+}
+
+type ArchiveFile struct {
+	CreatedAt time.Time `json:"createdAt"`
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+}
+
+// ArchiveRequest is what an archive holds, the payload of its job.
+type ArchiveRequest struct {
+	Format     string    `json:"format"`
+	From       time.Time `json:"from"`
+	S3         bool      `json:"s3"`
+	System     uint      `json:"system"`
+	Talkgroups []uint    `json:"talkgroups"`
+	To         time.Time `json:"to"`
+}
+
+// Payload returns the request as the payload of a job.
+func (request *ArchiveRequest) Payload() (map[string]any, error) {
+	m := map[string]any{}
+
+	b, err := json.Marshal(request)
+	if err == nil {
+		err = json.Unmarshal(b, &m)
+	}
+
+	return m, err
+}
+
+// Validate checks the request, the format defaulting to zip.
+func (request *ArchiveRequest) Validate(config *Config) error {
+	switch request.Format {
+	case "":
+		request.Format = ArchiveFormatZip
+	case ArchiveFormatTar, ArchiveFormatZip:
+	default:
+		return fmt.Errorf("unknown format %q", request.Format)
+	}
+
+	if request.System == 0 {
+		return errors.New("no system")
+	}
+
+	if request.From.IsZero() || request.To.IsZero() || !request.From.Before(request.To) {
+		return errors.New("invalid date range")
+	}
+
+	if request.S3 && !config.ArchiveS3 {
+		return errors.New("archive_s3 is not set")
+	}
+
+	return nil
+}
+
+func (request *ArchiveRequest) sqlCondition() *SqlCondition {
+	conditions := []*SqlCondition{
+		SqlWhere("`system` = ?", request.System),
+		SqlWhere("`dateTime` >= ?", request.From.UTC()),
+		SqlWhere("`dateTime` < ?", request.To.UTC()),
+	}
+
+	if len(request.Talkgroups) > 0 {
+		conditions = append(conditions, SqlIn("talkgroup", request.Talkgroups))
+	}
+
+	return SqlAnd(conditions...)
+}
+
+func NewArchives(controller *Controller) *Archives {
+	return &Archives{Controller: controller}
+}
+
+func (archives *Archives) Enabled() bool {
+	return len(archives.Controller.Config.ArchiveDir) > 0
+}
+
+// Archive writes the archive of the request under the name to the archive
+// directory, and returns how many calls it holds.
+func (archives *Archives) Archive(request *ArchiveRequest, name string, cancel <-chan struct{}) (int, error) {
+	var (
+		config = archives.Controller.Config
+		count  int
+		writer archiveWriter
+	)
+
+	formatError := func(err error) error {
+		return fmt.Errorf("archives.archive: %v", err)
+	}
+
+	if !archives.Enabled() {
+		return 0, formatError(errors.New("no archive directory configured"))
+	}
+
+	f, err := os.CreateTemp(config.GetArchiveDirPath(), ".archive-*")
+	if err != nil {
+		return 0, formatError(err)
+	}
+
+	tmp := f.Name()
+
+	switch request.Format {
+	case ArchiveFormatTar:
+		writer = &archiveTar{tar.NewWriter(f)}
+	default:
+		writer = &archiveZip{zip.NewWriter(f)}
+	}
+
+	count, err = archives.write(writer, request, cancel)
+
+	if cerr := writer.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(config.GetArchiveDirPath(), name))
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return 0, formatError(err)
+	}
+
+	if request.S3 {
+		if err = archives.upload(name); err != nil {
+			return count, formatError(err)
+		}
+	}
+
+	return count, nil
+}
+
+// ArchiveJob writes the archive asked by an admin, named after its job.
+func (archives *Archives) ArchiveJob(job *Job, cancel <-chan struct{}) error {
+	var request ArchiveRequest
+
+	b, err := json.Marshal(job.Payload)
+	if err == nil {
+		err = json.Unmarshal(b, &request)
+	}
+	if err == nil {
+		err = request.Validate(archives.Controller.Config)
+	}
+	if err != nil {
+		return fmt.Errorf("archives.job: %v", err)
+	}
+
+	if err = archives.prune(); err != nil {
+		archives.Controller.Logs.LogEvent(LogLevelError, err.Error())
+	}
+
+	start := time.Now()
+
+	name := fmt.Sprintf("%s%v.%s", archivePrefix, job.Id, request.Format)
+
+	count, err := archives.Archive(&request, name, cancel)
+	if err != nil {
+		return err
+	}
+
+	archives.Controller.Logs.LogEvent(LogLevelInfo, fmt.Sprintf("archive: %s of %d calls written in %v", name, count, time.Since(start).Round(time.Second)))
+
+	return nil
+}
+
+// List returns the archives of the archive directory, the most recent first.
+func (archives *Archives) List() ([]ArchiveFile, error) {
+	l := []ArchiveFile{}
+
+	if !archives.Enabled() {
+		return l, nil
+	}
+
+	entries, err := os.ReadDir(archives.Controller.Config.GetArchiveDirPath())
+	if err != nil {
+		return nil, fmt.Errorf("archives.list: %v", err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !archiveNameRegexp.MatchString(entry.Name()) {
+			continue
+		}
+
+		fi, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		l = append(l, ArchiveFile{CreatedAt: fi.ModTime(), Name: entry.Name(), Size: fi.Size()})
+	}
+
+	sort.Slice(l, func(i int, j int) bool {
+		return l[i].CreatedAt.After(l[j].CreatedAt)
+	})
+
+	return l, nil
+}
+
+// audio returns the audio of the call, read in place from the cold storage.
+func (archives *Archives) audio(id uint, call *Call) ([]byte, error) {
+	if !call.Cold {
+		return call.Audio, nil
+	}
+
+	return archives.Controller.ColdStorage.Audio(id)
+}
+
+// prune removes the archives past the retention.
+func (archives *Archives) prune() error {
+	l, err := archives.List()
+	if err != nil {
+		return fmt.Errorf("archives.prune: %v", err)
+	}
+
+	for _, archive := range l {
+		if time.Since(archive.CreatedAt) > archiveRetention {
+			if err := os.Remove(filepath.Join(archives.Controller.Config.GetArchiveDirPath(), archive.Name)); err != nil {
+				return fmt.Errorf("archives.prune: %v", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (archives *Archives) upload(name string) error {
+	store, err := NewS3AudioStore(archives.Controller.Config)
+	if err != nil {
+		return err
+	}
+
+	return store.PutFile(archiveS3Prefix+name, filepath.Join(archives.Controller.Config.GetArchiveDirPath(), name), mime.TypeByExtension(path.Ext(name)))
+}
+
+// write adds the audio of the calls to the archive by batches, the manifest
+// coming last.
+func (archives *Archives) write(writer archiveWriter, request *ArchiveRequest, cancel <-chan struct{}) (int, error) {
+	var (
+		controller = archives.Controller
+		count      int
+		db         = controller.Database
+		last       uint
+		manifest   = &strings.Builder{}
+	)
+
+	cw := csv.NewWriter(manifest)
+	cw.Write(archiveManifestColumns)
+
+	for {
+		ids := []uint{}
+
+		rows, err := db.Select("rdioScannerCalls", "id").Where(request.sqlCondition(), SqlWhere("`id` > ?", last)).OrderBy("id", false).Limit(archiveBatch).Query()
+		if err != nil {
+			return count, err
+		}
+
+		for rows.Next() {
+			var id uint
+			if err = rows.Scan(&id); err != nil {
+				break
+			}
+			ids = append(ids, id)
+		}
+
+		rows.Close()
+
+		if err != nil {
+			return count, err
+		}
+
+		if len(ids) == 0 {
+			break
+		}
+
+		for _, id := range ids {
+			select {
+			case <-cancel:
+				return count, errors.New("canceled")
+			default:
+			}
+
+			call, err := controller.Calls.GetCall(id, db)
+			if errors.Is(err, ErrCallNotFound) {
+				continue
+			} else if err != nil {
+				return count, err
+			}
+
+			var (
+				file string
+				hash string
+			)
+
+			// the calls of which the audio can't be read are listed without
+			// a file, rather than failing the whole archive
+			if audio, err := archives.audio(id, call); err == nil && len(audio) > 0 {
+				file = archives.fileName(call)
+
+				sum := sha256.Sum256(audio)
+				hash = hex.EncodeToString(sum[:])
+
+				if err = writer.Add(file, audio, call.DateTime, false); err != nil {
+					return count, err
+				}
+
+			} else if err != nil {
+				controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("archive: call %d without audio, %v", id, err))
+			}
+
+			cw.Write(archives.manifestRow(call, file, hash))
+
+			count++
+		}
+
+		last = ids[len(ids)-1]
+	}
+
+	cw.Flush()
+
+	if err := cw.Error(); err != nil {
+		return count, err
+	}
+
+	return count, writer.Add(archiveManifest, []byte(manifest.String()), time.Now(), true)
+}
+
+// fileName names the audio of the call after its date, its system, its
+// talkgroup and its id, ie: 20221014-153000_1-county_10-fd_4242.m4a.
+func (archives *Archives) fileName(call *Call) string {
+	parts := []string{call.DateTime.UTC().Format("20060102-150405")}
+
+	systemPart := strconv.Itoa(int(call.System))
+	talkgroupPart := strconv.Itoa(int(call.Talkgroup))
+
+	if system, ok := archives.Controller.Systems.GetSystem(call.System); ok {
+		if s := archiveSlug(system.Label); len(s) > 0 {
+			systemPart += "-" + s
+		}
+
+		if talkgroup, ok := system.Talkgroups.GetSiteTalkgroup(call.Talkgroup, call.Site); ok {
+			if s := archiveSlug(talkgroup.Label); len(s) > 0 {
+				talkgroupPart += "-" + s
+			}
+		}
+	}
+
+	parts = append(parts, systemPart, talkgroupPart, fmt.Sprint(call.Id))
+
+	return strings.Join(parts, "_") + archiveExt(call)
+}
+
+func (archives *Archives) manifestRow(call *Call, file string, hash string) []string {
+	var systemLabel, talkgroupLabel, talkgroupName string
+
+	if system, ok := archives.Controller.Systems.GetSystem(call.System); ok {
+		systemLabel = system.Label
+
+		if talkgroup, ok := system.Talkgroups.GetSiteTalkgroup(call.Talkgroup, call.Site); ok {
+			talkgroupLabel = talkgroup.Label
+			talkgroupName = talkgroup.Name
+		}
+	}
+
+	optional := func(v any) string {
+		switch v := v.(type) {
+		case nil:
+			return ""
+		case uint:
+			if v == 0 {
+				return ""
+			}
+		}
+		return fmt.Sprint(v)
+	}
+
+	transcript, _ := call.Transcript.(string)
+
+	return []string{
+		file,
+		fmt.Sprint(call.Id),
+		call.DateTime.UTC().Format(time.RFC3339),
+		strconv.FormatFloat(call.Duration.Seconds(), 'f', 3, 64),
+		strconv.Itoa(int(call.System)),
+		systemLabel,
+		strconv.Itoa(int(call.Talkgroup)),
+		talkgroupLabel,
+		talkgroupName,
+		optional(call.Site),
+		optional(call.Frequency),
+		optional(call.Source),
+		strconv.FormatBool(call.Emergency),
+		strconv.FormatBool(call.Encrypted),
+		hash,
+		transcript,
+	}
+}
+
+// archiveWriter adds the files to a zip or a tar archive.
+type archiveWriter interface {
+	Add(name string, b []byte, modTime time.Time, compress bool) error
+	Close() error
+}
+
+type archiveTar struct {
+	*tar.Writer
+}
+
+func (archive *archiveTar) Add(name string, b []byte, modTime time.Time, compress bool) error {
+	if err := archive.WriteHeader(&tar.Header{Name: name, Mode: 0644, ModTime: modTime, Size: int64(len(b)), Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+
+	_, err := archive.Write(b)
+
+	return err
+}
+
+type archiveZip struct {
+	*zip.Writer
+}
+
+// Add stores the audio as is, it compresses no further.
+func (archive *archiveZip) Add(name string, b []byte, modTime time.Time, compress bool) error {
+	method := zip.Store
+	if compress {
+		method = zip.Deflate
+	}
+
+	w, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: modTime})
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(b)
+
+	return err
+}
+
+// archiveExt returns the extension of the audio file of the call, from its
+// name or else from its type.
+func archiveExt(call *Call) string {
+	if name, ok := call.AudioName.(string); ok {
+		if ext := path.Ext(name); len(ext) > 1 {
+			return strings.ToLower(ext)
+		}
+	}
+
+	if audioType, ok := call.AudioType.(string); ok {
+		if exts, err := mime.ExtensionsByType(audioType); err == nil && len(exts) > 0 {
+			return exts[0]
+		}
+	}
+
+	return ".bin"
+}
+
+var archiveSlugRegexp = regexp.MustCompile(`[^a-z0-9]+`)
+
+// archiveSlug keeps the letters and digits of a label, for a file name.
+func archiveSlug(s string) string {
+	return strings.Trim(archiveSlugRegexp.ReplaceAllString(strings.ToLower(s), "-"), "-")
+}
+
+// ArchivesHandler lists the archives, queues a new one, ie: {"system": 1,
+// "talkgroups": [10], "from": "2022-10-01T00:00:00Z", "to":
+// "2022-10-02T00:00:00Z", "format": "zip"}, downloads one with ?name or
+// deletes it.
+func (admin *Admin) ArchivesHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		archives = admin.Controller.Archives
+		config   = admin.Controller.Config
+		logs     = admin.Controller.Logs
+		name     = r.URL.Query().Get("name")
+	)
+
+	// the archives hold the audio of the calls, the viewers only list them
+	role := AdminRoleViewer
+	if r.Method != http.MethodGet || len(name) > 0 {
+		role = AdminRoleConfigEditor
+	}
+
+	if !admin.Authorize(w, r, role) {
+		return
+	}
+
+	if len(name) > 0 && !archiveNameRegexp.MatchString(name) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodDelete:
+		if len(name) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if err := os.Remove(filepath.Join(config.GetArchiveDirPath(), name)); errors.Is(err, os.ErrNotExist) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			logs.LogEvent(LogLevelError, fmt.Sprintf("archives.delete: %v", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		logs.LogEvent(LogLevelInfo, fmt.Sprintf("archive: %s deleted by %s from ip %s", name, admin.author(r), GetRemoteAddr(r)))
+
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodGet:
+		if len(name) > 0 {
+			f, err := os.Open(filepath.Join(config.GetArchiveDirPath(), name))
+			if err != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			defer f.Close()
+
+			fi, err := f.Stat()
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			logs.LogEvent(LogLevelInfo, fmt.Sprintf("archive: %s downloaded by %s from ip %s", name, admin.author(r), GetRemoteAddr(r)))
+
+			clearReadDeadline(r)
+			extendWriteDeadline(r, time.Hour)
+
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+			w.Header().Set("Content-Type", mime.TypeByExtension(path.Ext(name)))
+
+			http.ServeContent(w, r, name, fi.ModTime(), f)
+			return
+		}
+
+		l, err := archives.List()
+		if err != nil {
+			logs.LogEvent(LogLevelError, err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if b, err := json.Marshal(map[string]any{
+			"archives": l,
+			"enabled":  archives.Enabled(),
+			"s3":       config.ArchiveS3,
+		}); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+
+	case http.MethodPost:
+		var request ArchiveRequest
+
+		if !archives.Enabled() {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 65536)).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if err := request.Validate(config); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		payload, err := request.Payload()
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		job, err := admin.Controller.Jobs.Enqueue(JobKindArchive, payload, JobPriorityNormal)
+		if err != nil {
+			logs.LogEvent(LogLevelError, err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		logs.LogEvent(LogLevelInfo, fmt.Sprintf("archive: system %d from %s to %s asked by %s from ip %s", request.System, request.From.Format(time.RFC3339), request.To.Format(time.RFC3339), admin.author(r), GetRemoteAddr(r)))
+
+		if b, err := json.Marshal(map[string]any{
+			"job":  job,
+			"name": fmt.Sprintf("%s%v.%s", archivePrefix, job.Id, request.Format),
+		}); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,328 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestArchives(t *testing.T) *Controller {
+	t.Helper()
+
+	controller := newTestController(t, &Config{ArchiveDir: t.TempDir()})
+
+	system := NewSystem()
+	system.Id = 1
+	system.Label = "County"
+	system.Talkgroups.List = append(system.Talkgroups.List, &Talkgroup{Id: 10, Label: "FD", Name: "Fire Dispatch"}, &Talkgroup{Id: 20, Label: "PD", Name: "Police Dispatch"})
+	controller.Systems.List = append(controller.Systems.List, system)
+
+	return controller
+}
+
+func TestArchive(t *testing.T) {
+	controller := newTestArchives(t)
+
+	from := time.Date(2022, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	calls := []*Call{
+		{Audio: []byte("fire"), AudioName: "fire.m4a", AudioType: "audio/mp4", DateTime: from.Add(time.Hour), Source: 4242, System: 1, Talkgroup: 10},
+		{Audio: []byte("police"), AudioType: "audio/mpeg", DateTime: from.Add(2 * time.Hour), System: 1, Talkgroup: 20},
+		{Audio: []byte("later"), AudioName: "later.m4a", DateTime: from.Add(48 * time.Hour), System: 1, Talkgroup: 10},
+		{Audio: []byte("other"), AudioName: "other.m4a", DateTime: from.Add(time.Hour), System: 2, Talkgroup: 10},
+	}
+	for _, call := range calls {
+		if _, err := controller.Calls.WriteCall(call, controller.Database); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := controller.Calls.WriteTranscript(1, "engine 1, respond", controller.Database); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(t *testing.T, format string, name string) map[string][]byte {
+		files := map[string][]byte{}
+
+		switch format {
+		case ArchiveFormatTar:
+			f, err := os.Open(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			r := tar.NewReader(f)
+			for {
+				h, err := r.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				b, _ := io.ReadAll(r)
+				files[h.Name] = b
+			}
+
+		default:
+			r, err := zip.OpenReader(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+
+			for _, f := range r.File {
+				rc, err := f.Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, _ := io.ReadAll(rc)
+				rc.Close()
+				files[f.Name] = b
+			}
+		}
+
+		return files
+	}
+
+	tests := []struct {
+		name       string
+		format     string
+		talkgroups []uint
+		files      []string
+	}{
+		{"zip of a system", ArchiveFormatZip, nil, []string{"20221001-010000_1-county_10-fd_1.m4a", "20221001-020000_1-county_20-pd_2.mp3"}},
+		{"tar of a talkgroup", ArchiveFormatTar, []uint{10}, []string{"20221001-010000_1-county_10-fd_1.m4a"}},
+	}
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := &ArchiveRequest{Format: test.format, From: from, System: 1, Talkgroups: test.talkgroups, To: from.Add(24 * time.Hour)}
+			if err := request.Validate(controller.Config); err != nil {
+				t.Fatal(err)
+			}
+
+			name := archivePrefix + strconv.Itoa(i+1) + "." + test.format
+
+			count, err := controller.Archives.Archive(request, name, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != len(test.files) {
+				t.Errorf("count = %d, want %d", count, len(test.files))
+			}
+
+			files := read(t, test.format, filepath.Join(controller.Config.ArchiveDir, name))
+			if len(files) != len(test.files)+1 {
+				t.Errorf("files = %d, want %d", len(files), len(test.files)+1)
+			}
+			for _, file := range test.files {
+				if _, ok := files[file]; !ok {
+					t.Errorf("no %s in the archive", file)
+				}
+			}
+
+			rows, err := csv.NewReader(bytes.NewReader(files[archiveManifest])).ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rows) != len(test.files)+1 || strings.Join(rows[0], ",") != strings.Join(archiveManifestColumns, ",") {
+				t.Fatalf("manifest = %v", rows)
+			}
+
+			row := rows[1]
+			if row[0] != test.files[0] || row[7] != "FD" || row[8] != "Fire Dispatch" || row[11] != "4242" || row[15] != "engine 1, respond" {
+				t.Errorf("manifest row = %v", row)
+			}
+			if string(files[row[0]]) != "fire" {
+				t.Errorf("audio = %q", files[row[0]])
+			}
+		})
+	}
+
+	l, err := controller.Archives.List()
+	if err != nil || len(l) != len(tests) {
+		t.Errorf("archives = %+v, %v", l, err)
+	}
+}
+
+func TestArchiveSiteTalkgroup(t *testing.T) {
+	controller := newTestArchives(t)
+
+	system, _ := controller.Systems.GetSystem(uint(1))
+	system.Talkgroups.List = append(system.Talkgroups.List, &Talkgroup{Id: 30, Label: "TAC", Name: "Tactical"}, &Talkgroup{Id: 30, Label: "TAC N", Name: "Tactical North", Site: 2})
+
+	tests := []struct {
+		name  string
+		site  uint
+		file  string
+		label string
+	}{
+		{"talkgroup of the site", 2, "20221001-010000_1-county_30-tac-n_1.m4a", "TAC N"},
+		{"talkgroup of all sites", 3, "20221001-010000_1-county_30-tac_1.m4a", "TAC"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			call := &Call{Id: uint(1), AudioName: "tac.m4a", DateTime: time.Date(2022, 10, 1, 1, 0, 0, 0, time.UTC), Site: test.site, System: 1, Talkgroup: 30}
+
+			if file := controller.Archives.fileName(call); file != test.file {
+				t.Errorf("file = %s, want %s", file, test.file)
+			}
+			if row := controller.Archives.manifestRow(call, test.file, ""); row[7] != test.label {
+				t.Errorf("label = %s, want %s", row[7], test.label)
+			}
+		})
+	}
+}
+
+func TestArchiveUpload(t *testing.T) {
+	var (
+		body   []byte
+		length int64
+		sum    string
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		length = r.ContentLength
+		sum = r.Header.Get("X-Amz-Content-Sha256")
+	}))
+	defer server.Close()
+
+	controller := newTestArchives(t)
+	controller.Config.S3Bucket = "bucket"
+	controller.Config.S3Endpoint = server.URL
+	controller.Config.S3PathStyle = true
+
+	content := bytes.Repeat([]byte("archive"), 1000)
+
+	name := archivePrefix + "1.zip"
+	if err := os.WriteFile(filepath.Join(controller.Config.ArchiveDir, name), content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := controller.Archives.upload(name); err != nil {
+		t.Fatal(err)
+	}
+
+	hash := sha256.Sum256(content)
+
+	if !bytes.Equal(body, content) || length != int64(len(content)) || sum != hex.EncodeToString(hash[:]) {
+		t.Errorf("uploaded %d bytes of length %d and sha256 %s", len(body), length, sum)
+	}
+}
+
+func TestArchiveRequestValidate(t *testing.T) {
+	from := time.Date(2022, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		request ArchiveRequest
+		err     bool
+	}{
+		{name: "default format", request: ArchiveRequest{From: from, System: 1, To: from.Add(time.Hour)}},
+		{name: "unknown format", request: ArchiveRequest{Format: "rar", From: from, System: 1, To: from.Add(time.Hour)}, err: true},
+		{name: "no system", request: ArchiveRequest{From: from, To: from.Add(time.Hour)}, err: true},
+		{name: "no range", request: ArchiveRequest{System: 1}, err: true},
+		{name: "reversed range", request: ArchiveRequest{From: from.Add(time.Hour), System: 1, To: from}, err: true},
+		{name: "s3 not configured", request: ArchiveRequest{From: from, S3: true, System: 1, To: from.Add(time.Hour)}, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.request.Validate(&Config{})
+
+			if test.err != (err != nil) {
+				t.Fatalf("err = %v, want an error %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestArchivesHandler(t *testing.T) {
+	controller := newTestArchives(t)
+
+	token, err := controller.Admin.NewToken(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewer, err := controller.Admin.NewOidcToken("someone", AdminRoleViewer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(controller.Config.ArchiveDir, archivePrefix+"1.zip"), []byte("zip"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	request := `{"system":1,"from":"2022-10-01T00:00:00Z","to":"2022-10-02T00:00:00Z"}`
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		token  string
+		body   string
+		status int
+	}{
+		{"no token", http.MethodGet, "/api/admin/archives", "", "", http.StatusUnauthorized},
+		{"list", http.MethodGet, "/api/admin/archives", viewer, "", http.StatusOK},
+		{"viewer download", http.MethodGet, "/api/admin/archives?name=" + archivePrefix + "1.zip", viewer, "", http.StatusForbidden},
+		{"viewer export", http.MethodPost, "/api/admin/archives", viewer, request, http.StatusForbidden},
+		{"download", http.MethodGet, "/api/admin/archives?name=" + archivePrefix + "1.zip", token, "", http.StatusOK},
+		{"download another file", http.MethodGet, "/api/admin/archives?name=../rdio-scanner.db", token, "", http.StatusBadRequest},
+		{"download nothing", http.MethodGet, "/api/admin/archives?name=" + archivePrefix + "2.zip", token, "", http.StatusNotFound},
+		{"export not json", http.MethodPost, "/api/admin/archives", token, "system", http.StatusBadRequest},
+		{"export an invalid range", http.MethodPost, "/api/admin/archives", token, `{"system":1,"from":"2022-10-02T00:00:00Z","to":"2022-10-01T00:00:00Z"}`, http.StatusBadRequest},
+		{"export", http.MethodPost, "/api/admin/archives", token, request, http.StatusAccepted},
+		{"delete", http.MethodDelete, "/api/admin/archives?name=" + archivePrefix + "1.zip", token, "", http.StatusOK},
+		{"delete again", http.MethodDelete, "/api/admin/archives?name=" + archivePrefix + "1.zip", token, "", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, test.target, strings.NewReader(test.body))
+			if len(test.token) > 0 {
+				r.Header.Set("Authorization", test.token)
+			}
+
+			w := httptest.NewRecorder()
+			controller.Admin.ArchivesHandler(w, r)
+
+			if w.Code != test.status {
+				t.Errorf("status %d, want %d", w.Code, test.status)
+			}
+		})
+	}
+
+	if !controller.Jobs.HasPending(JobKindArchive) {
+		t.Error("no archive job queued")
+	}
+}
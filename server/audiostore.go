@@ -0,0 +1,150 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	AudioStoreDatabase string = "database"
+	AudioStoreS3       string = "s3"
+)
+
+// AudioStore keeps call audio outside of the database. When no store is
+// configured, audio stays in the rdioScannerCalls table as before.
+type AudioStore interface {
+	Delete(key string) error
+	Get(key string) ([]byte, error)
+	Put(key string, audio []byte, contentType string) error
+}
+
+func NewAudioStore(config *Config) (AudioStore, error) {
+	switch config.AudioStore {
+	case "", AudioStoreDatabase:
+		return nil, nil
+
+	case AudioStoreS3:
+		return NewS3AudioStore(config)
+
+	default:
+		return nil, fmt.Errorf("unknown audio store %s", config.AudioStore)
+	}
+}
+
+// DirAudioStore keeps call audio as files of a directory, the keys being
+// their paths relative to it.
+type DirAudioStore struct {
+	dir string
+}
+
+func NewDirAudioStore(dir string) (*DirAudioStore, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("dir: %v", err)
+	}
+
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("dir: %s is not a directory", dir)
+	}
+
+	return &DirAudioStore{dir: dir}, nil
+}
+
+func (store *DirAudioStore) Delete(key string) error {
+	if err := os.Remove(store.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("dir: %v", err)
+	}
+
+	return nil
+}
+
+func (store *DirAudioStore) Get(key string) ([]byte, error) {
+	b, err := os.ReadFile(store.path(key))
+	if err != nil {
+		return nil, fmt.Errorf("dir: %v", err)
+	}
+
+	return b, nil
+}
+
+// Put writes the audio to a temporary file renamed once complete, so that
+// a file of the store is never partially written.
+func (store *DirAudioStore) Put(key string, audio []byte, contentType string) error {
+	p := store.path(key)
+
+	formatError := func(err error) error {
+		return fmt.Errorf("dir: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0770); err != nil {
+		return formatError(err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(p), ".tmp*")
+	if err != nil {
+		return formatError(err)
+	}
+
+	if _, err = f.Write(audio); err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		return formatError(err)
+	}
+
+	return nil
+}
+
+func (store *DirAudioStore) path(key string) string {
+	return filepath.Join(store.dir, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+func GetAudioKey(call *Call) string {
+	var ext string
+
+	switch v := call.AudioName.(type) {
+	case string:
+		ext = path.Ext(v)
+	}
+
+	if len(ext) == 0 {
+		switch v := call.AudioType.(type) {
+		case string:
+			if a, err := mime.ExtensionsByType(v); err == nil && len(a) > 0 {
+				ext = a[0]
+			}
+		}
+	}
+
+	return fmt.Sprintf("%d/%d/%s%s", call.System, call.Talkgroup, strings.Replace(call.DateTime.UTC().Format("20060102150405.000000"), ".", "", 1), ext)
+}
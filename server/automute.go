@@ -0,0 +1,182 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// talkgroups unmuted by an admin aren't muted again for this long
+	autoMuteExemption = 24 * time.Hour
+
+	// weight of the last window in the normal rate of a talkgroup
+	autoMuteSmoothing = 0.1
+
+	// windows to observe before the normal rate of a talkgroup is trusted
+	autoMuteWarmup = 12
+
+	autoMuteWindow = 5 * time.Minute
+)
+
+// autoMuteKey is a talkgroup of a site, the sites reusing the talkgroup ids
+// having their own rates.
+type autoMuteKey struct {
+	site      uint
+	system    uint
+	talkgroup uint
+}
+
+type autoMuteRate struct {
+	average float64
+	count   uint
+	exempt  time.Time
+	window  time.Time
+	windows uint
+}
+
+// AutoMute mutes the talkgroups which suddenly produce calls at several
+// times their normal rate, like a stuck microphone or a misconfigured data
+// channel, by putting them in a blackout. The normal rate is the moving
+// average of the calls per window of each talkgroup of each site, kept in
+// memory only.
+// Admins unmute a talkgroup by lifting its blackout.
+type AutoMute struct {
+	Controller *Controller
+	rates      map[autoMuteKey]*autoMuteRate
+	mutex      sync.Mutex
+}
+
+func NewAutoMute(controller *Controller) *AutoMute {
+	return &AutoMute{
+		Controller: controller,
+		rates:      map[autoMuteKey]*autoMuteRate{},
+		mutex:      sync.Mutex{},
+	}
+}
+
+// Evaluate accounts for the call and mutes its talkgroup when its rate goes
+// past the limit. It returns true when the talkgroup got muted.
+func (autoMute *AutoMute) Evaluate(call *Call) bool {
+	controller := autoMute.Controller
+	options := controller.Options
+
+	if options.AutoMuteRate == 0 {
+		return false
+	}
+
+	autoMute.mutex.Lock()
+	defer autoMute.mutex.Unlock()
+
+	key := autoMuteKey{site: call.Site, system: call.System, talkgroup: call.Talkgroup}
+	window := call.DateTime.Truncate(autoMuteWindow)
+
+	rate, ok := autoMute.rates[key]
+	if !ok {
+		rate = &autoMuteRate{window: window}
+		autoMute.rates[key] = rate
+	}
+
+	// the calls of a muted talkgroup don't count towards its normal rate
+	if controller.Blackouts.IsBlackedOut(call) {
+		if window.After(rate.window) {
+			rate.count = 0
+			rate.window = window
+		}
+		return false
+	}
+
+	if window.Before(rate.window) {
+		return false
+	}
+
+	if window.After(rate.window) {
+		elapsed := int(window.Sub(rate.window) / autoMuteWindow)
+
+		rate.average = autoMuteSmoothing*float64(rate.count) + (1-autoMuteSmoothing)*rate.average
+
+		// the windows without calls
+		if elapsed > 1 {
+			rate.average *= math.Pow(1-autoMuteSmoothing, float64(elapsed-1))
+		}
+
+		rate.count = 0
+		rate.window = window
+		rate.windows += uint(elapsed)
+	}
+
+	rate.count++
+
+	if rate.windows < autoMuteWarmup || rate.count < options.AutoMuteMinCalls || time.Now().Before(rate.exempt) {
+		return false
+	}
+
+	limit := math.Max(rate.average, 1) * float64(options.AutoMuteRate)
+	if float64(rate.count) <= limit {
+		return false
+	}
+
+	duration := options.AutoMuteDuration
+	if duration == 0 {
+		duration = defaults.options.autoMuteDuration
+	}
+
+	now := time.Now().UTC()
+
+	blackout := &Blackout{
+		CreatedAt:  now,
+		Expires:    now.Add(time.Duration(duration) * time.Minute),
+		Reason:     fmt.Sprintf("automatic mute, %d calls in %d minutes against %.1f normally", rate.count, int(autoMuteWindow.Minutes()), rate.average),
+		System:     call.System,
+		Talkgroups: []uint{call.Talkgroup},
+	}
+
+	if err := controller.Blackouts.Add(blackout, controller.Database); err != nil {
+		controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("automute: %v", err))
+		return false
+	}
+
+	controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("automute: system=%v talkgroup=%v muted until %v, %d calls in %d minutes is more than %d times its normal rate of %.1f", call.System, call.Talkgroup, blackout.Expires.Format(time.RFC3339), rate.count, int(autoMuteWindow.Minutes()), options.AutoMuteRate, rate.average))
+
+	rate.count = 0
+
+	return true
+}
+
+// Exempt keeps the talkgroups of a lifted blackout from being muted again
+// for a while, their traffic being deemed legitimate.
+func (autoMute *AutoMute) Exempt(blackout *Blackout) {
+	autoMute.mutex.Lock()
+	defer autoMute.mutex.Unlock()
+
+	// a blackout covers the talkgroup of every site
+	for key, rate := range autoMute.rates {
+		if key.system != blackout.System {
+			continue
+		}
+
+		for _, talkgroup := range blackout.Talkgroups {
+			if key.talkgroup == talkgroup {
+				rate.count = 0
+				rate.exempt = time.Now().Add(autoMuteExemption)
+				break
+			}
+		}
+	}
+}
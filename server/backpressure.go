@@ -0,0 +1,167 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BackpressureHeader carries the state of the ingest queue on the uploads
+// refused with a 503, as comma separated key=value pairs.
+const BackpressureHeader = "X-Rdio-Scanner-Backpressure"
+
+const (
+	backpressureMinRetry = time.Second
+	backpressureMaxRetry = 5 * time.Minute
+
+	// weight of the last ingested call in the average ingest time
+	backpressureSmoothing = 0.2
+)
+
+// Backpressure tells the uploaders to back off when the ingest queue grows
+// past its limit, or would take too long to drain at the average time it
+// takes to ingest a call, the database latency included. The calls handed
+// to the ingest workers count as queued, and drain as many at once as there
+// are workers.
+type Backpressure struct {
+	Controller *Controller
+	average    time.Duration
+	mutex      sync.Mutex
+}
+
+type BackpressureState struct {
+	Delay      time.Duration
+	Depth      int
+	Limit      int
+	Overloaded bool
+	RetryAfter time.Duration
+}
+
+func NewBackpressure(controller *Controller) *Backpressure {
+	return &Backpressure{
+		Controller: controller,
+		mutex:      sync.Mutex{},
+	}
+}
+
+// Observe accounts for the time it took to ingest a call.
+func (backpressure *Backpressure) Observe(d time.Duration) {
+	backpressure.mutex.Lock()
+	defer backpressure.mutex.Unlock()
+
+	if backpressure.average == 0 {
+		backpressure.average = d
+	} else {
+		backpressure.average = time.Duration(backpressureSmoothing*float64(d) + (1-backpressureSmoothing)*float64(backpressure.average))
+	}
+}
+
+func (backpressure *Backpressure) State() BackpressureState {
+	var (
+		config   = backpressure.Controller.Config
+		maxDelay = time.Duration(config.IngestMaxDelay) * time.Second
+		pipeline = backpressure.Controller.Pipeline
+		state    = BackpressureState{Depth: len(backpressure.Controller.Ingest)}
+		workers  = 1
+	)
+
+	if pipeline != nil {
+		state.Depth += pipeline.Pending()
+		workers = pipeline.Workers()
+	}
+
+	backpressure.mutex.Lock()
+	average := backpressure.average / time.Duration(workers)
+	backpressure.mutex.Unlock()
+
+	state.Delay = time.Duration(state.Depth) * average
+
+	// the queue can't hold more than its capacity anyway
+	state.Limit = cap(backpressure.Controller.Ingest)
+	if config.IngestQueueLimit > 0 && int(config.IngestQueueLimit) < state.Limit {
+		state.Limit = int(config.IngestQueueLimit)
+	}
+
+	state.Overloaded = state.Depth >= state.Limit || (maxDelay > 0 && state.Delay >= maxDelay)
+
+	// time for the queue to drain back under its limits
+	if state.Overloaded {
+		if state.Depth >= state.Limit {
+			state.RetryAfter = time.Duration(state.Depth-state.Limit+1) * average
+		}
+
+		if maxDelay > 0 && state.Delay-maxDelay > state.RetryAfter {
+			state.RetryAfter = state.Delay - maxDelay
+		}
+
+		if state.RetryAfter < backpressureMinRetry {
+			state.RetryAfter = backpressureMinRetry
+		} else if state.RetryAfter > backpressureMaxRetry {
+			state.RetryAfter = backpressureMaxRetry
+		}
+	}
+
+	return state
+}
+
+// Refuse replies with a 503 when the ingest is overloaded, telling when to
+// retry in the Retry-After header. It returns false when the call can be
+// queued.
+func (backpressure *Backpressure) Refuse(w http.ResponseWriter) bool {
+	state := backpressure.State()
+
+	if !state.Overloaded {
+		return false
+	}
+
+	retryAfter := int(math.Ceil(state.RetryAfter.Seconds()))
+
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.Header().Set(BackpressureHeader, fmt.Sprintf("depth=%d, limit=%d, delay=%d, retry=%d", state.Depth, state.Limit, int(math.Ceil(state.Delay.Seconds())), retryAfter))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte(fmt.Sprintf("Server overloaded, retry in %d seconds.\n", retryAfter)))
+
+	return true
+}
+
+// BackpressureRetryAfter returns the delay before retrying a refused upload,
+// from the Retry-After header in seconds or as an http date.
+func BackpressureRetryAfter(res *http.Response) (time.Duration, bool) {
+	v := strings.TrimSpace(res.Header.Get("Retry-After"))
+
+	if len(v) == 0 {
+		return 0, false
+	}
+
+	if i, err := strconv.Atoi(v); err == nil && i >= 0 {
+		return time.Duration(i) * time.Second, true
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+
+	return 0, false
+}
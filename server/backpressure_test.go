@@ -0,0 +1,61 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackpressureState(t *testing.T) {
+	tests := []struct {
+		name       string
+		queued     int
+		pending    int64
+		workers    int64
+		depth      int
+		delay      time.Duration
+		overloaded bool
+	}{
+		{name: "idle", workers: 4},
+		{name: "queued and pending", queued: 10, pending: 6, workers: 1, depth: 16, delay: 16 * time.Second},
+		{name: "drained in parallel", queued: 40, pending: 40, workers: 4, depth: 80, delay: 20 * time.Second},
+		{name: "too slow", queued: 100, workers: 1, depth: 100, delay: 100 * time.Second, overloaded: true},
+		{name: "over the limit", queued: 60, pending: 60, workers: 8, depth: 120, delay: 15 * time.Second, overloaded: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			controller := &Controller{Config: &Config{IngestMaxDelay: 60, IngestQueueLimit: 100}, Ingest: make(chan *Call, 200)}
+			controller.Backpressure = NewBackpressure(controller)
+			controller.Pipeline = NewIngestPipeline(controller)
+			controller.Pipeline.pending = test.pending
+			controller.Pipeline.workers = test.workers
+
+			controller.Backpressure.Observe(time.Second)
+
+			for i := 0; i < test.queued; i++ {
+				controller.Ingest <- &Call{}
+			}
+
+			state := controller.Backpressure.State()
+
+			if state.Depth != test.depth || state.Delay != test.delay || state.Overloaded != test.overloaded {
+				t.Errorf("got depth %d delay %v overloaded %v, want depth %d delay %v overloaded %v", state.Depth, state.Delay, state.Overloaded, test.depth, test.delay, test.overloaded)
+			}
+		})
+	}
+}
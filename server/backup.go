@@ -0,0 +1,886 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	backupExt      = ".backup.gz"
+	backupPrefix   = "rdio-scanner-"
+	backupS3Prefix = "backups/"
+
+	backupKindBlob = "blob"
+	backupKindTime = "time"
+)
+
+// the tables which belong to the running instance rather than to its data,
+// the migrations applied, the jobs in progress, the progress of a database
+// migration and the full-text index, rebuilt from the calls
+var backupSkipTables = map[string]bool{
+	dbMigrateTable:    true,
+	searchIndexTable:  true,
+	"rdioScannerJobs": true,
+	"rdioScannerMeta": true,
+}
+
+// Backups dumps the database to the backup directory on the schedule of the
+// backupSchedule option, keeping the backupKeep most recent ones, and
+// restores it from them. A backup is a gzipped stream of json lines, a header
+// followed by each table with its columns and its rows, so that it restores
+// into any database type and into the schema of later versions.
+type Backups struct {
+	Controller *Controller
+	cancel     chan struct{}
+	checked    time.Time
+	invalid    string
+	mutex      sync.Mutex
+}
+
+type BackupFile struct {
+	CreatedAt time.Time `json:"createdAt"`
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+}
+
+type backupHeader struct {
+	Audio     bool      `json:"audio"`
+	CreatedAt time.Time `json:"createdAt"`
+	DbType    string    `json:"dbType"`
+	Version   string    `json:"version"`
+}
+
+type backupRecord struct {
+	Backup  *backupHeader `json:"backup,omitempty"`
+	Columns []string      `json:"columns,omitempty"`
+	Kinds   []string      `json:"kinds,omitempty"`
+	Row     []any         `json:"row,omitempty"`
+	Table   string        `json:"table,omitempty"`
+}
+
+func NewBackups(controller *Controller) *Backups {
+	return &Backups{
+		Controller: controller,
+		cancel:     make(chan struct{}),
+	}
+}
+
+func (backups *Backups) Enabled() bool {
+	return len(backups.Controller.Config.BackupDir) > 0
+}
+
+// Backup writes a backup of the database and returns its name once uploaded
+// to s3 if configured, the older backups past the backupKeep option being
+// removed.
+func (backups *Backups) Backup(cancel <-chan struct{}) (string, error) {
+	var (
+		config     = backups.Controller.Config
+		controller = backups.Controller
+	)
+
+	formatError := func(err error) error {
+		return fmt.Errorf("backups.backup: %v", err)
+	}
+
+	if !backups.Enabled() {
+		return "", formatError(errors.New("no backup directory configured"))
+	}
+
+	name := fmt.Sprintf("%s%s%s", backupPrefix, time.Now().UTC().Format("20060102-150405"), backupExt)
+
+	f, err := os.CreateTemp(config.GetBackupDirPath(), ".backup-*")
+	if err != nil {
+		return "", formatError(err)
+	}
+
+	tmp := f.Name()
+
+	zw := gzip.NewWriter(f)
+
+	if err = backups.dump(json.NewEncoder(zw), controller.Options.BackupAudio, cancel); err == nil {
+		err = zw.Close()
+	}
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(config.GetBackupDirPath(), name))
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return "", formatError(err)
+	}
+
+	if config.BackupS3 {
+		if err = backups.upload(name); err != nil {
+			return name, formatError(err)
+		}
+	}
+
+	if err = backups.prune(); err != nil {
+		return name, formatError(err)
+	}
+
+	return name, nil
+}
+
+// BackupJob writes a backup, as scheduled or asked by an admin.
+func (backups *Backups) BackupJob(job *Job, cancel <-chan struct{}) error {
+	start := time.Now()
+
+	name, err := backups.Backup(cancel)
+	if err != nil {
+		return err
+	}
+
+	size := int64(0)
+	if fi, err := os.Stat(filepath.Join(backups.Controller.Config.GetBackupDirPath(), name)); err == nil {
+		size = fi.Size()
+	}
+
+	backups.Controller.Logs.LogEvent(LogLevelInfo, fmt.Sprintf("backup: %s written in %v, %.1f MiB", name, time.Since(start).Round(time.Second), float64(size)/(1024*1024)))
+
+	return nil
+}
+
+// List returns the backups of the backup directory, the most recent first.
+func (backups *Backups) List() ([]BackupFile, error) {
+	l := []BackupFile{}
+
+	if !backups.Enabled() {
+		return l, nil
+	}
+
+	entries, err := os.ReadDir(backups.Controller.Config.GetBackupDirPath())
+	if err != nil {
+		return nil, fmt.Errorf("backups.list: %v", err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !backupIsName(entry.Name()) {
+			continue
+		}
+
+		fi, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		l = append(l, BackupFile{CreatedAt: fi.ModTime(), Name: entry.Name(), Size: fi.Size()})
+	}
+
+	// the names sort by their date
+	sort.Slice(l, func(i int, j int) bool {
+		return l[i].Name > l[j].Name
+	})
+
+	return l, nil
+}
+
+// Restore replaces the data of the database with that of a backup, given by
+// its name in the backup directory or in the s3 bucket, or by its path when
+// allowed. It returns the number of rows restored.
+func (backups *Backups) Restore(name string, allowPath bool) (int, error) {
+	formatError := func(err error) error {
+		return fmt.Errorf("backups.restore: %v", err)
+	}
+
+	r, err := backups.open(name, allowPath)
+	if err != nil {
+		return 0, formatError(err)
+	}
+	defer r.Close()
+
+	count, err := backups.restore(r)
+	if err != nil {
+		return 0, formatError(err)
+	}
+
+	return count, nil
+}
+
+// RestoreJob restores a backup asked by an admin, reading the configuration
+// back from the database once done.
+func (backups *Backups) RestoreJob(job *Job, cancel <-chan struct{}) error {
+	controller := backups.Controller
+
+	name, _ := job.Payload["name"].(string)
+	if len(name) == 0 {
+		return errors.New("no backup name")
+	}
+
+	count, err := backups.Restore(name, false)
+	if err != nil {
+		return err
+	}
+
+	controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("backup: %s restored, %d rows", name, count))
+
+	controller.Reload()
+
+	// the index still has the calls from before the restore
+	if _, err := controller.SearchIndex.Rebuild(); err != nil {
+		controller.Logs.LogEvent(LogLevelError, err.Error())
+	}
+
+	return nil
+}
+
+func (backups *Backups) Start() error {
+	backups.checked = time.Now().Truncate(time.Minute)
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-backups.cancel:
+				return
+			case t := <-ticker.C:
+				backups.check(t)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// check queues a backup when the schedule matched any minute since the last
+// check, a tick coming late not skipping its minute.
+func (backups *Backups) check(t time.Time) {
+	controller := backups.Controller
+
+	backups.mutex.Lock()
+	defer backups.mutex.Unlock()
+
+	from := backups.checked
+	backups.checked = t.Truncate(time.Minute)
+
+	schedule := strings.TrimSpace(controller.Options.BackupSchedule)
+	if len(schedule) == 0 || !backups.Enabled() {
+		return
+	}
+
+	cron, err := ParseCron(schedule)
+	if err != nil {
+		// reported once until the schedule changes
+		if backups.invalid != schedule {
+			backups.invalid = schedule
+			controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("backup: skipped, %v", err))
+		}
+		return
+	}
+
+	backups.invalid = ""
+
+	due := false
+	for m := from.Add(time.Minute); !m.After(backups.checked); m = m.Add(time.Minute) {
+		due = due || cron.Match(m)
+	}
+
+	if due && !controller.Jobs.HasPending(JobKindBackup) {
+		if _, err := controller.Jobs.Enqueue(JobKindBackup, nil, JobPriorityNormal); err != nil {
+			controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("backups.check: %v", err))
+		}
+	}
+}
+
+func (backups *Backups) dump(enc *json.Encoder, audio bool, cancel <-chan struct{}) error {
+	db := backups.Controller.Database
+
+	tables, err := db.Tables()
+	if err != nil {
+		return err
+	}
+
+	if err = enc.Encode(backupRecord{Backup: &backupHeader{
+		Audio:     audio,
+		CreatedAt: time.Now().UTC(),
+		DbType:    db.Config.DbType,
+		Version:   Version,
+	}}); err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		if backupSkipTables[table] {
+			continue
+		}
+
+		if err = backups.dumpTable(enc, table, audio, cancel); err != nil {
+			return fmt.Errorf("%s: %v", table, err)
+		}
+	}
+
+	return nil
+}
+
+func (backups *Backups) dumpTable(enc *json.Encoder, table string, audio bool, cancel <-chan struct{}) error {
+	var (
+		calls    = backups.Controller.Calls
+		db       = backups.Controller.Database
+		audioCol = -1
+		keyCol   = -1
+	)
+
+	rows, err := db.Sql.Query(fmt.Sprintf("select * from `%s`", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return err
+	}
+
+	kinds := make([]string, len(columns))
+	for i, t := range types {
+		kinds[i] = backupColumnKind(t.DatabaseTypeName())
+	}
+
+	if table == "rdioScannerCalls" {
+		for i, column := range columns {
+			switch column {
+			case "audio":
+				audioCol = i
+			case "audioKey":
+				keyCol = i
+			}
+		}
+	}
+
+	if err = enc.Encode(backupRecord{Table: table, Columns: columns, Kinds: kinds}); err != nil {
+		return err
+	}
+
+	values := make([]any, len(columns))
+	dest := make([]any, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+
+	for n := 0; rows.Next(); n++ {
+		if n%1000 == 0 {
+			select {
+			case <-cancel:
+				return errors.New("canceled")
+			default:
+			}
+		}
+
+		if err = rows.Scan(dest...); err != nil {
+			return err
+		}
+
+		row := make([]any, len(values))
+		for i, v := range values {
+			row[i] = backupValue(kinds[i], v, db)
+		}
+
+		if audioCol >= 0 {
+			key := ""
+			if keyCol >= 0 {
+				key, _ = row[keyCol].(string)
+			}
+
+			switch {
+			case !audio:
+				row[audioCol] = []byte{}
+
+			// the audio kept in the audio store comes along, restored
+			// into the database
+			case len(key) > 0 && calls.AudioStore != nil:
+				if b, err := calls.AudioStore.Get(key); err == nil {
+					row[audioCol] = b
+					row[keyCol] = nil
+				} else {
+					backups.Controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("backup: audio %s not included, %v", key, err))
+				}
+			}
+		}
+
+		if err = enc.Encode(backupRecord{Row: row}); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// open opens a backup by its name, looking in the backup directory then in
+// the s3 bucket, or by its path when allowed.
+func (backups *Backups) open(name string, allowPath bool) (io.ReadCloser, error) {
+	config := backups.Controller.Config
+
+	if filepath.Base(name) != name || !backupIsName(name) {
+		if !allowPath {
+			return nil, fmt.Errorf("invalid backup name %s", name)
+		}
+		return os.Open(name)
+	}
+
+	if backups.Enabled() {
+		if f, err := os.Open(filepath.Join(config.GetBackupDirPath(), name)); err == nil {
+			return f, nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	if config.BackupS3 {
+		store, err := NewS3AudioStore(config)
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := store.Get(backupS3Prefix + name)
+		if err != nil {
+			return nil, err
+		}
+
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+
+	if allowPath {
+		return os.Open(name)
+	}
+
+	return nil, fmt.Errorf("backup %s not found", name)
+}
+
+// prune removes the backups past the backupKeep option, from the s3 bucket
+// as well.
+func (backups *Backups) prune() error {
+	var (
+		config = backups.Controller.Config
+		keep   = int(backups.Controller.Options.BackupKeep)
+		store  *S3AudioStore
+	)
+
+	if keep == 0 {
+		return nil
+	}
+
+	l, err := backups.List()
+	if err != nil || len(l) <= keep {
+		return err
+	}
+
+	if config.BackupS3 {
+		if store, err = NewS3AudioStore(config); err != nil {
+			return err
+		}
+	}
+
+	for _, backup := range l[keep:] {
+		if err = os.Remove(filepath.Join(config.GetBackupDirPath(), backup.Name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		if store != nil {
+			if err = store.Delete(backupS3Prefix + backup.Name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// restore reads a backup into the database, in a single transaction. The
+// tables and the columns the database doesn't have are ignored, those the
+// backup doesn't have are left empty.
+func (backups *Backups) restore(r io.Reader) (int, error) {
+	var (
+		count   int
+		columns []int
+		kinds   []string
+		skip    bool
+		stmt    *sql.Stmt
+		tx      *sql.Tx
+	)
+
+	db := backups.Controller.Database
+
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	defer zr.Close()
+
+	dec := json.NewDecoder(zr)
+	dec.UseNumber()
+
+	record := backupRecord{}
+	if err = dec.Decode(&record); err != nil || record.Backup == nil {
+		return 0, errors.New("not a backup")
+	}
+
+	tables, err := db.Tables()
+	if err != nil {
+		return 0, err
+	}
+
+	exists := map[string]bool{}
+	for _, table := range tables {
+		exists[table] = !backupSkipTables[table]
+	}
+
+	if tx, err = db.Sql.Begin(); err != nil {
+		return 0, err
+	}
+
+	fail := func(err error) (int, error) {
+		if stmt != nil {
+			stmt.Close()
+		}
+		tx.Rollback()
+		return 0, err
+	}
+
+	for {
+		record = backupRecord{}
+
+		if err = dec.Decode(&record); err == io.EOF {
+			break
+		} else if err != nil {
+			return fail(err)
+		}
+
+		if len(record.Table) > 0 {
+			if stmt != nil {
+				stmt.Close()
+				stmt = nil
+			}
+
+			if skip = !exists[record.Table]; skip {
+				continue
+			}
+
+			if columns, kinds, stmt, err = backups.restoreTable(tx, record); err != nil {
+				return fail(fmt.Errorf("%s: %v", record.Table, err))
+			}
+
+			continue
+		}
+
+		if skip || stmt == nil {
+			continue
+		}
+
+		args := make([]any, len(columns))
+		for i, col := range columns {
+			if col < len(record.Row) {
+				args[i] = restoreValue(kinds[col], record.Row[col])
+			}
+		}
+
+		if _, err = stmt.Exec(args...); err != nil {
+			return fail(err)
+		}
+
+		count++
+	}
+
+	if stmt != nil {
+		stmt.Close()
+	}
+
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// restoreTable empties a table and prepares the insert of its rows, for the
+// columns both the backup and the database have.
+func (backups *Backups) restoreTable(tx *sql.Tx, record backupRecord) ([]int, []string, *sql.Stmt, error) {
+	rows, err := tx.Query(fmt.Sprintf("select * from `%s` where 1 = 0", record.Table))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	current, err := rows.Columns()
+	rows.Close()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	has := map[string]bool{}
+	for _, column := range current {
+		has[column] = true
+	}
+
+	columns := []int{}
+	names := []string{}
+	for i, column := range record.Columns {
+		if has[column] {
+			columns = append(columns, i)
+			names = append(names, fmt.Sprintf("`%s`", column))
+		}
+	}
+
+	kinds := record.Kinds
+	if len(kinds) < len(record.Columns) {
+		kinds = append(kinds, make([]string, len(record.Columns)-len(kinds))...)
+	}
+
+	if _, err = tx.Exec(fmt.Sprintf("delete from `%s`", record.Table)); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if len(columns) == 0 {
+		return columns, kinds, nil, nil
+	}
+
+	stmt, err := tx.Prepare(fmt.Sprintf("insert into `%s` (%s) values (%s)", record.Table, strings.Join(names, ", "), strings.TrimSuffix(strings.Repeat("?, ", len(names)), ", ")))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return columns, kinds, stmt, nil
+}
+
+func (backups *Backups) upload(name string) error {
+	store, err := NewS3AudioStore(backups.Controller.Config)
+	if err != nil {
+		return err
+	}
+
+	b, err := os.ReadFile(filepath.Join(backups.Controller.Config.GetBackupDirPath(), name))
+	if err != nil {
+		return err
+	}
+
+	return store.Put(backupS3Prefix+name, b, "application/gzip")
+}
+
+func backupColumnKind(typeName string) string {
+	switch t := strings.ToUpper(typeName); {
+	case strings.Contains(t, "BLOB"), t == "BYTEA", t == "BINARY", t == "VARBINARY":
+		return backupKindBlob
+	case t == "DATETIME", t == "DATE", strings.HasPrefix(t, "TIMESTAMP"):
+		return backupKindTime
+	default:
+		return ""
+	}
+}
+
+func backupIsName(name string) bool {
+	return strings.HasPrefix(name, backupPrefix) && strings.HasSuffix(name, backupExt)
+}
+
+// backupValue normalizes a value as read from the database driver, the
+// binary values being written as base64 and the datetimes as rfc3339.
+func backupValue(kind string, v any, db *Database) any {
+	switch kind {
+	case backupKindBlob:
+		if s, ok := v.(string); ok {
+			return []byte(s)
+		}
+
+	case backupKindTime:
+		if v == nil {
+			return nil
+		}
+		if t, err := db.ParseDateTime(v); err == nil {
+			return t.UTC().Format(time.RFC3339Nano)
+		}
+	}
+
+	if b, ok := v.([]byte); ok && kind != backupKindBlob {
+		return string(b)
+	}
+
+	return v
+}
+
+func restoreValue(kind string, v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+
+	case string:
+		switch kind {
+		case backupKindBlob:
+			if b, err := base64.StdEncoding.DecodeString(v); err == nil {
+				return b
+			}
+		case backupKindTime:
+			if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+				return t
+			}
+		}
+		return v
+
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+
+	default:
+		return v
+	}
+}
+
+// BackupsHandler lists the backups, and queues a backup or the restore of
+// one, ie: {"restore": "rdio-scanner-20221014-033000.backup.gz"}. Restoring
+// takes a superadmin.
+func (admin *Admin) BackupsHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		backups = admin.Controller.Backups
+		jobs    = admin.Controller.Jobs
+		logs    = admin.Controller.Logs
+	)
+
+	switch r.Method {
+	case http.MethodGet:
+		if !admin.Authorize(w, r, AdminRoleViewer) {
+			return
+		}
+
+		l, err := backups.List()
+		if err != nil {
+			logs.LogEvent(LogLevelError, err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if b, err := json.Marshal(map[string]any{
+			"backups": l,
+			"enabled": backups.Enabled(),
+			"s3":      admin.Controller.Config.BackupS3,
+		}); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+
+	case http.MethodPost:
+		var req struct {
+			Restore string `json:"restore"`
+		}
+
+		// the body is only read for the admins, restoring needing a
+		// superadmin once known
+		if !admin.Authorize(w, r, AdminRoleConfigEditor) {
+			return
+		}
+
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		var (
+			err error
+			job *Job
+		)
+
+		if len(req.Restore) > 0 {
+			if !admin.Authorize(w, r, AdminRoleSuperadmin) {
+				return
+			}
+
+			if !backupIsName(req.Restore) || filepath.Base(req.Restore) != req.Restore {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			if jobs.HasPending(JobKindRestore) {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+
+			if job, err = jobs.Enqueue(JobKindRestore, map[string]any{"name": req.Restore}, JobPriorityHigh); err == nil {
+				logs.LogEvent(LogLevelWarn, fmt.Sprintf("backup: restore of %s asked by admin from ip %s", req.Restore, GetRemoteAddr(r)))
+			}
+
+		} else {
+			if !backups.Enabled() {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			if jobs.HasPending(JobKindBackup) {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+
+			if job, err = jobs.Enqueue(JobKindBackup, nil, JobPriorityHigh); err == nil {
+				logs.LogEvent(LogLevelInfo, fmt.Sprintf("backup: asked by admin from ip %s", GetRemoteAddr(r)))
+			}
+		}
+
+		if err != nil {
+			logs.LogEvent(LogLevelError, err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if b, err := json.Marshal(job); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestBackups(t *testing.T) *Backups {
+	t.Helper()
+
+	controller := &Controller{
+		Calls:    NewCalls(),
+		Config:   &Config{BackupDir: t.TempDir()},
+		Database: newTestDatabase(t),
+		Logs:     NewLogs(),
+		Options:  NewOptions(),
+	}
+
+	return NewBackups(controller)
+}
+
+func TestBackupsPrune(t *testing.T) {
+	names := []string{
+		"rdio-scanner-20261011-033000.backup.gz",
+		"rdio-scanner-20261012-033000.backup.gz",
+		"rdio-scanner-20261013-033000.backup.gz",
+		"rdio-scanner-20261014-033000.backup.gz",
+	}
+
+	tests := []struct {
+		name string
+		keep uint
+		want []string
+	}{
+		{"keep everything", 0, names},
+		{"keep more than there are", 10, names},
+		{"keep the most recent", 2, names[2:]},
+		{"keep one", 1, names[3:]},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backups := newTestBackups(t)
+			backups.Controller.Options.BackupKeep = test.keep
+
+			dir := backups.Controller.Config.GetBackupDirPath()
+			for _, name := range append([]string{"notes.txt"}, names...) {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte{}, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := backups.prune(); err != nil {
+				t.Fatal(err)
+			}
+
+			got := []string{}
+			entries, _ := os.ReadDir(dir)
+			for _, entry := range entries {
+				if backupIsName(entry.Name()) {
+					got = append(got, entry.Name())
+				} else if entry.Name() != "notes.txt" {
+					t.Errorf("unexpected file %s", entry.Name())
+				}
+			}
+			sort.Strings(got)
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("kept %v, want %v", got, test.want)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err != nil {
+				t.Errorf("a file other than a backup was pruned, %v", err)
+			}
+		})
+	}
+}
+
+func TestBackupsRestore(t *testing.T) {
+	tests := []struct {
+		name      string
+		audio     bool
+		wantAudio int
+	}{
+		{"with the audio", true, 64},
+		{"without the audio", false, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backups := newTestBackups(t)
+			controller := backups.Controller
+			db := controller.Database
+
+			controller.Options.BackupAudio = test.audio
+
+			dateTime := time.Date(2026, 10, 14, 3, 30, 15, 0, time.UTC)
+
+			id, err := controller.Calls.WriteCall(&Call{Audio: make([]byte, 64), AudioName: "a.mp3", AudioType: "audio/mpeg", DateTime: dateTime, Source: 5, System: 1, Talkgroup: 2}, db)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = db.Sql.Exec("insert into `rdioScannerConfigs` (`key`, `val`) values (?, ?)", "test", `{"a":1}`); err != nil {
+				t.Fatal(err)
+			}
+
+			name, err := backups.Backup(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// changes made after the backup are undone by the restore
+			if _, err = db.Sql.Exec("update `rdioScannerConfigs` set `val` = ? where `key` = ?", "changed", "test"); err != nil {
+				t.Fatal(err)
+			}
+
+			other, err := controller.Calls.WriteCall(&Call{Audio: make([]byte, 64), DateTime: time.Now(), System: 3, Talkgroup: 4}, db)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			count, err := backups.Restore(name, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count < 2 {
+				t.Errorf("Restore() = %d rows, want at least 2", count)
+			}
+
+			call, err := controller.Calls.GetCall(id, db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if call.System != 1 || call.Talkgroup != 2 || call.Source != uint(5) || !call.DateTime.Equal(dateTime) || len(call.Audio) != test.wantAudio {
+				t.Errorf("restored call system %d talkgroup %d source %d datetime %v audio %d bytes", call.System, call.Talkgroup, call.Source, call.DateTime, len(call.Audio))
+			}
+
+			if _, err = controller.Calls.GetCall(other, db); !errors.Is(err, ErrCallNotFound) {
+				t.Errorf("the call written after the backup is still there, %v", err)
+			}
+
+			var val string
+			if err = db.Sql.QueryRow("select `val` from `rdioScannerConfigs` where `key` = ?", "test").Scan(&val); err != nil || val != `{"a":1}` {
+				t.Errorf("restored config %q, %v", val, err)
+			}
+		})
+	}
+}
+
+func TestBackupsRestoreSchemaChanges(t *testing.T) {
+	backups := newTestBackups(t)
+	db := backups.Controller.Database
+
+	var b bytes.Buffer
+
+	zw := gzip.NewWriter(&b)
+	enc := json.NewEncoder(zw)
+
+	for _, record := range []backupRecord{
+		{Backup: &backupHeader{CreatedAt: time.Now(), DbType: DbTypeSqlite, Version: Version}},
+		{Table: "rdioScannerGone", Columns: []string{"id"}},
+		{Row: []any{1}},
+		{Table: "rdioScannerConfigs", Columns: []string{"_id", "gone", "key", "val"}},
+		{Row: []any{7, "x", "a", "b"}},
+		{Table: "rdioScannerMeta", Columns: []string{"name"}},
+		{Row: []any{"not a migration"}},
+	} {
+		if err := enc.Encode(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	zw.Close()
+
+	count, err := backups.restore(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("restore() = %d rows, want 1", count)
+	}
+
+	var key, val string
+	if err = db.Sql.QueryRow("select `key`, `val` from `rdioScannerConfigs` where `_id` = 7").Scan(&key, &val); err != nil || key != "a" || val != "b" {
+		t.Errorf("restored config %q = %q, %v", key, val, err)
+	}
+
+	var n int
+	if err = db.Sql.QueryRow("select count(*) from `rdioScannerMeta` where `name` = ?", "not a migration").Scan(&n); err != nil || n != 0 {
+		t.Errorf("the migrations were restored, %d, %v", n, err)
+	}
+}
+
+func TestBackupsRestoreInvalid(t *testing.T) {
+	backups := newTestBackups(t)
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(`{"table":"rdioScannerConfigs"}` + "\n"))
+	zw.Close()
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"not gzipped", []byte("hello")},
+		{"no header", gz.Bytes()},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := backups.restore(bytes.NewReader(test.data)); err == nil {
+				t.Error("restore() succeeded")
+			}
+		})
+	}
+
+	if _, err := backups.Restore("../rdio-scanner-20261014-033000.backup.gz", false); err == nil {
+		t.Error("Restore() accepted a path")
+	}
+}
+
+func TestBackupsHandlerAuthorizesFirst(t *testing.T) {
+	backups := newTestBackups(t)
+	controller := backups.Controller
+	controller.Backups = backups
+	controller.Options.secret = "secret"
+
+	admin := NewAdmin(controller)
+
+	token := func(role string) string {
+		var (
+			s   string
+			err error
+		)
+		if len(role) == 0 {
+			s, err = admin.NewToken(nil)
+		} else {
+			s, err = admin.NewOidcToken("someone", role)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		body   string
+		status int
+	}{
+		{"no token with an invalid body", "", "{", http.StatusUnauthorized},
+		{"no token with a large body", "", `{"restore":"` + strings.Repeat("a", 1<<20) + `"}`, http.StatusUnauthorized},
+		{"viewer", token(AdminRoleViewer), "{", http.StatusForbidden},
+		{"config editor restoring", token(AdminRoleConfigEditor), `{"restore":"rdio-scanner-20261014-033000.backup.gz"}`, http.StatusForbidden},
+		{"invalid body", token(""), "{", http.StatusBadRequest},
+		{"too large body", token(""), `{"restore":"` + strings.Repeat("a", 8192) + `"}`, http.StatusBadRequest},
+		{"invalid name", token(""), `{"restore":"../etc/passwd"}`, http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/admin/backups", strings.NewReader(test.body))
+			if len(test.token) > 0 {
+				r.Header.Set("Authorization", test.token)
+			}
+
+			w := httptest.NewRecorder()
+			admin.BackupsHandler(w, r)
+
+			if w.Code != test.status {
+				t.Errorf("status %d, want %d", w.Code, test.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,401 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type Blackout struct {
+	Id         any       `json:"_id"`
+	CreatedAt  time.Time `json:"createdAt"`
+	Expires    time.Time `json:"expires"`
+	Reason     string    `json:"reason"`
+	System     uint      `json:"system"`
+	Talkgroups []uint    `json:"talkgroups"`
+}
+
+func (blackout *Blackout) FromMap(m map[string]any) *Blackout {
+	blackout.CreatedAt = time.Now().UTC()
+
+	switch v := m["duration"].(type) {
+	case float64:
+		blackout.Expires = blackout.CreatedAt.Add(time.Duration(v * float64(time.Minute)))
+	}
+
+	switch v := m["reason"].(type) {
+	case string:
+		blackout.Reason = v
+	}
+
+	switch v := m["system"].(type) {
+	case float64:
+		blackout.System = uint(v)
+	}
+
+	switch v := m["talkgroups"].(type) {
+	case []any:
+		blackout.Talkgroups = []uint{}
+		for _, f := range v {
+			switch tg := f.(type) {
+			case float64:
+				blackout.Talkgroups = append(blackout.Talkgroups, uint(tg))
+			}
+		}
+	}
+
+	return blackout
+}
+
+func (blackout *Blackout) IsActive() bool {
+	return time.Now().Before(blackout.Expires)
+}
+
+func (blackout *Blackout) Matches(call *Call) bool {
+	if blackout.System != call.System {
+		return false
+	}
+
+	for _, tg := range blackout.Talkgroups {
+		if tg == call.Talkgroup {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Blackouts suspend the delivery of selected talkgroups to listeners and
+// downstreams for a limited time. Calls are still ingested and archived.
+type Blackouts struct {
+	Controller *Controller
+	List       []*Blackout
+	timers     map[uint]*time.Timer
+	mutex      sync.Mutex
+}
+
+func NewBlackouts(controller *Controller) *Blackouts {
+	return &Blackouts{
+		Controller: controller,
+		List:       []*Blackout{},
+		timers:     map[uint]*time.Timer{},
+		mutex:      sync.Mutex{},
+	}
+}
+
+func (blackouts *Blackouts) Add(blackout *Blackout, db *Database) error {
+	var (
+		b   []byte
+		err error
+		id  int64
+		res sql.Result
+	)
+
+	blackouts.mutex.Lock()
+	defer blackouts.mutex.Unlock()
+
+	formatError := func(err error) error {
+		return fmt.Errorf("blackouts.add: %v", err)
+	}
+
+	if blackout.System == 0 {
+		return formatError(errors.New("no system"))
+	}
+
+	if len(blackout.Talkgroups) == 0 {
+		return formatError(errors.New("no talkgroups"))
+	}
+
+	if !blackout.IsActive() {
+		return formatError(errors.New("invalid duration"))
+	}
+
+	if b, err = json.Marshal(blackout.Talkgroups); err != nil {
+		return formatError(err)
+	}
+
+	if res, err = db.Sql.Exec("insert into `rdioScannerBlackouts` (`createdAt`, `expires`, `reason`, `system`, `talkgroups`) values (?, ?, ?, ?, ?)", blackout.CreatedAt, blackout.Expires, blackout.Reason, blackout.System, string(b)); err != nil {
+		return formatError(err)
+	}
+
+	if id, err = res.LastInsertId(); err != nil {
+		return formatError(err)
+	}
+
+	blackout.Id = uint(id)
+
+	blackouts.List = append(blackouts.List, blackout)
+	blackouts.schedule(blackout)
+
+	return nil
+}
+
+func (blackouts *Blackouts) GetActive() []*Blackout {
+	blackouts.mutex.Lock()
+	defer blackouts.mutex.Unlock()
+
+	l := []*Blackout{}
+
+	for _, blackout := range blackouts.List {
+		if blackout.IsActive() {
+			l = append(l, blackout)
+		}
+	}
+
+	return l
+}
+
+func (blackouts *Blackouts) IsBlackedOut(call *Call) bool {
+	blackouts.mutex.Lock()
+	defer blackouts.mutex.Unlock()
+
+	for _, blackout := range blackouts.List {
+		if blackout.IsActive() && blackout.Matches(call) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (blackouts *Blackouts) Lift(id uint, db *Database) (*Blackout, error) {
+	blackouts.mutex.Lock()
+	defer blackouts.mutex.Unlock()
+
+	return blackouts.remove(id, db)
+}
+
+func (blackouts *Blackouts) Read(db *Database) error {
+	var (
+		createdAt  any
+		err        error
+		expires    any
+		expired    = []*Blackout{}
+		id         sql.NullFloat64
+		rows       *sql.Rows
+		talkgroups string
+	)
+
+	blackouts.mutex.Lock()
+	defer blackouts.mutex.Unlock()
+
+	for _, timer := range blackouts.timers {
+		timer.Stop()
+	}
+
+	blackouts.List = []*Blackout{}
+	blackouts.timers = map[uint]*time.Timer{}
+
+	formatError := func(err error) error {
+		return fmt.Errorf("blackouts.read: %v", err)
+	}
+
+	if rows, err = db.Sql.Query("select `_id`, `createdAt`, `expires`, `reason`, `system`, `talkgroups` from `rdioScannerBlackouts`"); err != nil {
+		return formatError(err)
+	}
+
+	for rows.Next() {
+		blackout := &Blackout{}
+
+		if err = rows.Scan(&id, &createdAt, &expires, &blackout.Reason, &blackout.System, &talkgroups); err != nil {
+			break
+		}
+
+		if id.Valid && id.Float64 > 0 {
+			blackout.Id = uint(id.Float64)
+		}
+
+		if t, err := db.ParseDateTime(createdAt); err == nil {
+			blackout.CreatedAt = t
+		}
+
+		if t, err := db.ParseDateTime(expires); err == nil {
+			blackout.Expires = t
+		}
+
+		if err = json.Unmarshal([]byte(talkgroups), &blackout.Talkgroups); err != nil {
+			blackout.Talkgroups = []uint{}
+		}
+
+		if blackout.IsActive() {
+			blackouts.List = append(blackouts.List, blackout)
+		} else {
+			expired = append(expired, blackout)
+		}
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	for _, blackout := range blackouts.List {
+		blackouts.schedule(blackout)
+	}
+
+	for _, blackout := range expired {
+		if _, err = db.Sql.Exec("delete from `rdioScannerBlackouts` where `_id` = ?", blackout.Id); err != nil {
+			return formatError(err)
+		}
+
+		blackouts.Controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("blackout: system=%v talkgroups=%v expired", blackout.System, blackout.Talkgroups))
+	}
+
+	return nil
+}
+
+func (blackouts *Blackouts) remove(id uint, db *Database) (*Blackout, error) {
+	for i, blackout := range blackouts.List {
+		if blackout.Id != id {
+			continue
+		}
+
+		if _, err := db.Sql.Exec("delete from `rdioScannerBlackouts` where `_id` = ?", id); err != nil {
+			return nil, fmt.Errorf("blackouts.remove: %v", err)
+		}
+
+		if timer, ok := blackouts.timers[id]; ok {
+			timer.Stop()
+			delete(blackouts.timers, id)
+		}
+
+		blackouts.List = append(blackouts.List[:i], blackouts.List[i+1:]...)
+
+		return blackout, nil
+	}
+
+	return nil, nil
+}
+
+func (blackouts *Blackouts) schedule(blackout *Blackout) {
+	id, ok := blackout.Id.(uint)
+	if !ok {
+		return
+	}
+
+	blackouts.timers[id] = time.AfterFunc(time.Until(blackout.Expires), func() {
+		blackouts.mutex.Lock()
+		defer blackouts.mutex.Unlock()
+
+		delete(blackouts.timers, id)
+
+		if b, err := blackouts.remove(id, blackouts.Controller.Database); err != nil {
+			blackouts.Controller.Logs.LogEvent(LogLevelError, err.Error())
+		} else if b != nil {
+			blackouts.Controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("blackout: system=%v talkgroups=%v expired", b.System, b.Talkgroups))
+		}
+	})
+}
+
+func (blackouts *Blackouts) sqlCondition() *SqlCondition {
+	blackouts.mutex.Lock()
+	defer blackouts.mutex.Unlock()
+
+	a := []*SqlCondition{}
+
+	for _, blackout := range blackouts.List {
+		if !blackout.IsActive() {
+			continue
+		}
+
+		a = append(a, SqlAnd(SqlWhere("`system` = ?", blackout.System), SqlIn("talkgroup", blackout.Talkgroups)))
+	}
+
+	if len(a) == 0 {
+		return nil
+	}
+
+	return SqlNot(SqlOr(a...))
+}
+
+func (admin *Admin) BlackoutsHandler(w http.ResponseWriter, r *http.Request) {
+	if !admin.Authorize(w, r, adminWriteRole(r)) {
+		return
+	}
+
+	blackouts := admin.Controller.Blackouts
+	logs := admin.Controller.Logs
+
+	switch r.Method {
+	case http.MethodDelete:
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil || id < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		blackout, err := blackouts.Lift(uint(id), admin.Controller.Database)
+		if err != nil {
+			logs.LogEvent(LogLevelError, err.Error())
+			w.WriteHeader(http.StatusExpectationFailed)
+			return
+		}
+
+		if blackout == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		admin.Controller.AutoMute.Exempt(blackout)
+
+		logs.LogEvent(LogLevelWarn, fmt.Sprintf("blackout: system=%v talkgroups=%v lifted by admin from ip %s", blackout.System, blackout.Talkgroups, GetRemoteAddr(r)))
+
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodGet:
+		if b, err := json.Marshal(blackouts.GetActive()); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+
+	case http.MethodPost:
+		m := map[string]any{}
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		blackout := (&Blackout{}).FromMap(m)
+
+		if err := blackouts.Add(blackout, admin.Controller.Database); err != nil {
+			logs.LogEvent(LogLevelWarn, err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		logs.LogEvent(LogLevelWarn, fmt.Sprintf("blackout: system=%v talkgroups=%v suspended until %v by admin from ip %s, reason: %s", blackout.System, blackout.Talkgroups, blackout.Expires.Format(time.RFC3339), GetRemoteAddr(r), blackout.Reason))
+
+		if b, err := json.Marshal(blackout); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
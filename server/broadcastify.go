@@ -0,0 +1,488 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	broadcastifyBackoff = 5 * time.Second
+	broadcastifyRetries = 5
+	broadcastifyUrl     = "https://api.broadcastify.com/call-upload"
+)
+
+// BroadcastifyFeed uploads the calls of the selected systems and talkgroups
+// to a Broadcastify Calls system, minus the excluded ones. Both selections
+// use the same format as the downstreams. The url defaults to the
+// Broadcastify api when left empty.
+type BroadcastifyFeed struct {
+	Id       any    `json:"_id"`
+	Apikey   string `json:"apiKey"`
+	Disabled bool   `json:"disabled"`
+	Excludes any    `json:"excludes"`
+	Order    any    `json:"order"`
+	SystemId uint   `json:"systemId"`
+	Systems  any    `json:"systems"`
+	Url      string `json:"url"`
+}
+
+func (feed *BroadcastifyFeed) FromMap(m map[string]any) *BroadcastifyFeed {
+	switch v := m["_id"].(type) {
+	case float64:
+		feed.Id = uint(v)
+	}
+
+	switch v := m["apiKey"].(type) {
+	case string:
+		feed.Apikey = v
+	}
+
+	switch v := m["disabled"].(type) {
+	case bool:
+		feed.Disabled = v
+	}
+
+	switch v := m["excludes"].(type) {
+	case []any:
+		if b, err := json.Marshal(v); err == nil {
+			feed.Excludes = string(b)
+		}
+	case string:
+		feed.Excludes = v
+	}
+
+	switch v := m["order"].(type) {
+	case float64:
+		feed.Order = uint(v)
+	}
+
+	switch v := m["systemId"].(type) {
+	case float64:
+		feed.SystemId = uint(v)
+	}
+
+	switch v := m["systems"].(type) {
+	case []any:
+		if b, err := json.Marshal(v); err == nil {
+			feed.Systems = string(b)
+		}
+	case string:
+		feed.Systems = v
+	}
+
+	switch v := m["url"].(type) {
+	case string:
+		feed.Url = v
+	}
+
+	return feed
+}
+
+func (feed *BroadcastifyFeed) HasAccess(call *Call) bool {
+	if feed.Disabled {
+		return false
+	}
+
+	if feed.Excludes != nil && (&Downstream{Systems: feed.Excludes}).HasAccess(call) {
+		return false
+	}
+
+	return (&Downstream{Systems: feed.Systems}).HasAccess(call)
+}
+
+// Send does one upload attempt. The call metadata is posted first, in the
+// trunk-recorder format, and Broadcastify answers with the url where the
+// audio is then put. The returned bool tells whether the attempt can be
+// retried.
+func (feed *BroadcastifyFeed) Send(call *Call) (bool, error) {
+	var buf = bytes.Buffer{}
+
+	formatError := func(err error) error {
+		return fmt.Errorf("broadcastify.send: %v", err)
+	}
+
+	if call.AudioType != "audio/mp4" {
+		return false, formatError(errors.New("audio must be converted to m4a"))
+	}
+
+	metadata, err := json.Marshal(broadcastifyMetadata(call))
+	if err != nil {
+		return false, formatError(err)
+	}
+
+	mw := multipart.NewWriter(&buf)
+
+	if w, err := mw.CreateFormFile("metadata", "metadata.json"); err == nil {
+		if _, err = w.Write(metadata); err != nil {
+			return false, formatError(err)
+		}
+	} else {
+		return false, formatError(err)
+	}
+
+	for k, v := range map[string]string{
+		"apiKey":       feed.Apikey,
+		"callDuration": fmt.Sprintf("%.2f", call.Duration.Seconds()),
+		"systemId":     fmt.Sprintf("%d", feed.SystemId),
+	} {
+		if err = mw.WriteField(k, v); err != nil {
+			return false, formatError(err)
+		}
+	}
+
+	if err = mw.Close(); err != nil {
+		return false, formatError(err)
+	}
+
+	u := broadcastifyUrl
+	if len(feed.Url) > 0 {
+		u = feed.Url
+	}
+
+	c := http.Client{Timeout: 30 * time.Second}
+
+	res, err := c.Post(u, mw.FormDataContentType(), &buf)
+	if err != nil {
+		return true, formatError(err)
+	}
+
+	b, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return true, formatError(err)
+	}
+
+	if res.StatusCode >= 500 {
+		return true, formatError(fmt.Errorf("bad status: %s", res.Status))
+	} else if res.StatusCode != http.StatusOK {
+		return false, formatError(fmt.Errorf("bad status: %s %s", res.Status, strings.TrimSpace(string(b))))
+	}
+
+	// a successful answer is "0 <upload url>", anything else is an error
+	// code followed by its description
+	f := strings.SplitN(strings.TrimSpace(string(b)), " ", 2)
+	if len(f) != 2 || f[0] != "0" {
+		if len(f) == 2 && strings.Contains(f[1], "SKIPPED") {
+			return false, nil
+		}
+		return false, formatError(fmt.Errorf("upload refused: %s", strings.TrimSpace(string(b))))
+	}
+
+	req, err := http.NewRequest(http.MethodPut, f[1], bytes.NewReader(call.Audio))
+	if err != nil {
+		return false, formatError(err)
+	}
+	req.Header.Set("Content-Type", "audio/aac")
+
+	if res, err = c.Do(req); err != nil {
+		return true, formatError(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return res.StatusCode >= 500, formatError(fmt.Errorf("audio upload bad status: %s", res.Status))
+	}
+
+	return false, nil
+}
+
+type BroadcastifyFeeds struct {
+	Controller *Controller
+	List       []*BroadcastifyFeed
+	mutex      sync.Mutex
+}
+
+func NewBroadcastifyFeeds(controller *Controller) *BroadcastifyFeeds {
+	return &BroadcastifyFeeds{
+		Controller: controller,
+		List:       []*BroadcastifyFeed{},
+		mutex:      sync.Mutex{},
+	}
+}
+
+func (feeds *BroadcastifyFeeds) FromMap(f []any) *BroadcastifyFeeds {
+	feeds.mutex.Lock()
+	defer feeds.mutex.Unlock()
+
+	feeds.List = []*BroadcastifyFeed{}
+
+	for _, r := range f {
+		switch m := r.(type) {
+		case map[string]any:
+			feed := &BroadcastifyFeed{}
+			feed.FromMap(m)
+			feeds.List = append(feeds.List, feed)
+		}
+	}
+
+	return feeds
+}
+
+func (feeds *BroadcastifyFeeds) Read(db *Database) error {
+	var (
+		err      error
+		excludes string
+		id       sql.NullFloat64
+		order    sql.NullFloat64
+		rows     *sql.Rows
+		systems  string
+	)
+
+	feeds.mutex.Lock()
+	defer feeds.mutex.Unlock()
+
+	feeds.List = []*BroadcastifyFeed{}
+
+	formatError := func(err error) error {
+		return fmt.Errorf("broadcastifyFeeds.read: %v", err)
+	}
+
+	if rows, err = db.Sql.Query("select `_id`, `apiKey`, `disabled`, `excludes`, `order`, `systemId`, `systems`, `url` from `rdioScannerBroadcastifyFeeds` order by `order`"); err != nil {
+		return formatError(err)
+	}
+
+	for rows.Next() {
+		feed := &BroadcastifyFeed{}
+
+		if err = rows.Scan(&id, &feed.Apikey, &feed.Disabled, &excludes, &order, &feed.SystemId, &systems, &feed.Url); err != nil {
+			break
+		}
+
+		if feed.Apikey, err = db.Secrets.Open(feed.Apikey); err != nil {
+			break
+		}
+
+		if id.Valid && id.Float64 > 0 {
+			feed.Id = uint(id.Float64)
+		}
+
+		if order.Valid && order.Float64 > 0 {
+			feed.Order = uint(order.Float64)
+		}
+
+		if err = json.Unmarshal([]byte(excludes), &feed.Excludes); err != nil {
+			feed.Excludes = []any{}
+		}
+
+		if err = json.Unmarshal([]byte(systems), &feed.Systems); err != nil {
+			feed.Systems = []any{}
+		}
+
+		feeds.List = append(feeds.List, feed)
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	return nil
+}
+
+// Send uploads the call to every matching feed, retrying with an
+// exponential backoff when Broadcastify can't be reached.
+func (feeds *BroadcastifyFeeds) Send(call *Call) {
+	controller := feeds.Controller
+
+	feeds.mutex.Lock()
+	list := []*BroadcastifyFeed{}
+	for _, feed := range feeds.List {
+		if feed.HasAccess(call) {
+			list = append(list, feed)
+		}
+	}
+	feeds.mutex.Unlock()
+
+	if len(list) == 0 {
+		return
+	}
+
+	for _, feed := range list {
+		go func(feed *BroadcastifyFeed) {
+			logEvent := func(logLevel string, message string) {
+				controller.Logs.LogEvent(logLevel, fmt.Sprintf("broadcastify: system=%v talkgroup=%v file=%v to %v %v", call.System, call.Talkgroup, call.AudioName, feed.SystemId, message))
+			}
+
+			backoff := broadcastifyBackoff
+
+			for attempt := 1; ; attempt++ {
+				retry, err := feed.Send(call)
+				if err == nil {
+					logEvent(LogLevelInfo, "success")
+					return
+				}
+
+				if !retry || attempt == broadcastifyRetries {
+					logEvent(LogLevelError, err.Error())
+
+					if call.trace != nil {
+						call.trace.AddEvent(fmt.Sprintf("broadcastify %v %v", feed.SystemId, err.Error()))
+					}
+					return
+				}
+
+				logEvent(LogLevelWarn, fmt.Sprintf("%v, retrying in %v", err.Error(), backoff))
+
+				time.Sleep(backoff)
+				backoff *= 2
+			}
+		}(feed)
+	}
+}
+
+func (feeds *BroadcastifyFeeds) Write(db *Database) error {
+	var (
+		apiKey   string
+		count    uint
+		err      error
+		excludes any
+		rows     *sql.Rows
+		rowIds   = []uint{}
+		systems  any
+	)
+
+	feeds.mutex.Lock()
+	defer feeds.mutex.Unlock()
+
+	formatError := func(err error) error {
+		return fmt.Errorf("broadcastifyFeeds.write: %v", err)
+	}
+
+	if rows, err = db.Sql.Query("select `_id` from `rdioScannerBroadcastifyFeeds`"); err != nil {
+		return formatError(err)
+	}
+
+	for rows.Next() {
+		var rowId uint
+		if err = rows.Scan(&rowId); err != nil {
+			break
+		}
+		remove := true
+		for _, feed := range feeds.List {
+			if feed.Id == nil || feed.Id == rowId {
+				remove = false
+				break
+			}
+		}
+		if remove {
+			rowIds = append(rowIds, rowId)
+		}
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	if len(rowIds) > 0 {
+		if _, err = db.Delete("rdioScannerBroadcastifyFeeds").Where(SqlIn("_id", rowIds)).Exec(); err != nil {
+			return formatError(err)
+		}
+	}
+
+	for _, feed := range feeds.List {
+		switch feed.Excludes {
+		case nil:
+			excludes = "[]"
+		case "*":
+			excludes = `"*"`
+		default:
+			excludes = feed.Excludes
+		}
+
+		switch feed.Systems {
+		case "*":
+			systems = `"*"`
+		default:
+			systems = feed.Systems
+		}
+
+		if apiKey, err = db.Secrets.Seal(feed.Apikey); err != nil {
+			break
+		}
+
+		if err = db.Sql.QueryRow("select count(*) from `rdioScannerBroadcastifyFeeds` where `_id` = ?", feed.Id).Scan(&count); err != nil {
+			break
+		}
+
+		if count == 0 {
+			if _, err = db.Sql.Exec("insert into `rdioScannerBroadcastifyFeeds` (`_id`, `apiKey`, `disabled`, `excludes`, `order`, `systemId`, `systems`, `url`) values (?, ?, ?, ?, ?, ?, ?, ?)", feed.Id, apiKey, feed.Disabled, excludes, feed.Order, feed.SystemId, systems, feed.Url); err != nil {
+				break
+			}
+
+		} else if _, err = db.Sql.Exec("update `rdioScannerBroadcastifyFeeds` set `apiKey` = ?, `disabled` = ?, `excludes` = ?, `order` = ?, `systemId` = ?, `systems` = ?, `url` = ? where `_id` = ?", apiKey, feed.Disabled, excludes, feed.Order, feed.SystemId, systems, feed.Url, feed.Id); err != nil {
+			break
+		}
+	}
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	return nil
+}
+
+func broadcastifyMetadata(call *Call) map[string]any {
+	freqList := []map[string]any{}
+	srcList := []map[string]any{}
+
+	switch v := call.Frequencies.(type) {
+	case []map[string]any:
+		for _, f := range v {
+			freqList = append(freqList, map[string]any{
+				"error_count": f["errorCount"],
+				"freq":        f["freq"],
+				"len":         f["len"],
+				"pos":         f["pos"],
+				"spike_count": f["spikeCount"],
+			})
+		}
+	}
+
+	switch v := call.Sources.(type) {
+	case []map[string]any:
+		for _, s := range v {
+			srcList = append(srcList, map[string]any{
+				"pos": s["pos"],
+				"src": s["src"],
+			})
+		}
+	}
+
+	return map[string]any{
+		"call_length": int(call.Duration.Seconds()),
+		"emergency":   0,
+		"freq":        call.Frequency,
+		"freqList":    freqList,
+		"srcList":     srcList,
+		"start_time":  call.DateTime.Unix(),
+		"stop_time":   call.DateTime.Add(call.Duration).Unix(),
+		"talkgroup":   call.Talkgroup,
+	}
+}
@@ -21,29 +21,56 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	CallModeFdma = "fdma"
+	CallModeTdma = "tdma"
 )
 
+// ErrCallNotFound is returned by GetCall when no call has the id.
+var ErrCallNotFound = errors.New("call not found")
+
 type Call struct {
-	Id             any       `json:"id"`
-	Audio          []byte    `json:"audio"`
-	AudioName      any       `json:"audioName"`
-	AudioType      any       `json:"audioType"`
-	DateTime       time.Time `json:"dateTime"`
-	Frequencies    any       `json:"frequencies"`
-	Frequency      any       `json:"frequency"`
-	Patches        any       `json:"patches"`
-	Source         any       `json:"source"`
-	Sources        any       `json:"sources"`
-	System         uint      `json:"system"`
-	Talkgroup      uint      `json:"talkgroup"`
+	Id             any               `json:"id"`
+	Audio          []byte            `json:"audio"`
+	AudioName      any               `json:"audioName"`
+	AudioType      any               `json:"audioType"`
+	Cold           bool              `json:"cold"`
+	DateTime       time.Time         `json:"dateTime"`
+	Duration       time.Duration     `json:"duration"`
+	Emergency      bool              `json:"emergency"`
+	Encrypted      bool              `json:"encrypted"`
+	Frequencies    any               `json:"frequencies"`
+	Frequency      any               `json:"frequency"`
+	Latitude       any               `json:"latitude"`
+	Longitude      any               `json:"longitude"`
+	Metadata       map[string]string `json:"metadata"`
+	Mode           string            `json:"mode"`
+	Patches        any               `json:"patches"`
+	Priority       uint              `json:"priority"`
+	Site           uint              `json:"site"`
+	Source         any               `json:"source"`
+	Sources        any               `json:"sources"`
+	System         uint              `json:"system"`
+	Talkgroup      uint              `json:"talkgroup"`
+	Transcript     any               `json:"transcript"`
+	Uuid           string            `json:"uuid"`
+	populate       bool
+	skew           time.Duration
 	systemLabel    any
 	talkgroupGroup any
 	talkgroupLabel any
 	talkgroupName  any
 	talkgroupTag   any
+	trace          *CallTrace
 	units          any
 }
 
@@ -55,6 +82,14 @@ func NewCall() *Call {
 	}
 }
 
+// HasLocation tells whether the call has both a latitude and a longitude.
+func (call *Call) HasLocation() bool {
+	_, lat := call.Latitude.(float64)
+	_, lon := call.Longitude.(float64)
+
+	return lat && lon
+}
+
 func (call *Call) IsValid() (ok bool, err error) {
 	ok = true
 
@@ -85,23 +120,137 @@ func (call *Call) MarshalJSON() ([]byte, error) {
 	audio := fmt.Sprintf("%v", call.Audio)
 	audio = strings.ReplaceAll(audio, " ", ",")
 
-	return json.Marshal(map[string]any{
-		"id": call.Id,
-		"audio": map[string]any{
-			"data": json.RawMessage(audio),
-			"type": "Buffer",
-		},
+	m := call.metadata()
+	m["audio"] = map[string]any{
+		"data": json.RawMessage(audio),
+		"type": "Buffer",
+	}
+
+	return json.Marshal(m)
+}
+
+// metadata returns the fields of the call sent to the listeners but its
+// audio.
+func (call *Call) metadata() map[string]any {
+	m := map[string]any{
+		"id":          call.Id,
 		"audioName":   call.AudioName,
 		"audioType":   call.AudioType,
 		"dateTime":    call.DateTime.Format(time.RFC3339),
+		"duration":    call.Duration.Seconds(),
 		"frequencies": call.Frequencies,
 		"frequency":   call.Frequency,
+		"latitude":    call.Latitude,
+		"longitude":   call.Longitude,
 		"patches":     call.Patches,
 		"source":      call.Source,
 		"sources":     call.Sources,
 		"system":      call.System,
 		"talkgroup":   call.Talkgroup,
-	})
+		"transcript":  call.Transcript,
+	}
+
+	if call.Cold {
+		m["cold"] = true
+	}
+
+	if call.Emergency {
+		m["emergency"] = true
+	}
+
+	if call.Encrypted {
+		m["encrypted"] = true
+	}
+
+	if len(call.Metadata) > 0 {
+		m["metadata"] = call.Metadata
+	}
+
+	if len(call.Mode) > 0 {
+		m["mode"] = call.Mode
+	}
+
+	if call.Priority > 0 {
+		m["priority"] = call.Priority
+	}
+
+	if call.Site > 0 {
+		m["site"] = call.Site
+	}
+
+	if len(call.Uuid) > 0 {
+		m["uuid"] = call.Uuid
+	}
+
+	return m
+}
+
+// Slice keeps the frequencies and the sources of the call heard between
+// start and end, shifting their positions to the start of the slice. The
+// source or frequency already active at start is kept at position 0.
+func (call *Call) Slice(start time.Duration, end time.Duration) {
+	slice := func(marks any) any {
+		var (
+			active   map[string]any
+			from     = start.Seconds()
+			to       = end.Seconds()
+			selected = []map[string]any{}
+		)
+
+		list := []map[string]any{}
+		switch v := marks.(type) {
+		case []any:
+			for _, mark := range v {
+				if m, ok := mark.(map[string]any); ok {
+					list = append(list, m)
+				}
+			}
+		case []map[string]any:
+			list = v
+		}
+
+		for _, mark := range list {
+			var pos float64
+
+			switch v := mark["pos"].(type) {
+			case float64:
+				pos = v
+			case uint:
+				pos = float64(v)
+			case int:
+				pos = float64(v)
+			}
+
+			if pos <= from {
+				active = mark
+				continue
+			}
+
+			if pos < to {
+				m := map[string]any{}
+				for k, v := range mark {
+					m[k] = v
+				}
+				m["pos"] = pos - from
+				selected = append(selected, m)
+			}
+		}
+
+		if active != nil {
+			m := map[string]any{}
+			for k, v := range active {
+				m[k] = v
+			}
+			m["pos"] = 0
+			selected = append([]map[string]any{m}, selected...)
+		}
+
+		return selected
+	}
+
+	call.Duration = end - start
+	call.Frequencies = slice(call.Frequencies)
+	call.Sources = slice(call.Sources)
 }
 
 func (call *Call) ToJson() (string, error) {
@@ -113,7 +262,9 @@ func (call *Call) ToJson() (string, error) {
 }
 
 type Calls struct {
-	mutex sync.Mutex
+	AudioStore AudioStore
+	ColdStore  AudioStore
+	mutex      sync.Mutex
 }
 
 func NewCalls() *Calls {
@@ -122,6 +273,143 @@ func NewCalls() *Calls {
 	}
 }
 
+// Airtime sums the duration of the calls between from and to, per system
+// and talkgroup, into buckets of the given interval.
+func (calls *Calls) Airtime(db *Database, from time.Time, to time.Time, interval time.Duration, system uint, talkgroup uint) ([]*TalkgroupAirtime, error) {
+	var (
+		airtimes = map[string]*TalkgroupAirtime{}
+		dateTime any
+		duration sql.NullFloat64
+		err      error
+		rows     *sql.Rows
+		sys      uint
+		t        time.Time
+		tg       uint
+	)
+
+	calls.mutex.Lock()
+	defer calls.mutex.Unlock()
+
+	formatError := func(err error) error {
+		return fmt.Errorf("calls.airtime: %v", err)
+	}
+
+	query := db.Select("rdioScannerCalls", "dateTime", "duration", "system", "talkgroup").Where(SqlWhere("`dateTime` between ? and ?", from, to))
+
+	if system > 0 {
+		query.Where(SqlWhere("`system` = ?", system))
+
+		if talkgroup > 0 {
+			query.Where(SqlWhere("`talkgroup` = ?", talkgroup))
+		}
+	}
+
+	if rows, err = query.Query(); err != nil {
+		return nil, formatError(err)
+	}
+
+	for rows.Next() {
+		if err = rows.Scan(&dateTime, &duration, &sys, &tg); err != nil {
+			break
+		}
+
+		if t, err = db.ParseDateTime(dateTime); err != nil {
+			err = nil
+			continue
+		}
+
+		k := fmt.Sprintf("%d.%d", sys, tg)
+
+		airtime := airtimes[k]
+		if airtime == nil {
+			airtime = &TalkgroupAirtime{System: sys, Talkgroup: tg, buckets: map[int64]*AirtimeBucket{}}
+			airtimes[k] = airtime
+		}
+
+		airtime.Add(t.UTC().Truncate(interval), duration.Float64/1000)
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return nil, formatError(err)
+	}
+
+	list := make([]*TalkgroupAirtime, 0, len(airtimes))
+	for _, airtime := range airtimes {
+		list = append(list, airtime.sort())
+	}
+
+	sort.Slice(list, func(i int, j int) bool {
+		if list[i].System == list[j].System {
+			return list[i].Talkgroup < list[j].Talkgroup
+		}
+		return list[i].System < list[j].System
+	})
+
+	return list, nil
+}
+
+// SignalStats returns the signal statistics of the calls of the system, of
+// one of its sites when site is set. The calls are not locked, the
+// statistics being read only.
+func (calls *Calls) SignalStats(db *Database, from time.Time, to time.Time, interval time.Duration, system uint, site uint) (*SignalStats, error) {
+	var (
+		dateTime    any
+		duration    sql.NullFloat64
+		err         error
+		frequencies string
+		rows        *sql.Rows
+		s           sql.NullFloat64
+		t           time.Time
+	)
+
+	formatError := func(err error) error {
+		return fmt.Errorf("calls.signalstats: %v", err)
+	}
+
+	stats := NewSignalStats()
+
+	query := db.Select("rdioScannerCalls", "dateTime", "duration", "frequencies", "site").Where(SqlWhere("`dateTime` between ? and ?", from, to), SqlWhere("`system` = ?", system))
+
+	if site > 0 {
+		query.Where(SqlWhere("`site` = ?", site))
+	}
+
+	if rows, err = query.Query(); err != nil {
+		return nil, formatError(err)
+	}
+
+	for rows.Next() {
+		if err = rows.Scan(&dateTime, &duration, &frequencies, &s); err != nil {
+			break
+		}
+
+		if t, err = db.ParseDateTime(dateTime); err != nil {
+			err = nil
+			continue
+		}
+
+		f := []map[string]any{}
+		if len(frequencies) > 0 {
+			if err = json.Unmarshal([]byte(frequencies), &f); err != nil {
+				err = nil
+				continue
+			}
+		}
+
+		stats.Add(t.UTC().Truncate(interval), uint(s.Float64), duration.Float64/1000, f)
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return nil, formatError(err)
+	}
+
+	return stats.sort(), nil
+}
+
 func (calls *Calls) CheckDuplicate(call *Call, msTimeFrame uint, db *Database) bool {
 	var count uint
 
@@ -143,33 +431,62 @@ func (calls *Calls) CheckDuplicate(call *Call, msTimeFrame uint, db *Database) b
 
 func (calls *Calls) GetCall(id uint, db *Database) (*Call, error) {
 	var (
+		audioKey    sql.NullString
 		audioName   sql.NullString
 		audioType   sql.NullString
+		coldAt      any
 		dateTime    any
+		duration    sql.NullFloat64
 		frequency   sql.NullFloat64
+		latitude    sql.NullFloat64
+		longitude   sql.NullFloat64
+		metadata    sql.NullString
+		mode        sql.NullString
+		priority    sql.NullFloat64
+		site        sql.NullFloat64
 		source      sql.NullFloat64
 		frequencies string
 		patches     string
 		sources     string
 		t           time.Time
+		transcript  sql.NullString
+		uuid        sql.NullString
 	)
 
-	calls.mutex.Lock()
-	defer calls.mutex.Unlock()
-
 	call := Call{Id: id}
 
 	// Use parameterized query to prevent SQL injection
-	query := "select `audio`, `audioName`, `audioType`, `DateTime`, `frequencies`, `frequency`, `patches`, `source`, `sources`, `system`, `talkgroup` from `rdioScannerCalls` where `id` = ?"
-	err := db.Sql.QueryRow(query, id).Scan(&call.Audio, &audioName, &audioType, &dateTime, &frequencies, &frequency, &patches, &source, &sources, &call.System, &call.Talkgroup)
-	if err != nil && err != sql.ErrNoRows {
+	query := "select `audio`, `audioKey`, `audioName`, `audioType`, `coldAt`, `dateTime`, `duration`, `emergency`, `encrypted`, `frequencies`, `frequency`, `latitude`, `longitude`, `metadata`, `mode`, `patches`, `priority`, `site`, `source`, `sources`, `system`, `talkgroup`, `transcript`, `uuid` from `rdioScannerCalls` where `id` = ?"
+
+	calls.mutex.Lock()
+	err := db.Sql.QueryRow(query, id).Scan(&call.Audio, &audioKey, &audioName, &audioType, &coldAt, &dateTime, &duration, &call.Emergency, &call.Encrypted, &frequencies, &frequency, &latitude, &longitude, &metadata, &mode, &patches, &priority, &site, &source, &sources, &call.System, &call.Talkgroup, &transcript, &uuid)
+	calls.mutex.Unlock()
+
+	if err == sql.ErrNoRows {
+		return nil, ErrCallNotFound
+	} else if err != nil {
 		return nil, fmt.Errorf("getcall: %v, %v", err, query)
 	}
 
+	// the audio store is reached without holding the lock
+
+	if audioKey.Valid && len(audioKey.String) > 0 {
+		if calls.AudioStore == nil {
+			return nil, fmt.Errorf("getcall: no audio store configured for %v", audioKey.String)
+		}
+
+		if call.Audio, err = calls.AudioStore.Get(audioKey.String); err != nil {
+			return nil, fmt.Errorf("getcall: %v", err)
+		}
+	}
+
 	if audioName.Valid {
 		call.AudioName = audioName.String
 	}
 
+	// the audio is in the cold storage, to be retrieved
+	call.Cold = coldAt != nil
+
 	if audioType.Valid {
 		call.AudioType = audioType.String
 	}
@@ -184,18 +501,45 @@ func (calls *Calls) GetCall(id uint, db *Database) (*Call, error) {
 		call.DateTime = time.Time{}
 	}
 
+	if duration.Valid && duration.Float64 > 0 {
+		call.Duration = time.Duration(duration.Float64) * time.Millisecond
+	}
+
 	if len(frequencies) > 0 {
 		if err = json.Unmarshal([]byte(frequencies), &call.Frequencies); err != nil {
 			call.Frequencies = []any{}
 		}
 	}
 
+	if latitude.Valid && longitude.Valid {
+		call.Latitude = latitude.Float64
+		call.Longitude = longitude.Float64
+	}
+
+	if metadata.Valid && len(metadata.String) > 0 {
+		if err = json.Unmarshal([]byte(metadata.String), &call.Metadata); err != nil {
+			call.Metadata = nil
+		}
+	}
+
+	if mode.Valid {
+		call.Mode = mode.String
+	}
+
 	if len(patches) > 0 {
 		if err = json.Unmarshal([]byte(patches), &call.Patches); err != nil {
 			call.Patches = []any{}
 		}
 	}
 
+	if priority.Valid && priority.Float64 > 0 {
+		call.Priority = uint(priority.Float64)
+	}
+
+	if site.Valid && site.Float64 > 0 {
+		call.Site = uint(site.Float64)
+	}
+
 	if source.Valid && source.Float64 > 0 {
 		call.Source = uint(source.Float64)
 	}
@@ -206,36 +550,168 @@ func (calls *Calls) GetCall(id uint, db *Database) (*Call, error) {
 		}
 	}
 
+	if uuid.Valid {
+		call.Uuid = uuid.String
+	}
+
+	if transcript.Valid && len(transcript.String) > 0 {
+		call.Transcript = transcript.String
+	}
+
 	return &call, nil
 }
 
-func (calls *Calls) Prune(db *Database, pruneDays uint) error {
+// PruneWhere deletes the calls matching the condition and returns how many
+// were deleted along with the size of the audio reclaimed.
+func (calls *Calls) PruneWhere(db *Database, where *SqlCondition) (int64, int64, error) {
+	formatError := func(err error) error {
+		return fmt.Errorf("calls.prune: %v", err)
+	}
+
+	tx, err := db.Sql.Begin()
+	if err != nil {
+		return 0, 0, formatError(err)
+	}
+
+	count, size, keys, err := calls.PruneTx(tx, db, where)
+	if err != nil {
+		tx.Rollback()
+		return 0, 0, formatError(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, 0, formatError(err)
+	}
+
+	if err = calls.PruneKeys(keys); err != nil {
+		return 0, 0, formatError(err)
+	}
+
+	return count, size, nil
+}
+
+// CallsPrunedKeys are the keys of the audio of the deleted calls, in the
+// audio store and in the cold store.
+type CallsPrunedKeys struct {
+	Audio []string
+	Cold  []string
+}
+
+// PruneTx deletes within the transaction the calls matching the condition,
+// along with their entries of the full-text index, and returns how many
+// were deleted, the size of the audio reclaimed and the keys of their audio
+// in the stores, to delete with PruneKeys once committed.
+func (calls *Calls) PruneTx(tx *sql.Tx, db *Database, where *SqlCondition) (int64, int64, *CallsPrunedKeys, error) {
+	var (
+		count int64
+		err   error
+		keys  = &CallsPrunedKeys{}
+		res   sql.Result
+		size  sql.NullInt64
+	)
+
 	calls.mutex.Lock()
 	defer calls.mutex.Unlock()
 
-	date := time.Now().Add(-24 * time.Hour * time.Duration(pruneDays)).Format(db.DateTimeFormat)
-	_, err := db.Sql.Exec("delete from `rdioScannerCalls` where `dateTime` < ?", date)
+	q, args := db.Select("rdioScannerCalls", "sum(length(`audio`))").Where(where).Build()
+	if err = tx.QueryRow(q, args...).Scan(&size); err != nil {
+		return 0, 0, nil, err
+	}
+
+	if calls.AudioStore != nil {
+		if keys.Audio, err = calls.pruneStoreKeys(tx, db, where, "audioKey"); err != nil {
+			return 0, 0, nil, err
+		}
+	}
+
+	if calls.ColdStore != nil {
+		if keys.Cold, err = calls.pruneStoreKeys(tx, db, where, "coldKey"); err != nil {
+			return 0, 0, nil, err
+		}
+	}
+
+	if err = searchIndexDelete(tx, db, where); err != nil {
+		return 0, 0, nil, err
+	}
 
-	return err
+	q, args = db.Delete("rdioScannerCalls").Where(where).Build()
+	if res, err = tx.Exec(q, args...); err != nil {
+		return 0, 0, nil, err
+	}
+
+	if count, err = res.RowsAffected(); err != nil {
+		return 0, 0, nil, err
+	}
+
+	return count, size.Int64, keys, nil
 }
 
-func (calls *Calls) Search(searchOptions *CallsSearchOptions, client *Client) (*CallsSearchResults, error) {
-	const (
-		ascOrder  = "asc"
-		descOrder = "desc"
+// PruneKeys deletes from the stores the audio of the calls deleted, which
+// stays when their deletion is rolled back.
+func (calls *Calls) PruneKeys(keys *CallsPrunedKeys) error {
+	for _, store := range []struct {
+		keys  []string
+		store AudioStore
+	}{
+		{keys.Audio, calls.AudioStore},
+		{keys.Cold, calls.ColdStore},
+	} {
+		for _, key := range store.keys {
+			if err := store.store.Delete(key); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// pruneStoreKeys returns the keys in the store of the audio of the calls
+// matching the condition, of which the column is the key.
+func (calls *Calls) pruneStoreKeys(tx *sql.Tx, db *Database, where *SqlCondition, column string) ([]string, error) {
+	var (
+		err  error
+		key  string
+		keys = []string{}
+		rows *sql.Rows
 	)
 
+	q, args := db.Select("rdioScannerCalls", column).Where(SqlWhere(fmt.Sprintf("%s is not null", sqlQuote(column))), where).Build()
+	if rows, err = tx.Query(q, args...); err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		if err = rows.Scan(&key); err != nil {
+			break
+		}
+		keys = append(keys, key)
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func (calls *Calls) Search(searchOptions *CallsSearchOptions, client *Client) (*CallsSearchResults, error) {
 	var (
-		dateTime any
-		err      error
-		id       sql.NullFloat64
-		limit    uint
-		offset   uint
-		order    string
-		query    string
-		rows     *sql.Rows
-		t        time.Time
-		where    string = "true"
+		dateTime   any
+		desc       bool
+		duration   sql.NullFloat64
+		err        error
+		id         sql.NullFloat64
+		limit      uint
+		offset     uint
+		query      *SqlQuery
+		rows       *sql.Rows
+		site       sql.NullFloat64
+		t          time.Time
+		transcript sql.NullString
+		where      = []*SqlCondition{}
 	)
 
 	calls.mutex.Lock()
@@ -252,80 +728,96 @@ func (calls *Calls) Search(searchOptions *CallsSearchOptions, client *Client) (*
 		Results: []CallsSearchResult{},
 	}
 
-	if client.Access != nil {
-		switch v := client.Access.Systems.(type) {
+	if client.GetAccess() != nil {
+		switch client.GetAccess().Systems.(type) {
 		case []any:
-			a := []string{}
-			for _, scope := range v {
-				var c string
-				switch v := scope.(type) {
-				case map[string]any:
-					switch v["talkgroups"].(type) {
-					case []any:
-						b := strings.ReplaceAll(fmt.Sprintf("%v", v["talkgroups"]), " ", ", ")
-						b = strings.ReplaceAll(b, "[", "(")
-						b = strings.ReplaceAll(b, "]", ")")
-						c = fmt.Sprintf("(`system` = %v and `talkgroup` in %v)", v["id"], b)
-					case string:
-						if v["talkgroups"] == "*" {
-							c = fmt.Sprintf("`system` = %v", v["id"])
-						}
-					}
-				}
-				if len(c) > 0 {
-					a = append(a, c)
-				}
-			}
-			where = fmt.Sprintf("(%s)", strings.Join(a, " or "))
+			where = append(where, sqlScope(client.GetAccess().Systems))
 		}
 	}
 
+	where = append(where, client.Controller.Blackouts.sqlCondition())
+
+	where = append(where, client.Controller.Systems.sqlHiddenCondition())
+
+	tier := client.GetTier()
+
+	where = append(where, tier.sqlCondition())
+
 	switch v := searchOptions.System.(type) {
 	case uint:
-		a := []string{
-			fmt.Sprintf("`system` = %v", v),
+		where = append(where, SqlWhere("`system` = ?", v))
+
+		switch v := searchOptions.Site.(type) {
+		case uint:
+			where = append(where, SqlWhere("`site` = ?", v))
 		}
+
 		switch v := searchOptions.Talkgroup.(type) {
 		case uint:
 			if searchOptions.searchPatchedTalkgroups {
-				a = append(a, fmt.Sprintf("`talkgroup` = %v or patches = '%v' or patches like '[%v,%%' or patches like '%%,%v,%%' or patches like '%%,%v]'", v, v, v, v, v))
+				where = append(where, SqlOr(
+					SqlWhere("`talkgroup` = ?", v),
+					SqlWhere("`patches` = ?", fmt.Sprintf("[%d]", v)),
+					SqlWhere("`patches` like ?", fmt.Sprintf("[%d,%%", v)),
+					SqlWhere("`patches` like ?", fmt.Sprintf("%%,%d,%%", v)),
+					SqlWhere("`patches` like ?", fmt.Sprintf("%%,%d]", v)),
+				))
 			} else {
-				a = append(a, fmt.Sprintf("`talkgroup` = %v", v))
+				where = append(where, SqlWhere("`talkgroup` = ?", v))
 			}
 		}
-		where += fmt.Sprintf(" and (%s)", strings.Join(a, " and "))
 	}
 
-	switch v := searchOptions.Group.(type) {
-	case string:
-		a := []string{}
-		for id, m := range client.GroupsMap[v] {
-			b := strings.ReplaceAll(fmt.Sprintf("%v", m), " ", ", ")
-			b = strings.ReplaceAll(b, "[", "(")
-			b = strings.ReplaceAll(b, "]", ")")
-			a = append(a, fmt.Sprintf("(`system` = %v and `talkgroup` in %v)", id, b))
-		}
-		if len(a) > 0 {
-			where += fmt.Sprintf(" and (%s)", strings.Join(a, " or "))
+	for _, f := range []struct {
+		label any
+		m     map[string]map[uint][]uint
+	}{
+		{searchOptions.Group, client.GroupsMap},
+		{searchOptions.Tag, client.TagsMap},
+	} {
+		switch v := f.label.(type) {
+		case string:
+			a := []*SqlCondition{}
+			for id, m := range f.m[v] {
+				a = append(a, SqlAnd(SqlWhere("`system` = ?", id), SqlIn("talkgroup", m)))
+			}
+			where = append(where, SqlOr(a...))
 		}
 	}
 
-	switch v := searchOptions.Tag.(type) {
+	switch v := searchOptions.Text.(type) {
 	case string:
-		a := []string{}
-		for id, m := range client.TagsMap[v] {
-			b := strings.ReplaceAll(fmt.Sprintf("%v", m), " ", ", ")
-			b = strings.ReplaceAll(b, "[", "(")
-			b = strings.ReplaceAll(b, "]", ")")
-			a = append(a, fmt.Sprintf("(`system` = %v and `talkgroup` in %v)", id, b))
+		if tier != nil && tier.Redact {
+			break
 		}
-		if len(a) > 0 {
-			where += fmt.Sprintf(" and (%s)", strings.Join(a, " or "))
+		where = append(where, SqlWhere("`transcript` like ?", "%"+v+"%"))
+	}
+
+	// the tiers redacting the radio ids can't search them either
+	if searchOptions.Unit != nil && (tier == nil || !tier.Redact) {
+		system, _ := searchOptions.System.(uint)
+		where = append(where, client.Controller.Systems.sqlUnitCondition(searchOptions.Unit, system))
+	}
+
+	switch v := searchOptions.Metadata.(type) {
+	case map[string]string:
+		for key, value := range v {
+			where = append(where, sqlMetadata(key, value))
 		}
 	}
 
-	query = fmt.Sprintf("select `dateTime` from `rdioScannerCalls` where %v order by `dateTime` asc", where)
-	if err = db.Sql.QueryRow(query).Scan(&dateTime); err != nil && err != sql.ErrNoRows {
+	switch v := searchOptions.MinDuration.(type) {
+	case float64:
+		where = append(where, SqlWhere("`duration` >= ?", int64(v*1000)))
+	}
+
+	switch v := searchOptions.MaxDuration.(type) {
+	case float64:
+		where = append(where, SqlWhere("`duration` <= ?", int64(v*1000)))
+	}
+
+	query = db.Select("rdioScannerCalls", "dateTime").Where(where...).OrderBy("dateTime", false).Limit(1)
+	if err = query.QueryRow().Scan(&dateTime); err != nil && err != sql.ErrNoRows {
 		return nil, formatError(fmt.Errorf("%v, %v", err, query))
 	}
 
@@ -333,8 +825,8 @@ func (calls *Calls) Search(searchOptions *CallsSearchOptions, client *Client) (*
 		searchResults.DateStart = t
 	}
 
-	query = fmt.Sprintf("select `dateTime` from `rdioScannerCalls` where %v order by `dateTime` desc", where)
-	if err = db.Sql.QueryRow(query).Scan(&dateTime); err != nil && err != sql.ErrNoRows {
+	query = db.Select("rdioScannerCalls", "dateTime").Where(where...).OrderBy("dateTime", true).Limit(1)
+	if err = query.QueryRow().Scan(&dateTime); err != nil && err != sql.ErrNoRows {
 		return nil, formatError(fmt.Errorf("%v, %v", err, query))
 	}
 
@@ -346,24 +838,17 @@ func (calls *Calls) Search(searchOptions *CallsSearchOptions, client *Client) (*
 
 	switch v := searchOptions.Sort.(type) {
 	case int:
-		if v < 0 {
-			order = descOrder
-		} else {
-			order = ascOrder
-		}
-	default:
-		order = ascOrder
+		desc = v < 0
 	}
 
 	switch v := searchOptions.Date.(type) {
 	case time.Time:
 		var (
-			df    string = client.Controller.Database.DateTimeFormat
 			start time.Time
 			stop  time.Time
 		)
 
-		if order == ascOrder {
+		if !desc {
 			start = time.Date(v.Year(), v.Month(), v.Day(), v.Hour(), v.Minute(), 0, 0, time.UTC)
 			stop = start.Add(time.Hour*24 - time.Millisecond)
 
@@ -372,7 +857,7 @@ func (calls *Calls) Search(searchOptions *CallsSearchOptions, client *Client) (*
 			stop = time.Date(v.Year(), v.Month(), v.Day(), v.Hour(), v.Minute(), 0, 0, time.UTC)
 		}
 
-		where += fmt.Sprintf(" and (`dateTime` between '%v' and '%v')", start.Format(df), stop.Format(df))
+		where = append(where, SqlWhere("`dateTime` between ? and ?", start, stop))
 	}
 
 	switch v := searchOptions.Limit.(type) {
@@ -387,22 +872,34 @@ func (calls *Calls) Search(searchOptions *CallsSearchOptions, client *Client) (*
 		offset = v
 	}
 
-	query = fmt.Sprintf("select count(*) from `rdioScannerCalls` where %v", where)
-	if err = db.Sql.QueryRow(query).Scan(&searchResults.Count); err != nil && err != sql.ErrNoRows {
+	query = db.Select("rdioScannerCalls", "count(*)").Where(where...)
+	if err = query.QueryRow().Scan(&searchResults.Count); err != nil && err != sql.ErrNoRows {
 		return nil, formatError(fmt.Errorf("%v, %v", err, query))
 	}
 
-	query = fmt.Sprintf("select `id`, `DateTime`, `system`, `talkgroup` from `rdioScannerCalls` where %v order by `dateTime` %v limit %v offset %v", where, order, limit, offset)
-	if rows, err = db.Sql.Query(query); err != nil && err != sql.ErrNoRows {
+	query = db.Select("rdioScannerCalls", "id", "dateTime", "duration", "site", "system", "talkgroup", "transcript").Where(where...).OrderBy("dateTime", desc).Limit(limit, offset)
+	if rows, err = query.Query(); err != nil && err != sql.ErrNoRows {
 		return nil, formatError(fmt.Errorf("%v, %v", err, query))
 	}
 
 	for rows.Next() {
 		searchResult := CallsSearchResult{}
-		if err = rows.Scan(&id, &dateTime, &searchResult.System, &searchResult.Talkgroup); err != nil {
+		if err = rows.Scan(&id, &dateTime, &duration, &site, &searchResult.System, &searchResult.Talkgroup, &transcript); err != nil {
 			break
 		}
 
+		if duration.Valid && duration.Float64 > 0 {
+			searchResult.Duration = duration.Float64 / 1000
+		}
+
+		if site.Valid && site.Float64 > 0 {
+			searchResult.Site = uint(site.Float64)
+		}
+
+		if transcript.Valid && (tier == nil || !tier.Redact) {
+			searchResult.Transcript = transcript.String
+		}
+
 		if id.Valid && id.Float64 > 0 {
 			searchResult.Id = uint(id.Float64)
 		}
@@ -428,18 +925,21 @@ func (calls *Calls) Search(searchOptions *CallsSearchOptions, client *Client) (*
 
 func (calls *Calls) WriteCall(call *Call, db *Database) (uint, error) {
 	var (
+		audio       = call.Audio
+		audioKey    any
 		b           []byte
 		err         error
 		frequencies string
 		id          int64
+		latitude    any
+		longitude   any
+		metadata    any
 		patches     string
 		res         sql.Result
+		site        any
 		sources     string
 	)
 
-	calls.mutex.Lock()
-	defer calls.mutex.Unlock()
-
 	formatError := func(err error) error {
 		return fmt.Errorf("call.write: %s", err.Error())
 	}
@@ -471,7 +971,64 @@ func (calls *Calls) WriteCall(call *Call, db *Database) (uint, error) {
 		}
 	}
 
-	if res, err = db.Sql.Exec("insert into `rdioScannerCalls` (`id`, `audio`, `audioName`, `audioType`, `dateTime`, `frequencies`, `frequency`, `patches`, `source`, `sources`, `system`, `talkgroup`) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", call.Id, call.Audio, call.AudioName, call.AudioType, call.DateTime, frequencies, call.Frequency, patches, call.Source, sources, call.System, call.Talkgroup); err != nil {
+	if len(call.Metadata) > 0 {
+		if b, err = json.Marshal(call.Metadata); err == nil {
+			metadata = string(b)
+		} else {
+			return 0, formatError(err)
+		}
+	}
+
+	if call.HasLocation() {
+		latitude = call.Latitude
+		longitude = call.Longitude
+	}
+
+	if call.Site > 0 {
+		site = call.Site
+	}
+
+	if calls.AudioStore != nil {
+		var contentType string
+
+		switch v := call.AudioType.(type) {
+		case string:
+			contentType = v
+		}
+
+		key := GetAudioKey(call)
+
+		if err = calls.AudioStore.Put(key, call.Audio, contentType); err != nil {
+			return 0, formatError(err)
+		}
+
+		audio = []byte{}
+		audioKey = key
+	}
+
+	calls.mutex.Lock()
+	defer calls.mutex.Unlock()
+
+	// the uuid of a call relayed by another instance is kept, the permalinks
+	// of both instances then being the same, unless it is already taken
+	if len(call.Uuid) > 0 {
+		var count uint
+		if err = db.Sql.QueryRow("select count(*) from `rdioScannerCalls` where `uuid` = ?", call.Uuid).Scan(&count); err != nil {
+			return 0, formatError(err)
+		}
+		if count > 0 {
+			call.Uuid = ""
+		}
+	}
+
+	if len(call.Uuid) == 0 {
+		call.Uuid = uuid.New().String()
+	}
+
+	if res, err = db.Sql.Exec("insert into `rdioScannerCalls` (`id`, `audio`, `audioKey`, `audioName`, `audioType`, `dateTime`, `duration`, `emergency`, `encrypted`, `frequencies`, `frequency`, `latitude`, `longitude`, `metadata`, `mode`, `patches`, `priority`, `site`, `skew`, `source`, `sources`, `system`, `talkgroup`, `uuid`) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", call.Id, audio, audioKey, call.AudioName, call.AudioType, call.DateTime, call.Duration.Milliseconds(), call.Emergency, call.Encrypted, frequencies, call.Frequency, latitude, longitude, metadata, call.Mode, patches, call.Priority, site, int64(call.skew.Seconds()), call.Source, sources, call.System, call.Talkgroup, call.Uuid); err != nil {
+		if key, ok := audioKey.(string); ok {
+			calls.AudioStore.Delete(key)
+		}
 		return 0, formatError(err)
 	}
 
@@ -482,15 +1039,143 @@ func (calls *Calls) WriteCall(call *Call, db *Database) (uint, error) {
 	}
 }
 
+// WriteAudio replaces the audio of an already written call, moving it to a
+// new key of the audio store when its file extension changes.
+func (calls *Calls) WriteAudio(call *Call, db *Database) error {
+	var (
+		audio    any = call.Audio
+		audioKey any
+		err      error
+		oldKey   sql.NullString
+	)
+
+	calls.mutex.Lock()
+	defer calls.mutex.Unlock()
+
+	formatError := func(err error) error {
+		return fmt.Errorf("call.writeaudio: %v", err)
+	}
+
+	if err = db.Sql.QueryRow("select `audioKey` from `rdioScannerCalls` where `id` = ?", call.Id).Scan(&oldKey); err != nil {
+		return formatError(err)
+	}
+
+	if calls.AudioStore != nil {
+		var contentType string
+
+		switch v := call.AudioType.(type) {
+		case string:
+			contentType = v
+		}
+
+		key := GetAudioKey(call)
+
+		if err = calls.AudioStore.Put(key, call.Audio, contentType); err != nil {
+			return formatError(err)
+		}
+
+		audio = []byte{}
+		audioKey = key
+	}
+
+	if _, err = db.Sql.Exec("update `rdioScannerCalls` set `audio` = ?, `audioKey` = ?, `audioName` = ?, `audioType` = ? where `id` = ?", audio, audioKey, call.AudioName, call.AudioType, call.Id); err != nil {
+		if key, ok := audioKey.(string); ok && key != oldKey.String {
+			calls.AudioStore.Delete(key)
+		}
+		return formatError(err)
+	}
+
+	if oldKey.Valid && len(oldKey.String) > 0 && oldKey.String != audioKey && calls.AudioStore != nil {
+		if err = calls.AudioStore.Delete(oldKey.String); err != nil {
+			return formatError(err)
+		}
+	}
+
+	return nil
+}
+
+// GetCallByUuid returns the call of a permalink.
+func (calls *Calls) GetCallByUuid(s string, db *Database) (*Call, error) {
+	var id uint
+
+	u, err := uuid.Parse(s)
+	if err != nil {
+		return nil, ErrCallNotFound
+	}
+
+	calls.mutex.Lock()
+	err = db.Sql.QueryRow("select `id` from `rdioScannerCalls` where `uuid` = ?", u.String()).Scan(&id)
+	calls.mutex.Unlock()
+
+	if err == sql.ErrNoRows {
+		return nil, ErrCallNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("getcallbyuuid: %v", err)
+	}
+
+	return calls.GetCall(id, db)
+}
+
+// Permalink returns the uuid of the call, given to the calls written before
+// the permalinks on their first use.
+func (calls *Calls) Permalink(call *Call, db *Database) (string, error) {
+	if len(call.Uuid) > 0 {
+		return call.Uuid, nil
+	}
+
+	calls.mutex.Lock()
+	defer calls.mutex.Unlock()
+
+	s := uuid.New().String()
+
+	if _, err := db.Sql.Exec("update `rdioScannerCalls` set `uuid` = ? where `id` = ? and `uuid` is null", s, call.Id); err != nil {
+		return "", fmt.Errorf("call.permalink: %v", err)
+	}
+
+	// another request may have given it first
+	var u sql.NullString
+	if err := db.Sql.QueryRow("select `uuid` from `rdioScannerCalls` where `id` = ?", call.Id).Scan(&u); err == sql.ErrNoRows {
+		return "", ErrCallNotFound
+	} else if err != nil {
+		return "", fmt.Errorf("call.permalink: %v", err)
+	}
+
+	if !u.Valid {
+		return "", ErrCallNotFound
+	}
+
+	call.Uuid = u.String
+
+	return call.Uuid, nil
+}
+
+// WriteTranscript stores the transcription of an already written call.
+func (calls *Calls) WriteTranscript(id uint, transcript string, db *Database) error {
+	calls.mutex.Lock()
+	defer calls.mutex.Unlock()
+
+	if _, err := db.Sql.Exec("update `rdioScannerCalls` set `transcript` = ? where `id` = ?", transcript, id); err != nil {
+		return fmt.Errorf("call.writetranscript: %v", err)
+	}
+
+	return nil
+}
+
 type CallsSearchOptions struct {
 	Date                    any `json:"date,omitempty"`
 	Group                   any `json:"group,omitempty"`
 	Limit                   any `json:"limit,omitempty"`
+	MaxDuration             any `json:"maxDuration,omitempty"`
+	Metadata                any `json:"metadata,omitempty"`
+	MinDuration             any `json:"minDuration,omitempty"`
 	Offset                  any `json:"offset,omitempty"`
+	Site                    any `json:"site,omitempty"`
 	Sort                    any `json:"sort,omitempty"`
 	System                  any `json:"system,omitempty"`
 	Tag                     any `json:"tag,omitempty"`
 	Talkgroup               any `json:"talkgroup,omitempty"`
+	Text                    any `json:"text,omitempty"`
+	Unit                    any `json:"unit,omitempty"`
 	searchPatchedTalkgroups bool
 }
 
@@ -512,11 +1197,45 @@ func (searchOptions *CallsSearchOptions) fromMap(m map[string]any) error {
 		searchOptions.Limit = uint(v)
 	}
 
+	switch v := m["maxDuration"].(type) {
+	case float64:
+		if v > 0 {
+			searchOptions.MaxDuration = v
+		}
+	}
+
+	switch v := m["metadata"].(type) {
+	case map[string]any:
+		metadata := map[string]string{}
+		for key, value := range v {
+			if s, ok := value.(string); ok && len(s) > 0 {
+				metadata[key] = s
+			}
+		}
+		if len(metadata) > 0 {
+			searchOptions.Metadata = metadata
+		}
+	}
+
+	switch v := m["minDuration"].(type) {
+	case float64:
+		if v > 0 {
+			searchOptions.MinDuration = v
+		}
+	}
+
 	switch v := m["offset"].(type) {
 	case float64:
 		searchOptions.Offset = uint(v)
 	}
 
+	switch v := m["site"].(type) {
+	case float64:
+		if v > 0 {
+			searchOptions.Site = uint(v)
+		}
+	}
+
 	switch v := m["sort"].(type) {
 	case float64:
 		searchOptions.Sort = int(v)
@@ -537,14 +1256,56 @@ func (searchOptions *CallsSearchOptions) fromMap(m map[string]any) error {
 		searchOptions.Talkgroup = uint(v)
 	}
 
+	switch v := m["text"].(type) {
+	case string:
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			searchOptions.Text = v
+		}
+	}
+
+	searchOptions.Unit = searchUnit(m["unit"])
+
+	return nil
+}
+
+// searchUnit reads the unit searched, a radio id or an alias, nil when none.
+func searchUnit(f any) any {
+	switch v := f.(type) {
+	case float64:
+		if v > 0 {
+			return uint(v)
+		}
+	case string:
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			if id, err := strconv.ParseUint(v, 10, 32); err == nil && id > 0 {
+				return uint(id)
+			}
+			return v
+		}
+	}
+
 	return nil
 }
 
+// sqlMetadata is the condition on the calls having the value for the custom
+// metadata field, matched in the json of their metadata as it is written.
+func sqlMetadata(key string, value string) *SqlCondition {
+	k, _ := json.Marshal(key)
+	v, _ := json.Marshal(value)
+
+	pattern := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(string(k) + ":" + string(v))
+
+	return SqlWhere("`metadata` like ? escape '!'", "%"+pattern+"%")
+}
+
 type CallsSearchResult struct {
-	Id        uint      `json:"id"`
-	DateTime  time.Time `json:"dateTime"`
-	System    uint      `json:"system"`
-	Talkgroup uint      `json:"talkgroup"`
+	Id         uint      `json:"id"`
+	DateTime   time.Time `json:"dateTime"`
+	Duration   float64   `json:"duration,omitempty"`
+	Site       uint      `json:"site,omitempty"`
+	System     uint      `json:"system"`
+	Talkgroup  uint      `json:"talkgroup"`
+	Transcript string    `json:"transcript,omitempty"`
 }
 
 type CallsSearchResults struct {
@@ -0,0 +1,461 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestDatabase returns a migrated sqlite database in a temporary
+// directory, closed with the test.
+func newTestDatabase(t *testing.T) *Database {
+	t.Helper()
+
+	db := NewDatabase(&Config{DbType: DbTypeSqlite, DbFile: filepath.Join(t.TempDir(), "rdio-scanner.db")})
+
+	t.Cleanup(func() { db.Sql.Close() })
+
+	return db
+}
+
+// newTestController returns a controller on a new sqlite database, with the
+// logins loose enough for the tests unless the config sets them, nil being
+// an empty config.
+func newTestController(t *testing.T, config *Config) *Controller {
+	t.Helper()
+
+	if config == nil {
+		config = &Config{}
+	}
+
+	config.DbType = DbTypeSqlite
+	config.DbFile = filepath.Join(t.TempDir(), "rdio-scanner.db")
+
+	if config.LoginBurst == 0 {
+		config.LoginBurst = 20
+	}
+	if config.LoginMaxFailures == 0 {
+		config.LoginMaxFailures = 20
+	}
+	if config.LoginRate == 0 {
+		config.LoginRate = 60
+	}
+
+	controller := NewController(config)
+
+	t.Cleanup(func() { controller.Database.Sql.Close() })
+
+	controller.Options.secret = "secret"
+
+	return controller
+}
+
+// lockCheckStore fails when the calls are locked while it is reached.
+type lockCheckStore struct {
+	audio map[string][]byte
+	calls *Calls
+	t     *testing.T
+}
+
+func (store *lockCheckStore) check() {
+	if !store.calls.mutex.TryLock() {
+		store.t.Error("the audio store is reached while the calls are locked")
+		return
+	}
+	store.calls.mutex.Unlock()
+}
+
+func (store *lockCheckStore) Delete(key string) error {
+	store.check()
+	delete(store.audio, key)
+	return nil
+}
+
+func (store *lockCheckStore) Get(key string) ([]byte, error) {
+	store.check()
+	return store.audio[key], nil
+}
+
+func (store *lockCheckStore) Put(key string, audio []byte, contentType string) error {
+	store.check()
+	store.audio[key] = audio
+	return nil
+}
+
+func TestCallsGetCall(t *testing.T) {
+	db := newTestDatabase(t)
+
+	calls := NewCalls()
+	calls.AudioStore = &lockCheckStore{audio: map[string][]byte{}, calls: calls, t: t}
+
+	audio := make([]byte, 64)
+	call := &Call{Audio: audio, AudioName: "a.mp3", AudioType: "audio/mpeg", DateTime: time.Now(), Site: 3, System: 1, Talkgroup: 2}
+
+	id, err := calls.WriteCall(call, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		id      uint
+		wantErr error
+	}{
+		{"found", id, nil},
+		{"not found", id + 1, ErrCallNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := calls.GetCall(test.id, db)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("GetCall(%d) error = %v, want %v", test.id, err, test.wantErr)
+			}
+			if test.wantErr != nil {
+				if got != nil {
+					t.Errorf("GetCall(%d) = %v, want nil", test.id, got)
+				}
+				return
+			}
+			if got.System != 1 || got.Talkgroup != 2 || got.Site != 3 || len(got.Audio) != len(audio) {
+				t.Errorf("GetCall(%d) = system %d talkgroup %d site %d audio %d bytes", test.id, got.System, got.Talkgroup, got.Site, len(got.Audio))
+			}
+		})
+	}
+}
+
+func TestCallsWriteCallFlags(t *testing.T) {
+	db := newTestDatabase(t)
+
+	calls := NewCalls()
+
+	tests := []struct {
+		name string
+		call *Call
+	}{
+		{"none", &Call{}},
+		{"flags", &Call{Emergency: true, Encrypted: true, Mode: CallModeTdma, Priority: 3}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.call.Audio = []byte{0}
+			test.call.DateTime = time.Now()
+			test.call.System = 1
+			test.call.Talkgroup = 2
+
+			id, err := calls.WriteCall(test.call, db)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := calls.GetCall(id, db)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got.Emergency != test.call.Emergency || got.Encrypted != test.call.Encrypted || got.Mode != test.call.Mode || got.Priority != test.call.Priority {
+				t.Errorf("got emergency %v encrypted %v mode %q priority %d", got.Emergency, got.Encrypted, got.Mode, got.Priority)
+			}
+
+			m := got.metadata()
+			if _, ok := m["emergency"]; ok != test.call.Emergency {
+				t.Errorf("got metadata %v", m)
+			}
+		})
+	}
+}
+
+func TestSystemsSqlHiddenCondition(t *testing.T) {
+	db := newTestDatabase(t)
+
+	calls := NewCalls()
+
+	for _, call := range []*Call{
+		{System: 1, Talkgroup: 1, Encrypted: true},
+		{System: 1, Talkgroup: 1},
+		{System: 1, Talkgroup: 2, Encrypted: true},
+		{System: 2, Talkgroup: 1, Encrypted: true},
+		{System: 1, Talkgroup: 1, DateTime: time.Now().Add(-time.Hour)},
+	} {
+		call.Audio = []byte{0}
+		if call.DateTime.IsZero() {
+			call.DateTime = time.Now()
+		}
+		if _, err := calls.WriteCall(call, db); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		hide   []uint
+		hidden []uint
+		delay  uint
+		want   int
+	}{
+		{"none hidden", nil, nil, 0, 5},
+		{"talkgroup hidden", []uint{1}, nil, 0, 4},
+		{"talkgroups hidden", []uint{1, 2}, nil, 0, 3},
+		{"talkgroup hidden from the listeners", nil, []uint{1}, 0, 2},
+		{"talkgroup delayed", nil, nil, 60, 3},
+		{"talkgroup delayed hiding its encrypted calls", []uint{1}, nil, 60, 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			system := NewSystem()
+			system.Id = 1
+			for _, id := range []uint{1, 2} {
+				hide, hidden := false, false
+				for _, h := range test.hide {
+					hide = hide || h == id
+				}
+				for _, h := range test.hidden {
+					hidden = hidden || h == id
+				}
+				talkgroup := &Talkgroup{Id: id, HideEncrypted: hide, Hidden: hidden}
+				if id == 1 {
+					talkgroup.Delay = test.delay
+				}
+				system.Talkgroups.List = append(system.Talkgroups.List, talkgroup)
+			}
+
+			systems := NewSystems()
+			systems.List = []*System{system}
+
+			var count int
+			if err := db.Select("rdioScannerCalls", "count(*)").Where(systems.sqlHiddenCondition()).QueryRow().Scan(&count); err != nil {
+				t.Fatal(err)
+			}
+
+			if count != test.want {
+				t.Errorf("got %d calls, want %d", count, test.want)
+			}
+		})
+	}
+}
+
+func TestSystemsSqlUnitCondition(t *testing.T) {
+	db := newTestDatabase(t)
+
+	calls := NewCalls()
+
+	for _, call := range []*Call{
+		{System: 1, Talkgroup: 1, Source: 4424001},
+		{System: 1, Talkgroup: 2, Source: 4424001, Sources: []map[string]any{{"pos": 0, "src": 4424001}, {"pos": 2.5, "src": 4424002}}},
+		{System: 1, Talkgroup: 1, Source: 4424002},
+		{System: 1, Talkgroup: 1, Source: 44240010},
+		{System: 2, Talkgroup: 1, Source: 4424001},
+	} {
+		call.Audio = []byte{0}
+		call.DateTime = time.Now()
+		if _, err := calls.WriteCall(call, db); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	systems := NewSystems()
+	for _, id := range []uint{1, 2} {
+		system := NewSystem()
+		system.Id = id
+		systems.List = append(systems.List, system)
+	}
+	systems.List[0].Units.List = []*Unit{{Id: 4424001, Label: "Engine 1"}, {Id: 4424002, Label: "Medic 2"}}
+	systems.List[1].Units.List = []*Unit{{Id: 4424001, Label: "Engine 1"}}
+
+	tests := []struct {
+		name   string
+		unit   any
+		system uint
+		want   int
+	}{
+		{"radio id", searchUnit(float64(4424001)), 0, 3},
+		{"radio id of a system", searchUnit("4424001"), 1, 2},
+		{"radio id mid-call", searchUnit(float64(4424002)), 0, 2},
+		{"alias", searchUnit("medic 2"), 0, 2},
+		{"alias of all the systems", searchUnit("Engine 1"), 0, 3},
+		{"alias of a system", searchUnit("Engine 1"), 2, 1},
+		{"unknown alias", searchUnit("Ladder 3"), 0, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			where := []*SqlCondition{systems.sqlUnitCondition(test.unit, test.system)}
+			if test.system > 0 {
+				where = append(where, SqlWhere("`system` = ?", test.system))
+			}
+
+			var count int
+			if err := db.Select("rdioScannerCalls", "count(*)").Where(where...).QueryRow().Scan(&count); err != nil {
+				t.Fatal(err)
+			}
+
+			if count != test.want {
+				t.Errorf("got %d calls, want %d", count, test.want)
+			}
+		})
+	}
+}
+
+func TestSqlMetadata(t *testing.T) {
+	db := newTestDatabase(t)
+
+	calls := NewCalls()
+
+	for _, metadata := range []map[string]string{
+		{"zone": "north", "bank": "3"},
+		{"zone": "north_east"},
+		{"zone": "100%"},
+		{},
+	} {
+		call := &Call{Audio: []byte{0}, DateTime: time.Now(), Metadata: metadata, System: 1, Talkgroup: 1}
+		if _, err := calls.WriteCall(call, db); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		key   string
+		value string
+		want  int
+	}{
+		{"zone", "north", 1},
+		{"zone", "north_east", 1},
+		{"zone", "north e", 0},
+		{"zone", "100%", 1},
+		{"zone", "%", 0},
+		{"bank", "3", 1},
+		{"unknown", "north", 0},
+	}
+
+	for _, test := range tests {
+		var count int
+		if err := db.Select("rdioScannerCalls", "count(*)").Where(sqlMetadata(test.key, test.value)).QueryRow().Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+
+		if count != test.want {
+			t.Errorf("%s=%s: got %d calls, want %d", test.key, test.value, count, test.want)
+		}
+	}
+}
+
+func TestCallsWriteCallUuid(t *testing.T) {
+	db := newTestDatabase(t)
+
+	calls := NewCalls()
+
+	write := func(uuid string) (*Call, uint) {
+		call := &Call{Audio: []byte{0}, DateTime: time.Now(), System: 1, Talkgroup: 2, Uuid: uuid}
+		id, err := calls.WriteCall(call, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return call, id
+	}
+
+	relayed := "0b9a1e3c-5b6f-4f0e-9d3a-3f1c2a7e8d10"
+
+	tests := []struct {
+		name string
+		uuid string
+		keep bool
+	}{
+		{"generated", "", false},
+		{"relayed", relayed, true},
+		{"taken", relayed, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			call, id := write(test.uuid)
+
+			if len(call.Uuid) != 36 {
+				t.Fatalf("uuid = %q", call.Uuid)
+			}
+			if (call.Uuid == test.uuid) != test.keep {
+				t.Errorf("uuid = %q, given %q, kept %v", call.Uuid, test.uuid, !test.keep)
+			}
+
+			got, err := calls.GetCallByUuid(call.Uuid, db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Id != id || got.Uuid != call.Uuid {
+				t.Errorf("GetCallByUuid(%q) = call %v %q, want call %d", call.Uuid, got.Id, got.Uuid, id)
+			}
+		})
+	}
+
+	for _, s := range []string{"", "not-a-uuid", "5d0c2f7e-8b1a-4c3d-9e6f-7a8b9c0d1e2f"} {
+		if _, err := calls.GetCallByUuid(s, db); !errors.Is(err, ErrCallNotFound) {
+			t.Errorf("GetCallByUuid(%q) error = %v, want %v", s, err, ErrCallNotFound)
+		}
+	}
+}
+
+func TestCallsPermalink(t *testing.T) {
+	db := newTestDatabase(t)
+
+	calls := NewCalls()
+
+	call := &Call{Audio: []byte{0}, DateTime: time.Now(), System: 1, Talkgroup: 2}
+
+	id, err := calls.WriteCall(call, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a call written before the permalinks
+	if _, err = db.Sql.Exec("update `rdioScannerCalls` set `uuid` = null where `id` = ?", id); err != nil {
+		t.Fatal(err)
+	}
+
+	legacy, err := calls.GetCall(id, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(legacy.Uuid) > 0 {
+		t.Fatalf("uuid = %q, want none", legacy.Uuid)
+	}
+
+	first, err := calls.Permalink(legacy, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := calls.GetCall(id, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Uuid != first {
+		t.Errorf("uuid = %q, want %q", again.Uuid, first)
+	}
+
+	// a stale copy of the call gets the same permalink
+	stale := &Call{Id: id}
+	if second, err := calls.Permalink(stale, db); err != nil || second != first {
+		t.Errorf("Permalink() = %q, %v, want %q", second, err, first)
+	}
+
+	if _, err := calls.Permalink(&Call{Id: id + 1}, db); !errors.Is(err, ErrCallNotFound) {
+		t.Errorf("Permalink() of an unknown call error = %v, want %v", err, ErrCallNotFound)
+	}
+}
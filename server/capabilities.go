@@ -0,0 +1,105 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Capabilities tells the front-ends which optional features this server
+// offers, so that they don't have to probe the API for them. What a
+// listener may use of them still depends on its access, ie: a tier may
+// forbid the downloads. The streams are icecast mounts, this server has no
+// hls output.
+type Capabilities struct {
+	AudioCues     bool     `json:"audioCues"`
+	Download      bool     `json:"download"`
+	Events        bool     `json:"events"`
+	Hls           bool     `json:"hls"`
+	LiveCaptions  bool     `json:"liveCaptions"`
+	Oidc          bool     `json:"oidc"`
+	Registration  bool     `json:"registration"`
+	Replay        bool     `json:"replay"`
+	Share         bool     `json:"share"`
+	Streams       bool     `json:"streams"`
+	Subscriptions []string `json:"subscriptions"`
+	Transcription bool     `json:"transcription"`
+	Version       string   `json:"version"`
+}
+
+func NewCapabilities(controller *Controller) *Capabilities {
+	var (
+		config  = controller.Config
+		options = controller.Options
+	)
+
+	capabilities := &Capabilities{
+		AudioCues:     options.AudioCues,
+		Download:      true,
+		Events:        true,
+		Hls:           false,
+		LiveCaptions:  options.LiveCaptions,
+		Oidc:          controller.Oidc.Enabled() && len(config.OidcListeners) > 0,
+		Registration:  options.Registration,
+		Replay:        true,
+		Share:         options.ShareLinks,
+		Subscriptions: []string{},
+		Version:       Version,
+	}
+
+	if options.SubscriptionsMax > 0 {
+		capabilities.Subscriptions = controller.Subscriptions.actions()
+	}
+
+	controller.Streams.mutex.Lock()
+	for _, stream := range controller.Streams.List {
+		if !stream.Disabled {
+			capabilities.Streams = true
+			break
+		}
+	}
+	controller.Streams.mutex.Unlock()
+
+	controller.Transcribers.mutex.Lock()
+	for _, transcriber := range controller.Transcribers.List {
+		if !transcriber.Disabled {
+			capabilities.Transcription = true
+			break
+		}
+	}
+	controller.Transcribers.mutex.Unlock()
+
+	return capabilities
+}
+
+// CapabilitiesHandler returns the capabilities of the server, to anyone as
+// the webapp reads them before the listener is known.
+func (api *Api) CapabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if b, err := json.Marshal(NewCapabilities(api.Controller)); err == nil {
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
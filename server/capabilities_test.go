@@ -0,0 +1,81 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCapabilities(t *testing.T) {
+	controller := newTestController(t, nil)
+
+	tests := []struct {
+		name  string
+		setup func()
+		check func(capabilities *Capabilities) bool
+	}{
+		{"defaults", func() {}, func(c *Capabilities) bool {
+			return c.Download && c.Replay && !c.Hls && !c.Streams && !c.Transcription && len(c.Subscriptions) == 0 && c.Version == Version
+		}},
+		{"disabled transcriber", func() {
+			controller.Transcribers.List = []*Transcriber{{Disabled: true}}
+		}, func(c *Capabilities) bool { return !c.Transcription }},
+		{"transcriber", func() {
+			controller.Transcribers.List = append(controller.Transcribers.List, &Transcriber{})
+		}, func(c *Capabilities) bool { return c.Transcription }},
+		{"stream", func() {
+			controller.Streams.List = []*Stream{{Disabled: true}, {Mount: "fire"}}
+		}, func(c *Capabilities) bool { return c.Streams }},
+		{"email subscriptions", func() {
+			controller.Options.SmtpFrom = "scanner@example.com"
+			controller.Options.SmtpHost = "127.0.0.1"
+			controller.Options.SubscriptionsMax = 5
+		}, func(c *Capabilities) bool { return strings.Join(c.Subscriptions, ",") == SubscriptionActionEmail }},
+		{"options", func() {
+			controller.Options.LiveCaptions = true
+			controller.Options.Registration = true
+			controller.Options.ShareLinks = true
+		}, func(c *Capabilities) bool { return c.LiveCaptions && c.Registration && c.Share && !c.Oidc }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.setup()
+
+			if capabilities := NewCapabilities(controller); !test.check(capabilities) {
+				t.Errorf("capabilities = %+v", capabilities)
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	controller.Api.CapabilitiesHandler(w, httptest.NewRequest(http.MethodGet, "/api/capabilities", nil))
+
+	m := map[string]any{}
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil || m["transcription"] != true || m["hls"] != false {
+		t.Errorf("body = %s, %v", w.Body.String(), err)
+	}
+
+	w = httptest.NewRecorder()
+	controller.Api.CapabilitiesHandler(w, httptest.NewRequest(http.MethodPost, "/api/capabilities", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("post status = %d", w.Code)
+	}
+}
@@ -16,10 +16,13 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
@@ -27,7 +30,7 @@ import (
 )
 
 type Client struct {
-	Access     *Access
+	Agent      *ClientAgent
 	AuthCount  int
 	Controller *Controller
 	Conn       *websocket.Conn
@@ -37,38 +40,72 @@ type Client struct {
 	TagsMap    TagsMap
 	Livefeed   *Livefeed
 	SystemsMap SystemsMap
+	access     *Access
+	calls      []*Message
+	config     *protocolConfig
+	connected  time.Time
+	degraded   bool
+	dropped    uint64
+	closed     bool
+	gap        uint64
+	id         uint64
+	latency    time.Duration
+	protocol   uint
 	request    *http.Request
+	session    *ListenerSession
+	seq        uint64
+	// the access is replaced by the admin and the enforcement while the
+	// emitters and the writer read it
+	accessMutex sync.RWMutex
+	mutex       sync.Mutex
 }
 
 func (client *Client) Init(controller *Controller, request *http.Request, conn *websocket.Conn) error {
 	const (
 		pongWait   = 60 * time.Second
-		pingPeriod = pongWait / 10 * 9
-		writeWait  = 10 * time.Second
+		pingPeriod = 15 * time.Second
 	)
 
 	if conn == nil {
 		return errors.New("client.init: no websocket connection")
 	}
 
+	if message, ok := controller.Pages.Maintenance(); ok {
+		closeWebsocket(conn, websocket.CloseTryAgainLater, message)
+		conn.Close()
+		return nil
+	}
+
 	if controller.Clients.Count() >= int(controller.Options.MaxClients) {
+		closeWebsocket(conn, websocket.CloseTryAgainLater, "The scanner has too many listeners right now, please try again later.")
 		conn.Close()
 		return nil
 	}
 
-	client.Access = &Access{}
+	client.SetAccess(&Access{})
+	client.Agent = NewClientAgent(request.UserAgent())
 	client.Controller = controller
 	client.Conn = conn
+	client.connected = time.Now()
 	client.Livefeed = NewLivefeed()
-	client.Send = make(chan *Message, 8192)
+	client.protocol = 1
+	client.Send = make(chan *Message, client.bufferSize())
 	client.request = request
 
+	if conn.Subprotocol() == ProtocolV2 {
+		client.protocol = 2
+	}
+
+	controller.Stats.ClientConnected(client.Agent)
+
 	go func() {
+		defer controller.Recover("client.reader")
+
 		defer func() {
 			controller.Unregister <- client
 
-			if len(client.Access.Ident) > 0 {
-				controller.Logs.LogEvent(LogLevelInfo, fmt.Sprintf("listener disconnected from ip %s with ident %s", client.GetRemoteAddr(), client.Access.Ident))
+			if len(client.GetAccess().Ident) > 0 {
+				controller.Logs.LogEvent(LogLevelInfo, fmt.Sprintf("listener disconnected from ip %s with ident %s", client.GetRemoteAddr(), client.GetAccess().Ident))
 
 			} else {
 				controller.Logs.LogEvent(LogLevelInfo, fmt.Sprintf("listener disconnected from ip %s", client.GetRemoteAddr()))
@@ -79,8 +116,19 @@ func (client *Client) Init(controller *Controller, request *http.Request, conn *
 
 		client.Conn.SetReadDeadline(time.Now().Add(pongWait))
 
-		client.Conn.SetPongHandler(func(string) error {
-			client.Conn.SetReadDeadline(time.Now().Add(pongWait))
+		// pings carry their send time, the pong echoing it back gives us the
+		// round trip time of the link
+		client.Conn.SetPongHandler(func(data string) error {
+			if sent, err := strconv.ParseInt(data, 10, 64); err == nil {
+				latency := client.measureLatency(time.Since(time.Unix(0, sent)))
+
+				select {
+				case client.Send <- &Message{Command: MessageCommandLatency, Payload: latency.Milliseconds()}:
+				default:
+				}
+			}
+
+			client.Conn.SetReadDeadline(time.Now().Add(pongWait + 2*client.GetLatency()))
 			return nil
 		})
 
@@ -90,6 +138,8 @@ func (client *Client) Init(controller *Controller, request *http.Request, conn *
 				return
 			}
 
+			controller.Metrics.WebsocketReceived()
+
 			message := &Message{}
 			if err = message.FromJson(b); err != nil {
 				log.Println(fmt.Errorf("client.message.fromjson: %v", err))
@@ -104,6 +154,8 @@ func (client *Client) Init(controller *Controller, request *http.Request, conn *
 	}()
 
 	go func() {
+		defer controller.Recover("client.writer")
+
 		ticker := time.NewTicker(pingPeriod)
 
 		timer := time.AfterFunc(pongWait, func() {
@@ -120,6 +172,12 @@ func (client *Client) Init(controller *Controller, request *http.Request, conn *
 			client.Conn.Close()
 		}()
 
+		// a first measurement right away, pacing starts from a known latency
+		client.Conn.SetWriteDeadline(time.Now().Add(client.writeWait()))
+		if err := client.Conn.WriteMessage(websocket.PingMessage, []byte(strconv.FormatInt(time.Now().UnixNano(), 10))); err != nil {
+			return
+		}
+
 		for {
 			select {
 			case message, ok := <-client.Send:
@@ -127,15 +185,20 @@ func (client *Client) Init(controller *Controller, request *http.Request, conn *
 					return
 				}
 
+				if !client.dequeueCall(message) {
+					continue
+				}
+
 				if message.Command == MessageCommandConfig {
 					if timer != nil {
 						timer.Stop()
 						timer = nil
 
+						client.session = NewListenerSession(client)
 						controller.Register <- client
 
-						if len(client.Access.Ident) > 0 {
-							controller.Logs.LogEvent(LogLevelInfo, fmt.Sprintf("new listener from ip %s with ident %s", client.GetRemoteAddr(), client.Access.Ident))
+						if len(client.GetAccess().Ident) > 0 {
+							controller.Logs.LogEvent(LogLevelInfo, fmt.Sprintf("new listener from ip %s with ident %s", client.GetRemoteAddr(), client.GetAccess().Ident))
 
 						} else {
 							controller.Logs.LogEvent(LogLevelInfo, fmt.Sprintf("new listener from ip %s", client.GetRemoteAddr()))
@@ -143,22 +206,55 @@ func (client *Client) Init(controller *Controller, request *http.Request, conn *
 					}
 				}
 
-				b, err := message.ToJson()
+				// messages are numbered in the exact order they are written on the
+				// connection, letting the webapp detect gaps and ask for a resync
+				client.seq++
+				message.Seq = client.seq
+
+				var (
+					b           []byte
+					binary      bool
+					err         error
+					messageType = websocket.TextMessage
+				)
+
+				if client.protocol >= 2 {
+					if b, binary, err = message.ToBinary(); binary {
+						messageType = websocket.BinaryMessage
+					}
+				}
+
+				if !binary && err == nil {
+					b, err = message.ToJson()
+				}
+
 				if err != nil {
 					log.Println(fmt.Errorf("client.message.tojson: %v", err))
 
 				} else {
-					client.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+					client.Conn.SetWriteDeadline(time.Now().Add(client.writeWait()))
 
-					if err = client.Conn.WriteMessage(websocket.TextMessage, b); err != nil {
+					if err = client.Conn.WriteMessage(messageType, b); err != nil {
 						return
 					}
+
+					// a normal closure, the webapp doesn't reconnect
+					if message.Command == MessageCommandKick {
+						closeWebsocket(client.Conn, websocket.CloseNormalClosure, "You were disconnected by the administrator.")
+						return
+					}
+
+					controller.Metrics.WebsocketSent(client.protocol, len(b))
+
+					if client.session != nil {
+						client.session.Track(message, len(b))
+					}
 				}
 
 			case <-ticker.C:
-				client.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+				client.Conn.SetWriteDeadline(time.Now().Add(client.writeWait()))
 
-				if err := client.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				if err := client.Conn.WriteMessage(websocket.PingMessage, []byte(strconv.FormatInt(time.Now().UnixNano(), 10))); err != nil {
 					return
 				}
 			}
@@ -168,11 +264,347 @@ func (client *Client) Init(controller *Controller, request *http.Request, conn *
 	return nil
 }
 
+// SendCall queues a live call. Once the client has too many calls waiting to
+// be written, a call displaces the oldest queued call of a system with a
+// lower qos weight. When there is none, the slow client policy decides
+// between dropping the oldest call, disconnecting the client, or sending
+// the calls without their audio until the client caught up.
+func (client *Client) SendCall(message *Message) bool {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if client.closed {
+		return false
+	}
+
+	if client.degraded {
+		return client.sendMetadata(message)
+	}
+
+	if len(client.calls) >= client.callQueueSize() {
+		victim := -1
+
+		for i, m := range client.calls {
+			if m.weight < message.weight && (victim < 0 || m.weight < client.calls[victim].weight) {
+				victim = i
+			}
+		}
+
+		if victim < 0 {
+			switch client.slowPolicy() {
+			case SLOW_CLIENT_DISCONNECT:
+				client.disconnect(fmt.Sprintf("%d calls queued", len(client.calls)))
+				return false
+
+			case SLOW_CLIENT_METADATA:
+				client.degraded = true
+				client.slow("degraded")
+				client.logEvent(LogLevelWarn, fmt.Sprintf("%d calls queued, sending calls without audio until it catches up", len(client.calls)))
+				return client.sendMetadata(message)
+
+			default:
+				for i, m := range client.calls {
+					if m.weight <= message.weight {
+						victim = i
+						break
+					}
+				}
+			}
+		}
+
+		if victim < 0 {
+			client.slow("dropped")
+			return false
+		}
+
+		client.calls[victim].dropped = true
+		client.calls = append(client.calls[:victim], client.calls[victim+1:]...)
+		client.slow("dropped")
+	}
+
+	select {
+	case client.Send <- message:
+		client.calls = append(client.calls, message)
+		return true
+	default:
+		client.overflow(message)
+		return false
+	}
+}
+
+// Deliver queues a message other than a live call without ever blocking the
+// caller, applying the slow client policy when the buffer is full.
+func (client *Client) Deliver(message *Message) bool {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if client.closed {
+		return false
+	}
+
+	select {
+	case client.Send <- message:
+		return true
+	default:
+		client.overflow(message)
+		return false
+	}
+}
+
+// dequeueCall is called by the writer for every message it takes, telling
+// if it is to be written. The calls dropped since the last message leave
+// as many numbers unused, the webapp seeing the gap and asking for a resync.
+func (client *Client) dequeueCall(message *Message) bool {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	client.seq += client.gap
+	client.gap = 0
+
+	if message.dropped {
+		return false
+	}
+
+	for i, m := range client.calls {
+		if m == message {
+			client.calls = append(client.calls[:i], client.calls[i+1:]...)
+			break
+		}
+	}
+
+	if client.degraded && len(client.calls) == 0 {
+		client.degraded = false
+		client.logEvent(LogLevelInfo, "caught up, sending calls with audio again")
+	}
+
+	return true
+}
+
+func (client *Client) bufferSize() uint {
+	if client.Controller != nil && client.Controller.Options.ClientBufferSize > 0 {
+		return client.Controller.Options.ClientBufferSize
+	}
+	return defaults.options.clientBufferSize
+}
+
+func (client *Client) callQueueSize() int {
+	if client.Controller != nil && client.Controller.Options.ClientCallQueue > 0 {
+		return int(client.Controller.Options.ClientCallQueue)
+	}
+	return int(defaults.options.clientCallQueue)
+}
+
+// disconnect closes the connection of the client, the reading goroutine
+// unregistering it. The caller holds the mutex.
+func (client *Client) disconnect(reason string) {
+	if client.closed {
+		return
+	}
+
+	client.closed = true
+	client.slow("disconnected")
+	client.logEvent(LogLevelWarn, fmt.Sprintf("disconnected, too slow with %s", reason))
+
+	if client.Conn != nil {
+		client.Conn.Close()
+	}
+}
+
+func (client *Client) logEvent(level string, message string) {
+	if client.Controller == nil {
+		return
+	}
+
+	if client.GetAccess() != nil && len(client.GetAccess().Ident) > 0 {
+		client.Controller.Logs.LogEvent(level, fmt.Sprintf("listener from ip %s with ident %s %s", client.GetRemoteAddr(), client.GetAccess().Ident, message))
+	} else {
+		client.Controller.Logs.LogEvent(level, fmt.Sprintf("listener from ip %s %s", client.GetRemoteAddr(), message))
+	}
+}
+
+// overflow handles a message that didn't fit in the buffer of the client.
+// The listener can't be left without its config or the loss of its access,
+// those disconnect it whatever the policy. The caller holds the mutex.
+func (client *Client) overflow(message *Message) {
+	switch message.Command {
+	case MessageCommandConfig, MessageCommandConfigDelta, MessageCommandExpired, MessageCommandKick, MessageCommandPin:
+		client.disconnect("a full buffer")
+		return
+	}
+
+	if client.slowPolicy() == SLOW_CLIENT_DISCONNECT {
+		client.disconnect("a full buffer")
+		return
+	}
+
+	client.slow("dropped")
+}
+
+// sendMetadata queues a live call without its audio, the webapp showing it
+// without playing it. The caller holds the mutex.
+func (client *Client) sendMetadata(message *Message) bool {
+	if call, ok := message.Payload.(*Call); ok {
+		metadata := *call
+		metadata.Audio = nil
+		message.Payload = &metadata
+	}
+
+	select {
+	case client.Send <- message:
+		return true
+	default:
+		client.overflow(message)
+		return false
+	}
+}
+
+func (client *Client) slow(action string) {
+	if action == "dropped" {
+		client.dropped++
+		client.gap++
+	}
+
+	if client.Controller != nil {
+		client.Controller.Metrics.SlowClient(action)
+	}
+}
+
+func (client *Client) slowPolicy() string {
+	if client.Controller != nil && len(client.Controller.Options.SlowClientPolicy) > 0 {
+		return client.Controller.Options.SlowClientPolicy
+	}
+	return defaults.options.slowClientPolicy
+}
+
+// GetAccess returns the access of the listener, an empty access until the
+// listener gives its code.
+func (client *Client) GetAccess() *Access {
+	client.accessMutex.RLock()
+	defer client.accessMutex.RUnlock()
+
+	return client.access
+}
+
+func (client *Client) SetAccess(access *Access) {
+	client.accessMutex.Lock()
+	defer client.accessMutex.Unlock()
+
+	client.access = access
+}
+
+// GetTier returns the tier of the listener access, nil when the access is
+// not bound to a tier.
+func (client *Client) GetTier() *Tier {
+	if client.GetAccess() == nil || client.Controller == nil {
+		return nil
+	}
+
+	if tier, ok := client.Controller.Tiers.GetTier(client.GetAccess().Tier); ok {
+		return tier
+	}
+
+	return nil
+}
+
+func (client *Client) GetLatency() time.Duration {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	return client.latency
+}
+
 func (client *Client) GetRemoteAddr() string {
 	return GetRemoteAddr(client.request)
 }
 
+// measureLatency smooths the round trip times so that a single slow pong
+// doesn't swing the delivery pacing.
+func (client *Client) measureLatency(rtt time.Duration) time.Duration {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if client.latency == 0 {
+		client.latency = rtt
+	} else {
+		client.latency = (client.latency*3 + rtt) / 4
+	}
+
+	return client.latency
+}
+
+// writeWait gives high latency links, like satellite or rural lte, more time
+// to take a message before the connection is considered dead.
+func (client *Client) writeWait() time.Duration {
+	const (
+		writeWait    = 10 * time.Second
+		writeWaitMax = 60 * time.Second
+	)
+
+	if d := writeWait + 4*client.GetLatency(); d < writeWaitMax {
+		return d
+	}
+
+	return writeWaitMax
+}
+
+// SendConfig sends the whole config to the listener.
 func (client *Client) SendConfig(groups *Groups, options *Options, systems *Systems, tags *Tags) {
+	payload := client.configPayload(groups, options, systems, tags)
+
+	if client.protocol >= 2 {
+		config, err := newProtocolConfig(payload)
+		if err != nil {
+			log.Println(fmt.Errorf("client.sendconfig: %v", err))
+		}
+
+		client.mutex.Lock()
+		client.config = config
+		client.mutex.Unlock()
+	}
+
+	client.Deliver(&Message{Command: MessageCommandConfig, Payload: payload})
+
+	if client.Controller != nil {
+		client.Controller.Incidents.Send(client)
+		client.Controller.Occupancy.Send(client)
+	}
+}
+
+// SendConfigUpdate sends a changed config to the listener, as a delta of the
+// last config sent when the listener speaks the second protocol.
+func (client *Client) SendConfigUpdate(groups *Groups, options *Options, systems *Systems, tags *Tags) {
+	client.mutex.Lock()
+	previous := client.config
+	client.mutex.Unlock()
+
+	if client.protocol < 2 || previous == nil {
+		client.SendConfig(groups, options, systems, tags)
+		return
+	}
+
+	payload := client.configPayload(groups, options, systems, tags)
+
+	config, err := newProtocolConfig(payload)
+	if err != nil {
+		log.Println(fmt.Errorf("client.sendconfigupdate: %v", err))
+		client.SendConfig(groups, options, systems, tags)
+		return
+	}
+
+	client.mutex.Lock()
+	client.config = config
+	client.mutex.Unlock()
+
+	if delta := previous.delta(config, payload); delta != nil {
+		client.Deliver(&Message{Command: MessageCommandConfigDelta, Payload: delta})
+	}
+
+	if client.Controller != nil {
+		client.Controller.Incidents.Send(client)
+	}
+}
+
+func (client *Client) configPayload(groups *Groups, options *Options, systems *Systems, tags *Tags) map[string]any {
 	client.SystemsMap = systems.GetScopedSystems(client, groups, tags, options.SortTalkgroups)
 	client.GroupsMap = groups.GetGroupsMap(&client.SystemsMap)
 	client.TagsMap = tags.GetTagsMap(&client.SystemsMap)
@@ -183,8 +615,10 @@ func (client *Client) SendConfig(groups *Groups, options *Options, systems *Syst
 		"email":              options.Email,
 		"groups":             client.GroupsMap,
 		"keypadBeeps":        GetKeypadBeeps(options),
+		"liveCaptions":       options.LiveCaptions,
 		"playbackGoesLive":   options.PlaybackGoesLive,
 		"showListenersCount": options.ShowListenersCount,
+		"showOccupancy":      options.ShowOccupancy,
 		"systems":            client.SystemsMap,
 		"tags":               client.TagsMap,
 		"tagsToggle":         options.TagsToggle,
@@ -195,18 +629,37 @@ func (client *Client) SendConfig(groups *Groups, options *Options, systems *Syst
 		payload["afs"] = options.AfsSystems
 	}
 
-	client.Send <- &Message{Command: MessageCommandConfig, Payload: payload}
+	if options.AudioCues {
+		payload["audioCues"] = map[string]any{"speech": client.Controller != nil && client.Controller.Config != nil && len(client.Controller.Config.TtsCommand) > 0}
+	}
+
+	if tier := client.GetTier(); tier != nil {
+		payload["download"] = tier.Download
+	}
+
+	if options.ShareLinks {
+		payload["share"] = payload["download"] != false
+	}
+
+	if client.Controller != nil && options.SubscriptionsMax > 0 {
+		if _, ok := client.Controller.Subscriptions.GetSubscriber(client.GetAccess()); ok {
+			payload["subscriptions"] = options.SubscriptionsMax
+		}
+	}
+
+	return payload
 }
 
 func (client *Client) SendListenersCount(count int) {
-	client.Send <- &Message{
+	client.Deliver(&Message{
 		Command: MessagecommandListenersCount,
 		Payload: count,
-	}
+	})
 }
 
 type Clients struct {
 	Map   map[*Client]bool
+	seq   uint64
 	mutex sync.Mutex
 }
 
@@ -217,11 +670,16 @@ func NewClients() *Clients {
 	}
 }
 
+// AccessCount returns how many other listeners are connected with the
+// access code of the client.
 func (clients *Clients) AccessCount(client *Client) int {
+	clients.mutex.Lock()
+	defer clients.mutex.Unlock()
+
 	count := 0
 
 	for c := range clients.Map {
-		if c.Access == client.Access {
+		if c != client && c.GetAccess() != nil && c.GetAccess().Systems != nil && c.GetAccess().Code == client.GetAccess().Code {
 			count++
 		}
 	}
@@ -233,17 +691,122 @@ func (clients *Clients) Add(client *Client) {
 	clients.mutex.Lock()
 	defer clients.mutex.Unlock()
 
+	if client.id == 0 {
+		clients.seq++
+		client.id = clients.seq
+	}
+
 	clients.Map[client] = true
 }
 
+func (clients *Clients) Agents() *ClientStatsBreakdown {
+	clients.mutex.Lock()
+	defer clients.mutex.Unlock()
+
+	breakdown := NewClientStatsBreakdown()
+
+	for c := range clients.Map {
+		if c.Agent != nil {
+			breakdown.Add(c.Agent)
+		}
+	}
+
+	return breakdown
+}
+
 func (clients *Clients) Count() int {
 	return len(clients.Map)
 }
 
-func (clients *Clients) EmitCall(call *Call, restricted bool) {
+// EmitCall sends the call to the listeners with access to it, held back by
+// the longest of the delay of its talkgroup and of the tier of the listener.
+func (clients *Clients) EmitCall(call *Call, delay time.Duration, restricted bool, weight uint) (count uint, dropped uint) {
+	clients.mutex.Lock()
+	defer clients.mutex.Unlock()
+
 	for c := range clients.Map {
-		if (!restricted || c.Access.HasAccess(call)) && c.Livefeed.IsEnabled(call) {
-			c.Send <- &Message{Command: MessageCommandCall, Payload: call}
+		if (!restricted || c.GetAccess().HasAccess(call)) && c.Livefeed.IsEnabled(call) {
+			tier := c.GetTier()
+			message := &Message{Command: MessageCommandCall, Payload: tier.RedactCall(call), weight: weight}
+
+			if c.Livefeed.IsMetadata() {
+				message.Payload = tier.RedactCall(call).metadata()
+				message.Flag = LivefeedFlagMetadata
+			}
+
+			if delay := clientDelay(tier, delay); delay > 0 {
+				client := c
+				time.AfterFunc(delay, func() { client.SendCall(message) })
+				count++
+
+			} else if c.SendCall(message) {
+				count++
+
+			} else {
+				dropped++
+			}
+		}
+	}
+
+	return count, dropped
+}
+
+// EmitCaptions sends the timed segments of the transcript to the listeners,
+// which show them as captions while the call plays.
+func (clients *Clients) EmitCaptions(call *Call, segments []TranscriptSegment, delay time.Duration, restricted bool) {
+	clients.emitText(call, &Message{Command: MessageCommandCaptions, Payload: map[string]any{"id": call.Id, "segments": segments}}, delay, restricted)
+}
+
+func (clients *Clients) EmitTranscript(call *Call, transcript string, delay time.Duration, restricted bool) {
+	clients.emitText(call, &Message{Command: MessageCommandTranscript, Payload: map[string]any{"id": call.Id, "transcript": transcript}}, delay, restricted)
+}
+
+// emitText sends a message derived from the transcript of the call to the
+// listeners with access to it, except those whose tier redacts transcripts.
+func (clients *Clients) emitText(call *Call, message *Message, delay time.Duration, restricted bool) {
+	clients.mutex.Lock()
+	defer clients.mutex.Unlock()
+
+	for c := range clients.Map {
+		if !restricted || c.GetAccess().HasAccess(call) {
+			tier := c.GetTier()
+			if tier != nil && tier.Redact {
+				continue
+			}
+
+			send := func(client *Client) {
+				client.Deliver(message)
+			}
+
+			if delay := clientDelay(tier, delay); delay > 0 {
+				client := c
+				time.AfterFunc(delay, func() { send(client) })
+			} else {
+				send(c)
+			}
+		}
+	}
+}
+
+// clientDelay returns the longest of the delay of the tier and of the given
+// delay of a talkgroup.
+func clientDelay(tier *Tier, delay time.Duration) time.Duration {
+	if d := tier.GetDelay(); d > delay {
+		return d
+	}
+
+	return delay
+}
+
+// EmitOccupancy sends the talkgroups whose activity changed to the listeners
+// with access to them.
+func (clients *Clients) EmitOccupancy(occupancy *Occupancy, states []OccupancyState, restricted bool) {
+	clients.mutex.Lock()
+	defer clients.mutex.Unlock()
+
+	for c := range clients.Map {
+		if scoped, ok := occupancy.scoped(c, states, restricted); ok && len(scoped) > 0 {
+			c.Deliver(&Message{Command: MessageCommandOccupancy, Payload: scoped})
 		}
 	}
 }
@@ -253,9 +816,9 @@ func (clients *Clients) EmitConfig(groups *Groups, options *Options, systems *Sy
 
 	for c := range clients.Map {
 		if restricted {
-			c.Send <- &Message{Command: MessageCommandPin}
+			c.Deliver(&Message{Command: MessageCommandPin})
 		} else {
-			c.SendConfig(groups, options, systems, tags)
+			c.SendConfigUpdate(groups, options, systems, tags)
 		}
 
 		if options.ShowListenersCount {
@@ -272,9 +835,206 @@ func (clients *Clients) EmitListenersCount() {
 	}
 }
 
+// Sessions lists the connected listeners for the admin dashboard.
+func (clients *Clients) Sessions() []map[string]any {
+	clients.mutex.Lock()
+	defer clients.mutex.Unlock()
+
+	sessions := []map[string]any{}
+
+	for c := range clients.Map {
+		session := map[string]any{
+			"id":        c.id,
+			"connected": c.connected,
+			"ip":        c.GetRemoteAddr(),
+			"latency":   c.GetLatency().Milliseconds(),
+			"protocol":  c.protocol,
+		}
+
+		c.mutex.Lock()
+		session["degraded"] = c.degraded
+		session["dropped"] = c.dropped
+		session["queued"] = len(c.calls)
+		c.mutex.Unlock()
+
+		if c.GetAccess() != nil && len(c.GetAccess().Ident) > 0 {
+			session["ident"] = c.GetAccess().Ident
+		}
+
+		if c.Agent != nil {
+			session["browser"] = c.Agent.Browser
+			session["device"] = c.Agent.Device
+			session["platform"] = c.Agent.Platform
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	sort.Slice(sessions, func(i int, j int) bool {
+		return sessions[i]["connected"].(time.Time).Before(sessions[j]["connected"].(time.Time))
+	})
+
+	return sessions
+}
+
+// Enforce takes the access away from the listeners whose access code is gone
+// or has expired, then from the most recent listeners of the access codes
+// over their limit of concurrent connections. It returns how many listeners
+// lost their access for each reason.
+func (clients *Clients) Enforce(getAccess func(code string) (*Access, bool)) (expired int, excess int) {
+	clients.mutex.Lock()
+	list := []*Client{}
+	for c := range clients.Map {
+		if c.GetAccess() != nil && c.GetAccess().Systems != nil && len(c.GetAccess().Code) > 0 {
+			list = append(list, c)
+		}
+	}
+	clients.mutex.Unlock()
+
+	sort.Slice(list, func(i int, j int) bool {
+		return list[i].connected.Before(list[j].connected)
+	})
+
+	counts := map[string]uint{}
+
+	for _, c := range list {
+		access, ok := getAccess(c.GetAccess().Code)
+		if !ok || access.HasExpired() {
+			c.logEvent(LogLevelWarn, "disconnected, access expired")
+			c.SetAccess(&Access{})
+			c.Deliver(&Message{Command: MessageCommandExpired})
+			expired++
+			continue
+		}
+
+		counts[access.Code]++
+
+		if limit, ok := access.Limit.(uint); ok && limit > 0 && counts[access.Code] > limit {
+			c.logEvent(LogLevelWarn, fmt.Sprintf("disconnected, over the limit of %d concurrent connections", limit))
+			c.SetAccess(&Access{})
+			c.Deliver(&Message{Command: MessageCommandMax})
+			excess++
+		}
+	}
+
+	return expired, excess
+}
+
+// Kick disconnects a listener, the webapp forgetting its access code instead
+// of reconnecting by itself.
+func (clients *Clients) Kick(id uint64) (*Client, bool) {
+	clients.mutex.Lock()
+	defer clients.mutex.Unlock()
+
+	for c := range clients.Map {
+		if c.id == id {
+			c.SetAccess(&Access{})
+			c.Deliver(&Message{Command: MessageCommandKick})
+			return c, true
+		}
+	}
+
+	return nil, false
+}
+
+// Revoke takes the access away from the listeners using it, telling them it
+// has expired. It returns how many listeners were using it.
+func (clients *Clients) Revoke(access *Access) int {
+	clients.mutex.Lock()
+	defer clients.mutex.Unlock()
+
+	count := 0
+
+	for c := range clients.Map {
+		if c.GetAccess() == access {
+			c.SetAccess(&Access{})
+			c.Deliver(&Message{Command: MessageCommandExpired})
+			count++
+		}
+	}
+
+	return count
+}
+
 func (clients *Clients) Remove(client *Client) {
 	clients.mutex.Lock()
 	defer clients.mutex.Unlock()
 
 	delete(clients.Map, client)
 }
+
+// CloseAll closes the connections of the listeners with the reason the
+// webapp shows them, the webapp reconnecting by itself unless the closure is
+// a normal one.
+func (clients *Clients) CloseAll(code int, reason string) {
+	clients.mutex.Lock()
+	conns := make([]*websocket.Conn, 0, len(clients.Map))
+	for c := range clients.Map {
+		conns = append(conns, c.Conn)
+	}
+	clients.mutex.Unlock()
+
+	for _, conn := range conns {
+		closeWebsocket(conn, code, reason)
+	}
+}
+
+// ListenersHandler lists the connected listeners, or with history the
+// recorded listener sessions filtered by access code, ident, ip and dates.
+// Deleting a listener by its id disconnects it.
+func (admin *Admin) ListenersHandler(w http.ResponseWriter, r *http.Request) {
+	if !admin.Authorize(w, r, adminWriteRole(r)) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		// the recorded sessions, connected or not, for auditing
+		if len(r.URL.Query().Get("history")) > 0 {
+			searchOptions := &ListenerSessionsSearchOptions{}
+			searchOptions.FromQuery(r)
+
+			results, err := admin.Controller.ListenerSessions.Search(searchOptions, admin.Controller.Database)
+			if err != nil {
+				admin.Controller.Logs.LogEvent(LogLevelError, err.Error())
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			if b, err := json.Marshal(results); err == nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write(b)
+			} else {
+				w.WriteHeader(http.StatusExpectationFailed)
+			}
+			return
+		}
+
+		if b, err := json.Marshal(map[string]any{"listeners": admin.Controller.Clients.Sessions()}); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+
+	case http.MethodDelete:
+		id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+		if err != nil || id == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		client, ok := admin.Controller.Clients.Kick(id)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		admin.Controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("listener %d from ip %s kicked by admin from ip %s", id, client.GetRemoteAddr(), GetRemoteAddr(r)))
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
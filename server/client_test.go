@@ -0,0 +1,140 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import "testing"
+
+// drain numbers the queued messages as the writer does.
+func drain(client *Client) []uint64 {
+	seqs := []uint64{}
+
+	for {
+		select {
+		case message := <-client.Send:
+			if !client.dequeueCall(message) {
+				continue
+			}
+			client.seq++
+			seqs = append(seqs, client.seq)
+		default:
+			return seqs
+		}
+	}
+}
+
+func TestClientDroppedCallsLeaveGap(t *testing.T) {
+	tests := []struct {
+		name  string
+		queue int
+		send  func(client *Client)
+		want  []uint64
+	}{
+		{
+			name:  "no drop",
+			queue: 8,
+			send: func(client *Client) {
+				for i := 0; i < 3; i++ {
+					client.SendCall(&Message{Command: MessageCommandCall})
+				}
+			},
+			want: []uint64{1, 2, 3},
+		},
+		{
+			name:  "displaced by a higher weight",
+			queue: int(defaults.options.clientCallQueue) + 1,
+			send: func(client *Client) {
+				for i := 0; i < int(defaults.options.clientCallQueue); i++ {
+					client.SendCall(&Message{Command: MessageCommandCall})
+				}
+				client.SendCall(&Message{Command: MessageCommandCall, weight: 1})
+			},
+			want: func() []uint64 {
+				// the oldest call is displaced, its number is skipped
+				seqs := []uint64{}
+				for i := uint64(2); i <= uint64(defaults.options.clientCallQueue)+1; i++ {
+					seqs = append(seqs, i)
+				}
+				return seqs
+			}(),
+		},
+		{
+			name:  "buffer overflow",
+			queue: 2,
+			send: func(client *Client) {
+				for i := 0; i < 3; i++ {
+					client.SendCall(&Message{Command: MessageCommandCall})
+				}
+			},
+			// the gap shows with the next message written
+			want: []uint64{2, 3},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &Client{Send: make(chan *Message, test.queue)}
+
+			test.send(client)
+
+			got := drain(client)
+
+			if len(got) != len(test.want) {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Fatalf("got %v, want %v", got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestClientsEnforceRace(t *testing.T) {
+	clients := NewClients()
+
+	call := &Call{System: 1, Talkgroup: 1}
+
+	for i := 0; i < 4; i++ {
+		client := &Client{Livefeed: NewLivefeed(), Send: make(chan *Message, 1024)}
+		client.Livefeed.Matrix[1] = map[uint]bool{1: true}
+		client.SetAccess(&Access{Code: "code", Systems: "*"})
+		clients.Map[client] = true
+
+		go func() {
+			for range client.Send {
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			clients.EmitCall(call, 0, true, 0)
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		clients.Enforce(func(code string) (*Access, bool) { return nil, false })
+		for client := range clients.Map {
+			client.SetAccess(&Access{Code: "code", Systems: "*"})
+		}
+	}
+
+	<-done
+}
@@ -0,0 +1,114 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// LoadClientCAs reads the PEM bundle of the authorities issuing the client
+// certificates of the recorders and of the upstream instances.
+func LoadClientCAs(file string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.New("no PEM formated certificate found")
+	}
+
+	return pool, nil
+}
+
+// ClientTLSConfig adds the verification of the client certificates to the
+// tls config of the ssl listener, nil giving a new one. A certificate stays
+// optional during the handshake for the browsers of the listeners to connect
+// without one, the upload handlers deciding whether they require it.
+func (config *Config) ClientTLSConfig(tlsConfig *tls.Config) (*tls.Config, error) {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+
+	if len(config.SslClientCa) == 0 {
+		return tlsConfig, nil
+	}
+
+	pool, err := LoadClientCAs(config.GetSslClientCaFilePath())
+	if err != nil {
+		return nil, fmt.Errorf("ssl_client_ca_file: %v", err)
+	}
+
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	tlsConfig.ClientCAs = pool
+
+	return tlsConfig, nil
+}
+
+// DownstreamClient returns the http client uploading the calls to the
+// downstream instances, presenting the client certificate when one is set.
+func (config *Config) DownstreamClient() (*http.Client, error) {
+	client := &http.Client{Timeout: downstreamTimeout}
+
+	if len(config.DownstreamCert) == 0 && len(config.DownstreamKey) == 0 {
+		return client, nil
+	}
+
+	pair, err := tls.LoadX509KeyPair(config.GetDownstreamCertFilePath(), config.GetDownstreamKeyFilePath())
+	if err != nil {
+		return nil, fmt.Errorf("downstream_cert_file: %v", err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{Certificates: []tls.Certificate{pair}}
+
+	client.Transport = transport
+
+	return client, nil
+}
+
+// CertificateFingerprint is the SHA-256 fingerprint of the certificate, in
+// lowercase hexadecimal.
+func CertificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifiedClientCertificate returns the client certificate of the request
+// once verified against the client CA, nil otherwise. Requests reaching the
+// server through a reverse proxy terminating the ssl never carry one.
+func VerifiedClientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// normalizeFingerprint accepts the fingerprints as printed by openssl, in
+// uppercase with colons.
+func normalizeFingerprint(s string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(s))
+}
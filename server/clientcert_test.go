@@ -0,0 +1,286 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pair tls.Certificate
+}
+
+// newTestCertificate issues a certificate signed by the parent, a
+// self-signed CA without one.
+func newTestCertificate(t *testing.T, cn string, parent *testCertificate) *testCertificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCertificate{cert: cert, key: key, pair: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}}
+}
+
+// write saves the certificate and its key as PEM files in the folder.
+func (c *testCertificate) write(t *testing.T, dir string, name string) (certFile string, keyFile string) {
+	t.Helper()
+
+	b, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func TestGetApikeyByCertificate(t *testing.T) {
+	ca := newTestCertificate(t, "ca", nil)
+	site := newTestCertificate(t, "site-a", ca)
+
+	fingerprint := strings.ToUpper(CertificateFingerprint(site.cert))
+	for i := len(fingerprint) - 2; i > 0; i -= 2 {
+		fingerprint = fingerprint[:i] + ":" + fingerprint[i:]
+	}
+
+	tests := []struct {
+		name   string
+		apikey *Apikey
+		cert   *x509.Certificate
+		ok     bool
+	}{
+		{"common name", &Apikey{Certificate: "site-a"}, site.cert, true},
+		{"fingerprint", &Apikey{Certificate: CertificateFingerprint(site.cert)}, site.cert, true},
+		{"openssl fingerprint", &Apikey{Certificate: fingerprint}, site.cert, true},
+		{"other common name", &Apikey{Certificate: "site-b"}, site.cert, false},
+		{"no certificate", &Apikey{}, site.cert, false},
+		{"disabled", &Apikey{Certificate: "site-a", Disabled: true}, site.cert, false},
+		{"revoked", &Apikey{Certificate: "site-a", Revoked: time.Now()}, site.cert, false},
+		{"no client certificate", &Apikey{Certificate: "site-a"}, nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			apikeys := NewApikeys()
+			apikeys.List = append(apikeys.List, test.apikey)
+
+			if _, ok := apikeys.GetApikeyByCertificate(test.cert); ok != test.ok {
+				t.Errorf("ok = %v, want %v", ok, test.ok)
+			}
+		})
+	}
+}
+
+func TestCallUploadClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+
+	ca := newTestCertificate(t, "ca", nil)
+	caFile, _ := ca.write(t, dir, "ca")
+
+	site := newTestCertificate(t, "site-a", ca)
+	siteCert, siteKey := site.write(t, dir, "site-a")
+
+	other := newTestCertificate(t, "site-b", ca)
+	rogue := newTestCertificate(t, "site-a", newTestCertificate(t, "rogue", nil))
+
+	tests := []struct {
+		name     string
+		required bool
+		cert     *testCertificate
+		key      string
+		status   int
+		err      bool
+	}{
+		{name: "certificate", cert: site, status: http.StatusOK},
+		{name: "certificate required", required: true, cert: site, status: http.StatusOK},
+		{name: "key", key: "key", status: http.StatusOK},
+		{name: "key with a certificate required", required: true, key: "key", status: http.StatusUnauthorized},
+		{name: "unknown certificate with a key", cert: other, key: "key", status: http.StatusOK},
+		{name: "unknown certificate required", required: true, cert: other, key: "key", status: http.StatusUnauthorized},
+		{name: "certificate of another CA", cert: rogue, err: true},
+		{name: "nothing", status: http.StatusUnauthorized},
+	}
+
+	controller := newTestController(t, &Config{SslClientCa: caFile})
+
+	controller.Apikeys.List = append(controller.Apikeys.List,
+		&Apikey{Id: uint(1), Ident: "site a", Key: "uuid", Certificate: "site-a", Systems: "*"},
+		&Apikey{Id: uint(2), Ident: "shared", Key: "key", Systems: "*"},
+	)
+
+	tlsConfig, err := controller.Config.ClientTLSConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(controller.Api.CallUploadHandler))
+	server.TLS = tlsConfig
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			controller.Config.SslClientRequire = test.required
+
+			// the certificate is presented even when the server asks for
+			// another CA, as a rogue client would
+			transport := server.Client().Transport.(*http.Transport).Clone()
+			transport.TLSClientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				if test.cert == nil {
+					return &tls.Certificate{}, nil
+				}
+				return &test.cert.pair, nil
+			}
+
+			body, contentType := newTestUpload(t, test.key)
+
+			res, err := (&http.Client{Transport: transport}).Post(server.URL, contentType, body)
+			if test.err {
+				if err == nil {
+					res.Body.Close()
+					t.Fatal("no handshake error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != test.status {
+				t.Errorf("status %d, want %d", res.StatusCode, test.status)
+			}
+		})
+	}
+
+	ingested := len(controller.Ingest)
+
+	// the upstream instances present their client certificate the same way
+	controller.Config.DownstreamCert = siteCert
+	controller.Config.DownstreamKey = siteKey
+	controller.Config.SslClientRequire = true
+
+	if err := controller.Downstreams.Start(controller.Config); err != nil {
+		t.Fatal(err)
+	}
+
+	client := controller.Downstreams.client
+	client.Transport.(*http.Transport).TLSClientConfig.RootCAs = server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	call := NewCall()
+	call.Audio = bytes.Repeat([]byte{0}, 64)
+	call.AudioName = "call.wav"
+	call.DateTime = time.Now().UTC()
+	call.System = 1
+	call.Talkgroup = 10
+
+	if err := (&Downstream{Url: server.URL}).Send(call, client); err != nil {
+		t.Fatal(err)
+	}
+	if len(controller.Ingest) != ingested+1 {
+		t.Errorf("%d calls ingested, want %d", len(controller.Ingest), ingested+1)
+	}
+}
+
+// newTestUpload is a call upload with the key, none if empty.
+func newTestUpload(t *testing.T, key string) (*bytes.Buffer, string) {
+	t.Helper()
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+
+	fields := map[string]string{"dateTime": "1700000000", "system": "1", "talkgroup": "10"}
+	if len(key) > 0 {
+		fields["key"] = key
+	}
+
+	for name, value := range fields {
+		if err := mw.WriteField(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fw, err := mw.CreateFormFile("audio", "call.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(bytes.Repeat([]byte{0}, 64))
+
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return body, mw.FormDataContentType()
+}
@@ -0,0 +1,315 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	coldStorageBatch      = 100
+	coldStorageRetryAfter = 30 * time.Second
+
+	// the audio retrieved from the cold storage stays in the database for a
+	// while before being moved back
+	coldStorageRetrievedTtl = 24 * time.Hour
+)
+
+// ColdStorage moves the audio of the calls older than the coldStorageDays
+// option to a slower store, keeping their metadata in the database so they
+// are still listed and searched. The audio of those calls is retrieved on
+// demand by a background job, the listeners being told to try again soon.
+type ColdStorage struct {
+	Controller *Controller
+	Store      AudioStore
+}
+
+func NewColdStorage(controller *Controller) *ColdStorage {
+	coldStorage := &ColdStorage{Controller: controller}
+
+	if dir := controller.Config.ColdStorageDir; len(dir) > 0 {
+		if store, err := NewDirAudioStore(controller.Config.GetColdStorageDirPath()); err == nil {
+			coldStorage.Store = store
+			controller.Calls.ColdStore = store
+		} else {
+			log.Fatal(fmt.Errorf("cold storage: %v", err))
+		}
+	}
+
+	return coldStorage
+}
+
+func (coldStorage *ColdStorage) Enabled() bool {
+	return coldStorage.Store != nil
+}
+
+// Retrieve queues the retrieval of the audio of a call in the cold storage,
+// unless it is already queued.
+func (coldStorage *ColdStorage) Retrieve(call *Call) error {
+	jobs := coldStorage.Controller.Jobs
+
+	id, ok := call.Id.(uint)
+	if !ok {
+		return errors.New("coldstorage.retrieve: no call id")
+	}
+
+	if jobs.HasPendingFor(JobKindRetrieve, "call", id) {
+		return nil
+	}
+
+	if _, err := jobs.Enqueue(JobKindRetrieve, map[string]any{"call": id}, JobPriorityHigh); err != nil {
+		return fmt.Errorf("coldstorage.retrieve: %v", err)
+	}
+
+	coldStorage.Controller.Logs.LogEvent(LogLevelInfo, fmt.Sprintf("cold storage: retrieving the audio of call %d", id))
+
+	return nil
+}
+
+// ReplyRetrieving queues the retrieval of the call and tells the client to
+// try again soon.
+func (coldStorage *ColdStorage) ReplyRetrieving(w http.ResponseWriter, call *Call) {
+	if err := coldStorage.Retrieve(call); err != nil {
+		coldStorage.Controller.Logs.LogEvent(LogLevelError, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(map[string]any{
+		"id":         call.Id,
+		"retryAfter": coldStorageRetryAfter.Seconds(),
+		"status":     "retrieving",
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusExpectationFailed)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(int(coldStorageRetryAfter.Seconds())))
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(b)
+}
+
+// Audio reads the audio of a call in the cold storage, leaving it there.
+func (coldStorage *ColdStorage) Audio(id uint) ([]byte, error) {
+	var coldKey sql.NullString
+
+	if !coldStorage.Enabled() {
+		return nil, errors.New("coldstorage.audio: no cold storage configured")
+	}
+
+	if err := coldStorage.Controller.Database.Sql.QueryRow("select `coldKey` from `rdioScannerCalls` where `id` = ?", id).Scan(&coldKey); err != nil {
+		return nil, fmt.Errorf("coldstorage.audio: %v", err)
+	}
+
+	if !coldKey.Valid || len(coldKey.String) == 0 {
+		return nil, fmt.Errorf("coldstorage.audio: call %d has no cold storage key", id)
+	}
+
+	return coldStorage.Store.Get(coldKey.String)
+}
+
+// RetrieveJob moves the audio of a call back from the cold storage.
+func (coldStorage *ColdStorage) RetrieveJob(job *Job, cancel <-chan struct{}) error {
+	controller := coldStorage.Controller
+
+	id, ok := job.GetUint("call")
+	if !ok {
+		return errors.New("no call id")
+	}
+
+	if !coldStorage.Enabled() {
+		return errors.New("no cold storage configured")
+	}
+
+	return controller.Calls.WarmCall(id, coldStorage.Store, controller.Database)
+}
+
+// RunJob moves to the cold storage the audio of the calls past the
+// coldStorageDays option, by batches until none is left.
+func (coldStorage *ColdStorage) RunJob(job *Job, cancel <-chan struct{}) error {
+	var (
+		controller = coldStorage.Controller
+		count      int
+		days       = controller.Options.ColdStorageDays
+		err        error
+		id         uint
+		ids        []uint
+		rows       *sql.Rows
+	)
+
+	if !coldStorage.Enabled() || days == 0 {
+		return nil
+	}
+
+	formatError := func(err error) error {
+		return fmt.Errorf("coldstorage.run: %v", err)
+	}
+
+	before := time.Now().Add(-24 * time.Hour * time.Duration(days))
+	retrievedBefore := time.Now().Add(-coldStorageRetrievedTtl)
+
+	for {
+		select {
+		case <-cancel:
+			return nil
+		default:
+		}
+
+		where := SqlAnd(SqlWhere("`coldAt` is null"), SqlWhere("`dateTime` < ?", before), SqlOr(SqlWhere("`retrievedAt` is null"), SqlWhere("`retrievedAt` < ?", retrievedBefore)))
+
+		if rows, err = controller.Database.Select("rdioScannerCalls", "id").Where(where).OrderBy("id", false).Limit(coldStorageBatch).Query(); err != nil {
+			return formatError(err)
+		}
+
+		ids = []uint{}
+
+		for rows.Next() {
+			if err = rows.Scan(&id); err != nil {
+				break
+			}
+			ids = append(ids, id)
+		}
+
+		rows.Close()
+
+		if err != nil {
+			return formatError(err)
+		}
+
+		if len(ids) == 0 {
+			break
+		}
+
+		for _, id = range ids {
+			if err = controller.Calls.ColdCall(id, coldStorage.Store, controller.Database); err != nil {
+				return formatError(err)
+			}
+			count++
+		}
+	}
+
+	if count > 0 {
+		controller.Logs.LogEvent(LogLevelInfo, fmt.Sprintf("cold storage: audio of %d calls moved", count))
+	}
+
+	return nil
+}
+
+// ColdCall moves the audio of a call to the cold store, replacing the copy
+// left there by a previous retrieval.
+func (calls *Calls) ColdCall(id uint, store AudioStore, db *Database) error {
+	var (
+		audioKey    sql.NullString
+		contentType string
+		oldKey      sql.NullString
+	)
+
+	call, err := calls.GetCall(id, db)
+	if err != nil {
+		return err
+	}
+
+	calls.mutex.Lock()
+	defer calls.mutex.Unlock()
+
+	if err = db.Sql.QueryRow("select `audioKey`, `coldKey` from `rdioScannerCalls` where `id` = ?", id).Scan(&audioKey, &oldKey); err != nil {
+		return err
+	}
+
+	switch v := call.AudioType.(type) {
+	case string:
+		contentType = v
+	}
+
+	key := GetAudioKey(call)
+
+	if err = store.Put(key, call.Audio, contentType); err != nil {
+		return err
+	}
+
+	if _, err = db.Sql.Exec("update `rdioScannerCalls` set `audio` = ?, `audioKey` = null, `coldAt` = ?, `coldKey` = ? where `id` = ?", []byte{}, time.Now().UTC(), key, id); err != nil {
+		return err
+	}
+
+	if oldKey.Valid && len(oldKey.String) > 0 && oldKey.String != key {
+		if err = store.Delete(oldKey.String); err != nil {
+			return err
+		}
+	}
+
+	if audioKey.Valid && len(audioKey.String) > 0 && calls.AudioStore != nil {
+		if err = calls.AudioStore.Delete(audioKey.String); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WarmCall moves the audio of a call back from the cold store, where it is
+// kept for when the call is moved again.
+func (calls *Calls) WarmCall(id uint, store AudioStore, db *Database) error {
+	var (
+		coldAt  any
+		coldKey sql.NullString
+	)
+
+	if err := db.Sql.QueryRow("select `coldAt`, `coldKey` from `rdioScannerCalls` where `id` = ?", id).Scan(&coldAt, &coldKey); err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if coldAt == nil {
+		return nil
+	}
+
+	if !coldKey.Valid || len(coldKey.String) == 0 {
+		return fmt.Errorf("call %d has no cold storage key", id)
+	}
+
+	call, err := calls.GetCall(id, db)
+	if err != nil {
+		return err
+	}
+
+	if call.Audio, err = store.Get(coldKey.String); err != nil {
+		return err
+	}
+
+	if err = calls.WriteAudio(call, db); err != nil {
+		return err
+	}
+
+	calls.mutex.Lock()
+	defer calls.mutex.Unlock()
+
+	if _, err = db.Sql.Exec("update `rdioScannerCalls` set `coldAt` = null, `retrievedAt` = ? where `id` = ?", time.Now().UTC(), id); err != nil {
+		return err
+	}
+
+	return nil
+}
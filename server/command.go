@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -35,18 +36,24 @@ const (
 	COMMAND_ARG            = "cmd"
 	COMMAND_ARG_CODE       = "+code"
 	COMMAND_ARG_EXPIRATION = "+expiration"
+	COMMAND_ARG_FORMAT     = "+format"
 	COMMAND_ARG_IDENT      = "+ident"
 	COMMAND_ARG_IN         = "+in"
+	COMMAND_ARG_LABEL      = "+label"
 	COMMAND_ARG_LIMIT      = "+limit"
 	COMMAND_ARG_OUT        = "+out"
+	COMMAND_ARG_OVERWRITE  = "+overwrite"
 	COMMAND_ARG_PASSWORD   = "+password"
+	COMMAND_ARG_SYSTEM     = "+system"
 	COMMAND_ARG_SYSTEMS    = "+systems"
 	COMMAND_ARG_TOKEN      = "+token"
 	COMMAND_ARG_URL        = "+url"
 	COMMAND_ADMIN_PASSWORD = "admin-password"
 	COMMAND_CONFIG_GET     = "config-get"
 	COMMAND_CONFIG_SET     = "config-set"
+	COMMAND_EXPORT_TGS     = "export-talkgroups"
 	COMMAND_HELP           = "help"
+	COMMAND_IMPORT_TGS     = "import-talkgroups"
 	COMMAND_LOGIN          = "login"
 	COMMAND_LOGOUT         = "logout"
 	COMMAND_USER_ADD       = "user-add"
@@ -61,11 +68,15 @@ type Command struct {
 	code       string
 	command    string
 	expiration string
+	format     string
 	ident      string
 	in         string
+	label      string
 	limit      string
 	out        string
+	overwrite  bool
 	password   string
+	system     string
 	systems    string
 	token      string
 	tokenFile  string
@@ -110,24 +121,36 @@ func (command *Command) Do(action string) {
 		case COMMAND_ARG_EXPIRATION:
 			command.expiration = readVal()
 
+		case COMMAND_ARG_FORMAT:
+			command.format = readVal()
+
 		case COMMAND_ARG_IDENT:
 			command.ident = readVal()
 
 		case COMMAND_ARG_IN:
 			command.in = readVal()
 
+		case COMMAND_ARG_LABEL:
+			command.label = readVal()
+
 		case COMMAND_ARG_LIMIT:
 			command.limit = readVal()
 
 		case COMMAND_ARG_OUT:
 			command.out = readVal()
-			if !strings.HasSuffix(strings.ToLower(command.out), ".json") {
+			if action == COMMAND_CONFIG_GET && !strings.HasSuffix(strings.ToLower(command.out), ".json") {
 				command.out = command.out + ".json"
 			}
 
+		case COMMAND_ARG_OVERWRITE:
+			command.overwrite = true
+
 		case COMMAND_ARG_PASSWORD:
 			command.password = readVal()
 
+		case COMMAND_ARG_SYSTEM:
+			command.system = readVal()
+
 		case COMMAND_ARG_SYSTEMS:
 			command.systems = readVal()
 
@@ -160,6 +183,12 @@ func (command *Command) Do(action string) {
 	case COMMAND_CONFIG_SET:
 		command.configSet()
 
+	case COMMAND_EXPORT_TGS:
+		command.exportTalkgroups()
+
+	case COMMAND_IMPORT_TGS:
+		command.importTalkgroups()
+
 	case COMMAND_LOGIN:
 		command.login()
 
@@ -199,6 +228,16 @@ func (command *Command) printUsage() {
 	fmt.Printf("    %-11s %s%s -%s %s %s <file.json>\n\n", "", prompt, command.app, COMMAND_ARG, COMMAND_CONFIG_GET, COMMAND_ARG_OUT)
 	fmt.Printf("  %-11s – Set server's configuration.\n\n", COMMAND_CONFIG_SET)
 	fmt.Printf("    %-11s %s%s -%s %s %s <file.json>\n\n", "", prompt, command.app, COMMAND_ARG, COMMAND_CONFIG_SET, COMMAND_ARG_IN)
+	fmt.Printf("  %-11s – Export a system's talkgroups.\n\n", COMMAND_EXPORT_TGS)
+	fmt.Printf("    %-11s %s%s -%s %s %s <id> %s <file>\n\n", "", prompt, command.app, COMMAND_ARG, COMMAND_EXPORT_TGS, COMMAND_ARG_SYSTEM, COMMAND_ARG_OUT)
+	fmt.Printf("    %-11s Optional:\n\n", "")
+	fmt.Printf("      %-11s %-11s <format>              – One of %s (default), %s, %s.\n\n", "", COMMAND_ARG_FORMAT, FLEETMAP_TRUNK_RECORDER, FLEETMAP_RADIOREFERENCE, FLEETMAP_SDRTRUNK)
+	fmt.Printf("  %-11s – Import talkgroups into a system.\n\n", COMMAND_IMPORT_TGS)
+	fmt.Printf("    %-11s %s%s -%s %s %s <id> %s <file>\n\n", "", prompt, command.app, COMMAND_ARG, COMMAND_IMPORT_TGS, COMMAND_ARG_SYSTEM, COMMAND_ARG_IN)
+	fmt.Printf("    %-11s Optional:\n\n", "")
+	fmt.Printf("      %-11s %-11s <format>              – One of %s, %s, %s, guessed if omitted.\n", "", COMMAND_ARG_FORMAT, FLEETMAP_TRUNK_RECORDER, FLEETMAP_RADIOREFERENCE, FLEETMAP_SDRTRUNK)
+	fmt.Printf("      %-11s %-11s <label>               – Label of the system if it is created.\n", "", COMMAND_ARG_LABEL)
+	fmt.Printf("      %-11s %-11s                       – Update the existing talkgroups.\n\n", "", COMMAND_ARG_OVERWRITE)
 	fmt.Printf("  %-11s – Login to server.\n\n", COMMAND_LOGIN)
 	if runtime.GOOS != "windows" {
 		fmt.Printf("    %-11s $ RDIO_ADMIN_PASSWORD=<password> ./%s -%s %s\n", "", command.app, COMMAND_ARG, COMMAND_LOGIN)
@@ -299,6 +338,91 @@ func (command *Command) configSet() {
 	}
 }
 
+func (command *Command) exportTalkgroups() {
+	if command.system == "" {
+		command.exitWithError(fmt.Sprintf("Missing %s <id> arguments.", COMMAND_ARG_SYSTEM))
+	}
+	if command.out == "" {
+		command.exitWithError(fmt.Sprintf("Missing %s <file> arguments.", COMMAND_ARG_OUT))
+	}
+
+	q := url.Values{"system": {command.system}}
+	if command.format != "" {
+		q.Set("format", command.format)
+	}
+
+	if res, err := command.submit(http.MethodGet, "/api/admin/talkgroups/export?"+q.Encode(), nil, true); err == nil {
+		defer res.Body.Close()
+		if res.StatusCode == http.StatusOK {
+			if f, err := os.Create(command.out); err == nil {
+				defer f.Close()
+				if _, err := io.Copy(f, res.Body); err == nil {
+					fmt.Printf("System %s talkgroups saved to %s.\n", command.system, command.out)
+				} else {
+					command.exitWithError(err)
+				}
+			} else {
+				command.exitWithError(err)
+			}
+		} else {
+			command.exitWithError(errors.New(res.Status))
+		}
+	} else {
+		command.exitWithError(err)
+	}
+}
+
+func (command *Command) importTalkgroups() {
+	if command.system == "" {
+		command.exitWithError(fmt.Sprintf("Missing %s <id> arguments.", COMMAND_ARG_SYSTEM))
+	}
+	if command.in == "" {
+		command.exitWithError(fmt.Sprintf("Missing %s <file> arguments.", COMMAND_ARG_IN))
+	}
+
+	b, err := os.ReadFile(command.in)
+	if err != nil {
+		command.exitWithError(err)
+	}
+
+	q := url.Values{"system": {command.system}}
+	if command.format != "" {
+		q.Set("format", command.format)
+	}
+	if command.label != "" {
+		q.Set("label", command.label)
+	}
+	if command.overwrite {
+		q.Set("overwrite", "true")
+	}
+
+	contentType := "text/csv"
+	if GetFleetmapFormat(b) == FLEETMAP_SDRTRUNK {
+		contentType = "application/xml"
+	}
+
+	if res, err := command.send(http.MethodPost, "/api/admin/talkgroups/import?"+q.Encode(), bytes.NewReader(b), contentType, true); err == nil {
+		if res.StatusCode == http.StatusOK {
+			if data, err := command.readBody(res.Body); err == nil {
+				switch v := data.(type) {
+				case map[string]any:
+					imported, _ := v["imported"].([]any)
+					skipped, _ := v["skipped"].([]any)
+					fmt.Printf("%d talkgroups imported into system %s, %d existing talkgroups skipped.\n", len(imported), command.system, len(skipped))
+				default:
+					command.exitWithError(errors.New("invalid response"))
+				}
+			} else {
+				command.exitWithError(err)
+			}
+		} else {
+			command.exitWithError(errors.New(res.Status))
+		}
+	} else {
+		command.exitWithError(err)
+	}
+}
+
 func (command *Command) login() {
 	if body, err := command.writeBody(map[string]any{"password": command.password}); err == nil {
 		if res, err := command.submit(http.MethodPost, "/api/admin/login", body, false); err == nil {
@@ -446,6 +570,10 @@ func (c *Command) writeBody(data any) (body io.Reader, err error) {
 }
 
 func (c *Command) submit(method string, url string, body io.Reader, auth bool) (res *http.Response, err error) {
+	return c.send(method, url, body, "application/json", auth)
+}
+
+func (c *Command) send(method string, url string, body io.Reader, contentType string, auth bool) (res *http.Response, err error) {
 	var req *http.Request
 	u := strings.TrimSuffix(c.url, "/") + url
 	if req, err = http.NewRequest(method, u, body); err == nil {
@@ -457,7 +585,7 @@ func (c *Command) submit(method string, url string, body io.Reader, auth bool) (
 			}
 		}
 		if body != nil {
-			req.Header.Add("Content-Type", "application/json")
+			req.Header.Add("Content-Type", contentType)
 		}
 		res, err = http.DefaultClient.Do(req)
 	}
@@ -0,0 +1,614 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// complianceBatch is how many calls are deleted per query, to stay within
+// the bound parameters limit of the databases.
+const complianceBatch = 500
+
+var ErrRetentionProtected = errors.New("calls inside their minimum retention")
+
+// RetentionPolicy is the minimum and maximum retention of the calls of the
+// talkgroups of a tag, enforced in the retention compliance mode.
+type RetentionPolicy struct {
+	MaxDays uint
+	MinDays uint
+	Tag     string
+	Where   *SqlCondition
+}
+
+// DeletionCertificate attests a deletion of calls made in the retention
+// compliance mode: how many, the span of their timestamps, and the sha256
+// of their ids in ascending order, one per line. It is signed with the
+// ed25519 key of the server and carries the public key, so that it can be
+// verified away from the server.
+type DeletionCertificate struct {
+	Id        uint       `json:"_id"`
+	Count     int64      `json:"count"`
+	DateTime  time.Time  `json:"dateTime"`
+	Digest    string     `json:"digest"`
+	FirstCall *time.Time `json:"firstCall,omitempty"`
+	LastCall  *time.Time `json:"lastCall,omitempty"`
+	PublicKey string     `json:"publicKey"`
+	Reason    string     `json:"reason"`
+	Signature string     `json:"signature"`
+}
+
+// Payload is the signed text of the certificate.
+func (certificate *DeletionCertificate) Payload() []byte {
+	format := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+
+	return []byte(strings.Join([]string{
+		"rdio-scanner-deletion-certificate",
+		strconv.FormatInt(certificate.Count, 10),
+		certificate.DateTime.UTC().Format(time.RFC3339),
+		certificate.Digest,
+		format(certificate.FirstCall),
+		format(certificate.LastCall),
+		certificate.PublicKey,
+		certificate.Reason,
+	}, "\n"))
+}
+
+// Verify tells if the signature of the certificate matches its public key.
+func (certificate *DeletionCertificate) Verify() bool {
+	publicKey, err := hex.DecodeString(certificate.PublicKey)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return false
+	}
+
+	signature, err := hex.DecodeString(certificate.Signature)
+	if err != nil {
+		return false
+	}
+
+	return ed25519.Verify(publicKey, certificate.Payload(), signature)
+}
+
+// Compliance enforces the minimum and maximum retention of the talkgroup
+// categories when the retentionCompliance option is set, and certifies the
+// deletions of calls.
+type Compliance struct {
+	Controller *Controller
+
+	// mutex serializes the deletions, so that a certificate accounts for
+	// exactly the calls it lists
+	mutex sync.Mutex
+}
+
+func NewCompliance(controller *Controller) *Compliance {
+	return &Compliance{Controller: controller}
+}
+
+// Certificates returns the latest deletion certificates, or the one of the
+// id.
+func (compliance *Compliance) Certificates(id uint, limit uint) ([]*DeletionCertificate, error) {
+	var (
+		certificates = []*DeletionCertificate{}
+		db           = compliance.Controller.Database
+		err          error
+		rows         *sql.Rows
+	)
+
+	formatError := func(err error) error {
+		return fmt.Errorf("compliance.certificates: %v", err)
+	}
+
+	query := db.Select("rdioScannerDeletionCertificates", "_id", "count", "dateTime", "digest", "firstCall", "lastCall", "publicKey", "reason", "signature").OrderBy("_id", true).Limit(limit)
+	if id > 0 {
+		query = query.Where(SqlWhere("`_id` = ?", id))
+	}
+
+	if rows, err = query.Query(); err != nil {
+		return nil, formatError(err)
+	}
+
+	for rows.Next() {
+		var (
+			certificate = &DeletionCertificate{}
+			dateTime    any
+			firstCall   any
+			lastCall    any
+		)
+
+		if err = rows.Scan(&certificate.Id, &certificate.Count, &dateTime, &certificate.Digest, &firstCall, &lastCall, &certificate.PublicKey, &certificate.Reason, &certificate.Signature); err != nil {
+			break
+		}
+
+		if certificate.DateTime, err = db.ParseDateTime(dateTime); err != nil {
+			break
+		}
+
+		for _, f := range []struct {
+			dst **time.Time
+			src any
+		}{{&certificate.FirstCall, firstCall}, {&certificate.LastCall, lastCall}} {
+			if f.src == nil {
+				continue
+			}
+			t, err := db.ParseDateTime(f.src)
+			if err != nil {
+				continue
+			}
+			*f.dst = &t
+		}
+
+		certificates = append(certificates, certificate)
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return nil, formatError(err)
+	}
+
+	return certificates, nil
+}
+
+// Delete deletes the calls of the ids for author. In the retention
+// compliance mode, it fails with ErrRetentionProtected and the ids of the
+// calls still inside their minimum retention, deleting nothing, and
+// otherwise returns the certificate of the deletion.
+func (compliance *Compliance) Delete(ids []uint, author string) (*DeletionCertificate, []uint, error) {
+	var (
+		controller = compliance.Controller
+		db         = controller.Database
+		protected  = []uint{}
+		where      = SqlIn("id", ids)
+	)
+
+	formatError := func(err error) error {
+		return fmt.Errorf("compliance.delete: %v", err)
+	}
+
+	if !controller.Options.RetentionCompliance {
+		for i := 0; i < len(ids); i += complianceBatch {
+			if _, _, err := controller.Calls.PruneWhere(db, SqlIn("id", ids[i:minInt(i+complianceBatch, len(ids))])); err != nil {
+				return nil, nil, formatError(err)
+			}
+		}
+		return nil, nil, nil
+	}
+
+	now := time.Now()
+
+	compliance.mutex.Lock()
+	defer compliance.mutex.Unlock()
+
+	if guard := compliance.protected(now); guard != nil {
+		rows, err := db.Select("rdioScannerCalls", "id").Where(where, guard).OrderBy("id", false).Query()
+		if err != nil {
+			return nil, nil, formatError(err)
+		}
+
+		for rows.Next() {
+			var id uint
+			if err = rows.Scan(&id); err != nil {
+				break
+			}
+			protected = append(protected, id)
+		}
+
+		rows.Close()
+
+		if err != nil {
+			return nil, nil, formatError(err)
+		}
+
+		if len(protected) > 0 {
+			return nil, protected, ErrRetentionProtected
+		}
+	}
+
+	certificate, _, err := compliance.purge(where, fmt.Sprintf("deleted by %s", author), now)
+	if err != nil {
+		return nil, nil, formatError(err)
+	}
+
+	return certificate, nil, nil
+}
+
+// Policies returns the retention policies of the tags which have a minimum
+// or a maximum retention and talkgroups.
+func (compliance *Compliance) Policies() []*RetentionPolicy {
+	var (
+		controller = compliance.Controller
+		policies   = []*RetentionPolicy{}
+	)
+
+	controller.Tags.mutex.Lock()
+	tags := append([]*Tag{}, controller.Tags.List...)
+	controller.Tags.mutex.Unlock()
+
+	controller.Systems.mutex.Lock()
+	systems := append([]*System{}, controller.Systems.List...)
+	controller.Systems.mutex.Unlock()
+
+	for _, tag := range tags {
+		if tag.MinDays == 0 && tag.MaxDays == 0 {
+			continue
+		}
+
+		conditions := []*SqlCondition{}
+
+		for _, system := range systems {
+			talkgroups := []uint{}
+			system.Talkgroups.mutex.Lock()
+			for _, talkgroup := range system.Talkgroups.List {
+				if tag.Id == talkgroup.TagId {
+					talkgroups = append(talkgroups, talkgroup.Id)
+				}
+			}
+			system.Talkgroups.mutex.Unlock()
+			if len(talkgroups) > 0 {
+				conditions = append(conditions, SqlAnd(SqlWhere("`system` = ?", system.Id), SqlIn("talkgroup", talkgroups)))
+			}
+		}
+
+		if len(conditions) == 0 {
+			continue
+		}
+
+		policies = append(policies, &RetentionPolicy{
+			MaxDays: tag.MaxDays,
+			MinDays: tag.MinDays,
+			Tag:     tag.Label,
+			Where:   SqlOr(conditions...),
+		})
+	}
+
+	return policies
+}
+
+// Prune deletes the calls past their retention period, within the bounds
+// of the retention policies, and certifies each deletion.
+func (compliance *Compliance) Prune() (count int64, size int64, err error) {
+	var (
+		controller = compliance.Controller
+		now        = time.Now()
+	)
+
+	compliance.mutex.Lock()
+	defer compliance.mutex.Unlock()
+
+	for _, purge := range controller.Retentions.Purges(controller.Options.PruneDays, compliance.Policies(), now) {
+		certificate, s, err := compliance.purge(purge.Where, purge.Reason, now)
+		if err != nil {
+			return count, size, fmt.Errorf("compliance.prune: %v", err)
+		}
+		if certificate != nil {
+			count += certificate.Count
+			size += s
+		}
+	}
+
+	return count, size, nil
+}
+
+// PublicKey returns the hex encoded public key of the deletion certificates.
+func (compliance *Compliance) PublicKey() string {
+	return hex.EncodeToString(compliance.key().Public().(ed25519.PublicKey))
+}
+
+// key is the signing key of the certificates, derived from the secret of
+// the server so that it survives the restarts.
+func (compliance *Compliance) key() ed25519.PrivateKey {
+	seed := sha256.Sum256([]byte("rdio-scanner-deletion-certificate:" + compliance.Controller.Options.secret))
+	return ed25519.NewKeyFromSeed(seed[:])
+}
+
+// protected returns the condition on the calls inside the minimum retention
+// of their category, nil when there are none.
+func (compliance *Compliance) protected(now time.Time) *SqlCondition {
+	conditions := []*SqlCondition{}
+
+	for _, policy := range compliance.Policies() {
+		if policy.MinDays > 0 {
+			conditions = append(conditions, SqlAnd(policy.Where, SqlWhere("`dateTime` >= ?", now.Add(-24*time.Hour*time.Duration(policy.MinDays)))))
+		}
+	}
+
+	return SqlOr(conditions...)
+}
+
+// purge deletes the calls matching the condition and records the signed
+// certificate of the deletion, nil when there was nothing to delete. The
+// caller holds the mutex.
+func (compliance *Compliance) purge(where *SqlCondition, reason string, now time.Time) (*DeletionCertificate, int64, error) {
+	var (
+		controller  = compliance.Controller
+		db          = controller.Database
+		digest      = sha256.New()
+		ids         = []uint{}
+		certificate = &DeletionCertificate{DateTime: now.UTC().Truncate(time.Second), Reason: truncateRunes(reason, 255)}
+		size        int64
+	)
+
+	rows, err := db.Select("rdioScannerCalls", "id", "dateTime").Where(where).OrderBy("id", false).Query()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for rows.Next() {
+		var (
+			dateTime any
+			id       uint
+			t        time.Time
+		)
+
+		if err = rows.Scan(&id, &dateTime); err != nil {
+			break
+		}
+
+		if t, err = db.ParseDateTime(dateTime); err != nil {
+			break
+		}
+
+		t = t.UTC().Truncate(time.Second)
+		if certificate.FirstCall == nil || t.Before(*certificate.FirstCall) {
+			first := t
+			certificate.FirstCall = &first
+		}
+		if certificate.LastCall == nil || t.After(*certificate.LastCall) {
+			last := t
+			certificate.LastCall = &last
+		}
+
+		fmt.Fprintf(digest, "%d\n", id)
+		ids = append(ids, id)
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(ids) == 0 {
+		return nil, 0, nil
+	}
+
+	tx, err := db.Sql.Begin()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	keys := []*CallsPrunedKeys{}
+
+	for i := 0; i < len(ids); i += complianceBatch {
+		c, s, k, err := controller.Calls.PruneTx(tx, db, SqlIn("id", ids[i:minInt(i+complianceBatch, len(ids))]))
+		if err != nil {
+			tx.Rollback()
+			return nil, 0, err
+		}
+		certificate.Count += c
+		size += s
+		keys = append(keys, k)
+	}
+
+	certificate.Digest = hex.EncodeToString(digest.Sum(nil))
+	certificate.PublicKey = compliance.PublicKey()
+	certificate.Signature = hex.EncodeToString(ed25519.Sign(compliance.key(), certificate.Payload()))
+
+	if err = compliance.insertCertificate(tx, certificate); err != nil {
+		tx.Rollback()
+		return nil, 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, 0, err
+	}
+
+	for _, k := range keys {
+		if err = controller.Calls.PruneKeys(k); err != nil {
+			controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("compliance.purge: %v", err))
+		}
+	}
+
+	controller.Logs.LogEvent(LogLevelInfo, fmt.Sprintf("compliance: %d calls deleted, %s, certificate %s", certificate.Count, certificate.Reason, certificate.Digest[:12]))
+
+	return certificate, size, nil
+}
+
+// insertCertificate records the certificate within the transaction of the
+// deletion and sets its id.
+func (compliance *Compliance) insertCertificate(tx *sql.Tx, certificate *DeletionCertificate) error {
+	var (
+		args = []any{certificate.Count, certificate.DateTime, certificate.Digest, *certificate.FirstCall, *certificate.LastCall, certificate.PublicKey, certificate.Reason, certificate.Signature}
+		db   = compliance.Controller.Database
+		id   int64
+	)
+
+	query := "insert into `rdioScannerDeletionCertificates` (`count`, `dateTime`, `digest`, `firstCall`, `lastCall`, `publicKey`, `reason`, `signature`) values (?, ?, ?, ?, ?, ?, ?, ?)"
+
+	if db.Config.DbType == DbTypePostgres {
+		if err := tx.QueryRow(query+" returning `_id`", args...).Scan(&id); err != nil {
+			return err
+		}
+
+	} else {
+		res, err := tx.Exec(query, args...)
+		if err != nil {
+			return err
+		}
+
+		if id, err = res.LastInsertId(); err != nil {
+			return err
+		}
+	}
+
+	certificate.Id = uint(id)
+
+	return nil
+}
+
+// minInt returns the smaller of the two.
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// CallsDeleteHandler deletes the calls of a POST of {"ids": [...]}. In the
+// retention compliance mode, it answers 409 Conflict with the ids of the
+// calls inside their minimum retention, or the deletion certificate.
+func (admin *Admin) CallsDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		ids = []uint{}
+		m   = map[string]any{}
+	)
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !admin.Authorize(w, r, AdminRoleSuperadmin) {
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	switch v := m["ids"].(type) {
+	case []any:
+		for _, f := range v {
+			switch id := f.(type) {
+			case float64:
+				if id > 0 {
+					ids = append(ids, uint(id))
+				}
+			}
+		}
+	}
+
+	if len(ids) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	writeJson := func(status int, v any) {
+		if b, err := json.Marshal(v); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+	}
+
+	certificate, protected, err := admin.Controller.Compliance.Delete(ids, admin.author(r))
+	if err == ErrRetentionProtected {
+		admin.Controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("admin: deletion of %d call(s) by %s refused, %d inside their minimum retention", len(ids), admin.author(r), len(protected)))
+		writeJson(http.StatusConflict, map[string]any{"protected": protected})
+		return
+	} else if err != nil {
+		admin.Controller.Logs.LogEvent(LogLevelError, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	admin.Controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("admin: %d call(s) deleted by %s", len(ids), admin.author(r)))
+
+	writeJson(http.StatusOK, map[string]any{"certificate": certificate})
+}
+
+// DeletionCertificatesHandler lists the latest deletion certificates on
+// GET, or returns the one of ?id=, each with whether its signature is
+// valid, along with the public key of the server.
+func (admin *Admin) DeletionCertificatesHandler(w http.ResponseWriter, r *http.Request) {
+	const defaultLimit = 200
+
+	var (
+		id    uint
+		limit = uint(defaultLimit)
+		query = r.URL.Query()
+	)
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !admin.Authorize(w, r, adminWriteRole(r)) {
+		return
+	}
+
+	if s := query.Get("id"); len(s) > 0 {
+		i, err := strconv.ParseUint(s, 10, 32)
+		if err != nil || i == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		id = uint(i)
+	}
+
+	if i, err := strconv.Atoi(query.Get("limit")); err == nil && i > 0 {
+		limit = uint(i)
+	}
+
+	certificates, err := admin.Controller.Compliance.Certificates(id, limit)
+	if err != nil {
+		admin.Controller.Logs.LogEvent(LogLevelError, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if id > 0 && len(certificates) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	type verified struct {
+		*DeletionCertificate
+		Valid bool `json:"valid"`
+	}
+
+	list := []verified{}
+	for _, certificate := range certificates {
+		list = append(list, verified{certificate, certificate.Verify()})
+	}
+
+	if b, err := json.Marshal(map[string]any{"certificates": list, "publicKey": admin.Controller.Compliance.PublicKey()}); err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	} else {
+		w.WriteHeader(http.StatusExpectationFailed)
+	}
+}
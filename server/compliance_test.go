@@ -0,0 +1,289 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestCompliance returns a controller of which talkgroup 10 is tagged
+// Fire, kept 30 to 365 days, and talkgroup 20 is tagged Police, unbounded,
+// with a call of each age in days of ages.
+func newTestCompliance(t *testing.T, ages map[uint][]uint) (*Controller, map[uint]string) {
+	t.Helper()
+
+	controller := newTestController(t, nil)
+	controller.Options.PruneDays = 7
+	controller.Options.RetentionCompliance = true
+
+	controller.Tags.List = []*Tag{{Id: uint(1), Label: "Fire", MaxDays: 365, MinDays: 30}, {Id: uint(2), Label: "Police"}}
+
+	system := NewSystem()
+	system.Id = 1
+	system.Talkgroups.List = []*Talkgroup{{Id: 10, Label: "FD", TagId: 1}, {Id: 20, Label: "PD", TagId: 2}}
+	controller.Systems.List = append(controller.Systems.List, system)
+
+	names := map[uint]string{}
+
+	for talkgroup, days := range ages {
+		for _, d := range days {
+			id, err := controller.Calls.WriteCall(&Call{Audio: make([]byte, 8), DateTime: time.Now().Add(-24*time.Hour*time.Duration(d) - time.Hour), System: 1, Talkgroup: talkgroup}, controller.Database)
+			if err != nil {
+				t.Fatal(err)
+			}
+			names[id] = fmt.Sprintf("%s@%d", map[uint]string{10: "fd", 20: "pd"}[talkgroup], d)
+		}
+	}
+
+	return controller, names
+}
+
+// remaining returns the names of the calls left in the database.
+func remaining(t *testing.T, controller *Controller, names map[uint]string) []string {
+	t.Helper()
+
+	rows, err := controller.Database.Sql.Query("select `id` from `rdioScannerCalls`")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	left := []string{}
+	for rows.Next() {
+		var id uint
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		left = append(left, names[id])
+	}
+	sort.Strings(left)
+
+	return left
+}
+
+func TestCompliancePrune(t *testing.T) {
+	ages := map[uint][]uint{10: {10, 40, 400}, 20: {2, 10}}
+
+	tests := []struct {
+		name         string
+		compliance   bool
+		retentions   []*Retention
+		certificates int
+		want         []string
+	}{
+		{
+			name:         "prune days outside the minimum",
+			compliance:   true,
+			certificates: 1,
+			want:         []string{"fd@10", "pd@2"},
+		},
+		{
+			name:         "keep forever bounded by the maximum",
+			compliance:   true,
+			retentions:   []*Retention{{Days: 0, System: 1, Talkgroup: uint(10)}},
+			certificates: 2,
+			want:         []string{"fd@10", "fd@40", "pd@2"},
+		},
+		{
+			name:         "rule shorter than the minimum",
+			compliance:   true,
+			retentions:   []*Retention{{Days: 5, System: 1, Talkgroup: uint(10)}},
+			certificates: 2,
+			want:         []string{"fd@10", "pd@2"},
+		},
+		{
+			name:       "compliance off",
+			retentions: []*Retention{{Days: 5, System: 1, Talkgroup: uint(10)}, {Days: 0, System: 1}},
+			want:       []string{"pd@10", "pd@2"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			controller, names := newTestCompliance(t, ages)
+			controller.Options.RetentionCompliance = test.compliance
+			controller.Retentions.List = test.retentions
+
+			if err := controller.Scheduler.pruneDatabase(); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := remaining(t, controller, names); strings.Join(got, ",") != strings.Join(test.want, ",") {
+				t.Errorf("remaining %v, want %v", got, test.want)
+			}
+
+			certificates, err := controller.Compliance.Certificates(0, 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(certificates) != test.certificates {
+				t.Fatalf("%d certificates, want %d", len(certificates), test.certificates)
+			}
+
+			var count int64
+			for _, certificate := range certificates {
+				if !certificate.Verify() {
+					t.Errorf("certificate %+v does not verify", certificate)
+				}
+				if certificate.FirstCall == nil || certificate.LastCall == nil || certificate.LastCall.Before(*certificate.FirstCall) {
+					t.Errorf("certificate span %v to %v", certificate.FirstCall, certificate.LastCall)
+				}
+				count += certificate.Count
+			}
+			if test.compliance && int(count) != len(names)-len(test.want) {
+				t.Errorf("certified %d deletions, want %d", count, len(names)-len(test.want))
+			}
+		})
+	}
+}
+
+func TestCompliancePurgeRollback(t *testing.T) {
+	controller, names := newTestCompliance(t, map[uint][]uint{10: {10, 400}, 20: {2, 10}})
+	controller.Options.RetentionCompliance = true
+
+	if _, err := controller.Database.Sql.Exec("drop table `rdioScannerDeletionCertificates`"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := controller.Scheduler.pruneDatabase(); err == nil {
+		t.Fatal("pruned without recording the certificate")
+	}
+
+	if got := remaining(t, controller, names); len(got) != len(names) {
+		t.Errorf("remaining %v, want all of %d calls", got, len(names))
+	}
+}
+
+func TestDeletionCertificateVerify(t *testing.T) {
+	controller, _ := newTestCompliance(t, map[uint][]uint{20: {10}})
+
+	if err := controller.Scheduler.pruneDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	certificates, err := controller.Compliance.Certificates(0, 1)
+	if err != nil || len(certificates) != 1 {
+		t.Fatalf("certificates = %v, %v", certificates, err)
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(certificate *DeletionCertificate)
+		want   bool
+	}{
+		{"untouched", func(certificate *DeletionCertificate) {}, true},
+		{"count", func(certificate *DeletionCertificate) { certificate.Count++ }, false},
+		{"digest", func(certificate *DeletionCertificate) { certificate.Digest = strings.Repeat("0", 64) }, false},
+		{"reason", func(certificate *DeletionCertificate) { certificate.Reason = "nothing" }, false},
+		{"public key", func(certificate *DeletionCertificate) {
+			other, _ := newTestCompliance(t, nil)
+			other.Options.secret = "other"
+			certificate.PublicKey = other.Compliance.PublicKey()
+		}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			certificate := *certificates[0]
+			test.tamper(&certificate)
+
+			if got := certificate.Verify(); got != test.want {
+				t.Errorf("Verify() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCallsDeleteHandler(t *testing.T) {
+	controller, names := newTestCompliance(t, map[uint][]uint{10: {10, 40}, 20: {2}})
+
+	ids := map[string]uint{}
+	for id, name := range names {
+		ids[name] = id
+	}
+
+	token, err := controller.Admin.NewToken(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	editor, err := controller.Admin.NewOidcToken("someone", AdminRoleConfigEditor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := func(names ...string) string {
+		a := []uint{}
+		for _, name := range names {
+			a = append(a, ids[name])
+		}
+		b, _ := json.Marshal(map[string]any{"ids": a})
+		return string(b)
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		body   string
+		status int
+		want   []string
+	}{
+		{"no token", "", body("pd@2"), http.StatusUnauthorized, []string{"fd@10", "fd@40", "pd@2"}},
+		{"config editor", editor, body("pd@2"), http.StatusForbidden, []string{"fd@10", "fd@40", "pd@2"}},
+		{"no ids", token, `{"ids":[]}`, http.StatusBadRequest, []string{"fd@10", "fd@40", "pd@2"}},
+		{"inside the minimum", token, body("fd@10", "fd@40"), http.StatusConflict, []string{"fd@10", "fd@40", "pd@2"}},
+		{"outside the minimum", token, body("fd@40", "pd@2"), http.StatusOK, []string{"fd@10"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/admin/calls-delete", strings.NewReader(test.body))
+			if len(test.token) > 0 {
+				r.Header.Set("Authorization", test.token)
+			}
+
+			w := httptest.NewRecorder()
+			controller.Admin.CallsDeleteHandler(w, r)
+
+			if w.Code != test.status {
+				t.Errorf("status %d, want %d", w.Code, test.status)
+			}
+
+			if got := remaining(t, controller, names); strings.Join(got, ",") != strings.Join(test.want, ",") {
+				t.Errorf("remaining %v, want %v", got, test.want)
+			}
+
+			switch w.Code {
+			case http.StatusConflict:
+				var res struct{ Protected []uint }
+				if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || len(res.Protected) != 1 || res.Protected[0] != ids["fd@10"] {
+					t.Errorf("protected = %v, %v", res.Protected, err)
+				}
+			case http.StatusOK:
+				var res struct{ Certificate *DeletionCertificate }
+				if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || res.Certificate == nil || res.Certificate.Count != 2 || !res.Certificate.Verify() || !strings.HasPrefix(res.Certificate.Reason, "deleted by ") {
+					t.Errorf("certificate = %+v, %v", res.Certificate, err)
+				}
+			}
+		})
+	}
+}
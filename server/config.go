@@ -16,6 +16,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -23,19 +24,29 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 
 	"gopkg.in/ini.v1"
 )
 
 const (
-	DbTypeMariadb string = "mariadb"
-	DbTypeMysql   string = "mysql"
-	DbTypeSqlite  string = "sqlite"
+	DbTypeMariadb  string = "mariadb"
+	DbTypeMysql    string = "mysql"
+	DbTypePostgres string = "postgres"
+	DbTypeSqlite   string = "sqlite"
 )
 
 type Config struct {
+	ArchiveDir       string
+	ArchiveS3        bool
+	AudioStore       string
+	BackupDir        string
+	BackupS3         bool
 	BaseDir          string
+	BasePath         string
+	ColdStorageDir   string
 	ConfigFile       string
 	DbType           string
 	DbFile           string
@@ -44,15 +55,78 @@ type Config struct {
 	DbName           string
 	DbUsername       string
 	DbPassword       string
+	DbSlowQuery      uint
+	DbSslMode        string
+	DownstreamCert   string
+	DownstreamKey    string
+	EmbedBurst       uint
+	EmbedRate        uint
+	EnableMetrics    bool
+	ExportFile       string
+	ExportGzip       bool
+	ExportRotate     string
+	FfmpegWorkers    uint
+	HttpIdleTimeout  uint
+	HttpMaxHeader    uint
+	HttpReadTimeout  uint
+	HttpRoutes       string
+	HttpWriteTimeout uint
+	IngestMaxDelay   uint
+	IngestQueueLimit uint
+	IngestWorkers    uint
 	Listen           string
+	LoginBurst       uint
+	LoginLockout     uint
+	LoginLockoutMax  uint
+	LoginMaxFailures uint
+	LoginRate        uint
+	OidcAdminRoles   string
+	OidcAdmins       string
+	OidcClientId     string
+	OidcClientSecret string
+	OidcIssuer       string
+	OidcListeners    string
+	OidcOnly         bool
+	OidcPublicUrl    string
+	OidcSystems      string
+	OidcTiers        string
+	PushApnsKeyFile  string
+	PushApnsKeyId    string
+	PushApnsSandbox  bool
+	PushApnsTeamId   string
+	PushApnsTopic    string
+	PushFcmFile      string
+	PushVapidSubject string
+	ReplicationKey   string
+	S3AccessKey      string
+	S3Bucket         string
+	S3Endpoint       string
+	S3PathStyle      bool
+	S3Prefix         string
+	S3Region         string
+	S3SecretKey      string
+	SecretsKey       string
+	SentryDsn        string
 	SslAutoCert      string
 	SslCaCertFile    string
 	SslCaKeyFile     string
 	SslCertFile      string
+	SslClientCa      string
+	SslClientRequire bool
+	SslHsts          uint
 	SslKeyFile       string
 	SslListen        string
+	SslRedirect      bool
+	StandbyOf        string
+	TrustedProxies   string
+	TtsCommand       string
 	daemon           *Daemon
+	exportConfig     string
+	importConfig     string
+	migrateDb        *Config
 	newAdminPassword string
+	promote          bool
+	restore          string
 }
 
 func NewConfig() *Config {
@@ -63,13 +137,44 @@ func NewConfig() *Config {
 		defaultDbFile     = "rdio-scanner.db"
 		defaultDbHost     = "localhost"
 		defaultDbPort     = uint(3306)
+		defaultDbPostgres = uint(5432)
+		defaultDbSslMode  = "disable"
 		defaultListen     = ":3000"
+
+		defaultTrustedProxies = "127.0.0.1,::1"
+
+		defaultDbSlowQuery = uint(500)
+
+		defaultHttpIdleTimeout  = uint(120)
+		defaultHttpMaxHeader    = uint(1 << 20)
+		defaultHttpReadTimeout  = uint(30)
+		defaultHttpRoutes       = "/api/call-upload=300,/api/trunk-recorder-call-upload=300,/api/admin/export=0,/stream/=0"
+		defaultHttpWriteTimeout = uint(30)
+
+		defaultEmbedBurst = uint(20)
+		defaultEmbedRate  = uint(30)
+
+		defaultIngestMaxDelay   = uint(60)
+		defaultIngestQueueLimit = uint(1024)
+
+		defaultLoginBurst       = uint(5)
+		defaultLoginLockout     = uint(60)
+		defaultLoginLockoutMax  = uint(3600)
+		defaultLoginMaxFailures = uint(5)
+		defaultLoginRate        = uint(5)
 	)
 
 	var (
+		checkConfig   = flag.Bool("check-config", false, "validate the config file, the database connectivity and the ssl files, then exit non-zero on errors")
 		command       = flag.String(COMMAND_ARG, "", fmt.Sprintf("advanced administrative tasks (use -%s %s for usage)", COMMAND_ARG, COMMAND_HELP))
 		config        = &Config{}
 		configSave    = flag.Bool("config_save", false, fmt.Sprintf("save configuration to %s", defaultConfigFile))
+		encryptSecret = flag.String("encrypt_secret", "", "print the value encrypted with the secrets key, for the db_pass, oidc_client_secret, replication_key, s3_access_key, s3_secret_key and sentry_dsn settings, then exit")
+		exportConfig  = flag.String("export-config", "", "write the configuration bundle of the systems, talkgroups, groups, tags, access codes, api keys, downstreams and options to this file, then exit")
+		importConfig  = flag.String("import-config", "", "replace the configuration with the sections of this configuration bundle, then exit")
+		initConfig    = flag.Bool("init-config", false, "write a config file with every setting commented out at its default")
+		promote       = flag.Bool("promote", false, "turn the standby into a primary, which stops following the standby_of instance, then exit")
+		migrateDb     = flag.String("migrate-db", "", "copy the data of the database to the database of another config file, ie: a mysql or postgresql one, then exit, resuming where it stopped when run again")
 		serviceAction = flag.String("service", "", "service command, one of start, stop, restart, install, uninstall")
 		version       = flag.Bool("version", false, "show application version")
 	)
@@ -88,21 +193,87 @@ func NewConfig() *Config {
 		}
 	}
 
+	flag.StringVar(&config.ArchiveDir, "archive_dir", "", "directory where the audio archives asked by the admins are written, to be downloaded")
+	flag.BoolVar(&config.ArchiveS3, "archive_s3", false, "upload the audio archives to the s3 bucket when asked, under archives/")
+	flag.StringVar(&config.AudioStore, "audio_store", AudioStoreDatabase, fmt.Sprintf("where call audio is stored, one of %s, %s", AudioStoreDatabase, AudioStoreS3))
+	flag.StringVar(&config.BackupDir, "backup_dir", "", "directory where the database backups are written, on the schedule of the backup schedule option")
+	flag.BoolVar(&config.BackupS3, "backup_s3", false, "also upload the database backups to the s3 bucket, under backups/")
 	flag.StringVar(&config.BaseDir, "base_dir", config.BaseDir, "base directory where all data will be written")
+	flag.StringVar(&config.BasePath, "base_path", "", "url path the server is reached at behind a reverse proxy, ie: /scanner/")
+	flag.StringVar(&config.ColdStorageDir, "cold_storage_dir", "", "directory, ie: on a slow disk, where the audio of the calls older than the cold storage days option is moved")
 	flag.StringVar(&config.DbFile, "db_file", defaultDbFile, "sqlite database file")
 	flag.StringVar(&config.DbHost, "db_host", defaultDbHost, "database host ip or hostname")
 	flag.StringVar(&config.DbName, "db_name", "", "database name")
 	flag.StringVar(&config.DbPassword, "db_pass", "", "database password")
 	flag.UintVar(&config.DbPort, "db_port", defaultDbPort, "database host port")
-	flag.StringVar(&config.DbType, "db_type", defaultDbType, fmt.Sprintf("database type, one of %s, %s, %s", DbTypeSqlite, DbTypeMariadb, DbTypeMysql))
+	flag.UintVar(&config.DbSlowQuery, "db_slow_query", defaultDbSlowQuery, "milliseconds a database query must take to be reported by the index advisor, 0 to disable")
+	flag.StringVar(&config.DbSslMode, "db_sslmode", defaultDbSslMode, "postgresql ssl mode, one of disable, require, verify-ca, verify-full")
+	flag.StringVar(&config.DbType, "db_type", defaultDbType, fmt.Sprintf("database type, one of %s, %s, %s, %s", DbTypeSqlite, DbTypeMariadb, DbTypeMysql, DbTypePostgres))
 	flag.StringVar(&config.DbUsername, "db_user", "", "database user name")
+	flag.StringVar(&config.DownstreamCert, "downstream_cert_file", "", "ssl PEM formated client certificate presented to the downstream instances")
+	flag.StringVar(&config.DownstreamKey, "downstream_key_file", "", "ssl PEM formated key of the client certificate presented to the downstream instances")
 	flag.StringVar(&config.ConfigFile, "config", defaultConfigFile, "server config file")
+	flag.UintVar(&config.EmbedBurst, "embed_burst", defaultEmbedBurst, "requests to the embedded players an ip address can make in a row before being throttled")
+	flag.UintVar(&config.EmbedRate, "embed_rate", defaultEmbedRate, "requests to the embedded players per minute refilled for each ip address")
+	flag.BoolVar(&config.EnableMetrics, "enable_metrics", false, "expose prometheus metrics on /metrics")
+	flag.StringVar(&config.ExportFile, "export_file", "", "append the metadata of every ingested call as ndjson to this file")
+	flag.BoolVar(&config.ExportGzip, "export_gzip", false, "gzip rotated export files")
+	flag.UintVar(&config.FfmpegWorkers, "ffmpeg_workers", 0, "ffmpeg processes run at once for the audio conversions, 0 for one per cpu")
+	flag.StringVar(&config.ExportRotate, "export_rotate", "", fmt.Sprintf("rotate the export file, one of %s, %s", ExportRotateDaily, ExportRotateHourly))
+	flag.UintVar(&config.HttpIdleTimeout, "http_idle_timeout", defaultHttpIdleTimeout, "seconds an idle keep-alive connection is kept open")
+	flag.UintVar(&config.HttpMaxHeader, "http_max_header", defaultHttpMaxHeader, "maximum size in bytes of the request headers")
+	flag.UintVar(&config.HttpReadTimeout, "http_read_timeout", defaultHttpReadTimeout, "seconds allowed to read a whole request, body included")
+	flag.StringVar(&config.HttpRoutes, "http_routes", defaultHttpRoutes, "comma separated path=seconds pairs overriding the read and write timeouts of the paths starting with path, 0 for no timeout")
+	flag.UintVar(&config.HttpWriteTimeout, "http_write_timeout", defaultHttpWriteTimeout, "seconds allowed to write a response")
+	flag.UintVar(&config.IngestMaxDelay, "ingest_max_delay", defaultIngestMaxDelay, "seconds the queued calls may take to be ingested before uploads are refused with a 503, 0 to disable")
+	flag.UintVar(&config.IngestQueueLimit, "ingest_queue_limit", defaultIngestQueueLimit, "queued calls above which uploads are refused with a 503, 0 for the capacity of the queue")
+	flag.UintVar(&config.IngestWorkers, "ingest_workers", 0, "calls of different talkgroups ingested at once, 0 for one per cpu")
 	flag.StringVar(&config.Listen, "listen", defaultListen, "listening address")
+	flag.UintVar(&config.LoginBurst, "login_burst", defaultLoginBurst, "login attempts an ip address can make in a row before being throttled")
+	flag.UintVar(&config.LoginLockout, "login_lockout", defaultLoginLockout, "seconds an ip address is locked out after too many failed logins, doubled on every new lockout")
+	flag.UintVar(&config.LoginLockoutMax, "login_lockout_max", defaultLoginLockoutMax, "maximum lockout in seconds")
+	flag.UintVar(&config.LoginMaxFailures, "login_max_failures", defaultLoginMaxFailures, "consecutive failed logins before an ip address is locked out, 0 to disable lockouts")
+	flag.UintVar(&config.LoginRate, "login_rate", defaultLoginRate, "login attempts per minute refilled for each ip address")
 	flag.StringVar(&config.newAdminPassword, "admin_password", "", "change admin password")
+	flag.StringVar(&config.OidcAdminRoles, "oidc_admin_roles", "", "comma separated match=role pairs mapping emails, @domains or groups to the roles of the openid connect admins, first match wins, the others being viewers, ie: it=superadmin,dispatch=config-editor")
+	flag.StringVar(&config.OidcAdmins, "oidc_admins", "", "comma separated emails, @domains or groups allowed to administer through openid connect")
+	flag.StringVar(&config.OidcClientId, "oidc_client_id", "", "openid connect client id")
+	flag.StringVar(&config.OidcClientSecret, "oidc_client_secret", "", "openid connect client secret")
+	flag.StringVar(&config.OidcIssuer, "oidc_issuer", "", "openid connect issuer url, ie: https://keycloak.example.com/realms/scanner")
+	flag.StringVar(&config.OidcListeners, "oidc_listeners", "", "comma separated emails, @domains or groups allowed to listen through openid connect, * for any authenticated user")
+	flag.BoolVar(&config.OidcOnly, "oidc_only", false, "disable the admin password and access codes, openid connect only")
+	flag.StringVar(&config.OidcPublicUrl, "oidc_public_url", "", "public url of this server used for the openid connect redirect, ie: https://scanner.example.com")
+	flag.StringVar(&config.OidcSystems, "oidc_systems", "", "comma separated match=systems pairs mapping emails, @domains or groups to the systems the openid connect listeners get, 1+2 for whole systems or 1:100/101 for some talkgroups, the matches adding up, ie: fire=1+2:300,police=2")
+	flag.StringVar(&config.OidcTiers, "oidc_tiers", "", "comma separated match=tier pairs mapping emails, @domains or groups to listener tiers, first match wins, ie: dispatch=dispatcher,@example.com=member")
+	flag.StringVar(&config.PushApnsKeyFile, "push_apns_key_file", "", "apple push notification service .p8 authentication key file")
+	flag.StringVar(&config.PushApnsKeyId, "push_apns_key_id", "", "apple push notification service key id")
+	flag.BoolVar(&config.PushApnsSandbox, "push_apns_sandbox", false, "use the apple push notification service sandbox")
+	flag.StringVar(&config.PushApnsTeamId, "push_apns_team_id", "", "apple developer team id")
+	flag.StringVar(&config.PushApnsTopic, "push_apns_topic", "", "bundle id of the ios app receiving the notifications")
+	flag.StringVar(&config.PushFcmFile, "push_fcm_file", "", "firebase cloud messaging service account json file")
+	flag.StringVar(&config.PushVapidSubject, "push_vapid_subject", "", "contact sent to the web push services, ie: mailto:admin@example.com")
+	flag.StringVar(&config.ReplicationKey, "replication_key", "", "shared key of the replication of the calls and of the configuration of a primary to its standby, of at least 32 characters, set on both")
+	flag.StringVar(&config.restore, "restore", "", "restore the database from a backup file, or a backup name of the backup directory or the s3 bucket, then exit")
+	flag.StringVar(&config.S3AccessKey, "s3_access_key", "", "s3 access key id")
+	flag.StringVar(&config.S3Bucket, "s3_bucket", "", "s3 bucket name")
+	flag.StringVar(&config.S3Endpoint, "s3_endpoint", "", "s3 endpoint url, ie: https://s3.amazonaws.com or http://minio:9000")
+	flag.BoolVar(&config.S3PathStyle, "s3_path_style", false, "use path style s3 urls, required by most minio setups")
+	flag.StringVar(&config.S3Prefix, "s3_prefix", "", "s3 key prefix for call audio")
+	flag.StringVar(&config.S3Region, "s3_region", "", "s3 region")
+	flag.StringVar(&config.S3SecretKey, "s3_secret_key", "", "s3 secret access key")
+	flag.StringVar(&config.SecretsKey, "secrets_key", "", "master key encrypting the credentials stored in the database, ie: ${file:/etc/rdio-scanner/secrets.key}, ${env:RDIO_SECRETS_KEY} or ${command:...} to get it from a key management service")
+	flag.StringVar(&config.SentryDsn, "sentry_dsn", "", "sentry dsn the panics recovered by the server are reported to, ie: https://key@o1.ingest.sentry.io/42")
 	flag.StringVar(&config.SslAutoCert, "ssl_auto_cert", "", "domain name for Let's Encrypt automatic certificate")
 	flag.StringVar(&config.SslCertFile, "ssl_cert_file", "", "ssl PEM formated certificate")
+	flag.StringVar(&config.SslClientCa, "ssl_client_ca_file", "", "ssl PEM formated certificate authorities verifying the client certificates which stand for the API keys of the uploads")
+	flag.BoolVar(&config.SslClientRequire, "ssl_client_cert_required", false, "refuse the call uploads without a verified client certificate matching an API key")
+	flag.UintVar(&config.SslHsts, "ssl_hsts", 0, "seconds the browsers are told to only reach the server over https through the Strict-Transport-Security header, 0 to disable")
 	flag.StringVar(&config.SslKeyFile, "ssl_key_file", "", "ssl PEM formated key")
 	flag.StringVar(&config.SslListen, "ssl_listen", "", "listening address for ssl")
+	flag.BoolVar(&config.SslRedirect, "ssl_redirect", false, "redirect the requests of the listening address to the ssl listening address, the Let's Encrypt challenges excepted")
+	flag.StringVar(&config.StandbyOf, "standby_of", "", "url of the primary instance this standby replicates the calls and the configuration of, ie: https://primary.example.com")
+	flag.StringVar(&config.TrustedProxies, "trusted_proxies", defaultTrustedProxies, "comma separated ip addresses and cidr ranges of the reverse proxies whose X-Forwarded-For, X-Forwarded-Host and X-Forwarded-Proto headers are honored, ie: 127.0.0.1,10.0.0.0/8")
+	flag.StringVar(&config.TtsCommand, "tts_command", "", "text to speech command speaking the talkgroups of the audio cues, reading the text on stdin and writing a wav file on stdout, ie: espeak-ng --stdout")
 	flag.Parse()
 
 	if !config.isBaseDirWritable() {
@@ -119,65 +290,91 @@ func NewConfig() *Config {
 			os.Exit(-1)
 		}
 
+	case *initConfig:
+		if err := config.initConfig(); err == nil {
+			fmt.Printf("%s file created\n", config.GetConfigFilePath())
+			os.Exit(0)
+		} else {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
 	case *version:
 		fmt.Println(Version)
 		os.Exit(0)
+	}
 
-	default:
-		if cfg, err := ini.Load(config.GetConfigFilePath()); err == nil {
-			if v := cfg.Section("").Key("db_file").String(); len(v) > 0 {
-				config.DbFile = v
-			}
+	config.loadFile()
 
-			if v := cfg.Section("").Key("db_host").String(); len(v) > 0 {
-				config.DbHost = v
-			}
+	// the default port is the one of mysql
+	if config.DbType == DbTypePostgres && config.DbPort == defaultDbPort {
+		config.DbPort = defaultDbPostgres
+	}
 
-			if v := cfg.Section("").Key("db_name").String(); len(v) > 0 {
-				config.DbName = v
-			}
+	if err := config.resolveSecrets(); err != nil {
+		log.Fatalf("config: %v", err)
+	}
 
-			if v := cfg.Section("").Key("db_pass").String(); len(v) > 0 {
-				config.DbPassword = v
-			}
+	if len(*encryptSecret) > 0 {
+		key := secretsMasterKey(config.SecretsKey)
+		if key == nil {
+			log.Fatal("encrypt_secret: the secrets_key setting is required")
+		}
 
-			if config.DbPort, err = cfg.Section("").Key("db_port").Uint(); err != nil {
-				config.DbPort = defaultDbPort
-			}
+		s, err := secretsSeal(key, *encryptSecret)
+		if err != nil {
+			log.Fatalf("encrypt_secret: %v", err)
+		}
 
-			if v := cfg.Section("").Key("db_type").String(); len(v) > 0 {
-				config.DbType = v
-			}
+		fmt.Println(s)
+		os.Exit(0)
+	}
 
-			if v := cfg.Section("").Key("db_user").String(); len(v) > 0 {
-				config.DbUsername = v
-			}
+	config.exportConfig = *exportConfig
+	config.importConfig = *importConfig
+	config.promote = *promote
 
-			if v := cfg.Section("").Key("listen").String(); len(v) > 0 {
-				config.Listen = v
-			}
+	if len(*migrateDb) > 0 {
+		target := &Config{
+			BaseDir:    config.BaseDir,
+			ConfigFile: *migrateDb,
+			DbFile:     defaultDbFile,
+			DbHost:     defaultDbHost,
+			DbPort:     defaultDbPort,
+			DbSslMode:  defaultDbSslMode,
+			DbType:     defaultDbType,
+		}
 
-			if v := cfg.Section("").Key("ssl_auto_cert").String(); len(v) > 0 {
-				config.SslAutoCert = v
-			}
+		if err := target.loadFile(); err != nil {
+			log.Fatalf("migrate-db: %v", err)
+		}
 
-			if v := cfg.Section("").Key("ssl_cert_file").String(); len(v) > 0 {
-				config.SslCertFile = v
-			}
+		if target.DbType == DbTypePostgres && target.DbPort == defaultDbPort {
+			target.DbPort = defaultDbPostgres
+		}
 
-			if v := cfg.Section("").Key("ssl_key_file").String(); len(v) > 0 {
-				config.SslKeyFile = v
-			}
+		if err := target.resolveSecrets(); err != nil {
+			log.Fatalf("migrate-db: %v", err)
+		}
 
-			if v := cfg.Section("").Key("ssl_listen").String(); len(v) > 0 {
-				config.SslListen = v
+		config.migrateDb = target
+	}
+
+	if *checkConfig {
+		if problems := config.checkConfig(); len(problems) > 0 {
+			for _, problem := range problems {
+				fmt.Println(problem)
 			}
+			os.Exit(1)
 		}
 
-		if !(config.DbType == DbTypeMariadb || config.DbType == DbTypeMysql || config.DbType == DbTypeSqlite) {
-			fmt.Printf("unknown database type %s\n", config.DbType)
-			return nil
-		}
+		fmt.Printf("%s: ok\n", config.GetConfigFilePath())
+		os.Exit(0)
+	}
+
+	if !(config.DbType == DbTypeMariadb || config.DbType == DbTypeMysql || config.DbType == DbTypePostgres || config.DbType == DbTypeSqlite) {
+		fmt.Printf("unknown database type %s\n", config.DbType)
+		return nil
 	}
 
 	if *command != "" {
@@ -191,6 +388,466 @@ func NewConfig() *Config {
 	return config
 }
 
+// loadFile overrides the settings with those of the config file.
+func (config *Config) loadFile() error {
+	cfg, err := ini.Load(config.GetConfigFilePath())
+	if err != nil {
+		return err
+	}
+
+	if v := cfg.Section("").Key("archive_dir").String(); len(v) > 0 {
+		config.ArchiveDir = v
+	}
+
+	if v, err := cfg.Section("").Key("archive_s3").Bool(); err == nil && v {
+		config.ArchiveS3 = v
+	}
+
+	if v := cfg.Section("").Key("audio_store").String(); len(v) > 0 {
+		config.AudioStore = v
+	}
+
+	if v := cfg.Section("").Key("backup_dir").String(); len(v) > 0 {
+		config.BackupDir = v
+	}
+
+	if v, err := cfg.Section("").Key("backup_s3").Bool(); err == nil && v {
+		config.BackupS3 = v
+	}
+
+	if v := cfg.Section("").Key("base_path").String(); len(v) > 0 {
+		config.BasePath = v
+	}
+
+	if v := cfg.Section("").Key("cold_storage_dir").String(); len(v) > 0 {
+		config.ColdStorageDir = v
+	}
+
+	if v := cfg.Section("").Key("db_file").String(); len(v) > 0 {
+		config.DbFile = v
+	}
+
+	if v := cfg.Section("").Key("db_host").String(); len(v) > 0 {
+		config.DbHost = v
+	}
+
+	if v := cfg.Section("").Key("db_name").String(); len(v) > 0 {
+		config.DbName = v
+	}
+
+	if v := cfg.Section("").Key("db_pass").String(); len(v) > 0 {
+		config.DbPassword = v
+	}
+
+	if v, err := cfg.Section("").Key("db_port").Uint(); err == nil {
+		config.DbPort = v
+	}
+
+	if v, err := cfg.Section("").Key("db_slow_query").Uint(); err == nil {
+		config.DbSlowQuery = v
+	}
+
+	if v := cfg.Section("").Key("db_sslmode").String(); len(v) > 0 {
+		config.DbSslMode = v
+	}
+
+	if v := cfg.Section("").Key("db_type").String(); len(v) > 0 {
+		config.DbType = v
+	}
+
+	if v := cfg.Section("").Key("db_user").String(); len(v) > 0 {
+		config.DbUsername = v
+	}
+
+	if v := cfg.Section("").Key("downstream_cert_file").String(); len(v) > 0 {
+		config.DownstreamCert = v
+	}
+
+	if v := cfg.Section("").Key("downstream_key_file").String(); len(v) > 0 {
+		config.DownstreamKey = v
+	}
+
+	if v, err := cfg.Section("").Key("embed_burst").Uint(); err == nil {
+		config.EmbedBurst = v
+	}
+
+	if v, err := cfg.Section("").Key("embed_rate").Uint(); err == nil {
+		config.EmbedRate = v
+	}
+
+	if v, err := cfg.Section("").Key("enable_metrics").Bool(); err == nil && v {
+		config.EnableMetrics = v
+	}
+
+	if v := cfg.Section("").Key("export_file").String(); len(v) > 0 {
+		config.ExportFile = v
+	}
+
+	if v, err := cfg.Section("").Key("export_gzip").Bool(); err == nil && v {
+		config.ExportGzip = v
+	}
+
+	if v := cfg.Section("").Key("export_rotate").String(); len(v) > 0 {
+		config.ExportRotate = v
+	}
+
+	if v, err := cfg.Section("").Key("ffmpeg_workers").Uint(); err == nil {
+		config.FfmpegWorkers = v
+	}
+
+	if v, err := cfg.Section("").Key("http_idle_timeout").Uint(); err == nil {
+		config.HttpIdleTimeout = v
+	}
+
+	if v, err := cfg.Section("").Key("http_max_header").Uint(); err == nil && v > 0 {
+		config.HttpMaxHeader = v
+	}
+
+	if v, err := cfg.Section("").Key("http_read_timeout").Uint(); err == nil {
+		config.HttpReadTimeout = v
+	}
+
+	if cfg.Section("").HasKey("http_routes") {
+		config.HttpRoutes = cfg.Section("").Key("http_routes").String()
+	}
+
+	if v, err := cfg.Section("").Key("http_write_timeout").Uint(); err == nil {
+		config.HttpWriteTimeout = v
+	}
+
+	if v, err := cfg.Section("").Key("ingest_max_delay").Uint(); err == nil {
+		config.IngestMaxDelay = v
+	}
+
+	if v, err := cfg.Section("").Key("ingest_queue_limit").Uint(); err == nil {
+		config.IngestQueueLimit = v
+	}
+
+	if v, err := cfg.Section("").Key("ingest_workers").Uint(); err == nil {
+		config.IngestWorkers = v
+	}
+
+	if v := cfg.Section("").Key("listen").String(); len(v) > 0 {
+		config.Listen = v
+	}
+
+	if v, err := cfg.Section("").Key("login_burst").Uint(); err == nil {
+		config.LoginBurst = v
+	}
+
+	if v, err := cfg.Section("").Key("login_lockout").Uint(); err == nil {
+		config.LoginLockout = v
+	}
+
+	if v, err := cfg.Section("").Key("login_lockout_max").Uint(); err == nil {
+		config.LoginLockoutMax = v
+	}
+
+	if v, err := cfg.Section("").Key("login_max_failures").Uint(); err == nil {
+		config.LoginMaxFailures = v
+	}
+
+	if v, err := cfg.Section("").Key("login_rate").Uint(); err == nil {
+		config.LoginRate = v
+	}
+
+	if v := cfg.Section("").Key("oidc_admin_roles").String(); len(v) > 0 {
+		config.OidcAdminRoles = v
+	}
+
+	if v := cfg.Section("").Key("oidc_admins").String(); len(v) > 0 {
+		config.OidcAdmins = v
+	}
+
+	if v := cfg.Section("").Key("oidc_client_id").String(); len(v) > 0 {
+		config.OidcClientId = v
+	}
+
+	if v := cfg.Section("").Key("oidc_client_secret").String(); len(v) > 0 {
+		config.OidcClientSecret = v
+	}
+
+	if v := cfg.Section("").Key("oidc_issuer").String(); len(v) > 0 {
+		config.OidcIssuer = v
+	}
+
+	if v := cfg.Section("").Key("oidc_listeners").String(); len(v) > 0 {
+		config.OidcListeners = v
+	}
+
+	if v, err := cfg.Section("").Key("oidc_only").Bool(); err == nil && v {
+		config.OidcOnly = v
+	}
+
+	if v := cfg.Section("").Key("oidc_public_url").String(); len(v) > 0 {
+		config.OidcPublicUrl = v
+	}
+
+	if v := cfg.Section("").Key("oidc_systems").String(); len(v) > 0 {
+		config.OidcSystems = v
+	}
+
+	if v := cfg.Section("").Key("oidc_tiers").String(); len(v) > 0 {
+		config.OidcTiers = v
+	}
+
+	if v := cfg.Section("").Key("push_apns_key_file").String(); len(v) > 0 {
+		config.PushApnsKeyFile = v
+	}
+
+	if v := cfg.Section("").Key("push_apns_key_id").String(); len(v) > 0 {
+		config.PushApnsKeyId = v
+	}
+
+	if v, err := cfg.Section("").Key("push_apns_sandbox").Bool(); err == nil && v {
+		config.PushApnsSandbox = v
+	}
+
+	if v := cfg.Section("").Key("push_apns_team_id").String(); len(v) > 0 {
+		config.PushApnsTeamId = v
+	}
+
+	if v := cfg.Section("").Key("push_apns_topic").String(); len(v) > 0 {
+		config.PushApnsTopic = v
+	}
+
+	if v := cfg.Section("").Key("push_fcm_file").String(); len(v) > 0 {
+		config.PushFcmFile = v
+	}
+
+	if v := cfg.Section("").Key("push_vapid_subject").String(); len(v) > 0 {
+		config.PushVapidSubject = v
+	}
+
+	if v := cfg.Section("").Key("replication_key").String(); len(v) > 0 {
+		config.ReplicationKey = v
+	}
+
+	if v := cfg.Section("").Key("s3_access_key").String(); len(v) > 0 {
+		config.S3AccessKey = v
+	}
+
+	if v := cfg.Section("").Key("s3_bucket").String(); len(v) > 0 {
+		config.S3Bucket = v
+	}
+
+	if v := cfg.Section("").Key("s3_endpoint").String(); len(v) > 0 {
+		config.S3Endpoint = v
+	}
+
+	if v, err := cfg.Section("").Key("s3_path_style").Bool(); err == nil && v {
+		config.S3PathStyle = v
+	}
+
+	if v := cfg.Section("").Key("s3_prefix").String(); len(v) > 0 {
+		config.S3Prefix = v
+	}
+
+	if v := cfg.Section("").Key("s3_region").String(); len(v) > 0 {
+		config.S3Region = v
+	}
+
+	if v := cfg.Section("").Key("s3_secret_key").String(); len(v) > 0 {
+		config.S3SecretKey = v
+	}
+
+	if v := cfg.Section("").Key("secrets_key").String(); len(v) > 0 {
+		config.SecretsKey = v
+	}
+
+	if v := cfg.Section("").Key("sentry_dsn").String(); len(v) > 0 {
+		config.SentryDsn = v
+	}
+
+	if v := cfg.Section("").Key("ssl_auto_cert").String(); len(v) > 0 {
+		config.SslAutoCert = v
+	}
+
+	if v := cfg.Section("").Key("ssl_cert_file").String(); len(v) > 0 {
+		config.SslCertFile = v
+	}
+
+	if v := cfg.Section("").Key("ssl_client_ca_file").String(); len(v) > 0 {
+		config.SslClientCa = v
+	}
+
+	if v, err := cfg.Section("").Key("ssl_client_cert_required").Bool(); err == nil && v {
+		config.SslClientRequire = v
+	}
+
+	if v, err := cfg.Section("").Key("ssl_hsts").Uint(); err == nil {
+		config.SslHsts = v
+	}
+
+	if v := cfg.Section("").Key("ssl_key_file").String(); len(v) > 0 {
+		config.SslKeyFile = v
+	}
+
+	if v := cfg.Section("").Key("ssl_listen").String(); len(v) > 0 {
+		config.SslListen = v
+	}
+
+	if v, err := cfg.Section("").Key("ssl_redirect").Bool(); err == nil && v {
+		config.SslRedirect = v
+	}
+
+	if v := cfg.Section("").Key("standby_of").String(); len(v) > 0 {
+		config.StandbyOf = v
+	}
+
+	if cfg.Section("").HasKey("trusted_proxies") {
+		config.TrustedProxies = cfg.Section("").Key("trusted_proxies").String()
+	}
+
+	if v := cfg.Section("").Key("tts_command").String(); len(v) > 0 {
+		config.TtsCommand = v
+	}
+
+	return nil
+}
+
+// Reload reads the config file again and applies the settings that can be
+// changed while running. It returns the changed settings that will only be
+// applied on the next restart.
+func (config *Config) Reload() ([]string, error) {
+	next := *config
+
+	if err := next.loadFile(); errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := next.resolveSecrets(); err != nil {
+		return nil, err
+	}
+
+	config.ArchiveDir = next.ArchiveDir
+	config.ArchiveS3 = next.ArchiveS3
+	config.BackupDir = next.BackupDir
+	config.BackupS3 = next.BackupS3
+	config.DbSlowQuery = next.DbSlowQuery
+	config.EmbedBurst = next.EmbedBurst
+	config.EmbedRate = next.EmbedRate
+	config.IngestMaxDelay = next.IngestMaxDelay
+	config.IngestQueueLimit = next.IngestQueueLimit
+	config.LoginBurst = next.LoginBurst
+	config.LoginLockout = next.LoginLockout
+	config.LoginLockoutMax = next.LoginLockoutMax
+	config.LoginMaxFailures = next.LoginMaxFailures
+	config.LoginRate = next.LoginRate
+	config.OidcAdminRoles = next.OidcAdminRoles
+	config.OidcAdmins = next.OidcAdmins
+	config.OidcListeners = next.OidcListeners
+	config.OidcSystems = next.OidcSystems
+	config.OidcTiers = next.OidcTiers
+	config.PushApnsKeyFile = next.PushApnsKeyFile
+	config.PushApnsKeyId = next.PushApnsKeyId
+	config.PushApnsSandbox = next.PushApnsSandbox
+	config.PushApnsTeamId = next.PushApnsTeamId
+	config.PushApnsTopic = next.PushApnsTopic
+	config.PushFcmFile = next.PushFcmFile
+	config.PushVapidSubject = next.PushVapidSubject
+	config.SentryDsn = next.SentryDsn
+	config.SslHsts = next.SslHsts
+	config.TrustedProxies = next.TrustedProxies
+	config.TtsCommand = next.TtsCommand
+
+	restart := []string{}
+
+	for name, changed := range map[string]bool{
+		"audio_store":      next.AudioStore != config.AudioStore,
+		"base_path":        next.BasePath != config.BasePath,
+		"cold_storage_dir": next.ColdStorageDir != config.ColdStorageDir,
+		"db":               next.DbType != config.DbType || next.DbFile != config.DbFile || next.DbHost != config.DbHost || next.DbPort != config.DbPort || next.DbName != config.DbName || next.DbUsername != config.DbUsername || next.DbPassword != config.DbPassword || next.DbSslMode != config.DbSslMode,
+		"downstream":       next.DownstreamCert != config.DownstreamCert || next.DownstreamKey != config.DownstreamKey,
+		"export":           next.ExportFile != config.ExportFile || next.ExportGzip != config.ExportGzip || next.ExportRotate != config.ExportRotate,
+		"ffmpeg":           next.FfmpegWorkers != config.FfmpegWorkers,
+		"http":             next.HttpIdleTimeout != config.HttpIdleTimeout || next.HttpMaxHeader != config.HttpMaxHeader || next.HttpReadTimeout != config.HttpReadTimeout || next.HttpRoutes != config.HttpRoutes || next.HttpWriteTimeout != config.HttpWriteTimeout,
+		"ingest":           next.IngestWorkers != config.IngestWorkers,
+		"listen":           next.Listen != config.Listen || next.SslListen != config.SslListen,
+		"oidc":             next.OidcClientId != config.OidcClientId || next.OidcClientSecret != config.OidcClientSecret || next.OidcIssuer != config.OidcIssuer || next.OidcOnly != config.OidcOnly || next.OidcPublicUrl != config.OidcPublicUrl,
+		"replication":      next.ReplicationKey != config.ReplicationKey || next.StandbyOf != config.StandbyOf,
+		"s3":               next.S3AccessKey != config.S3AccessKey || next.S3Bucket != config.S3Bucket || next.S3Endpoint != config.S3Endpoint || next.S3PathStyle != config.S3PathStyle || next.S3Prefix != config.S3Prefix || next.S3Region != config.S3Region || next.S3SecretKey != config.S3SecretKey,
+		"secrets":          next.SecretsKey != config.SecretsKey,
+		"ssl":              next.SslAutoCert != config.SslAutoCert || next.SslCertFile != config.SslCertFile || next.SslKeyFile != config.SslKeyFile || next.SslRedirect != config.SslRedirect || next.SslClientCa != config.SslClientCa || next.SslClientRequire != config.SslClientRequire,
+	} {
+		if changed {
+			restart = append(restart, name)
+		}
+	}
+
+	sort.Strings(restart)
+
+	return restart, nil
+}
+
+// resolveSecrets replaces the secret references of the secret settings with
+// their values, see resolveSecret, and decrypts the values encrypted with
+// the secrets key by -encrypt_secret.
+func (config *Config) resolveSecrets() error {
+	var err error
+
+	if config.SecretsKey, err = resolveSecret(config.SecretsKey); err != nil {
+		return fmt.Errorf("secrets_key: %v", err)
+	}
+
+	key := secretsMasterKey(config.SecretsKey)
+
+	for _, setting := range []struct {
+		name  string
+		value *string
+	}{
+		{"db_pass", &config.DbPassword},
+		{"oidc_client_secret", &config.OidcClientSecret},
+		{"replication_key", &config.ReplicationKey},
+		{"s3_access_key", &config.S3AccessKey},
+		{"s3_secret_key", &config.S3SecretKey},
+		{"sentry_dsn", &config.SentryDsn},
+	} {
+		v, err := resolveSecret(*setting.value)
+
+		if err == nil && strings.HasPrefix(v, secretsPrefix) {
+			if key == nil {
+				err = errors.New("encrypted without a secrets_key setting")
+			} else {
+				v, err = secretsOpen(key, v)
+			}
+		}
+
+		if err != nil {
+			return fmt.Errorf("%s: %v", setting.name, err)
+		}
+
+		*setting.value = v
+	}
+
+	return nil
+}
+
+// GetBasePath returns the base path of the server without its trailing
+// slash, empty for the root.
+func (config *Config) GetBasePath() string {
+	p, err := ParseBasePath(config.BasePath)
+	if err != nil {
+		return ""
+	}
+
+	return p
+}
+
+func (config *Config) GetArchiveDirPath() string {
+	return config.GetPath(config.ArchiveDir)
+}
+
+func (config *Config) GetBackupDirPath() string {
+	return config.GetPath(config.BackupDir)
+}
+
+func (config *Config) GetColdStorageDirPath() string {
+	return config.GetPath(config.ColdStorageDir)
+}
+
 func (config *Config) GetConfigFilePath() string {
 	return config.GetPath(config.ConfigFile)
 }
@@ -199,6 +856,18 @@ func (config *Config) GetDbFilePath() string {
 	return config.GetPath(config.DbFile)
 }
 
+func (config *Config) GetDownstreamCertFilePath() string {
+	return config.GetPath(config.DownstreamCert)
+}
+
+func (config *Config) GetDownstreamKeyFilePath() string {
+	return config.GetPath(config.DownstreamKey)
+}
+
+func (config *Config) GetExportFilePath() string {
+	return config.GetPath(config.ExportFile)
+}
+
 func (config *Config) GetPath(p string) string {
 	if path.IsAbs(p) {
 		return p
@@ -218,6 +887,10 @@ func (config *Config) GetSslCertFilePath() string {
 	return config.GetPath(config.SslCertFile)
 }
 
+func (config *Config) GetSslClientCaFilePath() string {
+	return config.GetPath(config.SslClientCa)
+}
+
 func (config *Config) GetSslKeyFilePath() string {
 	return config.GetPath(config.SslKeyFile)
 }
@@ -234,6 +907,34 @@ func (config *Config) isBaseDirWritable() bool {
 func (config *Config) saveConfig() error {
 	ini := []string{}
 
+	if config.ArchiveDir != "" {
+		ini = append(ini, fmt.Sprintf("archive_dir = %s", config.ArchiveDir))
+	}
+
+	if config.ArchiveS3 {
+		ini = append(ini, "archive_s3 = true")
+	}
+
+	if config.AudioStore != "" && config.AudioStore != AudioStoreDatabase {
+		ini = append(ini, fmt.Sprintf("audio_store = %s", config.AudioStore))
+	}
+
+	if config.BackupDir != "" {
+		ini = append(ini, fmt.Sprintf("backup_dir = %s", config.BackupDir))
+	}
+
+	if config.BackupS3 {
+		ini = append(ini, "backup_s3 = true")
+	}
+
+	if config.BasePath != "" {
+		ini = append(ini, fmt.Sprintf("base_path = %s", config.BasePath))
+	}
+
+	if config.ColdStorageDir != "" {
+		ini = append(ini, fmt.Sprintf("cold_storage_dir = %s", config.ColdStorageDir))
+	}
+
 	if config.DbType == DbTypeSqlite {
 		if config.DbFile != "" {
 			ini = append(ini, fmt.Sprintf("db_file = %s", config.DbFile))
@@ -255,6 +956,14 @@ func (config *Config) saveConfig() error {
 		if config.DbPort > 0 {
 			ini = append(ini, fmt.Sprintf("db_port = %s", strconv.Itoa(int(config.DbPort))))
 		}
+
+		if config.DbType == DbTypePostgres && config.DbSslMode != "" {
+			ini = append(ini, fmt.Sprintf("db_sslmode = %s", config.DbSslMode))
+		}
+	}
+
+	if f := flag.Lookup("db_slow_query"); f == nil || f.DefValue != strconv.Itoa(int(config.DbSlowQuery)) {
+		ini = append(ini, fmt.Sprintf("db_slow_query = %d", config.DbSlowQuery))
 	}
 
 	if config.DbType != "" {
@@ -265,10 +974,193 @@ func (config *Config) saveConfig() error {
 		ini = append(ini, fmt.Sprintf("db_user = %s", config.DbUsername))
 	}
 
+	if config.DownstreamCert != "" {
+		ini = append(ini, fmt.Sprintf("downstream_cert_file = %s", config.DownstreamCert))
+	}
+
+	if config.DownstreamKey != "" {
+		ini = append(ini, fmt.Sprintf("downstream_key_file = %s", config.DownstreamKey))
+	}
+
+	for _, embed := range []struct {
+		name  string
+		value uint
+	}{
+		{"embed_burst", config.EmbedBurst},
+		{"embed_rate", config.EmbedRate},
+	} {
+		if f := flag.Lookup(embed.name); f == nil || f.DefValue != strconv.Itoa(int(embed.value)) {
+			ini = append(ini, fmt.Sprintf("%s = %d", embed.name, embed.value))
+		}
+	}
+
+	if config.EnableMetrics {
+		ini = append(ini, "enable_metrics = true")
+	}
+
+	if config.ExportFile != "" {
+		ini = append(ini, fmt.Sprintf("export_file = %s", config.ExportFile))
+
+		if config.ExportGzip {
+			ini = append(ini, "export_gzip = true")
+		}
+
+		if config.ExportRotate != "" {
+			ini = append(ini, fmt.Sprintf("export_rotate = %s", config.ExportRotate))
+		}
+	}
+
+	if config.FfmpegWorkers > 0 {
+		ini = append(ini, fmt.Sprintf("ffmpeg_workers = %d", config.FfmpegWorkers))
+	}
+
+	if config.IngestWorkers > 0 {
+		ini = append(ini, fmt.Sprintf("ingest_workers = %d", config.IngestWorkers))
+	}
+
+	for _, limit := range []struct {
+		name  string
+		value uint
+	}{
+		{"http_idle_timeout", config.HttpIdleTimeout},
+		{"http_max_header", config.HttpMaxHeader},
+		{"http_read_timeout", config.HttpReadTimeout},
+		{"http_write_timeout", config.HttpWriteTimeout},
+		{"ingest_max_delay", config.IngestMaxDelay},
+		{"ingest_queue_limit", config.IngestQueueLimit},
+	} {
+		if f := flag.Lookup(limit.name); f == nil || f.DefValue != strconv.Itoa(int(limit.value)) {
+			ini = append(ini, fmt.Sprintf("%s = %d", limit.name, limit.value))
+		}
+	}
+
+	if f := flag.Lookup("http_routes"); f == nil || f.DefValue != config.HttpRoutes {
+		ini = append(ini, fmt.Sprintf("http_routes = %s", config.HttpRoutes))
+	}
+
 	if config.Listen != "" {
 		ini = append(ini, fmt.Sprintf("listen = %s", config.Listen))
 	}
 
+	for _, login := range []struct {
+		name  string
+		value uint
+	}{
+		{"login_burst", config.LoginBurst},
+		{"login_lockout", config.LoginLockout},
+		{"login_lockout_max", config.LoginLockoutMax},
+		{"login_max_failures", config.LoginMaxFailures},
+		{"login_rate", config.LoginRate},
+	} {
+		if f := flag.Lookup(login.name); f == nil || f.DefValue != strconv.Itoa(int(login.value)) {
+			ini = append(ini, fmt.Sprintf("%s = %d", login.name, login.value))
+		}
+	}
+
+	if config.OidcIssuer != "" {
+		if config.OidcAdminRoles != "" {
+			ini = append(ini, fmt.Sprintf("oidc_admin_roles = %s", config.OidcAdminRoles))
+		}
+
+		if config.OidcAdmins != "" {
+			ini = append(ini, fmt.Sprintf("oidc_admins = %s", config.OidcAdmins))
+		}
+
+		if config.OidcClientId != "" {
+			ini = append(ini, fmt.Sprintf("oidc_client_id = %s", config.OidcClientId))
+		}
+
+		if config.OidcClientSecret != "" {
+			ini = append(ini, fmt.Sprintf("oidc_client_secret = %s", config.OidcClientSecret))
+		}
+
+		if config.OidcIssuer != "" {
+			ini = append(ini, fmt.Sprintf("oidc_issuer = %s", config.OidcIssuer))
+		}
+
+		if config.OidcListeners != "" {
+			ini = append(ini, fmt.Sprintf("oidc_listeners = %s", config.OidcListeners))
+		}
+
+		if config.OidcOnly {
+			ini = append(ini, "oidc_only = true")
+		}
+
+		if config.OidcPublicUrl != "" {
+			ini = append(ini, fmt.Sprintf("oidc_public_url = %s", config.OidcPublicUrl))
+		}
+
+		if config.OidcSystems != "" {
+			ini = append(ini, fmt.Sprintf("oidc_systems = %s", config.OidcSystems))
+		}
+
+		if config.OidcTiers != "" {
+			ini = append(ini, fmt.Sprintf("oidc_tiers = %s", config.OidcTiers))
+		}
+	}
+
+	for _, push := range []struct {
+		name  string
+		value string
+	}{
+		{"push_apns_key_file", config.PushApnsKeyFile},
+		{"push_apns_key_id", config.PushApnsKeyId},
+		{"push_apns_team_id", config.PushApnsTeamId},
+		{"push_apns_topic", config.PushApnsTopic},
+		{"push_fcm_file", config.PushFcmFile},
+		{"push_vapid_subject", config.PushVapidSubject},
+	} {
+		if push.value != "" {
+			ini = append(ini, fmt.Sprintf("%s = %s", push.name, push.value))
+		}
+	}
+
+	if config.PushApnsSandbox {
+		ini = append(ini, "push_apns_sandbox = true")
+	}
+
+	if config.ReplicationKey != "" {
+		ini = append(ini, fmt.Sprintf("replication_key = %s", config.ReplicationKey))
+	}
+
+	if config.AudioStore == AudioStoreS3 || config.ArchiveS3 || config.BackupS3 {
+		if config.S3AccessKey != "" {
+			ini = append(ini, fmt.Sprintf("s3_access_key = %s", config.S3AccessKey))
+		}
+
+		if config.S3Bucket != "" {
+			ini = append(ini, fmt.Sprintf("s3_bucket = %s", config.S3Bucket))
+		}
+
+		if config.S3Endpoint != "" {
+			ini = append(ini, fmt.Sprintf("s3_endpoint = %s", config.S3Endpoint))
+		}
+
+		if config.S3PathStyle {
+			ini = append(ini, "s3_path_style = true")
+		}
+
+		if config.S3Prefix != "" {
+			ini = append(ini, fmt.Sprintf("s3_prefix = %s", config.S3Prefix))
+		}
+
+		if config.S3Region != "" {
+			ini = append(ini, fmt.Sprintf("s3_region = %s", config.S3Region))
+		}
+
+		if config.S3SecretKey != "" {
+			ini = append(ini, fmt.Sprintf("s3_secret_key = %s", config.S3SecretKey))
+		}
+	}
+
+	if config.SecretsKey != "" {
+		ini = append(ini, fmt.Sprintf("secrets_key = %s", config.SecretsKey))
+	}
+
+	if config.SentryDsn != "" {
+		ini = append(ini, fmt.Sprintf("sentry_dsn = %s", config.SentryDsn))
+	}
+
 	if config.SslAutoCert != "" {
 		ini = append(ini, fmt.Sprintf("ssl_auto_cert = %s", config.SslAutoCert))
 	}
@@ -277,6 +1169,18 @@ func (config *Config) saveConfig() error {
 		ini = append(ini, fmt.Sprintf("ssl_cert_file = %s", config.SslCertFile))
 	}
 
+	if config.SslClientCa != "" {
+		ini = append(ini, fmt.Sprintf("ssl_client_ca_file = %s", config.SslClientCa))
+	}
+
+	if config.SslClientRequire {
+		ini = append(ini, "ssl_client_cert_required = true")
+	}
+
+	if config.SslHsts > 0 {
+		ini = append(ini, fmt.Sprintf("ssl_hsts = %d", config.SslHsts))
+	}
+
 	if config.SslKeyFile != "" {
 		ini = append(ini, fmt.Sprintf("ssl_key_file = %s", config.SslKeyFile))
 	}
@@ -285,6 +1189,22 @@ func (config *Config) saveConfig() error {
 		ini = append(ini, fmt.Sprintf("ssl_listen = %s", config.SslListen))
 	}
 
+	if config.SslRedirect {
+		ini = append(ini, "ssl_redirect = true")
+	}
+
+	if config.StandbyOf != "" {
+		ini = append(ini, fmt.Sprintf("standby_of = %s", config.StandbyOf))
+	}
+
+	if f := flag.Lookup("trusted_proxies"); f == nil || f.DefValue != config.TrustedProxies {
+		ini = append(ini, fmt.Sprintf("trusted_proxies = %s", config.TrustedProxies))
+	}
+
+	if config.TtsCommand != "" {
+		ini = append(ini, fmt.Sprintf("tts_command = %s", config.TtsCommand))
+	}
+
 	file, err := os.Create(config.GetConfigFilePath())
 	if err != nil {
 		return err
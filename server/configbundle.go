@@ -0,0 +1,212 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	ConfigBundleFormat  = "rdio-scanner-config"
+	ConfigBundleVersion = 1
+)
+
+// configBundleMaxSize is the largest bundle accepted by the admin endpoint.
+const configBundleMaxSize = 64 << 20
+
+// ConfigBundleSections are the sections of the configuration carried by the
+// bundles, the others being tied to the host they run on, ie: the dirwatches.
+var ConfigBundleSections = []string{"access", "apiKeys", "downstreams", "groups", "options", "systems", "tags"}
+
+// ConfigBundle is a portable copy of the configuration, to move a server
+// to another host or to seed a staging one. The sections it carries replace
+// those of the server it is imported to.
+type ConfigBundle struct {
+	Config   map[string]any `json:"config"`
+	DateTime time.Time      `json:"dateTime"`
+	Format   string         `json:"format"`
+	Server   string         `json:"server"`
+	Version  uint           `json:"version"`
+}
+
+// ParseConfigBundle decodes a bundle, refusing those of a newer server.
+func ParseConfigBundle(r io.Reader) (*ConfigBundle, error) {
+	bundle := &ConfigBundle{}
+
+	if err := json.NewDecoder(r).Decode(bundle); err != nil {
+		return nil, fmt.Errorf("configbundle.parse: %v", err)
+	}
+
+	if bundle.Format != ConfigBundleFormat || bundle.Config == nil {
+		return nil, errors.New("configbundle.parse: not a configuration bundle")
+	}
+
+	if bundle.Version > ConfigBundleVersion {
+		return nil, fmt.Errorf("configbundle.parse: bundle version %d made by a newer server, %s", bundle.Version, bundle.Server)
+	}
+
+	return bundle, nil
+}
+
+// Sections returns the sections of the bundle that can be imported.
+func (bundle *ConfigBundle) Sections() []string {
+	sections := []string{}
+
+	for _, section := range ConfigBundleSections {
+		if _, ok := bundle.Config[section]; ok {
+			sections = append(sections, section)
+		}
+	}
+
+	return sections
+}
+
+// ExportConfig returns the bundle of the given sections of the
+// configuration, all of them when none is given.
+func (admin *Admin) ExportConfig(sections []string) (*ConfigBundle, error) {
+	if len(sections) == 0 {
+		sections = ConfigBundleSections
+	}
+
+	config := admin.GetConfig()
+
+	bundle := &ConfigBundle{
+		Config:   map[string]any{},
+		DateTime: time.Now().UTC(),
+		Format:   ConfigBundleFormat,
+		Server:   Version,
+		Version:  ConfigBundleVersion,
+	}
+
+	for _, section := range sections {
+		if !configBundleSection(section) {
+			return nil, fmt.Errorf("admin.exportconfig: unknown section %s", section)
+		}
+
+		bundle.Config[section] = config[section]
+	}
+
+	return bundle, nil
+}
+
+// ImportConfig replaces the sections of the configuration carried by the
+// bundle and keeps the result as a version. It returns the sections
+// imported.
+func (admin *Admin) ImportConfig(bundle *ConfigBundle, author string) ([]string, error) {
+	sections := bundle.Sections()
+
+	if len(sections) == 0 {
+		return nil, errors.New("admin.importconfig: nothing to import")
+	}
+
+	m := map[string]any{}
+	for _, section := range sections {
+		m[section] = bundle.Config[section]
+	}
+
+	admin.mutex.Lock()
+	defer admin.mutex.Unlock()
+
+	admin.applyConfig(m)
+
+	if _, err := admin.Controller.ConfigVersions.Snapshot(author, fmt.Sprintf("configuration bundle of %s imported", bundle.DateTime.Format(time.RFC3339))); err != nil {
+		admin.Controller.Logs.LogEvent(LogLevelError, err.Error())
+	}
+
+	return sections, nil
+}
+
+// ConfigBundleHandler exports the configuration as a bundle on GET, only the
+// comma separated sections of the sections query when set, and imports a
+// bundle on POST. The bundles hold the access codes, the api keys and the
+// credentials of the options in clear, for the superadmins only.
+func (admin *Admin) ConfigBundleHandler(w http.ResponseWriter, r *http.Request) {
+	logs := admin.Controller.Logs
+
+	if !admin.Authorize(w, r, AdminRoleSuperadmin) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		sections := []string{}
+		if s := r.URL.Query().Get("sections"); len(s) > 0 {
+			sections = strings.Split(s, ",")
+		}
+
+		bundle, err := admin.ExportConfig(sections)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		b, err := json.MarshalIndent(bundle, "", "  ")
+		if err != nil {
+			logs.LogEvent(LogLevelError, err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		logs.LogEvent(LogLevelWarn, fmt.Sprintf("configuration bundle exported by %s from ip %s", admin.author(r), GetRemoteAddr(r)))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"rdio-scanner-config-%s.json\"", bundle.DateTime.Format("20060102")))
+		w.Write(b)
+
+	case http.MethodPost:
+		bundle, err := ParseConfigBundle(http.MaxBytesReader(w, r.Body, configBundleMaxSize))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		sections, err := admin.ImportConfig(bundle, admin.author(r))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		logs.LogEvent(LogLevelWarn, fmt.Sprintf("configuration bundle imported by %s from ip %s, %s", admin.author(r), GetRemoteAddr(r), strings.Join(sections, ", ")))
+
+		if b, err := json.Marshal(map[string]any{"sections": sections}); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func configBundleSection(section string) bool {
+	for _, s := range ConfigBundleSections {
+		if s == section {
+			return true
+		}
+	}
+
+	return false
+}
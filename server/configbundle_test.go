@@ -0,0 +1,169 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestConfigBundle(t *testing.T) *Controller {
+	t.Helper()
+
+	controller := newTestController(t, nil)
+
+	return controller
+}
+
+func TestParseConfigBundle(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		err  bool
+	}{
+		{name: "bundle", in: `{"format":"rdio-scanner-config","version":1,"config":{"tags":[]}}`},
+		{name: "not json", in: `tags`, err: true},
+		{name: "other format", in: `{"format":"other","version":1,"config":{}}`, err: true},
+		{name: "no config", in: `{"format":"rdio-scanner-config","version":1}`, err: true},
+		{name: "newer version", in: `{"format":"rdio-scanner-config","version":2,"config":{},"server":"7.0.0"}`, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseConfigBundle(strings.NewReader(test.in))
+
+			if test.err != (err != nil) {
+				t.Fatalf("err = %v, want an error %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestConfigBundleRoundTrip(t *testing.T) {
+	source := newTestConfigBundle(t)
+
+	system := NewSystem()
+	system.Id = 1
+	system.Label = "County"
+	system.Talkgroups.List = append(system.Talkgroups.List, &Talkgroup{Id: 10, Label: "FD", Name: "Fire Dispatch"})
+	source.Systems.List = append(source.Systems.List, system)
+	source.Accesses.Add(&Access{Code: "1234", Ident: "someone", Systems: "*"})
+	source.Options.Branding = "County Scanner"
+	source.Dirwatches.List = append(source.Dirwatches.List, &Dirwatch{Directory: "/var/lib/recordings"})
+
+	if _, err := source.Admin.ExportConfig([]string{"systems", "dirWatch"}); err == nil {
+		t.Fatal("dirWatch exported")
+	}
+
+	bundle, err := source.Admin.ExportConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseConfigBundle(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := newTestConfigBundle(t)
+
+	sections, err := target.Admin.ImportConfig(parsed, "someone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sections) != len(ConfigBundleSections) {
+		t.Errorf("sections = %v, want %v", sections, ConfigBundleSections)
+	}
+
+	// the sections imported are read back from the database of the target
+	if len(target.Systems.List) != 1 || len(target.Systems.List[0].Talkgroups.List) != 1 || target.Systems.List[0].Talkgroups.List[0].Label != "FD" {
+		t.Fatalf("systems = %+v", target.Systems.List)
+	}
+	if len(target.Accesses.List) != 1 || target.Accesses.List[0].Code != "1234" {
+		t.Errorf("accesses = %+v", target.Accesses.List)
+	}
+	if target.Options.Branding != "County Scanner" {
+		t.Errorf("branding = %q", target.Options.Branding)
+	}
+	if len(target.Dirwatches.List) != 0 {
+		t.Errorf("dirwatches = %+v", target.Dirwatches.List)
+	}
+
+	versions, err := target.ConfigVersions.List()
+	if err != nil || len(versions) != 1 || versions[0].Author != "someone" {
+		t.Errorf("versions = %+v, %v", versions, err)
+	}
+}
+
+func TestConfigBundleHandler(t *testing.T) {
+	controller := newTestConfigBundle(t)
+
+	token, err := controller.Admin.NewToken(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	editor, err := controller.Admin.NewOidcToken("someone", AdminRoleConfigEditor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		token  string
+		body   string
+		status int
+	}{
+		{"no token", http.MethodGet, "/api/admin/config-bundle", "", "", http.StatusUnauthorized},
+		{"config editor", http.MethodGet, "/api/admin/config-bundle", editor, "", http.StatusForbidden},
+		{"export", http.MethodGet, "/api/admin/config-bundle", token, "", http.StatusOK},
+		{"export some sections", http.MethodGet, "/api/admin/config-bundle?sections=groups,tags", token, "", http.StatusOK},
+		{"export an unknown section", http.MethodGet, "/api/admin/config-bundle?sections=users", token, "", http.StatusBadRequest},
+		{"import not a bundle", http.MethodPost, "/api/admin/config-bundle", token, `{"tags":[]}`, http.StatusBadRequest},
+		{"import nothing", http.MethodPost, "/api/admin/config-bundle", token, `{"format":"rdio-scanner-config","version":1,"config":{"dirWatch":[]}}`, http.StatusBadRequest},
+		{"import", http.MethodPost, "/api/admin/config-bundle", token, `{"format":"rdio-scanner-config","version":1,"config":{"tags":[{"_id":1,"label":"Fire"}]}}`, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, test.target, strings.NewReader(test.body))
+			if len(test.token) > 0 {
+				r.Header.Set("Authorization", test.token)
+			}
+
+			w := httptest.NewRecorder()
+			controller.Admin.ConfigBundleHandler(w, r)
+
+			if w.Code != test.status {
+				t.Errorf("status %d, want %d", w.Code, test.status)
+			}
+		})
+	}
+
+	if len(controller.Tags.List) != 1 || controller.Tags.List[0].Label != "Fire" {
+		t.Errorf("tags = %+v", controller.Tags.List)
+	}
+}
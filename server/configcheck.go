@@ -0,0 +1,478 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// configCommandLineOnly are the flags which have no meaning in the config
+// file.
+var configCommandLineOnly = map[string]bool{
+	"admin_password": true,
+	"base_dir":       true,
+	"check-config":   true,
+	"config":         true,
+	"config_save":    true,
+	"encrypt_secret": true,
+	"export-config":  true,
+	"import-config":  true,
+	"init-config":    true,
+	"migrate-db":     true,
+	"promote":        true,
+	"restore":        true,
+	"service":        true,
+	"version":        true,
+	COMMAND_ARG:      true,
+}
+
+// configChoices are the values accepted by the settings limited to a few.
+var configChoices = map[string][]string{
+	"audio_store":   {AudioStoreDatabase, AudioStoreS3},
+	"db_sslmode":    {"disable", "require", "verify-ca", "verify-full"},
+	"db_type":       {DbTypeSqlite, DbTypeMariadb, DbTypeMysql, DbTypePostgres},
+	"export_rotate": {ExportRotateDaily, ExportRotateHourly},
+}
+
+type configSetting struct {
+	key   string
+	value string
+}
+
+// initConfig writes a config file with every setting commented out at its
+// default value, along with its description.
+func (config *Config) initConfig() error {
+	const width = 78
+
+	p := config.GetConfigFilePath()
+
+	if _, err := os.Stat(p); err == nil {
+		return fmt.Errorf("%s already exists", p)
+	}
+
+	lines := []string{
+		"; Rdio Scanner server config",
+		";",
+		"; Every setting is shown with its default value. Uncomment a setting to",
+		"; change it, the config file having precedence over the command line.",
+		"",
+	}
+
+	flag.VisitAll(func(f *flag.Flag) {
+		if configCommandLineOnly[f.Name] {
+			return
+		}
+
+		line := ";"
+		for _, word := range strings.Fields(f.Usage) {
+			if len(line)+len(word)+1 > width && len(line) > 1 {
+				lines = append(lines, line)
+				line = ";"
+			}
+			line += " " + word
+		}
+
+		lines = append(lines, line, strings.TrimSpace(fmt.Sprintf(";%s = %s", f.Name, f.DefValue)), "")
+	})
+
+	return os.WriteFile(p, []byte(strings.Join(lines, "\n")), 0600)
+}
+
+// checkConfig validates the config file and the loaded settings,
+// the database connectivity and the ssl files included. It returns the
+// problems found, prefixed with the location of the setting at fault.
+func (config *Config) checkConfig() []string {
+	p := config.GetConfigFilePath()
+
+	problems := []string{}
+
+	locations := map[string]int{}
+
+	report := func(key string, format string, a ...any) {
+		if line := locations[key]; line > 0 {
+			problems = append(problems, fmt.Sprintf("%s:%d: %s", p, line, fmt.Sprintf(format, a...)))
+		} else {
+			problems = append(problems, fmt.Sprintf("%s: %s", p, fmt.Sprintf(format, a...)))
+		}
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return []string{fmt.Sprintf("%s: %v", p, err)}
+	}
+
+	scanner := bufio.NewScanner(f)
+	section := ""
+
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		if len(line) == 0 || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if i := strings.Index(line, "]"); i > 0 {
+				section = strings.TrimSpace(line[1:i])
+				if strings.EqualFold(section, ini.DefaultSection) {
+					section = ""
+				}
+			} else {
+				problems = append(problems, fmt.Sprintf("%s:%d: unclosed section %s", p, n, line))
+			}
+			continue
+		}
+
+		i := strings.IndexAny(line, "=:")
+		if i < 1 {
+			problems = append(problems, fmt.Sprintf("%s:%d: expected key = value, got %s", p, n, line))
+			continue
+		}
+
+		key := strings.TrimSpace(line[:i])
+
+		switch fl := flag.Lookup(key); {
+		case section != "":
+			problems = append(problems, fmt.Sprintf("%s:%d: %s is ignored in section [%s], settings must come before any section", p, n, key, section))
+
+		case fl == nil:
+			problems = append(problems, fmt.Sprintf("%s:%d: unknown setting %s", p, n, key))
+
+		case configCommandLineOnly[key]:
+			problems = append(problems, fmt.Sprintf("%s:%d: %s can only be given on the command line", p, n, key))
+
+		case locations[key] > 0:
+			problems = append(problems, fmt.Sprintf("%s:%d: %s overrides the one set on line %d", p, n, key, locations[key]))
+			locations[key] = n
+
+		default:
+			locations[key] = n
+		}
+	}
+
+	f.Close()
+
+	if err := scanner.Err(); err != nil {
+		return append(problems, fmt.Sprintf("%s: %v", p, err))
+	}
+
+	cfg, err := ini.Load(p)
+	if err != nil {
+		return append(problems, fmt.Sprintf("%s: %v", p, err))
+	}
+
+	flag.VisitAll(func(fl *flag.Flag) {
+		key := fl.Name
+
+		getter, ok := fl.Value.(flag.Getter)
+		if !ok || locations[key] == 0 {
+			return
+		}
+
+		v := cfg.Section("").Key(key).String()
+
+		switch getter.Get().(type) {
+		case bool:
+			if _, err := cfg.Section("").Key(key).Bool(); err != nil {
+				report(key, "%s: %q is not a boolean, use true or false", key, v)
+			}
+
+		case uint:
+			if _, err := cfg.Section("").Key(key).Uint(); err != nil {
+				report(key, "%s: %q is not a positive integer", key, v)
+			}
+		}
+
+		if choices, ok := configChoices[key]; ok && len(v) > 0 {
+			valid := false
+			for _, choice := range choices {
+				valid = valid || v == choice
+			}
+			if !valid {
+				report(key, "%s: %q is not one of %s", key, v, strings.Join(choices, ", "))
+			}
+		}
+	})
+
+	if _, err := ParseBasePath(config.BasePath); err != nil {
+		report("base_path", "base_path: %v", err)
+	}
+
+	if _, err := ParseHttpRoutes(config.HttpRoutes); err != nil {
+		report("http_routes", "http_routes: %v", err)
+	}
+
+	if _, err := ParseTrustedProxies(config.TrustedProxies); err != nil {
+		report("trusted_proxies", "trusted_proxies: %v", err)
+	}
+
+	for _, setting := range []configSetting{{"listen", config.Listen}, {"ssl_listen", config.SslListen}} {
+		if s := strings.Split(setting.value, ":"); len(s) > 1 {
+			if port, err := strconv.ParseUint(s[len(s)-1], 10, 16); err != nil || port == 0 {
+				report(setting.key, "%s: invalid port in %q", setting.key, setting.value)
+			}
+		}
+	}
+
+	for _, setting := range []configSetting{{"oidc_issuer", config.OidcIssuer}, {"oidc_public_url", config.OidcPublicUrl}} {
+		if len(setting.value) == 0 {
+			continue
+		}
+		if u, err := url.Parse(setting.value); err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 {
+			report(setting.key, "%s: %q is not an absolute url", setting.key, setting.value)
+		}
+	}
+
+	if len(config.StandbyOf) > 0 {
+		if u, err := url.Parse(config.StandbyOf); err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 {
+			report("standby_of", "standby_of: %q is not an absolute url", config.StandbyOf)
+		} else if len(config.ReplicationKey) == 0 {
+			report("standby_of", "standby_of: the replication needs replication_key")
+		}
+	}
+
+	if len(config.ReplicationKey) > 0 && len(config.ReplicationKey) < replicationKeyMinLength {
+		report("replication_key", "replication_key: shorter than %d characters", replicationKeyMinLength)
+	}
+
+	if len(config.OidcIssuer) > 0 && len(config.OidcClientId) == 0 {
+		report("oidc_issuer", "oidc_issuer: openid connect needs oidc_client_id")
+	}
+
+	for _, entry := range strings.Split(config.OidcAdminRoles, ",") {
+		if _, role, ok := strings.Cut(entry, "="); ok && adminRoleRank(strings.TrimSpace(role)) == 0 {
+			report("oidc_admin_roles", "oidc_admin_roles: unknown role %q", strings.TrimSpace(role))
+		} else if !ok && len(strings.TrimSpace(entry)) > 0 {
+			report("oidc_admin_roles", "oidc_admin_roles: %q is not a match=role pair", strings.TrimSpace(entry))
+		}
+	}
+
+	if _, err := oidcParseSystems(config.OidcSystems); err != nil {
+		report("oidc_systems", "oidc_systems: %v", err)
+	}
+
+	if config.AudioStore == AudioStoreS3 {
+		if _, err := NewS3AudioStore(config); err != nil {
+			report("audio_store", "audio_store: %v", err)
+		}
+	}
+
+	if len(config.ArchiveDir) > 0 {
+		if fi, err := os.Stat(config.GetArchiveDirPath()); err != nil {
+			report("archive_dir", "archive_dir: %v", err)
+		} else if !fi.IsDir() {
+			report("archive_dir", "archive_dir: %s is not a directory", config.GetArchiveDirPath())
+		}
+	}
+
+	if config.ArchiveS3 {
+		if len(config.ArchiveDir) == 0 {
+			report("archive_s3", "archive_s3: the archives are uploaded from archive_dir, which is not set")
+		}
+		if _, err := NewS3AudioStore(config); err != nil {
+			report("archive_s3", "archive_s3: %v", err)
+		}
+	}
+
+	if len(config.BackupDir) > 0 {
+		if fi, err := os.Stat(config.GetBackupDirPath()); err != nil {
+			report("backup_dir", "backup_dir: %v", err)
+		} else if !fi.IsDir() {
+			report("backup_dir", "backup_dir: %s is not a directory", config.GetBackupDirPath())
+		}
+	}
+
+	if config.BackupS3 {
+		if len(config.BackupDir) == 0 {
+			report("backup_s3", "backup_s3: the backups are uploaded from backup_dir, which is not set")
+		}
+		if _, err := NewS3AudioStore(config); err != nil {
+			report("backup_s3", "backup_s3: %v", err)
+		}
+	}
+
+	if len(config.ColdStorageDir) > 0 {
+		if fi, err := os.Stat(config.GetColdStorageDirPath()); err != nil {
+			report("cold_storage_dir", "cold_storage_dir: %v", err)
+		} else if !fi.IsDir() {
+			report("cold_storage_dir", "cold_storage_dir: %s is not a directory", config.GetColdStorageDirPath())
+		}
+	}
+
+	for _, setting := range []configSetting{{"push_apns_key_file", config.PushApnsKeyFile}, {"push_fcm_file", config.PushFcmFile}} {
+		if len(setting.value) == 0 {
+			continue
+		}
+		if _, err := os.Stat(config.GetPath(setting.value)); err != nil {
+			report(setting.key, "%s: %v", setting.key, err)
+		}
+	}
+
+	if len(config.SecretsKey) > 0 && len(config.SecretsKey) < 32 {
+		report("secrets_key", "secrets_key: shorter than 32 characters, use a random key, ie: openssl rand -base64 32")
+	}
+
+	config.checkConfigSsl(report)
+
+	config.checkConfigClientCerts(report)
+
+	config.checkConfigDatabase(report)
+
+	return problems
+}
+
+// checkConfigSsl reports the ssl certificate and key which are missing, can't
+// be loaded or don't match, and the certificate which has expired.
+func (config *Config) checkConfigSsl(report func(key string, format string, a ...any)) {
+	if len(config.SslCertFile) == 0 && len(config.SslKeyFile) == 0 && len(config.SslAutoCert) == 0 {
+		if config.SslRedirect {
+			report("ssl_redirect", "ssl_redirect: ignored without ssl")
+		}
+
+		if config.SslHsts > 0 {
+			report("ssl_hsts", "ssl_hsts: ignored without ssl")
+		}
+	}
+
+	switch {
+	case len(config.SslCertFile) == 0 && len(config.SslKeyFile) == 0:
+		return
+
+	case len(config.SslKeyFile) == 0:
+		report("ssl_cert_file", "ssl_cert_file: ssl needs ssl_key_file")
+		return
+
+	case len(config.SslCertFile) == 0:
+		report("ssl_key_file", "ssl_key_file: ssl needs ssl_cert_file")
+		return
+	}
+
+	if len(config.SslAutoCert) > 0 {
+		report("ssl_auto_cert", "ssl_auto_cert: ignored as ssl_cert_file and ssl_key_file are set")
+	}
+
+	for _, setting := range []configSetting{{"ssl_cert_file", config.GetSslCertFilePath()}, {"ssl_key_file", config.GetSslKeyFilePath()}} {
+		if _, err := os.Stat(setting.value); err != nil {
+			report(setting.key, "%s: %v", setting.key, err)
+			return
+		}
+	}
+
+	pair, err := tls.LoadX509KeyPair(config.GetSslCertFilePath(), config.GetSslKeyFilePath())
+	if err != nil {
+		report("ssl_cert_file", "ssl_cert_file: %v", err)
+		return
+	}
+
+	if cert, err := x509.ParseCertificate(pair.Certificate[0]); err == nil && time.Now().After(cert.NotAfter) {
+		report("ssl_cert_file", "ssl_cert_file: certificate expired on %s", cert.NotAfter.Format(time.RFC3339))
+	}
+}
+
+// checkConfigClientCerts reports the client CA which can't be loaded, and the
+// client certificate presented to the downstream instances which is
+// incomplete, can't be loaded or has expired.
+func (config *Config) checkConfigClientCerts(report func(key string, format string, a ...any)) {
+	if len(config.SslClientCa) > 0 {
+		if len(config.SslCertFile) == 0 && len(config.SslAutoCert) == 0 {
+			report("ssl_client_ca_file", "ssl_client_ca_file: ignored without ssl")
+
+		} else if _, err := LoadClientCAs(config.GetSslClientCaFilePath()); err != nil {
+			report("ssl_client_ca_file", "ssl_client_ca_file: %v", err)
+		}
+	}
+
+	if config.SslClientRequire && len(config.SslClientCa) == 0 {
+		report("ssl_client_cert_required", "ssl_client_cert_required: the client certificates need ssl_client_ca_file")
+	}
+
+	switch {
+	case len(config.DownstreamCert) == 0 && len(config.DownstreamKey) == 0:
+		return
+
+	case len(config.DownstreamKey) == 0:
+		report("downstream_cert_file", "downstream_cert_file: the client certificate needs downstream_key_file")
+		return
+
+	case len(config.DownstreamCert) == 0:
+		report("downstream_key_file", "downstream_key_file: the client certificate needs downstream_cert_file")
+		return
+	}
+
+	pair, err := tls.LoadX509KeyPair(config.GetDownstreamCertFilePath(), config.GetDownstreamKeyFilePath())
+	if err != nil {
+		report("downstream_cert_file", "downstream_cert_file: %v", err)
+		return
+	}
+
+	if cert, err := x509.ParseCertificate(pair.Certificate[0]); err == nil && time.Now().After(cert.NotAfter) {
+		report("downstream_cert_file", "downstream_cert_file: certificate expired on %s", cert.NotAfter.Format(time.RFC3339))
+	}
+}
+
+// checkConfigDatabase reports the database which can't be reached. A sqlite
+// database file which doesn't exist yet is fine, it is created on startup.
+func (config *Config) checkConfigDatabase(report func(key string, format string, a ...any)) {
+	const timeout = 10 * time.Second
+
+	key := "db_type"
+
+	switch config.DbType {
+	case DbTypeSqlite:
+		if _, err := os.Stat(config.GetDbFilePath()); os.IsNotExist(err) {
+			return
+		}
+		key = "db_file"
+
+	case DbTypeMariadb, DbTypeMysql, DbTypePostgres:
+		if len(config.DbName) == 0 {
+			report(key, "db_type: %s needs db_name", config.DbType)
+			return
+		}
+		key = "db_host"
+
+	default:
+		return
+	}
+
+	db, err := sql.Open(databaseDsn(config))
+	if err != nil {
+		report(key, "%s: %v", key, err)
+		return
+	}
+
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := db.PingContext(ctx); err != nil {
+		report(key, "%s: cannot connect to the database: %v", key, err)
+	}
+}
@@ -0,0 +1,529 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ConfigChangeAdd     = "add"
+	ConfigChangeRemove  = "remove"
+	ConfigChangeReplace = "replace"
+)
+
+// configVersionsKeep is how many versions of the configuration are kept,
+// the older ones being removed as new ones are saved.
+const configVersionsKeep = 100
+
+var ErrConfigVersionNotFound = errors.New("config version not found")
+
+// ConfigChange is a difference between two versions of the configuration.
+// The path is made of the keys of the objects and of the positions in the
+// lists, or of the _id or id of their items when all have one, ie:
+// /systems/_id=3/talkgroups/id=1001/label.
+type ConfigChange struct {
+	From any    `json:"from,omitempty"`
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	To   any    `json:"to,omitempty"`
+}
+
+// ConfigVersion is a snapshot of the configuration, as sent to the admin
+// dashboard, taken each time it is saved.
+type ConfigVersion struct {
+	Id       uint           `json:"_id"`
+	Author   string         `json:"author"`
+	Config   map[string]any `json:"config,omitempty"`
+	DateTime time.Time      `json:"dateTime"`
+	Note     string         `json:"note"`
+}
+
+// ConfigVersions keeps the versions of the configuration, so that a bad
+// edit can be undone by rolling back to a previous one. The snapshots hold
+// credentials and are sealed when a secrets key is set.
+type ConfigVersions struct {
+	Controller *Controller
+}
+
+func NewConfigVersions(controller *Controller) *ConfigVersions {
+	return &ConfigVersions{Controller: controller}
+}
+
+// Diff returns the changes from the version from to the version to, or to
+// the current configuration when to is 0.
+func (configVersions *ConfigVersions) Diff(from uint, to uint) ([]*ConfigChange, error) {
+	a, err := configVersions.Get(from)
+	if err != nil {
+		return nil, err
+	}
+
+	var b map[string]any
+	if to > 0 {
+		v, err := configVersions.Get(to)
+		if err != nil {
+			return nil, err
+		}
+		b = v.Config
+	} else if b, err = configVersions.current(); err != nil {
+		return nil, err
+	}
+
+	return configDiff("", a.Config, b), nil
+}
+
+func (configVersions *ConfigVersions) Get(id uint) (*ConfigVersion, error) {
+	var (
+		config   string
+		dateTime any
+		db       = configVersions.Controller.Database
+		err      error
+	)
+
+	formatError := func(err error) error {
+		return fmt.Errorf("configversions.get: %v", err)
+	}
+
+	version := &ConfigVersion{}
+
+	if err = db.Sql.QueryRow("select `_id`, `author`, `config`, `dateTime`, `note` from `rdioScannerConfigVersions` where `_id` = ?", id).Scan(&version.Id, &version.Author, &config, &dateTime, &version.Note); err == sql.ErrNoRows {
+		return nil, ErrConfigVersionNotFound
+	} else if err != nil {
+		return nil, formatError(err)
+	}
+
+	if version.DateTime, err = db.ParseDateTime(dateTime); err != nil {
+		return nil, formatError(err)
+	}
+
+	if config, err = db.Secrets.Open(config); err != nil {
+		return nil, formatError(err)
+	}
+
+	if err = json.Unmarshal([]byte(config), &version.Config); err != nil {
+		return nil, formatError(err)
+	}
+
+	return version, nil
+}
+
+// List returns the most recent versions, without their configuration.
+func (configVersions *ConfigVersions) List() ([]*ConfigVersion, error) {
+	db := configVersions.Controller.Database
+
+	formatError := func(err error) error {
+		return fmt.Errorf("configversions.list: %v", err)
+	}
+
+	rows, err := db.Sql.Query(fmt.Sprintf("select `_id`, `author`, `dateTime`, `note` from `rdioScannerConfigVersions` order by `_id` desc limit %d", configVersionsKeep))
+	if err != nil {
+		return nil, formatError(err)
+	}
+	defer rows.Close()
+
+	versions := []*ConfigVersion{}
+
+	for rows.Next() {
+		var dateTime any
+
+		version := &ConfigVersion{}
+		if err = rows.Scan(&version.Id, &version.Author, &dateTime, &version.Note); err != nil {
+			return nil, formatError(err)
+		}
+
+		if version.DateTime, err = db.ParseDateTime(dateTime); err != nil {
+			continue
+		}
+
+		versions = append(versions, version)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, formatError(err)
+	}
+
+	return versions, nil
+}
+
+// Snapshot saves the current configuration as a new version and removes
+// the versions beyond those kept. It must be called with the admin mutex
+// held, as the configuration is saved.
+func (configVersions *ConfigVersions) Snapshot(author string, note string) (uint, error) {
+	db := configVersions.Controller.Database
+
+	formatError := func(err error) error {
+		return fmt.Errorf("configversions.snapshot: %v", err)
+	}
+
+	b, err := json.Marshal(configVersions.Controller.Admin.GetConfig())
+	if err != nil {
+		return 0, formatError(err)
+	}
+
+	config, err := db.Secrets.Seal(string(b))
+	if err != nil {
+		return 0, formatError(err)
+	}
+
+	res, err := db.Sql.Exec("insert into `rdioScannerConfigVersions` (`author`, `config`, `dateTime`, `note`) values (?, ?, ?, ?)", author, config, time.Now().UTC(), note)
+	if err != nil {
+		return 0, formatError(err)
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, formatError(err)
+	}
+
+	var oldest uint
+	if err = db.Sql.QueryRow(fmt.Sprintf("select `_id` from `rdioScannerConfigVersions` order by `_id` desc limit 1 offset %d", configVersionsKeep)).Scan(&oldest); err == nil {
+		if _, err = db.Sql.Exec("delete from `rdioScannerConfigVersions` where `_id` <= ?", oldest); err != nil {
+			return 0, formatError(err)
+		}
+	} else if err != sql.ErrNoRows {
+		return 0, formatError(err)
+	}
+
+	return uint(id), nil
+}
+
+// Start saves the configuration as a version when it differs from the last
+// one, ie: on first run or after a restore, so that the first edit can be
+// rolled back.
+func (configVersions *ConfigVersions) Start() error {
+	var id uint
+
+	db := configVersions.Controller.Database
+
+	if err := db.Sql.QueryRow("select `_id` from `rdioScannerConfigVersions` order by `_id` desc limit 1").Scan(&id); err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("configversions.start: %v", err)
+	}
+
+	if id > 0 {
+		if changes, err := configVersions.Diff(id, 0); err == nil && len(changes) == 0 {
+			return nil
+		}
+	}
+
+	admin := configVersions.Controller.Admin
+
+	admin.mutex.Lock()
+	defer admin.mutex.Unlock()
+
+	_, err := configVersions.Snapshot("", "configuration at startup")
+
+	return err
+}
+
+// current returns the current configuration as it is saved in a version.
+func (configVersions *ConfigVersions) current() (map[string]any, error) {
+	var m map[string]any
+
+	b, err := json.Marshal(configVersions.Controller.Admin.GetConfig())
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// ConfigVersionsHandler lists the versions of the configuration on GET, or
+// returns one with ?id=, or the changes between two with ?from=&to=, to
+// being the current configuration when omitted. A POST of {"rollback": id}
+// saves that version as the configuration. The versions and their changes
+// hold the credentials of the configuration, only superadmins get them.
+func (admin *Admin) ConfigVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		configVersions = admin.Controller.ConfigVersions
+		logs           = admin.Controller.Logs
+		role           = adminWriteRole(r)
+	)
+
+	if r.Method == http.MethodGet && (r.URL.Query().Has("id") || r.URL.Query().Has("from")) {
+		role = AdminRoleSuperadmin
+	}
+
+	if !admin.Authorize(w, r, role) {
+		return
+	}
+
+	writeJson := func(v any) {
+		if b, err := json.Marshal(v); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+	}
+
+	writeError := func(err error) {
+		if err == ErrConfigVersionNotFound {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			logs.LogEvent(LogLevelError, err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}
+
+	parseId := func(s string) (uint, bool) {
+		if len(s) == 0 {
+			return 0, true
+		}
+		i, err := strconv.ParseUint(s, 10, 32)
+		if err != nil || i == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return 0, false
+		}
+		return uint(i), true
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		query := r.URL.Query()
+
+		id, ok := parseId(query.Get("id"))
+		if !ok {
+			return
+		}
+		from, ok := parseId(query.Get("from"))
+		if !ok {
+			return
+		}
+		to, ok := parseId(query.Get("to"))
+		if !ok {
+			return
+		}
+
+		switch {
+		case id > 0:
+			if version, err := configVersions.Get(id); err == nil {
+				writeJson(version)
+			} else {
+				writeError(err)
+			}
+
+		case from > 0:
+			if changes, err := configVersions.Diff(from, to); err == nil {
+				writeJson(map[string]any{"changes": changes, "from": from, "to": to})
+			} else {
+				writeError(err)
+			}
+
+		default:
+			if versions, err := configVersions.List(); err == nil {
+				writeJson(versions)
+			} else {
+				writeError(err)
+			}
+		}
+
+	case http.MethodPost:
+		var req struct {
+			Rollback uint `json:"rollback"`
+		}
+
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil || req.Rollback == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		version, err := configVersions.Get(req.Rollback)
+		if err != nil {
+			writeError(err)
+			return
+		}
+
+		admin.mutex.Lock()
+		defer admin.mutex.Unlock()
+
+		admin.applyConfig(version.Config)
+
+		if _, err := configVersions.Snapshot(admin.author(r), fmt.Sprintf("rollback to version %d", version.Id)); err != nil {
+			logs.LogEvent(LogLevelError, err.Error())
+		}
+
+		logs.LogEvent(LogLevelWarn, fmt.Sprintf("configuration rolled back to version %d by %s from ip %s", version.Id, admin.author(r), GetRemoteAddr(r)))
+
+		admin.SendConfig(w)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// configDiff returns the changes from a to b, two configurations decoded
+// from json.
+func configDiff(path string, a any, b any) []*ConfigChange {
+	changes := []*ConfigChange{}
+
+	switch va := a.(type) {
+	case map[string]any:
+		vb, ok := b.(map[string]any)
+		if !ok {
+			break
+		}
+
+		keys := []string{}
+		for k := range va {
+			keys = append(keys, k)
+		}
+		for k := range vb {
+			if _, ok := va[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			p := path + "/" + configPathEscape(k)
+			x, inA := va[k]
+			y, inB := vb[k]
+
+			switch {
+			case !inB:
+				changes = append(changes, &ConfigChange{Op: ConfigChangeRemove, Path: p, From: x})
+			case !inA:
+				changes = append(changes, &ConfigChange{Op: ConfigChangeAdd, Path: p, To: y})
+			default:
+				changes = append(changes, configDiff(p, x, y)...)
+			}
+		}
+
+		return changes
+
+	case []any:
+		vb, ok := b.([]any)
+		if !ok {
+			break
+		}
+
+		key := configListKey(va, vb)
+
+		if len(key) == 0 {
+			for i := 0; i < len(va) || i < len(vb); i++ {
+				p := path + "/" + strconv.Itoa(i)
+
+				switch {
+				case i >= len(vb):
+					changes = append(changes, &ConfigChange{Op: ConfigChangeRemove, Path: p, From: va[i]})
+				case i >= len(va):
+					changes = append(changes, &ConfigChange{Op: ConfigChangeAdd, Path: p, To: vb[i]})
+				default:
+					changes = append(changes, configDiff(p, va[i], vb[i])...)
+				}
+			}
+
+			return changes
+		}
+
+		itemKey := func(item any) string {
+			return fmt.Sprint(item.(map[string]any)[key])
+		}
+
+		items := map[string]any{}
+		for _, item := range vb {
+			items[itemKey(item)] = item
+		}
+
+		seen := map[string]bool{}
+		for _, x := range va {
+			k := itemKey(x)
+			p := path + "/" + configPathEscape(key+"="+k)
+			seen[k] = true
+
+			if y, ok := items[k]; ok {
+				changes = append(changes, configDiff(p, x, y)...)
+			} else {
+				changes = append(changes, &ConfigChange{Op: ConfigChangeRemove, Path: p, From: x})
+			}
+		}
+
+		for _, y := range vb {
+			if k := itemKey(y); !seen[k] {
+				changes = append(changes, &ConfigChange{Op: ConfigChangeAdd, Path: path + "/" + configPathEscape(key+"="+k), To: y})
+			}
+		}
+
+		return changes
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		changes = append(changes, &ConfigChange{Op: ConfigChangeReplace, Path: path, From: a, To: b})
+	}
+
+	return changes
+}
+
+// configListKey returns _id or id when all the items of both lists are
+// objects with distinct values of it, and an empty string otherwise.
+func configListKey(a []any, b []any) string {
+	for _, key := range []string{"_id", "id"} {
+		unique := true
+
+		for _, l := range [][]any{a, b} {
+			seen := map[string]bool{}
+
+			for _, item := range l {
+				m, ok := item.(map[string]any)
+				if !ok {
+					unique = false
+					break
+				}
+
+				v, ok := m[key]
+				if !ok || v == nil {
+					unique = false
+					break
+				}
+
+				k := fmt.Sprint(v)
+				if seen[k] {
+					unique = false
+					break
+				}
+				seen[k] = true
+			}
+
+			if !unique {
+				break
+			}
+		}
+
+		if unique && (len(a) > 0 || len(b) > 0) {
+			return key
+		}
+	}
+
+	return ""
+}
+
+// configPathEscape escapes a key of the path as in a json pointer.
+func configPathEscape(s string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(s)
+}
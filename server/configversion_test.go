@@ -0,0 +1,178 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestConfigDiff(t *testing.T) {
+	decode := func(s string) any {
+		var v any
+		if err := json.Unmarshal([]byte(s), &v); err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	tests := []struct {
+		name string
+		a    string
+		b    string
+		want []string
+	}{
+		{"equal", `{"a":1,"b":[1,2]}`, `{"a":1,"b":[1,2]}`, []string{}},
+		{"replace", `{"options":{"branding":"a"}}`, `{"options":{"branding":"b"}}`, []string{"replace /options/branding"}},
+		{"add and remove keys", `{"a":1}`, `{"b":2}`, []string{"remove /a", "add /b"}},
+		{"list by position", `{"l":[1,2,3]}`, `{"l":[1,5]}`, []string{"replace /l/1", "remove /l/2"}},
+		{"list by _id", `{"l":[{"_id":1,"x":1},{"_id":2,"x":2}]}`, `{"l":[{"_id":2,"x":3},{"_id":3,"x":1}]}`, []string{"remove /l/_id=1", "replace /l/_id=2/x", "add /l/_id=3"}},
+		{"list by id", `{"t":[{"id":10,"label":"a"}]}`, `{"t":[{"id":9,"label":"b"},{"id":10,"label":"a"}]}`, []string{"add /t/id=9"}},
+		{"duplicate ids", `{"t":[{"id":10,"site":1},{"id":10,"site":2}]}`, `{"t":[{"id":10,"site":1}]}`, []string{"remove /t/1"}},
+		{"escaped key", `{"a/b":1}`, `{"a/b":2}`, []string{"replace /a~1b"}},
+		{"type change", `{"a":[1]}`, `{"a":"1"}`, []string{"replace /a"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := []string{}
+			for _, change := range configDiff("", decode(test.a), decode(test.b)) {
+				got = append(got, change.Op+" "+change.Path)
+			}
+			if strings.Join(got, ",") != strings.Join(test.want, ",") {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestConfigVersions(t *testing.T) {
+	controller := newTestController(t, nil)
+
+	configVersions := controller.ConfigVersions
+
+	count := func() int {
+		versions, err := configVersions.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(versions)
+	}
+
+	// the configuration at startup is kept once
+	for i := 0; i < 2; i++ {
+		if err := configVersions.Start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := count(); n != 1 {
+		t.Fatalf("versions = %d, want 1", n)
+	}
+
+	controller.Options.Branding = "changed"
+	id, err := configVersions.Snapshot("someone", "configuration changed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := configVersions.Diff(id-1, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Path != "/options/branding" || changes[0].To != "changed" {
+		t.Fatalf("changes = %v", changes)
+	}
+
+	version, err := configVersions.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version.Author != "someone" || version.Config["options"].(map[string]any)["branding"] != "changed" {
+		t.Errorf("version = %+v", version)
+	}
+
+	if _, err := configVersions.Get(id + 100); err != ErrConfigVersionNotFound {
+		t.Errorf("err = %v, want %v", err, ErrConfigVersionNotFound)
+	}
+
+	token, err := controller.Admin.NewToken(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewer, err := controller.Admin.NewOidcToken("someone", AdminRoleViewer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		token  string
+		body   string
+		status int
+	}{
+		{"no token", http.MethodGet, "/api/admin/config-versions", "", "", http.StatusUnauthorized},
+		{"list", http.MethodGet, "/api/admin/config-versions", viewer, "", http.StatusOK},
+		{"viewer getting a version", http.MethodGet, "/api/admin/config-versions?id=1", viewer, "", http.StatusForbidden},
+		{"viewer getting a diff", http.MethodGet, "/api/admin/config-versions?from=1", viewer, "", http.StatusForbidden},
+		{"diff to current", http.MethodGet, "/api/admin/config-versions?from=1", token, "", http.StatusOK},
+		{"version", http.MethodGet, "/api/admin/config-versions?id=1", token, "", http.StatusOK},
+		{"invalid id", http.MethodGet, "/api/admin/config-versions?id=x", token, "", http.StatusBadRequest},
+		{"unknown version", http.MethodGet, "/api/admin/config-versions?id=999", token, "", http.StatusNotFound},
+		{"viewer rolling back", http.MethodPost, "/api/admin/config-versions", viewer, `{"rollback":1}`, http.StatusForbidden},
+		{"rollback to unknown version", http.MethodPost, "/api/admin/config-versions", token, `{"rollback":999}`, http.StatusNotFound},
+		{"rollback", http.MethodPost, "/api/admin/config-versions", token, `{"rollback":1}`, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, test.target, strings.NewReader(test.body))
+			if len(test.token) > 0 {
+				r.Header.Set("Authorization", test.token)
+			}
+
+			w := httptest.NewRecorder()
+			controller.Admin.ConfigVersionsHandler(w, r)
+
+			if w.Code != test.status {
+				t.Errorf("status %d, want %d", w.Code, test.status)
+			}
+		})
+	}
+
+	if controller.Options.Branding != "" {
+		t.Errorf("branding = %q after the rollback", controller.Options.Branding)
+	}
+
+	// the rollback is a version of its own
+	if n := count(); n != 3 {
+		t.Errorf("versions = %d, want 3", n)
+	}
+
+	for i := 0; i < configVersionsKeep; i++ {
+		if _, err := configVersions.Snapshot("", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var n int
+	if err := controller.Database.Sql.QueryRow("select count(*) from `rdioScannerConfigVersions`").Scan(&n); err != nil || n != configVersionsKeep {
+		t.Errorf("versions = %d, want %d, %v", n, configVersionsKeep, err)
+	}
+}
@@ -0,0 +1,343 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type httpConnKey struct{}
+
+type httpProxyKey struct{}
+
+// httpProxy is what a request tells of the reverse proxy it came through,
+// as kept in its context.
+type httpProxy struct {
+	basePath string
+	proxies  []*net.IPNet
+}
+
+// httpConnContext keeps the connection of a request in its context so that
+// long running handlers can push the server timeouts.
+func httpConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, httpConnKey{}, c)
+}
+
+// extendWriteDeadline gives the response of a request d more time to be
+// written, past the write timeout of the server.
+func extendWriteDeadline(r *http.Request, d time.Duration) {
+	if c, ok := r.Context().Value(httpConnKey{}).(net.Conn); ok {
+		c.SetWriteDeadline(time.Now().Add(d))
+	}
+}
+
+// clearReadDeadline removes the read deadline of the connection of a
+// request, for the streams outlasting the read timeout of the server.
+func clearReadDeadline(r *http.Request) {
+	if c, ok := r.Context().Value(httpConnKey{}).(net.Conn); ok {
+		c.SetReadDeadline(time.Time{})
+	}
+}
+
+// HttpRoute overrides the read and write timeouts of the requests whose path
+// starts with Prefix. A zero timeout removes the deadlines.
+type HttpRoute struct {
+	Prefix  string
+	Timeout time.Duration
+}
+
+// ParseHttpRoutes reads a comma separated list of path=seconds pairs, the
+// longest prefixes first so that they take precedence.
+func ParseHttpRoutes(list string) ([]HttpRoute, error) {
+	routes := []HttpRoute{}
+
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		prefix, seconds, ok := strings.Cut(entry, "=")
+		if !ok || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("invalid http route %s", entry)
+		}
+
+		i, err := strconv.ParseUint(strings.TrimSpace(seconds), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid http route %s: %v", entry, err)
+		}
+
+		routes = append(routes, HttpRoute{Prefix: strings.TrimSpace(prefix), Timeout: time.Duration(i) * time.Second})
+	}
+
+	sort.SliceStable(routes, func(i int, j int) bool {
+		return len(routes[i].Prefix) > len(routes[j].Prefix)
+	})
+
+	return routes, nil
+}
+
+// httpRoutesHandler applies the route timeouts before handing the request
+// over to next.
+func httpRoutesHandler(routes []HttpRoute, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, route := range routes {
+			if strings.HasPrefix(r.URL.Path, route.Prefix) {
+				if c, ok := r.Context().Value(httpConnKey{}).(net.Conn); ok {
+					deadline := time.Time{}
+					if route.Timeout > 0 {
+						deadline = time.Now().Add(route.Timeout)
+					}
+					c.SetDeadline(deadline)
+				}
+				break
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// httpProxies parses the trusted proxies of the config once for each value
+// of the setting, which can change on reload. None is trusted when the
+// setting is invalid.
+type httpProxies struct {
+	list    string
+	parsed  bool
+	proxies []*net.IPNet
+	mutex   sync.Mutex
+}
+
+func (proxies *httpProxies) get(list string) []*net.IPNet {
+	proxies.mutex.Lock()
+	defer proxies.mutex.Unlock()
+
+	if !proxies.parsed || proxies.list != list {
+		proxies.list = list
+		proxies.parsed = true
+		proxies.proxies, _ = ParseTrustedProxies(list)
+	}
+
+	return proxies.proxies
+}
+
+// ParseTrustedProxies reads a comma separated list of ip addresses and cidr
+// ranges, ie: 127.0.0.1,10.0.0.0/8.
+func ParseTrustedProxies(list string) ([]*net.IPNet, error) {
+	proxies := []*net.IPNet{}
+
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %s", entry)
+			}
+
+			if ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %s", entry)
+		}
+
+		proxies = append(proxies, ipNet)
+	}
+
+	return proxies, nil
+}
+
+// ParseBasePath returns the base path the server is reached at behind a
+// reverse proxy, without its trailing slash, empty for the root.
+func ParseBasePath(p string) (string, error) {
+	p = strings.TrimSpace(p)
+
+	if len(p) == 0 || p == "/" {
+		return "", nil
+	}
+
+	if !strings.HasPrefix(p, "/") || strings.ContainsAny(p, "?#%\\ ") || strings.Contains(p, "//") || strings.Contains(p, "/../") || strings.HasSuffix(p, "/..") {
+		return "", fmt.Errorf("invalid base path %s", p)
+	}
+
+	return strings.TrimSuffix(p, "/"), nil
+}
+
+// httpProxyHandler keeps what the request tells of the reverse proxy in its
+// context and strips the base path of the config from the requests before
+// handing them over to next. The requests outside of the base path are not
+// found, the base path itself is redirected to its folder for the webapp to
+// load its files relative to it.
+func httpProxyHandler(config *Config, next http.Handler) http.Handler {
+	proxies := &httpProxies{}
+
+	basePath := config.GetBasePath()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(context.WithValue(r.Context(), httpProxyKey{}, &httpProxy{
+			basePath: basePath,
+			proxies:  proxies.get(config.TrustedProxies),
+		}))
+
+		if len(basePath) > 0 {
+			if r.URL.Path == basePath {
+				u := *r.URL
+				u.Path = basePath + "/"
+				http.Redirect(w, r, u.RequestURI(), http.StatusMovedPermanently)
+				return
+			}
+
+			if !strings.HasPrefix(r.URL.Path, basePath+"/") {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			http.StripPrefix(basePath, next).ServeHTTP(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// httpsRedirectHandler redirects the requests to the same url over https on
+// port, the requests of a trusted proxy already made over https excepted.
+func httpsRedirectHandler(port string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Forwarded-Proto") == "https" && isTrustedProxy(r, requestPeerAddr(r)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+
+		if port == "443" {
+			if strings.Contains(host, ":") {
+				host = "[" + host + "]"
+			}
+		} else {
+			host = net.JoinHostPort(host, port)
+		}
+
+		status := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			status = http.StatusMovedPermanently
+		}
+
+		http.Redirect(w, r, fmt.Sprintf("https://%s%s%s", host, requestBasePath(r), r.URL.RequestURI()), status)
+	})
+}
+
+// httpsSecurityHandler adds the security headers to the responses served
+// over https, the Strict-Transport-Security one when ssl_hsts is set.
+func httpsSecurityHandler(config *Config, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config.SslHsts > 0 {
+			w.Header().Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d", config.SslHsts))
+		}
+
+		w.Header().Set("Referrer-Policy", "strict-origin-when-cross-origin")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isTrustedProxy tells whether the ip address is one of the trusted proxies
+// of the request.
+func isTrustedProxy(r *http.Request, ip string) bool {
+	proxy, ok := r.Context().Value(httpProxyKey{}).(*httpProxy)
+	if !ok {
+		return false
+	}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+
+	for _, ipNet := range proxy.proxies {
+		if ipNet.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// requestBaseUrl returns the public url of the server for the request, ie:
+// https://example.com/scanner, the forwarded headers of the trusted proxies
+// included.
+func requestBaseUrl(r *http.Request) string {
+	scheme := "http"
+	host := r.Host
+
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	if isTrustedProxy(r, requestPeerAddr(r)) {
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto == "https" || proto == "http" {
+			scheme = proto
+		}
+
+		if h := strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Host"), ",")[0]); len(h) > 0 {
+			host = h
+		}
+	}
+
+	return fmt.Sprintf("%s://%s%s", scheme, host, requestBasePath(r))
+}
+
+// requestBasePath returns the base path the request was made under.
+func requestBasePath(r *http.Request) string {
+	if proxy, ok := r.Context().Value(httpProxyKey{}).(*httpProxy); ok {
+		return proxy.basePath
+	}
+
+	return ""
+}
+
+// requestPeerAddr returns the ip address the request came from, a proxy or
+// the client itself.
+func requestPeerAddr(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+
+	return r.RemoteAddr
+}
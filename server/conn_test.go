@@ -0,0 +1,312 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		list string
+		want []string
+		fail bool
+	}{
+		{list: "", want: []string{}},
+		{list: "127.0.0.1, ::1", want: []string{"127.0.0.1/32", "::1/128"}},
+		{list: "10.0.0.0/8,192.168.1.0/24", want: []string{"10.0.0.0/8", "192.168.1.0/24"}},
+		{list: "10.0.0.1/8", want: []string{"10.0.0.0/8"}},
+		{list: "localhost", fail: true},
+		{list: "10.0.0.0/33", fail: true},
+	}
+
+	for _, test := range tests {
+		proxies, err := ParseTrustedProxies(test.list)
+		if test.fail {
+			if err == nil {
+				t.Errorf("%q: want an error", test.list)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", test.list, err)
+		}
+		if len(proxies) != len(test.want) {
+			t.Fatalf("%q: got %v, want %v", test.list, proxies, test.want)
+		}
+		for i, proxy := range proxies {
+			if proxy.String() != test.want[i] {
+				t.Errorf("%q: got %v, want %v", test.list, proxies, test.want)
+			}
+		}
+	}
+}
+
+func TestParseBasePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+		fail bool
+	}{
+		{path: "", want: ""},
+		{path: "/", want: ""},
+		{path: "/scanner", want: "/scanner"},
+		{path: " /scanner/ ", want: "/scanner"},
+		{path: "/radio/scanner/", want: "/radio/scanner"},
+		{path: "scanner", fail: true},
+		{path: "/scanner?x", fail: true},
+		{path: "//scanner", fail: true},
+		{path: "/scanner/../admin", fail: true},
+		{path: "/scanner/..", fail: true},
+		{path: "/scan%2Fner", fail: true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseBasePath(test.path)
+		if test.fail {
+			if err == nil {
+				t.Errorf("%q: want an error", test.path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", test.path, err)
+		}
+		if got != test.want {
+			t.Errorf("%q: got %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+// serveProxied runs the request through the proxy handler and returns the
+// request next got, nil if it never got it.
+func serveProxied(config *Config, r *http.Request) (*http.Request, *httptest.ResponseRecorder) {
+	var got *http.Request
+
+	w := httptest.NewRecorder()
+
+	httpProxyHandler(config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	})).ServeHTTP(w, r)
+
+	return got, w
+}
+
+func TestGetRemoteAddr(t *testing.T) {
+	tests := []struct {
+		name      string
+		peer      string
+		forwarded string
+		want      string
+	}{
+		{name: "direct", peer: "203.0.113.5:1234", want: "203.0.113.5"},
+		{name: "spoofed from an untrusted peer", peer: "203.0.113.5:1234", forwarded: "198.51.100.1", want: "203.0.113.5"},
+		{name: "trusted proxy", peer: "10.0.0.2:1234", forwarded: "198.51.100.1", want: "198.51.100.1"},
+		{name: "trusted chain", peer: "10.0.0.2:1234", forwarded: "198.51.100.1, 10.0.0.3", want: "198.51.100.1"},
+		{name: "spoofed through a trusted proxy", peer: "10.0.0.2:1234", forwarded: "1.2.3.4, 198.51.100.1", want: "198.51.100.1"},
+		{name: "invalid forwarded address", peer: "10.0.0.2:1234", forwarded: "1.2.3.4, bogus", want: "10.0.0.2"},
+		{name: "forwarded with a port", peer: "10.0.0.2:1234", forwarded: "198.51.100.1:5678", want: "198.51.100.1"},
+		{name: "ipv6 proxy", peer: "[::1]:1234", forwarded: "2001:db8::1", want: "2001:db8::1"},
+	}
+
+	config := &Config{TrustedProxies: "10.0.0.0/8,::1"}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = test.peer
+			if len(test.forwarded) > 0 {
+				r.Header.Set("X-Forwarded-For", test.forwarded)
+			}
+
+			got, _ := serveProxied(config, r)
+			if got == nil {
+				t.Fatal("request not served")
+			}
+
+			if addr := GetRemoteAddr(got); addr != test.want {
+				t.Errorf("got %s, want %s", addr, test.want)
+			}
+		})
+	}
+}
+
+func TestHttpProxyHandlerBasePath(t *testing.T) {
+	tests := []struct {
+		target   string
+		status   int
+		location string
+		path     string
+	}{
+		{target: "/scanner", status: http.StatusMovedPermanently, location: "/scanner/"},
+		{target: "/scanner?x=1", status: http.StatusMovedPermanently, location: "/scanner/?x=1"},
+		{target: "/scanner/", status: http.StatusOK, path: "/"},
+		{target: "/scanner/api/admin/config", status: http.StatusOK, path: "/api/admin/config"},
+		{target: "/scannerx", status: http.StatusNotFound},
+		{target: "/api/admin/config", status: http.StatusNotFound},
+	}
+
+	config := &Config{BasePath: "/scanner/"}
+
+	for _, test := range tests {
+		got, w := serveProxied(config, httptest.NewRequest(http.MethodGet, test.target, nil))
+
+		if w.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.target, w.Code, test.status)
+			continue
+		}
+		if location := w.Header().Get("Location"); location != test.location {
+			t.Errorf("%s: got location %q, want %q", test.target, location, test.location)
+		}
+		if len(test.path) > 0 && (got == nil || got.URL.Path != test.path) {
+			t.Errorf("%s: path not stripped to %s", test.target, test.path)
+		}
+	}
+}
+
+func TestRequestBaseUrl(t *testing.T) {
+	tests := []struct {
+		name    string
+		peer    string
+		headers map[string]string
+		want    string
+	}{
+		{name: "direct", peer: "203.0.113.5:1234", want: "http://example.com/scanner"},
+		{
+			name:    "untrusted forwarded headers",
+			peer:    "203.0.113.5:1234",
+			headers: map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "evil.com"},
+			want:    "http://example.com/scanner",
+		},
+		{
+			name:    "trusted forwarded headers",
+			peer:    "127.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "scanner.org, proxy.local"},
+			want:    "https://scanner.org/scanner",
+		},
+		{
+			name:    "invalid forwarded proto",
+			peer:    "127.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-Proto": "javascript"},
+			want:    "http://example.com/scanner",
+		},
+	}
+
+	config := &Config{BasePath: "/scanner", TrustedProxies: "127.0.0.1,::1"}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/scanner/", nil)
+			r.RemoteAddr = test.peer
+			for k, v := range test.headers {
+				r.Header.Set(k, v)
+			}
+
+			got, _ := serveProxied(config, r)
+			if got == nil {
+				t.Fatal("request not served")
+			}
+
+			if u := requestBaseUrl(got); u != test.want {
+				t.Errorf("got %s, want %s", u, test.want)
+			}
+		})
+	}
+}
+
+func TestHttpsRedirectHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		port     string
+		peer     string
+		proto    string
+		status   int
+		location string
+	}{
+		{name: "default port", target: "http://example.com:3000/admin?x=1", port: "443", status: http.StatusMovedPermanently, location: "https://example.com/admin?x=1"},
+		{name: "custom port", target: "http://example.com/", port: "3443", status: http.StatusMovedPermanently, location: "https://example.com:3443/"},
+		{name: "ipv6 host", target: "http://[2001:db8::1]:3000/", port: "443", status: http.StatusMovedPermanently, location: "https://[2001:db8::1]/"},
+		{name: "ipv6 host custom port", target: "http://[2001:db8::1]:3000/", port: "3443", status: http.StatusMovedPermanently, location: "https://[2001:db8::1]:3443/"},
+		{name: "base path kept", target: "http://example.com/scanner/api/admin/config", port: "443", status: http.StatusMovedPermanently, location: "https://example.com/scanner/api/admin/config"},
+		{name: "post keeps its method", method: http.MethodPost, target: "http://example.com/api/call-upload", port: "443", status: http.StatusPermanentRedirect, location: "https://example.com/api/call-upload"},
+		{name: "https through a trusted proxy", target: "http://example.com/scanner/", port: "443", peer: "127.0.0.1:1234", proto: "https", status: http.StatusOK},
+		{name: "https claimed by an untrusted peer", target: "http://example.com/scanner/", port: "443", peer: "203.0.113.5:1234", proto: "https", status: http.StatusMovedPermanently, location: "https://example.com/scanner/"},
+	}
+
+	config := &Config{BasePath: "/scanner", TrustedProxies: "127.0.0.1"}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			method := test.method
+			if len(method) == 0 {
+				method = http.MethodGet
+			}
+
+			r := httptest.NewRequest(method, test.target, nil)
+			if len(test.peer) > 0 {
+				r.RemoteAddr = test.peer
+			}
+			if len(test.proto) > 0 {
+				r.Header.Set("X-Forwarded-Proto", test.proto)
+			}
+
+			proxyConfig := config
+			if !strings.HasPrefix(r.URL.Path, "/scanner/") {
+				proxyConfig = &Config{TrustedProxies: config.TrustedProxies}
+			}
+
+			handler := httpProxyHandler(proxyConfig, httpsRedirectHandler(test.port, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.status {
+				t.Fatalf("got status %d, want %d", w.Code, test.status)
+			}
+			if location := w.Header().Get("Location"); location != test.location {
+				t.Errorf("got location %q, want %q", location, test.location)
+			}
+		})
+	}
+}
+
+func TestHttpsSecurityHandler(t *testing.T) {
+	tests := []struct {
+		hsts uint
+		want string
+	}{
+		{hsts: 0, want: ""},
+		{hsts: 31536000, want: "max-age=31536000"},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+
+		httpsSecurityHandler(&Config{SslHsts: test.hsts}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		if got := w.Header().Get("Strict-Transport-Security"); got != test.want {
+			t.Errorf("hsts %d: got %q, want %q", test.hsts, got, test.want)
+		}
+		if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+			t.Errorf("hsts %d: got X-Content-Type-Options %q", test.hsts, got)
+		}
+	}
+}
@@ -16,38 +16,95 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 type Controller struct {
-	Admin       *Admin
-	Api         *Api
-	Calls       *Calls
-	Config      *Config
-	Database    *Database
-	Accesses    *Accesses
-	Apikeys     *Apikeys
-	Dirwatches  *Dirwatches
-	Downstreams *Downstreams
-	FFMpeg      *FFMpeg
-	Groups      *Groups
-	Logs        *Logs
-	Options     *Options
-	Scheduler   *Scheduler
-	Systems     *Systems
-	Tags        *Tags
-	Clients     *Clients
-	Register    chan *Client
-	Unregister  chan *Client
-	Ingest      chan *Call
-	running     bool
+	Admin            *Admin
+	Alerts           *Alerts
+	Api              *Api
+	Calls            *Calls
+	Config           *Config
+	Database         *Database
+	Accesses         *Accesses
+	Apikeys          *Apikeys
+	Archives         *Archives
+	Backups          *Backups
+	Backpressure     *Backpressure
+	AutoMute         *AutoMute
+	Blackouts        *Blackouts
+	Broadcastify     *BroadcastifyFeeds
+	ColdStorage      *ColdStorage
+	Compliance       *Compliance
+	ConfigVersions   *ConfigVersions
+	Cues             *AudioCues
+	Digests          *Digests
+	Dirwatches       *Dirwatches
+	Downstreams      *Downstreams
+	Embeds           *Embeds
+	Events           *Events
+	Export           *Export
+	FFMpeg           *FFMpeg
+	Groups           *Groups
+	GuestPasses      *GuestPasses
+	Health           *Health
+	Incidents        *Incidents
+	Jobs             *Jobs
+	Kiosks           *Kiosks
+	ListenerSessions *ListenerSessions
+	Logins           *Logins
+	Logs             *Logs
+	Mailer           *Mailer
+	Metrics          *Metrics
+	Occupancy        *Occupancy
+	Oidc             *Oidc
+	Openmhz          *OpenmhzImports
+	Options          *Options
+	Pages            *Pages
+	Panics           *Panics
+	Pipeline         *IngestPipeline
+	Publishers       *Publishers
+	Push             *Push
+	RadioReference   *RadioReferenceSyncs
+	Registrations    *Registrations
+	Replication      *Replication
+	Retentions       *Retentions
+	Scheduler        *Scheduler
+	SearchIndex      *SearchIndex
+	Shares           *Shares
+	Stats            *Stats
+	Streams          *Streams
+	Subscriptions    *Subscriptions
+	Systems          *Systems
+	Tags             *Tags
+	Tiers            *Tiers
+	Traces           *CallTraces
+	Transcoder       *Transcoder
+	Transcribers     *Transcribers
+	Users            *AdminUsers
+	Clients          *Clients
+	Register         chan *Client
+	Unregister       chan *Client
+	Ingest           chan *Call
+	drained          chan struct{}
+	populateMutex    sync.Mutex
+	running          bool
+	servers          []*http.Server
+	mutex            sync.Mutex
 }
 
 func NewController(config *Config) *Controller {
@@ -58,22 +115,89 @@ func NewController(config *Config) *Controller {
 		Calls:       NewCalls(),
 		Dirwatches:  NewDirwatches(),
 		Downstreams: NewDownstreams(),
-		FFMpeg:      NewFFMpeg(),
+		FFMpeg:      NewFFMpeg(config.FfmpegWorkers),
 		Groups:      NewGroups(),
+		Logins:      NewLogins(config),
 		Logs:        NewLogs(),
 		Options:     NewOptions(),
+		Retentions:  NewRetentions(),
 		Systems:     NewSystems(),
 		Tags:        NewTags(),
+		Tiers:       NewTiers(),
+		Traces:      NewCallTraces(defaults.callTraces),
+		Users:       NewAdminUsers(),
 		Clients:     NewClients(),
 		Register:    make(chan *Client, 8192),
 		Unregister:  make(chan *Client, 8192),
 		Ingest:      make(chan *Call, 8192),
+		drained:     make(chan struct{}),
+	}
+
+	if audioStore, err := NewAudioStore(config); err == nil {
+		controller.Calls.AudioStore = audioStore
+	} else {
+		log.Fatal(err)
 	}
 
 	controller.Admin = NewAdmin(controller)
+	controller.Alerts = NewAlerts(controller)
 	controller.Api = NewApi(controller)
+	controller.Archives = NewArchives(controller)
+	controller.Backpressure = NewBackpressure(controller)
+	controller.AutoMute = NewAutoMute(controller)
+	controller.Backups = NewBackups(controller)
+	controller.Blackouts = NewBlackouts(controller)
+	controller.ColdStorage = NewColdStorage(controller)
+	controller.Compliance = NewCompliance(controller)
+	controller.ConfigVersions = NewConfigVersions(controller)
+	controller.Cues = NewAudioCues(controller)
+	controller.Digests = NewDigests(controller)
+	controller.Embeds = NewEmbeds(controller)
+	controller.Events = NewEvents(controller)
+	controller.GuestPasses = NewGuestPasses(controller)
+	controller.Health = NewHealth(controller)
+	controller.Incidents = NewIncidents(controller)
+	controller.Jobs = NewJobs(controller)
+	controller.Kiosks = NewKiosks(controller)
+	controller.ListenerSessions = NewListenerSessions(controller)
+	controller.Broadcastify = NewBroadcastifyFeeds(controller)
+	controller.Mailer = NewMailer(controller)
+	controller.Metrics = NewMetrics(controller)
+	controller.Occupancy = NewOccupancy(controller)
+	controller.Oidc = NewOidc(controller)
+	controller.Openmhz = NewOpenmhzImports(controller)
+	controller.Pages = NewPages(controller)
+	controller.Panics = NewPanics(controller)
+	controller.Pipeline = NewIngestPipeline(controller)
+	controller.Publishers = NewPublishers(controller)
+	controller.Push = NewPush(controller)
+	controller.RadioReference = NewRadioReferenceSyncs(controller)
+	controller.Registrations = NewRegistrations(controller)
+	controller.Replication = NewReplication(controller)
 	controller.Database = NewDatabase(config)
+	controller.Export = NewExport(controller)
 	controller.Scheduler = NewScheduler(controller)
+	controller.SearchIndex = NewSearchIndex(controller)
+	controller.Shares = NewShares(controller)
+	controller.Stats = NewStats(controller)
+	controller.Streams = NewStreams(controller)
+	controller.Subscriptions = NewSubscriptions(controller)
+	controller.Transcoder = NewTranscoder(controller)
+	controller.Transcribers = NewTranscribers(controller)
+
+	controller.Jobs.Register(JobKindArchive, controller.Archives.ArchiveJob)
+	controller.Jobs.Register(JobKindBackup, controller.Backups.BackupJob)
+	controller.Jobs.Register(JobKindColdStorage, controller.ColdStorage.RunJob)
+	controller.Jobs.Register(JobKindDigest, controller.Digests.DigestJob)
+	controller.Jobs.Register(JobKindPrune, controller.Scheduler.pruneJob)
+	controller.Jobs.Register(JobKindRestore, controller.Backups.RestoreJob)
+	controller.Jobs.Register(JobKindRetrieve, controller.ColdStorage.RetrieveJob)
+	controller.Jobs.Register(JobKindSearchIndex, controller.SearchIndex.RunJob)
+	controller.Jobs.Register(JobKindTranscode, controller.Transcoder.RunJob)
+	controller.Jobs.Register(JobKindTranscribe, controller.Transcribers.RunJob)
+
+	// listeners must sign in when openid connect is configured for them
+	controller.Accesses.external = controller.Oidc.Enabled() && len(config.OidcListeners) > 0
 
 	controller.Logs.setDaemon(config.daemon)
 	controller.Logs.setDatabase(controller.Database)
@@ -82,233 +206,93 @@ func NewController(config *Config) *Controller {
 }
 
 func (controller *Controller) EmitCall(call *Call) {
-	go controller.Downstreams.Send(controller, call)
-	go controller.Clients.EmitCall(call, controller.Accesses.IsRestricted())
-}
-
-func (controller *Controller) EmitConfig() {
-	go controller.Clients.EmitConfig(controller.Groups, controller.Options, controller.Systems, controller.Tags, controller.Accesses.IsRestricted())
-	go controller.Admin.BroadcastConfig()
-}
-
-func (controller *Controller) IngestCall(call *Call) {
-	var (
-		err        error
-		group      *Group
-		groupId    uint
-		groupLabel string
-		id         uint
-		ok         bool
-		populated  bool
-		system     *System
-		tag        *Tag
-		tagId      uint
-		tagLabel   string
-		talkgroup  *Talkgroup
-	)
-
-	logCall := func(call *Call, level string, message string) {
-		controller.Logs.LogEvent(level, fmt.Sprintf("newcall: system=%v talkgroup=%v file=%v %v", call.System, call.Talkgroup, call.AudioName, message))
-	}
-
-	logError := func(err error) {
-		controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("controller.ingestcall: %v", err.Error()))
-	}
-
-	if system, ok = controller.Systems.GetSystem(call.System); ok {
-		if system.Blacklists.IsBlacklisted(call.Talkgroup) {
-			logCall(call, LogLevelInfo, "blacklisted")
-			return
-		}
-		talkgroup, _ = system.Talkgroups.GetTalkgroup(call.Talkgroup)
-	}
-
-	if controller.Options.AutoPopulate && system == nil {
-		populated = true
-
-		system = NewSystem()
-		system.Id = call.System
-
-		switch v := call.systemLabel.(type) {
-		case string:
-			system.Label = v
-		default:
-			system.Label = fmt.Sprintf("System %v", call.System)
+	if controller.Blackouts.IsBlackedOut(call) {
+		if call.trace != nil {
+			call.trace.AddEvent("delivery suspended by blackout")
 		}
-
-		controller.Systems.List = append(controller.Systems.List, system)
+		return
 	}
 
-	if controller.Options.AutoPopulate || (system != nil && system.AutoPopulate) {
-		if system != nil && talkgroup == nil {
-			populated = true
-
-			switch v := call.talkgroupGroup.(type) {
-			case string:
-				groupLabel = v
-			default:
-				groupLabel = "Unknown"
-			}
-
-			switch v := call.talkgroupTag.(type) {
-			case string:
-				tagLabel = v
-			default:
-				tagLabel = "Untagged"
-			}
-
-			if group, ok = controller.Groups.GetGroup(groupLabel); !ok {
-				group = &Group{Label: groupLabel}
-
-				controller.Groups.List = append(controller.Groups.List, group)
-
-				if err = controller.Groups.Write(controller.Database); err != nil {
-					logError(err)
-					return
-				}
-
-				if err = controller.Groups.Read(controller.Database); err != nil {
-					logError(err)
-					return
-				}
-
-				if group, ok = controller.Groups.GetGroup(groupLabel); !ok {
-					logError(fmt.Errorf("unable to get group %s", groupLabel))
-					return
-				}
-			}
-
-			switch v := group.Id.(type) {
-			case uint:
-				groupId = v
-			default:
-				logError(fmt.Errorf("unable to get group id for group %s", groupLabel))
-				return
-			}
-
-			if tag, ok = controller.Tags.GetTag(tagLabel); !ok {
-				tag = &Tag{Label: tagLabel}
-
-				controller.Tags.List = append(controller.Tags.List, tag)
+	go controller.Downstreams.Send(controller, call)
 
-				if err = controller.Tags.Write(controller.Database); err != nil {
-					logError(err)
-					return
-				}
+	go controller.Broadcastify.Send(call)
 
-				if err = controller.Tags.Read(controller.Database); err != nil {
-					logError(err)
-					return
-				}
+	controller.Streams.Feed(call)
 
-				if tag, ok = controller.Tags.GetTag(tagLabel); !ok {
-					logError(fmt.Errorf("unable to get tag %s", tagLabel))
-					return
-				}
-			}
+	controller.Occupancy.Observe(call, time.Now())
 
-			switch v := tag.Id.(type) {
-			case uint:
-				tagId = v
-			default:
-				logError(fmt.Errorf("unable to get tag id for tag %s", tagLabel))
-				return
-			}
+	// emitted synchronously from the ingest worker of the talkgroup so that
+	// listeners always receive its calls in the order they were ingested
+	var weight uint
+	if system, ok := controller.Systems.GetSystem(call.System); ok {
+		weight = system.QosWeight
+	}
 
-			talkgroup = &Talkgroup{
-				GroupId: groupId,
-				Id:      call.Talkgroup,
-				Label:   fmt.Sprintf("%d", call.Talkgroup),
-				TagId:   tagId,
-			}
+	// the hidden talkgroups don't reach the listeners
+	var count, dropped uint
+	if talkgroup := controller.Systems.GetCallTalkgroup(call); talkgroup == nil || !talkgroup.Hidden {
+		count, dropped = controller.Clients.EmitCall(call, talkgroup.GetDelay(), controller.Accesses.IsRestricted(), weight)
 
-			system.Talkgroups.List = append(system.Talkgroups.List, talkgroup)
-		}
+	} else if call.trace != nil {
+		call.trace.AddEvent("hidden talkgroup, not sent to the listeners")
+	}
 
-		switch v := call.talkgroupLabel.(type) {
-		case string:
-			if talkgroup.Label != v {
-				populated = true
-				talkgroup.Label = v
-			}
-		}
+	controller.Events.EmitCall(call)
 
-		switch v := call.talkgroupName.(type) {
-		case string:
-			if talkgroup.Name != v {
-				populated = true
-				talkgroup.Name = v
-			}
-		default:
-			if len(talkgroup.Name) == 0 {
-				populated = true
-				talkgroup.Name = talkgroup.Label
-			}
-		}
+	if call.trace != nil {
+		call.trace.SetListeners(count)
 
-		switch v := call.units.(type) {
-		case *Units:
-			if v != nil {
-				populated = system.Units.Merge(v)
-			}
+		if dropped > 0 {
+			call.trace.AddEvent(fmt.Sprintf("dropped for %d congested listeners", dropped))
 		}
 	}
+}
 
-	if populated {
-		if err = controller.Systems.Write(controller.Database); err != nil {
-			logError(err)
-			return
-		}
-
-		if err = controller.Systems.Read(controller.Database); err != nil {
-			logError(err)
+func (controller *Controller) EmitConfig() {
+	go func() {
+		// the listeners reconnect once the maintenance is over
+		if message, ok := controller.Pages.Maintenance(); ok {
+			controller.Clients.CloseAll(websocket.CloseTryAgainLater, message)
 			return
 		}
 
-		controller.EmitConfig()
-	}
+		// the listeners over a lowered limit lose their access before the
+		// others sign in again
+		controller.EnforceAccesses()
+		controller.Clients.EmitConfig(controller.Groups, controller.Options, controller.Systems, controller.Tags, controller.Accesses.IsRestricted())
+	}()
+	go controller.Admin.BroadcastConfig()
+}
 
-	if system == nil || talkgroup == nil {
-		logCall(call, LogLevelWarn, "no matching system/talkgroup")
+// EnforceAccesses takes their access away from the listeners whose access
+// code expired and from those over its limit of concurrent connections.
+func (controller *Controller) EnforceAccesses() {
+	if !controller.Accesses.IsRestricted() {
 		return
 	}
 
-	if !controller.Options.DisableDuplicateDetection {
-		if controller.Calls.CheckDuplicate(call, controller.Options.DuplicateDetectionTimeFrame, controller.Database) {
-			logCall(call, LogLevelWarn, "duplicate call rejected")
-			return
-		}
+	if expired, excess := controller.Clients.Enforce(controller.GetListenerAccess); expired > 0 || excess > 0 {
+		controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("access enforcement disconnected %d listener(s) with an expired access and %d over their limit", expired, excess))
 	}
+}
 
-	if err := controller.FFMpeg.Convert(call, controller.Systems, controller.Tags, controller.Options.AudioConversion); err != nil {
-		controller.Logs.LogEvent(LogLevelWarn, err.Error())
-	}
-
-	if id, err = controller.Calls.WriteCall(call, controller.Database); err == nil {
-		call.Id = id
-		call.systemLabel = system.Label
-		call.talkgroupLabel = talkgroup.Label
-		call.talkgroupName = talkgroup.Name
-
-		if group == nil {
-			if group, ok = controller.Groups.GetGroup(talkgroup.GroupId); ok {
-				call.talkgroupGroup = group.Label
-			}
-		}
-
-		if tag == nil {
-			if tag, ok = controller.Tags.GetTag(talkgroup.TagId); ok {
-				call.talkgroupTag = tag.Label
-			}
-		}
-
-		logCall(call, LogLevelInfo, "success")
-
-		controller.EmitCall(call)
+// IngestCall runs the new call through the ingest pipeline.
+func (controller *Controller) IngestCall(call *Call) {
+	controller.Pipeline.Process(call)
+}
 
-	} else {
-		logError(err)
+// GetListenerAccess returns the access of a listener code, be it an openid
+// connect token, a guest pass token or an access code.
+func (controller *Controller) GetListenerAccess(code string) (*Access, bool) {
+	if access, ok := controller.Oidc.GetListenerAccess(code); ok {
+		return access, true
+	} else if access, ok := controller.GuestPasses.GetAccess(code); ok {
+		return access, true
+	} else if access, ok := controller.Accesses.GetAccess(code); ok && !controller.Config.OidcOnly {
+		return access, true
 	}
+
+	return nil, false
 }
 
 func (controller *Controller) LogClientsCount() {
@@ -319,7 +303,7 @@ func (controller *Controller) ProcessMessage(client *Client, message *Message) e
 	if message.Command == MessageCommandVersion {
 		controller.ProcessMessageCommandVersion(client)
 
-	} else if controller.Accesses.IsRestricted() && client.Access.Systems == nil && message.Command != MessageCommandPin {
+	} else if controller.Accesses.IsRestricted() && client.GetAccess().Systems == nil && message.Command != MessageCommandPin {
 		client.Send <- &Message{Command: MessageCommandPin}
 
 	} else if message.Command == MessageCommandCall {
@@ -330,18 +314,42 @@ func (controller *Controller) ProcessMessage(client *Client, message *Message) e
 	} else if message.Command == MessageCommandConfig {
 		client.SendConfig(controller.Groups, controller.Options, controller.Systems, controller.Tags)
 
+	} else if message.Command == MessageCommandCue {
+		// the speech can take a while, the other messages are not held back
+		go controller.Cues.Request(client, message.Payload)
+
 	} else if message.Command == MessageCommandListCall {
 		if err := controller.ProcessMessageCommandListCall(client, message); err != nil {
 			return err
 		}
 
+	} else if message.Command == MessageCommandKiosk {
+		controller.ProcessMessageCommandKiosk(client, message)
+
 	} else if message.Command == MessageCommandLivefeedMap {
 		controller.ProcessMessageCommandLivefeedMap(client, message)
 
+	} else if message.Command == MessageCommandNowPlaying {
+		controller.ProcessMessageCommandNowPlaying(client, message)
+
 	} else if message.Command == MessageCommandPin {
 		if err := controller.ProcessMessageCommandPin(client, message); err != nil {
 			return err
 		}
+
+	} else if message.Command == MessageCommandShare {
+		if err := controller.ProcessMessageCommandShare(client, message); err != nil {
+			return err
+		}
+
+	} else if message.Command == MessageCommandSites {
+		client.Livefeed.SetSites(message.Payload)
+
+	} else if message.Command == MessageCommandSubscriptions {
+		controller.ProcessMessageCommandSubscriptions(client, message)
+
+	} else if message.Command == MessageCommandSync {
+		controller.ProcessMessageCommandSync(client, message)
 	}
 
 	return nil
@@ -366,12 +374,32 @@ func (controller *Controller) ProcessMessageCommandCall(client *Client, message
 		}
 	}
 
-	if call, err = controller.Calls.GetCall(id, controller.Database); err != nil {
+	if call, err = controller.Calls.GetCall(id, controller.Database); errors.Is(err, ErrCallNotFound) {
+		return nil
+	} else if err != nil {
 		return err
 	}
 
-	if !controller.Accesses.IsRestricted() || client.Access.HasAccess(call) {
-		client.Send <- &Message{Command: MessageCommandCall, Payload: call, Flag: message.Flag}
+	if controller.Blackouts.IsBlackedOut(call) {
+		return nil
+	}
+
+	tier := client.GetTier()
+
+	if !tier.IsAvailable(call) || !controller.Systems.GetCallTalkgroup(call).IsAvailable(call) || (message.Flag == "d" && tier != nil && !tier.Download) {
+		return nil
+	}
+
+	if !controller.Accesses.IsRestricted() || client.GetAccess().HasAccess(call) {
+		// the call comes without its audio, which the listener asks again
+		// once retrieved
+		if call.Cold {
+			if err = controller.ColdStorage.Retrieve(call); err != nil {
+				return err
+			}
+		}
+
+		client.Send <- &Message{Command: MessageCommandCall, Payload: tier.RedactCall(call), Flag: message.Flag}
 	}
 
 	return nil
@@ -392,7 +420,7 @@ func (controller *Controller) ProcessMessageCommandListCall(client *Client, mess
 }
 
 func (controller *Controller) ProcessMessageCommandLivefeedMap(client *Client, message *Message) {
-	client.Livefeed.FromMap(message.Payload)
+	client.Livefeed.FromMap(message.Payload).SetMetadata(message.Flag == LivefeedFlagMetadata)
 	client.Send <- &Message{Command: MessageCommandLivefeedMap, Payload: !client.Livefeed.IsAllOff()}
 }
 
@@ -413,31 +441,43 @@ func (controller *Controller) ProcessMessageCommandPin(client *Client, message *
 		}
 
 		if controller.Accesses.IsRestricted() {
+			remoteAddr := client.GetRemoteAddr()
+
+			if ok, _ := controller.Logins.Allow(LoginKindAccess, remoteAddr); !ok {
+				client.Send <- &Message{Command: MessageCommandPin}
+				return nil
+			}
+
 			code := string(b)
-			if access, ok := controller.Accesses.GetAccess(code); ok {
-				client.Access = access
+			if access, ok := controller.GetListenerAccess(code); ok {
+				client.SetAccess(access)
 			} else {
-				controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("invalid access code %s for ip %s", code, client.GetRemoteAddr()))
+				controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("invalid access code %s for ip %s", code, remoteAddr))
+				if locked, until := controller.Logins.Fail(LoginKindAccess, remoteAddr); locked {
+					controller.Logs.LogEvent(LogLevelWarn, loginLockedMessage(LoginKindAccess, remoteAddr, until))
+				}
 				client.Send <- &Message{Command: MessageCommandPin}
 				return nil
 			}
 
+			controller.Logins.Succeed(LoginKindAccess, remoteAddr)
+
 			if client.AuthCount == maxAuthCount {
-				controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("locked access for ident %s locked", client.Access.Ident))
+				controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("locked access for ident %s locked", client.GetAccess().Ident))
 				client.Send <- &Message{Command: MessageCommandPin}
 				return nil
 			}
 
-			if client.Access.HasExpired() {
-				controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("expired access for ident %s", client.Access.Ident))
+			if client.GetAccess().HasExpired() {
+				controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("expired access for ident %s", client.GetAccess().Ident))
 				client.Send <- &Message{Command: MessageCommandExpired}
 				return nil
 			}
 
-			switch v := client.Access.Limit.(type) {
+			switch v := client.GetAccess().Limit.(type) {
 			case uint:
-				if controller.Clients.AccessCount(client) > int(v) {
-					controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("too many concurrent connections for ident %s, limit is %d", client.Access.Ident, client.Access.Limit))
+				if v > 0 && controller.Clients.AccessCount(client) >= int(v) {
+					controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("too many concurrent connections for ident %s, limit is %d", client.GetAccess().Ident, client.GetAccess().Limit))
 					client.Send <- &Message{Command: MessageCommandMax}
 					return nil
 				}
@@ -452,6 +492,21 @@ func (controller *Controller) ProcessMessageCommandPin(client *Client, message *
 	return nil
 }
 
+func (controller *Controller) ProcessMessageCommandSync(client *Client, message *Message) {
+	switch v := message.Payload.(type) {
+	case float64:
+		controller.Logs.LogEvent(LogLevelInfo, fmt.Sprintf("resync requested after seq %v from ip %s", uint64(v), client.GetRemoteAddr()))
+	}
+
+	client.Send <- &Message{Command: MessageCommandSync}
+
+	client.SendConfig(controller.Groups, controller.Options, controller.Systems, controller.Tags)
+
+	if controller.Options.ShowListenersCount {
+		client.SendListenersCount(controller.Clients.Count())
+	}
+}
+
 func (controller *Controller) ProcessMessageCommandVersion(client *Client) {
 	p := map[string]string{"version": Version}
 
@@ -481,50 +536,62 @@ func (controller *Controller) Start() error {
 		log.Printf("base folder is %s\n", controller.Config.BaseDir)
 	}
 
-	if err = controller.Accesses.Read(controller.Database); err != nil {
-		return err
-	}
-	if err = controller.Apikeys.Read(controller.Database); err != nil {
-		return err
-	}
-	if err = controller.Dirwatches.Read(controller.Database); err != nil {
-		return err
-	}
-	if err = controller.Downstreams.Read(controller.Database); err != nil {
-		return err
-	}
-	if err = controller.Groups.Read(controller.Database); err != nil {
-		return err
-	}
-	if err = controller.Options.Read(controller.Database); err != nil {
-		return err
-	}
-	if err = controller.Systems.Read(controller.Database); err != nil {
-		return err
-	}
-	if err = controller.Tags.Read(controller.Database); err != nil {
-		return err
-	}
-
-	if err = controller.Admin.Start(); err != nil {
-		return err
-	}
-	if err = controller.Scheduler.Start(); err != nil {
+	// the services start once the parts of the configuration they use are
+	// read, the listeners and the uploads being served after all
+	modules := append(controller.configModules(), []startupModule{
+		{name: "admin.start", start: controller.Admin.Start},
+		{name: "backups.start", after: []string{"options"}, start: controller.Backups.Start},
+		{name: "configversions.start", after: []string{"accesses", "alerts", "apikeys", "broadcastify", "dirwatches", "downstreams", "groups", "openmhz", "options", "publishers", "radioreference", "retentions", "streams", "systems", "tags", "tiers", "transcribers"}, start: controller.ConfigVersions.Start},
+		{name: "digests.start", after: []string{"options"}, start: controller.Digests.Start},
+		{name: "dirwatches.start", after: []string{"dirwatches", "options", "replication.start", "systems"}, start: func() error {
+			if !controller.Replication.Standby() {
+				controller.Dirwatches.Start(controller)
+			}
+			return nil
+		}},
+		{name: "downstreams.start", start: func() error { return controller.Downstreams.Start(controller.Config) }},
+		{name: "events.start", after: []string{"systems"}, start: controller.Events.Start},
+		{name: "export.start", start: controller.Export.Start},
+		{name: "jobs.start", after: []string{"jobs"}, start: controller.Jobs.Start},
+		{name: "listeners.start", start: controller.ListenerSessions.Start},
+		{name: "metrics.start", start: controller.Metrics.Start},
+		{name: "occupancy.start", after: []string{"accesses", "options"}, start: controller.Occupancy.Start},
+		{name: "openmhz.start", after: []string{"openmhz", "systems"}, start: controller.Openmhz.Start},
+		{name: "radioreference.start", after: []string{"radioreference", "systems"}, start: controller.RadioReference.Start},
+		{name: "replication.start", after: []string{"configversions.start"}, start: controller.Replication.Start},
+		{name: "scheduler.start", after: []string{"options", "retentions"}, start: controller.Scheduler.Start},
+		{name: "searchindex.start", after: []string{"jobs.start", "systems"}, start: controller.SearchIndex.Start},
+		{name: "streams.start", after: []string{"streams"}, start: controller.Streams.Start},
+		{name: "transcribers.start", after: []string{"transcribers"}, start: controller.Transcribers.Start},
+	}...)
+
+	if err = runStartup(modules, log.Printf); err != nil {
 		return err
 	}
 
 	go func() {
 		c := make(chan os.Signal, 8)
-		signal.Notify(c, os.Interrupt)
+		signal.Notify(c, os.Interrupt, syscall.SIGHUP, syscall.SIGTERM)
+		for sig := range c {
+			if sig == syscall.SIGHUP {
+				controller.Reload()
+				continue
+			}
+			break
+		}
+
+		go controller.Terminate()
+
+		// a second signal doesn't wait for the shutdown to complete
 		<-c
-		controller.Terminate()
+		log.Println("terminated without waiting")
+		os.Exit(1)
 	}()
 
+	// a nil call is queued by the shutdown once no more calls come in
 	go func() {
-		for {
-			call := <-controller.Ingest
-			controller.IngestCall(call)
-		}
+		controller.Pipeline.Run(controller.Ingest, controller.Config.IngestWorkers)
+		close(controller.drained)
 	}()
 
 	go func() {
@@ -534,6 +601,7 @@ func (controller *Controller) Start() error {
 		)
 
 		var (
+			enforce               = time.NewTicker(time.Minute)
 			timeout time.Duration = minTimeout
 			timer   *time.Timer
 		)
@@ -554,6 +622,8 @@ func (controller *Controller) Start() error {
 
 				controller.LogClientsCount()
 
+				controller.Events.EmitListeners(controller.Clients.Count())
+
 				if controller.Options.ShowListenersCount {
 					controller.Clients.EmitListenersCount()
 				}
@@ -566,20 +636,153 @@ func (controller *Controller) Start() error {
 				controller.Clients.Add(client)
 				doClientsCount()
 
+				// two listeners signing in at once both pass the limit
+				controller.EnforceAccesses()
+
+				if err := controller.ListenerSessions.Open(client.session); err != nil {
+					controller.Logs.LogEvent(LogLevelError, err.Error())
+				}
+
 			case client := <-controller.Unregister:
 				controller.Clients.Remove(client)
+				controller.Kiosks.Unpair(client)
 				doClientsCount()
+
+				if err := controller.ListenerSessions.Close(client.session); err != nil {
+					controller.Logs.LogEvent(LogLevelError, err.Error())
+				}
+
+			case <-enforce.C:
+				controller.EnforceAccesses()
 			}
 		}
 	}()
 
-	controller.Dirwatches.Start(controller)
-
 	return nil
 }
 
+// ReadConfig reads the configuration from the database.
+func (controller *Controller) ReadConfig() error {
+	return runStartup(controller.configModules(), nil)
+}
+
+// configModules reads each part of the configuration from the database, the
+// parts not depending on each other.
+func (controller *Controller) configModules() []startupModule {
+	return []startupModule{
+		{name: "accesses", start: func() error { return controller.Accesses.Read(controller.Database) }},
+		{name: "alerts", start: func() error { return controller.Alerts.Read(controller.Database) }},
+		{name: "apikeys", start: func() error { return controller.Apikeys.Read(controller.Database) }},
+		{name: "blackouts", start: func() error { return controller.Blackouts.Read(controller.Database) }},
+		{name: "broadcastify", start: func() error { return controller.Broadcastify.Read(controller.Database) }},
+		{name: "dirwatches", start: func() error { return controller.Dirwatches.Read(controller.Database) }},
+		{name: "downstreams", start: func() error { return controller.Downstreams.Read(controller.Database) }},
+		{name: "embeds", start: func() error { return controller.Embeds.Read(controller.Database) }},
+		{name: "groups", start: func() error { return controller.Groups.Read(controller.Database) }},
+		{name: "guestpasses", start: func() error { return controller.GuestPasses.Read(controller.Database) }},
+		{name: "incidents", start: func() error { return controller.Incidents.Read(controller.Database) }},
+		{name: "jobs", start: func() error { return controller.Jobs.Read(controller.Database) }},
+		{name: "kiosks", start: func() error { return controller.Kiosks.Read(controller.Database) }},
+		{name: "openmhz", start: func() error { return controller.Openmhz.Read(controller.Database) }},
+		{name: "options", start: func() error { return controller.Options.Read(controller.Database) }},
+		{name: "publishers", start: func() error { return controller.Publishers.Read(controller.Database) }},
+		{name: "radioreference", start: func() error { return controller.RadioReference.Read(controller.Database) }},
+		{name: "push", start: func() error { return controller.Push.Read(controller.Database) }},
+		{name: "registrations", start: func() error { return controller.Registrations.Read(controller.Database) }},
+		{name: "retentions", start: func() error { return controller.Retentions.Read(controller.Database) }},
+		{name: "streams", start: func() error { return controller.Streams.Read(controller.Database) }},
+		{name: "subscriptions", start: func() error { return controller.Subscriptions.Read(controller.Database) }},
+		{name: "systems", start: func() error { return controller.Systems.Read(controller.Database) }},
+		{name: "tags", start: func() error { return controller.Tags.Read(controller.Database) }},
+		{name: "tiers", start: func() error { return controller.Tiers.Read(controller.Database) }},
+		{name: "transcribers", start: func() error { return controller.Transcribers.Read(controller.Database) }},
+		{name: "users", start: func() error { return controller.Users.Read(controller.Database) }},
+	}
+}
+
+// Reload applies the settings of the config file that can change while
+// running and reads the configuration back from the database, without
+// dropping the listeners or the uploads in progress.
+func (controller *Controller) Reload() {
+	controller.Logs.LogEvent(LogLevelWarn, "reloading configuration")
+
+	if restart, err := controller.Config.Reload(); err != nil {
+		controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("controller.reload: %v", err))
+	} else if len(restart) > 0 {
+		controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("changes to %s settings require a restart", strings.Join(restart, ", ")))
+	}
+
+	if _, err := ParseTrustedProxies(controller.Config.TrustedProxies); err != nil {
+		controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("controller.reload: %v, no proxy is trusted", err))
+	}
+
+	controller.Logins.Configure(controller.Config)
+	controller.Accesses.external = controller.Oidc.Enabled() && len(controller.Config.OidcListeners) > 0
+
+	controller.Dirwatches.Stop()
+
+	if err := controller.ReadConfig(); err != nil {
+		controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("controller.reload: %v", err))
+	}
+
+	controller.EmitConfig()
+	controller.Admin.BroadcastConfig()
+
+	if !controller.Replication.Standby() {
+		controller.Dirwatches.Start(controller)
+	}
+}
+
+// Serve registers an http server to be shut down gracefully on terminate.
+func (controller *Controller) Serve(server *http.Server) {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+
+	controller.servers = append(controller.servers, server)
+}
+
+// Terminate stops taking new calls and listeners, lets the requests in
+// progress complete and the queued calls be written, then exits.
 func (controller *Controller) Terminate() {
+	const shutdownTimeout = 30 * time.Second
+
+	log.Println("shutting down")
+
+	controller.Logs.LogEvent(LogLevelWarn, "server shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
 	controller.Dirwatches.Stop()
+	controller.Replication.Stop()
+
+	controller.mutex.Lock()
+	servers := controller.servers
+	controller.mutex.Unlock()
+
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Println(err)
+		}
+	}
+
+	controller.Clients.CloseAll(websocket.CloseGoingAway, "The scanner is restarting, it will be back in a moment.")
+
+	if err := controller.ListenerSessions.CloseAll(); err != nil {
+		log.Println(err)
+	}
+
+	if controller.running {
+		select {
+		case controller.Ingest <- nil:
+			select {
+			case <-controller.drained:
+			case <-ctx.Done():
+				log.Printf("shutdown timeout, %d queued calls not written", len(controller.Ingest)+controller.Pipeline.Pending())
+			}
+		case <-ctx.Done():
+		}
+	}
 
 	if err := controller.Database.Sql.Close(); err != nil {
 		log.Println(err)
@@ -0,0 +1,192 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var cronShortcuts = map[string]string{
+	"@daily":   "0 0 * * *",
+	"@hourly":  "0 * * * *",
+	"@monthly": "0 0 1 * *",
+	"@weekly":  "0 0 * * 0",
+}
+
+// Cron is a schedule written as the five fields of a crontab, "minute hour
+// day-of-month month day-of-week", ie: "30 3 * * *" every day at 3:30 or
+// "0 */6 * * mon-fri" every 6 hours on weekdays. The fields take lists,
+// ranges and steps, and as in cron a day matches either of the day fields
+// when both are restricted. The day of week ranges may wrap around the week,
+// ie: fri-mon. The @hourly, @daily, @weekly and @monthly
+// shortcuts are understood.
+type Cron struct {
+	days     [32]bool
+	hours    [24]bool
+	minutes  [60]bool
+	months   [13]bool
+	weekdays [8]bool
+	anyDay   bool
+	anyWday  bool
+}
+
+func ParseCron(s string) (*Cron, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+
+	if v, ok := cronShortcuts[s]; ok {
+		s = v
+	}
+
+	f := strings.Fields(s)
+	if len(f) != 5 {
+		return nil, fmt.Errorf("invalid cron %q, expected 5 fields", s)
+	}
+
+	cron := &Cron{anyDay: f[2] == "*", anyWday: f[4] == "*"}
+
+	fields := []struct {
+		name  string
+		value string
+		set   []bool
+		lo    int
+		names map[string]int
+	}{
+		{"minute", f[0], cron.minutes[:], 0, nil},
+		{"hour", f[1], cron.hours[:], 0, nil},
+		{"day of month", f[2], cron.days[:], 1, nil},
+		{"month", f[3], cron.months[:], 1, cronMonths},
+		{"day of week", f[4], cron.weekdays[:], 0, cronWeekdays},
+	}
+
+	for _, field := range fields {
+		if err := cronParseField(field.value, field.set, field.lo, field.names); err != nil {
+			return nil, fmt.Errorf("invalid cron %s %q, %v", field.name, field.value, err)
+		}
+	}
+
+	return cron, nil
+}
+
+var cronMonths = map[string]int{"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6, "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12}
+
+var cronWeekdays = map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}
+
+// cronParseField sets the values of a field from lo to the size of the set,
+// the named fields taking their names as values.
+func cronParseField(s string, set []bool, lo int, names map[string]int) error {
+	hi := len(set) - 1
+
+	value := func(s string) (int, error) {
+		if n, ok := names[s]; ok {
+			return n, nil
+		}
+
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a number", s)
+		}
+
+		if n < lo || n > hi {
+			return 0, fmt.Errorf("%d is out of %d-%d", n, lo, hi)
+		}
+
+		return n, nil
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		var (
+			err   error
+			first = lo
+			last  = hi
+			step  = 1
+			wrap  bool
+		)
+
+		if i := strings.Index(part, "/"); i >= 0 {
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return fmt.Errorf("invalid step %q", part[i+1:])
+			}
+			part = part[:i]
+		}
+
+		switch i := strings.Index(part, "-"); {
+		case part == "*":
+
+		case i > 0:
+			if first, err = value(part[:i]); err != nil {
+				return err
+			}
+			if last, err = value(part[i+1:]); err != nil {
+				return err
+			}
+			if last < first {
+				// only the week goes round
+				if names == nil || lo != 0 || hi != 7 {
+					return fmt.Errorf("invalid range %q", part)
+				}
+				wrap = true
+			}
+
+		default:
+			if first, err = value(part); err != nil {
+				return err
+			}
+			if step == 1 {
+				last = first
+			}
+		}
+
+		if wrap {
+			// sunday counts once
+			for k := 0; k <= (last-first+7)%7; k += step {
+				set[(first+k)%7] = true
+			}
+			continue
+		}
+
+		for n := first; n <= last; n += step {
+			set[n] = true
+		}
+	}
+
+	return nil
+}
+
+// Match tells whether the schedule runs at the minute of t.
+func (cron *Cron) Match(t time.Time) bool {
+	if !cron.minutes[t.Minute()] || !cron.hours[t.Hour()] || !cron.months[t.Month()] {
+		return false
+	}
+
+	day := cron.days[t.Day()]
+
+	// sunday is both 0 and 7
+	wday := cron.weekdays[t.Weekday()] || (t.Weekday() == time.Sunday && cron.weekdays[7])
+
+	switch {
+	case cron.anyDay && cron.anyWday:
+		return true
+	case cron.anyDay:
+		return wday
+	case cron.anyWday:
+		return day
+	default:
+		return day || wday
+	}
+}
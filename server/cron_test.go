@@ -0,0 +1,81 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	// 2026-10-12 is a monday
+	at := func(day int, hour int, minute int) time.Time {
+		return time.Date(2026, 10, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name    string
+		cron    string
+		wantErr bool
+		match   []time.Time
+		miss    []time.Time
+	}{
+		{name: "every minute", cron: "* * * * *", match: []time.Time{at(12, 0, 0), at(31, 23, 59)}},
+		{name: "fixed time", cron: "30 3 * * *", match: []time.Time{at(12, 3, 30), at(13, 3, 30)}, miss: []time.Time{at(12, 3, 31), at(12, 4, 30)}},
+		{name: "list", cron: "0,15,45 * * * *", match: []time.Time{at(12, 1, 15), at(12, 1, 45)}, miss: []time.Time{at(12, 1, 30)}},
+		{name: "range", cron: "0 9-17 * * *", match: []time.Time{at(12, 9, 0), at(12, 17, 0)}, miss: []time.Time{at(12, 8, 0), at(12, 18, 0)}},
+		{name: "step", cron: "*/20 */6 * * *", match: []time.Time{at(12, 0, 0), at(12, 6, 40), at(12, 18, 20)}, miss: []time.Time{at(12, 6, 10), at(12, 5, 0)}},
+		{name: "range with step", cron: "10-50/20 * * * *", match: []time.Time{at(12, 0, 10), at(12, 0, 30), at(12, 0, 50)}, miss: []time.Time{at(12, 0, 20), at(12, 0, 0)}},
+		{name: "value with step", cron: "50/5 * * * *", match: []time.Time{at(12, 0, 50), at(12, 0, 55)}, miss: []time.Time{at(12, 0, 45)}},
+		{name: "weekday names", cron: "0 0 * * mon-fri", match: []time.Time{at(12, 0, 0), at(16, 0, 0)}, miss: []time.Time{at(17, 0, 0), at(18, 0, 0)}},
+		{name: "weekdays wrapping the week", cron: "0 0 * * fri-mon", match: []time.Time{at(16, 0, 0), at(18, 0, 0), at(19, 0, 0)}, miss: []time.Time{at(13, 0, 0), at(15, 0, 0)}},
+		{name: "sunday as 7", cron: "0 0 * * 7", match: []time.Time{at(18, 0, 0)}, miss: []time.Time{at(17, 0, 0)}},
+		{name: "month names", cron: "0 0 1 oct,dec *", match: []time.Time{at(1, 0, 0)}, miss: []time.Time{time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)}},
+		{name: "day of month", cron: "0 0 13 * *", match: []time.Time{at(13, 0, 0)}, miss: []time.Time{at(12, 0, 0)}},
+		{name: "day of month or of week", cron: "0 0 13 * sun", match: []time.Time{at(13, 0, 0), at(18, 0, 0)}, miss: []time.Time{at(12, 0, 0), at(14, 0, 0)}},
+		{name: "day of week with any day of month", cron: "0 0 * * sun", match: []time.Time{at(18, 0, 0)}, miss: []time.Time{at(13, 0, 0)}},
+		{name: "shortcut", cron: "@Daily", match: []time.Time{at(12, 0, 0)}, miss: []time.Time{at(12, 1, 0)}},
+		{name: "weekly", cron: "@weekly", match: []time.Time{at(18, 0, 0)}, miss: []time.Time{at(12, 0, 0)}},
+		{name: "too few fields", cron: "* * * *", wantErr: true},
+		{name: "too many fields", cron: "* * * * * *", wantErr: true},
+		{name: "out of range", cron: "60 * * * *", wantErr: true},
+		{name: "day of month zero", cron: "0 0 0 * *", wantErr: true},
+		{name: "reversed range", cron: "0 17-9 * * *", wantErr: true},
+		{name: "zero step", cron: "*/0 * * * *", wantErr: true},
+		{name: "unknown name", cron: "0 0 * * xyz", wantErr: true},
+		{name: "month name as a weekday", cron: "0 0 * * jan", wantErr: true},
+		{name: "unknown shortcut", cron: "@yearly", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cron, err := ParseCron(test.cron)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseCron(%q) error = %v, want error %v", test.cron, err, test.wantErr)
+			}
+			for _, tm := range test.match {
+				if !cron.Match(tm) {
+					t.Errorf("%q doesn't match %s", test.cron, tm.Format("Mon Jan 2 15:04"))
+				}
+			}
+			for _, tm := range test.miss {
+				if cron.Match(tm) {
+					t.Errorf("%q matches %s", test.cron, tm.Format("Mon Jan 2 15:04"))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,379 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The tones of the audio cues tell the calls apart either by their system
+// or by their priority.
+const (
+	CueTonesNone     = ""
+	CueTonesPriority = "priority"
+	CueTonesSystem   = "system"
+)
+
+const (
+	cueCacheMax   = 1000
+	cueSampleRate = 16000
+	cueSpeechMax  = 4 << 20
+	cueTimeout    = 10 * time.Second
+	cueWorkers    = 2
+)
+
+// the notes of a pentatonic scale, easy to tell apart and never dissonant
+var cueSystemNotes = []float64{523.25, 587.33, 659.25, 783.99, 880, 1046.5, 1174.66, 1318.51}
+
+// AudioCues generates the audible cues played before the calls by the
+// webapp, for the listeners who can't read the display: a tone telling the
+// system or the priority of the call, then the talkgroup spoken by the text
+// to speech command of the config. The cues are the same for all the calls
+// of a talkgroup, they are cached.
+type AudioCues struct {
+	Controller *Controller
+	cache      map[string][]byte
+	mutex      sync.Mutex
+	workers    chan struct{}
+}
+
+// CueRequest is a cue asked by a listener, the key being echoed back for
+// the webapp to match it with its calls.
+type CueRequest struct {
+	Emergency bool
+	Key       string
+	Priority  uint
+	Speech    bool
+	System    uint
+	Talkgroup uint
+	Tones     string
+}
+
+func NewCueRequest(f any) (*CueRequest, bool) {
+	m, ok := f.(map[string]any)
+	if !ok {
+		return nil, false
+	}
+
+	request := &CueRequest{}
+
+	switch v := m["emergency"].(type) {
+	case bool:
+		request.Emergency = v
+	}
+
+	switch v := m["key"].(type) {
+	case string:
+		if len(v) > 64 {
+			return nil, false
+		}
+		request.Key = v
+	}
+
+	switch v := m["priority"].(type) {
+	case float64:
+		if v > 0 {
+			request.Priority = uint(v)
+		}
+	}
+
+	switch v := m["speech"].(type) {
+	case bool:
+		request.Speech = v
+	}
+
+	switch v := m["system"].(type) {
+	case float64:
+		request.System = uint(v)
+	}
+
+	switch v := m["talkgroup"].(type) {
+	case float64:
+		request.Talkgroup = uint(v)
+	}
+
+	switch v := m["tones"].(type) {
+	case string:
+		switch v {
+		case CueTonesNone, CueTonesPriority, CueTonesSystem:
+			request.Tones = v
+		default:
+			return nil, false
+		}
+	}
+
+	if request.System == 0 || request.Talkgroup == 0 {
+		return nil, false
+	}
+
+	return request, true
+}
+
+func NewAudioCues(controller *Controller) *AudioCues {
+	return &AudioCues{
+		Controller: controller,
+		cache:      map[string][]byte{},
+		mutex:      sync.Mutex{},
+		workers:    make(chan struct{}, cueWorkers),
+	}
+}
+
+// Request sends the cue of the request to the listener, provided the audio
+// cues are turned on and the listener has access to the talkgroup, whose
+// name would be spoken otherwise.
+func (cues *AudioCues) Request(client *Client, payload any) {
+	controller := cues.Controller
+
+	if !controller.Options.AudioCues {
+		return
+	}
+
+	request, ok := NewCueRequest(payload)
+	if !ok {
+		return
+	}
+
+	call := &Call{System: request.System, Talkgroup: request.Talkgroup}
+
+	if controller.Accesses.IsRestricted() && !client.GetAccess().HasAccess(call) {
+		return
+	}
+
+	p := map[string]any{"key": request.Key}
+
+	if tone := cues.Tone(request); tone != nil {
+		p["tone"] = tone
+	}
+
+	if request.Speech {
+		if speech, err := cues.Speak(cues.Text(request)); err == nil {
+			p["speech"] = speech
+		} else {
+			controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("audiocues.request: %v", err))
+		}
+	}
+
+	client.Deliver(&Message{Command: MessageCommandCue, Payload: p})
+}
+
+// Speak returns the wav file of the text spoken by the text to speech
+// command. The command is run without a shell, with the text on its stdin.
+func (cues *AudioCues) Speak(text string) ([]byte, error) {
+	key := "speech:" + text
+
+	if b, ok := cues.cached(key); ok {
+		return b, nil
+	}
+
+	args := strings.Fields(cues.Controller.Config.TtsCommand)
+	if len(args) == 0 {
+		return nil, errors.New("no tts_command")
+	}
+
+	cues.workers <- struct{}{}
+	defer func() { <-cues.workers }()
+
+	// spoken while waiting for a worker
+	if b, ok := cues.cached(key); ok {
+		return b, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cueTimeout)
+	defer cancel()
+
+	stdout := &limitedBuffer{max: cueSpeechMax}
+	stderr := &bytes.Buffer{}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %v %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	if stdout.Len() == 0 {
+		return nil, fmt.Errorf("%s: no audio", args[0])
+	}
+
+	b := stdout.Bytes()
+
+	cues.store(key, b)
+
+	return b, nil
+}
+
+// Text returns what is spoken before the calls of the talkgroup.
+func (cues *AudioCues) Text(request *CueRequest) string {
+	text := fmt.Sprintf("talkgroup %d", request.Talkgroup)
+
+	if system, ok := cues.Controller.Systems.GetSystem(request.System); ok {
+		if talkgroup, ok := system.Talkgroups.GetTalkgroup(request.Talkgroup); ok {
+			if len(talkgroup.Name) > 0 {
+				text = talkgroup.Name
+			} else if len(talkgroup.Label) > 0 {
+				text = talkgroup.Label
+			}
+		}
+	}
+
+	if request.Emergency {
+		text = "emergency, " + text
+	}
+
+	return text
+}
+
+// Tone returns the wav file of the tone of the request. By system, each
+// system has a note of its own. By priority, the emergencies are three high
+// beeps, the calls with a priority two beeps whose pitch lowers as the
+// priority number grows, and the other calls a single low beep.
+func (cues *AudioCues) Tone(request *CueRequest) []byte {
+	var (
+		freq  float64
+		count int
+	)
+
+	switch request.Tones {
+	case CueTonesSystem:
+		freq = cueSystemNotes[request.System%uint(len(cueSystemNotes))]
+		count = 1
+
+	case CueTonesPriority:
+		switch {
+		case request.Emergency:
+			freq, count = 1318.51, 3
+		case request.Priority > 0:
+			level := request.Priority
+			if level > 4 {
+				level = 4
+			}
+			freq, count = 1046.5/math.Pow(2, float64(level-1)/4), 2
+		default:
+			freq, count = 523.25, 1
+		}
+
+	default:
+		return nil
+	}
+
+	key := fmt.Sprintf("tone:%.2f:%d", freq, count)
+
+	if b, ok := cues.cached(key); ok {
+		return b
+	}
+
+	b := cueTone(freq, count, 120*time.Millisecond, 80*time.Millisecond)
+
+	cues.store(key, b)
+
+	return b
+}
+
+func (cues *AudioCues) cached(key string) ([]byte, bool) {
+	cues.mutex.Lock()
+	defer cues.mutex.Unlock()
+
+	b, ok := cues.cache[key]
+
+	return b, ok
+}
+
+func (cues *AudioCues) store(key string, b []byte) {
+	cues.mutex.Lock()
+	defer cues.mutex.Unlock()
+
+	// the texts come from the talkgroups, the cache only fills up when they
+	// are renamed many times
+	if len(cues.cache) >= cueCacheMax {
+		cues.cache = map[string][]byte{}
+	}
+
+	cues.cache[key] = b
+}
+
+// cueTone returns a wav file of count beeps of the frequency, faded in and
+// out to not click.
+func cueTone(freq float64, count int, beep time.Duration, gap time.Duration) []byte {
+	const fade = cueSampleRate / 200
+
+	beepSamples := int(beep.Seconds() * cueSampleRate)
+	gapSamples := int(gap.Seconds() * cueSampleRate)
+
+	samples := make([]int16, 0, count*(beepSamples+gapSamples))
+
+	for n := 0; n < count; n++ {
+		for i := 0; i < beepSamples; i++ {
+			gain := 0.5
+			if i < fade {
+				gain *= float64(i) / fade
+			} else if i >= beepSamples-fade {
+				gain *= float64(beepSamples-i) / fade
+			}
+
+			samples = append(samples, int16(gain*math.MaxInt16*math.Sin(2*math.Pi*freq*float64(i)/cueSampleRate)))
+		}
+
+		samples = append(samples, make([]int16, gapSamples)...)
+	}
+
+	return wavEncode(samples, cueSampleRate)
+}
+
+// wavEncode returns the pcm samples, mono on 16 bits, as a wav file.
+func wavEncode(samples []int16, rate uint32) []byte {
+	b := &bytes.Buffer{}
+
+	b.WriteString("RIFF")
+	binary.Write(b, binary.LittleEndian, uint32(36+len(samples)*2))
+	b.WriteString("WAVEfmt ")
+	binary.Write(b, binary.LittleEndian, uint32(16))
+	binary.Write(b, binary.LittleEndian, uint16(1))
+	binary.Write(b, binary.LittleEndian, uint16(1))
+	binary.Write(b, binary.LittleEndian, rate)
+	binary.Write(b, binary.LittleEndian, rate*2)
+	binary.Write(b, binary.LittleEndian, uint16(2))
+	binary.Write(b, binary.LittleEndian, uint16(16))
+	b.WriteString("data")
+	binary.Write(b, binary.LittleEndian, uint32(len(samples)*2))
+	binary.Write(b, binary.LittleEndian, samples)
+
+	return b.Bytes()
+}
+
+// limitedBuffer fails the writes past its maximum size.
+type limitedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (buffer *limitedBuffer) Write(p []byte) (int, error) {
+	if buffer.Len()+len(p) > buffer.max {
+		return 0, errors.New("output too large")
+	}
+
+	return buffer.Buffer.Write(p)
+}
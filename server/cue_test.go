@@ -0,0 +1,221 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func newTestAudioCues() *AudioCues {
+	system := NewSystem()
+	system.Id = 1
+	system.Talkgroups.List = []*Talkgroup{
+		{Id: 1, Label: "FD1", Name: "Fire Dispatch"},
+		{Id: 2, Label: "PD2"},
+	}
+
+	controller := &Controller{
+		Accesses: NewAccesses(),
+		Config:   &Config{},
+		Logs:     NewLogs(),
+		Options:  NewOptions(),
+		Systems:  NewSystems(),
+	}
+	controller.Options.AudioCues = true
+	controller.Systems.List = []*System{system}
+
+	return NewAudioCues(controller)
+}
+
+func TestNewCueRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload any
+		ok      bool
+	}{
+		{"valid", map[string]any{"key": "1:1", "system": 1.0, "talkgroup": 1.0, "tones": "system", "speech": true}, true},
+		{"no tones", map[string]any{"system": 1.0, "talkgroup": 1.0}, true},
+		{"not a map", "1:1", false},
+		{"no system", map[string]any{"talkgroup": 1.0}, false},
+		{"no talkgroup", map[string]any{"system": 1.0}, false},
+		{"invalid tones", map[string]any{"system": 1.0, "talkgroup": 1.0, "tones": "loud"}, false},
+		{"long key", map[string]any{"key": string(make([]byte, 65)), "system": 1.0, "talkgroup": 1.0}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, ok := NewCueRequest(test.payload); ok != test.ok {
+				t.Errorf("NewCueRequest(%v) ok = %v, want %v", test.payload, ok, test.ok)
+			}
+		})
+	}
+}
+
+func TestAudioCuesTone(t *testing.T) {
+	cues := newTestAudioCues()
+
+	// the duration of count beeps of 120 ms, each followed by 80 ms of silence
+	duration := func(count int) int {
+		return count * int((200*time.Millisecond).Seconds()*cueSampleRate) * 2
+	}
+
+	tests := []struct {
+		name    string
+		request CueRequest
+		length  int
+	}{
+		{"no tones", CueRequest{System: 1, Talkgroup: 1}, 0},
+		{"system", CueRequest{System: 1, Talkgroup: 1, Tones: CueTonesSystem}, duration(1)},
+		{"no priority", CueRequest{System: 1, Talkgroup: 1, Tones: CueTonesPriority}, duration(1)},
+		{"priority", CueRequest{System: 1, Talkgroup: 1, Tones: CueTonesPriority, Priority: 2}, duration(2)},
+		{"emergency", CueRequest{System: 1, Talkgroup: 1, Tones: CueTonesPriority, Priority: 2, Emergency: true}, duration(3)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := cues.Tone(&test.request)
+
+			if test.length == 0 {
+				if b != nil {
+					t.Errorf("got a tone of %d bytes", len(b))
+				}
+				return
+			}
+
+			if len(b) < 44 || string(b[:4]) != "RIFF" || string(b[8:16]) != "WAVEfmt " || string(b[36:40]) != "data" {
+				t.Fatalf("not a wav file")
+			}
+
+			if size := binary.LittleEndian.Uint32(b[40:44]); int(size) != test.length || len(b) != 44+test.length {
+				t.Errorf("data of %d bytes in a file of %d, want %d", size, len(b), test.length)
+			}
+		})
+	}
+
+	one := cues.Tone(&CueRequest{System: 1, Tones: CueTonesSystem})
+	two := cues.Tone(&CueRequest{System: 2, Tones: CueTonesSystem})
+	if bytes.Equal(one, two) {
+		t.Error("two systems have the same tone")
+	}
+
+	high := cues.Tone(&CueRequest{Priority: 1, Tones: CueTonesPriority})
+	low := cues.Tone(&CueRequest{Priority: 3, Tones: CueTonesPriority})
+	if bytes.Equal(high, low) {
+		t.Error("two priorities have the same tone")
+	}
+}
+
+func TestAudioCuesText(t *testing.T) {
+	cues := newTestAudioCues()
+
+	tests := []struct {
+		name    string
+		request CueRequest
+		want    string
+	}{
+		{"name", CueRequest{System: 1, Talkgroup: 1}, "Fire Dispatch"},
+		{"label", CueRequest{System: 1, Talkgroup: 2}, "PD2"},
+		{"unknown talkgroup", CueRequest{System: 1, Talkgroup: 3}, "talkgroup 3"},
+		{"unknown system", CueRequest{System: 2, Talkgroup: 1}, "talkgroup 1"},
+		{"emergency", CueRequest{System: 1, Talkgroup: 1, Emergency: true}, "emergency, Fire Dispatch"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := cues.Text(&test.request); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAudioCuesSpeak(t *testing.T) {
+	cues := newTestAudioCues()
+
+	if _, err := cues.Speak("Fire Dispatch"); err == nil {
+		t.Error("spoken without a tts command")
+	}
+
+	// cat gives back the text as the audio
+	cues.Controller.Config.TtsCommand = "cat"
+
+	b, err := cues.Speak("Fire Dispatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "Fire Dispatch" {
+		t.Errorf("got %q", b)
+	}
+
+	cues.Controller.Config.TtsCommand = "false"
+
+	if b, err := cues.Speak("Fire Dispatch"); err != nil || string(b) != "Fire Dispatch" {
+		t.Errorf("cached speech: %q, %v", b, err)
+	}
+
+	if _, err := cues.Speak("PD2"); err == nil {
+		t.Error("no error from a failing tts command")
+	}
+}
+
+func TestAudioCuesRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		disabled bool
+		access   *Access
+		payload  map[string]any
+		want     bool
+	}{
+		{"unrestricted", false, nil, map[string]any{"key": "k", "system": 1.0, "talkgroup": 1.0, "tones": "system"}, true},
+		{"disabled", true, nil, map[string]any{"key": "k", "system": 1.0, "talkgroup": 1.0, "tones": "system"}, false},
+		{"with access", false, &Access{Code: "a", Systems: "*"}, map[string]any{"key": "k", "system": 1.0, "talkgroup": 1.0, "tones": "system"}, true},
+		{"without access", false, &Access{Code: "a", Systems: []any{map[string]any{"id": 1.0, "talkgroups": []any{2.0}}}}, map[string]any{"key": "k", "system": 1.0, "talkgroup": 1.0, "tones": "system"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cues := newTestAudioCues()
+			cues.Controller.Options.AudioCues = !test.disabled
+
+			client := &Client{Send: make(chan *Message, 1)}
+
+			if test.access != nil {
+				cues.Controller.Accesses.Add(&Access{Code: "other", Systems: "*"})
+				client.SetAccess(test.access)
+			}
+
+			cues.Request(client, test.payload)
+
+			select {
+			case message := <-client.Send:
+				if !test.want {
+					t.Fatalf("got %v", message)
+				}
+				p := message.Payload.(map[string]any)
+				if message.Command != MessageCommandCue || p["key"] != "k" || p["tone"] == nil {
+					t.Errorf("got %v", message)
+				}
+			default:
+				if test.want {
+					t.Error("no cue sent")
+				}
+			}
+		})
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"regexp"
 	"strings"
 	"time"
 
@@ -27,40 +28,36 @@ import (
 	_ "modernc.org/sqlite"
 )
 
+var sqliteAutoIncrement = regexp.MustCompile(`(?i)\binteger primary key auto_increment\b`)
+
 type Database struct {
 	Config         *Config
 	DateTimeFormat string
+	Secrets        *Secrets
+	SlowQueries    *SlowQueries
 	Sql            *sql.DB
 }
 
 func NewDatabase(config *Config) *Database {
 	var err error
 
-	database := &Database{Config: config}
+	database := &Database{Config: config, SlowQueries: NewSlowQueries(config)}
 
 	switch config.DbType {
 	case DbTypeSqlite:
 		database.DateTimeFormat = "2006-01-02 15:04:05.000 -07:00"
 
-		dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout%%3d10000", config.GetDbFilePath())
-
-		if database.Sql, err = sql.Open("sqlite", dsn); err != nil {
-			log.Fatal(err)
-		}
-
-	case DbTypeMariadb, DbTypeMysql:
+	case DbTypeMariadb, DbTypeMysql, DbTypePostgres:
 		database.DateTimeFormat = "2006-01-02 15:04:05"
 
-		dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s", config.DbUsername, config.DbPassword, config.DbHost, config.DbPort, config.DbName)
-
-		if database.Sql, err = sql.Open("mysql", dsn); err != nil {
-			log.Fatal(err)
-		}
-
 	default:
 		log.Fatalf("unknown database type %s\n", config.DbType)
 	}
 
+	if database.Sql, err = database.open(databaseDsn(config)); err != nil {
+		log.Fatal(err)
+	}
+
 	database.Sql.SetConnMaxLifetime(time.Minute)
 	database.Sql.SetMaxIdleConns(25)
 	database.Sql.SetMaxOpenConns(25)
@@ -73,9 +70,115 @@ func NewDatabase(config *Config) *Database {
 		log.Fatal(err)
 	}
 
+	if database.Secrets, err = NewSecrets(database, secretsMasterKey(config.SecretsKey)); err != nil {
+		log.Fatal(err)
+	}
+
+	if count, err := database.Secrets.Encrypt(database); err != nil {
+		log.Fatal(err)
+	} else if count > 0 {
+		log.Printf("secrets: %d secrets of the database encrypted", count)
+	}
+
 	return database
 }
 
+// databaseDsn returns the driver name and the data source name of the
+// configured database.
+func databaseDsn(config *Config) (string, string) {
+	switch config.DbType {
+	case DbTypeMariadb, DbTypeMysql:
+		return "mysql", fmt.Sprintf("%s:%s@tcp(%s:%d)/%s", config.DbUsername, config.DbPassword, config.DbHost, config.DbPort, config.DbName)
+
+	case DbTypePostgres:
+		return postgresDriverName, fmt.Sprintf("host=%s port=%d dbname=%s user=%s password=%s sslmode=%s", postgresDsnValue(config.DbHost), config.DbPort, postgresDsnValue(config.DbName), postgresDsnValue(config.DbUsername), postgresDsnValue(config.DbPassword), postgresDsnValue(config.DbSslMode))
+
+	default:
+		return "sqlite", fmt.Sprintf("file:%s?_pragma=busy_timeout%%3d10000", config.GetDbFilePath())
+	}
+}
+
+// open opens the database through the registered driver, its connections
+// reporting their slow queries.
+func (db *Database) open(driverName string, dsn string) (*sql.DB, error) {
+	d, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	defer d.Close()
+
+	return sql.OpenDB(&slowQueryConnector{driver: d.Driver(), dsn: dsn, slowQueries: db.SlowQueries}), nil
+}
+
+// Size returns the size in bytes the database takes on disk.
+func (db *Database) Size() (int64, error) {
+	var (
+		err       error
+		pageCount int64
+		pageSize  int64
+		size      sql.NullInt64
+	)
+
+	switch db.Config.DbType {
+	case DbTypeSqlite:
+		if err = db.Sql.QueryRow("pragma page_count").Scan(&pageCount); err != nil {
+			return 0, err
+		}
+		if err = db.Sql.QueryRow("pragma page_size").Scan(&pageSize); err != nil {
+			return 0, err
+		}
+		return pageCount * pageSize, nil
+
+	case DbTypePostgres:
+		err = db.Sql.QueryRow("select pg_database_size(current_database())").Scan(&size)
+
+	default:
+		err = db.Sql.QueryRow("select sum(`data_length` + `index_length`) from `information_schema`.`tables` where `table_schema` = database()").Scan(&size)
+	}
+
+	return size.Int64, err
+}
+
+// Tables returns the names of the tables of the database, sorted.
+func (db *Database) Tables() ([]string, error) {
+	var (
+		err   error
+		query string
+		rows  *sql.Rows
+		table string
+	)
+
+	switch db.Config.DbType {
+	case DbTypeSqlite:
+		// the virtual tables and their shadow tables, like those of the
+		// full-text index, aren't data of their own
+		query = "select name from pragma_table_list where schema = 'main' and type = 'table' and name not like 'sqlite_%' order by name"
+
+	case DbTypePostgres:
+		query = "select table_name from information_schema.tables where table_schema = current_schema() and table_type = 'BASE TABLE' order by table_name"
+
+	default:
+		query = "select table_name from information_schema.tables where table_schema = database() and table_type = 'BASE TABLE' order by table_name"
+	}
+
+	if rows, err = db.Sql.Query(query); err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tables := []string{}
+
+	for rows.Next() {
+		if err = rows.Scan(&table); err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+
+	return tables, rows.Err()
+}
+
 func (db *Database) ParseDateTime(f any) (time.Time, error) {
 	switch v := f.(type) {
 	case []uint8:
@@ -97,35 +200,202 @@ func (db *Database) migrate() error {
 
 	verbose, err = db.prepareMigration()
 
+	// postgresql databases start from the schema of v6.1, the migrations
+	// before it bringing the databases of earlier versions up to date
+	if db.Config.DbType == DbTypePostgres {
+		if err == nil {
+			err = db.migrationPostgres(verbose)
+		}
+	} else {
+		if err == nil {
+			err = db.migration20191028144433(verbose)
+		}
+		if err == nil {
+			err = db.migration20191029092201(verbose)
+		}
+		if err == nil {
+			err = db.migration20191126135515(verbose)
+		}
+		if err == nil {
+			err = db.migration20191220093214(verbose)
+		}
+		if err == nil {
+			err = db.migration20200123094105(verbose)
+		}
+		if err == nil {
+			err = db.migration20200428132918(verbose)
+		}
+		if err == nil {
+			err = db.migration20210115105958(verbose)
+		}
+		if err == nil {
+			err = db.migration20210830092027(verbose)
+		}
+		if err == nil {
+			err = db.migration20211202094819(verbose)
+		}
+		if err == nil {
+			err = db.migration20220101070000(verbose)
+		}
+	}
+	if err == nil {
+		err = db.migration20261014090000(verbose)
+	}
+	if err == nil {
+		err = db.migration20261014100000(verbose)
+	}
+	if err == nil {
+		err = db.migration20261014110000(verbose)
+	}
+	if err == nil {
+		err = db.migration20261014120000(verbose)
+	}
+	if err == nil {
+		err = db.migration20261014130000(verbose)
+	}
+	if err == nil {
+		err = db.migration20261014140000(verbose)
+	}
+	if err == nil {
+		err = db.migration20261014150000(verbose)
+	}
+	if err == nil {
+		err = db.migration20261014160000(verbose)
+	}
+	if err == nil {
+		err = db.migration20261014170000(verbose)
+	}
+	if err == nil {
+		err = db.migration20261014180000(verbose)
+	}
+	if err == nil {
+		err = db.migration20261014190000(verbose)
+	}
+	if err == nil {
+		err = db.migration20261014200000(verbose)
+	}
 	if err == nil {
-		err = db.migration20191028144433(verbose)
+		err = db.migration20261014210000(verbose)
 	}
 	if err == nil {
-		err = db.migration20191029092201(verbose)
+		err = db.migration20261014220000(verbose)
 	}
 	if err == nil {
-		err = db.migration20191126135515(verbose)
+		err = db.migration20261014230000(verbose)
 	}
 	if err == nil {
-		err = db.migration20191220093214(verbose)
+		err = db.migration20261015000000(verbose)
 	}
 	if err == nil {
-		err = db.migration20200123094105(verbose)
+		err = db.migration20261015010000(verbose)
 	}
 	if err == nil {
-		err = db.migration20200428132918(verbose)
+		err = db.migration20261015020000(verbose)
 	}
 	if err == nil {
-		err = db.migration20210115105958(verbose)
+		err = db.migration20261015030000(verbose)
 	}
 	if err == nil {
-		err = db.migration20210830092027(verbose)
+		err = db.migration20261015040000(verbose)
 	}
 	if err == nil {
-		err = db.migration20211202094819(verbose)
+		err = db.migration20261015050000(verbose)
 	}
 	if err == nil {
-		err = db.migration20220101070000(verbose)
+		err = db.migration20261015060000(verbose)
+	}
+	if err == nil {
+		err = db.migration20261015070000(verbose)
+	}
+	if err == nil {
+		err = db.migration20261015080000(verbose)
+	}
+
+	if err == nil {
+		err = db.migration20261015090000(verbose)
+	}
+
+	if err == nil {
+		err = db.migration20261015100000(verbose)
+	}
+
+	if err == nil {
+		err = db.migration20261015110000(verbose)
+	}
+
+	if err == nil {
+		err = db.migration20261015120000(verbose)
+	}
+
+	if err == nil {
+		err = db.migration20261015130000(verbose)
+	}
+
+	if err == nil {
+		err = db.migration20261015140000(verbose)
+	}
+
+	if err == nil {
+		err = db.migration20261015150000(verbose)
+	}
+
+	if err == nil {
+		err = db.migration20261015160000(verbose)
+	}
+
+	if err == nil {
+		err = db.migration20261015170000(verbose)
+	}
+
+	if err == nil {
+		err = db.migration20261015180000(verbose)
+	}
+
+	if err == nil {
+		err = db.migration20261015190000(verbose)
+	}
+
+	if err == nil {
+		err = db.migration20261015200000(verbose)
+	}
+
+	if err == nil {
+		err = db.migration20261015210000(verbose)
+	}
+
+	if err == nil {
+		err = db.migration20261015220000(verbose)
+	}
+
+	if err == nil {
+		err = db.migration20261015230000(verbose)
+	}
+
+	if err == nil {
+		err = db.migration20261016000000(verbose)
+	}
+
+	if err == nil {
+		err = db.migration20261016010000(verbose)
+	}
+
+	if err == nil {
+		err = db.migration20261016020000(verbose)
+	}
+
+	if err == nil {
+		err = db.migration20261016030000(verbose)
+	}
+
+	if err == nil {
+		err = db.migration20261016040000(verbose)
+	}
+
+	if err == nil {
+		err = db.migration20261016050000(verbose)
+	}
+	if err == nil {
+		err = db.migration20261016060000(verbose)
 	}
 
 	return err
@@ -156,7 +426,7 @@ func (db *Database) migrateWithSchema(name string, schemas []string, verbose boo
 
 		if tx, err = db.Sql.Begin(); err == nil {
 			for _, query = range schemas {
-				if _, err = tx.Exec(query); err != nil {
+				if _, err = tx.Exec(db.schema(query)); err != nil {
 					tx.Rollback()
 					return formatError(err, query)
 				}
@@ -179,38 +449,30 @@ func (db *Database) migrateWithSchema(name string, schemas []string, verbose boo
 	return nil
 }
 
-func (db *Database) migration20191028144433(verbose bool) error {
-	var queries []string
+// schema rewrites for sqlite a schema query written for mysql, postgresql
+// having its own driver doing it.
+func (db *Database) schema(query string) string {
 	if db.Config.DbType == DbTypeSqlite {
-		queries = []string{
-			"create table `rdioScannerSystems` (`id` integer primary key autoincrement, `createdAt` datetime not null, `updatedAt` datetime not null, `name` varchar(255) not null, `system` integer not null, `talkgroups` json not null)",
-			"create unique index `rdio_scanner_systems_system` on `rdioScannerSystems` (`system`)",
-		}
-	} else {
-		queries = []string{
-			"create table `rdioScannerSystems` (`id` integer primary key auto_increment, `createdAt` datetime not null, `updatedAt` datetime not null, `name` varchar(255) not null, `system` integer not null, `talkgroups` json not null)",
-			"create unique index `rdio_scanner_systems_system` on `rdioScannerSystems` (`system`)",
-		}
+		return sqliteAutoIncrement.ReplaceAllString(query, "integer primary key autoincrement")
+	}
+
+	return query
+}
+
+func (db *Database) migration20191028144433(verbose bool) error {
+	queries := []string{
+		"create table `rdioScannerSystems` (`id` integer primary key auto_increment, `createdAt` datetime not null, `updatedAt` datetime not null, `name` varchar(255) not null, `system` integer not null, `talkgroups` json not null)",
+		"create unique index `rdio_scanner_systems_system` on `rdioScannerSystems` (`system`)",
 	}
 	return db.migrateWithSchema("20191028144433-create-rdio-scanner-system", queries, verbose)
 }
 
 func (db *Database) migration20191029092201(verbose bool) error {
-	var queries []string
-	if db.Config.DbType == DbTypeSqlite {
-		queries = []string{
-			"create table `rdioScannerCalls` (`id` integer primary key autoincrement, `createdAt` datetime not null, `updatedAt` datetime not null, `audio` longblob not null, `emergency` tinyint(1) not null, `freq` integer not null, `freqList` json not null, `startTime` datetime not null, `stopTime` datetime not null, `srcList` json not null, `system` integer not null, `talkgroup` integer not null)",
-			"create index `rdio_scanner_calls_start_time` on `rdioScannerCalls` (`startTime`)",
-			"create index `rdio_scanner_calls_system` on `rdioScannerCalls` (`system`)",
-			"create index `rdio_scanner_calls_talkgroup` on `rdioScannerCalls` (`talkgroup`)",
-		}
-	} else {
-		queries = []string{
-			"create table `rdioScannerCalls` (`id` integer primary key auto_increment, `createdAt` datetime not null, `updatedAt` datetime not null, `audio` longblob not null, `emergency` tinyint(1) not null, `freq` integer not null, `freqList` json not null, `startTime` datetime not null, `stopTime` datetime not null, `srcList` json not null, `system` integer not null, `talkgroup` integer not null)",
-			"create index `rdio_scanner_calls_start_time` on `rdioScannerCalls` (`startTime`)",
-			"create index `rdio_scanner_calls_system` on `rdioScannerCalls` (`system`)",
-			"create index `rdio_scanner_calls_talkgroup` on `rdioScannerCalls` (`talkgroup`)",
-		}
+	queries := []string{
+		"create table `rdioScannerCalls` (`id` integer primary key auto_increment, `createdAt` datetime not null, `updatedAt` datetime not null, `audio` longblob not null, `emergency` tinyint(1) not null, `freq` integer not null, `freqList` json not null, `startTime` datetime not null, `stopTime` datetime not null, `srcList` json not null, `system` integer not null, `talkgroup` integer not null)",
+		"create index `rdio_scanner_calls_start_time` on `rdioScannerCalls` (`startTime`)",
+		"create index `rdio_scanner_calls_system` on `rdioScannerCalls` (`system`)",
+		"create index `rdio_scanner_calls_talkgroup` on `rdioScannerCalls` (`talkgroup`)",
 	}
 	return db.migrateWithSchema("20191029092201-create-rdio-scanner-call", queries, verbose)
 }
@@ -232,103 +494,52 @@ func (db *Database) migration20191126135515(verbose bool) error {
 }
 
 func (db *Database) migration20191220093214(verbose bool) error {
-	var queries []string
-	if db.Config.DbType == DbTypeSqlite {
-		queries = []string{
-			"alter table `rdioScannerCalls` add column `audioName` varchar(255)",
-			"alter table `rdioScannerCalls` add column `audioType` varchar(255)",
-			"alter table `rdioScannerSystems` add column `aliases` json not null",
-		}
-	} else {
-		queries = []string{
-			"alter table `rdioScannerCalls` add column `audioName` varchar(255)",
-			"alter table `rdioScannerCalls` add column `audioType` varchar(255)",
-			"alter table `rdioScannerSystems` add column `aliases` json not null",
-		}
+	queries := []string{
+		"alter table `rdioScannerCalls` add column `audioName` varchar(255)",
+		"alter table `rdioScannerCalls` add column `audioType` varchar(255)",
+		"alter table `rdioScannerSystems` add column `aliases` json not null",
 	}
 	return db.migrateWithSchema("20191220093214-new-v3-tables", queries, verbose)
 }
 
 func (db *Database) migration20200123094105(verbose bool) error {
-	var queries []string
-	if db.Config.DbType == DbTypeSqlite {
-		queries = []string{
-			"create index `rdio_scanner_calls_system` on `rdioScannerCalls` (`system`)",
-			"create index `rdio_scanner_calls_system_talkgroup` on `rdioScannerCalls` (`system`, `talkgroup`)",
-		}
-	} else {
-		queries = []string{
-			"create index `rdio_scanner_calls_system` on `rdioScannerCalls` (`system`)",
-			"create index `rdio_scanner_calls_system_talkgroup` on `rdioScannerCalls` (`system`, `talkgroup`)",
-		}
+	queries := []string{
+		"create index `rdio_scanner_calls_system` on `rdioScannerCalls` (`system`)",
+		"create index `rdio_scanner_calls_system_talkgroup` on `rdioScannerCalls` (`system`, `talkgroup`)",
 	}
 	return db.migrateWithSchema("20200123094105-optimize-rdio-scanner-calls", queries, verbose)
 }
 
 func (db *Database) migration20200428132918(verbose bool) error {
-	var queries []string
-	if db.Config.DbType == DbTypeSqlite {
-		queries = []string{
-			"drop table `rdioScannerSystems`",
-			"create table `rdioScannerCalls2` (`id` integer primary key autoincrement, `audio` longblob not null, `audioName` varchar(255), `audioType` varchar(255), `dateTime` datetime not null, `frequencies` json not null, `frequency` integer, `source` integer, `sources` json not null, `system` integer not null, `talkgroup` integer not null)",
-			"insert into `rdioScannerCalls2` select `id`, `audio`, `audioName`, `audioType`, `startTime`, `freqList`, `freq`, null, `srcList`, `system`, `talkgroup` from `rdioScannerCalls`",
-			"drop table `rdioScannerCalls`",
-			"alter table `rdioScannerCalls2` rename to `rdioScannerCalls`",
-			"create index `rdio_scanner_calls_date_time_system_talkgroup` on `rdioScannerCalls` (`dateTime`, `system`, `talkgroup`)",
-		}
-	} else {
-		queries = []string{
-			"drop table `rdioScannerSystems`",
-			"create table `rdioScannerCalls2` (`id` integer primary key auto_increment, `audio` longblob not null, `audioName` varchar(255), `audioType` varchar(255), `dateTime` datetime not null, `frequencies` json not null, `frequency` integer, `source` integer, `sources` json not null, `system` integer not null, `talkgroup` integer not null)",
-			"insert into `rdioScannerCalls2` select `id`, `audio`, `audioName`, `audioType`, `startTime`, `freqList`, `freq`, null, `srcList`, `system`, `talkgroup` from `rdioScannerCalls`",
-			"drop table `rdioScannerCalls`",
-			"alter table `rdioScannerCalls2` rename to `rdioScannerCalls`",
-			"create index `rdio_scanner_calls_date_time_system_talkgroup` on `rdioScannerCalls` (`dateTime`, `system`, `talkgroup`)",
-		}
+	queries := []string{
+		"drop table `rdioScannerSystems`",
+		"create table `rdioScannerCalls2` (`id` integer primary key auto_increment, `audio` longblob not null, `audioName` varchar(255), `audioType` varchar(255), `dateTime` datetime not null, `frequencies` json not null, `frequency` integer, `source` integer, `sources` json not null, `system` integer not null, `talkgroup` integer not null)",
+		"insert into `rdioScannerCalls2` select `id`, `audio`, `audioName`, `audioType`, `startTime`, `freqList`, `freq`, null, `srcList`, `system`, `talkgroup` from `rdioScannerCalls`",
+		"drop table `rdioScannerCalls`",
+		"alter table `rdioScannerCalls2` rename to `rdioScannerCalls`",
+		"create index `rdio_scanner_calls_date_time_system_talkgroup` on `rdioScannerCalls` (`dateTime`, `system`, `talkgroup`)",
 	}
 	return db.migrateWithSchema("20200428132918-new-v4-tables", queries, verbose)
 }
 
 func (db *Database) migration20210115105958(verbose bool) error {
-	var queries []string
-	if db.Config.DbType == DbTypeSqlite {
-		queries = []string{
-			"create table `rdioScannerAccesses` (`_id` integer primary key autoincrement, `code` varchar(255) not null unique, `expiration` datetime, `ident` varchar(255), `limit` integer, `order` integer, `systems` text not null)",
-			"create table `rdioScannerApiKeys` (`_id` integer primary key autoincrement, `disabled` tinyint(1) default 0, `ident` varchar(255), `key` varchar(255) not null unique, `order` integer, `systems` text not null)",
-			"create table `rdioScannerCalls2` (`id` integer primary key autoincrement, `audio` longblob not null, `audioName` varchar(255), `audioType` varchar(255), `dateTime` datetime not null, `frequencies` text not null, `frequency` integer, `source` integer, `sources` text not null, `system` integer not null, `talkgroup` integer not null)",
-			"create index `rdio_scanner_calls2_date_time_system_talkgroup` on `rdioScannerCalls2` (`dateTime`, `system`, `talkgroup`)",
-			"insert into `rdioScannerCalls2` select `id`, `audio`, `audioName`, `audioType`, `dateTime`, `frequencies`, `frequency`, `source`, `sources`, `system`, `talkgroup` from `rdioScannerCalls`",
-			"drop table `rdioScannerCalls`",
-			"alter table `rdioScannerCalls2` rename to `rdioScannerCalls`",
-			"create table `rdioScannerConfigs` (`_id` integer primary key autoincrement, `key` varchar(255) not null unique, `val` text not null)",
-			"create index `rdio_scanner_configs_key` on `rdioScannerConfigs` (`key`)",
-			"create table `rdioScannerDirWatches` (`_id` integer primary key autoincrement, `delay` integer default 0, `deleteAfter` tinyint(1) default 0, `directory` varchar(255) not null unique, `disabled` tinyint(1) default 0, `extension` varchar(255), `frequency` integer, `mask` varchar(255), `order` integer, `systemId` integer, `talkgroupId` integer, `type` varchar(255), `usePolling` tinyint(1) default 0)",
-			"create table `rdioScannerDownstreams` (`_id` integer primary key autoincrement, `apiKey` varchar(255) not null unique, `disabled` tinyint(1) default 0, `order` integer, `systems` text not null, `url` varchar(255) not null)",
-			"create table `rdioScannerGroups` (`_id` integer primary key autoincrement, `label` varchar(255) not null)",
-			"create table `rdioScannerLogs` (`_id` integer primary key autoincrement, `dateTime` datetime not null, `level` varchar(255) not null, `message` varchar(255) not null)",
-			"create index `rdio_scanner_logs_date_time_level` on `rdioScannerLogs` (`dateTime`, `level`)",
-			"create table `rdioScannerSystems` (`_id` integer primary key autoincrement, `autoPopulate` tinyint(1) default 0, `blacklists` text not null, `id` integer not null unique, `label` varchar(255) not null, `led` varchar(255), `order` integer, `talkgroups` text not null, `units` text not null)",
-			"create table `rdioScannerTags` (`_id` integer primary key autoincrement, `label` varchar(255) not null)",
-		}
-	} else {
-		queries = []string{
-			"create table `rdioScannerAccesses` (`_id` integer primary key auto_increment, `code` varchar(255) not null unique, `expiration` datetime, `ident` varchar(255), `limit` integer, `order` integer, `systems` text not null)",
-			"create table `rdioScannerApiKeys` (`_id` integer primary key auto_increment, `disabled` tinyint(1) default 0, `ident` varchar(255), `key` varchar(255) not null unique, `order` integer, `systems` text not null)",
-			"create table `rdioScannerCalls2` (`id` integer primary key auto_increment, `audio` longblob not null, `audioName` varchar(255), `audioType` varchar(255), `dateTime` datetime not null, `frequencies` text not null, `frequency` integer, `source` integer, `sources` text not null, `system` integer not null, `talkgroup` integer not null)",
-			"create index `rdio_scanner_calls2_date_time_system_talkgroup` on `rdioScannerCalls2` (`dateTime`, `system`, `talkgroup`)",
-			"insert into `rdioScannerCalls2` select `id`, `audio`, `audioName`, `audioType`, `dateTime`, `frequencies`, `frequency`, `source`, `sources`, `system`, `talkgroup` from `rdioScannerCalls`",
-			"drop table `rdioScannerCalls`",
-			"alter table `rdioScannerCalls2` rename to `rdioScannerCalls`",
-			"create table `rdioScannerConfigs` (`_id` integer primary key auto_increment, `key` varchar(255) not null unique, `val` text not null)",
-			"create index `rdio_scanner_configs_key` on `rdioScannerConfigs` (`key`)",
-			"create table `rdioScannerDirWatches` (`_id` integer primary key auto_increment, `delay` integer default 0, `deleteAfter` tinyint(1) default 0, `directory` varchar(255) not null unique, `disabled` tinyint(1) default 0, `extension` varchar(255), `frequency` integer, `mask` varchar(255), `order` integer, `systemId` integer, `talkgroupId` integer, `type` varchar(255), `usePolling` tinyint(1) default 0)",
-			"create table `rdioScannerDownstreams` (`_id` integer primary key auto_increment, `apiKey` varchar(255) not null unique, `disabled` tinyint(1) default 0, `order` integer, `systems` text not null, `url` varchar(255) not null)",
-			"create table `rdioScannerGroups` (`_id` integer primary key auto_increment, `label` varchar(255) not null)",
-			"create table `rdioScannerLogs` (`_id` integer primary key auto_increment, `dateTime` datetime not null, `level` varchar(255) not null, `message` varchar(255) not null)",
-			"create index `rdio_scanner_logs_date_time_level` on `rdioScannerLogs` (`dateTime`, `level`)",
-			"create table `rdioScannerSystems` (`_id` integer primary key auto_increment, `autoPopulate` tinyint(1) default 0, `blacklists` text not null, `id` integer not null unique, `label` varchar(255) not null, `led` varchar(255), `order` integer, `talkgroups` text not null, `units` text not null)",
-			"create table `rdioScannerTags` (`_id` integer primary key auto_increment, `label` varchar(255) not null)",
-		}
+	queries := []string{
+		"create table `rdioScannerAccesses` (`_id` integer primary key auto_increment, `code` varchar(255) not null unique, `expiration` datetime, `ident` varchar(255), `limit` integer, `order` integer, `systems` text not null)",
+		"create table `rdioScannerApiKeys` (`_id` integer primary key auto_increment, `disabled` tinyint(1) default 0, `ident` varchar(255), `key` varchar(255) not null unique, `order` integer, `systems` text not null)",
+		"create table `rdioScannerCalls2` (`id` integer primary key auto_increment, `audio` longblob not null, `audioName` varchar(255), `audioType` varchar(255), `dateTime` datetime not null, `frequencies` text not null, `frequency` integer, `source` integer, `sources` text not null, `system` integer not null, `talkgroup` integer not null)",
+		"create index `rdio_scanner_calls2_date_time_system_talkgroup` on `rdioScannerCalls2` (`dateTime`, `system`, `talkgroup`)",
+		"insert into `rdioScannerCalls2` select `id`, `audio`, `audioName`, `audioType`, `dateTime`, `frequencies`, `frequency`, `source`, `sources`, `system`, `talkgroup` from `rdioScannerCalls`",
+		"drop table `rdioScannerCalls`",
+		"alter table `rdioScannerCalls2` rename to `rdioScannerCalls`",
+		"create table `rdioScannerConfigs` (`_id` integer primary key auto_increment, `key` varchar(255) not null unique, `val` text not null)",
+		"create index `rdio_scanner_configs_key` on `rdioScannerConfigs` (`key`)",
+		"create table `rdioScannerDirWatches` (`_id` integer primary key auto_increment, `delay` integer default 0, `deleteAfter` tinyint(1) default 0, `directory` varchar(255) not null unique, `disabled` tinyint(1) default 0, `extension` varchar(255), `frequency` integer, `mask` varchar(255), `order` integer, `systemId` integer, `talkgroupId` integer, `type` varchar(255), `usePolling` tinyint(1) default 0)",
+		"create table `rdioScannerDownstreams` (`_id` integer primary key auto_increment, `apiKey` varchar(255) not null unique, `disabled` tinyint(1) default 0, `order` integer, `systems` text not null, `url` varchar(255) not null)",
+		"create table `rdioScannerGroups` (`_id` integer primary key auto_increment, `label` varchar(255) not null)",
+		"create table `rdioScannerLogs` (`_id` integer primary key auto_increment, `dateTime` datetime not null, `level` varchar(255) not null, `message` varchar(255) not null)",
+		"create index `rdio_scanner_logs_date_time_level` on `rdioScannerLogs` (`dateTime`, `level`)",
+		"create table `rdioScannerSystems` (`_id` integer primary key auto_increment, `autoPopulate` tinyint(1) default 0, `blacklists` text not null, `id` integer not null unique, `label` varchar(255) not null, `led` varchar(255), `order` integer, `talkgroups` text not null, `units` text not null)",
+		"create table `rdioScannerTags` (`_id` integer primary key auto_increment, `label` varchar(255) not null)",
 	}
 	return db.migrateWithSchema("20210115105958-new-v5.1-tables", queries, verbose)
 }
@@ -357,21 +568,11 @@ func (db *Database) migration20210830092027(verbose bool) error {
 }
 
 func (db *Database) migration20211202094819(verbose bool) error {
-	var queries []string
-	if db.Config.DbType == DbTypeSqlite {
-		queries = []string{
-			"alter table `rdioScannerDownstreams` rename to `rdioScannerDownstreams2`",
-			"create table `rdioScannerDownstreams` (`_id` integer primary key autoincrement, `apiKey` varchar(255) not null, `disabled` tinyint(1) default 0, `order` integer, `systems` text not null, `url` varchar(255) not null)",
-			"insert into `rdioScannerDownstreams` select * from `rdioScannerDownstreams2`",
-			"drop table `rdioScannerDownstreams2`",
-		}
-	} else {
-		queries = []string{
-			"alter table `rdioScannerDownstreams` rename to `rdioScannerDownstreams2`",
-			"create table `rdioScannerDownstreams` (`_id` integer primary key auto_increment, `apiKey` varchar(255) not null, `disabled` tinyint(1) default 0, `order` integer, `systems` text not null, `url` varchar(255) not null)",
-			"insert into `rdioScannerDownstreams` select * from `rdioScannerDownstreams2`",
-			"drop table `rdioScannerDownstreams2`",
-		}
+	queries := []string{
+		"alter table `rdioScannerDownstreams` rename to `rdioScannerDownstreams2`",
+		"create table `rdioScannerDownstreams` (`_id` integer primary key auto_increment, `apiKey` varchar(255) not null, `disabled` tinyint(1) default 0, `order` integer, `systems` text not null, `url` varchar(255) not null)",
+		"insert into `rdioScannerDownstreams` select * from `rdioScannerDownstreams2`",
+		"drop table `rdioScannerDownstreams2`",
 	}
 	return db.migrateWithSchema("20211202094819-v6.0.2-alter-table", queries, verbose)
 }
@@ -461,6 +662,425 @@ func (db *Database) migration20220101070000(verbose bool) error {
 	return db.migrateWithSchema("20220101070000-v6.1.0", queries, verbose)
 }
 
+func (db *Database) migration20261014090000(verbose bool) error {
+	queries := []string{
+		"alter table `rdioScannerCalls` add column `audioKey` varchar(255)",
+	}
+	return db.migrateWithSchema("20261014090000-audio-store", queries, verbose)
+}
+
+func (db *Database) migration20261014100000(verbose bool) error {
+	queries := []string{
+		"create table `rdioScannerBlackouts` (`_id` integer primary key auto_increment, `createdAt` datetime not null, `expires` datetime not null, `reason` text not null, `system` integer not null, `talkgroups` text not null)",
+	}
+	return db.migrateWithSchema("20261014100000-blackouts", queries, verbose)
+}
+
+func (db *Database) migration20261014110000(verbose bool) error {
+	queries := []string{
+		"create table `rdioScannerRetentions` (`_id` integer primary key auto_increment, `days` integer not null, `order` integer, `systemId` integer not null, `talkgroupId` integer)",
+	}
+	return db.migrateWithSchema("20261014110000-retentions", queries, verbose)
+}
+
+func (db *Database) migration20261014120000(verbose bool) error {
+	queries := []string{
+		"create table `rdioScannerStreams` (`_id` integer primary key auto_increment, `disabled` tinyint(1) default 0, `mount` varchar(255) not null unique, `name` varchar(255) not null, `order` integer, `systems` text not null)",
+	}
+	return db.migrateWithSchema("20261014120000-streams", queries, verbose)
+}
+
+func (db *Database) migration20261014130000(verbose bool) error {
+	queries := []string{
+		"alter table `rdioScannerSystems` add column `qosWeight` integer default 0",
+	}
+	return db.migrateWithSchema("20261014130000-system-qos-weight", queries, verbose)
+}
+
+func (db *Database) migration20261014140000(verbose bool) error {
+	queries := []string{
+		"alter table `rdioScannerCalls` add column `transcript` text",
+		"create table `rdioScannerTranscribers` (`_id` integer primary key auto_increment, `apiKey` varchar(255) not null, `disabled` tinyint(1) default 0, `language` varchar(255) not null, `model` varchar(255) not null, `order` integer, `provider` varchar(255) not null, `systems` text not null, `url` varchar(255) not null)",
+	}
+	return db.migrateWithSchema("20261014140000-transcriptions", queries, verbose)
+}
+
+func (db *Database) migration20261014150000(verbose bool) error {
+	queries := []string{
+		"create table `rdioScannerAlerts` (`_id` integer primary key auto_increment, `action` varchar(255) not null, `disabled` tinyint(1) default 0, `keywords` text not null, `label` varchar(255) not null, `order` integer, `systems` text not null, `threshold` integer not null default 0, `trigger` varchar(255) not null, `units` text not null, `url` text not null, `window` integer not null default 0)",
+	}
+	return db.migrateWithSchema("20261014150000-alerts", queries, verbose)
+}
+
+func (db *Database) migration20261014160000(verbose bool) error {
+	queries := []string{
+		"create table `rdioScannerBroadcastifyFeeds` (`_id` integer primary key auto_increment, `apiKey` varchar(255) not null, `disabled` tinyint(1) default 0, `excludes` text not null, `order` integer, `systemId` integer not null default 0, `systems` text not null, `url` varchar(255) not null)",
+	}
+	return db.migrateWithSchema("20261014160000-broadcastify", queries, verbose)
+}
+
+func (db *Database) migration20261014170000(verbose bool) error {
+	queries := []string{
+		"create table `rdioScannerPublishers` (`_id` integer primary key auto_increment, `brokers` text not null, `disabled` tinyint(1) default 0, `order` integer, `subject` varchar(255) not null, `systems` text not null, `type` varchar(255) not null)",
+	}
+	return db.migrateWithSchema("20261014170000-publishers", queries, verbose)
+}
+
+func (db *Database) migration20261014180000(verbose bool) error {
+	queries := []string{
+		"create table `rdioScannerOpenmhzImports` (`_id` integer primary key auto_increment, `cursor` bigint not null default 0, `disabled` tinyint(1) default 0, `history` integer not null default 0, `interval` integer not null default 0, `order` integer, `shortName` varchar(255) not null, `system` integer not null, `url` varchar(255) not null)",
+	}
+	return db.migrateWithSchema("20261014180000-openmhz", queries, verbose)
+}
+
+func (db *Database) migration20261014190000(verbose bool) error {
+	queries := []string{
+		"alter table `rdioScannerCalls` add column `duration` integer not null default 0",
+		"create index `rdio_scanner_calls_duration` on `rdioScannerCalls` (`duration`)",
+	}
+	return db.migrateWithSchema("20261014190000-call-duration", queries, verbose)
+}
+
+func (db *Database) migration20261014200000(verbose bool) error {
+	queries := []string{
+		"alter table `rdioScannerCalls` add column `skew` integer not null default 0",
+		"create index `rdio_scanner_calls_skew` on `rdioScannerCalls` (`skew`)",
+	}
+	return db.migrateWithSchema("20261014200000-call-skew", queries, verbose)
+}
+
+func (db *Database) migration20261014210000(verbose bool) error {
+	queries := []string{
+		"alter table `rdioScannerApiKeys` add column `lastUsed` datetime",
+		"alter table `rdioScannerApiKeys` add column `revoked` datetime",
+		"alter table `rdioScannerApiKeys` add column `scopes` text",
+	}
+	return db.migrateWithSchema("20261014210000-apikey-scopes", queries, verbose)
+}
+
+func (db *Database) migration20261014220000(verbose bool) error {
+	queries := []string{
+		"create table `rdioScannerTiers` (`_id` integer primary key auto_increment, `delay` integer not null default 0, `download` tinyint(1) default 0, `name` varchar(255) not null unique, `order` integer, `redact` tinyint(1) default 0, `searchDays` integer not null default 0)",
+	}
+	queries = append(queries,
+		"insert into `rdioScannerTiers` (`delay`, `download`, `name`, `order`, `redact`, `searchDays`) values (60, 0, 'public', 1, 1, 1)",
+		"insert into `rdioScannerTiers` (`delay`, `download`, `name`, `order`, `redact`, `searchDays`) values (0, 0, 'member', 2, 1, 7)",
+		"insert into `rdioScannerTiers` (`delay`, `download`, `name`, `order`, `redact`, `searchDays`) values (0, 1, 'dispatcher', 3, 0, 0)",
+		"insert into `rdioScannerTiers` (`delay`, `download`, `name`, `order`, `redact`, `searchDays`) values (0, 1, 'admin-viewer', 4, 0, 0)",
+		"alter table `rdioScannerAccesses` add column `tier` varchar(255)",
+	)
+	return db.migrateWithSchema("20261014220000-tiers", queries, verbose)
+}
+
+func (db *Database) migration20261014230000(verbose bool) error {
+	queries := []string{
+		"create table `rdioScannerUsers` (`_id` integer primary key auto_increment, `disabled` tinyint(1) default 0, `password` varchar(255) not null, `role` varchar(255) not null, `username` varchar(255) not null unique)",
+	}
+	return db.migrateWithSchema("20261014230000-admin-users", queries, verbose)
+}
+
+func (db *Database) migration20261015000000(verbose bool) error {
+	queries := []string{
+		"create table `rdioScannerGuestPasses` (`_id` integer primary key auto_increment, `createdAt` datetime not null, `expires` datetime not null, `ident` varchar(255) not null, `systems` text not null, `tier` varchar(255), `token` varchar(255) not null unique)",
+	}
+	return db.migrateWithSchema("20261015000000-guest-passes", queries, verbose)
+}
+
+func (db *Database) migration20261015010000(verbose bool) error {
+	queries := []string{
+		"alter table `rdioScannerCalls` add column `latitude` double",
+		"alter table `rdioScannerCalls` add column `longitude` double",
+	}
+	return db.migrateWithSchema("20261015010000-call-location", queries, verbose)
+}
+
+func (db *Database) migration20261015020000(verbose bool) error {
+	queries := []string{
+		"create table `rdioScannerSubscriptions` (`_id` integer primary key auto_increment, `action` varchar(255) not null, `address` varchar(255) not null, `createdAt` datetime not null, `subscriber` varchar(255) not null, `system` integer not null, `talkgroup` integer not null, `tier` varchar(255))",
+		"create index `rdio_scanner_subscriptions_subscriber` on `rdioScannerSubscriptions` (`subscriber`)",
+	}
+	return db.migrateWithSchema("20261015020000-subscriptions", queries, verbose)
+}
+
+func (db *Database) migration20261015030000(verbose bool) error {
+	queries := []string{
+		"create table `rdioScannerKiosks` (`_id` integer primary key auto_increment, `createdAt` datetime not null, `label` varchar(255) not null, `state` text not null, `token` varchar(255) not null unique)",
+	}
+	return db.migrateWithSchema("20261015030000-kiosks", queries, verbose)
+}
+
+// migration20261015040000 widens the subscription addresses for the web push
+// subscriptions, sqlite having no length limit in the first place.
+func (db *Database) migration20261015040000(verbose bool) error {
+	var queries []string
+	if db.Config.DbType != DbTypeSqlite {
+		queries = []string{
+			"alter table `rdioScannerSubscriptions` modify `address` text not null",
+		}
+	}
+	return db.migrateWithSchema("20261015040000-subscriptions-address", queries, verbose)
+}
+
+func (db *Database) migration20261015050000(verbose bool) error {
+	queries := []string{
+		"alter table `rdioScannerDownstreams` add column `groups` text",
+		"alter table `rdioScannerDownstreams` add column `schedule` varchar(255)",
+		"alter table `rdioScannerDownstreams` add column `tags` text",
+	}
+	return db.migrateWithSchema("20261015050000-downstream-filters", queries, verbose)
+}
+
+func (db *Database) migration20261015060000(verbose bool) error {
+	queries := []string{
+		"alter table `rdioScannerSystems` add column `audioNormalization` varchar(255)",
+	}
+	return db.migrateWithSchema("20261015060000-system-audio-normalization", queries, verbose)
+}
+
+func (db *Database) migration20261015070000(verbose bool) error {
+	queries := []string{
+		"create table `rdioScannerIncidents` (`_id` integer primary key auto_increment, `calls` text not null, `createdAt` datetime not null, `expires` datetime, `label` varchar(255) not null, `system` integer not null, `talkgroups` text not null)",
+	}
+	return db.migrateWithSchema("20261015070000-incidents", queries, verbose)
+}
+
+func (db *Database) migration20261015080000(verbose bool) error {
+	queries := []string{
+		"create table `rdioScannerRadioReferenceSyncs` (`_id` integer primary key auto_increment, `appKey` varchar(255) not null, `disabled` tinyint(1) default 0, `interval` integer not null default 0, `order` integer, `password` varchar(255) not null, `sid` integer not null, `system` integer not null, `url` varchar(255) not null, `username` varchar(255) not null)",
+	}
+	return db.migrateWithSchema("20261015080000-radioreference", queries, verbose)
+}
+
+func (db *Database) migration20261015090000(verbose bool) error {
+	queries := []string{
+		"create table `rdioScannerJobs` (`_id` integer primary key auto_increment, `attempts` integer not null default 0, `createdAt` datetime not null, `error` text not null, `finishedAt` datetime, `kind` varchar(255) not null, `maxAttempts` integer not null default 0, `payload` text not null, `priority` integer not null default 0, `runAt` datetime not null, `startedAt` datetime, `status` varchar(255) not null)",
+		"create index `rdio_scanner_jobs_status` on `rdioScannerJobs` (`status`)",
+	}
+	return db.migrateWithSchema("20261015090000-jobs", queries, verbose)
+}
+
+func (db *Database) migration20261015100000(verbose bool) error {
+	queries := []string{
+		"alter table `rdioScannerUnits` add column `calls` integer not null default 0",
+		"alter table `rdioScannerUnits` add column `firstHeard` datetime",
+		"alter table `rdioScannerUnits` add column `lastHeard` datetime",
+		"alter table `rdioScannerUnits` add column `talkgroups` text",
+	}
+	return db.migrateWithSchema("20261015100000-units", queries, verbose)
+}
+
+func (db *Database) migration20261015110000(verbose bool) error {
+	queries := []string{
+		"create table `rdioScannerListenerSessions` (`_id` integer primary key auto_increment, `bytes` bigint not null default 0, `calls` integer not null default 0, `code` varchar(255) not null, `connectedAt` datetime not null, `disconnectedAt` datetime, `ident` varchar(255) not null, `ip` varchar(255) not null, `talkgroups` text not null, `updatedAt` datetime not null)",
+		"create index `rdio_scanner_listener_sessions_connected_at` on `rdioScannerListenerSessions` (`connectedAt`)",
+	}
+	return db.migrateWithSchema("20261015110000-listeners", queries, verbose)
+}
+
+func (db *Database) migration20261015120000(verbose bool) error {
+	queries := []string{
+		"alter table `rdioScannerTalkgroups` add column `site` integer not null default 0",
+	}
+	if db.Config.DbType == DbTypeSqlite {
+		queries = append(queries, "drop index `rdio_scanner_talkgroups_system_id_id`")
+	} else {
+		queries = append(queries, "drop index `rdio_scanner_talkgroups_system_id_id` on `rdioScannerTalkgroups`")
+	}
+	queries = append(queries, "create unique index `rdio_scanner_talkgroups_system_id_id_site` on `rdioScannerTalkgroups` (`systemId`, `id`, `site`)")
+	return db.migrateWithSchema("20261015120000-talkgroup-sites", queries, verbose)
+}
+
+func (db *Database) migration20261015130000(verbose bool) error {
+	queries := []string{
+		"alter table `rdioScannerCalls` add column `coldKey` varchar(255)",
+		"alter table `rdioScannerCalls` add column `coldAt` datetime",
+		"alter table `rdioScannerCalls` add column `retrievedAt` datetime",
+	}
+	return db.migrateWithSchema("20261015130000-cold-storage", queries, verbose)
+}
+
+func (db *Database) migration20261015140000(verbose bool) error {
+	queries := []string{
+		"alter table `rdioScannerCalls` add column `site` integer",
+	}
+	return db.migrateWithSchema("20261015140000-call-site", queries, verbose)
+}
+
+func (db *Database) migration20261015150000(verbose bool) error {
+	queries := []string{
+		"create table `rdioScannerEmbeds` (`_id` integer primary key auto_increment, `createdAt` datetime not null, `delay` integer not null default 0, `label` varchar(255) not null, `origins` text not null, `system` integer not null, `talkgroup` integer not null, `token` varchar(255) not null unique)",
+	}
+	return db.migrateWithSchema("20261015150000-embeds", queries, verbose)
+}
+
+func (db *Database) migration20261015160000(verbose bool) error {
+	queries := []string{
+		"alter table `rdioScannerPublishers` add column `transcripts` tinyint(1) default 0",
+	}
+	return db.migrateWithSchema("20261015160000-publisher-transcripts", queries, verbose)
+}
+
+func (db *Database) migration20261015170000(verbose bool) error {
+	queries := []string{
+		"alter table `rdioScannerPublishers` add column `discovery` varchar(255) not null default ''",
+	}
+	return db.migrateWithSchema("20261015170000-publisher-discovery", queries, verbose)
+}
+
+func (db *Database) migration20261015180000(verbose bool) error {
+	queries := []string{
+		"alter table `rdioScannerPublishers` add column `rate` integer not null default 0",
+		"alter table `rdioScannerPublishers` add column `template` varchar(1024) not null default ''",
+	}
+	return db.migrateWithSchema("20261015180000-publisher-social", queries, verbose)
+}
+
+// migration20261015190000 widens the credentials columns for their
+// encrypted values, sqlite having no length limit in the first place.
+func (db *Database) migration20261015190000(verbose bool) error {
+	var queries []string
+	if db.Config.DbType != DbTypeSqlite {
+		queries = []string{
+			"alter table `rdioScannerBroadcastifyFeeds` modify `apiKey` text not null",
+			"alter table `rdioScannerDownstreams` modify `apiKey` text not null",
+			"alter table `rdioScannerRadioReferenceSyncs` modify `appKey` text not null",
+			"alter table `rdioScannerRadioReferenceSyncs` modify `password` text not null",
+			"alter table `rdioScannerTranscribers` modify `apiKey` text not null",
+		}
+	}
+	return db.migrateWithSchema("20261015190000-secrets-columns", queries, verbose)
+}
+
+func (db *Database) migration20261015200000(verbose bool) error {
+	queries := []string{
+		"alter table `rdioScannerCalls` add column `emergency` tinyint(1) default 0",
+		"alter table `rdioScannerCalls` add column `encrypted` tinyint(1) default 0",
+		"alter table `rdioScannerCalls` add column `mode` varchar(255) not null default ''",
+		"alter table `rdioScannerCalls` add column `priority` integer not null default 0",
+		"alter table `rdioScannerTalkgroups` add column `hideEncrypted` tinyint(1) default 0",
+	}
+	return db.migrateWithSchema("20261015200000-call-flags", queries, verbose)
+}
+
+func (db *Database) migration20261015210000(verbose bool) error {
+	queries := []string{
+		"alter table `rdioScannerCalls` add column `metadata` text",
+		"alter table `rdioScannerSystems` add column `metadataFields` varchar(1024) not null default ''",
+	}
+	return db.migrateWithSchema("20261015210000-call-metadata", queries, verbose)
+}
+
+func (db *Database) migration20261015220000(verbose bool) error {
+	queries := []string{
+		"create table `rdioScannerSites` (`_id` integer primary key auto_increment, `id` integer not null, `label` varchar(255) not null, `order` integer, `systemId` integer not null)",
+		"create unique index `rdio_scanner_sites_system_id_id` on `rdioScannerSites` (`systemId`, `id`)",
+	}
+	return db.migrateWithSchema("20261015220000-system-sites", queries, verbose)
+}
+
+func (db *Database) migration20261015230000(verbose bool) error {
+	queries := []string{
+		"create table `rdioScannerRegistrations` (`_id` integer primary key auto_increment, `createdAt` datetime not null, `decidedAt` datetime, `email` varchar(255) not null, `ident` varchar(255) not null, `ip` varchar(255) not null, `message` text, `status` varchar(255) not null)",
+		"create index `rdio_scanner_registrations_email` on `rdioScannerRegistrations` (`email`)",
+	}
+	return db.migrateWithSchema("20261015230000-registrations", queries, verbose)
+}
+
+func (db *Database) migration20261016000000(verbose bool) error {
+	queries := []string{
+		"alter table `rdioScannerCalls` add column `uuid` varchar(36)",
+		"create unique index `rdio_scanner_calls_uuid` on `rdioScannerCalls` (`uuid`)",
+	}
+	return db.migrateWithSchema("20261016000000-call-uuids", queries, verbose)
+}
+
+func (db *Database) migration20261016010000(verbose bool) error {
+	queries := []string{
+		"create table `rdioScannerAlertHits` (`_id` integer primary key auto_increment, `alert` varchar(255) not null, `dateTime` datetime not null, `system` integer not null, `talkgroup` integer not null)",
+		"create index `rdio_scanner_alert_hits_date_time` on `rdioScannerAlertHits` (`dateTime`)",
+	}
+	return db.migrateWithSchema("20261016010000-alert-hits", queries, verbose)
+}
+
+func (db *Database) migration20261016020000(verbose bool) error {
+	queries := []string{
+		"create table `rdioScannerConfigVersions` (`_id` integer primary key auto_increment, `author` varchar(255) not null default '', `config` longtext not null, `dateTime` datetime not null, `note` varchar(255) not null default '')",
+	}
+	return db.migrateWithSchema("20261016020000-config-versions", queries, verbose)
+}
+
+func (db *Database) migration20261016030000(verbose bool) error {
+	queries := []string{
+		"alter table `rdioScannerTags` add column `maxDays` integer not null default 0",
+		"alter table `rdioScannerTags` add column `minDays` integer not null default 0",
+		"create table `rdioScannerDeletionCertificates` (`_id` integer primary key auto_increment, `count` integer not null, `dateTime` datetime not null, `digest` varchar(64) not null, `firstCall` datetime, `lastCall` datetime, `publicKey` varchar(64) not null, `reason` varchar(255) not null default '', `signature` varchar(128) not null)",
+	}
+	return db.migrateWithSchema("20261016030000-retention-compliance", queries, verbose)
+}
+
+func (db *Database) migration20261016040000(verbose bool) error {
+	queries := []string{
+		"alter table `rdioScannerApiKeys` add column `certificate` varchar(255) not null default ''",
+	}
+	return db.migrateWithSchema("20261016040000-apikey-certificate", queries, verbose)
+}
+
+func (db *Database) migration20261016050000(verbose bool) error {
+	queries := []string{
+		"alter table `rdioScannerTalkgroups` add column `delay` integer not null default 0",
+		"alter table `rdioScannerTalkgroups` add column `hidden` tinyint(1) default 0",
+		"alter table `rdioScannerTalkgroups` add column `muteAlerts` tinyint(1) default 0",
+	}
+	return db.migrateWithSchema("20261016050000-talkgroup-delivery", queries, verbose)
+}
+
+// migration20261016060000 creates the full-text index of the calls, of which
+// the rows are keyed by the ids of the calls: an fts5 table with sqlite, the
+// rowid being the id, a fulltext index with mysql and mariadb and a text
+// search index over the same expression as the searches with postgresql.
+func (db *Database) migration20261016060000(verbose bool) error {
+	var queries []string
+	switch db.Config.DbType {
+	case DbTypeSqlite:
+		queries = []string{
+			"create virtual table `rdioScannerCallsIndex` using fts5(`transcript`, `talkgroup`, `units`)",
+		}
+	case DbTypePostgres:
+		queries = []string{
+			"create table `rdioScannerCallsIndex` (`id` integer not null primary key, `transcript` text, `talkgroup` text, `units` text)",
+			fmt.Sprintf("create index `rdio_scanner_calls_index_text` on `rdioScannerCallsIndex` using gin (%s)", searchIndexPostgresDocument),
+		}
+	default:
+		queries = []string{
+			"create table `rdioScannerCallsIndex` (`id` integer not null primary key, `transcript` text, `talkgroup` text, `units` text, fulltext key `rdio_scanner_calls_index_text` (`transcript`, `talkgroup`, `units`), fulltext key `rdio_scanner_calls_index_talkgroup` (`talkgroup`))",
+		}
+	}
+	return db.migrateWithSchema("20261016060000-calls-index", queries, verbose)
+}
+
+func (db *Database) migrationPostgres(verbose bool) error {
+	queries := []string{
+		"create table `rdioScannerAccesses` (`_id` integer primary key auto_increment, `code` varchar(255) not null unique, `expiration` datetime, `ident` varchar(255), `limit` integer, `order` integer, `systems` text not null)",
+		"create table `rdioScannerApiKeys` (`_id` integer primary key auto_increment, `disabled` tinyint(1) default 0, `ident` varchar(255), `key` varchar(255) not null unique, `order` integer, `systems` text not null)",
+		"create table `rdioScannerCalls` (`id` integer primary key auto_increment, `audio` longblob not null, `audioName` varchar(255), `audioType` varchar(255), `dateTime` datetime not null, `frequencies` text not null, `frequency` integer, `patches` text not null, `source` integer, `sources` text not null, `system` integer not null, `talkgroup` integer not null)",
+		"create index `rdio_scanner_calls_date_time_system_talkgroup` on `rdioScannerCalls` (`dateTime`, `system`, `talkgroup`)",
+		"create table `rdioScannerConfigs` (`_id` integer primary key auto_increment, `key` varchar(255) not null unique, `val` text not null)",
+		"create index `rdio_scanner_configs_key` on `rdioScannerConfigs` (`key`)",
+		"create table `rdioScannerDirWatches` (`_id` integer primary key auto_increment, `delay` integer default 0, `deleteAfter` tinyint(1) default 0, `directory` varchar(255) not null unique, `disabled` tinyint(1) default 0, `extension` varchar(255), `frequency` integer, `mask` varchar(255), `order` integer, `systemId` integer, `talkgroupId` integer, `type` varchar(255), `usePolling` tinyint(1) default 0)",
+		"create table `rdioScannerDownstreams` (`_id` integer primary key auto_increment, `apiKey` varchar(255) not null, `disabled` tinyint(1) default 0, `order` integer, `systems` text not null, `url` varchar(255) not null)",
+		"create table `rdioScannerGroups` (`_id` integer primary key auto_increment, `label` varchar(255) not null)",
+		"create table `rdioScannerLogs` (`_id` integer primary key auto_increment, `dateTime` datetime not null, `level` varchar(255) not null, `message` varchar(255) not null)",
+		"create index `rdio_scanner_logs_date_time_level` on `rdioScannerLogs` (`dateTime`, `level`)",
+		"create table `rdioScannerSystems` (`_id` integer primary key auto_increment, `autoPopulate` tinyint(1) default 0, `blacklists` text not null, `id` integer not null unique, `label` varchar(255) not null, `led` varchar(255), `order` integer)",
+		"create table `rdioScannerTags` (`_id` integer primary key auto_increment, `label` varchar(255) not null)",
+		"create table `rdioScannerTalkgroups` (`_id` integer primary key auto_increment, `frequency` integer, `groupId` integer not null, `id` integer not null, `label` varchar(255) not null, `led` varchar(255), `name` varchar(255) not null, `order` integer, `systemId` integer not null, `tagId` integer not null)",
+		"create unique index `rdio_scanner_talkgroups_system_id_id` on `rdioScannerTalkgroups` (`systemId`, `id`)",
+		"create table `rdioScannerUnits` (`_id` integer primary key auto_increment, `id` integer not null, `label` varchar(255) not null, `order` integer, `systemId` integer not null)",
+		"create unique index `rdio_scanner_units_system_id_id` on `rdioScannerUnits` (`systemId`, `id`)",
+	}
+	return db.migrateWithSchema("20220101070000-v6.1.0-postgres", queries, verbose)
+}
+
 func (db *Database) prepareMigration() (bool, error) {
 	var (
 		err     error
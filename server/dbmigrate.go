@@ -0,0 +1,311 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// the rows copied at once, fewer when their blobs reach dbMigrateBatchBytes
+var (
+	dbMigrateBatch      = 500
+	dbMigrateBatchBytes = 32 << 20
+)
+
+// the progress of each table, kept in the target database and skipped by
+// the backups
+const dbMigrateTable = "rdioScannerDbMigration"
+
+// MigrateTo copies the data of the database to the target database, table
+// by table in batches of rows ordered by their id, the values converted as
+// for the backups. The progress of each table is kept in the target
+// database with its rows, so a migration which is interrupted resumes where
+// it stopped when started again. The rows the target tables held before,
+// like the default groups and tags, are replaced. The migrations applied
+// and the jobs are not copied, as for the backups.
+func (db *Database) MigrateTo(target *Database, progress func(table string, copied int64, total int64) error) (int64, error) {
+	formatError := func(err error) error {
+		return fmt.Errorf("database.migrateto: %v", err)
+	}
+
+	if _, err := target.Sql.Exec(fmt.Sprintf("create table if not exists `%s` (`name` varchar(255) not null primary key, `copied` integer not null, `done` integer not null, `lastKey` integer)", dbMigrateTable)); err != nil {
+		return 0, formatError(err)
+	}
+
+	tables, err := db.Tables()
+	if err != nil {
+		return 0, formatError(err)
+	}
+
+	targetTables, err := target.Tables()
+	if err != nil {
+		return 0, formatError(err)
+	}
+
+	exists := map[string]bool{}
+	for _, table := range targetTables {
+		exists[table] = true
+	}
+
+	count := int64(0)
+
+	for _, table := range tables {
+		if backupSkipTables[table] {
+			continue
+		}
+
+		if !exists[table] {
+			return count, formatError(fmt.Errorf("%s: missing from the target database", table))
+		}
+
+		copied, err := db.migrateTable(target, table, progress)
+		count += copied
+		if err != nil {
+			return count, formatError(fmt.Errorf("%s: %v", table, err))
+		}
+	}
+
+	return count, nil
+}
+
+// migrateTable copies the rows of the table not yet copied and returns how
+// many it copied.
+func (db *Database) migrateTable(target *Database, table string, progress func(table string, copied int64, total int64) error) (int64, error) {
+	var (
+		copied  int64
+		count   int64
+		done    bool
+		lastKey sql.NullInt64
+		started bool
+		total   int64
+	)
+
+	switch err := target.Sql.QueryRow(fmt.Sprintf("select `copied`, `done`, `lastKey` from `%s` where `name` = ?", dbMigrateTable), table).Scan(&copied, &done, &lastKey); err {
+	case nil:
+		started = true
+	case sql.ErrNoRows:
+	default:
+		return 0, err
+	}
+
+	if done {
+		return 0, nil
+	}
+
+	columns, kinds, err := dbMigrateColumns(db, table)
+	if err != nil {
+		return 0, err
+	}
+
+	targetColumns, _, err := dbMigrateColumns(target, table)
+	if err != nil {
+		return 0, err
+	}
+
+	has := map[string]bool{}
+	for _, column := range targetColumns {
+		has[column] = true
+	}
+
+	names := []string{}
+	indexes := []int{}
+	key := -1
+
+	for i, column := range columns {
+		if !has[column] {
+			continue
+		}
+		if column == "_id" || (column == "id" && key < 0) {
+			key = len(names)
+		}
+		indexes = append(indexes, i)
+		names = append(names, fmt.Sprintf("`%s`", column))
+	}
+
+	if len(names) == 0 {
+		return 0, nil
+	}
+
+	if err = db.Sql.QueryRow(fmt.Sprintf("select count(*) from `%s`", table)).Scan(&total); err != nil {
+		return 0, err
+	}
+
+	insert := fmt.Sprintf("insert into `%s` (%s) values (%s)", table, strings.Join(names, ", "), strings.TrimSuffix(strings.Repeat("?, ", len(names)), ", "))
+
+	for !done {
+		query := fmt.Sprintf("select %s from `%s`", strings.Join(names, ", "), table)
+		args := []any{}
+
+		// the tables without an id are copied at once
+		if key >= 0 {
+			if lastKey.Valid {
+				query += fmt.Sprintf(" where %s > ?", names[key])
+				args = append(args, lastKey.Int64)
+			}
+			query += fmt.Sprintf(" order by %s limit %d", names[key], dbMigrateBatch)
+		}
+
+		rows, err := dbMigrateRows(db, query, args, indexes, kinds)
+		if err != nil {
+			return count, err
+		}
+
+		done = key < 0 || len(rows) == 0
+
+		if key >= 0 && len(rows) > 0 {
+			k, err := strconv.ParseInt(fmt.Sprintf("%v", rows[len(rows)-1][key]), 10, 64)
+			if err != nil {
+				return count, fmt.Errorf("invalid id %v", rows[len(rows)-1][key])
+			}
+			lastKey = sql.NullInt64{Int64: k, Valid: true}
+		}
+
+		if err = target.migrateBatch(table, insert, rows, started, copied+int64(len(rows)), done, lastKey); err != nil {
+			return count, err
+		}
+
+		started = true
+		copied += int64(len(rows))
+		count += int64(len(rows))
+
+		if progress != nil && (len(rows) > 0 || done) {
+			if err = progress(table, copied, total); err != nil {
+				return count, err
+			}
+		}
+	}
+
+	return count, nil
+}
+
+// migrateBatch writes the rows along with the progress of the table in a
+// single transaction, emptying the table first when it is its first batch.
+func (db *Database) migrateBatch(table string, insert string, rows [][]any, started bool, copied int64, done bool, lastKey sql.NullInt64) error {
+	tx, err := db.Sql.Begin()
+	if err != nil {
+		return err
+	}
+
+	fail := func(err error) error {
+		tx.Rollback()
+		return err
+	}
+
+	if !started {
+		if _, err = tx.Exec(fmt.Sprintf("delete from `%s`", table)); err != nil {
+			return fail(err)
+		}
+
+		if _, err = tx.Exec(fmt.Sprintf("insert into `%s` (`name`, `copied`, `done`, `lastKey`) values (?, 0, 0, null)", dbMigrateTable), table); err != nil {
+			return fail(err)
+		}
+	}
+
+	if len(rows) > 0 {
+		stmt, err := tx.Prepare(insert)
+		if err != nil {
+			return fail(err)
+		}
+
+		for _, row := range rows {
+			if _, err = stmt.Exec(row...); err != nil {
+				stmt.Close()
+				return fail(err)
+			}
+		}
+
+		stmt.Close()
+	}
+
+	var key any
+	if lastKey.Valid {
+		key = lastKey.Int64
+	}
+
+	if _, err = tx.Exec(fmt.Sprintf("update `%s` set `copied` = ?, `done` = ?, `lastKey` = ? where `name` = ?", dbMigrateTable), copied, done, key, table); err != nil {
+		return fail(err)
+	}
+
+	return tx.Commit()
+}
+
+func dbMigrateColumns(db *Database, table string) ([]string, []string, error) {
+	rows, err := db.Sql.Query(fmt.Sprintf("select * from `%s` where 1 = 0", table))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	kinds := make([]string, len(types))
+	for i, t := range types {
+		kinds[i] = backupColumnKind(t.DatabaseTypeName())
+	}
+
+	return columns, kinds, nil
+}
+
+// dbMigrateRows reads the rows of a batch, stopping early once their blobs
+// reach dbMigrateBatchBytes.
+func dbMigrateRows(db *Database, query string, args []any, indexes []int, kinds []string) ([][]any, error) {
+	rows, err := db.Sql.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	batch := [][]any{}
+	size := 0
+
+	values := make([]any, len(indexes))
+	dest := make([]any, len(indexes))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+
+	for size < dbMigrateBatchBytes && rows.Next() {
+		if err = rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		row := make([]any, len(values))
+		for i, v := range values {
+			kind := kinds[indexes[i]]
+
+			if b, ok := v.([]byte); ok && kind == backupKindBlob {
+				size += len(b)
+			}
+
+			row[i] = restoreValue(kind, backupValue(kind, v, db))
+		}
+
+		batch = append(batch, row)
+	}
+
+	return batch, rows.Err()
+}
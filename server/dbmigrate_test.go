@@ -0,0 +1,168 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDatabaseMigrateTo(t *testing.T) {
+	batch := dbMigrateBatch
+	dbMigrateBatch = 2
+	defer func() { dbMigrateBatch = batch }()
+
+	source := newTestDatabase(t)
+	calls := NewCalls()
+
+	dateTime := time.Date(2026, 10, 14, 3, 30, 15, 0, time.UTC)
+
+	ids := []uint{}
+	for i := uint(1); i <= 5; i++ {
+		id, err := calls.WriteCall(&Call{Audio: make([]byte, 64+i), AudioName: "a.mp3", AudioType: "audio/mpeg", DateTime: dateTime.Add(time.Duration(i) * time.Minute), System: 1, Talkgroup: i}, source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	// the groups differ from the defaults the target is seeded with
+	if _, err := source.Sql.Exec("delete from `rdioScannerGroups` where `_id` = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := source.Sql.Exec("insert into `rdioScannerGroups` (`_id`, `label`) values (100, 'Custom')"); err != nil {
+		t.Fatal(err)
+	}
+
+	target := newTestDatabase(t)
+
+	stop := errors.New("stop")
+
+	before := map[string]bool{}
+
+	// interrupted after the first batch of calls
+	_, err := source.MigrateTo(target, func(table string, copied int64, total int64) error {
+		if table == "rdioScannerCalls" {
+			return stop
+		}
+		before[table] = true
+		return nil
+	})
+	if err == nil || !strings.HasSuffix(err.Error(), stop.Error()) {
+		t.Fatalf("MigrateTo() error = %v, want %v", err, stop)
+	}
+
+	var n int
+	if err = target.Sql.QueryRow("select count(*) from `rdioScannerCalls`").Scan(&n); err != nil || n != 2 {
+		t.Fatalf("%d calls copied before the interruption, %v, want 2", n, err)
+	}
+
+	reported := map[string]int64{}
+
+	count, err := source.MigrateTo(target, func(table string, copied int64, total int64) error {
+		if copied > total {
+			t.Errorf("%s copied %d of %d", table, copied, total)
+		}
+		reported[table] = copied
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reported["rdioScannerCalls"] != 5 {
+		t.Errorf("calls copied %d, want 5", reported["rdioScannerCalls"])
+	}
+	for table := range before {
+		if _, ok := reported[table]; ok {
+			t.Errorf("%s copied again when resuming", table)
+		}
+	}
+	if count == 0 {
+		t.Error("nothing copied when resuming")
+	}
+
+	for i, id := range ids {
+		call, err := calls.GetCall(id, target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if call.Talkgroup != uint(i+1) || len(call.Audio) != 65+i || !call.DateTime.Equal(dateTime.Add(time.Duration(i+1)*time.Minute)) {
+			t.Errorf("call %d copied with talkgroup %d, audio %d bytes, datetime %v", id, call.Talkgroup, len(call.Audio), call.DateTime)
+		}
+	}
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"select count(*) from `rdioScannerCalls`", 5},
+		{"select count(*) from `rdioScannerGroups` where `_id` = 1", 0},
+		{"select count(*) from `rdioScannerGroups` where `_id` = 100 and `label` = 'Custom'", 1},
+		{"select count(*) from `rdioScannerDbMigration` where `done` = 0", 0},
+	}
+
+	for _, test := range tests {
+		if err = target.Sql.QueryRow(test.query).Scan(&n); err != nil || n != test.want {
+			t.Errorf("%s = %d, %v, want %d", test.query, n, err, test.want)
+		}
+	}
+
+	// a migration done is not copied again
+	if count, err = source.MigrateTo(target, nil); err != nil || count != 0 {
+		t.Errorf("MigrateTo() again = %d, %v, want 0", count, err)
+	}
+
+	// the ids go on from the copied ones
+	id, err := calls.WriteCall(&Call{Audio: make([]byte, 64), DateTime: time.Now(), System: 1, Talkgroup: 1}, target)
+	if err != nil || id <= ids[len(ids)-1] {
+		t.Errorf("new call id %d, %v, want more than %d", id, err, ids[len(ids)-1])
+	}
+}
+
+func TestDatabaseMigrateToSmallBatches(t *testing.T) {
+	batchBytes := dbMigrateBatchBytes
+	dbMigrateBatchBytes = 50
+	defer func() { dbMigrateBatchBytes = batchBytes }()
+
+	source := newTestDatabase(t)
+	calls := NewCalls()
+
+	for i := uint(1); i <= 3; i++ {
+		if _, err := calls.WriteCall(&Call{Audio: make([]byte, 80), DateTime: time.Now(), System: 1, Talkgroup: i}, source); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	target := newTestDatabase(t)
+
+	batches := 0
+	if _, err := source.MigrateTo(target, func(table string, copied int64, total int64) error {
+		if table == "rdioScannerCalls" {
+			batches++
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// one call for each batch, its audio over the budget, then the empty one ending the table
+	if batches != 4 {
+		t.Errorf("%d batches of calls, want 4", batches)
+	}
+}
@@ -0,0 +1,326 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// the durations of two recordings of the same transmission differ by no more
+// than the greater of these
+const (
+	duplicateDurationRatio     = 0.25
+	duplicateDurationTolerance = time.Second
+)
+
+// CallRecording is the fingerprint of a recording, used to tell apart the
+// duplicates received from several recorders and to keep the best of them.
+type CallRecording struct {
+	Duration time.Duration
+	Errors   uint
+	Id       uint
+	Size     int
+	Sources  int
+	Spikes   uint
+	signal   bool
+}
+
+func NewCallRecording(call *Call) *CallRecording {
+	recording := &CallRecording{
+		Duration: call.Duration,
+		Size:     len(call.Audio),
+	}
+
+	switch v := call.Id.(type) {
+	case uint:
+		recording.Id = v
+	}
+
+	recording.setFrequencies(call.Frequencies)
+	recording.setSources(call.Sources)
+
+	return recording
+}
+
+// IsBetter tells if the recording has a better signal than the other one,
+// that is fewer decoding errors and spikes, then more identified units,
+// then a longer and finally a larger audio.
+func (recording *CallRecording) IsBetter(other *CallRecording) bool {
+	if recording.signal && other.signal {
+		if a, b := recording.Errors+recording.Spikes, other.Errors+other.Spikes; a != b {
+			return a < b
+		}
+	} else if recording.signal != other.signal {
+		return recording.signal
+	}
+
+	if recording.Sources != other.Sources {
+		return recording.Sources > other.Sources
+	}
+
+	if recording.Duration != other.Duration {
+		return recording.Duration > other.Duration
+	}
+
+	return recording.Size > other.Size
+}
+
+// Matches tells if both recordings last about as long, the recordings of
+// which the duration is unknown always matching.
+func (recording *CallRecording) Matches(other *CallRecording) bool {
+	if recording.Duration <= 0 || other.Duration <= 0 {
+		return true
+	}
+
+	d := recording.Duration - other.Duration
+	if d < 0 {
+		d = -d
+	}
+
+	longest := recording.Duration
+	if other.Duration > longest {
+		longest = other.Duration
+	}
+
+	tolerance := time.Duration(float64(longest) * duplicateDurationRatio)
+	if tolerance < duplicateDurationTolerance {
+		tolerance = duplicateDurationTolerance
+	}
+
+	return d <= tolerance
+}
+
+func (recording *CallRecording) setFrequencies(frequencies any) {
+	count := func(v any) (uint, bool) {
+		switch v := v.(type) {
+		case float64:
+			return uint(v), true
+		case int:
+			return uint(v), true
+		case uint:
+			return v, true
+		}
+		return 0, false
+	}
+
+	add := func(f map[string]any) {
+		if n, ok := count(f["errorCount"]); ok {
+			recording.Errors += n
+			recording.signal = true
+		}
+		if n, ok := count(f["spikeCount"]); ok {
+			recording.Spikes += n
+			recording.signal = true
+		}
+	}
+
+	switch v := frequencies.(type) {
+	case []any:
+		for _, f := range v {
+			if m, ok := f.(map[string]any); ok {
+				add(m)
+			}
+		}
+	case []map[string]any:
+		for _, f := range v {
+			add(f)
+		}
+	}
+}
+
+func (recording *CallRecording) setSources(sources any) {
+	units := map[any]bool{}
+
+	add := func(s map[string]any) {
+		if src, ok := s["src"]; ok {
+			switch v := src.(type) {
+			case float64:
+				if v > 0 {
+					units[uint(v)] = true
+				}
+			case int:
+				if v > 0 {
+					units[uint(v)] = true
+				}
+			case uint:
+				if v > 0 {
+					units[v] = true
+				}
+			}
+		}
+	}
+
+	switch v := sources.(type) {
+	case []any:
+		for _, s := range v {
+			if m, ok := s.(map[string]any); ok {
+				add(m)
+			}
+		}
+	case []map[string]any:
+		for _, s := range v {
+			add(s)
+		}
+	}
+
+	recording.Sources = len(units)
+}
+
+// GetDuplicates returns the recordings of the calls of the same system and
+// talkgroup received within the time frame of the call.
+func (calls *Calls) GetDuplicates(call *Call, msTimeFrame uint, db *Database) ([]*CallRecording, error) {
+	var (
+		duration    sql.NullFloat64
+		err         error
+		frequencies sql.NullString
+		id          uint
+		recordings  = []*CallRecording{}
+		rows        *sql.Rows
+		sources     sql.NullString
+	)
+
+	calls.mutex.Lock()
+	defer calls.mutex.Unlock()
+
+	formatError := func(err error) error {
+		return fmt.Errorf("calls.getduplicates: %v", err)
+	}
+
+	d := time.Duration(msTimeFrame) * time.Millisecond
+
+	query := db.Select("rdioScannerCalls", "id", "duration", "frequencies", "sources").Where(
+		SqlWhere("`dateTime` between ? and ?", call.DateTime.Add(-d), call.DateTime.Add(d)),
+		SqlWhere("`system` = ?", call.System),
+		SqlWhere("`talkgroup` = ?", call.Talkgroup),
+	).OrderBy("id", false)
+
+	if rows, err = query.Query(); err != nil {
+		return nil, formatError(err)
+	}
+
+	for rows.Next() {
+		if err = rows.Scan(&id, &duration, &frequencies, &sources); err != nil {
+			break
+		}
+
+		recording := &CallRecording{Id: id}
+
+		if duration.Valid {
+			recording.Duration = time.Duration(duration.Float64) * time.Millisecond
+		}
+
+		if frequencies.Valid {
+			var f any
+			if err := json.Unmarshal([]byte(frequencies.String), &f); err == nil {
+				recording.setFrequencies(f)
+			}
+		}
+
+		if sources.Valid {
+			var s any
+			if err := json.Unmarshal([]byte(sources.String), &s); err == nil {
+				recording.setSources(s)
+			}
+		}
+
+		recordings = append(recordings, recording)
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return nil, formatError(err)
+	}
+
+	return recordings, nil
+}
+
+// WriteRecording replaces the recording of an archived call with the one of
+// a duplicate, keeping the id and the date time of the archived call.
+func (calls *Calls) WriteRecording(call *Call, db *Database) error {
+	var (
+		b           []byte
+		err         error
+		frequencies string
+		sources     string
+	)
+
+	formatError := func(err error) error {
+		return fmt.Errorf("call.writerecording: %v", err)
+	}
+
+	if err = calls.WriteAudio(call, db); err != nil {
+		return formatError(err)
+	}
+
+	switch v := call.Frequencies.(type) {
+	case []map[string]any:
+		if b, err = json.Marshal(v); err != nil {
+			return formatError(err)
+		}
+		frequencies = string(b)
+	}
+
+	switch v := call.Sources.(type) {
+	case []map[string]any:
+		if b, err = json.Marshal(v); err != nil {
+			return formatError(err)
+		}
+		sources = string(b)
+	}
+
+	calls.mutex.Lock()
+	defer calls.mutex.Unlock()
+
+	if _, err = db.Sql.Exec("update `rdioScannerCalls` set `duration` = ?, `frequencies` = ?, `frequency` = ?, `source` = ?, `sources` = ? where `id` = ?", call.Duration.Milliseconds(), frequencies, call.Frequency, call.Source, sources, call.Id); err != nil {
+		return formatError(err)
+	}
+
+	return nil
+}
+
+// MergeDuplicate keeps the best of the recordings of a transmission received
+// from several recorders, replacing the archived call with the new one when
+// it has a better signal. It returns what became of the call, nothing when
+// the call isn't a duplicate.
+func (controller *Controller) MergeDuplicate(call *Call, duplicates []*CallRecording) (string, error) {
+	recording := NewCallRecording(call)
+
+	for _, duplicate := range duplicates {
+		if !recording.Matches(duplicate) {
+			continue
+		}
+
+		if !recording.IsBetter(duplicate) {
+			return fmt.Sprintf("duplicate call rejected, call %d has a better recording", duplicate.Id), nil
+		}
+
+		call.Id = duplicate.Id
+
+		if err := controller.Calls.WriteRecording(call, controller.Database); err != nil {
+			return "", err
+		}
+
+		call.trace.SetCallId(duplicate.Id)
+
+		return fmt.Sprintf("duplicate call merged into call %d", duplicate.Id), nil
+	}
+
+	return "", nil
+}
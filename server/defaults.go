@@ -25,6 +25,8 @@ type Defaults struct {
 	adminPassword           string
 	adminPasswordNeedChange bool
 	access                  DefaultAccess
+	callTraces              int
+	transcriptionWorkers    int
 	apikey                  DefaultApikey
 	dirwatch                DefaultDirwatch
 	downstream              DefaultDownstream
@@ -57,17 +59,47 @@ type DefaultDownstream struct {
 
 type DefaultOptions struct {
 	autoPopulate                bool
+	audioBitrate                uint
+	audioCodec                  string
 	audioConversion             uint
+	audioCues                   bool
+	autoLearnUnits              bool
+	autoMuteDuration            uint
+	autoMuteMinCalls            uint
+	autoMuteRate                uint
+	backupAudio                 bool
+	backupKeep                  uint
+	backupSchedule              string
+	clientBufferSize            uint
+	clientCallQueue             uint
+	coldStorageDays             uint
 	dimmerDelay                 uint
+	dirwatchQuarantine          bool
+	dirwatchStaleMinutes        uint
 	disableDuplicateDetection   bool
+	duplicateDetectionMode      string
 	duplicateDetectionTimeFrame uint
+	errorMessage                string
+	ingestPipeline              string
 	keypadBeeps                 string
+	liveCaptions                bool
+	maintenance                 bool
+	maintenanceMessage          string
 	maxClients                  uint
 	playbackGoesLive            bool
 	pruneDays                   uint
+	registration                bool
+	registrationMax             uint
+	retentionCompliance         bool
 	searchPatchedTalkgroups     bool
+	shareLinks                  bool
 	showListenersCount          bool
+	showOccupancy               bool
+	slowClientPolicy            string
+	smtpPort                    uint
+	smtpTls                     string
 	sortTalkgroups              bool
+	subscriptionsCooldown       uint
 	tagsToggle                  bool
 	time12hFormat               bool
 }
@@ -94,6 +126,8 @@ var defaults Defaults = Defaults{
 		ident:   "Unknown",
 		systems: "*",
 	},
+	callTraces:           200,
+	transcriptionWorkers: 2,
 	dirwatch: DefaultDirwatch{
 		deleteAfter: true,
 		disabled:    false,
@@ -112,18 +146,48 @@ var defaults Defaults = Defaults{
 	},
 	keypadBeeps: "uniden",
 	options: DefaultOptions{
+		audioBitrate:                32,
+		audioCodec:                  AUDIO_CODEC_AAC,
 		audioConversion:             AUDIO_CONVERSION_ENABLED,
+		audioCues:                   false,
+		autoLearnUnits:              false,
+		autoMuteDuration:            30,
+		autoMuteMinCalls:            10,
+		autoMuteRate:                0,
 		autoPopulate:                true,
+		backupAudio:                 false,
+		backupKeep:                  7,
+		backupSchedule:              "",
+		clientBufferSize:            8192,
+		clientCallQueue:             500,
+		coldStorageDays:             0,
 		dimmerDelay:                 5000,
+		dirwatchQuarantine:          false,
+		dirwatchStaleMinutes:        60,
 		disableDuplicateDetection:   false,
+		duplicateDetectionMode:      DUPLICATE_DETECTION_DROP,
 		duplicateDetectionTimeFrame: 500,
+		errorMessage:                "Something went wrong on our side, please try again in a moment.",
+		ingestPipeline:              "validate, dedupe, transcode, store, broadcast, alert, transcribe",
 		keypadBeeps:                 "uniden",
+		liveCaptions:                false,
+		maintenance:                 false,
+		maintenanceMessage:          "The scanner is down for maintenance, please come back later.",
 		maxClients:                  200,
 		playbackGoesLive:            false,
 		pruneDays:                   7,
+		registration:                false,
+		registrationMax:             100,
+		retentionCompliance:         false,
 		searchPatchedTalkgroups:     false,
+		shareLinks:                  false,
 		showListenersCount:          false,
+		showOccupancy:               false,
+		slowClientPolicy:            SLOW_CLIENT_DROP,
+		smtpPort:                    587,
+		smtpTls:                     SmtpTlsStarttls,
 		sortTalkgroups:              false,
+		subscriptionsCooldown:       300,
 		tagsToggle:                  false,
 		time12hFormat:               false,
 	},
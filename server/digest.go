@@ -0,0 +1,567 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	digestTopLimit   = 10
+	digestUnitsLimit = 50
+)
+
+// digestTemplate is the text of the digests when the digest template option
+// is empty. The custom templates are given the same Digest and functions.
+const digestTemplate = `Rdio Scanner activity from {{date .From}} to {{date .To}}
+
+Calls: {{.Calls}}
+Audio stored: {{bytes .Storage.AudioBytes}}, database size: {{bytes .Storage.DatabaseBytes}}
+
+Busiest talkgroups:
+{{range .Talkgroups}}- {{.SystemLabel}} / {{.TalkgroupLabel}}: {{.Calls}} calls, {{airtime .Airtime}}
+{{else}}- none
+{{end}}
+Top alerts:
+{{range .Alerts}}- {{.Label}}: {{.Count}} hits
+{{else}}- none
+{{end}}
+New units: {{.NewUnitsTotal}}
+{{range .NewUnits}}- {{.SystemLabel}} / {{.Label}} ({{.Id}})
+{{end}}`
+
+var digestFuncs = template.FuncMap{
+	"airtime": func(seconds float64) string {
+		return (time.Duration(seconds) * time.Second).String()
+	},
+	"bytes": func(n int64) string {
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1024*1024))
+	},
+	"date": func(t time.Time) string {
+		return t.Local().Format("2006-01-02 15:04")
+	},
+}
+
+// Digest is the summary of the activity of a period.
+type Digest struct {
+	Alerts        []*DigestCount     `json:"alerts"`
+	Calls         uint               `json:"calls"`
+	From          time.Time          `json:"from"`
+	NewUnits      []*DigestUnit      `json:"newUnits"`
+	NewUnitsTotal uint               `json:"newUnitsTotal"`
+	Storage       DigestStorage      `json:"storage"`
+	Talkgroups    []*DigestTalkgroup `json:"talkgroups"`
+	To            time.Time          `json:"to"`
+}
+
+type DigestCount struct {
+	Count uint   `json:"count"`
+	Label string `json:"label"`
+}
+
+// DigestStorage tells the audio stored in the database during the period,
+// the external stores having no cheap way to tell it, and the size of the
+// database at its end.
+type DigestStorage struct {
+	AudioBytes    int64 `json:"audioBytes"`
+	DatabaseBytes int64 `json:"databaseBytes"`
+}
+
+type DigestTalkgroup struct {
+	Airtime        float64 `json:"airtime"`
+	Calls          uint    `json:"calls"`
+	System         uint    `json:"system"`
+	SystemLabel    string  `json:"systemLabel"`
+	Talkgroup      uint    `json:"talkgroup"`
+	TalkgroupLabel string  `json:"talkgroupLabel"`
+}
+
+type DigestUnit struct {
+	FirstHeard  time.Time `json:"firstHeard"`
+	Id          uint      `json:"id"`
+	Label       string    `json:"label"`
+	System      uint      `json:"system"`
+	SystemLabel string    `json:"systemLabel"`
+}
+
+// Digests sends the activity digests on the schedule of the digest schedule
+// option, by email to the digest email or the admin email, and to the digest
+// webhook. Each digest covers the time since the previous run of the
+// schedule, ie: the last day of a daily schedule.
+type Digests struct {
+	Controller *Controller
+	cancel     chan struct{}
+	checked    time.Time
+	invalid    string
+	mutex      sync.Mutex
+}
+
+func NewDigests(controller *Controller) *Digests {
+	return &Digests{
+		Controller: controller,
+		cancel:     make(chan struct{}),
+	}
+}
+
+// Enabled tells if the digests have somewhere to go.
+func (digests *Digests) Enabled() bool {
+	options := digests.Controller.Options
+
+	return len(options.DigestWebhook) > 0 || len(digests.recipients()) > 0
+}
+
+// Generate summarizes the activity between from and to.
+func (digests *Digests) Generate(from time.Time, to time.Time) (*Digest, error) {
+	var (
+		audioBytes sql.NullFloat64
+		controller = digests.Controller
+		db         = digests.Controller.Database
+		err        error
+	)
+
+	formatError := func(err error) error {
+		return fmt.Errorf("digests.generate: %v", err)
+	}
+
+	from, to = from.UTC(), to.UTC()
+
+	digest := &Digest{
+		Alerts:     []*DigestCount{},
+		From:       from,
+		NewUnits:   []*DigestUnit{},
+		Talkgroups: []*DigestTalkgroup{},
+		To:         to,
+	}
+
+	if err = db.Sql.QueryRow("select count(*), sum(length(`audio`)) from `rdioScannerCalls` where `dateTime` >= ? and `dateTime` < ?", from, to).Scan(&digest.Calls, &audioBytes); err != nil {
+		return nil, formatError(err)
+	}
+	digest.Storage.AudioBytes = int64(audioBytes.Float64)
+
+	if digest.Storage.DatabaseBytes, err = db.Size(); err != nil {
+		return nil, formatError(err)
+	}
+
+	rows, err := db.Sql.Query(fmt.Sprintf("select `system`, `talkgroup`, count(*), sum(`duration`) from `rdioScannerCalls` where `dateTime` >= ? and `dateTime` < ? group by `system`, `talkgroup` order by count(*) desc, sum(`duration`) desc limit %d", digestTopLimit), from, to)
+	if err != nil {
+		return nil, formatError(err)
+	}
+
+	for rows.Next() {
+		var duration sql.NullFloat64
+
+		talkgroup := &DigestTalkgroup{}
+		if err = rows.Scan(&talkgroup.System, &talkgroup.Talkgroup, &talkgroup.Calls, &duration); err != nil {
+			break
+		}
+		talkgroup.Airtime = duration.Float64 / 1000
+		talkgroup.SystemLabel, talkgroup.TalkgroupLabel = digests.labels(talkgroup.System, talkgroup.Talkgroup)
+
+		digest.Talkgroups = append(digest.Talkgroups, talkgroup)
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return nil, formatError(err)
+	}
+
+	rows, err = db.Sql.Query(fmt.Sprintf("select `alert`, count(*) from `rdioScannerAlertHits` where `dateTime` >= ? and `dateTime` < ? group by `alert` order by count(*) desc, `alert` limit %d", digestTopLimit), from, to)
+	if err != nil {
+		return nil, formatError(err)
+	}
+
+	for rows.Next() {
+		count := &DigestCount{}
+		if err = rows.Scan(&count.Label, &count.Count); err != nil {
+			break
+		}
+
+		digest.Alerts = append(digest.Alerts, count)
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return nil, formatError(err)
+	}
+
+	controller.Systems.mutex.Lock()
+	systems := append([]*System{}, controller.Systems.List...)
+	controller.Systems.mutex.Unlock()
+
+	for _, system := range systems {
+		if system.Units == nil {
+			continue
+		}
+
+		system.Units.mutex.Lock()
+		for _, unit := range system.Units.List {
+			if unit.FirstHeard == nil || unit.FirstHeard.Before(from) || !unit.FirstHeard.Before(to) {
+				continue
+			}
+
+			digest.NewUnitsTotal++
+			digest.NewUnits = append(digest.NewUnits, &DigestUnit{
+				FirstHeard:  unit.FirstHeard.UTC(),
+				Id:          unit.Id,
+				Label:       unit.Label,
+				System:      system.Id,
+				SystemLabel: system.Label,
+			})
+		}
+		system.Units.mutex.Unlock()
+	}
+
+	sort.Slice(digest.NewUnits, func(i, j int) bool {
+		return digest.NewUnits[i].FirstHeard.Before(digest.NewUnits[j].FirstHeard)
+	})
+
+	if len(digest.NewUnits) > digestUnitsLimit {
+		digest.NewUnits = digest.NewUnits[:digestUnitsLimit]
+	}
+
+	return digest, nil
+}
+
+// Render returns the text of the digest, written with the digest template
+// option or the default template.
+func (digests *Digests) Render(digest *Digest) (string, error) {
+	var b strings.Builder
+
+	text := digests.Controller.Options.DigestTemplate
+	if len(strings.TrimSpace(text)) == 0 {
+		text = digestTemplate
+	}
+
+	t, err := template.New("digest").Funcs(digestFuncs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	if err = t.Execute(&b, digest); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+// Send emails the digest and posts it to the webhook, both being attempted
+// when one fails.
+func (digests *Digests) Send(digest *Digest) error {
+	var (
+		controller = digests.Controller
+		errs       = []string{}
+		options    = digests.Controller.Options
+	)
+
+	text, err := digests.Render(digest)
+	if err != nil {
+		// a broken template still lets the digest out
+		controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("digests.send: invalid digest template, %v", err))
+
+		t := template.Must(template.New("digest").Funcs(digestFuncs).Parse(digestTemplate))
+
+		var b strings.Builder
+		if err = t.Execute(&b, digest); err != nil {
+			return fmt.Errorf("digests.send: %v", err)
+		}
+		text = b.String()
+	}
+
+	if to := digests.recipients(); len(to) > 0 {
+		subject := fmt.Sprintf("Rdio Scanner activity digest, %s", digest.To.Local().Format("2006-01-02"))
+
+		if err := controller.Mailer.Send(options.DigestEmail, to, subject, text); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(options.DigestWebhook) > 0 {
+		if err := digests.post(digest, text); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("digests.send: %s", strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+func (digests *Digests) Start() error {
+	digests.checked = time.Now().Truncate(time.Minute)
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-digests.cancel:
+				return
+			case t := <-ticker.C:
+				digests.check(t)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// DigestJob generates and sends the digest of the period of the job, its
+// retries covering the same period.
+func (digests *Digests) DigestJob(job *Job, cancel <-chan struct{}) error {
+	from, to, err := digestJobPeriod(job.Payload)
+	if err != nil {
+		return err
+	}
+
+	digest, err := digests.Generate(from, to)
+	if err != nil {
+		return err
+	}
+
+	if err = digests.Send(digest); err != nil {
+		return err
+	}
+
+	digests.Controller.Logs.LogEvent(LogLevelInfo, fmt.Sprintf("digest: %d calls from %s to %s sent", digest.Calls, from.Format(time.RFC3339), to.Format(time.RFC3339)))
+
+	return nil
+}
+
+// check queues a digest when the schedule matched any minute since the last
+// check, a tick coming late not skipping its minute.
+func (digests *Digests) check(t time.Time) {
+	controller := digests.Controller
+
+	digests.mutex.Lock()
+	defer digests.mutex.Unlock()
+
+	from := digests.checked
+	digests.checked = t.Truncate(time.Minute)
+
+	schedule := strings.TrimSpace(controller.Options.DigestSchedule)
+	if len(schedule) == 0 || !digests.Enabled() {
+		return
+	}
+
+	cron, err := ParseCron(schedule)
+	if err != nil {
+		// reported once until the schedule changes
+		if digests.invalid != schedule {
+			digests.invalid = schedule
+			controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("digest: skipped, %v", err))
+		}
+		return
+	}
+
+	digests.invalid = ""
+
+	var due time.Time
+	for m := from.Add(time.Minute); !m.After(digests.checked); m = m.Add(time.Minute) {
+		if cron.Match(m) {
+			due = m
+		}
+	}
+
+	if due.IsZero() {
+		return
+	}
+
+	if _, err := controller.Jobs.Enqueue(JobKindDigest, digestJobPayload(digestPreviousRun(cron, due), due), JobPriorityNormal); err != nil {
+		controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("digests.check: %v", err))
+	}
+}
+
+func (digests *Digests) labels(systemId uint, talkgroupId uint) (string, string) {
+	systemLabel := strconv.FormatUint(uint64(systemId), 10)
+	talkgroupLabel := strconv.FormatUint(uint64(talkgroupId), 10)
+
+	if system, ok := digests.Controller.Systems.GetSystem(systemId); ok {
+		systemLabel = system.Label
+
+		if talkgroup, ok := system.Talkgroups.GetTalkgroup(talkgroupId); ok {
+			if len(talkgroup.Name) > 0 {
+				talkgroupLabel = talkgroup.Name
+			} else if len(talkgroup.Label) > 0 {
+				talkgroupLabel = talkgroup.Label
+			}
+		}
+	}
+
+	return systemLabel, talkgroupLabel
+}
+
+func (digests *Digests) post(digest *Digest, text string) error {
+	b, err := json.Marshal(map[string]any{"digest": digest, "text": text})
+	if err != nil {
+		return err
+	}
+
+	c := http.Client{Timeout: 30 * time.Second}
+
+	res, err := c.Post(digests.Controller.Options.DigestWebhook, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("bad status: %s", res.Status)
+	}
+
+	return nil
+}
+
+// recipients returns the recipients of the digest email, or the admin
+// email, when the emails can be sent.
+func (digests *Digests) recipients() []string {
+	var (
+		mailer  = digests.Controller.Mailer
+		options = digests.Controller.Options
+	)
+
+	if !mailer.Available(options.DigestEmail) {
+		return []string{}
+	}
+
+	to := mailer.Recipients(options.DigestEmail)
+	if len(to) == 0 && len(options.AdminEmail) > 0 {
+		to = []string{options.AdminEmail}
+	}
+
+	return to
+}
+
+// DigestHandler previews on GET the digest of the last hours, 24 by
+// default, ie: /api/admin/digest?hours=168, and sends it on POST.
+func (admin *Admin) DigestHandler(w http.ResponseWriter, r *http.Request) {
+	if !admin.Authorize(w, r, adminWriteRole(r)) {
+		return
+	}
+
+	digests := admin.Controller.Digests
+
+	hours := 24
+	if v := r.URL.Query().Get("hours"); len(v) > 0 {
+		i, err := strconv.Atoi(v)
+		if err != nil || i < 1 || i > 24*366 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		hours = i
+	}
+
+	to := time.Now().Truncate(time.Minute)
+	from := to.Add(-time.Duration(hours) * time.Hour)
+
+	writeJson := func(v any) {
+		if b, err := json.Marshal(v); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		digest, err := digests.Generate(from, to)
+		if err != nil {
+			admin.Controller.Logs.LogEvent(LogLevelError, err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		p := map[string]any{"digest": digest}
+		if text, err := digests.Render(digest); err == nil {
+			p["text"] = text
+		} else {
+			p["error"] = err.Error()
+		}
+
+		writeJson(p)
+
+	case http.MethodPost:
+		if !digests.Enabled() {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		job, err := admin.Controller.Jobs.Enqueue(JobKindDigest, digestJobPayload(from, to), JobPriorityHigh)
+		if err != nil {
+			admin.Controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("admin.digesthandler: %v", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+		writeJson(job)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// digestPreviousRun returns the run of the schedule before t, looking back
+// as far as a monthly schedule goes, or the day before when none is found.
+func digestPreviousRun(cron *Cron, t time.Time) time.Time {
+	for m := t.Add(-time.Minute); t.Sub(m) <= 31*24*time.Hour; m = m.Add(-time.Minute) {
+		if cron.Match(m) {
+			return m
+		}
+	}
+
+	return t.Add(-24 * time.Hour)
+}
+
+func digestJobPayload(from time.Time, to time.Time) map[string]any {
+	return map[string]any{
+		"from": from.UTC().Format(time.RFC3339),
+		"to":   to.UTC().Format(time.RFC3339),
+	}
+}
+
+func digestJobPeriod(payload map[string]any) (time.Time, time.Time, error) {
+	from, _ := payload["from"].(string)
+	to, _ := payload["to"].(string)
+
+	f, err := time.Parse(time.RFC3339, from)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.New("digest job without a period")
+	}
+
+	t, err := time.Parse(time.RFC3339, to)
+	if err != nil || !t.After(f) {
+		return time.Time{}, time.Time{}, errors.New("digest job without a period")
+	}
+
+	return f, t, nil
+}
@@ -0,0 +1,254 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestDigests(t *testing.T) *Controller {
+	t.Helper()
+
+	controller := newTestController(t, nil)
+
+	system := NewSystem()
+	system.Id = 1
+	system.Label = "County"
+	system.Talkgroups.List = append(system.Talkgroups.List, &Talkgroup{Id: 10, Label: "FD", Name: "Fire Dispatch"})
+	controller.Systems.List = append(controller.Systems.List, system)
+
+	return controller
+}
+
+func TestDigestPreviousRun(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule string
+		t        time.Time
+		want     time.Time
+	}{
+		{"daily", "0 7 * * *", time.Date(2026, 10, 14, 7, 0, 0, 0, time.Local), time.Date(2026, 10, 13, 7, 0, 0, 0, time.Local)},
+		{"weekly", "0 7 * * 1", time.Date(2026, 10, 12, 7, 0, 0, 0, time.Local), time.Date(2026, 10, 5, 7, 0, 0, 0, time.Local)},
+		{"monthly", "0 0 1 * *", time.Date(2026, 10, 1, 0, 0, 0, 0, time.Local), time.Date(2026, 9, 1, 0, 0, 0, 0, time.Local)},
+		{"yearly falls back to a day", "0 0 1 1 *", time.Date(2026, 1, 1, 0, 0, 0, 0, time.Local), time.Date(2025, 12, 31, 0, 0, 0, 0, time.Local)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cron, err := ParseCron(test.schedule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := digestPreviousRun(cron, test.t); !got.Equal(test.want) {
+				t.Errorf("digestPreviousRun(%q, %v) = %v, want %v", test.schedule, test.t, got, test.want)
+			}
+		})
+	}
+}
+
+func TestDigestJobPeriod(t *testing.T) {
+	from := time.Date(2026, 10, 13, 7, 0, 0, 0, time.UTC)
+	to := from.Add(24 * time.Hour)
+
+	tests := []struct {
+		name    string
+		payload map[string]any
+		wantErr bool
+	}{
+		{"period", digestJobPayload(from, to), false},
+		{"empty", map[string]any{}, true},
+		{"reversed", digestJobPayload(to, from), true},
+		{"invalid", map[string]any{"from": "yesterday", "to": "today"}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, to2, err := digestJobPeriod(test.payload)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, want error %v", err, test.wantErr)
+			}
+			if err == nil && (!f.Equal(from) || !to2.Equal(to)) {
+				t.Errorf("period = %v %v, want %v %v", f, to2, from, to)
+			}
+		})
+	}
+}
+
+func TestDigestsGenerate(t *testing.T) {
+	controller := newTestDigests(t)
+
+	// the alert hits are recorded now
+	to := time.Now().UTC().Add(time.Minute)
+	from := to.Add(-24 * time.Hour)
+
+	write := func(talkgroup uint, dateTime time.Time, duration time.Duration) {
+		call := &Call{Audio: []byte{0, 1, 2, 3}, DateTime: dateTime, Duration: duration, System: 1, Talkgroup: talkgroup}
+		if _, err := controller.Calls.WriteCall(call, controller.Database); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(10, to.Add(-time.Hour), 4*time.Second)
+	write(10, to.Add(-2*time.Hour), 6*time.Second)
+	write(20, to.Add(-3*time.Hour), time.Second)
+	write(20, from.Add(-time.Hour), time.Second)
+
+	for _, label := range []string{"fire", "fire", "mayday"} {
+		if err := controller.Alerts.recordHit(&Alert{Label: label}, &Call{System: 1, Talkgroup: 10}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	heard, old := to.Add(-time.Hour), from.Add(-time.Hour)
+	system, _ := controller.Systems.GetSystem(uint(1))
+	system.Units.List = append(system.Units.List, &Unit{Id: 1001, Label: "Engine 1", FirstHeard: &heard}, &Unit{Id: 1002, Label: "Engine 2", FirstHeard: &old})
+
+	digest, err := controller.Digests.Generate(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if digest.Calls != 3 {
+		t.Errorf("calls = %d, want 3", digest.Calls)
+	}
+	if digest.Storage.AudioBytes != 12 {
+		t.Errorf("audio bytes = %d, want 12", digest.Storage.AudioBytes)
+	}
+	if digest.Storage.DatabaseBytes <= 0 {
+		t.Errorf("database bytes = %d", digest.Storage.DatabaseBytes)
+	}
+
+	if len(digest.Talkgroups) != 2 {
+		t.Fatalf("talkgroups = %d, want 2", len(digest.Talkgroups))
+	}
+	if tg := digest.Talkgroups[0]; tg.Talkgroup != 10 || tg.Calls != 2 || tg.Airtime != 10 || tg.SystemLabel != "County" || tg.TalkgroupLabel != "Fire Dispatch" {
+		t.Errorf("busiest talkgroup = %+v", tg)
+	}
+	if tg := digest.Talkgroups[1]; tg.TalkgroupLabel != "20" || tg.Calls != 1 {
+		t.Errorf("unknown talkgroup = %+v", tg)
+	}
+
+	if len(digest.Alerts) != 2 || digest.Alerts[0].Label != "fire" || digest.Alerts[0].Count != 2 {
+		t.Errorf("alerts = %v", digest.Alerts)
+	}
+
+	if digest.NewUnitsTotal != 1 || len(digest.NewUnits) != 1 || digest.NewUnits[0].Id != 1001 {
+		t.Errorf("new units = %d %v", digest.NewUnitsTotal, digest.NewUnits)
+	}
+}
+
+func TestDigestsRender(t *testing.T) {
+	controller := newTestDigests(t)
+
+	digest := &Digest{
+		Alerts:     []*DigestCount{{Count: 2, Label: "fire"}},
+		Calls:      3,
+		From:       time.Date(2026, 10, 13, 7, 0, 0, 0, time.UTC),
+		NewUnits:   []*DigestUnit{},
+		Storage:    DigestStorage{AudioBytes: 3 * 1024 * 1024},
+		Talkgroups: []*DigestTalkgroup{{Airtime: 90, Calls: 3, SystemLabel: "County", TalkgroupLabel: "Fire Dispatch"}},
+		To:         time.Date(2026, 10, 14, 7, 0, 0, 0, time.UTC),
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		want     []string
+		wantErr  bool
+	}{
+		{"default", "", []string{"Calls: 3\n", "Audio stored: 3.0 MiB", "- County / Fire Dispatch: 3 calls, 1m30s\n", "- fire: 2 hits\n", "New units: 0\n"}, false},
+		{"custom", "{{.Calls}} calls, {{len .Alerts}} alerts", []string{"3 calls, 1 alerts"}, false},
+		{"invalid", "{{.Calls", nil, true},
+		{"unknown field", "{{.Missing}}", nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			controller.Options.DigestTemplate = test.template
+
+			text, err := controller.Digests.Render(digest)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, want error %v", err, test.wantErr)
+			}
+			for _, want := range test.want {
+				if !strings.Contains(text, want) {
+					t.Errorf("text %q does not contain %q", text, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDigestsSend(t *testing.T) {
+	port, messages := newTestSmtpServer(t)
+
+	posted := make(chan map[string]any, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p map[string]any
+		b, _ := io.ReadAll(r.Body)
+		json.Unmarshal(b, &p)
+		posted <- p
+	}))
+	t.Cleanup(server.Close)
+
+	controller := newTestDigests(t)
+
+	if controller.Digests.Enabled() {
+		t.Fatal("digests enabled without an email nor a webhook")
+	}
+
+	controller.Options.AdminEmail = "admin@example.com"
+	controller.Options.DigestTemplate = "{{.Calls"
+	controller.Options.DigestWebhook = server.URL
+	controller.Options.SmtpFrom = "scanner@example.com"
+	controller.Options.SmtpHost = "127.0.0.1"
+	controller.Options.SmtpPort = port
+	controller.Options.SmtpTls = SmtpTlsNone
+
+	if !controller.Digests.Enabled() {
+		t.Fatal("digests disabled")
+	}
+
+	digest := &Digest{Calls: 7, From: time.Now().Add(-time.Hour), To: time.Now()}
+
+	// a broken template falls back to the default text
+	if err := controller.Digests.Send(digest); err != nil {
+		t.Fatal(err)
+	}
+
+	message := <-messages
+	if len(message.rcpts) != 1 || message.rcpts[0] != "admin@example.com" {
+		t.Errorf("recipients = %v", message.rcpts)
+	}
+	if !strings.Contains(message.data, "Calls: 7") {
+		t.Errorf("email %q without the digest", message.data)
+	}
+
+	p := <-posted
+	if text, _ := p["text"].(string); !strings.Contains(text, "Calls: 7") {
+		t.Errorf("webhook text = %q", text)
+	}
+	if d, _ := p["digest"].(map[string]any); d == nil || d["calls"] != float64(7) {
+		t.Errorf("webhook digest = %v", p["digest"])
+	}
+}
@@ -20,9 +20,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"math"
 	"mime"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
@@ -36,6 +38,12 @@ import (
 	"github.com/fsnotify/fsnotify"
 )
 
+const DirwatchQuarantineDir = ".quarantine"
+
+// only the end of the dsdplus event logs is read, they grow for as long as
+// dsdplus runs and the matching entries are the most recent ones
+const dirwatchEventLogTail = 256 * 1024
+
 const (
 	DirwatchTypeDefault       = "default"
 	DirwatchTypeDSDPlus       = "dsdplus"
@@ -263,6 +271,12 @@ func (dirwatch *Dirwatch) ingestDSDPlus(p string) error {
 		return err
 	}
 
+	for _, eventLog := range dirwatch.dsdplusEventLogs(p) {
+		if b, err := readTail(eventLog, dirwatchEventLogTail); err == nil {
+			ParseDSDPlusEventLog(call, b)
+		}
+	}
+
 	if ok, err := call.IsValid(); ok {
 		dirwatch.controller.Ingest <- call
 
@@ -270,6 +284,14 @@ func (dirwatch *Dirwatch) ingestDSDPlus(p string) error {
 			if err = os.Remove(p); err != nil {
 				return err
 			}
+
+			// raw voice frames dsdplus may have kept along with the audio
+			mbe := strings.TrimSuffix(p, path.Ext(p)) + ".mbe"
+			if _, err = os.Stat(mbe); err == nil {
+				if err = os.Remove(mbe); err != nil {
+					return err
+				}
+			}
 		}
 
 	} else {
@@ -296,10 +318,20 @@ func (dirwatch *Dirwatch) ingestSdrTrunk(p string) error {
 		return err
 	}
 
-	if err = ParseSdrTrunkMeta(call, dirwatch.controller); err != nil {
+	sidecar := strings.TrimSuffix(p, path.Ext(p)) + ".json"
+
+	b, sidecarErr := os.ReadFile(sidecar)
+
+	if err = ParseSdrTrunkMeta(call, dirwatch.controller); err != nil && sidecarErr != nil {
 		return err
 	}
 
+	if sidecarErr == nil {
+		if err = ParseSdrTrunkJsonMeta(call, b, dirwatch.controller); err != nil {
+			return fmt.Errorf("%v, %v", err, sidecar)
+		}
+	}
+
 	if ok, err := call.IsValid(); ok {
 		dirwatch.controller.Ingest <- call
 
@@ -307,6 +339,12 @@ func (dirwatch *Dirwatch) ingestSdrTrunk(p string) error {
 			if err = os.Remove(p); err != nil {
 				return err
 			}
+
+			if sidecarErr == nil {
+				if err = os.Remove(sidecar); err != nil {
+					return err
+				}
+			}
 		}
 
 	} else {
@@ -613,12 +651,16 @@ func (dirwatch *Dirwatch) Start(controller *Controller) error {
 	}
 
 	go func() {
+		defer controller.Recover("dirwatch.watcher")
+
 		logError := func(err error) {
 			controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("dirwatch.watcher: %v", err.Error()))
 		}
 
 		newTimer := func(eventName string) *time.Timer {
 			return time.AfterFunc(delay, func() {
+				defer controller.Recover("dirwatch.ingest")
+
 				dirwatch.mutex.Lock()
 				defer dirwatch.mutex.Unlock()
 
@@ -660,6 +702,10 @@ func (dirwatch *Dirwatch) Start(controller *Controller) error {
 					return
 				}
 
+				if dirwatch.isQuarantined(event.Name) {
+					continue
+				}
+
 				switch event.Op {
 				case fsnotify.Create:
 					if dirwatch.isDir(event.Name) {
@@ -705,19 +751,17 @@ func (dirwatch *Dirwatch) Start(controller *Controller) error {
 	}()
 
 	go func() {
-		defer func() {
-			switch v := recover().(type) {
-			case error:
-				controller.Logs.LogEvent(LogLevelError, v.Error())
-			}
-		}()
+		defer controller.Recover("dirwatch.walk")
 
 		time.Sleep(delay)
 
 		if err := fs.WalkDir(os.DirFS(dirwatch.Directory), ".", func(p string, _ fs.DirEntry, err error) error {
 			fp := filepath.Join(dirwatch.Directory, p)
 
-			if dirwatch.isDir(fp) {
+			if dirwatch.isQuarantined(fp) {
+				return fs.SkipDir
+
+			} else if dirwatch.isDir(fp) {
 				dirwatch.dirs[fp] = true
 				dirwatch.watcher.Add(fp)
 
@@ -734,6 +778,92 @@ func (dirwatch *Dirwatch) Start(controller *Controller) error {
 	return nil
 }
 
+// FindStale returns the files that have been sitting in the watched folder
+// for longer than threshold. Files are only expected to linger when they
+// are not deleted after ingest, in which case nothing is reported.
+func (dirwatch *Dirwatch) FindStale(threshold time.Duration) []*DirwatchStaleFile {
+	files := []*DirwatchStaleFile{}
+
+	if dirwatch.Disabled || !dirwatch.DeleteAfter || len(dirwatch.Directory) == 0 {
+		return files
+	}
+
+	ext := dirwatch.expectedExtension()
+	now := time.Now()
+
+	fs.WalkDir(os.DirFS(dirwatch.Directory), ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		fp := filepath.Join(dirwatch.Directory, p)
+
+		if dirwatch.isQuarantined(fp) {
+			return fs.SkipDir
+		}
+
+		if d.IsDir() || dirwatch.isSidecar(fp) {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil || now.Sub(fi.ModTime()) < threshold {
+			return nil
+		}
+
+		dirwatch.mutex.Lock()
+		pending := dirwatch.timers[fp] != nil
+		dirwatch.mutex.Unlock()
+
+		if pending {
+			return nil
+		}
+
+		file := &DirwatchStaleFile{
+			DirwatchId: dirwatch.Id,
+			ModTime:    fi.ModTime().UTC(),
+			Path:       fp,
+			Size:       fi.Size(),
+		}
+
+		switch {
+		case fi.Size() == 0:
+			file.Reason = "empty or partially written file"
+		case len(ext) > 0 && !strings.EqualFold(path.Ext(fp), ext):
+			file.Reason = "unexpected file type"
+		default:
+			file.Reason = "not ingested, check the mask and the system/talkgroup"
+		}
+
+		files = append(files, file)
+
+		return nil
+	})
+
+	return files
+}
+
+func (dirwatch *Dirwatch) Quarantine(file *DirwatchStaleFile) error {
+	rel, err := filepath.Rel(dirwatch.Directory, file.Path)
+	if err != nil {
+		return err
+	}
+
+	dest := filepath.Join(dirwatch.Directory, DirwatchQuarantineDir, rel)
+
+	if err = os.MkdirAll(filepath.Dir(dest), 0770); err != nil {
+		return err
+	}
+
+	if err = os.Rename(file.Path, dest); err != nil {
+		return err
+	}
+
+	file.Quarantined = dest
+
+	return nil
+}
+
 func (dirwatch *Dirwatch) Stop() {
 	if dirwatch.watcher != nil {
 		w := dirwatch.watcher
@@ -742,6 +872,15 @@ func (dirwatch *Dirwatch) Stop() {
 	}
 }
 
+type DirwatchStaleFile struct {
+	DirwatchId  any       `json:"dirwatchId"`
+	ModTime     time.Time `json:"modTime"`
+	Path        string    `json:"path"`
+	Quarantined string    `json:"quarantined,omitempty"`
+	Reason      string    `json:"reason"`
+	Size        int64     `json:"size"`
+}
+
 type Dirwatches struct {
 	List  []*Dirwatch
 	mutex sync.Mutex
@@ -873,6 +1012,44 @@ func (dirwatches *Dirwatches) Stop() {
 	dirwatches.List = []*Dirwatch{}
 }
 
+func (dirwatches *Dirwatches) FindStale(threshold time.Duration) []*DirwatchStaleFile {
+	dirwatches.mutex.Lock()
+	defer dirwatches.mutex.Unlock()
+
+	files := []*DirwatchStaleFile{}
+
+	for _, dirwatch := range dirwatches.List {
+		files = append(files, dirwatch.FindStale(threshold)...)
+	}
+
+	return files
+}
+
+func (dirwatches *Dirwatches) GetDirwatch(id any) (*Dirwatch, bool) {
+	dirwatches.mutex.Lock()
+	defer dirwatches.mutex.Unlock()
+
+	for _, dirwatch := range dirwatches.List {
+		if dirwatch.Id == id {
+			return dirwatch, true
+		}
+	}
+
+	return nil, false
+}
+
+func (dirwatches *Dirwatches) QuarantineAll(files []*DirwatchStaleFile, controller *Controller) {
+	for _, file := range files {
+		if dirwatch, ok := dirwatches.GetDirwatch(file.DirwatchId); ok {
+			if err := dirwatch.Quarantine(file); err == nil {
+				controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("dirwatch: %s quarantined to %s", file.Path, file.Quarantined))
+			} else {
+				controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("dirwatch.quarantine: %s", err.Error()))
+			}
+		}
+	}
+}
+
 func (dirwatches *Dirwatches) Write(db *Database) error {
 	var (
 		count  uint
@@ -916,15 +1093,7 @@ func (dirwatches *Dirwatches) Write(db *Database) error {
 	}
 
 	if len(rowIds) > 0 {
-		// Build parameterized IN clause to prevent SQL injection
-		placeholders := make([]string, len(rowIds))
-		args := make([]any, len(rowIds))
-		for i, id := range rowIds {
-			placeholders[i] = "?"
-			args[i] = id
-		}
-		q := fmt.Sprintf("delete from `rdioScannerDirwatches` where `_id` in (%s)", strings.Join(placeholders, ","))
-		if _, err = db.Sql.Exec(q, args...); err != nil {
+		if _, err = db.Delete("rdioScannerDirWatches").Where(SqlIn("_id", rowIds)).Exec(); err != nil {
 			return formatError(err)
 		}
 	}
@@ -951,6 +1120,68 @@ func (dirwatches *Dirwatches) Write(db *Database) error {
 	return nil
 }
 
+// dsdplusEventLogs returns the event logs found from the folder of the
+// recording up to the watched directory.
+func (dirwatch *Dirwatch) dsdplusEventLogs(p string) []string {
+	logs := []string{}
+
+	root := filepath.Clean(dirwatch.Directory)
+
+	for dir := filepath.Dir(p); ; dir = filepath.Dir(dir) {
+		if m, err := filepath.Glob(filepath.Join(dir, "*.event")); err == nil {
+			logs = append(logs, m...)
+		}
+
+		if dir == root || !strings.HasPrefix(dir, root) || dir == filepath.Dir(dir) {
+			break
+		}
+	}
+
+	return logs
+}
+
+func (dirwatch *Dirwatch) expectedExtension() string {
+	switch dirwatch.Kind {
+	case DirwatchTypeSdrTrunk:
+		return ".mp3"
+	case DirwatchTypeTrunkRecorder:
+		return ""
+	}
+
+	switch v := dirwatch.Extension.(type) {
+	case string:
+		if len(v) > 0 {
+			return fmt.Sprintf(".%s", v)
+		}
+	}
+
+	if dirwatch.Kind == DirwatchTypeDSDPlus {
+		return ".mp3"
+	}
+
+	return ".wav"
+}
+
+// isSidecar tells whether the file only carries metadata for the recordings
+// and is not expected to be ingested or deleted on its own.
+func (dirwatch *Dirwatch) isSidecar(p string) bool {
+	switch dirwatch.Kind {
+	case DirwatchTypeDSDPlus:
+		return strings.EqualFold(path.Ext(p), ".event")
+	case DirwatchTypeSdrTrunk:
+		if strings.EqualFold(path.Ext(p), ".json") {
+			_, err := os.Stat(strings.TrimSuffix(p, path.Ext(p)) + ".mp3")
+			return err == nil
+		}
+	}
+
+	return false
+}
+
+func (dirwatch *Dirwatch) isQuarantined(p string) bool {
+	return strings.HasPrefix(p, filepath.Join(dirwatch.Directory, DirwatchQuarantineDir))
+}
+
 func (dirwatch *Dirwatch) isDir(d string) bool {
 	if fi, err := os.Stat(d); err == nil {
 		if fi.IsDir() {
@@ -966,6 +1197,9 @@ func (dirwatch *Dirwatch) walkDir(d string) error {
 
 	return fs.WalkDir(dfs, ".", func(p string, _ fs.DirEntry, err error) error {
 		fp := filepath.Join(d, p)
+		if dirwatch.isQuarantined(fp) {
+			return fs.SkipDir
+		}
 		if dirwatch.isDir(fp) {
 			if !dirwatch.dirs[fp] {
 				dirwatch.dirs[fp] = true
@@ -975,3 +1209,57 @@ func (dirwatch *Dirwatch) walkDir(d string) error {
 		return err
 	})
 }
+
+func (admin *Admin) DirwatchStaleHandler(w http.ResponseWriter, r *http.Request) {
+	if !admin.Authorize(w, r, adminWriteRole(r)) {
+		return
+	}
+
+	threshold := time.Duration(admin.Controller.Options.DirwatchStaleMinutes) * time.Minute
+	if threshold == 0 {
+		threshold = time.Duration(defaults.options.dirwatchStaleMinutes) * time.Minute
+	}
+
+	var files []*DirwatchStaleFile
+
+	switch r.Method {
+	case http.MethodGet:
+		files = admin.Controller.Dirwatches.FindStale(threshold)
+
+	case http.MethodPost:
+		files = admin.Controller.Dirwatches.FindStale(threshold)
+		admin.Controller.Dirwatches.QuarantineAll(files, admin.Controller)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if b, err := json.Marshal(files); err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	} else {
+		w.WriteHeader(http.StatusExpectationFailed)
+	}
+}
+
+func readTail(p string, size int64) ([]byte, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.Size() > size {
+		if _, err = f.Seek(fi.Size()-size, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+
+	return io.ReadAll(f)
+}
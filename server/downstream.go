@@ -20,24 +20,73 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io"
 	"mime/multipart"
 	"net/http"
 	"net/url"
 	"path"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// DownstreamHeader is set on the calls relayed to downstream instances, it
+// carries the version of the sending instance.
+const DownstreamHeader = "X-Rdio-Scanner-Downstream"
+
+// the uploads refused by an overloaded downstream are retried when it asks
+// to wait no longer than downstreamMaxRetryAfter
+const (
+	downstreamMaxRetryAfter = 2 * time.Minute
+	downstreamRetries       = 3
+)
+
+// downstreamTimeout bounds the upload of a call to a downstream instance.
+const downstreamTimeout = 30 * time.Second
+
 type Downstream struct {
-	Id       any    `json:"_id"`
-	Apikey   string `json:"apiKey"`
-	Disabled bool   `json:"disabled"`
-	Order    any    `json:"order"`
-	Systems  any    `json:"systems"`
-	Url      string `json:"url"`
+	Id          any    `json:"_id"`
+	Apikey      string `json:"apiKey"`
+	Disabled    bool   `json:"disabled"`
+	Groups      []uint `json:"groups"`
+	Order       any    `json:"order"`
+	Schedule    string `json:"schedule"`
+	Systems     any    `json:"systems"`
+	Tags        []uint `json:"tags"`
+	Url         string `json:"url"`
+	schedule    Schedule
+	scheduleErr error
+	status      DownstreamStatus
+	statusMutex sync.Mutex
+}
+
+// DownstreamStatus is the outcome of the last calls sent to a downstream,
+// reported by the readiness endpoint.
+type DownstreamStatus struct {
+	LastError   string
+	LastFailure time.Time
+	LastSuccess time.Time
+}
+
+// Status returns the outcome of the last calls sent.
+func (downstream *Downstream) Status() DownstreamStatus {
+	downstream.statusMutex.Lock()
+	defer downstream.statusMutex.Unlock()
+
+	return downstream.status
+}
+
+func (downstream *Downstream) setStatus(err error) {
+	downstream.statusMutex.Lock()
+	defer downstream.statusMutex.Unlock()
+
+	if err == nil {
+		downstream.status.LastSuccess = time.Now()
+	} else {
+		downstream.status.LastError = err.Error()
+		downstream.status.LastFailure = time.Now()
+	}
 }
 
 func (downstream *Downstream) FromMap(m map[string]any) *Downstream {
@@ -56,11 +105,23 @@ func (downstream *Downstream) FromMap(m map[string]any) *Downstream {
 		downstream.Disabled = v
 	}
 
+	switch v := m["groups"].(type) {
+	case []any:
+		downstream.Groups = downstreamIds(v)
+	}
+
 	switch v := m["order"].(type) {
 	case float64:
 		downstream.Order = uint(v)
 	}
 
+	switch v := m["schedule"].(type) {
+	case string:
+		downstream.Schedule = v
+	}
+
+	downstream.schedule, downstream.scheduleErr = ParseSchedule(downstream.Schedule)
+
 	switch v := m["systems"].(type) {
 	case []any:
 		if b, err := json.Marshal(v); err == nil {
@@ -70,6 +131,11 @@ func (downstream *Downstream) FromMap(m map[string]any) *Downstream {
 		downstream.Systems = v
 	}
 
+	switch v := m["tags"].(type) {
+	case []any:
+		downstream.Tags = downstreamIds(v)
+	}
+
 	switch v := m["url"].(type) {
 	case string:
 		downstream.Url = v
@@ -121,7 +187,32 @@ func (downstream *Downstream) HasAccess(call *Call) bool {
 	return false
 }
 
-func (downstream *Downstream) Send(call *Call) error {
+// Matches tells if the call is to be forwarded, that is if the downstream has
+// access to its talkgroup, the talkgroup is in one of the groups and has one
+// of the tags when they are set, and the call is within the schedule.
+func (downstream *Downstream) Matches(call *Call, talkgroup *Talkgroup) bool {
+	if !downstream.HasAccess(call) {
+		return false
+	}
+
+	if len(downstream.Groups) > 0 {
+		if talkgroup == nil || !downstreamHasId(downstream.Groups, talkgroup.GroupId) {
+			return false
+		}
+	}
+
+	if len(downstream.Tags) > 0 {
+		if talkgroup == nil || !downstreamHasId(downstream.Tags, talkgroup.TagId) {
+			return false
+		}
+	}
+
+	return downstream.schedule.Contains(call.DateTime)
+}
+
+// Send uploads the call to the downstream instance with the client, which
+// presents the client certificate of the instance when one is set.
+func (downstream *Downstream) Send(call *Call, client *http.Client) error {
 	var (
 		audioName string
 		buf       = bytes.Buffer{}
@@ -206,6 +297,18 @@ func (downstream *Downstream) Send(call *Call) error {
 		}
 	}
 
+	if call.HasLocation() {
+		for name, v := range map[string]any{"latitude": call.Latitude, "longitude": call.Longitude} {
+			if w, err := mw.CreateFormField(name); err == nil {
+				if _, err = w.Write([]byte(fmt.Sprintf("%v", v))); err != nil {
+					return formatError(err)
+				}
+			} else {
+				return formatError(err)
+			}
+		}
+	}
+
 	if w, err := mw.CreateFormField("key"); err == nil {
 		if _, err = w.Write([]byte(downstream.Apikey)); err != nil {
 			return formatError(err)
@@ -229,6 +332,16 @@ func (downstream *Downstream) Send(call *Call) error {
 		}
 	}
 
+	if call.Site > 0 {
+		if w, err := mw.CreateFormField("site"); err == nil {
+			if _, err = w.Write([]byte(fmt.Sprintf("%v", call.Site))); err != nil {
+				return formatError(err)
+			}
+		} else {
+			return formatError(err)
+		}
+	}
+
 	switch v := call.Source.(type) {
 	case uint:
 		if w, err := mw.CreateFormField("source"); err == nil {
@@ -326,6 +439,16 @@ func (downstream *Downstream) Send(call *Call) error {
 		}
 	}
 
+	if len(call.Uuid) > 0 {
+		if w, err := mw.CreateFormField("uuid"); err == nil {
+			if _, err = w.Write([]byte(call.Uuid)); err != nil {
+				return formatError(err)
+			}
+		} else {
+			return formatError(err)
+		}
+	}
+
 	if err := mw.Close(); err != nil {
 		return formatError(err)
 	}
@@ -333,15 +456,36 @@ func (downstream *Downstream) Send(call *Call) error {
 	if u, err := url.Parse(downstream.Url); err == nil {
 		u.Path = path.Join(u.Path, "/api/call-upload")
 
-		c := http.Client{Timeout: 30 * time.Second}
+		// an overloaded instance is given the time it asks for to catch up
+		for attempt := 1; ; attempt++ {
+			req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				return formatError(err)
+			}
+
+			req.Header.Set("Content-Type", mw.FormDataContentType())
+			req.Header.Set(DownstreamHeader, Version)
 
-		if res, err := c.Post(u.String(), mw.FormDataContentType(), &buf); err == nil {
-			if res.StatusCode != http.StatusOK {
-				return formatError(fmt.Errorf("bad status: %s", res.Status))
+			res, err := client.Do(req)
+			if err != nil {
+				return formatError(err)
 			}
 
-		} else {
-			return formatError(err)
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+
+			if res.StatusCode == http.StatusOK {
+				break
+			}
+
+			if res.StatusCode == http.StatusServiceUnavailable && attempt < downstreamRetries {
+				if d, ok := BackpressureRetryAfter(res); ok && d <= downstreamMaxRetryAfter {
+					time.Sleep(d)
+					continue
+				}
+			}
+
+			return formatError(fmt.Errorf("bad status: %s", res.Status))
 		}
 
 	} else {
@@ -352,17 +496,33 @@ func (downstream *Downstream) Send(call *Call) error {
 }
 
 type Downstreams struct {
-	List  []*Downstream
-	mutex sync.Mutex
+	List   []*Downstream
+	client *http.Client
+	mutex  sync.Mutex
 }
 
 func NewDownstreams() *Downstreams {
 	return &Downstreams{
-		List:  []*Downstream{},
-		mutex: sync.Mutex{},
+		List:   []*Downstream{},
+		client: &http.Client{Timeout: downstreamTimeout},
+		mutex:  sync.Mutex{},
 	}
 }
 
+// Start loads the client certificate presented to the downstream instances.
+func (downstreams *Downstreams) Start(config *Config) error {
+	client, err := config.DownstreamClient()
+	if err != nil {
+		return fmt.Errorf("downstreams.start: %v", err)
+	}
+
+	downstreams.mutex.Lock()
+	downstreams.client = client
+	downstreams.mutex.Unlock()
+
+	return nil
+}
+
 func (downstreams *Downstreams) FromMap(f []any) *Downstreams {
 	downstreams.mutex.Lock()
 	defer downstreams.mutex.Unlock()
@@ -383,11 +543,14 @@ func (downstreams *Downstreams) FromMap(f []any) *Downstreams {
 
 func (downstreams *Downstreams) Read(db *Database) error {
 	var (
-		err     error
-		id      sql.NullFloat64
-		order   sql.NullFloat64
-		rows    *sql.Rows
-		systems string
+		err      error
+		groups   sql.NullString
+		id       sql.NullFloat64
+		order    sql.NullFloat64
+		rows     *sql.Rows
+		schedule sql.NullString
+		systems  string
+		tags     sql.NullString
 	)
 
 	downstreams.mutex.Lock()
@@ -399,14 +562,18 @@ func (downstreams *Downstreams) Read(db *Database) error {
 		return fmt.Errorf("downstreams.read: %v", err)
 	}
 
-	if rows, err = db.Sql.Query("select `_id`, `apiKey`, `disabled`, `order`, `systems`, `url` from `rdioScannerDownstreams`"); err != nil {
+	if rows, err = db.Sql.Query("select `_id`, `apiKey`, `disabled`, `groups`, `order`, `schedule`, `systems`, `tags`, `url` from `rdioScannerDownstreams`"); err != nil {
 		return formatError(err)
 	}
 
 	for rows.Next() {
 		downstream := &Downstream{}
 
-		if err = rows.Scan(&id, &downstream.Apikey, &downstream.Disabled, &order, &systems, &downstream.Url); err != nil {
+		if err = rows.Scan(&id, &downstream.Apikey, &downstream.Disabled, &groups, &order, &schedule, &systems, &tags, &downstream.Url); err != nil {
+			break
+		}
+
+		if downstream.Apikey, err = db.Secrets.Open(downstream.Apikey); err != nil {
 			break
 		}
 
@@ -418,14 +585,34 @@ func (downstreams *Downstreams) Read(db *Database) error {
 			downstream.Apikey = uuid.New().String()
 		}
 
+		if groups.Valid && len(groups.String) > 0 {
+			if err = json.Unmarshal([]byte(groups.String), &downstream.Groups); err != nil {
+				downstream.Groups = nil
+			}
+		}
+
 		if order.Valid && order.Float64 > 0 {
 			downstream.Order = uint(order.Float64)
 		}
 
+		if schedule.Valid {
+			downstream.Schedule = schedule.String
+		}
+
+		downstream.schedule, downstream.scheduleErr = ParseSchedule(downstream.Schedule)
+
 		if err = json.Unmarshal([]byte(systems), &downstream.Systems); err != nil {
 			downstream.Systems = []any{}
 		}
 
+		if tags.Valid && len(tags.String) > 0 {
+			if err = json.Unmarshal([]byte(tags.String), &downstream.Tags); err != nil {
+				downstream.Tags = nil
+			}
+		}
+
+		err = nil
+
 		if len(downstream.Url) == 0 {
 			continue
 		}
@@ -443,16 +630,44 @@ func (downstreams *Downstreams) Read(db *Database) error {
 }
 
 func (downstreams *Downstreams) Send(controller *Controller, call *Call) {
+	var talkgroup *Talkgroup
+
+	if system, ok := controller.Systems.GetSystem(call.System); ok {
+		talkgroup, _ = system.Talkgroups.GetSiteTalkgroup(call.Talkgroup, call.Site)
+	}
+
+	downstreams.mutex.Lock()
+	client := downstreams.client
+	downstreams.mutex.Unlock()
+
 	for _, downstream := range downstreams.List {
 		logEvent := func(logLevel string, message string) {
 			controller.Logs.LogEvent(logLevel, fmt.Sprintf("downstream: system=%v talkgroup=%v file=%v to %v %v", call.System, call.Talkgroup, call.AudioName, downstream.Url, message))
 		}
 
-		if downstream.HasAccess(call) {
-			if err := downstream.Send(call); err == nil {
+		if downstream.scheduleErr != nil {
+			logEvent(LogLevelWarn, fmt.Sprintf("skipped, %v", downstream.scheduleErr))
+			continue
+		}
+
+		if downstream.Matches(call, talkgroup) {
+			err := downstream.Send(call, client)
+
+			downstream.setStatus(err)
+
+			if err == nil {
 				logEvent(LogLevelInfo, "success")
+
+				if call.trace != nil {
+					call.trace.AddDownstream()
+				}
+
 			} else {
 				logEvent(LogLevelError, err.Error())
+
+				if call.trace != nil {
+					call.trace.AddEvent(fmt.Sprintf("downstream %v %v", downstream.Url, err.Error()))
+				}
 			}
 		}
 	}
@@ -460,11 +675,14 @@ func (downstreams *Downstreams) Send(controller *Controller, call *Call) {
 
 func (downstreams *Downstreams) Write(db *Database) error {
 	var (
+		apiKey  string
 		count   uint
 		err     error
 		rows    *sql.Rows
+		groups  any
 		rowIds  = []uint{}
 		systems any
+		tags    any
 	)
 
 	downstreams.mutex.Lock()
@@ -502,15 +720,7 @@ func (downstreams *Downstreams) Write(db *Database) error {
 	}
 
 	if len(rowIds) > 0 {
-		// Build parameterized IN clause to prevent SQL injection
-		placeholders := make([]string, len(rowIds))
-		args := make([]any, len(rowIds))
-		for i, id := range rowIds {
-			placeholders[i] = "?"
-			args[i] = id
-		}
-		q := fmt.Sprintf("delete from `rdioScannerDownstreams` where `_id` in (%s)", strings.Join(placeholders, ","))
-		if _, err = db.Sql.Exec(q, args...); err != nil {
+		if _, err = db.Delete("rdioScannerDownstreams").Where(SqlIn("_id", rowIds)).Exec(); err != nil {
 			return formatError(err)
 		}
 	}
@@ -523,16 +733,23 @@ func (downstreams *Downstreams) Write(db *Database) error {
 			systems = downstream.Systems
 		}
 
+		groups = downstreamIdsJson(downstream.Groups)
+		tags = downstreamIdsJson(downstream.Tags)
+
+		if apiKey, err = db.Secrets.Seal(downstream.Apikey); err != nil {
+			break
+		}
+
 		if err = db.Sql.QueryRow("select count(*) from `rdioScannerDownstreams` where `_id` = ?", downstream.Id).Scan(&count); err != nil {
 			break
 		}
 
 		if count == 0 {
-			if _, err = db.Sql.Exec("insert into `rdioScannerDownstreams` (`_id`, `apiKey`, `disabled`, `order`, `systems`, `url`) values (?, ?, ?, ?, ?, ?)", downstream.Id, downstream.Apikey, downstream.Disabled, downstream.Order, systems, downstream.Url); err != nil {
+			if _, err = db.Sql.Exec("insert into `rdioScannerDownstreams` (`_id`, `apiKey`, `disabled`, `groups`, `order`, `schedule`, `systems`, `tags`, `url`) values (?, ?, ?, ?, ?, ?, ?, ?, ?)", downstream.Id, apiKey, downstream.Disabled, groups, downstream.Order, downstream.Schedule, systems, tags, downstream.Url); err != nil {
 				break
 			}
 
-		} else if _, err = db.Sql.Exec("update `rdioScannerDownstreams` set `_id` = ?, `apiKey` = ?, `disabled` = ?, `order` = ?, `systems` = ?, `url` = ? where `_id` = ?", downstream.Id, downstream.Apikey, downstream.Disabled, downstream.Order, systems, downstream.Url, downstream.Id); err != nil {
+		} else if _, err = db.Sql.Exec("update `rdioScannerDownstreams` set `_id` = ?, `apiKey` = ?, `disabled` = ?, `groups` = ?, `order` = ?, `schedule` = ?, `systems` = ?, `tags` = ?, `url` = ? where `_id` = ?", downstream.Id, apiKey, downstream.Disabled, groups, downstream.Order, downstream.Schedule, systems, tags, downstream.Url, downstream.Id); err != nil {
 			break
 		}
 	}
@@ -543,3 +760,38 @@ func (downstreams *Downstreams) Write(db *Database) error {
 
 	return nil
 }
+
+func downstreamHasId(ids []uint, id uint) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+func downstreamIds(f []any) []uint {
+	ids := []uint{}
+
+	for _, v := range f {
+		switch id := v.(type) {
+		case float64:
+			ids = append(ids, uint(id))
+		}
+	}
+
+	return ids
+}
+
+func downstreamIdsJson(ids []uint) any {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	if b, err := json.Marshal(ids); err == nil {
+		return string(b)
+	}
+
+	return nil
+}
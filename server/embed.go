@@ -0,0 +1,719 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// the recent calls listed are kept this long, the embedded players of a
+	// busy website polling them at once
+	embedCache = 5 * time.Second
+
+	embedCalls = 10
+
+	// the embedded players poll the recent calls this often
+	embedRefresh = 15 * time.Second
+)
+
+// Embed is a public read-only player of the recent calls of a talkgroup, for
+// a department to embed its dispatch channel on its own website. It is
+// reached on /embed/{system}/{talkgroup}?token= by anyone knowing the token,
+// and only lists the calls of its talkgroup, without the radio ids, their
+// location, the search or the live feed. The calls are delayed as for the
+// tiers, and the page may only be framed by the origins given, if any.
+type Embed struct {
+	Id        any       `json:"_id"`
+	CreatedAt time.Time `json:"createdAt"`
+	Delay     uint      `json:"delay"`
+	Label     string    `json:"label"`
+	Origins   []string  `json:"origins"`
+	System    uint      `json:"system"`
+	Talkgroup uint      `json:"talkgroup"`
+	Token     string    `json:"token"`
+	cached    []map[string]any
+	cachedAt  time.Time
+	mutex     sync.Mutex
+}
+
+func (embed *Embed) FromMap(m map[string]any) *Embed {
+	switch v := m["delay"].(type) {
+	case float64:
+		if v > 0 {
+			embed.Delay = uint(v)
+		}
+	}
+
+	switch v := m["label"].(type) {
+	case string:
+		embed.Label = strings.TrimSpace(v)
+	}
+
+	embed.Origins = []string{}
+
+	switch v := m["origins"].(type) {
+	case []any:
+		for _, f := range v {
+			if s, ok := f.(string); ok && len(strings.TrimSpace(s)) > 0 {
+				embed.Origins = append(embed.Origins, strings.TrimSpace(s))
+			}
+		}
+	case string:
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); len(s) > 0 {
+				embed.Origins = append(embed.Origins, s)
+			}
+		}
+	}
+
+	switch v := m["system"].(type) {
+	case float64:
+		embed.System = uint(v)
+	}
+
+	switch v := m["talkgroup"].(type) {
+	case float64:
+		embed.Talkgroup = uint(v)
+	}
+
+	return embed
+}
+
+// GetDelay returns how old the calls must be to be listed.
+func (embed *Embed) GetDelay() time.Duration {
+	return time.Duration(embed.Delay) * time.Second
+}
+
+// frameAncestors returns the content security policy directive of the
+// origins allowed to frame the player, any when none is given.
+func (embed *Embed) frameAncestors() string {
+	if len(embed.Origins) == 0 {
+		return "frame-ancestors *"
+	}
+
+	return "frame-ancestors " + strings.Join(embed.Origins, " ")
+}
+
+type embedBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+type Embeds struct {
+	Controller *Controller
+	List       []*Embed
+	buckets    map[string]*embedBucket
+	mutex      sync.Mutex
+}
+
+func NewEmbeds(controller *Controller) *Embeds {
+	return &Embeds{
+		Controller: controller,
+		List:       []*Embed{},
+		buckets:    map[string]*embedBucket{},
+		mutex:      sync.Mutex{},
+	}
+}
+
+func (embeds *Embeds) Add(embed *Embed, db *Database) error {
+	var (
+		err error
+		id  int64
+		res sql.Result
+	)
+
+	formatError := func(err error) error {
+		return fmt.Errorf("embeds.add: %v", err)
+	}
+
+	if len(embed.Label) == 0 {
+		return formatError(errors.New("no label"))
+	}
+
+	for _, origin := range embed.Origins {
+		if !embedOriginValid(origin) {
+			return formatError(fmt.Errorf("invalid origin %q", origin))
+		}
+	}
+
+	system, ok := embeds.Controller.Systems.GetSystem(embed.System)
+	if !ok {
+		return formatError(fmt.Errorf("unknown system %d", embed.System))
+	}
+
+	if _, ok := system.Talkgroups.GetTalkgroup(embed.Talkgroup); !ok {
+		return formatError(fmt.Errorf("unknown talkgroup %d of system %d", embed.Talkgroup, embed.System))
+	}
+
+	origins, err := json.Marshal(embed.Origins)
+	if err != nil {
+		return formatError(err)
+	}
+
+	embeds.mutex.Lock()
+	defer embeds.mutex.Unlock()
+
+	embed.CreatedAt = time.Now().UTC()
+	embed.Token = uuid.New().String()
+
+	if res, err = db.Sql.Exec("insert into `rdioScannerEmbeds` (`createdAt`, `delay`, `label`, `origins`, `system`, `talkgroup`, `token`) values (?, ?, ?, ?, ?, ?, ?)", embed.CreatedAt, embed.Delay, embed.Label, string(origins), embed.System, embed.Talkgroup, embed.Token); err != nil {
+		return formatError(err)
+	}
+
+	if id, err = res.LastInsertId(); err != nil {
+		return formatError(err)
+	}
+
+	embed.Id = uint(id)
+
+	embeds.List = append(embeds.List, embed)
+
+	return nil
+}
+
+// GetEmbed returns the embed of the token for the talkgroup.
+func (embeds *Embeds) GetEmbed(token string, system uint, talkgroup uint) (*Embed, bool) {
+	embeds.mutex.Lock()
+	defer embeds.mutex.Unlock()
+
+	if len(token) == 0 {
+		return nil, false
+	}
+
+	for _, embed := range embeds.List {
+		if embed.Token == token && embed.System == system && embed.Talkgroup == talkgroup {
+			return embed, true
+		}
+	}
+
+	return nil, false
+}
+
+func (embeds *Embeds) Read(db *Database) error {
+	var (
+		createdAt any
+		err       error
+		id        sql.NullFloat64
+		origins   string
+		rows      *sql.Rows
+	)
+
+	embeds.mutex.Lock()
+	defer embeds.mutex.Unlock()
+
+	embeds.List = []*Embed{}
+
+	formatError := func(err error) error {
+		return fmt.Errorf("embeds.read: %v", err)
+	}
+
+	if rows, err = db.Sql.Query("select `_id`, `createdAt`, `delay`, `label`, `origins`, `system`, `talkgroup`, `token` from `rdioScannerEmbeds` order by `label`"); err != nil {
+		return formatError(err)
+	}
+
+	for rows.Next() {
+		embed := &Embed{}
+
+		if err = rows.Scan(&id, &createdAt, &embed.Delay, &embed.Label, &origins, &embed.System, &embed.Talkgroup, &embed.Token); err != nil {
+			break
+		}
+
+		if id.Valid && id.Float64 > 0 {
+			embed.Id = uint(id.Float64)
+		}
+
+		if t, err := db.ParseDateTime(createdAt); err == nil {
+			embed.CreatedAt = t
+		}
+
+		if err = json.Unmarshal([]byte(origins), &embed.Origins); err != nil {
+			embed.Origins = []string{}
+			err = nil
+		}
+
+		embeds.List = append(embeds.List, embed)
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	return nil
+}
+
+func (embeds *Embeds) Remove(id uint, db *Database) (*Embed, error) {
+	embeds.mutex.Lock()
+	defer embeds.mutex.Unlock()
+
+	for i, embed := range embeds.List {
+		if embed.Id != id {
+			continue
+		}
+
+		if _, err := db.Sql.Exec("delete from `rdioScannerEmbeds` where `_id` = ?", id); err != nil {
+			return nil, fmt.Errorf("embeds.remove: %v", err)
+		}
+
+		embeds.List = append(embeds.List[:i], embeds.List[i+1:]...)
+
+		return embed, nil
+	}
+
+	return nil, nil
+}
+
+// allow takes a token from the bucket of the ip, the embedded players being
+// throttled apart from the listeners and the logins. It returns false with
+// the time to wait when the ip has no token left.
+func (embeds *Embeds) allow(ip string, now time.Time) (bool, time.Duration) {
+	config := embeds.Controller.Config
+
+	burst := float64(config.EmbedBurst)
+	rate := float64(config.EmbedRate) / 60
+
+	embeds.mutex.Lock()
+	defer embeds.mutex.Unlock()
+
+	bucket := embeds.buckets[ip]
+
+	if bucket == nil {
+		// the buckets full again are forgotten
+		for key, b := range embeds.buckets {
+			if b.tokens+now.Sub(b.updated).Seconds()*rate >= burst {
+				delete(embeds.buckets, key)
+			}
+		}
+
+		bucket = &embedBucket{tokens: burst, updated: now}
+		embeds.buckets[ip] = bucket
+
+	} else {
+		bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*rate)
+		bucket.updated = now
+	}
+
+	if bucket.tokens < 1 {
+		if rate <= 0 {
+			return false, time.Minute
+		}
+		return false, time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+	}
+
+	bucket.tokens--
+
+	return true, 0
+}
+
+// recent returns the recent calls of the talkgroup of the embed, as listed
+// by the player.
+func (embeds *Embeds) recent(embed *Embed) ([]map[string]any, error) {
+	var (
+		dateTime   any
+		duration   sql.NullFloat64
+		id         uint
+		transcript sql.NullString
+	)
+
+	controller := embeds.Controller
+
+	embed.mutex.Lock()
+	defer embed.mutex.Unlock()
+
+	now := time.Now()
+
+	if embed.cached != nil && now.Sub(embed.cachedAt) < embedCache {
+		return embed.cached, nil
+	}
+
+	list := []map[string]any{}
+
+	if controller.Blackouts.IsBlackedOut(&Call{DateTime: now, System: embed.System, Talkgroup: embed.Talkgroup}) {
+		embed.cached, embed.cachedAt = list, now
+		return list, nil
+	}
+
+	rows, err := controller.Database.Select("rdioScannerCalls", "id", "dateTime", "duration", "transcript").
+		Where(
+			SqlWhere("`system` = ?", embed.System),
+			SqlWhere("`talkgroup` = ?", embed.Talkgroup),
+			SqlWhere("`dateTime` <= ?", now.Add(-embed.GetDelay())),
+		).
+		OrderBy("dateTime", true).
+		Limit(embedCalls).
+		Query()
+	if err != nil {
+		return nil, fmt.Errorf("embeds.recent: %v", err)
+	}
+
+	for rows.Next() {
+		if err = rows.Scan(&id, &dateTime, &duration, &transcript); err != nil {
+			break
+		}
+
+		call := map[string]any{
+			"audio": fmt.Sprintf("%s/embed/%d/%d/%d/audio?token=%s", controller.Config.GetBasePath(), embed.System, embed.Talkgroup, id, url.QueryEscape(embed.Token)),
+			"id":    id,
+		}
+
+		if t, err := controller.Database.ParseDateTime(dateTime); err == nil {
+			call["dateTime"] = t
+		}
+
+		if duration.Valid && duration.Float64 > 0 {
+			call["duration"] = duration.Float64 / 1000
+		}
+
+		if transcript.Valid && len(transcript.String) > 0 {
+			call["transcript"] = transcript.String
+		}
+
+		list = append(list, call)
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return nil, fmt.Errorf("embeds.recent: %v", err)
+	}
+
+	embed.cached, embed.cachedAt = list, now
+
+	return list, nil
+}
+
+// EmbedHandler serves the embedded player of a talkgroup on
+// /embed/{system}/{talkgroup}?token=, its recent calls as json when asked
+// for json, and their audio on /embed/{system}/{talkgroup}/{id}/audio.
+func (embeds *Embeds) EmbedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	controller := embeds.Controller
+
+	ip := GetRemoteAddr(r)
+
+	if ok, wait := embeds.allow(ip, time.Now()); !ok {
+		loginRetryAfter(w, wait)
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	p := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/embed/"), "/"), "/")
+	if len(p) != 2 && (len(p) != 4 || p[3] != "audio") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	system, err := strconv.ParseUint(p[0], 10, 32)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	talkgroup, err := strconv.ParseUint(p[1], 10, 32)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	embed, ok := embeds.GetEmbed(r.URL.Query().Get("token"), uint(system), uint(talkgroup))
+	if !ok {
+		controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("embed: invalid token for system=%d talkgroup=%d from ip %s", system, talkgroup, ip))
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Security-Policy", embed.frameAncestors())
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	if len(p) == 4 {
+		embeds.serveAudio(w, r, embed, p[2])
+		return
+	}
+
+	calls, err := embeds.recent(embed)
+	if err != nil {
+		controller.Logs.LogEvent(LogLevelError, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	if r.URL.Query().Get("format") == "json" || !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		if b, err := json.Marshal(calls); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+		return
+	}
+
+	b, err := embeds.page(embed)
+	if err != nil {
+		controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("embeds.page: %v", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(b)
+}
+
+func (embeds *Embeds) page(embed *Embed) ([]byte, error) {
+	var b strings.Builder
+
+	controller := embeds.Controller
+
+	data := map[string]any{
+		"calls":   fmt.Sprintf("%s/embed/%d/%d?format=json&token=%s", controller.Config.GetBasePath(), embed.System, embed.Talkgroup, url.QueryEscape(embed.Token)),
+		"refresh": int(embedRefresh / time.Millisecond),
+		"title":   embed.Label,
+	}
+
+	if len(controller.Options.Branding) > 0 {
+		data["siteName"] = controller.Options.Branding
+	} else {
+		data["siteName"] = "Rdio Scanner"
+	}
+
+	if system, ok := controller.Systems.GetSystem(embed.System); ok {
+		if talkgroup, ok := system.Talkgroups.GetTalkgroup(embed.Talkgroup); ok {
+			if len(talkgroup.Name) > 0 {
+				data["talkgroup"] = talkgroup.Name
+			} else {
+				data["talkgroup"] = talkgroup.Label
+			}
+		}
+	}
+
+	if err := embedPage.Execute(&b, data); err != nil {
+		return nil, err
+	}
+
+	return []byte(b.String()), nil
+}
+
+// serveAudio serves the audio of a call of the talkgroup of the embed, once
+// it is old enough to be listed.
+func (embeds *Embeds) serveAudio(w http.ResponseWriter, r *http.Request, embed *Embed, id string) {
+	controller := embeds.Controller
+
+	i, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	call, err := controller.Calls.GetCall(uint(i), controller.Database)
+	if errors.Is(err, ErrCallNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("embeds.serveaudio: %v", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if call.System != embed.System || call.Talkgroup != embed.Talkgroup || time.Since(call.DateTime) < embed.GetDelay() || controller.Blackouts.IsBlackedOut(call) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if call.Cold {
+		controller.ColdStorage.ReplyRetrieving(w, call)
+		return
+	}
+
+	if len(call.Audio) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+
+	controller.Api.serveAudio(w, r, call)
+}
+
+func (admin *Admin) EmbedsHandler(w http.ResponseWriter, r *http.Request) {
+	if !admin.Authorize(w, r, adminWriteRole(r)) {
+		return
+	}
+
+	embeds := admin.Controller.Embeds
+	logs := admin.Controller.Logs
+
+	switch r.Method {
+	case http.MethodDelete:
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil || id < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		embed, err := embeds.Remove(uint(id), admin.Controller.Database)
+		if err != nil {
+			logs.LogEvent(LogLevelError, err.Error())
+			w.WriteHeader(http.StatusExpectationFailed)
+			return
+		}
+
+		if embed == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		logs.LogEvent(LogLevelWarn, fmt.Sprintf("embed: %s removed by admin from ip %s", embed.Label, GetRemoteAddr(r)))
+
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodGet:
+		embeds.mutex.Lock()
+		b, err := json.Marshal(embeds.List)
+		embeds.mutex.Unlock()
+
+		if err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+
+	case http.MethodPost:
+		m := map[string]any{}
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		embed := (&Embed{}).FromMap(m)
+
+		if err := embeds.Add(embed, admin.Controller.Database); err != nil {
+			logs.LogEvent(LogLevelWarn, err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		logs.LogEvent(LogLevelWarn, fmt.Sprintf("embed: %s added by admin from ip %s", embed.Label, GetRemoteAddr(r)))
+
+		u := fmt.Sprintf("%s/embed/%d/%d?token=%s", requestBaseUrl(r), embed.System, embed.Talkgroup, embed.Token)
+
+		if b, err := json.Marshal(map[string]any{
+			"embed":  embed,
+			"iframe": fmt.Sprintf(`<iframe src="%s" width="400" height="480" frameborder="0"></iframe>`, u),
+			"url":    u,
+		}); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// embedOriginValid tells whether the origin can be given to frame-ancestors,
+// a scheme and a host with no path, ie: https://www.example.com.
+func embedOriginValid(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return false
+	}
+
+	return (u.Path == "" || u.Path == "/") && u.RawQuery == "" && u.Fragment == "" && u.User == nil && !strings.ContainsAny(origin, " ;,'\"")
+}
+
+var embedPage = template.Must(template.New("embed").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.title}}</title>
+<style>
+body { background: #000; color: #fff; font-family: sans-serif; font-size: 14px; margin: 0; padding: 8px; }
+#title { font-size: 1.2em; font-weight: bold; }
+#site, .time { color: #aaa; }
+.call { border-top: 1px solid #333; padding: 8px 0; }
+.transcript { margin-top: 4px; }
+audio { margin-top: 4px; width: 100%; }
+</style>
+</head>
+<body>
+<div id="site">{{.siteName}}</div>
+<div id="title">{{if .talkgroup}}{{.talkgroup}}{{else}}{{.title}}{{end}}</div>
+<div id="calls"></div>
+<script>
+var calls = {{.calls}};
+function render(list) {
+	var el = document.getElementById('calls');
+	// the list is not replaced while a call is played
+	if (Array.prototype.some.call(el.querySelectorAll('audio'), function (a) { return !a.paused; })) return;
+	el.textContent = '';
+	if (!list.length) { el.textContent = 'No recent calls.'; return; }
+	list.forEach(function (c) {
+		var div = document.createElement('div');
+		div.className = 'call';
+		var time = document.createElement('div');
+		time.className = 'time';
+		time.textContent = new Date(c.dateTime).toLocaleString() + (c.duration ? ', ' + c.duration.toFixed(1) + 's' : '');
+		div.appendChild(time);
+		var audio = document.createElement('audio');
+		audio.controls = true;
+		audio.preload = 'none';
+		audio.src = c.audio;
+		div.appendChild(audio);
+		if (c.transcript) {
+			var t = document.createElement('div');
+			t.className = 'transcript';
+			t.textContent = c.transcript;
+			div.appendChild(t);
+		}
+		el.appendChild(div);
+	});
+}
+function load() {
+	fetch(calls, { headers: { Accept: 'application/json' } })
+		.then(function (r) { return r.ok ? r.json() : null; })
+		.then(function (list) { if (list) render(list); })
+		.catch(function () {})
+		.then(function () { setTimeout(load, {{.refresh}}); });
+}
+load();
+</script>
+</body>
+</html>
+`))
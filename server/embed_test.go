@@ -0,0 +1,249 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestEmbeds(t *testing.T) *Embeds {
+	t.Helper()
+
+	controller := &Controller{
+		Calls:    NewCalls(),
+		Config:   &Config{EmbedBurst: 100, EmbedRate: 60},
+		Database: newTestDatabase(t),
+		Logs:     NewLogs(),
+		Options:  NewOptions(),
+		Systems:  NewSystems(),
+	}
+
+	controller.Api = NewApi(controller)
+	controller.Blackouts = NewBlackouts(controller)
+	controller.Embeds = NewEmbeds(controller)
+
+	system := NewSystem()
+	system.Id = 1
+	system.Label = "County"
+	system.Talkgroups.List = []*Talkgroup{{Id: 2, Label: "Fire", Name: "Fire Dispatch"}, {Id: 3, Label: "EMS"}}
+	controller.Systems.List = []*System{system}
+
+	return controller.Embeds
+}
+
+func TestEmbedOriginValid(t *testing.T) {
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://www.example.com", true},
+		{"https://www.example.com/", true},
+		{"http://localhost:8080", true},
+		{"https://www.example.com/page", false},
+		{"https://www.example.com?a=b", false},
+		{"ftp://www.example.com", false},
+		{"www.example.com", false},
+		{"https://a.com https://b.com", false},
+		{"https://a.com;script-src", false},
+		{"'self'", false},
+		{"*", false},
+	}
+
+	for _, test := range tests {
+		if got := embedOriginValid(test.origin); got != test.want {
+			t.Errorf("embedOriginValid(%q) = %v, want %v", test.origin, got, test.want)
+		}
+	}
+}
+
+func TestEmbedsAllow(t *testing.T) {
+	embeds := newTestEmbeds(t)
+	embeds.Controller.Config.EmbedBurst = 3
+	embeds.Controller.Config.EmbedRate = 60
+
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := embeds.allow("10.0.0.1", now); !ok {
+			t.Fatalf("request %d throttled within the burst", i+1)
+		}
+	}
+
+	ok, wait := embeds.allow("10.0.0.1", now)
+	if ok || wait != time.Second {
+		t.Fatalf("allow() over the burst = %v, %v, want false, 1s", ok, wait)
+	}
+
+	if ok, _ = embeds.allow("10.0.0.2", now); !ok {
+		t.Fatal("another ip throttled")
+	}
+
+	if ok, _ = embeds.allow("10.0.0.1", now.Add(time.Second)); !ok {
+		t.Fatal("throttled after the refill")
+	}
+}
+
+func TestEmbedsAdd(t *testing.T) {
+	tests := []struct {
+		name  string
+		embed map[string]any
+		ok    bool
+	}{
+		{name: "valid", embed: map[string]any{"label": "Fire", "system": 1.0, "talkgroup": 2.0, "origins": "https://fire.example.com"}, ok: true},
+		{name: "no label", embed: map[string]any{"system": 1.0, "talkgroup": 2.0}, ok: false},
+		{name: "unknown system", embed: map[string]any{"label": "Fire", "system": 9.0, "talkgroup": 2.0}, ok: false},
+		{name: "unknown talkgroup", embed: map[string]any{"label": "Fire", "system": 1.0, "talkgroup": 9.0}, ok: false},
+		{name: "invalid origin", embed: map[string]any{"label": "Fire", "system": 1.0, "talkgroup": 2.0, "origins": []any{"https://a.com; script-src *"}}, ok: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			embeds := newTestEmbeds(t)
+
+			err := embeds.Add((&Embed{}).FromMap(test.embed), embeds.Controller.Database)
+			if (err == nil) != test.ok {
+				t.Fatalf("Add() error = %v, want ok %v", err, test.ok)
+			}
+		})
+	}
+}
+
+func TestEmbedHandler(t *testing.T) {
+	embeds := newTestEmbeds(t)
+	controller := embeds.Controller
+
+	now := time.Now().UTC()
+
+	write := func(talkgroup uint, dateTime time.Time) uint {
+		id, err := controller.Calls.WriteCall(&Call{Audio: []byte("audio"), AudioType: "audio/mpeg", DateTime: dateTime, Duration: 2500 * time.Millisecond, Source: uint(1234), System: 1, Talkgroup: talkgroup}, controller.Database)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	old := write(2, now.Add(-time.Hour))
+	recent := write(2, now)
+	other := write(3, now.Add(-time.Hour))
+
+	embed := (&Embed{}).FromMap(map[string]any{"delay": 60.0, "label": "Fire", "origins": []any{"https://fire.example.com"}, "system": 1.0, "talkgroup": 2.0})
+	if err := embeds.Add(embed, controller.Database); err != nil {
+		t.Fatal(err)
+	}
+
+	// read back as on a restart
+	if err := embeds.Read(controller.Database); err != nil {
+		t.Fatal(err)
+	}
+
+	path := func(format string, a ...any) string {
+		return fmt.Sprintf(format, a...) + "?token=" + embed.Token
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		accept string
+		status int
+		check  func(t *testing.T, w *httptest.ResponseRecorder)
+	}{
+		{
+			name:   "recent calls",
+			path:   path("/embed/1/2"),
+			accept: "application/json",
+			status: http.StatusOK,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				calls := []map[string]any{}
+				if err := json.Unmarshal(w.Body.Bytes(), &calls); err != nil {
+					t.Fatal(err)
+				}
+
+				// the recent call is delayed
+				if len(calls) != 1 || calls[0]["id"] != float64(old) || calls[0]["duration"] != 2.5 {
+					t.Fatalf("got %v, want call %d only", calls, old)
+				}
+
+				if _, ok := calls[0]["source"]; ok {
+					t.Fatal("radio id listed")
+				}
+
+				if got := w.Header().Get("Content-Security-Policy"); got != "frame-ancestors https://fire.example.com" {
+					t.Fatalf("content security policy %q", got)
+				}
+			},
+		},
+		{
+			name:   "player page",
+			path:   path("/embed/1/2"),
+			accept: "text/html",
+			status: http.StatusOK,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				if body := w.Body.String(); !strings.Contains(body, "Fire Dispatch") {
+					t.Fatalf("page without the talkgroup name: %s", body)
+				}
+			},
+		},
+		{name: "audio", path: path("/embed/1/2/%d/audio", old), status: http.StatusOK},
+		{name: "audio delayed", path: path("/embed/1/2/%d/audio", recent), status: http.StatusNotFound},
+		{name: "audio of another talkgroup", path: path("/embed/1/2/%d/audio", other), status: http.StatusNotFound},
+		{name: "another talkgroup", path: path("/embed/1/3"), status: http.StatusNotFound},
+		{name: "invalid token", path: "/embed/1/2?token=invalid", status: http.StatusNotFound},
+		{name: "no token", path: "/embed/1/2", status: http.StatusNotFound},
+		{name: "invalid path", path: path("/embed/1/2/%d", old), status: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, test.path, nil)
+			if len(test.accept) > 0 {
+				r.Header.Set("Accept", test.accept)
+			}
+
+			w := httptest.NewRecorder()
+
+			embeds.EmbedHandler(w, r)
+
+			if w.Code != test.status {
+				t.Fatalf("status %d, want %d", w.Code, test.status)
+			}
+
+			if test.check != nil {
+				test.check(t, w)
+			}
+		})
+	}
+}
+
+func TestEmbedHandlerThrottled(t *testing.T) {
+	embeds := newTestEmbeds(t)
+	embeds.Controller.Config.EmbedBurst = 1
+
+	for i, want := range []int{http.StatusNotFound, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+
+		embeds.EmbedHandler(w, httptest.NewRequest(http.MethodGet, "/embed/1/2?token=invalid", nil))
+
+		if w.Code != want {
+			t.Fatalf("request %d status %d, want %d", i+1, w.Code, want)
+		}
+	}
+}
@@ -0,0 +1,579 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	EventKindCall      = "call"
+	EventKindListeners = "listeners"
+	EventKindSystem    = "system"
+)
+
+const (
+	// events queued for a subscriber before the newer ones are dropped
+	eventsQueue = 64
+
+	// the stream gets a comment this often, which keeps the proxies from
+	// closing it and checks that its access code or api key is still valid
+	eventsHeartbeat = 15 * time.Second
+
+	// a system without calls for this long is reported offline
+	eventsSystemSilence = time.Hour
+
+	eventsWriteWait = 30 * time.Second
+)
+
+// Event is a live event of the activity feed, sent as a Server-Sent Event
+// whose data is the json of its payload.
+type Event struct {
+	Id   uint64
+	Data []byte
+	Kind string
+	call *Call
+}
+
+// EventCall is the payload of the call events, a summary of the call
+// without its audio.
+type EventCall struct {
+	Id             any       `json:"id"`
+	DateTime       time.Time `json:"dateTime"`
+	Duration       float64   `json:"duration"`
+	Emergency      bool      `json:"emergency"`
+	Frequency      any       `json:"frequency,omitempty"`
+	Source         any       `json:"source,omitempty"`
+	System         uint      `json:"system"`
+	SystemLabel    string    `json:"systemLabel"`
+	Talkgroup      uint      `json:"talkgroup"`
+	TalkgroupLabel string    `json:"talkgroupLabel"`
+	TalkgroupName  string    `json:"talkgroupName"`
+}
+
+// EventListeners is the payload of the listeners events.
+type EventListeners struct {
+	Count int `json:"count"`
+}
+
+// EventSystem is the payload of the system events, sent when a system goes
+// offline for having no call for an hour, and when its calls come back.
+type EventSystem struct {
+	Id       uint      `json:"id"`
+	Label    string    `json:"label"`
+	LastCall time.Time `json:"lastCall"`
+	Online   bool      `json:"online"`
+}
+
+// Events feeds the live activity to the subscribers of /api/events, for the
+// dashboards and the status pages which don't speak the websocket protocol
+// of the webapp. A slow subscriber misses events rather than holding the
+// ingest back.
+type Events struct {
+	Controller  *Controller
+	lastCall    map[uint]time.Time
+	offline     map[uint]bool
+	seq         uint64
+	subscribers map[*eventsSubscriber]bool
+	mutex       sync.Mutex
+}
+
+type eventsSubscriber struct {
+	access  *Access
+	apikey  *Apikey
+	code    string
+	dropped uint64
+	kinds   map[string]bool
+	send    chan *Event
+	tier    *Tier
+}
+
+func NewEvents(controller *Controller) *Events {
+	return &Events{
+		Controller:  controller,
+		lastCall:    map[uint]time.Time{},
+		offline:     map[uint]bool{},
+		subscribers: map[*eventsSubscriber]bool{},
+	}
+}
+
+// EmitCall sends the call to the subscribers allowed to listen to it, and
+// tells that its system is back online when it was offline.
+func (events *Events) EmitCall(call *Call) {
+	systemLabel, talkgroupLabel, talkgroupName := fmt.Sprint(call.System), fmt.Sprint(call.Talkgroup), ""
+
+	if system, ok := events.Controller.Systems.GetSystem(call.System); ok {
+		systemLabel = system.Label
+	}
+
+	talkgroup := events.Controller.Systems.GetCallTalkgroup(call)
+	if talkgroup != nil {
+		talkgroupLabel = talkgroup.Label
+		talkgroupName = talkgroup.Name
+	}
+
+	events.mutex.Lock()
+	events.lastCall[call.System] = time.Now()
+	back := events.offline[call.System]
+	delete(events.offline, call.System)
+	events.mutex.Unlock()
+
+	if back {
+		events.emit(EventKindSystem, &EventSystem{Id: call.System, Label: systemLabel, LastCall: call.DateTime, Online: true}, call)
+	}
+
+	// the calls of the hidden and of the delayed talkgroups don't go live
+	if !talkgroup.IsAvailable(call) {
+		return
+	}
+
+	events.emit(EventKindCall, &EventCall{
+		Id:             call.Id,
+		DateTime:       call.DateTime,
+		Duration:       call.Duration.Seconds(),
+		Emergency:      call.Emergency,
+		Frequency:      call.Frequency,
+		Source:         call.Source,
+		System:         call.System,
+		SystemLabel:    systemLabel,
+		Talkgroup:      call.Talkgroup,
+		TalkgroupLabel: talkgroupLabel,
+		TalkgroupName:  talkgroupName,
+	}, call)
+}
+
+// EmitListeners sends the count of connected listeners, when the listeners
+// count is shown.
+func (events *Events) EmitListeners(count int) {
+	if !events.Controller.Options.ShowListenersCount {
+		return
+	}
+
+	events.emit(EventKindListeners, &EventListeners{Count: count}, nil)
+}
+
+// Start checks every minute for the systems gone silent. The systems are
+// deemed online when the server starts.
+func (events *Events) Start() error {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+
+		for t := range ticker.C {
+			events.check(t)
+		}
+	}()
+
+	return nil
+}
+
+// Subscribers returns how many subscribers are connected.
+func (events *Events) Subscribers() int {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+
+	return len(events.subscribers)
+}
+
+func (events *Events) check(now time.Time) {
+	defer events.Controller.Recover("events.check")
+
+	offline := []*EventSystem{}
+
+	events.Controller.Systems.mutex.Lock()
+	systems := make([]*System, len(events.Controller.Systems.List))
+	copy(systems, events.Controller.Systems.List)
+	events.Controller.Systems.mutex.Unlock()
+
+	events.mutex.Lock()
+	for _, system := range systems {
+		lastCall, ok := events.lastCall[system.Id]
+		if !ok {
+			events.lastCall[system.Id] = now
+			continue
+		}
+
+		if !events.offline[system.Id] && now.Sub(lastCall) >= eventsSystemSilence {
+			events.offline[system.Id] = true
+			offline = append(offline, &EventSystem{Id: system.Id, Label: system.Label, LastCall: lastCall.UTC()})
+		}
+	}
+	events.mutex.Unlock()
+
+	for _, system := range offline {
+		events.emit(EventKindSystem, system, &Call{System: system.Id})
+	}
+}
+
+// emit queues the event for the subscribers allowed to get it, the call
+// being the one it is about, if any.
+func (events *Events) emit(kind string, payload any, call *Call) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		events.Controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("events.emit: %v", err))
+		return
+	}
+
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+
+	if len(events.subscribers) == 0 {
+		return
+	}
+
+	events.seq++
+
+	event := &Event{Id: events.seq, Data: b, Kind: kind, call: call}
+
+	for subscriber := range events.subscribers {
+		if !subscriber.allowed(event, events.Controller.Accesses.IsRestricted()) {
+			continue
+		}
+
+		select {
+		case subscriber.send <- event:
+		default:
+			atomic.AddUint64(&subscriber.dropped, 1)
+		}
+	}
+}
+
+func (events *Events) subscribe(subscriber *eventsSubscriber) {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+
+	events.subscribers[subscriber] = true
+}
+
+func (events *Events) unsubscribe(subscriber *eventsSubscriber) {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+
+	delete(events.subscribers, subscriber)
+}
+
+// allowed tells if the subscriber may get the event, the system events
+// going to those with access to some talkgroups of the system.
+func (subscriber *eventsSubscriber) allowed(event *Event, restricted bool) bool {
+	if len(subscriber.kinds) > 0 && !subscriber.kinds[event.Kind] {
+		return false
+	}
+
+	if event.call == nil {
+		return true
+	}
+
+	switch event.Kind {
+	case EventKindCall:
+		// the calls of a delayed tier don't go live
+		if subscriber.tier != nil && !subscriber.tier.IsAvailable(event.call) {
+			return false
+		}
+
+		switch {
+		case subscriber.apikey != nil:
+			return subscriber.apikey.HasAccess(event.call)
+		case subscriber.access != nil:
+			return subscriber.access.HasAccess(event.call)
+		}
+
+	case EventKindSystem:
+		switch {
+		case subscriber.apikey != nil:
+			return eventsHasSystem(subscriber.apikey.Systems, event.call.System)
+		case subscriber.access != nil:
+			return eventsHasSystem(subscriber.access.Systems, event.call.System)
+		}
+	}
+
+	return !restricted
+}
+
+// payload returns the data of the event as the subscriber may get it.
+func (subscriber *eventsSubscriber) payload(event *Event) []byte {
+	if event.Kind != EventKindCall || subscriber.tier == nil || !subscriber.tier.Redact {
+		return event.Data
+	}
+
+	m := map[string]any{}
+	if err := json.Unmarshal(event.Data, &m); err != nil {
+		return event.Data
+	}
+	delete(m, "source")
+
+	if b, err := json.Marshal(m); err == nil {
+		return b
+	}
+
+	return event.Data
+}
+
+// EventsHandler streams the live activity as Server-Sent Events: the call
+// events, the listeners events when the listeners count is shown, and the
+// system events. The events query restricts the stream to some kinds, ie:
+// events=call,system. When the access codes are in use, the stream needs an
+// access code, in the code query or as the password of a basic
+// authentication, or an api key with the read scope, in the X-Api-Key
+// header or the key query, and only carries the calls it gives access to.
+func (api *Api) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	controller := api.Controller
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	subscriber := &eventsSubscriber{kinds: map[string]bool{}, send: make(chan *Event, eventsQueue)}
+
+	for _, kind := range strings.Split(r.URL.Query().Get("events"), ",") {
+		switch kind = strings.TrimSpace(kind); kind {
+		case "":
+		case EventKindCall, EventKindListeners, EventKindSystem:
+			subscriber.kinds[kind] = true
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("Unknown event %s.\n", kind)))
+			return
+		}
+	}
+
+	if status := api.authorizeEvents(w, r, subscriber); status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+
+	controller.Events.subscribe(subscriber)
+	defer controller.Events.unsubscribe(subscriber)
+
+	// the stream outlasts the read timeout of the server
+	clearReadDeadline(r)
+
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	write := func(s string) bool {
+		extendWriteDeadline(r, eventsWriteWait)
+
+		if _, err := w.Write([]byte(s)); err != nil {
+			return false
+		}
+
+		flusher.Flush()
+
+		return true
+	}
+
+	if !write(fmt.Sprintf("retry: %d\n\n", (5 * time.Second).Milliseconds())) {
+		return
+	}
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case event := <-subscriber.send:
+			if !write(fmt.Sprintf("id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Kind, subscriber.payload(event))) {
+				return
+			}
+
+		case <-heartbeat.C:
+			if !api.revalidateEvents(subscriber) {
+				return
+			}
+
+			comment := ": ping\n\n"
+			if dropped := atomic.SwapUint64(&subscriber.dropped, 0); dropped > 0 {
+				comment = fmt.Sprintf(": %d events dropped\n\n", dropped)
+			}
+
+			if !write(comment) {
+				return
+			}
+		}
+	}
+}
+
+// authorizeEvents checks the api key or the access code of the request, the
+// latter through the login limits as for the listeners.
+func (api *Api) authorizeEvents(w http.ResponseWriter, r *http.Request, subscriber *eventsSubscriber) int {
+	controller := api.Controller
+
+	key := r.Header.Get("X-Api-Key")
+	if len(key) == 0 {
+		key = r.URL.Query().Get("key")
+	}
+
+	if len(key) > 0 {
+		apikey, ok := controller.Apikeys.GetApikey(key)
+		if !ok || !apikey.HasScope(ApikeyScopeRead) {
+			return http.StatusUnauthorized
+		}
+
+		if err := controller.Apikeys.Used(apikey, controller.Database); err != nil {
+			controller.Logs.LogEvent(LogLevelError, err.Error())
+		}
+
+		subscriber.apikey = apikey
+
+		return http.StatusOK
+	}
+
+	if !controller.Accesses.IsRestricted() {
+		return http.StatusOK
+	}
+
+	code := r.URL.Query().Get("code")
+	if _, password, ok := r.BasicAuth(); ok {
+		code = password
+	}
+
+	if len(code) == 0 {
+		return http.StatusUnauthorized
+	}
+
+	remoteAddr := GetRemoteAddr(r)
+
+	if ok, wait := controller.Logins.Allow(LoginKindAccess, remoteAddr); !ok {
+		loginRetryAfter(w, wait)
+		return http.StatusTooManyRequests
+	}
+
+	access, ok := controller.GetListenerAccess(code)
+	if !ok || access.HasExpired() {
+		if locked, until := controller.Logins.Fail(LoginKindAccess, remoteAddr); locked {
+			controller.Logs.LogEvent(LogLevelWarn, loginLockedMessage(LoginKindAccess, remoteAddr, until))
+		}
+		return http.StatusUnauthorized
+	}
+
+	controller.Logins.Succeed(LoginKindAccess, remoteAddr)
+
+	subscriber.access = access
+	subscriber.code = code
+
+	if tier, ok := controller.Tiers.GetTier(access.Tier); ok {
+		subscriber.tier = tier
+	}
+
+	return http.StatusOK
+}
+
+// eventsScope is the condition on the calls given access to by the api key
+// or the access code of the subscriber, the listeners not getting the calls
+// of the hidden talkgroups nor those of their tier's delay.
+func (api *Api) eventsScope(subscriber *eventsSubscriber) *SqlCondition {
+	controller := api.Controller
+
+	scope := []*SqlCondition{controller.Blackouts.sqlCondition()}
+
+	switch {
+	case subscriber.apikey != nil:
+		scope = append(scope, subscriber.apikey.sqlCondition())
+
+	default:
+		if subscriber.access != nil {
+			switch subscriber.access.Systems.(type) {
+			case []any:
+				scope = append(scope, sqlScope(subscriber.access.Systems))
+			}
+		}
+		scope = append(scope, controller.Systems.sqlHiddenCondition(), subscriber.tier.sqlCondition())
+	}
+
+	return SqlAnd(scope...)
+}
+
+// revalidateEvents tells if the api key or the access code of the
+// subscriber is still valid, ie: not revoked or expired since it connected,
+// and picks up the changes of its systems and of its tier.
+func (api *Api) revalidateEvents(subscriber *eventsSubscriber) bool {
+	controller := api.Controller
+
+	controller.Events.mutex.Lock()
+	apikey, access := subscriber.apikey, subscriber.access
+	controller.Events.mutex.Unlock()
+
+	switch {
+	case apikey != nil:
+		apikey, ok := controller.Apikeys.GetApikey(apikey.Key)
+		if !ok || !apikey.HasScope(ApikeyScopeRead) {
+			return false
+		}
+
+		controller.Events.mutex.Lock()
+		subscriber.apikey = apikey
+		controller.Events.mutex.Unlock()
+
+		return true
+
+	case access != nil:
+		access, ok := controller.GetListenerAccess(subscriber.code)
+		if !ok || access.HasExpired() {
+			return false
+		}
+
+		tier, _ := controller.Tiers.GetTier(access.Tier)
+
+		controller.Events.mutex.Lock()
+		subscriber.access = access
+		subscriber.tier = tier
+		controller.Events.mutex.Unlock()
+
+		return true
+	}
+
+	return !controller.Accesses.IsRestricted()
+}
+
+// eventsHasSystem tells if the systems of an access code or an api key give
+// access to some talkgroups of the system.
+func eventsHasSystem(systems any, id uint) bool {
+	switch v := systems.(type) {
+	case []any:
+		for _, f := range v {
+			switch v := f.(type) {
+			case map[string]any:
+				switch i := v["id"].(type) {
+				case float64:
+					if i == float64(id) {
+						return true
+					}
+				}
+			}
+		}
+
+	case string:
+		return v == "*"
+	}
+
+	return false
+}
@@ -0,0 +1,173 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventsSubscriberAllowed(t *testing.T) {
+	partial := []any{map[string]any{"id": float64(1), "talkgroups": []any{float64(10)}}}
+
+	call := &Call{DateTime: time.Now(), System: 1, Talkgroup: 10}
+	other := &Call{DateTime: time.Now(), System: 1, Talkgroup: 20}
+
+	tests := []struct {
+		name       string
+		subscriber *eventsSubscriber
+		event      *Event
+		restricted bool
+		want       bool
+	}{
+		{"open server", &eventsSubscriber{}, &Event{Kind: EventKindCall, call: call}, false, true},
+		{"kind not asked for", &eventsSubscriber{kinds: map[string]bool{EventKindSystem: true}}, &Event{Kind: EventKindCall, call: call}, false, false},
+		{"listeners", &eventsSubscriber{access: &Access{Systems: partial}}, &Event{Kind: EventKindListeners}, true, true},
+		{"talkgroup of the access", &eventsSubscriber{access: &Access{Systems: partial}}, &Event{Kind: EventKindCall, call: call}, true, true},
+		{"talkgroup outside the access", &eventsSubscriber{access: &Access{Systems: partial}}, &Event{Kind: EventKindCall, call: other}, true, false},
+		{"system of the access", &eventsSubscriber{access: &Access{Systems: partial}}, &Event{Kind: EventKindSystem, call: &Call{System: 1}}, true, true},
+		{"system outside the access", &eventsSubscriber{access: &Access{Systems: partial}}, &Event{Kind: EventKindSystem, call: &Call{System: 2}}, true, false},
+		{"api key", &eventsSubscriber{apikey: &Apikey{Systems: "*"}}, &Event{Kind: EventKindCall, call: other}, true, true},
+		{"delayed tier", &eventsSubscriber{access: &Access{Systems: "*"}, tier: &Tier{Delay: 15}}, &Event{Kind: EventKindCall, call: call}, true, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.subscriber.allowed(test.event, test.restricted); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEventsCheck(t *testing.T) {
+	controller := newTestDigests(t)
+
+	events := controller.Events
+	subscriber := &eventsSubscriber{send: make(chan *Event, eventsQueue)}
+	events.subscribe(subscriber)
+
+	now := time.Now()
+
+	// the systems are deemed online when first seen
+	events.check(now)
+	events.check(now.Add(eventsSystemSilence - time.Minute))
+	if len(subscriber.send) != 0 {
+		t.Fatalf("%d events before the silence", len(subscriber.send))
+	}
+
+	events.check(now.Add(eventsSystemSilence))
+	events.check(now.Add(eventsSystemSilence + time.Minute))
+	if len(subscriber.send) != 1 {
+		t.Fatalf("%d events, want 1 offline", len(subscriber.send))
+	}
+	if event := <-subscriber.send; event.Kind != EventKindSystem || !strings.Contains(string(event.Data), `"online":false`) {
+		t.Fatalf("event = %s %s", event.Kind, event.Data)
+	}
+
+	events.EmitCall(&Call{DateTime: now, System: 1, Talkgroup: 10})
+	if len(subscriber.send) != 2 {
+		t.Fatalf("%d events, want online and call", len(subscriber.send))
+	}
+	if event := <-subscriber.send; event.Kind != EventKindSystem || !strings.Contains(string(event.Data), `"online":true`) {
+		t.Fatalf("event = %s %s", event.Kind, event.Data)
+	}
+	if event := <-subscriber.send; event.Kind != EventKindCall || !strings.Contains(string(event.Data), `"talkgroupName":"Fire Dispatch"`) {
+		t.Fatalf("event = %s %s", event.Kind, event.Data)
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	controller := newTestController(t, nil)
+	controller.Accesses.Add(&Access{Code: "1234", Systems: []any{map[string]any{"id": float64(1), "talkgroups": "*"}}})
+
+	system := NewSystem()
+	system.Id = 1
+	system.Label = "County"
+	system.Talkgroups.List = []*Talkgroup{{Id: 10, Label: "FD", Name: "Fire"}, {Id: 10, Label: "FD N", Name: "Fire North", Site: 2}}
+	controller.Systems.List = append(controller.Systems.List, system)
+
+	server := httptest.NewServer(http.HandlerFunc(controller.Api.EventsHandler))
+	t.Cleanup(server.Close)
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+	}{
+		{"no code", "/", http.StatusUnauthorized},
+		{"wrong code", "/?code=0000", http.StatusUnauthorized},
+		{"unknown event", "/?code=1234&events=audio", http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res, err := http.Get(server.URL + test.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != test.status {
+				t.Errorf("status %d, want %d", res.StatusCode, test.status)
+			}
+		})
+	}
+
+	res, err := http.Get(server.URL + "/?code=1234&events=call")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status %d, content type %q", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+
+	reader := bufio.NewReader(res.Body)
+
+	// the retry line is written once subscribed
+	if line, err := reader.ReadString('\n'); err != nil || !strings.HasPrefix(line, "retry:") {
+		t.Fatalf("line = %q, %v", line, err)
+	}
+
+	controller.Events.EmitCall(&Call{DateTime: time.Now(), System: 2, Talkgroup: 10})
+	controller.Events.EmitCall(&Call{DateTime: time.Now(), Id: uint(7), Site: 2, System: 1, Talkgroup: 10})
+
+	lines := []string{}
+	for len(lines) < 3 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line = strings.TrimSpace(line); len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+
+	if lines[1] != "event: call" || !strings.HasPrefix(lines[2], `data: {"id":7,`) {
+		t.Fatalf("lines = %q", lines)
+	}
+
+	// the talkgroup is the one of the site of the call
+	if !strings.Contains(lines[2], `"talkgroupLabel":"FD N","talkgroupName":"Fire North"`) {
+		t.Errorf("data = %s", lines[2])
+	}
+}
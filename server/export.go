@@ -0,0 +1,262 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ExportRotateDaily  = "daily"
+	ExportRotateHourly = "hourly"
+)
+
+// Export appends the metadata of every ingested call as one json object per
+// line, to a file sink and to the admins following the export endpoint.
+type Export struct {
+	Controller *Controller
+	file       *os.File
+	listeners  map[chan []byte]bool
+	period     string
+	mutex      sync.Mutex
+}
+
+func NewExport(controller *Controller) *Export {
+	return &Export{
+		Controller: controller,
+		listeners:  map[chan []byte]bool{},
+		mutex:      sync.Mutex{},
+	}
+}
+
+func (admin *Admin) ExportHandler(w http.ResponseWriter, r *http.Request) {
+	export := admin.Controller.Export
+
+	if !admin.Authorize(w, r, AdminRoleViewer) {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	c := make(chan []byte, 256)
+
+	export.mutex.Lock()
+	export.listeners[c] = true
+	export.mutex.Unlock()
+
+	defer func() {
+		export.mutex.Lock()
+		delete(export.listeners, c)
+		export.mutex.Unlock()
+	}()
+
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case b, ok := <-c:
+			if !ok {
+				return
+			}
+
+			if _, err := w.Write(b); err != nil {
+				return
+			}
+
+			flusher.Flush()
+		}
+	}
+}
+
+func (export *Export) Start() error {
+	if len(export.Controller.Config.ExportFile) == 0 {
+		return nil
+	}
+
+	export.mutex.Lock()
+	defer export.mutex.Unlock()
+
+	// a file left over from a previous period is rotated before appending
+	if fi, err := os.Stat(export.Controller.Config.GetExportFilePath()); err == nil {
+		export.period = export.getPeriod(fi.ModTime())
+	}
+
+	return export.open()
+}
+
+func (export *Export) Write(call *Call) {
+	b, err := json.Marshal(call.exportFields())
+	if err != nil {
+		export.Controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("export.write: %v", err))
+		return
+	}
+	b = append(b, '\n')
+
+	export.mutex.Lock()
+	defer export.mutex.Unlock()
+
+	for c := range export.listeners {
+		select {
+		case c <- b:
+		default:
+			close(c)
+			delete(export.listeners, c)
+		}
+	}
+
+	if len(export.Controller.Config.ExportFile) == 0 {
+		return
+	}
+
+	if err = export.open(); err == nil {
+		_, err = export.file.Write(b)
+	}
+
+	if err != nil {
+		export.Controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("export.write: %v", err))
+	}
+}
+
+func (export *Export) getPeriod(t time.Time) string {
+	switch export.Controller.Config.ExportRotate {
+	case ExportRotateDaily:
+		return t.UTC().Format("20060102")
+	case ExportRotateHourly:
+		return t.UTC().Format("2006010215")
+	default:
+		return ""
+	}
+}
+
+// open opens the export file, rotating the current one first when the
+// rotation period has changed.
+func (export *Export) open() error {
+	config := export.Controller.Config
+	file := config.GetExportFilePath()
+
+	period := export.getPeriod(time.Now())
+
+	if export.file != nil && period == export.period {
+		return nil
+	}
+
+	if export.file != nil {
+		export.file.Close()
+		export.file = nil
+	}
+
+	if len(export.period) > 0 && export.period != period {
+		ext := filepath.Ext(file)
+		rotated := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(file, ext), export.period, ext)
+
+		if err := os.Rename(file, rotated); err == nil {
+			if config.ExportGzip {
+				go export.compress(rotated)
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0660)
+	if err != nil {
+		return err
+	}
+
+	export.file = f
+	export.period = period
+
+	return nil
+}
+
+func (export *Export) compress(path string) {
+	logError := func(err error) {
+		export.Controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("export.compress: %v", err))
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		logError(err)
+		return
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0660)
+	if err != nil {
+		logError(err)
+		return
+	}
+
+	zw := gzip.NewWriter(dst)
+
+	if _, err = io.Copy(zw, src); err == nil {
+		err = zw.Close()
+	}
+
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(path + ".gz")
+		logError(err)
+		return
+	}
+
+	os.Remove(path)
+}
+
+func (call *Call) exportFields() map[string]any {
+	record := call.traceFields()
+	record["dateTime"] = call.DateTime.Format(time.RFC3339)
+	record["duration"] = call.Duration.Seconds()
+	record["frequencies"] = call.Frequencies
+	record["id"] = call.Id
+	record["ingestedAt"] = time.Now().UTC().Format(time.RFC3339)
+	record["sources"] = call.Sources
+	record["uuid"] = call.Uuid
+
+	if call.HasLocation() {
+		record["latitude"] = call.Latitude
+		record["longitude"] = call.Longitude
+	}
+
+	return record
+}
@@ -22,18 +22,27 @@ import (
 	"os/exec"
 	"path"
 	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// FFMpeg runs at most as many ffmpeg processes at once as there are workers,
+// the other conversions waiting for a worker to be free.
 type FFMpeg struct {
 	available bool
 	version43 bool
 	warned    bool
+	workers   chan struct{}
 }
 
-func NewFFMpeg() *FFMpeg {
-	ffmpeg := &FFMpeg{}
+func NewFFMpeg(workers uint) *FFMpeg {
+	if workers == 0 {
+		workers = uint(runtime.NumCPU())
+	}
+
+	ffmpeg := &FFMpeg{workers: make(chan struct{}, workers)}
 
 	stdout := bytes.NewBuffer([]byte(nil))
 
@@ -61,10 +70,11 @@ func NewFFMpeg() *FFMpeg {
 	return ffmpeg
 }
 
-func (ffmpeg *FFMpeg) Convert(call *Call, systems *Systems, tags *Tags, mode uint) error {
+func (ffmpeg *FFMpeg) Convert(call *Call, systems *Systems, tags *Tags, options *Options) error {
 	var (
 		args = []string{"-i", "-"}
 		err  error
+		mode = options.AudioConversion
 	)
 
 	if mode == AUDIO_CONVERSION_DISABLED {
@@ -80,8 +90,21 @@ func (ffmpeg *FFMpeg) Convert(call *Call, systems *Systems, tags *Tags, mode uin
 		return nil
 	}
 
+	normalization := AUDIO_NORMALIZATION_NONE
+
+	switch mode {
+	case AUDIO_CONVERSION_ENABLED_NORM:
+		normalization = AUDIO_NORMALIZATION_EBU
+	case AUDIO_CONVERSION_ENABLED_LOUD_NORM:
+		normalization = AUDIO_NORMALIZATION_LOUD
+	}
+
 	if system, ok := systems.GetSystem(call.System); ok {
-		if talkgroup, ok := system.Talkgroups.GetTalkgroup(call.Talkgroup); ok {
+		if len(system.AudioNormalization) > 0 {
+			normalization = system.AudioNormalization
+		}
+
+		if talkgroup, ok := system.Talkgroups.GetSiteTalkgroup(call.Talkgroup, call.Site); ok {
 			if tag, ok := tags.GetTag(talkgroup.TagId); ok {
 				args = append(args,
 					"-metadata", fmt.Sprintf("album=%v", talkgroup.Label),
@@ -94,15 +117,13 @@ func (ffmpeg *FFMpeg) Convert(call *Call, systems *Systems, tags *Tags, mode uin
 		}
 	}
 
-	if ffmpeg.version43 {
-		if mode == AUDIO_CONVERSION_ENABLED_NORM {
-			args = append(args, "-af", "apad=whole_dur=3s,loudnorm")
-		} else if mode == AUDIO_CONVERSION_ENABLED_LOUD_NORM {
-			args = append(args, "-af", "apad=whole_dur=3s,loudnorm=I=-16:TP=-1.5:LRA=11")
-		}
+	if filter := ffmpeg.normalization(normalization); len(filter) > 0 {
+		args = append(args, "-af", filter)
 	}
 
-	args = append(args, "-c:a", "aac", "-b:a", "32k", "-movflags", "frag_keyframe+empty_moov", "-f", "ipod", "-")
+	codec, audioType, ext := ffmpeg.codec(options.AudioCodec, options.AudioBitrate)
+
+	args = append(append(args, codec...), "-")
 
 	cmd := exec.Command("ffmpeg", args...)
 	cmd.Stdin = bytes.NewReader(call.Audio)
@@ -113,13 +134,13 @@ func (ffmpeg *FFMpeg) Convert(call *Call, systems *Systems, tags *Tags, mode uin
 	stderr := bytes.NewBuffer([]byte(nil))
 	cmd.Stderr = stderr
 
-	if err = cmd.Run(); err == nil {
+	if err = ffmpeg.run(cmd); err == nil {
 		call.Audio = stdout.Bytes()
-		call.AudioType = "audio/mp4"
+		call.AudioType = audioType
 
 		switch v := call.AudioName.(type) {
 		case string:
-			call.AudioName = fmt.Sprintf("%v.m4a", strings.TrimSuffix(v, path.Ext((v))))
+			call.AudioName = fmt.Sprintf("%v%s", strings.TrimSuffix(v, path.Ext((v))), ext)
 		}
 
 	} else {
@@ -128,3 +149,260 @@ func (ffmpeg *FFMpeg) Convert(call *Call, systems *Systems, tags *Tags, mode uin
 
 	return nil
 }
+
+// Transcode re-encodes audio already converted, keeping its metadata but
+// without applying the normalization filters a second time. It returns the
+// new audio with its mime type and file extension.
+func (ffmpeg *FFMpeg) Transcode(audio []byte, codec string, bitrate uint) ([]byte, string, string, error) {
+	if !ffmpeg.available {
+		return nil, "", "", errors.New("ffmpeg is not available")
+	}
+
+	args, audioType, ext := ffmpeg.codec(codec, bitrate)
+
+	cmd := exec.Command("ffmpeg", append(append([]string{"-i", "-", "-vn"}, args...), "-")...)
+	cmd.Stdin = bytes.NewReader(audio)
+
+	stdout := bytes.NewBuffer([]byte(nil))
+	cmd.Stdout = stdout
+
+	stderr := bytes.NewBuffer([]byte(nil))
+	cmd.Stderr = stderr
+
+	if err := ffmpeg.run(cmd); err != nil {
+		return nil, "", "", fmt.Errorf("ffmpeg: %v %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	if stdout.Len() == 0 {
+		return nil, "", "", errors.New("ffmpeg: no audio")
+	}
+
+	return stdout.Bytes(), audioType, ext, nil
+}
+
+// Slice re-encodes the part of the audio starting at start and lasting
+// length, the remainder of the audio when length is zero. It returns the
+// trimmed audio with its mime type and file extension.
+func (ffmpeg *FFMpeg) Slice(audio []byte, start time.Duration, length time.Duration, codec string, bitrate uint) ([]byte, string, string, error) {
+	if !ffmpeg.available {
+		return nil, "", "", errors.New("ffmpeg is not available")
+	}
+
+	args, audioType, ext := ffmpeg.codec(codec, bitrate)
+
+	input := []string{"-i", "-", "-vn", "-ss", fmt.Sprintf("%.3f", start.Seconds())}
+	if length > 0 {
+		input = append(input, "-t", fmt.Sprintf("%.3f", length.Seconds()))
+	}
+
+	cmd := exec.Command("ffmpeg", append(append(input, args...), "-")...)
+	cmd.Stdin = bytes.NewReader(audio)
+
+	stdout := bytes.NewBuffer([]byte(nil))
+	cmd.Stdout = stdout
+
+	stderr := bytes.NewBuffer([]byte(nil))
+	cmd.Stderr = stderr
+
+	if err := ffmpeg.run(cmd); err != nil {
+		return nil, "", "", fmt.Errorf("ffmpeg: %v %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	if stdout.Len() == 0 {
+		return nil, "", "", errors.New("ffmpeg: no audio")
+	}
+
+	return stdout.Bytes(), audioType, ext, nil
+}
+
+// Mixdown mixes the audio files into one, each starting at its offset, so
+// that the calls heard at the same time overlap as they did on the air. The
+// mix is normalized, as amix lowers the inputs by how many are playing. It
+// returns the mixed audio with its mime type and file extension.
+func (ffmpeg *FFMpeg) Mixdown(files []string, offsets []time.Duration, codec string, bitrate uint) ([]byte, string, string, error) {
+	if !ffmpeg.available {
+		return nil, "", "", errors.New("ffmpeg is not available")
+	}
+
+	if len(files) == 0 || len(files) != len(offsets) {
+		return nil, "", "", errors.New("ffmpeg: nothing to mix")
+	}
+
+	var (
+		args    = []string{}
+		filters = []string{}
+		labels  = ""
+	)
+
+	for i, file := range files {
+		args = append(args, "-i", file)
+
+		ms := offsets[i].Milliseconds()
+		if ms < 0 {
+			ms = 0
+		}
+
+		filters = append(filters, fmt.Sprintf("[%d:a]aresample=%d,aformat=channel_layouts=mono,adelay=%d|%d[a%d]", i, streamSampleRate, ms, ms, i))
+		labels += fmt.Sprintf("[a%d]", i)
+	}
+
+	filters = append(filters, fmt.Sprintf("%samix=inputs=%d:duration=longest:dropout_transition=0,%s[mix]", labels, len(files), ffmpeg.normalization(AUDIO_NORMALIZATION_AGC)))
+
+	codecArgs, audioType, ext := ffmpeg.codec(codec, bitrate)
+
+	args = append(args, "-filter_complex", strings.Join(filters, ";"), "-map", "[mix]", "-vn", "-map_metadata", "-1")
+
+	cmd := exec.Command("ffmpeg", append(append(args, codecArgs...), "-")...)
+
+	stdout := bytes.NewBuffer([]byte(nil))
+	cmd.Stdout = stdout
+
+	stderr := bytes.NewBuffer([]byte(nil))
+	cmd.Stderr = stderr
+
+	if err := ffmpeg.run(cmd); err != nil {
+		return nil, "", "", fmt.Errorf("ffmpeg: %v %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	if stdout.Len() == 0 {
+		return nil, "", "", errors.New("ffmpeg: no audio")
+	}
+
+	return stdout.Bytes(), audioType, ext, nil
+}
+
+// Duration decodes the audio to find out its length, which is reported by
+// ffmpeg as the time of the last decoded frame.
+func (ffmpeg *FFMpeg) Duration(audio []byte) (time.Duration, error) {
+	if !ffmpeg.available {
+		return 0, errors.New("ffmpeg is not available")
+	}
+
+	cmd := exec.Command("ffmpeg", "-i", "-", "-vn", "-f", "null", "-")
+	cmd.Stdin = bytes.NewReader(audio)
+
+	stderr := bytes.NewBuffer([]byte(nil))
+	cmd.Stderr = stderr
+
+	if err := ffmpeg.run(cmd); err != nil {
+		return 0, fmt.Errorf("ffmpeg: %v %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	m := regexp.MustCompile(`time=([0-9]+):([0-9]{2}):([0-9]{2}(?:\.[0-9]+)?)`).FindAllStringSubmatch(stderr.String(), -1)
+	if len(m) == 0 {
+		return 0, errors.New("ffmpeg: unknown duration")
+	}
+
+	h, _ := strconv.Atoi(m[len(m)-1][1])
+	mn, _ := strconv.Atoi(m[len(m)-1][2])
+	sc, _ := strconv.ParseFloat(m[len(m)-1][3], 64)
+
+	return time.Duration(h)*time.Hour + time.Duration(mn)*time.Minute + time.Duration(sc*float64(time.Second)), nil
+}
+
+// EncodeWav converts audio to mono 16 bits pcm, the format expected by most
+// speech to text engines.
+func (ffmpeg *FFMpeg) EncodeWav(audio []byte, sampleRate uint) ([]byte, error) {
+	if !ffmpeg.available {
+		return nil, errors.New("ffmpeg is not available")
+	}
+
+	cmd := exec.Command("ffmpeg", "-i", "-", "-vn", "-map_metadata", "-1", "-ar", fmt.Sprintf("%d", sampleRate), "-ac", "1", "-c:a", "pcm_s16le", "-f", "wav", "-")
+	cmd.Stdin = bytes.NewReader(audio)
+
+	stdout := bytes.NewBuffer([]byte(nil))
+	cmd.Stdout = stdout
+
+	stderr := bytes.NewBuffer([]byte(nil))
+	cmd.Stderr = stderr
+
+	if err := ffmpeg.run(cmd); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %v %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// EncodeStream transcodes audio to the constant bitrate mp3 format shared by
+// all streams, so that encoded calls can be concatenated on a mountpoint.
+func (ffmpeg *FFMpeg) EncodeStream(audio []byte) ([]byte, error) {
+	return ffmpeg.encodeStream(audio, "-i", "-")
+}
+
+func (ffmpeg *FFMpeg) EncodeStreamSilence(d time.Duration) ([]byte, error) {
+	return ffmpeg.encodeStream(nil, "-f", "lavfi", "-i", fmt.Sprintf("anullsrc=r=%d:cl=mono", streamSampleRate), "-t", fmt.Sprintf("%.3f", d.Seconds()))
+}
+
+func (ffmpeg *FFMpeg) encodeStream(audio []byte, input ...string) ([]byte, error) {
+	if !ffmpeg.available {
+		return nil, errors.New("ffmpeg is not available")
+	}
+
+	args := append(input,
+		"-vn", "-map_metadata", "-1",
+		"-c:a", "libmp3lame", "-b:a", fmt.Sprintf("%d", streamBitrate), "-ar", fmt.Sprintf("%d", streamSampleRate), "-ac", "1",
+		"-write_xing", "0", "-id3v2_version", "0", "-f", "mp3", "-",
+	)
+
+	cmd := exec.Command("ffmpeg", args...)
+	if audio != nil {
+		cmd.Stdin = bytes.NewReader(audio)
+	}
+
+	stdout := bytes.NewBuffer([]byte(nil))
+	cmd.Stdout = stdout
+
+	stderr := bytes.NewBuffer([]byte(nil))
+	cmd.Stderr = stderr
+
+	if err := ffmpeg.run(cmd); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %v %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// codec returns the encoder arguments of the codec at the bitrate in kbps,
+// with the mime type and the file extension of the encoded audio.
+func (ffmpeg *FFMpeg) codec(codec string, bitrate uint) ([]string, string, string) {
+	if bitrate == 0 {
+		bitrate = defaults.options.audioBitrate
+	}
+
+	switch codec {
+	case AUDIO_CODEC_OPUS:
+		return []string{"-c:a", "libopus", "-b:a", fmt.Sprintf("%dk", bitrate), "-application", "voip", "-f", "ogg"}, "audio/ogg", ".ogg"
+
+	default:
+		return []string{"-c:a", "aac", "-b:a", fmt.Sprintf("%dk", bitrate), "-movflags", "frag_keyframe+empty_moov", "-f", "ipod"}, "audio/mp4", ".m4a"
+	}
+}
+
+// normalization returns the audio filter of the normalization. The loudness
+// normalizations pad the short calls to the 3 seconds loudnorm needs to
+// measure them, which requires ffmpeg 4.3, while the agc works on any version.
+func (ffmpeg *FFMpeg) normalization(normalization string) string {
+	switch normalization {
+	case AUDIO_NORMALIZATION_AGC:
+		return "dynaudnorm=f=150:g=15:p=0.9:m=20"
+
+	case AUDIO_NORMALIZATION_EBU:
+		if ffmpeg.version43 {
+			return "apad=whole_dur=3s,loudnorm"
+		}
+
+	case AUDIO_NORMALIZATION_LOUD:
+		if ffmpeg.version43 {
+			return "apad=whole_dur=3s,loudnorm=I=-16:TP=-1.5:LRA=11"
+		}
+	}
+
+	return ""
+}
+
+func (ffmpeg *FFMpeg) run(cmd *exec.Cmd) error {
+	ffmpeg.workers <- struct{}{}
+	defer func() { <-ffmpeg.workers }()
+
+	return cmd.Run()
+}
@@ -0,0 +1,582 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	FLEETMAP_RADIOREFERENCE = "radioreference"
+	FLEETMAP_SDRTRUNK       = "sdrtrunk"
+	FLEETMAP_TRUNK_RECORDER = "trunk-recorder"
+)
+
+// FleetmapTalkgroup is a talkgroup as listed in a fleetmap file, its group
+// and its tag being referred to by their labels.
+type FleetmapTalkgroup struct {
+	Group string
+	Id    uint
+	Label string
+	Name  string
+	Tag   string
+}
+
+// columns of the id, label, name, tag and group of the csv files without a
+// header, same as the client side import
+var fleetmapCsvColumns = map[string][5]int{
+	FLEETMAP_RADIOREFERENCE: {0, 2, 4, 5, 6},
+	FLEETMAP_TRUNK_RECORDER: {0, 3, 4, 5, 6},
+}
+
+type fleetmapSdrTrunkId struct {
+	Protocol string `xml:"protocol,attr,omitempty"`
+	Type     string `xml:"type,attr"`
+	Value    string `xml:"value,attr"`
+}
+
+type fleetmapSdrTrunkAlias struct {
+	Group string               `xml:"group,attr,omitempty"`
+	Ids   []fleetmapSdrTrunkId `xml:"id"`
+	List  string               `xml:"list,attr"`
+	Name  string               `xml:"name,attr"`
+}
+
+type fleetmapSdrTrunkPlaylist struct {
+	XMLName xml.Name                `xml:"playlist"`
+	Aliases []fleetmapSdrTrunkAlias `xml:"alias"`
+	Version string                  `xml:"version,attr"`
+}
+
+// GetFleetmapFormat returns the format of a fleetmap file, the playlists of
+// SDRTrunk being the only xml files.
+func GetFleetmapFormat(b []byte) string {
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("<")) {
+		return FLEETMAP_SDRTRUNK
+	}
+	return FLEETMAP_TRUNK_RECORDER
+}
+
+// ParseFleetmap reads the talkgroups of a fleetmap file. The talkgroups
+// listed more than once are only read the first time.
+func ParseFleetmap(b []byte, format string) ([]*FleetmapTalkgroup, error) {
+	formatError := func(err error) error {
+		return fmt.Errorf("parsefleetmap: %v", err)
+	}
+
+	var (
+		err        error
+		talkgroups []*FleetmapTalkgroup
+	)
+
+	switch format {
+	case FLEETMAP_RADIOREFERENCE, FLEETMAP_TRUNK_RECORDER:
+		talkgroups, err = parseFleetmapCsv(b, fleetmapCsvColumns[format])
+	case FLEETMAP_SDRTRUNK:
+		talkgroups, err = parseFleetmapSdrTrunk(b)
+	default:
+		err = fmt.Errorf("unknown format %s", format)
+	}
+
+	if err != nil {
+		return nil, formatError(err)
+	}
+
+	seen := map[uint]bool{}
+	unique := []*FleetmapTalkgroup{}
+
+	for _, talkgroup := range talkgroups {
+		if !seen[talkgroup.Id] {
+			seen[talkgroup.Id] = true
+			unique = append(unique, talkgroup)
+		}
+	}
+
+	if len(unique) == 0 {
+		return nil, formatError(errors.New("no talkgroups found"))
+	}
+
+	return unique, nil
+}
+
+// parseFleetmapCsv maps the columns by their names when the file has a
+// header, and falls back to the columns of the format otherwise.
+func parseFleetmapCsv(b []byte, columns [5]int) ([]*FleetmapTalkgroup, error) {
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(b, []byte("\xef\xbb\xbf"))))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) > 0 && len(records[0]) > 0 {
+		if _, err := strconv.ParseUint(strings.TrimSpace(records[0][0]), 10, 32); err != nil {
+			names := [5][]string{
+				{"dec", "decimal", "id", "talkgroup"},
+				{"alpha tag", "alphatag", "label"},
+				{"description", "name"},
+				{"tag"},
+				{"category", "group"},
+			}
+
+			header := map[string]int{}
+			for i, name := range records[0] {
+				header[strings.ToLower(strings.TrimSpace(name))] = i
+			}
+
+			for i := range names {
+				columns[i] = -1
+				for _, name := range names[i] {
+					if c, ok := header[name]; ok {
+						columns[i] = c
+						break
+					}
+				}
+			}
+
+			if columns[0] < 0 {
+				return nil, errors.New("no talkgroup id column")
+			}
+
+			records = records[1:]
+		}
+	}
+
+	field := func(record []string, i int) string {
+		if i < 0 || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	talkgroups := []*FleetmapTalkgroup{}
+
+	for _, record := range records {
+		id, err := strconv.ParseUint(field(record, columns[0]), 10, 32)
+		if err != nil || id == 0 {
+			continue
+		}
+
+		talkgroups = append(talkgroups, &FleetmapTalkgroup{
+			Group: field(record, columns[4]),
+			Id:    uint(id),
+			Label: field(record, columns[1]),
+			Name:  field(record, columns[2]),
+			Tag:   field(record, columns[3]),
+		})
+	}
+
+	return talkgroups, nil
+}
+
+// parseFleetmapSdrTrunk reads the aliases of the talkgroups of a playlist,
+// the alias name becoming the talkgroup label. SDRTrunk has no tags.
+func parseFleetmapSdrTrunk(b []byte) ([]*FleetmapTalkgroup, error) {
+	playlist := fleetmapSdrTrunkPlaylist{}
+
+	if err := xml.Unmarshal(b, &playlist); err != nil {
+		return nil, err
+	}
+
+	talkgroups := []*FleetmapTalkgroup{}
+
+	for _, alias := range playlist.Aliases {
+		for _, id := range alias.Ids {
+			if id.Type != "talkgroup" {
+				continue
+			}
+
+			i, err := strconv.ParseUint(strings.TrimSpace(id.Value), 10, 32)
+			if err != nil || i == 0 {
+				continue
+			}
+
+			talkgroups = append(talkgroups, &FleetmapTalkgroup{
+				Group: alias.Group,
+				Id:    uint(i),
+				Label: alias.Name,
+				Name:  alias.Name,
+			})
+		}
+	}
+
+	return talkgroups, nil
+}
+
+// WriteFleetmap writes the talkgroups of a system in the given format, the
+// csv files starting with the header of their application.
+func WriteFleetmap(w io.Writer, system *System, talkgroups []*FleetmapTalkgroup, format string) error {
+	formatError := func(err error) error {
+		return fmt.Errorf("writefleetmap: %v", err)
+	}
+
+	switch format {
+	case FLEETMAP_RADIOREFERENCE, FLEETMAP_TRUNK_RECORDER:
+		writer := csv.NewWriter(w)
+
+		for i, talkgroup := range append([]*FleetmapTalkgroup{nil}, talkgroups...) {
+			var record []string
+
+			switch {
+			case i == 0 && format == FLEETMAP_RADIOREFERENCE:
+				record = []string{"Decimal", "Hex", "Alpha Tag", "Mode", "Description", "Tag", "Category"}
+			case i == 0:
+				record = []string{"Decimal", "Hex", "Mode", "Alpha Tag", "Description", "Tag", "Category"}
+			case format == FLEETMAP_RADIOREFERENCE:
+				record = []string{strconv.Itoa(int(talkgroup.Id)), strconv.FormatUint(uint64(talkgroup.Id), 16), talkgroup.Label, "D", talkgroup.Name, talkgroup.Tag, talkgroup.Group}
+			default:
+				record = []string{strconv.Itoa(int(talkgroup.Id)), strconv.FormatUint(uint64(talkgroup.Id), 16), "D", talkgroup.Label, talkgroup.Name, talkgroup.Tag, talkgroup.Group}
+			}
+
+			if err := writer.Write(record); err != nil {
+				return formatError(err)
+			}
+		}
+
+		writer.Flush()
+
+		if err := writer.Error(); err != nil {
+			return formatError(err)
+		}
+
+	case FLEETMAP_SDRTRUNK:
+		playlist := fleetmapSdrTrunkPlaylist{Aliases: []fleetmapSdrTrunkAlias{}, Version: "4"}
+
+		for _, talkgroup := range talkgroups {
+			name := talkgroup.Name
+			if len(name) == 0 {
+				name = talkgroup.Label
+			}
+
+			playlist.Aliases = append(playlist.Aliases, fleetmapSdrTrunkAlias{
+				Group: talkgroup.Group,
+				Ids:   []fleetmapSdrTrunkId{{Protocol: "APCO25", Type: "talkgroup", Value: strconv.Itoa(int(talkgroup.Id))}},
+				List:  system.Label,
+				Name:  name,
+			})
+		}
+
+		if _, err := io.WriteString(w, xml.Header); err != nil {
+			return formatError(err)
+		}
+
+		encoder := xml.NewEncoder(w)
+		encoder.Indent("", "  ")
+
+		if err := encoder.Encode(playlist); err != nil {
+			return formatError(err)
+		}
+
+		if _, err := io.WriteString(w, "\n"); err != nil {
+			return formatError(err)
+		}
+
+	default:
+		return formatError(fmt.Errorf("unknown format %s", format))
+	}
+
+	return nil
+}
+
+// ExportTalkgroups lists the talkgroups of a system with the labels of their
+// group and tag.
+func (controller *Controller) ExportTalkgroups(system *System) []*FleetmapTalkgroup {
+	talkgroups := []*FleetmapTalkgroup{}
+
+	system.Talkgroups.mutex.Lock()
+	list := append([]*Talkgroup{}, system.Talkgroups.List...)
+	system.Talkgroups.mutex.Unlock()
+
+	for _, talkgroup := range list {
+		entry := &FleetmapTalkgroup{
+			Id:    talkgroup.Id,
+			Label: talkgroup.Label,
+			Name:  talkgroup.Name,
+		}
+
+		if group, ok := controller.Groups.GetGroup(talkgroup.GroupId); ok {
+			entry.Group = group.Label
+		}
+
+		if tag, ok := controller.Tags.GetTag(talkgroup.TagId); ok {
+			entry.Tag = tag.Label
+		}
+
+		talkgroups = append(talkgroups, entry)
+	}
+
+	return talkgroups
+}
+
+// ImportTalkgroups adds the talkgroups of a fleetmap to a system, creating
+// the system as well as the missing groups and tags. Existing talkgroups are
+// left untouched unless overwrite is set, their ids are returned as skipped.
+func (controller *Controller) ImportTalkgroups(systemId uint, systemLabel string, source []*FleetmapTalkgroup, overwrite bool) (imported []uint, skipped []uint, err error) {
+	formatError := func(err error) error {
+		return fmt.Errorf("controller.importtalkgroups: %v", err)
+	}
+
+	groupLabel := func(talkgroup *FleetmapTalkgroup) string {
+		if len(talkgroup.Group) > 0 {
+			return talkgroup.Group
+		}
+		return "Unknown"
+	}
+
+	tagLabel := func(talkgroup *FleetmapTalkgroup) string {
+		if len(talkgroup.Tag) > 0 {
+			return talkgroup.Tag
+		}
+		return "Untagged"
+	}
+
+	var newGroups, newTags bool
+
+	for _, talkgroup := range source {
+		if _, ok := controller.Groups.GetGroup(groupLabel(talkgroup)); !ok {
+			controller.Groups.List = append(controller.Groups.List, &Group{Label: groupLabel(talkgroup)})
+			newGroups = true
+		}
+
+		if _, ok := controller.Tags.GetTag(tagLabel(talkgroup)); !ok {
+			controller.Tags.List = append(controller.Tags.List, &Tag{Label: tagLabel(talkgroup)})
+			newTags = true
+		}
+	}
+
+	if newGroups {
+		if err = controller.Groups.Write(controller.Database); err != nil {
+			return nil, nil, formatError(err)
+		}
+
+		if err = controller.Groups.Read(controller.Database); err != nil {
+			return nil, nil, formatError(err)
+		}
+	}
+
+	if newTags {
+		if err = controller.Tags.Write(controller.Database); err != nil {
+			return nil, nil, formatError(err)
+		}
+
+		if err = controller.Tags.Read(controller.Database); err != nil {
+			return nil, nil, formatError(err)
+		}
+	}
+
+	system, ok := controller.Systems.GetSystem(systemId)
+	if !ok {
+		system = NewSystem()
+		system.Id = systemId
+
+		if len(systemLabel) > 0 {
+			system.Label = systemLabel
+		} else {
+			system.Label = fmt.Sprintf("System %v", systemId)
+		}
+
+		controller.Systems.List = append(controller.Systems.List, system)
+	}
+
+	talkgroups := []*Talkgroup{}
+
+	for _, src := range source {
+		talkgroup := &Talkgroup{
+			Id:    src.Id,
+			Label: src.Label,
+			Name:  src.Name,
+		}
+
+		if len(talkgroup.Label) == 0 {
+			talkgroup.Label = strconv.Itoa(int(src.Id))
+		}
+
+		if len(talkgroup.Name) == 0 {
+			talkgroup.Name = talkgroup.Label
+		}
+
+		if group, ok := controller.Groups.GetGroup(groupLabel(src)); ok {
+			switch v := group.Id.(type) {
+			case uint:
+				talkgroup.GroupId = v
+			}
+		}
+
+		if tag, ok := controller.Tags.GetTag(tagLabel(src)); ok {
+			switch v := tag.Id.(type) {
+			case uint:
+				talkgroup.TagId = v
+			}
+		}
+
+		if talkgroup.GroupId == 0 || talkgroup.TagId == 0 {
+			return nil, nil, formatError(fmt.Errorf("unable to get the group and tag ids of talkgroup %d", src.Id))
+		}
+
+		talkgroups = append(talkgroups, talkgroup)
+	}
+
+	if imported, skipped, err = system.Talkgroups.Merge(talkgroups, overwrite); err != nil {
+		return nil, nil, formatError(err)
+	}
+
+	if err = controller.Systems.Write(controller.Database); err != nil {
+		return nil, nil, formatError(err)
+	}
+
+	if err = controller.Systems.Read(controller.Database); err != nil {
+		return nil, nil, formatError(err)
+	}
+
+	controller.EmitConfig()
+
+	return imported, skipped, nil
+}
+
+// TalkgroupsExportHandler downloads the talkgroups of a system as a
+// Trunk Recorder or RadioReference csv file, or as an SDRTrunk playlist.
+func (admin *Admin) TalkgroupsExportHandler(w http.ResponseWriter, r *http.Request) {
+	if !admin.Authorize(w, r, AdminRoleViewer) {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if len(format) == 0 {
+		format = FLEETMAP_TRUNK_RECORDER
+	}
+
+	id, err := strconv.ParseUint(r.URL.Query().Get("system"), 10, 32)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	system, ok := admin.Controller.Systems.GetSystem(uint(id))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var (
+		b           = bytes.Buffer{}
+		contentType = "text/csv"
+		ext         = "csv"
+	)
+
+	if format == FLEETMAP_SDRTRUNK {
+		contentType = "application/xml"
+		ext = "xml"
+	}
+
+	if err = WriteFleetmap(&b, system, admin.Controller.ExportTalkgroups(system), format); err != nil {
+		admin.Controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("talkgroups export: %v", err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"system-%d-%s.%s\"", system.Id, format, ext))
+	w.Write(b.Bytes())
+}
+
+// TalkgroupsImportHandler imports the talkgroups of a fleetmap file posted
+// as the request body into the system given in the query string, which is
+// created when it doesn't exist. The format is guessed from the content
+// when not given, csv files being read as Trunk Recorder ones.
+func (admin *Admin) TalkgroupsImportHandler(w http.ResponseWriter, r *http.Request) {
+	if !admin.Authorize(w, r, AdminRoleConfigEditor) {
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	controller := admin.Controller
+
+	badRequest := func(err error) {
+		controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("talkgroups import: %v", err))
+		w.WriteHeader(http.StatusBadRequest)
+	}
+
+	query := r.URL.Query()
+
+	id, err := strconv.ParseUint(query.Get("system"), 10, 32)
+	if err != nil || id == 0 {
+		badRequest(fmt.Errorf("invalid system id %s", query.Get("system")))
+		return
+	}
+
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	format := query.Get("format")
+	if len(format) == 0 {
+		format = GetFleetmapFormat(b)
+	}
+
+	talkgroups, err := ParseFleetmap(b, format)
+	if err != nil {
+		badRequest(err)
+		return
+	}
+
+	overwrite, _ := strconv.ParseBool(query.Get("overwrite"))
+
+	admin.mutex.Lock()
+	defer admin.mutex.Unlock()
+
+	imported, skipped, err := controller.ImportTalkgroups(uint(id), query.Get("label"), talkgroups, overwrite)
+	if err != nil {
+		controller.Logs.LogEvent(LogLevelError, err.Error())
+		w.WriteHeader(http.StatusExpectationFailed)
+		return
+	}
+
+	controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("talkgroups import: %d talkgroups imported into system %d from a %s file by admin from ip %s", len(imported), id, format, GetRemoteAddr(r)))
+
+	if _, err := controller.ConfigVersions.Snapshot(admin.author(r), fmt.Sprintf("talkgroups imported into system %d", id)); err != nil {
+		controller.Logs.LogEvent(LogLevelError, err.Error())
+	}
+
+	if b, err := json.Marshal(map[string]any{"imported": imported, "skipped": skipped}); err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	} else {
+		w.WriteHeader(http.StatusExpectationFailed)
+	}
+}
@@ -3,6 +3,7 @@ module rdio-scanner/server
 go 1.18
 
 require (
+	github.com/SherClockHolmes/webpush-go v1.2.0
 	github.com/dhowden/tag v0.0.0-20220618230019-adf36e896086
 	github.com/fsnotify/fsnotify v1.5.4
 	github.com/go-sql-driver/mysql v1.6.0
@@ -10,12 +11,14 @@ require (
 	github.com/google/uuid v1.3.0
 	github.com/gorilla/websocket v1.5.0
 	github.com/kardianos/service v1.2.1
+	github.com/lib/pq v1.10.7
 	golang.org/x/crypto v0.0.0-20220926161630-eccd6366d1be
 	gopkg.in/ini.v1 v1.67.0
 	modernc.org/sqlite v1.19.1
 )
 
 require (
+	github.com/golang-jwt/jwt v3.2.2+incompatible // indirect
 	github.com/kballard/go-shellquote v0.0.0-20180428030007-95032a82bc51 // indirect
 	github.com/mattn/go-isatty v0.0.16 // indirect
 	github.com/remyoudompheng/bigfft v0.0.0-20220927061507-ef77025ab5aa // indirect
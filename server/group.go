@@ -17,9 +17,7 @@ package main
 
 import (
 	"database/sql"
-	"encoding/json"
 	"fmt"
-	"strings"
 	"sync"
 )
 
@@ -252,15 +250,7 @@ func (groups *Groups) Write(db *Database) error {
 	}
 
 	if len(rowIds) > 0 {
-		// Build parameterized IN clause to prevent SQL injection
-		placeholders := make([]string, len(rowIds))
-		args := make([]any, len(rowIds))
-		for i, id := range rowIds {
-			placeholders[i] = "?"
-			args[i] = id
-		}
-		q := fmt.Sprintf("delete from `rdioScannerGroups` where `_id` in (%s)", strings.Join(placeholders, ","))
-		if _, err = db.Sql.Exec(q, args...); err != nil {
+		if _, err = db.Delete("rdioScannerGroups").Where(SqlIn("_id", rowIds)).Exec(); err != nil {
 			return formatError(err)
 		}
 	}
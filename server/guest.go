@@ -0,0 +1,466 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// GuestPass is a temporary access handed out by the admin during an incident,
+// for journalists or officials. Unlike the access codes it is a token given
+// as a link, it is limited to the selected systems and it is revoked by
+// itself when it expires.
+type GuestPass struct {
+	Id        any       `json:"_id"`
+	CreatedAt time.Time `json:"createdAt"`
+	Expires   time.Time `json:"expires"`
+	Ident     string    `json:"ident"`
+	Systems   any       `json:"systems"`
+	Tier      any       `json:"tier"`
+	Token     string    `json:"token"`
+	access    *Access
+}
+
+func (pass *GuestPass) FromMap(m map[string]any) *GuestPass {
+	pass.CreatedAt = time.Now().UTC()
+
+	switch v := m["hours"].(type) {
+	case float64:
+		pass.Expires = pass.CreatedAt.Add(time.Duration(v * float64(time.Hour)))
+	}
+
+	switch v := m["ident"].(type) {
+	case string:
+		pass.Ident = strings.TrimSpace(v)
+	}
+
+	// systems are either given as system ids or as in the access codes
+	switch v := m["systems"].(type) {
+	case []any:
+		systems := []any{}
+		for _, f := range v {
+			switch s := f.(type) {
+			case float64:
+				systems = append(systems, map[string]any{"id": s, "talkgroups": "*"})
+			case map[string]any:
+				systems = append(systems, s)
+			}
+		}
+		pass.Systems = systems
+	}
+
+	switch v := m["tier"].(type) {
+	case string:
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			pass.Tier = v
+		}
+	}
+
+	return pass
+}
+
+// GetAccess returns the access of the listeners using the pass, the same
+// for all of them so that they can be found again when the pass is revoked.
+func (pass *GuestPass) GetAccess() *Access {
+	if pass.access == nil {
+		pass.access = &Access{
+			Expiration: pass.Expires,
+			Ident:      fmt.Sprintf("guest %s", pass.Ident),
+			Systems:    pass.Systems,
+			Tier:       pass.Tier,
+		}
+	}
+
+	return pass.access
+}
+
+func (pass *GuestPass) IsActive() bool {
+	return time.Now().Before(pass.Expires)
+}
+
+type GuestPasses struct {
+	Controller *Controller
+	List       []*GuestPass
+	timers     map[uint]*time.Timer
+	mutex      sync.Mutex
+}
+
+func NewGuestPasses(controller *Controller) *GuestPasses {
+	return &GuestPasses{
+		Controller: controller,
+		List:       []*GuestPass{},
+		timers:     map[uint]*time.Timer{},
+		mutex:      sync.Mutex{},
+	}
+}
+
+func (passes *GuestPasses) Add(pass *GuestPass, db *Database) error {
+	var (
+		b   []byte
+		err error
+		id  int64
+		res sql.Result
+	)
+
+	passes.mutex.Lock()
+	defer passes.mutex.Unlock()
+
+	formatError := func(err error) error {
+		return fmt.Errorf("guestpasses.add: %v", err)
+	}
+
+	if len(pass.Ident) == 0 {
+		return formatError(errors.New("no ident"))
+	}
+
+	switch v := pass.Systems.(type) {
+	case []any:
+		if len(v) == 0 {
+			return formatError(errors.New("no systems"))
+		}
+	default:
+		return formatError(errors.New("no systems"))
+	}
+
+	if !pass.IsActive() {
+		return formatError(errors.New("invalid duration"))
+	}
+
+	if b, err = json.Marshal(pass.Systems); err != nil {
+		return formatError(err)
+	}
+
+	pass.Token = uuid.New().String()
+
+	if res, err = db.Sql.Exec("insert into `rdioScannerGuestPasses` (`createdAt`, `expires`, `ident`, `systems`, `tier`, `token`) values (?, ?, ?, ?, ?, ?)", pass.CreatedAt, pass.Expires, pass.Ident, string(b), pass.Tier, pass.Token); err != nil {
+		return formatError(err)
+	}
+
+	if id, err = res.LastInsertId(); err != nil {
+		return formatError(err)
+	}
+
+	pass.Id = uint(id)
+
+	passes.List = append(passes.List, pass)
+	passes.schedule(pass)
+
+	return nil
+}
+
+func (passes *GuestPasses) GetAccess(token string) (*Access, bool) {
+	passes.mutex.Lock()
+	defer passes.mutex.Unlock()
+
+	for _, pass := range passes.List {
+		if pass.Token == token && pass.IsActive() {
+			return pass.GetAccess(), true
+		}
+	}
+
+	return nil, false
+}
+
+func (passes *GuestPasses) GetActive() []*GuestPass {
+	passes.mutex.Lock()
+	defer passes.mutex.Unlock()
+
+	l := []*GuestPass{}
+
+	for _, pass := range passes.List {
+		if pass.IsActive() {
+			l = append(l, pass)
+		}
+	}
+
+	return l
+}
+
+// IsGuest tells whether the access is the one of a guest pass.
+func (passes *GuestPasses) IsGuest(access *Access) bool {
+	passes.mutex.Lock()
+	defer passes.mutex.Unlock()
+
+	for _, pass := range passes.List {
+		if pass.access != nil && pass.access == access {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (passes *GuestPasses) Read(db *Database) error {
+	var (
+		createdAt any
+		err       error
+		expires   any
+		expired   = []*GuestPass{}
+		id        sql.NullFloat64
+		rows      *sql.Rows
+		systems   string
+		tier      sql.NullString
+	)
+
+	passes.mutex.Lock()
+	defer passes.mutex.Unlock()
+
+	for _, timer := range passes.timers {
+		timer.Stop()
+	}
+
+	previous := passes.List
+
+	passes.List = []*GuestPass{}
+	passes.timers = map[uint]*time.Timer{}
+
+	formatError := func(err error) error {
+		return fmt.Errorf("guestpasses.read: %v", err)
+	}
+
+	if rows, err = db.Sql.Query("select `_id`, `createdAt`, `expires`, `ident`, `systems`, `tier`, `token` from `rdioScannerGuestPasses`"); err != nil {
+		return formatError(err)
+	}
+
+	for rows.Next() {
+		pass := &GuestPass{}
+
+		if err = rows.Scan(&id, &createdAt, &expires, &pass.Ident, &systems, &tier, &pass.Token); err != nil {
+			break
+		}
+
+		if id.Valid && id.Float64 > 0 {
+			pass.Id = uint(id.Float64)
+		}
+
+		if t, err := db.ParseDateTime(createdAt); err == nil {
+			pass.CreatedAt = t
+		}
+
+		if t, err := db.ParseDateTime(expires); err == nil {
+			pass.Expires = t
+		}
+
+		if err = json.Unmarshal([]byte(systems), &pass.Systems); err != nil {
+			pass.Systems = []any{}
+			err = nil
+		}
+
+		if tier.Valid && len(tier.String) > 0 {
+			pass.Tier = tier.String
+		}
+
+		// the listeners connected with the pass keep their access on reload
+		for _, p := range previous {
+			if p.Token == pass.Token {
+				pass.access = p.access
+			}
+		}
+
+		if pass.IsActive() {
+			passes.List = append(passes.List, pass)
+		} else {
+			expired = append(expired, pass)
+		}
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	for _, pass := range passes.List {
+		passes.schedule(pass)
+	}
+
+	for _, pass := range expired {
+		if _, err = db.Sql.Exec("delete from `rdioScannerGuestPasses` where `_id` = ?", pass.Id); err != nil {
+			return formatError(err)
+		}
+
+		passes.revoke(pass, "expired")
+	}
+
+	return nil
+}
+
+func (passes *GuestPasses) Revoke(id uint, db *Database) (*GuestPass, error) {
+	passes.mutex.Lock()
+	defer passes.mutex.Unlock()
+
+	return passes.remove(id, db)
+}
+
+func (passes *GuestPasses) remove(id uint, db *Database) (*GuestPass, error) {
+	for i, pass := range passes.List {
+		if pass.Id != id {
+			continue
+		}
+
+		if _, err := db.Sql.Exec("delete from `rdioScannerGuestPasses` where `_id` = ?", id); err != nil {
+			return nil, fmt.Errorf("guestpasses.remove: %v", err)
+		}
+
+		if timer, ok := passes.timers[id]; ok {
+			timer.Stop()
+			delete(passes.timers, id)
+		}
+
+		passes.List = append(passes.List[:i], passes.List[i+1:]...)
+
+		return pass, nil
+	}
+
+	return nil, nil
+}
+
+// revoke disconnects the listeners of the pass.
+func (passes *GuestPasses) revoke(pass *GuestPass, reason string) {
+	count := 0
+
+	if pass.access != nil {
+		count = passes.Controller.Clients.Revoke(pass.access)
+	}
+
+	passes.Controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("guest pass: %s %s, %d listener(s) disconnected", pass.Ident, reason, count))
+}
+
+func (passes *GuestPasses) schedule(pass *GuestPass) {
+	id, ok := pass.Id.(uint)
+	if !ok {
+		return
+	}
+
+	passes.timers[id] = time.AfterFunc(time.Until(pass.Expires), func() {
+		passes.mutex.Lock()
+		defer passes.mutex.Unlock()
+
+		delete(passes.timers, id)
+
+		if p, err := passes.remove(id, passes.Controller.Database); err != nil {
+			passes.Controller.Logs.LogEvent(LogLevelError, err.Error())
+		} else if p != nil {
+			passes.revoke(p, "expired")
+		}
+	})
+}
+
+func (admin *Admin) GuestPassesHandler(w http.ResponseWriter, r *http.Request) {
+	if !admin.Authorize(w, r, adminWriteRole(r)) {
+		return
+	}
+
+	passes := admin.Controller.GuestPasses
+	logs := admin.Controller.Logs
+
+	switch r.Method {
+	case http.MethodDelete:
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil || id < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		pass, err := passes.Revoke(uint(id), admin.Controller.Database)
+		if err != nil {
+			logs.LogEvent(LogLevelError, err.Error())
+			w.WriteHeader(http.StatusExpectationFailed)
+			return
+		}
+
+		if pass == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		passes.revoke(pass, fmt.Sprintf("revoked by admin from ip %s", GetRemoteAddr(r)))
+
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodGet:
+		if b, err := json.Marshal(passes.GetActive()); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+
+	case http.MethodPost:
+		m := map[string]any{}
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		pass := (&GuestPass{}).FromMap(m)
+
+		if err := passes.Add(pass, admin.Controller.Database); err != nil {
+			logs.LogEvent(LogLevelWarn, err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		logs.LogEvent(LogLevelWarn, fmt.Sprintf("guest pass: %s issued until %v by admin from ip %s", pass.Ident, pass.Expires.Format(time.RFC3339), GetRemoteAddr(r)))
+
+		if b, err := json.Marshal(map[string]any{
+			"pass": pass,
+			"url":  fmt.Sprintf("%s/api/guest?token=%s", requestBaseUrl(r), pass.Token),
+		}); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// GuestHandler is the link given with a guest pass. It saves the token as
+// the access code of the webapp, which then authenticates with it.
+func (passes *GuestPasses) GuestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+
+	if _, ok := passes.GetAccess(token); !ok {
+		passes.Controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("guest pass: invalid or expired token from ip %s", GetRemoteAddr(r)))
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	b, _ := json.Marshal(base64.StdEncoding.EncodeToString([]byte(token)))
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<!DOCTYPE html><html><head><meta charset=\"utf-8\"></head><body><script>localStorage.setItem('rdio-scanner-pin',%s);location.replace('../');</script></body></html>", b)
+}
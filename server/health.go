@@ -0,0 +1,299 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	HealthStatusDegraded = "degraded"
+	HealthStatusDisabled = "disabled"
+	HealthStatusDown     = "down"
+	HealthStatusFailing  = "failing"
+	HealthStatusMissing  = "missing"
+	HealthStatusOk       = "ok"
+	HealthStatusStopped  = "stopped"
+	HealthStatusUnknown  = "unknown"
+)
+
+const (
+	healthDatabaseTimeout = 2 * time.Second
+
+	// the ingest queue filled over this ratio turns the server not ready,
+	// so that the uploads go to another instance
+	healthIngestSaturation = 0.9
+)
+
+type HealthDatabase struct {
+	Error   string  `json:"error,omitempty"`
+	Latency float64 `json:"latencyMs"`
+	Status  string  `json:"status"`
+}
+
+type HealthDirwatch struct {
+	Id        any    `json:"_id"`
+	Directory string `json:"directory,omitempty"`
+	Status    string `json:"status"`
+}
+
+type HealthDownstream struct {
+	Id          any        `json:"_id"`
+	Error       string     `json:"error,omitempty"`
+	LastFailure *time.Time `json:"lastFailure,omitempty"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	Status      string     `json:"status"`
+	Url         string     `json:"url,omitempty"`
+}
+
+type HealthIngest struct {
+	Capacity int    `json:"capacity"`
+	Pending  int    `json:"pending"`
+	Queued   int    `json:"queued"`
+	Status   string `json:"status"`
+}
+
+type HealthReplication struct {
+	Connected bool   `json:"connected"`
+	Lag       uint   `json:"lag"`
+	Mode      string `json:"mode"`
+	Standbys  int    `json:"standbys"`
+}
+
+// HealthReport is the state of the server and of what it depends on. Its
+// status is down when it can't take calls, a standby included, and degraded
+// when a dirwatch or a downstream is failing.
+type HealthReport struct {
+	Database    *HealthDatabase     `json:"database"`
+	Dirwatches  []*HealthDirwatch   `json:"dirwatches,omitempty"`
+	Downstreams []*HealthDownstream `json:"downstreams,omitempty"`
+	Ingest      *HealthIngest       `json:"ingest,omitempty"`
+	Replication *HealthReplication  `json:"replication,omitempty"`
+	Status      string              `json:"status"`
+	Version     string              `json:"version,omitempty"`
+}
+
+// Health answers the probes of the container orchestrators and of the
+// uptime monitors. The directories, the urls and the errors are only
+// reported to the admins, the probes being unauthenticated.
+type Health struct {
+	Controller *Controller
+}
+
+func NewHealth(controller *Controller) *Health {
+	return &Health{Controller: controller}
+}
+
+// Database pings the database.
+func (health *Health) Database(ctx context.Context, detailed bool) *HealthDatabase {
+	ctx, cancel := context.WithTimeout(ctx, healthDatabaseTimeout)
+	defer cancel()
+
+	t := time.Now()
+	err := health.Controller.Database.Sql.PingContext(ctx)
+
+	check := &HealthDatabase{Latency: float64(time.Since(t).Microseconds()) / 1000, Status: HealthStatusOk}
+
+	if err != nil {
+		check.Status = HealthStatusDown
+		if detailed {
+			check.Error = err.Error()
+		}
+	}
+
+	return check
+}
+
+// Readiness returns the state of the database, of the dirwatches, of the
+// downstreams and of the ingest queue.
+func (health *Health) Readiness(ctx context.Context, detailed bool) *HealthReport {
+	var (
+		controller = health.Controller
+		report     = &HealthReport{
+			Database:    health.Database(ctx, detailed),
+			Dirwatches:  []*HealthDirwatch{},
+			Downstreams: []*HealthDownstream{},
+			Status:      HealthStatusOk,
+		}
+	)
+
+	degrade := func(status string) {
+		if report.Status == HealthStatusOk {
+			report.Status = status
+		}
+	}
+
+	if detailed {
+		report.Version = Version
+	}
+
+	if report.Database.Status != HealthStatusOk {
+		report.Status = HealthStatusDown
+	}
+
+	controller.Dirwatches.mutex.Lock()
+	dirwatches := append([]*Dirwatch{}, controller.Dirwatches.List...)
+	controller.Dirwatches.mutex.Unlock()
+
+	for _, dirwatch := range dirwatches {
+		check := &HealthDirwatch{Id: dirwatch.Id, Status: HealthStatusOk}
+
+		if detailed {
+			check.Directory = dirwatch.Directory
+		}
+
+		if dirwatch.Disabled {
+			check.Status = HealthStatusDisabled
+		} else if fi, err := os.Stat(dirwatch.Directory); err != nil || !fi.IsDir() {
+			check.Status = HealthStatusMissing
+			degrade(HealthStatusDegraded)
+		} else if dirwatch.watcher == nil {
+			check.Status = HealthStatusStopped
+			degrade(HealthStatusDegraded)
+		}
+
+		report.Dirwatches = append(report.Dirwatches, check)
+	}
+
+	controller.Downstreams.mutex.Lock()
+	downstreams := append([]*Downstream{}, controller.Downstreams.List...)
+	controller.Downstreams.mutex.Unlock()
+
+	for _, downstream := range downstreams {
+		var (
+			check  = &HealthDownstream{Id: downstream.Id, Status: HealthStatusUnknown}
+			status = downstream.Status()
+		)
+
+		if detailed {
+			check.Url = downstream.Url
+		}
+
+		if !status.LastFailure.IsZero() {
+			check.LastFailure = &status.LastFailure
+		}
+
+		if !status.LastSuccess.IsZero() {
+			check.LastSuccess = &status.LastSuccess
+		}
+
+		switch {
+		case downstream.Disabled:
+			check.Status = HealthStatusDisabled
+		case status.LastFailure.After(status.LastSuccess):
+			check.Status = HealthStatusFailing
+			if detailed {
+				check.Error = status.LastError
+			}
+			degrade(HealthStatusDegraded)
+		case !status.LastSuccess.IsZero():
+			check.Status = HealthStatusOk
+		}
+
+		report.Downstreams = append(report.Downstreams, check)
+	}
+
+	report.Ingest = &HealthIngest{
+		Capacity: cap(controller.Ingest),
+		Pending:  controller.Pipeline.Pending(),
+		Queued:   len(controller.Ingest),
+		Status:   HealthStatusOk,
+	}
+
+	if report.Ingest.Capacity > 0 && float64(report.Ingest.Queued) >= healthIngestSaturation*float64(report.Ingest.Capacity) {
+		report.Ingest.Status = HealthStatusDown
+		report.Status = HealthStatusDown
+	}
+
+	if len(controller.Config.ReplicationKey) > 0 {
+		status := controller.Replication.Status()
+
+		report.Replication = &HealthReplication{
+			Connected: status.Connected,
+			Lag:       status.Lag,
+			Mode:      status.Mode,
+			Standbys:  status.Standbys,
+		}
+
+		// the uploads are refused until the standby is promoted
+		if status.Mode == ReplicationModeStandby {
+			report.Status = HealthStatusDown
+		}
+	}
+
+	return report
+}
+
+// HealthzHandler is the liveness probe, which fails when the database
+// doesn't answer.
+func (health *Health) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	database := health.Database(r.Context(), health.detailed(r))
+
+	report := &HealthReport{Database: database, Status: database.Status}
+
+	health.write(w, r, report)
+}
+
+// ReadyzHandler is the readiness probe, which fails when the server can't
+// take calls and reports the state of what it depends on.
+func (health *Health) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	health.write(w, r, health.Readiness(r.Context(), health.detailed(r)))
+}
+
+// detailed tells if the request bears the token of an admin.
+func (health *Health) detailed(r *http.Request) bool {
+	admin := health.Controller.Admin
+
+	user, ok := admin.GetTokenUser(admin.GetAuthorization(r))
+
+	return ok && user.HasRole(AdminRoleViewer)
+}
+
+func (health *Health) write(w http.ResponseWriter, r *http.Request, report *HealthReport) {
+	status := http.StatusOK
+	if report.Status == HealthStatusDown {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+
+	if b, err := json.Marshal(report); err == nil {
+		w.WriteHeader(status)
+		w.Write(b)
+	} else {
+		w.WriteHeader(http.StatusExpectationFailed)
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestHealthReadyz(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func(t *testing.T, controller *Controller)
+		detailed bool
+		status   int
+		want     func(report *HealthReport) bool
+	}{
+		{
+			name:   "nothing to watch",
+			status: http.StatusOK,
+			want: func(report *HealthReport) bool {
+				return report.Status == HealthStatusOk && report.Database.Status == HealthStatusOk && report.Ingest.Capacity > 0 && len(report.Version) == 0
+			},
+		},
+		{
+			name: "disabled dirwatch",
+			setup: func(t *testing.T, controller *Controller) {
+				controller.Dirwatches.List = []*Dirwatch{{Id: uint(1), Directory: "/nonexistent", Disabled: true}}
+			},
+			status: http.StatusOK,
+			want: func(report *HealthReport) bool {
+				return report.Status == HealthStatusOk && report.Dirwatches[0].Status == HealthStatusDisabled
+			},
+		},
+		{
+			name: "missing directory",
+			setup: func(t *testing.T, controller *Controller) {
+				controller.Dirwatches.List = []*Dirwatch{{Id: uint(1), Directory: filepath.Join(t.TempDir(), "gone")}}
+			},
+			status: http.StatusOK,
+			want: func(report *HealthReport) bool {
+				return report.Status == HealthStatusDegraded && report.Dirwatches[0].Status == HealthStatusMissing && len(report.Dirwatches[0].Directory) == 0
+			},
+		},
+		{
+			name: "stopped dirwatch",
+			setup: func(t *testing.T, controller *Controller) {
+				controller.Dirwatches.List = []*Dirwatch{{Id: uint(1), Directory: t.TempDir()}}
+			},
+			detailed: true,
+			status:   http.StatusOK,
+			want: func(report *HealthReport) bool {
+				return report.Status == HealthStatusDegraded && report.Dirwatches[0].Status == HealthStatusStopped && len(report.Dirwatches[0].Directory) > 0
+			},
+		},
+		{
+			name: "failing downstream",
+			setup: func(t *testing.T, controller *Controller) {
+				downstream := &Downstream{Id: uint(1), Url: "https://downstream.example"}
+				downstream.setStatus(nil)
+				downstream.setStatus(errors.New("connection refused"))
+				controller.Downstreams.List = []*Downstream{downstream, {Id: uint(2), Url: "https://other.example"}}
+			},
+			status: http.StatusOK,
+			want: func(report *HealthReport) bool {
+				failing, unknown := report.Downstreams[0], report.Downstreams[1]
+				return report.Status == HealthStatusDegraded && failing.Status == HealthStatusFailing && len(failing.Error) == 0 && len(failing.Url) == 0 && failing.LastSuccess != nil && unknown.Status == HealthStatusUnknown
+			},
+		},
+		{
+			name: "failing downstream to an admin",
+			setup: func(t *testing.T, controller *Controller) {
+				downstream := &Downstream{Id: uint(1), Url: "https://downstream.example"}
+				downstream.setStatus(errors.New("connection refused"))
+				controller.Downstreams.List = []*Downstream{downstream}
+			},
+			detailed: true,
+			status:   http.StatusOK,
+			want: func(report *HealthReport) bool {
+				return report.Downstreams[0].Error == "connection refused" && report.Downstreams[0].Url == "https://downstream.example" && report.Version == Version
+			},
+		},
+		{
+			name: "saturated ingest queue",
+			setup: func(t *testing.T, controller *Controller) {
+				for len(controller.Ingest) < cap(controller.Ingest) {
+					controller.Ingest <- &Call{}
+				}
+			},
+			status: http.StatusServiceUnavailable,
+			want: func(report *HealthReport) bool {
+				return report.Status == HealthStatusDown && report.Ingest.Status == HealthStatusDown && report.Ingest.Queued == report.Ingest.Capacity
+			},
+		},
+		{
+			name: "database gone",
+			setup: func(t *testing.T, controller *Controller) {
+				controller.Database.Sql.Close()
+			},
+			status: http.StatusServiceUnavailable,
+			want: func(report *HealthReport) bool {
+				return report.Status == HealthStatusDown && report.Database.Status == HealthStatusDown && len(report.Database.Error) == 0
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			controller := newTestDigests(t)
+
+			token, err := controller.Admin.NewOidcToken("someone", AdminRoleViewer)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.setup != nil {
+				test.setup(t, controller)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+			if test.detailed {
+				r.Header.Set("Authorization", token)
+			}
+
+			w := httptest.NewRecorder()
+			controller.Health.ReadyzHandler(w, r)
+
+			if w.Code != test.status {
+				t.Errorf("status %d, want %d", w.Code, test.status)
+			}
+
+			report := &HealthReport{}
+			if err := json.Unmarshal(w.Body.Bytes(), report); err != nil {
+				t.Fatal(err)
+			}
+			if !test.want(report) {
+				t.Errorf("report %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestHealthHealthz(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		close  bool
+		status int
+	}{
+		{"up", http.MethodGet, false, http.StatusOK},
+		{"head", http.MethodHead, false, http.StatusOK},
+		{"post", http.MethodPost, false, http.StatusMethodNotAllowed},
+		{"database gone", http.MethodGet, true, http.StatusServiceUnavailable},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			controller := newTestDigests(t)
+
+			// a missing dirwatch doesn't fail the liveness
+			controller.Dirwatches.List = []*Dirwatch{{Id: uint(1), Directory: filepath.Join(t.TempDir(), "gone")}}
+
+			if test.close {
+				controller.Database.Sql.Close()
+			}
+
+			r := httptest.NewRequest(test.method, "/healthz", nil)
+			w := httptest.NewRecorder()
+			controller.Health.HealthzHandler(w, r)
+
+			if w.Code != test.status {
+				t.Errorf("status %d, want %d", w.Code, test.status)
+			}
+		})
+	}
+}
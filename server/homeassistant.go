@@ -0,0 +1,205 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const homeAssistantManufacturer = "Rdio Scanner"
+
+// homeAssistantTalkgroup is a talkgroup announced to home assistant.
+type homeAssistantTalkgroup struct {
+	system      uint
+	systemLabel string
+	talkgroup   uint
+	label       string
+	name        string
+}
+
+// mqttMessage is a message of the home assistant integration.
+type mqttMessage struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+// homeAssistantTopic returns the base topic of the talkgroup, under which
+// its state and its events are published. The subject gets the system and
+// the talkgroup appended when it doesn't hold their placeholders, each
+// talkgroup needing its own topics.
+func (publisher *Publisher) homeAssistantTopic(system uint, talkgroup uint) string {
+	subject := publisher.Subject
+
+	if !strings.Contains(subject, "{system}") || !strings.Contains(subject, "{talkgroup}") {
+		subject = strings.TrimSuffix(subject, "/") + "/{system}/{talkgroup}"
+	}
+
+	return publisher.subject(system, talkgroup, subject)
+}
+
+// homeAssistantTalkgroups returns the talkgroups of the systems the
+// publisher publishes, once for all of their sites.
+func (publisher *Publisher) homeAssistantTalkgroups(systems *Systems) []homeAssistantTalkgroup {
+	list := []homeAssistantTalkgroup{}
+
+	if systems == nil {
+		return list
+	}
+
+	systems.mutex.Lock()
+	defer systems.mutex.Unlock()
+
+	for _, system := range systems.List {
+		seen := map[uint]bool{}
+
+		system.Talkgroups.mutex.Lock()
+		for _, talkgroup := range system.Talkgroups.List {
+			if seen[talkgroup.Id] || !publisher.HasAccess(&Call{System: system.Id, Talkgroup: talkgroup.Id}) {
+				continue
+			}
+			seen[talkgroup.Id] = true
+
+			list = append(list, homeAssistantTalkgroup{
+				system:      system.Id,
+				systemLabel: system.Label,
+				talkgroup:   talkgroup.Id,
+				label:       talkgroup.Label,
+				name:        talkgroup.Name,
+			})
+		}
+		system.Talkgroups.mutex.Unlock()
+	}
+
+	return list
+}
+
+// homeAssistantDiscovery returns the retained configs through which home
+// assistant discovers the talkgroup as a device, with the sensors of its last
+// call, its last unit and its calls count, and the event of its calls.
+func (publisher *Publisher) homeAssistantDiscovery(talkgroup homeAssistantTalkgroup) ([]mqttMessage, error) {
+	prefix := strings.TrimSuffix(publisher.Discovery, "/")
+
+	base := publisher.homeAssistantTopic(talkgroup.system, talkgroup.talkgroup)
+	node := fmt.Sprintf("rdio_scanner_%d_%d", talkgroup.system, talkgroup.talkgroup)
+
+	name := talkgroup.name
+	if len(name) == 0 {
+		name = talkgroup.label
+	}
+	if len(name) == 0 {
+		name = fmt.Sprintf("Talkgroup %d", talkgroup.talkgroup)
+	}
+
+	device := map[string]any{
+		"identifiers":  []string{node},
+		"manufacturer": homeAssistantManufacturer,
+		"model":        fmt.Sprintf("%s talkgroup %d", talkgroup.systemLabel, talkgroup.talkgroup),
+		"name":         name,
+		"sw_version":   Version,
+	}
+
+	entities := []struct {
+		component string
+		object    string
+		config    map[string]any
+	}{
+		{"sensor", "last_call", map[string]any{
+			"device_class":   "timestamp",
+			"name":           "Last call",
+			"state_topic":    base + "/state",
+			"value_template": "{{ value_json.dateTime }}",
+		}},
+		{"sensor", "last_unit", map[string]any{
+			"icon":           "mdi:radio-handheld",
+			"name":           "Last unit",
+			"state_topic":    base + "/state",
+			"value_template": "{{ value_json.unit }}",
+		}},
+		{"sensor", "calls", map[string]any{
+			"icon":                "mdi:counter",
+			"name":                "Calls",
+			"state_class":         "total_increasing",
+			"state_topic":         base + "/state",
+			"unit_of_measurement": "calls",
+			"value_template":      "{{ value_json.calls }}",
+		}},
+		{"event", "call", map[string]any{
+			"event_types": []string{"call"},
+			"name":        "Call",
+			"state_topic": base + "/event",
+		}},
+	}
+
+	messages := []mqttMessage{}
+
+	for _, entity := range entities {
+		entity.config["device"] = device
+		entity.config["unique_id"] = fmt.Sprintf("%s_%s", node, entity.object)
+
+		b, err := json.Marshal(entity.config)
+		if err != nil {
+			return nil, err
+		}
+
+		messages = append(messages, mqttMessage{
+			topic:   fmt.Sprintf("%s/%s/%s/%s/config", prefix, entity.component, node, entity.object),
+			payload: b,
+			retain:  true,
+		})
+	}
+
+	return messages, nil
+}
+
+// homeAssistantCall returns the retained state of the talkgroup after the
+// call, the count of its calls included, and the event of the call, which
+// is not retained for home assistant not to fire it again on restart.
+func (publisher *Publisher) homeAssistantCall(call *Call, calls uint, systems *Systems) ([]mqttMessage, error) {
+	base := publisher.homeAssistantTopic(call.System, call.Talkgroup)
+
+	unit := publisherUnit(call, systems)
+
+	state, err := json.Marshal(map[string]any{
+		"calls":    calls,
+		"dateTime": call.DateTime.UTC().Format(time.RFC3339),
+		"id":       call.Id,
+		"source":   call.Source,
+		"unit":     unit,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	event, err := json.Marshal(map[string]any{
+		"duration":   call.Duration.Seconds(),
+		"event_type": "call",
+		"id":         call.Id,
+		"source":     call.Source,
+		"unit":       unit,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return []mqttMessage{
+		{topic: base + "/state", payload: state, retain: true},
+		{topic: base + "/event", payload: event},
+	}, nil
+}
@@ -0,0 +1,264 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestHomeAssistantSystems returns a system whose talkgroup 2 is defined
+// for two sites.
+func newTestHomeAssistantSystems() *Systems {
+	systems := NewSystems()
+
+	system := NewSystem()
+	system.Id = 1
+	system.Label = "County"
+	system.Talkgroups.List = []*Talkgroup{
+		{Id: 2, Label: "Fire", Name: "Fire Dispatch", Site: 1},
+		{Id: 2, Label: "Fire", Name: "Fire Dispatch", Site: 2},
+		{Id: 3, Label: "EMS"},
+	}
+	system.Units.List = []*Unit{{Id: 1234, Label: "Engine 5"}}
+
+	other := NewSystem()
+	other.Id = 9
+	other.Talkgroups.List = []*Talkgroup{{Id: 1}}
+
+	systems.List = []*System{system, other}
+
+	return systems
+}
+
+func TestHomeAssistantTopic(t *testing.T) {
+	tests := []struct {
+		subject string
+		want    string
+	}{
+		{"rdio/{system}/{talkgroup}", "rdio/1/2"},
+		{"scanner/{talkgroup}/{system}", "scanner/2/1"},
+		{"rdio/calls", "rdio/calls/1/2"},
+		{"rdio/calls/", "rdio/calls/1/2"},
+		{"rdio/{system}", "rdio/1/1/2"},
+	}
+
+	for _, test := range tests {
+		if got := (&Publisher{Subject: test.subject}).homeAssistantTopic(1, 2); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.subject, got, test.want)
+		}
+	}
+}
+
+func TestHomeAssistantTalkgroups(t *testing.T) {
+	publisher := &Publisher{Systems: []any{map[string]any{"id": float64(1), "talkgroups": "*"}}}
+
+	got := publisher.homeAssistantTalkgroups(newTestHomeAssistantSystems())
+
+	if len(got) != 2 || got[0].talkgroup != 2 || got[1].talkgroup != 3 {
+		t.Fatalf("got %+v, want the talkgroups 2 and 3 once", got)
+	}
+
+	if got[0].name != "Fire Dispatch" || got[0].systemLabel != "County" {
+		t.Errorf("got %+v", got[0])
+	}
+}
+
+func TestHomeAssistantDiscovery(t *testing.T) {
+	tests := []struct {
+		talkgroup homeAssistantTalkgroup
+		device    string
+	}{
+		{homeAssistantTalkgroup{system: 1, systemLabel: "County", talkgroup: 2, label: "Fire", name: "Fire Dispatch"}, "Fire Dispatch"},
+		{homeAssistantTalkgroup{system: 1, talkgroup: 3, label: "EMS"}, "EMS"},
+		{homeAssistantTalkgroup{system: 1, talkgroup: 4}, "Talkgroup 4"},
+	}
+
+	publisher := &Publisher{Discovery: "homeassistant/", Subject: "rdio/{system}/{talkgroup}"}
+
+	for _, test := range tests {
+		messages, err := publisher.homeAssistantDiscovery(test.talkgroup)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		node := fmt.Sprintf("rdio_scanner_1_%d", test.talkgroup.talkgroup)
+
+		topics := []string{}
+		for _, message := range messages {
+			topics = append(topics, message.topic)
+
+			if !message.retain {
+				t.Errorf("%s not retained", message.topic)
+			}
+
+			config := map[string]any{}
+			if err := json.Unmarshal(message.payload, &config); err != nil {
+				t.Fatal(err)
+			}
+
+			device, _ := config["device"].(map[string]any)
+			if device["name"] != test.device {
+				t.Errorf("%s: device %v, want %s", message.topic, device["name"], test.device)
+			}
+
+			object := path.Base(path.Dir(message.topic))
+			if config["unique_id"] != node+"_"+object {
+				t.Errorf("%s: unique id %v", message.topic, config["unique_id"])
+			}
+
+			if topic, _ := config["state_topic"].(string); !strings.HasPrefix(topic, "rdio/1/") {
+				t.Errorf("%s: state topic %v", message.topic, config["state_topic"])
+			}
+		}
+
+		want := []string{
+			"homeassistant/sensor/" + node + "/last_call/config",
+			"homeassistant/sensor/" + node + "/last_unit/config",
+			"homeassistant/sensor/" + node + "/calls/config",
+			"homeassistant/event/" + node + "/call/config",
+		}
+		if strings.Join(topics, ",") != strings.Join(want, ",") {
+			t.Errorf("got topics %v, want %v", topics, want)
+		}
+	}
+}
+
+func TestHomeAssistantCall(t *testing.T) {
+	tests := []struct {
+		source any
+		unit   string
+	}{
+		{uint(1234), "Engine 5"},
+		{int(5678), "5678"},
+		{nil, ""},
+	}
+
+	publisher := &Publisher{Subject: "rdio/{system}/{talkgroup}"}
+
+	for _, test := range tests {
+		call := &Call{DateTime: time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC), Id: 7, Source: test.source, System: 1, Talkgroup: 2}
+
+		messages, err := publisher.homeAssistantCall(call, 3, newTestHomeAssistantSystems())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(messages) != 2 || messages[0].topic != "rdio/1/2/state" || !messages[0].retain || messages[1].topic != "rdio/1/2/event" || messages[1].retain {
+			t.Fatalf("got %+v", messages)
+		}
+
+		state := map[string]any{}
+		json.Unmarshal(messages[0].payload, &state)
+		if state["unit"] != test.unit || state["calls"] != float64(3) || state["dateTime"] != "2026-10-14T12:00:00Z" {
+			t.Errorf("%v: state %v", test.source, state)
+		}
+
+		event := map[string]any{}
+		json.Unmarshal(messages[1].payload, &event)
+		if event["event_type"] != "call" || event["unit"] != test.unit {
+			t.Errorf("%v: event %v", test.source, event)
+		}
+	}
+}
+
+func TestPublisherMqttHomeAssistant(t *testing.T) {
+	broker := newMqttFakeBroker(t, 0, 0)
+
+	publisher := &Publisher{
+		Brokers:   broker.listener.Addr().String(),
+		Discovery: "homeassistant",
+		Subject:   "rdio/{system}/{talkgroup}",
+		Systems:   []any{map[string]any{"id": float64(1), "talkgroups": "*"}},
+		Type:      PublisherTypeMqtt,
+		systems:   newTestHomeAssistantSystems(),
+	}
+	defer publisher.close()
+
+	drain := func(c chan string) []string {
+		list := []string{}
+		for {
+			select {
+			case s := <-c:
+				list = append(list, strings.Fields(s)[0])
+			default:
+				return list
+			}
+		}
+	}
+
+	tests := []struct {
+		call      *Call
+		published int
+		retained  int
+		calls     float64
+	}{
+		// the event, the configs of the talkgroups 2 and 3, the state and
+		// the event of the call
+		{&Call{DateTime: time.Now(), Id: 1, System: 1, Talkgroup: 2}, 1 + 8 + 2, 8 + 1, 1},
+		{&Call{DateTime: time.Now(), Id: 2, System: 1, Talkgroup: 2}, 1 + 2, 1, 2},
+		// a talkgroup unknown at connection
+		{&Call{DateTime: time.Now(), Id: 3, System: 1, Talkgroup: 4}, 1 + 4 + 2, 4 + 1, 1},
+	}
+
+	for _, test := range tests {
+		if err := publisher.Publish(test.call, "event"); err != nil {
+			t.Fatal(err)
+		}
+
+		published := []string{}
+		state := map[string]any{}
+
+		for len(published) < test.published {
+			select {
+			case s := <-broker.published:
+				topic, payload, _ := strings.Cut(s, " ")
+				published = append(published, topic)
+				if strings.HasSuffix(topic, "/state") {
+					json.Unmarshal([]byte(payload), &state)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("call %d: published %v", test.call.Id, published)
+			}
+		}
+
+		if retained := drain(broker.retained); len(retained) != test.retained {
+			t.Errorf("call %d: retained %v", test.call.Id, retained)
+		}
+
+		if state["calls"] != test.calls {
+			t.Errorf("call %d: state %v, want %v calls", test.call.Id, state, test.calls)
+		}
+	}
+
+	if err := publisher.PublishTranscript(tests[0].call, "engine 5 respond", "event"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.Fields(<-broker.published)[0]; got != "rdio/1/2" {
+		t.Errorf("transcript published to %s", got)
+	}
+
+	select {
+	case s := <-broker.published:
+		t.Errorf("transcript updated the state, published %s", s)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,470 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Incident struct {
+	Id         any        `json:"_id"`
+	Calls      []uint     `json:"calls"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	Expires    *time.Time `json:"expires,omitempty"`
+	Label      string     `json:"label"`
+	System     uint       `json:"system"`
+	Talkgroups []uint     `json:"talkgroups"`
+}
+
+func (incident *Incident) FromMap(m map[string]any) *Incident {
+	incident.CreatedAt = time.Now().UTC()
+
+	switch v := m["calls"].(type) {
+	case []any:
+		incident.Calls = []uint{}
+		for _, f := range v {
+			switch id := f.(type) {
+			case float64:
+				incident.Calls = append(incident.Calls, uint(id))
+			}
+		}
+	}
+
+	switch v := m["duration"].(type) {
+	case float64:
+		if v > 0 {
+			expires := incident.CreatedAt.Add(time.Duration(v * float64(time.Minute)))
+			incident.Expires = &expires
+		}
+	}
+
+	switch v := m["label"].(type) {
+	case string:
+		incident.Label = strings.TrimSpace(v)
+	}
+
+	switch v := m["system"].(type) {
+	case float64:
+		incident.System = uint(v)
+	}
+
+	switch v := m["talkgroups"].(type) {
+	case []any:
+		incident.Talkgroups = []uint{}
+		for _, f := range v {
+			switch tg := f.(type) {
+			case float64:
+				incident.Talkgroups = append(incident.Talkgroups, uint(tg))
+			}
+		}
+	}
+
+	if incident.Calls == nil {
+		incident.Calls = []uint{}
+	}
+
+	return incident
+}
+
+// IsActive tells if the incident is still pinned, the incidents without an
+// expiry staying pinned until unpinned.
+func (incident *Incident) IsActive() bool {
+	return incident.Expires == nil || time.Now().Before(*incident.Expires)
+}
+
+// ScopedFor returns the incident as sent to the listener, with only the
+// talkgroups the listener has access to, or nil when there is none left.
+func (incident *Incident) ScopedFor(client *Client, restricted bool) map[string]any {
+	talkgroups := []uint{}
+
+	for _, tg := range incident.Talkgroups {
+		if !restricted || client.GetAccess().HasAccess(&Call{System: incident.System, Talkgroup: tg}) {
+			talkgroups = append(talkgroups, tg)
+		}
+	}
+
+	if len(talkgroups) == 0 {
+		return nil
+	}
+
+	m := map[string]any{
+		"id":         incident.Id,
+		"calls":      incident.Calls,
+		"createdAt":  incident.CreatedAt.Format(time.RFC3339),
+		"label":      incident.Label,
+		"system":     incident.System,
+		"talkgroups": talkgroups,
+	}
+
+	if incident.Expires != nil {
+		m["expires"] = incident.Expires.Format(time.RFC3339)
+	}
+
+	return m
+}
+
+// Incidents are the calls and talkgroups pinned by the admins during a major
+// event. They are pushed to the listeners, which surface them on top of the
+// live view until they are unpinned or expire.
+type Incidents struct {
+	Controller *Controller
+	List       []*Incident
+	timers     map[uint]*time.Timer
+	mutex      sync.Mutex
+}
+
+func NewIncidents(controller *Controller) *Incidents {
+	return &Incidents{
+		Controller: controller,
+		List:       []*Incident{},
+		timers:     map[uint]*time.Timer{},
+		mutex:      sync.Mutex{},
+	}
+}
+
+func (incidents *Incidents) Add(incident *Incident, db *Database) error {
+	var (
+		calls      []byte
+		err        error
+		expires    any
+		id         int64
+		res        sql.Result
+		talkgroups []byte
+	)
+
+	incidents.mutex.Lock()
+	defer incidents.mutex.Unlock()
+
+	formatError := func(err error) error {
+		return fmt.Errorf("incidents.add: %v", err)
+	}
+
+	if len(incident.Label) == 0 {
+		return formatError(errors.New("no label"))
+	}
+
+	if incident.System == 0 {
+		return formatError(errors.New("no system"))
+	}
+
+	if len(incident.Talkgroups) == 0 {
+		return formatError(errors.New("no talkgroups"))
+	}
+
+	if !incident.IsActive() {
+		return formatError(errors.New("invalid duration"))
+	}
+
+	if calls, err = json.Marshal(incident.Calls); err != nil {
+		return formatError(err)
+	}
+
+	if talkgroups, err = json.Marshal(incident.Talkgroups); err != nil {
+		return formatError(err)
+	}
+
+	if incident.Expires != nil {
+		expires = *incident.Expires
+	}
+
+	if res, err = db.Sql.Exec("insert into `rdioScannerIncidents` (`calls`, `createdAt`, `expires`, `label`, `system`, `talkgroups`) values (?, ?, ?, ?, ?, ?)", string(calls), incident.CreatedAt, expires, incident.Label, incident.System, string(talkgroups)); err != nil {
+		return formatError(err)
+	}
+
+	if id, err = res.LastInsertId(); err != nil {
+		return formatError(err)
+	}
+
+	incident.Id = uint(id)
+
+	incidents.List = append(incidents.List, incident)
+	incidents.schedule(incident)
+
+	go incidents.Emit()
+
+	return nil
+}
+
+// Emit sends the pinned incidents to all the listeners.
+func (incidents *Incidents) Emit() {
+	clients := incidents.Controller.Clients
+
+	clients.mutex.Lock()
+	defer clients.mutex.Unlock()
+
+	for c := range clients.Map {
+		incidents.Send(c)
+	}
+}
+
+func (incidents *Incidents) GetActive() []*Incident {
+	incidents.mutex.Lock()
+	defer incidents.mutex.Unlock()
+
+	l := []*Incident{}
+
+	for _, incident := range incidents.List {
+		if incident.IsActive() {
+			l = append(l, incident)
+		}
+	}
+
+	return l
+}
+
+func (incidents *Incidents) Read(db *Database) error {
+	var (
+		calls      string
+		createdAt  any
+		err        error
+		expires    any
+		expired    = []*Incident{}
+		id         sql.NullFloat64
+		rows       *sql.Rows
+		talkgroups string
+	)
+
+	incidents.mutex.Lock()
+	defer incidents.mutex.Unlock()
+
+	for _, timer := range incidents.timers {
+		timer.Stop()
+	}
+
+	incidents.List = []*Incident{}
+	incidents.timers = map[uint]*time.Timer{}
+
+	formatError := func(err error) error {
+		return fmt.Errorf("incidents.read: %v", err)
+	}
+
+	if rows, err = db.Sql.Query("select `_id`, `calls`, `createdAt`, `expires`, `label`, `system`, `talkgroups` from `rdioScannerIncidents`"); err != nil {
+		return formatError(err)
+	}
+
+	for rows.Next() {
+		incident := &Incident{}
+
+		if err = rows.Scan(&id, &calls, &createdAt, &expires, &incident.Label, &incident.System, &talkgroups); err != nil {
+			break
+		}
+
+		if id.Valid && id.Float64 > 0 {
+			incident.Id = uint(id.Float64)
+		}
+
+		if t, err := db.ParseDateTime(createdAt); err == nil {
+			incident.CreatedAt = t
+		}
+
+		if expires != nil {
+			if t, err := db.ParseDateTime(expires); err == nil {
+				incident.Expires = &t
+			}
+		}
+
+		if err := json.Unmarshal([]byte(calls), &incident.Calls); err != nil {
+			incident.Calls = []uint{}
+		}
+
+		if err := json.Unmarshal([]byte(talkgroups), &incident.Talkgroups); err != nil {
+			incident.Talkgroups = []uint{}
+		}
+
+		if incident.IsActive() {
+			incidents.List = append(incidents.List, incident)
+		} else {
+			expired = append(expired, incident)
+		}
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	for _, incident := range incidents.List {
+		incidents.schedule(incident)
+	}
+
+	for _, incident := range expired {
+		if _, err = db.Sql.Exec("delete from `rdioScannerIncidents` where `_id` = ?", incident.Id); err != nil {
+			return formatError(err)
+		}
+
+		incidents.Controller.Logs.LogEvent(LogLevelInfo, fmt.Sprintf("incident: %s expired", incident.Label))
+	}
+
+	return nil
+}
+
+// Send sends the pinned incidents the listener has access to.
+func (incidents *Incidents) Send(client *Client) {
+	restricted := incidents.Controller.Accesses.IsRestricted()
+
+	if restricted && client.GetAccess().Systems == nil {
+		return
+	}
+
+	l := []map[string]any{}
+
+	for _, incident := range incidents.GetActive() {
+		if m := incident.ScopedFor(client, restricted); m != nil {
+			l = append(l, m)
+		}
+	}
+
+	select {
+	case client.Send <- &Message{Command: MessageCommandIncidents, Payload: l}:
+	default:
+	}
+}
+
+func (incidents *Incidents) Unpin(id uint, db *Database) (*Incident, error) {
+	incidents.mutex.Lock()
+	defer incidents.mutex.Unlock()
+
+	incident, err := incidents.remove(id, db)
+
+	if incident != nil {
+		go incidents.Emit()
+	}
+
+	return incident, err
+}
+
+func (incidents *Incidents) remove(id uint, db *Database) (*Incident, error) {
+	for i, incident := range incidents.List {
+		if incident.Id != id {
+			continue
+		}
+
+		if _, err := db.Sql.Exec("delete from `rdioScannerIncidents` where `_id` = ?", id); err != nil {
+			return nil, fmt.Errorf("incidents.remove: %v", err)
+		}
+
+		if timer, ok := incidents.timers[id]; ok {
+			timer.Stop()
+			delete(incidents.timers, id)
+		}
+
+		incidents.List = append(incidents.List[:i], incidents.List[i+1:]...)
+
+		return incident, nil
+	}
+
+	return nil, nil
+}
+
+func (incidents *Incidents) schedule(incident *Incident) {
+	id, ok := incident.Id.(uint)
+	if !ok || incident.Expires == nil {
+		return
+	}
+
+	incidents.timers[id] = time.AfterFunc(time.Until(*incident.Expires), func() {
+		incidents.mutex.Lock()
+		defer incidents.mutex.Unlock()
+
+		delete(incidents.timers, id)
+
+		if i, err := incidents.remove(id, incidents.Controller.Database); err != nil {
+			incidents.Controller.Logs.LogEvent(LogLevelError, err.Error())
+		} else if i != nil {
+			incidents.Controller.Logs.LogEvent(LogLevelInfo, fmt.Sprintf("incident: %s expired", i.Label))
+
+			go incidents.Emit()
+		}
+	})
+}
+
+func (admin *Admin) IncidentsHandler(w http.ResponseWriter, r *http.Request) {
+	if !admin.Authorize(w, r, adminWriteRole(r)) {
+		return
+	}
+
+	incidents := admin.Controller.Incidents
+	logs := admin.Controller.Logs
+
+	switch r.Method {
+	case http.MethodDelete:
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil || id < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		incident, err := incidents.Unpin(uint(id), admin.Controller.Database)
+		if err != nil {
+			logs.LogEvent(LogLevelError, err.Error())
+			w.WriteHeader(http.StatusExpectationFailed)
+			return
+		}
+
+		if incident == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		logs.LogEvent(LogLevelInfo, fmt.Sprintf("incident: %s unpinned by admin from ip %s", incident.Label, GetRemoteAddr(r)))
+
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodGet:
+		if b, err := json.Marshal(incidents.GetActive()); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+
+	case http.MethodPost:
+		m := map[string]any{}
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		incident := (&Incident{}).FromMap(m)
+
+		if err := incidents.Add(incident, admin.Controller.Database); err != nil {
+			logs.LogEvent(LogLevelWarn, err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		logs.LogEvent(LogLevelInfo, fmt.Sprintf("incident: %s pinned on system=%v talkgroups=%v by admin from ip %s", incident.Label, incident.System, incident.Talkgroups, GetRemoteAddr(r)))
+
+		if b, err := json.Marshal(incident); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,701 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	IngestStageAlert      = "alert"
+	IngestStageBroadcast  = "broadcast"
+	IngestStageDedupe     = "dedupe"
+	IngestStageStore      = "store"
+	IngestStageTranscode  = "transcode"
+	IngestStageTranscribe = "transcribe"
+	IngestStageValidate   = "validate"
+)
+
+// ingestWorkerQueue is how many calls a worker can be handed before the
+// others wait for it, those of a busy talkgroup piling up in the ingest
+// queue rather than blocking the other talkgroups right away.
+const ingestWorkerQueue = 256
+
+// IngestProcessor is a stage of the call ingest pipeline. Process stops the
+// ingest of the call when it returns an error, an IngestRejection when the
+// call is rejected.
+type IngestProcessor interface {
+	Name() string
+	Process(ingest *Ingest) error
+}
+
+// IngestRejection is a call rejected by a stage, logged at its level with
+// its message and counted under its reason when set.
+type IngestRejection struct {
+	Level   string
+	Message string
+	Reason  string
+}
+
+func (rejection *IngestRejection) Error() string {
+	return rejection.Message
+}
+
+// Ingest is a call going through the pipeline, along with what the stages
+// found out about it.
+type Ingest struct {
+	Call       *Call
+	Controller *Controller
+	Duplicates []*CallRecording
+	Group      *Group
+	System     *System
+	Tag        *Tag
+	Talkgroup  *Talkgroup
+}
+
+// logCall logs the outcome of the call, kept in its trace.
+func (ingest *Ingest) logCall(level string, message string) {
+	ingest.Controller.Logs.LogEvent(level, fmt.Sprintf("newcall: system=%v talkgroup=%v file=%v %v", ingest.Call.System, ingest.Call.Talkgroup, ingest.Call.AudioName, message))
+	ingest.Call.trace.SetOutcome(message)
+}
+
+// hidden returns true if the call is encrypted and its talkgroup hides the
+// encrypted calls from the listeners.
+func (ingest *Ingest) hidden() bool {
+	return ingest.Call.Encrypted && ingest.Talkgroup != nil && ingest.Talkgroup.HideEncrypted
+}
+
+// ingestProcessor is a stage of the pipeline implemented by a function.
+type ingestProcessor struct {
+	name    string
+	process func(ingest *Ingest) error
+}
+
+func (processor *ingestProcessor) Name() string {
+	return processor.name
+}
+
+func (processor *ingestProcessor) Process(ingest *Ingest) error {
+	return processor.process(ingest)
+}
+
+// IngestPipeline runs the new calls through the stages listed in the ingest
+// pipeline option, in order. The validate and the store stages are
+// required, the other built in stages are disabled when not listed.
+// Registered stages can be listed anywhere after the validate stage.
+type IngestPipeline struct {
+	Controller *Controller
+	option     string
+	pending    int64
+	processors map[string]IngestProcessor
+	stages     []IngestProcessor
+	workers    int64
+	mutex      sync.Mutex
+}
+
+func NewIngestPipeline(controller *Controller) *IngestPipeline {
+	pipeline := &IngestPipeline{
+		Controller: controller,
+		processors: map[string]IngestProcessor{},
+		mutex:      sync.Mutex{},
+	}
+
+	pipeline.Register(&ingestProcessor{IngestStageAlert, ingestAlert})
+	pipeline.Register(&ingestProcessor{IngestStageBroadcast, ingestBroadcast})
+	pipeline.Register(&ingestProcessor{IngestStageDedupe, ingestDedupe})
+	pipeline.Register(&ingestProcessor{IngestStageStore, ingestStore})
+	pipeline.Register(&ingestProcessor{IngestStageTranscode, ingestTranscode})
+	pipeline.Register(&ingestProcessor{IngestStageTranscribe, ingestTranscribe})
+	pipeline.Register(&ingestProcessor{IngestStageValidate, ingestValidate})
+
+	return pipeline
+}
+
+// Register adds a stage to the pipeline, replacing the one of the same name.
+func (pipeline *IngestPipeline) Register(processor IngestProcessor) {
+	pipeline.mutex.Lock()
+	defer pipeline.mutex.Unlock()
+
+	pipeline.processors[processor.Name()] = processor
+	pipeline.stages = nil
+}
+
+// process runs the call through the stages, a panic dropping the call
+// rather than the worker.
+func (pipeline *IngestPipeline) process(call *Call) {
+	defer pipeline.Controller.Recover("ingest")
+
+	pipeline.Process(call)
+}
+
+// Process runs the call through the stages until one of them stops it.
+func (pipeline *IngestPipeline) Process(call *Call) {
+	controller := pipeline.Controller
+
+	call.trace = NewCallTrace(call)
+	controller.Traces.Add(call.trace)
+
+	ingest := &Ingest{Call: call, Controller: controller}
+
+	for _, processor := range pipeline.Stages() {
+		err := processor.Process(ingest)
+		if err == nil {
+			continue
+		}
+
+		var rejection *IngestRejection
+		if errors.As(err, &rejection) {
+			ingest.logCall(rejection.Level, rejection.Message)
+			if len(rejection.Reason) > 0 {
+				controller.Metrics.CallRejected(rejection.Reason)
+			}
+
+		} else {
+			controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("controller.ingestcall: %s: %v", processor.Name(), err.Error()))
+			call.trace.SetOutcome(err.Error())
+		}
+
+		return
+	}
+}
+
+// Pending returns how many calls were taken from the ingest queue by the
+// workers and are still to be ingested.
+func (pipeline *IngestPipeline) Pending() int {
+	return int(atomic.LoadInt64(&pipeline.pending))
+}
+
+// Run ingests the calls of the queue until a nil call is queued, with the
+// given number of workers, one per cpu when 0. The calls of a talkgroup are
+// always handed to the same worker, so that they are ingested in the order
+// they were queued, from one source or another, while those of the other
+// talkgroups are ingested in parallel. Keeping a talkgroup to one worker
+// also keeps the duplicates of a call from being checked at once.
+func (pipeline *IngestPipeline) Run(queue <-chan *Call, workers uint) {
+	var wg sync.WaitGroup
+
+	if workers == 0 {
+		workers = uint(runtime.NumCPU())
+	}
+
+	atomic.StoreInt64(&pipeline.workers, int64(workers))
+
+	queues := make([]chan *Call, workers)
+
+	for i := range queues {
+		queues[i] = make(chan *Call, ingestWorkerQueue)
+
+		wg.Add(1)
+
+		go func(calls <-chan *Call) {
+			defer wg.Done()
+
+			for call := range calls {
+				start := time.Now()
+				pipeline.process(call)
+				pipeline.Controller.Backpressure.Observe(time.Since(start))
+				atomic.AddInt64(&pipeline.pending, -1)
+			}
+		}(queues[i])
+	}
+
+	for call := range queue {
+		if call == nil {
+			break
+		}
+
+		atomic.AddInt64(&pipeline.pending, 1)
+		queues[ingestWorker(call, workers)] <- call
+	}
+
+	for _, calls := range queues {
+		close(calls)
+	}
+
+	wg.Wait()
+}
+
+// Workers returns how many workers ingest the calls, 1 until they run.
+func (pipeline *IngestPipeline) Workers() int {
+	if workers := atomic.LoadInt64(&pipeline.workers); workers > 0 {
+		return int(workers)
+	}
+
+	return 1
+}
+
+// ingestWorker returns the worker of the talkgroup of the call.
+func ingestWorker(call *Call, workers uint) uint {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%d/%d", call.System, call.Talkgroup)
+
+	return uint(h.Sum32()) % workers
+}
+
+// Stages returns the stages of the ingest pipeline option, or the default
+// ones when the option is invalid.
+func (pipeline *IngestPipeline) Stages() []IngestProcessor {
+	var err error
+
+	option := pipeline.Controller.Options.IngestPipeline
+
+	pipeline.mutex.Lock()
+
+	if pipeline.stages == nil || pipeline.option != option {
+		pipeline.option = option
+
+		if pipeline.stages, err = parseIngestPipeline(option, pipeline.processors); err != nil {
+			pipeline.stages, _ = parseIngestPipeline(defaults.options.ingestPipeline, pipeline.processors)
+		}
+	}
+
+	stages := pipeline.stages
+
+	pipeline.mutex.Unlock()
+
+	if err != nil {
+		pipeline.Controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("ingest pipeline: %v, using the default one", err.Error()))
+	}
+
+	return stages
+}
+
+// parseIngestPipeline returns the processors of a comma separated list of
+// stages, checking that the built in stages are in a workable order.
+func parseIngestPipeline(s string, processors map[string]IngestProcessor) ([]IngestProcessor, error) {
+	stages := []IngestProcessor{}
+
+	seen := map[string]bool{}
+
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); len(name) == 0 {
+			continue
+		}
+
+		processor, ok := processors[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown stage %s", name)
+		}
+
+		if seen[name] {
+			return nil, fmt.Errorf("stage %s listed twice", name)
+		}
+
+		switch name {
+		case IngestStageValidate:
+			if len(stages) > 0 {
+				return nil, fmt.Errorf("the %s stage must come first", name)
+			}
+		case IngestStageDedupe, IngestStageTranscode:
+			if seen[IngestStageStore] {
+				return nil, fmt.Errorf("the %s stage must come before the %s stage", name, IngestStageStore)
+			}
+		case IngestStageAlert, IngestStageBroadcast, IngestStageTranscribe:
+			if !seen[IngestStageStore] {
+				return nil, fmt.Errorf("the %s stage must come after the %s stage", name, IngestStageStore)
+			}
+		}
+
+		if len(stages) == 0 && name != IngestStageValidate {
+			return nil, fmt.Errorf("the %s stage must come first", IngestStageValidate)
+		}
+
+		seen[name] = true
+		stages = append(stages, processor)
+	}
+
+	if !seen[IngestStageStore] {
+		return nil, fmt.Errorf("the %s stage is required", IngestStageStore)
+	}
+
+	return stages, nil
+}
+
+// ingestValidate matches the call with its system and talkgroup, auto
+// populating them when allowed. The workers validate one call at a time, as
+// auto populating two talkgroups of a new system at once would create it
+// twice.
+func ingestValidate(ingest *Ingest) error {
+	var (
+		err        error
+		groupId    uint
+		groupLabel string
+		ok         bool
+		populated  bool
+		tagId      uint
+		tagLabel   string
+	)
+
+	call := ingest.Call
+	controller := ingest.Controller
+
+	// the skew is kept with the call so that the admin can review and fix
+	// the timestamps of recorders with a drifting clock
+	call.skew = time.Since(call.DateTime)
+
+	if -call.skew > callFutureTolerance {
+		message := fmt.Sprintf("clock skew, call dated %v in the future", (-call.skew).Round(time.Second))
+		controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("newcall: system=%v talkgroup=%v file=%v %v", call.System, call.Talkgroup, call.AudioName, message))
+		call.trace.AddEvent(message)
+	}
+
+	controller.populateMutex.Lock()
+	defer controller.populateMutex.Unlock()
+
+	if ingest.System, ok = controller.Systems.GetSystem(call.System); ok {
+		if ingest.System.Blacklists.IsBlacklisted(call.Talkgroup) {
+			return &IngestRejection{Level: LogLevelInfo, Message: "blacklisted", Reason: "blacklisted"}
+		}
+		ingest.Talkgroup, _ = ingest.System.Talkgroups.GetSiteTalkgroup(call.Talkgroup, call.Site)
+	}
+
+	system := ingest.System
+	talkgroup := ingest.Talkgroup
+
+	// imported calls always populate, they come with their own talkgroups
+	if (controller.Options.AutoPopulate || call.populate) && system == nil {
+		populated = true
+
+		system = NewSystem()
+		system.Id = call.System
+
+		switch v := call.systemLabel.(type) {
+		case string:
+			system.Label = v
+		default:
+			system.Label = fmt.Sprintf("System %v", call.System)
+		}
+
+		controller.Systems.List = append(controller.Systems.List, system)
+
+		call.trace.AddEvent(fmt.Sprintf("system %v auto populated", call.System))
+	}
+
+	if controller.Options.AutoPopulate || call.populate || (system != nil && system.AutoPopulate) {
+		if system != nil && talkgroup == nil {
+			populated = true
+
+			switch v := call.talkgroupGroup.(type) {
+			case string:
+				groupLabel = v
+			default:
+				groupLabel = "Unknown"
+			}
+
+			switch v := call.talkgroupTag.(type) {
+			case string:
+				tagLabel = v
+			default:
+				tagLabel = "Untagged"
+			}
+
+			group, ok := controller.Groups.GetGroup(groupLabel)
+			if !ok {
+				group = &Group{Label: groupLabel}
+
+				controller.Groups.List = append(controller.Groups.List, group)
+
+				if err = controller.Groups.Write(controller.Database); err != nil {
+					return err
+				}
+
+				if err = controller.Groups.Read(controller.Database); err != nil {
+					return err
+				}
+
+				if group, ok = controller.Groups.GetGroup(groupLabel); !ok {
+					return fmt.Errorf("unable to get group %s", groupLabel)
+				}
+			}
+
+			switch v := group.Id.(type) {
+			case uint:
+				groupId = v
+			default:
+				return fmt.Errorf("unable to get group id for group %s", groupLabel)
+			}
+
+			tag, ok := controller.Tags.GetTag(tagLabel)
+			if !ok {
+				tag = &Tag{Label: tagLabel}
+
+				controller.Tags.List = append(controller.Tags.List, tag)
+
+				if err = controller.Tags.Write(controller.Database); err != nil {
+					return err
+				}
+
+				if err = controller.Tags.Read(controller.Database); err != nil {
+					return err
+				}
+
+				if tag, ok = controller.Tags.GetTag(tagLabel); !ok {
+					return fmt.Errorf("unable to get tag %s", tagLabel)
+				}
+			}
+
+			switch v := tag.Id.(type) {
+			case uint:
+				tagId = v
+			default:
+				return fmt.Errorf("unable to get tag id for tag %s", tagLabel)
+			}
+
+			ingest.Group = group
+			ingest.Tag = tag
+
+			talkgroup = &Talkgroup{
+				GroupId: groupId,
+				Id:      call.Talkgroup,
+				Label:   fmt.Sprintf("%d", call.Talkgroup),
+				TagId:   tagId,
+			}
+
+			system.Talkgroups.List = append(system.Talkgroups.List, talkgroup)
+
+			call.trace.AddEvent(fmt.Sprintf("talkgroup %v auto populated", call.Talkgroup))
+		}
+
+		switch v := call.talkgroupLabel.(type) {
+		case string:
+			if talkgroup.Label != v {
+				populated = true
+				talkgroup.Label = v
+			}
+		}
+
+		switch v := call.talkgroupName.(type) {
+		case string:
+			if talkgroup.Name != v {
+				populated = true
+				talkgroup.Name = v
+			}
+		default:
+			if len(talkgroup.Name) == 0 {
+				populated = true
+				talkgroup.Name = talkgroup.Label
+			}
+		}
+
+		switch v := call.units.(type) {
+		case *Units:
+			if v != nil {
+				populated = system.Units.Merge(v)
+			}
+		}
+	}
+
+	if populated {
+		if err = controller.Systems.Write(controller.Database); err != nil {
+			return err
+		}
+
+		if err = controller.Systems.Read(controller.Database); err != nil {
+			return err
+		}
+
+		controller.EmitConfig()
+	}
+
+	if system == nil || talkgroup == nil {
+		return &IngestRejection{Level: LogLevelWarn, Message: "no matching system/talkgroup", Reason: "unknown"}
+	}
+
+	ingest.System = system
+	ingest.Talkgroup = talkgroup
+
+	call.Metadata = system.FilterMetadata(call.Metadata)
+
+	return nil
+}
+
+// ingestDedupe rejects the duplicates of an archived call, or keeps them
+// for the store stage to tell them apart when merging.
+func ingestDedupe(ingest *Ingest) error {
+	var err error
+
+	call := ingest.Call
+	controller := ingest.Controller
+
+	if controller.Options.DisableDuplicateDetection {
+		return nil
+	}
+
+	// when merging, the duplicates are only told apart once the duration of
+	// the call is known
+	if controller.Options.DuplicateDetectionMode == DUPLICATE_DETECTION_MERGE {
+		if ingest.Duplicates, err = controller.Calls.GetDuplicates(call, controller.Options.DuplicateDetectionTimeFrame, controller.Database); err != nil {
+			controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("controller.ingestcall: %v", err.Error()))
+		}
+		return nil
+	}
+
+	duplicate := controller.Calls.CheckDuplicate(call, controller.Options.DuplicateDetectionTimeFrame, controller.Database)
+
+	call.trace.SetDuplicate(duplicate)
+
+	if duplicate {
+		return &IngestRejection{Level: LogLevelWarn, Message: "duplicate call rejected", Reason: "duplicate"}
+	}
+
+	return nil
+}
+
+// ingestTranscode converts the audio of the call.
+func ingestTranscode(ingest *Ingest) error {
+	call := ingest.Call
+	controller := ingest.Controller
+
+	transcodeStart := time.Now()
+
+	if err := controller.FFMpeg.Convert(call, controller.Systems, controller.Tags, controller.Options); err != nil {
+		controller.Logs.LogEvent(LogLevelWarn, err.Error())
+		call.trace.AddEvent(err.Error())
+	}
+
+	call.trace.SetTranscodeTime(time.Since(transcodeStart))
+
+	return nil
+}
+
+// ingestStore archives the call, unless it is a duplicate merged into an
+// archived one, and learns its units.
+func ingestStore(ingest *Ingest) error {
+	var err error
+
+	call := ingest.Call
+	controller := ingest.Controller
+
+	if call.Duration, err = controller.FFMpeg.Duration(call.Audio); err != nil {
+		// estimated from the bitrate of the audio conversion
+		bitrate := controller.Options.AudioBitrate
+		if bitrate == 0 {
+			bitrate = defaults.options.audioBitrate
+		}
+		call.Duration = time.Duration(len(call.Audio)) * time.Second / time.Duration(125*bitrate)
+	}
+
+	if len(ingest.Duplicates) > 0 {
+		outcome, err := controller.MergeDuplicate(call, ingest.Duplicates)
+
+		call.trace.SetDuplicate(len(outcome) > 0 || err != nil)
+
+		if err != nil {
+			return err
+		}
+
+		if len(outcome) > 0 {
+			return &IngestRejection{Level: LogLevelInfo, Message: outcome, Reason: "duplicate"}
+		}
+
+	} else if controller.Options.DuplicateDetectionMode == DUPLICATE_DETECTION_MERGE {
+		call.trace.SetDuplicate(false)
+	}
+
+	id, err := controller.Calls.WriteCall(call, controller.Database)
+	if err != nil {
+		return err
+	}
+
+	call.Id = id
+	call.trace.SetCallId(id)
+	call.systemLabel = ingest.System.Label
+	call.talkgroupLabel = ingest.Talkgroup.Label
+	call.talkgroupName = ingest.Talkgroup.Name
+
+	if err := controller.SearchIndex.Write(call); err != nil {
+		controller.Logs.LogEvent(LogLevelError, err.Error())
+	}
+
+	if ingest.Group == nil {
+		if group, ok := controller.Groups.GetGroup(ingest.Talkgroup.GroupId); ok {
+			ingest.Group = group
+			call.talkgroupGroup = group.Label
+		}
+	}
+
+	if ingest.Tag == nil {
+		if tag, ok := controller.Tags.GetTag(ingest.Talkgroup.TagId); ok {
+			ingest.Tag = tag
+			call.talkgroupTag = tag.Label
+		}
+	}
+
+	ingest.logCall(LogLevelInfo, "success")
+
+	controller.Metrics.CallIngested(call)
+
+	if learned, err := ingest.System.Units.Heard(call, controller.Options.AutoLearnUnits, controller.Database, ingest.System.Id); err != nil {
+		controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("controller.ingestcall: %v", err.Error()))
+	} else if len(learned) > 0 {
+		call.trace.AddEvent(fmt.Sprintf("units %v learned", learned))
+	}
+
+	if controller.AutoMute.Evaluate(call) {
+		call.trace.AddEvent("talkgroup automatically muted")
+	}
+
+	return nil
+}
+
+// ingestBroadcast sends the call to the listeners, the export and the
+// publishers, but the encrypted calls their talkgroup hides.
+func ingestBroadcast(ingest *Ingest) error {
+	controller := ingest.Controller
+
+	if ingest.hidden() {
+		ingest.Call.trace.AddEvent("encrypted call hidden")
+		return nil
+	}
+
+	controller.EmitCall(ingest.Call)
+
+	controller.Export.Write(ingest.Call)
+
+	controller.Publishers.Publish(ingest.Call)
+
+	return nil
+}
+
+// ingestAlert evaluates the alerts and the subscriptions of the call.
+func ingestAlert(ingest *Ingest) error {
+	controller := ingest.Controller
+
+	controller.Alerts.Evaluate(ingest.Call)
+
+	controller.Subscriptions.Evaluate(ingest.Call)
+
+	return nil
+}
+
+// ingestTranscribe queues the call to the transcribers, the hidden encrypted
+// calls having nothing to transcribe.
+func ingestTranscribe(ingest *Ingest) error {
+	if ingest.hidden() {
+		return nil
+	}
+
+	ingest.Controller.Transcribers.Queue(ingest.Call)
+
+	return nil
+}
@@ -0,0 +1,296 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseIngestPipeline(t *testing.T) {
+	processors := NewIngestPipeline(&Controller{}).processors
+	processors["geocode"] = &ingestProcessor{"geocode", func(ingest *Ingest) error { return nil }}
+
+	tests := []struct {
+		option string
+		want   string
+		err    string
+	}{
+		{option: defaults.options.ingestPipeline, want: "validate,dedupe,transcode,store,broadcast,alert,transcribe"},
+		{option: "Validate,TRANSCODE , dedupe,store, transcribe,broadcast,", want: "validate,transcode,dedupe,store,transcribe,broadcast"},
+		{option: "validate, store", want: "validate,store"},
+		{option: "validate, geocode, store, geocode2", err: "unknown stage geocode2"},
+		{option: "validate, store, geocode", want: "validate,store,geocode"},
+		{option: "validate, store, alert, alert", err: "stage alert listed twice"},
+		{option: "dedupe, validate, store", err: "the validate stage must come first"},
+		{option: "geocode, validate, store", err: "the validate stage must come first"},
+		{option: "validate, broadcast", err: "the broadcast stage must come after the store stage"},
+		{option: "validate, store, transcode", err: "the transcode stage must come before the store stage"},
+		{option: "validate, dedupe", err: "the store stage is required"},
+		{option: "", err: "the store stage is required"},
+	}
+
+	for _, test := range tests {
+		stages, err := parseIngestPipeline(test.option, processors)
+
+		if len(test.err) > 0 {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%q: got error %v, want %s", test.option, err, test.err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: %v", test.option, err)
+			continue
+		}
+
+		names := []string{}
+		for _, stage := range stages {
+			names = append(names, stage.Name())
+		}
+
+		if got := strings.Join(names, ","); got != test.want {
+			t.Errorf("%q: got %s, want %s", test.option, got, test.want)
+		}
+	}
+}
+
+func TestIngestPipelineProcess(t *testing.T) {
+	tests := []struct {
+		name    string
+		option  string
+		fail    string
+		want    string
+		outcome string
+		reason  string
+	}{
+		{name: "all", option: "validate, check, store", want: "validate,check,store", outcome: "stored"},
+		{name: "rejected", option: "validate, check, store", fail: "reject", want: "validate,check", outcome: "rejected", reason: "custom"},
+		{name: "error", option: "validate, check, store", fail: "error", want: "validate,check", outcome: "failed"},
+		{name: "disabled", option: "validate, store", want: "validate,store", outcome: "stored"},
+		{name: "invalid", option: "store, validate", want: "validate,dedupe,transcode,store,broadcast,alert,transcribe", outcome: "stored"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			controller := &Controller{Logs: NewLogs(), Options: NewOptions(), Traces: NewCallTraces(10)}
+			controller.Metrics = NewMetrics(controller)
+			controller.Options.IngestPipeline = test.option
+
+			pipeline := NewIngestPipeline(controller)
+
+			ran := []string{}
+
+			for _, name := range []string{"alert", "broadcast", "check", "dedupe", "store", "transcode", "transcribe", "validate"} {
+				name := name
+				pipeline.Register(&ingestProcessor{name, func(ingest *Ingest) error {
+					ran = append(ran, name)
+					switch {
+					case name == "check" && test.fail == "reject":
+						return &IngestRejection{Level: LogLevelInfo, Message: "rejected", Reason: "custom"}
+					case name == "check" && test.fail == "error":
+						return errors.New("failed")
+					case name == "store":
+						ingest.Call.trace.SetOutcome("stored")
+					}
+					return nil
+				}})
+			}
+
+			call := &Call{DateTime: time.Now()}
+
+			pipeline.Process(call)
+
+			if got := strings.Join(ran, ","); got != test.want {
+				t.Errorf("got stages %s, want %s", got, test.want)
+			}
+
+			if call.trace.Outcome != test.outcome {
+				t.Errorf("got outcome %q, want %q", call.trace.Outcome, test.outcome)
+			}
+
+			if len(test.reason) > 0 && controller.Metrics.callsRejected[test.reason] != 1 {
+				t.Errorf("rejection not counted under %s", test.reason)
+			}
+		})
+	}
+}
+
+func TestIngestPipelineRun(t *testing.T) {
+	const workers = 4
+
+	// two talkgroups of different workers
+	slow, fast := uint(1), uint(2)
+	for ingestWorker(&Call{System: 1, Talkgroup: fast}, workers) == ingestWorker(&Call{System: 1, Talkgroup: slow}, workers) {
+		fast++
+	}
+
+	controller := &Controller{Logs: NewLogs(), Options: NewOptions(), Traces: NewCallTraces(10)}
+	controller.Backpressure = NewBackpressure(controller)
+	controller.Options.IngestPipeline = "validate, store"
+
+	pipeline := NewIngestPipeline(controller)
+	controller.Pipeline = pipeline
+
+	var (
+		fastDone = make(chan struct{})
+		mutex    sync.Mutex
+		order    = map[uint][]string{}
+		parallel = true
+	)
+
+	pipeline.Register(&ingestProcessor{IngestStageValidate, func(ingest *Ingest) error { return nil }})
+	pipeline.Register(&ingestProcessor{IngestStageStore, func(ingest *Ingest) error {
+		call := ingest.Call
+
+		// the slow talkgroup waits for the fast one, which never comes when
+		// the talkgroups are ingested one after the other
+		if call.Talkgroup == slow && call.Mode == "0" {
+			select {
+			case <-fastDone:
+			case <-time.After(5 * time.Second):
+				parallel = false
+			}
+		}
+
+		mutex.Lock()
+		order[call.Talkgroup] = append(order[call.Talkgroup], call.Mode)
+		if call.Talkgroup == fast && len(order[fast]) == 50 {
+			close(fastDone)
+		}
+		mutex.Unlock()
+
+		return nil
+	}})
+
+	queue := make(chan *Call, 256)
+
+	for i := 0; i < 50; i++ {
+		queue <- &Call{DateTime: time.Now(), Mode: strconv.Itoa(i), System: 1, Talkgroup: slow}
+		queue <- &Call{DateTime: time.Now(), Mode: strconv.Itoa(i), System: 1, Talkgroup: fast}
+	}
+	queue <- nil
+
+	pipeline.Run(queue, workers)
+
+	if !parallel {
+		t.Error("the talkgroups were not ingested in parallel")
+	}
+
+	for _, talkgroup := range []uint{slow, fast} {
+		if len(order[talkgroup]) != 50 {
+			t.Fatalf("talkgroup %d: %d calls ingested, want 50", talkgroup, len(order[talkgroup]))
+		}
+		for i, name := range order[talkgroup] {
+			if name != strconv.Itoa(i) {
+				t.Fatalf("talkgroup %d: calls ingested in the order %v", talkgroup, order[talkgroup])
+			}
+		}
+	}
+
+	if pending := pipeline.Pending(); pending != 0 {
+		t.Errorf("%d calls pending once drained", pending)
+	}
+
+	if got := pipeline.Workers(); got != workers {
+		t.Errorf("got %d workers, want %d", got, workers)
+	}
+}
+
+func TestIngestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		call   *Call
+		reason string
+	}{
+		{name: "known", call: &Call{System: 1, Talkgroup: 2}},
+		{name: "blacklisted", call: &Call{System: 1, Talkgroup: 3}, reason: "blacklisted"},
+		{name: "unknown talkgroup", call: &Call{System: 1, Talkgroup: 4}, reason: "unknown"},
+		{name: "unknown system", call: &Call{System: 2, Talkgroup: 2}, reason: "unknown"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			system := NewSystem()
+			system.Id = 1
+			system.Blacklists = "3"
+			system.Talkgroups.List = []*Talkgroup{{Id: 2, Label: "Fire"}}
+
+			controller := &Controller{Logs: NewLogs(), Options: NewOptions(), Systems: NewSystems()}
+			controller.Systems.List = []*System{system}
+
+			test.call.DateTime = time.Now()
+			test.call.trace = NewCallTrace(test.call)
+
+			ingest := &Ingest{Call: test.call, Controller: controller}
+
+			err := ingestValidate(ingest)
+
+			if len(test.reason) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ingest.System != system || ingest.Talkgroup == nil || ingest.Talkgroup.Label != "Fire" {
+					t.Errorf("got system %v talkgroup %v", ingest.System, ingest.Talkgroup)
+				}
+				return
+			}
+
+			var rejection *IngestRejection
+			if !errors.As(err, &rejection) || rejection.Reason != test.reason {
+				t.Errorf("got %v, want a %s rejection", err, test.reason)
+			}
+		})
+	}
+}
+
+func TestIngestHidden(t *testing.T) {
+	tests := []struct {
+		name      string
+		encrypted bool
+		hide      bool
+		want      bool
+	}{
+		{name: "clear", hide: true},
+		{name: "encrypted", encrypted: true},
+		{name: "encrypted hidden", encrypted: true, hide: true, want: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			call := &Call{DateTime: time.Now(), Encrypted: test.encrypted}
+			call.trace = NewCallTrace(call)
+
+			ingest := &Ingest{Call: call, Talkgroup: &Talkgroup{HideEncrypted: test.hide}}
+
+			if got := ingest.hidden(); got != test.want {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+
+			// a hidden call stops short of the controller
+			if test.want {
+				if err := ingestBroadcast(ingest); err != nil || len(call.trace.Events) != 1 {
+					t.Errorf("got %v, events %v", err, call.trace.Events)
+				}
+			}
+		})
+	}
+}
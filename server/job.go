@@ -0,0 +1,685 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	JobKindArchive     = "archive"
+	JobKindBackup      = "backup"
+	JobKindColdStorage = "cold-storage"
+	JobKindDigest      = "digest"
+	JobKindPrune       = "prune"
+	JobKindRestore     = "restore"
+	JobKindRetrieve    = "retrieve"
+	JobKindSearchIndex = "search-index"
+	JobKindTranscode   = "transcode"
+	JobKindTranscribe  = "transcribe"
+
+	JobPriorityHigh   = 10
+	JobPriorityNormal = 0
+	JobPriorityLow    = -10
+
+	JobStatusCanceled = "canceled"
+	JobStatusDone     = "done"
+	JobStatusFailed   = "failed"
+	JobStatusQueued   = "queued"
+	JobStatusRunning  = "running"
+)
+
+const (
+	jobsMaxAttempts = 3
+	jobsRetention   = 7 * 24 * time.Hour
+	jobsRetryDelay  = 30 * time.Second
+	jobsTick        = 5 * time.Second
+	jobsWorkers     = 2
+)
+
+// JobHandler does the work of a job. It should return early when cancel is
+// closed. The jobs of which the handler returns an error are retried.
+type JobHandler func(job *Job, cancel <-chan struct{}) error
+
+type Job struct {
+	Id          any            `json:"_id"`
+	Attempts    uint           `json:"attempts"`
+	CreatedAt   time.Time      `json:"createdAt"`
+	Error       string         `json:"error,omitempty"`
+	FinishedAt  *time.Time     `json:"finishedAt,omitempty"`
+	Kind        string         `json:"kind"`
+	MaxAttempts uint           `json:"maxAttempts"`
+	Payload     map[string]any `json:"payload"`
+	Priority    int            `json:"priority"`
+	RunAt       time.Time      `json:"runAt"`
+	StartedAt   *time.Time     `json:"startedAt,omitempty"`
+	Status      string         `json:"status"`
+	cancel      chan struct{}
+}
+
+// GetUint returns a number of the payload, as decoded from json.
+func (job *Job) GetUint(key string) (uint, bool) {
+	switch v := job.Payload[key].(type) {
+	case float64:
+		return uint(v), true
+	case uint:
+		return v, true
+	case int:
+		return uint(v), true
+	}
+	return 0, false
+}
+
+func (job *Job) IsPending() bool {
+	return job.Status == JobStatusQueued || job.Status == JobStatusRunning
+}
+
+// Jobs runs the background tasks on a few workers, by order of priority
+// then of creation. The jobs are persisted, those that were running when
+// the server stopped are run again on the next start. Failed jobs are
+// retried with an increasing delay, up to their max attempts.
+type Jobs struct {
+	Controller *Controller
+	List       []*Job
+	handlers   map[string]JobHandler
+	wake       chan struct{}
+	mutex      sync.Mutex
+}
+
+func NewJobs(controller *Controller) *Jobs {
+	return &Jobs{
+		Controller: controller,
+		List:       []*Job{},
+		handlers:   map[string]JobHandler{},
+		wake:       make(chan struct{}, 1),
+		mutex:      sync.Mutex{},
+	}
+}
+
+func (jobs *Jobs) Cancel(id uint) (*Job, error) {
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+
+	job := jobs.get(id)
+	if job == nil {
+		return nil, nil
+	}
+
+	switch job.Status {
+	case JobStatusQueued:
+		now := time.Now().UTC()
+		job.FinishedAt = &now
+		job.Status = JobStatusCanceled
+
+		if err := jobs.save(job); err != nil {
+			return nil, err
+		}
+
+	case JobStatusRunning:
+		// the worker marks the job as canceled once its handler returns
+		select {
+		case <-job.cancel:
+		default:
+			close(job.cancel)
+		}
+
+	default:
+		return nil, fmt.Errorf("jobs.cancel: job %d is %s", id, job.Status)
+	}
+
+	copy := *job
+
+	return &copy, nil
+}
+
+// CancelKind cancels the pending jobs of the kind.
+func (jobs *Jobs) CancelKind(kind string) {
+	ids := []uint{}
+
+	jobs.mutex.Lock()
+	for _, job := range jobs.List {
+		if id, ok := job.Id.(uint); ok && job.Kind == kind && job.IsPending() {
+			ids = append(ids, id)
+		}
+	}
+	jobs.mutex.Unlock()
+
+	for _, id := range ids {
+		if _, err := jobs.Cancel(id); err != nil {
+			jobs.Controller.Logs.LogEvent(LogLevelError, err.Error())
+		}
+	}
+}
+
+func (jobs *Jobs) Enqueue(kind string, payload map[string]any, priority int) (*Job, error) {
+	var (
+		b   []byte
+		err error
+		id  int64
+		res sql.Result
+	)
+
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+
+	formatError := func(err error) error {
+		return fmt.Errorf("jobs.enqueue: %v", err)
+	}
+
+	if _, ok := jobs.handlers[kind]; !ok {
+		return nil, formatError(fmt.Errorf("unknown kind %s", kind))
+	}
+
+	if payload == nil {
+		payload = map[string]any{}
+	}
+
+	now := time.Now().UTC()
+
+	job := &Job{
+		CreatedAt:   now,
+		Kind:        kind,
+		MaxAttempts: jobsMaxAttempts,
+		Payload:     payload,
+		Priority:    priority,
+		RunAt:       now,
+		Status:      JobStatusQueued,
+	}
+
+	if b, err = json.Marshal(job.Payload); err != nil {
+		return nil, formatError(err)
+	}
+
+	if res, err = jobs.Controller.Database.Sql.Exec("insert into `rdioScannerJobs` (`attempts`, `createdAt`, `error`, `kind`, `maxAttempts`, `payload`, `priority`, `runAt`, `status`) values (?, ?, ?, ?, ?, ?, ?, ?, ?)", job.Attempts, job.CreatedAt, job.Error, job.Kind, job.MaxAttempts, string(b), job.Priority, job.RunAt, job.Status); err != nil {
+		return nil, formatError(err)
+	}
+
+	if id, err = res.LastInsertId(); err != nil {
+		return nil, formatError(err)
+	}
+
+	job.Id = uint(id)
+
+	jobs.List = append(jobs.List, job)
+
+	jobs.signal()
+
+	copy := *job
+
+	return &copy, nil
+}
+
+func (jobs *Jobs) GetList() []Job {
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+
+	l := []Job{}
+	for _, job := range jobs.List {
+		l = append(l, *job)
+	}
+
+	sort.Slice(l, func(i int, j int) bool {
+		return l[i].CreatedAt.After(l[j].CreatedAt)
+	})
+
+	return l
+}
+
+// HasPending tells if a job of the kind is queued or running.
+func (jobs *Jobs) HasPending(kind string) bool {
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+
+	for _, job := range jobs.List {
+		if job.Kind == kind && job.IsPending() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasPendingFor tells if a job of the kind is queued or running with the id
+// as the key of its payload.
+func (jobs *Jobs) HasPendingFor(kind string, key string, id uint) bool {
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+
+	for _, job := range jobs.List {
+		if v, ok := job.GetUint(key); ok && v == id && job.Kind == kind && job.IsPending() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Prune removes the finished jobs past the retention.
+func (jobs *Jobs) Prune(db *Database) error {
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+
+	date := time.Now().Add(-jobsRetention).UTC()
+
+	if _, err := db.Sql.Exec("delete from `rdioScannerJobs` where `finishedAt` < ?", date); err != nil {
+		return fmt.Errorf("jobs.prune: %v", err)
+	}
+
+	l := []*Job{}
+	for _, job := range jobs.List {
+		if job.FinishedAt == nil || job.FinishedAt.After(date) {
+			l = append(l, job)
+		}
+	}
+	jobs.List = l
+
+	return nil
+}
+
+func (jobs *Jobs) Read(db *Database) error {
+	var (
+		createdAt  any
+		err        error
+		finishedAt any
+		id         sql.NullFloat64
+		payload    string
+		rows       *sql.Rows
+		runAt      any
+		startedAt  any
+	)
+
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+
+	// the jobs running when the configuration is read back on a reload go
+	// on, rather than being queued again
+	running := map[uint]*Job{}
+	for _, job := range jobs.List {
+		if id, ok := job.Id.(uint); ok && job.Status == JobStatusRunning {
+			running[id] = job
+		}
+	}
+
+	jobs.List = []*Job{}
+
+	formatError := func(err error) error {
+		return fmt.Errorf("jobs.read: %v", err)
+	}
+
+	if rows, err = db.Sql.Query("select `_id`, `attempts`, `createdAt`, `error`, `finishedAt`, `kind`, `maxAttempts`, `payload`, `priority`, `runAt`, `startedAt`, `status` from `rdioScannerJobs`"); err != nil {
+		return formatError(err)
+	}
+
+	for rows.Next() {
+		job := &Job{}
+
+		if err = rows.Scan(&id, &job.Attempts, &createdAt, &job.Error, &finishedAt, &job.Kind, &job.MaxAttempts, &payload, &job.Priority, &runAt, &startedAt, &job.Status); err != nil {
+			break
+		}
+
+		if id.Valid && id.Float64 > 0 {
+			job.Id = uint(id.Float64)
+
+			if running[uint(id.Float64)] != nil {
+				jobs.List = append(jobs.List, running[uint(id.Float64)])
+				continue
+			}
+		}
+
+		if t, err := db.ParseDateTime(createdAt); err == nil {
+			job.CreatedAt = t
+		}
+
+		if t, err := db.ParseDateTime(finishedAt); err == nil {
+			job.FinishedAt = &t
+		}
+
+		if t, err := db.ParseDateTime(runAt); err == nil {
+			job.RunAt = t
+		}
+
+		if t, err := db.ParseDateTime(startedAt); err == nil {
+			job.StartedAt = &t
+		}
+
+		if err := json.Unmarshal([]byte(payload), &job.Payload); err != nil || job.Payload == nil {
+			job.Payload = map[string]any{}
+		}
+
+		// interrupted by the shutdown of the server
+		if job.Status == JobStatusRunning {
+			job.Status = JobStatusQueued
+		}
+
+		jobs.List = append(jobs.List, job)
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	jobs.signal()
+
+	return nil
+}
+
+// Register sets the handler of a kind of job, before the jobs are started.
+func (jobs *Jobs) Register(kind string, handler JobHandler) {
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+
+	jobs.handlers[kind] = handler
+}
+
+// Retry queues again a job that failed or was canceled.
+func (jobs *Jobs) Retry(id uint) (*Job, error) {
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+
+	job := jobs.get(id)
+	if job == nil {
+		return nil, nil
+	}
+
+	if job.IsPending() || job.Status == JobStatusDone {
+		return nil, fmt.Errorf("jobs.retry: job %d is %s", id, job.Status)
+	}
+
+	job.Attempts = 0
+	job.Error = ""
+	job.FinishedAt = nil
+	job.RunAt = time.Now().UTC()
+	job.StartedAt = nil
+	job.Status = JobStatusQueued
+
+	if err := jobs.save(job); err != nil {
+		return nil, err
+	}
+
+	jobs.signal()
+
+	copy := *job
+
+	return &copy, nil
+}
+
+func (jobs *Jobs) Start() error {
+	for i := 0; i < jobsWorkers; i++ {
+		go func() {
+			ticker := time.NewTicker(jobsTick)
+
+			for {
+				for job := jobs.next(); job != nil; job = jobs.next() {
+					jobs.run(job)
+				}
+
+				select {
+				case <-jobs.wake:
+				case <-ticker.C:
+				}
+			}
+		}()
+	}
+
+	return nil
+}
+
+// handle runs the handler of the job, a panic failing the attempt.
+func (jobs *Jobs) handle(handler JobHandler, job *Job) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			jobs.Controller.ReportPanic(NewPanicReport(fmt.Sprintf("jobs.%s", job.Kind), v))
+			err = fmt.Errorf("panic: %v", v)
+		}
+	}()
+
+	return handler(job, job.cancel)
+}
+
+func (jobs *Jobs) get(id uint) *Job {
+	for _, job := range jobs.List {
+		if job.Id == id {
+			return job
+		}
+	}
+	return nil
+}
+
+// next marks the job to run next as running, by order of priority then of
+// creation, if any is due.
+func (jobs *Jobs) next() *Job {
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+
+	var next *Job
+
+	now := time.Now()
+
+	for _, job := range jobs.List {
+		if job.Status != JobStatusQueued || job.RunAt.After(now) {
+			continue
+		}
+
+		if _, ok := jobs.handlers[job.Kind]; !ok {
+			continue
+		}
+
+		if next == nil || job.Priority > next.Priority || (job.Priority == next.Priority && job.CreatedAt.Before(next.CreatedAt)) {
+			next = job
+		}
+	}
+
+	if next == nil {
+		return nil
+	}
+
+	startedAt := now.UTC()
+
+	next.Attempts++
+	next.StartedAt = &startedAt
+	next.Status = JobStatusRunning
+	next.cancel = make(chan struct{})
+
+	if err := jobs.save(next); err != nil {
+		jobs.Controller.Logs.LogEvent(LogLevelError, err.Error())
+	}
+
+	return next
+}
+
+func (jobs *Jobs) run(job *Job) {
+	logs := jobs.Controller.Logs
+
+	jobs.mutex.Lock()
+	handler := jobs.handlers[job.Kind]
+	jobs.mutex.Unlock()
+
+	err := jobs.handle(handler, job)
+
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+
+	now := time.Now().UTC()
+
+	select {
+	case <-job.cancel:
+		job.FinishedAt = &now
+		job.Status = JobStatusCanceled
+		logs.LogEvent(LogLevelWarn, fmt.Sprintf("jobs: %s job %v canceled", job.Kind, job.Id))
+
+	default:
+		if err == nil {
+			job.Error = ""
+			job.FinishedAt = &now
+			job.Status = JobStatusDone
+
+		} else if job.Attempts < job.MaxAttempts {
+			job.Error = err.Error()
+			job.RunAt = now.Add(jobsRetryDelay * time.Duration(1<<(job.Attempts-1)))
+			job.Status = JobStatusQueued
+			logs.LogEvent(LogLevelWarn, fmt.Sprintf("jobs: %s job %v attempt %d of %d failed, retrying at %v, %v", job.Kind, job.Id, job.Attempts, job.MaxAttempts, job.RunAt.Format(time.RFC3339), err))
+
+		} else {
+			job.Error = err.Error()
+			job.FinishedAt = &now
+			job.Status = JobStatusFailed
+			logs.LogEvent(LogLevelError, fmt.Sprintf("jobs: %s job %v failed after %d attempts, %v", job.Kind, job.Id, job.Attempts, err))
+		}
+	}
+
+	if err := jobs.save(job); err != nil {
+		logs.LogEvent(LogLevelError, err.Error())
+	}
+}
+
+func (jobs *Jobs) save(job *Job) error {
+	if _, err := jobs.Controller.Database.Sql.Exec("update `rdioScannerJobs` set `attempts` = ?, `error` = ?, `finishedAt` = ?, `runAt` = ?, `startedAt` = ?, `status` = ? where `_id` = ?", job.Attempts, job.Error, job.FinishedAt, job.RunAt, job.StartedAt, job.Status, job.Id); err != nil {
+		return fmt.Errorf("jobs.save: %v", err)
+	}
+	return nil
+}
+
+func (jobs *Jobs) signal() {
+	select {
+	case jobs.wake <- struct{}{}:
+	default:
+	}
+}
+
+// JobsHandler lists the jobs, queues a new job of a given kind, or retries
+// the failed job given by its id. Deleting a job cancels it.
+func (admin *Admin) JobsHandler(w http.ResponseWriter, r *http.Request) {
+	if !admin.Authorize(w, r, adminWriteRole(r)) {
+		return
+	}
+
+	jobs := admin.Controller.Jobs
+	logs := admin.Controller.Logs
+
+	writeJob := func(job *Job) {
+		if b, err := json.Marshal(job); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+	}
+
+	var id int
+
+	if s := r.URL.Query().Get("id"); len(s) > 0 {
+		var err error
+		if id, err = strconv.Atoi(s); err != nil || id < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodDelete:
+		if id == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		job, err := jobs.Cancel(uint(id))
+		if err != nil {
+			logs.LogEvent(LogLevelWarn, err.Error())
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+
+		if job == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		logs.LogEvent(LogLevelWarn, fmt.Sprintf("jobs: %s job %d canceled by admin from ip %s", job.Kind, id, GetRemoteAddr(r)))
+
+		writeJob(job)
+
+	case http.MethodGet:
+		status := r.URL.Query().Get("status")
+
+		l := []Job{}
+		for _, job := range jobs.GetList() {
+			if len(status) == 0 || job.Status == status {
+				l = append(l, job)
+			}
+		}
+
+		if b, err := json.Marshal(l); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+
+	case http.MethodPost:
+		if id > 0 {
+			job, err := jobs.Retry(uint(id))
+			if err != nil {
+				logs.LogEvent(LogLevelWarn, err.Error())
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+
+			if job == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			logs.LogEvent(LogLevelWarn, fmt.Sprintf("jobs: %s job %d retried by admin from ip %s", job.Kind, id, GetRemoteAddr(r)))
+
+			writeJob(job)
+			return
+		}
+
+		var req struct {
+			Kind     string         `json:"kind"`
+			Payload  map[string]any `json:"payload"`
+			Priority int            `json:"priority"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		job, err := jobs.Enqueue(req.Kind, req.Payload, req.Priority)
+		if err != nil {
+			logs.LogEvent(LogLevelWarn, err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		logs.LogEvent(LogLevelWarn, fmt.Sprintf("jobs: %s job %v queued by admin from ip %s", job.Kind, job.Id, GetRemoteAddr(r)))
+
+		writeJob(job)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,721 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// Kiosk mirrors what a listener session is playing on read-only displays,
+// like the wall-mounted dashboards of a fire station. The session pairs with
+// the token of the kiosk and reports the calls it plays, the displays only
+// get their labels, unit and transcript, never the audio. The last state is
+// persisted so that the displays show it again after a restart.
+type Kiosk struct {
+	Id        any         `json:"_id"`
+	CreatedAt time.Time   `json:"createdAt"`
+	Label     string      `json:"label"`
+	Paired    bool        `json:"paired"`
+	State     *KioskState `json:"state"`
+	Token     string      `json:"token"`
+	displays  map[chan *KioskState]bool
+	source    *Client
+}
+
+type KioskState struct {
+	CallId         any       `json:"callId"`
+	DateTime       any       `json:"dateTime"`
+	Playing        bool      `json:"playing"`
+	System         any       `json:"system"`
+	SystemLabel    any       `json:"systemLabel"`
+	Talkgroup      any       `json:"talkgroup"`
+	TalkgroupLabel any       `json:"talkgroupLabel"`
+	TalkgroupName  any       `json:"talkgroupName"`
+	Transcript     any       `json:"transcript"`
+	Unit           any       `json:"unit"`
+	UnitLabel      any       `json:"unitLabel"`
+	UpdatedAt      time.Time `json:"updatedAt"`
+	redact         bool
+}
+
+func (kiosk *Kiosk) FromMap(m map[string]any) *Kiosk {
+	switch v := m["label"].(type) {
+	case string:
+		kiosk.Label = strings.TrimSpace(v)
+	}
+
+	return kiosk
+}
+
+func (kiosk *Kiosk) broadcast() {
+	for display := range kiosk.displays {
+		select {
+		case display <- kiosk.State:
+		default:
+		}
+	}
+}
+
+type Kiosks struct {
+	Controller *Controller
+	List       []*Kiosk
+	mutex      sync.Mutex
+}
+
+func NewKiosks(controller *Controller) *Kiosks {
+	return &Kiosks{
+		Controller: controller,
+		List:       []*Kiosk{},
+		mutex:      sync.Mutex{},
+	}
+}
+
+func (kiosks *Kiosks) Add(kiosk *Kiosk, db *Database) error {
+	var (
+		err error
+		id  int64
+		res sql.Result
+	)
+
+	kiosks.mutex.Lock()
+	defer kiosks.mutex.Unlock()
+
+	formatError := func(err error) error {
+		return fmt.Errorf("kiosks.add: %v", err)
+	}
+
+	if len(kiosk.Label) == 0 {
+		return formatError(errors.New("no label"))
+	}
+
+	kiosk.CreatedAt = time.Now().UTC()
+	kiosk.State = &KioskState{}
+	kiosk.Token = uuid.New().String()
+	kiosk.displays = map[chan *KioskState]bool{}
+
+	if res, err = db.Sql.Exec("insert into `rdioScannerKiosks` (`createdAt`, `label`, `state`, `token`) values (?, ?, ?, ?)", kiosk.CreatedAt, kiosk.Label, "{}", kiosk.Token); err != nil {
+		return formatError(err)
+	}
+
+	if id, err = res.LastInsertId(); err != nil {
+		return formatError(err)
+	}
+
+	kiosk.Id = uint(id)
+
+	kiosks.List = append(kiosks.List, kiosk)
+
+	return nil
+}
+
+// GetState returns the state of the kiosk of the token.
+func (kiosks *Kiosks) GetState(token string) (*KioskState, bool) {
+	kiosks.mutex.Lock()
+	defer kiosks.mutex.Unlock()
+
+	if kiosk := kiosks.getKiosk(token); kiosk != nil {
+		return kiosk.State, true
+	}
+
+	return nil, false
+}
+
+// Pair makes the client the session mirrored by the kiosk of the token,
+// replacing the session it was paired with. An empty token unpairs the
+// client.
+func (kiosks *Kiosks) Pair(client *Client, token string) (*Kiosk, bool) {
+	kiosks.mutex.Lock()
+	defer kiosks.mutex.Unlock()
+
+	kiosks.unpair(client)
+
+	if len(token) == 0 {
+		return nil, true
+	}
+
+	kiosk := kiosks.getKiosk(token)
+	if kiosk == nil {
+		return nil, false
+	}
+
+	if kiosk.source != nil && kiosk.source != client {
+		kiosks.Controller.Logs.LogEvent(LogLevelInfo, fmt.Sprintf("kiosk: %s paired session from ip %s replaced", kiosk.Label, kiosk.source.GetRemoteAddr()))
+	}
+
+	kiosk.Paired = true
+	kiosk.source = client
+
+	kiosks.Controller.Logs.LogEvent(LogLevelInfo, fmt.Sprintf("kiosk: %s paired with session from ip %s", kiosk.Label, client.GetRemoteAddr()))
+
+	return kiosk, true
+}
+
+// Play updates the kiosks paired with the client with the call it plays, or
+// marks them idle when the call id is nil.
+func (kiosks *Kiosks) Play(client *Client, id any) error {
+	var (
+		call  *Call
+		err   error
+		state = &KioskState{}
+	)
+
+	formatError := func(err error) error {
+		return fmt.Errorf("kiosks.play: %v", err)
+	}
+
+	controller := kiosks.Controller
+
+	if !kiosks.isPaired(client) {
+		return nil
+	}
+
+	switch v := id.(type) {
+	case float64:
+		if call, err = controller.Calls.GetCall(uint(v), controller.Database); errors.Is(err, ErrCallNotFound) {
+			return nil
+		} else if err != nil {
+			return formatError(err)
+		}
+
+		if controller.Accesses.IsRestricted() && !client.GetAccess().HasAccess(call) {
+			return nil
+		}
+
+		tier := client.GetTier()
+		if !tier.IsAvailable(call) {
+			return nil
+		}
+
+		call = tier.RedactCall(call)
+
+		state.CallId = call.Id
+		state.DateTime = call.DateTime
+		state.Playing = true
+		state.System = call.System
+		state.Talkgroup = call.Talkgroup
+		state.Transcript = call.Transcript
+		state.Unit = call.Source
+		state.redact = tier != nil && tier.Redact
+
+		if system, ok := controller.Systems.GetSystem(call.System); ok {
+			state.SystemLabel = system.Label
+
+			if talkgroup, ok := system.Talkgroups.GetSiteTalkgroup(call.Talkgroup, call.Site); ok {
+				state.TalkgroupLabel = talkgroup.Label
+				state.TalkgroupName = talkgroup.Name
+			}
+
+			if unit, ok := call.Source.(uint); ok && system.Units != nil {
+				for _, u := range system.Units.List {
+					if u.Id == unit {
+						state.UnitLabel = u.Label
+					}
+				}
+			}
+		}
+	}
+
+	state.UpdatedAt = time.Now().UTC()
+
+	kiosks.mutex.Lock()
+	defer kiosks.mutex.Unlock()
+
+	for _, kiosk := range kiosks.List {
+		if kiosk.source != client {
+			continue
+		}
+
+		// an idle session keeps showing the last call it played
+		if !state.Playing && kiosk.State != nil && kiosk.State.CallId != nil {
+			idle := *kiosk.State
+			idle.Playing = false
+			idle.UpdatedAt = state.UpdatedAt
+			kiosk.State = &idle
+		} else {
+			kiosk.State = state
+		}
+
+		if err = kiosks.write(kiosk, controller.Database); err != nil {
+			return formatError(err)
+		}
+
+		kiosk.broadcast()
+	}
+
+	return nil
+}
+
+func (kiosks *Kiosks) Read(db *Database) error {
+	var (
+		createdAt any
+		err       error
+		id        sql.NullFloat64
+		rows      *sql.Rows
+		state     string
+	)
+
+	kiosks.mutex.Lock()
+	defer kiosks.mutex.Unlock()
+
+	previous := kiosks.List
+
+	kiosks.List = []*Kiosk{}
+
+	formatError := func(err error) error {
+		return fmt.Errorf("kiosks.read: %v", err)
+	}
+
+	if rows, err = db.Sql.Query("select `_id`, `createdAt`, `label`, `state`, `token` from `rdioScannerKiosks` order by `label`"); err != nil {
+		return formatError(err)
+	}
+
+	for rows.Next() {
+		kiosk := &Kiosk{displays: map[chan *KioskState]bool{}, State: &KioskState{}}
+
+		if err = rows.Scan(&id, &createdAt, &kiosk.Label, &state, &kiosk.Token); err != nil {
+			break
+		}
+
+		if id.Valid && id.Float64 > 0 {
+			kiosk.Id = uint(id.Float64)
+		}
+
+		if t, err := db.ParseDateTime(createdAt); err == nil {
+			kiosk.CreatedAt = t
+		}
+
+		if err = json.Unmarshal([]byte(state), kiosk.State); err != nil {
+			kiosk.State = &KioskState{}
+			err = nil
+		}
+
+		// the paired session and the displays stay connected on reload
+		for _, k := range previous {
+			if k.Token == kiosk.Token {
+				kiosk.Paired = k.Paired
+				kiosk.displays = k.displays
+				kiosk.source = k.source
+				kiosk.State.redact = k.State.redact
+			}
+		}
+
+		kiosks.List = append(kiosks.List, kiosk)
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	return nil
+}
+
+func (kiosks *Kiosks) Remove(id uint, db *Database) (*Kiosk, error) {
+	kiosks.mutex.Lock()
+	defer kiosks.mutex.Unlock()
+
+	for i, kiosk := range kiosks.List {
+		if kiosk.Id != id {
+			continue
+		}
+
+		if _, err := db.Sql.Exec("delete from `rdioScannerKiosks` where `_id` = ?", id); err != nil {
+			return nil, fmt.Errorf("kiosks.remove: %v", err)
+		}
+
+		for display := range kiosk.displays {
+			delete(kiosk.displays, display)
+			close(display)
+		}
+
+		kiosks.List = append(kiosks.List[:i], kiosks.List[i+1:]...)
+
+		return kiosk, nil
+	}
+
+	return nil, nil
+}
+
+// Transcript adds the transcript of the call to the kiosks showing it.
+func (kiosks *Kiosks) Transcript(call *Call, transcript string) {
+	kiosks.mutex.Lock()
+	defer kiosks.mutex.Unlock()
+
+	for _, kiosk := range kiosks.List {
+		if kiosk.source == nil || kiosk.State == nil || kiosk.State.CallId != call.Id || kiosk.State.redact {
+			continue
+		}
+
+		state := *kiosk.State
+		state.Transcript = transcript
+		kiosk.State = &state
+
+		if err := kiosks.write(kiosk, kiosks.Controller.Database); err != nil {
+			kiosks.Controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("kiosks.transcript: %v", err))
+		}
+
+		kiosk.broadcast()
+	}
+}
+
+// Unpair releases the kiosks of a disconnected client, which keep showing
+// the last call that was played.
+func (kiosks *Kiosks) Unpair(client *Client) {
+	kiosks.mutex.Lock()
+	defer kiosks.mutex.Unlock()
+
+	kiosks.unpair(client)
+}
+
+func (kiosks *Kiosks) getKiosk(token string) *Kiosk {
+	if len(token) == 0 {
+		return nil
+	}
+
+	for _, kiosk := range kiosks.List {
+		if kiosk.Token == token {
+			return kiosk
+		}
+	}
+
+	return nil
+}
+
+func (kiosks *Kiosks) isPaired(client *Client) bool {
+	kiosks.mutex.Lock()
+	defer kiosks.mutex.Unlock()
+
+	for _, kiosk := range kiosks.List {
+		if kiosk.source == client {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (kiosks *Kiosks) unpair(client *Client) {
+	for _, kiosk := range kiosks.List {
+		if kiosk.source != client {
+			continue
+		}
+
+		kiosk.Paired = false
+		kiosk.source = nil
+
+		if kiosk.State != nil && kiosk.State.Playing {
+			state := *kiosk.State
+			state.Playing = false
+			state.UpdatedAt = time.Now().UTC()
+			kiosk.State = &state
+
+			if err := kiosks.write(kiosk, kiosks.Controller.Database); err != nil {
+				kiosks.Controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("kiosks.unpair: %v", err))
+			}
+
+			kiosk.broadcast()
+		}
+	}
+}
+
+func (kiosks *Kiosks) write(kiosk *Kiosk, db *Database) error {
+	b, err := json.Marshal(kiosk.State)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Sql.Exec("update `rdioScannerKiosks` set `state` = ? where `_id` = ?", string(b), kiosk.Id)
+
+	return err
+}
+
+func (controller *Controller) ProcessMessageCommandKiosk(client *Client, message *Message) {
+	token, _ := message.Payload.(string)
+
+	kiosk, ok := controller.Kiosks.Pair(client, token)
+	if !ok {
+		controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("kiosk: invalid pairing token from ip %s", client.GetRemoteAddr()))
+		client.Send <- &Message{Command: MessageCommandKiosk, Payload: map[string]any{"paired": false}}
+		return
+	}
+
+	payload := map[string]any{"paired": kiosk != nil}
+	if kiosk != nil {
+		payload["label"] = kiosk.Label
+	}
+
+	client.Send <- &Message{Command: MessageCommandKiosk, Payload: payload}
+}
+
+func (controller *Controller) ProcessMessageCommandNowPlaying(client *Client, message *Message) {
+	if err := controller.Kiosks.Play(client, message.Payload); err != nil {
+		controller.Logs.LogEvent(LogLevelError, err.Error())
+	}
+}
+
+// KioskHandler is the read-only endpoint of the displays. A websocket gets
+// the state of the kiosk each time it changes, a plain request the current
+// state as json, or the html page of the display if it accepts html.
+func (kiosks *Kiosks) KioskHandler(w http.ResponseWriter, r *http.Request) {
+	const (
+		pongWait   = 60 * time.Second
+		pingPeriod = 15 * time.Second
+		writeWait  = 10 * time.Second
+	)
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+
+	state, ok := kiosks.GetState(token)
+	if !ok {
+		kiosks.Controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("kiosk: invalid display token from ip %s", GetRemoteAddr(r)))
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if !strings.EqualFold(r.Header.Get("upgrade"), "websocket") {
+		w.Header().Set("Cache-Control", "no-store")
+
+		if strings.Contains(r.Header.Get("Accept"), "text/html") {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte(kioskPage))
+			return
+		}
+
+		if b, err := json.Marshal(state); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+		return
+	}
+
+	upgrader := websocket.Upgrader{CheckOrigin: checkWebsocketOrigin}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	display := make(chan *KioskState, 16)
+
+	kiosks.mutex.Lock()
+	kiosk := kiosks.getKiosk(token)
+	if kiosk == nil {
+		kiosks.mutex.Unlock()
+		conn.Close()
+		return
+	}
+	kiosk.displays[display] = true
+	kiosks.mutex.Unlock()
+
+	display <- state
+
+	// the displays are read-only, their messages are only read for the pongs
+	// and the close of the connection
+	go func() {
+		defer func() {
+			kiosks.mutex.Lock()
+			if _, ok := kiosk.displays[display]; ok {
+				delete(kiosk.displays, display)
+				close(display)
+			}
+			kiosks.mutex.Unlock()
+		}()
+
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		conn.SetPongHandler(func(string) error {
+			conn.SetReadDeadline(time.Now().Add(pongWait))
+			return nil
+		})
+
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(pingPeriod)
+
+		defer func() {
+			ticker.Stop()
+			conn.Close()
+		}()
+
+		for {
+			select {
+			case state, ok := <-display:
+				if !ok {
+					conn.SetWriteDeadline(time.Now().Add(writeWait))
+					conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+					return
+				}
+
+				b, err := (&Message{Command: MessageCommandKiosk, Payload: state}).ToJson()
+				if err != nil {
+					continue
+				}
+
+				conn.SetWriteDeadline(time.Now().Add(writeWait))
+				if err = conn.WriteMessage(websocket.TextMessage, b); err != nil {
+					return
+				}
+
+			case <-ticker.C:
+				conn.SetWriteDeadline(time.Now().Add(writeWait))
+				if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+					return
+				}
+			}
+		}
+	}()
+}
+
+func (admin *Admin) KiosksHandler(w http.ResponseWriter, r *http.Request) {
+	if !admin.Authorize(w, r, adminWriteRole(r)) {
+		return
+	}
+
+	kiosks := admin.Controller.Kiosks
+	logs := admin.Controller.Logs
+
+	switch r.Method {
+	case http.MethodDelete:
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil || id < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		kiosk, err := kiosks.Remove(uint(id), admin.Controller.Database)
+		if err != nil {
+			logs.LogEvent(LogLevelError, err.Error())
+			w.WriteHeader(http.StatusExpectationFailed)
+			return
+		}
+
+		if kiosk == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		logs.LogEvent(LogLevelWarn, fmt.Sprintf("kiosk: %s removed by admin from ip %s", kiosk.Label, GetRemoteAddr(r)))
+
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodGet:
+		kiosks.mutex.Lock()
+		b, err := json.Marshal(kiosks.List)
+		kiosks.mutex.Unlock()
+
+		if err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+
+	case http.MethodPost:
+		m := map[string]any{}
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		kiosk := (&Kiosk{}).FromMap(m)
+
+		if err := kiosks.Add(kiosk, admin.Controller.Database); err != nil {
+			logs.LogEvent(LogLevelWarn, err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		logs.LogEvent(LogLevelWarn, fmt.Sprintf("kiosk: %s added by admin from ip %s", kiosk.Label, GetRemoteAddr(r)))
+
+		if b, err := json.Marshal(map[string]any{
+			"kiosk": kiosk,
+			"url":   fmt.Sprintf("%s/api/kiosk?token=%s", requestBaseUrl(r), kiosk.Token),
+		}); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+const kioskPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Rdio Scanner</title>
+<style>
+body { background: #000; color: #fff; font-family: sans-serif; margin: 0; padding: 4vh 4vw; }
+#talkgroup { font-size: 12vh; font-weight: bold; }
+#system, #unit, #time { color: #aaa; font-size: 5vh; }
+#transcript { font-size: 5vh; margin-top: 4vh; }
+.idle #talkgroup { color: #666; }
+</style>
+</head>
+<body class="idle">
+<div id="system"></div>
+<div id="talkgroup"></div>
+<div id="unit"></div>
+<div id="time"></div>
+<div id="transcript"></div>
+<script>
+function text(id, v) { document.getElementById(id).textContent = v === null || v === undefined ? '' : v; }
+function show(s) {
+	document.body.className = s.playing ? 'playing' : 'idle';
+	text('system', s.systemLabel);
+	text('talkgroup', s.talkgroupName || s.talkgroupLabel);
+	text('unit', s.unitLabel || s.unit);
+	text('time', s.dateTime ? new Date(s.dateTime).toLocaleString() : '');
+	text('transcript', s.transcript);
+}
+function connect() {
+	var ws = new WebSocket(location.href.replace(/^http/, 'ws'));
+	ws.onmessage = function (ev) { var m = JSON.parse(ev.data); if (m[0] === 'KSK' && m[1]) show(m[1]); };
+	ws.onclose = function () { setTimeout(connect, 5000); };
+}
+connect();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,417 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// the open sessions are saved on this interval, a server that dies without
+// closing them leaves them ended at their last save
+const listenerSessionsFlush = 5 * time.Minute
+
+// ListenerSession is the record of a listener connection, from the moment it
+// got its config to its disconnection, for the admins to audit the usage of
+// their access codes.
+type ListenerSession struct {
+	Id             any             `json:"_id"`
+	Bytes          uint64          `json:"bytes"`
+	Calls          uint            `json:"calls"`
+	Code           string          `json:"code,omitempty"`
+	ConnectedAt    time.Time       `json:"connectedAt"`
+	DisconnectedAt *time.Time      `json:"disconnectedAt,omitempty"`
+	Ident          string          `json:"ident,omitempty"`
+	Ip             string          `json:"ip"`
+	Talkgroups     map[string]uint `json:"talkgroups"`
+	UpdatedAt      time.Time       `json:"updatedAt"`
+	mutex          sync.Mutex
+}
+
+func NewListenerSession(client *Client) *ListenerSession {
+	session := &ListenerSession{
+		ConnectedAt: client.connected.UTC(),
+		Ip:          client.GetRemoteAddr(),
+		Talkgroups:  map[string]uint{},
+	}
+
+	if client.GetAccess() != nil {
+		session.Code = client.GetAccess().Code
+		session.Ident = client.GetAccess().Ident
+	}
+
+	return session
+}
+
+// Track accounts for a message written to the listener.
+func (session *ListenerSession) Track(message *Message, size int) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	session.Bytes += uint64(size)
+
+	if message.Command == MessageCommandCall {
+		if call, ok := message.Payload.(*Call); ok && call != nil {
+			session.Calls++
+			session.Talkgroups[fmt.Sprintf("%d:%d", call.System, call.Talkgroup)]++
+		}
+	}
+}
+
+func (session *ListenerSession) values() (uint64, uint, *time.Time, string, error) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	b, err := json.Marshal(session.Talkgroups)
+	if err != nil {
+		return 0, 0, nil, "", err
+	}
+
+	return session.Bytes, session.Calls, session.DisconnectedAt, string(b), nil
+}
+
+type ListenerSessions struct {
+	Controller *Controller
+	open       map[*ListenerSession]bool
+	mutex      sync.Mutex
+}
+
+func NewListenerSessions(controller *Controller) *ListenerSessions {
+	return &ListenerSessions{
+		Controller: controller,
+		open:       map[*ListenerSession]bool{},
+		mutex:      sync.Mutex{},
+	}
+}
+
+// Close saves the session of a disconnected listener.
+func (sessions *ListenerSessions) Close(session *ListenerSession) error {
+	if session == nil {
+		return nil
+	}
+
+	sessions.mutex.Lock()
+	defer sessions.mutex.Unlock()
+
+	return sessions.close(session)
+}
+
+// CloseAll saves the sessions of the listeners still connected, before the
+// database goes away on shutdown.
+func (sessions *ListenerSessions) CloseAll() error {
+	sessions.mutex.Lock()
+	defer sessions.mutex.Unlock()
+
+	var err error
+
+	for session := range sessions.open {
+		if e := sessions.close(session); e != nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+// Open creates the record of a new listener session.
+func (sessions *ListenerSessions) Open(session *ListenerSession) error {
+	var (
+		bytes          uint64
+		calls          uint
+		disconnectedAt *time.Time
+		err            error
+		id             int64
+		res            sql.Result
+		talkgroups     string
+	)
+
+	if session == nil {
+		return nil
+	}
+
+	sessions.mutex.Lock()
+	defer sessions.mutex.Unlock()
+
+	formatError := func(err error) error {
+		return fmt.Errorf("listenersessions.open: %v", err)
+	}
+
+	if bytes, calls, disconnectedAt, talkgroups, err = session.values(); err != nil {
+		return formatError(err)
+	}
+
+	session.UpdatedAt = time.Now().UTC()
+
+	if res, err = sessions.Controller.Database.Sql.Exec("insert into `rdioScannerListenerSessions` (`bytes`, `calls`, `code`, `connectedAt`, `disconnectedAt`, `ident`, `ip`, `talkgroups`, `updatedAt`) values (?, ?, ?, ?, ?, ?, ?, ?, ?)", bytes, calls, session.Code, session.ConnectedAt, disconnectedAt, session.Ident, session.Ip, talkgroups, session.UpdatedAt); err != nil {
+		return formatError(err)
+	}
+
+	if id, err = res.LastInsertId(); err != nil {
+		return formatError(err)
+	}
+
+	session.Id = uint(id)
+
+	// the listener may have been gone before its session was recorded
+	if disconnectedAt == nil {
+		sessions.open[session] = true
+	}
+
+	return nil
+}
+
+func (sessions *ListenerSessions) Prune(db *Database, pruneDays uint) error {
+	sessions.mutex.Lock()
+	defer sessions.mutex.Unlock()
+
+	if _, err := db.Sql.Exec("delete from `rdioScannerListenerSessions` where `disconnectedAt` < ?", time.Now().Add(-24*time.Hour*time.Duration(pruneDays)).UTC()); err != nil {
+		return fmt.Errorf("listenersessions.prune: %v", err)
+	}
+
+	return nil
+}
+
+func (sessions *ListenerSessions) Search(searchOptions *ListenerSessionsSearchOptions, db *Database) (*ListenerSessionsSearchResults, error) {
+	var (
+		connectedAt    any
+		disconnectedAt any
+		err            error
+		id             sql.NullFloat64
+		limit          uint
+		offset         uint
+		query          *SqlQuery
+		rows           *sql.Rows
+		talkgroups     sql.NullString
+		updatedAt      any
+		where          = []*SqlCondition{}
+	)
+
+	formatError := func(err error) error {
+		return fmt.Errorf("listenersessions.search: %v", err)
+	}
+
+	results := &ListenerSessionsSearchResults{
+		Options:  searchOptions,
+		Sessions: []*ListenerSession{},
+	}
+
+	if len(searchOptions.Code) > 0 {
+		where = append(where, SqlWhere("`code` = ?", searchOptions.Code))
+	}
+
+	if len(searchOptions.Ident) > 0 {
+		where = append(where, SqlWhere("`ident` = ?", searchOptions.Ident))
+	}
+
+	if len(searchOptions.Ip) > 0 {
+		where = append(where, SqlWhere("`ip` = ?", searchOptions.Ip))
+	}
+
+	switch v := searchOptions.From.(type) {
+	case time.Time:
+		where = append(where, SqlWhere("`connectedAt` >= ?", v.UTC()))
+	}
+
+	switch v := searchOptions.To.(type) {
+	case time.Time:
+		where = append(where, SqlWhere("`connectedAt` <= ?", v.UTC()))
+	}
+
+	switch v := searchOptions.Limit.(type) {
+	case uint:
+		limit = uint(math.Min(float64(500), float64(v)))
+	default:
+		limit = 200
+	}
+
+	switch v := searchOptions.Offset.(type) {
+	case uint:
+		offset = v
+	}
+
+	query = db.Select("rdioScannerListenerSessions", "count(*)").Where(where...)
+	if err = query.QueryRow().Scan(&results.Count); err != nil && err != sql.ErrNoRows {
+		return nil, formatError(fmt.Errorf("%v, %v", err, query))
+	}
+
+	query = db.Select("rdioScannerListenerSessions", "_id", "bytes", "calls", "code", "connectedAt", "disconnectedAt", "ident", "ip", "talkgroups", "updatedAt").Where(where...).OrderBy("connectedAt", true).Limit(limit, offset)
+	if rows, err = query.Query(); err != nil && err != sql.ErrNoRows {
+		return nil, formatError(fmt.Errorf("%v, %v", err, query))
+	}
+
+	for rows.Next() {
+		session := &ListenerSession{Talkgroups: map[string]uint{}}
+
+		if err = rows.Scan(&id, &session.Bytes, &session.Calls, &session.Code, &connectedAt, &disconnectedAt, &session.Ident, &session.Ip, &talkgroups, &updatedAt); err != nil {
+			break
+		}
+
+		if id.Valid && id.Float64 > 0 {
+			session.Id = uint(id.Float64)
+		}
+
+		if t, err := db.ParseDateTime(connectedAt); err == nil {
+			session.ConnectedAt = t
+		} else {
+			continue
+		}
+
+		if t, err := db.ParseDateTime(disconnectedAt); err == nil {
+			session.DisconnectedAt = &t
+		}
+
+		if t, err := db.ParseDateTime(updatedAt); err == nil {
+			session.UpdatedAt = t
+		}
+
+		if talkgroups.Valid && len(talkgroups.String) > 0 {
+			json.Unmarshal([]byte(talkgroups.String), &session.Talkgroups)
+		}
+
+		results.Sessions = append(results.Sessions, session)
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return nil, formatError(err)
+	}
+
+	return results, nil
+}
+
+// Start ends the sessions a previous run left open at their last save, then
+// saves the open sessions periodically.
+func (sessions *ListenerSessions) Start() error {
+	if _, err := sessions.Controller.Database.Sql.Exec("update `rdioScannerListenerSessions` set `disconnectedAt` = `updatedAt` where `disconnectedAt` is null"); err != nil {
+		return fmt.Errorf("listenersessions.start: %v", err)
+	}
+
+	go func() {
+		for range time.Tick(listenerSessionsFlush) {
+			if err := sessions.flush(); err != nil {
+				sessions.Controller.Logs.LogEvent(LogLevelError, err.Error())
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (sessions *ListenerSessions) close(session *ListenerSession) error {
+	session.mutex.Lock()
+	if session.DisconnectedAt == nil {
+		t := time.Now().UTC()
+		session.DisconnectedAt = &t
+	}
+	session.mutex.Unlock()
+
+	// not recorded yet, it will be with its disconnection time
+	if session.Id == nil {
+		return nil
+	}
+
+	delete(sessions.open, session)
+
+	if err := sessions.save(session); err != nil {
+		return fmt.Errorf("listenersessions.close: %v", err)
+	}
+
+	return nil
+}
+
+func (sessions *ListenerSessions) flush() error {
+	sessions.mutex.Lock()
+	defer sessions.mutex.Unlock()
+
+	for session := range sessions.open {
+		if err := sessions.save(session); err != nil {
+			return fmt.Errorf("listenersessions.flush: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (sessions *ListenerSessions) save(session *ListenerSession) error {
+	bytes, calls, disconnectedAt, talkgroups, err := session.values()
+	if err != nil {
+		return err
+	}
+
+	session.UpdatedAt = time.Now().UTC()
+
+	_, err = sessions.Controller.Database.Sql.Exec("update `rdioScannerListenerSessions` set `bytes` = ?, `calls` = ?, `disconnectedAt` = ?, `talkgroups` = ?, `updatedAt` = ? where `_id` = ?", bytes, calls, disconnectedAt, talkgroups, session.UpdatedAt, session.Id)
+
+	return err
+}
+
+type ListenerSessionsSearchOptions struct {
+	Code   string `json:"code,omitempty"`
+	From   any    `json:"from,omitempty"`
+	Ident  string `json:"ident,omitempty"`
+	Ip     string `json:"ip,omitempty"`
+	Limit  any    `json:"limit,omitempty"`
+	Offset any    `json:"offset,omitempty"`
+	To     any    `json:"to,omitempty"`
+}
+
+// FromQuery reads the search options from the query string of a request,
+// the dates being either unix timestamps or in rfc3339.
+func (searchOptions *ListenerSessionsSearchOptions) FromQuery(r *http.Request) {
+	q := r.URL.Query()
+
+	parseTime := func(s string) any {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return time.Unix(i, 0)
+		} else if t, err := time.Parse(time.RFC3339, s); err == nil {
+			return t
+		}
+		return nil
+	}
+
+	searchOptions.Code = q.Get("code")
+	searchOptions.Ident = q.Get("ident")
+	searchOptions.Ip = q.Get("ip")
+
+	if s := q.Get("from"); len(s) > 0 {
+		searchOptions.From = parseTime(s)
+	}
+
+	if s := q.Get("to"); len(s) > 0 {
+		searchOptions.To = parseTime(s)
+	}
+
+	if i, err := strconv.Atoi(q.Get("limit")); err == nil && i > 0 {
+		searchOptions.Limit = uint(i)
+	}
+
+	if i, err := strconv.Atoi(q.Get("offset")); err == nil && i > 0 {
+		searchOptions.Offset = uint(i)
+	}
+}
+
+type ListenerSessionsSearchResults struct {
+	Count    uint               `json:"count"`
+	Options  any                `json:"options"`
+	Sessions []*ListenerSession `json:"sessions"`
+}
@@ -20,9 +20,15 @@ import (
 	"sync"
 )
 
+// LivefeedFlagMetadata is the flag of the livefeed map asking for the calls
+// without their audio, which the listener fetches on demand by call id.
+const LivefeedFlagMetadata = "m"
+
 type Livefeed struct {
-	Matrix map[uint]map[uint]bool
-	mutex  sync.Mutex
+	Matrix   map[uint]map[uint]bool
+	metadata bool
+	mutex    sync.Mutex
+	sites    map[uint]uint
 }
 
 func NewLivefeed() *Livefeed {
@@ -82,11 +88,58 @@ func (livefeed *Livefeed) IsAllOff() bool {
 	return true
 }
 
+// IsMetadata tells whether the listener gets the calls without their audio.
+func (livefeed *Livefeed) IsMetadata() bool {
+	livefeed.mutex.Lock()
+	defer livefeed.mutex.Unlock()
+
+	return livefeed.metadata
+}
+
+func (livefeed *Livefeed) SetMetadata(metadata bool) *Livefeed {
+	livefeed.mutex.Lock()
+	defer livefeed.mutex.Unlock()
+
+	livefeed.metadata = metadata
+
+	return livefeed
+}
+
+// SetSites restricts the calls of the systems to the ones of a site, given
+// as a map of system ids to site ids like {"1": 2}. The calls without a site
+// are still delivered.
+func (livefeed *Livefeed) SetSites(f any) *Livefeed {
+	livefeed.mutex.Lock()
+	defer livefeed.mutex.Unlock()
+
+	livefeed.sites = map[uint]uint{}
+
+	switch v := f.(type) {
+	case map[string]any:
+		for s, n := range v {
+			if sysId, err := strconv.Atoi(s); err == nil && sysId > 0 {
+				switch v := n.(type) {
+				case float64:
+					if v > 0 {
+						livefeed.sites[uint(sysId)] = uint(v)
+					}
+				}
+			}
+		}
+	}
+
+	return livefeed
+}
+
 func (livefeed *Livefeed) IsEnabled(call *Call) bool {
 	livefeed.mutex.Lock()
 	defer livefeed.mutex.Unlock()
 
 	if call != nil {
+		if site, ok := livefeed.sites[call.System]; ok && call.Site > 0 && call.Site != site {
+			return false
+		}
+
 		if livefeed.Matrix[call.System][call.Talkgroup] {
 			return true
 		} else {
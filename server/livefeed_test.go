@@ -0,0 +1,120 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLivefeedMetadataFlag(t *testing.T) {
+	controller := &Controller{}
+	client := &Client{Livefeed: NewLivefeed(), Send: make(chan *Message, 8)}
+
+	lfm := map[string]any{"1": map[string]any{"2": true}}
+
+	tests := []struct {
+		flag any
+		want bool
+	}{
+		{flag: LivefeedFlagMetadata, want: true},
+		{flag: nil, want: false},
+		{flag: "x", want: false},
+	}
+
+	for _, test := range tests {
+		controller.ProcessMessageCommandLivefeedMap(client, &Message{Command: MessageCommandLivefeedMap, Payload: lfm, Flag: test.flag})
+
+		if got := client.Livefeed.IsMetadata(); got != test.want {
+			t.Errorf("flag %v: got metadata %v, want %v", test.flag, got, test.want)
+		}
+	}
+}
+
+func TestClientsEmitCallMetadata(t *testing.T) {
+	clients := NewClients()
+
+	full := &Client{Livefeed: NewLivefeed(), Send: make(chan *Message, 8)}
+	metadata := &Client{Livefeed: NewLivefeed(), Send: make(chan *Message, 8)}
+
+	for _, client := range []*Client{full, metadata} {
+		client.Livefeed.Matrix[1] = map[uint]bool{2: true}
+		clients.Map[client] = true
+	}
+	metadata.Livefeed.SetMetadata(true)
+
+	call := &Call{Id: 7, Audio: []byte{1, 2, 3}, System: 1, Talkgroup: 2}
+
+	if count, _ := clients.EmitCall(call, 0, false, 0); count != 2 {
+		t.Fatalf("got %d listeners, want 2", count)
+	}
+
+	message := <-full.Send
+	if message.Flag != nil {
+		t.Errorf("full: got flag %v", message.Flag)
+	}
+	if _, ok, _ := message.ToBinary(); !ok {
+		t.Error("full: want a binary frame with the audio")
+	}
+
+	message = <-metadata.Send
+	if message.Flag != LivefeedFlagMetadata {
+		t.Errorf("metadata: got flag %v, want %v", message.Flag, LivefeedFlagMetadata)
+	}
+	if _, ok, _ := message.ToBinary(); ok {
+		t.Error("metadata: want no binary frame")
+	}
+
+	b, err := message.ToJson()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "\"audio\"") {
+		t.Errorf("metadata: audio sent in %s", b)
+	}
+	if !strings.Contains(string(b), "\"id\":7") {
+		t.Errorf("metadata: call id missing in %s", b)
+	}
+}
+
+func TestLivefeedSites(t *testing.T) {
+	tests := []struct {
+		name  string
+		sites any
+		call  *Call
+		want  bool
+	}{
+		{name: "no filter", call: &Call{System: 1, Talkgroup: 2, Site: 3}, want: true},
+		{name: "site", sites: map[string]any{"1": float64(3)}, call: &Call{System: 1, Talkgroup: 2, Site: 3}, want: true},
+		{name: "other site", sites: map[string]any{"1": float64(4)}, call: &Call{System: 1, Talkgroup: 2, Site: 3}, want: false},
+		{name: "no site", sites: map[string]any{"1": float64(4)}, call: &Call{System: 1, Talkgroup: 2}, want: true},
+		{name: "other system", sites: map[string]any{"2": float64(4)}, call: &Call{System: 1, Talkgroup: 2, Site: 3}, want: true},
+		{name: "all sites", sites: map[string]any{"1": float64(0)}, call: &Call{System: 1, Talkgroup: 2, Site: 3}, want: true},
+		{name: "not a map", sites: "1", call: &Call{System: 1, Talkgroup: 2, Site: 3}, want: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			livefeed := NewLivefeed()
+			livefeed.Matrix[1] = map[uint]bool{2: true}
+			livefeed.SetSites(test.sites)
+
+			if got := livefeed.IsEnabled(test.call); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
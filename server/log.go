@@ -86,29 +86,22 @@ func (logs *Logs) Prune(db *Database, pruneDays uint) error {
 	logs.mutex.Lock()
 	defer logs.mutex.Unlock()
 
-	date := time.Now().Add(-24 * time.Hour * time.Duration(pruneDays)).Format(db.DateTimeFormat)
-	_, err := db.Sql.Exec("delete from `rdioScannerLogs` where `dateTime` < ?", date)
+	_, err := db.Delete("rdioScannerLogs").Where(SqlWhere("`dateTime` < ?", time.Now().Add(-24*time.Hour*time.Duration(pruneDays)))).Exec()
 
 	return err
 }
 
 func (logs *Logs) Search(searchOptions *LogsSearchOptions, db *Database) (*LogsSearchResults, error) {
-	const (
-		ascOrder  = "asc"
-		descOrder = "desc"
-	)
-
 	var (
 		dateTime any
+		desc     bool
 		err      error
 		id       sql.NullFloat64
 		limit    uint
 		offset   uint
-		order    string
-		query    string
+		query    *SqlQuery
 		rows     *sql.Rows
-		where    string = "1=1"
-		args     []any
+		where    = []*SqlCondition{}
 	)
 
 	logs.mutex.Lock()
@@ -123,33 +116,24 @@ func (logs *Logs) Search(searchOptions *LogsSearchOptions, db *Database) (*LogsS
 		Logs:    []Log{},
 	}
 
-	// Build WHERE clause with parameterized queries to prevent SQL injection
 	switch v := searchOptions.Level.(type) {
 	case string:
-		where += " and `level` = ?"
-		args = append(args, v)
+		where = append(where, SqlWhere("`level` = ?", v))
 	}
 
 	switch v := searchOptions.Sort.(type) {
 	case int:
-		if v < 0 {
-			order = descOrder
-		} else {
-			order = ascOrder
-		}
-	default:
-		order = ascOrder
+		desc = v < 0
 	}
 
 	switch v := searchOptions.Date.(type) {
 	case time.Time:
 		var (
-			df    string = db.DateTimeFormat
 			start time.Time
 			stop  time.Time
 		)
 
-		if order == ascOrder {
+		if !desc {
 			start = time.Date(v.Year(), v.Month(), v.Day(), v.Hour(), v.Minute(), 0, 0, time.UTC)
 			stop = start.Add(time.Hour*24 - time.Millisecond)
 
@@ -158,8 +142,7 @@ func (logs *Logs) Search(searchOptions *LogsSearchOptions, db *Database) (*LogsS
 			stop = start.Add(time.Hour*24 - time.Millisecond - time.Duration(v.Hour())).Add(time.Minute * time.Duration(-v.Minute()))
 		}
 
-		where += " and (`dateTime` between ? and ?)"
-		args = append(args, start.Format(df), stop.Format(df))
+		where = append(where, SqlWhere("`dateTime` between ? and ?", start, stop))
 	}
 
 	switch v := searchOptions.Limit.(type) {
@@ -174,9 +157,8 @@ func (logs *Logs) Search(searchOptions *LogsSearchOptions, db *Database) (*LogsS
 		offset = v
 	}
 
-	// Query for date start with parameterized where clause
-	query = fmt.Sprintf("select `dateTime` from `rdioScannerLogs` where %v order by `dateTime` asc", where)
-	if err = db.Sql.QueryRow(query, args...).Scan(&dateTime); err != nil && err != sql.ErrNoRows {
+	query = db.Select("rdioScannerLogs", "dateTime").Where(where...).OrderBy("dateTime", false).Limit(1)
+	if err = query.QueryRow().Scan(&dateTime); err != nil && err != sql.ErrNoRows {
 		return nil, formatError(fmt.Errorf("%v, %v", err, query))
 	}
 
@@ -184,9 +166,8 @@ func (logs *Logs) Search(searchOptions *LogsSearchOptions, db *Database) (*LogsS
 		logResults.DateStart = t
 	}
 
-	// Query for date stop with parameterized where clause
-	query = fmt.Sprintf("select `dateTime` from `rdioScannerLogs` where %v order by `dateTime` desc", where)
-	if err = db.Sql.QueryRow(query, args...).Scan(&dateTime); err != nil && err != sql.ErrNoRows {
+	query = db.Select("rdioScannerLogs", "dateTime").Where(where...).OrderBy("dateTime", true).Limit(1)
+	if err = query.QueryRow().Scan(&dateTime); err != nil && err != sql.ErrNoRows {
 		return nil, formatError(fmt.Errorf("%v, %v", err, query))
 	}
 
@@ -194,16 +175,13 @@ func (logs *Logs) Search(searchOptions *LogsSearchOptions, db *Database) (*LogsS
 		logResults.DateStop = t
 	}
 
-	// Query for count with parameterized where clause
-	query = fmt.Sprintf("select count(*) from `rdioScannerLogs` where %v", where)
-	if err = db.Sql.QueryRow(query, args...).Scan(&logResults.Count); err != nil && err != sql.ErrNoRows {
+	query = db.Select("rdioScannerLogs", "count(*)").Where(where...)
+	if err = query.QueryRow().Scan(&logResults.Count); err != nil && err != sql.ErrNoRows {
 		return nil, formatError(fmt.Errorf("%v, %v", err, query))
 	}
 
-	// Main query with parameterized where clause
-	// Note: limit and offset are safe integers from validated input
-	query = fmt.Sprintf("select `_id`, `DateTime`, `level`, `message` from `rdioScannerLogs` where %v order by `dateTime` %v limit %v offset %v", where, order, limit, offset)
-	if rows, err = db.Sql.Query(query, args...); err != nil && err != sql.ErrNoRows {
+	query = db.Select("rdioScannerLogs", "_id", "dateTime", "level", "message").Where(where...).OrderBy("dateTime", desc).Limit(limit, offset)
+	if rows, err = query.Query(); err != nil && err != sql.ErrNoRows {
 		return nil, formatError(fmt.Errorf("%v, %v", err, query))
 	}
 
@@ -0,0 +1,239 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"encoding/base64"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type testSmtpMessage struct {
+	auth  string
+	data  string
+	from  string
+	rcpts []string
+}
+
+// newTestSmtpServer listens for the emails on localhost, answering just
+// enough of smtp for the mailer.
+func newTestSmtpServer(t *testing.T) (uint, chan testSmtpMessage) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	messages := make(chan testSmtpMessage, 8)
+
+	serve := func(conn net.Conn) {
+		tp := textproto.NewConn(conn)
+		defer tp.Close()
+
+		message := testSmtpMessage{}
+
+		tp.PrintfLine("220 localhost ESMTP")
+
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+
+			verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+			switch verb {
+			case "EHLO":
+				tp.PrintfLine("250-localhost")
+				tp.PrintfLine("250 AUTH PLAIN")
+			case "AUTH":
+				if b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(line, "AUTH PLAIN ")); err == nil {
+					message.auth = string(b)
+				}
+				tp.PrintfLine("235 ok")
+			case "MAIL":
+				message.from = strings.TrimSuffix(strings.TrimPrefix(line, "MAIL FROM:<"), ">")
+				tp.PrintfLine("250 ok")
+			case "RCPT":
+				message.rcpts = append(message.rcpts, strings.TrimSuffix(strings.TrimPrefix(line, "RCPT TO:<"), ">"))
+				tp.PrintfLine("250 ok")
+			case "DATA":
+				tp.PrintfLine("354 go ahead")
+				b, err := tp.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				message.data = string(b)
+				messages <- message
+				tp.PrintfLine("250 ok")
+			case "QUIT":
+				tp.PrintfLine("221 bye")
+				return
+			default:
+				tp.PrintfLine("502 unknown")
+			}
+		}
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+
+	port, _ := strconv.Atoi(strings.TrimPrefix(ln.Addr().String(), "127.0.0.1:"))
+
+	return uint(port), messages
+}
+
+func newTestMailer(port uint) *Mailer {
+	options := NewOptions()
+	options.SmtpFrom = "Rdio Scanner <scanner@example.com>"
+	options.SmtpHost = "127.0.0.1"
+	options.SmtpPort = port
+	options.SmtpTls = SmtpTlsNone
+
+	return NewMailer(&Controller{Options: options})
+}
+
+func TestEmailMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		from    string
+		to      []string
+		subject string
+		want    []string
+		wantErr bool
+	}{
+		{name: "plain", from: "scanner@example.com", to: []string{"a@example.com", "B <b@example.com>"}, subject: "alert", want: []string{"From: scanner@example.com\r\n", "To: a@example.com, b@example.com\r\n", "Subject: alert\r\n", "@example.com>\r\n"}},
+		{name: "header injection", from: "scanner@example.com", to: []string{"a@example.com"}, subject: "alert\r\nBcc: x@example.com", want: []string{"Subject: alert Bcc: x@example.com\r\n"}},
+		{name: "encoded subject", from: "scanner@example.com", to: []string{"a@example.com"}, subject: "caserne é", want: []string{"Subject: =?utf-8?q?caserne_=C3=A9?=\r\n"}},
+		{name: "invalid sender", from: "scanner", to: []string{"a@example.com"}, wantErr: true},
+		{name: "invalid recipient", from: "scanner@example.com", to: []string{"a@example.com\r\nBcc: x@example.com"}, wantErr: true},
+		{name: "no recipient", from: "scanner@example.com", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b, err := emailMessage(test.from, test.to, test.subject, "line 1\nline 2")
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, want error %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			headers, body, _ := strings.Cut(string(b), "\r\n\r\n")
+			for _, want := range test.want {
+				if !strings.Contains(headers+"\r\n", want) {
+					t.Errorf("headers %q do not contain %q", headers, want)
+				}
+			}
+			if strings.Contains(headers, "\nBcc:") {
+				t.Errorf("headers %q were injected", headers)
+			}
+			if body != "line 1\r\nline 2\r\n" {
+				t.Errorf("body = %q", body)
+			}
+		})
+	}
+}
+
+func TestMailerTargets(t *testing.T) {
+	enabled := newTestMailer(25)
+	disabled := NewMailer(&Controller{Options: NewOptions()})
+
+	tests := []struct {
+		name       string
+		mailer     *Mailer
+		target     string
+		available  bool
+		recipients []string
+	}{
+		{"list", enabled, "a@example.com, b@example.com", true, []string{"a@example.com", "b@example.com"}},
+		{"empty", enabled, "", true, []string{}},
+		{"url", disabled, "smtp://mail.example.com?from=s@example.com&to=a@example.com,b@example.com", true, []string{"a@example.com", "b@example.com"}},
+		{"list without server", disabled, "a@example.com", false, []string{"a@example.com"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.mailer.Available(test.target); got != test.available {
+				t.Errorf("Available(%q) = %v, want %v", test.target, got, test.available)
+			}
+			if got := test.mailer.Recipients(test.target); strings.Join(got, ",") != strings.Join(test.recipients, ",") {
+				t.Errorf("Recipients(%q) = %v, want %v", test.target, got, test.recipients)
+			}
+		})
+	}
+}
+
+func TestMailerSendMail(t *testing.T) {
+	port, messages := newTestSmtpServer(t)
+
+	t.Setenv("RDIO_TEST_SMTP_PASSWORD", "secret")
+
+	mailer := newTestMailer(port)
+	mailer.Controller.Options.SmtpUsername = "scanner"
+	mailer.Controller.Options.SmtpPassword = "${env:RDIO_TEST_SMTP_PASSWORD}"
+
+	if err := mailer.Send("a@example.com, B <b@example.com>", nil, "alert", "engine 5"); err != nil {
+		t.Fatal(err)
+	}
+
+	message := <-messages
+
+	if message.from != "scanner@example.com" {
+		t.Errorf("from = %q", message.from)
+	}
+	if strings.Join(message.rcpts, ",") != "a@example.com,b@example.com" {
+		t.Errorf("recipients = %v", message.rcpts)
+	}
+	if message.auth != "\x00scanner\x00secret" {
+		t.Errorf("auth = %q", message.auth)
+	}
+	if !strings.Contains(message.data, "Subject: alert") || !strings.Contains(message.data, "engine 5") {
+		t.Errorf("data = %q", message.data)
+	}
+
+	// the given recipients replace those of the setting
+	if err := mailer.Send("a@example.com", []string{"c@example.com"}, "alert", "engine 5"); err != nil {
+		t.Fatal(err)
+	}
+	if message = <-messages; strings.Join(message.rcpts, ",") != "c@example.com" {
+		t.Errorf("recipients = %v", message.rcpts)
+	}
+
+	// the server does not offer starttls
+	mailer.Controller.Options.SmtpTls = SmtpTlsStarttls
+	if err := mailer.SendMail([]string{"a@example.com"}, "alert", "engine 5"); err == nil || !strings.Contains(err.Error(), "starttls") {
+		t.Errorf("error = %v, want a starttls error", err)
+	}
+
+	mailer.Controller.Options.SmtpHost = ""
+	if err := mailer.SendMail([]string{"a@example.com"}, "alert", "engine 5"); err == nil {
+		t.Error("sent without a smtp server")
+	}
+}
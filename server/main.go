@@ -17,15 +17,16 @@ package main
 
 import (
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
-	"regexp"
 	"strings"
 	"time"
 
@@ -43,6 +44,7 @@ func main() {
 		hostname string
 		sslAddr  string
 		sslPort  string
+		manager  *autocert.Manager
 	)
 
 	config := NewConfig()
@@ -71,6 +73,100 @@ func main() {
 		}
 	}
 
+	if config.restore != "" {
+		count, err := controller.Backups.Restore(config.restore, true)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("backup: %s restored, %d rows", config.restore, count))
+
+		os.Exit(0)
+	}
+
+	if config.exportConfig != "" || config.importConfig != "" {
+		if err := controller.ReadConfig(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if config.exportConfig != "" {
+		bundle, err := controller.Admin.ExportConfig(nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		b, err := json.MarshalIndent(bundle, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err = os.WriteFile(config.exportConfig, b, 0600); err != nil {
+			log.Fatal(fmt.Errorf("export-config: %v", err))
+		}
+
+		fmt.Printf("%s file created\n", config.exportConfig)
+
+		os.Exit(0)
+	}
+
+	if config.importConfig != "" {
+		f, err := os.Open(config.importConfig)
+		if err != nil {
+			log.Fatal(fmt.Errorf("import-config: %v", err))
+		}
+
+		bundle, err := ParseConfigBundle(f)
+		f.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		sections, err := controller.Admin.ImportConfig(bundle, "import-config")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("import-config: %s imported from %s", strings.Join(sections, ", "), config.importConfig))
+
+		os.Exit(0)
+	}
+
+	if config.promote {
+		if len(config.StandbyOf) == 0 {
+			log.Fatal("promote: not a standby, the standby_of setting is not set")
+		}
+
+		if err := replicationPromote(controller.Database); err != nil {
+			log.Fatal(err)
+		}
+
+		controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("promote: promoted to primary, %s no longer followed", config.StandbyOf))
+
+		fmt.Println("promoted to primary, restart the server to take the uploads")
+
+		os.Exit(0)
+	}
+
+	if config.migrateDb != nil {
+		_, from := databaseDsn(config)
+		if _, to := databaseDsn(config.migrateDb); from == to {
+			log.Fatal("migrate-db: the databases are the same")
+		}
+
+		count, err := controller.Database.MigrateTo(NewDatabase(config.migrateDb), func(table string, copied int64, total int64) error {
+			log.Printf("migrate-db: %s %d/%d", table, copied, total)
+			return nil
+		})
+		if err != nil {
+			log.Fatal(fmt.Errorf("migrate-db: %v", err))
+		}
+
+		controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("migrate-db: %d rows copied to the %s database of %s", count, config.migrateDb.DbType, config.migrateDb.GetConfigFilePath()))
+
+		os.Exit(0)
+	}
+
 	fmt.Printf("\nRdio Scanner v%s\n", Version)
 	fmt.Printf("----------------------------------\n")
 
@@ -106,60 +202,152 @@ func main() {
 		sslAddr = defaultAddr
 	}
 
+	http.HandleFunc("/api/admin/airtime", controller.Admin.AirtimeHandler)
+
+	http.HandleFunc("/api/admin/apikeys", controller.Admin.ApikeysHandler)
+
+	http.HandleFunc("/api/admin/archives", controller.Admin.ArchivesHandler)
+
+	http.HandleFunc("/api/admin/backups", controller.Admin.BackupsHandler)
+
+	http.HandleFunc("/api/admin/blackouts", controller.Admin.BlackoutsHandler)
+
+	http.HandleFunc("/api/admin/calls-delete", controller.Admin.CallsDeleteHandler)
+
 	http.HandleFunc("/api/admin/config", controller.Admin.ConfigHandler)
 
+	http.HandleFunc("/api/admin/config-bundle", controller.Admin.ConfigBundleHandler)
+
+	http.HandleFunc("/api/admin/config-versions", controller.Admin.ConfigVersionsHandler)
+
+	http.HandleFunc("/api/admin/digest", controller.Admin.DigestHandler)
+
+	http.HandleFunc("/api/admin/deletion-certificates", controller.Admin.DeletionCertificatesHandler)
+
+	http.HandleFunc("/api/admin/dirwatch-stale", controller.Admin.DirwatchStaleHandler)
+
+	http.HandleFunc("/api/admin/embeds", controller.Admin.EmbedsHandler)
+
+	http.HandleFunc("/api/admin/export", controller.Admin.ExportHandler)
+
+	http.HandleFunc("/api/admin/guest-passes", controller.Admin.GuestPassesHandler)
+
+	http.HandleFunc("/api/admin/incidents", controller.Admin.IncidentsHandler)
+
+	http.HandleFunc("/api/admin/index-advisor", controller.Admin.IndexAdvisorHandler)
+
+	http.HandleFunc("/api/admin/jobs", controller.Admin.JobsHandler)
+
+	http.HandleFunc("/api/admin/kiosks", controller.Admin.KiosksHandler)
+
+	http.HandleFunc("/api/admin/listeners", controller.Admin.ListenersHandler)
+
 	http.HandleFunc("/api/admin/login", controller.Admin.LoginHandler)
 
+	http.HandleFunc("/api/admin/login-failures", controller.Admin.LoginFailuresHandler)
+
 	http.HandleFunc("/api/admin/logout", controller.Admin.LogoutHandler)
 
 	http.HandleFunc("/api/admin/logs", controller.Admin.LogsHandler)
 
+	http.HandleFunc("/api/admin/mailer", controller.Admin.MailerHandler)
+
+	http.HandleFunc("/api/admin/monitoring", controller.Admin.MonitoringHandler)
+
 	http.HandleFunc("/api/admin/password", controller.Admin.PasswordHandler)
 
+	http.HandleFunc("/api/admin/password-reset", controller.Admin.PasswordResetHandler)
+
+	http.HandleFunc("/api/admin/registrations", controller.Admin.RegistrationsHandler)
+
+	http.HandleFunc("/api/admin/replication", controller.Admin.ReplicationHandler)
+
+	http.HandleFunc("/api/admin/skewed-calls", controller.Admin.SkewedCallsHandler)
+
+	http.HandleFunc("/api/admin/stats", controller.Admin.StatsHandler)
+
+	http.HandleFunc("/api/admin/stats/", controller.Admin.SystemStatsHandler)
+
+	http.HandleFunc("/api/admin/search-index", controller.Admin.SearchIndexHandler)
+
+	http.HandleFunc("/api/admin/subscriptions", controller.Admin.SubscriptionsHandler)
+
+	http.HandleFunc("/api/admin/talkgroup-clone", controller.Admin.TalkgroupCloneHandler)
+
+	http.HandleFunc("/api/admin/talkgroups/bulk", controller.Admin.TalkgroupsBulkHandler)
+
+	http.HandleFunc("/api/admin/talkgroups/export", controller.Admin.TalkgroupsExportHandler)
+
+	http.HandleFunc("/api/admin/talkgroups/import", controller.Admin.TalkgroupsImportHandler)
+
+	http.HandleFunc("/api/admin/traces", controller.Admin.TracesHandler)
+
+	http.HandleFunc("/api/admin/transcode", controller.Admin.TranscodeHandler)
+
+	http.HandleFunc("/api/admin/units", controller.Admin.UnitsHandler)
+
 	http.HandleFunc("/api/admin/user-add", controller.Admin.UserAddHandler)
 
 	http.HandleFunc("/api/admin/user-remove", controller.Admin.UserRemoveHandler)
 
+	http.HandleFunc("/api/admin/users", controller.Admin.UsersHandler)
+
 	http.HandleFunc("/api/call-upload", controller.Api.CallUploadHandler)
 
+	http.HandleFunc("/api/call/", controller.Api.CallAudioHandler)
+
+	http.HandleFunc("/api/calls", controller.Api.CallsHandler)
+
+	http.HandleFunc("/api/capabilities", controller.Api.CapabilitiesHandler)
+
+	http.HandleFunc("/api/events", controller.Api.EventsHandler)
+
+	http.HandleFunc("/api/guest", controller.GuestPasses.GuestHandler)
+
+	http.HandleFunc("/api/kiosk", controller.Kiosks.KioskHandler)
+
+	http.HandleFunc("/api/oidc/callback", controller.Oidc.CallbackHandler)
+
+	http.HandleFunc("/api/oidc/login", controller.Oidc.LoginHandler)
+
+	http.HandleFunc("/api/registration", controller.Registrations.RegistrationHandler)
+
+	http.HandleFunc("/api/replication", controller.Api.ReplicationHandler)
+
+	http.HandleFunc("/api/search", controller.Api.SearchHandler)
+
+	http.HandleFunc("/api/share", controller.Shares.ShareHandler)
+
+	http.HandleFunc("/api/subscriptions", controller.Subscriptions.SubscriptionsHandler)
+
+	http.HandleFunc("/api/timeline", controller.Api.TimelineHandler)
+
 	http.HandleFunc("/api/trunk-recorder-call-upload", controller.Api.TrunkRecorderCallUploadHandler)
 
+	http.HandleFunc("/c/", controller.Shares.PageHandler)
+
+	http.HandleFunc("/call/", controller.Shares.PageHandler)
+
+	http.HandleFunc("/embed/", controller.Embeds.EmbedHandler)
+
+	http.HandleFunc("/healthz", controller.Health.HealthzHandler)
+
+	http.HandleFunc("/readyz", controller.Health.ReadyzHandler)
+
+	http.HandleFunc("/stream/", controller.Streams.StreamHandler)
+
+	if config.EnableMetrics {
+		http.HandleFunc("/metrics", controller.Metrics.MetricsHandler)
+	}
+
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		url := r.URL.Path[1:]
+		p := r.URL.Path[1:]
 
 		if strings.EqualFold(r.Header.Get("upgrade"), "websocket") {
 			upgrader := websocket.Upgrader{
-				CheckOrigin: func(r *http.Request) bool {
-					// Validate WebSocket origin to prevent CSRF attacks
-					origin := r.Header.Get("Origin")
-					if origin == "" {
-						// Allow requests without Origin header (non-browser clients)
-						return true
-					}
-
-					// Parse the origin URL
-					originURL, err := url.Parse(origin)
-					if err != nil {
-						return false
-					}
-
-					// Allow same-origin requests
-					if originURL.Host == r.Host {
-						return true
-					}
-
-					// Allow localhost for development (both IPv4 and IPv6)
-					if strings.HasPrefix(originURL.Host, "localhost:") ||
-					   strings.HasPrefix(originURL.Host, "127.0.0.1:") ||
-					   strings.HasPrefix(originURL.Host, "[::1]:") {
-						return true
-					}
-
-					// TODO: Add support for configured trusted origins in options
-					// For now, reject all other origins
-					return false
-				},
+				CheckOrigin:     checkWebsocketOrigin,
 				ReadBufferSize:  1024,
+				Subprotocols:    []string{ProtocolV2},
 				WriteBufferSize: 1024,
 			}
 
@@ -174,63 +362,91 @@ func main() {
 			}
 
 		} else {
-			if url == "" {
-				url = "index.html"
+			if p == "" {
+				p = "index.html"
 			}
 
-			if b, err := webapp.ReadFile(path.Join("webapp", url)); err == nil {
+			if _, ok := controller.Pages.Maintenance(); ok && pagesMaintained(p) {
+				controller.Pages.ServeMaintenance(w, r)
+				return
+			}
+
+			if b, err := webapp.ReadFile(path.Join("webapp", p)); err == nil {
 				var t string
-				switch path.Ext(url) {
+				switch path.Ext(p) {
 				case ".js":
 					t = "text/javascript" // see https://github.com/golang/go/issues/32350
 				default:
-					t = mime.TypeByExtension(path.Ext(url))
+					t = mime.TypeByExtension(path.Ext(p))
 				}
 				w.Header().Set("Content-Type", t)
 				w.Write(b)
 
-			} else if url[:len(url)-1] != "/" {
+			} else if p[:len(p)-1] != "/" {
 				if b, err := webapp.ReadFile("webapp/index.html"); err == nil {
 					w.Write(b)
 
 				} else {
-					w.WriteHeader(http.StatusNotFound)
+					controller.Pages.ServeError(w, r, http.StatusNotFound)
 				}
 
 			} else {
-				w.WriteHeader(http.StatusNotFound)
+				controller.Pages.ServeError(w, r, http.StatusNotFound)
 			}
 		}
 	})
 
+	basePath := config.GetBasePath()
+
 	if port == "80" {
-		log.Printf("main interface at http://%s", hostname)
+		log.Printf("main interface at http://%s%s", hostname, basePath)
 	} else {
-		log.Printf("main interface at http://%s:%s", hostname, port)
+		log.Printf("main interface at http://%s:%s%s", hostname, port, basePath)
 	}
 
 	sslPrintInfo := func() {
 		if sslPort == "443" {
-			log.Printf("main interface at https://%s", hostname)
-			log.Printf("admin interface at https://%s/admin", hostname)
+			log.Printf("main interface at https://%s%s", hostname, basePath)
+			log.Printf("admin interface at https://%s%s/admin", hostname, basePath)
 
 		} else {
-			log.Printf("main interface at https://%s:%s", hostname, sslPort)
-			log.Printf("admin interface at https://%s:%s/admin", hostname, sslPort)
+			log.Printf("main interface at https://%s:%s%s", hostname, sslPort, basePath)
+			log.Printf("admin interface at https://%s:%s%s/admin", hostname, sslPort, basePath)
 		}
 	}
 
-	newServer := func(addr string, tlsConfig *tls.Config) *http.Server {
+	httpRoutes, err := ParseHttpRoutes(config.HttpRoutes)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err = ParseBasePath(config.BasePath); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err = ParseTrustedProxies(config.TrustedProxies); err != nil {
+		log.Fatal(err)
+	}
+
+	handler := httpProxyHandler(config, httpRoutesHandler(httpRoutes, httpRecoverHandler(controller, http.DefaultServeMux)))
+
+	newServer := func(addr string, handler http.Handler, tlsConfig *tls.Config) *http.Server {
 		s := &http.Server{
-			Addr:         addr,
-			TLSConfig:    tlsConfig,
-			ReadTimeout:  30 * time.Second,
-			WriteTimeout: 30 * time.Second,
-			ErrorLog:     log.New(io.Discard, "", 0),
+			Addr:           addr,
+			Handler:        handler,
+			TLSConfig:      tlsConfig,
+			ReadTimeout:    time.Duration(config.HttpReadTimeout) * time.Second,
+			WriteTimeout:   time.Duration(config.HttpWriteTimeout) * time.Second,
+			IdleTimeout:    time.Duration(config.HttpIdleTimeout) * time.Second,
+			MaxHeaderBytes: int(config.HttpMaxHeader),
+			ConnContext:    httpConnContext,
+			ErrorLog:       log.New(io.Discard, "", 0),
 		}
 
 		s.SetKeepAlivesEnabled(true)
 
+		controller.Serve(s)
+
 		return s
 	}
 
@@ -241,56 +457,129 @@ func main() {
 			sslCert := config.GetSslCertFilePath()
 			sslKey := config.GetSslKeyFilePath()
 
-			server := newServer(fmt.Sprintf("%s:%s", sslAddr, sslPort), nil)
+			tlsConfig, err := config.ClientTLSConfig(nil)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			server := newServer(fmt.Sprintf("%s:%s", sslAddr, sslPort), httpsSecurityHandler(config, handler), tlsConfig)
 
-			if err := server.ListenAndServeTLS(sslCert, sslKey); err != nil {
+			if err := server.ListenAndServeTLS(sslCert, sslKey); err != nil && err != http.ErrServerClosed {
 				log.Fatal(err)
 			}
 		}()
 
 	} else if config.SslAutoCert != "" {
+		manager = &autocert.Manager{
+			Cache:      autocert.DirCache("autocert"),
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(config.SslAutoCert),
+		}
+
 		go func() {
 			sslPrintInfo()
 
-			manager := &autocert.Manager{
-				Cache:      autocert.DirCache("autocert"),
-				Prompt:     autocert.AcceptTOS,
-				HostPolicy: autocert.HostWhitelist(config.SslAutoCert),
+			tlsConfig, err := config.ClientTLSConfig(manager.TLSConfig())
+			if err != nil {
+				log.Fatal(err)
 			}
 
-			server := newServer(fmt.Sprintf("%s:%s", sslAddr, sslPort), manager.TLSConfig())
+			server := newServer(fmt.Sprintf("%s:%s", sslAddr, sslPort), httpsSecurityHandler(config, handler), tlsConfig)
 
-			if err := server.ListenAndServeTLS("", ""); err != nil {
+			if err := server.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
 				log.Fatal(err)
 			}
 		}()
 
 	} else if port == "80" {
-		log.Printf("admin interface at http://%s/admin", hostname)
+		log.Printf("admin interface at http://%s%s/admin", hostname, basePath)
 
 	} else {
-		log.Printf("admin interface at http://%s:%s/admin", hostname, port)
+		log.Printf("admin interface at http://%s:%s%s/admin", hostname, port, basePath)
+	}
+
+	plainHandler := handler
+
+	if config.SslRedirect && (len(config.SslCertFile) > 0 && len(config.SslKeyFile) > 0 || manager != nil) {
+		log.Printf("requests at http://%s:%s redirected to https", hostname, port)
+
+		plainHandler = httpProxyHandler(config, httpsRedirectHandler(sslPort, httpRoutesHandler(httpRoutes, httpRecoverHandler(controller, http.DefaultServeMux))))
+	}
+
+	if manager != nil {
+		// answers the http-01 challenges of let's encrypt
+		plainHandler = manager.HTTPHandler(plainHandler)
 	}
 
-	server := newServer(fmt.Sprintf("%s:%s", addr, port), nil)
+	server := newServer(fmt.Sprintf("%s:%s", addr, port), plainHandler, nil)
 
-	if err := server.ListenAndServe(); err != nil {
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
+
+	// wait for the shutdown to complete, terminate exits
+	select {}
 }
 
-func GetRemoteAddr(r *http.Request) string {
-	re := regexp.MustCompile(`(.+):.*$`)
+func checkWebsocketOrigin(r *http.Request) bool {
+	// Validate WebSocket origin to prevent CSRF attacks
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// Allow requests without Origin header (non-browser clients)
+		return true
+	}
 
-	for _, addr := range strings.Split(r.Header.Get("X-Forwarded-For"), ",") {
-		if ip := re.ReplaceAllString(addr, "$1"); len(ip) > 0 {
-			return ip
-		}
+	// Parse the origin URL
+	originURL, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	// Allow same-origin requests
+	if originURL.Host == r.Host {
+		return true
+	}
+
+	// Allow localhost for development (both IPv4 and IPv6)
+	if strings.HasPrefix(originURL.Host, "localhost:") ||
+		strings.HasPrefix(originURL.Host, "127.0.0.1:") ||
+		strings.HasPrefix(originURL.Host, "[::1]:") {
+		return true
 	}
 
-	if ip := re.ReplaceAllString(r.RemoteAddr, "$1"); len(ip) > 0 {
+	// TODO: Add support for configured trusted origins in options
+	// For now, reject all other origins
+	return false
+}
+
+// GetRemoteAddr returns the ip address of the client of the request. The
+// X-Forwarded-For header is only honored from the trusted proxies, read back
+// from the last proxy to the first address which is not a trusted one.
+func GetRemoteAddr(r *http.Request) string {
+	ip := requestPeerAddr(r)
+
+	if !isTrustedProxy(r, ip) {
 		return ip
 	}
 
-	return r.RemoteAddr
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			addr = host
+		}
+
+		if net.ParseIP(addr) == nil {
+			break
+		}
+
+		ip = addr
+
+		if !isTrustedProxy(r, addr) {
+			break
+		}
+	}
+
+	return ip
 }
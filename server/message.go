@@ -21,16 +21,30 @@ import (
 
 const (
 	MessageCommandCall           = "CAL"
+	MessageCommandCaptions       = "CAP"
 	MessageCommandConfig         = "CFG"
+	MessageCommandConfigDelta    = "CFD"
+	MessageCommandCue            = "CUE"
 	MessageCommandExpired        = "XPR"
+	MessageCommandIncidents      = "INC"
 	MessageCommandIOS            = "IOS"
+	MessageCommandKick           = "KCK"
+	MessageCommandKiosk          = "KSK"
+	MessageCommandLatency        = "LAT"
 	MessageCommandListCall       = "LCL"
 	MessagecommandListenersCount = "LSC"
 	MessageCommandLivefeedMap    = "LFM"
 	MessageCommandMax            = "MAX"
+	MessageCommandNowPlaying     = "NPL"
+	MessageCommandOccupancy      = "OCC"
 	MessageCommandPin            = "PIN"
 	MessageCommandPushId         = "PID"
 	MessageCommandServer         = "SRV"
+	MessageCommandShare          = "SHR"
+	MessageCommandSites          = "SIT"
+	MessageCommandSubscriptions  = "SUB"
+	MessageCommandSync           = "SYN"
+	MessageCommandTranscript     = "TRN"
 	MessageCommandVersion        = "VER"
 )
 
@@ -38,6 +52,9 @@ type Message struct {
 	Command any
 	Payload any
 	Flag    any
+	Seq     uint64
+	dropped bool
+	weight  uint
 }
 
 func (message *Message) FromJson(b []byte) error {
@@ -70,6 +87,20 @@ func (message *Message) FromJson(b []byte) error {
 func (message *Message) ToJson() ([]byte, error) {
 	str := []any{message.Command}
 
+	if message.Seq > 0 {
+		var payload, flag any
+
+		if message.Payload != "" {
+			payload = message.Payload
+		}
+
+		if message.Flag != "" {
+			flag = message.Flag
+		}
+
+		return json.Marshal(append(str, payload, flag, message.Seq))
+	}
+
 	if message.Payload != nil && message.Payload != "" {
 		str = append(str, message.Payload)
 	}
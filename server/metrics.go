@@ -0,0 +1,313 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Metrics struct {
+	Controller         *Controller
+	callsIngested      map[uint]uint64
+	callsRejected      map[string]uint64
+	panics             map[string]uint64
+	slowClients        map[string]uint64
+	storageAudioBytes  int64
+	storageAudioCalls  map[string]int64
+	storageDbBytes     int64
+	talkgroupsActivity map[uint]map[uint]uint64
+	uploadErrors       uint64
+	wsBytesSent        map[uint]uint64
+	wsReceived         uint64
+	wsSent             uint64
+	mutex              sync.Mutex
+}
+
+func NewMetrics(controller *Controller) *Metrics {
+	return &Metrics{
+		Controller:         controller,
+		callsIngested:      map[uint]uint64{},
+		callsRejected:      map[string]uint64{},
+		panics:             map[string]uint64{},
+		slowClients:        map[string]uint64{},
+		storageAudioCalls:  map[string]int64{},
+		talkgroupsActivity: map[uint]map[uint]uint64{},
+		wsBytesSent:        map[uint]uint64{},
+		mutex:              sync.Mutex{},
+	}
+}
+
+func (metrics *Metrics) CallIngested(call *Call) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	metrics.callsIngested[call.System]++
+
+	if metrics.talkgroupsActivity[call.System] == nil {
+		metrics.talkgroupsActivity[call.System] = map[uint]uint64{}
+	}
+	metrics.talkgroupsActivity[call.System][call.Talkgroup]++
+}
+
+func (metrics *Metrics) CallRejected(reason string) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	metrics.callsRejected[reason]++
+}
+
+func (metrics *Metrics) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(metrics.render())
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Panic counts the panics recovered per place, see Controller.Recover.
+func (metrics *Metrics) Panic(where string) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	metrics.panics[where]++
+}
+
+// SlowClient counts the calls dropped, the listeners disconnected and those
+// degraded to metadata by the slow client policy.
+func (metrics *Metrics) SlowClient(action string) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	metrics.slowClients[action]++
+}
+
+func (metrics *Metrics) UploadError() {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	metrics.uploadErrors++
+}
+
+func (metrics *Metrics) WebsocketReceived() {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	metrics.wsReceived++
+}
+
+func (metrics *Metrics) WebsocketSent(protocol uint, size int) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	metrics.wsBytesSent[protocol] += uint64(size)
+	metrics.wsSent++
+}
+
+// Start refreshes the storage gauges every minute, their queries scanning
+// the calls being kept away from the scrapes.
+func (metrics *Metrics) Start() error {
+	if !metrics.Controller.Config.EnableMetrics {
+		return nil
+	}
+
+	go func() {
+		metrics.readStorage()
+
+		ticker := time.NewTicker(time.Minute)
+		for range ticker.C {
+			metrics.readStorage()
+		}
+	}()
+
+	return nil
+}
+
+// readStorage measures the audio kept in the database, and counts the calls
+// whose audio is in each store, the external stores having no cheap way to
+// tell their size.
+func (metrics *Metrics) readStorage() {
+	var (
+		audioBytes sql.NullInt64
+		calls      = map[string]int64{}
+		count      int64
+		dbBytes    int64
+		err        error
+	)
+
+	db := metrics.Controller.Database
+
+	if err = db.Select("rdioScannerCalls", "sum(length(`audio`))").QueryRow().Scan(&audioBytes); err != nil {
+		metrics.Controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("metrics.readstorage: %v", err))
+		return
+	}
+
+	external := metrics.Controller.Config.AudioStore
+	if len(external) == 0 || external == AudioStoreDatabase {
+		external = "external"
+	}
+
+	for _, f := range []struct {
+		store string
+		where *SqlCondition
+	}{
+		{AudioStoreDatabase, SqlAnd(SqlWhere("`audioKey` is null"), SqlWhere("`coldAt` is null"))},
+		{external, SqlAnd(SqlWhere("`audioKey` is not null"), SqlWhere("`coldAt` is null"))},
+		{"cold", SqlWhere("`coldAt` is not null")},
+	} {
+		if err = db.Select("rdioScannerCalls", "count(*)").Where(f.where).QueryRow().Scan(&count); err != nil {
+			metrics.Controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("metrics.readstorage: %v", err))
+			return
+		}
+		calls[f.store] = count
+	}
+
+	if dbBytes, err = db.Size(); err != nil {
+		metrics.Controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("metrics.readstorage: %v", err))
+		return
+	}
+
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	if audioBytes.Valid {
+		metrics.storageAudioBytes = audioBytes.Int64
+	}
+	metrics.storageAudioCalls = calls
+	metrics.storageDbBytes = dbBytes
+}
+
+func (metrics *Metrics) render() []byte {
+	var b bytes.Buffer
+
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	header := func(name string, kind string, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	header("rdio_scanner_calls_ingested_total", "counter", "Calls ingested per system.")
+	systemIds := []uint{}
+	for id := range metrics.callsIngested {
+		systemIds = append(systemIds, id)
+	}
+	sortUints(systemIds)
+	for _, id := range systemIds {
+		fmt.Fprintf(&b, "rdio_scanner_calls_ingested_total{system=\"%d\"} %d\n", id, metrics.callsIngested[id])
+	}
+
+	header("rdio_scanner_calls_rejected_total", "counter", "Calls rejected during ingest per reason.")
+	reasons := make([]string, 0, len(metrics.callsRejected))
+	for reason := range metrics.callsRejected {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(&b, "rdio_scanner_calls_rejected_total{reason=%q} %d\n", reason, metrics.callsRejected[reason])
+	}
+
+	header("rdio_scanner_panics_total", "counter", "Panics recovered per place.")
+	places := make([]string, 0, len(metrics.panics))
+	for where := range metrics.panics {
+		places = append(places, where)
+	}
+	sort.Strings(places)
+	for _, where := range places {
+		fmt.Fprintf(&b, "rdio_scanner_panics_total{where=%q} %d\n", where, metrics.panics[where])
+	}
+
+	header("rdio_scanner_talkgroup_calls_total", "counter", "Calls ingested per talkgroup.")
+	systemIds = []uint{}
+	for id := range metrics.talkgroupsActivity {
+		systemIds = append(systemIds, id)
+	}
+	sortUints(systemIds)
+	for _, systemId := range systemIds {
+		talkgroupIds := []uint{}
+		for id := range metrics.talkgroupsActivity[systemId] {
+			talkgroupIds = append(talkgroupIds, id)
+		}
+		sortUints(talkgroupIds)
+		for _, talkgroupId := range talkgroupIds {
+			fmt.Fprintf(&b, "rdio_scanner_talkgroup_calls_total{system=\"%d\",talkgroup=\"%d\"} %d\n", systemId, talkgroupId, metrics.talkgroupsActivity[systemId][talkgroupId])
+		}
+	}
+
+	header("rdio_scanner_upload_errors_total", "counter", "Failed call uploads through the API.")
+	fmt.Fprintf(&b, "rdio_scanner_upload_errors_total %d\n", metrics.uploadErrors)
+
+	header("rdio_scanner_listeners", "gauge", "Connected listeners.")
+	fmt.Fprintf(&b, "rdio_scanner_listeners %d\n", metrics.Controller.Clients.Count())
+
+	header("rdio_scanner_websocket_messages_received_total", "counter", "WebSocket messages received from listeners.")
+	fmt.Fprintf(&b, "rdio_scanner_websocket_messages_received_total %d\n", metrics.wsReceived)
+
+	header("rdio_scanner_websocket_messages_sent_total", "counter", "WebSocket messages sent to listeners.")
+	fmt.Fprintf(&b, "rdio_scanner_websocket_messages_sent_total %d\n", metrics.wsSent)
+
+	header("rdio_scanner_websocket_bytes_sent_total", "counter", "Bytes sent to listeners per protocol version.")
+	protocols := []uint{}
+	for protocol := range metrics.wsBytesSent {
+		protocols = append(protocols, protocol)
+	}
+	sortUints(protocols)
+	for _, protocol := range protocols {
+		fmt.Fprintf(&b, "rdio_scanner_websocket_bytes_sent_total{protocol=\"%d\"} %d\n", protocol, metrics.wsBytesSent[protocol])
+	}
+
+	header("rdio_scanner_websocket_slow_clients_total", "counter", "Actions taken on listeners too slow to keep up, per action.")
+	actions := make([]string, 0, len(metrics.slowClients))
+	for action := range metrics.slowClients {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+	for _, action := range actions {
+		fmt.Fprintf(&b, "rdio_scanner_websocket_slow_clients_total{action=%q} %d\n", action, metrics.slowClients[action])
+	}
+
+	header("rdio_scanner_database_size_bytes", "gauge", "Size of the database.")
+	fmt.Fprintf(&b, "rdio_scanner_database_size_bytes %d\n", metrics.storageDbBytes)
+
+	header("rdio_scanner_database_audio_bytes", "gauge", "Size of the audio kept in the database, that of the external and cold stores excluded.")
+	fmt.Fprintf(&b, "rdio_scanner_database_audio_bytes %d\n", metrics.storageAudioBytes)
+
+	header("rdio_scanner_audio_stored_calls", "gauge", "Calls whose audio is in each store.")
+	stores := make([]string, 0, len(metrics.storageAudioCalls))
+	for store := range metrics.storageAudioCalls {
+		stores = append(stores, store)
+	}
+	sort.Strings(stores)
+	for _, store := range stores {
+		fmt.Fprintf(&b, "rdio_scanner_audio_stored_calls{store=%q} %d\n", store, metrics.storageAudioCalls[store])
+	}
+
+	return b.Bytes()
+}
+
+func sortUints(a []uint) {
+	sort.Slice(a, func(i int, j int) bool {
+		return a[i] < a[j]
+	})
+}
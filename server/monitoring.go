@@ -0,0 +1,306 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+const (
+	// the talkgroups given their label in the legends of a system panel,
+	// busy systems having thousands of them
+	monitoringMaxTalkgroups = 200
+
+	monitoringDefaultJob     = "rdio-scanner"
+	monitoringDefaultSilence = time.Hour
+)
+
+var monitoringJob = regexp.MustCompile(`^[a-zA-Z0-9_:.-]+$`)
+
+// MonitoringHandler generates the monitoring definitions of the instance
+// from the metrics it exposes: a grafana dashboard by default, or with
+// format=prometheus the alerting rules, among which an alert for each
+// system going silent longer than the silence duration.
+func (admin *Admin) MonitoringHandler(w http.ResponseWriter, r *http.Request) {
+	if !admin.Authorize(w, r, AdminRoleViewer) {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	job := monitoringDefaultJob
+	if s := r.URL.Query().Get("job"); len(s) > 0 {
+		if !monitoringJob.MatchString(s) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		job = s
+	}
+
+	silence := monitoringDefaultSilence
+	if s := r.URL.Query().Get("silence"); len(s) > 0 {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < time.Minute {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		silence = d
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "", "grafana":
+		if b, err := json.MarshalIndent(admin.Controller.grafanaDashboard(), "", "  "); err == nil {
+			w.Header().Set("Content-Disposition", "attachment; filename=rdio-scanner-dashboard.json")
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+
+	case "prometheus":
+		w.Header().Set("Content-Disposition", "attachment; filename=rdio-scanner-rules.yml")
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(admin.Controller.prometheusRules(job, silence))
+
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// grafanaDashboard returns a dashboard for the grafana import, asking for
+// the prometheus datasource and selecting the job by a variable.
+func (controller *Controller) grafanaDashboard() map[string]any {
+	var (
+		height int
+		id     int
+		panels = []map[string]any{}
+		x      int
+		y      int
+	)
+
+	datasource := map[string]any{"type": "prometheus", "uid": "${DS_PROMETHEUS}"}
+
+	add := func(title string, kind string, width int, h int, unit string, targets []map[string]any, overrides []map[string]any) {
+		if x+width > 24 {
+			x = 0
+			y += height
+			height = 0
+		}
+
+		if h > height {
+			height = h
+		}
+
+		id++
+
+		for i, target := range targets {
+			target["datasource"] = datasource
+			target["refId"] = string(rune('A' + i))
+		}
+
+		panels = append(panels, map[string]any{
+			"datasource": datasource,
+			"fieldConfig": map[string]any{
+				"defaults":  map[string]any{"unit": unit},
+				"overrides": overrides,
+			},
+			"gridPos": map[string]any{"h": h, "w": width, "x": x, "y": y},
+			"id":      id,
+			"targets": targets,
+			"title":   title,
+			"type":    kind,
+		})
+
+		x += width
+	}
+
+	row := func(title string) {
+		if x > 0 {
+			x = 0
+			y += height
+			height = 0
+		}
+
+		id++
+
+		panels = append(panels, map[string]any{
+			"collapsed": false,
+			"gridPos":   map[string]any{"h": 1, "w": 24, "x": 0, "y": y},
+			"id":        id,
+			"panels":    []any{},
+			"title":     title,
+			"type":      "row",
+		})
+
+		y++
+	}
+
+	target := func(expr string, legend string) map[string]any {
+		return map[string]any{"expr": expr, "legendFormat": legend}
+	}
+
+	row("Overview")
+	add("Listeners", "stat", 4, 5, "none", []map[string]any{target(`sum(rdio_scanner_listeners{job="$job"})`, "")}, []map[string]any{})
+	add("Calls per minute", "stat", 4, 5, "none", []map[string]any{target(`sum(rate(rdio_scanner_calls_ingested_total{job="$job"}[5m])) * 60`, "")}, []map[string]any{})
+	add("Upload errors per hour", "stat", 4, 5, "none", []map[string]any{target(`sum(increase(rdio_scanner_upload_errors_total{job="$job"}[1h]))`, "")}, []map[string]any{})
+	add("Database size", "stat", 6, 5, "bytes", []map[string]any{target(`sum(rdio_scanner_database_size_bytes{job="$job"})`, "")}, []map[string]any{})
+	add("Audio in database", "stat", 6, 5, "bytes", []map[string]any{target(`sum(rdio_scanner_database_audio_bytes{job="$job"})`, "")}, []map[string]any{})
+
+	systems := []map[string]any{}
+
+	for _, system := range controller.Systems.List {
+		systems = append(systems, map[string]any{
+			"matcher":    map[string]any{"id": "byName", "options": fmt.Sprint(system.Id)},
+			"properties": []map[string]any{{"id": "displayName", "value": system.Label}},
+		})
+	}
+
+	row("Ingest")
+	add("Calls per minute by system", "timeseries", 12, 8, "none", []map[string]any{target(`sum by (system) (rate(rdio_scanner_calls_ingested_total{job="$job"}[5m])) * 60`, "{{system}}")}, systems)
+	add("Rejected calls by reason", "timeseries", 12, 8, "none", []map[string]any{target(`sum by (reason) (increase(rdio_scanner_calls_rejected_total{job="$job"}[5m]))`, "{{reason}}")}, []map[string]any{})
+
+	row("Listeners")
+	add("Listeners", "timeseries", 8, 8, "none", []map[string]any{target(`sum(rdio_scanner_listeners{job="$job"})`, "listeners")}, []map[string]any{})
+	add("Bytes sent by protocol", "timeseries", 8, 8, "Bps", []map[string]any{target(`sum by (protocol) (rate(rdio_scanner_websocket_bytes_sent_total{job="$job"}[5m]))`, "v{{protocol}}")}, []map[string]any{})
+	add("Slow listeners by action", "timeseries", 8, 8, "none", []map[string]any{target(`sum by (action) (increase(rdio_scanner_websocket_slow_clients_total{job="$job"}[5m]))`, "{{action}}")}, []map[string]any{})
+
+	for _, system := range controller.Systems.List {
+		seen := map[uint]bool{}
+		talkgroups := []map[string]any{}
+
+		system.Talkgroups.mutex.Lock()
+		for _, talkgroup := range system.Talkgroups.List {
+			if len(talkgroups) >= monitoringMaxTalkgroups {
+				break
+			}
+			// the label of the first site stands for the others
+			if seen[talkgroup.Id] {
+				continue
+			}
+			seen[talkgroup.Id] = true
+			talkgroups = append(talkgroups, map[string]any{
+				"matcher":    map[string]any{"id": "byName", "options": fmt.Sprint(talkgroup.Id)},
+				"properties": []map[string]any{{"id": "displayName", "value": talkgroup.Label}},
+			})
+		}
+		system.Talkgroups.mutex.Unlock()
+
+		row(system.Label)
+		add(fmt.Sprintf("%s calls per minute", system.Label), "timeseries", 12, 8, "none", []map[string]any{target(fmt.Sprintf(`sum(rate(rdio_scanner_calls_ingested_total{job="$job",system="%d"}[5m])) * 60`, system.Id), "calls")}, []map[string]any{})
+		add(fmt.Sprintf("%s busiest talkgroups", system.Label), "timeseries", 12, 8, "none", []map[string]any{target(fmt.Sprintf(`topk(10, sum by (talkgroup) (increase(rdio_scanner_talkgroup_calls_total{job="$job",system="%d"}[15m])))`, system.Id), "{{talkgroup}}")}, talkgroups)
+	}
+
+	branding := controller.Options.Branding
+	if len(branding) == 0 {
+		branding = "Rdio Scanner"
+	}
+
+	return map[string]any{
+		"__inputs": []map[string]any{{
+			"description": "",
+			"label":       "Prometheus",
+			"name":        "DS_PROMETHEUS",
+			"pluginId":    "prometheus",
+			"pluginName":  "Prometheus",
+			"type":        "datasource",
+		}},
+		"editable":      true,
+		"panels":        panels,
+		"refresh":       "1m",
+		"schemaVersion": 36,
+		"tags":          []string{"rdio-scanner"},
+		"templating": map[string]any{
+			"list": []map[string]any{{
+				"datasource": datasource,
+				"definition": "label_values(rdio_scanner_listeners, job)",
+				"label":      "Job",
+				"name":       "job",
+				"query":      map[string]any{"query": "label_values(rdio_scanner_listeners, job)", "refId": "job"},
+				"refresh":    1,
+				"type":       "query",
+			}},
+		},
+		"time":     map[string]any{"from": "now-24h", "to": "now"},
+		"timezone": "",
+		"title":    branding,
+		"uid":      "rdio-scanner",
+		"version":  1,
+	}
+}
+
+// prometheusRules returns the alerting rules, written by hand as yaml like
+// the metrics are in the text format.
+func (controller *Controller) prometheusRules(job string, silence time.Duration) []byte {
+	var b bytes.Buffer
+
+	window := formatPrometheusDuration(silence)
+
+	rule := func(alert string, expr string, duration string, severity string, summary string, system string) {
+		fmt.Fprintf(&b, "      - alert: %s\n", alert)
+		fmt.Fprintf(&b, "        expr: %q\n", expr)
+		fmt.Fprintf(&b, "        for: %s\n", duration)
+		fmt.Fprintf(&b, "        labels:\n")
+		fmt.Fprintf(&b, "          severity: %s\n", severity)
+		if len(system) > 0 {
+			fmt.Fprintf(&b, "          system: %q\n", system)
+		}
+		fmt.Fprintf(&b, "        annotations:\n")
+		fmt.Fprintf(&b, "          summary: %q\n", summary)
+	}
+
+	fmt.Fprintf(&b, "groups:\n")
+	fmt.Fprintf(&b, "  - name: rdio-scanner\n")
+	fmt.Fprintf(&b, "    rules:\n")
+
+	rule("RdioScannerDown", fmt.Sprintf(`up{job=%q} == 0`, job), "5m", "critical", "Rdio Scanner is not answering the metrics scrapes", "")
+	rule("RdioScannerUploadErrors", fmt.Sprintf(`sum(increase(rdio_scanner_upload_errors_total{job=%q}[15m])) > 10`, job), "5m", "warning", "More than 10 call uploads failed in the last 15 minutes", "")
+	rule("RdioScannerCallsRejected", fmt.Sprintf(`sum(increase(rdio_scanner_calls_rejected_total{job=%q,reason=~"backpressure|unknown"}[15m])) > 0`, job), "5m", "warning", "Calls are rejected for backpressure or an unknown system or talkgroup", "")
+	rule("RdioScannerSlowListeners", fmt.Sprintf(`sum(increase(rdio_scanner_websocket_slow_clients_total{job=%q,action="disconnected"}[15m])) > 5`, job), "5m", "info", "Listeners are disconnected for being too slow", "")
+
+	if len(controller.Systems.List) > 0 {
+		fmt.Fprintf(&b, "  - name: rdio-scanner-systems\n")
+		fmt.Fprintf(&b, "    rules:\n")
+
+		for _, system := range controller.Systems.List {
+			expr := fmt.Sprintf(`(sum(increase(rdio_scanner_calls_ingested_total{job=%q,system="%d"}[%s])) or vector(0)) == 0`, job, system.Id, window)
+			summary := fmt.Sprintf("No calls from system %s for %s", system.Label, window)
+
+			rule(fmt.Sprintf("RdioScannerSystemSilent%d", system.Id), expr, "5m", "warning", summary, fmt.Sprint(system.Id))
+		}
+	}
+
+	return b.Bytes()
+}
+
+// formatPrometheusDuration writes a duration the way promql reads it.
+func formatPrometheusDuration(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	default:
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+}
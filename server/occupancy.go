@@ -0,0 +1,229 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// talkgroups are busy at least this long after a call, the duration of
+	// many calls being unknown
+	occupancyHold = 3 * time.Second
+
+	// the changes are sent to the listeners at most once every tick
+	occupancyTick = time.Second
+
+	// calls counted as the recent activity of a talkgroup
+	occupancyWindow = 5 * time.Minute
+)
+
+type occupancyKey struct {
+	system    uint
+	talkgroup uint
+}
+
+type occupancyChannel struct {
+	busy      bool
+	busyUntil time.Time
+	calls     []time.Time
+	count     int
+}
+
+// OccupancyState is the activity of a talkgroup as sent to the listeners.
+type OccupancyState struct {
+	Busy      bool `json:"busy"`
+	Calls     int  `json:"calls"`
+	System    uint `json:"system"`
+	Talkgroup uint `json:"talkgroup"`
+}
+
+// Occupancy tracks which talkgroups are busy, a call being emitted to the
+// listeners, and how many calls they had recently, so that the webapp shows
+// the active channels before they are selected. Only the changes are sent
+// each tick, in memory only.
+type Occupancy struct {
+	Controller *Controller
+	channels   map[occupancyKey]*occupancyChannel
+	mutex      sync.Mutex
+}
+
+func NewOccupancy(controller *Controller) *Occupancy {
+	return &Occupancy{
+		Controller: controller,
+		channels:   map[occupancyKey]*occupancyChannel{},
+		mutex:      sync.Mutex{},
+	}
+}
+
+// Observe marks the talkgroup of the call busy for the duration of the call.
+func (occupancy *Occupancy) Observe(call *Call, now time.Time) {
+	occupancy.mutex.Lock()
+	defer occupancy.mutex.Unlock()
+
+	key := occupancyKey{system: call.System, talkgroup: call.Talkgroup}
+
+	channel, ok := occupancy.channels[key]
+	if !ok {
+		channel = &occupancyChannel{}
+		occupancy.channels[key] = channel
+	}
+
+	hold := call.Duration
+	if hold < occupancyHold {
+		hold = occupancyHold
+	}
+
+	if until := now.Add(hold); until.After(channel.busyUntil) {
+		channel.busyUntil = until
+	}
+
+	channel.calls = append(channel.calls, now)
+}
+
+// Changes returns the talkgroups whose state changed since the last time,
+// forgetting those no longer active.
+func (occupancy *Occupancy) Changes(now time.Time) []OccupancyState {
+	occupancy.mutex.Lock()
+	defer occupancy.mutex.Unlock()
+
+	states := []OccupancyState{}
+
+	for key, channel := range occupancy.channels {
+		channel.prune(now)
+
+		busy := now.Before(channel.busyUntil)
+
+		if busy != channel.busy || len(channel.calls) != channel.count {
+			channel.busy = busy
+			channel.count = len(channel.calls)
+
+			states = append(states, channel.state(key))
+		}
+
+		if !busy && len(channel.calls) == 0 {
+			delete(occupancy.channels, key)
+		}
+	}
+
+	sortOccupancyStates(states)
+
+	return states
+}
+
+// Snapshot returns the state of the active talkgroups as last sent.
+func (occupancy *Occupancy) Snapshot() []OccupancyState {
+	occupancy.mutex.Lock()
+	defer occupancy.mutex.Unlock()
+
+	states := []OccupancyState{}
+
+	for key, channel := range occupancy.channels {
+		if channel.busy || channel.count > 0 {
+			states = append(states, channel.state(key))
+		}
+	}
+
+	sortOccupancyStates(states)
+
+	return states
+}
+
+// Send sends the state of the active talkgroups the listener has access to,
+// which replaces the one the webapp had.
+func (occupancy *Occupancy) Send(client *Client) {
+	controller := occupancy.Controller
+
+	if !controller.Options.ShowOccupancy {
+		return
+	}
+
+	if states, ok := occupancy.scoped(client, occupancy.Snapshot(), controller.Accesses.IsRestricted()); ok {
+		client.Deliver(&Message{Command: MessageCommandOccupancy, Payload: states, Flag: "all"})
+	}
+}
+
+func (occupancy *Occupancy) Start() error {
+	go func() {
+		ticker := time.NewTicker(occupancyTick)
+		for now := range ticker.C {
+			states := occupancy.Changes(now)
+
+			if len(states) > 0 && occupancy.Controller.Options.ShowOccupancy {
+				occupancy.Controller.Clients.EmitOccupancy(occupancy, states, occupancy.Controller.Accesses.IsRestricted())
+			}
+		}
+	}()
+
+	return nil
+}
+
+// scoped returns the states of the talkgroups the listener has access to.
+// The listeners of a delayed tier get none, the indicators would tell of
+// the calls before they are delivered.
+func (occupancy *Occupancy) scoped(client *Client, states []OccupancyState, restricted bool) ([]OccupancyState, bool) {
+	if client.GetTier().GetDelay() > 0 {
+		return nil, false
+	}
+
+	if !restricted {
+		return states, true
+	}
+
+	access := client.GetAccess()
+	if access == nil || access.Systems == nil {
+		return nil, false
+	}
+
+	scoped := []OccupancyState{}
+
+	for _, state := range states {
+		if access.HasAccess(&Call{System: state.System, Talkgroup: state.Talkgroup}) {
+			scoped = append(scoped, state)
+		}
+	}
+
+	return scoped, true
+}
+
+func (channel *occupancyChannel) prune(now time.Time) {
+	i := 0
+	for i < len(channel.calls) && now.Sub(channel.calls[i]) >= occupancyWindow {
+		i++
+	}
+
+	channel.calls = channel.calls[i:]
+}
+
+func (channel *occupancyChannel) state(key occupancyKey) OccupancyState {
+	return OccupancyState{
+		Busy:      channel.busy,
+		Calls:     channel.count,
+		System:    key.system,
+		Talkgroup: key.talkgroup,
+	}
+}
+
+func sortOccupancyStates(states []OccupancyState) {
+	sort.Slice(states, func(i int, j int) bool {
+		if states[i].System != states[j].System {
+			return states[i].System < states[j].System
+		}
+		return states[i].Talkgroup < states[j].Talkgroup
+	})
+}
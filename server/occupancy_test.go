@@ -0,0 +1,150 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOccupancyChanges(t *testing.T) {
+	start := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+
+	type step struct {
+		at    time.Duration
+		calls []*Call
+		want  []OccupancyState
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "busy for the duration of the call",
+			steps: []step{
+				{at: 0, calls: []*Call{{System: 1, Talkgroup: 2, Duration: 10 * time.Second}}, want: []OccupancyState{{Busy: true, Calls: 1, System: 1, Talkgroup: 2}}},
+				{at: 5 * time.Second, want: []OccupancyState{}},
+				{at: 10 * time.Second, want: []OccupancyState{{Busy: false, Calls: 1, System: 1, Talkgroup: 2}}},
+				{at: occupancyWindow, want: []OccupancyState{{Busy: false, Calls: 0, System: 1, Talkgroup: 2}}},
+				{at: occupancyWindow + time.Second, want: []OccupancyState{}},
+			},
+		},
+		{
+			name: "held when the duration is unknown",
+			steps: []step{
+				{at: 0, calls: []*Call{{System: 1, Talkgroup: 2}}, want: []OccupancyState{{Busy: true, Calls: 1, System: 1, Talkgroup: 2}}},
+				{at: occupancyHold - time.Millisecond, want: []OccupancyState{}},
+				{at: occupancyHold, want: []OccupancyState{{Busy: false, Calls: 1, System: 1, Talkgroup: 2}}},
+			},
+		},
+		{
+			name: "recent calls counted",
+			steps: []step{
+				{at: 0, calls: []*Call{{System: 1, Talkgroup: 2}}, want: []OccupancyState{{Busy: true, Calls: 1, System: 1, Talkgroup: 2}}},
+				{at: time.Second, calls: []*Call{{System: 1, Talkgroup: 2}, {System: 1, Talkgroup: 1}}, want: []OccupancyState{{Busy: true, Calls: 1, System: 1, Talkgroup: 1}, {Busy: true, Calls: 2, System: 1, Talkgroup: 2}}},
+				{at: time.Minute, want: []OccupancyState{{Busy: false, Calls: 1, System: 1, Talkgroup: 1}, {Busy: false, Calls: 2, System: 1, Talkgroup: 2}}},
+				{at: occupancyWindow, want: []OccupancyState{{Busy: false, Calls: 1, System: 1, Talkgroup: 2}}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			occupancy := NewOccupancy(nil)
+
+			for _, step := range test.steps {
+				now := start.Add(step.at)
+
+				for _, call := range step.calls {
+					occupancy.Observe(call, now)
+				}
+
+				if got := occupancy.Changes(now); !reflect.DeepEqual(got, step.want) {
+					t.Fatalf("at %v got %v, want %v", step.at, got, step.want)
+				}
+			}
+		})
+	}
+}
+
+func TestOccupancySnapshot(t *testing.T) {
+	now := time.Now()
+
+	occupancy := NewOccupancy(nil)
+	occupancy.Observe(&Call{System: 2, Talkgroup: 1}, now)
+	occupancy.Observe(&Call{System: 1, Talkgroup: 5}, now)
+
+	// not yet sent
+	if got := occupancy.Snapshot(); len(got) != 0 {
+		t.Fatalf("got %v before the changes are sent", got)
+	}
+
+	occupancy.Changes(now)
+
+	want := []OccupancyState{{Busy: true, Calls: 1, System: 1, Talkgroup: 5}, {Busy: true, Calls: 1, System: 2, Talkgroup: 1}}
+	if got := occupancy.Snapshot(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestOccupancyScoped(t *testing.T) {
+	states := []OccupancyState{
+		{Busy: true, Calls: 1, System: 1, Talkgroup: 1},
+		{Busy: true, Calls: 1, System: 1, Talkgroup: 2},
+		{Busy: true, Calls: 1, System: 2, Talkgroup: 1},
+	}
+
+	tests := []struct {
+		name       string
+		access     *Access
+		restricted bool
+		want       []OccupancyState
+		ok         bool
+	}{
+		{name: "unrestricted", restricted: false, want: states, ok: true},
+		{name: "no access", restricted: true, ok: false},
+		{name: "not signed in", access: &Access{}, restricted: true, ok: false},
+		{name: "all systems", access: &Access{Systems: "*"}, restricted: true, want: states, ok: true},
+		{
+			name:       "some talkgroups",
+			access:     &Access{Systems: []any{map[string]any{"id": float64(1), "talkgroups": []any{float64(2)}}}},
+			restricted: true,
+			want:       []OccupancyState{{Busy: true, Calls: 1, System: 1, Talkgroup: 2}},
+			ok:         true,
+		},
+		{name: "delayed tier", access: &Access{Systems: "*", Tier: "delayed"}, restricted: true, ok: false},
+		{name: "delayed tier unrestricted", access: &Access{Tier: "delayed"}, restricted: false, ok: false},
+	}
+
+	controller := &Controller{Tiers: NewTiers()}
+	controller.Tiers.List = []*Tier{{Delay: 60, Name: "delayed"}}
+
+	occupancy := NewOccupancy(controller)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &Client{Controller: controller}
+			client.SetAccess(test.access)
+
+			got, ok := occupancy.scoped(client, states, test.restricted)
+			if ok != test.ok || (ok && !reflect.DeepEqual(got, test.want)) {
+				t.Fatalf("got %v, %v, want %v, %v", got, ok, test.want, test.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,735 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	OidcTargetAdmin    = "admin"
+	OidcTargetListener = "listener"
+)
+
+// Oidc implements the OpenID Connect authorization code flow against an
+// external identity provider. Authenticated admins receive an admin token
+// with the role their groups map to, authenticated listeners receive a
+// signed listener token which the webapp presents in place of an access
+// code. The listener token carries the verified email and the groups of the
+// listener, its systems and tier being mapped from them on every use so
+// that changing the mappings takes effect right away. The emails only count
+// once verified by the provider.
+type Oidc struct {
+	Controller *Controller
+	client     *http.Client
+	keys       map[string]*rsa.PublicKey
+	provider   *OidcProvider
+	states     map[string]*OidcState
+	mutex      sync.Mutex
+}
+
+type OidcProvider struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	Issuer                string `json:"issuer"`
+	JwksUri               string `json:"jwks_uri"`
+	TokenEndpoint         string `json:"token_endpoint"`
+}
+
+type OidcState struct {
+	Created time.Time
+	Nonce   string
+	Target  string
+}
+
+type oidcListenerClaims struct {
+	jwt.RegisteredClaims
+	Email  string   `json:"email,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+// oidcSystemsEntry is a match=systems pair of the oidc_systems setting, the
+// talkgroups of a system being nil for the whole system.
+type oidcSystemsEntry struct {
+	all     bool
+	match   string
+	systems map[uint][]uint
+}
+
+func NewOidc(controller *Controller) *Oidc {
+	return &Oidc{
+		Controller: controller,
+		client:     &http.Client{Timeout: 15 * time.Second},
+		keys:       map[string]*rsa.PublicKey{},
+		states:     map[string]*OidcState{},
+		mutex:      sync.Mutex{},
+	}
+}
+
+func (oidc *Oidc) CallbackHandler(w http.ResponseWriter, r *http.Request) {
+	logs := oidc.Controller.Logs
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	oidc.mutex.Lock()
+	state := oidc.states[r.URL.Query().Get("state")]
+	delete(oidc.states, r.URL.Query().Get("state"))
+	oidc.mutex.Unlock()
+
+	if state == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if e := r.URL.Query().Get("error"); len(e) > 0 {
+		logs.LogEvent(LogLevelWarn, fmt.Sprintf("oidc: provider returned %s for ip %s", e, GetRemoteAddr(r)))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	claims, err := oidc.exchange(r.URL.Query().Get("code"), state.Nonce)
+	if err != nil {
+		logs.LogEvent(LogLevelWarn, fmt.Sprintf("oidc: %s for ip %s", err.Error(), GetRemoteAddr(r)))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	ident := oidcIdent(claims)
+
+	var script string
+
+	switch state.Target {
+	case OidcTargetAdmin:
+		if !oidcMatches(oidc.Controller.Config.OidcAdmins, claims) {
+			logs.LogEvent(LogLevelWarn, fmt.Sprintf("oidc: %s is not an admin, ip %s", ident, GetRemoteAddr(r)))
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		role := oidcRole(oidc.Controller.Config.OidcAdminRoles, claims)
+
+		token, err := oidc.Controller.Admin.NewOidcToken(ident, role)
+		if err != nil {
+			w.WriteHeader(http.StatusExpectationFailed)
+			return
+		}
+
+		logs.LogEvent(LogLevelInfo, fmt.Sprintf("oidc: admin login for %s with role %s from ip %s", ident, role, GetRemoteAddr(r)))
+
+		b, _ := json.Marshal(token)
+		script = fmt.Sprintf("sessionStorage.setItem('rdio-scanner-admin-token',%s);location.replace('../../admin');", b)
+
+	default:
+		if !oidcMatches(oidc.Controller.Config.OidcListeners, claims) {
+			logs.LogEvent(LogLevelWarn, fmt.Sprintf("oidc: %s is not allowed to listen, ip %s", ident, GetRemoteAddr(r)))
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if _, ok := oidcSystems(oidc.Controller.Config.OidcSystems, claims); !ok {
+			logs.LogEvent(LogLevelWarn, fmt.Sprintf("oidc: %s has no systems to listen to, ip %s", ident, GetRemoteAddr(r)))
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		token, err := oidc.newListenerToken(ident, claims)
+		if err != nil {
+			w.WriteHeader(http.StatusExpectationFailed)
+			return
+		}
+
+		logs.LogEvent(LogLevelInfo, fmt.Sprintf("oidc: listener login for %s from ip %s", ident, GetRemoteAddr(r)))
+
+		b, _ := json.Marshal(base64.StdEncoding.EncodeToString([]byte(token)))
+		script = fmt.Sprintf("localStorage.setItem('rdio-scanner-pin',%s);location.replace('../../');", b)
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<!DOCTYPE html><html><head><meta charset=\"utf-8\"></head><body><script>%s</script></body></html>", script)
+}
+
+func (oidc *Oidc) Enabled() bool {
+	config := oidc.Controller.Config
+
+	return len(config.OidcIssuer) > 0 && len(config.OidcClientId) > 0
+}
+
+// GetListenerAccess returns an access for a listener token issued by
+// the callback handler, or false if the code is not such a token.
+func (oidc *Oidc) GetListenerAccess(code string) (*Access, bool) {
+	if !oidc.Enabled() || len(oidc.Controller.Config.OidcListeners) == 0 {
+		return nil, false
+	}
+
+	claims := &oidcListenerClaims{}
+
+	token, err := jwt.ParseWithClaims(code, claims, func(token *jwt.Token) (any, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(oidc.Controller.Options.secret), nil
+	})
+	if err != nil || !token.Valid || !claims.VerifyAudience(OidcTargetListener, true) {
+		return nil, false
+	}
+
+	config := oidc.Controller.Config
+	mapClaims := claims.mapClaims()
+
+	if !oidcMatches(config.OidcListeners, mapClaims) {
+		return nil, false
+	}
+
+	systems, ok := oidcSystems(config.OidcSystems, mapClaims)
+	if !ok {
+		return nil, false
+	}
+
+	access := NewAccess()
+	access.Ident = claims.Subject
+	access.Expiration = claims.ExpiresAt.Time
+	access.Systems = systems
+
+	if tier := oidcTier(config.OidcTiers, mapClaims); len(tier) > 0 {
+		access.Tier = tier
+	}
+
+	return access, true
+}
+
+func (oidc *Oidc) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	const stateTtl = 10 * time.Minute
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !oidc.Enabled() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	target := r.URL.Query().Get("target")
+	if target != OidcTargetAdmin {
+		target = OidcTargetListener
+	}
+
+	provider, err := oidc.getProvider()
+	if err != nil {
+		oidc.Controller.Logs.LogEvent(LogLevelError, err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	state := &OidcState{Created: time.Now(), Nonce: oidcRandom(), Target: target}
+	key := oidcRandom()
+
+	oidc.mutex.Lock()
+	for k, s := range oidc.states {
+		if time.Since(s.Created) > stateTtl {
+			delete(oidc.states, k)
+		}
+	}
+	oidc.states[key] = state
+	oidc.mutex.Unlock()
+
+	q := url.Values{}
+	q.Set("client_id", oidc.Controller.Config.OidcClientId)
+	q.Set("nonce", state.Nonce)
+	q.Set("redirect_uri", oidc.redirectUri())
+	q.Set("response_type", "code")
+	q.Set("scope", "openid email profile")
+	q.Set("state", key)
+
+	sep := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+
+	http.Redirect(w, r, provider.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+func (oidc *Oidc) exchange(code string, nonce string) (jwt.MapClaims, error) {
+	provider, err := oidc.getProvider()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("client_id", oidc.Controller.Config.OidcClientId)
+	form.Set("client_secret", oidc.Controller.Config.OidcClientSecret)
+	form.Set("code", code)
+	form.Set("grant_type", "authorization_code")
+	form.Set("redirect_uri", oidc.redirectUri())
+
+	res, err := oidc.client.PostForm(provider.TokenEndpoint, form)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned %s", res.Status)
+	}
+
+	m := map[string]any{}
+	if err = json.NewDecoder(res.Body).Decode(&m); err != nil {
+		return nil, err
+	}
+
+	idToken, ok := m["id_token"].(string)
+	if !ok {
+		return nil, errors.New("no id_token in token response")
+	}
+
+	claims := jwt.MapClaims{}
+
+	if _, err = jwt.ParseWithClaims(idToken, claims, oidc.keyFunc); err != nil {
+		return nil, err
+	}
+
+	if !claims.VerifyIssuer(provider.Issuer, true) {
+		return nil, errors.New("invalid id_token issuer")
+	}
+
+	if !claims.VerifyAudience(oidc.Controller.Config.OidcClientId, true) {
+		return nil, errors.New("invalid id_token audience")
+	}
+
+	if claims["nonce"] != nonce {
+		return nil, errors.New("invalid id_token nonce")
+	}
+
+	return claims, nil
+}
+
+func (oidc *Oidc) fetchJson(u string, v any) error {
+	res, err := oidc.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", u, res.Status)
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func (oidc *Oidc) getProvider() (*OidcProvider, error) {
+	oidc.mutex.Lock()
+	defer oidc.mutex.Unlock()
+
+	if oidc.provider != nil {
+		return oidc.provider, nil
+	}
+
+	provider := &OidcProvider{}
+
+	u := strings.TrimSuffix(oidc.Controller.Config.OidcIssuer, "/") + "/.well-known/openid-configuration"
+	if err := oidc.fetchJson(u, provider); err != nil {
+		return nil, fmt.Errorf("oidc.discovery: %v", err)
+	}
+
+	oidc.provider = provider
+
+	return provider, nil
+}
+
+func (oidc *Oidc) keyFunc(token *jwt.Token) (any, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+
+	kid, _ := token.Header["kid"].(string)
+
+	oidc.mutex.Lock()
+	key := oidc.keys[kid]
+	oidc.mutex.Unlock()
+
+	if key != nil {
+		return key, nil
+	}
+
+	// unknown key id, the provider may have rotated its keys
+	if err := oidc.refreshKeys(); err != nil {
+		return nil, err
+	}
+
+	oidc.mutex.Lock()
+	defer oidc.mutex.Unlock()
+
+	if key = oidc.keys[kid]; key == nil {
+		return nil, fmt.Errorf("unknown key id %s", kid)
+	}
+
+	return key, nil
+}
+
+func (oidc *Oidc) newListenerToken(ident string, claims jwt.MapClaims) (string, error) {
+	const listenerTtl = 7 * 24 * time.Hour
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, oidcListenerClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{OidcTargetListener},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(listenerTtl)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			Subject:   ident,
+		},
+		Email:  oidcEmail(claims),
+		Groups: oidcGroups(claims),
+	})
+
+	return token.SignedString([]byte(oidc.Controller.Options.secret))
+}
+
+func (oidc *Oidc) redirectUri() string {
+	return strings.TrimSuffix(oidc.Controller.Config.OidcPublicUrl, "/") + "/api/oidc/callback"
+}
+
+func (oidc *Oidc) refreshKeys() error {
+	var jwks struct {
+		Keys []struct {
+			E   string `json:"e"`
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		} `json:"keys"`
+	}
+
+	provider, err := oidc.getProvider()
+	if err != nil {
+		return err
+	}
+
+	if err = oidc.fetchJson(provider.JwksUri, &jwks); err != nil {
+		return fmt.Errorf("oidc.jwks: %v", err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+
+		keys[k.Kid] = &rsa.PublicKey{
+			E: int(new(big.Int).SetBytes(e).Int64()),
+			N: new(big.Int).SetBytes(n),
+		}
+	}
+
+	oidc.mutex.Lock()
+	oidc.keys = keys
+	oidc.mutex.Unlock()
+
+	return nil
+}
+
+func oidcIdent(claims jwt.MapClaims) string {
+	for _, k := range []string{"email", "preferred_username", "sub"} {
+		if v, ok := claims[k].(string); ok && len(v) > 0 {
+			return v
+		}
+	}
+
+	return "unknown"
+}
+
+// mapClaims gives back the claims of the provider the token was issued for.
+func (claims *oidcListenerClaims) mapClaims() jwt.MapClaims {
+	m := jwt.MapClaims{}
+
+	if len(claims.Email) > 0 {
+		m["email"] = claims.Email
+		m["email_verified"] = true
+	}
+
+	groups := []any{}
+	for _, g := range claims.Groups {
+		groups = append(groups, g)
+	}
+	m["groups"] = groups
+
+	return m
+}
+
+// oidcEmail returns the email of the claims in lower case, only if the
+// provider verified it.
+func oidcEmail(claims jwt.MapClaims) string {
+	email, _ := claims["email"].(string)
+
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		if v {
+			return strings.ToLower(email)
+		}
+	case string:
+		// some providers send it as a string
+		if v == "true" {
+			return strings.ToLower(email)
+		}
+	}
+
+	return ""
+}
+
+func oidcGroups(claims jwt.MapClaims) []string {
+	groups := []string{}
+
+	switch v := claims["groups"].(type) {
+	case []any:
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				groups = append(groups, strings.TrimPrefix(s, "/"))
+			}
+		}
+	}
+
+	return groups
+}
+
+// oidcMatches checks the claims against a comma separated list of email
+// addresses, @domains or group names. A single * matches everyone. The
+// emails must be verified by the provider.
+func oidcMatches(list string, claims jwt.MapClaims) bool {
+	email := oidcEmail(claims)
+	groups := oidcGroups(claims)
+
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+
+		switch {
+		case len(entry) == 0:
+			continue
+
+		case entry == "*":
+			return true
+
+		case strings.HasPrefix(entry, "@"):
+			if len(email) > 0 && strings.HasSuffix(email, strings.ToLower(entry)) {
+				return true
+			}
+
+		case strings.Contains(entry, "@"):
+			if email == strings.ToLower(entry) {
+				return true
+			}
+
+		default:
+			for _, g := range groups {
+				if g == entry {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// oidcTier returns the tier of the first entry of a comma separated list of
+// match=tier pairs whose match accepts the claims, the matches being the
+// same as for oidcMatches.
+func oidcTier(list string, claims jwt.MapClaims) string {
+	for _, entry := range strings.Split(list, ",") {
+		if match, tier, ok := strings.Cut(entry, "="); ok && oidcMatches(match, claims) {
+			return strings.TrimSpace(tier)
+		}
+	}
+
+	return ""
+}
+
+// oidcParseSystems reads the match=systems pairs of the oidc_systems
+// setting, where systems is * or a + separated list of system ids, each with
+// its / separated talkgroups after a colon when not the whole system.
+func oidcParseSystems(list string) ([]oidcSystemsEntry, error) {
+	entries := []oidcSystemsEntry{}
+
+	for _, pair := range strings.Split(list, ",") {
+		if len(strings.TrimSpace(pair)) == 0 {
+			continue
+		}
+
+		match, spec, ok := strings.Cut(pair, "=")
+		match, spec = strings.TrimSpace(match), strings.TrimSpace(spec)
+		if !ok || len(match) == 0 || len(spec) == 0 {
+			return nil, fmt.Errorf("%q is not a match=systems pair", strings.TrimSpace(pair))
+		}
+
+		entry := oidcSystemsEntry{match: match, systems: map[uint][]uint{}}
+
+		if spec == "*" {
+			entry.all = true
+			entries = append(entries, entry)
+			continue
+		}
+
+		for _, s := range strings.Split(spec, "+") {
+			id, tgs, _ := strings.Cut(strings.TrimSpace(s), ":")
+
+			systemId, err := strconv.ParseUint(id, 10, 32)
+			if err != nil || systemId == 0 {
+				return nil, fmt.Errorf("%q is not a system id", id)
+			}
+
+			if len(tgs) == 0 {
+				entry.systems[uint(systemId)] = nil
+				continue
+			}
+
+			talkgroups := []uint{}
+			for _, tg := range strings.Split(tgs, "/") {
+				talkgroupId, err := strconv.ParseUint(strings.TrimSpace(tg), 10, 32)
+				if err != nil || talkgroupId == 0 {
+					return nil, fmt.Errorf("%q is not a talkgroup id", tg)
+				}
+				talkgroups = append(talkgroups, uint(talkgroupId))
+			}
+
+			entry.systems[uint(systemId)] = talkgroups
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// oidcRole returns the admin role of the first entry of a comma separated
+// list of match=role pairs whose match accepts the claims, viewer when none
+// does. Without any pair the admins are superadmins.
+func oidcRole(list string, claims jwt.MapClaims) string {
+	if len(strings.TrimSpace(list)) == 0 {
+		return AdminRoleSuperadmin
+	}
+
+	for _, entry := range strings.Split(list, ",") {
+		if match, role, ok := strings.Cut(entry, "="); ok && oidcMatches(match, claims) {
+			if role = strings.TrimSpace(role); adminRoleRank(role) > 0 {
+				return role
+			}
+		}
+	}
+
+	return AdminRoleViewer
+}
+
+// oidcSystems returns the systems of the access of a listener, as those of
+// the access codes, gathered from every pair of the oidc_systems setting
+// whose match accepts the claims. Without any pair the listeners get every
+// system, false is returned when pairs are set but none matches.
+func oidcSystems(list string, claims jwt.MapClaims) (any, bool) {
+	if len(strings.TrimSpace(list)) == 0 {
+		return "*", true
+	}
+
+	entries, err := oidcParseSystems(list)
+	if err != nil {
+		return nil, false
+	}
+
+	matched := false
+	systems := map[uint][]uint{}
+
+	for _, entry := range entries {
+		if !oidcMatches(entry.match, claims) {
+			continue
+		}
+
+		if entry.all {
+			return "*", true
+		}
+
+		matched = true
+
+		for id, talkgroups := range entry.systems {
+			current, ok := systems[id]
+
+			switch {
+			case ok && current == nil:
+			case talkgroups == nil:
+				systems[id] = nil
+			default:
+				systems[id] = append(current, talkgroups...)
+			}
+		}
+	}
+
+	if !matched {
+		return nil, false
+	}
+
+	ids := []uint{}
+	for id := range systems {
+		ids = append(ids, id)
+	}
+	sortUints(ids)
+
+	access := []any{}
+
+	for _, id := range ids {
+		var talkgroups any = "*"
+
+		if systems[id] != nil {
+			tgs := []any{}
+			for _, tg := range systems[id] {
+				tgs = append(tgs, float64(tg))
+			}
+			talkgroups = tgs
+		}
+
+		access = append(access, map[string]any{"id": float64(id), "talkgroups": talkgroups})
+	}
+
+	return access, true
+}
+
+func oidcRandom() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,200 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestOidcMatches(t *testing.T) {
+	verified := jwt.MapClaims{"email": "Jane@Example.org", "email_verified": true, "groups": []any{"/dispatch", "fire"}}
+	unverified := jwt.MapClaims{"email": "jane@example.org", "email_verified": false}
+	stringVerified := jwt.MapClaims{"email": "jane@example.org", "email_verified": "true"}
+	missing := jwt.MapClaims{"email": "jane@example.org"}
+
+	tests := []struct {
+		name   string
+		list   string
+		claims jwt.MapClaims
+		want   bool
+	}{
+		{"wildcard", "*", jwt.MapClaims{}, true},
+		{"empty list", "", verified, false},
+		{"domain verified", "@example.org", verified, true},
+		{"domain unverified", "@example.org", unverified, false},
+		{"domain without email_verified", "@example.org", missing, false},
+		{"domain verified as a string", "@example.org", stringVerified, true},
+		{"other domain", "@example.com", verified, false},
+		{"domain suffix only", "@ample.org", verified, false},
+		{"exact email", "nobody@x.org, jane@example.org", verified, true},
+		{"exact email unverified", "jane@example.org", unverified, false},
+		{"group with slash prefix", "dispatch", verified, true},
+		{"group", "police,fire", verified, true},
+		{"unknown group", "police", verified, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := oidcMatches(test.list, test.claims); got != test.want {
+				t.Errorf("oidcMatches(%q) = %v, want %v", test.list, got, test.want)
+			}
+		})
+	}
+}
+
+func TestOidcTier(t *testing.T) {
+	claims := jwt.MapClaims{"email": "jane@example.org", "email_verified": true, "groups": []any{"dispatch"}}
+
+	tests := []struct {
+		name string
+		list string
+		want string
+	}{
+		{"no tiers", "", ""},
+		{"first match wins", "dispatch=dispatcher,@example.org=public", "dispatcher"},
+		{"domain", "police=dispatcher, @example.org = public", "public"},
+		{"no match", "police=dispatcher", ""},
+		{"malformed pair", "dispatch", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := oidcTier(test.list, claims); got != test.want {
+				t.Errorf("oidcTier(%q) = %q, want %q", test.list, got, test.want)
+			}
+		})
+	}
+}
+
+func TestOidcRole(t *testing.T) {
+	claims := jwt.MapClaims{"groups": []any{"dispatch"}}
+
+	tests := []struct {
+		name string
+		list string
+		want string
+	}{
+		{"no roles", "", AdminRoleSuperadmin},
+		{"match", "it=superadmin,dispatch=config-editor", AdminRoleConfigEditor},
+		{"no match", "it=superadmin", AdminRoleViewer},
+		{"unknown role", "dispatch=root", AdminRoleViewer},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := oidcRole(test.list, claims); got != test.want {
+				t.Errorf("oidcRole(%q) = %q, want %q", test.list, got, test.want)
+			}
+		})
+	}
+}
+
+func TestOidcParseSystems(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    string
+		want    []oidcSystemsEntry
+		wantErr bool
+	}{
+		{"empty", "", []oidcSystemsEntry{}, false},
+		{"all", "fire=*", []oidcSystemsEntry{{all: true, match: "fire", systems: map[uint][]uint{}}}, false},
+		{
+			name: "systems and talkgroups",
+			list: "fire = 1+2:300/301, police=2",
+			want: []oidcSystemsEntry{
+				{match: "fire", systems: map[uint][]uint{1: nil, 2: {300, 301}}},
+				{match: "police", systems: map[uint][]uint{2: nil}},
+			},
+		},
+		{"no systems", "fire=", nil, true},
+		{"no pair", "fire", nil, true},
+		{"bad system", "fire=x", nil, true},
+		{"zero system", "fire=0", nil, true},
+		{"bad talkgroup", "fire=1:a", nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := oidcParseSystems(test.list)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("oidcParseSystems(%q) error = %v, want error %v", test.list, err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("oidcParseSystems(%q) = %v, want %v", test.list, got, test.want)
+			}
+		})
+	}
+}
+
+func TestOidcSystems(t *testing.T) {
+	claims := jwt.MapClaims{"groups": []any{"fire", "police"}}
+
+	tests := []struct {
+		name   string
+		list   string
+		want   any
+		wantOk bool
+	}{
+		{"no mapping", "", "*", true},
+		{"no match", "ems=1", nil, false},
+		{"all", "fire=1,police=*", "*", true},
+		{
+			name:   "union",
+			list:   "fire=1:100,police=1:101+2,ems=3",
+			want:   []any{map[string]any{"id": float64(1), "talkgroups": []any{float64(100), float64(101)}}, map[string]any{"id": float64(2), "talkgroups": "*"}},
+			wantOk: true,
+		},
+		{
+			name:   "whole system wins over talkgroups",
+			list:   "fire=1:100,police=1",
+			want:   []any{map[string]any{"id": float64(1), "talkgroups": "*"}},
+			wantOk: true,
+		},
+		{
+			name:   "talkgroups after the whole system",
+			list:   "police=1,fire=1:100",
+			want:   []any{map[string]any{"id": float64(1), "talkgroups": "*"}},
+			wantOk: true,
+		},
+		{"invalid mapping", "fire=x", nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := oidcSystems(test.list, claims)
+			if ok != test.wantOk || !reflect.DeepEqual(got, test.want) {
+				t.Errorf("oidcSystems(%q) = %v, %v, want %v, %v", test.list, got, ok, test.want, test.wantOk)
+			}
+		})
+	}
+}
+
+func TestOidcListenerClaimsKeepsVerifiedEmail(t *testing.T) {
+	claims := oidcListenerClaims{
+		Email:  oidcEmail(jwt.MapClaims{"email": "jane@example.org", "email_verified": false}),
+		Groups: oidcGroups(jwt.MapClaims{"groups": []any{"/fire"}}),
+	}
+
+	if oidcMatches("@example.org", claims.mapClaims()) {
+		t.Error("an unverified email was kept in the listener token")
+	}
+	if !oidcMatches("fire", claims.mapClaims()) {
+		t.Error("the groups were not kept in the listener token")
+	}
+}
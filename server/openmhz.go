@@ -0,0 +1,509 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	openmhzInterval = 60 * time.Second
+	openmhzTick     = 10 * time.Second
+	openmhzUrl      = "https://api.openmhz.com"
+)
+
+// OpenmhzImport mirrors an OpenMHz system, given its short name, into a local
+// system. On its first run it goes back history hours, then polls for newer
+// calls every interval seconds. Talkgroups missing locally are populated
+// from the OpenMHz talkgroups list. The cursor is the time of the last
+// imported call, in milliseconds.
+type OpenmhzImport struct {
+	Id        any    `json:"_id"`
+	Cursor    int64  `json:"cursor"`
+	Disabled  bool   `json:"disabled"`
+	History   uint   `json:"history"`
+	Interval  uint   `json:"interval"`
+	Order     any    `json:"order"`
+	ShortName string `json:"shortName"`
+	System    uint   `json:"system"`
+	Url       string `json:"url"`
+	polled    time.Time
+	running   bool
+}
+
+type OpenmhzCall struct {
+	Filename     string  `json:"filename"`
+	Freq         float64 `json:"freq"`
+	SrcList      []any   `json:"srcList"`
+	TalkgroupNum uint    `json:"talkgroupNum"`
+	Time         string  `json:"time"`
+	Url          string  `json:"url"`
+}
+
+type OpenmhzTalkgroup struct {
+	Alpha       string `json:"alpha"`
+	Description string `json:"description"`
+	Group       string `json:"group"`
+	Tag         string `json:"tag"`
+}
+
+func (imp *OpenmhzImport) FromMap(m map[string]any) *OpenmhzImport {
+	switch v := m["_id"].(type) {
+	case float64:
+		imp.Id = uint(v)
+	}
+
+	switch v := m["cursor"].(type) {
+	case float64:
+		imp.Cursor = int64(v)
+	}
+
+	switch v := m["disabled"].(type) {
+	case bool:
+		imp.Disabled = v
+	}
+
+	switch v := m["history"].(type) {
+	case float64:
+		imp.History = uint(v)
+	}
+
+	switch v := m["interval"].(type) {
+	case float64:
+		imp.Interval = uint(v)
+	}
+
+	switch v := m["order"].(type) {
+	case float64:
+		imp.Order = uint(v)
+	}
+
+	switch v := m["shortName"].(type) {
+	case string:
+		imp.ShortName = strings.TrimSpace(v)
+	}
+
+	switch v := m["system"].(type) {
+	case float64:
+		imp.System = uint(v)
+	}
+
+	switch v := m["url"].(type) {
+	case string:
+		imp.Url = v
+	}
+
+	return imp
+}
+
+// Poll imports the calls newer than the cursor, in chronological order, and
+// returns the new cursor.
+func (imp *OpenmhzImport) Poll(controller *Controller) (int64, int, error) {
+	formatError := func(err error) error {
+		return fmt.Errorf("openmhz.poll: %v", err)
+	}
+
+	cursor := imp.Cursor
+	if cursor == 0 {
+		cursor = time.Now().Add(-time.Duration(imp.History) * time.Hour).UnixMilli()
+	}
+
+	talkgroups := map[string]OpenmhzTalkgroup{}
+	if err := imp.fetch("talkgroups", nil, &struct {
+		Talkgroups *map[string]OpenmhzTalkgroup `json:"talkgroups"`
+	}{&talkgroups}); err != nil {
+		return cursor, 0, formatError(err)
+	}
+
+	count := 0
+
+	for {
+		res := struct {
+			Calls []OpenmhzCall `json:"calls"`
+		}{}
+
+		if err := imp.fetch("calls/newer", url.Values{"time": {fmt.Sprintf("%d", cursor)}}, &res); err != nil {
+			return cursor, count, formatError(err)
+		}
+
+		calls := []*Call{}
+		last := cursor
+
+		for _, c := range res.Calls {
+			t, err := time.Parse(time.RFC3339, c.Time)
+			if err != nil || t.UnixMilli() <= cursor {
+				continue
+			}
+
+			call, err := imp.newCall(&c, talkgroups)
+			if err != nil {
+				return cursor, count, formatError(err)
+			}
+			call.DateTime = t.UTC()
+
+			calls = append(calls, call)
+
+			if t.UnixMilli() > last {
+				last = t.UnixMilli()
+			}
+		}
+
+		if len(calls) == 0 {
+			break
+		}
+
+		sort.Slice(calls, func(i int, j int) bool {
+			return calls[i].DateTime.Before(calls[j].DateTime)
+		})
+
+		for _, call := range calls {
+			if ok, err := call.IsValid(); !ok {
+				controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("openmhz: %s talkgroup=%v file=%v skipped, %v", imp.ShortName, call.Talkgroup, call.AudioName, err))
+				continue
+			}
+
+			controller.Ingest <- call
+		}
+
+		count += len(calls)
+		cursor = last
+	}
+
+	return cursor, count, nil
+}
+
+func (imp *OpenmhzImport) fetch(resource string, query url.Values, v any) error {
+	base := openmhzUrl
+	if len(imp.Url) > 0 {
+		base = strings.TrimSuffix(imp.Url, "/")
+	}
+
+	u := fmt.Sprintf("%s/%s/%s", base, url.PathEscape(imp.ShortName), resource)
+	if len(query) > 0 {
+		u = fmt.Sprintf("%s?%s", u, query.Encode())
+	}
+
+	b, err := openmhzGet(u)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+func (imp *OpenmhzImport) newCall(c *OpenmhzCall, talkgroups map[string]OpenmhzTalkgroup) (*Call, error) {
+	audio, err := openmhzGet(c.Url)
+	if err != nil {
+		return nil, err
+	}
+
+	call := NewCall()
+	call.Audio = audio
+	call.AudioType = "audio/mp4"
+	call.System = imp.System
+	call.Talkgroup = c.TalkgroupNum
+	call.populate = true
+	call.systemLabel = imp.ShortName
+
+	if len(c.Filename) > 0 {
+		call.AudioName = path.Base(c.Filename)
+	} else {
+		call.AudioName = path.Base(c.Url)
+	}
+
+	if c.Freq > 0 {
+		call.Frequency = uint(c.Freq)
+	}
+
+	sources := []map[string]any{}
+	for _, f := range c.SrcList {
+		switch v := f.(type) {
+		case map[string]any:
+			source := map[string]any{}
+			if pos, ok := v["pos"].(float64); ok && pos >= 0 {
+				source["pos"] = uint(pos)
+			}
+			if src, ok := v["src"].(float64); ok && src > 0 {
+				source["src"] = uint(src)
+			}
+			sources = append(sources, source)
+		}
+	}
+	call.Sources = sources
+	if len(sources) > 0 {
+		call.Source = sources[0]["src"]
+	}
+
+	if talkgroup, ok := talkgroups[fmt.Sprintf("%d", c.TalkgroupNum)]; ok {
+		if len(talkgroup.Alpha) > 0 {
+			call.talkgroupLabel = talkgroup.Alpha
+		}
+		if len(talkgroup.Description) > 0 {
+			call.talkgroupName = talkgroup.Description
+		}
+		if len(talkgroup.Group) > 0 {
+			call.talkgroupGroup = talkgroup.Group
+		}
+		if len(talkgroup.Tag) > 0 {
+			call.talkgroupTag = talkgroup.Tag
+		}
+	}
+
+	return call, nil
+}
+
+type OpenmhzImports struct {
+	Controller *Controller
+	List       []*OpenmhzImport
+	mutex      sync.Mutex
+}
+
+func NewOpenmhzImports(controller *Controller) *OpenmhzImports {
+	return &OpenmhzImports{
+		Controller: controller,
+		List:       []*OpenmhzImport{},
+		mutex:      sync.Mutex{},
+	}
+}
+
+func (imports *OpenmhzImports) FromMap(f []any) *OpenmhzImports {
+	imports.mutex.Lock()
+	defer imports.mutex.Unlock()
+
+	imports.List = []*OpenmhzImport{}
+
+	for _, r := range f {
+		switch m := r.(type) {
+		case map[string]any:
+			imp := &OpenmhzImport{}
+			imp.FromMap(m)
+			imports.List = append(imports.List, imp)
+		}
+	}
+
+	return imports
+}
+
+func (imports *OpenmhzImports) Read(db *Database) error {
+	var (
+		err   error
+		id    sql.NullFloat64
+		order sql.NullFloat64
+		rows  *sql.Rows
+	)
+
+	imports.mutex.Lock()
+	defer imports.mutex.Unlock()
+
+	imports.List = []*OpenmhzImport{}
+
+	formatError := func(err error) error {
+		return fmt.Errorf("openmhzImports.read: %v", err)
+	}
+
+	if rows, err = db.Sql.Query("select `_id`, `cursor`, `disabled`, `history`, `interval`, `order`, `shortName`, `system`, `url` from `rdioScannerOpenmhzImports` order by `order`"); err != nil {
+		return formatError(err)
+	}
+
+	for rows.Next() {
+		imp := &OpenmhzImport{}
+
+		if err = rows.Scan(&id, &imp.Cursor, &imp.Disabled, &imp.History, &imp.Interval, &order, &imp.ShortName, &imp.System, &imp.Url); err != nil {
+			break
+		}
+
+		if id.Valid && id.Float64 > 0 {
+			imp.Id = uint(id.Float64)
+		}
+
+		if order.Valid && order.Float64 > 0 {
+			imp.Order = uint(order.Float64)
+		}
+
+		imports.List = append(imports.List, imp)
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	return nil
+}
+
+func (imports *OpenmhzImports) Start() error {
+	go func() {
+		ticker := time.NewTicker(openmhzTick)
+
+		for range ticker.C {
+			imports.poll()
+		}
+	}()
+
+	return nil
+}
+
+func (imports *OpenmhzImports) Write(db *Database) error {
+	var (
+		count  uint
+		err    error
+		rows   *sql.Rows
+		rowIds = []uint{}
+	)
+
+	imports.mutex.Lock()
+	defer imports.mutex.Unlock()
+
+	formatError := func(err error) error {
+		return fmt.Errorf("openmhzImports.write: %v", err)
+	}
+
+	if rows, err = db.Sql.Query("select `_id` from `rdioScannerOpenmhzImports`"); err != nil {
+		return formatError(err)
+	}
+
+	for rows.Next() {
+		var rowId uint
+		if err = rows.Scan(&rowId); err != nil {
+			break
+		}
+		remove := true
+		for _, imp := range imports.List {
+			if imp.Id == nil || imp.Id == rowId {
+				remove = false
+				break
+			}
+		}
+		if remove {
+			rowIds = append(rowIds, rowId)
+		}
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	if len(rowIds) > 0 {
+		if _, err = db.Delete("rdioScannerOpenmhzImports").Where(SqlIn("_id", rowIds)).Exec(); err != nil {
+			return formatError(err)
+		}
+	}
+
+	for _, imp := range imports.List {
+		if err = db.Sql.QueryRow("select count(*) from `rdioScannerOpenmhzImports` where `_id` = ?", imp.Id).Scan(&count); err != nil {
+			break
+		}
+
+		if count == 0 {
+			if _, err = db.Sql.Exec("insert into `rdioScannerOpenmhzImports` (`_id`, `cursor`, `disabled`, `history`, `interval`, `order`, `shortName`, `system`, `url`) values (?, ?, ?, ?, ?, ?, ?, ?, ?)", imp.Id, imp.Cursor, imp.Disabled, imp.History, imp.Interval, imp.Order, imp.ShortName, imp.System, imp.Url); err != nil {
+				break
+			}
+
+		} else if _, err = db.Sql.Exec("update `rdioScannerOpenmhzImports` set `cursor` = ?, `disabled` = ?, `history` = ?, `interval` = ?, `order` = ?, `shortName` = ?, `system` = ?, `url` = ? where `_id` = ?", imp.Cursor, imp.Disabled, imp.History, imp.Interval, imp.Order, imp.ShortName, imp.System, imp.Url, imp.Id); err != nil {
+			break
+		}
+	}
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	return nil
+}
+
+func (imports *OpenmhzImports) poll() {
+	controller := imports.Controller
+
+	imports.mutex.Lock()
+	defer imports.mutex.Unlock()
+
+	for _, imp := range imports.List {
+		interval := openmhzInterval
+		if imp.Interval > 0 {
+			interval = time.Duration(imp.Interval) * time.Second
+		}
+
+		if imp.Disabled || imp.running || len(imp.ShortName) == 0 || imp.System == 0 || time.Since(imp.polled) < interval {
+			continue
+		}
+
+		imp.polled = time.Now()
+		imp.running = true
+
+		go func(imp *OpenmhzImport) {
+			logEvent := func(logLevel string, message string) {
+				controller.Logs.LogEvent(logLevel, fmt.Sprintf("openmhz: %s to system=%v %s", imp.ShortName, imp.System, message))
+			}
+
+			cursor, count, err := imp.Poll(controller)
+
+			imports.mutex.Lock()
+			imp.running = false
+			changed := cursor != imp.Cursor
+			imp.Cursor = cursor
+			imports.mutex.Unlock()
+
+			if err != nil {
+				logEvent(LogLevelError, err.Error())
+			}
+
+			if count > 0 {
+				logEvent(LogLevelInfo, fmt.Sprintf("%d calls imported", count))
+			}
+
+			if changed && imp.Id != nil {
+				if _, err = controller.Database.Sql.Exec("update `rdioScannerOpenmhzImports` set `cursor` = ? where `_id` = ?", cursor, imp.Id); err != nil {
+					logEvent(LogLevelError, fmt.Sprintf("openmhzImports.poll: %v", err))
+				}
+			}
+		}(imp)
+	}
+}
+
+func openmhzGet(u string) ([]byte, error) {
+	c := http.Client{Timeout: 60 * time.Second}
+
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", fmt.Sprintf("rdio-scanner/%s", Version))
+
+	res, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status: %s for %s", res.Status, u)
+	}
+
+	return io.ReadAll(res.Body)
+}
@@ -19,27 +19,70 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"log"
 	"sync"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
 type Options struct {
+	AdminEmail                  string `json:"adminEmail"`
 	AfsSystems                  string `json:"afsSystems"`
+	AudioBitrate                uint   `json:"audioBitrate"`
+	AudioCodec                  string `json:"audioCodec"`
 	AudioConversion             uint   `json:"audioConversion"`
+	AudioCues                   bool   `json:"audioCues"`
+	AutoLearnUnits              bool   `json:"autoLearnUnits"`
+	AutoMuteDuration            uint   `json:"autoMuteDuration"`
+	AutoMuteMinCalls            uint   `json:"autoMuteMinCalls"`
+	AutoMuteRate                uint   `json:"autoMuteRate"`
 	AutoPopulate                bool   `json:"autoPopulate"`
+	BackupAudio                 bool   `json:"backupAudio"`
+	BackupKeep                  uint   `json:"backupKeep"`
+	BackupSchedule              string `json:"backupSchedule"`
 	Branding                    string `json:"branding"`
+	ClientBufferSize            uint   `json:"clientBufferSize"`
+	ClientCallQueue             uint   `json:"clientCallQueue"`
+	ColdStorageDays             uint   `json:"coldStorageDays"`
+	DigestEmail                 string `json:"digestEmail"`
+	DigestSchedule              string `json:"digestSchedule"`
+	DigestTemplate              string `json:"digestTemplate"`
+	DigestWebhook               string `json:"digestWebhook"`
 	DimmerDelay                 uint   `json:"dimmerDelay"`
+	DirwatchQuarantine          bool   `json:"dirwatchQuarantine"`
+	DirwatchStaleMinutes        uint   `json:"dirwatchStaleMinutes"`
 	DisableDuplicateDetection   bool   `json:"disableDuplicateDetection"`
+	DuplicateDetectionMode      string `json:"duplicateDetectionMode"`
 	DuplicateDetectionTimeFrame uint   `json:"duplicateDetectionTimeFrame"`
 	Email                       string `json:"email"`
+	ErrorMessage                string `json:"errorMessage"`
+	IngestPipeline              string `json:"ingestPipeline"`
 	KeypadBeeps                 string `json:"keypadBeeps"`
+	LiveCaptions                bool   `json:"liveCaptions"`
+	Maintenance                 bool   `json:"maintenance"`
+	MaintenanceMessage          string `json:"maintenanceMessage"`
 	MaxClients                  uint   `json:"maxClients"`
 	PlaybackGoesLive            bool   `json:"playbackGoesLive"`
 	PruneDays                   uint   `json:"pruneDays"`
+	Registration                bool   `json:"registration"`
+	RegistrationEmail           string `json:"registrationEmail"`
+	RegistrationMax             uint   `json:"registrationMax"`
+	RetentionCompliance         bool   `json:"retentionCompliance"`
 	SearchPatchedTalkgroups     bool   `json:"searchPatchedTalkgroups"`
+	ShareLinks                  bool   `json:"shareLinks"`
 	ShowListenersCount          bool   `json:"showListenersCount"`
+	ShowOccupancy               bool   `json:"showOccupancy"`
+	SlowClientPolicy            string `json:"slowClientPolicy"`
+	SmtpFrom                    string `json:"smtpFrom"`
+	SmtpHost                    string `json:"smtpHost"`
+	SmtpPassword                string `json:"smtpPassword"`
+	SmtpPort                    uint   `json:"smtpPort"`
+	SmtpTls                     string `json:"smtpTls"`
+	SmtpUsername                string `json:"smtpUsername"`
 	SortTalkgroups              bool   `json:"sortTalkgroups"`
+	SubscriptionsCooldown       uint   `json:"subscriptionsCooldown"`
+	SubscriptionsEmail          string `json:"subscriptionsEmail"`
+	SubscriptionsMax            uint   `json:"subscriptionsMax"`
 	TagsToggle                  bool   `json:"tagsToggle"`
 	Time12hFormat               bool   `json:"time12hFormat"`
 	adminPassword               string
@@ -55,6 +98,38 @@ const (
 	AUDIO_CONVERSION_ENABLED_LOUD_NORM = 3
 )
 
+// The audio normalizations of the systems, overriding the one of the audio
+// conversion when set. The ebu one is the EBU R128 loudness normalization of
+// ffmpeg at its default target, the loud one targets -16 LUFS and agc is a
+// dynamic normalization evening out the levels within the call.
+const (
+	AUDIO_NORMALIZATION_AGC  = "agc"
+	AUDIO_NORMALIZATION_EBU  = "ebu"
+	AUDIO_NORMALIZATION_LOUD = "loud"
+	AUDIO_NORMALIZATION_NONE = "none"
+)
+
+const (
+	AUDIO_CODEC_AAC  = "aac"
+	AUDIO_CODEC_OPUS = "opus"
+)
+
+// The duplicates of an archived call are either rejected, or merged into it
+// when their recording has a better signal.
+const (
+	DUPLICATE_DETECTION_DROP  = "drop"
+	DUPLICATE_DETECTION_MERGE = "merge"
+)
+
+// The listeners that can't keep up with the calls either miss the oldest
+// calls queued for them, get disconnected, or receive the calls without
+// their audio until they catch up.
+const (
+	SLOW_CLIENT_DISCONNECT = "disconnect"
+	SLOW_CLIENT_DROP       = "drop"
+	SLOW_CLIENT_METADATA   = "metadata"
+)
+
 func NewOptions() *Options {
 	return &Options{
 		mutex: sync.Mutex{},
@@ -65,11 +140,30 @@ func (options *Options) FromMap(m map[string]any) *Options {
 	options.mutex.Lock()
 	defer options.mutex.Unlock()
 
+	switch v := m["adminEmail"].(type) {
+	case string:
+		options.AdminEmail = v
+	}
+
 	switch v := m["afsSystems"].(type) {
 	case string:
 		options.AfsSystems = v
 	}
 
+	switch v := m["audioBitrate"].(type) {
+	case float64:
+		options.AudioBitrate = uint(v)
+	default:
+		options.AudioBitrate = defaults.options.audioBitrate
+	}
+
+	switch v := m["audioCodec"].(type) {
+	case string:
+		options.AudioCodec = v
+	default:
+		options.AudioCodec = defaults.options.audioCodec
+	}
+
 	switch v := m["audioConversion"].(type) {
 	case float64:
 		options.AudioConversion = uint(v)
@@ -77,6 +171,41 @@ func (options *Options) FromMap(m map[string]any) *Options {
 		options.MaxClients = defaults.options.audioConversion
 	}
 
+	switch v := m["audioCues"].(type) {
+	case bool:
+		options.AudioCues = v
+	default:
+		options.AudioCues = defaults.options.audioCues
+	}
+
+	switch v := m["autoLearnUnits"].(type) {
+	case bool:
+		options.AutoLearnUnits = v
+	default:
+		options.AutoLearnUnits = defaults.options.autoLearnUnits
+	}
+
+	switch v := m["autoMuteDuration"].(type) {
+	case float64:
+		options.AutoMuteDuration = uint(v)
+	default:
+		options.AutoMuteDuration = defaults.options.autoMuteDuration
+	}
+
+	switch v := m["autoMuteMinCalls"].(type) {
+	case float64:
+		options.AutoMuteMinCalls = uint(v)
+	default:
+		options.AutoMuteMinCalls = defaults.options.autoMuteMinCalls
+	}
+
+	switch v := m["autoMuteRate"].(type) {
+	case float64:
+		options.AutoMuteRate = uint(v)
+	default:
+		options.AutoMuteRate = defaults.options.autoMuteRate
+	}
+
 	switch v := m["autoPopulate"].(type) {
 	case bool:
 		options.AutoPopulate = v
@@ -84,18 +213,92 @@ func (options *Options) FromMap(m map[string]any) *Options {
 		options.AutoPopulate = defaults.options.autoPopulate
 	}
 
+	switch v := m["backupAudio"].(type) {
+	case bool:
+		options.BackupAudio = v
+	default:
+		options.BackupAudio = defaults.options.backupAudio
+	}
+
+	switch v := m["backupKeep"].(type) {
+	case float64:
+		options.BackupKeep = uint(v)
+	default:
+		options.BackupKeep = defaults.options.backupKeep
+	}
+
+	switch v := m["backupSchedule"].(type) {
+	case string:
+		options.BackupSchedule = v
+	default:
+		options.BackupSchedule = defaults.options.backupSchedule
+	}
+
 	switch v := m["branding"].(type) {
 	case string:
 		options.Branding = v
 	}
 
+	switch v := m["clientBufferSize"].(type) {
+	case float64:
+		options.ClientBufferSize = uint(v)
+	default:
+		options.ClientBufferSize = defaults.options.clientBufferSize
+	}
+
+	switch v := m["clientCallQueue"].(type) {
+	case float64:
+		options.ClientCallQueue = uint(v)
+	default:
+		options.ClientCallQueue = defaults.options.clientCallQueue
+	}
+
+	switch v := m["coldStorageDays"].(type) {
+	case float64:
+		options.ColdStorageDays = uint(v)
+	default:
+		options.ColdStorageDays = defaults.options.coldStorageDays
+	}
+
+	switch v := m["digestEmail"].(type) {
+	case string:
+		options.DigestEmail = v
+	}
+
+	switch v := m["digestSchedule"].(type) {
+	case string:
+		options.DigestSchedule = v
+	}
+
+	switch v := m["digestTemplate"].(type) {
+	case string:
+		options.DigestTemplate = v
+	}
+
+	switch v := m["digestWebhook"].(type) {
+	case string:
+		options.DigestWebhook = v
+	}
+
 	switch v := m["dimmerDelay"].(type) {
 	case float64:
 		options.DimmerDelay = uint(v)
 	default:
+		options.ClientBufferSize = defaults.options.clientBufferSize
+		options.ClientCallQueue = defaults.options.clientCallQueue
 		options.DimmerDelay = defaults.options.dimmerDelay
 	}
 
+	switch v := m["dirwatchQuarantine"].(type) {
+	case bool:
+		options.DirwatchQuarantine = v
+	}
+
+	switch v := m["dirwatchStaleMinutes"].(type) {
+	case float64:
+		options.DirwatchStaleMinutes = uint(v)
+	}
+
 	switch v := m["disableAudioConversion"].(type) {
 	case bool:
 		if v {
@@ -112,6 +315,13 @@ func (options *Options) FromMap(m map[string]any) *Options {
 		options.DisableDuplicateDetection = defaults.options.disableDuplicateDetection
 	}
 
+	switch v := m["duplicateDetectionMode"].(type) {
+	case string:
+		options.DuplicateDetectionMode = v
+	default:
+		options.DuplicateDetectionMode = defaults.options.duplicateDetectionMode
+	}
+
 	switch v := m["duplicateDetectionTimeFrame"].(type) {
 	case float64:
 		options.DuplicateDetectionTimeFrame = uint(v)
@@ -124,6 +334,20 @@ func (options *Options) FromMap(m map[string]any) *Options {
 		options.Email = v
 	}
 
+	switch v := m["errorMessage"].(type) {
+	case string:
+		options.ErrorMessage = v
+	default:
+		options.ErrorMessage = defaults.options.errorMessage
+	}
+
+	switch v := m["ingestPipeline"].(type) {
+	case string:
+		options.IngestPipeline = v
+	default:
+		options.IngestPipeline = defaults.options.ingestPipeline
+	}
+
 	switch v := m["keypadBeeps"].(type) {
 	case string:
 		options.KeypadBeeps = v
@@ -131,6 +355,27 @@ func (options *Options) FromMap(m map[string]any) *Options {
 		options.KeypadBeeps = defaults.options.keypadBeeps
 	}
 
+	switch v := m["liveCaptions"].(type) {
+	case bool:
+		options.LiveCaptions = v
+	default:
+		options.LiveCaptions = defaults.options.liveCaptions
+	}
+
+	switch v := m["maintenance"].(type) {
+	case bool:
+		options.Maintenance = v
+	default:
+		options.Maintenance = defaults.options.maintenance
+	}
+
+	switch v := m["maintenanceMessage"].(type) {
+	case string:
+		options.MaintenanceMessage = v
+	default:
+		options.MaintenanceMessage = defaults.options.maintenanceMessage
+	}
+
 	switch v := m["maxClients"].(type) {
 	case float64:
 		options.MaxClients = uint(v)
@@ -150,6 +395,32 @@ func (options *Options) FromMap(m map[string]any) *Options {
 		options.PruneDays = defaults.options.pruneDays
 	}
 
+	switch v := m["registration"].(type) {
+	case bool:
+		options.Registration = v
+	default:
+		options.Registration = defaults.options.registration
+	}
+
+	switch v := m["registrationEmail"].(type) {
+	case string:
+		options.RegistrationEmail = v
+	}
+
+	switch v := m["registrationMax"].(type) {
+	case float64:
+		options.RegistrationMax = uint(v)
+	default:
+		options.RegistrationMax = defaults.options.registrationMax
+	}
+
+	switch v := m["retentionCompliance"].(type) {
+	case bool:
+		options.RetentionCompliance = v
+	default:
+		options.RetentionCompliance = defaults.options.retentionCompliance
+	}
+
 	switch v := m["searchPatchedTalkgroups"].(type) {
 	case bool:
 		options.SearchPatchedTalkgroups = v
@@ -157,6 +428,13 @@ func (options *Options) FromMap(m map[string]any) *Options {
 		options.SearchPatchedTalkgroups = defaults.options.searchPatchedTalkgroups
 	}
 
+	switch v := m["shareLinks"].(type) {
+	case bool:
+		options.ShareLinks = v
+	default:
+		options.ShareLinks = defaults.options.shareLinks
+	}
+
 	switch v := m["showListenersCount"].(type) {
 	case bool:
 		options.ShowListenersCount = v
@@ -164,13 +442,89 @@ func (options *Options) FromMap(m map[string]any) *Options {
 		options.ShowListenersCount = defaults.options.showListenersCount
 	}
 
+	switch v := m["showOccupancy"].(type) {
+	case bool:
+		options.ShowOccupancy = v
+	default:
+		options.ShowOccupancy = defaults.options.showOccupancy
+	}
+
+	switch v := m["slowClientPolicy"].(type) {
+	case string:
+		switch v {
+		case SLOW_CLIENT_DISCONNECT, SLOW_CLIENT_DROP, SLOW_CLIENT_METADATA:
+			options.SlowClientPolicy = v
+		default:
+			options.SlowClientPolicy = defaults.options.slowClientPolicy
+		}
+	default:
+		options.SlowClientPolicy = defaults.options.slowClientPolicy
+	}
+
+	switch v := m["smtpFrom"].(type) {
+	case string:
+		options.SmtpFrom = v
+	}
+
+	switch v := m["smtpHost"].(type) {
+	case string:
+		options.SmtpHost = v
+	}
+
+	switch v := m["smtpPassword"].(type) {
+	case string:
+		options.SmtpPassword = v
+	}
+
+	switch v := m["smtpPort"].(type) {
+	case float64:
+		options.SmtpPort = uint(v)
+	default:
+		options.SmtpPort = defaults.options.smtpPort
+	}
+
+	switch v := m["smtpTls"].(type) {
+	case string:
+		switch v {
+		case SmtpTlsNone, SmtpTlsStarttls, SmtpTlsTls:
+			options.SmtpTls = v
+		default:
+			options.SmtpTls = defaults.options.smtpTls
+		}
+	default:
+		options.SmtpTls = defaults.options.smtpTls
+	}
+
+	switch v := m["smtpUsername"].(type) {
+	case string:
+		options.SmtpUsername = v
+	}
+
 	switch v := m["sortTalkgroups"].(type) {
 	case bool:
 		options.SortTalkgroups = v
 	default:
+		options.SlowClientPolicy = defaults.options.slowClientPolicy
 		options.SortTalkgroups = defaults.options.sortTalkgroups
 	}
 
+	switch v := m["subscriptionsCooldown"].(type) {
+	case float64:
+		options.SubscriptionsCooldown = uint(v)
+	default:
+		options.SubscriptionsCooldown = defaults.options.subscriptionsCooldown
+	}
+
+	switch v := m["subscriptionsEmail"].(type) {
+	case string:
+		options.SubscriptionsEmail = v
+	}
+
+	switch v := m["subscriptionsMax"].(type) {
+	case float64:
+		options.SubscriptionsMax = uint(v)
+	}
+
 	switch v := m["tagsToggle"].(type) {
 	case bool:
 		options.TagsToggle = v
@@ -207,18 +561,45 @@ func (options *Options) Read(db *Database) error {
 
 	// Track if this is first-time setup to log the password
 	isFirstSetup := false
+	options.AudioBitrate = defaults.options.audioBitrate
+	options.AudioCodec = defaults.options.audioCodec
 	options.AudioConversion = defaults.options.audioConversion
+	options.AudioCues = defaults.options.audioCues
+	options.AutoLearnUnits = defaults.options.autoLearnUnits
+	options.AutoMuteDuration = defaults.options.autoMuteDuration
+	options.AutoMuteMinCalls = defaults.options.autoMuteMinCalls
+	options.AutoMuteRate = defaults.options.autoMuteRate
 	options.AutoPopulate = defaults.options.autoPopulate
+	options.BackupAudio = defaults.options.backupAudio
+	options.BackupKeep = defaults.options.backupKeep
+	options.BackupSchedule = defaults.options.backupSchedule
+	options.ColdStorageDays = defaults.options.coldStorageDays
 	options.DimmerDelay = defaults.options.dimmerDelay
+	options.DirwatchQuarantine = defaults.options.dirwatchQuarantine
+	options.DirwatchStaleMinutes = defaults.options.dirwatchStaleMinutes
 	options.DisableDuplicateDetection = defaults.options.disableDuplicateDetection
+	options.DuplicateDetectionMode = defaults.options.duplicateDetectionMode
 	options.DuplicateDetectionTimeFrame = defaults.options.duplicateDetectionTimeFrame
+	options.ErrorMessage = defaults.options.errorMessage
+	options.IngestPipeline = defaults.options.ingestPipeline
 	options.KeypadBeeps = defaults.options.keypadBeeps
+	options.LiveCaptions = defaults.options.liveCaptions
+	options.Maintenance = defaults.options.maintenance
+	options.MaintenanceMessage = defaults.options.maintenanceMessage
 	options.MaxClients = defaults.options.maxClients
 	options.PlaybackGoesLive = defaults.options.playbackGoesLive
 	options.PruneDays = defaults.options.pruneDays
+	options.Registration = defaults.options.registration
+	options.RegistrationMax = defaults.options.registrationMax
+	options.RetentionCompliance = defaults.options.retentionCompliance
 	options.SearchPatchedTalkgroups = defaults.options.searchPatchedTalkgroups
+	options.ShareLinks = defaults.options.shareLinks
 	options.ShowListenersCount = defaults.options.showListenersCount
+	options.ShowOccupancy = defaults.options.showOccupancy
+	options.SmtpPort = defaults.options.smtpPort
+	options.SmtpTls = defaults.options.smtpTls
 	options.SortTalkgroups = defaults.options.sortTalkgroups
+	options.SubscriptionsCooldown = defaults.options.subscriptionsCooldown
 	options.TagsToggle = defaults.options.tagsToggle
 
 	err = db.Sql.QueryRow("select `val` from `rdioScannerConfigs` where `key` = 'adminPassword'").Scan(&s)
@@ -233,11 +614,11 @@ func (options *Options) Read(db *Database) error {
 
 	// Log the initial password for first-time setup
 	if isFirstSetup {
-		log.Printf("\n" +
-			"═══════════════════════════════════════════════════════════\n" +
-			"  FIRST-TIME SETUP DETECTED\n" +
-			"  Initial admin password: %s\n" +
-			"  WARNING: You MUST change this password on first login!\n" +
+		log.Printf("\n"+
+			"═══════════════════════════════════════════════════════════\n"+
+			"  FIRST-TIME SETUP DETECTED\n"+
+			"  Initial admin password: %s\n"+
+			"  WARNING: You MUST change this password on first login!\n"+
 			"═══════════════════════════════════════════════════════════\n",
 			initialPassword)
 	}
@@ -255,36 +636,141 @@ func (options *Options) Read(db *Database) error {
 		var m map[string]any
 
 		if err = json.Unmarshal([]byte(s), &m); err == nil {
+			switch v := m["adminEmail"].(type) {
+			case string:
+				options.AdminEmail = v
+			}
+
 			switch v := m["afsSystems"].(type) {
 			case string:
 				options.AfsSystems = v
 			}
 
+			switch v := m["audioBitrate"].(type) {
+			case float64:
+				options.AudioBitrate = uint(v)
+			}
+
+			switch v := m["audioCodec"].(type) {
+			case string:
+				options.AudioCodec = v
+			}
+
 			switch v := m["audioConversion"].(type) {
 			case float64:
 				options.AudioConversion = uint(v)
 			}
 
+			switch v := m["audioCues"].(type) {
+			case bool:
+				options.AudioCues = v
+			}
+
+			switch v := m["autoLearnUnits"].(type) {
+			case bool:
+				options.AutoLearnUnits = v
+			}
+
+			switch v := m["autoMuteDuration"].(type) {
+			case float64:
+				options.AutoMuteDuration = uint(v)
+			}
+
+			switch v := m["autoMuteMinCalls"].(type) {
+			case float64:
+				options.AutoMuteMinCalls = uint(v)
+			}
+
+			switch v := m["autoMuteRate"].(type) {
+			case float64:
+				options.AutoMuteRate = uint(v)
+			}
+
 			switch v := m["autoPopulate"].(type) {
 			case bool:
 				options.AutoPopulate = v
 			}
 
+			switch v := m["backupAudio"].(type) {
+			case bool:
+				options.BackupAudio = v
+			}
+
+			switch v := m["backupKeep"].(type) {
+			case float64:
+				options.BackupKeep = uint(v)
+			}
+
+			switch v := m["backupSchedule"].(type) {
+			case string:
+				options.BackupSchedule = v
+			}
+
 			switch v := m["branding"].(type) {
 			case string:
 				options.Branding = v
 			}
 
+			switch v := m["clientBufferSize"].(type) {
+			case float64:
+				options.ClientBufferSize = uint(v)
+			}
+
+			switch v := m["clientCallQueue"].(type) {
+			case float64:
+				options.ClientCallQueue = uint(v)
+			}
+
+			switch v := m["coldStorageDays"].(type) {
+			case float64:
+				options.ColdStorageDays = uint(v)
+			}
+
+			switch v := m["digestEmail"].(type) {
+			case string:
+				options.DigestEmail = v
+			}
+
+			switch v := m["digestSchedule"].(type) {
+			case string:
+				options.DigestSchedule = v
+			}
+
+			switch v := m["digestTemplate"].(type) {
+			case string:
+				options.DigestTemplate = v
+			}
+
+			switch v := m["digestWebhook"].(type) {
+			case string:
+				options.DigestWebhook = v
+			}
+
 			switch v := m["dimmerDelay"].(type) {
 			case float64:
 				options.DimmerDelay = uint(v)
 			}
 
+			switch v := m["dirwatchQuarantine"].(type) {
+			case bool:
+				options.DirwatchQuarantine = v
+			}
+
+			switch v := m["dirwatchStaleMinutes"].(type) {
+			case float64:
+				options.DirwatchStaleMinutes = uint(v)
+			}
+
 			switch v := m["disableDuplicateDetection"].(type) {
 			case bool:
 				options.DisableDuplicateDetection = v
 			}
 
+			switch v := m["duplicateDetectionMode"].(type) {
+			case string:
+				options.DuplicateDetectionMode = v
+			}
+
 			switch v := m["duplicateDetectionTimeFrame"].(type) {
 			case float64:
 				options.DuplicateDetectionTimeFrame = uint(v)
@@ -295,11 +781,36 @@ func (options *Options) Read(db *Database) error {
 				options.Email = v
 			}
 
+			switch v := m["errorMessage"].(type) {
+			case string:
+				options.ErrorMessage = v
+			}
+
+			switch v := m["ingestPipeline"].(type) {
+			case string:
+				options.IngestPipeline = v
+			}
+
 			switch v := m["keypadBeeps"].(type) {
 			case string:
 				options.KeypadBeeps = v
 			}
 
+			switch v := m["liveCaptions"].(type) {
+			case bool:
+				options.LiveCaptions = v
+			}
+
+			switch v := m["maintenance"].(type) {
+			case bool:
+				options.Maintenance = v
+			}
+
+			switch v := m["maintenanceMessage"].(type) {
+			case string:
+				options.MaintenanceMessage = v
+			}
+
 			switch v := m["maxClients"].(type) {
 			case float64:
 				options.MaxClients = uint(v)
@@ -315,21 +826,103 @@ func (options *Options) Read(db *Database) error {
 				options.PruneDays = uint(v)
 			}
 
+			switch v := m["registration"].(type) {
+			case bool:
+				options.Registration = v
+			}
+
+			switch v := m["registrationEmail"].(type) {
+			case string:
+				options.RegistrationEmail = v
+			}
+
+			switch v := m["registrationMax"].(type) {
+			case float64:
+				options.RegistrationMax = uint(v)
+			}
+
+			switch v := m["retentionCompliance"].(type) {
+			case bool:
+				options.RetentionCompliance = v
+			}
+
 			switch v := m["searchPatchedTalkgroups"].(type) {
 			case bool:
 				options.SearchPatchedTalkgroups = v
 			}
 
+			switch v := m["shareLinks"].(type) {
+			case bool:
+				options.ShareLinks = v
+			}
+
 			switch v := m["showListenersCount"].(type) {
 			case bool:
 				options.ShowListenersCount = v
 			}
 
+			switch v := m["showOccupancy"].(type) {
+			case bool:
+				options.ShowOccupancy = v
+			}
+
+			switch v := m["slowClientPolicy"].(type) {
+			case string:
+				options.SlowClientPolicy = v
+			}
+
+			switch v := m["smtpFrom"].(type) {
+			case string:
+				options.SmtpFrom = v
+			}
+
+			switch v := m["smtpHost"].(type) {
+			case string:
+				options.SmtpHost = v
+			}
+
+			switch v := m["smtpPassword"].(type) {
+			case string:
+				if options.SmtpPassword, err = db.Secrets.Open(v); err != nil {
+					log.Printf("options.read: smtp password: %v", err)
+				}
+			}
+
+			switch v := m["smtpPort"].(type) {
+			case float64:
+				options.SmtpPort = uint(v)
+			}
+
+			switch v := m["smtpTls"].(type) {
+			case string:
+				options.SmtpTls = v
+			}
+
+			switch v := m["smtpUsername"].(type) {
+			case string:
+				options.SmtpUsername = v
+			}
+
 			switch v := m["sortTalkgroups"].(type) {
 			case bool:
 				options.SortTalkgroups = v
 			}
 
+			switch v := m["subscriptionsCooldown"].(type) {
+			case float64:
+				options.SubscriptionsCooldown = uint(v)
+			}
+
+			switch v := m["subscriptionsEmail"].(type) {
+			case string:
+				options.SubscriptionsEmail = v
+			}
+
+			switch v := m["subscriptionsMax"].(type) {
+			case float64:
+				options.SubscriptionsMax = uint(v)
+			}
+
 			switch v := m["tagsToggle"].(type) {
 			case bool:
 				options.TagsToggle = v
@@ -391,22 +984,69 @@ func (options *Options) Write(db *Database) error {
 		db.Sql.Exec("insert into `rdioScannerConfigs` (`key`, `val`) values (?, ?)", "adminPasswordNeedChange", string(b))
 	}
 
+	smtpPassword, err := db.Secrets.Seal(options.SmtpPassword)
+	if err != nil {
+		return formatError(err)
+	}
+
 	if b, err = json.Marshal(map[string]any{
+		"adminEmail":                  options.AdminEmail,
 		"afsSystems":                  options.AfsSystems,
+		"audioBitrate":                options.AudioBitrate,
+		"audioCodec":                  options.AudioCodec,
 		"audioConversion":             options.AudioConversion,
+		"audioCues":                   options.AudioCues,
+		"autoLearnUnits":              options.AutoLearnUnits,
+		"autoMuteDuration":            options.AutoMuteDuration,
+		"autoMuteMinCalls":            options.AutoMuteMinCalls,
+		"autoMuteRate":                options.AutoMuteRate,
 		"autoPopulate":                options.AutoPopulate,
+		"backupAudio":                 options.BackupAudio,
+		"backupKeep":                  options.BackupKeep,
+		"backupSchedule":              options.BackupSchedule,
 		"branding":                    options.Branding,
+		"clientBufferSize":            options.ClientBufferSize,
+		"clientCallQueue":             options.ClientCallQueue,
+		"coldStorageDays":             options.ColdStorageDays,
+		"digestEmail":                 options.DigestEmail,
+		"digestSchedule":              options.DigestSchedule,
+		"digestTemplate":              options.DigestTemplate,
+		"digestWebhook":               options.DigestWebhook,
 		"dimmerDelay":                 options.DimmerDelay,
+		"dirwatchQuarantine":          options.DirwatchQuarantine,
+		"dirwatchStaleMinutes":        options.DirwatchStaleMinutes,
 		"disableDuplicateDetection":   options.DisableDuplicateDetection,
+		"duplicateDetectionMode":      options.DuplicateDetectionMode,
 		"duplicateDetectionTimeFrame": options.DuplicateDetectionTimeFrame,
 		"email":                       options.Email,
+		"errorMessage":                options.ErrorMessage,
+		"ingestPipeline":              options.IngestPipeline,
 		"keypadBeeps":                 options.KeypadBeeps,
+		"liveCaptions":                options.LiveCaptions,
+		"maintenance":                 options.Maintenance,
+		"maintenanceMessage":          options.MaintenanceMessage,
 		"maxClients":                  options.MaxClients,
 		"playbackGoesLive":            options.PlaybackGoesLive,
 		"pruneDays":                   options.PruneDays,
+		"registration":                options.Registration,
+		"registrationEmail":           options.RegistrationEmail,
+		"registrationMax":             options.RegistrationMax,
+		"retentionCompliance":         options.RetentionCompliance,
 		"searchPatchedTalkgroups":     options.SearchPatchedTalkgroups,
+		"shareLinks":                  options.ShareLinks,
 		"showListenersCount":          options.ShowListenersCount,
+		"showOccupancy":               options.ShowOccupancy,
+		"slowClientPolicy":            options.SlowClientPolicy,
+		"smtpFrom":                    options.SmtpFrom,
+		"smtpHost":                    options.SmtpHost,
+		"smtpPassword":                smtpPassword,
+		"smtpPort":                    options.SmtpPort,
+		"smtpTls":                     options.SmtpTls,
+		"smtpUsername":                options.SmtpUsername,
 		"sortTalkgroups":              options.SortTalkgroups,
+		"subscriptionsCooldown":       options.SubscriptionsCooldown,
+		"subscriptionsEmail":          options.SubscriptionsEmail,
+		"subscriptionsMax":            options.SubscriptionsMax,
 		"tagsToggle":                  options.TagsToggle,
 		"time12hFormat":               options.Time12hFormat,
 	}); err != nil {
@@ -0,0 +1,195 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// the browsers showing the maintenance page check back after pagesRetryAfter
+const pagesRetryAfter = time.Minute
+
+// websocketCloseReasonMax is the longest reason a close frame can carry.
+const websocketCloseReasonMax = 123
+
+// Pages answers the listeners with a page saying what is going on, rather
+// than a blank answer, when the scanner is down for maintenance or when
+// their request fails. The messages are set in the options.
+type Pages struct {
+	Controller *Controller
+}
+
+func NewPages(controller *Controller) *Pages {
+	return &Pages{Controller: controller}
+}
+
+// Maintenance returns the message for the listeners while the scanner is
+// down for maintenance.
+func (pages *Pages) Maintenance() (string, bool) {
+	options := pages.Controller.Options
+
+	if !options.Maintenance {
+		return "", false
+	}
+
+	if message := strings.TrimSpace(options.MaintenanceMessage); len(message) > 0 {
+		return message, true
+	}
+
+	return defaults.options.maintenanceMessage, true
+}
+
+// ServeMaintenance answers with the maintenance page, which reloads by
+// itself until the scanner is back.
+func (pages *Pages) ServeMaintenance(w http.ResponseWriter, r *http.Request) {
+	message, _ := pages.Maintenance()
+
+	w.Header().Set("Retry-After", fmt.Sprint(int(pagesRetryAfter.Seconds())))
+
+	pages.serve(w, r, http.StatusServiceUnavailable, "Down for maintenance", message, true)
+}
+
+// ServeError answers with the status, along with the error page for the
+// browsers. The api clients and the players still get a blank answer.
+func (pages *Pages) ServeError(w http.ResponseWriter, r *http.Request, status int) {
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.WriteHeader(status)
+		return
+	}
+
+	var message string
+
+	switch {
+	case status == http.StatusNotFound:
+		message = "This page doesn't exist."
+
+	case status >= http.StatusInternalServerError:
+		message = strings.TrimSpace(pages.Controller.Options.ErrorMessage)
+		if len(message) == 0 {
+			message = defaults.options.errorMessage
+		}
+
+	default:
+		message = http.StatusText(status)
+	}
+
+	pages.serve(w, r, status, http.StatusText(status), message, false)
+}
+
+func (pages *Pages) serve(w http.ResponseWriter, r *http.Request, status int, title string, message string, refresh bool) {
+	var (
+		b       strings.Builder
+		options = pages.Controller.Options
+	)
+
+	data := map[string]any{
+		"email":    options.Email,
+		"home":     pages.Controller.Config.GetBasePath() + "/",
+		"message":  strings.Split(message, "\n"),
+		"siteName": "Rdio Scanner",
+		"title":    title,
+	}
+
+	if refresh {
+		data["refresh"] = int(pagesRetryAfter.Seconds())
+	}
+
+	if len(options.Branding) > 0 {
+		data["siteName"] = options.Branding
+	}
+
+	if err := errorPage.Execute(&b, data); err != nil {
+		pages.Controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("pages.serve: %v", err))
+		w.WriteHeader(status)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+
+	if r.Method != http.MethodHead {
+		w.Write([]byte(b.String()))
+	}
+}
+
+var errorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+{{if .refresh}}<meta http-equiv="refresh" content="{{.refresh}}">
+{{end}}<title>{{.siteName}} - {{.title}}</title>
+<style>
+body { background: #000; color: #fff; font-family: sans-serif; margin: 0; padding: 16px; text-align: center; }
+#site { color: #aaa; margin-top: 15vh; }
+#title { font-size: 1.5em; font-weight: bold; margin: 16px 0; }
+a { color: #aaa; }
+</style>
+</head>
+<body>
+<div id="site">{{.siteName}}</div>
+<div id="title">{{.title}}</div>
+{{range .message}}<p>{{.}}</p>
+{{end}}{{if .email}}<p><a href="mailto:{{.email}}">{{.email}}</a></p>
+{{end}}{{if not .refresh}}<p><a href="{{.home}}">Back to the scanner</a></p>
+{{end}}</body>
+</html>
+`))
+
+// pagesMaintained tells whether the path of the webapp is one of its pages,
+// which the maintenance page replaces. The admin dashboard and the assets it
+// loads stay served.
+func pagesMaintained(p string) bool {
+	if p == "admin" || strings.HasPrefix(p, "admin/") {
+		return false
+	}
+
+	return p == "index.html" || len(path.Ext(p)) == 0
+}
+
+// closeWebsocket closes the connection of a listener with a reason the
+// webapp shows as is.
+func closeWebsocket(conn *websocket.Conn, code int, reason string) {
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, websocketCloseReason(reason)), time.Now().Add(time.Second))
+}
+
+// websocketCloseReason puts the reason on a single line short enough for a
+// close frame, without cutting a character in half.
+func websocketCloseReason(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+
+	if len(s) <= websocketCloseReasonMax {
+		return s
+	}
+
+	const ellipsis = "…"
+
+	cut := websocketCloseReasonMax - len(ellipsis)
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+
+	return s[:cut] + ellipsis
+}
@@ -0,0 +1,170 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+func newTestPages(t *testing.T) *Controller {
+	t.Helper()
+
+	return newTestController(t, nil)
+}
+
+func TestWebsocketCloseReason(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"short", "Back at noon.", "Back at noon."},
+		{"lines", "Back\n  at noon.\n", "Back at noon."},
+		{"long", strings.Repeat("a", 200), strings.Repeat("a", 120) + "…"},
+		{"long with accents", strings.Repeat("é", 100), strings.Repeat("é", 60) + "…"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := websocketCloseReason(test.in)
+
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+			if len(got) > websocketCloseReasonMax || !utf8.ValidString(got) {
+				t.Errorf("%q doesn't fit in a close frame", got)
+			}
+		})
+	}
+}
+
+func TestPagesMaintained(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"index.html", true},
+		{"search", true},
+		{"admin", false},
+		{"admin/config", false},
+		{"main.js", false},
+		{"assets/icon.png", false},
+	}
+
+	for _, test := range tests {
+		if got := pagesMaintained(test.path); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.path, got, test.want)
+		}
+	}
+}
+
+func TestPagesServeError(t *testing.T) {
+	controller := newTestPages(t)
+	controller.Options.Branding = "County <Scanner>"
+	controller.Options.ErrorMessage = "The database is being moved,\nback in an hour."
+
+	tests := []struct {
+		name     string
+		accept   string
+		status   int
+		contains []string
+	}{
+		{"not found", "text/html,application/xhtml+xml", http.StatusNotFound, []string{"Not Found", "doesn&#39;t exist", "County &lt;Scanner&gt;"}},
+		{"server error", "text/html", http.StatusInternalServerError, []string{"<p>The database is being moved,</p>", "<p>back in an hour.</p>"}},
+		{"api client", "application/json", http.StatusNotFound, nil},
+		{"no accept", "", http.StatusInternalServerError, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/nowhere/", nil)
+			if len(test.accept) > 0 {
+				r.Header.Set("Accept", test.accept)
+			}
+
+			w := httptest.NewRecorder()
+			controller.Pages.ServeError(w, r, test.status)
+
+			if w.Code != test.status {
+				t.Errorf("status %d, want %d", w.Code, test.status)
+			}
+			if test.contains == nil && w.Body.Len() > 0 {
+				t.Errorf("body %q, want none", w.Body.String())
+			}
+			for _, s := range test.contains {
+				if !strings.Contains(w.Body.String(), s) {
+					t.Errorf("body doesn't contain %q", s)
+				}
+			}
+		})
+	}
+}
+
+func TestPagesMaintenance(t *testing.T) {
+	controller := newTestPages(t)
+
+	if _, ok := controller.Pages.Maintenance(); ok {
+		t.Fatal("maintenance by default")
+	}
+
+	controller.Options.Maintenance = true
+
+	if message, ok := controller.Pages.Maintenance(); !ok || message != defaults.options.maintenanceMessage {
+		t.Errorf("message = %q, %v", message, ok)
+	}
+
+	controller.Options.MaintenanceMessage = "Moving to the new tower, back at noon."
+
+	w := httptest.NewRecorder()
+	controller.Pages.ServeMaintenance(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "60" {
+		t.Errorf("status %d, retry after %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if !strings.Contains(w.Body.String(), "Moving to the new tower, back at noon.") {
+		t.Errorf("body = %s", w.Body.String())
+	}
+
+	// the listeners connecting get the message as the reason of the closure
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		(&Client{}).Init(controller, r, conn)
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, _, err = conn.ReadMessage()
+
+	var closed *websocket.CloseError
+	if !errors.As(err, &closed) || closed.Code != websocket.CloseTryAgainLater || closed.Text != "Moving to the new tower, back at noon." {
+		t.Errorf("err = %v", err)
+	}
+}
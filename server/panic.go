@@ -0,0 +1,351 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	panicsSentryInterval = time.Minute
+	panicsSentryTimeout  = 10 * time.Second
+)
+
+// panicsPackage is the prefix of the functions of the server in the
+// stacks, ie: main.
+var panicsPackage = func() string {
+	pc, _, _, _ := runtime.Caller(0)
+	name := runtime.FuncForPC(pc).Name()
+	i := strings.LastIndex(name, "/") + 1
+	return name[:i+strings.Index(name[i:], ".")+1]
+}()
+
+// PanicFrame is a function call of the stack of a panic.
+type PanicFrame struct {
+	File     string `json:"filename"`
+	Function string `json:"function"`
+	InApp    bool   `json:"in_app"`
+	Line     int    `json:"lineno"`
+}
+
+// PanicReport describes a recovered panic, where it was recovered, the
+// value it was raised with and the stack of the goroutine that raised it,
+// the innermost call first.
+type PanicReport struct {
+	DateTime time.Time
+	Frames   []PanicFrame
+	Request  string
+	Stack    []byte
+	Type     string
+	Value    string
+	Where    string
+}
+
+// NewPanicReport must be called from the deferred function that recovered
+// the panic, the stack being the one of the panicking goroutine then.
+func NewPanicReport(where string, v any) *PanicReport {
+	report := &PanicReport{
+		DateTime: time.Now().UTC(),
+		Stack:    debug.Stack(),
+		Type:     fmt.Sprintf("%T", v),
+		Value:    fmt.Sprint(v),
+		Where:    where,
+	}
+
+	if err, ok := v.(error); ok {
+		report.Value = err.Error()
+	}
+
+	pcs := make([]uintptr, 64)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(1, pcs)])
+
+	for {
+		frame, more := frames.Next()
+
+		// the calls up to the panic are the ones of the recovery
+		if frame.Function == "runtime.gopanic" {
+			report.Frames = []PanicFrame{}
+
+		} else if !strings.HasPrefix(frame.Function, "runtime.") {
+			report.Frames = append(report.Frames, PanicFrame{
+				File:     frame.File,
+				Function: frame.Function,
+				InApp:    strings.HasPrefix(frame.Function, panicsPackage),
+				Line:     frame.Line,
+			})
+		}
+
+		if !more {
+			break
+		}
+	}
+
+	return report
+}
+
+// Location returns the innermost call of the server in the stack.
+func (report *PanicReport) Location() string {
+	for _, frame := range report.Frames {
+		if frame.InApp {
+			return fmt.Sprintf("%s:%d", frame.File[strings.LastIndex(frame.File, "/")+1:], frame.Line)
+		}
+	}
+
+	return "unknown location"
+}
+
+// String returns the one line summary of the panic written to the logs.
+func (report *PanicReport) String() string {
+	s := fmt.Sprintf("panic in %s at %s", report.Where, report.Location())
+
+	if len(report.Request) > 0 {
+		s = fmt.Sprintf("%s serving %s", s, report.Request)
+	}
+
+	return fmt.Sprintf("%s: %s", s, report.Value)
+}
+
+// Panics reports the panics recovered from the handlers and the goroutines
+// to the logs, the metrics and, when the sentry_dsn setting is set, to
+// Sentry.
+type Panics struct {
+	Controller *Controller
+	client     *http.Client
+	sent       map[string]time.Time
+	mutex      sync.Mutex
+}
+
+func NewPanics(controller *Controller) *Panics {
+	return &Panics{
+		Controller: controller,
+		client:     &http.Client{Timeout: panicsSentryTimeout},
+		sent:       map[string]time.Time{},
+	}
+}
+
+// Report logs the panic, the whole stack going to the standard error only
+// as the log messages are kept short, and sends it to Sentry in the
+// background, once a minute at most for a same place.
+func (panics *Panics) Report(report *PanicReport) {
+	controller := panics.Controller
+
+	if controller.Logs != nil {
+		controller.Logs.LogEvent(LogLevelError, truncateRunes(report.String(), 255))
+	}
+
+	log.Printf("panic in %s, stack:\n%s", report.Where, report.Stack)
+
+	if controller.Metrics != nil {
+		controller.Metrics.Panic(report.Where)
+	}
+
+	if controller.Config == nil || len(controller.Config.SentryDsn) == 0 {
+		return
+	}
+
+	panics.mutex.Lock()
+	if time.Since(panics.sent[report.Where]) < panicsSentryInterval {
+		panics.mutex.Unlock()
+		return
+	}
+	panics.sent[report.Where] = time.Now()
+	panics.mutex.Unlock()
+
+	go func() {
+		if err := panics.sentry(controller.Config.SentryDsn, report); err != nil {
+			log.Println(fmt.Errorf("panics.sentry: %v", err))
+		}
+	}()
+}
+
+// sentry sends the report as an event envelope to the project of the dsn.
+func (panics *Panics) sentry(dsn string, report *PanicReport) error {
+	endpoint, key, err := sentryEndpoint(dsn)
+	if err != nil {
+		return err
+	}
+
+	b, err := sentryEnvelope(report)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_key=%s, sentry_client=rdio-scanner/%s", key, Version))
+
+	res, err := panics.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("bad status: %s", res.Status)
+	}
+
+	return nil
+}
+
+// Recover is deferred first thing by the handlers and the goroutines, so
+// that their own deferred calls still run. It reports the panic unwinding
+// them, if any, and stops it from crashing the server.
+func (controller *Controller) Recover(where string) {
+	if v := recover(); v != nil {
+		controller.ReportPanic(NewPanicReport(where, v))
+	}
+}
+
+// ReportPanic reports a panic recovered by the caller.
+func (controller *Controller) ReportPanic(report *PanicReport) {
+	if controller == nil || controller.Panics == nil {
+		log.Printf("%s\n%s", report.String(), report.Stack)
+		return
+	}
+
+	controller.Panics.Report(report)
+}
+
+// httpRecoverHandler answers a 500 to the requests whose handler panics
+// rather than dropping their connection, the aborted handlers excepted.
+func httpRecoverHandler(controller *Controller, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+
+			if v == nil {
+				return
+
+			} else if v == http.ErrAbortHandler {
+				panic(v)
+			}
+
+			report := NewPanicReport("http", v)
+			report.Request = fmt.Sprintf("%s %s", r.Method, r.URL.Path)
+
+			controller.ReportPanic(report)
+
+			controller.Pages.ServeError(w, r, http.StatusInternalServerError)
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sentryEndpoint returns the envelope endpoint and the public key of a
+// dsn, ie: https://key@o1.ingest.sentry.io/42.
+func sentryEndpoint(dsn string) (string, string, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", "", err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", "", fmt.Errorf("invalid dsn scheme %q", u.Scheme)
+	}
+
+	if u.User == nil || len(u.User.Username()) == 0 {
+		return "", "", errors.New("no public key in the dsn")
+	}
+
+	i := strings.LastIndex(u.Path, "/")
+	if i == -1 || i == len(u.Path)-1 {
+		return "", "", errors.New("no project in the dsn")
+	}
+
+	endpoint := url.URL{
+		Scheme: u.Scheme,
+		Host:   u.Host,
+		Path:   fmt.Sprintf("%s/api/%s/envelope/", u.Path[:i], u.Path[i+1:]),
+	}
+
+	return endpoint.String(), u.User.Username(), nil
+}
+
+// sentryEnvelope returns the envelope of the event of the report, its
+// stack frames being sent the outermost call first as Sentry wants them.
+func sentryEnvelope(report *PanicReport) ([]byte, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	frames := make([]PanicFrame, len(report.Frames))
+	for i, frame := range report.Frames {
+		frames[len(frames)-1-i] = frame
+	}
+
+	event := map[string]any{
+		"event_id": hex.EncodeToString(id),
+		"exception": map[string]any{
+			"values": []map[string]any{{
+				"stacktrace": map[string]any{"frames": frames},
+				"type":       report.Type,
+				"value":      report.Value,
+			}},
+		},
+		"level":     "fatal",
+		"platform":  "go",
+		"release":   fmt.Sprintf("rdio-scanner@%s", Version),
+		"tags":      map[string]string{"where": report.Where},
+		"timestamp": report.DateTime.Format(time.RFC3339),
+	}
+
+	if hostname, err := os.Hostname(); err == nil {
+		event["server_name"] = hostname
+	}
+
+	if len(report.Request) > 0 {
+		if method, path, ok := strings.Cut(report.Request, " "); ok {
+			event["request"] = map[string]string{"method": method, "url": path}
+		}
+	}
+
+	b, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := json.Marshal(map[string]any{"event_id": event["event_id"], "sent_at": time.Now().UTC().Format(time.RFC3339)})
+	if err != nil {
+		return nil, err
+	}
+
+	item, err := json.Marshal(map[string]any{"length": len(b), "type": "event"})
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(fmt.Sprintf("%s\n%s\n%s\n", header, item, b)), nil
+}
@@ -19,6 +19,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"math"
 	"mime"
 	"mime/multipart"
 	"path"
@@ -29,6 +30,7 @@ import (
 	"time"
 
 	"github.com/dhowden/tag"
+	"github.com/google/uuid"
 )
 
 func ParseDSDPlusMeta(call *Call, fp string) error {
@@ -234,6 +236,210 @@ func ParseSdrTrunkMeta(call *Call, controller *Controller) error {
 	return nil
 }
 
+// ParseDSDPlusEventLog completes the call with the event log entry that
+// matches it, the event log being the only place where DSDPlus records the
+// frequency along with the talkgroup and radio aliases. Entries look like:
+//
+//	2022/05/14  13:42:07  Freq=851.012500  Group call; TG=1234 [Fire Disp]  RID=5678 [Engine 1]
+//
+// The closest entry within a few seconds of the call, for the same talkgroup
+// when it is known, is used.
+func ParseDSDPlusEventLog(call *Call, b []byte) error {
+	const window = 5 * time.Second
+
+	var (
+		best     []string
+		bestDiff time.Duration = window + 1
+		reDate                 = regexp.MustCompile(`^\s*([0-9]{4}/[0-9]{2}/[0-9]{2})\s+([0-9]{2}:[0-9]{2}:[0-9]{2})`)
+		reFreq                 = regexp.MustCompile(`Freq=\s*([0-9\.]+)`)
+		reSrc                  = regexp.MustCompile(`(?:RID|Src|Source)=\s*([0-9]+)(?:\s*\[([^\]]*)\])?`)
+		reTg                   = regexp.MustCompile(`(?:TG|TGT|Group)=\s*([0-9]+)(?:\s*\[([^\]]*)\])?`)
+	)
+
+	if call.DateTime.IsZero() {
+		return nil
+	}
+
+	for _, line := range strings.Split(string(b), "\n") {
+		d := reDate.FindStringSubmatch(line)
+		if len(d) != 3 {
+			continue
+		}
+
+		t, err := time.ParseInLocation("2006/01/02 15:04:05", d[1]+" "+d[2], time.Now().Location())
+		if err != nil {
+			continue
+		}
+
+		diff := call.DateTime.Sub(t.UTC())
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff > bestDiff {
+			continue
+		}
+
+		tg := reTg.FindStringSubmatch(line)
+		if len(tg) < 2 {
+			continue
+		}
+		if call.Talkgroup > 0 && tg[1] != strconv.Itoa(int(call.Talkgroup)) {
+			continue
+		}
+
+		best = append([]string{line}, tg...)
+		bestDiff = diff
+	}
+
+	if best == nil {
+		return nil
+	}
+
+	if call.Talkgroup == 0 {
+		if i, err := strconv.Atoi(best[2]); err == nil && i > 0 {
+			call.Talkgroup = uint(i)
+		}
+	}
+
+	if call.talkgroupLabel == nil && len(strings.TrimSpace(best[3])) > 0 {
+		call.talkgroupLabel = strings.TrimSpace(best[3])
+	}
+
+	if f := reFreq.FindStringSubmatch(best[0]); len(f) == 2 {
+		if mhz, err := strconv.ParseFloat(f[1], 64); err == nil && mhz > 0 {
+			call.Frequency = uint(math.Round(mhz * 1e6))
+		}
+	}
+
+	if src := reSrc.FindStringSubmatch(best[0]); len(src) == 3 {
+		if i, err := strconv.Atoi(src[1]); err == nil && i > 0 {
+			call.Source = uint(i)
+
+			if label := strings.TrimSpace(src[2]); len(label) > 0 {
+				if call.units == nil {
+					call.units = NewUnits()
+				}
+				switch units := call.units.(type) {
+				case *Units:
+					units.Add(uint(i), label)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// ParseSdrTrunkJsonMeta reads the call metadata sidecar SDRTrunk writes next
+// to its recordings. Its values take precedence over the ID3 tags.
+func ParseSdrTrunkJsonMeta(call *Call, b []byte, controller *Controller) error {
+	m := map[string]any{}
+
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+
+	first := func(keys ...string) any {
+		for _, k := range keys {
+			if v, ok := m[k]; ok && v != nil {
+				return v
+			}
+		}
+		return nil
+	}
+
+	toUint := func(f any) uint {
+		switch v := f.(type) {
+		case float64:
+			if v > 0 {
+				return uint(v)
+			}
+		case string:
+			if i, err := strconv.Atoi(strings.TrimSpace(v)); err == nil && i > 0 {
+				return uint(i)
+			}
+		}
+		return 0
+	}
+
+	toString := func(f any) string {
+		switch v := f.(type) {
+		case string:
+			return strings.TrimSpace(v)
+		}
+		return ""
+	}
+
+	switch v := first("timestamp", "eventStart", "date").(type) {
+	case float64:
+		if v > 0 {
+			call.DateTime = time.UnixMilli(int64(v)).UTC()
+		}
+	case string:
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			call.DateTime = t.UTC()
+		} else if t, err := time.ParseInLocation("2006-01-02 15:04:05.999", v, time.Now().Location()); err == nil {
+			call.DateTime = t.UTC()
+		}
+	}
+
+	switch v := first("frequency", "freq").(type) {
+	case float64:
+		if v > 0 && v < 10000 {
+			call.Frequency = uint(math.Round(v * 1e6))
+		} else if v > 0 {
+			call.Frequency = uint(v)
+		}
+	}
+
+	if system := toString(first("system", "systemName")); len(system) > 0 {
+		if s, ok := controller.Systems.GetSystem(system); ok {
+			call.System = s.Id
+		} else if call.System == 0 {
+			call.System = controller.Systems.GetNewSystemId()
+			call.systemLabel = system
+		}
+	}
+
+	if tg := toUint(first("talkgroup", "to")); tg > 0 {
+		call.Talkgroup = tg
+	}
+
+	if label := toString(first("talkgroupAlias", "toAlias", "talkgroupLabel")); len(label) > 0 {
+		call.talkgroupLabel = label
+		call.talkgroupName = label
+	}
+
+	if src := toUint(first("radio", "from", "source")); src > 0 {
+		call.Source = src
+
+		if label := toString(first("radioAlias", "fromAlias", "sourceAlias")); len(label) > 0 {
+			if call.units == nil {
+				call.units = NewUnits()
+			}
+			switch units := call.units.(type) {
+			case *Units:
+				units.Add(src, label)
+			}
+		}
+	}
+
+	switch v := first("patches", "patchedTalkgroups").(type) {
+	case []any:
+		patches := []uint{}
+		for _, patch := range v {
+			if tg := toUint(patch); tg > 0 {
+				patches = append(patches, tg)
+			}
+		}
+		if len(patches) > 0 {
+			call.Patches = patches
+		}
+	}
+
+	return nil
+}
+
 func ParseMultipartContent(call *Call, p *multipart.Part, b []byte) {
 	switch p.FormName() {
 	case "audio":
@@ -254,6 +460,12 @@ func ParseMultipartContent(call *Call, p *multipart.Part, b []byte) {
 			call.DateTime = call.DateTime.UTC()
 		}
 
+	case "emergency":
+		call.Emergency, _ = parseFlag(string(b))
+
+	case "encrypted":
+		call.Encrypted, _ = parseFlag(string(b))
+
 	case "frequencies":
 		var f any
 		if err := json.Unmarshal(b, &f); err == nil {
@@ -306,6 +518,25 @@ func ParseMultipartContent(call *Call, p *multipart.Part, b []byte) {
 			call.Frequency = uint(i)
 		}
 
+	case "latitude", "lat":
+		if v, ok := parseCoordinate(string(b), 90); ok {
+			call.Latitude = v
+		}
+
+	case "longitude", "lon", "lng":
+		if v, ok := parseCoordinate(string(b), 180); ok {
+			call.Longitude = v
+		}
+
+	case "metadata":
+		var f any
+		if err := json.Unmarshal(b, &f); err == nil {
+			call.Metadata = parseMetadata(f)
+		}
+
+	case "mode":
+		call.Mode = parseMode(string(b))
+
 	case "patches", "patched_talkgroups":
 		var (
 			f       any
@@ -326,6 +557,21 @@ func ParseMultipartContent(call *Call, p *multipart.Part, b []byte) {
 			call.Patches = patches
 		}
 
+	case "priority":
+		if i, err := strconv.Atoi(string(b)); err == nil && i > 0 {
+			call.Priority = uint(i)
+		}
+
+	case "site", "siteId":
+		if i, err := strconv.Atoi(string(b)); err == nil && i > 0 {
+			call.Site = uint(i)
+		}
+
+	case "uuid":
+		if u, err := uuid.Parse(string(b)); err == nil {
+			call.Uuid = u.String()
+		}
+
 	case "source":
 		if i, err := strconv.Atoi(string(b)); err == nil {
 			call.Source = int(i)
@@ -344,6 +590,7 @@ func ParseMultipartContent(call *Call, p *multipart.Part, b []byte) {
 					src := map[string]any{}
 					switch v := f.(type) {
 					case map[string]any:
+						parseSourceLocation(src, v)
 						switch v := v["pos"].(type) {
 						case float64:
 							if v >= 0 {
@@ -371,6 +618,7 @@ func ParseMultipartContent(call *Call, p *multipart.Part, b []byte) {
 				}
 				call.Sources = sources
 				call.units = units
+				setSourcesLocation(call, sources)
 			}
 		}
 
@@ -416,6 +664,14 @@ func ParseTrunkRecorderMeta(call *Call, b []byte) error {
 		return err
 	}
 
+	if v, ok := parseFlag(m["emergency"]); ok {
+		call.Emergency = v
+	}
+
+	if v, ok := parseFlag(m["encrypted"]); ok {
+		call.Encrypted = v
+	}
+
 	switch v := m["freq"].(type) {
 	case float64:
 		if v > 0 {
@@ -487,6 +743,36 @@ func ParseTrunkRecorderMeta(call *Call, b []byte) error {
 		}
 	}
 
+	if metadata := parseMetadata(m["metadata"]); metadata != nil {
+		call.Metadata = metadata
+	}
+
+	if v, ok := parseFlag(m["phase2_tdma"]); ok {
+		if v {
+			call.Mode = CallModeTdma
+		} else {
+			call.Mode = CallModeFdma
+		}
+	} else if v, ok := m["audio_type"].(string); ok {
+		call.Mode = parseMode(v)
+	}
+
+	switch v := m["priority"].(type) {
+	case float64:
+		if v > 0 {
+			call.Priority = uint(v)
+		}
+	}
+
+	for _, key := range []string{"site", "site_id"} {
+		switch v := m[key].(type) {
+		case float64:
+			if v > 0 {
+				call.Site = uint(v)
+			}
+		}
+	}
+
 	switch v := m["srcList"].(type) {
 	case []any:
 		sources := []map[string]any{}
@@ -494,6 +780,7 @@ func ParseTrunkRecorderMeta(call *Call, b []byte) error {
 			source := map[string]any{}
 			switch v := f.(type) {
 			case map[string]any:
+				parseSourceLocation(source, v)
 				switch v := v["pos"].(type) {
 				case float64:
 					if v >= 0 {
@@ -527,6 +814,13 @@ func ParseTrunkRecorderMeta(call *Call, b []byte) error {
 		call.Sources = sources
 	}
 
+	if lat, lon, ok := parseLocation(m); ok {
+		call.Latitude = lat
+		call.Longitude = lon
+	} else {
+		setSourcesLocation(call, call.Sources)
+	}
+
 	switch v := m["start_time"].(type) {
 	case float64:
 		call.DateTime = time.Unix(int64(v), 0).UTC()
@@ -548,3 +842,148 @@ func ParseTrunkRecorderMeta(call *Call, b []byte) error {
 
 	return nil
 }
+
+// parseFlag returns a flag given as a boolean, a number or a string like
+// "1", "true" or "yes".
+func parseFlag(f any) (bool, bool) {
+	switch v := f.(type) {
+	case bool:
+		return v, true
+	case float64:
+		return v != 0, true
+	case string:
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "1", "on", "true", "yes":
+			return true, true
+		case "0", "off", "false", "no":
+			return false, true
+		}
+	}
+
+	return false, false
+}
+
+// parseMetadata returns the custom metadata of a call given as a json object
+// of strings, numbers or booleans, nil when there is none.
+func parseMetadata(f any) map[string]string {
+	var metadata map[string]string
+
+	switch v := f.(type) {
+	case map[string]any:
+		for key, value := range v {
+			var s string
+
+			switch v := value.(type) {
+			case bool:
+				s = strconv.FormatBool(v)
+			case float64:
+				s = strconv.FormatFloat(v, 'f', -1, 64)
+			case string:
+				s = strings.TrimSpace(v)
+			}
+
+			if key = strings.TrimSpace(key); len(key) > 0 && len(s) > 0 {
+				if metadata == nil {
+					metadata = map[string]string{}
+				}
+				metadata[key] = s
+			}
+		}
+	}
+
+	return metadata
+}
+
+// parseMode returns the access mode of a call given as "tdma" or "fdma", or
+// as the "digital tdma" audio type of trunk-recorder.
+func parseMode(s string) string {
+	s = strings.ToLower(s)
+
+	switch {
+	case strings.Contains(s, CallModeTdma):
+		return CallModeTdma
+	case strings.Contains(s, CallModeFdma), s == "digital", s == "analog":
+		return CallModeFdma
+	}
+
+	return ""
+}
+
+// parseCoordinate returns a latitude or a longitude given as a number or a
+// string, if it is within max degrees.
+func parseCoordinate(f any, max float64) (float64, bool) {
+	var v float64
+
+	switch c := f.(type) {
+	case float64:
+		v = c
+	case string:
+		var err error
+		if v, err = strconv.ParseFloat(strings.TrimSpace(c), 64); err != nil {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+
+	if math.IsNaN(v) || v < -max || v > max {
+		return 0, false
+	}
+
+	return v, true
+}
+
+// parseLocation reads the latitude and longitude of a json object, either
+// as latitude and longitude or as lat and lon. A location at 0, 0 is the
+// position reported by gps units without a fix.
+func parseLocation(m map[string]any) (float64, float64, bool) {
+	first := func(keys ...string) any {
+		for _, key := range keys {
+			if v, ok := m[key]; ok {
+				return v
+			}
+		}
+		return nil
+	}
+
+	lat, ok := parseCoordinate(first("latitude", "lat"), 90)
+	if !ok {
+		return 0, 0, false
+	}
+
+	lon, ok := parseCoordinate(first("longitude", "lon", "lng"), 180)
+	if !ok || (lat == 0 && lon == 0) {
+		return 0, 0, false
+	}
+
+	return lat, lon, true
+}
+
+// parseSourceLocation copies the location of a unit of the call, as reported
+// with gps or lrrp, to the source.
+func parseSourceLocation(source map[string]any, m map[string]any) {
+	if lat, lon, ok := parseLocation(m); ok {
+		source["latitude"] = lat
+		source["longitude"] = lon
+	}
+}
+
+// setSourcesLocation gives the call the last location reported by its units
+// when it has none of its own.
+func setSourcesLocation(call *Call, sources any) {
+	if call.HasLocation() {
+		return
+	}
+
+	switch v := sources.(type) {
+	case []map[string]any:
+		for _, source := range v {
+			if lat, ok := source["latitude"].(float64); ok {
+				if lon, ok := source["longitude"].(float64); ok {
+					call.Latitude = lat
+					call.Longitude = lon
+				}
+			}
+		}
+	}
+}
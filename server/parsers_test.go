@@ -0,0 +1,172 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"mime/multipart"
+	"net/textproto"
+	"testing"
+)
+
+func TestParseTrunkRecorderMetaFlags(t *testing.T) {
+	tests := []struct {
+		name      string
+		meta      string
+		emergency bool
+		encrypted bool
+		mode      string
+		priority  uint
+	}{
+		{name: "none", meta: `{"talkgroup":1}`},
+		{name: "flags", meta: `{"emergency":1,"encrypted":1,"priority":4,"talkgroup":1}`, emergency: true, encrypted: true, priority: 4},
+		{name: "booleans", meta: `{"emergency":true,"encrypted":false,"talkgroup":1}`, emergency: true},
+		{name: "tdma", meta: `{"phase2_tdma":1,"talkgroup":1}`, mode: CallModeTdma},
+		{name: "fdma", meta: `{"phase2_tdma":0,"talkgroup":1}`, mode: CallModeFdma},
+		{name: "audio type", meta: `{"audio_type":"digital tdma","talkgroup":1}`, mode: CallModeTdma},
+		{name: "negative priority", meta: `{"priority":-1,"talkgroup":1}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			call := NewCall()
+
+			if err := ParseTrunkRecorderMeta(call, []byte(test.meta)); err != nil {
+				t.Fatal(err)
+			}
+
+			if call.Emergency != test.emergency || call.Encrypted != test.encrypted || call.Mode != test.mode || call.Priority != test.priority {
+				t.Errorf("got emergency %v encrypted %v mode %q priority %d", call.Emergency, call.Encrypted, call.Mode, call.Priority)
+			}
+		})
+	}
+}
+
+func TestParseTrunkRecorderMetaSite(t *testing.T) {
+	tests := []struct {
+		meta string
+		want uint
+	}{
+		{`{"talkgroup":1}`, 0},
+		{`{"site":2,"talkgroup":1}`, 2},
+		{`{"site_id":3,"talkgroup":1}`, 3},
+		{`{"site_id":-1,"talkgroup":1}`, 0},
+	}
+
+	for _, test := range tests {
+		call := NewCall()
+
+		if err := ParseTrunkRecorderMeta(call, []byte(test.meta)); err != nil {
+			t.Fatal(err)
+		}
+
+		if call.Site != test.want {
+			t.Errorf("%s: got site %d, want %d", test.meta, call.Site, test.want)
+		}
+	}
+}
+
+func TestParseFlag(t *testing.T) {
+	tests := []struct {
+		in     any
+		want   bool
+		wantOk bool
+	}{
+		{true, true, true},
+		{float64(0), false, true},
+		{float64(2), true, true},
+		{"1", true, true},
+		{" Yes ", true, true},
+		{"false", false, true},
+		{"maybe", false, false},
+		{nil, false, false},
+	}
+
+	for _, test := range tests {
+		if got, ok := parseFlag(test.in); got != test.want || ok != test.wantOk {
+			t.Errorf("parseFlag(%#v) = %v, %v, want %v, %v", test.in, got, ok, test.want, test.wantOk)
+		}
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"tdma", CallModeTdma},
+		{"FDMA", CallModeFdma},
+		{"digital", CallModeFdma},
+		{"digital tdma", CallModeTdma},
+		{"analog", CallModeFdma},
+		{"", ""},
+		{"dmr", ""},
+	}
+
+	for _, test := range tests {
+		if got := parseMode(test.in); got != test.want {
+			t.Errorf("parseMode(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestParseMetadata(t *testing.T) {
+	tests := []struct {
+		name string
+		in   any
+		want map[string]string
+	}{
+		{name: "none", in: nil},
+		{name: "not an object", in: "zone"},
+		{name: "values", in: map[string]any{" zone ": " north ", "bank": float64(3), "night": true, "empty": "", "list": []any{}}, want: map[string]string{"zone": "north", "bank": "3", "night": "true"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := parseMetadata(test.in)
+
+			if len(got) != len(test.want) {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+			for k, v := range test.want {
+				if got[k] != v {
+					t.Errorf("got %v, want %v", got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseMultipartContentUuid(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"0b9a1e3c-5b6f-4f0e-9d3a-3f1c2a7e8d10", "0b9a1e3c-5b6f-4f0e-9d3a-3f1c2a7e8d10"},
+		{"0B9A1E3C-5B6F-4F0E-9D3A-3F1C2A7E8D10", "0b9a1e3c-5b6f-4f0e-9d3a-3f1c2a7e8d10"},
+		{"", ""},
+		{"call-1", ""},
+	}
+
+	for _, test := range tests {
+		call := &Call{}
+
+		ParseMultipartContent(call, &multipart.Part{Header: textproto.MIMEHeader{"Content-Disposition": {`form-data; name="uuid"`}}}, []byte(test.in))
+
+		if call.Uuid != test.want {
+			t.Errorf("uuid %q = %q, want %q", test.in, call.Uuid, test.want)
+		}
+	}
+}
@@ -0,0 +1,381 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The queries of the server are written for sqlite and mysql, with back
+// quoted identifiers, ? placeholders and auto increment ids. Rather than a
+// third version of each of them, postgresql is reached through a driver
+// wrapping lib/pq which rewrites them for its dialect.
+const postgresDriverName = "rdio-scanner-postgres"
+
+// postgresSerial lets the serial ids behave like the auto increment ids of
+// mysql, where inserting a null id takes the next one and inserting a given
+// id moves the sequence past it.
+const postgresSerial = `create or replace function rdio_scanner_serial() returns trigger as $$
+declare
+	seq text := pg_get_serial_sequence(format('%I.%I', tg_table_schema, tg_table_name), tg_argv[0]);
+	id bigint := (to_jsonb(new) ->> tg_argv[0])::bigint;
+begin
+	if id is null then
+		new := jsonb_populate_record(new, jsonb_build_object(tg_argv[0], nextval(seq::regclass)));
+	elsif id > coalesce(pg_sequence_last_value(seq::regclass), 0) then
+		perform setval(seq::regclass, id);
+	end if;
+	return new;
+end
+$$ language plpgsql`
+
+type postgresRewrite struct {
+	re   *regexp.Regexp
+	repl string
+}
+
+// postgresTypes translate the column types, outside of the identifiers and
+// the literals as columns such as dateTime share their names with types.
+var postgresTypes = []postgresRewrite{
+	{regexp.MustCompile(`(?i)\bint(eger)? primary key auto_increment\b`), "serial primary key"},
+	{regexp.MustCompile(`(?i)\btinyint\(1\)`), "smallint"},
+	{regexp.MustCompile(`(?i)\bdatetime\b`), "timestamp"},
+	{regexp.MustCompile(`(?i)\b(long|medium)?blob\b`), "bytea"},
+	{regexp.MustCompile(`(?i)\b(long|medium)text\b`), "text"},
+	{regexp.MustCompile(`(?i)\bjson\b`), "text"},
+	{regexp.MustCompile(`(?i)\bdouble\b`), "double precision"},
+}
+
+// postgresDdl rewrite the statements of mysql which postgresql words
+// differently, once their types are translated.
+var postgresDdl = []postgresRewrite{
+	{regexp.MustCompile(`(?i)^(drop index "\w+") on "\w+"$`), "$1"},
+	{regexp.MustCompile(`(?i)^(alter table "\w+") modify ("\w+") ([\w ()]+?)( (not null|null|default)\b.*)?$`), "$1 alter column $2 type $3"},
+}
+
+var (
+	postgresCreateTable = regexp.MustCompile(`(?i)^create table "(\w+)" \(.*"(\w+)" serial primary key`)
+	postgresInsert      = regexp.MustCompile(`(?i)^insert into "(\w+)"`)
+)
+
+type postgresDriver struct {
+	open    func(dsn string) (driver.Conn, error)
+	serials map[string]string
+	mutex   sync.Mutex
+}
+
+func init() {
+	sql.Register(postgresDriverName, &postgresDriver{open: pq.Open, serials: map[string]string{}})
+}
+
+func (d *postgresDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := d.open(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &postgresConn{Conn: conn, driver: d}, nil
+}
+
+type postgresConn struct {
+	driver.Conn
+	driver *postgresDriver
+}
+
+func (conn *postgresConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return conn.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+// ExecContext runs the inserts with a returning clause for their serial id
+// as lib/pq has no last insert id.
+func (conn *postgresConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	query = postgresQuery(query)
+	args = postgresArgs(args)
+
+	if m := postgresInsert.FindStringSubmatch(query); m != nil && !strings.Contains(strings.ToLower(query), " returning ") {
+		if column, err := conn.serial(ctx, m[1]); err != nil {
+			return nil, err
+
+		} else if len(column) > 0 {
+			rows, err := conn.Conn.(driver.QueryerContext).QueryContext(ctx, fmt.Sprintf("%s returning \"%s\"", query, column), args)
+			if err != nil {
+				return nil, err
+			}
+			defer rows.Close()
+
+			result := &postgresResult{}
+			dest := make([]driver.Value, 1)
+
+			for {
+				if err = rows.Next(dest); err == io.EOF {
+					break
+				} else if err != nil {
+					return nil, err
+				}
+
+				switch v := dest[0].(type) {
+				case int64:
+					result.id = v
+				}
+				result.count++
+			}
+
+			return result, nil
+		}
+	}
+
+	return conn.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+}
+
+func (conn *postgresConn) Ping(ctx context.Context) error {
+	return conn.Conn.(driver.Pinger).Ping(ctx)
+}
+
+func (conn *postgresConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := conn.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, postgresQuery(query))
+	if err != nil {
+		return nil, err
+	}
+
+	return &postgresStmt{Stmt: stmt}, nil
+}
+
+func (conn *postgresConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return conn.Conn.(driver.QueryerContext).QueryContext(ctx, postgresQuery(query), postgresArgs(args))
+}
+
+// serial returns the serial column of the table, if any.
+func (conn *postgresConn) serial(ctx context.Context, table string) (string, error) {
+	d := conn.driver
+
+	d.mutex.Lock()
+	column, ok := d.serials[table]
+	d.mutex.Unlock()
+
+	if ok {
+		return column, nil
+	}
+
+	rows, err := conn.Conn.(driver.QueryerContext).QueryContext(ctx, "select column_name from information_schema.columns where table_schema = current_schema() and table_name = $1 and column_default like 'nextval(%'", []driver.NamedValue{{Ordinal: 1, Value: table}})
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	dest := make([]driver.Value, 1)
+
+	if err = rows.Next(dest); err == io.EOF {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	switch v := dest[0].(type) {
+	case string:
+		column = v
+	case []byte:
+		column = string(v)
+	}
+
+	// tables without a serial column aren't cached as they may be created
+	// later on by a migration
+	if len(column) > 0 {
+		d.mutex.Lock()
+		d.serials[table] = column
+		d.mutex.Unlock()
+	}
+
+	return column, nil
+}
+
+type postgresResult struct {
+	count int64
+	id    int64
+}
+
+func (result *postgresResult) LastInsertId() (int64, error) {
+	if result.id == 0 {
+		return 0, errors.New("no insert id")
+	}
+
+	return result.id, nil
+}
+
+func (result *postgresResult) RowsAffected() (int64, error) {
+	return result.count, nil
+}
+
+type postgresStmt struct {
+	driver.Stmt
+}
+
+func (stmt *postgresStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	return stmt.Stmt.(driver.StmtExecContext).ExecContext(ctx, postgresArgs(args))
+}
+
+func (stmt *postgresStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return stmt.Stmt.(driver.StmtQueryContext).QueryContext(ctx, postgresArgs(args))
+}
+
+// postgresArgs stores the booleans as the small integers of the tinyint(1)
+// columns and the times in utc, the timestamps having no time zone.
+func postgresArgs(args []driver.NamedValue) []driver.NamedValue {
+	for i, arg := range args {
+		switch v := arg.Value.(type) {
+		case bool:
+			if v {
+				args[i].Value = int64(1)
+			} else {
+				args[i].Value = int64(0)
+			}
+		case time.Time:
+			args[i].Value = v.UTC()
+		}
+	}
+
+	return args
+}
+
+// postgresQuery rewrites a query for postgresql. Outside of the string
+// literals and the quoted identifiers, back quotes become double quotes, ?
+// placeholders are numbered and like is case insensitive as it is with
+// sqlite and mysql. Table definitions have their column types translated.
+func postgresQuery(query string) string {
+	var (
+		b     strings.Builder
+		n     int
+		quote byte
+	)
+
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+
+		switch {
+		case quote == '`' && c == '`':
+			quote = 0
+			b.WriteByte('"')
+
+		case quote == '`' && c == '"':
+			b.WriteString(`""`)
+
+		case quote != 0:
+			// the doubled quotes of the literals close and reopen them
+			if c == quote {
+				quote = 0
+			}
+			b.WriteByte(c)
+
+		case c == '\'' || c == '"':
+			quote = c
+			b.WriteByte(c)
+
+		case c == '`':
+			quote = c
+			b.WriteByte('"')
+
+		case c == '?':
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+
+		case (c == 'l' || c == 'L') && (i == 0 || !postgresWordByte(query[i-1])) && len(query) > i+4 && strings.EqualFold(query[i:i+4], "like") && !postgresWordByte(query[i+4]):
+			b.WriteString("ilike")
+			i += 3
+
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	query = b.String()
+
+	lower := strings.ToLower(query)
+	if !strings.HasPrefix(lower, "create table") && !strings.HasPrefix(lower, "alter table") && !strings.HasPrefix(lower, "drop index") {
+		return query
+	}
+
+	query = postgresUnquoted(query, func(s string) string {
+		for _, t := range postgresTypes {
+			s = t.re.ReplaceAllString(s, t.repl)
+		}
+		return s
+	})
+
+	for _, ddl := range postgresDdl {
+		query = ddl.re.ReplaceAllString(query, ddl.repl)
+	}
+
+	if m := postgresCreateTable.FindStringSubmatch(query); m != nil {
+		query = fmt.Sprintf("%s; %s; create trigger \"%s_serial\" before insert on \"%s\" for each row execute procedure rdio_scanner_serial('%s')", query, postgresSerial, m[1], m[1], m[2])
+	}
+
+	return query
+}
+
+// postgresUnquoted applies f to the parts of a rewritten query outside of
+// its literals and identifiers.
+func postgresUnquoted(query string, f func(string) string) string {
+	var (
+		b     strings.Builder
+		quote byte
+		start int
+	)
+
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+				b.WriteString(query[start : i+1])
+				start = i + 1
+			}
+
+		case c == '\'' || c == '"':
+			b.WriteString(f(query[start:i]))
+			quote = c
+			start = i
+		}
+	}
+
+	if quote != 0 {
+		b.WriteString(query[start:])
+	} else {
+		b.WriteString(f(query[start:]))
+	}
+
+	return b.String()
+}
+
+func postgresWordByte(c byte) bool {
+	return c == '_' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// postgresDsnValue quotes a value of a key/value connection string.
+func postgresDsnValue(v string) string {
+	return fmt.Sprintf("'%s'", strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v))
+}
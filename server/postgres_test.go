@@ -0,0 +1,295 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestPostgresQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{
+			name:  "placeholders",
+			query: "select `id` from `rdioScannerCalls` where `system` = ? and `talkgroup` = ?",
+			want:  `select "id" from "rdioScannerCalls" where "system" = $1 and "talkgroup" = $2`,
+		},
+		{
+			name:  "literals",
+			query: "select `id` from `t` where `a` = 'it''s `b` ?' and `c` = ?",
+			want:  `select "id" from "t" where "a" = 'it''s ` + "`b`" + ` ?' and "c" = $1`,
+		},
+		{
+			name:  "quoted identifiers",
+			query: "select `it's ?`, \"like ?\" from `t` where `a` = ?",
+			want:  `select "it's ?", "like ?" from "t" where "a" = $1`,
+		},
+		{
+			name:  "double quote in a back quoted identifier",
+			query: "select `a\"b` from `t`",
+			want:  `select "a""b" from "t"`,
+		},
+		{
+			name:  "like",
+			query: "select `id` from `t` where `a` like ? and (`b` not LIKE '%like %') or `likes` = 1",
+			want:  `select "id" from "t" where "a" ilike $1 and ("b" not ilike '%like %') or "likes" = 1`,
+		},
+		{
+			name:  "like operand",
+			query: "select `likely`, unlike from `t` where (like_count = 1)",
+			want:  `select "likely", unlike from "t" where (like_count = 1)`,
+		},
+		{
+			name:  "column types",
+			query: "alter table `t` add column `dateTime` datetime not null default 'json'",
+			want:  `alter table "t" add column "dateTime" timestamp not null default 'json'`,
+		},
+		{
+			name:  "types named as columns",
+			query: "create table `t` (`_id` integer primary key, `json` json, `double` double, `blob` longblob, `text` mediumtext, `bool` tinyint(1) default 0, `datetime` datetime)",
+			want:  `create table "t" ("_id" integer primary key, "json" text, "double" double precision, "blob" bytea, "text" text, "bool" smallint default 0, "datetime" timestamp)`,
+		},
+		{
+			name:  "serial",
+			query: "create table `t` (`id` integer primary key auto_increment, `dateTime` datetime)",
+			want:  `create table "t" ("id" serial primary key, "dateTime" timestamp); ` + postgresSerial + `; create trigger "t_serial" before insert on "t" for each row execute procedure rdio_scanner_serial('id')`,
+		},
+		{
+			name:  "drop index",
+			query: "drop index `i` on `t`",
+			want:  `drop index "i"`,
+		},
+		{
+			name:  "modify",
+			query: "alter table `t` modify `units` longtext null not null",
+			want:  `alter table "t" alter column "units" type text`,
+		},
+		{
+			name:  "modify with a parameterized type",
+			query: "alter table `t` modify `address` varchar(255) not null",
+			want:  `alter table "t" alter column "address" type varchar(255)`,
+		},
+		{
+			name:  "modify to a two words type",
+			query: "alter table `t` modify `rate` double default 0",
+			want:  `alter table "t" alter column "rate" type double precision`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := postgresQuery(test.query); got != test.want {
+				t.Errorf("postgresQuery(%q)\n got %s\nwant %s", test.query, got, test.want)
+			}
+		})
+	}
+}
+
+func TestPostgresUnquoted(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{`a 'b' "c" d`, `A 'b' "c" D`},
+		{`'it''s' a`, `'it''s' A`},
+		{`a 'open`, `A 'open`},
+		{``, ``},
+	}
+
+	for _, test := range tests {
+		if got := postgresUnquoted(test.query, strings.ToUpper); got != test.want {
+			t.Errorf("postgresUnquoted(%q) = %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+// postgresFakeConn stands for a lib/pq connection, recording the queries it
+// is given. The counts are zero, inserts return the id 1 and rdioScannerCalls
+// is the only table with a serial column.
+type postgresFakeConn struct {
+	queries []string
+}
+
+type postgresFakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (rows *postgresFakeRows) Columns() []string { return rows.columns }
+func (rows *postgresFakeRows) Close() error      { return nil }
+func (rows *postgresFakeRows) Next(dest []driver.Value) error {
+	if len(rows.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, rows.values[0])
+	rows.values = rows.values[1:]
+	return nil
+}
+
+func (conn *postgresFakeConn) Begin() (driver.Tx, error) { return conn, nil }
+func (conn *postgresFakeConn) Close() error              { return nil }
+func (conn *postgresFakeConn) Commit() error             { return nil }
+func (conn *postgresFakeConn) Rollback() error           { return nil }
+
+func (conn *postgresFakeConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return conn, nil
+}
+
+func (conn *postgresFakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	conn.queries = append(conn.queries, query)
+	return driver.RowsAffected(0), nil
+}
+
+func (conn *postgresFakeConn) Ping(ctx context.Context) error { return nil }
+
+func (conn *postgresFakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("no prepared statements")
+}
+
+func (conn *postgresFakeConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return conn.Prepare(query)
+}
+
+func (conn *postgresFakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	conn.queries = append(conn.queries, query)
+
+	switch {
+	case strings.HasPrefix(query, "select count(*)"):
+		return &postgresFakeRows{columns: []string{"count"}, values: [][]driver.Value{{int64(0)}}}, nil
+
+	case strings.Contains(query, "information_schema") && len(args) == 1 && args[0].Value == "rdioScannerCalls":
+		return &postgresFakeRows{columns: []string{"column_name"}, values: [][]driver.Value{{"id"}}}, nil
+
+	case strings.Contains(query, " returning "):
+		return &postgresFakeRows{columns: []string{"id"}, values: [][]driver.Value{{int64(1)}}}, nil
+	}
+
+	return &postgresFakeRows{}, nil
+}
+
+func newPostgresFakeDatabase(t *testing.T) (*Database, *postgresFakeConn) {
+	t.Helper()
+
+	conn := &postgresFakeConn{}
+
+	d := &postgresDriver{open: func(string) (driver.Conn, error) { return conn, nil }, serials: map[string]string{}}
+
+	sqlDb := sql.OpenDB(postgresFakeConnector{d})
+	sqlDb.SetMaxOpenConns(1)
+
+	t.Cleanup(func() { sqlDb.Close() })
+
+	return &Database{Config: &Config{DbType: DbTypePostgres}, Sql: sqlDb}, conn
+}
+
+type postgresFakeConnector struct {
+	driver *postgresDriver
+}
+
+func (c postgresFakeConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.driver.Open("")
+}
+
+func (c postgresFakeConnector) Driver() driver.Driver { return c.driver }
+
+// TestPostgresMigrations runs every migration of a postgresql database
+// through the driver, checking that no mysql is left in what reaches the
+// server.
+func TestPostgresMigrations(t *testing.T) {
+	db, conn := newPostgresFakeDatabase(t)
+
+	if err := db.migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	mysql := []*regexp.Regexp{
+		regexp.MustCompile("`"),
+		regexp.MustCompile(`\?`),
+		regexp.MustCompile(`(?i)\bauto_increment\b`),
+		regexp.MustCompile(`(?i)\btinyint\b`),
+		regexp.MustCompile(`(?i)\b(long|medium)?blob\b`),
+		regexp.MustCompile(`(?i)\b(long|medium)text\b`),
+		regexp.MustCompile(`(?i)\bdatetime\b`),
+		regexp.MustCompile(`(?i)\bjson\b`),
+		regexp.MustCompile(`(?i)\bdouble\b( precision)?`),
+		regexp.MustCompile(`(?i)\bmodify\b`),
+		regexp.MustCompile(`(?i)^drop index "\w+" on\b`),
+	}
+
+	creates := 0
+
+	for _, query := range conn.queries {
+		// the serial function is plpgsql
+		query = strings.Replace(query, postgresSerial, "", 1)
+
+		unquoted := postgresUnquoted(query, func(s string) string { return s })
+		unquoted = regexp.MustCompile(`'([^']|'')*'|"([^"]|"")*"`).ReplaceAllString(unquoted, "")
+
+		for _, re := range mysql {
+			if m := re.FindString(unquoted); len(m) > 0 && m != "double precision" {
+				t.Errorf("%q left in %s", m, query)
+			}
+		}
+
+		if strings.HasPrefix(query, "create table ") {
+			creates++
+		}
+
+		if strings.Contains(query, `"timestamp"`) || strings.Contains(query, `"text"`) {
+			t.Errorf("an identifier was translated in %s", query)
+		}
+	}
+
+	if creates == 0 {
+		t.Fatal("no table was created")
+	}
+}
+
+func TestPostgresInsertReturning(t *testing.T) {
+	db, conn := newPostgresFakeDatabase(t)
+
+	res, err := db.Sql.Exec("insert into `rdioScannerCalls` (`system`, `talkgroup`) values (?, ?)", 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id, err := res.LastInsertId(); err != nil || id != 1 {
+		t.Errorf("LastInsertId() = %d, %v, want 1", id, err)
+	}
+
+	want := `insert into "rdioScannerCalls" ("system", "talkgroup") values ($1, $2) returning "id"`
+	if got := conn.queries[len(conn.queries)-1]; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	if _, err = db.Sql.Exec("insert into `rdioScannerMeta` (`name`) values (?)", "x"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := conn.queries[len(conn.queries)-1]; strings.Contains(got, "returning") {
+		t.Errorf("returning without a serial column in %s", got)
+	}
+}
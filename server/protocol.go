@@ -0,0 +1,171 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+)
+
+// The webapp asks for the second version of the listener protocol with this
+// websocket subprotocol. Listeners that don't, like older webapps and third
+// party apps, keep the first version where everything is json.
+//
+// With the second version, the calls come as binary frames made of the
+// length of a json header on 4 bytes, the header being the message as in
+// the first version without the audio, followed by the raw audio. The
+// config changes come as deltas of the last config sent.
+const (
+	ProtocolV2 = "rdio-scanner.v2"
+)
+
+// ToBinary returns the binary frame of a call message, false when the
+// message is not a call with audio.
+func (message *Message) ToBinary() ([]byte, bool, error) {
+	if message.Command != MessageCommandCall {
+		return nil, false, nil
+	}
+
+	call, ok := message.Payload.(*Call)
+	if !ok || call == nil || len(call.Audio) == 0 {
+		return nil, false, nil
+	}
+
+	header := &Message{Command: message.Command, Payload: call.metadata(), Flag: message.Flag, Seq: message.Seq}
+
+	b, err := header.ToJson()
+	if err != nil {
+		return nil, false, err
+	}
+
+	frame := make([]byte, 4, 4+len(b)+len(call.Audio))
+	binary.BigEndian.PutUint32(frame, uint32(len(b)))
+	frame = append(frame, b...)
+	frame = append(frame, call.Audio...)
+
+	return frame, true, nil
+}
+
+// protocolConfig is the json of each part of the last config sent to a
+// listener, from which the next config is sent as a delta.
+type protocolConfig struct {
+	keys    map[string]string
+	order   []any
+	systems map[string]string
+}
+
+func newProtocolConfig(payload map[string]any) (*protocolConfig, error) {
+	config := &protocolConfig{
+		keys:    map[string]string{},
+		order:   []any{},
+		systems: map[string]string{},
+	}
+
+	for key, value := range payload {
+		if key == "systems" {
+			continue
+		}
+
+		b, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+
+		config.keys[key] = string(b)
+	}
+
+	if systems, ok := payload["systems"].(SystemsMap); ok {
+		for _, system := range systems {
+			b, err := json.Marshal(system)
+			if err != nil {
+				return nil, err
+			}
+
+			config.order = append(config.order, system["id"])
+			config.systems[fmt.Sprintf("%v", system["id"])] = string(b)
+		}
+	}
+
+	return config, nil
+}
+
+// delta returns the changes from the config to the next one, nil when they
+// are the same. Only the systems that changed are sent, along with the order
+// of all of them.
+func (config *protocolConfig) delta(next *protocolConfig, payload map[string]any) map[string]any {
+	set := map[string]any{}
+	unset := []string{}
+
+	for key, value := range next.keys {
+		if config.keys[key] != value {
+			set[key] = payload[key]
+		}
+	}
+
+	for key := range config.keys {
+		if _, ok := next.keys[key]; !ok {
+			unset = append(unset, key)
+		}
+	}
+
+	systemsSet := []SystemMap{}
+	systemsRemove := []any{}
+
+	if systems, ok := payload["systems"].(SystemsMap); ok {
+		for _, system := range systems {
+			id := fmt.Sprintf("%v", system["id"])
+			if config.systems[id] != next.systems[id] {
+				systemsSet = append(systemsSet, system)
+			}
+		}
+	}
+
+	for _, id := range config.order {
+		if _, ok := next.systems[fmt.Sprintf("%v", id)]; !ok {
+			systemsRemove = append(systemsRemove, id)
+		}
+	}
+
+	reordered := len(config.order) != len(next.order)
+	for i := 0; !reordered && i < len(next.order); i++ {
+		reordered = fmt.Sprintf("%v", config.order[i]) != fmt.Sprintf("%v", next.order[i])
+	}
+
+	delta := map[string]any{}
+
+	if len(set) > 0 {
+		delta["set"] = set
+	}
+
+	if len(unset) > 0 {
+		delta["unset"] = unset
+	}
+
+	if len(systemsSet) > 0 || len(systemsRemove) > 0 || reordered {
+		delta["systems"] = map[string]any{
+			"order":  next.order,
+			"remove": systemsRemove,
+			"set":    systemsSet,
+		}
+	}
+
+	if len(delta) == 0 {
+		return nil
+	}
+
+	return delta
+}
@@ -0,0 +1,190 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// protocolJson returns the value as the webapp gets it.
+func protocolJson(t *testing.T, v any) map[string]any {
+	t.Helper()
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := map[string]any{}
+	if err = json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+// protocolApply merges a delta into a config as the webapp does.
+func protocolApply(config map[string]any, delta map[string]any) map[string]any {
+	next := map[string]any{}
+
+	for k, v := range config {
+		next[k] = v
+	}
+
+	if set, ok := delta["set"].(map[string]any); ok {
+		for k, v := range set {
+			next[k] = v
+		}
+	}
+
+	if unset, ok := delta["unset"].([]any); ok {
+		for _, k := range unset {
+			delete(next, k.(string))
+		}
+	}
+
+	if d, ok := delta["systems"].(map[string]any); ok {
+		systems := map[float64]any{}
+
+		if l, ok := next["systems"].([]any); ok {
+			for _, system := range l {
+				systems[system.(map[string]any)["id"].(float64)] = system
+			}
+		}
+
+		if remove, ok := d["remove"].([]any); ok {
+			for _, id := range remove {
+				delete(systems, id.(float64))
+			}
+		}
+
+		if set, ok := d["set"].([]any); ok {
+			for _, system := range set {
+				systems[system.(map[string]any)["id"].(float64)] = system
+			}
+		}
+
+		l := []any{}
+		if order, ok := d["order"].([]any); ok {
+			for _, id := range order {
+				if system, ok := systems[id.(float64)]; ok {
+					l = append(l, system)
+				}
+			}
+		}
+		next["systems"] = l
+	}
+
+	return next
+}
+
+func TestProtocolConfigDelta(t *testing.T) {
+	system := func(id uint, label string, talkgroups ...uint) SystemMap {
+		tgs := []map[string]any{}
+		for _, tg := range talkgroups {
+			tgs = append(tgs, map[string]any{"id": tg, "label": label})
+		}
+		return SystemMap{"id": id, "label": label, "talkgroups": tgs}
+	}
+
+	base := func() map[string]any {
+		return map[string]any{
+			"options": map[string]any{"dimmerDelay": 5000, "time12h": false},
+			"groups":  map[string]any{"1": []uint{1, 2}},
+			"systems": SystemsMap{system(1, "a", 1, 2), system(2, "b", 3)},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		change    func(m map[string]any)
+		wantDelta bool
+	}{
+		{"same", func(m map[string]any) {}, false},
+		{"option changed", func(m map[string]any) { m["options"].(map[string]any)["time12h"] = true }, true},
+		{"key added", func(m map[string]any) { m["tags"] = map[string]any{"fire": []uint{1}} }, true},
+		{"key set to null", func(m map[string]any) { m["groups"] = nil }, true},
+		{"key removed", func(m map[string]any) { delete(m, "groups") }, true},
+		{"talkgroup changed", func(m map[string]any) { m["systems"] = SystemsMap{system(1, "a", 1, 4), system(2, "b", 3)} }, true},
+		{"system added", func(m map[string]any) { m["systems"] = append(m["systems"].(SystemsMap), system(3, "c", 5)) }, true},
+		{"system removed", func(m map[string]any) { m["systems"] = SystemsMap{system(2, "b", 3)} }, true},
+		{"systems reordered", func(m map[string]any) { m["systems"] = SystemsMap{system(2, "b", 3), system(1, "a", 1, 2)} }, true},
+		{"every system removed", func(m map[string]any) { m["systems"] = SystemsMap{} }, true},
+		{
+			name: "everything at once",
+			change: func(m map[string]any) {
+				delete(m, "groups")
+				m["options"] = map[string]any{"dimmerDelay": 0}
+				m["tags"] = []any{}
+				m["systems"] = SystemsMap{system(4, "d"), system(2, "B", 3)}
+			},
+			wantDelta: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := base()
+			b := base()
+			test.change(b)
+
+			configA, err := newProtocolConfig(a)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			configB, err := newProtocolConfig(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			delta := configA.delta(configB, b)
+			if (delta != nil) != test.wantDelta {
+				t.Fatalf("delta() = %v, want a delta %v", delta, test.wantDelta)
+			}
+
+			got := protocolJson(t, a)
+			if delta != nil {
+				got = protocolApply(got, protocolJson(t, delta))
+			}
+
+			if want := protocolJson(t, b); !reflect.DeepEqual(got, want) {
+				t.Errorf("applied delta\n got %v\nwant %v", got, want)
+			}
+		})
+	}
+}
+
+func TestProtocolConfigDeltaSendsChangesOnly(t *testing.T) {
+	a := map[string]any{"options": 1, "systems": SystemsMap{{"id": uint(1), "label": "a"}, {"id": uint(2), "label": "b"}}}
+	b := map[string]any{"options": 1, "systems": SystemsMap{{"id": uint(1), "label": "a"}, {"id": uint(2), "label": "c"}}}
+
+	configA, _ := newProtocolConfig(a)
+	configB, _ := newProtocolConfig(b)
+
+	delta := protocolJson(t, configA.delta(configB, b))
+
+	if _, ok := delta["set"]; ok {
+		t.Errorf("unchanged keys sent, %v", delta["set"])
+	}
+
+	set := delta["systems"].(map[string]any)["set"].([]any)
+	if len(set) != 1 || set[0].(map[string]any)["id"] != float64(2) {
+		t.Errorf("systems sent %v, want only system 2", set)
+	}
+}
@@ -0,0 +1,1377 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	PublisherTypeKafka    = "kafka"
+	PublisherTypeMastodon = "mastodon"
+	PublisherTypeMqtt     = "mqtt"
+	PublisherTypeNats     = "nats"
+	PublisherTypeX        = "x"
+
+	PublisherSchema           = "rdio-scanner.call.ingested"
+	PublisherSchemaTranscript = "rdio-scanner.call.transcribed"
+	PublisherSchemaVersion    = 1
+
+	publisherBackoff   = time.Second
+	publisherQueueSize = 1024
+	publisherRetries   = 5
+	publisherTimeout   = 10 * time.Second
+)
+
+// Publisher sends a versioned event for each ingested call of the selected
+// systems to a kafka topic, a mqtt topic or a nats subject, and another one
+// once the call is transcribed when Transcripts is set. Brokers is a comma
+// separated list of host:port, mqtt and nats brokers may be prefixed with
+// user:pass@. The subject accepts the {system} and {talkgroup} placeholders,
+// ie: rdio/{system}/{talkgroup}. Events are acknowledged by the broker before
+// the next one is sent, and retried on failure, so consumers should dedupe
+// them on their id. Mqtt publishers with a Discovery prefix, ie:
+// homeassistant, also announce the talkgroups to home assistant.
+//
+// Mastodon and x publishers post the Template, a text/template of the
+// call, to the api url in Brokers with the access token as its user, ie:
+// https://token@mastodon.social. They post once the call is transcribed
+// when Transcripts is set, and no more than Rate posts per hour when set.
+type Publisher struct {
+	Id          any    `json:"_id"`
+	Brokers     string `json:"brokers"`
+	Disabled    bool   `json:"disabled"`
+	Discovery   string `json:"discovery"`
+	Order       any    `json:"order"`
+	Rate        uint   `json:"rate"`
+	Subject     string `json:"subject"`
+	Systems     any    `json:"systems"`
+	Template    string `json:"template"`
+	Transcripts bool   `json:"transcripts"`
+	Type        string `json:"type"`
+	calls       map[string]uint
+	kafka       *publisherKafka
+	mqtt        *publisherMqtt
+	nats        *publisherNats
+	posts       []time.Time
+	queue       chan *publisherEvent
+	shares      *Shares
+	systems     *Systems
+}
+
+// publisherEvent is a call queued to a publisher, with its transcript when
+// it is the transcription which is published. Calls is the count of the
+// calls of the talkgroup once the call is counted, it is counted once for
+// all the retries.
+type publisherEvent struct {
+	call       *Call
+	calls      uint
+	transcript string
+}
+
+func (publisher *Publisher) FromMap(m map[string]any) *Publisher {
+	switch v := m["_id"].(type) {
+	case float64:
+		publisher.Id = uint(v)
+	}
+
+	switch v := m["brokers"].(type) {
+	case string:
+		publisher.Brokers = v
+	}
+
+	switch v := m["disabled"].(type) {
+	case bool:
+		publisher.Disabled = v
+	}
+
+	switch v := m["discovery"].(type) {
+	case string:
+		publisher.Discovery = v
+	}
+
+	switch v := m["order"].(type) {
+	case float64:
+		publisher.Order = uint(v)
+	}
+
+	switch v := m["rate"].(type) {
+	case float64:
+		publisher.Rate = uint(v)
+	}
+
+	switch v := m["subject"].(type) {
+	case string:
+		publisher.Subject = v
+	}
+
+	switch v := m["systems"].(type) {
+	case []any:
+		if b, err := json.Marshal(v); err == nil {
+			publisher.Systems = string(b)
+		}
+	case string:
+		publisher.Systems = v
+	}
+
+	switch v := m["template"].(type) {
+	case string:
+		publisher.Template = v
+	}
+
+	switch v := m["transcripts"].(type) {
+	case bool:
+		publisher.Transcripts = v
+	}
+
+	switch v := m["type"].(type) {
+	case string:
+		publisher.Type = v
+	}
+
+	return publisher
+}
+
+func (publisher *Publisher) HasAccess(call *Call) bool {
+	if publisher.Disabled {
+		return false
+	}
+
+	return (&Downstream{Systems: publisher.Systems}).HasAccess(call)
+}
+
+// Publish sends the event of the call, id stays the same across retries.
+func (publisher *Publisher) Publish(call *Call, id string) error {
+	return publisher.publish(&publisherEvent{call: call}, id)
+}
+
+// PublishTranscript sends the event of the transcription of the call.
+func (publisher *Publisher) PublishTranscript(call *Call, transcript string, id string) error {
+	return publisher.publish(&publisherEvent{call: call, transcript: transcript}, id)
+}
+
+func (publisher *Publisher) publish(event *publisherEvent, id string) error {
+	formatError := func(err error) error {
+		return fmt.Errorf("publisher.publish: %v", err)
+	}
+
+	call := event.call
+
+	m := map[string]any{
+		"call":    call.exportFields(),
+		"id":      id,
+		"schema":  PublisherSchema,
+		"time":    time.Now().UTC().Format(time.RFC3339Nano),
+		"version": PublisherSchemaVersion,
+	}
+
+	if len(event.transcript) > 0 {
+		m["schema"] = PublisherSchemaTranscript
+		m["transcript"] = event.transcript
+	}
+
+	payload, err := json.Marshal(m)
+	if err != nil {
+		return formatError(err)
+	}
+
+	subject := publisher.subject(call.System, call.Talkgroup, publisher.Subject)
+
+	key := fmt.Sprintf("%d.%d", call.System, call.Talkgroup)
+
+	brokers := []string{}
+	for _, broker := range strings.Split(publisher.Brokers, ",") {
+		if broker = strings.TrimSpace(broker); len(broker) > 0 {
+			brokers = append(brokers, broker)
+		}
+	}
+	if len(brokers) == 0 {
+		return formatError(errors.New("no brokers"))
+	}
+
+	switch publisher.Type {
+	case PublisherTypeKafka:
+		if publisher.kafka == nil {
+			publisher.kafka = &publisherKafka{brokers: brokers}
+		}
+		err = publisher.kafka.produce(subject, []byte(key), payload)
+
+	case PublisherTypeMastodon, PublisherTypeX:
+		// the call is posted with its transcript instead
+		if publisher.Transcripts && len(event.transcript) == 0 {
+			return nil
+		}
+
+		if err = publisher.post(event, id, brokers[0]); errors.Is(err, errPublisherRate) {
+			return err
+		}
+
+	case PublisherTypeMqtt:
+		if publisher.mqtt == nil {
+			publisher.mqtt = &publisherMqtt{brokers: brokers}
+		}
+		err = publisher.mqtt.publish(subject, payload, false)
+
+		if err == nil && len(publisher.Discovery) > 0 && len(event.transcript) == 0 {
+			err = publisher.publishHomeAssistant(event)
+		}
+
+	case PublisherTypeNats:
+		if publisher.nats == nil {
+			publisher.nats = &publisherNats{brokers: brokers}
+		}
+		err = publisher.nats.publish(subject, payload)
+
+	default:
+		err = fmt.Errorf("unknown type %s", publisher.Type)
+	}
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	return nil
+}
+
+// publishHomeAssistant announces the talkgroups when connected again, and
+// then the talkgroup of the call if it wasn't, before its state and event.
+func (publisher *Publisher) publishHomeAssistant(event *publisherEvent) error {
+	call := event.call
+
+	talkgroups := []homeAssistantTalkgroup{}
+
+	if publisher.mqtt.announced == nil {
+		publisher.mqtt.announced = map[string]bool{}
+		talkgroups = publisher.homeAssistantTalkgroups(publisher.systems)
+	}
+
+	key := fmt.Sprintf("%d.%d", call.System, call.Talkgroup)
+
+	if !publisher.mqtt.announced[key] {
+		talkgroup := homeAssistantTalkgroup{system: call.System, talkgroup: call.Talkgroup}
+
+		// a talkgroup added since connected
+		if publisher.systems != nil {
+			if system, ok := publisher.systems.GetSystem(call.System); ok {
+				talkgroup.systemLabel = system.Label
+				if t, ok := system.Talkgroups.GetTalkgroup(call.Talkgroup); ok {
+					talkgroup.label = t.Label
+					talkgroup.name = t.Name
+				}
+			}
+		}
+
+		talkgroups = append(talkgroups, talkgroup)
+	}
+
+	for _, talkgroup := range talkgroups {
+		k := fmt.Sprintf("%d.%d", talkgroup.system, talkgroup.talkgroup)
+		if publisher.mqtt.announced[k] {
+			continue
+		}
+
+		messages, err := publisher.homeAssistantDiscovery(talkgroup)
+		if err != nil {
+			return err
+		}
+
+		for _, message := range messages {
+			if err = publisher.mqtt.publish(message.topic, message.payload, message.retain); err != nil {
+				return err
+			}
+		}
+
+		publisher.mqtt.announced[k] = true
+	}
+
+	if event.calls == 0 {
+		if publisher.calls == nil {
+			publisher.calls = map[string]uint{}
+		}
+		publisher.calls[key]++
+		event.calls = publisher.calls[key]
+	}
+
+	messages, err := publisher.homeAssistantCall(call, event.calls, publisher.systems)
+	if err != nil {
+		return err
+	}
+
+	for _, message := range messages {
+		if err = publisher.mqtt.publish(message.topic, message.payload, message.retain); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// publisherUnit returns the label of the unit of the call, or its radio id
+// when the unit has no label.
+func publisherUnit(call *Call, systems *Systems) string {
+	var source uint
+
+	switch v := call.Source.(type) {
+	case float64:
+		source = uint(v)
+	case int:
+		if v > 0 {
+			source = uint(v)
+		}
+	case uint:
+		source = v
+	}
+
+	if source == 0 {
+		return ""
+	}
+
+	if systems != nil {
+		if system, ok := systems.GetSystem(call.System); ok {
+			if unit, ok := system.Units.GetUnit(source); ok && len(unit.Label) > 0 {
+				return unit.Label
+			}
+		}
+	}
+
+	return fmt.Sprintf("%d", source)
+}
+
+// subject returns the subject with the placeholders of the talkgroup
+// replaced.
+func (publisher *Publisher) subject(system uint, talkgroup uint, subject string) string {
+	return strings.NewReplacer(
+		"{system}", fmt.Sprintf("%d", system),
+		"{talkgroup}", fmt.Sprintf("%d", talkgroup),
+	).Replace(subject)
+}
+
+func (publisher *Publisher) close() {
+	if publisher.kafka != nil {
+		publisher.kafka.close()
+	}
+
+	if publisher.mqtt != nil {
+		publisher.mqtt.close()
+	}
+
+	if publisher.nats != nil {
+		publisher.nats.close()
+	}
+}
+
+func (publisher *Publisher) start(controller *Controller) {
+	publisher.queue = make(chan *publisherEvent, publisherQueueSize)
+	publisher.shares = controller.Shares
+	publisher.systems = controller.Systems
+
+	go func(queue chan *publisherEvent) {
+		for event := range queue {
+			call := event.call
+
+			logEvent := func(logLevel string, message string) {
+				controller.Logs.LogEvent(logLevel, fmt.Sprintf("publisher: system=%v talkgroup=%v to %v %v %v", call.System, call.Talkgroup, publisher.Type, publisher.Subject, message))
+			}
+
+			backoff := publisherBackoff
+
+			id := uuid.New().String()
+
+			for attempt := 1; ; attempt++ {
+				err := publisher.publish(event, id)
+				if err == nil {
+					break
+				}
+
+				if errors.Is(err, errPublisherRate) {
+					logEvent(LogLevelInfo, fmt.Sprintf("skipped, %v of %d posts per hour", err.Error(), publisher.Rate))
+					break
+				}
+
+				publisher.close()
+
+				if attempt == publisherRetries {
+					logEvent(LogLevelError, err.Error())
+
+					if call.trace != nil {
+						call.trace.AddEvent(fmt.Sprintf("publisher %v %v", publisher.Type, err.Error()))
+					}
+					break
+				}
+
+				logEvent(LogLevelWarn, fmt.Sprintf("%v, retrying in %v", err.Error(), backoff))
+
+				time.Sleep(backoff)
+				backoff *= 2
+			}
+		}
+
+		publisher.close()
+	}(publisher.queue)
+}
+
+func (publisher *Publisher) stop() {
+	if publisher.queue != nil {
+		close(publisher.queue)
+		publisher.queue = nil
+	}
+}
+
+type Publishers struct {
+	Controller *Controller
+	List       []*Publisher
+	mutex      sync.Mutex
+}
+
+func NewPublishers(controller *Controller) *Publishers {
+	return &Publishers{
+		Controller: controller,
+		List:       []*Publisher{},
+		mutex:      sync.Mutex{},
+	}
+}
+
+func (publishers *Publishers) FromMap(f []any) *Publishers {
+	publishers.mutex.Lock()
+	defer publishers.mutex.Unlock()
+
+	for _, publisher := range publishers.List {
+		publisher.stop()
+	}
+
+	publishers.List = []*Publisher{}
+
+	for _, r := range f {
+		switch m := r.(type) {
+		case map[string]any:
+			publisher := &Publisher{}
+			publisher.FromMap(m)
+			publishers.List = append(publishers.List, publisher)
+		}
+	}
+
+	return publishers
+}
+
+// Publish queues the call on every matching publisher. Each publisher sends
+// its events in order from its own worker, a call is dropped if the queue of
+// a publisher is full.
+func (publishers *Publishers) Publish(call *Call) {
+	publishers.mutex.Lock()
+	defer publishers.mutex.Unlock()
+
+	for _, publisher := range publishers.List {
+		if publisher.queue == nil || !publisher.HasAccess(call) {
+			continue
+		}
+
+		select {
+		case publisher.queue <- &publisherEvent{call: call}:
+		default:
+			publishers.Controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("publisher: system=%v talkgroup=%v to %v %v skipped, queue is full", call.System, call.Talkgroup, publisher.Type, publisher.Subject))
+		}
+	}
+}
+
+// PublishTranscript queues the transcription of the call on the matching
+// publishers which publish the transcripts.
+func (publishers *Publishers) PublishTranscript(call *Call, transcript string) {
+	publishers.mutex.Lock()
+	defer publishers.mutex.Unlock()
+
+	for _, publisher := range publishers.List {
+		if publisher.queue == nil || !publisher.Transcripts || !publisher.HasAccess(call) {
+			continue
+		}
+
+		select {
+		case publisher.queue <- &publisherEvent{call: call, transcript: transcript}:
+		default:
+			publishers.Controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("publisher: system=%v talkgroup=%v transcript to %v %v skipped, queue is full", call.System, call.Talkgroup, publisher.Type, publisher.Subject))
+		}
+	}
+}
+
+func (publishers *Publishers) Read(db *Database) error {
+	var (
+		err     error
+		id      sql.NullFloat64
+		order   sql.NullFloat64
+		rows    *sql.Rows
+		systems string
+	)
+
+	publishers.mutex.Lock()
+	defer publishers.mutex.Unlock()
+
+	for _, publisher := range publishers.List {
+		publisher.stop()
+	}
+
+	publishers.List = []*Publisher{}
+
+	formatError := func(err error) error {
+		return fmt.Errorf("publishers.read: %v", err)
+	}
+
+	if rows, err = db.Sql.Query("select `_id`, `brokers`, `disabled`, `discovery`, `order`, `rate`, `subject`, `systems`, `template`, `transcripts`, `type` from `rdioScannerPublishers` order by `order`"); err != nil {
+		return formatError(err)
+	}
+
+	for rows.Next() {
+		publisher := &Publisher{}
+
+		if err = rows.Scan(&id, &publisher.Brokers, &publisher.Disabled, &publisher.Discovery, &order, &publisher.Rate, &publisher.Subject, &systems, &publisher.Template, &publisher.Transcripts, &publisher.Type); err != nil {
+			break
+		}
+
+		if publisher.Brokers, err = db.Secrets.Open(publisher.Brokers); err != nil {
+			break
+		}
+
+		if id.Valid && id.Float64 > 0 {
+			publisher.Id = uint(id.Float64)
+		}
+
+		if order.Valid && order.Float64 > 0 {
+			publisher.Order = uint(order.Float64)
+		}
+
+		if err = json.Unmarshal([]byte(systems), &publisher.Systems); err != nil {
+			publisher.Systems = []any{}
+		}
+
+		if !publisher.Disabled {
+			publisher.start(publishers.Controller)
+		}
+
+		publishers.List = append(publishers.List, publisher)
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	return nil
+}
+
+func (publishers *Publishers) Write(db *Database) error {
+	var (
+		brokers string
+		count   uint
+		err     error
+		rows    *sql.Rows
+		rowIds  = []uint{}
+		systems any
+	)
+
+	publishers.mutex.Lock()
+	defer publishers.mutex.Unlock()
+
+	formatError := func(err error) error {
+		return fmt.Errorf("publishers.write: %v", err)
+	}
+
+	if rows, err = db.Sql.Query("select `_id` from `rdioScannerPublishers`"); err != nil {
+		return formatError(err)
+	}
+
+	for rows.Next() {
+		var rowId uint
+		if err = rows.Scan(&rowId); err != nil {
+			break
+		}
+		remove := true
+		for _, publisher := range publishers.List {
+			if publisher.Id == nil || publisher.Id == rowId {
+				remove = false
+				break
+			}
+		}
+		if remove {
+			rowIds = append(rowIds, rowId)
+		}
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	if len(rowIds) > 0 {
+		if _, err = db.Delete("rdioScannerPublishers").Where(SqlIn("_id", rowIds)).Exec(); err != nil {
+			return formatError(err)
+		}
+	}
+
+	for _, publisher := range publishers.List {
+		switch publisher.Systems {
+		case "*":
+			systems = `"*"`
+		default:
+			systems = publisher.Systems
+		}
+
+		if brokers, err = db.Secrets.Seal(publisher.Brokers); err != nil {
+			break
+		}
+
+		if err = db.Sql.QueryRow("select count(*) from `rdioScannerPublishers` where `_id` = ?", publisher.Id).Scan(&count); err != nil {
+			break
+		}
+
+		if count == 0 {
+			if _, err = db.Sql.Exec("insert into `rdioScannerPublishers` (`_id`, `brokers`, `disabled`, `discovery`, `order`, `rate`, `subject`, `systems`, `template`, `transcripts`, `type`) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", publisher.Id, brokers, publisher.Disabled, publisher.Discovery, publisher.Order, publisher.Rate, publisher.Subject, systems, publisher.Template, publisher.Transcripts, publisher.Type); err != nil {
+				break
+			}
+
+		} else if _, err = db.Sql.Exec("update `rdioScannerPublishers` set `brokers` = ?, `disabled` = ?, `discovery` = ?, `order` = ?, `rate` = ?, `subject` = ?, `systems` = ?, `template` = ?, `transcripts` = ?, `type` = ? where `_id` = ?", brokers, publisher.Disabled, publisher.Discovery, publisher.Order, publisher.Rate, publisher.Subject, systems, publisher.Template, publisher.Transcripts, publisher.Type, publisher.Id); err != nil {
+			break
+		}
+	}
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	return nil
+}
+
+// publisherKafka is a minimal kafka producer. It speaks metadata v4 to find
+// the partition leaders and produce v3 with acks from all in sync replicas.
+// The call key picks the partition, keeping the events of a talkgroup in
+// order.
+type publisherKafka struct {
+	brokers     []string
+	conns       map[string]net.Conn
+	correlation int32
+	leaders     []string
+	topic       string
+}
+
+func (kafka *publisherKafka) close() {
+	for _, conn := range kafka.conns {
+		conn.Close()
+	}
+
+	kafka.conns = nil
+	kafka.leaders = nil
+}
+
+func (kafka *publisherKafka) conn(addr string) (net.Conn, error) {
+	if kafka.conns == nil {
+		kafka.conns = map[string]net.Conn{}
+	}
+
+	if conn, ok := kafka.conns[addr]; ok {
+		return conn, nil
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, publisherTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	kafka.conns[addr] = conn
+
+	return conn, nil
+}
+
+func (kafka *publisherKafka) metadata(topic string) error {
+	var err error
+
+	req := &kafkaWriter{}
+	req.int32(1)
+	req.string(topic)
+	req.int8(1) // allow auto topic creation
+
+	for _, broker := range kafka.brokers {
+		var res *kafkaReader
+
+		if res, err = kafka.request(broker, 3, 4, req.Bytes()); err != nil {
+			continue
+		}
+
+		res.int32() // throttle time
+
+		nodes := map[int32]string{}
+		for i := res.int32(); i > 0; i-- {
+			node := res.int32()
+			host := res.string()
+			port := res.int32()
+			res.string() // rack
+			nodes[node] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+		}
+
+		res.string() // cluster id
+		res.int32()  // controller id
+
+		leaders := []string{}
+		for i := res.int32(); i > 0; i-- {
+			if code := res.int16(); code != 0 {
+				err = fmt.Errorf("kafka metadata error %d", code)
+			}
+			res.string() // name
+			res.int8()   // is internal
+
+			for j := res.int32(); j > 0; j-- {
+				res.int16() // partition error
+				index := res.int32()
+				leader := res.int32()
+				res.skipArray(4) // replicas
+				res.skipArray(4) // isr
+
+				for int(index) >= len(leaders) {
+					leaders = append(leaders, "")
+				}
+				leaders[index] = nodes[leader]
+			}
+		}
+
+		if res.err != nil {
+			err = res.err
+			continue
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if len(leaders) == 0 {
+			err = fmt.Errorf("kafka topic %s has no partitions", topic)
+			continue
+		}
+
+		kafka.leaders = leaders
+		kafka.topic = topic
+
+		return nil
+	}
+
+	return err
+}
+
+func (kafka *publisherKafka) produce(topic string, key []byte, value []byte) error {
+	if kafka.leaders == nil || kafka.topic != topic {
+		if err := kafka.metadata(topic); err != nil {
+			return err
+		}
+	}
+
+	h := fnv.New32a()
+	h.Write(key)
+	partition := int32(h.Sum32() % uint32(len(kafka.leaders)))
+
+	leader := kafka.leaders[partition]
+	if len(leader) == 0 {
+		kafka.leaders = nil
+		return fmt.Errorf("kafka partition %d has no leader", partition)
+	}
+
+	req := &kafkaWriter{}
+	req.int16(-1) // transactional id
+	req.int16(-1) // acks from all in sync replicas
+	req.int32(int32(publisherTimeout / time.Millisecond))
+	req.int32(1)
+	req.string(topic)
+	req.int32(1)
+	req.int32(partition)
+	batch := kafkaRecordBatch(key, value, time.Now())
+	req.int32(int32(len(batch)))
+	req.Write(batch)
+
+	res, err := kafka.request(leader, 0, 3, req.Bytes())
+	if err != nil {
+		return err
+	}
+
+	for i := res.int32(); i > 0; i-- {
+		res.string()
+		for j := res.int32(); j > 0; j-- {
+			res.int32()
+			if code := res.int16(); code != 0 {
+				kafka.leaders = nil
+				return fmt.Errorf("kafka produce error %d", code)
+			}
+			res.int64()
+			res.int64()
+		}
+	}
+
+	return res.err
+}
+
+func (kafka *publisherKafka) request(addr string, apiKey int16, apiVersion int16, body []byte) (*kafkaReader, error) {
+	conn, err := kafka.conn(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	kafka.correlation++
+
+	req := &kafkaWriter{}
+	req.int16(apiKey)
+	req.int16(apiVersion)
+	req.int32(kafka.correlation)
+	req.string("rdio-scanner")
+	req.Write(body)
+
+	b := make([]byte, 4, 4+req.Len())
+	binary.BigEndian.PutUint32(b, uint32(req.Len()))
+	b = append(b, req.Bytes()...)
+
+	conn.SetDeadline(time.Now().Add(publisherTimeout))
+
+	if _, err = conn.Write(b); err != nil {
+		kafka.close()
+		return nil, err
+	}
+
+	if _, err = io.ReadFull(conn, b[:4]); err != nil {
+		kafka.close()
+		return nil, err
+	}
+
+	res := make([]byte, binary.BigEndian.Uint32(b[:4]))
+	if _, err = io.ReadFull(conn, res); err != nil {
+		kafka.close()
+		return nil, err
+	}
+
+	r := &kafkaReader{b: res}
+	if r.int32() != kafka.correlation {
+		kafka.close()
+		return nil, errors.New("kafka correlation mismatch")
+	}
+
+	return r, nil
+}
+
+var kafkaCrcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaCrc is the castagnoli checksum of the record batches.
+func kafkaCrc(b []byte) uint32 {
+	return crc32.Checksum(b, kafkaCrcTable)
+}
+
+// kafkaRecordBatch returns the v2 record batch of a single record, stamped
+// with the time given.
+func kafkaRecordBatch(key []byte, value []byte, t time.Time) []byte {
+	now := t.UnixMilli()
+
+	record := &kafkaWriter{}
+	record.int8(0)   // attributes
+	record.varint(0) // timestamp delta
+	record.varint(0) // offset delta
+	record.varint(int64(len(key)))
+	record.Write(key)
+	record.varint(int64(len(value)))
+	record.Write(value)
+	record.varint(0) // headers
+
+	// everything after the crc, which itself is a castagnoli checksum
+	tail := &kafkaWriter{}
+	tail.int16(0) // attributes
+	tail.int32(0) // last offset delta
+	tail.int64(now)
+	tail.int64(now)
+	tail.int64(-1) // producer id
+	tail.int16(-1) // producer epoch
+	tail.int32(-1) // base sequence
+	tail.int32(1)
+	tail.varint(int64(record.Len()))
+	tail.Write(record.Bytes())
+
+	batch := &kafkaWriter{}
+	batch.int64(0)                             // base offset
+	batch.int32(int32(4 + 1 + 4 + tail.Len())) // batch length
+	batch.int32(-1)                            // partition leader epoch
+	batch.int8(2)                              // magic
+	batch.int32(int32(kafkaCrc(tail.Bytes())))
+	batch.Write(tail.Bytes())
+
+	return batch.Bytes()
+}
+
+type kafkaReader struct {
+	b   []byte
+	err error
+}
+
+func (r *kafkaReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.b) < n {
+		r.err = errors.New("kafka short response")
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *kafkaReader) int8() int8 {
+	if b := r.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (r *kafkaReader) int16() int16 {
+	if b := r.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int32() int32 {
+	if b := r.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int64() int64 {
+	if b := r.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) skipArray(size int) {
+	if n := r.int32(); n > 0 {
+		r.next(int(n) * size)
+	}
+}
+
+func (r *kafkaReader) string() string {
+	n := r.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(r.next(int(n)))
+}
+
+type kafkaWriter struct {
+	bytes.Buffer
+}
+
+func (w *kafkaWriter) int8(v int8) {
+	w.WriteByte(byte(v))
+}
+
+func (w *kafkaWriter) int16(v int16) {
+	binary.Write(w, binary.BigEndian, v)
+}
+
+func (w *kafkaWriter) int32(v int32) {
+	binary.Write(w, binary.BigEndian, v)
+}
+
+func (w *kafkaWriter) int64(v int64) {
+	binary.Write(w, binary.BigEndian, v)
+}
+
+func (w *kafkaWriter) string(s string) {
+	w.int16(int16(len(s)))
+	w.WriteString(s)
+}
+
+func (w *kafkaWriter) varint(v int64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	w.Write(b[:binary.PutVarint(b, v)])
+}
+
+// publisherMqtt is a minimal mqtt 3.1.1 client. It publishes with qos 1, the
+// puback confirming that the broker has the message. The topic is the
+// subject of the publisher, it can't hold the + and # wildcards. Announced
+// are the talkgroups announced to home assistant since connected.
+type publisherMqtt struct {
+	announced map[string]bool
+	brokers   []string
+	conn      net.Conn
+	packetId  uint16
+	reader    *bufio.Reader
+}
+
+func (mqtt *publisherMqtt) close() {
+	if mqtt.conn != nil {
+		mqtt.conn.Write([]byte{0xe0, 0x00})
+		mqtt.conn.Close()
+		mqtt.conn = nil
+	}
+}
+
+func (mqtt *publisherMqtt) connect() error {
+	var err error
+
+	for _, broker := range mqtt.brokers {
+		var (
+			conn     net.Conn
+			user     string
+			password string
+		)
+
+		broker = strings.TrimPrefix(broker, "mqtt://")
+
+		if i := strings.LastIndex(broker, "@"); i >= 0 {
+			user, password, _ = strings.Cut(broker[:i], ":")
+			broker = broker[i+1:]
+		}
+
+		if conn, err = net.DialTimeout("tcp", broker, publisherTimeout); err != nil {
+			continue
+		}
+
+		mqtt.announced = nil
+		mqtt.conn = conn
+		mqtt.reader = bufio.NewReader(conn)
+
+		conn.SetDeadline(time.Now().Add(publisherTimeout))
+
+		// clean session, no keep alive as the broker isn't read between
+		// the publishes
+		flags := byte(0x02)
+		if len(user) > 0 {
+			flags |= 0x80
+		}
+		if len(password) > 0 {
+			flags |= 0x40
+		}
+
+		w := &mqttWriter{}
+		w.string("MQTT")
+		w.buf.WriteByte(4)
+		w.buf.WriteByte(flags)
+		w.uint16(0)
+		w.string(fmt.Sprintf("rdio-scanner-%s", strings.ReplaceAll(uuid.New().String(), "-", "")[:12]))
+		if len(user) > 0 {
+			w.string(user)
+		}
+		if len(password) > 0 {
+			w.string(password)
+		}
+
+		if _, err = conn.Write(mqttPacket(0x10, w.buf.Bytes())); err == nil {
+			var (
+				kind byte
+				body []byte
+			)
+
+			if kind, body, err = mqttReadPacket(mqtt.reader); err == nil {
+				switch {
+				case kind>>4 != 2 || len(body) != 2:
+					err = fmt.Errorf("mqtt unexpected packet %d", kind>>4)
+				case body[1] != 0:
+					err = fmt.Errorf("mqtt connection refused, %s", mqttConnackReason(body[1]))
+				}
+			}
+		}
+
+		if err != nil {
+			mqtt.close()
+			continue
+		}
+
+		return nil
+	}
+
+	return err
+}
+
+func (mqtt *publisherMqtt) publish(topic string, payload []byte, retain bool) error {
+	if len(topic) == 0 || strings.ContainsAny(topic, "+#") {
+		return fmt.Errorf("mqtt invalid topic %s", topic)
+	}
+
+	if mqtt.conn == nil {
+		if err := mqtt.connect(); err != nil {
+			return err
+		}
+	}
+
+	mqtt.conn.SetDeadline(time.Now().Add(publisherTimeout))
+
+	mqtt.packetId++
+	if mqtt.packetId == 0 {
+		mqtt.packetId = 1
+	}
+
+	w := &mqttWriter{}
+	w.string(topic)
+	w.uint16(mqtt.packetId)
+	w.buf.Write(payload)
+
+	kind := byte(0x32)
+	if retain {
+		kind |= 0x01
+	}
+
+	if _, err := mqtt.conn.Write(mqttPacket(kind, w.buf.Bytes())); err != nil {
+		mqtt.close()
+		return err
+	}
+
+	// the connection is not reused after an error, the next publish
+	// connecting again
+	for {
+		kind, body, err := mqttReadPacket(mqtt.reader)
+		if err != nil {
+			mqtt.close()
+			return err
+		}
+
+		if kind>>4 == 4 && len(body) == 2 && binary.BigEndian.Uint16(body) == mqtt.packetId {
+			return nil
+		}
+	}
+}
+
+// mqttConnackReason returns the reason of the connack return code.
+func mqttConnackReason(code byte) string {
+	switch code {
+	case 1:
+		return "unacceptable protocol version"
+	case 2:
+		return "identifier rejected"
+	case 3:
+		return "server unavailable"
+	case 4:
+		return "bad user name or password"
+	case 5:
+		return "not authorized"
+	default:
+		return fmt.Sprintf("return code %d", code)
+	}
+}
+
+// mqttPacket returns the packet of kind, its fixed header included.
+func mqttPacket(kind byte, body []byte) []byte {
+	b := []byte{kind}
+
+	n := len(body)
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			break
+		}
+	}
+
+	return append(b, body...)
+}
+
+// mqttReadPacket reads the next packet, returning its first byte and its
+// body.
+func mqttReadPacket(reader *bufio.Reader) (byte, []byte, error) {
+	kind, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	n := 0
+	for i, multiplier := 0, 1; ; i, multiplier = i+1, multiplier*128 {
+		if i == 4 {
+			return 0, nil, errors.New("mqtt malformed remaining length")
+		}
+
+		digit, err := reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		n += int(digit&0x7f) * multiplier
+
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+
+	body := make([]byte, n)
+	if _, err = io.ReadFull(reader, body); err != nil {
+		return 0, nil, err
+	}
+
+	return kind, body, nil
+}
+
+type mqttWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *mqttWriter) string(s string) {
+	w.uint16(uint16(len(s)))
+	w.buf.WriteString(s)
+}
+
+func (w *mqttWriter) uint16(v uint16) {
+	binary.Write(&w.buf, binary.BigEndian, v)
+}
+
+// publisherNats speaks the nats client protocol. Each publish is followed by
+// a ping, the pong confirming that the server has processed the message.
+type publisherNats struct {
+	brokers []string
+	conn    net.Conn
+	reader  *bufio.Reader
+}
+
+func (nats *publisherNats) close() {
+	if nats.conn != nil {
+		nats.conn.Close()
+		nats.conn = nil
+	}
+}
+
+func (nats *publisherNats) connect() error {
+	var err error
+
+	for _, broker := range nats.brokers {
+		var (
+			conn     net.Conn
+			user     string
+			password string
+		)
+
+		broker = strings.TrimPrefix(broker, "nats://")
+
+		if i := strings.LastIndex(broker, "@"); i >= 0 {
+			user, password, _ = strings.Cut(broker[:i], ":")
+			broker = broker[i+1:]
+		}
+
+		if conn, err = net.DialTimeout("tcp", broker, publisherTimeout); err != nil {
+			continue
+		}
+
+		nats.conn = conn
+		nats.reader = bufio.NewReader(conn)
+
+		conn.SetDeadline(time.Now().Add(publisherTimeout))
+
+		var line string
+		if line, err = nats.reader.ReadString('\n'); err != nil || !strings.HasPrefix(line, "INFO ") {
+			if err == nil {
+				err = fmt.Errorf("nats unexpected greeting %s", strings.TrimSpace(line))
+			}
+			nats.close()
+			continue
+		}
+
+		options := map[string]any{
+			"lang":     "go",
+			"name":     "rdio-scanner",
+			"pedantic": false,
+			"verbose":  false,
+			"version":  Version,
+		}
+		if len(user) > 0 {
+			options["user"] = user
+			options["pass"] = password
+		}
+
+		b, _ := json.Marshal(options)
+
+		if _, err = fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", b); err == nil {
+			err = nats.pong()
+		}
+
+		if err != nil {
+			nats.close()
+			continue
+		}
+
+		return nil
+	}
+
+	return err
+}
+
+func (nats *publisherNats) pong() error {
+	for {
+		line, err := nats.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+
+		line = strings.TrimSpace(line)
+
+		switch {
+		case line == "PONG":
+			return nil
+
+		case line == "PING":
+			if _, err = nats.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("nats %s", line)
+		}
+	}
+}
+
+func (nats *publisherNats) publish(subject string, payload []byte) error {
+	if nats.conn == nil {
+		if err := nats.connect(); err != nil {
+			return err
+		}
+	}
+
+	nats.conn.SetDeadline(time.Now().Add(publisherTimeout))
+
+	b := []byte(fmt.Sprintf("PUB %s %d\r\n", subject, len(payload)))
+	b = append(b, payload...)
+	b = append(b, []byte("\r\nPING\r\n")...)
+
+	if _, err := nats.conn.Write(b); err != nil {
+		nats.close()
+		return err
+	}
+
+	// the connection is not reused after an error, the next publish
+	// connecting again
+	if err := nats.pong(); err != nil {
+		nats.close()
+		return err
+	}
+
+	return nil
+}
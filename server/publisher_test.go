@@ -0,0 +1,628 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKafkaVarint(t *testing.T) {
+	tests := []struct {
+		v    int64
+		want string
+	}{
+		{0, "00"},
+		{-1, "01"},
+		{1, "02"},
+		{-64, "7f"},
+		{63, "7e"},
+		{64, "8001"},
+		{300, "d804"},
+		{-129, "8102"},
+	}
+
+	for _, test := range tests {
+		w := &kafkaWriter{}
+		w.varint(test.v)
+		if got := hex.EncodeToString(w.Bytes()); got != test.want {
+			t.Errorf("varint(%d) = %s, want %s", test.v, got, test.want)
+		}
+	}
+}
+
+func TestKafkaCrc(t *testing.T) {
+	tests := []struct {
+		b    string
+		want uint32
+	}{
+		{"", 0},
+		{"123456789", 0xe3069283},
+		{"a", 0xc1d04330},
+	}
+
+	for _, test := range tests {
+		if got := kafkaCrc([]byte(test.b)); got != test.want {
+			t.Errorf("kafkaCrc(%q) = %08x, want %08x", test.b, got, test.want)
+		}
+	}
+}
+
+func TestKafkaRecordBatch(t *testing.T) {
+	now := time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC)
+
+	want := strings.Join([]string{
+		"0000000000000000", // base offset
+		"0000003a",         // batch length
+		"ffffffff",         // partition leader epoch
+		"02",               // magic
+		"abd2c774",         // crc
+		"0000",             // attributes
+		"00000000",         // last offset delta
+		"000001a137b57000", // first timestamp
+		"000001a137b57000", // max timestamp
+		"ffffffffffffffff", // producer id
+		"ffff",             // producer epoch
+		"ffffffff",         // base sequence
+		"00000001",         // records
+		"10",               // record length
+		"00",               // record attributes
+		"00",               // timestamp delta
+		"00",               // offset delta
+		"02", "6b",         // key
+		"02", "76", // value
+		"00", // headers
+	}, "")
+
+	if got := hex.EncodeToString(kafkaRecordBatch([]byte("k"), []byte("v"), now)); got != want {
+		t.Errorf("kafkaRecordBatch()\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestKafkaReaderShortResponse(t *testing.T) {
+	r := &kafkaReader{b: []byte{0, 5, 'a', 'b'}}
+
+	if s := r.string(); s != "" || r.err == nil {
+		t.Errorf("string() = %q, %v, want a short response error", s, r.err)
+	}
+
+	// the reads after an error return zeros
+	if v := r.int32(); v != 0 {
+		t.Errorf("int32() = %d after an error", v)
+	}
+}
+
+// kafkaFakeBroker answers the metadata and produce requests of a single
+// broker cluster, closing the connection instead of answering the first
+// drops produce requests.
+type kafkaFakeBroker struct {
+	accepted   int32
+	drops      int32
+	listener   net.Listener
+	partitions int32
+	produced   chan kafkaFakeProduce
+}
+
+type kafkaFakeProduce struct {
+	batch     []byte
+	partition int32
+	topic     string
+}
+
+func newKafkaFakeBroker(t *testing.T, partitions int32, drops int32) *kafkaFakeBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broker := &kafkaFakeBroker{drops: drops, listener: listener, partitions: partitions, produced: make(chan kafkaFakeProduce, 10)}
+
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&broker.accepted, 1)
+			go broker.serve(conn)
+		}
+	}()
+
+	return broker
+}
+
+func (broker *kafkaFakeBroker) serve(conn net.Conn) {
+	defer conn.Close()
+
+	host, p, _ := net.SplitHostPort(broker.listener.Addr().String())
+	port, _ := strconv.Atoi(p)
+
+	for {
+		size := make([]byte, 4)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return
+		}
+
+		body := make([]byte, binary.BigEndian.Uint32(size))
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+
+		r := &kafkaReader{b: body}
+		apiKey := r.int16()
+		r.int16() // api version
+		correlation := r.int32()
+		r.string() // client id
+
+		w := &kafkaWriter{}
+		w.int32(correlation)
+
+		switch apiKey {
+		case 3:
+			r.int32()
+			topic := r.string()
+
+			w.int32(0) // throttle time
+			w.int32(1)
+			w.int32(1)
+			w.string(host)
+			w.int32(int32(port))
+			w.int16(-1) // rack
+			w.int16(-1) // cluster id
+			w.int32(1)  // controller id
+			w.int32(1)
+			w.int16(0)
+			w.string(topic)
+			w.int8(0)
+			w.int32(broker.partitions)
+			for i := int32(0); i < broker.partitions; i++ {
+				w.int16(0)
+				w.int32(i)
+				w.int32(1)
+				w.int32(1) // replicas
+				w.int32(1)
+				w.int32(1) // isr
+				w.int32(1)
+			}
+
+		case 0:
+			r.int16() // transactional id
+			r.int16() // acks
+			r.int32() // timeout
+			r.int32()
+			topic := r.string()
+			r.int32()
+			partition := r.int32()
+			batch := r.next(int(r.int32()))
+
+			if atomic.AddInt32(&broker.drops, -1) >= 0 {
+				return
+			}
+
+			broker.produced <- kafkaFakeProduce{batch: batch, partition: partition, topic: topic}
+
+			w.int32(1)
+			w.string(topic)
+			w.int32(1)
+			w.int32(partition)
+			w.int16(0)
+			w.int64(0)
+			w.int64(-1)
+			w.int32(0) // throttle time
+
+		default:
+			return
+		}
+
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(w.Len()))
+		if _, err := conn.Write(append(b, w.Bytes()...)); err != nil {
+			return
+		}
+	}
+}
+
+func TestPublisherKafka(t *testing.T) {
+	tests := []struct {
+		name         string
+		drops        int32
+		wantAccepted int32
+	}{
+		{"publish", 0, 1},
+		{"reconnect after a dropped connection", 1, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			broker := newKafkaFakeBroker(t, 3, test.drops)
+
+			publisher := &Publisher{Brokers: broker.listener.Addr().String(), Subject: "calls.{system}", Type: PublisherTypeKafka}
+			defer publisher.close()
+
+			call := &Call{DateTime: time.Now(), Id: uint(7), System: 1, Talkgroup: 2}
+
+			for i := int32(0); i < test.drops; i++ {
+				if err := publisher.Publish(call, "event"); err == nil {
+					t.Fatal("Publish() succeeded on a dropped connection")
+				}
+			}
+
+			if err := publisher.Publish(call, "event"); err != nil {
+				t.Fatal(err)
+			}
+
+			got := <-broker.produced
+
+			h := fnv.New32a()
+			h.Write([]byte("1.2"))
+			if want := int32(h.Sum32() % 3); got.topic != "calls.1" || got.partition != want {
+				t.Errorf("produced to %s partition %d, want calls.1 partition %d", got.topic, got.partition, want)
+			}
+
+			if len(got.batch) < 21 || got.batch[16] != 2 || binary.BigEndian.Uint32(got.batch[17:21]) != kafkaCrc(got.batch[21:]) {
+				t.Errorf("invalid record batch %x", got.batch)
+			}
+
+			if !bytes.Contains(got.batch, []byte(`"id":"event"`)) {
+				t.Errorf("the record batch misses the event %s", got.batch)
+			}
+
+			if accepted := atomic.LoadInt32(&broker.accepted); accepted != test.wantAccepted {
+				t.Errorf("%d connections, want %d", accepted, test.wantAccepted)
+			}
+		})
+	}
+}
+
+// natsFakeServer speaks enough of the nats protocol to receive publishes,
+// closing the connection instead of confirming the first drops and replying
+// errors when asked to.
+type natsFakeServer struct {
+	accepted  int32
+	connects  chan map[string]any
+	drops     int32
+	err       string
+	listener  net.Listener
+	published chan string
+}
+
+func newNatsFakeServer(t *testing.T, drops int32, err string) *natsFakeServer {
+	listener, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	server := &natsFakeServer{connects: make(chan map[string]any, 10), drops: drops, err: err, listener: listener, published: make(chan string, 10)}
+
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&server.accepted, 1)
+			go server.serve(conn)
+		}
+	}()
+
+	return server
+}
+
+func (server *natsFakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	fmt.Fprint(conn, "INFO {\"server_id\":\"test\"}\r\n")
+
+	reader := bufio.NewReader(conn)
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		switch f := strings.Fields(line); {
+		case len(f) == 0:
+
+		case f[0] == "CONNECT":
+			options := map[string]any{}
+			json.Unmarshal([]byte(strings.TrimPrefix(strings.TrimSpace(line), "CONNECT ")), &options)
+			server.connects <- options
+
+		case f[0] == "PING":
+			fmt.Fprint(conn, "PONG\r\n")
+
+		case f[0] == "PUB" && len(f) == 3:
+			n, _ := strconv.Atoi(f[2])
+			payload := make([]byte, n+2)
+			if _, err = io.ReadFull(reader, payload); err != nil {
+				return
+			}
+
+			if atomic.AddInt32(&server.drops, -1) >= 0 {
+				return
+			}
+
+			if len(server.err) > 0 {
+				fmt.Fprintf(conn, "-ERR '%s'\r\n", server.err)
+				continue
+			}
+
+			// a ping of the server comes before the pong
+			fmt.Fprint(conn, "PING\r\n")
+
+			server.published <- f[1] + " " + string(payload[:n])
+		}
+	}
+}
+
+func TestPublisherNats(t *testing.T) {
+	tests := []struct {
+		name         string
+		drops        int32
+		err          string
+		wantAccepted int32
+	}{
+		{"publish", 0, "", 1},
+		{"reconnect after a dropped connection", 1, "", 2},
+		{"server error", 0, "Permissions Violation", 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newNatsFakeServer(t, test.drops, test.err)
+
+			publisher := &Publisher{Brokers: "nats://user:p@ss@" + server.listener.Addr().String(), Subject: "calls.{system}.{talkgroup}", Type: PublisherTypeNats}
+			defer publisher.close()
+
+			call := &Call{DateTime: time.Now(), Id: uint(7), System: 1, Talkgroup: 2}
+
+			for i := int32(0); i < test.drops; i++ {
+				if err := publisher.Publish(call, "event"); err == nil {
+					t.Fatal("Publish() succeeded on a dropped connection")
+				}
+			}
+
+			err := publisher.Publish(call, "event")
+
+			if len(test.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Publish() error = %v, want %s", err, test.err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if got := <-server.published; !strings.HasPrefix(got, "calls.1.2 ") || !strings.Contains(got, `"id":"event"`) {
+				t.Errorf("published %s", got)
+			}
+
+			options := <-server.connects
+			if options["user"] != "user" || options["pass"] != "p@ss" || options["verbose"] != false {
+				t.Errorf("connect options %v", options)
+			}
+
+			if accepted := atomic.LoadInt32(&server.accepted); accepted != test.wantAccepted {
+				t.Errorf("%d connections, want %d", accepted, test.wantAccepted)
+			}
+		})
+	}
+}
+
+func TestMqttPacket(t *testing.T) {
+	tests := []struct {
+		size   int
+		header []byte
+	}{
+		{0, []byte{0x30, 0x00}},
+		{127, []byte{0x30, 0x7f}},
+		{128, []byte{0x30, 0x80, 0x01}},
+		{16383, []byte{0x30, 0xff, 0x7f}},
+		{16384, []byte{0x30, 0x80, 0x80, 0x01}},
+	}
+
+	for _, test := range tests {
+		packet := mqttPacket(0x30, make([]byte, test.size))
+
+		if !bytes.Equal(packet[:len(test.header)], test.header) || len(packet) != len(test.header)+test.size {
+			t.Errorf("%d bytes: got header %x, want %x", test.size, packet[:len(test.header)], test.header)
+			continue
+		}
+
+		kind, body, err := mqttReadPacket(bufio.NewReader(bytes.NewReader(packet)))
+		if err != nil || kind != 0x30 || len(body) != test.size {
+			t.Errorf("%d bytes: read back %x, %d bytes, %v", test.size, kind, len(body), err)
+		}
+	}
+
+	if _, _, err := mqttReadPacket(bufio.NewReader(bytes.NewReader([]byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01}))); err == nil {
+		t.Error("want an error on a remaining length of more than 4 bytes")
+	}
+}
+
+// mqttFakeBroker speaks enough of mqtt 3.1.1 to receive qos 1 publishes,
+// closing the connection instead of acknowledging the first drops and
+// refusing the connections with code when set. The topics of the retained
+// messages are also sent to retained.
+type mqttFakeBroker struct {
+	accepted  int32
+	code      byte
+	connects  chan []byte
+	drops     int32
+	listener  net.Listener
+	published chan string
+	retained  chan string
+}
+
+func newMqttFakeBroker(t *testing.T, drops int32, code byte) *mqttFakeBroker {
+	listener, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	broker := &mqttFakeBroker{code: code, connects: make(chan []byte, 10), drops: drops, listener: listener, published: make(chan string, 100), retained: make(chan string, 100)}
+
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&broker.accepted, 1)
+			go broker.serve(conn)
+		}
+	}()
+
+	return broker
+}
+
+func (broker *mqttFakeBroker) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	for {
+		kind, body, err := mqttReadPacket(reader)
+		if err != nil {
+			return
+		}
+
+		switch kind >> 4 {
+		case 1:
+			broker.connects <- body
+			conn.Write([]byte{0x20, 0x02, 0x00, broker.code})
+
+		case 3:
+			n := int(binary.BigEndian.Uint16(body))
+			topic := string(body[2 : 2+n])
+			packetId := body[2+n : 4+n]
+
+			if atomic.AddInt32(&broker.drops, -1) >= 0 {
+				return
+			}
+
+			// a puback of another packet comes first
+			conn.Write([]byte{0x40, 0x02, packetId[0], packetId[1] + 1})
+			conn.Write(append([]byte{0x40, 0x02}, packetId...))
+
+			if kind&0x01 != 0 {
+				broker.retained <- topic
+			}
+
+			broker.published <- topic + " " + string(body[4+n:])
+		}
+	}
+}
+
+func TestPublisherMqtt(t *testing.T) {
+	tests := []struct {
+		name         string
+		drops        int32
+		code         byte
+		err          string
+		wantAccepted int32
+	}{
+		{"publish", 0, 0, "", 1},
+		{"reconnect after a dropped connection", 1, 0, "", 2},
+		{"connection refused", 0, 5, "not authorized", 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			broker := newMqttFakeBroker(t, test.drops, test.code)
+
+			publisher := &Publisher{Brokers: "mqtt://user:p@ss@" + broker.listener.Addr().String(), Subject: "rdio/{system}/{talkgroup}", Type: PublisherTypeMqtt}
+			defer publisher.close()
+
+			call := &Call{DateTime: time.Now(), Id: uint(7), System: 1, Talkgroup: 2}
+
+			for i := int32(0); i < test.drops; i++ {
+				if err := publisher.Publish(call, "event"); err == nil {
+					t.Fatal("Publish() succeeded on a dropped connection")
+				}
+			}
+
+			err := publisher.PublishTranscript(call, "engine 5 respond", "event")
+
+			if len(test.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Publish() error = %v, want %s", err, test.err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if got := <-broker.published; !strings.HasPrefix(got, "rdio/1/2 ") || !strings.Contains(got, `"schema":"`+PublisherSchemaTranscript+`"`) || !strings.Contains(got, `"transcript":"engine 5 respond"`) {
+				t.Errorf("published %s", got)
+			}
+
+			// protocol name, level, flags with user, password and clean
+			// session, keep alive
+			connect := <-broker.connects
+			if !bytes.HasPrefix(connect, []byte{0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0xc2, 0x00, 0x00}) || !bytes.HasSuffix(connect, []byte("\x00\x04user\x00\x04p@ss")) {
+				t.Errorf("connect %x", connect)
+			}
+
+			if accepted := atomic.LoadInt32(&broker.accepted); accepted != test.wantAccepted {
+				t.Errorf("%d connections, want %d", accepted, test.wantAccepted)
+			}
+		})
+	}
+}
+
+func TestPublisherMqttInvalidTopic(t *testing.T) {
+	publisher := &Publisher{Brokers: "127.0.0.1:1", Subject: "rdio/#", Type: PublisherTypeMqtt}
+
+	if err := publisher.Publish(&Call{System: 1, Talkgroup: 2}, "event"); err == nil || !strings.Contains(err.Error(), "invalid topic") {
+		t.Errorf("Publish() error = %v, want an invalid topic", err)
+	}
+}
+
+func TestPublishersPublishTranscript(t *testing.T) {
+	publishers := NewPublishers(&Controller{})
+
+	with := &Publisher{Systems: "*", Transcripts: true, queue: make(chan *publisherEvent, 1)}
+	without := &Publisher{Systems: "*", queue: make(chan *publisherEvent, 1)}
+	disabled := &Publisher{Disabled: true, Systems: "*", Transcripts: true, queue: make(chan *publisherEvent, 1)}
+
+	publishers.List = []*Publisher{with, without, disabled}
+
+	publishers.PublishTranscript(&Call{System: 1, Talkgroup: 2}, "engine 5 respond")
+
+	if len(with.queue) != 1 {
+		t.Error("the transcript is not queued on the publisher of the transcripts")
+	} else if event := <-with.queue; event.transcript != "engine 5 respond" {
+		t.Errorf("queued transcript %q", event.transcript)
+	}
+
+	if len(without.queue) != 0 || len(disabled.queue) != 0 {
+		t.Error("the transcript is queued on a publisher without transcripts or disabled")
+	}
+}
@@ -0,0 +1,518 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SherClockHolmes/webpush-go"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	pushApnsHost        = "https://api.push.apple.com"
+	pushApnsSandboxHost = "https://api.sandbox.push.apple.com"
+	pushFcmHost         = "https://fcm.googleapis.com"
+	pushFcmScope        = "https://www.googleapis.com/auth/firebase.messaging"
+	pushTtl             = 3600
+)
+
+// errPushGone is returned when the push service reports that the device or
+// the browser subscription no longer exists.
+var errPushGone = errors.New("push subscription is gone")
+
+// PushNotification is what is sent through any of the push services. The
+// data values are strings as fcm doesn't accept anything else.
+type PushNotification struct {
+	Body  string
+	Data  map[string]string
+	Title string
+}
+
+type pushFcmCredentials struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	ProjectId   string `json:"project_id"`
+	TokenUri    string `json:"token_uri"`
+}
+
+// Push sends the notifications to the browsers through web push, and to the
+// mobile apps through firebase cloud messaging and the apple push
+// notification service. Web push is always available with the vapid keys
+// generated on first run, fcm and apns once their credentials are set in the
+// config.
+type Push struct {
+	Controller      *Controller
+	apnsJwt         string
+	apnsJwtIssuedAt time.Time
+	client          *http.Client
+	fcmExpiresAt    time.Time
+	fcmProjectId    string
+	fcmToken        string
+	vapidPrivateKey string
+	vapidPublicKey  string
+	mutex           sync.Mutex
+}
+
+func NewPush(controller *Controller) *Push {
+	return &Push{
+		Controller: controller,
+		client:     &http.Client{Timeout: 30 * time.Second},
+		mutex:      sync.Mutex{},
+	}
+}
+
+// Actions returns the push services which can be used.
+func (push *Push) Actions() []string {
+	config := push.Controller.Config
+
+	push.mutex.Lock()
+	defer push.mutex.Unlock()
+
+	actions := []string{}
+
+	if len(config.PushApnsKeyFile) > 0 && len(config.PushApnsKeyId) > 0 && len(config.PushApnsTeamId) > 0 && len(config.PushApnsTopic) > 0 {
+		actions = append(actions, SubscriptionActionApns)
+	}
+
+	if len(config.PushFcmFile) > 0 {
+		actions = append(actions, SubscriptionActionFcm)
+	}
+
+	if len(push.vapidPublicKey) > 0 {
+		actions = append(actions, SubscriptionActionWebPush)
+	}
+
+	return actions
+}
+
+// HasAction tells if the push service can be used.
+func (push *Push) HasAction(action string) bool {
+	for _, a := range push.Actions() {
+		if a == action {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Read loads the vapid keys, generating them on first run. They must not
+// change afterward as the browser subscriptions are bound to them.
+func (push *Push) Read(db *Database) error {
+	var (
+		err error
+		s   string
+	)
+
+	push.mutex.Lock()
+	defer push.mutex.Unlock()
+
+	formatError := func(err error) error {
+		return fmt.Errorf("push.read: %v", err)
+	}
+
+	keys := struct {
+		PrivateKey string `json:"privateKey"`
+		PublicKey  string `json:"publicKey"`
+	}{}
+
+	err = db.Sql.QueryRow("select `val` from `rdioScannerConfigs` where `key` = 'vapid'").Scan(&s)
+	if err == nil {
+		if err = json.Unmarshal([]byte(s), &keys); err != nil {
+			return formatError(err)
+		}
+
+	} else if err == sql.ErrNoRows {
+		if keys.PrivateKey, keys.PublicKey, err = webpush.GenerateVAPIDKeys(); err != nil {
+			return formatError(err)
+		}
+
+		b, err := json.Marshal(keys)
+		if err != nil {
+			return formatError(err)
+		}
+
+		if _, err = db.Sql.Exec("insert into `rdioScannerConfigs` (`key`, `val`) values (?, ?)", "vapid", string(b)); err != nil {
+			return formatError(err)
+		}
+
+	} else {
+		return formatError(err)
+	}
+
+	push.vapidPrivateKey = keys.PrivateKey
+	push.vapidPublicKey = keys.PublicKey
+
+	return nil
+}
+
+// Send delivers the notification to the address of the push service, a
+// device token for apns and fcm or the json browser subscription for web
+// push. It returns errPushGone when the address should be forgotten.
+func (push *Push) Send(action string, address string, notification *PushNotification) error {
+	switch action {
+	case SubscriptionActionApns:
+		return push.sendApns(address, notification)
+
+	case SubscriptionActionFcm:
+		return push.sendFcm(address, notification)
+
+	case SubscriptionActionWebPush:
+		return push.sendWebPush(address, notification)
+
+	default:
+		return fmt.Errorf("unknown push action %s", action)
+	}
+}
+
+// VapidPublicKey is the application server key the browsers subscribe with.
+func (push *Push) VapidPublicKey() string {
+	push.mutex.Lock()
+	defer push.mutex.Unlock()
+
+	return push.vapidPublicKey
+}
+
+// getApnsJwt returns the provider token of apns, which apple wants renewed
+// between 20 and 60 minutes.
+func (push *Push) getApnsJwt() (string, error) {
+	config := push.Controller.Config
+
+	push.mutex.Lock()
+	defer push.mutex.Unlock()
+
+	if len(push.apnsJwt) > 0 && time.Since(push.apnsJwtIssuedAt) < 40*time.Minute {
+		return push.apnsJwt, nil
+	}
+
+	b, err := os.ReadFile(config.GetPath(config.PushApnsKeyFile))
+	if err != nil {
+		return "", err
+	}
+
+	key, err := jwt.ParseECPrivateKeyFromPEM(b)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iat": now.Unix(),
+		"iss": config.PushApnsTeamId,
+	})
+	token.Header["kid"] = config.PushApnsKeyId
+
+	s, err := token.SignedString(key)
+	if err != nil {
+		return "", err
+	}
+
+	push.apnsJwt = s
+	push.apnsJwtIssuedAt = now
+
+	return s, nil
+}
+
+// getFcmToken exchanges a jwt signed with the service account key for an
+// oauth access token, kept until shortly before it expires.
+func (push *Push) getFcmToken() (string, string, error) {
+	config := push.Controller.Config
+
+	push.mutex.Lock()
+	defer push.mutex.Unlock()
+
+	if len(push.fcmToken) > 0 && time.Now().Before(push.fcmExpiresAt) {
+		return push.fcmToken, push.fcmProjectId, nil
+	}
+
+	b, err := os.ReadFile(config.GetPath(config.PushFcmFile))
+	if err != nil {
+		return "", "", err
+	}
+
+	credentials := pushFcmCredentials{}
+	if err = json.Unmarshal(b, &credentials); err != nil {
+		return "", "", err
+	}
+
+	if len(credentials.ProjectId) == 0 || len(credentials.TokenUri) == 0 {
+		return "", "", errors.New("invalid fcm service account file")
+	}
+
+	key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(credentials.PrivateKey))
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
+
+	assertion, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"aud":   credentials.TokenUri,
+		"exp":   now.Add(time.Hour).Unix(),
+		"iat":   now.Unix(),
+		"iss":   credentials.ClientEmail,
+		"scope": pushFcmScope,
+	}).SignedString(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	res, err := push.client.PostForm(credentials.TokenUri, url.Values{
+		"assertion":  {assertion},
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+	})
+	if err != nil {
+		return "", "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("fcm token: %s", pushResponseError(res))
+	}
+
+	token := struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}{}
+
+	if err = json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return "", "", err
+	}
+
+	push.fcmExpiresAt = now.Add(time.Duration(token.ExpiresIn)*time.Second - 5*time.Minute)
+	push.fcmProjectId = credentials.ProjectId
+	push.fcmToken = token.AccessToken
+
+	return push.fcmToken, push.fcmProjectId, nil
+}
+
+func (push *Push) sendApns(token string, notification *PushNotification) error {
+	config := push.Controller.Config
+
+	formatError := func(err error) error {
+		return fmt.Errorf("apns: %v", err)
+	}
+
+	bearer, err := push.getApnsJwt()
+	if err != nil {
+		return formatError(err)
+	}
+
+	payload := map[string]any{
+		"aps": map[string]any{
+			"alert": map[string]any{
+				"body":  notification.Body,
+				"title": notification.Title,
+			},
+			"sound": "default",
+		},
+	}
+	for k, v := range notification.Data {
+		payload[k] = v
+	}
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return formatError(err)
+	}
+
+	host := pushApnsHost
+	if config.PushApnsSandbox {
+		host = pushApnsSandboxHost
+	}
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/3/device/%s", host, url.PathEscape(token)), bytes.NewReader(b))
+	if err != nil {
+		return formatError(err)
+	}
+
+	req.Header.Set("Authorization", "bearer "+bearer)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("apns-expiration", fmt.Sprint(time.Now().Add(pushTtl*time.Second).Unix()))
+	req.Header.Set("apns-push-type", "alert")
+	req.Header.Set("apns-topic", config.PushApnsTopic)
+
+	res, err := push.client.Do(req)
+	if err != nil {
+		return formatError(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	reason := struct {
+		Reason string `json:"reason"`
+	}{}
+	json.NewDecoder(res.Body).Decode(&reason)
+
+	switch {
+	case res.StatusCode == http.StatusGone, reason.Reason == "BadDeviceToken", reason.Reason == "Unregistered":
+		return errPushGone
+
+	case reason.Reason == "ExpiredProviderToken":
+		push.mutex.Lock()
+		push.apnsJwt = ""
+		push.mutex.Unlock()
+	}
+
+	return formatError(fmt.Errorf("%s %s", res.Status, reason.Reason))
+}
+
+func (push *Push) sendFcm(token string, notification *PushNotification) error {
+	formatError := func(err error) error {
+		return fmt.Errorf("fcm: %v", err)
+	}
+
+	bearer, projectId, err := push.getFcmToken()
+	if err != nil {
+		return formatError(err)
+	}
+
+	b, err := json.Marshal(map[string]any{
+		"message": map[string]any{
+			"android": map[string]any{
+				"ttl": fmt.Sprintf("%ds", pushTtl),
+			},
+			"data": notification.Data,
+			"notification": map[string]any{
+				"body":  notification.Body,
+				"title": notification.Title,
+			},
+			"token": token,
+		},
+	})
+	if err != nil {
+		return formatError(err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/v1/projects/%s/messages:send", pushFcmHost, url.PathEscape(projectId)), bytes.NewReader(b))
+	if err != nil {
+		return formatError(err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+bearer)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := push.client.Do(req)
+	if err != nil {
+		return formatError(err)
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return nil
+
+	case http.StatusNotFound:
+		return errPushGone
+
+	case http.StatusUnauthorized:
+		push.mutex.Lock()
+		push.fcmToken = ""
+		push.mutex.Unlock()
+	}
+
+	return formatError(errors.New(pushResponseError(res)))
+}
+
+// sendWebPush sends the notification in the format the angular service
+// worker displays, opening the app when it is clicked.
+func (push *Push) sendWebPush(address string, notification *PushNotification) error {
+	config := push.Controller.Config
+
+	formatError := func(err error) error {
+		return fmt.Errorf("webpush: %v", err)
+	}
+
+	subscription := &webpush.Subscription{}
+	if err := json.Unmarshal([]byte(address), subscription); err != nil {
+		return formatError(err)
+	}
+
+	data := map[string]any{
+		"onActionClick": map[string]any{
+			"default": map[string]any{"operation": "navigateLastFocusedOrOpen", "url": "/"},
+		},
+	}
+	for k, v := range notification.Data {
+		data[k] = v
+	}
+
+	b, err := json.Marshal(map[string]any{
+		"notification": map[string]any{
+			"body":  notification.Body,
+			"data":  data,
+			"icon":  "assets/icons/icon-192x192.png",
+			"title": notification.Title,
+		},
+	})
+	if err != nil {
+		return formatError(err)
+	}
+
+	push.mutex.Lock()
+	privateKey := push.vapidPrivateKey
+	publicKey := push.vapidPublicKey
+	push.mutex.Unlock()
+
+	res, err := webpush.SendNotification(b, subscription, &webpush.Options{
+		HTTPClient: push.client,
+		// the library prefixes the subject with mailto:
+		Subscriber:      strings.TrimPrefix(config.PushVapidSubject, "mailto:"),
+		TTL:             pushTtl,
+		VAPIDPrivateKey: privateKey,
+		VAPIDPublicKey:  publicKey,
+	})
+	if err != nil {
+		return formatError(err)
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusNotFound, res.StatusCode == http.StatusGone:
+		return errPushGone
+
+	case res.StatusCode < 200 || res.StatusCode > 299:
+		return formatError(errors.New(pushResponseError(res)))
+	}
+
+	return nil
+}
+
+func pushResponseError(res *http.Response) string {
+	b, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+
+	if s := strings.TrimSpace(string(b)); len(s) > 0 {
+		return fmt.Sprintf("%s %s", res.Status, s)
+	}
+
+	return res.Status
+}
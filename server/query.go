@@ -0,0 +1,280 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var sqlIdentifier = regexp.MustCompile(`^\w+$`)
+
+// SqlCondition is a part of a where clause along with its arguments. The
+// values are always bound to ? placeholders, never formatted into the
+// query, and the conditions are combined with SqlAnd, SqlOr and SqlNot.
+// A nil condition doesn't restrict anything.
+type SqlCondition struct {
+	args  []any
+	query string
+}
+
+// SqlWhere returns the condition with its arguments, ie:
+// SqlWhere("`system` = ?", 1).
+func SqlWhere(query string, args ...any) *SqlCondition {
+	return &SqlCondition{args: args, query: query}
+}
+
+// SqlFalse is the condition matching nothing.
+func SqlFalse() *SqlCondition {
+	return SqlWhere("1 = 0")
+}
+
+// SqlIn returns the condition of the column having one of the values, which
+// is any slice. An empty slice matches nothing.
+func SqlIn(column string, values any) *SqlCondition {
+	v := reflect.ValueOf(values)
+
+	if v.Kind() != reflect.Slice || v.Len() == 0 {
+		return SqlFalse()
+	}
+
+	args := make([]any, v.Len())
+	placeholders := make([]string, v.Len())
+
+	for i := 0; i < v.Len(); i++ {
+		args[i] = v.Index(i).Interface()
+		placeholders[i] = "?"
+	}
+
+	return SqlWhere(fmt.Sprintf("%s in (%s)", sqlQuote(column), strings.Join(placeholders, ", ")), args...)
+}
+
+// SqlAnd returns the conditions which must all be met, nil when there are
+// none.
+func SqlAnd(conditions ...*SqlCondition) *SqlCondition {
+	return sqlJoin(" and ", conditions)
+}
+
+// SqlNot negates the condition.
+func SqlNot(condition *SqlCondition) *SqlCondition {
+	if condition == nil {
+		return SqlFalse()
+	}
+
+	return SqlWhere(fmt.Sprintf("not (%s)", condition.query), condition.args...)
+}
+
+// SqlOr returns the conditions of which one must be met, nil when there are
+// none.
+func SqlOr(conditions ...*SqlCondition) *SqlCondition {
+	return sqlJoin(" or ", conditions)
+}
+
+// sqlScope is the condition on the calls of the systems and talkgroups of an
+// access or an api key. Anything but a list of scopes or * matches nothing.
+func sqlScope(systems any) *SqlCondition {
+	switch v := systems.(type) {
+	case []any:
+		a := []*SqlCondition{}
+		for _, scope := range v {
+			switch v := scope.(type) {
+			case map[string]any:
+				switch talkgroups := v["talkgroups"].(type) {
+				case []any:
+					a = append(a, SqlAnd(SqlWhere("`system` = ?", v["id"]), SqlIn("talkgroup", talkgroups)))
+				case string:
+					if talkgroups == "*" {
+						a = append(a, SqlWhere("`system` = ?", v["id"]))
+					}
+				}
+			}
+		}
+		if len(a) == 0 {
+			return SqlFalse()
+		}
+		return SqlOr(a...)
+
+	case string:
+		if v == "*" {
+			return nil
+		}
+	}
+
+	return SqlFalse()
+}
+
+func sqlJoin(sep string, conditions []*SqlCondition) *SqlCondition {
+	var (
+		args    = []any{}
+		queries = []string{}
+	)
+
+	for _, condition := range conditions {
+		if condition == nil {
+			continue
+		}
+		args = append(args, condition.args...)
+		queries = append(queries, condition.query)
+	}
+
+	switch len(queries) {
+	case 0:
+		return nil
+	case 1:
+		return SqlWhere(queries[0], args...)
+	default:
+		return SqlWhere(fmt.Sprintf("(%s)", strings.Join(queries, ")"+sep+"(")), args...)
+	}
+}
+
+// sqlQuote back quotes the plain column names, leaving the expressions as
+// they are.
+func sqlQuote(column string) string {
+	if sqlIdentifier.MatchString(column) {
+		return fmt.Sprintf("`%s`", column)
+	}
+
+	return column
+}
+
+// SqlQuery is a select or a delete statement on a single table, written in
+// the dialect shared by every database type, the postgresql driver taking
+// care of its differences.
+type SqlQuery struct {
+	columns []string
+	db      *Database
+	delete  bool
+	limit   any
+	offset  any
+	orders  []string
+	table   string
+	where   []*SqlCondition
+}
+
+// Delete returns a delete statement on the table.
+func (db *Database) Delete(table string) *SqlQuery {
+	return &SqlQuery{db: db, delete: true, table: table}
+}
+
+// Select returns a select statement of the columns of the table.
+func (db *Database) Select(table string, columns ...string) *SqlQuery {
+	return &SqlQuery{columns: columns, db: db, table: table}
+}
+
+// Build returns the query and its arguments, the times being converted to
+// the date time format of the database.
+func (query *SqlQuery) Build() (string, []any) {
+	var (
+		args = []any{}
+		b    strings.Builder
+	)
+
+	if query.delete {
+		fmt.Fprintf(&b, "delete from `%s`", query.table)
+
+	} else {
+		columns := make([]string, len(query.columns))
+		for i, column := range query.columns {
+			columns[i] = sqlQuote(column)
+		}
+		fmt.Fprintf(&b, "select %s from `%s`", strings.Join(columns, ", "), query.table)
+	}
+
+	if where := SqlAnd(query.where...); where != nil {
+		fmt.Fprintf(&b, " where %s", where.query)
+		args = append(args, where.args...)
+	}
+
+	if len(query.orders) > 0 {
+		fmt.Fprintf(&b, " order by %s", strings.Join(query.orders, ", "))
+	}
+
+	if query.limit != nil {
+		b.WriteString(" limit ?")
+		args = append(args, query.limit)
+
+		if query.offset != nil {
+			b.WriteString(" offset ?")
+			args = append(args, query.offset)
+		}
+	}
+
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case time.Time:
+			args[i] = v.UTC().Format(query.db.DateTimeFormat)
+		}
+	}
+
+	return b.String(), args
+}
+
+func (query *SqlQuery) Exec() (sql.Result, error) {
+	q, args := query.Build()
+
+	return query.db.Sql.Exec(q, args...)
+}
+
+// Limit limits the number of rows, with an optional offset.
+func (query *SqlQuery) Limit(limit uint, offset ...uint) *SqlQuery {
+	query.limit = limit
+
+	if len(offset) > 0 {
+		query.offset = offset[0]
+	}
+
+	return query
+}
+
+// OrderBy appends the column to the sort order, descending when desc is true.
+func (query *SqlQuery) OrderBy(column string, desc bool) *SqlQuery {
+	if desc {
+		query.orders = append(query.orders, fmt.Sprintf("%s desc", sqlQuote(column)))
+	} else {
+		query.orders = append(query.orders, fmt.Sprintf("%s asc", sqlQuote(column)))
+	}
+
+	return query
+}
+
+func (query *SqlQuery) Query() (*sql.Rows, error) {
+	q, args := query.Build()
+
+	return query.db.Sql.Query(q, args...)
+}
+
+func (query *SqlQuery) QueryRow() *sql.Row {
+	q, args := query.Build()
+
+	return query.db.Sql.QueryRow(q, args...)
+}
+
+func (query *SqlQuery) String() string {
+	q, _ := query.Build()
+
+	return q
+}
+
+// Where adds conditions which must all be met.
+func (query *SqlQuery) Where(conditions ...*SqlCondition) *SqlQuery {
+	query.where = append(query.where, conditions...)
+
+	return query
+}
@@ -0,0 +1,165 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSqlQueryBuild(t *testing.T) {
+	sqlite := &Database{Config: &Config{DbType: DbTypeSqlite}, DateTimeFormat: "2006-01-02 15:04:05.000 -07:00"}
+	mysql := &Database{Config: &Config{DbType: DbTypeMysql}, DateTimeFormat: "2006-01-02 15:04:05"}
+
+	at := time.Date(2026, 10, 14, 8, 30, 0, 0, time.FixedZone("EDT", -4*3600))
+
+	tests := []struct {
+		name      string
+		query     *SqlQuery
+		want      string
+		wantArgs  []any
+		postgres  string
+		wantMysql []any
+	}{
+		{
+			name:     "select",
+			query:    sqlite.Select("rdioScannerCalls", "id", "count(*)"),
+			want:     "select `id`, count(*) from `rdioScannerCalls`",
+			wantArgs: []any{},
+			postgres: `select "id", count(*) from "rdioScannerCalls"`,
+		},
+		{
+			name:     "nil conditions",
+			query:    sqlite.Select("t", "id").Where(nil, SqlAnd(), SqlOr(nil)),
+			want:     "select `id` from `t`",
+			wantArgs: []any{},
+			postgres: `select "id" from "t"`,
+		},
+		{
+			name: "nested conditions",
+			query: sqlite.Select("t", "id").
+				Where(SqlWhere("`system` = ?", 1), SqlOr(SqlIn("talkgroup", []uint{2, 3}), SqlNot(SqlWhere("`source` = ?", 4)))).
+				OrderBy("dateTime", true).OrderBy("id", false).Limit(10, 20),
+			want:     "select `id` from `t` where (`system` = ?) and ((`talkgroup` in (?, ?)) or (not (`source` = ?))) order by `dateTime` desc, `id` asc limit ? offset ?",
+			wantArgs: []any{1, uint(2), uint(3), 4, uint(10), uint(20)},
+			postgres: `select "id" from "t" where ("system" = $1) and (("talkgroup" in ($2, $3)) or (not ("source" = $4))) order by "dateTime" desc, "id" asc limit $5 offset $6`,
+		},
+		{
+			name:     "empty in",
+			query:    sqlite.Delete("t").Where(SqlIn("id", []uint{})),
+			want:     "delete from `t` where 1 = 0",
+			wantArgs: []any{},
+			postgres: `delete from "t" where 1 = 0`,
+		},
+		{
+			name:     "values are never formatted into the query",
+			query:    sqlite.Select("t", "id").Where(SqlWhere("`label` like ?", "%'; drop table `t`; --")),
+			want:     "select `id` from `t` where `label` like ?",
+			wantArgs: []any{"%'; drop table `t`; --"},
+			postgres: `select "id" from "t" where "label" ilike $1`,
+		},
+		{
+			name:     "sqlite times",
+			query:    sqlite.Delete("t").Where(SqlWhere("`dateTime` < ?", at)),
+			want:     "delete from `t` where `dateTime` < ?",
+			wantArgs: []any{"2026-10-14 12:30:00.000 +00:00"},
+			postgres: `delete from "t" where "dateTime" < $1`,
+		},
+		{
+			name:     "mysql times",
+			query:    mysql.Delete("t").Where(SqlWhere("`dateTime` < ?", at)),
+			want:     "delete from `t` where `dateTime` < ?",
+			wantArgs: []any{"2026-10-14 12:30:00"},
+			postgres: `delete from "t" where "dateTime" < $1`,
+		},
+		{
+			name:     "limit without offset",
+			query:    sqlite.Select("t", "id").Limit(5),
+			want:     "select `id` from `t` limit ?",
+			wantArgs: []any{uint(5)},
+			postgres: `select "id" from "t" limit $1`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, args := test.query.Build()
+			if got != test.want {
+				t.Errorf("Build()\n got %s\nwant %s", got, test.want)
+			}
+			if !reflect.DeepEqual(args, test.wantArgs) {
+				t.Errorf("Build() args = %#v, want %#v", args, test.wantArgs)
+			}
+			if pg := postgresQuery(got); pg != test.postgres {
+				t.Errorf("postgresQuery()\n got %s\nwant %s", pg, test.postgres)
+			}
+		})
+	}
+}
+
+func TestSqlQuote(t *testing.T) {
+	tests := []struct {
+		column string
+		want   string
+	}{
+		{"dateTime", "`dateTime`"},
+		{"_id", "`_id`"},
+		{"count(*)", "count(*)"},
+		{"`id`", "`id`"},
+		{"max(`id`)", "max(`id`)"},
+	}
+
+	for _, test := range tests {
+		if got := sqlQuote(test.column); got != test.want {
+			t.Errorf("sqlQuote(%q) = %q, want %q", test.column, got, test.want)
+		}
+	}
+}
+
+func TestSqlScope(t *testing.T) {
+	tests := []struct {
+		name     string
+		systems  any
+		want     *SqlCondition
+		wantNone bool
+	}{
+		{name: "everything", systems: "*", want: nil},
+		{name: "nothing", systems: nil, wantNone: true},
+		{name: "unknown string", systems: "1", wantNone: true},
+		{name: "empty list", systems: []any{}, wantNone: true},
+		{
+			name:    "systems and talkgroups",
+			systems: []any{map[string]any{"id": float64(1), "talkgroups": "*"}, map[string]any{"id": float64(2), "talkgroups": []any{float64(3)}}},
+			want:    SqlWhere("(`system` = ?) or ((`system` = ?) and (`talkgroup` in (?)))", float64(1), float64(2), float64(3)),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := sqlScope(test.systems)
+			if test.wantNone {
+				if got == nil || got.query != SqlFalse().query {
+					t.Errorf("sqlScope(%v) = %v, want %v", test.systems, got, SqlFalse())
+				}
+				return
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("sqlScope(%v) = %v, want %v", test.systems, got, test.want)
+			}
+		})
+	}
+}
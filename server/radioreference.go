@@ -0,0 +1,575 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	radioReferenceInterval  = 24 * time.Hour
+	radioReferenceNamespace = "http://api.radioreference.com/soap2"
+	radioReferenceTick      = time.Minute
+	radioReferenceUrl       = "https://api.radioreference.com/soap2/index.php"
+)
+
+// RadioReferenceSync keeps the talkgroups of a local system in sync with
+// those of a trunked system of the RadioReference database, given its
+// system id, every interval hours. The web service requires the credentials
+// of a premium subscriber along with an application key. New and updated
+// talkgroups are applied to the local system and reported in the logs, the
+// talkgroups missing from RadioReference are left untouched.
+type RadioReferenceSync struct {
+	Id       any    `json:"_id"`
+	AppKey   string `json:"appKey"`
+	Disabled bool   `json:"disabled"`
+	Interval uint   `json:"interval"`
+	Order    any    `json:"order"`
+	Password string `json:"password"`
+	Sid      uint   `json:"sid"`
+	System   uint   `json:"system"`
+	Url      string `json:"url"`
+	Username string `json:"username"`
+	polled   time.Time
+	running  bool
+}
+
+type radioReferenceCategory struct {
+	Cid  uint   `xml:"tgCid"`
+	Name string `xml:"tgCname"`
+}
+
+type radioReferenceTag struct {
+	Descr string `xml:"tagDescr"`
+	Id    uint   `xml:"tagId"`
+}
+
+type radioReferenceTalkgroup struct {
+	Alpha string `xml:"tgAlpha"`
+	Cid   uint   `xml:"tgCid"`
+	Dec   uint   `xml:"tgDec"`
+	Descr string `xml:"tgDescr"`
+	Tags  []uint `xml:"tags>item>tagId"`
+}
+
+func (rr *RadioReferenceSync) FromMap(m map[string]any) *RadioReferenceSync {
+	switch v := m["_id"].(type) {
+	case float64:
+		rr.Id = uint(v)
+	}
+
+	switch v := m["appKey"].(type) {
+	case string:
+		rr.AppKey = strings.TrimSpace(v)
+	}
+
+	switch v := m["disabled"].(type) {
+	case bool:
+		rr.Disabled = v
+	}
+
+	switch v := m["interval"].(type) {
+	case float64:
+		rr.Interval = uint(v)
+	}
+
+	switch v := m["order"].(type) {
+	case float64:
+		rr.Order = uint(v)
+	}
+
+	switch v := m["password"].(type) {
+	case string:
+		rr.Password = v
+	}
+
+	switch v := m["sid"].(type) {
+	case float64:
+		rr.Sid = uint(v)
+	}
+
+	switch v := m["system"].(type) {
+	case float64:
+		rr.System = uint(v)
+	}
+
+	switch v := m["url"].(type) {
+	case string:
+		rr.Url = v
+	}
+
+	switch v := m["username"].(type) {
+	case string:
+		rr.Username = strings.TrimSpace(v)
+	}
+
+	return rr
+}
+
+// Fetch returns the talkgroups of the RadioReference system, with their
+// category as group and their first tag as tag.
+func (rr *RadioReferenceSync) Fetch() ([]*FleetmapTalkgroup, error) {
+	formatError := func(err error) error {
+		return fmt.Errorf("radioreference.fetch: %v", err)
+	}
+
+	categories := struct {
+		Items []radioReferenceCategory `xml:"return>item"`
+	}{}
+	if err := rr.call("getTrsTalkgroupCats", fmt.Sprintf(`<sid xsi:type="xsd:int">%d</sid>`, rr.Sid), &categories); err != nil {
+		return nil, formatError(err)
+	}
+
+	tags := struct {
+		Items []radioReferenceTag `xml:"return>item"`
+	}{}
+	if err := rr.call("getTag", `<id xsi:type="xsd:int">0</id>`, &tags); err != nil {
+		return nil, formatError(err)
+	}
+
+	talkgroups := struct {
+		Items []radioReferenceTalkgroup `xml:"return>item"`
+	}{}
+	if err := rr.call("getTrsTalkgroups", fmt.Sprintf(`<sid xsi:type="xsd:int">%d</sid><tgCid xsi:type="xsd:int">0</tgCid><tgTag xsi:type="xsd:int">0</tgTag><tgDec xsi:type="xsd:int">0</tgDec>`, rr.Sid), &talkgroups); err != nil {
+		return nil, formatError(err)
+	}
+
+	groupLabels := map[uint]string{}
+	for _, category := range categories.Items {
+		groupLabels[category.Cid] = strings.TrimSpace(category.Name)
+	}
+
+	tagLabels := map[uint]string{}
+	for _, tag := range tags.Items {
+		tagLabels[tag.Id] = strings.TrimSpace(tag.Descr)
+	}
+
+	list := []*FleetmapTalkgroup{}
+	seen := map[uint]bool{}
+
+	for _, tg := range talkgroups.Items {
+		if tg.Dec == 0 || seen[tg.Dec] {
+			continue
+		}
+		seen[tg.Dec] = true
+
+		talkgroup := &FleetmapTalkgroup{
+			Group: groupLabels[tg.Cid],
+			Id:    tg.Dec,
+			Label: strings.TrimSpace(tg.Alpha),
+			Name:  strings.TrimSpace(tg.Descr),
+		}
+
+		if len(tg.Tags) > 0 {
+			talkgroup.Tag = tagLabels[tg.Tags[0]]
+		}
+
+		list = append(list, talkgroup)
+	}
+
+	sort.Slice(list, func(i int, j int) bool {
+		return list[i].Id < list[j].Id
+	})
+
+	return list, nil
+}
+
+// Sync applies the new and updated talkgroups to the local system and
+// returns how many were added and updated.
+func (rr *RadioReferenceSync) Sync(controller *Controller) (int, int, error) {
+	formatError := func(err error) error {
+		return fmt.Errorf("radioreference.sync: %v", err)
+	}
+
+	logEvent := func(logLevel string, message string) {
+		controller.Logs.LogEvent(logLevel, fmt.Sprintf("radioreference: sid=%v to system=%v %s", rr.Sid, rr.System, message))
+	}
+
+	remote, err := rr.Fetch()
+	if err != nil {
+		return 0, 0, formatError(err)
+	}
+
+	local := map[uint]*FleetmapTalkgroup{}
+
+	systemLabel := ""
+	if system, ok := controller.Systems.GetSystem(rr.System); ok {
+		for _, talkgroup := range controller.ExportTalkgroups(system) {
+			local[talkgroup.Id] = talkgroup
+		}
+	} else {
+		details := struct {
+			Name string `xml:"return>sName"`
+		}{}
+		if err := rr.call("getTrsDetails", fmt.Sprintf(`<sid xsi:type="xsd:int">%d</sid>`, rr.Sid), &details); err == nil {
+			systemLabel = strings.TrimSpace(details.Name)
+		}
+	}
+
+	var (
+		added   int
+		changed = []*FleetmapTalkgroup{}
+		updated int
+	)
+
+	for _, talkgroup := range remote {
+		if len(talkgroup.Label) == 0 {
+			talkgroup.Label = fmt.Sprintf("%d", talkgroup.Id)
+		}
+
+		if len(talkgroup.Name) == 0 {
+			talkgroup.Name = talkgroup.Label
+		}
+
+		existing, ok := local[talkgroup.Id]
+
+		switch {
+		case !ok:
+			logEvent(LogLevelInfo, fmt.Sprintf("new talkgroup %d %s", talkgroup.Id, talkgroup.Label))
+			added++
+
+		case existing.Label != talkgroup.Label || existing.Name != talkgroup.Name:
+			logEvent(LogLevelInfo, fmt.Sprintf("talkgroup %d renamed from %s to %s", talkgroup.Id, existing.Label, talkgroup.Label))
+			updated++
+
+		case (len(talkgroup.Group) > 0 && existing.Group != talkgroup.Group) || (len(talkgroup.Tag) > 0 && existing.Tag != talkgroup.Tag):
+			logEvent(LogLevelInfo, fmt.Sprintf("talkgroup %d %s moved to group %s and tag %s", talkgroup.Id, talkgroup.Label, talkgroup.Group, talkgroup.Tag))
+			updated++
+
+		default:
+			continue
+		}
+
+		// keep the group and tag of the local talkgroups when unknown
+		if ok {
+			if len(talkgroup.Group) == 0 {
+				talkgroup.Group = existing.Group
+			}
+			if len(talkgroup.Tag) == 0 {
+				talkgroup.Tag = existing.Tag
+			}
+		}
+
+		changed = append(changed, talkgroup)
+	}
+
+	if len(changed) > 0 {
+		if _, _, err = controller.ImportTalkgroups(rr.System, systemLabel, changed, true); err != nil {
+			return 0, 0, formatError(err)
+		}
+	}
+
+	return added, updated, nil
+}
+
+// call invokes a method of the rpc encoded soap web service, decoding the
+// content of its response into v.
+func (rr *RadioReferenceSync) call(method string, params string, v any) error {
+	u := radioReferenceUrl
+	if len(rr.Url) > 0 {
+		u = rr.Url
+	}
+
+	escape := func(s string) string {
+		b := bytes.Buffer{}
+		xml.EscapeText(&b, []byte(s))
+		return b.String()
+	}
+
+	body := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>`+
+		`<SOAP-ENV:Envelope xmlns:SOAP-ENV="http://schemas.xmlsoap.org/soap/envelope/" xmlns:SOAP-ENC="http://schemas.xmlsoap.org/soap/encoding/" xmlns:ns1="%s" xmlns:xsd="http://www.w3.org/2001/XMLSchema" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" SOAP-ENV:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">`+
+		`<SOAP-ENV:Body><ns1:%s>%s`+
+		`<authInfo xsi:type="ns1:authInfo"><appKey xsi:type="xsd:string">%s</appKey><password xsi:type="xsd:string">%s</password><style xsi:type="xsd:string">rpc</style><username xsi:type="xsd:string">%s</username><version xsi:type="xsd:string">latest</version></authInfo>`+
+		`</ns1:%s></SOAP-ENV:Body></SOAP-ENV:Envelope>`,
+		radioReferenceNamespace, method, params, escape(rr.AppKey), escape(rr.Password), escape(rr.Username), method)
+
+	c := http.Client{Timeout: 60 * time.Second}
+
+	req, err := http.NewRequest(http.MethodPost, u, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	req.Header.Set("SOAPAction", fmt.Sprintf("%s#%s", radioReferenceNamespace, method))
+	req.Header.Set("User-Agent", fmt.Sprintf("rdio-scanner/%s", Version))
+
+	res, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	envelope := struct {
+		Body struct {
+			Fault *struct {
+				Code   string `xml:"faultcode"`
+				String string `xml:"faultstring"`
+			} `xml:"Fault"`
+			Response struct {
+				Content []byte `xml:",innerxml"`
+			} `xml:",any"`
+		} `xml:"Body"`
+	}{}
+
+	if err = xml.Unmarshal(b, &envelope); err != nil {
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("bad status: %s for %s", res.Status, method)
+		}
+		return err
+	}
+
+	if envelope.Body.Fault != nil {
+		return fmt.Errorf("%s: %s", method, strings.TrimSpace(envelope.Body.Fault.String))
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad status: %s for %s", res.Status, method)
+	}
+
+	content := append([]byte("<response>"), envelope.Body.Response.Content...)
+	content = append(content, []byte("</response>")...)
+
+	return xml.Unmarshal(content, v)
+}
+
+type RadioReferenceSyncs struct {
+	Controller *Controller
+	List       []*RadioReferenceSync
+	mutex      sync.Mutex
+}
+
+func NewRadioReferenceSyncs(controller *Controller) *RadioReferenceSyncs {
+	return &RadioReferenceSyncs{
+		Controller: controller,
+		List:       []*RadioReferenceSync{},
+		mutex:      sync.Mutex{},
+	}
+}
+
+func (syncs *RadioReferenceSyncs) FromMap(f []any) *RadioReferenceSyncs {
+	syncs.mutex.Lock()
+	defer syncs.mutex.Unlock()
+
+	syncs.List = []*RadioReferenceSync{}
+
+	for _, r := range f {
+		switch m := r.(type) {
+		case map[string]any:
+			rr := &RadioReferenceSync{}
+			rr.FromMap(m)
+			syncs.List = append(syncs.List, rr)
+		}
+	}
+
+	return syncs
+}
+
+func (syncs *RadioReferenceSyncs) Read(db *Database) error {
+	var (
+		err   error
+		id    sql.NullFloat64
+		order sql.NullFloat64
+		rows  *sql.Rows
+	)
+
+	syncs.mutex.Lock()
+	defer syncs.mutex.Unlock()
+
+	syncs.List = []*RadioReferenceSync{}
+
+	formatError := func(err error) error {
+		return fmt.Errorf("radioReferenceSyncs.read: %v", err)
+	}
+
+	if rows, err = db.Sql.Query("select `_id`, `appKey`, `disabled`, `interval`, `order`, `password`, `sid`, `system`, `url`, `username` from `rdioScannerRadioReferenceSyncs` order by `order`"); err != nil {
+		return formatError(err)
+	}
+
+	for rows.Next() {
+		rr := &RadioReferenceSync{}
+
+		if err = rows.Scan(&id, &rr.AppKey, &rr.Disabled, &rr.Interval, &order, &rr.Password, &rr.Sid, &rr.System, &rr.Url, &rr.Username); err != nil {
+			break
+		}
+
+		if rr.AppKey, err = db.Secrets.Open(rr.AppKey); err != nil {
+			break
+		}
+
+		if rr.Password, err = db.Secrets.Open(rr.Password); err != nil {
+			break
+		}
+
+		if id.Valid && id.Float64 > 0 {
+			rr.Id = uint(id.Float64)
+		}
+
+		if order.Valid && order.Float64 > 0 {
+			rr.Order = uint(order.Float64)
+		}
+
+		syncs.List = append(syncs.List, rr)
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	return nil
+}
+
+func (syncs *RadioReferenceSyncs) Start() error {
+	go func() {
+		ticker := time.NewTicker(radioReferenceTick)
+
+		for range ticker.C {
+			syncs.poll()
+		}
+	}()
+
+	return nil
+}
+
+func (syncs *RadioReferenceSyncs) Write(db *Database) error {
+	var (
+		appKey   string
+		count    uint
+		err      error
+		password string
+		rows     *sql.Rows
+		rowIds   = []uint{}
+	)
+
+	syncs.mutex.Lock()
+	defer syncs.mutex.Unlock()
+
+	formatError := func(err error) error {
+		return fmt.Errorf("radioReferenceSyncs.write: %v", err)
+	}
+
+	if rows, err = db.Sql.Query("select `_id` from `rdioScannerRadioReferenceSyncs`"); err != nil {
+		return formatError(err)
+	}
+
+	for rows.Next() {
+		var rowId uint
+		if err = rows.Scan(&rowId); err != nil {
+			break
+		}
+		remove := true
+		for _, rr := range syncs.List {
+			if rr.Id == nil || rr.Id == rowId {
+				remove = false
+				break
+			}
+		}
+		if remove {
+			rowIds = append(rowIds, rowId)
+		}
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	if len(rowIds) > 0 {
+		if _, err = db.Delete("rdioScannerRadioReferenceSyncs").Where(SqlIn("_id", rowIds)).Exec(); err != nil {
+			return formatError(err)
+		}
+	}
+
+	for _, rr := range syncs.List {
+		if appKey, err = db.Secrets.Seal(rr.AppKey); err != nil {
+			break
+		}
+
+		if password, err = db.Secrets.Seal(rr.Password); err != nil {
+			break
+		}
+
+		if err = db.Sql.QueryRow("select count(*) from `rdioScannerRadioReferenceSyncs` where `_id` = ?", rr.Id).Scan(&count); err != nil {
+			break
+		}
+
+		if count == 0 {
+			if _, err = db.Sql.Exec("insert into `rdioScannerRadioReferenceSyncs` (`_id`, `appKey`, `disabled`, `interval`, `order`, `password`, `sid`, `system`, `url`, `username`) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", rr.Id, appKey, rr.Disabled, rr.Interval, rr.Order, password, rr.Sid, rr.System, rr.Url, rr.Username); err != nil {
+				break
+			}
+
+		} else if _, err = db.Sql.Exec("update `rdioScannerRadioReferenceSyncs` set `appKey` = ?, `disabled` = ?, `interval` = ?, `order` = ?, `password` = ?, `sid` = ?, `system` = ?, `url` = ?, `username` = ? where `_id` = ?", appKey, rr.Disabled, rr.Interval, rr.Order, password, rr.Sid, rr.System, rr.Url, rr.Username, rr.Id); err != nil {
+			break
+		}
+	}
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	return nil
+}
+
+func (syncs *RadioReferenceSyncs) poll() {
+	controller := syncs.Controller
+
+	syncs.mutex.Lock()
+	defer syncs.mutex.Unlock()
+
+	for _, rr := range syncs.List {
+		interval := radioReferenceInterval
+		if rr.Interval > 0 {
+			interval = time.Duration(rr.Interval) * time.Hour
+		}
+
+		if rr.Disabled || rr.running || rr.Sid == 0 || rr.System == 0 || len(rr.Username) == 0 || time.Since(rr.polled) < interval {
+			continue
+		}
+
+		rr.polled = time.Now()
+		rr.running = true
+
+		go func(rr *RadioReferenceSync) {
+			added, updated, err := rr.Sync(controller)
+
+			syncs.mutex.Lock()
+			rr.running = false
+			syncs.mutex.Unlock()
+
+			if err != nil {
+				controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("radioreference: sid=%v to system=%v %v", rr.Sid, rr.System, err))
+			} else if added > 0 || updated > 0 {
+				controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("radioreference: sid=%v to system=%v %d talkgroups added, %d updated", rr.Sid, rr.System, added, updated))
+			}
+		}(rr)
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	LoginKindAccess        = "access"
+	LoginKindAdmin         = "admin"
+	LoginKindMixdown       = "mixdown"
+	LoginKindPasswordReset = "password-reset"
+	LoginKindRegistration  = "registration"
+	LoginKindReplication   = "replication"
+)
+
+// LoginFailure is a failed authentication attempt as listed to the admin.
+type LoginFailure struct {
+	DateTime time.Time  `json:"dateTime"`
+	Ip       string     `json:"ip"`
+	Kind     string     `json:"kind"`
+	Locked   bool       `json:"locked,omitempty"`
+	Until    *time.Time `json:"until,omitempty"`
+}
+
+type loginBucket struct {
+	failures    uint
+	lockouts    uint
+	lockedUntil time.Time
+	tokens      float64
+	updated     time.Time
+}
+
+// Logins throttles the admin password and the access code validation, and
+// the timeline mixdowns, per ip address. Each ip has a token bucket refilled
+// at the configured rate, and too many consecutive failures lock it out for
+// a period doubling with each new lockout, up to the configured maximum.
+type Logins struct {
+	Burst       uint
+	Lockout     time.Duration
+	LockoutMax  time.Duration
+	MaxFailures uint
+	Rate        float64
+	buckets     map[string]*loginBucket
+	failures    []*LoginFailure
+	mutex       sync.Mutex
+}
+
+func NewLogins(config *Config) *Logins {
+	logins := &Logins{
+		buckets:  map[string]*loginBucket{},
+		failures: []*LoginFailure{},
+		mutex:    sync.Mutex{},
+	}
+
+	logins.Configure(config)
+
+	return logins
+}
+
+// Configure applies the login limits of the config, keeping the state of
+// the current buckets.
+func (logins *Logins) Configure(config *Config) {
+	logins.mutex.Lock()
+	defer logins.mutex.Unlock()
+
+	logins.Burst = config.LoginBurst
+	logins.Lockout = time.Duration(config.LoginLockout) * time.Second
+	logins.LockoutMax = time.Duration(config.LoginLockoutMax) * time.Second
+	logins.MaxFailures = config.LoginMaxFailures
+	logins.Rate = float64(config.LoginRate) / 60
+}
+
+// Allow takes a token from the bucket of the ip for the given kind of login.
+// It returns false with the time to wait when the ip is locked out or has
+// no token left.
+func (logins *Logins) Allow(kind string, ip string) (bool, time.Duration) {
+	logins.mutex.Lock()
+	defer logins.mutex.Unlock()
+
+	now := time.Now()
+
+	bucket := logins.getBucket(kind, ip, now)
+
+	if now.Before(bucket.lockedUntil) {
+		return false, bucket.lockedUntil.Sub(now)
+	}
+
+	if bucket.tokens < 1 {
+		if logins.Rate <= 0 {
+			return false, logins.LockoutMax
+		}
+		return false, time.Duration((1 - bucket.tokens) / logins.Rate * float64(time.Second))
+	}
+
+	bucket.tokens--
+
+	return true, 0
+}
+
+// Fail records a failed attempt and returns the end of the lockout when it
+// locks the ip out.
+func (logins *Logins) Fail(kind string, ip string) (bool, time.Time) {
+	const maxFailures = 500
+
+	logins.mutex.Lock()
+	defer logins.mutex.Unlock()
+
+	now := time.Now()
+
+	bucket := logins.getBucket(kind, ip, now)
+	bucket.failures++
+
+	failure := &LoginFailure{DateTime: now, Ip: ip, Kind: kind}
+
+	if logins.MaxFailures > 0 && bucket.failures >= logins.MaxFailures {
+		lockout := time.Duration(float64(logins.Lockout) * math.Pow(2, float64(bucket.lockouts)))
+		if logins.LockoutMax > 0 && (lockout > logins.LockoutMax || lockout <= 0) {
+			lockout = logins.LockoutMax
+		}
+
+		bucket.failures = 0
+		bucket.lockedUntil = now.Add(lockout)
+		bucket.lockouts++
+
+		until := bucket.lockedUntil
+
+		failure.Locked = true
+		failure.Until = &until
+	}
+
+	logins.failures = append(logins.failures, failure)
+	if len(logins.failures) > maxFailures {
+		logins.failures = logins.failures[len(logins.failures)-maxFailures:]
+	}
+
+	return failure.Locked, bucket.lockedUntil
+}
+
+// Failures lists the recorded failed attempts, the most recent first.
+func (logins *Logins) Failures() []*LoginFailure {
+	logins.mutex.Lock()
+	defer logins.mutex.Unlock()
+
+	failures := make([]*LoginFailure, len(logins.failures))
+	copy(failures, logins.failures)
+
+	sort.Slice(failures, func(i int, j int) bool {
+		return failures[i].DateTime.After(failures[j].DateTime)
+	})
+
+	return failures
+}
+
+// Succeed clears the failures and the lockout history of the ip.
+func (logins *Logins) Succeed(kind string, ip string) {
+	logins.mutex.Lock()
+	defer logins.mutex.Unlock()
+
+	delete(logins.buckets, kind+"|"+ip)
+}
+
+func (logins *Logins) getBucket(kind string, ip string, now time.Time) *loginBucket {
+	key := kind + "|" + ip
+
+	bucket := logins.buckets[key]
+
+	if bucket == nil {
+		logins.prune(now)
+
+		bucket = &loginBucket{tokens: float64(logins.Burst), updated: now}
+		logins.buckets[key] = bucket
+
+	} else {
+		bucket.tokens = math.Min(float64(logins.Burst), bucket.tokens+now.Sub(bucket.updated).Seconds()*logins.Rate)
+		bucket.updated = now
+	}
+
+	return bucket
+}
+
+// prune forgets the buckets that are full again and whose lockout is over
+// for longer than the maximum lockout, so that their backoff starts over.
+func (logins *Logins) prune(now time.Time) {
+	for key, bucket := range logins.buckets {
+		if now.Sub(bucket.lockedUntil) < logins.LockoutMax {
+			continue
+		}
+
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*logins.Rate >= float64(logins.Burst) {
+			delete(logins.buckets, key)
+		}
+	}
+}
+
+func (admin *Admin) LoginFailuresHandler(w http.ResponseWriter, r *http.Request) {
+	if !admin.Authorize(w, r, AdminRoleSuperadmin) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if b, err := json.Marshal(admin.Controller.Logins.Failures()); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// loginRetryAfter sets the Retry-After header of a throttled login response.
+func loginRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
+
+func loginLockedMessage(kind string, ip string, until time.Time) string {
+	return fmt.Sprintf("%s login locked for ip %s until %s", kind, ip, until.Format(time.RFC3339))
+}
@@ -0,0 +1,230 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package rdioserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Call is a call uploaded to a server. The audio is a second of silence and
+// the date and time are now when not given.
+type Call struct {
+	Audio     []byte
+	AudioName string
+	DateTime  time.Time
+	Emergency bool
+	Encrypted bool
+	Frequency uint
+	Source    uint
+	System    uint
+	Talkgroup uint
+}
+
+// ListenerCall is a call as the listeners receive it.
+type ListenerCall struct {
+	Id         uint      `json:"id"`
+	Audio      []byte    `json:"-"`
+	AudioName  string    `json:"audioName"`
+	AudioType  string    `json:"audioType"`
+	DateTime   time.Time `json:"dateTime"`
+	Emergency  bool      `json:"emergency"`
+	Encrypted  bool      `json:"encrypted"`
+	Frequency  uint      `json:"frequency"`
+	Mode       string    `json:"mode"`
+	Priority   uint      `json:"priority"`
+	Site       uint      `json:"site"`
+	Source     uint      `json:"source"`
+	System     uint      `json:"system"`
+	Talkgroup  uint      `json:"talkgroup"`
+	Transcript string    `json:"transcript"`
+}
+
+// UnmarshalJSON reads the audio sent as a node buffer, an array of bytes.
+func (call *ListenerCall) UnmarshalJSON(b []byte) error {
+	type listenerCall ListenerCall
+
+	var audio struct {
+		Audio struct {
+			Data []int `json:"data"`
+		} `json:"audio"`
+	}
+
+	if err := json.Unmarshal(b, (*listenerCall)(call)); err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(b, &audio); err != nil {
+		return err
+	}
+
+	call.Audio = make([]byte, len(audio.Audio.Data))
+	for i, v := range audio.Audio.Data {
+		call.Audio[i] = byte(v)
+	}
+
+	return nil
+}
+
+// Silence returns a wav file of silence lasting d, at 8 kHz on 16 bits.
+func Silence(d time.Duration) []byte {
+	const rate = 8000
+
+	samples := int(d.Seconds() * rate)
+
+	b := &bytes.Buffer{}
+	b.WriteString("RIFF")
+	binary.Write(b, binary.LittleEndian, uint32(36+samples*2))
+	b.WriteString("WAVEfmt ")
+	binary.Write(b, binary.LittleEndian, uint32(16))
+	binary.Write(b, binary.LittleEndian, uint16(1))
+	binary.Write(b, binary.LittleEndian, uint16(1))
+	binary.Write(b, binary.LittleEndian, uint32(rate))
+	binary.Write(b, binary.LittleEndian, uint32(rate*2))
+	binary.Write(b, binary.LittleEndian, uint16(2))
+	binary.Write(b, binary.LittleEndian, uint16(16))
+	b.WriteString("data")
+	binary.Write(b, binary.LittleEndian, uint32(samples*2))
+	b.Write(make([]byte, samples*2))
+
+	return b.Bytes()
+}
+
+// Upload uploads the call to /api/call-upload with the api key of the
+// fixture. The call is ingested once the server answered, the listeners
+// receiving it shortly after.
+func (server *Server) Upload(call *Call) error {
+	audio, audioName, dateTime := call.Audio, call.AudioName, call.DateTime
+
+	if len(audio) == 0 {
+		audio = Silence(time.Second)
+	}
+
+	if len(audioName) == 0 {
+		audioName = "call.wav"
+	}
+
+	if dateTime.IsZero() {
+		dateTime = time.Now()
+	}
+
+	fields := map[string]string{
+		"dateTime":  dateTime.UTC().Format(time.RFC3339),
+		"key":       server.ApiKey,
+		"system":    strconv.FormatUint(uint64(call.System), 10),
+		"talkgroup": strconv.FormatUint(uint64(call.Talkgroup), 10),
+	}
+
+	if call.Emergency {
+		fields["emergency"] = "1"
+	}
+
+	if call.Encrypted {
+		fields["encrypted"] = "1"
+	}
+
+	if call.Frequency > 0 {
+		fields["frequency"] = strconv.FormatUint(uint64(call.Frequency), 10)
+	}
+
+	if call.Source > 0 {
+		fields["source"] = strconv.FormatUint(uint64(call.Source), 10)
+	}
+
+	return server.upload("/api/call-upload", fields, "audio", audioName, audio)
+}
+
+// UploadTrunkRecorder uploads the audio with the call metadata of
+// trunk-recorder to /api/trunk-recorder-call-upload.
+func (server *Server) UploadTrunkRecorder(system uint, audio []byte, meta map[string]any) error {
+	if len(audio) == 0 {
+		audio = Silence(time.Second)
+	}
+
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	fields := map[string]string{
+		"key":    server.ApiKey,
+		"meta":   string(b),
+		"system": strconv.FormatUint(uint64(system), 10),
+	}
+
+	return server.upload("/api/trunk-recorder-call-upload", fields, "audio", "call.wav", audio)
+}
+
+func (server *Server) upload(path string, fields map[string]string, fileField string, fileName string, file []byte) error {
+	body := &bytes.Buffer{}
+
+	mw := multipart.NewWriter(body)
+
+	for name, value := range fields {
+		var (
+			err error
+			w   io.Writer
+		)
+
+		// trunk-recorder sends its metadata as a file
+		if name == "meta" {
+			w, err = mw.CreateFormFile(name, "call.json")
+		} else {
+			w, err = mw.CreateFormField(name)
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err = io.WriteString(w, value); err != nil {
+			return err
+		}
+	}
+
+	w, err := mw.CreateFormFile(fileField, fileName)
+	if err != nil {
+		return err
+	}
+
+	if _, err = w.Write(file); err != nil {
+		return err
+	}
+
+	if err = mw.Close(); err != nil {
+		return err
+	}
+
+	res, err := http.Post(server.Url+path, mw.FormDataContentType(), body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	b, _ := io.ReadAll(res.Body)
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("upload: %s %s", res.Status, bytes.TrimSpace(b))
+	}
+
+	return nil
+}
@@ -0,0 +1,258 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package rdioserver
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// the commands of the listener protocol used by the client
+const (
+	CommandCall        = "CAL"
+	CommandConfig      = "CFG"
+	CommandLivefeedMap = "LFM"
+	CommandPin         = "PIN"
+	CommandTranscript  = "TRN"
+	CommandVersion     = "VER"
+)
+
+var errClientClosed = errors.New("rdioserver: client closed")
+
+// Message is a message of the listener protocol, a json array of the
+// command, its payload, its flag and a sequence number for the calls.
+type Message struct {
+	Command string
+	Flag    json.RawMessage
+	Payload json.RawMessage
+	Seq     uint64
+}
+
+// Client is a listener connected to a server with the first version of the
+// listener protocol, where everything is json.
+type Client struct {
+	conn     *websocket.Conn
+	err      error
+	messages chan *Message
+}
+
+// Dial connects a listener for the test, closed with it.
+func (server *Server) Dial(t testing.TB) *Client {
+	t.Helper()
+
+	client, err := server.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("rdioserver: %v", err)
+	}
+
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+// DialContext connects a listener, which must be closed by the caller.
+func (server *Server) DialContext(ctx context.Context) (*Client, error) {
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, "ws"+strings.TrimPrefix(server.Url, "http")+"/", nil)
+	if err != nil {
+		return nil, fmt.Errorf("dial: %v", err)
+	}
+
+	client := &Client{conn: conn, messages: make(chan *Message, 256)}
+
+	go client.read()
+
+	return client, nil
+}
+
+// Call returns the next call received, skipping the other messages.
+func (client *Client) Call(ctx context.Context) (*ListenerCall, error) {
+	message, err := client.Expect(ctx, CommandCall)
+	if err != nil {
+		return nil, err
+	}
+
+	call := &ListenerCall{}
+
+	if err = json.Unmarshal(message.Payload, call); err != nil {
+		return nil, fmt.Errorf("call: %v", err)
+	}
+
+	return call, nil
+}
+
+// Close disconnects the listener.
+func (client *Client) Close() error {
+	return client.conn.Close()
+}
+
+// Config asks for the config the listener is given and returns it.
+func (client *Client) Config(ctx context.Context) (map[string]any, error) {
+	if err := client.Send(CommandConfig, nil); err != nil {
+		return nil, err
+	}
+
+	message, err := client.Expect(ctx, CommandConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	config := map[string]any{}
+
+	if err = json.Unmarshal(message.Payload, &config); err != nil {
+		return nil, fmt.Errorf("config: %v", err)
+	}
+
+	return config, nil
+}
+
+// Expect returns the next message with the command, skipping the others.
+func (client *Client) Expect(ctx context.Context, command string) (*Message, error) {
+	for {
+		message, err := client.Next(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("expect %s: %v", command, err)
+		}
+
+		if message.Command == command {
+			return message, nil
+		}
+	}
+}
+
+// Listen turns the livefeed on for the talkgroups of the systems, the
+// others being turned off, and waits for the server to acknowledge it.
+func (client *Client) Listen(ctx context.Context, talkgroups map[uint][]uint) error {
+	matrix := map[string]map[string]bool{}
+
+	for system, ids := range talkgroups {
+		s := strconv.FormatUint(uint64(system), 10)
+		matrix[s] = map[string]bool{}
+		for _, id := range ids {
+			matrix[s][strconv.FormatUint(uint64(id), 10)] = true
+		}
+	}
+
+	if err := client.Send(CommandLivefeedMap, matrix); err != nil {
+		return err
+	}
+
+	_, err := client.Expect(ctx, CommandLivefeedMap)
+
+	return err
+}
+
+// Next returns the next message received.
+func (client *Client) Next(ctx context.Context) (*Message, error) {
+	select {
+	case message, ok := <-client.messages:
+		if !ok {
+			if client.err != nil {
+				return nil, client.err
+			}
+			return nil, errClientClosed
+		}
+		return message, nil
+
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Send sends the command with its payload, if not nil.
+func (client *Client) Send(command string, payload any) error {
+	message := []any{command}
+
+	if payload != nil {
+		message = append(message, payload)
+	}
+
+	b, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	return client.conn.WriteMessage(websocket.TextMessage, b)
+}
+
+// Unlock sends the access code the server asks for with a PIN message.
+func (client *Client) Unlock(code string) error {
+	return client.Send(CommandPin, base64.StdEncoding.EncodeToString([]byte(code)))
+}
+
+func (client *Client) read() {
+	defer close(client.messages)
+
+	for {
+		_, b, err := client.conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) && !errors.Is(err, websocket.ErrCloseSent) {
+				client.err = err
+			}
+			return
+		}
+
+		message, err := parseMessage(b)
+		if err != nil {
+			client.err = err
+			return
+		}
+
+		client.messages <- message
+	}
+}
+
+// parseMessage reads a message sent by the server.
+func parseMessage(b []byte) (*Message, error) {
+	var f []json.RawMessage
+
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("message: %v", err)
+	}
+
+	if len(f) == 0 {
+		return nil, errors.New("message: empty")
+	}
+
+	message := &Message{}
+
+	if err := json.Unmarshal(f[0], &message.Command); err != nil {
+		return nil, fmt.Errorf("message: %v", err)
+	}
+
+	if len(f) > 1 {
+		message.Payload = f[1]
+	}
+
+	if len(f) > 2 {
+		message.Flag = f[2]
+	}
+
+	if len(f) > 3 {
+		if err := json.Unmarshal(f[3], &message.Seq); err != nil {
+			return nil, fmt.Errorf("message: %v", err)
+		}
+	}
+
+	return message, nil
+}
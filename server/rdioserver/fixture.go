@@ -0,0 +1,148 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package rdioserver
+
+// Fixture is the config of a server, with the groups and the tags of the
+// talkgroups given by their labels.
+type Fixture struct {
+	ApiKey  string
+	Groups  []string
+	Options map[string]any
+	Systems []FixtureSystem
+	Tags    []string
+}
+
+type FixtureSystem struct {
+	Id         uint
+	Label      string
+	Talkgroups []FixtureTalkgroup
+	Units      []FixtureUnit
+}
+
+type FixtureTalkgroup struct {
+	Group         string
+	HideEncrypted bool
+	Id            uint
+	Label         string
+	Name          string
+	Tag           string
+}
+
+type FixtureUnit struct {
+	Id    uint
+	Label string
+}
+
+// DefaultFixture returns a system 1 with the talkgroups 1 and 2, and an api
+// key allowed to upload to any system.
+func DefaultFixture() *Fixture {
+	key, err := randomHex(16)
+	if err != nil {
+		panic(err)
+	}
+
+	return &Fixture{
+		ApiKey: key,
+		Groups: []string{"Fire", "Police"},
+		Systems: []FixtureSystem{
+			{
+				Id:    1,
+				Label: "Test",
+				Talkgroups: []FixtureTalkgroup{
+					{Group: "Fire", Id: 1, Label: "FD", Name: "Fire Dispatch", Tag: "Dispatch"},
+					{Group: "Police", Id: 2, Label: "PD", Name: "Police Dispatch", Tag: "Dispatch"},
+				},
+			},
+		},
+		Tags: []string{"Dispatch"},
+	}
+}
+
+// Config returns the config of the fixture as the admin api takes it.
+func (fixture *Fixture) Config() map[string]any {
+	config := map[string]any{
+		"apiKeys": []any{
+			map[string]any{"_id": 1, "ident": "rdioserver", "key": fixture.ApiKey, "order": 1, "systems": "*"},
+		},
+		"groups":  fixtureLabels(fixture.Groups),
+		"systems": []any{},
+		"tags":    fixtureLabels(fixture.Tags),
+	}
+
+	if fixture.Options != nil {
+		config["options"] = fixture.Options
+	}
+
+	systems := []any{}
+
+	for i, system := range fixture.Systems {
+		talkgroups := []any{}
+
+		for j, talkgroup := range system.Talkgroups {
+			talkgroups = append(talkgroups, map[string]any{
+				"groupId":       fixtureId(fixture.Groups, talkgroup.Group),
+				"hideEncrypted": talkgroup.HideEncrypted,
+				"id":            talkgroup.Id,
+				"label":         talkgroup.Label,
+				"name":          talkgroup.Name,
+				"order":         j + 1,
+				"tagId":         fixtureId(fixture.Tags, talkgroup.Tag),
+			})
+		}
+
+		units := []any{}
+
+		for j, unit := range system.Units {
+			units = append(units, map[string]any{"id": unit.Id, "label": unit.Label, "order": j + 1})
+		}
+
+		systems = append(systems, map[string]any{
+			"_id":        i + 1,
+			"blacklists": "",
+			"id":         system.Id,
+			"label":      system.Label,
+			"order":      i + 1,
+			"talkgroups": talkgroups,
+			"units":      units,
+		})
+	}
+
+	config["systems"] = systems
+
+	return config
+}
+
+// fixtureId returns the row id of the label, the first one when it is not
+// found.
+func fixtureId(labels []string, label string) int {
+	for i, l := range labels {
+		if l == label {
+			return i + 1
+		}
+	}
+
+	return 1
+}
+
+func fixtureLabels(labels []string) []any {
+	a := []any{}
+
+	for i, label := range labels {
+		a = append(a, map[string]any{"_id": i + 1, "label": label})
+	}
+
+	return a
+}
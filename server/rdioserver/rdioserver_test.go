@@ -0,0 +1,172 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package rdioserver
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestFixtureConfig(t *testing.T) {
+	fixture := DefaultFixture()
+	fixture.Systems[0].Talkgroups = append(fixture.Systems[0].Talkgroups, FixtureTalkgroup{Group: "Unknown", Id: 3, Label: "EMS", Name: "EMS", Tag: "Dispatch"})
+
+	config := fixture.Config()
+
+	talkgroups := config["systems"].([]any)[0].(map[string]any)["talkgroups"].([]any)
+
+	tests := []struct {
+		id      uint
+		groupId int
+		tagId   int
+	}{
+		{1, 1, 1},
+		{2, 2, 1},
+		{3, 1, 1},
+	}
+
+	for i, test := range tests {
+		talkgroup := talkgroups[i].(map[string]any)
+		if talkgroup["id"] != test.id || talkgroup["groupId"] != test.groupId || talkgroup["tagId"] != test.tagId {
+			t.Errorf("got talkgroup %v, want id %d group %d tag %d", talkgroup, test.id, test.groupId, test.tagId)
+		}
+	}
+
+	if key := config["apiKeys"].([]any)[0].(map[string]any)["key"]; key != fixture.ApiKey {
+		t.Errorf("got api key %v, want %s", key, fixture.ApiKey)
+	}
+}
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		command string
+		payload string
+		seq     uint64
+		wantErr bool
+	}{
+		{name: "command", in: `["VER"]`, command: "VER"},
+		{name: "payload", in: `["LFM",true]`, command: "LFM", payload: "true"},
+		{name: "sequence", in: `["CAL",{"id":1},null,7]`, command: "CAL", payload: `{"id":1}`, seq: 7},
+		{name: "empty", in: `[]`, wantErr: true},
+		{name: "not an array", in: `{}`, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message, err := parseMessage([]byte(test.in))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v", err)
+			}
+			if err != nil {
+				return
+			}
+			if message.Command != test.command || string(message.Payload) != test.payload || message.Seq != test.seq {
+				t.Errorf("got %s %s %d", message.Command, message.Payload, message.Seq)
+			}
+		})
+	}
+}
+
+func TestListenerCallUnmarshal(t *testing.T) {
+	call := &ListenerCall{}
+
+	if err := call.UnmarshalJSON([]byte(`{"id":3,"audio":{"type":"Buffer","data":[1,2,255]},"emergency":true,"system":1,"talkgroup":2}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if call.Id != 3 || !call.Emergency || call.System != 1 || call.Talkgroup != 2 || string(call.Audio) != "\x01\x02\xff" {
+		t.Errorf("got %+v", call)
+	}
+}
+
+func TestSilence(t *testing.T) {
+	b := Silence(500 * time.Millisecond)
+
+	if string(b[:4]) != "RIFF" || string(b[8:12]) != "WAVE" {
+		t.Fatalf("not a wav file")
+	}
+
+	if size := binary.LittleEndian.Uint32(b[40:44]); size != 8000 || len(b) != 44+8000 {
+		t.Errorf("got %d bytes of samples in %d bytes", size, len(b))
+	}
+}
+
+func TestServer(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs a server")
+	}
+
+	fixture := DefaultFixture()
+	fixture.Systems[0].Talkgroups[1].HideEncrypted = true
+
+	server := Start(t, &Options{Fixture: fixture})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	client := server.Dial(t)
+
+	config, err := client.Config(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if systems, ok := config["systems"].([]any); !ok || len(systems) != 1 {
+		t.Fatalf("got systems %v", config["systems"])
+	}
+
+	if err = client.Listen(ctx, map[uint][]uint{1: {1, 2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now().Add(-time.Minute)
+
+	// the encrypted call of the talkgroup 2 is hidden, the next one comes
+	// first
+	for i, call := range []*Call{
+		{DateTime: start, Encrypted: true, System: 1, Talkgroup: 2},
+		{DateTime: start.Add(time.Second), Emergency: true, System: 1, Talkgroup: 1},
+	} {
+		if err = server.Upload(call); err != nil {
+			t.Fatalf("upload %d: %v", i, err)
+		}
+	}
+
+	call, err := client.Call(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if call.System != 1 || call.Talkgroup != 1 || !call.Emergency || len(call.Audio) == 0 {
+		t.Errorf("got call %+v", call)
+	}
+
+	if err = server.UploadTrunkRecorder(1, nil, map[string]any{"start_time": start.Add(2 * time.Second).Unix(), "talkgroup": 2, "phase2_tdma": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if call, err = client.Call(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if call.Talkgroup != 2 || call.Mode != "tdma" {
+		t.Errorf("got call %+v", call)
+	}
+}
@@ -0,0 +1,389 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+// Package rdioserver runs ephemeral rdio scanner servers for the integration
+// tests of the integrators and the plugin authors, who upload calls to them
+// and listen to them as the webapp does rather than mocking the protocol.
+//
+// The server being a program, each instance is the real binary run on a
+// free port of the loopback interface with its own sqlite database in a
+// temporary directory:
+//
+//	server := rdioserver.Start(t, nil)
+//	client := server.Dial(t)
+//	client.Listen(ctx, map[uint][]uint{1: {1}})
+//	server.Upload(&rdioserver.Call{System: 1, Talkgroup: 1})
+//	call, err := client.Call(ctx)
+package rdioserver
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// BinaryEnv is the environment variable giving the server binary to run,
+// built from the module when unset.
+const BinaryEnv = "RDIO_SCANNER_BINARY"
+
+// the package of the server binary built when none is given
+const serverPackage = "rdio-scanner/server"
+
+const defaultStartTimeout = 30 * time.Second
+
+var built struct {
+	binary string
+	err    error
+	once   sync.Once
+}
+
+// Options are the options of a server, all of them optional.
+type Options struct {
+	// Args are the flags appended to the command line of the server, ie:
+	// -ingest_queue_limit=10.
+	Args []string
+	// Binary is the server binary, the BinaryEnv environment variable or a
+	// binary built once from the module being used when empty.
+	Binary string
+	// Fixture is the config applied once the server is started, the
+	// default fixture when nil.
+	Fixture *Fixture
+	// StartTimeout is how long the server has to answer, 30 seconds when
+	// zero.
+	StartTimeout time.Duration
+}
+
+// Server is a running server. Its logs are reported with the test when it
+// fails.
+type Server struct {
+	AdminPassword string
+	ApiKey        string
+	Dir           string
+	Fixture       *Fixture
+	Url           string
+	cmd           *exec.Cmd
+	done          chan error
+	logs          *syncBuffer
+	token         string
+}
+
+// Start runs a server for the test, stopped with it, and applies the
+// fixture. The test fails if the server does not start.
+func Start(t testing.TB, options *Options) *Server {
+	t.Helper()
+
+	server, err := NewServer(t.TempDir(), options)
+	if err != nil {
+		t.Fatalf("rdioserver: %v", err)
+	}
+
+	t.Cleanup(func() {
+		if err := server.Close(); err != nil {
+			t.Errorf("rdioserver: %v", err)
+		}
+		if t.Failed() {
+			t.Logf("rdioserver logs:\n%s", server.Logs())
+		}
+	})
+
+	return server
+}
+
+// NewServer runs a server writing its data to dir and applies the fixture.
+// The server must be closed by the caller.
+func NewServer(dir string, options *Options) (*Server, error) {
+	if options == nil {
+		options = &Options{}
+	}
+
+	binary, err := serverBinary(options.Binary)
+	if err != nil {
+		return nil, err
+	}
+
+	addr, err := freeAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	password, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+
+	fixture := options.Fixture
+	if fixture == nil {
+		fixture = DefaultFixture()
+	}
+
+	server := &Server{
+		AdminPassword: password,
+		ApiKey:        fixture.ApiKey,
+		Dir:           dir,
+		Fixture:       fixture,
+		Url:           "http://" + addr,
+		done:          make(chan error, 1),
+		logs:          &syncBuffer{},
+	}
+
+	// the admin password is set by a first run which exits right away
+	setup := exec.Command(binary, "-base_dir", dir, "-admin_password", password)
+	if b, err := setup.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("admin password: %v, %s", err, b)
+	}
+
+	args := append([]string{"-base_dir", dir, "-listen", addr}, options.Args...)
+
+	server.cmd = exec.Command(binary, args...)
+	server.cmd.Stdout = server.logs
+	server.cmd.Stderr = server.logs
+
+	if err = server.cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		server.done <- server.cmd.Wait()
+	}()
+
+	timeout := options.StartTimeout
+	if timeout == 0 {
+		timeout = defaultStartTimeout
+	}
+
+	if err = server.wait(timeout); err != nil {
+		server.Close()
+		return nil, err
+	}
+
+	if err = server.login(); err != nil {
+		server.Close()
+		return nil, err
+	}
+
+	if err = server.Configure(fixture); err != nil {
+		server.Close()
+		return nil, err
+	}
+
+	return server, nil
+}
+
+// Admin sends a request to the admin api with the token of the admin,
+// decoding the json response into out when not nil.
+func (server *Server) Admin(method string, path string, in any, out any) error {
+	var body io.Reader
+
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, server.Url+path, body)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", server.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s %s", method, path, res.Status, bytes.TrimSpace(b))
+	}
+
+	if out != nil && len(b) > 0 {
+		return json.Unmarshal(b, out)
+	}
+
+	return nil
+}
+
+// Close stops the server.
+func (server *Server) Close() error {
+	if server.cmd == nil || server.cmd.Process == nil {
+		return nil
+	}
+
+	select {
+	case <-server.done:
+		// already exited, ie: on a fatal error
+		return nil
+	default:
+	}
+
+	if err := server.cmd.Process.Kill(); err != nil {
+		return err
+	}
+
+	<-server.done
+
+	return nil
+}
+
+// Configure replaces the config of the server with the fixture.
+func (server *Server) Configure(fixture *Fixture) error {
+	if err := server.Admin(http.MethodPut, "/api/admin/config", fixture.Config(), nil); err != nil {
+		return fmt.Errorf("configure: %v", err)
+	}
+
+	server.ApiKey = fixture.ApiKey
+	server.Fixture = fixture
+
+	return nil
+}
+
+// Logs returns what the server logged so far.
+func (server *Server) Logs() string {
+	return server.logs.String()
+}
+
+func (server *Server) login() error {
+	var res struct {
+		Token string `json:"token"`
+	}
+
+	if err := server.Admin(http.MethodPost, "/api/admin/login", map[string]any{"password": server.AdminPassword}, &res); err != nil {
+		return fmt.Errorf("login: %v", err)
+	}
+
+	server.token = res.Token
+
+	return nil
+}
+
+// wait returns once the server answers, or with an error if it exits or
+// does not answer in time.
+func (server *Server) wait(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		select {
+		case err := <-server.done:
+			server.done <- err
+			return fmt.Errorf("server exited: %v, %s", err, server.Logs())
+		default:
+		}
+
+		if res, err := http.Get(server.Url + "/api/admin/login"); err == nil {
+			res.Body.Close()
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("server not started within %v, %s", timeout, server.Logs())
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// freeAddr returns a loopback address with a port free right now.
+func freeAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+
+	return l.Addr().String(), nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// serverBinary returns the binary given, or the one of the environment, or
+// builds it once for all the servers of the process.
+func serverBinary(binary string) (string, error) {
+	if len(binary) > 0 {
+		return binary, nil
+	}
+
+	if v := os.Getenv(BinaryEnv); len(v) > 0 {
+		return v, nil
+	}
+
+	built.once.Do(func() {
+		dir, err := os.MkdirTemp("", "rdioserver")
+		if err != nil {
+			built.err = err
+			return
+		}
+
+		built.binary = filepath.Join(dir, "rdio-scanner")
+
+		if b, err := exec.Command("go", "build", "-o", built.binary, serverPackage).CombinedOutput(); err != nil {
+			built.err = fmt.Errorf("go build %s: %v, %s", serverPackage, err, b)
+		}
+	})
+
+	if built.err != nil {
+		return "", built.err
+	}
+
+	return built.binary, nil
+}
+
+// syncBuffer collects the output of the server, written from the goroutines
+// of the command.
+type syncBuffer struct {
+	buffer bytes.Buffer
+	mutex  sync.Mutex
+}
+
+func (buffer *syncBuffer) String() string {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	return buffer.buffer.String()
+}
+
+func (buffer *syncBuffer) Write(b []byte) (int, error) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	return buffer.buffer.Write(b)
+}
@@ -0,0 +1,579 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RegistrationStatusApproved = "approved"
+	RegistrationStatusDenied   = "denied"
+	RegistrationStatusPending  = "pending"
+)
+
+const (
+	registrationCodeLength = 10
+	registrationMaxMessage = 1000
+)
+
+var (
+	errRegistrationDecided = errors.New("registration already decided")
+	errRegistrationsFull   = errors.New("too many pending registrations")
+)
+
+// Registration is an access request made by a listener from the webapp. It
+// waits for the admin, who approves it with a new access code emailed to the
+// listener, or denies it.
+type Registration struct {
+	Id        any       `json:"_id"`
+	CreatedAt time.Time `json:"createdAt"`
+	DecidedAt any       `json:"decidedAt"`
+	Email     string    `json:"email"`
+	Ident     string    `json:"ident"`
+	Ip        string    `json:"ip"`
+	Message   string    `json:"message"`
+	Status    string    `json:"status"`
+}
+
+func (registration *Registration) FromMap(m map[string]any) *Registration {
+	registration.CreatedAt = time.Now().UTC()
+	registration.Status = RegistrationStatusPending
+
+	switch v := m["email"].(type) {
+	case string:
+		registration.Email = strings.ToLower(strings.TrimSpace(v))
+	}
+
+	switch v := m["name"].(type) {
+	case string:
+		registration.Ident = truncateRunes(strings.TrimSpace(v), 255)
+	}
+
+	switch v := m["message"].(type) {
+	case string:
+		registration.Message = truncateRunes(strings.TrimSpace(v), registrationMaxMessage)
+	}
+
+	return registration
+}
+
+// Validate checks that the email is a bare address, the one which receives
+// the access code.
+func (registration *Registration) Validate() error {
+	if len(registration.Email) == 0 || len(registration.Email) > 255 {
+		return errors.New("invalid email")
+	}
+
+	address, err := mail.ParseAddress(registration.Email)
+	if err != nil || address.Address != registration.Email || address.Name != "" {
+		return errors.New("invalid email")
+	}
+
+	if len(registration.Ident) == 0 {
+		registration.Ident = registration.Email
+	}
+
+	return nil
+}
+
+type Registrations struct {
+	Controller *Controller
+	List       []*Registration
+	mutex      sync.Mutex
+}
+
+func NewRegistrations(controller *Controller) *Registrations {
+	return &Registrations{
+		Controller: controller,
+		List:       []*Registration{},
+		mutex:      sync.Mutex{},
+	}
+}
+
+// Decide approves or denies a pending registration. The status is set before
+// the database is updated so that two admins can't decide it both.
+func (registrations *Registrations) Decide(id uint, status string, db *Database) (*Registration, error) {
+	formatError := func(err error) error {
+		return fmt.Errorf("registrations.decide: %v", err)
+	}
+
+	if status != RegistrationStatusApproved && status != RegistrationStatusDenied {
+		return nil, formatError(fmt.Errorf("invalid status %s", status))
+	}
+
+	registration, err := registrations.setStatus(id, RegistrationStatusPending, status)
+	if err != nil || registration == nil {
+		return nil, err
+	}
+
+	if _, err = db.Sql.Exec("update `rdioScannerRegistrations` set `decidedAt` = ?, `status` = ? where `_id` = ?", registration.DecidedAt, status, id); err != nil {
+		registrations.setStatus(id, status, RegistrationStatusPending)
+		return nil, formatError(err)
+	}
+
+	return registration, nil
+}
+
+// Reopen sets a decided registration back to pending, when the decision
+// could not be carried out.
+func (registrations *Registrations) Reopen(id uint, db *Database) error {
+	registration, err := registrations.setStatus(id, "", RegistrationStatusPending)
+	if err != nil || registration == nil {
+		return err
+	}
+
+	if _, err = db.Sql.Exec("update `rdioScannerRegistrations` set `decidedAt` = null, `status` = ? where `_id` = ?", RegistrationStatusPending, id); err != nil {
+		return fmt.Errorf("registrations.reopen: %v", err)
+	}
+
+	return nil
+}
+
+func (registrations *Registrations) GetList() []*Registration {
+	registrations.mutex.Lock()
+	defer registrations.mutex.Unlock()
+
+	l := make([]*Registration, len(registrations.List))
+	for i, registration := range registrations.List {
+		r := *registration
+		l[i] = &r
+	}
+
+	return l
+}
+
+func (registrations *Registrations) Read(db *Database) error {
+	var (
+		createdAt any
+		decidedAt any
+		err       error
+		id        sql.NullFloat64
+		message   sql.NullString
+		rows      *sql.Rows
+	)
+
+	registrations.mutex.Lock()
+	defer registrations.mutex.Unlock()
+
+	registrations.List = []*Registration{}
+
+	formatError := func(err error) error {
+		return fmt.Errorf("registrations.read: %v", err)
+	}
+
+	if rows, err = db.Sql.Query("select `_id`, `createdAt`, `decidedAt`, `email`, `ident`, `ip`, `message`, `status` from `rdioScannerRegistrations` order by `_id`"); err != nil {
+		return formatError(err)
+	}
+
+	for rows.Next() {
+		registration := &Registration{}
+
+		if err = rows.Scan(&id, &createdAt, &decidedAt, &registration.Email, &registration.Ident, &registration.Ip, &message, &registration.Status); err != nil {
+			break
+		}
+
+		if id.Valid && id.Float64 > 0 {
+			registration.Id = uint(id.Float64)
+		}
+
+		if t, err := db.ParseDateTime(createdAt); err == nil {
+			registration.CreatedAt = t
+		}
+
+		if decidedAt != nil {
+			if t, err := db.ParseDateTime(decidedAt); err == nil {
+				registration.DecidedAt = t
+			}
+		}
+
+		if message.Valid {
+			registration.Message = message.String
+		}
+
+		registrations.List = append(registrations.List, registration)
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	return nil
+}
+
+// Request queues a new registration. It returns false, without an error,
+// when the email already has a pending registration, so that the requester
+// can't tell the emails already registered.
+func (registrations *Registrations) Request(registration *Registration, db *Database) (bool, error) {
+	var (
+		err error
+		id  int64
+		res sql.Result
+	)
+
+	formatError := func(err error) error {
+		return fmt.Errorf("registrations.request: %v", err)
+	}
+
+	if err = registration.Validate(); err != nil {
+		return false, formatError(err)
+	}
+
+	max := registrations.Controller.Options.RegistrationMax
+
+	registrations.mutex.Lock()
+
+	pending := uint(0)
+	for _, r := range registrations.List {
+		if r.Status != RegistrationStatusPending {
+			continue
+		}
+		if r.Email == registration.Email {
+			registrations.mutex.Unlock()
+			return false, nil
+		}
+		pending++
+	}
+
+	if max > 0 && pending >= max {
+		registrations.mutex.Unlock()
+		return false, errRegistrationsFull
+	}
+
+	// listed before it is inserted so that a concurrent request of the same
+	// email is seen as pending
+	registrations.List = append(registrations.List, registration)
+
+	registrations.mutex.Unlock()
+
+	res, err = db.Sql.Exec("insert into `rdioScannerRegistrations` (`createdAt`, `email`, `ident`, `ip`, `message`, `status`) values (?, ?, ?, ?, ?, ?)", registration.CreatedAt, registration.Email, registration.Ident, registration.Ip, registration.Message, registration.Status)
+	if err == nil {
+		id, err = res.LastInsertId()
+	}
+
+	registrations.mutex.Lock()
+	defer registrations.mutex.Unlock()
+
+	if err != nil {
+		for i, r := range registrations.List {
+			if r == registration {
+				registrations.List = append(registrations.List[:i], registrations.List[i+1:]...)
+				break
+			}
+		}
+		return false, formatError(err)
+	}
+
+	registration.Id = uint(id)
+
+	return true, nil
+}
+
+// setStatus changes the status of the registration when it is the from
+// status, any status when from is empty.
+func (registrations *Registrations) setStatus(id uint, from string, to string) (*Registration, error) {
+	registrations.mutex.Lock()
+	defer registrations.mutex.Unlock()
+
+	for _, registration := range registrations.List {
+		if registration.Id != id {
+			continue
+		}
+
+		if len(from) > 0 && registration.Status != from {
+			return nil, errRegistrationDecided
+		}
+
+		registration.Status = to
+		if to == RegistrationStatusPending {
+			registration.DecidedAt = nil
+		} else {
+			registration.DecidedAt = time.Now().UTC()
+		}
+
+		r := *registration
+		return &r, nil
+	}
+
+	return nil, nil
+}
+
+// newRegistrationCode returns a random numeric access code, easy to type on
+// a phone, not used by another access.
+func newRegistrationCode(accesses *Accesses) (string, error) {
+	for {
+		b := make([]byte, registrationCodeLength)
+		for i := range b {
+			n, err := rand.Int(rand.Reader, big.NewInt(10))
+			if err != nil {
+				return "", err
+			}
+			b[i] = byte('0' + n.Int64())
+		}
+
+		if _, ok := accesses.GetAccess(string(b)); !ok {
+			return string(b), nil
+		}
+	}
+}
+
+// notify emails the registration to the admins listed in the registration
+// email, or to the admin email.
+func (registrations *Registrations) notify(registration *Registration) {
+	var (
+		mailer  = registrations.Controller.Mailer
+		options = registrations.Controller.Options
+	)
+
+	to := mailer.Recipients(options.RegistrationEmail)
+	if len(to) == 0 && len(options.AdminEmail) > 0 {
+		to = []string{options.AdminEmail}
+	}
+
+	if len(to) == 0 || !mailer.Available(options.RegistrationEmail) {
+		return
+	}
+
+	text := fmt.Sprintf("%s <%s> requested an access from ip %s.\n\n%s", registration.Ident, registration.Email, registration.Ip, registration.Message)
+
+	if err := mailer.Send(options.RegistrationEmail, to, "Rdio Scanner access request", text); err != nil {
+		registrations.Controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("registrations.notify: %v", err))
+	}
+}
+
+// RegistrationHandler takes the access requests of the listeners. It is
+// throttled per ip like the access codes, in the bucket of its own kind.
+func (registrations *Registrations) RegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	controller := registrations.Controller
+
+	switch r.Method {
+	case http.MethodGet:
+		if b, err := json.Marshal(map[string]any{"enabled": controller.Options.Registration}); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+
+	case http.MethodPost:
+		if !controller.Options.Registration {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		remoteAddr := GetRemoteAddr(r)
+
+		if ok, wait := controller.Logins.Allow(LoginKindRegistration, remoteAddr); !ok {
+			loginRetryAfter(w, wait)
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		m := map[string]any{}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&m); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		registration := (&Registration{Ip: remoteAddr}).FromMap(m)
+
+		added, err := registrations.Request(registration, controller.Database)
+		if err != nil {
+			if errors.Is(err, errRegistrationsFull) {
+				controller.Logs.LogEvent(LogLevelWarn, err.Error())
+				w.WriteHeader(http.StatusServiceUnavailable)
+			} else if registration.Validate() != nil {
+				if locked, until := controller.Logins.Fail(LoginKindRegistration, remoteAddr); locked {
+					controller.Logs.LogEvent(LogLevelWarn, loginLockedMessage(LoginKindRegistration, remoteAddr, until))
+				}
+				w.WriteHeader(http.StatusBadRequest)
+			} else {
+				controller.Logs.LogEvent(LogLevelError, err.Error())
+				w.WriteHeader(http.StatusExpectationFailed)
+			}
+			return
+		}
+
+		if added {
+			controller.Logs.LogEvent(LogLevelInfo, fmt.Sprintf("registration: access requested by %s from ip %s", registration.Email, remoteAddr))
+			go registrations.notify(registration)
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// RegistrationsHandler lists the registrations to the admin, who approves
+// or denies them. The body of an approval is the access to give, with the
+// systems, tier, expiration and limit as for the access codes.
+func (admin *Admin) RegistrationsHandler(w http.ResponseWriter, r *http.Request) {
+	if !admin.Authorize(w, r, adminWriteRole(r)) {
+		return
+	}
+
+	controller := admin.Controller
+	logs := controller.Logs
+
+	writeJson := func(v any) {
+		if b, err := json.Marshal(v); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJson(controller.Registrations.GetList())
+
+	case http.MethodPost:
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil || id < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		m := map[string]any{}
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil && err != io.EOF {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var status string
+		switch r.URL.Query().Get("action") {
+		case "approve":
+			status = RegistrationStatusApproved
+		case "deny":
+			status = RegistrationStatusDenied
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		registration, err := controller.Registrations.Decide(uint(id), status, controller.Database)
+		if errors.Is(err, errRegistrationDecided) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		} else if err != nil {
+			logs.LogEvent(LogLevelError, err.Error())
+			w.WriteHeader(http.StatusExpectationFailed)
+			return
+		} else if registration == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		logs.LogEvent(LogLevelWarn, fmt.Sprintf("registration: %s %s by admin from ip %s", registration.Email, status, GetRemoteAddr(r)))
+
+		p := map[string]any{"registration": registration}
+
+		var subject, text string
+
+		if status == RegistrationStatusApproved {
+			access, err := admin.registrationAccess(registration, m)
+			if err != nil {
+				logs.LogEvent(LogLevelError, fmt.Sprintf("admin.registrationshandler: %v", err))
+				if err := controller.Registrations.Reopen(uint(id), controller.Database); err != nil {
+					logs.LogEvent(LogLevelError, err.Error())
+				}
+				w.WriteHeader(http.StatusExpectationFailed)
+				return
+			}
+
+			p["code"] = access.Code
+
+			subject = "Rdio Scanner access"
+			text = fmt.Sprintf("Your access request was approved.\n\nYour access code is %s\n\n%s/", access.Code, requestBaseUrl(r))
+
+		} else {
+			subject = "Rdio Scanner access request"
+			text = "Your access request was denied."
+		}
+
+		// the email is sent after the decision is saved, without any lock
+		emailed := false
+		if target := controller.Options.RegistrationEmail; controller.Mailer.Available(target) {
+			if err := controller.Mailer.Send(target, []string{registration.Email}, subject, text); err == nil {
+				emailed = true
+			} else {
+				logs.LogEvent(LogLevelError, fmt.Sprintf("admin.registrationshandler: %v", err))
+			}
+		}
+		p["emailed"] = emailed
+
+		writeJson(p)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// registrationAccess adds the access code of an approved registration.
+func (admin *Admin) registrationAccess(registration *Registration, m map[string]any) (*Access, error) {
+	accesses := admin.Controller.Accesses
+
+	code, err := newRegistrationCode(accesses)
+	if err != nil {
+		return nil, err
+	}
+
+	access := NewAccess().FromMap(m)
+	access.Id = nil
+	access.Code = code
+	access.Ident = registration.Email
+
+	accesses.Add(access)
+
+	if err = accesses.Write(admin.Controller.Database); err != nil {
+		accesses.Read(admin.Controller.Database)
+		return nil, err
+	}
+
+	if err = accesses.Read(admin.Controller.Database); err != nil {
+		return nil, err
+	}
+
+	admin.BroadcastConfig()
+
+	return access, nil
+}
+
+// truncateRunes cuts the string to at most max runes.
+func truncateRunes(s string, max int) string {
+	if r := []rune(s); len(r) > max {
+		return string(r[:max])
+	}
+
+	return s
+}
@@ -0,0 +1,265 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestRegistrations(t *testing.T) *Registrations {
+	t.Helper()
+
+	controller := newTestController(t, &Config{LoginBurst: 3, LoginMaxFailures: 5, LoginRate: 1})
+	controller.Options.Registration = true
+	controller.Options.RegistrationMax = 2
+
+	return controller.Registrations
+}
+
+func TestRegistrationValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		email string
+		ok    bool
+	}{
+		{"address", "someone@example.com", true},
+		{"uppercase", "Someone@Example.com", true},
+		{"empty", "", false},
+		{"no domain", "someone", false},
+		{"display name", "Someone <someone@example.com>", false},
+		{"two addresses", "a@example.com, b@example.com", false},
+		{"header injection", "someone@example.com\r\nBcc: other@example.com", false},
+		{"too long", strings.Repeat("a", 250) + "@example.com", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registration := (&Registration{}).FromMap(map[string]any{"email": test.email})
+
+			if err := registration.Validate(); (err == nil) != test.ok {
+				t.Errorf("Validate(%q) = %v, want ok %v", test.email, err, test.ok)
+			}
+		})
+	}
+}
+
+func TestRegistrationsRequest(t *testing.T) {
+	registrations := newTestRegistrations(t)
+	db := registrations.Controller.Database
+
+	request := func(email string) (bool, error) {
+		return registrations.Request((&Registration{Ip: "127.0.0.1"}).FromMap(map[string]any{"email": email}), db)
+	}
+
+	if added, err := request("a@example.com"); !added || err != nil {
+		t.Fatalf("first request: %v, %v", added, err)
+	}
+
+	if added, err := request("A@example.com"); added || err != nil {
+		t.Errorf("pending email: %v, %v, want quietly ignored", added, err)
+	}
+
+	if added, err := request("b@example.com"); !added || err != nil {
+		t.Fatalf("second email: %v, %v", added, err)
+	}
+
+	if _, err := request("c@example.com"); !errors.Is(err, errRegistrationsFull) {
+		t.Errorf("over the max: %v, want %v", err, errRegistrationsFull)
+	}
+
+	if _, err := registrations.Decide(1, RegistrationStatusDenied, db); err != nil {
+		t.Fatal(err)
+	}
+
+	// a decided registration neither counts as pending nor blocks the email
+	if added, err := request("a@example.com"); !added || err != nil {
+		t.Errorf("request after a denial: %v, %v", added, err)
+	}
+
+	if err := registrations.Read(db); err != nil {
+		t.Fatal(err)
+	}
+
+	got := []string{}
+	for _, registration := range registrations.GetList() {
+		got = append(got, registration.Email+" "+registration.Status)
+	}
+
+	want := []string{"a@example.com denied", "b@example.com pending", "a@example.com pending"}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestRegistrationsDecide(t *testing.T) {
+	registrations := newTestRegistrations(t)
+	db := registrations.Controller.Database
+
+	registrations.Request((&Registration{Ip: "127.0.0.1"}).FromMap(map[string]any{"email": "a@example.com"}), db)
+
+	if _, err := registrations.Decide(1, "maybe", db); err == nil {
+		t.Error("invalid status accepted")
+	}
+
+	if registration, err := registrations.Decide(9, RegistrationStatusApproved, db); registration != nil || err != nil {
+		t.Errorf("unknown id: %v, %v", registration, err)
+	}
+
+	if registration, err := registrations.Decide(1, RegistrationStatusApproved, db); err != nil || registration.Status != RegistrationStatusApproved || registration.DecidedAt == nil {
+		t.Fatalf("approve: %+v, %v", registration, err)
+	}
+
+	if _, err := registrations.Decide(1, RegistrationStatusDenied, db); !errors.Is(err, errRegistrationDecided) {
+		t.Errorf("decided twice: %v, want %v", err, errRegistrationDecided)
+	}
+
+	if err := registrations.Reopen(1, db); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := registrations.Read(db); err != nil {
+		t.Fatal(err)
+	}
+
+	if l := registrations.GetList(); len(l) != 1 || l[0].Status != RegistrationStatusPending || l[0].DecidedAt != nil {
+		t.Errorf("reopened registration: %+v", l[0])
+	}
+}
+
+func TestRegistrationHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		disabled bool
+		body     string
+		status   int
+	}{
+		{"disabled", true, `{"email":"a@example.com"}`, http.StatusNotFound},
+		{"invalid body", false, `{`, http.StatusBadRequest},
+		{"invalid email", false, `{"email":"someone"}`, http.StatusBadRequest},
+		{"valid", false, `{"email":"a@example.com","name":"Someone","message":"volunteer firefighter"}`, http.StatusAccepted},
+		{"throttled", false, `{"email":"b@example.com"}`, http.StatusTooManyRequests},
+	}
+
+	registrations := newTestRegistrations(t)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registrations.Controller.Options.Registration = !test.disabled
+
+			r := httptest.NewRequest(http.MethodPost, "/api/registration", strings.NewReader(test.body))
+			w := httptest.NewRecorder()
+
+			registrations.RegistrationHandler(w, r)
+
+			if w.Code != test.status {
+				t.Errorf("status %d, want %d", w.Code, test.status)
+			}
+		})
+	}
+}
+
+func TestAdminRegistrationsHandler(t *testing.T) {
+	registrations := newTestRegistrations(t)
+	controller := registrations.Controller
+	db := controller.Database
+
+	admin := controller.Admin
+
+	viewer, err := admin.NewOidcToken("someone", AdminRoleViewer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	editor, err := admin.NewOidcToken("someone", AdminRoleConfigEditor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	controller.Accesses.Add(&Access{Code: "1234", Ident: "existing", Systems: "*"})
+	if err := controller.Accesses.Write(db); err != nil {
+		t.Fatal(err)
+	}
+	controller.Accesses.Read(db)
+
+	registrations.Request((&Registration{Ip: "127.0.0.1"}).FromMap(map[string]any{"email": "a@example.com"}), db)
+	registrations.Request((&Registration{Ip: "127.0.0.1"}).FromMap(map[string]any{"email": "b@example.com"}), db)
+
+	tests := []struct {
+		name   string
+		token  string
+		query  string
+		body   string
+		status int
+	}{
+		{"no token", "", "?id=1&action=approve", "", http.StatusUnauthorized},
+		{"viewer", viewer, "?id=1&action=approve", "", http.StatusForbidden},
+		{"invalid id", editor, "?id=a&action=approve", "", http.StatusBadRequest},
+		{"invalid action", editor, "?id=1&action=ignore", "", http.StatusBadRequest},
+		{"unknown id", editor, "?id=9&action=approve", "", http.StatusNotFound},
+		{"approve", editor, "?id=1&action=approve", `{"systems":[{"id":1,"talkgroups":"*"}],"tier":"gold"}`, http.StatusOK},
+		{"approve again", editor, "?id=1&action=approve", "", http.StatusConflict},
+		{"deny", editor, "?id=2&action=deny", "", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/admin/registrations"+test.query, strings.NewReader(test.body))
+			if len(test.token) > 0 {
+				r.Header.Set("Authorization", test.token)
+			}
+
+			w := httptest.NewRecorder()
+			admin.RegistrationsHandler(w, r)
+
+			if w.Code != test.status {
+				t.Errorf("status %d, want %d", w.Code, test.status)
+			}
+		})
+	}
+
+	access, ok := controller.Accesses.GetIdentAccess("a@example.com", &Call{System: 1, Talkgroup: 1})
+	if !ok {
+		t.Fatal("no access for the approved registration")
+	}
+
+	if len(access.Code) != registrationCodeLength || access.Code == "1234" || access.Tier != "gold" {
+		t.Errorf("access %+v", access)
+	}
+
+	if _, ok := controller.Accesses.GetIdentAccess("b@example.com", &Call{System: 1, Talkgroup: 1}); ok {
+		t.Error("access for the denied registration")
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/admin/registrations", nil)
+	r.Header.Set("Authorization", viewer)
+
+	w := httptest.NewRecorder()
+	admin.RegistrationsHandler(w, r)
+
+	l := []*Registration{}
+	if err := json.Unmarshal(w.Body.Bytes(), &l); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(l) != 2 || l[0].Status != RegistrationStatusApproved || l[1].Status != RegistrationStatusDenied {
+		t.Errorf("listed %+v", l)
+	}
+}
@@ -0,0 +1,795 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ReplicationKindCall      = "call"
+	ReplicationKindConfig    = "config"
+	ReplicationKindHeartbeat = "heartbeat"
+
+	ReplicationModePrimary  = "primary"
+	ReplicationModePromoted = "promoted"
+	ReplicationModeStandby  = "standby"
+)
+
+const (
+	replicationBatch        = 100
+	replicationConfigPoll   = 10 * time.Second
+	replicationHeartbeat    = 15 * time.Second
+	replicationKeyMinLength = 32
+	replicationPoll         = time.Second
+	replicationPromotedKey  = "replicationPromoted"
+	replicationRetryMax     = time.Minute
+
+	// the standby reconnects when nothing came from the primary for that
+	// long, a few heartbeats being missed
+	replicationTimeout = 3 * replicationHeartbeat
+)
+
+var ErrReplicationNotStandby = errors.New("not a standby")
+
+// ReplicationCall is a call as streamed to the standby, with its id and
+// its audio, the audio store of the primary being out of reach.
+type ReplicationCall struct {
+	Id          uint              `json:"id"`
+	Audio       []byte            `json:"audio"`
+	AudioName   any               `json:"audioName,omitempty"`
+	AudioType   any               `json:"audioType,omitempty"`
+	DateTime    time.Time         `json:"dateTime"`
+	Duration    int64             `json:"duration,omitempty"`
+	Emergency   bool              `json:"emergency,omitempty"`
+	Encrypted   bool              `json:"encrypted,omitempty"`
+	Frequencies []map[string]any  `json:"frequencies,omitempty"`
+	Frequency   any               `json:"frequency,omitempty"`
+	Latitude    any               `json:"latitude,omitempty"`
+	Longitude   any               `json:"longitude,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Mode        string            `json:"mode,omitempty"`
+	Patches     []uint            `json:"patches,omitempty"`
+	Priority    uint              `json:"priority,omitempty"`
+	Site        uint              `json:"site,omitempty"`
+	Source      any               `json:"source,omitempty"`
+	Sources     []map[string]any  `json:"sources,omitempty"`
+	System      uint              `json:"system"`
+	Talkgroup   uint              `json:"talkgroup"`
+	Transcript  string            `json:"transcript,omitempty"`
+	Uuid        string            `json:"uuid"`
+}
+
+func NewReplicationCall(id uint, call *Call) *ReplicationCall {
+	replicationCall := &ReplicationCall{
+		Id:        id,
+		Audio:     call.Audio,
+		AudioName: call.AudioName,
+		AudioType: call.AudioType,
+		DateTime:  call.DateTime,
+		Duration:  call.Duration.Milliseconds(),
+		Emergency: call.Emergency,
+		Encrypted: call.Encrypted,
+		Frequency: call.Frequency,
+		Latitude:  call.Latitude,
+		Longitude: call.Longitude,
+		Metadata:  call.Metadata,
+		Mode:      call.Mode,
+		Priority:  call.Priority,
+		Site:      call.Site,
+		Source:    call.Source,
+		System:    call.System,
+		Talkgroup: call.Talkgroup,
+		Uuid:      call.Uuid,
+	}
+
+	// the lists are read back from the database as []any, they are given
+	// the types the calls are written with
+	for _, f := range []struct {
+		dst any
+		src any
+	}{
+		{&replicationCall.Frequencies, call.Frequencies},
+		{&replicationCall.Patches, call.Patches},
+		{&replicationCall.Sources, call.Sources},
+	} {
+		if b, err := json.Marshal(f.src); err == nil {
+			json.Unmarshal(b, f.dst)
+		}
+	}
+
+	switch v := call.Transcript.(type) {
+	case string:
+		replicationCall.Transcript = v
+	}
+
+	return replicationCall
+}
+
+// Call returns the call to be written, of the id of the primary.
+func (replicationCall *ReplicationCall) Call() *Call {
+	call := NewCall()
+
+	call.Id = replicationCall.Id
+	call.Audio = replicationCall.Audio
+	call.AudioName = replicationCall.AudioName
+	call.AudioType = replicationCall.AudioType
+	call.DateTime = replicationCall.DateTime
+	call.Duration = time.Duration(replicationCall.Duration) * time.Millisecond
+	call.Emergency = replicationCall.Emergency
+	call.Encrypted = replicationCall.Encrypted
+	call.Frequency = replicationCall.Frequency
+	call.Latitude = replicationCall.Latitude
+	call.Longitude = replicationCall.Longitude
+	call.Metadata = replicationCall.Metadata
+	call.Mode = replicationCall.Mode
+	call.Priority = replicationCall.Priority
+	call.Site = replicationCall.Site
+	call.Source = replicationCall.Source
+	call.System = replicationCall.System
+	call.Talkgroup = replicationCall.Talkgroup
+	call.Uuid = replicationCall.Uuid
+
+	if replicationCall.Frequencies != nil {
+		call.Frequencies = replicationCall.Frequencies
+	}
+
+	if replicationCall.Patches != nil {
+		call.Patches = replicationCall.Patches
+	}
+
+	if replicationCall.Sources != nil {
+		call.Sources = replicationCall.Sources
+	}
+
+	if len(replicationCall.Transcript) > 0 {
+		call.Transcript = replicationCall.Transcript
+	}
+
+	return call
+}
+
+// ReplicationMessage is a line of the replication stream: the configuration
+// bundle when it changes, a call, or a heartbeat with the last call id of
+// the primary.
+type ReplicationMessage struct {
+	Kind   string           `json:"kind"`
+	Call   *ReplicationCall `json:"call,omitempty"`
+	Config *ConfigBundle    `json:"config,omitempty"`
+	Digest string           `json:"digest,omitempty"`
+	LastId uint             `json:"lastId,omitempty"`
+}
+
+type ReplicationStatus struct {
+	Connected   bool       `json:"connected"`
+	Error       string     `json:"error,omitempty"`
+	Lag         uint       `json:"lag"`
+	LastCallId  uint       `json:"lastCallId"`
+	LastMessage *time.Time `json:"lastMessage,omitempty"`
+	Mode        string     `json:"mode"`
+	Primary     string     `json:"primary,omitempty"`
+	Standbys    int        `json:"standbys"`
+}
+
+// Replication streams the configuration and the calls of a primary to its
+// standby, of which the standby_of setting is the url of the primary, both
+// sharing the replication_key setting. The standby keeps the ids of the
+// calls of the primary and resumes from its last call. It takes no upload
+// and runs no dirwatch until it is promoted, by the admin or with the
+// -promote flag, after which it stops following the primary for good.
+type Replication struct {
+	Controller *Controller
+	cancel     context.CancelFunc
+	digest     string
+	promoted   bool
+	status     ReplicationStatus
+	mutex      sync.Mutex
+}
+
+func NewReplication(controller *Controller) *Replication {
+	return &Replication{Controller: controller}
+}
+
+// Promote turns the standby into a primary.
+func (replication *Replication) Promote(author string) error {
+	controller := replication.Controller
+
+	if !replication.Standby() {
+		return ErrReplicationNotStandby
+	}
+
+	if err := replicationPromote(controller.Database); err != nil {
+		return err
+	}
+
+	replication.mutex.Lock()
+	replication.promoted = true
+	replication.status.Connected = false
+	if replication.cancel != nil {
+		replication.cancel()
+		replication.cancel = nil
+	}
+	replication.mutex.Unlock()
+
+	controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("replication: promoted to primary by %s, %s no longer followed", author, controller.Config.StandbyOf))
+
+	if controller.running {
+		controller.Dirwatches.Start(controller)
+	}
+
+	return nil
+}
+
+// Standby tells if the server follows a primary.
+func (replication *Replication) Standby() bool {
+	replication.mutex.Lock()
+	defer replication.mutex.Unlock()
+
+	return len(replication.Controller.Config.StandbyOf) > 0 && !replication.promoted
+}
+
+func (replication *Replication) Start() error {
+	var (
+		controller = replication.Controller
+		s          string
+	)
+
+	if len(controller.Config.StandbyOf) == 0 {
+		return nil
+	}
+
+	err := controller.Database.Sql.QueryRow("select `val` from `rdioScannerConfigs` where `key` = ?", replicationPromotedKey).Scan(&s)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("replication.start: %v", err)
+	}
+
+	replication.mutex.Lock()
+	defer replication.mutex.Unlock()
+
+	if replication.promoted = s == "true"; replication.promoted {
+		controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("replication: promoted, %s not followed", controller.Config.StandbyOf))
+		return nil
+	}
+
+	if u, err := url.Parse(controller.Config.StandbyOf); err == nil && u.Scheme == "http" {
+		controller.Logs.LogEvent(LogLevelWarn, "replication: the primary is followed over http, the configuration, its access codes and its api keys included, is sent in clear")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	replication.cancel = cancel
+
+	go replication.follow(ctx)
+
+	return nil
+}
+
+// Status returns the state of the replication.
+func (replication *Replication) Status() ReplicationStatus {
+	replication.mutex.Lock()
+	defer replication.mutex.Unlock()
+
+	status := replication.status
+	status.Primary = replication.Controller.Config.StandbyOf
+
+	switch {
+	case len(status.Primary) == 0:
+		status.Mode = ReplicationModePrimary
+	case replication.promoted:
+		status.Mode = ReplicationModePromoted
+	default:
+		status.Mode = ReplicationModeStandby
+	}
+
+	return status
+}
+
+func (replication *Replication) Stop() {
+	replication.mutex.Lock()
+	defer replication.mutex.Unlock()
+
+	if replication.cancel != nil {
+		replication.cancel()
+		replication.cancel = nil
+	}
+}
+
+// follow receives the stream of the primary until the context is done,
+// reconnecting with a growing delay.
+func (replication *Replication) follow(ctx context.Context) {
+	const retryMin = time.Second
+
+	controller := replication.Controller
+
+	defer controller.Recover("replication.follow")
+
+	retry := retryMin
+
+	for {
+		received, err := replication.receive(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if received {
+			retry = retryMin
+		}
+
+		replication.mutex.Lock()
+		replication.status.Connected = false
+		if err != nil {
+			replication.status.Error = err.Error()
+		}
+		replication.mutex.Unlock()
+
+		if err != nil {
+			controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("replication: %v, retrying in %s", err, retry))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+
+		if retry *= 2; retry > replicationRetryMax {
+			retry = replicationRetryMax
+		}
+	}
+}
+
+// receive connects to the primary and applies its stream, telling if
+// anything was received.
+func (replication *Replication) receive(ctx context.Context) (bool, error) {
+	var (
+		controller = replication.Controller
+		received   bool
+	)
+
+	formatError := func(err error) error {
+		return fmt.Errorf("replication.receive: %v", err)
+	}
+
+	lastId, err := replicationLastId(controller.Database)
+	if err != nil {
+		return false, formatError(err)
+	}
+
+	replication.mutex.Lock()
+	digest := replication.digest
+	replication.status.LastCallId = lastId
+	replication.mutex.Unlock()
+
+	stream, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	watchdog := time.AfterFunc(replicationTimeout, cancel)
+	defer watchdog.Stop()
+
+	u := fmt.Sprintf("%s/api/replication?since=%d&digest=%s", strings.TrimSuffix(controller.Config.StandbyOf, "/"), lastId, url.QueryEscape(digest))
+
+	req, err := http.NewRequestWithContext(stream, http.MethodGet, u, nil)
+	if err != nil {
+		return false, formatError(err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+controller.Config.ReplicationKey)
+	req.Header.Set("User-Agent", fmt.Sprintf("rdio-scanner/%s", Version))
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, formatError(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return false, formatError(fmt.Errorf("primary answered %s", res.Status))
+	}
+
+	replication.mutex.Lock()
+	replication.status.Connected = true
+	replication.status.Error = ""
+	replication.mutex.Unlock()
+
+	decoder := json.NewDecoder(res.Body)
+
+	for {
+		message := &ReplicationMessage{}
+
+		if err := decoder.Decode(message); err != nil {
+			if ctx.Err() == nil && stream.Err() != nil {
+				return received, formatError(fmt.Errorf("nothing received from the primary for %s", replicationTimeout))
+			}
+			return received, formatError(err)
+		}
+
+		watchdog.Reset(replicationTimeout)
+
+		received = true
+
+		if err := replication.apply(message); err != nil {
+			return received, formatError(err)
+		}
+	}
+}
+
+// apply writes a message of the stream of the primary.
+func (replication *Replication) apply(message *ReplicationMessage) error {
+	var (
+		controller = replication.Controller
+		db         = controller.Database
+		now        = time.Now()
+	)
+
+	switch message.Kind {
+	case ReplicationKindCall:
+		if message.Call == nil || message.Call.Id == 0 {
+			return errors.New("call without id")
+		}
+
+		var count uint
+		if err := db.Sql.QueryRow("select count(*) from `rdioScannerCalls` where `id` = ?", message.Call.Id).Scan(&count); err != nil {
+			return err
+		}
+
+		if count == 0 {
+			call := message.Call.Call()
+
+			if _, err := controller.Calls.WriteCall(call, db); err != nil {
+				return err
+			}
+
+			if len(message.Call.Transcript) > 0 {
+				if err := controller.Calls.WriteTranscript(message.Call.Id, message.Call.Transcript, db); err != nil {
+					return err
+				}
+			}
+
+			if err := controller.SearchIndex.Write(call); err != nil {
+				controller.Logs.LogEvent(LogLevelError, err.Error())
+			}
+		}
+
+		replication.mutex.Lock()
+		replication.status.LastCallId = message.Call.Id
+		if replication.status.Lag > 0 {
+			replication.status.Lag--
+		}
+		replication.mutex.Unlock()
+
+	case ReplicationKindConfig:
+		if message.Config == nil {
+			return errors.New("config without bundle")
+		}
+
+		if _, err := controller.Admin.ImportConfig(message.Config, "replication"); err != nil {
+			return err
+		}
+
+		replication.mutex.Lock()
+		replication.digest = message.Digest
+		replication.mutex.Unlock()
+
+		controller.Logs.LogEvent(LogLevelInfo, fmt.Sprintf("replication: configuration of %s applied", controller.Config.StandbyOf))
+
+	case ReplicationKindHeartbeat:
+		replication.mutex.Lock()
+		if message.LastId > replication.status.LastCallId {
+			replication.status.Lag = message.LastId - replication.status.LastCallId
+		} else {
+			replication.status.Lag = 0
+		}
+		replication.mutex.Unlock()
+	}
+
+	replication.mutex.Lock()
+	replication.status.LastMessage = &now
+	replication.mutex.Unlock()
+
+	return nil
+}
+
+// ReplicationHandler streams to a standby the calls after the since query,
+// and the configuration bundle when its digest differs from the digest
+// query, as json lines, with a heartbeat every 15 seconds. It needs the
+// replication key as a bearer token.
+func (api *Api) ReplicationHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		controller  = api.Controller
+		db          = controller.Database
+		digest      = r.URL.Query().Get("digest")
+		replication = controller.Replication
+		remoteAddr  = GetRemoteAddr(r)
+		since       uint
+	)
+
+	if len(controller.Config.ReplicationKey) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if ok, wait := controller.Logins.Allow(LoginKindReplication, remoteAddr); !ok {
+		loginRetryAfter(w, wait)
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(key), []byte(controller.Config.ReplicationKey)) != 1 {
+		if locked, until := controller.Logins.Fail(LoginKindReplication, remoteAddr); locked {
+			controller.Logs.LogEvent(LogLevelWarn, loginLockedMessage(LoginKindReplication, remoteAddr, until))
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	controller.Logins.Succeed(LoginKindReplication, remoteAddr)
+
+	if s := r.URL.Query().Get("since"); len(s) > 0 {
+		i, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		since = uint(i)
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	clearReadDeadline(r)
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	replication.mutex.Lock()
+	replication.status.Standbys++
+	replication.mutex.Unlock()
+
+	controller.Logs.LogEvent(LogLevelInfo, fmt.Sprintf("replication: standby %s connected, from call %d", remoteAddr, since))
+
+	defer func() {
+		replication.mutex.Lock()
+		replication.status.Standbys--
+		replication.mutex.Unlock()
+
+		controller.Logs.LogEvent(LogLevelInfo, fmt.Sprintf("replication: standby %s disconnected", remoteAddr))
+	}()
+
+	var (
+		configCheck time.Time
+		encoder     = json.NewEncoder(w)
+		lastSent    = time.Now()
+		ticker      = time.NewTicker(replicationPoll)
+	)
+
+	defer ticker.Stop()
+
+	lastId, err := replicationLastId(db)
+	if err != nil {
+		controller.Logs.LogEvent(LogLevelError, err.Error())
+		return
+	}
+
+	send := func(message *ReplicationMessage) bool {
+		extendWriteDeadline(r, replicationTimeout)
+
+		if err := encoder.Encode(message); err != nil {
+			return false
+		}
+
+		flusher.Flush()
+
+		lastSent = time.Now()
+
+		return true
+	}
+
+	// the standby learns how many calls it is behind
+	if !send(&ReplicationMessage{Kind: ReplicationKindHeartbeat, LastId: lastId}) {
+		return
+	}
+
+	for {
+		if time.Since(configCheck) >= replicationConfigPoll {
+			configCheck = time.Now()
+
+			bundle, err := controller.Admin.ExportConfig(nil)
+			if err != nil {
+				controller.Logs.LogEvent(LogLevelError, err.Error())
+				return
+			}
+
+			if d := replicationDigest(bundle); d != digest {
+				if !send(&ReplicationMessage{Kind: ReplicationKindConfig, Config: bundle, Digest: d}) {
+					return
+				}
+				digest = d
+			}
+		}
+
+		ids, err := replicationCallIds(db, since)
+		if err != nil {
+			controller.Logs.LogEvent(LogLevelError, err.Error())
+			return
+		}
+
+		for _, id := range ids {
+			call, err := controller.Calls.GetCall(id, db)
+			if err == ErrCallNotFound {
+				continue
+			} else if err != nil {
+				controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("replication: %v", err))
+				return
+			}
+
+			if !send(&ReplicationMessage{Kind: ReplicationKindCall, Call: NewReplicationCall(id, call)}) {
+				return
+			}
+
+			since = id
+		}
+
+		// a full batch is followed by the next one at once
+		if len(ids) == replicationBatch {
+			continue
+		}
+
+		if time.Since(lastSent) >= replicationHeartbeat {
+			if !send(&ReplicationMessage{Kind: ReplicationKindHeartbeat, LastId: since}) {
+				return
+			}
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ReplicationHandler returns the state of the replication on GET, and
+// promotes the standby on a POST of {"promote": true}.
+func (admin *Admin) ReplicationHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		logs        = admin.Controller.Logs
+		replication = admin.Controller.Replication
+	)
+
+	writeStatus := func() {
+		if b, err := json.Marshal(replication.Status()); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if !admin.Authorize(w, r, AdminRoleViewer) {
+			return
+		}
+
+		writeStatus()
+
+	case http.MethodPost:
+		if !admin.Authorize(w, r, AdminRoleSuperadmin) {
+			return
+		}
+
+		m := map[string]any{}
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil || m["promote"] != true {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if err := replication.Promote(admin.author(r)); err == ErrReplicationNotStandby {
+			w.WriteHeader(http.StatusConflict)
+			return
+		} else if err != nil {
+			logs.LogEvent(LogLevelError, err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeStatus()
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// replicationCallIds returns the ids of the next batch of calls after since.
+func replicationCallIds(db *Database, since uint) ([]uint, error) {
+	ids := []uint{}
+
+	rows, err := db.Select("rdioScannerCalls", "id").Where(SqlWhere("`id` > ?", since)).OrderBy("id", false).Limit(replicationBatch).Query()
+	if err != nil {
+		return nil, fmt.Errorf("replication.callids: %v", err)
+	}
+
+	for rows.Next() {
+		var id uint
+		if err = rows.Scan(&id); err != nil {
+			break
+		}
+		ids = append(ids, id)
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return nil, fmt.Errorf("replication.callids: %v", err)
+	}
+
+	return ids, nil
+}
+
+// replicationLastId returns the id of the last call.
+func replicationLastId(db *Database) (uint, error) {
+	var id sql.NullInt64
+
+	if err := db.Sql.QueryRow("select max(`id`) from `rdioScannerCalls`").Scan(&id); err != nil {
+		return 0, fmt.Errorf("replication.lastid: %v", err)
+	}
+
+	return uint(id.Int64), nil
+}
+
+// replicationDigest is the digest of the configuration of a bundle, the
+// date of the bundle aside.
+func replicationDigest(bundle *ConfigBundle) string {
+	b, _ := json.Marshal(bundle.Config)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// replicationPromote records that the standby was promoted, so that it
+// doesn't follow the primary again on the next start.
+func replicationPromote(db *Database) error {
+	if _, err := db.Sql.Exec("delete from `rdioScannerConfigs` where `key` = ?", replicationPromotedKey); err != nil {
+		return fmt.Errorf("replication.promote: %v", err)
+	}
+
+	if _, err := db.Sql.Exec("insert into `rdioScannerConfigs` (`key`, `val`) values (?, ?)", replicationPromotedKey, "true"); err != nil {
+		return fmt.Errorf("replication.promote: %v", err)
+	}
+
+	return nil
+}
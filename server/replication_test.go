@@ -0,0 +1,246 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testReplicationKey = "0123456789abcdef0123456789abcdef"
+
+func newTestReplication(t *testing.T, standbyOf string) *Controller {
+	t.Helper()
+
+	controller := newTestController(t, &Config{ReplicationKey: testReplicationKey, StandbyOf: standbyOf})
+
+	t.Cleanup(controller.Replication.Stop)
+
+	return controller
+}
+
+func TestReplicationStream(t *testing.T) {
+	primary := newTestReplication(t, "")
+	primary.Tags.List = []*Tag{{Id: uint(1), Label: "Fire", MinDays: 30}}
+
+	written := []*Call{}
+	for i := 0; i < 3; i++ {
+		call := NewCall()
+		call.Audio = []byte{byte(i), 1, 2, 3}
+		call.AudioName = "call.m4a"
+		call.AudioType = "audio/mp4"
+		call.DateTime = time.Now().Add(time.Duration(i-3) * time.Minute).UTC().Truncate(time.Second)
+		call.Frequencies = []map[string]any{{"freq": float64(460025000), "pos": float64(0)}}
+		call.Patches = []uint{20}
+		call.Sources = []map[string]any{{"pos": float64(0), "src": float64(1234)}}
+		call.System = 1
+		call.Talkgroup = 10
+
+		id, err := primary.Calls.WriteCall(call, primary.Database)
+		if err != nil {
+			t.Fatal(err)
+		}
+		call.Id = id
+		written = append(written, call)
+	}
+
+	if err := primary.Calls.WriteTranscript(written[0].Id.(uint), "engine 4 respond", primary.Database); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(primary.Api.ReplicationHandler))
+	defer server.Close()
+
+	standby := newTestReplication(t, server.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		standby.Replication.receive(ctx)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for standby.Replication.Status().LastCallId < written[2].Id.(uint) && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	status := standby.Replication.Status()
+
+	cancel()
+	<-done
+
+	if status.Mode != ReplicationModeStandby || !status.Connected || status.Lag != 0 {
+		t.Errorf("status = %+v", status)
+	}
+
+	standby.Tags.mutex.Lock()
+	tags := standby.Tags.List
+	standby.Tags.mutex.Unlock()
+	if len(tags) != 1 || tags[0].Label != "Fire" || tags[0].MinDays != 30 {
+		t.Errorf("tags = %+v", tags)
+	}
+
+	for _, want := range written {
+		got, err := standby.Calls.GetCall(want.Id.(uint), standby.Database)
+		if err != nil {
+			t.Fatalf("call %v: %v", want.Id, err)
+		}
+
+		a, _ := json.Marshal(NewReplicationCall(want.Id.(uint), want))
+		b, _ := json.Marshal(NewReplicationCall(want.Id.(uint), got))
+		if want.Id == written[0].Id {
+			a = bytes.Replace(a, []byte(`"talkgroup":10,`), []byte(`"talkgroup":10,"transcript":"engine 4 respond",`), 1)
+		}
+		if !bytes.Equal(a, b) {
+			t.Errorf("call %v\n got %s\nwant %s", want.Id, b, a)
+		}
+	}
+}
+
+func TestReplicationHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		key    string
+		method string
+		token  string
+		target string
+		status int
+	}{
+		{"replication off", "", http.MethodGet, "Bearer " + testReplicationKey, "/api/replication", http.StatusNotFound},
+		{"post", testReplicationKey, http.MethodPost, "Bearer " + testReplicationKey, "/api/replication", http.StatusMethodNotAllowed},
+		{"no key", testReplicationKey, http.MethodGet, "", "/api/replication", http.StatusUnauthorized},
+		{"wrong key", testReplicationKey, http.MethodGet, "Bearer " + strings.Repeat("0", 32), "/api/replication", http.StatusUnauthorized},
+		{"bad since", testReplicationKey, http.MethodGet, "Bearer " + testReplicationKey, "/api/replication?since=last", http.StatusBadRequest},
+		{"stream", testReplicationKey, http.MethodGet, "Bearer " + testReplicationKey, "/api/replication?since=0", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			controller := newTestReplication(t, "")
+			controller.Config.ReplicationKey = test.key
+
+			server := httptest.NewServer(http.HandlerFunc(controller.Api.ReplicationHandler))
+			defer server.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			req, _ := http.NewRequestWithContext(ctx, test.method, server.URL+test.target, nil)
+			if len(test.token) > 0 {
+				req.Header.Set("Authorization", test.token)
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode != test.status {
+				t.Fatalf("status %d, want %d", res.StatusCode, test.status)
+			}
+
+			if res.StatusCode == http.StatusOK {
+				line, err := bufio.NewReader(res.Body).ReadBytes('\n')
+				message := &ReplicationMessage{}
+				if err != nil || json.Unmarshal(line, message) != nil || message.Kind != ReplicationKindHeartbeat {
+					t.Errorf("first line %q, %v", line, err)
+				}
+			}
+		})
+	}
+}
+
+func TestReplicationPromote(t *testing.T) {
+	// nothing listens on the primary, the standby keeps retrying
+	standby := newTestReplication(t, "http://127.0.0.1:1")
+
+	if err := standby.Replication.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	upload := httptest.NewRecorder()
+	standby.Api.CallUploadHandler(upload, httptest.NewRequest(http.MethodPost, "/api/call-upload", nil))
+	if upload.Code != http.StatusServiceUnavailable {
+		t.Errorf("upload status %d, want %d", upload.Code, http.StatusServiceUnavailable)
+	}
+
+	ready := httptest.NewRecorder()
+	standby.Health.ReadyzHandler(ready, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if ready.Code != http.StatusServiceUnavailable {
+		t.Errorf("readyz status %d, want %d", ready.Code, http.StatusServiceUnavailable)
+	}
+
+	token, err := standby.Admin.NewToken(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewer, err := standby.Admin.NewOidcToken("someone", AdminRoleViewer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		body   string
+		status int
+		mode   string
+	}{
+		{"status", http.MethodGet, viewer, "", http.StatusOK, ReplicationModeStandby},
+		{"viewer", http.MethodPost, viewer, `{"promote":true}`, http.StatusForbidden, ReplicationModeStandby},
+		{"no promote", http.MethodPost, token, `{}`, http.StatusBadRequest, ReplicationModeStandby},
+		{"promote", http.MethodPost, token, `{"promote":true}`, http.StatusOK, ReplicationModePromoted},
+		{"promoted already", http.MethodPost, token, `{"promote":true}`, http.StatusConflict, ReplicationModePromoted},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, "/api/admin/replication", strings.NewReader(test.body))
+			r.Header.Set("Authorization", test.token)
+
+			w := httptest.NewRecorder()
+			standby.Admin.ReplicationHandler(w, r)
+
+			if w.Code != test.status {
+				t.Errorf("status %d, want %d", w.Code, test.status)
+			}
+
+			if mode := standby.Replication.Status().Mode; mode != test.mode {
+				t.Errorf("mode %s, want %s", mode, test.mode)
+			}
+		})
+	}
+
+	// the promotion outlives a restart
+	restarted := NewReplication(standby)
+	if err := restarted.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if restarted.Standby() {
+		t.Error("standby again after a restart")
+	}
+}
@@ -0,0 +1,329 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Retention overrides the global pruneDays option for a whole system, or
+// for a single talkgroup when Talkgroup is set. Days of 0 keeps the calls
+// forever.
+type Retention struct {
+	Id        any  `json:"_id"`
+	Days      uint `json:"days"`
+	Order     any  `json:"order"`
+	System    uint `json:"system"`
+	Talkgroup any  `json:"talkgroup"`
+}
+
+func (retention *Retention) FromMap(m map[string]any) *Retention {
+	switch v := m["_id"].(type) {
+	case float64:
+		retention.Id = uint(v)
+	}
+
+	switch v := m["days"].(type) {
+	case float64:
+		retention.Days = uint(v)
+	}
+
+	switch v := m["order"].(type) {
+	case float64:
+		retention.Order = uint(v)
+	}
+
+	switch v := m["system"].(type) {
+	case float64:
+		retention.System = uint(v)
+	}
+
+	switch v := m["talkgroup"].(type) {
+	case float64:
+		retention.Talkgroup = uint(v)
+	}
+
+	return retention
+}
+
+type Retentions struct {
+	List  []*Retention
+	mutex sync.Mutex
+}
+
+func NewRetentions() *Retentions {
+	return &Retentions{
+		List:  []*Retention{},
+		mutex: sync.Mutex{},
+	}
+}
+
+func (retentions *Retentions) FromMap(f []any) *Retentions {
+	retentions.mutex.Lock()
+	defer retentions.mutex.Unlock()
+
+	retentions.List = []*Retention{}
+
+	for _, r := range f {
+		switch m := r.(type) {
+		case map[string]any:
+			retention := &Retention{}
+			retention.FromMap(m)
+			if retention.System > 0 {
+				retentions.List = append(retentions.List, retention)
+			}
+		}
+	}
+
+	return retentions
+}
+
+// RetentionPurge is the condition on the calls past their retention period
+// along with the rule which expires them.
+type RetentionPurge struct {
+	Reason string
+	Where  *SqlCondition
+}
+
+// Prune deletes the calls that are past their retention period, as listed
+// by Purges.
+func (retentions *Retentions) Prune(calls *Calls, db *Database, pruneDays uint) (count int64, size int64, err error) {
+	var (
+		c int64
+		s int64
+	)
+
+	for _, purge := range retentions.Purges(pruneDays, nil, time.Now()) {
+		if c, s, err = calls.PruneWhere(db, purge.Where); err != nil {
+			return count, size, err
+		}
+		count += c
+		size += s
+	}
+
+	return count, size, nil
+}
+
+// Purges returns the calls past their retention period, starting with the
+// talkgroup rules, then the system rules, and finally the global pruneDays
+// option for everything not covered by a rule. With retention policies, the
+// calls inside the minimum retention of their category are never purged,
+// and those past its maximum are purged whatever the rules.
+func (retentions *Retentions) Purges(pruneDays uint, policies []*RetentionPolicy, now time.Time) []*RetentionPurge {
+	var (
+		covered   = []*SqlCondition{}
+		protected = []*SqlCondition{}
+		purges    = []*RetentionPurge{}
+	)
+
+	retentions.mutex.Lock()
+	defer retentions.mutex.Unlock()
+
+	before := func(days uint) *SqlCondition {
+		return SqlWhere("`dateTime` < ?", now.Add(-24*time.Hour*time.Duration(days)))
+	}
+
+	for _, policy := range policies {
+		if policy.MinDays > 0 {
+			protected = append(protected, SqlAnd(policy.Where, SqlWhere("`dateTime` >= ?", now.Add(-24*time.Hour*time.Duration(policy.MinDays)))))
+		}
+	}
+
+	purge := func(reason string, where *SqlCondition) {
+		if len(protected) > 0 {
+			where = SqlAnd(where, SqlNot(SqlOr(protected...)))
+		}
+		purges = append(purges, &RetentionPurge{Reason: reason, Where: where})
+	}
+
+	talkgroupRules := map[uint][]uint{}
+
+	for _, retention := range retentions.List {
+		switch tg := retention.Talkgroup.(type) {
+		case uint:
+			talkgroupRules[retention.System] = append(talkgroupRules[retention.System], tg)
+
+			where := SqlAnd(SqlWhere("`system` = ?", retention.System), SqlWhere("`talkgroup` = ?", tg))
+			covered = append(covered, where)
+
+			if retention.Days > 0 {
+				purge(fmt.Sprintf("retention of %d days of talkgroup %d of system %d", retention.Days, tg, retention.System), SqlAnd(where, before(retention.Days)))
+			}
+		}
+	}
+
+	for _, retention := range retentions.List {
+		if retention.Talkgroup != nil {
+			continue
+		}
+
+		where := SqlWhere("`system` = ?", retention.System)
+		covered = append(covered, where)
+
+		if retention.Days == 0 {
+			continue
+		}
+
+		if l := talkgroupRules[retention.System]; len(l) > 0 {
+			where = SqlAnd(where, SqlNot(SqlIn("talkgroup", l)))
+		}
+
+		purge(fmt.Sprintf("retention of %d days of system %d", retention.Days, retention.System), SqlAnd(where, before(retention.Days)))
+	}
+
+	if pruneDays > 0 {
+		where := before(pruneDays)
+		if len(covered) > 0 {
+			where = SqlAnd(where, SqlNot(SqlOr(covered...)))
+		}
+
+		purge(fmt.Sprintf("prune days of %d", pruneDays), where)
+	}
+
+	for _, policy := range policies {
+		if policy.MaxDays > 0 {
+			purge(fmt.Sprintf("maximum retention of %d days of tag %s", policy.MaxDays, policy.Tag), SqlAnd(policy.Where, before(policy.MaxDays)))
+		}
+	}
+
+	return purges
+}
+
+func (retentions *Retentions) Read(db *Database) error {
+	var (
+		err       error
+		id        sql.NullFloat64
+		order     sql.NullFloat64
+		rows      *sql.Rows
+		talkgroup sql.NullFloat64
+	)
+
+	retentions.mutex.Lock()
+	defer retentions.mutex.Unlock()
+
+	retentions.List = []*Retention{}
+
+	formatError := func(err error) error {
+		return fmt.Errorf("retentions.read: %v", err)
+	}
+
+	if rows, err = db.Sql.Query("select `_id`, `days`, `order`, `systemId`, `talkgroupId` from `rdioScannerRetentions` order by `order`"); err != nil {
+		return formatError(err)
+	}
+
+	for rows.Next() {
+		retention := &Retention{}
+
+		if err = rows.Scan(&id, &retention.Days, &order, &retention.System, &talkgroup); err != nil {
+			break
+		}
+
+		if id.Valid && id.Float64 > 0 {
+			retention.Id = uint(id.Float64)
+		}
+
+		if order.Valid && order.Float64 > 0 {
+			retention.Order = uint(order.Float64)
+		}
+
+		if talkgroup.Valid && talkgroup.Float64 > 0 {
+			retention.Talkgroup = uint(talkgroup.Float64)
+		}
+
+		retentions.List = append(retentions.List, retention)
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	return nil
+}
+
+func (retentions *Retentions) Write(db *Database) error {
+	var (
+		count  uint
+		err    error
+		rows   *sql.Rows
+		rowIds = []uint{}
+	)
+
+	retentions.mutex.Lock()
+	defer retentions.mutex.Unlock()
+
+	formatError := func(err error) error {
+		return fmt.Errorf("retentions.write: %v", err)
+	}
+
+	if rows, err = db.Sql.Query("select `_id` from `rdioScannerRetentions`"); err != nil {
+		return formatError(err)
+	}
+
+	for rows.Next() {
+		var id uint
+		if err = rows.Scan(&id); err != nil {
+			break
+		}
+		remove := true
+		for _, retention := range retentions.List {
+			if retention.Id == nil || retention.Id == id {
+				remove = false
+				break
+			}
+		}
+		if remove {
+			rowIds = append(rowIds, id)
+		}
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	if len(rowIds) > 0 {
+		if _, err = db.Delete("rdioScannerRetentions").Where(SqlIn("_id", rowIds)).Exec(); err != nil {
+			return formatError(err)
+		}
+	}
+
+	for _, retention := range retentions.List {
+		if err = db.Sql.QueryRow("select count(*) from `rdioScannerRetentions` where `_id` = ?", retention.Id).Scan(&count); err != nil {
+			break
+		}
+
+		if count == 0 {
+			if _, err = db.Sql.Exec("insert into `rdioScannerRetentions` (`_id`, `days`, `order`, `systemId`, `talkgroupId`) values (?, ?, ?, ?, ?)", retention.Id, retention.Days, retention.Order, retention.System, retention.Talkgroup); err != nil {
+				break
+			}
+
+		} else if _, err = db.Sql.Exec("update `rdioScannerRetentions` set `days` = ?, `order` = ?, `systemId` = ?, `talkgroupId` = ? where `_id` = ?", retention.Days, retention.Order, retention.System, retention.Talkgroup, retention.Id); err != nil {
+			break
+		}
+	}
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	return nil
+}
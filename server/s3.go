@@ -0,0 +1,279 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+type S3AudioStore struct {
+	accessKey string
+	bucket    string
+	client    *http.Client
+	endpoint  *url.URL
+	pathStyle bool
+	prefix    string
+	region    string
+	secretKey string
+}
+
+func NewS3AudioStore(config *Config) (*S3AudioStore, error) {
+	const defaultRegion = "us-east-1"
+
+	formatError := func(err error) error {
+		return fmt.Errorf("s3: %v", err)
+	}
+
+	if len(config.S3Bucket) == 0 {
+		return nil, formatError(errors.New("no bucket"))
+	}
+
+	if len(config.S3Endpoint) == 0 {
+		return nil, formatError(errors.New("no endpoint"))
+	}
+
+	endpoint, err := url.Parse(config.S3Endpoint)
+	if err != nil {
+		return nil, formatError(err)
+	}
+
+	if len(endpoint.Scheme) == 0 || len(endpoint.Host) == 0 {
+		return nil, formatError(fmt.Errorf("invalid endpoint %s", config.S3Endpoint))
+	}
+
+	store := &S3AudioStore{
+		accessKey: config.S3AccessKey,
+		bucket:    config.S3Bucket,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		endpoint:  endpoint,
+		pathStyle: config.S3PathStyle,
+		prefix:    strings.Trim(config.S3Prefix, "/"),
+		region:    config.S3Region,
+		secretKey: config.S3SecretKey,
+	}
+
+	if len(store.region) == 0 {
+		store.region = defaultRegion
+	}
+
+	return store, nil
+}
+
+func (store *S3AudioStore) Delete(key string) error {
+	res, err := store.do(http.MethodDelete, key, nil, "")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound {
+		return store.responseError(res)
+	}
+
+	return nil
+}
+
+func (store *S3AudioStore) Get(key string) ([]byte, error) {
+	res, err := store.do(http.MethodGet, key, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, store.responseError(res)
+	}
+
+	return io.ReadAll(res.Body)
+}
+
+func (store *S3AudioStore) Put(key string, audio []byte, contentType string) error {
+	res, err := store.do(http.MethodPut, key, audio, contentType)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return store.responseError(res)
+	}
+
+	return nil
+}
+
+// PutFile uploads the file as it is read, without loading it, ie: an
+// archive, taking as long as it needs.
+func (store *S3AudioStore) PutFile(key string, file string, contentType string) error {
+	const timeout = time.Hour
+
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("s3: %v", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return fmt.Errorf("s3: %v", err)
+	}
+
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("s3: %v", err)
+	}
+
+	client := *store.client
+	client.Timeout = timeout
+
+	res, err := store.request(&client, http.MethodPut, key, io.NopCloser(f), size, hex.EncodeToString(h.Sum(nil)), contentType)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return store.responseError(res)
+	}
+
+	return nil
+}
+
+func (store *S3AudioStore) do(method string, key string, body []byte, contentType string) (*http.Response, error) {
+	payloadHash := sha256.Sum256(body)
+
+	return store.request(store.client, method, key, bytes.NewReader(body), int64(len(body)), hex.EncodeToString(payloadHash[:]), contentType)
+}
+
+// request sends the request with the body of the given length and sha256.
+func (store *S3AudioStore) request(client *http.Client, method string, key string, body io.Reader, length int64, payloadHash string, contentType string) (*http.Response, error) {
+	if len(store.prefix) > 0 {
+		key = store.prefix + "/" + key
+	}
+
+	u := *store.endpoint
+	if store.pathStyle {
+		u.Path = "/" + store.bucket + "/" + key
+	} else {
+		u.Host = store.bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawPath = s3EncodePath(u.Path)
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("s3: %v", err)
+	}
+
+	req.ContentLength = length
+
+	if len(contentType) > 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	store.sign(req, payloadHash, time.Now().UTC())
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3: %v", err)
+	}
+
+	return res, nil
+}
+
+func (store *S3AudioStore) responseError(res *http.Response) error {
+	b, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+
+	return fmt.Errorf("s3: %s %s, %s", res.Request.Method, res.Status, strings.TrimSpace(string(b)))
+}
+
+// sign adds an AWS signature version 4 to the request, which is understood
+// by AWS S3 as well as MinIO and most other S3-compatible services.
+func (store *S3AudioStore) sign(req *http.Request, payloadHash string, t time.Time) {
+	const algorithm = "AWS4-HMAC-SHA256"
+
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EncodePath(req.URL.Path),
+		"",
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + req.Header.Get("X-Amz-Content-Sha256"),
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+
+	scope := strings.Join([]string{date, store.region, "s3", "aws4_request"}, "/")
+
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+
+	stringToSign := strings.Join([]string{
+		algorithm,
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	key := s3Hmac([]byte("AWS4"+store.secretKey), date)
+	key = s3Hmac(key, store.region)
+	key = s3Hmac(key, "s3")
+	key = s3Hmac(key, "aws4_request")
+
+	signature := hex.EncodeToString(s3Hmac(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", algorithm, store.accessKey, scope, signedHeaders, signature))
+}
+
+func s3EncodePath(p string) string {
+	var b strings.Builder
+
+	for _, c := range []byte(p) {
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '.', c == '_', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+func s3Hmac(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,136 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var scheduleWindow = regexp.MustCompile(`^([a-z]{3}(?:-[a-z]{3})?)?\s*(?:(\d{1,2}):(\d{2})-(\d{1,2}):(\d{2}))?$`)
+
+// Schedule is a list of weekly time windows written as comma separated
+// "[day[-day]] [hh:mm-hh:mm]", ie: "mon-fri 18:00-08:00, sat, sun". A time
+// range ending before it starts runs past midnight and belongs to its start
+// day. The days are parsed as the day of week field of a cron, thus ranges
+// may wrap around the week. An empty schedule is always open.
+type Schedule []*ScheduleWindow
+
+type ScheduleWindow struct {
+	days  [7]bool
+	end   int
+	start int
+	times bool
+}
+
+func ParseSchedule(s string) (Schedule, error) {
+	schedule := Schedule{}
+
+	for _, f := range strings.Split(strings.ToLower(s), ",") {
+		f = strings.TrimSpace(f)
+
+		if len(f) == 0 {
+			continue
+		}
+
+		m := scheduleWindow.FindStringSubmatch(f)
+		if m == nil || (len(m[1]) == 0 && len(m[2]) == 0) {
+			return nil, fmt.Errorf("invalid schedule window %q", f)
+		}
+
+		window := &ScheduleWindow{}
+
+		days := "*"
+		if len(m[1]) > 0 {
+			days = m[1]
+		}
+
+		weekdays := [8]bool{}
+		if err := cronParseField(days, weekdays[:], 0, cronWeekdays); err != nil {
+			return nil, fmt.Errorf("invalid days %q, %v", days, err)
+		}
+
+		for d := range window.days {
+			window.days[d] = weekdays[d]
+		}
+		window.days[time.Sunday] = weekdays[0] || weekdays[7]
+
+		if len(m[2]) > 0 {
+			var err error
+
+			if window.start, err = scheduleMinutes(m[2], m[3]); err != nil {
+				return nil, err
+			}
+
+			if window.end, err = scheduleMinutes(m[4], m[5]); err != nil {
+				return nil, err
+			}
+
+			window.times = true
+		}
+
+		schedule = append(schedule, window)
+	}
+
+	return schedule, nil
+}
+
+// Contains tells if the time, in the server local time, falls in one of the
+// windows of the schedule.
+func (schedule Schedule) Contains(t time.Time) bool {
+	if len(schedule) == 0 {
+		return true
+	}
+
+	t = t.Local()
+
+	day := t.Weekday()
+	minutes := t.Hour()*60 + t.Minute()
+
+	for _, window := range schedule {
+		if window.Contains(day, minutes) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (window *ScheduleWindow) Contains(day time.Weekday, minutes int) bool {
+	if !window.times {
+		return window.days[day]
+	}
+
+	if window.start < window.end {
+		return window.days[day] && minutes >= window.start && minutes < window.end
+	}
+
+	return (window.days[day] && minutes >= window.start) || (window.days[(day+6)%7] && minutes < window.end)
+}
+
+func scheduleMinutes(hours string, minutes string) (int, error) {
+	h, _ := strconv.Atoi(hours)
+	m, _ := strconv.Atoi(minutes)
+
+	if h > 24 || m > 59 || (h == 24 && m > 0) {
+		return 0, fmt.Errorf("invalid time %s:%s", hours, minutes)
+	}
+
+	return h*60 + m, nil
+}
@@ -0,0 +1,69 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	// 2026-10-12 is a monday
+	at := func(day int, hour int, minute int) time.Time {
+		return time.Date(2026, 10, 12+day, hour, minute, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		name     string
+		schedule string
+		wantErr  bool
+		open     []time.Time
+		closed   []time.Time
+	}{
+		{name: "empty", schedule: "", open: []time.Time{at(0, 0, 0), at(6, 23, 59)}},
+		{name: "days", schedule: "mon-fri", open: []time.Time{at(0, 0, 0), at(4, 23, 59)}, closed: []time.Time{at(5, 12, 0), at(6, 12, 0)}},
+		{name: "single day", schedule: "Sun", open: []time.Time{at(6, 12, 0)}, closed: []time.Time{at(0, 12, 0)}},
+		{name: "days wrapping the week", schedule: "fri-mon", open: []time.Time{at(4, 1, 0), at(6, 1, 0), at(0, 1, 0)}, closed: []time.Time{at(1, 1, 0), at(3, 1, 0)}},
+		{name: "times", schedule: "08:00-17:30", open: []time.Time{at(2, 8, 0), at(2, 17, 29)}, closed: []time.Time{at(2, 7, 59), at(2, 17, 30)}},
+		{name: "past midnight", schedule: "fri 22:00-06:00", open: []time.Time{at(4, 23, 0), at(5, 5, 59)}, closed: []time.Time{at(5, 23, 0), at(4, 5, 0), at(5, 6, 0)}},
+		{name: "windows", schedule: "mon-fri 18:00-08:00, sat, sun", open: []time.Time{at(0, 19, 0), at(1, 7, 0), at(5, 12, 0)}, closed: []time.Time{at(0, 7, 0), at(1, 12, 0), at(4, 8, 0)}},
+		{name: "midnight end", schedule: "12:00-24:00", open: []time.Time{at(0, 23, 59)}, closed: []time.Time{at(0, 11, 59)}},
+		{name: "unknown day", schedule: "mon-xyz", wantErr: true},
+		{name: "numeric day", schedule: "1-5", wantErr: true},
+		{name: "bad time", schedule: "25:00-26:00", wantErr: true},
+		{name: "bad minutes", schedule: "08:60-09:00", wantErr: true},
+		{name: "garbage", schedule: "every day", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedule, err := ParseSchedule(test.schedule)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseSchedule(%q) error = %v, want error %v", test.schedule, err, test.wantErr)
+			}
+			for _, tm := range test.open {
+				if !schedule.Contains(tm) {
+					t.Errorf("%q is closed on %s", test.schedule, tm.Format("Mon 15:04"))
+				}
+			}
+			for _, tm := range test.closed {
+				if schedule.Contains(tm) {
+					t.Errorf("%q is open on %s", test.schedule, tm.Format("Mon 15:04"))
+				}
+			}
+		})
+	}
+}
@@ -37,25 +37,77 @@ func NewScheduler(controller *Controller) *Scheduler {
 	}
 }
 
+func (scheduler *Scheduler) checkDirwatches() {
+	controller := scheduler.Controller
+
+	if controller.Options.DirwatchStaleMinutes == 0 {
+		return
+	}
+
+	files := controller.Dirwatches.FindStale(time.Duration(controller.Options.DirwatchStaleMinutes) * time.Minute)
+	if len(files) == 0 {
+		return
+	}
+
+	controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("dirwatch: %d file(s) unprocessed for more than %d minutes, first is %s (%s)", len(files), controller.Options.DirwatchStaleMinutes, files[0].Path, files[0].Reason))
+
+	if controller.Options.DirwatchQuarantine {
+		controller.Dirwatches.QuarantineAll(files, controller)
+	}
+}
+
 func (scheduler *Scheduler) pruneDatabase() error {
-	if scheduler.Controller.Options.PruneDays == 0 {
+	controller := scheduler.Controller
+
+	if controller.Options.PruneDays == 0 && len(controller.Retentions.List) == 0 && !controller.Options.RetentionCompliance {
 		return nil
 	}
 
-	scheduler.Controller.Logs.LogEvent(LogLevelInfo, "database pruning")
+	controller.Logs.LogEvent(LogLevelInfo, "database pruning")
 
-	if err := scheduler.Controller.Calls.Prune(scheduler.Controller.Database, scheduler.Controller.Options.PruneDays); err != nil {
+	var (
+		count int64
+		err   error
+		size  int64
+	)
+
+	if controller.Options.RetentionCompliance {
+		count, size, err = controller.Compliance.Prune()
+	} else {
+		count, size, err = controller.Retentions.Prune(controller.Calls, controller.Database, controller.Options.PruneDays)
+	}
+	if err != nil {
 		return err
 	}
 
-	if err := scheduler.Controller.Logs.Prune(scheduler.Controller.Database, scheduler.Controller.Options.PruneDays); err != nil {
-		return err
+	if count > 0 {
+		controller.Logs.LogEvent(LogLevelInfo, fmt.Sprintf("database pruning removed %d calls, %.1f MiB of audio reclaimed", count, float64(size)/(1024*1024)))
+	}
+
+	if controller.Options.PruneDays > 0 {
+		if err := controller.Logs.Prune(controller.Database, controller.Options.PruneDays); err != nil {
+			return err
+		}
+
+		if err := controller.ListenerSessions.Prune(controller.Database, controller.Options.PruneDays); err != nil {
+			return err
+		}
+
+		if err := controller.Alerts.PruneHits(controller.Database, controller.Options.PruneDays); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+func (scheduler *Scheduler) pruneJob(job *Job, cancel <-chan struct{}) error {
+	return scheduler.pruneDatabase()
+}
+
 func (scheduler *Scheduler) run() {
+	defer scheduler.Controller.Recover("scheduler")
+
 	scheduler.mutex.Lock()
 	defer scheduler.mutex.Unlock()
 
@@ -63,9 +115,24 @@ func (scheduler *Scheduler) run() {
 		scheduler.Controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("scheduler.run: %s", err.Error()))
 	}
 
-	if err := scheduler.pruneDatabase(); err != nil {
+	// the pruning can take a while on large databases
+	if !scheduler.Controller.Jobs.HasPending(JobKindPrune) {
+		if _, err := scheduler.Controller.Jobs.Enqueue(JobKindPrune, nil, JobPriorityHigh); err != nil {
+			logError(err)
+		}
+	}
+
+	if scheduler.Controller.ColdStorage.Enabled() && scheduler.Controller.Options.ColdStorageDays > 0 && !scheduler.Controller.Jobs.HasPending(JobKindColdStorage) {
+		if _, err := scheduler.Controller.Jobs.Enqueue(JobKindColdStorage, nil, JobPriorityLow); err != nil {
+			logError(err)
+		}
+	}
+
+	if err := scheduler.Controller.Jobs.Prune(scheduler.Controller.Database); err != nil {
 		logError(err)
 	}
+
+	scheduler.checkDirwatches()
 }
 
 func (scheduler *Scheduler) Start() error {
@@ -0,0 +1,764 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	searchDefaultLimit = 50
+	searchIndexBatch   = 500
+	searchIndexTable   = "rdioScannerCallsIndex"
+	searchMaxLimit     = 200
+	searchMaxTerms     = 16
+
+	// the document of the text search index of postgresql, the searches
+	// using the very same expression for the index to apply
+	searchIndexPostgresDocument = "to_tsvector('simple', coalesce(`transcript`, '') || ' ' || coalesce(`talkgroup`, '') || ' ' || coalesce(`units`, ''))"
+)
+
+// SearchIndex is the full-text index of the calls, over their transcripts,
+// the labels and the names of their talkgroups and the aliases of their
+// units. The calls are indexed as they are written and transcribed, those
+// written before the index or before a restore by a background job.
+type SearchIndex struct {
+	Controller *Controller
+}
+
+type SearchIndexStatus struct {
+	Calls   uint `json:"calls"`
+	Indexed uint `json:"indexed"`
+	Pending bool `json:"pending"`
+}
+
+// SearchQuery is a full-text query, of which every term must match, a term
+// being a single word or the words of a phrase.
+type SearchQuery struct {
+	Terms [][]string `json:"terms"`
+}
+
+type SearchResults struct {
+	Count   uint           `json:"count"`
+	Results []SearchResult `json:"results"`
+	Terms   [][]string     `json:"terms"`
+}
+
+// SearchResult is a call matching a search, with its indexed texts escaped
+// for html and their matches within <mark> elements.
+type SearchResult struct {
+	Id         uint             `json:"id"`
+	DateTime   time.Time        `json:"dateTime"`
+	Duration   float64          `json:"duration,omitempty"`
+	Highlights SearchHighlights `json:"highlights"`
+	Site       uint             `json:"site,omitempty"`
+	System     uint             `json:"system"`
+	Talkgroup  uint             `json:"talkgroup"`
+}
+
+type SearchHighlights struct {
+	Talkgroup  string `json:"talkgroup,omitempty"`
+	Transcript string `json:"transcript,omitempty"`
+	Units      string `json:"units,omitempty"`
+}
+
+type searchToken struct {
+	start int
+	end   int
+	word  string
+}
+
+func NewSearchIndex(controller *Controller) *SearchIndex {
+	return &SearchIndex{Controller: controller}
+}
+
+// ParseSearchQuery splits the query into its words and its quoted phrases,
+// ie: engine 12 "structure fire". Only the letters and the digits are kept,
+// the query syntax of the databases never reaching them.
+func ParseSearchQuery(s string) (*SearchQuery, error) {
+	query := &SearchQuery{Terms: [][]string{}}
+
+	// the odd parts are within quotes, an unterminated one running to the
+	// end of the query
+	for i, part := range strings.Split(s, `"`) {
+		words := []string{}
+		for _, token := range searchTokens(part) {
+			words = append(words, token.word)
+		}
+
+		if i%2 == 1 {
+			if len(words) > 0 {
+				query.Terms = append(query.Terms, words)
+			}
+			continue
+		}
+
+		for _, word := range words {
+			query.Terms = append(query.Terms, []string{word})
+		}
+	}
+
+	switch {
+	case len(query.Terms) == 0:
+		return nil, errors.New("nothing to search")
+	case len(query.Terms) > searchMaxTerms:
+		return nil, fmt.Errorf("at most %d words or phrases", searchMaxTerms)
+	}
+
+	return query, nil
+}
+
+// sqlCondition is the condition on the calls matching the query, in the
+// full-text syntax of the database, over the talkgroups only when asked.
+func (query *SearchQuery) sqlCondition(db *Database, talkgroupsOnly bool) *SqlCondition {
+	terms := make([]string, len(query.Terms))
+
+	switch db.Config.DbType {
+	case DbTypeSqlite:
+		for i, term := range query.Terms {
+			terms[i] = fmt.Sprintf(`"%s"`, strings.Join(term, " "))
+		}
+
+		match := strings.Join(terms, " ")
+		if talkgroupsOnly {
+			match = fmt.Sprintf("talkgroup : (%s)", match)
+		}
+
+		return SqlWhere(fmt.Sprintf("`id` in (select rowid from `%s` where `%s` match ?)", searchIndexTable, searchIndexTable), match)
+
+	case DbTypePostgres:
+		for i, term := range query.Terms {
+			terms[i] = strings.Join(term, " <-> ")
+		}
+
+		document := searchIndexPostgresDocument
+		if talkgroupsOnly {
+			document = "to_tsvector('simple', coalesce(`talkgroup`, ''))"
+		}
+
+		return SqlWhere(fmt.Sprintf("`id` in (select `id` from `%s` where %s @@ to_tsquery('simple', ?))", searchIndexTable, document), strings.Join(terms, " & "))
+
+	default:
+		for i, term := range query.Terms {
+			terms[i] = fmt.Sprintf(`+"%s"`, strings.Join(term, " "))
+		}
+
+		// the columns are those of one of the fulltext indexes
+		columns := "`transcript`, `talkgroup`, `units`"
+		if talkgroupsOnly {
+			columns = "`talkgroup`"
+		}
+
+		return SqlWhere(fmt.Sprintf("`id` in (select `id` from `%s` where match(%s) against (? in boolean mode))", searchIndexTable, columns), strings.Join(terms, " "))
+	}
+}
+
+// Rebuild cancels the indexing in progress and queues another of all the
+// calls, the index being emptied first.
+func (index *SearchIndex) Rebuild() (*Job, error) {
+	jobs := index.Controller.Jobs
+
+	jobs.CancelKind(JobKindSearchIndex)
+
+	job, err := jobs.Enqueue(JobKindSearchIndex, map[string]any{"rebuild": true}, JobPriorityLow)
+	if err != nil {
+		return nil, fmt.Errorf("searchindex.rebuild: %v", err)
+	}
+
+	return job, nil
+}
+
+// RunJob indexes the calls missing from the index, once emptied for a
+// rebuild, in batches until done or canceled.
+func (index *SearchIndex) RunJob(job *Job, cancel <-chan struct{}) error {
+	var (
+		controller = index.Controller
+		count      int
+		db         = controller.Database
+		last       uint
+	)
+
+	formatError := func(err error) error {
+		return fmt.Errorf("searchindex.run: %v", err)
+	}
+
+	if rebuild, _ := job.Payload["rebuild"].(bool); rebuild {
+		if _, err := db.Delete(searchIndexTable).Exec(); err != nil {
+			return formatError(err)
+		}
+	}
+
+	// the calls indexed meanwhile by Write are left as they are, and the
+	// transcripts are read by the inserts themselves
+	insert := fmt.Sprintf("%s and `id` not in (select %s from `%s`)", searchIndexInsert(db), sqlQuote(searchIndexId(db)), searchIndexTable)
+
+	for {
+		select {
+		case <-cancel:
+			return nil
+		default:
+		}
+
+		calls, err := index.unindexed(last)
+		if err != nil {
+			return formatError(err)
+		}
+
+		if len(calls) == 0 {
+			break
+		}
+
+		tx, err := db.Sql.Begin()
+		if err != nil {
+			return formatError(err)
+		}
+
+		for _, call := range calls {
+			talkgroup, units := index.document(call)
+
+			if _, err = tx.Exec(insert, talkgroup, units, call.Id); err != nil {
+				tx.Rollback()
+				return formatError(err)
+			}
+
+			last = call.Id.(uint)
+		}
+
+		if err = tx.Commit(); err != nil {
+			return formatError(err)
+		}
+
+		count += len(calls)
+	}
+
+	controller.Logs.LogEvent(LogLevelInfo, fmt.Sprintf("search index: %d calls indexed", count))
+
+	return nil
+}
+
+// Search returns the calls matching the query within the condition, the
+// most recent first. The redacted searches only match the talkgroups and
+// leave out the transcripts and the units.
+func (index *SearchIndex) Search(query *SearchQuery, where *SqlCondition, redact bool, limit uint, offset uint) (*SearchResults, error) {
+	var (
+		dateTime   any
+		db         = index.Controller.Database
+		duration   sql.NullFloat64
+		err        error
+		ids        = []uint{}
+		rows       *sql.Rows
+		site       sql.NullInt64
+		talkgroup  sql.NullString
+		transcript sql.NullString
+		units      sql.NullString
+	)
+
+	formatError := func(err error) error {
+		return fmt.Errorf("searchindex.search: %v", err)
+	}
+
+	where = SqlAnd(where, query.sqlCondition(db, redact))
+
+	results := &SearchResults{Results: []SearchResult{}, Terms: query.Terms}
+
+	if err = db.Select("rdioScannerCalls", "count(*)").Where(where).QueryRow().Scan(&results.Count); err != nil {
+		return nil, formatError(err)
+	}
+
+	if rows, err = db.Select("rdioScannerCalls", "id", "dateTime", "duration", "site", "system", "talkgroup").Where(where).OrderBy("dateTime", true).OrderBy("id", true).Limit(limit, offset).Query(); err != nil {
+		return nil, formatError(err)
+	}
+
+	for rows.Next() {
+		result := SearchResult{}
+		if err = rows.Scan(&result.Id, &dateTime, &duration, &site, &result.System, &result.Talkgroup); err != nil {
+			break
+		}
+
+		if t, err := db.ParseDateTime(dateTime); err == nil {
+			result.DateTime = t
+		} else {
+			continue
+		}
+
+		if duration.Valid && duration.Float64 > 0 {
+			result.Duration = duration.Float64 / 1000
+		}
+
+		if site.Valid && site.Int64 > 0 {
+			result.Site = uint(site.Int64)
+		}
+
+		ids = append(ids, result.Id)
+		results.Results = append(results.Results, result)
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return nil, formatError(err)
+	}
+
+	if len(ids) == 0 {
+		return results, nil
+	}
+
+	// the highlights are of the texts as indexed
+	if rows, err = db.Select(searchIndexTable, searchIndexId(db), "transcript", "talkgroup", "units").Where(SqlIn(searchIndexId(db), ids)).Query(); err != nil {
+		return nil, formatError(err)
+	}
+
+	for rows.Next() {
+		var id uint
+		if err = rows.Scan(&id, &transcript, &talkgroup, &units); err != nil {
+			break
+		}
+
+		for i := range results.Results {
+			if results.Results[i].Id != id {
+				continue
+			}
+
+			highlights := &results.Results[i].Highlights
+			highlights.Talkgroup = searchHighlight(talkgroup.String, query.Terms)
+			if !redact {
+				highlights.Transcript = searchHighlight(transcript.String, query.Terms)
+				highlights.Units = searchHighlight(units.String, query.Terms)
+			}
+		}
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return nil, formatError(err)
+	}
+
+	return results, nil
+}
+
+// Start queues the indexing of the calls missing from the index, ie: those
+// written before it, unless already queued.
+func (index *SearchIndex) Start() error {
+	var (
+		controller = index.Controller
+		db         = controller.Database
+		id         uint
+	)
+
+	if controller.Jobs.HasPending(JobKindSearchIndex) {
+		return nil
+	}
+
+	switch err := db.Select("rdioScannerCalls", "id").Where(sqlSearchUnindexed(db)).Limit(1).QueryRow().Scan(&id); err {
+	case nil:
+	case sql.ErrNoRows:
+		return nil
+	default:
+		return fmt.Errorf("searchindex.start: %v", err)
+	}
+
+	if _, err := controller.Jobs.Enqueue(JobKindSearchIndex, nil, JobPriorityLow); err != nil {
+		return fmt.Errorf("searchindex.start: %v", err)
+	}
+
+	return nil
+}
+
+func (index *SearchIndex) Status() (*SearchIndexStatus, error) {
+	controller := index.Controller
+
+	status := &SearchIndexStatus{Pending: controller.Jobs.HasPending(JobKindSearchIndex)}
+
+	if err := controller.Database.Select("rdioScannerCalls", "count(*)").QueryRow().Scan(&status.Calls); err != nil {
+		return nil, fmt.Errorf("searchindex.status: %v", err)
+	}
+
+	if err := controller.Database.Select(searchIndexTable, "count(*)").QueryRow().Scan(&status.Indexed); err != nil {
+		return nil, fmt.Errorf("searchindex.status: %v", err)
+	}
+
+	return status, nil
+}
+
+// Write indexes the call, replacing its previous entry. Its transcript is
+// read from the calls by the insert, so that the transcriptions written
+// meanwhile are never replaced by an older one.
+func (index *SearchIndex) Write(call *Call) error {
+	db := index.Controller.Database
+
+	formatError := func(err error) error {
+		return fmt.Errorf("searchindex.write: %v", err)
+	}
+
+	id, ok := call.Id.(uint)
+	if !ok {
+		return nil
+	}
+
+	talkgroup, units := index.document(call)
+
+	tx, err := db.Sql.Begin()
+	if err != nil {
+		return formatError(err)
+	}
+
+	if _, err = tx.Exec(fmt.Sprintf("delete from `%s` where %s = ?", searchIndexTable, sqlQuote(searchIndexId(db))), id); err != nil {
+		tx.Rollback()
+		return formatError(err)
+	}
+
+	if _, err = tx.Exec(searchIndexInsert(db), talkgroup, units, id); err != nil {
+		tx.Rollback()
+		return formatError(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return formatError(err)
+	}
+
+	return nil
+}
+
+// document returns the talkgroup and the units of the call as indexed, the
+// label and the name of its talkgroup and the aliases of its units.
+func (index *SearchIndex) document(call *Call) (string, string) {
+	var (
+		systems   = index.Controller.Systems
+		talkgroup string
+		units     = []string{}
+	)
+
+	if t := systems.GetCallTalkgroup(call); t != nil {
+		talkgroup = strings.TrimSpace(fmt.Sprintf("%s %s", t.Label, t.Name))
+	}
+
+	if system, ok := systems.GetSystem(call.System); ok && system.Units != nil {
+		for _, id := range callUnitIds(call) {
+			if unit, ok := system.Units.GetUnit(id); ok && len(unit.Label) > 0 {
+				units = append(units, unit.Label)
+			}
+		}
+	}
+
+	return talkgroup, strings.Join(units, ", ")
+}
+
+// unindexed returns the next calls after the id missing from the index,
+// with only what their indexing needs.
+func (index *SearchIndex) unindexed(after uint) ([]*Call, error) {
+	var (
+		db      = index.Controller.Database
+		err     error
+		rows    *sql.Rows
+		site    sql.NullInt64
+		source  sql.NullInt64
+		sources sql.NullString
+	)
+
+	calls := []*Call{}
+
+	if rows, err = db.Select("rdioScannerCalls", "id", "site", "source", "sources", "system", "talkgroup").Where(SqlWhere("`id` > ?", after), sqlSearchUnindexed(db)).OrderBy("id", false).Limit(searchIndexBatch).Query(); err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var id uint
+
+		call := NewCall()
+		if err = rows.Scan(&id, &site, &source, &sources, &call.System, &call.Talkgroup); err != nil {
+			break
+		}
+
+		call.Id = id
+
+		if site.Valid && site.Int64 > 0 {
+			call.Site = uint(site.Int64)
+		}
+
+		if source.Valid && source.Int64 > 0 {
+			call.Source = uint(source.Int64)
+		}
+
+		if sources.Valid && len(sources.String) > 0 {
+			if err := json.Unmarshal([]byte(sources.String), &call.Sources); err != nil {
+				call.Sources = []any{}
+			}
+		}
+
+		calls = append(calls, call)
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return calls, nil
+}
+
+// SearchHandler searches the calls in the full-text index, ie:
+// ?q=engine 12 "structure fire"&system=1&talkgroup=54241&after=...&before=...
+// It takes the credentials of the events stream, the calls being those they
+// give access to.
+func (api *Api) SearchHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		controller = api.Controller
+		limit      = uint(searchDefaultLimit)
+		offset     uint
+		query      = r.URL.Query()
+	)
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	subscriber := &eventsSubscriber{}
+	if status := api.authorizeEvents(w, r, subscriber); status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+
+	search, err := ParseSearchQuery(query.Get("q"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	where := []*SqlCondition{api.eventsScope(subscriber)}
+
+	for _, param := range []string{"system", "talkgroup"} {
+		if v := query.Get(param); len(v) > 0 {
+			id, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s %q", param, v), http.StatusBadRequest)
+				return
+			}
+			where = append(where, SqlWhere(fmt.Sprintf("%s = ?", sqlQuote(param)), uint(id)))
+		}
+	}
+
+	for _, bound := range []struct {
+		param string
+		op    string
+	}{
+		{"after", ">"},
+		{"before", "<"},
+	} {
+		if v := query.Get(bound.param); len(v) > 0 {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s", bound.param), http.StatusBadRequest)
+				return
+			}
+			where = append(where, SqlWhere(fmt.Sprintf("`dateTime` %s ?", bound.op), t))
+		}
+	}
+
+	if i, err := strconv.ParseUint(query.Get("limit"), 10, 32); err == nil && i > 0 {
+		limit = uint(i)
+		if limit > searchMaxLimit {
+			limit = searchMaxLimit
+		}
+	}
+
+	if i, err := strconv.ParseUint(query.Get("offset"), 10, 32); err == nil {
+		offset = uint(i)
+	}
+
+	redact := subscriber.tier != nil && subscriber.tier.Redact
+
+	results, err := controller.SearchIndex.Search(search, SqlAnd(where...), redact, limit, offset)
+	if err != nil {
+		controller.Logs.LogEvent(LogLevelError, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if b, err := json.Marshal(results); err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	} else {
+		w.WriteHeader(http.StatusExpectationFailed)
+	}
+}
+
+// SearchIndexHandler returns the state of the full-text index of the calls
+// and with a post rebuilds it, ie: once the labels of many talkgroups or
+// units changed.
+func (admin *Admin) SearchIndexHandler(w http.ResponseWriter, r *http.Request) {
+	index := admin.Controller.SearchIndex
+
+	if !admin.Authorize(w, r, adminWriteRole(r)) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPost:
+		if _, err := index.Rebuild(); err != nil {
+			w.WriteHeader(http.StatusExpectationFailed)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		admin.Controller.Logs.LogEvent(LogLevelInfo, fmt.Sprintf("search index: rebuild by %s from ip %s", admin.author(r), GetRemoteAddr(r)))
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	status, err := index.Status()
+	if err != nil {
+		admin.Controller.Logs.LogEvent(LogLevelError, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if b, err := json.Marshal(status); err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	} else {
+		w.WriteHeader(http.StatusExpectationFailed)
+	}
+}
+
+// searchHighlight escapes the text for html and wraps the matches of the
+// terms within <mark> elements, the words being compared as they are
+// indexed, regardless of their case.
+func searchHighlight(text string, terms [][]string) string {
+	var (
+		b      strings.Builder
+		last   int
+		tokens = searchTokens(text)
+	)
+
+	for i := 0; i < len(tokens); {
+		n := 0
+
+		for _, term := range terms {
+			if len(term) > n && searchTermAt(tokens[i:], term) {
+				n = len(term)
+			}
+		}
+
+		if n == 0 {
+			i++
+			continue
+		}
+
+		start, end := tokens[i].start, tokens[i+n-1].end
+
+		b.WriteString(html.EscapeString(text[last:start]))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(text[start:end]))
+		b.WriteString("</mark>")
+
+		last = end
+		i += n
+	}
+
+	b.WriteString(html.EscapeString(text[last:]))
+
+	return b.String()
+}
+
+// searchIndexDelete deletes from the index the calls of the condition
+// within the transaction, before they are deleted.
+func searchIndexDelete(tx *sql.Tx, db *Database, where *SqlCondition) error {
+	query, args := db.Select("rdioScannerCalls", "id").Where(where).Build()
+
+	query, args = db.Delete(searchIndexTable).Where(SqlWhere(fmt.Sprintf("%s in (%s)", sqlQuote(searchIndexId(db)), query), args...)).Build()
+
+	_, err := tx.Exec(query, args...)
+
+	return err
+}
+
+// searchIndexId is the column of the index with the ids of the calls, the
+// rowid of the fts5 table with sqlite.
+func searchIndexId(db *Database) string {
+	if db.Config.DbType == DbTypeSqlite {
+		return "rowid"
+	}
+
+	return "id"
+}
+
+// searchIndexInsert indexes a call with its talkgroup and its units as
+// arguments, followed by its id.
+func searchIndexInsert(db *Database) string {
+	return fmt.Sprintf("insert into `%s` (%s, `transcript`, `talkgroup`, `units`) select `id`, `transcript`, ?, ? from `rdioScannerCalls` where `id` = ?", searchIndexTable, sqlQuote(searchIndexId(db)))
+}
+
+// searchTermAt tells if the tokens start with the words of the term.
+func searchTermAt(tokens []searchToken, term []string) bool {
+	if len(tokens) < len(term) {
+		return false
+	}
+
+	for i, word := range term {
+		if tokens[i].word != word {
+			return false
+		}
+	}
+
+	return true
+}
+
+// searchTokens returns the words of the text, the runs of letters and
+// digits, lower cased with their positions.
+func searchTokens(s string) []searchToken {
+	var (
+		start  = -1
+		tokens = []searchToken{}
+	)
+
+	for i, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = i
+			}
+
+		} else if start >= 0 {
+			tokens = append(tokens, searchToken{start: start, end: i, word: strings.ToLower(s[start:i])})
+			start = -1
+		}
+	}
+
+	if start >= 0 {
+		tokens = append(tokens, searchToken{start: start, end: len(s), word: strings.ToLower(s[start:])})
+	}
+
+	return tokens
+}
+
+func sqlSearchUnindexed(db *Database) *SqlCondition {
+	return SqlWhere(fmt.Sprintf("`id` not in (select %s from `%s`)", sqlQuote(searchIndexId(db)), searchIndexTable))
+}
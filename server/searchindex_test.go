@@ -0,0 +1,273 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want [][]string
+		err  bool
+	}{
+		{name: "words", s: "Engine  12", want: [][]string{{"engine"}, {"12"}}},
+		{name: "phrase", s: `engine "Structure Fire"`, want: [][]string{{"engine"}, {"structure", "fire"}}},
+		{name: "unterminated phrase", s: `"main street`, want: [][]string{{"main", "street"}}},
+		{name: "syntax of the databases", s: `fire* -alarm +"a" OR (b)`, want: [][]string{{"fire"}, {"alarm"}, {"a"}, {"or"}, {"b"}}},
+		{name: "nothing", s: ` "" - `, err: true},
+		{name: "too many terms", s: "a b c d e f g h i j k l m n o p q", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query, err := ParseSearchQuery(test.s)
+
+			if test.err != (err != nil) {
+				t.Fatalf("err = %v, want an error %v", err, test.err)
+			}
+			if err == nil && !reflect.DeepEqual(query.Terms, test.want) {
+				t.Errorf("terms = %v, want %v", query.Terms, test.want)
+			}
+		})
+	}
+}
+
+func TestSearchHighlight(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		terms [][]string
+		want  string
+	}{
+		{name: "word", text: "Engine 12 respond", terms: [][]string{{"engine"}}, want: "<mark>Engine</mark> 12 respond"},
+		{name: "phrase", text: "a structure, fire and a fire", terms: [][]string{{"structure", "fire"}}, want: "a <mark>structure, fire</mark> and a fire"},
+		{name: "longest term", text: "structure fire", terms: [][]string{{"structure"}, {"structure", "fire"}}, want: "<mark>structure fire</mark>"},
+		{name: "escaped", text: `<b>Traffic</b> & "stop"`, terms: [][]string{{"traffic"}}, want: "&lt;b&gt;<mark>Traffic</mark>&lt;/b&gt; &amp; &#34;stop&#34;"},
+		{name: "no match", text: "fire", terms: [][]string{{"fir"}}, want: "fire"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := searchHighlight(test.text, test.terms); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func newTestSearchIndex(t *testing.T) (*Controller, []uint) {
+	t.Helper()
+
+	controller := newTestController(t, nil)
+
+	system := NewSystem()
+	system.Id = 1
+	system.Talkgroups.List = append(system.Talkgroups.List, &Talkgroup{Id: 10, Label: "FD", Name: "Fire Dispatch"}, &Talkgroup{Id: 20, Label: "PD", Name: "Police"})
+	system.Units.Add(4424001, "Engine Twelve")
+	controller.Systems.List = append(controller.Systems.List, system)
+
+	ids := []uint{}
+
+	for i, call := range []struct {
+		source     any
+		talkgroup  uint
+		transcript string
+	}{
+		{4424001, 10, "Engine 12 respond to a structure fire on Main Street"},
+		{nil, 20, "Fire alarm at the structure, engine not needed"},
+		{nil, 20, "<b>Traffic</b> stop"},
+	} {
+		c := &Call{Audio: []byte{0}, DateTime: time.Date(2026, 10, 1, 12, i, 0, 0, time.UTC), Source: call.source, System: 1, Talkgroup: call.talkgroup}
+
+		id, err := controller.Calls.WriteCall(c, controller.Database)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Id = id
+
+		if err = controller.SearchIndex.Write(c); err != nil {
+			t.Fatal(err)
+		}
+
+		// as the transcriptions, once the call is written and indexed
+		if err = controller.Calls.WriteTranscript(id, call.transcript, controller.Database); err != nil {
+			t.Fatal(err)
+		}
+		if err = controller.SearchIndex.Write(c); err != nil {
+			t.Fatal(err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return controller, ids
+}
+
+func TestSearchIndexSearch(t *testing.T) {
+	controller, ids := newTestSearchIndex(t)
+
+	tests := []struct {
+		name   string
+		q      string
+		redact bool
+		want   []uint
+		mark   SearchHighlights
+	}{
+		{name: "phrase", q: `"structure fire"`, want: []uint{ids[0]}, mark: SearchHighlights{Talkgroup: "FD Fire Dispatch", Transcript: "Engine 12 respond to a <mark>structure fire</mark> on Main Street", Units: "Engine Twelve"}},
+		{name: "words", q: "Structure FIRE", want: []uint{ids[1], ids[0]}},
+		{name: "talkgroup label", q: `"fire dispatch"`, want: []uint{ids[0]}, mark: SearchHighlights{Talkgroup: "FD <mark>Fire Dispatch</mark>", Transcript: "Engine 12 respond to a structure fire on Main Street", Units: "Engine Twelve"}},
+		{name: "unit alias", q: "twelve", want: []uint{ids[0]}, mark: SearchHighlights{Talkgroup: "FD Fire Dispatch", Transcript: "Engine 12 respond to a structure fire on Main Street", Units: "Engine <mark>Twelve</mark>"}},
+		{name: "escaped", q: "traffic", want: []uint{ids[2]}, mark: SearchHighlights{Talkgroup: "PD Police", Transcript: "&lt;b&gt;<mark>Traffic</mark>&lt;/b&gt; stop"}},
+		{name: "no match", q: "ambulance", want: []uint{}},
+		{name: "redacted talkgroup", q: "police", redact: true, want: []uint{ids[2], ids[1]}},
+		{name: "redacted transcript", q: "engine", redact: true, want: []uint{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query, err := ParseSearchQuery(test.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			results, err := controller.SearchIndex.Search(query, nil, test.redact, 50, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := []uint{}
+			for _, result := range results.Results {
+				got = append(got, result.Id)
+			}
+			if !reflect.DeepEqual(got, test.want) || results.Count != uint(len(test.want)) {
+				t.Fatalf("got %v of %d, want %v", got, results.Count, test.want)
+			}
+
+			if len(test.mark.Talkgroup) > 0 && results.Results[0].Highlights != test.mark {
+				t.Errorf("highlights = %+v, want %+v", results.Results[0].Highlights, test.mark)
+			}
+			if test.redact && len(got) > 0 && (len(results.Results[0].Highlights.Transcript) > 0 || len(results.Results[0].Highlights.Units) > 0) {
+				t.Errorf("redacted highlights = %+v", results.Results[0].Highlights)
+			}
+		})
+	}
+}
+
+func TestSearchIndexMaintenance(t *testing.T) {
+	controller, ids := newTestSearchIndex(t)
+
+	// the deleted calls leave the index
+	if _, _, err := controller.Calls.PruneWhere(controller.Database, SqlWhere("`id` = ?", ids[0])); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := controller.SearchIndex.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Calls != 2 || status.Indexed != 2 {
+		t.Fatalf("status = %+v, want 2 calls indexed", status)
+	}
+
+	// the calls of before the index, ie: written by an earlier version
+	id, err := controller.Calls.WriteCall(&Call{Audio: []byte{0}, DateTime: time.Date(2026, 10, 1, 13, 0, 0, 0, time.UTC), System: 1, Talkgroup: 10}, controller.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = controller.Calls.WriteTranscript(id, "Engine 7 on scene", controller.Database); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = controller.SearchIndex.RunJob(&Job{Payload: map[string]any{"rebuild": true}}, make(chan struct{})); err != nil {
+		t.Fatal(err)
+	}
+
+	if status, err = controller.SearchIndex.Status(); err != nil {
+		t.Fatal(err)
+	}
+	if status.Calls != 3 || status.Indexed != 3 {
+		t.Fatalf("status = %+v, want 3 calls indexed", status)
+	}
+
+	query, _ := ParseSearchQuery(`"engine 7" "fire dispatch"`)
+
+	results, err := controller.SearchIndex.Search(query, nil, false, 50, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results.Results) != 1 || results.Results[0].Id != id {
+		t.Errorf("results = %+v, want call %d", results.Results, id)
+	}
+}
+
+func TestSearchHandler(t *testing.T) {
+	controller, ids := newTestSearchIndex(t)
+
+	controller.Apikeys.List = append(controller.Apikeys.List, &Apikey{Key: "key", Scopes: []any{ApikeyScopeRead}, Systems: "*"})
+	controller.Accesses.Add(&Access{Code: "1234", Systems: []any{map[string]any{"id": float64(1), "talkgroups": []any{float64(20)}}}})
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+		want   []uint
+	}{
+		{name: "no credentials", target: "/api/search?q=fire", status: http.StatusUnauthorized},
+		{name: "api key", target: "/api/search?q=fire&key=key", status: http.StatusOK, want: []uint{ids[1], ids[0]}},
+		{name: "access code", target: "/api/search?q=fire&code=1234", status: http.StatusOK, want: []uint{ids[1]}},
+		{name: "talkgroup", target: "/api/search?q=fire&talkgroup=10&key=key", status: http.StatusOK, want: []uint{ids[0]}},
+		{name: "before", target: "/api/search?q=fire&before=2026-10-01T12:00:30Z&key=key", status: http.StatusOK, want: []uint{ids[0]}},
+		{name: "limit", target: "/api/search?q=fire&limit=1&offset=1&key=key", status: http.StatusOK, want: []uint{ids[0]}},
+		{name: "no query", target: "/api/search?q=%22%22&key=key", status: http.StatusBadRequest},
+		{name: "invalid system", target: "/api/search?q=fire&system=one&key=key", status: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			controller.Api.SearchHandler(w, httptest.NewRequest(http.MethodGet, test.target, nil))
+
+			if w.Code != test.status {
+				t.Fatalf("status %d, want %d", w.Code, test.status)
+			}
+
+			if test.status != http.StatusOK {
+				return
+			}
+
+			var results SearchResults
+			if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+				t.Fatal(err)
+			}
+
+			got := []uint{}
+			for _, result := range results.Results {
+				got = append(got, result.Id)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+const (
+	secretsConfigKey = "secretsKey"
+	secretsPrefix    = "enc:v1:"
+)
+
+// secretsColumns are the columns holding credentials, sealed in the
+// database when a secrets key is set.
+var secretsColumns = []struct {
+	table  string
+	column string
+}{
+	{"rdioScannerAlerts", "url"},
+	{"rdioScannerBroadcastifyFeeds", "apiKey"},
+	{"rdioScannerConfigVersions", "config"},
+	{"rdioScannerDownstreams", "apiKey"},
+	{"rdioScannerPublishers", "brokers"},
+	{"rdioScannerRadioReferenceSyncs", "appKey"},
+	{"rdioScannerRadioReferenceSyncs", "password"},
+	{"rdioScannerTranscribers", "apiKey"},
+}
+
+var secretsReference = regexp.MustCompile(`^\$\{(command|env|file):(.+)\}$`)
+
+// Secrets seals the credentials stored in the database with envelope
+// encryption. A random data key encrypts the credentials with aes-gcm, and
+// is itself stored in the database encrypted with the master key derived
+// from the secrets_key setting, so that the master key never reaches the
+// database. Without a secrets key, the credentials are stored as is.
+type Secrets struct {
+	dataKey []byte
+}
+
+// NewSecrets unwraps the data key of the database with the master key, or
+// creates it on first use. It fails if the database has a data key and no
+// master key is given, its secrets being unreadable.
+func NewSecrets(db *Database, masterKey []byte) (*Secrets, error) {
+	var wrapped string
+
+	formatError := func(err error) error {
+		return fmt.Errorf("secrets: %v", err)
+	}
+
+	err := db.Sql.QueryRow("select `val` from `rdioScannerConfigs` where `key` = ?", secretsConfigKey).Scan(&wrapped)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, formatError(err)
+	}
+
+	if masterKey == nil {
+		if err == nil {
+			return nil, formatError(errors.New("the database secrets are encrypted, the secrets_key setting is required"))
+		}
+		return &Secrets{}, nil
+	}
+
+	if err == nil {
+		s, err := secretsOpen(masterKey, wrapped)
+		if err != nil {
+			return nil, formatError(errors.New("unable to decrypt the data key, wrong secrets_key"))
+		}
+
+		dataKey, err := base64.StdEncoding.DecodeString(s)
+		if err != nil || len(dataKey) != 32 {
+			return nil, formatError(errors.New("invalid data key"))
+		}
+
+		return &Secrets{dataKey: dataKey}, nil
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err = rand.Read(dataKey); err != nil {
+		return nil, formatError(err)
+	}
+
+	if wrapped, err = secretsSeal(masterKey, base64.StdEncoding.EncodeToString(dataKey)); err != nil {
+		return nil, formatError(err)
+	}
+
+	if _, err = db.Sql.Exec("insert into `rdioScannerConfigs` (`key`, `val`) values (?, ?)", secretsConfigKey, wrapped); err != nil {
+		return nil, formatError(err)
+	}
+
+	return &Secrets{dataKey: dataKey}, nil
+}
+
+// Enabled tells whether the credentials are sealed.
+func (secrets *Secrets) Enabled() bool {
+	return secrets != nil && secrets.dataKey != nil
+}
+
+// Encrypt seals the credentials still stored as is, ie: those written
+// before the secrets key was set, and returns how many it sealed.
+func (secrets *Secrets) Encrypt(db *Database) (int, error) {
+	formatError := func(err error) error {
+		return fmt.Errorf("secrets.encrypt: %v", err)
+	}
+
+	if !secrets.Enabled() {
+		return 0, nil
+	}
+
+	count := 0
+
+	for _, c := range secretsColumns {
+		type secret struct {
+			id    uint
+			value string
+		}
+
+		rows, err := db.Sql.Query(fmt.Sprintf("select `_id`, `%s` from `%s`", c.column, c.table))
+		if err != nil {
+			return count, formatError(err)
+		}
+
+		plain := []secret{}
+
+		for rows.Next() {
+			var (
+				id    uint
+				value sql.NullString
+			)
+
+			if err = rows.Scan(&id, &value); err != nil {
+				break
+			}
+
+			if len(value.String) > 0 && !strings.HasPrefix(value.String, secretsPrefix) {
+				plain = append(plain, secret{id, value.String})
+			}
+		}
+
+		rows.Close()
+
+		if err != nil {
+			return count, formatError(err)
+		}
+
+		for _, s := range plain {
+			sealed, err := secrets.Seal(s.value)
+			if err != nil {
+				return count, formatError(err)
+			}
+
+			if _, err = db.Sql.Exec(fmt.Sprintf("update `%s` set `%s` = ? where `_id` = ?", c.table, c.column), sealed, s.id); err != nil {
+				return count, formatError(err)
+			}
+
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// Open returns the credential of a sealed value, and the others as is.
+func (secrets *Secrets) Open(s string) (string, error) {
+	if !strings.HasPrefix(s, secretsPrefix) {
+		return s, nil
+	}
+
+	if !secrets.Enabled() {
+		return "", errors.New("encrypted secret without a secrets key")
+	}
+
+	return secretsOpen(secrets.dataKey, s)
+}
+
+// Seal returns the sealed value of a credential, or the credential as is
+// when no secrets key is set.
+func (secrets *Secrets) Seal(s string) (string, error) {
+	if !secrets.Enabled() || len(s) == 0 || strings.HasPrefix(s, secretsPrefix) {
+		return s, nil
+	}
+
+	return secretsSeal(secrets.dataKey, s)
+}
+
+// resolveSecret returns the value of a secret reference, ie:
+// ${env:RDIO_DB_PASS}, ${file:/run/secrets/db_pass} or ${command:vault kv
+// get -field=password secret/rdio}, trimmed of its surrounding spaces. Any
+// other value is returned as is.
+func resolveSecret(s string) (string, error) {
+	m := secretsReference.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return s, nil
+	}
+
+	switch m[1] {
+	case "command":
+		var cmd *exec.Cmd
+		if runtime.GOOS == "windows" {
+			cmd = exec.Command("cmd", "/c", m[2])
+		} else {
+			cmd = exec.Command("sh", "-c", m[2])
+		}
+		cmd.Stderr = os.Stderr
+
+		b, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("command %s: %v", m[2], err)
+		}
+		return strings.TrimSpace(string(b)), nil
+
+	case "env":
+		v, ok := os.LookupEnv(m[2])
+		if !ok {
+			return "", fmt.Errorf("environment variable %s not set", m[2])
+		}
+		return strings.TrimSpace(v), nil
+
+	default:
+		b, err := os.ReadFile(m[2])
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+}
+
+// resolveOptionSecret returns the value of an ${env:} reference of an
+// option. The options being set by the config editors, their references
+// never read the files nor run the commands of the host.
+func resolveOptionSecret(s string) (string, error) {
+	m := secretsReference.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return s, nil
+	}
+
+	if m[1] != "env" {
+		return "", fmt.Errorf("%s references are only allowed in the settings", m[1])
+	}
+
+	return resolveSecret(s)
+}
+
+// secretsMasterKey returns the aes-256 key of the secrets_key setting, nil
+// when it isn't set.
+func secretsMasterKey(s string) []byte {
+	if len(s) == 0 {
+		return nil
+	}
+
+	sum := sha256.Sum256([]byte(s))
+
+	return sum[:]
+}
+
+func secretsOpen(key []byte, s string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, secretsPrefix))
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := secretsCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	if len(b) < gcm.NonceSize() {
+		return "", errors.New("invalid encrypted secret")
+	}
+
+	plain, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("unable to decrypt the secret")
+	}
+
+	return string(plain), nil
+}
+
+func secretsSeal(key []byte, s string) (string, error) {
+	gcm, err := secretsCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return secretsPrefix + base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(s), nil)), nil
+}
+
+func secretsCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,428 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// the signature of a share code, in base62 characters
+const shareSignatureLength = 8
+
+// Shares gives the public links of the calls the listeners share. A link
+// carries the call id and its signature with the instance secret, so nothing
+// is stored and disabling the shareLinks option revokes every link given.
+type Shares struct {
+	Controller *Controller
+}
+
+func NewShares(controller *Controller) *Shares {
+	return &Shares{Controller: controller}
+}
+
+// Code returns the share code of a call, ie: /c/AbC123xyz0.
+func (shares *Shares) Code(id uint) string {
+	return new(big.Int).SetUint64(uint64(id)).Text(62) + shares.sign(id)
+}
+
+// Parse returns the call id of a share code, only if its signature is valid.
+func (shares *Shares) Parse(code string) (uint, bool) {
+	if len(code) <= shareSignatureLength {
+		return 0, false
+	}
+
+	n, ok := new(big.Int).SetString(code[:len(code)-shareSignatureLength], 62)
+	if !ok || n.Sign() <= 0 || !n.IsUint64() || n.Uint64() > uint64(^uint(0)) {
+		return 0, false
+	}
+
+	id := uint(n.Uint64())
+
+	if !hmac.Equal([]byte(code[len(code)-shareSignatureLength:]), []byte(shares.sign(id))) {
+		return 0, false
+	}
+
+	return id, true
+}
+
+// Link returns the share link of a call for the request it answers.
+func (shares *Shares) Link(r *http.Request, id uint) string {
+	return fmt.Sprintf("%s/c/%s", requestBaseUrl(r), shares.Code(id))
+}
+
+// Permalink returns the stable link of a call, which outlives its database
+// id, ie: /call/0b9a1e3c-5b6f-4f0e-9d3a-3f1c2a7e8d10.
+func (shares *Shares) Permalink(r *http.Request, uuid string) string {
+	return fmt.Sprintf("%s/call/%s", requestBaseUrl(r), uuid)
+}
+
+func (shares *Shares) sign(id uint) string {
+	mac := hmac.New(sha256.New, []byte(shares.Controller.Options.secret))
+	mac.Write([]byte(fmt.Sprintf("share:%d", id)))
+
+	s := new(big.Int).SetBytes(mac.Sum(nil)).Text(62)
+	if len(s) < shareSignatureLength {
+		s = strings.Repeat("0", shareSignatureLength-len(s)) + s
+	}
+
+	return s[:shareSignatureLength]
+}
+
+// ShareHandler gives the share link of a call on /api/share, authorized as
+// a download of its audio, ie: {"id": 123}.
+func (shares *Shares) ShareHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	controller := shares.Controller
+
+	if !controller.Options.ShareLinks {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	m := map[string]any{}
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	id, ok := m["id"].(float64)
+	if !ok || id < 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	call, err := controller.Calls.GetCall(uint(id), controller.Database)
+	if errors.Is(err, ErrCallNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("shares.share: %v", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if controller.Blackouts.IsBlackedOut(call) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if status := controller.Api.authorizeCall(w, r, call); status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+
+	uuid, err := controller.Calls.Permalink(call, controller.Database)
+	if err != nil {
+		controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("shares.share: %v", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	controller.Logs.LogEvent(LogLevelInfo, fmt.Sprintf("share: call %d shared from ip %s", uint(id), GetRemoteAddr(r)))
+
+	if b, err := json.Marshal(map[string]any{
+		"code": shares.Code(uint(id)),
+		"id":   uint(id),
+		"url":  shares.Permalink(r, uuid),
+		"uuid": uuid,
+	}); err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	} else {
+		w.WriteHeader(http.StatusExpectationFailed)
+	}
+}
+
+// PageHandler serves the page of a shared call on /call/{uuid} or /c/{code},
+// with its opengraph metadata for the link previews and its audio player, and
+// the audio itself on /call/{uuid}/audio or /c/{code}/audio. The page may be
+// embedded in an iframe.
+func (shares *Shares) PageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	controller := shares.Controller
+
+	if !controller.Options.ShareLinks {
+		controller.Pages.ServeError(w, r, http.StatusNotFound)
+		return
+	}
+
+	var (
+		call      *Call
+		err       error
+		permalink = strings.HasPrefix(r.URL.Path, "/call/")
+	)
+
+	p := strings.Split(strings.Trim(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/call/"), "/c/"), "/"), "/")
+	if len(p) > 2 || (len(p) == 2 && p[1] != "audio") {
+		controller.Pages.ServeError(w, r, http.StatusNotFound)
+		return
+	}
+
+	if permalink {
+		call, err = controller.Calls.GetCallByUuid(p[0], controller.Database)
+
+	} else if id, ok := shares.Parse(p[0]); ok {
+		call, err = controller.Calls.GetCall(id, controller.Database)
+
+	} else {
+		controller.Pages.ServeError(w, r, http.StatusNotFound)
+		return
+	}
+
+	if errors.Is(err, ErrCallNotFound) {
+		controller.Pages.ServeError(w, r, http.StatusNotFound)
+		return
+	} else if err != nil {
+		controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("shares.page: %v", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if controller.Blackouts.IsBlackedOut(call) {
+		controller.Pages.ServeError(w, r, http.StatusNotFound)
+		return
+	}
+
+	if len(p) == 2 {
+		if call.Cold {
+			controller.ColdStorage.ReplyRetrieving(w, call)
+			return
+		}
+
+		if len(call.Audio) == 0 {
+			controller.Pages.ServeError(w, r, http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+
+		controller.Api.serveAudio(w, r, call)
+		return
+	}
+
+	if call.Cold {
+		if err = controller.ColdStorage.Retrieve(call); err != nil {
+			controller.Logs.LogEvent(LogLevelError, err.Error())
+		}
+	}
+
+	var link string
+	if permalink {
+		link = shares.Permalink(r, call.Uuid)
+	} else {
+		id, _ := call.Id.(uint)
+		link = shares.Link(r, id)
+	}
+
+	b, err := shares.page(r, call, link)
+	if err != nil {
+		controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("shares.page: %v", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if call.Cold {
+		w.Header().Set("Cache-Control", "no-store")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(b)
+}
+
+func (shares *Shares) page(r *http.Request, call *Call, link string) ([]byte, error) {
+	var (
+		b       strings.Builder
+		options = shares.Controller.Options
+	)
+
+	data := map[string]any{
+		"audio":      link + "/audio",
+		"cold":       call.Cold,
+		"dateTime":   call.DateTime.Format(time.RFC3339),
+		"retryAfter": int(coldStorageRetryAfter.Seconds()),
+		"siteName":   "Rdio Scanner",
+		"url":        link,
+	}
+
+	if len(options.Branding) > 0 {
+		data["siteName"] = options.Branding
+	}
+
+	if audioType, ok := call.AudioType.(string); ok && len(audioType) > 0 {
+		data["audioType"] = audioType
+	}
+
+	system, ok := shares.Controller.Systems.GetSystem(call.System)
+	if !ok {
+		return nil, fmt.Errorf("unknown system %d", call.System)
+	}
+
+	title := fmt.Sprintf("%d - %s", call.Talkgroup, system.Label)
+
+	if talkgroup, ok := system.Talkgroups.GetSiteTalkgroup(call.Talkgroup, call.Site); ok {
+		if len(talkgroup.Name) > 0 {
+			title = fmt.Sprintf("%s - %s", talkgroup.Name, system.Label)
+		} else {
+			title = fmt.Sprintf("%s - %s", talkgroup.Label, system.Label)
+		}
+	}
+
+	data["title"] = title
+
+	description := call.DateTime.Format("2006-01-02 15:04:05 MST")
+	if call.Duration > 0 {
+		description += fmt.Sprintf(", %ss", strconv.FormatFloat(call.Duration.Seconds(), 'f', 1, 64))
+	}
+	if transcript, ok := call.Transcript.(string); ok && len(transcript) > 0 {
+		data["transcript"] = transcript
+		description += ": " + shareExcerpt(transcript, 200)
+	}
+
+	data["description"] = description
+
+	if err := sharePage.Execute(&b, data); err != nil {
+		return nil, err
+	}
+
+	return []byte(b.String()), nil
+}
+
+func (controller *Controller) ProcessMessageCommandShare(client *Client, message *Message) error {
+	var id uint
+
+	switch v := message.Payload.(type) {
+	case float64:
+		id = uint(v)
+	default:
+		return nil
+	}
+
+	reply := func(payload map[string]any) {
+		client.Send <- &Message{Command: MessageCommandShare, Payload: payload}
+	}
+
+	if !controller.Options.ShareLinks || id == 0 {
+		reply(map[string]any{"id": id})
+		return nil
+	}
+
+	call, err := controller.Calls.GetCall(id, controller.Database)
+	if errors.Is(err, ErrCallNotFound) {
+		reply(map[string]any{"id": id})
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	tier := client.GetTier()
+
+	if controller.Blackouts.IsBlackedOut(call) || !tier.IsAvailable(call) || (tier != nil && !tier.Download) ||
+		(controller.Accesses.IsRestricted() && !client.GetAccess().HasAccess(call)) {
+		reply(map[string]any{"id": id})
+		return nil
+	}
+
+	uuid, err := controller.Calls.Permalink(call, controller.Database)
+	if err != nil {
+		return err
+	}
+
+	controller.Logs.LogEvent(LogLevelInfo, fmt.Sprintf("share: call %d shared from ip %s", id, client.GetRemoteAddr()))
+
+	reply(map[string]any{"id": id, "code": controller.Shares.Code(id), "uuid": uuid})
+
+	return nil
+}
+
+var sharePage = template.Must(template.New("share").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+{{if .cold}}<meta http-equiv="refresh" content="{{.retryAfter}}">
+{{end}}<title>{{.title}}</title>
+<meta name="description" content="{{.description}}">
+<meta property="og:type" content="website">
+<meta property="og:site_name" content="{{.siteName}}">
+<meta property="og:title" content="{{.title}}">
+<meta property="og:description" content="{{.description}}">
+<meta property="og:url" content="{{.url}}">
+<meta property="og:audio" content="{{.audio}}">
+{{if .audioType}}<meta property="og:audio:type" content="{{.audioType}}">
+{{end}}<meta name="twitter:card" content="summary">
+<meta name="twitter:title" content="{{.title}}">
+<meta name="twitter:description" content="{{.description}}">
+<style>
+body { background: #000; color: #fff; font-family: sans-serif; margin: 0; padding: 16px; }
+#title { font-size: 1.5em; font-weight: bold; }
+#site, #time { color: #aaa; }
+#transcript { margin-top: 16px; }
+audio { margin-top: 16px; width: 100%; }
+</style>
+</head>
+<body>
+<div id="site">{{.siteName}}</div>
+<div id="title">{{.title}}</div>
+<div id="time" data-time="{{.dateTime}}">{{.dateTime}}</div>
+{{if .cold}}<p>The audio of this call is being retrieved, this page reloads in a moment.</p>
+{{else}}<audio controls preload="metadata" src="{{.audio}}"></audio>
+{{end}}{{if .transcript}}<div id="transcript">{{.transcript}}</div>
+{{end}}<script>
+var el = document.getElementById('time');
+el.textContent = new Date(el.getAttribute('data-time')).toLocaleString();
+</script>
+</body>
+</html>
+`))
+
+// shareExcerpt shortens the text to at most max characters, at a word
+// boundary when there is one.
+func shareExcerpt(s string, max int) string {
+	r := []rune(s)
+	if len(r) <= max {
+		return s
+	}
+
+	cut := max
+	for i := max; i > 0; i-- {
+		if unicode.IsSpace(r[i]) {
+			cut = i
+			break
+		}
+	}
+
+	return strings.TrimSpace(string(r[:cut])) + "..."
+}
@@ -0,0 +1,173 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestShareExcerpt(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		max  int
+		want string
+	}{
+		{"short", "engine 5 responding", 200, "engine 5 responding"},
+		{"exact", "abcde", 5, "abcde"},
+		{"word boundary", "engine 5 responding", 12, "engine 5..."},
+		{"space at the cut", "engine 5 responding", 8, "engine 5..."},
+		{"no space", "abcdefgh", 5, "abcde..."},
+		{"multibyte", "éééé ééé", 6, "éééé..."},
+		{"multibyte without space", strings.Repeat("日本", 150), 200, strings.Repeat("日本", 100) + "..."},
+		{"emoji", strings.Repeat("🚒", 201), 200, strings.Repeat("🚒", 200) + "..."},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := shareExcerpt(test.s, test.max)
+			if got != test.want {
+				t.Errorf("shareExcerpt(%q, %d) = %q, want %q", test.s, test.max, got, test.want)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("shareExcerpt(%q, %d) is not valid utf-8", test.s, test.max)
+			}
+		})
+	}
+}
+
+func TestSharesCode(t *testing.T) {
+	shares := NewShares(&Controller{Options: &Options{secret: "secret"}})
+	other := NewShares(&Controller{Options: &Options{secret: "other"}})
+
+	ids := []uint{1, 61, 62, 12345, uint(^uint32(0)), ^uint(0)}
+
+	for _, id := range ids {
+		code := shares.Code(id)
+
+		if got, ok := shares.Parse(code); !ok || got != id {
+			t.Errorf("Parse(Code(%d)) = %d, %v", id, got, ok)
+		}
+
+		if _, ok := other.Parse(code); ok {
+			t.Errorf("the code of %d is valid with another secret", id)
+		}
+	}
+
+	code := shares.Code(12345)
+	sig := code[len(code)-shareSignatureLength:]
+
+	flip := func(s string, i int) string {
+		b := []byte(s)
+		if b[i] == 'a' {
+			b[i] = 'b'
+		} else {
+			b[i] = 'a'
+		}
+		return string(b)
+	}
+
+	tests := []struct {
+		name string
+		code string
+	}{
+		{"empty", ""},
+		{"signature only", sig},
+		{"tampered signature", flip(code, len(code)-1)},
+		{"tampered id", flip(code, 0)},
+		{"other id with the signature", shares.Code(12346)[:len(shares.Code(12346))-shareSignatureLength] + sig},
+		{"truncated", code[:len(code)-1]},
+		{"extended", code + "0"},
+		{"not base62", "!!" + sig},
+		{"zero id", "0" + shares.sign(0)},
+		{"id overflow", "zzzzzzzzzzzzzzzz" + sig},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if id, ok := shares.Parse(test.code); ok {
+				t.Errorf("Parse(%q) = %d, true", test.code, id)
+			}
+		})
+	}
+}
+
+func TestSharesPageHandler(t *testing.T) {
+	controller := &Controller{
+		Calls:    NewCalls(),
+		Config:   &Config{},
+		Database: newTestDatabase(t),
+		Logs:     NewLogs(),
+		Options:  NewOptions(),
+		Systems:  NewSystems(),
+	}
+	controller.Options.ShareLinks = true
+	controller.Options.secret = "secret"
+
+	controller.Api = NewApi(controller)
+	controller.Blackouts = NewBlackouts(controller)
+	controller.Shares = NewShares(controller)
+
+	system := NewSystem()
+	system.Id = 1
+	system.Label = "County"
+	system.Talkgroups.List = []*Talkgroup{{Id: 2, Label: "Fire", Name: "Fire Dispatch"}}
+	controller.Systems.List = []*System{system}
+
+	call := &Call{Audio: []byte{0}, AudioType: "audio/mpeg", DateTime: time.Now(), System: 1, Talkgroup: 2}
+
+	id, err := controller.Calls.WriteCall(call, controller.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := controller.Shares.Code(id)
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		link   string
+	}{
+		{"permalink", "/call/" + call.Uuid, http.StatusOK, "/call/" + call.Uuid},
+		{"permalink audio", "/call/" + call.Uuid + "/audio", http.StatusOK, ""},
+		{"unknown permalink", "/call/5d0c2f7e-8b1a-4c3d-9e6f-7a8b9c0d1e2f", http.StatusNotFound, ""},
+		{"invalid permalink", "/call/" + code, http.StatusNotFound, ""},
+		{"permalink extra path", "/call/" + call.Uuid + "/audio/x", http.StatusNotFound, ""},
+		{"code", "/c/" + code, http.StatusOK, "/c/" + code},
+		{"invalid code", "/c/" + call.Uuid, http.StatusNotFound, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			controller.Shares.PageHandler(w, httptest.NewRequest(http.MethodGet, test.path, nil))
+
+			if w.Code != test.status {
+				t.Fatalf("status = %d, want %d", w.Code, test.status)
+			}
+			if len(test.link) > 0 && !strings.Contains(w.Body.String(), `content="http://example.com`+test.link+`"`) {
+				t.Errorf("the page does not link to %s: %s", test.link, w.Body.String())
+			}
+		})
+	}
+}
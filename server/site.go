@@ -0,0 +1,214 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Site is a receiving RF site of a trunked system, the calls being tagged
+// with the id of the site that recorded them.
+type Site struct {
+	Id    uint   `json:"id"`
+	Label string `json:"label"`
+	Order uint   `json:"order"`
+}
+
+func (site *Site) FromMap(m map[string]any) *Site {
+	switch v := m["id"].(type) {
+	case float64:
+		site.Id = uint(v)
+	}
+
+	switch v := m["label"].(type) {
+	case string:
+		site.Label = v
+	}
+
+	switch v := m["order"].(type) {
+	case float64:
+		site.Order = uint(v)
+	}
+
+	return site
+}
+
+type Sites struct {
+	List  []*Site
+	mutex sync.Mutex
+}
+
+func NewSites() *Sites {
+	return &Sites{
+		List:  []*Site{},
+		mutex: sync.Mutex{},
+	}
+}
+
+func (sites *Sites) FromMap(f []any) *Sites {
+	sites.mutex.Lock()
+	defer sites.mutex.Unlock()
+
+	sites.List = []*Site{}
+
+	for _, r := range f {
+		switch m := r.(type) {
+		case map[string]any:
+			site := &Site{}
+			site.FromMap(m)
+			sites.List = append(sites.List, site)
+		}
+	}
+
+	return sites
+}
+
+func (sites *Sites) GetSite(id uint) (*Site, bool) {
+	sites.mutex.Lock()
+	defer sites.mutex.Unlock()
+
+	for _, site := range sites.List {
+		if site.Id == id {
+			return site, true
+		}
+	}
+
+	return nil, false
+}
+
+// GetLabel returns the label of the site, or its id for a site not defined.
+func (sites *Sites) GetLabel(id uint) string {
+	if site, ok := sites.GetSite(id); ok && len(site.Label) > 0 {
+		return site.Label
+	}
+
+	return fmt.Sprintf("%d", id)
+}
+
+func (sites *Sites) Read(db *Database, systemId uint) error {
+	var (
+		err  error
+		rows *sql.Rows
+	)
+
+	sites.mutex.Lock()
+	defer sites.mutex.Unlock()
+
+	sites.List = []*Site{}
+
+	formatError := func(err error) error {
+		return fmt.Errorf("sites.read: %v", err)
+	}
+
+	if rows, err = db.Sql.Query("select `id`, `label`, `order` from `rdioScannerSites` where `systemId` = ?", systemId); err != nil {
+		return formatError(err)
+	}
+
+	for rows.Next() {
+		site := &Site{}
+
+		if err = rows.Scan(&site.Id, &site.Label, &site.Order); err != nil {
+			break
+		}
+
+		sites.List = append(sites.List, site)
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	sort.Slice(sites.List, func(i int, j int) bool {
+		return sites.List[i].Order < sites.List[j].Order
+	})
+
+	return nil
+}
+
+func (sites *Sites) Write(db *Database, systemId uint) error {
+	var (
+		count uint
+		err   error
+		ids   = []uint{}
+		rows  *sql.Rows
+	)
+
+	sites.mutex.Lock()
+	defer sites.mutex.Unlock()
+
+	formatError := func(err error) error {
+		return fmt.Errorf("sites.write: %v", err)
+	}
+
+	if rows, err = db.Sql.Query("select `id` from `rdioScannerSites` where `systemId` = ?", systemId); err != nil {
+		return formatError(err)
+	}
+
+	for rows.Next() {
+		var id uint
+		if err = rows.Scan(&id); err != nil {
+			break
+		}
+		remove := true
+		for _, site := range sites.List {
+			if site.Id == id {
+				remove = false
+				break
+			}
+		}
+		if remove {
+			ids = append(ids, id)
+		}
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	if len(ids) > 0 {
+		if _, err = db.Delete("rdioScannerSites").Where(SqlIn("id", ids), SqlWhere("`systemId` = ?", systemId)).Exec(); err != nil {
+			return formatError(err)
+		}
+	}
+
+	for _, site := range sites.List {
+		if err = db.Sql.QueryRow("select count(*) from `rdioScannerSites` where `id` = ? and `systemId` = ?", site.Id, systemId).Scan(&count); err != nil {
+			break
+		}
+
+		if count == 0 {
+			if _, err = db.Sql.Exec("insert into `rdioScannerSites` (`id`, `label`, `order`, `systemId`) values (?, ?, ?, ?)", site.Id, site.Label, site.Order, systemId); err != nil {
+				break
+			}
+
+		} else if _, err = db.Sql.Exec("update `rdioScannerSites` set `label` = ?, `order` = ? where `id` = ? and `systemId` = ?", site.Label, site.Order, site.Id, systemId); err != nil {
+			break
+		}
+	}
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	return nil
+}
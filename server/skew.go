@@ -0,0 +1,257 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// calls dated further in the future than this are logged at ingest
+	callFutureTolerance = time.Minute
+
+	// calls received later than this after their timestamp are listed as
+	// out of order
+	callLateTolerance = time.Hour
+)
+
+// SkewedCall is a call whose timestamp is in the future or far from the
+// moment it was received. The skew is the delay between the timestamp and
+// the reception, negative for calls that were dated in the future.
+type SkewedCall struct {
+	Id         uint       `json:"id"`
+	DateTime   time.Time  `json:"dateTime"`
+	ReceivedAt *time.Time `json:"receivedAt,omitempty"`
+	Skew       int64      `json:"skew"`
+	System     uint       `json:"system"`
+	Talkgroup  uint       `json:"talkgroup"`
+}
+
+// CorrectDateTime moves the timestamp of the given calls either to dateTime
+// or, when it is zero, to the moment each call was received. It returns how
+// many calls were corrected.
+func (calls *Calls) CorrectDateTime(db *Database, ids []uint, dateTime time.Time) (int, error) {
+	var (
+		count   int
+		current time.Time
+		err     error
+		skew    int64
+		t       any
+	)
+
+	calls.mutex.Lock()
+	defer calls.mutex.Unlock()
+
+	formatError := func(err error) error {
+		return fmt.Errorf("calls.correctdatetime: %v", err)
+	}
+
+	for _, id := range ids {
+		if err = db.Sql.QueryRow("select `dateTime`, `skew` from `rdioScannerCalls` where `id` = ?", id).Scan(&t, &skew); err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return count, formatError(err)
+		}
+
+		if current, err = db.ParseDateTime(t); err != nil {
+			continue
+		}
+
+		receivedAt := current.Add(time.Duration(skew) * time.Second)
+
+		corrected := dateTime
+		if corrected.IsZero() {
+			if skew == 0 {
+				continue
+			}
+			corrected = receivedAt
+		}
+
+		// calls stored before the skew was recorded have no reception time
+		if skew != 0 {
+			skew = int64(receivedAt.Sub(corrected).Seconds())
+		}
+
+		if _, err = db.Sql.Exec("update `rdioScannerCalls` set `dateTime` = ?, `skew` = ? where `id` = ?", corrected, skew, id); err != nil {
+			return count, formatError(err)
+		}
+
+		count++
+	}
+
+	return count, nil
+}
+
+// GetSkewed lists the calls dated more than future ahead of now or received
+// more than late after their timestamp, the most recent first.
+func (calls *Calls) GetSkewed(db *Database, future time.Duration, late time.Duration, limit uint) ([]*SkewedCall, error) {
+	var (
+		dateTime any
+		err      error
+		rows     *sql.Rows
+		skewed   = []*SkewedCall{}
+	)
+
+	calls.mutex.Lock()
+	defer calls.mutex.Unlock()
+
+	formatError := func(err error) error {
+		return fmt.Errorf("calls.getskewed: %v", err)
+	}
+
+	query := "select `id`, `dateTime`, `skew`, `system`, `talkgroup` from `rdioScannerCalls` where `dateTime` > ? or `skew` < ? or `skew` > ? order by `dateTime` desc limit ?"
+	if rows, err = db.Sql.Query(query, time.Now().UTC().Add(future), -int64(future.Seconds()), int64(late.Seconds()), limit); err != nil {
+		return nil, formatError(err)
+	}
+
+	for rows.Next() {
+		call := &SkewedCall{}
+
+		if err = rows.Scan(&call.Id, &dateTime, &call.Skew, &call.System, &call.Talkgroup); err != nil {
+			break
+		}
+
+		if call.DateTime, err = db.ParseDateTime(dateTime); err != nil {
+			err = nil
+			continue
+		}
+
+		if call.Skew != 0 {
+			receivedAt := call.DateTime.Add(time.Duration(call.Skew) * time.Second)
+			call.ReceivedAt = &receivedAt
+		}
+
+		skewed = append(skewed, call)
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return nil, formatError(err)
+	}
+
+	return skewed, nil
+}
+
+func (admin *Admin) SkewedCallsHandler(w http.ResponseWriter, r *http.Request) {
+	const defaultLimit = 200
+
+	if !admin.Authorize(w, r, adminWriteRole(r)) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var (
+			future = callFutureTolerance
+			late   = callLateTolerance
+			limit  = uint(defaultLimit)
+			query  = r.URL.Query()
+		)
+
+		if i, err := strconv.Atoi(query.Get("future")); err == nil && i >= 0 {
+			future = time.Duration(i) * time.Second
+		}
+
+		if i, err := strconv.Atoi(query.Get("late")); err == nil && i > 0 {
+			late = time.Duration(i) * time.Second
+		}
+
+		if i, err := strconv.Atoi(query.Get("limit")); err == nil && i > 0 {
+			limit = uint(i)
+		}
+
+		skewed, err := admin.Controller.Calls.GetSkewed(admin.Controller.Database, future, late, limit)
+		if err != nil {
+			admin.Controller.Logs.LogEvent(LogLevelError, err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if b, err := json.Marshal(skewed); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+
+	case http.MethodPut:
+		var (
+			dateTime time.Time
+			ids      = []uint{}
+			m        = map[string]any{}
+		)
+
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		switch v := m["ids"].(type) {
+		case []any:
+			for _, f := range v {
+				switch id := f.(type) {
+				case float64:
+					if id > 0 {
+						ids = append(ids, uint(id))
+					}
+				}
+			}
+		}
+
+		switch v := m["dateTime"].(type) {
+		case string:
+			if len(strings.TrimSpace(v)) > 0 {
+				var err error
+				if dateTime, err = time.Parse(time.RFC3339, v); err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				dateTime = dateTime.UTC()
+			}
+		}
+
+		if len(ids) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		count, err := admin.Controller.Calls.CorrectDateTime(admin.Controller.Database, ids, dateTime)
+		if err != nil {
+			admin.Controller.Logs.LogEvent(LogLevelError, err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		admin.Controller.Logs.LogEvent(LogLevelInfo, fmt.Sprintf("admin: timestamp corrected for %d call(s)", count))
+
+		if b, err := json.Marshal(map[string]any{"corrected": count}); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
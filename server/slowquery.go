@@ -0,0 +1,638 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// slowQueriesMax bounds the number of query patterns kept, the new patterns
+// being dropped once it is reached.
+const slowQueriesMax = 500
+
+var (
+	slowQueryIn      = regexp.MustCompile(`\(\s*\?(?:\s*,\s*\?)*\s*\)`)
+	slowQueryNumber  = regexp.MustCompile(`\b\d+(?:\.\d+)?\b`)
+	slowQuerySpaces  = regexp.MustCompile(`\s+`)
+	slowQueryString  = regexp.MustCompile(`'(?:[^']|'')*'`)
+	slowQueryTable   = regexp.MustCompile("(?i)\\b(?:from|update|into)\\s+[`\"](\\w+)[`\"]")
+	slowQueryWhere   = regexp.MustCompile("(?is)\\bwhere\\b(.*?)(?:\\border\\s+by\\b|\\bgroup\\s+by\\b|\\blimit\\b|$)")
+	slowQueryOrderBy = regexp.MustCompile("(?is)\\border\\s+by\\b(.*?)(?:\\blimit\\b|$)")
+	slowQueryEqual   = regexp.MustCompile("(?i)[`\"](\\w+)[`\"]\\s*(?:=\\s*\\?|in\\s*\\(|is\\s+null)")
+	slowQueryRange   = regexp.MustCompile("(?i)[`\"](\\w+)[`\"]\\s*(?:[<>]=?\\s*\\?|between\\b|like\\s+\\?)")
+	slowQueryColumn  = regexp.MustCompile("[`\"](\\w+)[`\"]")
+	slowQueryOr      = regexp.MustCompile(`(?i)\bor\b`)
+	slowQueryWords   = regexp.MustCompile(`([a-z0-9])([A-Z])`)
+)
+
+// SlowQueries aggregates the queries that took longer than the db_slow_query
+// threshold by pattern, that is with their literals and lists of values
+// replaced by placeholders, and derives index recommendations from them.
+type SlowQueries struct {
+	config   *Config
+	dropped  uint
+	patterns map[string]*SlowQuery
+	mutex    sync.Mutex
+}
+
+type SlowQuery struct {
+	Count    uint      `json:"count"`
+	LastSeen time.Time `json:"lastSeen"`
+	MaxMs    int64     `json:"maxMs"`
+	Pattern  string    `json:"pattern"`
+	Table    string    `json:"table,omitempty"`
+	TotalMs  int64     `json:"totalMs"`
+}
+
+type IndexRecommendation struct {
+	Columns   []string `json:"columns"`
+	Count     uint     `json:"count"`
+	Patterns  []string `json:"patterns"`
+	Statement string   `json:"statement"`
+	Table     string   `json:"table"`
+	TotalMs   int64    `json:"totalMs"`
+}
+
+func NewSlowQueries(config *Config) *SlowQueries {
+	return &SlowQueries{
+		config:   config,
+		patterns: map[string]*SlowQuery{},
+		mutex:    sync.Mutex{},
+	}
+}
+
+func (admin *Admin) IndexAdvisorHandler(w http.ResponseWriter, r *http.Request) {
+	db := admin.Controller.Database
+
+	if !admin.Authorize(w, r, adminWriteRole(r)) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		recommendations, err := db.SlowQueries.Recommend(db)
+		if err != nil {
+			admin.Controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("admin.indexadvisor: %v", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		queries, dropped := db.SlowQueries.List()
+
+		if b, err := json.Marshal(map[string]any{
+			"dropped":         dropped,
+			"queries":         queries,
+			"recommendations": recommendations,
+			"thresholdMs":     admin.Controller.Config.DbSlowQuery,
+		}); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+
+	case http.MethodDelete:
+		db.SlowQueries.Reset()
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// List returns the patterns, the slowest in total first, with the count of
+// the patterns dropped.
+func (slowQueries *SlowQueries) List() ([]SlowQuery, uint) {
+	slowQueries.mutex.Lock()
+	defer slowQueries.mutex.Unlock()
+
+	list := []SlowQuery{}
+	for _, q := range slowQueries.patterns {
+		list = append(list, *q)
+	}
+
+	sort.Slice(list, func(i int, j int) bool {
+		return list[i].TotalMs > list[j].TotalMs
+	})
+
+	return list, slowQueries.dropped
+}
+
+// Recommend suggests an index for each table and set of columns filtered on
+// by the slow patterns, unless an existing index already starts with them.
+// The columns compared for equality come first, then the ones compared on a
+// range and finally the sort column.
+func (slowQueries *SlowQueries) Recommend(db *Database) ([]*IndexRecommendation, error) {
+	var (
+		indexes         = map[string][][]string{}
+		recommendations = map[string]*IndexRecommendation{}
+	)
+
+	queries, _ := slowQueries.List()
+
+	for _, q := range queries {
+		if len(q.Table) == 0 {
+			continue
+		}
+
+		columns := slowQueryColumns(q.Pattern)
+		if len(columns) == 0 {
+			continue
+		}
+
+		if _, ok := indexes[q.Table]; !ok {
+			a, err := db.Indexes(q.Table)
+			if err != nil {
+				return nil, err
+			}
+			indexes[q.Table] = a
+		}
+
+		if slowQueryIndexed(indexes[q.Table], columns) {
+			continue
+		}
+
+		key := q.Table + "." + strings.Join(columns, ".")
+
+		recommendation, ok := recommendations[key]
+		if !ok {
+			quoted := make([]string, len(columns))
+			for i, column := range columns {
+				quoted[i] = fmt.Sprintf("`%s`", column)
+			}
+
+			recommendation = &IndexRecommendation{
+				Columns:   columns,
+				Patterns:  []string{},
+				Statement: fmt.Sprintf("create index `%s` on `%s` (%s)", slowQueryIndexName(q.Table, columns), q.Table, strings.Join(quoted, ", ")),
+				Table:     q.Table,
+			}
+			recommendations[key] = recommendation
+		}
+
+		recommendation.Count += q.Count
+		recommendation.Patterns = append(recommendation.Patterns, q.Pattern)
+		recommendation.TotalMs += q.TotalMs
+	}
+
+	list := []*IndexRecommendation{}
+	for _, recommendation := range recommendations {
+		list = append(list, recommendation)
+	}
+
+	sort.Slice(list, func(i int, j int) bool {
+		return list[i].TotalMs > list[j].TotalMs
+	})
+
+	return list, nil
+}
+
+func (slowQueries *SlowQueries) Reset() {
+	slowQueries.mutex.Lock()
+	defer slowQueries.mutex.Unlock()
+
+	slowQueries.dropped = 0
+	slowQueries.patterns = map[string]*SlowQuery{}
+}
+
+func (slowQueries *SlowQueries) record(query string, d time.Duration) {
+	threshold := time.Duration(slowQueries.config.DbSlowQuery) * time.Millisecond
+
+	if threshold == 0 || d < threshold {
+		return
+	}
+
+	pattern := slowQueryPattern(query)
+
+	slowQueries.mutex.Lock()
+	defer slowQueries.mutex.Unlock()
+
+	q, ok := slowQueries.patterns[pattern]
+	if !ok {
+		if len(slowQueries.patterns) >= slowQueriesMax {
+			slowQueries.dropped++
+			return
+		}
+
+		q = &SlowQuery{Pattern: pattern}
+
+		if m := slowQueryTable.FindStringSubmatch(pattern); m != nil {
+			q.Table = m[1]
+		}
+
+		slowQueries.patterns[pattern] = q
+	}
+
+	ms := d.Milliseconds()
+
+	q.Count++
+	q.LastSeen = time.Now().UTC()
+	q.TotalMs += ms
+
+	if ms > q.MaxMs {
+		q.MaxMs = ms
+	}
+}
+
+// Indexes returns the columns of each index of the table, in order.
+func (db *Database) Indexes(table string) ([][]string, error) {
+	var (
+		err     error
+		indexes = map[string][]string{}
+		rows    *sql.Rows
+	)
+
+	switch db.Config.DbType {
+	case DbTypeSqlite:
+		names := []string{}
+
+		// the integer primary key is the rowid, which isn't listed as an index
+		if rows, err = db.Sql.Query(fmt.Sprintf("select `name` from pragma_table_info('%s') where `pk` > 0 order by `pk`", table)); err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var column string
+			if err = rows.Scan(&column); err != nil {
+				break
+			}
+			indexes[""] = append(indexes[""], column)
+		}
+		rows.Close()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if rows, err = db.Sql.Query(fmt.Sprintf("select `name` from pragma_index_list('%s')", table)); err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var name string
+			if err = rows.Scan(&name); err != nil {
+				break
+			}
+			names = append(names, name)
+		}
+		rows.Close()
+
+		for _, name := range names {
+			if err != nil {
+				break
+			}
+			if rows, err = db.Sql.Query(fmt.Sprintf("select `name` from pragma_index_info('%s') order by `seqno`", name)); err != nil {
+				return nil, err
+			}
+			for rows.Next() {
+				var column sql.NullString
+				if err = rows.Scan(&column); err != nil {
+					break
+				}
+				indexes[name] = append(indexes[name], column.String)
+			}
+			rows.Close()
+		}
+
+	case DbTypeMariadb, DbTypeMysql:
+		if rows, err = db.Sql.Query("select `index_name`, `column_name` from `information_schema`.`statistics` where `table_schema` = database() and `table_name` = ? order by `index_name`, `seq_in_index`", table); err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var name, column string
+			if err = rows.Scan(&name, &column); err != nil {
+				break
+			}
+			indexes[name] = append(indexes[name], column)
+		}
+		rows.Close()
+
+	case DbTypePostgres:
+		if rows, err = db.Sql.Query("select i.relname, a.attname from pg_index x join pg_class t on t.oid = x.indrelid join pg_class i on i.oid = x.indexrelid join pg_namespace n on n.oid = t.relnamespace join lateral unnest(x.indkey::int2[]) with ordinality as k(attnum, ord) on true join pg_attribute a on a.attrelid = t.oid and a.attnum = k.attnum where n.nspname = current_schema() and t.relname = ? order by i.relname, k.ord", table); err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var name, column string
+			if err = rows.Scan(&name, &column); err != nil {
+				break
+			}
+			indexes[name] = append(indexes[name], column)
+		}
+		rows.Close()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	list := [][]string{}
+	for _, columns := range indexes {
+		list = append(list, columns)
+	}
+
+	return list, nil
+}
+
+// slowQueryColumns returns the columns an index should have for the pattern.
+func slowQueryColumns(pattern string) []string {
+	var (
+		columns = []string{}
+		seen    = map[string]bool{}
+	)
+
+	add := func(column string) {
+		if !seen[column] {
+			seen[column] = true
+			columns = append(columns, column)
+		}
+	}
+
+	if m := slowQueryWhere.FindStringSubmatch(pattern); m != nil {
+		// a where clause with an or can't be served by a single index
+		if !slowQueryOr.MatchString(m[1]) {
+			for _, c := range slowQueryEqual.FindAllStringSubmatch(m[1], -1) {
+				add(c[1])
+			}
+			for _, c := range slowQueryRange.FindAllStringSubmatch(m[1], -1) {
+				add(c[1])
+			}
+		}
+	}
+
+	if m := slowQueryOrderBy.FindStringSubmatch(pattern); m != nil {
+		if c := slowQueryColumn.FindStringSubmatch(m[1]); c != nil {
+			add(c[1])
+		}
+	}
+
+	return columns
+}
+
+// slowQueryIndexed tells if one of the indexes starts with the first of the
+// columns and covers as many of them as the columns it shares with them.
+func slowQueryIndexed(indexes [][]string, columns []string) bool {
+	for _, index := range indexes {
+		if len(index) == 0 || index[0] != columns[0] {
+			continue
+		}
+
+		covered := 0
+		for _, column := range index {
+			if covered < len(columns) && strings.EqualFold(column, columns[covered]) {
+				covered++
+			} else {
+				break
+			}
+		}
+
+		if covered == len(columns) || covered == len(index) && covered > 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func slowQueryIndexName(table string, columns []string) string {
+	name := slowQueryWords.ReplaceAllString(table, "${1}_${2}")
+
+	return strings.ToLower(fmt.Sprintf("%s_%s", name, strings.Join(columns, "_")))
+}
+
+func slowQueryPattern(query string) string {
+	query = slowQueryString.ReplaceAllString(query, "?")
+	query = slowQueryNumber.ReplaceAllString(query, "?")
+	query = slowQueryIn.ReplaceAllString(query, "(?)")
+
+	return strings.TrimSpace(slowQuerySpaces.ReplaceAllString(query, " "))
+}
+
+// slowQueryConnector opens the connections of a driver, timing their queries
+// for the slow queries.
+type slowQueryConnector struct {
+	driver      driver.Driver
+	dsn         string
+	slowQueries *SlowQueries
+}
+
+func (connector *slowQueryConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := connector.driver.Open(connector.dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &slowQueryConn{Conn: conn, slowQueries: connector.slowQueries}, nil
+}
+
+func (connector *slowQueryConnector) Driver() driver.Driver {
+	return connector.driver
+}
+
+type slowQueryConn struct {
+	driver.Conn
+	slowQueries *SlowQueries
+}
+
+func (conn *slowQueryConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if c, ok := conn.Conn.(driver.ConnBeginTx); ok {
+		return c.BeginTx(ctx, opts)
+	}
+
+	return conn.Conn.Begin()
+}
+
+func (conn *slowQueryConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if c, ok := conn.Conn.(driver.NamedValueChecker); ok {
+		return c.CheckNamedValue(nv)
+	}
+
+	return driver.ErrSkip
+}
+
+func (conn *slowQueryConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c, ok := conn.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	start := time.Now()
+	res, err := c.ExecContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		conn.slowQueries.record(query, time.Since(start))
+	}
+
+	return res, err
+}
+
+func (conn *slowQueryConn) IsValid() bool {
+	if c, ok := conn.Conn.(driver.Validator); ok {
+		return c.IsValid()
+	}
+
+	return true
+}
+
+func (conn *slowQueryConn) Ping(ctx context.Context) error {
+	if c, ok := conn.Conn.(driver.Pinger); ok {
+		return c.Ping(ctx)
+	}
+
+	return nil
+}
+
+func (conn *slowQueryConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var (
+		err  error
+		stmt driver.Stmt
+	)
+
+	if c, ok := conn.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = c.PrepareContext(ctx, query)
+	} else {
+		stmt, err = conn.Conn.Prepare(query)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &slowQueryStmt{Stmt: stmt, query: query, slowQueries: conn.slowQueries}, nil
+}
+
+// QueryContext times the query until its rows are closed, as some drivers
+// only run it on the first read.
+func (conn *slowQueryConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c, ok := conn.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	start := time.Now()
+	rows, err := c.QueryContext(ctx, query, args)
+	if err != nil {
+		if err != driver.ErrSkip {
+			conn.slowQueries.record(query, time.Since(start))
+		}
+		return nil, err
+	}
+
+	return &slowQueryRows{Rows: rows, query: query, slowQueries: conn.slowQueries, start: start}, nil
+}
+
+func (conn *slowQueryConn) ResetSession(ctx context.Context) error {
+	if c, ok := conn.Conn.(driver.SessionResetter); ok {
+		return c.ResetSession(ctx)
+	}
+
+	return nil
+}
+
+type slowQueryStmt struct {
+	driver.Stmt
+	query       string
+	slowQueries *SlowQueries
+}
+
+func (stmt *slowQueryStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if s, ok := stmt.Stmt.(driver.NamedValueChecker); ok {
+		return s.CheckNamedValue(nv)
+	}
+
+	return driver.ErrSkip
+}
+
+func (stmt *slowQueryStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	var (
+		err error
+		res driver.Result
+	)
+
+	start := time.Now()
+
+	if s, ok := stmt.Stmt.(driver.StmtExecContext); ok {
+		res, err = s.ExecContext(ctx, args)
+	} else {
+		res, err = stmt.Stmt.Exec(slowQueryValues(args))
+	}
+
+	stmt.slowQueries.record(stmt.query, time.Since(start))
+
+	return res, err
+}
+
+func (stmt *slowQueryStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	var (
+		err  error
+		rows driver.Rows
+	)
+
+	start := time.Now()
+
+	if s, ok := stmt.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = s.QueryContext(ctx, args)
+	} else {
+		rows, err = stmt.Stmt.Query(slowQueryValues(args))
+	}
+
+	if err != nil {
+		stmt.slowQueries.record(stmt.query, time.Since(start))
+		return nil, err
+	}
+
+	return &slowQueryRows{Rows: rows, query: stmt.query, slowQueries: stmt.slowQueries, start: start}, nil
+}
+
+type slowQueryRows struct {
+	driver.Rows
+	query       string
+	slowQueries *SlowQueries
+	start       time.Time
+}
+
+func (rows *slowQueryRows) Close() error {
+	err := rows.Rows.Close()
+
+	rows.slowQueries.record(rows.query, time.Since(rows.start))
+
+	return err
+}
+
+// ColumnTypeDatabaseTypeName passes on the column types of the driver, which
+// the backups need to tell the binary and datetime columns apart.
+func (rows *slowQueryRows) ColumnTypeDatabaseTypeName(index int) string {
+	if r, ok := rows.Rows.(driver.RowsColumnTypeDatabaseTypeName); ok {
+		return r.ColumnTypeDatabaseTypeName(index)
+	}
+
+	return ""
+}
+
+func slowQueryValues(args []driver.NamedValue) []driver.Value {
+	values := make([]driver.Value, len(args))
+
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+
+	return values
+}
@@ -0,0 +1,191 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	publisherMastodonLength = 500
+	publisherSnippetLength  = 200
+	publisherTemplate       = "{{.Talkgroup}} on {{.System}} at {{.Time}}{{if .Unit}} from {{.Unit}}{{end}}{{if .Transcript}}: {{.Transcript}}{{end}}"
+	publisherXLength        = 280
+)
+
+var errPublisherRate = errors.New("rate limit reached")
+
+// publisherPost holds the fields of the call given to the template of a
+// social publisher. Transcript is a snippet of the transcript and Code the
+// share code of the call, for the audio link, ie:
+// https://scanner.example.com/c/{{.Code}}.
+type publisherPost struct {
+	Code          string
+	DateTime      time.Time
+	Group         string
+	Id            any
+	System        string
+	Tag           string
+	Talkgroup     string
+	TalkgroupName string
+	Time          string
+	Transcript    string
+	Unit          string
+}
+
+// post posts the call to the mastodon or the x api, once the rate of the
+// publisher allows it. The event id is the idempotency key of mastodon.
+func (publisher *Publisher) post(event *publisherEvent, id string, broker string) error {
+	now := time.Now()
+
+	posts := []time.Time{}
+	for _, t := range publisher.posts {
+		if now.Sub(t) < time.Hour {
+			posts = append(posts, t)
+		}
+	}
+	publisher.posts = posts
+
+	if publisher.Rate > 0 && uint(len(publisher.posts)) >= publisher.Rate {
+		return errPublisherRate
+	}
+
+	text, err := publisher.postText(event)
+	if err != nil {
+		return err
+	}
+
+	u, err := url.Parse(broker)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid api url %s", u.Redacted())
+	}
+
+	if u.User == nil || len(u.User.Username()) == 0 {
+		return errors.New("no access token")
+	}
+
+	token := u.User.Username()
+	u.User = nil
+
+	var req *http.Request
+
+	switch publisher.Type {
+	case PublisherTypeMastodon:
+		form := url.Values{"status": {shareExcerpt(text, publisherMastodonLength-3)}}
+		if visibility := u.Query().Get("visibility"); len(visibility) > 0 {
+			form.Set("visibility", visibility)
+		}
+
+		u.RawQuery = ""
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v1/statuses"
+
+		if req, err = http.NewRequest(http.MethodPost, u.String(), strings.NewReader(form.Encode())); err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Idempotency-Key", id)
+
+	case PublisherTypeX:
+		b, err := json.Marshal(map[string]any{"text": shareExcerpt(text, publisherXLength-3)})
+		if err != nil {
+			return err
+		}
+
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/2/tweets"
+
+		if req, err = http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(b)); err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	c := http.Client{Timeout: publisherTimeout}
+
+	res, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("bad status: %s", res.Status)
+	}
+
+	publisher.posts = append(publisher.posts, now)
+
+	return nil
+}
+
+// postText returns the text of the post of the call from the template of the
+// publisher, or the default one.
+func (publisher *Publisher) postText(event *publisherEvent) (string, error) {
+	call := event.call
+
+	label := func(v any, def string) string {
+		if s, ok := v.(string); ok && len(s) > 0 {
+			return s
+		}
+		return def
+	}
+
+	post := publisherPost{
+		DateTime:      call.DateTime.Local(),
+		Group:         label(call.talkgroupGroup, ""),
+		Id:            call.Id,
+		System:        label(call.systemLabel, fmt.Sprintf("%d", call.System)),
+		Tag:           label(call.talkgroupTag, ""),
+		Talkgroup:     label(call.talkgroupLabel, fmt.Sprintf("%d", call.Talkgroup)),
+		TalkgroupName: label(call.talkgroupName, ""),
+		Time:          call.DateTime.Local().Format("15:04"),
+		Transcript:    shareExcerpt(strings.TrimSpace(event.transcript), publisherSnippetLength),
+		Unit:          publisherUnit(call, publisher.systems),
+	}
+
+	if id, ok := call.Id.(uint); ok && publisher.shares != nil {
+		post.Code = publisher.shares.Code(id)
+	}
+
+	text := publisher.Template
+	if len(strings.TrimSpace(text)) == 0 {
+		text = publisherTemplate
+	}
+
+	t, err := template.New("post").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	if err = t.Execute(&b, post); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(b.String()), nil
+}
@@ -0,0 +1,277 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// socialRequest is a post received by the fake api.
+type socialRequest struct {
+	auth  string
+	body  string
+	key   string
+	path  string
+	query string
+}
+
+func newSocialServer(t *testing.T, status int) (*httptest.Server, chan socialRequest) {
+	requests := make(chan socialRequest, 10)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		requests <- socialRequest{auth: r.Header.Get("Authorization"), body: string(b), key: r.Header.Get("Idempotency-Key"), path: r.URL.Path, query: r.URL.RawQuery}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, requests
+}
+
+func newSocialCall() *Call {
+	return &Call{
+		DateTime:       time.Date(2026, 10, 14, 12, 30, 0, 0, time.Local),
+		Id:             uint(42),
+		Source:         uint(1234),
+		System:         1,
+		Talkgroup:      2,
+		systemLabel:    "County",
+		talkgroupLabel: "Fire",
+		talkgroupName:  "Fire Dispatch",
+		talkgroupTag:   "Fire Dispatch",
+	}
+}
+
+func TestPublisherPostText(t *testing.T) {
+	shares := NewShares(&Controller{Options: &Options{secret: "secret"}})
+
+	tests := []struct {
+		name       string
+		template   string
+		call       *Call
+		transcript string
+		want       string
+		err        bool
+	}{
+		{
+			name: "default",
+			call: newSocialCall(),
+			want: "Fire on County at 12:30 from Engine 5",
+		},
+		{
+			name:       "default with transcript",
+			call:       newSocialCall(),
+			transcript: " engine 5 respond ",
+			want:       "Fire on County at 12:30 from Engine 5: engine 5 respond",
+		},
+		{
+			name: "unknown labels",
+			call: &Call{DateTime: time.Date(2026, 10, 14, 8, 5, 0, 0, time.Local), System: 3, Talkgroup: 4},
+			want: "4 on 3 at 08:05",
+		},
+		{
+			name:     "custom",
+			template: "{{.TalkgroupName}} #{{.Tag}} https://scanner.example.com/c/{{.Code}}",
+			call:     newSocialCall(),
+			want:     "Fire Dispatch #Fire Dispatch https://scanner.example.com/c/" + shares.Code(42),
+		},
+		{
+			name:       "snippet",
+			template:   "{{.Transcript}}",
+			call:       newSocialCall(),
+			transcript: strings.Repeat("word ", 100),
+			want:       strings.TrimSpace(strings.Repeat("word ", 40)) + "...",
+		},
+		{
+			name:     "invalid",
+			template: "{{.Talkgroup",
+			call:     newSocialCall(),
+			err:      true,
+		},
+		{
+			name:     "unknown field",
+			template: "{{.Nope}}",
+			call:     newSocialCall(),
+			err:      true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			publisher := &Publisher{Template: test.template, shares: shares, systems: newTestHomeAssistantSystems()}
+
+			got, err := publisher.postText(&publisherEvent{call: test.call, transcript: test.transcript})
+			if test.err {
+				if err == nil {
+					t.Fatalf("got %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPublisherPost(t *testing.T) {
+	tests := []struct {
+		name    string
+		kind    string
+		path    string
+		status  int
+		check   func(t *testing.T, request socialRequest)
+		err     bool
+		noToken bool
+	}{
+		{
+			name:   "mastodon",
+			kind:   PublisherTypeMastodon,
+			path:   "/?visibility=unlisted",
+			status: http.StatusOK,
+			check: func(t *testing.T, request socialRequest) {
+				form, _ := url.ParseQuery(request.body)
+				if request.path != "/api/v1/statuses" || request.query != "" || request.key != "event" || form.Get("visibility") != "unlisted" || len([]rune(form.Get("status"))) > publisherMastodonLength {
+					t.Errorf("got %+v", request)
+				}
+			},
+		},
+		{
+			name:   "x",
+			kind:   PublisherTypeX,
+			status: http.StatusCreated,
+			check: func(t *testing.T, request socialRequest) {
+				m := map[string]string{}
+				json.Unmarshal([]byte(request.body), &m)
+				if request.path != "/2/tweets" || len([]rune(m["text"])) > publisherXLength || !strings.HasSuffix(m["text"], "...") {
+					t.Errorf("got %+v", request)
+				}
+			},
+		},
+		{
+			name:   "bad status",
+			kind:   PublisherTypeX,
+			status: http.StatusTooManyRequests,
+			err:    true,
+		},
+		{
+			name:    "no token",
+			kind:    PublisherTypeMastodon,
+			status:  http.StatusOK,
+			err:     true,
+			noToken: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, requests := newSocialServer(t, test.status)
+
+			u, _ := url.Parse(server.URL + test.path)
+			if !test.noToken {
+				u.User = url.User("token")
+			}
+
+			publisher := &Publisher{Template: strings.Repeat("long text ", 60), Type: test.kind}
+
+			err := publisher.post(&publisherEvent{call: newSocialCall()}, "event", u.String())
+			if test.err {
+				if err == nil {
+					t.Fatal("want an error")
+				}
+				if len(publisher.posts) > 0 {
+					t.Error("failed post counted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			request := <-requests
+			if request.auth != "Bearer token" {
+				t.Errorf("got authorization %q", request.auth)
+			}
+			test.check(t, request)
+		})
+	}
+}
+
+func TestPublisherPostRate(t *testing.T) {
+	server, requests := newSocialServer(t, http.StatusOK)
+
+	broker := strings.Replace(server.URL, "://", "://token@", 1)
+
+	publisher := &Publisher{Rate: 2, Type: PublisherTypeMastodon, posts: []time.Time{time.Now().Add(-2 * time.Hour)}}
+
+	for i, want := range []error{nil, nil, errPublisherRate} {
+		if err := publisher.post(&publisherEvent{call: newSocialCall()}, "event", broker); !errors.Is(err, want) {
+			t.Fatalf("post %d: got %v, want %v", i, err, want)
+		}
+	}
+
+	if len(requests) != 2 {
+		t.Errorf("got %d posts, want 2", len(requests))
+	}
+
+	// the older post leaves the window
+	publisher.posts[0] = time.Now().Add(-time.Hour)
+
+	if err := publisher.post(&publisherEvent{call: newSocialCall()}, "event", broker); err != nil {
+		t.Errorf("got %v once the window moved", err)
+	}
+}
+
+func TestPublisherSocialTranscripts(t *testing.T) {
+	server, requests := newSocialServer(t, http.StatusOK)
+
+	publisher := &Publisher{
+		Brokers:     strings.Replace(server.URL, "://", "://token@", 1),
+		Template:    "{{.Transcript}}",
+		Transcripts: true,
+		Type:        PublisherTypeX,
+	}
+
+	if err := publisher.Publish(newSocialCall(), "event"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requests) != 0 {
+		t.Fatal("call posted before its transcript")
+	}
+
+	if err := publisher.PublishTranscript(newSocialCall(), "engine 5 respond", "event"); err != nil {
+		t.Fatal(err)
+	}
+
+	m := map[string]string{}
+	json.Unmarshal([]byte((<-requests).body), &m)
+	if m["text"] != "engine 5 respond" {
+		t.Errorf("got %q", m["text"])
+	}
+}
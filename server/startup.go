@@ -0,0 +1,165 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// startupModule is a part of the controller started once the modules it
+// comes after are.
+type startupModule struct {
+	name  string
+	after []string
+	start func() error
+}
+
+// runStartup starts the modules concurrently, each one as soon as those it
+// comes after are started, and logs how long each one took when logf is not
+// nil. A module is skipped when one it comes after failed. It returns the
+// error of the first module in the list to fail, nothing being started when
+// the modules come after unknown ones or after each other.
+func runStartup(modules []startupModule, logf func(format string, a ...any)) error {
+	formatError := func(err error) error {
+		return fmt.Errorf("startup: %v", err)
+	}
+
+	if err := startupCheck(modules); err != nil {
+		return formatError(err)
+	}
+
+	var (
+		done    = map[string]chan struct{}{}
+		errs    = make([]error, len(modules))
+		index   = map[string]int{}
+		skipped = make([]bool, len(modules))
+		start   = time.Now()
+	)
+
+	for i, module := range modules {
+		done[module.name] = make(chan struct{})
+		index[module.name] = i
+	}
+
+	for i, module := range modules {
+		go func(i int, module startupModule) {
+			defer close(done[module.name])
+
+			for _, name := range module.after {
+				<-done[name]
+
+				if errs[index[name]] != nil || skipped[index[name]] {
+					skipped[i] = true
+					return
+				}
+			}
+
+			t := time.Now()
+
+			if err := module.start(); err != nil {
+				errs[i] = err
+				return
+			}
+
+			if logf != nil {
+				logf("startup: %s in %v", module.name, time.Since(t).Round(time.Millisecond))
+			}
+		}(i, module)
+	}
+
+	for _, module := range modules {
+		<-done[module.name]
+	}
+
+	for i := range modules {
+		if errs[i] != nil {
+			return errs[i]
+		}
+	}
+
+	if logf != nil {
+		logf("startup: %d modules in %v", len(modules), time.Since(start).Round(time.Millisecond))
+	}
+
+	return nil
+}
+
+// startupCheck returns an error when modules have the same name, come after
+// unknown ones or after each other.
+func startupCheck(modules []startupModule) error {
+	after := map[string][]string{}
+
+	for _, module := range modules {
+		if _, ok := after[module.name]; ok {
+			return fmt.Errorf("duplicate module %s", module.name)
+		}
+		after[module.name] = module.after
+	}
+
+	for _, module := range modules {
+		for _, name := range module.after {
+			if _, ok := after[name]; !ok {
+				return fmt.Errorf("%s comes after the unknown module %s", module.name, name)
+			}
+		}
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+
+	state := map[string]int{}
+
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("modules come after each other, %s", strings.Join(append(path, name), " > "))
+		case visited:
+			return nil
+		}
+
+		state[name] = visiting
+
+		for _, next := range after[name] {
+			if err := visit(next, append(path, name)); err != nil {
+				return err
+			}
+		}
+
+		state[name] = visited
+
+		return nil
+	}
+
+	names := make([]string, 0, len(after))
+	for name := range after {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,198 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunStartupOrder(t *testing.T) {
+	var (
+		mutex sync.Mutex
+		order = []string{}
+	)
+
+	started := func(name string) func() error {
+		return func() error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			order = append(order, name)
+			return nil
+		}
+	}
+
+	modules := []startupModule{
+		{name: "scheduler", after: []string{"options", "retentions"}, start: started("scheduler")},
+		{name: "options", start: started("options")},
+		{name: "retentions", after: []string{"options"}, start: started("retentions")},
+		{name: "systems", start: started("systems")},
+	}
+
+	if err := runStartup(modules, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	position := map[string]int{}
+	for i, name := range order {
+		position[name] = i
+	}
+
+	if len(order) != len(modules) {
+		t.Fatalf("started %v", order)
+	}
+	if position["options"] > position["retentions"] || position["retentions"] > position["scheduler"] {
+		t.Errorf("started out of order %v", order)
+	}
+}
+
+func TestRunStartupConcurrent(t *testing.T) {
+	// each module waits for the other one to start, which only completes
+	// when they run at once
+	a, b := make(chan struct{}), make(chan struct{})
+
+	wait := func(mine chan struct{}, other chan struct{}) func() error {
+		return func() error {
+			close(mine)
+			select {
+			case <-other:
+				return nil
+			case <-time.After(5 * time.Second):
+				return errors.New("not started at once")
+			}
+		}
+	}
+
+	modules := []startupModule{
+		{name: "a", start: wait(a, b)},
+		{name: "b", start: wait(b, a)},
+	}
+
+	if err := runStartup(modules, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunStartupErrors(t *testing.T) {
+	fail := errors.New("systems.read: no such table")
+
+	ok := func() error { return nil }
+
+	tests := []struct {
+		name    string
+		modules []startupModule
+		err     string
+		started []string
+	}{
+		{
+			name: "failed module skips those after it",
+			modules: []startupModule{
+				{name: "systems", start: func() error { return fail }},
+				{name: "dirwatches", after: []string{"systems"}},
+				{name: "dirwatches.start", after: []string{"dirwatches"}},
+				{name: "options", start: ok},
+			},
+			err:     fail.Error(),
+			started: []string{"options"},
+		},
+		{
+			name:    "unknown module",
+			modules: []startupModule{{name: "jobs.start", after: []string{"jobs"}, start: ok}},
+			err:     "jobs.start comes after the unknown module jobs",
+		},
+		{
+			name:    "duplicate module",
+			modules: []startupModule{{name: "jobs", start: ok}, {name: "jobs", start: ok}},
+			err:     "duplicate module jobs",
+		},
+		{
+			name: "modules after each other",
+			modules: []startupModule{
+				{name: "a", after: []string{"c"}, start: ok},
+				{name: "b", after: []string{"a"}, start: ok},
+				{name: "c", after: []string{"b"}, start: ok},
+			},
+			err: "modules come after each other, a > c > b > a",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				mutex   sync.Mutex
+				started = []string{}
+			)
+
+			for i := range test.modules {
+				module := &test.modules[i]
+				start := module.start
+				name := module.name
+				module.start = func() error {
+					if start == nil {
+						t.Errorf("%s started", name)
+						return nil
+					}
+					if err := start(); err != nil {
+						return err
+					}
+					mutex.Lock()
+					started = append(started, name)
+					mutex.Unlock()
+					return nil
+				}
+			}
+
+			err := runStartup(test.modules, nil)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("got error %v, want %s", err, test.err)
+			}
+
+			if strings.Join(started, ",") != strings.Join(test.started, ",") {
+				t.Errorf("started %v, want %v", started, test.started)
+			}
+		})
+	}
+}
+
+func TestRunStartupLogs(t *testing.T) {
+	var (
+		logged = []string{}
+		mutex  sync.Mutex
+	)
+
+	logf := func(format string, a ...any) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		logged = append(logged, format)
+	}
+
+	modules := []startupModule{
+		{name: "options", start: func() error { return nil }},
+		{name: "scheduler.start", after: []string{"options"}, start: func() error { return nil }},
+	}
+
+	if err := runStartup(modules, logf); err != nil {
+		t.Fatal(err)
+	}
+
+	// one line for each module and one for all
+	if len(logged) != 3 {
+		t.Errorf("logged %v", logged)
+	}
+}
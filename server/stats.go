@@ -0,0 +1,536 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClientAgent is the anonymized view of a listener user agent. Only the
+// browser family and major version, the platform and the device class are
+// kept, the raw user agent string is discarded.
+type ClientAgent struct {
+	Browser  string
+	Device   string
+	Platform string
+}
+
+var (
+	clientAgentBrowsers = []struct {
+		name string
+		re   *regexp.Regexp
+	}{
+		{"Edge", regexp.MustCompile(`Edg(?:e|A|iOS)?/(\d+)`)},
+		{"Opera", regexp.MustCompile(`(?:OPR|Opera)/(\d+)`)},
+		{"Samsung Internet", regexp.MustCompile(`SamsungBrowser/(\d+)`)},
+		{"Firefox", regexp.MustCompile(`(?:Firefox|FxiOS)/(\d+)`)},
+		{"Chrome", regexp.MustCompile(`(?:Chrome|CriOS)/(\d+)`)},
+		{"Safari", regexp.MustCompile(`Version/(\d+).*Safari/`)},
+	}
+
+	clientAgentPlatforms = []struct {
+		name   string
+		tokens []string
+	}{
+		{"Android", []string{"Android"}},
+		{"iOS", []string{"iPhone", "iPad", "iPod"}},
+		{"Windows", []string{"Windows"}},
+		{"ChromeOS", []string{"CrOS"}},
+		{"macOS", []string{"Macintosh", "Mac OS X"}},
+		{"Linux", []string{"Linux", "X11"}},
+	}
+)
+
+func NewClientAgent(ua string) *ClientAgent {
+	const unknown = "Other"
+
+	agent := &ClientAgent{
+		Browser:  unknown,
+		Device:   "desktop",
+		Platform: unknown,
+	}
+
+	for _, b := range clientAgentBrowsers {
+		if m := b.re.FindStringSubmatch(ua); m != nil {
+			agent.Browser = b.name + " " + m[1]
+			break
+		}
+	}
+
+	for _, p := range clientAgentPlatforms {
+		for _, token := range p.tokens {
+			if strings.Contains(ua, token) {
+				agent.Platform = p.name
+				break
+			}
+		}
+		if agent.Platform != unknown {
+			break
+		}
+	}
+
+	switch {
+	case strings.Contains(ua, "iPad") || (strings.Contains(ua, "Android") && !strings.Contains(ua, "Mobile")):
+		agent.Device = "tablet"
+	case strings.Contains(ua, "Mobi") || strings.Contains(ua, "iPhone"):
+		agent.Device = "mobile"
+	case agent.Browser == unknown && agent.Platform == unknown:
+		agent.Device = unknown
+	}
+
+	return agent
+}
+
+type ClientStatsBreakdown struct {
+	Browsers  map[string]uint64 `json:"browsers"`
+	Devices   map[string]uint64 `json:"devices"`
+	Platforms map[string]uint64 `json:"platforms"`
+}
+
+func NewClientStatsBreakdown() *ClientStatsBreakdown {
+	return &ClientStatsBreakdown{
+		Browsers:  map[string]uint64{},
+		Devices:   map[string]uint64{},
+		Platforms: map[string]uint64{},
+	}
+}
+
+func (breakdown *ClientStatsBreakdown) Add(agent *ClientAgent) {
+	breakdown.Browsers[agent.Browser]++
+	breakdown.Devices[agent.Device]++
+	breakdown.Platforms[agent.Platform]++
+}
+
+func (breakdown *ClientStatsBreakdown) Copy() *ClientStatsBreakdown {
+	c := NewClientStatsBreakdown()
+
+	for k, v := range breakdown.Browsers {
+		c.Browsers[k] = v
+	}
+
+	for k, v := range breakdown.Devices {
+		c.Devices[k] = v
+	}
+
+	for k, v := range breakdown.Platforms {
+		c.Platforms[k] = v
+	}
+
+	return c
+}
+
+type Stats struct {
+	Controller  *Controller
+	connections *ClientStatsBreakdown
+	startedAt   time.Time
+	mutex       sync.Mutex
+}
+
+func NewStats(controller *Controller) *Stats {
+	return &Stats{
+		Controller:  controller,
+		connections: NewClientStatsBreakdown(),
+		startedAt:   time.Now().UTC(),
+		mutex:       sync.Mutex{},
+	}
+}
+
+func (stats *Stats) ClientConnected(agent *ClientAgent) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	stats.connections.Add(agent)
+}
+
+func (admin *Admin) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	if !admin.Authorize(w, r, AdminRoleViewer) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if b, err := json.Marshal(admin.Controller.Stats.toMap()); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (stats *Stats) toMap() map[string]any {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	return map[string]any{
+		"clients": map[string]any{
+			"connected":   stats.Controller.Clients.Agents(),
+			"connections": stats.connections.Copy(),
+			"since":       stats.startedAt,
+		},
+	}
+}
+
+type AirtimeBucket struct {
+	Calls   uint      `json:"calls"`
+	Seconds float64   `json:"seconds"`
+	Time    time.Time `json:"time"`
+}
+
+type TalkgroupAirtime struct {
+	Buckets   []*AirtimeBucket `json:"buckets"`
+	Calls     uint             `json:"calls"`
+	Seconds   float64          `json:"seconds"`
+	System    uint             `json:"system"`
+	Talkgroup uint             `json:"talkgroup"`
+	buckets   map[int64]*AirtimeBucket
+}
+
+func (airtime *TalkgroupAirtime) Add(t time.Time, seconds float64) {
+	bucket := airtime.buckets[t.Unix()]
+	if bucket == nil {
+		bucket = &AirtimeBucket{Time: t}
+		airtime.buckets[t.Unix()] = bucket
+	}
+
+	bucket.Calls++
+	bucket.Seconds += seconds
+
+	airtime.Calls++
+	airtime.Seconds += seconds
+}
+
+func (airtime *TalkgroupAirtime) sort() *TalkgroupAirtime {
+	airtime.Buckets = make([]*AirtimeBucket, 0, len(airtime.buckets))
+
+	for _, bucket := range airtime.buckets {
+		airtime.Buckets = append(airtime.Buckets, bucket)
+	}
+
+	sort.Slice(airtime.Buckets, func(i int, j int) bool {
+		return airtime.Buckets[i].Time.Before(airtime.Buckets[j].Time)
+	})
+
+	return airtime
+}
+
+// AirtimeHandler reports the talk time per talkgroup, by hour or by day,
+// for the requested period which defaults to the last 24 hours.
+func (admin *Admin) AirtimeHandler(w http.ResponseWriter, r *http.Request) {
+	if !admin.Authorize(w, r, AdminRoleViewer) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var (
+			query     = r.URL.Query()
+			system    uint
+			talkgroup uint
+		)
+
+		from, to, interval, ok := parseStatsPeriod(query)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if i, err := strconv.Atoi(query.Get("system")); err == nil && i > 0 {
+			system = uint(i)
+		}
+
+		if i, err := strconv.Atoi(query.Get("talkgroup")); err == nil && i > 0 {
+			talkgroup = uint(i)
+		}
+
+		airtimes, err := admin.Controller.Calls.Airtime(admin.Controller.Database, from, to, interval, system, talkgroup)
+		if err != nil {
+			admin.Controller.Logs.LogEvent(LogLevelError, err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if b, err := json.Marshal(map[string]any{
+			"from":       from,
+			"interval":   interval.Seconds(),
+			"talkgroups": airtimes,
+			"to":         to,
+		}); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// SignalStats is the decode quality of the frequencies of a system, from the
+// error and spike counts trunk-recorder reports for each frequency of the
+// calls. The rates are per second of transmission.
+type SignalStats struct {
+	Buckets     []*SignalBucket    `json:"buckets"`
+	Frequencies []*SignalFrequency `json:"frequencies"`
+	SignalCounts
+	buckets     map[int64]*SignalBucket
+	frequencies map[string]*SignalFrequency
+}
+
+type SignalBucket struct {
+	SignalCounts
+	Time time.Time `json:"time"`
+}
+
+type SignalCounts struct {
+	Calls     uint    `json:"calls"`
+	ErrorRate float64 `json:"errorRate"`
+	Errors    uint    `json:"errors"`
+	Seconds   float64 `json:"seconds"`
+	SpikeRate float64 `json:"spikeRate"`
+	Spikes    uint    `json:"spikes"`
+}
+
+type SignalFrequency struct {
+	SignalCounts
+	Frequency uint `json:"frequency"`
+	Site      uint `json:"site"`
+}
+
+func NewSignalStats() *SignalStats {
+	return &SignalStats{
+		Buckets:     []*SignalBucket{},
+		Frequencies: []*SignalFrequency{},
+		buckets:     map[int64]*SignalBucket{},
+		frequencies: map[string]*SignalFrequency{},
+	}
+}
+
+// Add accounts for the frequencies of a call, the call counting once for
+// each of its frequencies. A frequency without length lasts the call when it
+// is the only one.
+func (stats *SignalStats) Add(t time.Time, site uint, duration float64, frequencies []map[string]any) {
+	bucket := stats.buckets[t.Unix()]
+	if bucket == nil {
+		bucket = &SignalBucket{Time: t}
+		stats.buckets[t.Unix()] = bucket
+	}
+
+	bucket.Calls++
+	stats.Calls++
+
+	seen := map[uint]bool{}
+
+	for _, f := range frequencies {
+		freq := signalUint(f["freq"])
+		if freq == 0 {
+			continue
+		}
+
+		errorCount := signalUint(f["errorCount"])
+		spikeCount := signalUint(f["spikeCount"])
+
+		seconds, ok := f["len"].(float64)
+		if !ok && len(frequencies) == 1 {
+			seconds = duration
+		}
+
+		k := fmt.Sprintf("%d.%d", site, freq)
+
+		frequency := stats.frequencies[k]
+		if frequency == nil {
+			frequency = &SignalFrequency{Frequency: freq, Site: site}
+			stats.frequencies[k] = frequency
+		}
+
+		if !seen[freq] {
+			frequency.Calls++
+			seen[freq] = true
+		}
+
+		for _, counts := range []*SignalCounts{&bucket.SignalCounts, &frequency.SignalCounts, &stats.SignalCounts} {
+			counts.Errors += errorCount
+			counts.Seconds += seconds
+			counts.Spikes += spikeCount
+		}
+	}
+}
+
+func (stats *SignalStats) sort() *SignalStats {
+	stats.Buckets = make([]*SignalBucket, 0, len(stats.buckets))
+	for _, bucket := range stats.buckets {
+		bucket.rate()
+		stats.Buckets = append(stats.Buckets, bucket)
+	}
+
+	sort.Slice(stats.Buckets, func(i int, j int) bool {
+		return stats.Buckets[i].Time.Before(stats.Buckets[j].Time)
+	})
+
+	stats.Frequencies = make([]*SignalFrequency, 0, len(stats.frequencies))
+	for _, frequency := range stats.frequencies {
+		frequency.rate()
+		stats.Frequencies = append(stats.Frequencies, frequency)
+	}
+
+	// the worst frequencies first
+	sort.Slice(stats.Frequencies, func(i int, j int) bool {
+		a, b := stats.Frequencies[i], stats.Frequencies[j]
+		if a.ErrorRate != b.ErrorRate {
+			return a.ErrorRate > b.ErrorRate
+		}
+		if a.Site != b.Site {
+			return a.Site < b.Site
+		}
+		return a.Frequency < b.Frequency
+	})
+
+	stats.rate()
+
+	return stats
+}
+
+func (counts *SignalCounts) rate() {
+	if counts.Seconds > 0 {
+		counts.ErrorRate = float64(counts.Errors) / counts.Seconds
+		counts.SpikeRate = float64(counts.Spikes) / counts.Seconds
+	}
+}
+
+// SystemStatsHandler reports the signal statistics of a system on
+// /api/admin/stats/system/{id}, by hour or by day, for the requested period
+// which defaults to the last 24 hours.
+func (admin *Admin) SystemStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if !admin.Authorize(w, r, AdminRoleViewer) {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	p := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/stats/"), "/"), "/")
+	if len(p) != 2 || p[0] != "system" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	id, err := strconv.ParseUint(p[1], 10, 64)
+	if err != nil || id == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if _, ok := admin.Controller.Systems.GetSystem(uint(id)); !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+
+	from, to, interval, ok := parseStatsPeriod(query)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var site uint
+	if i, err := strconv.Atoi(query.Get("site")); err == nil && i > 0 {
+		site = uint(i)
+	}
+
+	stats, err := admin.Controller.Calls.SignalStats(admin.Controller.Database, from, to, interval, uint(id), site)
+	if err != nil {
+		admin.Controller.Logs.LogEvent(LogLevelError, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if b, err := json.Marshal(map[string]any{
+		"from":     from,
+		"interval": interval.Seconds(),
+		"signal":   stats,
+		"system":   id,
+		"to":       to,
+	}); err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	} else {
+		w.WriteHeader(http.StatusExpectationFailed)
+	}
+}
+
+// parseStatsPeriod returns the from, to and interval query parameters of the
+// statistics, the last 24 hours by hour by default.
+func parseStatsPeriod(query url.Values) (from time.Time, to time.Time, interval time.Duration, ok bool) {
+	interval = time.Hour
+	to = time.Now().UTC()
+	from = to.Add(-24 * time.Hour)
+
+	switch query.Get("interval") {
+	case "", "hour":
+	case "day":
+		interval = 24 * time.Hour
+	default:
+		return from, to, interval, false
+	}
+
+	if v := query.Get("from"); len(v) > 0 {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return from, to, interval, false
+		}
+		from = t.UTC()
+	}
+
+	if v := query.Get("to"); len(v) > 0 {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return from, to, interval, false
+		}
+		to = t.UTC()
+	}
+
+	return from, to, interval, true
+}
+
+// signalUint returns the count of a frequency, as stored in json.
+func signalUint(f any) uint {
+	switch v := f.(type) {
+	case float64:
+		if v > 0 {
+			return uint(v)
+		}
+	case uint:
+		return v
+	}
+
+	return 0
+}
@@ -0,0 +1,145 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSignalStatsAdd(t *testing.T) {
+	hour := time.Date(2026, 10, 14, 10, 0, 0, 0, time.UTC)
+
+	stats := NewSignalStats()
+	stats.Add(hour, 1, 10, []map[string]any{{"freq": float64(851000000), "errorCount": float64(20)}})
+	stats.Add(hour, 1, 10, []map[string]any{
+		{"freq": float64(851000000), "errorCount": float64(10), "len": float64(4), "spikeCount": float64(2)},
+		{"freq": float64(852000000), "errorCount": float64(0), "len": float64(6)},
+	})
+	stats.Add(hour.Add(time.Hour), 2, 5, []map[string]any{{"freq": float64(851000000), "errorCount": float64(1), "len": float64(5)}})
+	stats.sort()
+
+	tests := []struct {
+		site      uint
+		frequency uint
+		calls     uint
+		errors    uint
+		seconds   float64
+		errorRate float64
+	}{
+		{1, 851000000, 2, 30, 14, 30.0 / 14},
+		{2, 851000000, 1, 1, 5, 0.2},
+		{1, 852000000, 1, 0, 6, 0},
+	}
+
+	if len(stats.Frequencies) != len(tests) {
+		t.Fatalf("got %d frequencies, want %d", len(stats.Frequencies), len(tests))
+	}
+
+	for i, test := range tests {
+		got := stats.Frequencies[i]
+		if got.Site != test.site || got.Frequency != test.frequency || got.Calls != test.calls || got.Errors != test.errors || got.Seconds != test.seconds || got.ErrorRate != test.errorRate {
+			t.Errorf("frequency %d: got %+v, want %+v", i, got, test)
+		}
+	}
+
+	if len(stats.Buckets) != 2 || stats.Buckets[0].Calls != 2 || stats.Buckets[0].Errors != 30 || stats.Buckets[1].Calls != 1 {
+		t.Errorf("got buckets %+v", stats.Buckets)
+	}
+
+	if stats.Calls != 3 || stats.Errors != 31 || stats.Spikes != 2 || stats.Seconds != 25 {
+		t.Errorf("got totals %+v", stats.SignalCounts)
+	}
+}
+
+func TestCallsSignalStats(t *testing.T) {
+	db := newTestDatabase(t)
+
+	calls := NewCalls()
+
+	now := time.Now().UTC()
+
+	for _, call := range []*Call{
+		{Site: 1, System: 1, Frequencies: []map[string]any{{"freq": uint(851000000), "errorCount": uint(4), "len": uint(2)}}},
+		{Site: 2, System: 1, Frequencies: []map[string]any{{"freq": uint(852000000), "errorCount": uint(1), "len": uint(1)}}},
+		{Site: 1, System: 2, Frequencies: []map[string]any{{"freq": uint(853000000), "errorCount": uint(9), "len": uint(1)}}},
+	} {
+		call.Audio = []byte{0}
+		call.DateTime = now.Add(-time.Minute)
+		call.Duration = time.Second
+		call.Talkgroup = 1
+		if _, err := calls.WriteCall(call, db); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		site   uint
+		errors uint
+		count  int
+	}{
+		{"system", 0, 5, 2},
+		{"site", 2, 1, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stats, err := calls.SignalStats(db, now.Add(-time.Hour), now, time.Hour, 1, test.site)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if stats.Errors != test.errors || len(stats.Frequencies) != test.count {
+				t.Errorf("got %d errors on %d frequencies, want %d on %d", stats.Errors, len(stats.Frequencies), test.errors, test.count)
+			}
+		})
+	}
+}
+
+func TestParseStatsPeriod(t *testing.T) {
+	tests := []struct {
+		query    string
+		interval time.Duration
+		from     string
+		ok       bool
+	}{
+		{query: "", interval: time.Hour, ok: true},
+		{query: "interval=day&from=2026-10-01T00:00:00Z", interval: 24 * time.Hour, from: "2026-10-01T00:00:00Z", ok: true},
+		{query: "interval=week"},
+		{query: "to=yesterday"},
+	}
+
+	for _, test := range tests {
+		query, _ := url.ParseQuery(test.query)
+
+		from, _, interval, ok := parseStatsPeriod(query)
+		if ok != test.ok {
+			t.Errorf("%q: got ok %v", test.query, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if interval != test.interval {
+			t.Errorf("%q: got interval %v, want %v", test.query, interval, test.interval)
+		}
+		if len(test.from) > 0 && from.Format(time.RFC3339) != test.from {
+			t.Errorf("%q: got from %v, want %s", test.query, from, test.from)
+		}
+	}
+}
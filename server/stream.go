@@ -0,0 +1,694 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	streamBitrate    = 32000
+	streamMetaint    = 16000
+	streamQueueSize  = 50
+	streamSampleRate = 22050
+	streamTick       = 250 * time.Millisecond
+)
+
+// Stream is a mountpoint which plays the calls of the selected talkgroups
+// back to back as a continuous mp3 stream, filled with silence when idle.
+type Stream struct {
+	Id       any    `json:"_id"`
+	Disabled bool   `json:"disabled"`
+	Mount    string `json:"mount"`
+	Name     string `json:"name"`
+	Order    any    `json:"order"`
+	Systems  any    `json:"systems"`
+}
+
+func (stream *Stream) FromMap(m map[string]any) *Stream {
+	switch v := m["_id"].(type) {
+	case float64:
+		stream.Id = uint(v)
+	}
+
+	switch v := m["disabled"].(type) {
+	case bool:
+		stream.Disabled = v
+	}
+
+	switch v := m["mount"].(type) {
+	case string:
+		stream.Mount = strings.Trim(v, "/")
+	}
+
+	switch v := m["name"].(type) {
+	case string:
+		stream.Name = v
+	}
+
+	switch v := m["order"].(type) {
+	case float64:
+		stream.Order = uint(v)
+	}
+
+	switch v := m["systems"].(type) {
+	case []any:
+		if b, err := json.Marshal(v); err == nil {
+			stream.Systems = string(b)
+		}
+	case string:
+		stream.Systems = v
+	}
+
+	return stream
+}
+
+func (stream *Stream) HasAccess(call *Call) bool {
+	if stream.Disabled {
+		return false
+	}
+
+	return (&Downstream{Systems: stream.Systems}).HasAccess(call)
+}
+
+type StreamChunk struct {
+	Audio []byte
+	Title string
+}
+
+type StreamListener struct {
+	Send chan *StreamChunk
+}
+
+// StreamMount is what the listeners of a mountpoint hear, those of a tier
+// with a delay sharing their own mount.
+type StreamMount struct {
+	buffer    []byte
+	delay     time.Duration
+	listeners map[*StreamListener]bool
+	name      string
+	queue     []*StreamChunk
+}
+
+type Streams struct {
+	Controller *Controller
+	List       []*Stream
+	ingest     chan *Call
+	mounts     map[string]*StreamMount
+	silence    []byte
+	mutex      sync.Mutex
+}
+
+func NewStreams(controller *Controller) *Streams {
+	return &Streams{
+		Controller: controller,
+		List:       []*Stream{},
+		ingest:     make(chan *Call, 256),
+		mounts:     map[string]*StreamMount{},
+		mutex:      sync.Mutex{},
+	}
+}
+
+func (streams *Streams) Feed(call *Call) {
+	streams.mutex.Lock()
+	defer streams.mutex.Unlock()
+
+	for _, stream := range streams.List {
+		if streams.isListened(stream.Mount) && stream.HasAccess(call) {
+			select {
+			case streams.ingest <- call:
+			default:
+				streams.Controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("stream: system=%v talkgroup=%v dropped, encoder is falling behind", call.System, call.Talkgroup))
+			}
+			return
+		}
+	}
+}
+
+func (streams *Streams) FromMap(f []any) *Streams {
+	streams.mutex.Lock()
+	defer streams.mutex.Unlock()
+
+	streams.List = []*Stream{}
+
+	for _, r := range f {
+		switch m := r.(type) {
+		case map[string]any:
+			stream := &Stream{}
+			stream.FromMap(m)
+			streams.List = append(streams.List, stream)
+		}
+	}
+
+	return streams
+}
+
+func (streams *Streams) GetStream(mount string) (*Stream, bool) {
+	streams.mutex.Lock()
+	defer streams.mutex.Unlock()
+
+	for _, stream := range streams.List {
+		if stream.Mount == mount && !stream.Disabled {
+			return stream, true
+		}
+	}
+
+	return nil, false
+}
+
+func (streams *Streams) Read(db *Database) error {
+	var (
+		err     error
+		id      sql.NullFloat64
+		order   sql.NullFloat64
+		rows    *sql.Rows
+		systems string
+	)
+
+	streams.mutex.Lock()
+	defer streams.mutex.Unlock()
+
+	streams.List = []*Stream{}
+
+	formatError := func(err error) error {
+		return fmt.Errorf("streams.read: %v", err)
+	}
+
+	if rows, err = db.Sql.Query("select `_id`, `disabled`, `mount`, `name`, `order`, `systems` from `rdioScannerStreams`"); err != nil {
+		return formatError(err)
+	}
+
+	for rows.Next() {
+		stream := &Stream{}
+
+		if err = rows.Scan(&id, &stream.Disabled, &stream.Mount, &stream.Name, &order, &systems); err != nil {
+			break
+		}
+
+		if id.Valid && id.Float64 > 0 {
+			stream.Id = uint(id.Float64)
+		}
+
+		if order.Valid && order.Float64 > 0 {
+			stream.Order = uint(order.Float64)
+		}
+
+		if err = json.Unmarshal([]byte(systems), &stream.Systems); err != nil {
+			stream.Systems = []any{}
+		}
+
+		if len(stream.Mount) == 0 {
+			continue
+		}
+
+		streams.List = append(streams.List, stream)
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	return nil
+}
+
+func (streams *Streams) Start() error {
+	go func() {
+		for call := range streams.ingest {
+			streams.encode(call)
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(streamTick)
+		for range ticker.C {
+			streams.tick()
+		}
+	}()
+
+	return nil
+}
+
+func (streams *Streams) StreamHandler(w http.ResponseWriter, r *http.Request) {
+	logs := streams.Controller.Logs
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/stream/")
+
+	stream, ok := streams.GetStream(name)
+	if !ok {
+		stream, ok = streams.GetStream(strings.TrimSuffix(name, ".mp3"))
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	status, delay := streams.authorize(w, r, stream)
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Rdio Scanner"`)
+	}
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err := streams.prepareSilence(); err != nil {
+		logs.LogEvent(LogLevelError, fmt.Sprintf("stream: %v", err))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	metadata := r.Header.Get("Icy-MetaData") == "1"
+
+	listener := &StreamListener{Send: make(chan *StreamChunk, 64)}
+
+	key := stream.Mount
+	if delay > 0 {
+		key = fmt.Sprintf("%s@%d", stream.Mount, int(delay.Seconds()))
+	}
+
+	streams.mutex.Lock()
+	mount := streams.mounts[key]
+	if mount == nil {
+		mount = &StreamMount{delay: delay, listeners: map[*StreamListener]bool{}, name: stream.Mount}
+		streams.mounts[key] = mount
+	}
+	mount.listeners[listener] = true
+	streams.mutex.Unlock()
+
+	logs.LogEvent(LogLevelInfo, fmt.Sprintf("stream: listener connected to /%s from ip %s", stream.Mount, GetRemoteAddr(r)))
+
+	defer func() {
+		streams.mutex.Lock()
+		delete(mount.listeners, listener)
+		streams.mutex.Unlock()
+
+		logs.LogEvent(LogLevelInfo, fmt.Sprintf("stream: listener disconnected from /%s, ip %s", stream.Mount, GetRemoteAddr(r)))
+	}()
+
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.Header().Set("Content-Type", "audio/mpeg")
+	w.Header().Set("icy-br", fmt.Sprintf("%d", streamBitrate/1000))
+	w.Header().Set("icy-name", stream.Name)
+	w.Header().Set("icy-pub", "0")
+	if metadata {
+		w.Header().Set("icy-metaint", fmt.Sprintf("%d", streamMetaint))
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var (
+		count int
+		sent  string
+		title string
+	)
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case chunk, ok := <-listener.Send:
+			if !ok {
+				return
+			}
+
+			if len(chunk.Title) > 0 {
+				title = chunk.Title
+			}
+
+			audio := chunk.Audio
+
+			for len(audio) > 0 {
+				n := len(audio)
+				if metadata && count+n > streamMetaint {
+					n = streamMetaint - count
+				}
+
+				if _, err := w.Write(audio[:n]); err != nil {
+					return
+				}
+
+				audio = audio[n:]
+				count += n
+
+				if metadata && count == streamMetaint {
+					block := []byte{0}
+					if title != sent {
+						block = streamMetadata(title)
+						sent = title
+					}
+					if _, err := w.Write(block); err != nil {
+						return
+					}
+					count = 0
+				}
+			}
+
+			flusher.Flush()
+		}
+	}
+}
+
+func (streams *Streams) Write(db *Database) error {
+	var (
+		count   uint
+		err     error
+		rows    *sql.Rows
+		rowIds  = []uint{}
+		systems any
+	)
+
+	streams.mutex.Lock()
+	defer streams.mutex.Unlock()
+
+	formatError := func(err error) error {
+		return fmt.Errorf("streams.write: %v", err)
+	}
+
+	if rows, err = db.Sql.Query("select `_id` from `rdioScannerStreams`"); err != nil {
+		return formatError(err)
+	}
+
+	for rows.Next() {
+		var rowId uint
+		if err = rows.Scan(&rowId); err != nil {
+			break
+		}
+		remove := true
+		for _, stream := range streams.List {
+			if stream.Id == nil || stream.Id == rowId {
+				remove = false
+				break
+			}
+		}
+		if remove {
+			rowIds = append(rowIds, rowId)
+		}
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	if len(rowIds) > 0 {
+		if _, err = db.Delete("rdioScannerStreams").Where(SqlIn("_id", rowIds)).Exec(); err != nil {
+			return formatError(err)
+		}
+	}
+
+	for _, stream := range streams.List {
+		switch stream.Systems {
+		case "*":
+			systems = `"*"`
+		default:
+			systems = stream.Systems
+		}
+
+		if err = db.Sql.QueryRow("select count(*) from `rdioScannerStreams` where `_id` = ?", stream.Id).Scan(&count); err != nil {
+			break
+		}
+
+		if count == 0 {
+			if _, err = db.Sql.Exec("insert into `rdioScannerStreams` (`_id`, `disabled`, `mount`, `name`, `order`, `systems`) values (?, ?, ?, ?, ?, ?)", stream.Id, stream.Disabled, stream.Mount, stream.Name, stream.Order, systems); err != nil {
+				break
+			}
+
+		} else if _, err = db.Sql.Exec("update `rdioScannerStreams` set `disabled` = ?, `mount` = ?, `name` = ?, `order` = ?, `systems` = ? where `_id` = ?", stream.Disabled, stream.Mount, stream.Name, stream.Order, systems, stream.Id); err != nil {
+			break
+		}
+	}
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	return nil
+}
+
+// authorize accepts an access code, a guest pass or a listener token, either
+// as the code query parameter or as the basic auth password, which is what
+// most stream players support. The access must cover every talkgroup of the
+// mountpoint, and the codes count against the login rate limit as on the
+// websocket. It returns the http status to reply with and the delay of the
+// tier of the access.
+func (streams *Streams) authorize(w http.ResponseWriter, r *http.Request, stream *Stream) (int, time.Duration) {
+	controller := streams.Controller
+
+	if !controller.Accesses.IsRestricted() {
+		return http.StatusOK, 0
+	}
+
+	code := r.URL.Query().Get("code")
+	if _, password, ok := r.BasicAuth(); ok {
+		code = password
+	}
+
+	if len(code) == 0 {
+		return http.StatusUnauthorized, 0
+	}
+
+	remoteAddr := GetRemoteAddr(r)
+
+	if ok, wait := controller.Logins.Allow(LoginKindAccess, remoteAddr); !ok {
+		loginRetryAfter(w, wait)
+		return http.StatusTooManyRequests, 0
+	}
+
+	access, ok := controller.GetListenerAccess(code)
+	if !ok || access.HasExpired() {
+		if locked, until := controller.Logins.Fail(LoginKindAccess, remoteAddr); locked {
+			controller.Logs.LogEvent(LogLevelWarn, loginLockedMessage(LoginKindAccess, remoteAddr, until))
+		}
+		return http.StatusUnauthorized, 0
+	}
+
+	controller.Logins.Succeed(LoginKindAccess, remoteAddr)
+
+	if !streams.covers(access, stream) {
+		return http.StatusForbidden, 0
+	}
+
+	var delay time.Duration
+
+	if tier, ok := controller.Tiers.GetTier(access.Tier); ok {
+		delay = tier.GetDelay()
+	}
+
+	return http.StatusOK, delay
+}
+
+// covers tells if the access grants every talkgroup of the mountpoint.
+func (streams *Streams) covers(access *Access, stream *Stream) bool {
+	for _, system := range streams.Controller.Systems.List {
+		for _, talkgroup := range system.Talkgroups.List {
+			call := &Call{System: system.Id, Talkgroup: talkgroup.Id}
+			if stream.HasAccess(call) && !access.HasAccess(call) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func (streams *Streams) encode(call *Call) {
+	audio, err := streams.Controller.FFMpeg.EncodeStream(call.Audio)
+	if err != nil {
+		streams.Controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("stream: system=%v talkgroup=%v %v", call.System, call.Talkgroup, err))
+		return
+	}
+
+	title := fmt.Sprintf("%v %v", call.System, call.Talkgroup)
+	if system, ok := streams.Controller.Systems.GetSystem(call.System); ok {
+		title = system.Label
+		if talkgroup, ok := system.Talkgroups.GetSiteTalkgroup(call.Talkgroup, call.Site); ok {
+			title = fmt.Sprintf("%s - %s", system.Label, talkgroup.Label)
+		}
+	}
+
+	chunk := &StreamChunk{Audio: audio, Title: title}
+
+	streams.mutex.Lock()
+	defer streams.mutex.Unlock()
+
+	for _, stream := range streams.List {
+		if !stream.HasAccess(call) {
+			continue
+		}
+
+		for _, mount := range streams.mounts {
+			if mount.name != stream.Mount || len(mount.listeners) == 0 {
+				continue
+			}
+
+			if mount.delay > 0 {
+				mount := mount
+				time.AfterFunc(mount.delay, func() {
+					streams.mutex.Lock()
+					defer streams.mutex.Unlock()
+
+					mount.enqueue(chunk)
+				})
+
+			} else {
+				mount.enqueue(chunk)
+			}
+		}
+	}
+}
+
+func (mount *StreamMount) enqueue(chunk *StreamChunk) {
+	if len(mount.listeners) == 0 {
+		return
+	}
+
+	if len(mount.queue) >= streamQueueSize {
+		mount.queue = mount.queue[1:]
+	}
+
+	mount.queue = append(mount.queue, chunk)
+}
+
+// isListened tells if a mountpoint has listeners, whatever their delay.
+func (streams *Streams) isListened(name string) bool {
+	for _, mount := range streams.mounts {
+		if mount.name == name && len(mount.listeners) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (streams *Streams) prepareSilence() error {
+	streams.mutex.Lock()
+	defer streams.mutex.Unlock()
+
+	if streams.silence != nil {
+		return nil
+	}
+
+	silence, err := streams.Controller.FFMpeg.EncodeStreamSilence(time.Second)
+	if err != nil {
+		return err
+	}
+
+	streams.silence = silence
+
+	return nil
+}
+
+// tick paces each mountpoint at the stream bitrate so that players do not
+// have to buffer whole calls, queued calls are played one after the other.
+func (streams *Streams) tick() {
+	const size = streamBitrate / 8 * int(streamTick) / int(time.Second)
+
+	streams.mutex.Lock()
+	defer streams.mutex.Unlock()
+
+	for key, mount := range streams.mounts {
+		if len(mount.listeners) == 0 {
+			delete(streams.mounts, key)
+			continue
+		}
+
+		enabled := false
+		for _, stream := range streams.List {
+			if stream.Mount == mount.name && !stream.Disabled {
+				enabled = true
+				break
+			}
+		}
+
+		if !enabled {
+			for listener := range mount.listeners {
+				close(listener.Send)
+				delete(mount.listeners, listener)
+			}
+			delete(streams.mounts, key)
+			continue
+		}
+
+		title := ""
+
+		for len(mount.buffer) < size {
+			if len(mount.queue) > 0 {
+				mount.buffer = append(mount.buffer, mount.queue[0].Audio...)
+				title = mount.queue[0].Title
+				mount.queue = mount.queue[1:]
+			} else if len(streams.silence) > 0 {
+				mount.buffer = append(mount.buffer, streams.silence...)
+			} else {
+				break
+			}
+		}
+
+		n := size
+		if len(mount.buffer) < n {
+			n = len(mount.buffer)
+		}
+
+		chunk := &StreamChunk{Audio: mount.buffer[:n:n], Title: title}
+		mount.buffer = mount.buffer[n:]
+
+		for listener := range mount.listeners {
+			select {
+			case listener.Send <- chunk:
+			default:
+				// slow listener, drop it rather than stall the mountpoint
+				close(listener.Send)
+				delete(mount.listeners, listener)
+			}
+		}
+	}
+}
+
+func streamMetadata(title string) []byte {
+	title = strings.NewReplacer("'", "", "\r", "", "\n", "").Replace(title)
+	if len(title) > 255*16-16 {
+		title = title[:255*16-16]
+	}
+
+	s := fmt.Sprintf("StreamTitle='%s';", title)
+	n := (len(s) + 15) / 16
+
+	b := make([]byte, 1+n*16)
+	b[0] = byte(n)
+	copy(b[1:], s)
+
+	return b
+}
@@ -0,0 +1,702 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SherClockHolmes/webpush-go"
+)
+
+const (
+	SubscriptionActionApns    = "apns"
+	SubscriptionActionEmail   = "email"
+	SubscriptionActionFcm     = "fcm"
+	SubscriptionActionWebPush = "webpush"
+
+	subscriberAccess = "access:"
+	subscriberOidc   = "oidc:"
+)
+
+var subscriptionToken = regexp.MustCompile(`^[\w:.-]{8,1000}$`)
+
+// Subscription notifies a listener of the calls of a talkgroup. Listeners
+// manage their own subscriptions, within the maximum count and the cooldown
+// between two notifications set in the options. The subscriber is the ident
+// of the access code or the openid connect subject of the listener.
+type Subscription struct {
+	Id         any       `json:"_id"`
+	Action     string    `json:"action"`
+	Address    string    `json:"address"`
+	CreatedAt  time.Time `json:"createdAt"`
+	Subscriber string    `json:"subscriber"`
+	System     uint      `json:"system"`
+	Talkgroup  uint      `json:"talkgroup"`
+	tier       any
+}
+
+func (subscription *Subscription) FromMap(m map[string]any) *Subscription {
+	switch v := m["action"].(type) {
+	case string:
+		subscription.Action = strings.TrimSpace(v)
+	}
+
+	switch v := m["address"].(type) {
+	case string:
+		subscription.Address = strings.TrimSpace(v)
+	case map[string]any:
+		if b, err := json.Marshal(v); err == nil {
+			subscription.Address = string(b)
+		}
+	}
+
+	switch v := m["system"].(type) {
+	case float64:
+		subscription.System = uint(v)
+	}
+
+	switch v := m["talkgroup"].(type) {
+	case float64:
+		subscription.Talkgroup = uint(v)
+	}
+
+	return subscription
+}
+
+func (subscription *Subscription) key() string {
+	return fmt.Sprintf("%s|%s|%s|%d|%d", subscription.Subscriber, subscription.Action, subscription.Address, subscription.System, subscription.Talkgroup)
+}
+
+type Subscriptions struct {
+	Controller *Controller
+	List       []*Subscription
+	sent       map[string]time.Time
+	mutex      sync.Mutex
+}
+
+func NewSubscriptions(controller *Controller) *Subscriptions {
+	return &Subscriptions{
+		Controller: controller,
+		List:       []*Subscription{},
+		sent:       map[string]time.Time{},
+		mutex:      sync.Mutex{},
+	}
+}
+
+// Evaluate notifies the subscribers of the talkgroup of the call who still
+// have access to it, once the delay of their tier is over.
+func (subscriptions *Subscriptions) Evaluate(call *Call) {
+	controller := subscriptions.Controller
+	options := controller.Options
+
+	if options.SubscriptionsMax == 0 {
+		return
+	}
+
+	subscriptions.mutex.Lock()
+	defer subscriptions.mutex.Unlock()
+
+	now := time.Now()
+	cooldown := time.Duration(options.SubscriptionsCooldown) * time.Second
+
+	for _, subscription := range subscriptions.List {
+		if subscription.System != call.System || subscription.Talkgroup != call.Talkgroup {
+			continue
+		}
+
+		key := subscription.key()
+
+		if sent, ok := subscriptions.sent[key]; ok && now.Sub(sent) < cooldown {
+			continue
+		}
+
+		access, ok := subscriptions.getAccess(subscription, call)
+		if !ok {
+			continue
+		}
+
+		subscriptions.sent[key] = now
+
+		var delay time.Duration
+		if tier, ok := controller.Tiers.GetTier(access.Tier); ok {
+			delay = tier.GetDelay()
+		}
+
+		subscription := subscription
+
+		time.AfterFunc(delay, func() {
+			logEvent := func(logLevel string, message string) {
+				controller.Logs.LogEvent(logLevel, fmt.Sprintf("subscription: %s system=%v talkgroup=%v via %s %s", subscription.Subscriber, call.System, call.Talkgroup, subscription.Action, message))
+			}
+
+			if err := subscriptions.send(subscription, call); err != nil {
+				logEvent(LogLevelError, err.Error())
+			} else {
+				logEvent(LogLevelInfo, "success")
+			}
+		})
+	}
+}
+
+// Get returns the subscriptions of the subscriber.
+func (subscriptions *Subscriptions) Get(subscriber string) []*Subscription {
+	subscriptions.mutex.Lock()
+	defer subscriptions.mutex.Unlock()
+
+	l := []*Subscription{}
+
+	for _, subscription := range subscriptions.List {
+		if subscription.Subscriber == subscriber {
+			l = append(l, subscription)
+		}
+	}
+
+	return l
+}
+
+// GetSubscriber returns the subscriber of the listener access. Only the
+// listeners known by an ident, either of their access code or from openid
+// connect, may subscribe. Guest passes can't.
+func (subscriptions *Subscriptions) GetSubscriber(access *Access) (string, bool) {
+	if access == nil || len(access.Ident) == 0 || subscriptions.Controller.GuestPasses.IsGuest(access) {
+		return "", false
+	}
+
+	if len(access.Code) > 0 {
+		return subscriberAccess + access.Ident, true
+	}
+
+	return subscriberOidc + access.Ident, true
+}
+
+// Parse validates the subscriptions a listener submits against the options
+// and the talkgroups the access gives access to.
+func (subscriptions *Subscriptions) Parse(access *Access, f []any) ([]*Subscription, error) {
+	controller := subscriptions.Controller
+	options := controller.Options
+
+	subscriber, ok := subscriptions.GetSubscriber(access)
+	if !ok {
+		return nil, errors.New("listener has no ident")
+	}
+
+	if options.SubscriptionsMax == 0 {
+		return nil, errors.New("subscriptions are disabled")
+	}
+
+	if uint(len(f)) > options.SubscriptionsMax {
+		return nil, fmt.Errorf("no more than %d subscriptions allowed", options.SubscriptionsMax)
+	}
+
+	l := []*Subscription{}
+	keys := map[string]bool{}
+
+	for _, r := range f {
+		m, ok := r.(map[string]any)
+		if !ok {
+			return nil, errors.New("invalid subscription")
+		}
+
+		subscription := (&Subscription{}).FromMap(m)
+		subscription.Subscriber = subscriber
+		subscription.tier = access.Tier
+
+		switch subscription.Action {
+		case SubscriptionActionEmail:
+			if !subscriptions.Controller.Mailer.Available(options.SubscriptionsEmail) {
+				return nil, errors.New("email notifications are not available")
+			}
+
+			address, err := mail.ParseAddress(subscription.Address)
+			if err != nil {
+				return nil, fmt.Errorf("invalid email address %s", subscription.Address)
+			}
+			subscription.Address = address.Address
+
+		case SubscriptionActionApns, SubscriptionActionFcm:
+			if !controller.Push.HasAction(subscription.Action) {
+				return nil, fmt.Errorf("%s notifications are not available", subscription.Action)
+			}
+
+			if !subscriptionToken.MatchString(subscription.Address) {
+				return nil, fmt.Errorf("invalid %s device token", subscription.Action)
+			}
+
+		case SubscriptionActionWebPush:
+			if !controller.Push.HasAction(subscription.Action) {
+				return nil, errors.New("web push notifications are not available")
+			}
+
+			address, err := parseWebPushAddress(subscription.Address)
+			if err != nil {
+				return nil, err
+			}
+			subscription.Address = address
+
+		default:
+			return nil, fmt.Errorf("unknown action %s", subscription.Action)
+		}
+
+		system, ok := controller.Systems.GetSystem(subscription.System)
+		if !ok {
+			return nil, fmt.Errorf("unknown system %d", subscription.System)
+		}
+
+		if _, ok := system.Talkgroups.GetTalkgroup(subscription.Talkgroup); !ok || !access.HasAccess(&Call{System: subscription.System, Talkgroup: subscription.Talkgroup}) {
+			return nil, fmt.Errorf("unknown talkgroup %d of system %d", subscription.Talkgroup, subscription.System)
+		}
+
+		if key := subscription.key(); !keys[key] {
+			keys[key] = true
+			l = append(l, subscription)
+		}
+	}
+
+	return l, nil
+}
+
+func (subscriptions *Subscriptions) Read(db *Database) error {
+	var (
+		createdAt any
+		err       error
+		id        sql.NullFloat64
+		rows      *sql.Rows
+		tier      sql.NullString
+	)
+
+	subscriptions.mutex.Lock()
+	defer subscriptions.mutex.Unlock()
+
+	subscriptions.List = []*Subscription{}
+
+	formatError := func(err error) error {
+		return fmt.Errorf("subscriptions.read: %v", err)
+	}
+
+	if rows, err = db.Sql.Query("select `_id`, `action`, `address`, `createdAt`, `subscriber`, `system`, `talkgroup`, `tier` from `rdioScannerSubscriptions` order by `subscriber`, `system`, `talkgroup`"); err != nil {
+		return formatError(err)
+	}
+
+	for rows.Next() {
+		subscription := &Subscription{}
+
+		if err = rows.Scan(&id, &subscription.Action, &subscription.Address, &createdAt, &subscription.Subscriber, &subscription.System, &subscription.Talkgroup, &tier); err != nil {
+			break
+		}
+
+		if id.Valid && id.Float64 > 0 {
+			subscription.Id = uint(id.Float64)
+		}
+
+		if t, err := db.ParseDateTime(createdAt); err == nil {
+			subscription.CreatedAt = t
+		}
+
+		if tier.Valid && len(tier.String) > 0 {
+			subscription.tier = tier.String
+		}
+
+		subscriptions.List = append(subscriptions.List, subscription)
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	return nil
+}
+
+func (subscriptions *Subscriptions) Remove(id uint, db *Database) (*Subscription, error) {
+	subscriptions.mutex.Lock()
+	defer subscriptions.mutex.Unlock()
+
+	for i, subscription := range subscriptions.List {
+		if subscription.Id != id {
+			continue
+		}
+
+		if _, err := db.Sql.Exec("delete from `rdioScannerSubscriptions` where `_id` = ?", id); err != nil {
+			return nil, fmt.Errorf("subscriptions.remove: %v", err)
+		}
+
+		subscriptions.List = append(subscriptions.List[:i], subscriptions.List[i+1:]...)
+
+		return subscription, nil
+	}
+
+	return nil, nil
+}
+
+// Set replaces the subscriptions of the subscriber. The subscriptions which
+// are kept retain their creation date and their cooldown.
+func (subscriptions *Subscriptions) Set(subscriber string, l []*Subscription, db *Database) error {
+	var (
+		err  error
+		id   int64
+		list = []*Subscription{}
+		res  sql.Result
+		tx   *sql.Tx
+	)
+
+	subscriptions.mutex.Lock()
+	defer subscriptions.mutex.Unlock()
+
+	formatError := func(err error) error {
+		return fmt.Errorf("subscriptions.set: %v", err)
+	}
+
+	previous := map[string]*Subscription{}
+	for _, subscription := range subscriptions.List {
+		if subscription.Subscriber == subscriber {
+			previous[subscription.key()] = subscription
+		} else {
+			list = append(list, subscription)
+		}
+	}
+
+	if tx, err = db.Sql.Begin(); err != nil {
+		return formatError(err)
+	}
+
+	if _, err = tx.Exec("delete from `rdioScannerSubscriptions` where `subscriber` = ?", subscriber); err != nil {
+		tx.Rollback()
+		return formatError(err)
+	}
+
+	for _, subscription := range l {
+		if p, ok := previous[subscription.key()]; ok {
+			subscription.CreatedAt = p.CreatedAt
+		} else {
+			subscription.CreatedAt = time.Now().UTC()
+		}
+
+		if res, err = tx.Exec("insert into `rdioScannerSubscriptions` (`action`, `address`, `createdAt`, `subscriber`, `system`, `talkgroup`, `tier`) values (?, ?, ?, ?, ?, ?, ?)", subscription.Action, subscription.Address, subscription.CreatedAt, subscriber, subscription.System, subscription.Talkgroup, subscription.tier); err != nil {
+			tx.Rollback()
+			return formatError(err)
+		}
+
+		if id, err = res.LastInsertId(); err != nil {
+			tx.Rollback()
+			return formatError(err)
+		}
+
+		subscription.Id = uint(id)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return formatError(err)
+	}
+
+	kept := map[string]bool{}
+	for _, subscription := range l {
+		kept[subscription.key()] = true
+	}
+
+	for key := range previous {
+		if !kept[key] {
+			delete(subscriptions.sent, key)
+		}
+	}
+
+	subscriptions.List = append(list, l...)
+
+	return nil
+}
+
+// getAccess returns the access of the subscriber to the call. The access
+// codes are looked up again as they may have been changed since, while the
+// openid connect listeners keep the tier they subscribed with as long as
+// openid connect listeners are enabled.
+func (subscriptions *Subscriptions) getAccess(subscription *Subscription, call *Call) (*Access, bool) {
+	controller := subscriptions.Controller
+
+	if ident := strings.TrimPrefix(subscription.Subscriber, subscriberAccess); ident != subscription.Subscriber {
+		if controller.Config.OidcOnly {
+			return nil, false
+		}
+
+		return controller.Accesses.GetIdentAccess(ident, call)
+	}
+
+	if strings.HasPrefix(subscription.Subscriber, subscriberOidc) && controller.Accesses.external {
+		access := NewAccess()
+		access.Tier = subscription.tier
+
+		return access, true
+	}
+
+	return nil, false
+}
+
+// actions returns the ways the listeners can be notified of their
+// subscriptions.
+func (subscriptions *Subscriptions) actions() []string {
+	actions := subscriptions.Controller.Push.Actions()
+	if subscriptions.Controller.Mailer.Available(subscriptions.Controller.Options.SubscriptionsEmail) {
+		actions = append(actions, SubscriptionActionEmail)
+	}
+	sort.Strings(actions)
+
+	return actions
+}
+
+// payload is what a listener gets of its subscriptions.
+func (subscriptions *Subscriptions) payload(subscriber string) map[string]any {
+	options := subscriptions.Controller.Options
+
+	return map[string]any{
+		"actions":        subscriptions.actions(),
+		"cooldown":       options.SubscriptionsCooldown,
+		"max":            options.SubscriptionsMax,
+		"subscriptions":  subscriptions.Get(subscriber),
+		"vapidPublicKey": subscriptions.Controller.Push.VapidPublicKey(),
+	}
+}
+
+func (subscriptions *Subscriptions) send(subscription *Subscription, call *Call) error {
+	formatError := func(err error) error {
+		return fmt.Errorf("subscription.send: %v", err)
+	}
+
+	switch subscription.Action {
+	case SubscriptionActionEmail:
+		subject := fmt.Sprintf("Rdio Scanner: %v / %v", call.systemLabel, call.talkgroupLabel)
+		text := fmt.Sprintf("New call on %v / %v at %s", call.systemLabel, call.talkgroupLabel, call.DateTime.Local().Format("2006-01-02 15:04:05"))
+
+		if err := subscriptions.Controller.Mailer.Send(subscriptions.Controller.Options.SubscriptionsEmail, []string{subscription.Address}, subject, text); err != nil {
+			return formatError(err)
+		}
+
+	case SubscriptionActionApns, SubscriptionActionFcm, SubscriptionActionWebPush:
+		notification := &PushNotification{
+			Body: fmt.Sprintf("New call at %s", call.DateTime.Local().Format("15:04:05")),
+			Data: map[string]string{
+				"call":      fmt.Sprint(call.Id),
+				"system":    fmt.Sprint(call.System),
+				"talkgroup": fmt.Sprint(call.Talkgroup),
+			},
+			Title: fmt.Sprintf("%v / %v", call.systemLabel, call.talkgroupLabel),
+		}
+
+		if err := subscriptions.Controller.Push.Send(subscription.Action, subscription.Address, notification); errors.Is(err, errPushGone) {
+			// the browser or the app unsubscribed, no point trying again
+			if id, ok := subscription.Id.(uint); ok {
+				if _, err := subscriptions.Remove(id, subscriptions.Controller.Database); err != nil {
+					return formatError(err)
+				}
+			}
+			return formatError(err)
+
+		} else if err != nil {
+			return formatError(err)
+		}
+
+	default:
+		return formatError(fmt.Errorf("unknown action %s", subscription.Action))
+	}
+
+	return nil
+}
+
+// parseWebPushAddress validates the json browser subscription and keeps only
+// what is needed to send to it.
+func parseWebPushAddress(s string) (string, error) {
+	subscription := webpush.Subscription{}
+
+	if err := json.Unmarshal([]byte(s), &subscription); err != nil {
+		return "", errors.New("invalid web push subscription")
+	}
+
+	if u, err := url.Parse(subscription.Endpoint); err != nil || u.Scheme != "https" || len(u.Host) == 0 {
+		return "", errors.New("invalid web push endpoint")
+	}
+
+	if len(subscription.Keys.Auth) == 0 || len(subscription.Keys.P256dh) == 0 {
+		return "", errors.New("invalid web push keys")
+	}
+
+	b, err := json.Marshal(subscription)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func (controller *Controller) ProcessMessageCommandSubscriptions(client *Client, message *Message) {
+	subscriptions := controller.Subscriptions
+
+	subscriber, ok := subscriptions.GetSubscriber(client.GetAccess())
+	if !ok {
+		client.Send <- &Message{Command: MessageCommandSubscriptions, Payload: map[string]any{"error": "listener has no ident"}}
+		return
+	}
+
+	switch v := message.Payload.(type) {
+	case []any:
+		l, err := subscriptions.Parse(client.GetAccess(), v)
+		if err != nil {
+			payload := subscriptions.payload(subscriber)
+			payload["error"] = err.Error()
+			client.Send <- &Message{Command: MessageCommandSubscriptions, Payload: payload}
+			return
+		}
+
+		if err = subscriptions.Set(subscriber, l, controller.Database); err != nil {
+			controller.Logs.LogEvent(LogLevelError, err.Error())
+		}
+	}
+
+	client.Send <- &Message{Command: MessageCommandSubscriptions, Payload: subscriptions.payload(subscriber)}
+}
+
+// SubscriptionsHandler lets the listeners manage their subscriptions over
+// http, authenticated with their access code as the basic auth password or
+// the code query parameter.
+func (subscriptions *Subscriptions) SubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	controller := subscriptions.Controller
+
+	code := r.URL.Query().Get("code")
+	if _, password, ok := r.BasicAuth(); ok {
+		code = password
+	}
+
+	remoteAddr := GetRemoteAddr(r)
+
+	if ok, wait := controller.Logins.Allow(LoginKindAccess, remoteAddr); !ok {
+		loginRetryAfter(w, wait)
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	access, ok := controller.GetListenerAccess(code)
+	if !ok || access.HasExpired() {
+		if locked, until := controller.Logins.Fail(LoginKindAccess, remoteAddr); locked {
+			controller.Logs.LogEvent(LogLevelWarn, loginLockedMessage(LoginKindAccess, remoteAddr, until))
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	controller.Logins.Succeed(LoginKindAccess, remoteAddr)
+
+	subscriber, ok := subscriptions.GetSubscriber(access)
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	writeJson := func(status int, v any) {
+		if b, err := json.Marshal(v); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJson(http.StatusOK, subscriptions.payload(subscriber))
+
+	case http.MethodPut:
+		f := []any{}
+		if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		l, err := subscriptions.Parse(access, f)
+		if err != nil {
+			writeJson(http.StatusBadRequest, map[string]any{"error": err.Error()})
+			return
+		}
+
+		if err = subscriptions.Set(subscriber, l, controller.Database); err != nil {
+			controller.Logs.LogEvent(LogLevelError, err.Error())
+			w.WriteHeader(http.StatusExpectationFailed)
+			return
+		}
+
+		writeJson(http.StatusOK, subscriptions.payload(subscriber))
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (admin *Admin) SubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	if !admin.Authorize(w, r, adminWriteRole(r)) {
+		return
+	}
+
+	subscriptions := admin.Controller.Subscriptions
+
+	switch r.Method {
+	case http.MethodDelete:
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil || id < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		subscription, err := subscriptions.Remove(uint(id), admin.Controller.Database)
+		if err != nil {
+			admin.Controller.Logs.LogEvent(LogLevelError, err.Error())
+			w.WriteHeader(http.StatusExpectationFailed)
+			return
+		}
+
+		if subscription == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		admin.Controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("admin: subscription of %s to system=%d talkgroup=%d removed", subscription.Subscriber, subscription.System, subscription.Talkgroup))
+
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodGet:
+		subscriptions.mutex.Lock()
+		b, err := json.Marshal(subscriptions.List)
+		subscriptions.mutex.Unlock()
+
+		if err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
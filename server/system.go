@@ -17,28 +17,70 @@ package main
 
 import (
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 type System struct {
-	Id           uint        `json:"id"`
-	AutoPopulate bool        `json:"autoPopulate"`
-	Blacklists   Blacklists  `json:"blacklists"`
-	Label        string      `json:"label"`
-	Led          any         `json:"led"`
-	Order        uint        `json:"order"`
-	RowId        any         `json:"_id"`
-	Talkgroups   *Talkgroups `json:"talkgroups"`
-	Units        *Units      `json:"units"`
+	Id                 uint        `json:"id"`
+	AudioNormalization string      `json:"audioNormalization"`
+	AutoPopulate       bool        `json:"autoPopulate"`
+	Blacklists         Blacklists  `json:"blacklists"`
+	Label              string      `json:"label"`
+	Led                any         `json:"led"`
+	MetadataFields     string      `json:"metadataFields"`
+	Order              uint        `json:"order"`
+	QosWeight          uint        `json:"qosWeight"`
+	RowId              any         `json:"_id"`
+	Sites              *Sites      `json:"sites"`
+	Talkgroups         *Talkgroups `json:"talkgroups"`
+	Units              *Units      `json:"units"`
+}
+
+// systemMetadataLength is the longest value of a custom metadata field kept.
+const systemMetadataLength = 255
+
+// FilterMetadata returns the custom metadata of a call keeping only the
+// fields of the system, nil when none is left.
+func (system *System) FilterMetadata(metadata map[string]string) map[string]string {
+	var filtered map[string]string
+
+	for _, key := range system.MetadataKeys() {
+		if v, ok := metadata[key]; ok && len(v) > 0 {
+			if filtered == nil {
+				filtered = map[string]string{}
+			}
+			if len(v) > systemMetadataLength {
+				v = v[:systemMetadataLength]
+			}
+			filtered[key] = v
+		}
+	}
+
+	return filtered
+}
+
+// MetadataKeys returns the custom metadata fields of the calls of the
+// system, a comma separated list like "channel bank, dispatch zone".
+func (system *System) MetadataKeys() []string {
+	keys := []string{}
+
+	for _, key := range strings.Split(system.MetadataFields, ",") {
+		if key = strings.TrimSpace(key); len(key) > 0 {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
 }
 
 func NewSystem() *System {
 	return &System{
+		Sites:      NewSites(),
 		Talkgroups: NewTalkgroups(),
 		Units:      NewUnits(),
 	}
@@ -55,6 +97,11 @@ func (system *System) FromMap(m map[string]any) *System {
 		system.Id = uint(v)
 	}
 
+	switch v := m["audioNormalization"].(type) {
+	case string:
+		system.AudioNormalization = v
+	}
+
 	switch v := m["autoPopulate"].(type) {
 	case bool:
 		system.AutoPopulate = v
@@ -70,6 +117,11 @@ func (system *System) FromMap(m map[string]any) *System {
 		system.Label = v
 	}
 
+	switch v := m["metadataFields"].(type) {
+	case string:
+		system.MetadataFields = v
+	}
+
 	switch v := m["led"].(type) {
 	case string:
 		system.Led = v
@@ -80,6 +132,16 @@ func (system *System) FromMap(m map[string]any) *System {
 		system.Order = uint(v)
 	}
 
+	switch v := m["qosWeight"].(type) {
+	case float64:
+		system.QosWeight = uint(v)
+	}
+
+	switch v := m["sites"].(type) {
+	case []any:
+		system.Sites.FromMap(v)
+	}
+
 	switch v := m["talkgroups"].(type) {
 	case []any:
 		system.Talkgroups.FromMap(v)
@@ -162,19 +224,94 @@ func (systems *Systems) GetSystem(f any) (system *System, ok bool) {
 	return nil, false
 }
 
+// GetCallTalkgroup returns the talkgroup of the call on its site, nil when
+// it is unknown.
+func (systems *Systems) GetCallTalkgroup(call *Call) *Talkgroup {
+	system, ok := systems.GetSystem(call.System)
+	if !ok {
+		return nil
+	}
+
+	talkgroup, _ := system.Talkgroups.GetSiteTalkgroup(call.Talkgroup, call.Site)
+
+	return talkgroup
+}
+
+// sqlHiddenCondition is the condition on the calls leaving out the encrypted
+// calls of the talkgroups hiding them, the calls of the hidden talkgroups and
+// those too recent for the delay of their talkgroup, nil when there are none.
+func (systems *Systems) sqlHiddenCondition() *SqlCondition {
+	systems.mutex.Lock()
+	defer systems.mutex.Unlock()
+
+	var (
+		delayed   = []*SqlCondition{}
+		encrypted = []*SqlCondition{}
+		hidden    = []*SqlCondition{}
+		now       = time.Now()
+	)
+
+	for _, system := range systems.List {
+		system.Talkgroups.mutex.Lock()
+		for _, talkgroup := range system.Talkgroups.List {
+			if !talkgroup.HideEncrypted && !talkgroup.Hidden && talkgroup.Delay == 0 {
+				continue
+			}
+
+			condition := SqlAnd(SqlWhere("`system` = ?", system.Id), SqlWhere("`talkgroup` = ?", talkgroup.Id))
+			if talkgroup.Site > 0 {
+				condition = SqlAnd(condition, SqlWhere("`site` = ?", talkgroup.Site))
+			}
+
+			switch {
+			case talkgroup.Hidden:
+				hidden = append(hidden, condition)
+				continue
+			case talkgroup.Delay > 0:
+				delayed = append(delayed, SqlAnd(condition, SqlWhere("`dateTime` > ?", now.Add(-talkgroup.GetDelay()))))
+			}
+
+			if talkgroup.HideEncrypted {
+				encrypted = append(encrypted, condition)
+			}
+		}
+		system.Talkgroups.mutex.Unlock()
+	}
+
+	a := []*SqlCondition{}
+
+	if len(encrypted) > 0 {
+		a = append(a, SqlNot(SqlAnd(SqlWhere("`encrypted` = ?", true), SqlOr(encrypted...))))
+	}
+
+	if len(hidden) > 0 {
+		a = append(a, SqlNot(SqlOr(hidden...)))
+	}
+
+	if len(delayed) > 0 {
+		a = append(a, SqlNot(SqlOr(delayed...)))
+	}
+
+	if len(a) == 0 {
+		return nil
+	}
+
+	return SqlAnd(a...)
+}
+
 func (systems *Systems) GetScopedSystems(client *Client, groups *Groups, tags *Tags, sortTalkgroups bool) SystemsMap {
 	var (
 		rawSystems = []System{}
 		systemsMap = SystemsMap{}
 	)
 
-	if client.Access == nil {
+	if client.GetAccess() == nil {
 		for _, system := range systems.List {
 			rawSystems = append(rawSystems, *system)
 		}
 
 	} else {
-		switch v := client.Access.Systems.(type) {
+		switch v := client.GetAccess().Systems.(type) {
 		case nil:
 			for _, system := range systems.List {
 				rawSystems = append(rawSystems, *system)
@@ -222,12 +359,8 @@ func (systems *Systems) GetScopedSystems(client *Client, groups *Groups, tags *T
 						for _, fTalkgroupId := range v {
 							switch v := fTalkgroupId.(type) {
 							case float64:
-								talkgroupId := uint(v)
-								rawTalkgroup, ok := system.Talkgroups.GetTalkgroup(talkgroupId)
-								if !ok {
-									continue
-								}
-								rawSystem.Talkgroups.List = append(rawSystem.Talkgroups.List, rawTalkgroup)
+								// an access to a talkgroup gives it on all the sites
+								rawSystem.Talkgroups.List = append(rawSystem.Talkgroups.List, system.Talkgroups.GetTalkgroupSites(uint(v))...)
 							default:
 								continue
 							}
@@ -252,6 +385,10 @@ func (systems *Systems) GetScopedSystems(client *Client, groups *Groups, tags *T
 		}
 
 		for j, rawTalkgroup := range rawSystem.Talkgroups.List {
+			if rawTalkgroup.Hidden {
+				continue
+			}
+
 			group, ok := groups.GetGroup(rawTalkgroup.GroupId)
 			if !ok {
 				continue
@@ -281,6 +418,10 @@ func (systems *Systems) GetScopedSystems(client *Client, groups *Groups, tags *T
 				talkgroupMap["led"] = rawTalkgroup.Led
 			}
 
+			if rawTalkgroup.Site > 0 {
+				talkgroupMap["site"] = rawTalkgroup.Site
+			}
+
 			talkgroupsMap = append(talkgroupsMap, talkgroupMap)
 		}
 
@@ -305,6 +446,10 @@ func (systems *Systems) GetScopedSystems(client *Client, groups *Groups, tags *T
 			systemMap["led"] = rawSystem.Led
 		}
 
+		if rawSystem.Sites != nil && len(rawSystem.Sites.List) > 0 {
+			systemMap["sites"] = rawSystem.Sites.List
+		}
+
 		systemsMap = append(systemsMap, systemMap)
 	}
 
@@ -322,12 +467,15 @@ func (systems *Systems) GetScopedSystems(client *Client, groups *Groups, tags *T
 
 func (systems *Systems) Read(db *Database) error {
 	var (
-		blacklists sql.NullString
-		err        error
-		led        sql.NullString
-		order      sql.NullFloat64
-		rowId      sql.NullFloat64
-		rows       *sql.Rows
+		audioNormalization sql.NullString
+		blacklists         sql.NullString
+		err                error
+		led                sql.NullString
+		metadataFields     sql.NullString
+		order              sql.NullFloat64
+		qosWeight          sql.NullFloat64
+		rowId              sql.NullFloat64
+		rows               *sql.Rows
 	)
 
 	systems.mutex.Lock()
@@ -339,17 +487,18 @@ func (systems *Systems) Read(db *Database) error {
 		return fmt.Errorf("systems.read: %v", err)
 	}
 
-	if rows, err = db.Sql.Query("select `_id`, `autoPopulate`, `blacklists`, `id`, `label`, `led`, `order` from `rdioScannerSystems`"); err != nil {
+	if rows, err = db.Sql.Query("select `_id`, `audioNormalization`, `autoPopulate`, `blacklists`, `id`, `label`, `led`, `metadataFields`, `order`, `qosWeight` from `rdioScannerSystems`"); err != nil {
 		return formatError(err)
 	}
 
 	for rows.Next() {
 		system := &System{
+			Sites:      NewSites(),
 			Talkgroups: NewTalkgroups(),
 			Units:      NewUnits(),
 		}
 
-		if err = rows.Scan(&rowId, &system.AutoPopulate, &blacklists, &system.Id, &system.Label, &led, &order); err != nil {
+		if err = rows.Scan(&rowId, &audioNormalization, &system.AutoPopulate, &blacklists, &system.Id, &system.Label, &led, &metadataFields, &order, &qosWeight); err != nil {
 			break
 		}
 
@@ -357,6 +506,10 @@ func (systems *Systems) Read(db *Database) error {
 			system.RowId = uint(rowId.Float64)
 		}
 
+		if audioNormalization.Valid {
+			system.AudioNormalization = audioNormalization.String
+		}
+
 		if blacklists.Valid && len(blacklists.String) > 0 {
 			blacklists.String = strings.ReplaceAll(blacklists.String, "[", "")
 			blacklists.String = strings.ReplaceAll(blacklists.String, "]", "")
@@ -367,10 +520,22 @@ func (systems *Systems) Read(db *Database) error {
 			system.Led = led.String
 		}
 
+		if metadataFields.Valid {
+			system.MetadataFields = metadataFields.String
+		}
+
 		if order.Valid && order.Float64 > 0 {
 			system.Order = uint(order.Float64)
 		}
 
+		if qosWeight.Valid && qosWeight.Float64 > 0 {
+			system.QosWeight = uint(qosWeight.Float64)
+		}
+
+		if err = system.Sites.Read(db, system.Id); err != nil {
+			return err
+		}
+
 		if err = system.Talkgroups.Read(db, system.Id); err != nil {
 			return err
 		}
@@ -442,33 +607,19 @@ func (systems *Systems) Write(db *Database) error {
 	}
 
 	if len(rowIds) > 0 {
-		// Build parameterized IN clause to prevent SQL injection
-		placeholders := make([]string, len(rowIds))
-		args := make([]any, len(rowIds))
-		for i, id := range rowIds {
-			placeholders[i] = "?"
-			args[i] = id
-		}
-		q := fmt.Sprintf("delete from `rdioScannerSystems` where `_id` in (%s)", strings.Join(placeholders, ","))
-		if _, err = db.Sql.Exec(q, args...); err != nil {
+		if _, err = db.Delete("rdioScannerSystems").Where(SqlIn("_id", rowIds)).Exec(); err != nil {
 			return formatError(err)
 		}
 	}
 
 	if len(systemIds) > 0 {
-		// Build parameterized IN clause to prevent SQL injection
-		placeholders := make([]string, len(systemIds))
-		args := make([]any, len(systemIds))
-		for i, id := range systemIds {
-			placeholders[i] = "?"
-			args[i] = id
-		}
-		q := fmt.Sprintf("delete from `rdioScannerTalkgroups` where `systemId` in (%s)", strings.Join(placeholders, ","))
-		if _, err = db.Sql.Exec(q, args...); err != nil {
+		if _, err = db.Delete("rdioScannerSites").Where(SqlIn("systemId", systemIds)).Exec(); err != nil {
 			return formatError(err)
 		}
-		q = fmt.Sprintf("delete from `rdioScannerUnits` where `systemId` in (%s)", strings.Join(placeholders, ","))
-		if _, err = db.Sql.Exec(q, args...); err != nil {
+		if _, err = db.Delete("rdioScannerTalkgroups").Where(SqlIn("systemId", systemIds)).Exec(); err != nil {
+			return formatError(err)
+		}
+		if _, err = db.Delete("rdioScannerUnits").Where(SqlIn("systemId", systemIds)).Exec(); err != nil {
 			return formatError(err)
 		}
 	}
@@ -485,14 +636,18 @@ func (systems *Systems) Write(db *Database) error {
 		}
 
 		if count == 0 {
-			if _, err = db.Sql.Exec("insert into `rdioScannerSystems` (`_id`, `autoPopulate`, `blacklists`, `id`, `label`, `led`, `order`) values (?, ?, ?, ?, ?, ?, ?)", system.RowId, system.AutoPopulate, blacklists, system.Id, system.Label, system.Led, system.Order); err != nil {
+			if _, err = db.Sql.Exec("insert into `rdioScannerSystems` (`_id`, `audioNormalization`, `autoPopulate`, `blacklists`, `id`, `label`, `led`, `metadataFields`, `order`, `qosWeight`) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", system.RowId, system.AudioNormalization, system.AutoPopulate, blacklists, system.Id, system.Label, system.Led, system.MetadataFields, system.Order, system.QosWeight); err != nil {
 				break
 			}
 
-		} else if _, err = db.Sql.Exec("update `rdioScannerSystems` set `_id` = ?, `autoPopulate` = ?, `blacklists` = ?, `id` = ?, `label` = ?, `led` = ?, `order` = ? where `_id` = ?", system.RowId, system.AutoPopulate, blacklists, system.Id, system.Label, system.Led, system.Order, system.RowId); err != nil {
+		} else if _, err = db.Sql.Exec("update `rdioScannerSystems` set `_id` = ?, `audioNormalization` = ?, `autoPopulate` = ?, `blacklists` = ?, `id` = ?, `label` = ?, `led` = ?, `metadataFields` = ?, `order` = ?, `qosWeight` = ? where `_id` = ?", system.RowId, system.AudioNormalization, system.AutoPopulate, blacklists, system.Id, system.Label, system.Led, system.MetadataFields, system.Order, system.QosWeight, system.RowId); err != nil {
 			break
 		}
 
+		if err = system.Sites.Write(db, system.Id); err != nil {
+			return err
+		}
+
 		if err = system.Talkgroups.Write(db, system.Id); err != nil {
 			return err
 		}
@@ -0,0 +1,100 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSystemFilterMetadata(t *testing.T) {
+	long := strings.Repeat("a", systemMetadataLength+10)
+
+	tests := []struct {
+		name     string
+		fields   string
+		metadata map[string]string
+		want     map[string]string
+	}{
+		{name: "no fields", metadata: map[string]string{"zone": "north"}},
+		{name: "kept", fields: "channel bank, zone", metadata: map[string]string{"zone": "north", "other": "x"}, want: map[string]string{"zone": "north"}},
+		{name: "empty value", fields: "zone", metadata: map[string]string{"zone": ""}},
+		{name: "truncated", fields: "zone", metadata: map[string]string{"zone": long}, want: map[string]string{"zone": long[:systemMetadataLength]}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			system := &System{MetadataFields: test.fields}
+
+			got := system.FilterMetadata(test.metadata)
+
+			if len(got) != len(test.want) {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+			for k, v := range test.want {
+				if got[k] != v {
+					t.Errorf("got %v, want %v", got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSystemsWriteSites(t *testing.T) {
+	db := newTestDatabase(t)
+
+	systems := NewSystems()
+	systems.FromMap([]any{
+		map[string]any{
+			"_id":   float64(1),
+			"id":    float64(1),
+			"label": "System",
+			"sites": []any{
+				map[string]any{"id": float64(2), "label": "South", "order": float64(2)},
+				map[string]any{"id": float64(1), "label": "North", "order": float64(1)},
+			},
+			"talkgroups": []any{},
+			"units":      []any{},
+		},
+	})
+
+	if err := systems.Write(db); err != nil {
+		t.Fatal(err)
+	}
+
+	systems.List[0].Sites.List = systems.List[0].Sites.List[1:]
+
+	if err := systems.Write(db); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := systems.Read(db); err != nil {
+		t.Fatal(err)
+	}
+
+	system, ok := systems.GetSystem(uint(1))
+	if !ok {
+		t.Fatal("system not read")
+	}
+
+	if len(system.Sites.List) != 1 || system.Sites.GetLabel(1) != "North" {
+		t.Errorf("got sites %v", system.Sites.List)
+	}
+
+	if label := system.Sites.GetLabel(2); label != "2" {
+		t.Errorf("got label %q for a removed site, want its id", label)
+	}
+}
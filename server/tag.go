@@ -17,15 +17,18 @@ package main
 
 import (
 	"database/sql"
-	"encoding/json"
 	"fmt"
-	"strings"
 	"sync"
 )
 
+// Tag is the category of the talkgroups. In the retention compliance mode,
+// the calls of its talkgroups are kept at least MinDays and at most MaxDays,
+// 0 meaning no bound.
 type Tag struct {
-	Id    any    `json:"_id"`
-	Label string `json:"label"`
+	Id      any    `json:"_id"`
+	Label   string `json:"label"`
+	MaxDays uint   `json:"maxDays"`
+	MinDays uint   `json:"minDays"`
 }
 
 func (tag *Tag) FromMap(m map[string]any) *Tag {
@@ -39,6 +42,16 @@ func (tag *Tag) FromMap(m map[string]any) *Tag {
 		tag.Label = v
 	}
 
+	switch v := m["maxDays"].(type) {
+	case float64:
+		tag.MaxDays = uint(v)
+	}
+
+	switch v := m["minDays"].(type) {
+	case float64:
+		tag.MinDays = uint(v)
+	}
+
 	return tag
 }
 
@@ -178,14 +191,14 @@ func (tags *Tags) Read(db *Database) error {
 		return fmt.Errorf("tags read: %v", err)
 	}
 
-	if rows, err = db.Sql.Query("select `_id`, `label` from `rdioScannerTags`"); err != nil {
+	if rows, err = db.Sql.Query("select `_id`, `label`, `maxDays`, `minDays` from `rdioScannerTags`"); err != nil {
 		return formatError(err)
 	}
 
 	for rows.Next() {
 		tag := &Tag{}
 
-		if err = rows.Scan(&id, &tag.Label); err != nil {
+		if err = rows.Scan(&id, &tag.Label, &tag.MaxDays, &tag.MinDays); err != nil {
 			break
 		}
 
@@ -248,15 +261,7 @@ func (tags *Tags) Write(db *Database) error {
 	}
 
 	if len(rowIds) > 0 {
-		// Build parameterized IN clause to prevent SQL injection
-		placeholders := make([]string, len(rowIds))
-		args := make([]any, len(rowIds))
-		for i, id := range rowIds {
-			placeholders[i] = "?"
-			args[i] = id
-		}
-		q := fmt.Sprintf("delete from `rdioScannerTags` where `_id` in (%s)", strings.Join(placeholders, ","))
-		if _, err = db.Sql.Exec(q, args...); err != nil {
+		if _, err = db.Delete("rdioScannerTags").Where(SqlIn("_id", rowIds)).Exec(); err != nil {
 			return formatError(err)
 		}
 	}
@@ -267,10 +272,10 @@ func (tags *Tags) Write(db *Database) error {
 		}
 
 		if count == 0 {
-			if _, err = db.Sql.Exec("insert into `rdioScannerTags` (`_id`, `label`) values (?, ?)", tag.Id, tag.Label); err != nil {
+			if _, err = db.Sql.Exec("insert into `rdioScannerTags` (`_id`, `label`, `maxDays`, `minDays`) values (?, ?, ?, ?)", tag.Id, tag.Label, tag.MaxDays, tag.MinDays); err != nil {
 				break
 			}
-		} else if _, err = db.Sql.Exec("update `rdioScannerTags` set `_id` = ?, `label` = ? where `_id` = ?", tag.Id, tag.Label, tag.Id); err != nil {
+		} else if _, err = db.Sql.Exec("update `rdioScannerTags` set `_id` = ?, `label` = ?, `maxDays` = ?, `minDays` = ? where `_id` = ?", tag.Id, tag.Label, tag.MaxDays, tag.MinDays, tag.Id); err != nil {
 			break
 		}
 	}
@@ -18,23 +18,35 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 	"sort"
-	"strings"
 	"sync"
+	"time"
 )
 
+// Talkgroup is a talkgroup of a system. A hidden talkgroup is left out of the
+// webapp and of the events stream, its calls are still recorded and
+// relayed. The calls of a talkgroup with a delay reach the listeners that
+// many seconds late, the longest of its delay and of the tier delay, and
+// those of a talkgroup muting its alerts fire no alert.
 type Talkgroup struct {
-	Frequency any `json:"frequency"`
-	group     string
-	GroupId   uint   `json:"groupId"`
-	Id        uint   `json:"id"`
-	Label     string `json:"label"`
-	Led       any    `json:"led"`
-	Name      string `json:"name"`
-	Order     uint   `json:"order"`
-	TagId     uint   `json:"tagId"`
-	tag       string
+	Delay         uint `json:"delay"`
+	Frequency     any  `json:"frequency"`
+	group         string
+	GroupId       uint   `json:"groupId"`
+	HideEncrypted bool   `json:"hideEncrypted"`
+	Hidden        bool   `json:"hidden"`
+	Id            uint   `json:"id"`
+	Label         string `json:"label"`
+	Led           any    `json:"led"`
+	MuteAlerts    bool   `json:"muteAlerts"`
+	Name          string `json:"name"`
+	Order         uint   `json:"order"`
+	Site          uint   `json:"site"`
+	TagId         uint   `json:"tagId"`
+	tag           string
 }
 
 func (talkgroup *Talkgroup) FromMap(m map[string]any) *Talkgroup {
@@ -43,6 +55,11 @@ func (talkgroup *Talkgroup) FromMap(m map[string]any) *Talkgroup {
 		talkgroup.Id = uint(v)
 	}
 
+	switch v := m["delay"].(type) {
+	case float64:
+		talkgroup.Delay = uint(v)
+	}
+
 	switch v := m["frequency"].(type) {
 	case float64:
 		talkgroup.Frequency = uint(v)
@@ -58,6 +75,16 @@ func (talkgroup *Talkgroup) FromMap(m map[string]any) *Talkgroup {
 		talkgroup.GroupId = uint(v)
 	}
 
+	switch v := m["hideEncrypted"].(type) {
+	case bool:
+		talkgroup.HideEncrypted = v
+	}
+
+	switch v := m["hidden"].(type) {
+	case bool:
+		talkgroup.Hidden = v
+	}
+
 	switch v := m["label"].(type) {
 	case string:
 		talkgroup.Label = v
@@ -68,6 +95,11 @@ func (talkgroup *Talkgroup) FromMap(m map[string]any) *Talkgroup {
 		talkgroup.Led = v
 	}
 
+	switch v := m["muteAlerts"].(type) {
+	case bool:
+		talkgroup.MuteAlerts = v
+	}
+
 	switch v := m["name"].(type) {
 	case string:
 		talkgroup.Name = v
@@ -78,6 +110,11 @@ func (talkgroup *Talkgroup) FromMap(m map[string]any) *Talkgroup {
 		talkgroup.Order = uint(v)
 	}
 
+	switch v := m["site"].(type) {
+	case float64:
+		talkgroup.Site = uint(v)
+	}
+
 	switch v := m["tag"].(type) {
 	case string:
 		talkgroup.tag = v
@@ -91,6 +128,25 @@ func (talkgroup *Talkgroup) FromMap(m map[string]any) *Talkgroup {
 	return talkgroup
 }
 
+// GetDelay returns how far behind live the listeners hear the talkgroup.
+func (talkgroup *Talkgroup) GetDelay() time.Duration {
+	if talkgroup == nil {
+		return 0
+	}
+
+	return time.Duration(talkgroup.Delay) * time.Second
+}
+
+// IsAvailable tells whether a call of the talkgroup may reach the listeners,
+// the talkgroup being visible and the call old enough for its delay.
+func (talkgroup *Talkgroup) IsAvailable(call *Call) bool {
+	if talkgroup == nil {
+		return true
+	}
+
+	return !talkgroup.Hidden && (talkgroup.Delay == 0 || time.Since(call.DateTime) >= talkgroup.GetDelay())
+}
+
 type TalkgroupMap map[string]any
 
 type Talkgroups struct {
@@ -105,6 +161,60 @@ func NewTalkgroups() *Talkgroups {
 	}
 }
 
+// Clone copies the given talkgroups, shifting their ids by offset. Existing
+// talkgroups are left untouched unless overwrite is set, their ids are
+// returned as skipped.
+func (talkgroups *Talkgroups) Clone(source []*Talkgroup, offset int, overwrite bool) (cloned []uint, skipped []uint, err error) {
+	talkgroups.mutex.Lock()
+	defer talkgroups.mutex.Unlock()
+
+	var order uint
+	for _, talkgroup := range talkgroups.List {
+		if talkgroup.Order > order {
+			order = talkgroup.Order
+		}
+	}
+
+	cloned = []uint{}
+	skipped = []uint{}
+
+	for _, src := range source {
+		id := int(src.Id) + offset
+		if id < 1 {
+			return nil, nil, fmt.Errorf("talkgroups.clone: talkgroup %d would get id %d", src.Id, id)
+		}
+
+		var existing *Talkgroup
+		for _, talkgroup := range talkgroups.List {
+			if talkgroup.Id == uint(id) && talkgroup.Site == src.Site {
+				existing = talkgroup
+				break
+			}
+		}
+
+		if existing != nil && !overwrite {
+			skipped = append(skipped, uint(id))
+			continue
+		}
+
+		talkgroup := *src
+		talkgroup.Id = uint(id)
+
+		if existing != nil {
+			talkgroup.Order = existing.Order
+			*existing = talkgroup
+		} else {
+			order++
+			talkgroup.Order = order
+			talkgroups.List = append(talkgroups.List, &talkgroup)
+		}
+
+		cloned = append(cloned, uint(id))
+	}
+
+	return cloned, skipped, nil
+}
+
 func (talkgroups *Talkgroups) FromMap(f []any) *Talkgroups {
 	talkgroups.mutex.Lock()
 	defer talkgroups.mutex.Unlock()
@@ -145,6 +255,100 @@ func (talkgroups *Talkgroups) GetTalkgroup(f any) (system *Talkgroup, ok bool) {
 	return nil, false
 }
 
+// GetSiteTalkgroup returns the talkgroup of a site, a talkgroup defined for
+// all sites or else the first one with that id standing in for it.
+func (talkgroups *Talkgroups) GetSiteTalkgroup(id uint, site uint) (*Talkgroup, bool) {
+	talkgroups.mutex.Lock()
+	defer talkgroups.mutex.Unlock()
+
+	var found *Talkgroup
+
+	for _, talkgroup := range talkgroups.List {
+		if talkgroup.Id != id {
+			continue
+		}
+
+		if talkgroup.Site == site {
+			return talkgroup, true
+		}
+
+		if found == nil || (talkgroup.Site == 0 && found.Site != 0) {
+			found = talkgroup
+		}
+	}
+
+	return found, found != nil
+}
+
+// GetTalkgroupSites returns the talkgroups of all sites with that id.
+func (talkgroups *Talkgroups) GetTalkgroupSites(id uint) []*Talkgroup {
+	talkgroups.mutex.Lock()
+	defer talkgroups.mutex.Unlock()
+
+	list := []*Talkgroup{}
+
+	for _, talkgroup := range talkgroups.List {
+		if talkgroup.Id == id {
+			list = append(list, talkgroup)
+		}
+	}
+
+	return list
+}
+
+// Merge adds the given talkgroups, or updates the existing ones when
+// overwrite is set, keeping their order, frequency and led. The ids of the
+// existing talkgroups left untouched are returned as skipped.
+func (talkgroups *Talkgroups) Merge(source []*Talkgroup, overwrite bool) (merged []uint, skipped []uint, err error) {
+	talkgroups.mutex.Lock()
+	defer talkgroups.mutex.Unlock()
+
+	var order uint
+	for _, talkgroup := range talkgroups.List {
+		if talkgroup.Order > order {
+			order = talkgroup.Order
+		}
+	}
+
+	merged = []uint{}
+	skipped = []uint{}
+
+	for _, src := range source {
+		if src.Id == 0 {
+			return nil, nil, errors.New("talkgroups.merge: talkgroup without id")
+		}
+
+		var existing *Talkgroup
+		for _, talkgroup := range talkgroups.List {
+			if talkgroup.Id == src.Id && talkgroup.Site == src.Site {
+				existing = talkgroup
+				break
+			}
+		}
+
+		if existing != nil && !overwrite {
+			skipped = append(skipped, src.Id)
+			continue
+		}
+
+		if existing != nil {
+			existing.GroupId = src.GroupId
+			existing.Label = src.Label
+			existing.Name = src.Name
+			existing.TagId = src.TagId
+		} else {
+			talkgroup := *src
+			order++
+			talkgroup.Order = order
+			talkgroups.List = append(talkgroups.List, &talkgroup)
+		}
+
+		merged = append(merged, src.Id)
+	}
+
+	return merged, skipped, nil
+}
+
 func (talkgroups *Talkgroups) Read(db *Database, systemId uint) error {
 	var (
 		err       error
@@ -162,14 +366,14 @@ func (talkgroups *Talkgroups) Read(db *Database, systemId uint) error {
 		return fmt.Errorf("talkgroups.read: %v", err)
 	}
 
-	if rows, err = db.Sql.Query("select `frequency`, `groupId`, `id`, `label`, `led`, `name`, `order`, `tagId` from `rdioScannerTalkgroups` where `systemId` = ?", systemId); err != nil {
+	if rows, err = db.Sql.Query("select `delay`, `frequency`, `groupId`, `hideEncrypted`, `hidden`, `id`, `label`, `led`, `muteAlerts`, `name`, `order`, `site`, `tagId` from `rdioScannerTalkgroups` where `systemId` = ?", systemId); err != nil {
 		return formatError(err)
 	}
 
 	for rows.Next() {
 		talkgroup := &Talkgroup{}
 
-		if err = rows.Scan(&frequency, &talkgroup.GroupId, &talkgroup.Id, &talkgroup.Label, &led, &talkgroup.Name, &talkgroup.Order, &talkgroup.TagId); err != nil {
+		if err = rows.Scan(&talkgroup.Delay, &frequency, &talkgroup.GroupId, &talkgroup.HideEncrypted, &talkgroup.Hidden, &talkgroup.Id, &talkgroup.Label, &led, &talkgroup.MuteAlerts, &talkgroup.Name, &talkgroup.Order, &talkgroup.Site, &talkgroup.TagId); err != nil {
 			break
 		}
 
@@ -212,24 +416,28 @@ func (talkgroups *Talkgroups) Write(db *Database, systemId uint) error {
 		return fmt.Errorf("talkgroups.write: %v", err)
 	}
 
-	if rows, err = db.Sql.Query("select `id` from `rdioScannerTalkgroups` where `systemId` = ?", systemId); err != nil {
+	if rows, err = db.Sql.Query("select `_id`, `id`, `site` from `rdioScannerTalkgroups` where `systemId` = ?", systemId); err != nil {
 		return formatError(err)
 	}
 
 	for rows.Next() {
-		var id uint
-		if err = rows.Scan(&id); err != nil {
+		var (
+			_id  uint
+			id   uint
+			site uint
+		)
+		if err = rows.Scan(&_id, &id, &site); err != nil {
 			break
 		}
 		remove := true
 		for _, talkgroup := range talkgroups.List {
-			if talkgroup.Id == id {
+			if talkgroup.Id == id && talkgroup.Site == site {
 				remove = false
 				break
 			}
 		}
 		if remove {
-			ids = append(ids, id)
+			ids = append(ids, _id)
 		}
 	}
 
@@ -240,32 +448,22 @@ func (talkgroups *Talkgroups) Write(db *Database, systemId uint) error {
 	}
 
 	if len(ids) > 0 {
-		// Build parameterized IN clause to prevent SQL injection
-		placeholders := make([]string, len(ids))
-		args := make([]any, len(ids))
-		for i, id := range ids {
-			placeholders[i] = "?"
-			args[i] = id
-		}
-		// Add systemId as final parameter
-		args = append(args, systemId)
-		q := fmt.Sprintf("delete from `rdioScannerTalkgroups` where `id` in (%s) and `systemId` = ?", strings.Join(placeholders, ","))
-		if _, err = db.Sql.Exec(q, args...); err != nil {
+		if _, err = db.Delete("rdioScannerTalkgroups").Where(SqlIn("_id", ids)).Exec(); err != nil {
 			return formatError(err)
 		}
 	}
 
 	for _, talkgroup := range talkgroups.List {
-		if err = db.Sql.QueryRow("select count(*) from `rdioScannerTalkgroups` where `id` = ? and `systemId` = ?", talkgroup.Id, systemId).Scan(&count); err != nil {
+		if err = db.Sql.QueryRow("select count(*) from `rdioScannerTalkgroups` where `id` = ? and `site` = ? and `systemId` = ?", talkgroup.Id, talkgroup.Site, systemId).Scan(&count); err != nil {
 			break
 		}
 
 		if count == 0 {
-			if _, err = db.Sql.Exec("insert into `rdioScannerTalkgroups` (`frequency`, `groupId`, `id`, `label`, `led`, `name`, `order`, `systemId`, `tagId`) values (?, ?, ?, ?, ?, ?, ?, ?, ?)", talkgroup.Frequency, talkgroup.GroupId, talkgroup.Id, talkgroup.Label, talkgroup.Led, talkgroup.Name, talkgroup.Order, systemId, talkgroup.TagId); err != nil {
+			if _, err = db.Sql.Exec("insert into `rdioScannerTalkgroups` (`delay`, `frequency`, `groupId`, `hideEncrypted`, `hidden`, `id`, `label`, `led`, `muteAlerts`, `name`, `order`, `site`, `systemId`, `tagId`) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", talkgroup.Delay, talkgroup.Frequency, talkgroup.GroupId, talkgroup.HideEncrypted, talkgroup.Hidden, talkgroup.Id, talkgroup.Label, talkgroup.Led, talkgroup.MuteAlerts, talkgroup.Name, talkgroup.Order, talkgroup.Site, systemId, talkgroup.TagId); err != nil {
 				break
 			}
 
-		} else if _, err = db.Sql.Exec("update `rdioScannerTalkgroups` set `frequency` = ?, `groupId` = ?, `label` = ?, `led` = ?, `name` = ?, `order` = ?, `tagId` = ? where `id` = ? and `systemId` = ?", talkgroup.Frequency, talkgroup.GroupId, talkgroup.Label, talkgroup.Led, talkgroup.Name, talkgroup.Order, talkgroup.TagId, talkgroup.Id, systemId); err != nil {
+		} else if _, err = db.Sql.Exec("update `rdioScannerTalkgroups` set `delay` = ?, `frequency` = ?, `groupId` = ?, `hideEncrypted` = ?, `hidden` = ?, `label` = ?, `led` = ?, `muteAlerts` = ?, `name` = ?, `order` = ?, `tagId` = ? where `id` = ? and `site` = ? and `systemId` = ?", talkgroup.Delay, talkgroup.Frequency, talkgroup.GroupId, talkgroup.HideEncrypted, talkgroup.Hidden, talkgroup.Label, talkgroup.Led, talkgroup.MuteAlerts, talkgroup.Name, talkgroup.Order, talkgroup.TagId, talkgroup.Id, talkgroup.Site, systemId); err != nil {
 			break
 		}
 	}
@@ -278,3 +476,108 @@ func (talkgroups *Talkgroups) Write(db *Database, systemId uint) error {
 }
 
 type TalkgroupsMap []TalkgroupMap
+
+// TalkgroupCloneHandler copies talkgroups from one system to another, for
+// sites sharing the same fleetmap. Either a list of talkgroup ids or a
+// group id selects what to clone, or everything if neither is given.
+func (admin *Admin) TalkgroupCloneHandler(w http.ResponseWriter, r *http.Request) {
+	if !admin.Authorize(w, r, AdminRoleConfigEditor) {
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		From       uint   `json:"from"`
+		GroupId    uint   `json:"groupId"`
+		Offset     int    `json:"offset"`
+		Overwrite  bool   `json:"overwrite"`
+		Talkgroups []uint `json:"talkgroups"`
+		To         uint   `json:"to"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	controller := admin.Controller
+
+	badRequest := func(err error) {
+		controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("talkgroup clone: %v", err))
+		w.WriteHeader(http.StatusBadRequest)
+	}
+
+	from, ok := controller.Systems.GetSystem(req.From)
+	if !ok {
+		badRequest(fmt.Errorf("unknown source system %d", req.From))
+		return
+	}
+
+	to, ok := controller.Systems.GetSystem(req.To)
+	if !ok {
+		badRequest(fmt.Errorf("unknown target system %d", req.To))
+		return
+	}
+
+	if from == to && req.Offset == 0 {
+		badRequest(errors.New("cloning a system onto itself requires an offset"))
+		return
+	}
+
+	source := []*Talkgroup{}
+
+	from.Talkgroups.mutex.Lock()
+	for _, talkgroup := range from.Talkgroups.List {
+		selected := len(req.Talkgroups) == 0 && (req.GroupId == 0 || talkgroup.GroupId == req.GroupId)
+		for _, id := range req.Talkgroups {
+			if id == talkgroup.Id {
+				selected = true
+				break
+			}
+		}
+		if selected {
+			tg := *talkgroup
+			source = append(source, &tg)
+		}
+	}
+	from.Talkgroups.mutex.Unlock()
+
+	if len(source) == 0 {
+		badRequest(errors.New("no talkgroups selected"))
+		return
+	}
+
+	admin.mutex.Lock()
+	defer admin.mutex.Unlock()
+
+	cloned, skipped, err := to.Talkgroups.Clone(source, req.Offset, req.Overwrite)
+	if err != nil {
+		badRequest(err)
+		return
+	}
+
+	if err = to.Talkgroups.Write(controller.Database, to.Id); err != nil {
+		controller.Logs.LogEvent(LogLevelError, err.Error())
+		w.WriteHeader(http.StatusExpectationFailed)
+		return
+	}
+
+	controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("talkgroup clone: %d talkgroups cloned from system %d to system %d with offset %d by admin from ip %s", len(cloned), from.Id, to.Id, req.Offset, GetRemoteAddr(r)))
+
+	if _, err := controller.ConfigVersions.Snapshot(admin.author(r), fmt.Sprintf("talkgroups cloned from system %d to system %d", from.Id, to.Id)); err != nil {
+		controller.Logs.LogEvent(LogLevelError, err.Error())
+	}
+
+	controller.EmitConfig()
+
+	if b, err := json.Marshal(map[string]any{"cloned": cloned, "skipped": skipped}); err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	} else {
+		w.WriteHeader(http.StatusExpectationFailed)
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// TalkgroupsBulk changes at once how the listeners get the talkgroups of some
+// groups or tags, the systems narrowing them down, ie: {"tags": ["Law Tac"],
+// "set": {"delay": 300}}. The groups and the tags are given by id or label.
+type TalkgroupsBulk struct {
+	DryRun  bool              `json:"dryRun"`
+	Groups  []any             `json:"groups"`
+	Set     TalkgroupsBulkSet `json:"set"`
+	Systems []uint            `json:"systems"`
+	Tags    []any             `json:"tags"`
+}
+
+// TalkgroupsBulkSet holds the settings to change, those left out are kept.
+type TalkgroupsBulkSet struct {
+	Delay      *uint `json:"delay"`
+	Hidden     *bool `json:"hidden"`
+	MuteAlerts *bool `json:"muteAlerts"`
+}
+
+// String describes the change for the logs and the config versions.
+func (set *TalkgroupsBulkSet) String() string {
+	a := []string{}
+
+	if set.Delay != nil {
+		a = append(a, fmt.Sprintf("delay %ds", *set.Delay))
+	}
+
+	if set.Hidden != nil {
+		a = append(a, fmt.Sprintf("hidden %v", *set.Hidden))
+	}
+
+	if set.MuteAlerts != nil {
+		a = append(a, fmt.Sprintf("alerts muted %v", *set.MuteAlerts))
+	}
+
+	return strings.Join(a, ", ")
+}
+
+type TalkgroupsBulkMatch struct {
+	Id     uint   `json:"id"`
+	Label  string `json:"label"`
+	Site   uint   `json:"site,omitempty"`
+	System uint   `json:"system"`
+}
+
+type talkgroupsBulkChange struct {
+	delay      uint
+	hidden     bool
+	muteAlerts bool
+	system     uint
+	talkgroup  *Talkgroup
+}
+
+// BulkTalkgroups applies the change to the talkgroups it matches in a single
+// transaction, leaving them untouched if any of them can't be written, and
+// returns them. Nothing is written on a dry run.
+func (controller *Controller) BulkTalkgroups(bulk *TalkgroupsBulk) ([]TalkgroupsBulkMatch, error) {
+	var (
+		changes = []talkgroupsBulkChange{}
+		groups  = map[uint]bool{}
+		matches = []TalkgroupsBulkMatch{}
+		systems = map[uint]bool{}
+		tags    = map[uint]bool{}
+	)
+
+	formatError := func(err error) error {
+		return fmt.Errorf("controller.bulktalkgroups: %v", err)
+	}
+
+	if len(bulk.Groups) == 0 && len(bulk.Tags) == 0 {
+		return nil, formatError(errors.New("no group or tag given"))
+	}
+
+	if bulk.Set.Delay == nil && bulk.Set.Hidden == nil && bulk.Set.MuteAlerts == nil {
+		return nil, formatError(errors.New("nothing to set"))
+	}
+
+	for _, f := range bulk.Groups {
+		group, ok := controller.Groups.GetGroup(talkgroupsBulkKey(f))
+		if !ok {
+			return nil, formatError(fmt.Errorf("unknown group %v", f))
+		}
+		id, _ := group.Id.(uint)
+		groups[id] = true
+	}
+
+	for _, f := range bulk.Tags {
+		tag, ok := controller.Tags.GetTag(talkgroupsBulkKey(f))
+		if !ok {
+			return nil, formatError(fmt.Errorf("unknown tag %v", f))
+		}
+		id, _ := tag.Id.(uint)
+		tags[id] = true
+	}
+
+	for _, id := range bulk.Systems {
+		if _, ok := controller.Systems.GetSystem(id); !ok {
+			return nil, formatError(fmt.Errorf("unknown system %d", id))
+		}
+		systems[id] = true
+	}
+
+	controller.Systems.mutex.Lock()
+	list := append([]*System{}, controller.Systems.List...)
+	controller.Systems.mutex.Unlock()
+
+	for _, system := range list {
+		if len(systems) > 0 && !systems[system.Id] {
+			continue
+		}
+
+		system.Talkgroups.mutex.Lock()
+		for _, talkgroup := range system.Talkgroups.List {
+			if (len(groups) > 0 && !groups[talkgroup.GroupId]) || (len(tags) > 0 && !tags[talkgroup.TagId]) {
+				continue
+			}
+
+			change := talkgroupsBulkChange{
+				delay:      talkgroup.Delay,
+				hidden:     talkgroup.Hidden,
+				muteAlerts: talkgroup.MuteAlerts,
+				system:     system.Id,
+				talkgroup:  talkgroup,
+			}
+
+			if bulk.Set.Delay != nil {
+				change.delay = *bulk.Set.Delay
+			}
+
+			if bulk.Set.Hidden != nil {
+				change.hidden = *bulk.Set.Hidden
+			}
+
+			if bulk.Set.MuteAlerts != nil {
+				change.muteAlerts = *bulk.Set.MuteAlerts
+			}
+
+			changes = append(changes, change)
+			matches = append(matches, TalkgroupsBulkMatch{Id: talkgroup.Id, Label: talkgroup.Label, Site: talkgroup.Site, System: system.Id})
+		}
+		system.Talkgroups.mutex.Unlock()
+	}
+
+	if bulk.DryRun || len(changes) == 0 {
+		return matches, nil
+	}
+
+	tx, err := controller.Database.Sql.Begin()
+	if err != nil {
+		return nil, formatError(err)
+	}
+
+	for _, change := range changes {
+		if _, err = tx.Exec("update `rdioScannerTalkgroups` set `delay` = ?, `hidden` = ?, `muteAlerts` = ? where `id` = ? and `site` = ? and `systemId` = ?", change.delay, change.hidden, change.muteAlerts, change.talkgroup.Id, change.talkgroup.Site, change.system); err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+
+	if err != nil {
+		return nil, formatError(err)
+	}
+
+	for _, change := range changes {
+		if system, ok := controller.Systems.GetSystem(change.system); ok {
+			system.Talkgroups.mutex.Lock()
+			change.talkgroup.Delay = change.delay
+			change.talkgroup.Hidden = change.hidden
+			change.talkgroup.MuteAlerts = change.muteAlerts
+			system.Talkgroups.mutex.Unlock()
+		}
+	}
+
+	return matches, nil
+}
+
+// talkgroupsBulkKey turns the json id of a group or a tag into the key of
+// GetGroup and GetTag, the labels being kept as they are.
+func talkgroupsBulkKey(f any) any {
+	switch v := f.(type) {
+	case float64:
+		return uint(v)
+	}
+
+	return f
+}
+
+// TalkgroupsBulkHandler changes the delay, the visibility or the alerts of
+// the talkgroups of some groups or tags at once, for the changes an incident
+// calls for. The talkgroups matched are returned, without being changed on
+// a dry run.
+func (admin *Admin) TalkgroupsBulkHandler(w http.ResponseWriter, r *http.Request) {
+	if !admin.Authorize(w, r, AdminRoleConfigEditor) {
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var bulk TalkgroupsBulk
+
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 65536)).Decode(&bulk); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	controller := admin.Controller
+
+	admin.mutex.Lock()
+	defer admin.mutex.Unlock()
+
+	matches, err := controller.BulkTalkgroups(&bulk)
+	if err != nil {
+		controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("talkgroups bulk: %v", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !bulk.DryRun && len(matches) > 0 {
+		controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("talkgroups bulk: %s for %d talkgroups by %s from ip %s", bulk.Set.String(), len(matches), admin.author(r), GetRemoteAddr(r)))
+
+		if _, err := controller.ConfigVersions.Snapshot(admin.author(r), fmt.Sprintf("%s for %d talkgroups", bulk.Set.String(), len(matches))); err != nil {
+			controller.Logs.LogEvent(LogLevelError, err.Error())
+		}
+
+		controller.EmitConfig()
+	}
+
+	if b, err := json.Marshal(map[string]any{"dryRun": bulk.DryRun, "talkgroups": matches}); err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	} else {
+		w.WriteHeader(http.StatusExpectationFailed)
+	}
+}
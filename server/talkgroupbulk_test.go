@@ -0,0 +1,188 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestTalkgroupsBulk(t *testing.T) *Controller {
+	t.Helper()
+
+	controller := newTestController(t, nil)
+
+	controller.Groups.List = []*Group{{Id: uint(1), Label: "Law"}, {Id: uint(2), Label: "Fire"}}
+	controller.Tags.List = []*Tag{{Id: uint(1), Label: "Dispatch"}, {Id: uint(2), Label: "Tac"}}
+
+	for _, id := range []uint{1, 2} {
+		system := NewSystem()
+		system.Id = id
+		system.Label = "System"
+		system.Talkgroups.List = append(system.Talkgroups.List,
+			&Talkgroup{Id: 10, GroupId: 1, Label: "LAW DISP", TagId: 1},
+			&Talkgroup{Id: 11, GroupId: 1, Label: "LAW TAC", TagId: 2},
+			&Talkgroup{Id: 20, GroupId: 2, Label: "FIRE TAC", TagId: 2},
+		)
+		controller.Systems.List = append(controller.Systems.List, system)
+	}
+
+	if err := controller.Systems.Write(controller.Database); err != nil {
+		t.Fatal(err)
+	}
+
+	return controller
+}
+
+func TestTalkgroupIsAvailable(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		talkgroup *Talkgroup
+		dateTime  time.Time
+		want      bool
+	}{
+		{"unknown talkgroup", nil, now, true},
+		{"talkgroup", &Talkgroup{}, now, true},
+		{"hidden talkgroup", &Talkgroup{Hidden: true}, now.Add(-time.Hour), false},
+		{"recent call of a delayed talkgroup", &Talkgroup{Delay: 60}, now, false},
+		{"older call of a delayed talkgroup", &Talkgroup{Delay: 60}, now.Add(-2 * time.Minute), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.talkgroup.IsAvailable(&Call{DateTime: test.dateTime}); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBulkTalkgroups(t *testing.T) {
+	delay := uint(300)
+	hidden := true
+
+	tests := []struct {
+		name  string
+		bulk  TalkgroupsBulk
+		count int
+		err   bool
+	}{
+		{name: "no filter", bulk: TalkgroupsBulk{Set: TalkgroupsBulkSet{Delay: &delay}}, err: true},
+		{name: "nothing to set", bulk: TalkgroupsBulk{Tags: []any{"Tac"}}, err: true},
+		{name: "unknown tag", bulk: TalkgroupsBulk{Set: TalkgroupsBulkSet{Delay: &delay}, Tags: []any{"Patrol"}}, err: true},
+		{name: "unknown system", bulk: TalkgroupsBulk{Set: TalkgroupsBulkSet{Delay: &delay}, Systems: []uint{3}, Tags: []any{"Tac"}}, err: true},
+		{name: "dry run", bulk: TalkgroupsBulk{DryRun: true, Set: TalkgroupsBulkSet{Hidden: &hidden}, Tags: []any{"Tac"}}, count: 4},
+		{name: "group and tag", bulk: TalkgroupsBulk{Groups: []any{"Law"}, Set: TalkgroupsBulkSet{Delay: &delay}, Tags: []any{float64(2)}}, count: 2},
+		{name: "group of a system", bulk: TalkgroupsBulk{Groups: []any{float64(2)}, Set: TalkgroupsBulkSet{Hidden: &hidden}, Systems: []uint{1}}, count: 1},
+	}
+
+	controller := newTestTalkgroupsBulk(t)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			matches, err := controller.BulkTalkgroups(&test.bulk)
+
+			if test.err != (err != nil) {
+				t.Fatalf("err = %v, want an error %v", err, test.err)
+			}
+			if len(matches) != test.count {
+				t.Errorf("matches = %+v, want %d", matches, test.count)
+			}
+		})
+	}
+
+	// the changes are read back from the database, the dry run left nothing
+	for _, id := range []uint{1, 2} {
+		talkgroups := NewTalkgroups()
+		if err := talkgroups.Read(controller.Database, id); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, talkgroup := range talkgroups.List {
+			wantDelay := talkgroup.Id == 11
+			wantHidden := talkgroup.Id == 20 && id == 1
+
+			if (talkgroup.Delay == delay) != wantDelay || talkgroup.Hidden != wantHidden || talkgroup.MuteAlerts {
+				t.Errorf("system %d talkgroup %+v", id, talkgroup)
+			}
+
+			if live, _ := controller.Systems.List[id-1].Talkgroups.GetTalkgroup(talkgroup.Id); live.Delay != talkgroup.Delay || live.Hidden != talkgroup.Hidden {
+				t.Errorf("system %d talkgroup %d differs from the database", id, talkgroup.Id)
+			}
+		}
+	}
+}
+
+func TestTalkgroupsBulkHandler(t *testing.T) {
+	controller := newTestTalkgroupsBulk(t)
+
+	token, err := controller.Admin.NewToken(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewer, err := controller.Admin.NewOidcToken("someone", AdminRoleViewer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		body   string
+		status int
+	}{
+		{"no token", http.MethodPost, "", `{"tags":["Tac"],"set":{"muteAlerts":true}}`, http.StatusUnauthorized},
+		{"viewer", http.MethodPost, viewer, `{"tags":["Tac"],"set":{"muteAlerts":true}}`, http.StatusForbidden},
+		{"get", http.MethodGet, token, "", http.StatusMethodNotAllowed},
+		{"not json", http.MethodPost, token, "tags", http.StatusBadRequest},
+		{"unknown group", http.MethodPost, token, `{"groups":["EMS"],"set":{"muteAlerts":true}}`, http.StatusBadRequest},
+		{"mute the alerts", http.MethodPost, token, `{"tags":["Tac"],"set":{"muteAlerts":true}}`, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, "/api/admin/talkgroups/bulk", strings.NewReader(test.body))
+			if len(test.token) > 0 {
+				r.Header.Set("Authorization", test.token)
+			}
+
+			w := httptest.NewRecorder()
+			controller.Admin.TalkgroupsBulkHandler(w, r)
+
+			if w.Code != test.status {
+				t.Errorf("status %d, want %d", w.Code, test.status)
+			}
+		})
+	}
+
+	for _, system := range controller.Systems.List {
+		for _, talkgroup := range system.Talkgroups.List {
+			if talkgroup.MuteAlerts != (talkgroup.TagId == 2) {
+				t.Errorf("system %d talkgroup %+v", system.Id, talkgroup)
+			}
+		}
+	}
+
+	if versions, err := controller.ConfigVersions.List(); err != nil || len(versions) != 1 {
+		t.Errorf("versions = %+v, %v", versions, err)
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TierAdminViewer = "admin-viewer"
+	TierDispatcher  = "dispatcher"
+	TierMember      = "member"
+	TierPublic      = "public"
+)
+
+// Tier is a named set of capabilities. Access codes and openid connect
+// groups decide who the listener is and which systems they may hear, the
+// tier decides what they may do with it. Listeners without a tier are not
+// restricted beyond their systems.
+type Tier struct {
+	Id         any    `json:"_id"`
+	Delay      uint   `json:"delay"`
+	Download   bool   `json:"download"`
+	Name       string `json:"name"`
+	Order      any    `json:"order"`
+	Redact     bool   `json:"redact"`
+	SearchDays uint   `json:"searchDays"`
+}
+
+func (tier *Tier) FromMap(m map[string]any) *Tier {
+	switch v := m["_id"].(type) {
+	case float64:
+		tier.Id = uint(v)
+	}
+
+	switch v := m["delay"].(type) {
+	case float64:
+		tier.Delay = uint(v)
+	}
+
+	switch v := m["download"].(type) {
+	case bool:
+		tier.Download = v
+	}
+
+	switch v := m["name"].(type) {
+	case string:
+		tier.Name = strings.TrimSpace(v)
+	}
+
+	switch v := m["order"].(type) {
+	case float64:
+		tier.Order = uint(v)
+	}
+
+	switch v := m["redact"].(type) {
+	case bool:
+		tier.Redact = v
+	}
+
+	switch v := m["searchDays"].(type) {
+	case float64:
+		tier.SearchDays = uint(v)
+	}
+
+	return tier
+}
+
+// GetDelay returns how far behind live the listeners of the tier are.
+func (tier *Tier) GetDelay() time.Duration {
+	if tier == nil {
+		return 0
+	}
+
+	return time.Duration(tier.Delay) * time.Second
+}
+
+// IsAvailable tells whether a call is old enough for the tier delay.
+func (tier *Tier) IsAvailable(call *Call) bool {
+	return tier == nil || tier.Delay == 0 || time.Since(call.DateTime) >= tier.GetDelay()
+}
+
+// RedactCall returns the call as the listeners of the tier may receive it,
+// a copy without the radio ids, their location and the transcript when the
+// tier redacts.
+func (tier *Tier) RedactCall(call *Call) *Call {
+	if tier == nil || !tier.Redact {
+		return call
+	}
+
+	redacted := *call
+	redacted.Latitude = nil
+	redacted.Longitude = nil
+	redacted.Source = nil
+	redacted.Sources = []map[string]any{}
+	redacted.Transcript = nil
+
+	return &redacted
+}
+
+// sqlCondition restricts a search to the calls the tier delay and search
+// depth give access to.
+func (tier *Tier) sqlCondition() *SqlCondition {
+	a := []*SqlCondition{}
+
+	if tier == nil {
+		return nil
+	}
+
+	if tier.Delay > 0 {
+		a = append(a, SqlWhere("`dateTime` <= ?", time.Now().Add(-tier.GetDelay())))
+	}
+
+	if tier.SearchDays > 0 {
+		a = append(a, SqlWhere("`dateTime` >= ?", time.Now().Add(-time.Duration(tier.SearchDays)*24*time.Hour)))
+	}
+
+	return SqlAnd(a...)
+}
+
+type Tiers struct {
+	List  []*Tier
+	mutex sync.Mutex
+}
+
+func NewTiers() *Tiers {
+	return &Tiers{
+		List:  []*Tier{},
+		mutex: sync.Mutex{},
+	}
+}
+
+func (tiers *Tiers) FromMap(f []any) *Tiers {
+	tiers.mutex.Lock()
+	defer tiers.mutex.Unlock()
+
+	tiers.List = []*Tier{}
+
+	for _, r := range f {
+		switch m := r.(type) {
+		case map[string]any:
+			tier := &Tier{}
+			tier.FromMap(m)
+			if len(tier.Name) > 0 {
+				tiers.List = append(tiers.List, tier)
+			}
+		}
+	}
+
+	return tiers
+}
+
+func (tiers *Tiers) GetTier(name any) (*Tier, bool) {
+	tiers.mutex.Lock()
+	defer tiers.mutex.Unlock()
+
+	switch v := name.(type) {
+	case string:
+		for _, tier := range tiers.List {
+			if strings.EqualFold(tier.Name, v) {
+				return tier, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+func (tiers *Tiers) Read(db *Database) error {
+	var (
+		err   error
+		id    sql.NullFloat64
+		order sql.NullFloat64
+		rows  *sql.Rows
+	)
+
+	tiers.mutex.Lock()
+	defer tiers.mutex.Unlock()
+
+	tiers.List = []*Tier{}
+
+	formatError := func(err error) error {
+		return fmt.Errorf("tiers.read: %v", err)
+	}
+
+	if rows, err = db.Sql.Query("select `_id`, `delay`, `download`, `name`, `order`, `redact`, `searchDays` from `rdioScannerTiers` order by `order`"); err != nil {
+		return formatError(err)
+	}
+
+	for rows.Next() {
+		tier := &Tier{}
+
+		if err = rows.Scan(&id, &tier.Delay, &tier.Download, &tier.Name, &order, &tier.Redact, &tier.SearchDays); err != nil {
+			break
+		}
+
+		if id.Valid && id.Float64 > 0 {
+			tier.Id = uint(id.Float64)
+		}
+
+		if order.Valid && order.Float64 > 0 {
+			tier.Order = uint(order.Float64)
+		}
+
+		tiers.List = append(tiers.List, tier)
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	return nil
+}
+
+func (tiers *Tiers) Write(db *Database) error {
+	var (
+		count  uint
+		err    error
+		rows   *sql.Rows
+		rowIds = []uint{}
+	)
+
+	tiers.mutex.Lock()
+	defer tiers.mutex.Unlock()
+
+	formatError := func(err error) error {
+		return fmt.Errorf("tiers.write: %v", err)
+	}
+
+	if rows, err = db.Sql.Query("select `_id` from `rdioScannerTiers`"); err != nil {
+		return formatError(err)
+	}
+
+	for rows.Next() {
+		var id uint
+		if err = rows.Scan(&id); err != nil {
+			break
+		}
+		remove := true
+		for _, tier := range tiers.List {
+			if tier.Id == nil || tier.Id == id {
+				remove = false
+				break
+			}
+		}
+		if remove {
+			rowIds = append(rowIds, id)
+		}
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	if len(rowIds) > 0 {
+		if _, err = db.Delete("rdioScannerTiers").Where(SqlIn("_id", rowIds)).Exec(); err != nil {
+			return formatError(err)
+		}
+	}
+
+	for _, tier := range tiers.List {
+		if err = db.Sql.QueryRow("select count(*) from `rdioScannerTiers` where `_id` = ?", tier.Id).Scan(&count); err != nil {
+			break
+		}
+
+		if count == 0 {
+			if _, err = db.Sql.Exec("insert into `rdioScannerTiers` (`_id`, `delay`, `download`, `name`, `order`, `redact`, `searchDays`) values (?, ?, ?, ?, ?, ?, ?)", tier.Id, tier.Delay, tier.Download, tier.Name, tier.Order, tier.Redact, tier.SearchDays); err != nil {
+				break
+			}
+
+		} else if _, err = db.Sql.Exec("update `rdioScannerTiers` set `delay` = ?, `download` = ?, `name` = ?, `order` = ?, `redact` = ?, `searchDays` = ? where `_id` = ?", tier.Delay, tier.Download, tier.Name, tier.Order, tier.Redact, tier.SearchDays, tier.Id); err != nil {
+			break
+		}
+	}
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	return nil
+}
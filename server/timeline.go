@@ -0,0 +1,390 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	timelineMaxCalls      = 1000
+	timelineMaxMixdown    = 200
+	timelineMaxRange      = 24 * time.Hour
+	timelineMaxTalkgroups = 32
+)
+
+// Timeline is the calls of some talkgroups over a time range, interleaved in
+// the order they were heard, to follow an incident across its dispatch, tac
+// and ems channels at once.
+type Timeline struct {
+	Calls      []*TimelineCall     `json:"calls"`
+	From       time.Time           `json:"from"`
+	Talkgroups []TimelineTalkgroup `json:"talkgroups"`
+	To         time.Time           `json:"to"`
+}
+
+// TimelineCall is a call of the timeline. Its offset is the seconds from the
+// start of the timeline to the start of the call, and overlaps lists the
+// calls of the other talkgroups on the air at the same time.
+type TimelineCall struct {
+	Id             uint      `json:"id"`
+	DateTime       time.Time `json:"dateTime"`
+	Duration       float64   `json:"duration"`
+	Emergency      bool      `json:"emergency"`
+	Offset         float64   `json:"offset"`
+	Overlaps       []uint    `json:"overlaps,omitempty"`
+	Site           uint      `json:"site,omitempty"`
+	Source         any       `json:"source,omitempty"`
+	System         uint      `json:"system"`
+	Talkgroup      uint      `json:"talkgroup"`
+	TalkgroupLabel string    `json:"talkgroupLabel"`
+	TalkgroupName  string    `json:"talkgroupName"`
+}
+
+type TimelineTalkgroup struct {
+	System    uint `json:"system"`
+	Talkgroup uint `json:"talkgroup"`
+}
+
+// ParseTimelineTalkgroups reads a list of talkgroups like "54241,54242,2:100",
+// the talkgroups without a system being those of the given system.
+func ParseTimelineTalkgroups(s string, system uint) ([]TimelineTalkgroup, error) {
+	talkgroups := []TimelineTalkgroup{}
+
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); len(f) == 0 {
+			continue
+		}
+
+		tg := TimelineTalkgroup{System: system}
+
+		if i := strings.Index(f, ":"); i >= 0 {
+			id, err := strconv.ParseUint(f[:i], 10, 32)
+			if err != nil || id == 0 {
+				return nil, fmt.Errorf("invalid system %q", f[:i])
+			}
+			tg.System = uint(id)
+			f = f[i+1:]
+		}
+
+		id, err := strconv.ParseUint(f, 10, 32)
+		if err != nil || id == 0 {
+			return nil, fmt.Errorf("invalid talkgroup %q", f)
+		}
+		tg.Talkgroup = uint(id)
+
+		if tg.System == 0 {
+			return nil, fmt.Errorf("no system for talkgroup %d", tg.Talkgroup)
+		}
+
+		talkgroups = append(talkgroups, tg)
+	}
+
+	if len(talkgroups) == 0 {
+		return nil, errors.New("no talkgroups")
+	}
+
+	if len(talkgroups) > timelineMaxTalkgroups {
+		return nil, fmt.Errorf("more than %d talkgroups", timelineMaxTalkgroups)
+	}
+
+	return talkgroups, nil
+}
+
+// GetTimeline returns the calls of the talkgroups heard from the start of the
+// range until its end, within the scope of the condition.
+func (calls *Calls) GetTimeline(talkgroups []TimelineTalkgroup, from time.Time, to time.Time, scope *SqlCondition, controller *Controller) (*Timeline, error) {
+	var (
+		dateTime any
+		db       = controller.Database
+		duration sql.NullFloat64
+		err      error
+		rows     *sql.Rows
+		site     sql.NullFloat64
+		source   sql.NullFloat64
+	)
+
+	formatError := func(err error) error {
+		return fmt.Errorf("calls.gettimeline: %v", err)
+	}
+
+	timeline := &Timeline{Calls: []*TimelineCall{}, From: from, Talkgroups: talkgroups, To: to}
+
+	a := []*SqlCondition{}
+	for _, tg := range talkgroups {
+		a = append(a, SqlAnd(SqlWhere("`system` = ?", tg.System), SqlWhere("`talkgroup` = ?", tg.Talkgroup)))
+	}
+
+	where := []*SqlCondition{
+		scope,
+		SqlOr(a...),
+		SqlWhere("`dateTime` >= ?", from),
+		SqlWhere("`dateTime` < ?", to),
+	}
+
+	if rows, err = db.Select("rdioScannerCalls", "id", "dateTime", "duration", "emergency", "site", "source", "system", "talkgroup").Where(where...).OrderBy("dateTime", false).Limit(timelineMaxCalls + 1).Query(); err != nil {
+		return nil, formatError(err)
+	}
+
+	for rows.Next() {
+		call := &TimelineCall{}
+
+		if err = rows.Scan(&call.Id, &dateTime, &duration, &call.Emergency, &site, &source, &call.System, &call.Talkgroup); err != nil {
+			break
+		}
+
+		if call.DateTime, err = db.ParseDateTime(dateTime); err != nil {
+			break
+		}
+
+		if duration.Valid && duration.Float64 > 0 {
+			call.Duration = duration.Float64 / 1000
+		}
+
+		if site.Valid && site.Float64 > 0 {
+			call.Site = uint(site.Float64)
+		}
+
+		if source.Valid && source.Float64 > 0 {
+			call.Source = uint(source.Float64)
+		}
+
+		timeline.Calls = append(timeline.Calls, call)
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return nil, formatError(err)
+	}
+
+	if len(timeline.Calls) > timelineMaxCalls {
+		return nil, formatError(fmt.Errorf("more than %d calls, narrow the range", timelineMaxCalls))
+	}
+
+	sort.SliceStable(timeline.Calls, func(i int, j int) bool {
+		if timeline.Calls[i].DateTime.Equal(timeline.Calls[j].DateTime) {
+			return timeline.Calls[i].Id < timeline.Calls[j].Id
+		}
+		return timeline.Calls[i].DateTime.Before(timeline.Calls[j].DateTime)
+	})
+
+	for _, call := range timeline.Calls {
+		call.Offset = float64(call.DateTime.Sub(from).Milliseconds()) / 1000
+	}
+
+	for i, call := range timeline.Calls {
+		if system, ok := controller.Systems.GetSystem(call.System); ok {
+			if talkgroup, ok := system.Talkgroups.GetSiteTalkgroup(call.Talkgroup, call.Site); ok {
+				call.TalkgroupLabel = talkgroup.Label
+				call.TalkgroupName = talkgroup.Name
+			}
+		}
+
+		// the calls are sorted by their start, those after it which start
+		// before its end overlap
+		end := call.Offset + call.Duration
+		for _, other := range timeline.Calls[i+1:] {
+			if other.Offset >= end {
+				break
+			}
+			if other.System != call.System || other.Talkgroup != call.Talkgroup {
+				call.Overlaps = append(call.Overlaps, other.Id)
+				other.Overlaps = append(other.Overlaps, call.Id)
+			}
+		}
+	}
+
+	return timeline, nil
+}
+
+// Mixdown mixes the audio of the calls of the timeline into one, each call
+// starting at its offset.
+func (timeline *Timeline) Mixdown(controller *Controller) ([]byte, string, string, error) {
+	formatError := func(err error) error {
+		return fmt.Errorf("timeline.mixdown: %v", err)
+	}
+
+	if len(timeline.Calls) == 0 {
+		return nil, "", "", formatError(errors.New("no calls"))
+	}
+
+	if len(timeline.Calls) > timelineMaxMixdown {
+		return nil, "", "", formatError(fmt.Errorf("more than %d calls to mix, narrow the range", timelineMaxMixdown))
+	}
+
+	dir, err := os.MkdirTemp("", "rdio-scanner-mixdown-")
+	if err != nil {
+		return nil, "", "", formatError(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		files   = []string{}
+		offsets = []time.Duration{}
+	)
+
+	for _, tc := range timeline.Calls {
+		call, err := controller.Calls.GetCall(tc.Id, controller.Database)
+		if err != nil {
+			return nil, "", "", formatError(err)
+		}
+
+		audio := call.Audio
+		if call.Cold {
+			if audio, err = controller.ColdStorage.Audio(tc.Id); err != nil {
+				return nil, "", "", formatError(err)
+			}
+		}
+
+		if len(audio) == 0 {
+			continue
+		}
+
+		file := filepath.Join(dir, fmt.Sprintf("%d%s", tc.Id, archiveExt(call)))
+		if err = os.WriteFile(file, audio, 0600); err != nil {
+			return nil, "", "", formatError(err)
+		}
+
+		files = append(files, file)
+		offsets = append(offsets, call.DateTime.Sub(timeline.From))
+	}
+
+	options := controller.Options
+
+	audio, audioType, ext, err := controller.FFMpeg.Mixdown(files, offsets, options.AudioCodec, options.AudioBitrate)
+	if err != nil {
+		return nil, "", "", formatError(err)
+	}
+
+	return audio, audioType, ext, nil
+}
+
+// TimelineHandler returns the calls of some talkgroups over a time range with
+// their offsets, ie: ?system=1&talkgroups=54241,54242,2:100&from=...&to=...,
+// or with format=audio the mixdown of their audio. It takes the credentials
+// of the events stream, the calls being those they give access to.
+func (api *Api) TimelineHandler(w http.ResponseWriter, r *http.Request) {
+	controller := api.Controller
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// the same api key or access code as the events stream, with the same
+	// tier and the same login limits
+	subscriber := &eventsSubscriber{}
+	if status := api.authorizeEvents(w, r, subscriber); status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+
+	query := r.URL.Query()
+
+	// a mixdown is a download, which the tier may not allow, and runs
+	// ffmpeg over many calls, as few times as the logins
+	mixdown := query.Get("format") == "audio"
+	if mixdown {
+		if subscriber.tier != nil && !subscriber.tier.Download {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if ok, wait := controller.Logins.Allow(LoginKindMixdown, GetRemoteAddr(r)); !ok {
+			loginRetryAfter(w, wait)
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	var system uint
+	if v := query.Get("system"); len(v) > 0 {
+		id, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid system %q", v), http.StatusBadRequest)
+			return
+		}
+		system = uint(id)
+	}
+
+	talkgroups, err := ParseTimelineTalkgroups(query.Get("talkgroups"), system)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	from, err := time.Parse(time.RFC3339, query.Get("from"))
+	if err != nil {
+		http.Error(w, "invalid from", http.StatusBadRequest)
+		return
+	}
+
+	to, err := time.Parse(time.RFC3339, query.Get("to"))
+	if err != nil || !from.Before(to) || to.Sub(from) > timelineMaxRange {
+		http.Error(w, fmt.Sprintf("invalid range, at most %v", timelineMaxRange), http.StatusBadRequest)
+		return
+	}
+
+	timeline, err := controller.Calls.GetTimeline(talkgroups, from, to, api.eventsScope(subscriber), controller)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if subscriber.tier != nil && subscriber.tier.Redact {
+		for _, call := range timeline.Calls {
+			call.Source = nil
+		}
+	}
+
+	if mixdown {
+		extendWriteDeadline(r, 5*time.Minute)
+
+		audio, audioType, ext, err := timeline.Mixdown(controller)
+		if err != nil {
+			controller.Logs.LogEvent(LogLevelWarn, err.Error())
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		name := fmt.Sprintf("timeline-%s%s", from.UTC().Format("20060102-150405"), ext)
+
+		w.Header().Set("Content-Type", audioType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", name))
+
+		http.ServeContent(w, r, name, to, bytes.NewReader(audio))
+		return
+	}
+
+	if b, err := json.Marshal(timeline); err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	} else {
+		w.WriteHeader(http.StatusExpectationFailed)
+	}
+}
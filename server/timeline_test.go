@@ -0,0 +1,188 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseTimelineTalkgroups(t *testing.T) {
+	tests := []struct {
+		name   string
+		s      string
+		system uint
+		want   []TimelineTalkgroup
+		err    bool
+	}{
+		{name: "talkgroups of the system", s: "10, 20", system: 1, want: []TimelineTalkgroup{{1, 10}, {1, 20}}},
+		{name: "talkgroups of other systems", s: "10,2:100", system: 1, want: []TimelineTalkgroup{{1, 10}, {2, 100}}},
+		{name: "no system", s: "10", err: true},
+		{name: "invalid talkgroup", s: "1:fd", err: true},
+		{name: "no talkgroups", s: " , ", system: 1, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseTimelineTalkgroups(test.s, test.system)
+
+			if test.err != (err != nil) {
+				t.Fatalf("err = %v, want an error %v", err, test.err)
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Errorf("got %v, want %v", got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestTimelineHandler(t *testing.T) {
+	controller := newTestController(t, nil)
+
+	system := NewSystem()
+	system.Id = 1
+	system.Talkgroups.List = append(system.Talkgroups.List, &Talkgroup{Id: 10, Label: "FD", Name: "Fire Dispatch"}, &Talkgroup{Id: 20, Label: "FTAC", Name: "Fire Tac"})
+	controller.Systems.List = append(controller.Systems.List, system)
+
+	controller.Apikeys.List = append(controller.Apikeys.List, &Apikey{Key: "key", Scopes: []any{ApikeyScopeRead}, Systems: "*"})
+	controller.Accesses.Add(&Access{Code: "1234", Systems: []any{map[string]any{"id": float64(1), "talkgroups": []any{float64(10)}}}})
+
+	from := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, call := range []*Call{
+		{DateTime: from.Add(10 * time.Second), Duration: 5 * time.Second, Source: 4424001, System: 1, Talkgroup: 10},
+		{DateTime: from.Add(12 * time.Second), Duration: 3 * time.Second, System: 1, Talkgroup: 20},
+		{DateTime: from.Add(30 * time.Second), Duration: 2 * time.Second, System: 1, Talkgroup: 10},
+		{DateTime: from.Add(11 * time.Second), Duration: 2 * time.Second, System: 1, Talkgroup: 30},
+		{DateTime: from.Add(2 * time.Hour), Duration: 2 * time.Second, System: 1, Talkgroup: 10},
+	} {
+		call.Audio = []byte{0}
+		if _, err := controller.Calls.WriteCall(call, controller.Database); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const target = "/api/timeline?system=1&talkgroups=10,20&from=2026-10-01T12:00:00Z&to=2026-10-01T13:00:00Z"
+
+	tests := []struct {
+		name    string
+		target  string
+		status  int
+		offsets []float64
+	}{
+		{name: "no credentials", target: target, status: http.StatusUnauthorized},
+		{name: "api key", target: target + "&key=key", status: http.StatusOK, offsets: []float64{10, 12, 30}},
+		{name: "access code", target: target + "&code=1234", status: http.StatusOK, offsets: []float64{10, 30}},
+		{name: "no talkgroups", target: "/api/timeline?system=1&from=2026-10-01T12:00:00Z&to=2026-10-01T13:00:00Z&key=key", status: http.StatusBadRequest},
+		{name: "reversed range", target: "/api/timeline?system=1&talkgroups=10&from=2026-10-01T13:00:00Z&to=2026-10-01T12:00:00Z&key=key", status: http.StatusBadRequest},
+		{name: "range too long", target: "/api/timeline?system=1&talkgroups=10&from=2026-10-01T00:00:00Z&to=2026-10-03T00:00:00Z&key=key", status: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			controller.Api.TimelineHandler(w, httptest.NewRequest(http.MethodGet, test.target, nil))
+
+			if w.Code != test.status {
+				t.Fatalf("status %d, want %d", w.Code, test.status)
+			}
+
+			if test.status != http.StatusOK {
+				return
+			}
+
+			var timeline Timeline
+			if err := json.Unmarshal(w.Body.Bytes(), &timeline); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(timeline.Calls) != len(test.offsets) {
+				t.Fatalf("calls = %+v, want %d", timeline.Calls, len(test.offsets))
+			}
+			for i, call := range timeline.Calls {
+				if call.Offset != test.offsets[i] {
+					t.Errorf("call %d offset %v, want %v", call.Id, call.Offset, test.offsets[i])
+				}
+			}
+		})
+	}
+
+	// the dispatch call and the tac call were on the air at the same time
+	r := httptest.NewRequest(http.MethodGet, target+"&key=key", nil)
+	w := httptest.NewRecorder()
+	controller.Api.TimelineHandler(w, r)
+
+	var timeline Timeline
+	if err := json.Unmarshal(w.Body.Bytes(), &timeline); err != nil {
+		t.Fatal(err)
+	}
+
+	first, second := timeline.Calls[0], timeline.Calls[1]
+	if len(first.Overlaps) != 1 || first.Overlaps[0] != second.Id || len(second.Overlaps) != 1 || len(timeline.Calls[2].Overlaps) != 0 {
+		t.Errorf("overlaps = %v, %v, %v", first.Overlaps, second.Overlaps, timeline.Calls[2].Overlaps)
+	}
+	if first.TalkgroupLabel != "FD" || first.Source != float64(4424001) {
+		t.Errorf("call = %+v", first)
+	}
+}
+
+func TestTimelineMixdownLimits(t *testing.T) {
+	controller := newTestController(t, &Config{LoginBurst: 1, LoginRate: 1})
+
+	system := NewSystem()
+	system.Id = 1
+	system.Talkgroups.List = append(system.Talkgroups.List, &Talkgroup{Id: 10, Label: "FD", Name: "Fire Dispatch"})
+	controller.Systems.List = append(controller.Systems.List, system)
+
+	controller.Tiers.List = []*Tier{{Name: "listen only"}}
+	controller.Apikeys.List = append(controller.Apikeys.List, &Apikey{Key: "key", Scopes: []any{ApikeyScopeRead}, Systems: "*"})
+	controller.Accesses.Add(&Access{Code: "1234", Systems: "*", Tier: "listen only"})
+
+	const target = "/api/timeline?system=1&talkgroups=10&from=2026-10-01T12:00:00Z&to=2026-10-01T13:00:00Z&format=audio"
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+	}{
+		{name: "tier without downloads", target: target + "&code=1234", status: http.StatusForbidden},
+		{name: "first mixdown", target: target + "&key=key", status: http.StatusServiceUnavailable},
+		{name: "throttled mixdown", target: target + "&key=key", status: http.StatusTooManyRequests},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			controller.Api.TimelineHandler(w, httptest.NewRequest(http.MethodGet, test.target, nil))
+
+			// without ffmpeg nor calls a mixdown that went through fails
+			if test.status == http.StatusServiceUnavailable && w.Code == http.StatusOK {
+				return
+			}
+			if w.Code != test.status {
+				t.Errorf("status %d, want %d", w.Code, test.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type CallTrace struct {
+	CallId        any
+	Downstreams   uint
+	Duplicate     any
+	Events        []CallTraceEvent
+	Listeners     uint
+	Outcome       string
+	Parsed        map[string]any
+	Received      time.Time
+	TranscodeTime any
+	mutex         sync.Mutex
+}
+
+type CallTraceEvent struct {
+	DateTime time.Time `json:"dateTime"`
+	Message  string    `json:"message"`
+}
+
+func NewCallTrace(call *Call) *CallTrace {
+	return &CallTrace{
+		Events:   []CallTraceEvent{},
+		Parsed:   call.traceFields(),
+		Received: time.Now().UTC(),
+		mutex:    sync.Mutex{},
+	}
+}
+
+func (trace *CallTrace) AddDownstream() {
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+
+	trace.Downstreams++
+}
+
+func (trace *CallTrace) AddEvent(message string) {
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+
+	trace.Events = append(trace.Events, CallTraceEvent{DateTime: time.Now().UTC(), Message: message})
+}
+
+func (trace *CallTrace) MarshalJSON() ([]byte, error) {
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+
+	return json.Marshal(map[string]any{
+		"callId":        trace.CallId,
+		"downstreams":   trace.Downstreams,
+		"duplicate":     trace.Duplicate,
+		"events":        trace.Events,
+		"listeners":     trace.Listeners,
+		"outcome":       trace.Outcome,
+		"parsed":        trace.Parsed,
+		"received":      trace.Received,
+		"transcodeTime": trace.TranscodeTime,
+	})
+}
+
+func (trace *CallTrace) SetCallId(id uint) {
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+
+	trace.CallId = id
+}
+
+func (trace *CallTrace) SetDuplicate(duplicate bool) {
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+
+	trace.Duplicate = duplicate
+}
+
+func (trace *CallTrace) SetListeners(count uint) {
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+
+	trace.Listeners = count
+}
+
+func (trace *CallTrace) SetOutcome(outcome string) {
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+
+	trace.Outcome = outcome
+}
+
+func (trace *CallTrace) SetTranscodeTime(d time.Duration) {
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+
+	trace.TranscodeTime = d.Milliseconds()
+}
+
+type CallTraces struct {
+	List  []*CallTrace
+	size  int
+	mutex sync.Mutex
+}
+
+func NewCallTraces(size int) *CallTraces {
+	return &CallTraces{
+		List:  []*CallTrace{},
+		size:  size,
+		mutex: sync.Mutex{},
+	}
+}
+
+func (traces *CallTraces) Add(trace *CallTrace) {
+	traces.mutex.Lock()
+	defer traces.mutex.Unlock()
+
+	if len(traces.List) < traces.size {
+		traces.List = append(traces.List, trace)
+	} else {
+		traces.List = append(traces.List[1:], trace)
+	}
+}
+
+func (traces *CallTraces) Last(limit int) []*CallTrace {
+	traces.mutex.Lock()
+	defer traces.mutex.Unlock()
+
+	l := []*CallTrace{}
+
+	for i := len(traces.List) - 1; i >= 0 && len(l) < limit; i-- {
+		l = append(l, traces.List[i])
+	}
+
+	return l
+}
+
+func (admin *Admin) TracesHandler(w http.ResponseWriter, r *http.Request) {
+	const defaultLimit = 50
+
+	if !admin.Authorize(w, r, AdminRoleViewer) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		limit := defaultLimit
+
+		if i, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && i > 0 {
+			limit = i
+		}
+
+		if b, err := json.Marshal(admin.Controller.Traces.Last(limit)); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (call *Call) traceFields() map[string]any {
+	return map[string]any{
+		"audioName":      call.AudioName,
+		"audioSize":      len(call.Audio),
+		"audioType":      call.AudioType,
+		"dateTime":       call.DateTime,
+		"frequency":      call.Frequency,
+		"patches":        call.Patches,
+		"source":         call.Source,
+		"system":         call.System,
+		"systemLabel":    call.systemLabel,
+		"talkgroup":      call.Talkgroup,
+		"talkgroupGroup": call.talkgroupGroup,
+		"talkgroupLabel": call.talkgroupLabel,
+		"talkgroupName":  call.talkgroupName,
+		"talkgroupTag":   call.talkgroupTag,
+	}
+}
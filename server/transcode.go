@@ -0,0 +1,313 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transcoder re-encodes the archived calls to the audio codec and bitrate of
+// the options, so that the calls ingested before a change of the options
+// shrink as well. It runs in the background on the ffmpeg workers.
+type Transcoder struct {
+	Controller *Controller
+	status     TranscoderStatus
+	cancel     chan struct{}
+	done       chan struct{}
+	mutex      sync.Mutex
+}
+
+type TranscoderStatus struct {
+	Bitrate    uint       `json:"bitrate"`
+	Codec      string     `json:"codec"`
+	Done       uint       `json:"done"`
+	Errors     uint       `json:"errors"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	Running    bool       `json:"running"`
+	SavedBytes int64      `json:"savedBytes"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	Total      uint       `json:"total"`
+}
+
+func NewTranscoder(controller *Controller) *Transcoder {
+	return &Transcoder{
+		Controller: controller,
+		mutex:      sync.Mutex{},
+	}
+}
+
+func (admin *Admin) TranscodeHandler(w http.ResponseWriter, r *http.Request) {
+	transcoder := admin.Controller.Transcoder
+
+	if !admin.Authorize(w, r, adminWriteRole(r)) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodDelete:
+		admin.Controller.Jobs.CancelKind(JobKindTranscode)
+		transcoder.Stop()
+
+	case http.MethodPost:
+		m := map[string]any{}
+
+		if r.ContentLength > 0 {
+			if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		all, _ := m["all"].(bool)
+
+		if transcoder.Status().Running || admin.Controller.Jobs.HasPending(JobKindTranscode) {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte("transcoding already running"))
+			return
+		}
+
+		// the job resumes the transcoding when the server restarts
+		if _, err := admin.Controller.Jobs.Enqueue(JobKindTranscode, map[string]any{"all": all}, JobPriorityNormal); err != nil {
+			w.WriteHeader(http.StatusExpectationFailed)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if b, err := json.Marshal(transcoder.Status()); err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	} else {
+		w.WriteHeader(http.StatusExpectationFailed)
+	}
+}
+
+// Start transcodes the calls of which the audio type differs from the one of
+// the codec, or all of them when the bitrate changed.
+func (transcoder *Transcoder) Start(all bool) error {
+	controller := transcoder.Controller
+
+	transcoder.mutex.Lock()
+	defer transcoder.mutex.Unlock()
+
+	if transcoder.status.Running {
+		return errors.New("transcoding already running")
+	}
+
+	if !controller.FFMpeg.available {
+		return errors.New("ffmpeg is not available")
+	}
+
+	if controller.Options.AudioConversion == AUDIO_CONVERSION_DISABLED {
+		return errors.New("audio conversion is disabled")
+	}
+
+	codec := controller.Options.AudioCodec
+	bitrate := controller.Options.AudioBitrate
+
+	_, audioType, _ := controller.FFMpeg.codec(codec, bitrate)
+
+	query := controller.Database.Select("rdioScannerCalls", "id").OrderBy("id", false)
+	if !all {
+		query.Where(SqlOr(SqlWhere("`audioType` is null"), SqlWhere("`audioType` <> ?", audioType)))
+	}
+
+	rows, err := query.Query()
+	if err != nil {
+		return fmt.Errorf("transcoder.start: %v", err)
+	}
+
+	ids := []uint{}
+	for rows.Next() {
+		var id uint
+		if err = rows.Scan(&id); err != nil {
+			break
+		}
+		ids = append(ids, id)
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return fmt.Errorf("transcoder.start: %v", err)
+	}
+
+	startedAt := time.Now().UTC()
+
+	transcoder.cancel = make(chan struct{})
+	transcoder.done = make(chan struct{})
+	transcoder.status = TranscoderStatus{
+		Bitrate:   bitrate,
+		Codec:     codec,
+		Running:   true,
+		StartedAt: &startedAt,
+		Total:     uint(len(ids)),
+	}
+
+	controller.Logs.LogEvent(LogLevelInfo, fmt.Sprintf("transcoder: %d calls to %s at %dk", len(ids), codec, bitrate))
+
+	go transcoder.run(ids, codec, bitrate, transcoder.cancel, transcoder.done)
+
+	return nil
+}
+
+// RunJob transcodes the calls as a background job, until done or canceled.
+func (transcoder *Transcoder) RunJob(job *Job, cancel <-chan struct{}) error {
+	all, _ := job.Payload["all"].(bool)
+
+	if err := transcoder.Start(all); err != nil {
+		return err
+	}
+
+	transcoder.mutex.Lock()
+	done := transcoder.done
+	transcoder.mutex.Unlock()
+
+	select {
+	case <-done:
+	case <-cancel:
+		transcoder.Stop()
+		<-done
+	}
+
+	return nil
+}
+
+func (transcoder *Transcoder) Status() TranscoderStatus {
+	transcoder.mutex.Lock()
+	defer transcoder.mutex.Unlock()
+
+	return transcoder.status
+}
+
+func (transcoder *Transcoder) Stop() {
+	transcoder.mutex.Lock()
+	defer transcoder.mutex.Unlock()
+
+	if transcoder.status.Running {
+		select {
+		case <-transcoder.cancel:
+		default:
+			close(transcoder.cancel)
+		}
+	}
+}
+
+func (transcoder *Transcoder) run(ids []uint, codec string, bitrate uint, cancel chan struct{}, done chan struct{}) {
+	var (
+		controller = transcoder.Controller
+		queue      = make(chan uint)
+		wg         = sync.WaitGroup{}
+	)
+
+	for i := 0; i < cap(controller.FFMpeg.workers); i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for id := range queue {
+				saved, err := transcoder.transcode(id, codec, bitrate)
+
+				transcoder.mutex.Lock()
+				transcoder.status.Done++
+				if err == nil {
+					transcoder.status.SavedBytes += saved
+				} else {
+					transcoder.status.Errors++
+				}
+				transcoder.mutex.Unlock()
+
+				if err != nil {
+					controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("transcoder: call %d %v", id, err))
+				}
+			}
+		}()
+	}
+
+loop:
+	for _, id := range ids {
+		select {
+		case <-cancel:
+			break loop
+		case queue <- id:
+		}
+	}
+
+	close(queue)
+
+	wg.Wait()
+
+	finishedAt := time.Now().UTC()
+
+	transcoder.mutex.Lock()
+	transcoder.status.FinishedAt = &finishedAt
+	transcoder.status.Running = false
+	status := transcoder.status
+	transcoder.mutex.Unlock()
+
+	close(done)
+
+	controller.Logs.LogEvent(LogLevelInfo, fmt.Sprintf("transcoder: %d of %d calls done, %d errors, %d bytes saved", status.Done, status.Total, status.Errors, status.SavedBytes))
+}
+
+// transcode replaces the audio of the call, returning the bytes saved.
+func (transcoder *Transcoder) transcode(id uint, codec string, bitrate uint) (int64, error) {
+	controller := transcoder.Controller
+
+	call, err := controller.Calls.GetCall(id, controller.Database)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(call.Audio) == 0 {
+		return 0, nil
+	}
+
+	audio, audioType, ext, err := controller.FFMpeg.Transcode(call.Audio, codec, bitrate)
+	if err != nil {
+		return 0, err
+	}
+
+	saved := int64(len(call.Audio) - len(audio))
+
+	call.Audio = audio
+	call.AudioType = audioType
+
+	switch v := call.AudioName.(type) {
+	case string:
+		call.AudioName = fmt.Sprintf("%v%s", strings.TrimSuffix(v, path.Ext(v)), ext)
+	}
+
+	if err = controller.Calls.WriteAudio(call, controller.Database); err != nil {
+		return 0, err
+	}
+
+	return saved, nil
+}
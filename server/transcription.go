@@ -0,0 +1,603 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TranscriberProviderGoogle     = "google"
+	TranscriberProviderWhisper    = "whisper"
+	TranscriberProviderWhisperCpp = "whisper.cpp"
+)
+
+// Transcriber sends the calls of the selected systems to a speech to text
+// provider. The whisper provider speaks the OpenAI compatible transcription
+// api, whisper.cpp targets the inference endpoint of its bundled server.
+type Transcriber struct {
+	Id       any    `json:"_id"`
+	Apikey   string `json:"apiKey"`
+	Disabled bool   `json:"disabled"`
+	Language string `json:"language"`
+	Model    string `json:"model"`
+	Order    any    `json:"order"`
+	Provider string `json:"provider"`
+	Systems  any    `json:"systems"`
+	Url      string `json:"url"`
+}
+
+func (transcriber *Transcriber) FromMap(m map[string]any) *Transcriber {
+	switch v := m["_id"].(type) {
+	case float64:
+		transcriber.Id = uint(v)
+	}
+
+	switch v := m["apiKey"].(type) {
+	case string:
+		transcriber.Apikey = v
+	}
+
+	switch v := m["disabled"].(type) {
+	case bool:
+		transcriber.Disabled = v
+	}
+
+	switch v := m["language"].(type) {
+	case string:
+		transcriber.Language = v
+	}
+
+	switch v := m["model"].(type) {
+	case string:
+		transcriber.Model = v
+	}
+
+	switch v := m["order"].(type) {
+	case float64:
+		transcriber.Order = uint(v)
+	}
+
+	switch v := m["provider"].(type) {
+	case string:
+		transcriber.Provider = v
+	}
+
+	switch v := m["systems"].(type) {
+	case []any:
+		if b, err := json.Marshal(v); err == nil {
+			transcriber.Systems = string(b)
+		}
+	case string:
+		transcriber.Systems = v
+	}
+
+	switch v := m["url"].(type) {
+	case string:
+		transcriber.Url = v
+	}
+
+	return transcriber
+}
+
+// TranscriptSegment is a timed part of a transcript, its start and end being
+// the offsets in seconds from the beginning of the call audio.
+type TranscriptSegment struct {
+	End   float64 `json:"end"`
+	Start float64 `json:"start"`
+	Text  string  `json:"text"`
+}
+
+func (transcriber *Transcriber) HasAccess(call *Call) bool {
+	if transcriber.Disabled {
+		return false
+	}
+
+	return (&Downstream{Systems: transcriber.Systems}).HasAccess(call)
+}
+
+// Transcribe returns the transcript of the audio, along with its timed
+// segments when asked for and the provider returns them.
+func (transcriber *Transcriber) Transcribe(audio []byte, audioName string, audioType string, segments bool) (string, []TranscriptSegment, error) {
+	formatError := func(err error) error {
+		return fmt.Errorf("transcriber.transcribe: %v", err)
+	}
+
+	var (
+		err error
+		req *http.Request
+	)
+
+	switch transcriber.Provider {
+	case TranscriberProviderGoogle:
+		if audioType != "audio/wav" {
+			return "", nil, formatError(errors.New("google requires ffmpeg to convert the audio"))
+		}
+
+		config := map[string]any{
+			"encoding":        "LINEAR16",
+			"languageCode":    "en-US",
+			"sampleRateHertz": 16000,
+		}
+		if len(transcriber.Language) > 0 {
+			config["languageCode"] = transcriber.Language
+		}
+		if len(transcriber.Model) > 0 {
+			config["model"] = transcriber.Model
+		}
+
+		b, err := json.Marshal(map[string]any{
+			"audio":  map[string]any{"content": base64.StdEncoding.EncodeToString(audio)},
+			"config": config,
+		})
+		if err != nil {
+			return "", nil, formatError(err)
+		}
+
+		u := transcriber.Url
+		if len(u) == 0 {
+			u = "https://speech.googleapis.com/v1/speech:recognize"
+		}
+		u = fmt.Sprintf("%s?key=%s", u, url.QueryEscape(transcriber.Apikey))
+
+		if req, err = http.NewRequest(http.MethodPost, u, bytes.NewReader(b)); err != nil {
+			return "", nil, formatError(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+	case TranscriberProviderWhisper, TranscriberProviderWhisperCpp:
+		buf := bytes.Buffer{}
+		mw := multipart.NewWriter(&buf)
+
+		if w, err := mw.CreateFormFile("file", audioName); err == nil {
+			if _, err = w.Write(audio); err != nil {
+				return "", nil, formatError(err)
+			}
+		} else {
+			return "", nil, formatError(err)
+		}
+
+		fields := map[string]string{"response_format": "json"}
+		if segments {
+			fields["response_format"] = "verbose_json"
+		}
+		if len(transcriber.Language) > 0 {
+			fields["language"] = transcriber.Language
+		}
+		if transcriber.Provider == TranscriberProviderWhisper {
+			fields["model"] = "whisper-1"
+			if len(transcriber.Model) > 0 {
+				fields["model"] = transcriber.Model
+			}
+		}
+		for k, v := range fields {
+			if err = mw.WriteField(k, v); err != nil {
+				return "", nil, formatError(err)
+			}
+		}
+
+		if err = mw.Close(); err != nil {
+			return "", nil, formatError(err)
+		}
+
+		u, err := url.Parse(transcriber.Url)
+		if err != nil || len(transcriber.Url) == 0 {
+			u, _ = url.Parse("https://api.openai.com")
+		}
+		if transcriber.Provider == TranscriberProviderWhisperCpp {
+			u.Path = path.Join(u.Path, "/inference")
+		} else {
+			u.Path = path.Join(u.Path, "/v1/audio/transcriptions")
+		}
+
+		if req, err = http.NewRequest(http.MethodPost, u.String(), &buf); err != nil {
+			return "", nil, formatError(err)
+		}
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		if len(transcriber.Apikey) > 0 {
+			req.Header.Set("Authorization", "Bearer "+transcriber.Apikey)
+		}
+
+	default:
+		return "", nil, formatError(fmt.Errorf("unknown provider %s", transcriber.Provider))
+	}
+
+	c := http.Client{Timeout: 2 * time.Minute}
+
+	res, err := c.Do(req)
+	if err != nil {
+		return "", nil, formatError(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", nil, formatError(fmt.Errorf("bad status: %s", res.Status))
+	}
+
+	var r struct {
+		Results []struct {
+			Alternatives []struct {
+				Transcript string `json:"transcript"`
+			} `json:"alternatives"`
+			ResultEndTime string `json:"resultEndTime"`
+		} `json:"results"`
+		Segments []TranscriptSegment `json:"segments"`
+		Text     string              `json:"text"`
+	}
+
+	if err = json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return "", nil, formatError(err)
+	}
+
+	if transcriber.Provider == TranscriberProviderGoogle {
+		a := []string{}
+		start := float64(0)
+		for _, result := range r.Results {
+			if len(result.Alternatives) > 0 {
+				text := strings.TrimSpace(result.Alternatives[0].Transcript)
+				a = append(a, text)
+
+				// the results of google only carry their end offset
+				if d, err := time.ParseDuration(result.ResultEndTime); err == nil && segments && len(text) > 0 {
+					r.Segments = append(r.Segments, TranscriptSegment{End: d.Seconds(), Start: start, Text: text})
+					start = d.Seconds()
+				}
+			}
+		}
+		return strings.Join(a, " "), r.Segments, nil
+	}
+
+	if !segments {
+		return strings.TrimSpace(r.Text), nil, nil
+	}
+
+	timed := []TranscriptSegment{}
+	for _, segment := range r.Segments {
+		if segment.Text = strings.TrimSpace(segment.Text); len(segment.Text) > 0 {
+			timed = append(timed, segment)
+		}
+	}
+
+	return strings.TrimSpace(r.Text), timed, nil
+}
+
+type Transcribers struct {
+	Controller *Controller
+	List       []*Transcriber
+	queue      chan *Call
+	mutex      sync.Mutex
+}
+
+func NewTranscribers(controller *Controller) *Transcribers {
+	return &Transcribers{
+		Controller: controller,
+		List:       []*Transcriber{},
+		queue:      make(chan *Call, 1024),
+		mutex:      sync.Mutex{},
+	}
+}
+
+func (transcribers *Transcribers) FromMap(f []any) *Transcribers {
+	transcribers.mutex.Lock()
+	defer transcribers.mutex.Unlock()
+
+	transcribers.List = []*Transcriber{}
+
+	for _, r := range f {
+		switch m := r.(type) {
+		case map[string]any:
+			transcriber := &Transcriber{}
+			transcriber.FromMap(m)
+			transcribers.List = append(transcribers.List, transcriber)
+		}
+	}
+
+	return transcribers
+}
+
+func (transcribers *Transcribers) GetTranscriber(call *Call) (*Transcriber, bool) {
+	transcribers.mutex.Lock()
+	defer transcribers.mutex.Unlock()
+
+	for _, transcriber := range transcribers.List {
+		if transcriber.HasAccess(call) {
+			return transcriber, true
+		}
+	}
+
+	return nil, false
+}
+
+// Queue hands the call over to the transcription workers if a transcriber
+// covers its system. Calls are deferred to a background job rather than
+// slowing down the ingest when the providers can't keep up.
+func (transcribers *Transcribers) Queue(call *Call) {
+	if _, ok := transcribers.GetTranscriber(call); !ok {
+		return
+	}
+
+	select {
+	case transcribers.queue <- call:
+	default:
+		transcribers.defer_(call, "queue is full")
+	}
+}
+
+// RunJob transcribes an archived call as a background job.
+func (transcribers *Transcribers) RunJob(job *Job, cancel <-chan struct{}) error {
+	controller := transcribers.Controller
+
+	id, ok := job.GetUint("call")
+	if !ok {
+		return errors.New("no call id")
+	}
+
+	call, err := controller.Calls.GetCall(id, controller.Database)
+	if err != nil {
+		return err
+	}
+
+	return transcribers.transcribe(call)
+}
+
+func (transcribers *Transcribers) Read(db *Database) error {
+	var (
+		err     error
+		id      sql.NullFloat64
+		order   sql.NullFloat64
+		rows    *sql.Rows
+		systems string
+	)
+
+	transcribers.mutex.Lock()
+	defer transcribers.mutex.Unlock()
+
+	transcribers.List = []*Transcriber{}
+
+	formatError := func(err error) error {
+		return fmt.Errorf("transcribers.read: %v", err)
+	}
+
+	if rows, err = db.Sql.Query("select `_id`, `apiKey`, `disabled`, `language`, `model`, `order`, `provider`, `systems`, `url` from `rdioScannerTranscribers` order by `order`"); err != nil {
+		return formatError(err)
+	}
+
+	for rows.Next() {
+		transcriber := &Transcriber{}
+
+		if err = rows.Scan(&id, &transcriber.Apikey, &transcriber.Disabled, &transcriber.Language, &transcriber.Model, &order, &transcriber.Provider, &systems, &transcriber.Url); err != nil {
+			break
+		}
+
+		if transcriber.Apikey, err = db.Secrets.Open(transcriber.Apikey); err != nil {
+			break
+		}
+
+		if id.Valid && id.Float64 > 0 {
+			transcriber.Id = uint(id.Float64)
+		}
+
+		if order.Valid && order.Float64 > 0 {
+			transcriber.Order = uint(order.Float64)
+		}
+
+		if err = json.Unmarshal([]byte(systems), &transcriber.Systems); err != nil {
+			transcriber.Systems = []any{}
+		}
+
+		transcribers.List = append(transcribers.List, transcriber)
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	return nil
+}
+
+func (transcribers *Transcribers) Start() error {
+	for i := 0; i < defaults.transcriptionWorkers; i++ {
+		go func() {
+			for call := range transcribers.queue {
+				if err := transcribers.transcribe(call); err != nil {
+					transcribers.defer_(call, "will be retried")
+				}
+			}
+		}()
+	}
+
+	return nil
+}
+
+func (transcribers *Transcribers) Write(db *Database) error {
+	var (
+		apiKey  string
+		count   uint
+		err     error
+		rows    *sql.Rows
+		rowIds  = []uint{}
+		systems any
+	)
+
+	transcribers.mutex.Lock()
+	defer transcribers.mutex.Unlock()
+
+	formatError := func(err error) error {
+		return fmt.Errorf("transcribers.write: %v", err)
+	}
+
+	if rows, err = db.Sql.Query("select `_id` from `rdioScannerTranscribers`"); err != nil {
+		return formatError(err)
+	}
+
+	for rows.Next() {
+		var rowId uint
+		if err = rows.Scan(&rowId); err != nil {
+			break
+		}
+		remove := true
+		for _, transcriber := range transcribers.List {
+			if transcriber.Id == nil || transcriber.Id == rowId {
+				remove = false
+				break
+			}
+		}
+		if remove {
+			rowIds = append(rowIds, rowId)
+		}
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	if len(rowIds) > 0 {
+		if _, err = db.Delete("rdioScannerTranscribers").Where(SqlIn("_id", rowIds)).Exec(); err != nil {
+			return formatError(err)
+		}
+	}
+
+	for _, transcriber := range transcribers.List {
+		switch transcriber.Systems {
+		case "*":
+			systems = `"*"`
+		default:
+			systems = transcriber.Systems
+		}
+
+		if apiKey, err = db.Secrets.Seal(transcriber.Apikey); err != nil {
+			break
+		}
+
+		if err = db.Sql.QueryRow("select count(*) from `rdioScannerTranscribers` where `_id` = ?", transcriber.Id).Scan(&count); err != nil {
+			break
+		}
+
+		if count == 0 {
+			if _, err = db.Sql.Exec("insert into `rdioScannerTranscribers` (`_id`, `apiKey`, `disabled`, `language`, `model`, `order`, `provider`, `systems`, `url`) values (?, ?, ?, ?, ?, ?, ?, ?, ?)", transcriber.Id, apiKey, transcriber.Disabled, transcriber.Language, transcriber.Model, transcriber.Order, transcriber.Provider, systems, transcriber.Url); err != nil {
+				break
+			}
+
+		} else if _, err = db.Sql.Exec("update `rdioScannerTranscribers` set `apiKey` = ?, `disabled` = ?, `language` = ?, `model` = ?, `order` = ?, `provider` = ?, `systems` = ?, `url` = ? where `_id` = ?", apiKey, transcriber.Disabled, transcriber.Language, transcriber.Model, transcriber.Order, transcriber.Provider, systems, transcriber.Url, transcriber.Id); err != nil {
+			break
+		}
+	}
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	return nil
+}
+
+// defer_ queues a transcription job for the call, which persists until a
+// transcriber gets to it.
+func (transcribers *Transcribers) defer_(call *Call, reason string) {
+	controller := transcribers.Controller
+
+	id, ok := call.Id.(uint)
+	if !ok {
+		return
+	}
+
+	if _, err := controller.Jobs.Enqueue(JobKindTranscribe, map[string]any{"call": id}, JobPriorityLow); err != nil {
+		controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("transcription: system=%v talkgroup=%v skipped, %v", call.System, call.Talkgroup, err))
+		return
+	}
+
+	controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("transcription: system=%v talkgroup=%v deferred, %s", call.System, call.Talkgroup, reason))
+}
+
+func (transcribers *Transcribers) transcribe(call *Call) error {
+	controller := transcribers.Controller
+
+	transcriber, ok := transcribers.GetTranscriber(call)
+	if !ok {
+		return nil
+	}
+
+	id, ok := call.Id.(uint)
+	if !ok {
+		return nil
+	}
+
+	logEvent := func(logLevel string, message string) {
+		controller.Logs.LogEvent(logLevel, fmt.Sprintf("transcription: system=%v talkgroup=%v file=%v via %v %v", call.System, call.Talkgroup, call.AudioName, transcriber.Provider, message))
+	}
+
+	audio, audioName, audioType := call.Audio, fmt.Sprintf("%v", call.AudioName), fmt.Sprintf("%v", call.AudioType)
+
+	if wav, err := controller.FFMpeg.EncodeWav(call.Audio, 16000); err == nil {
+		audio, audioName, audioType = wav, strings.TrimSuffix(audioName, path.Ext(audioName))+".wav", "audio/wav"
+	}
+
+	captions := controller.Options.LiveCaptions
+
+	text, segments, err := transcriber.Transcribe(audio, audioName, audioType, captions)
+	if err != nil {
+		logEvent(LogLevelError, err.Error())
+		if call.trace != nil {
+			call.trace.AddEvent(fmt.Sprintf("transcription %v", err.Error()))
+		}
+		return err
+	}
+
+	if err = controller.Calls.WriteTranscript(id, text, controller.Database); err != nil {
+		logEvent(LogLevelError, err.Error())
+		return err
+	}
+
+	// the transcript is there, a failed indexing doesn't transcribe again
+	if err = controller.SearchIndex.Write(call); err != nil {
+		logEvent(LogLevelError, err.Error())
+	}
+
+	if call.trace != nil {
+		call.trace.AddEvent(fmt.Sprintf("transcribed by %v", transcriber.Provider))
+	}
+
+	logEvent(LogLevelInfo, "success")
+
+	controller.Alerts.EvaluateTranscript(call, text)
+
+	controller.Publishers.PublishTranscript(call, text)
+
+	if talkgroup := controller.Systems.GetCallTalkgroup(call); !controller.Blackouts.IsBlackedOut(call) && (talkgroup == nil || !talkgroup.Hidden) {
+		if captions && len(segments) > 0 {
+			controller.Clients.EmitCaptions(call, segments, talkgroup.GetDelay(), controller.Accesses.IsRestricted())
+		}
+		controller.Clients.EmitTranscript(call, text, talkgroup.GetDelay(), controller.Accesses.IsRestricted())
+		controller.Kiosks.Transcript(call, text)
+	}
+
+	return nil
+}
@@ -0,0 +1,135 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTranscriberTranscribeSegments(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider string
+		segments bool
+		response string
+		format   string
+		want     []TranscriptSegment
+	}{
+		{
+			name:     "whisper without segments",
+			provider: TranscriberProviderWhisper,
+			response: `{"text":" engine 3 respond "}`,
+			format:   "json",
+		},
+		{
+			name:     "whisper segments",
+			provider: TranscriberProviderWhisper,
+			segments: true,
+			response: `{"text":"engine 3 respond","segments":[{"start":0,"end":1.2,"text":" engine 3"},{"start":1.2,"end":1.5,"text":" "},{"start":1.5,"end":2.4,"text":" respond"}]}`,
+			format:   "verbose_json",
+			want:     []TranscriptSegment{{End: 1.2, Start: 0, Text: "engine 3"}, {End: 2.4, Start: 1.5, Text: "respond"}},
+		},
+		{
+			name:     "whisper.cpp segments",
+			provider: TranscriberProviderWhisperCpp,
+			segments: true,
+			response: `{"text":"engine 3 respond","segments":[{"start":0.5,"end":2,"text":"engine 3 respond"}]}`,
+			format:   "verbose_json",
+			want:     []TranscriptSegment{{End: 2, Start: 0.5, Text: "engine 3 respond"}},
+		},
+		{
+			name:     "google segments",
+			provider: TranscriberProviderGoogle,
+			segments: true,
+			response: `{"results":[{"alternatives":[{"transcript":"engine 3"}],"resultEndTime":"1.200s"},{"alternatives":[{"transcript":"respond"}],"resultEndTime":"2.400s"}]}`,
+			want:     []TranscriptSegment{{End: 1.2, Start: 0, Text: "engine 3"}, {End: 2.4, Start: 1.2, Text: "respond"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			format := ""
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Content-Type") != "application/json" {
+					format = r.FormValue("response_format")
+				}
+				fmt.Fprint(w, test.response)
+			}))
+			defer server.Close()
+
+			transcriber := &Transcriber{Provider: test.provider, Url: server.URL}
+
+			text, segments, err := transcriber.Transcribe([]byte{0}, "call.wav", "audio/wav", test.segments)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if text != "engine 3 respond" {
+				t.Errorf("got text %q", text)
+			}
+
+			if format != test.format {
+				t.Errorf("got response format %q, want %q", format, test.format)
+			}
+
+			if len(segments) != len(test.want) {
+				t.Fatalf("got %v, want %v", segments, test.want)
+			}
+			for i := range segments {
+				if segments[i] != test.want[i] {
+					t.Errorf("got %v, want %v", segments, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestClientsEmitCaptions(t *testing.T) {
+	clients := NewClients()
+
+	allowed := &Client{Send: make(chan *Message, 1)}
+	allowed.SetAccess(&Access{Code: "a", Systems: "*"})
+
+	denied := &Client{Send: make(chan *Message, 1)}
+	denied.SetAccess(&Access{Code: "b", Systems: []any{map[string]any{"id": float64(2), "talkgroups": "*"}}})
+
+	clients.Map[allowed] = true
+	clients.Map[denied] = true
+
+	segments := []TranscriptSegment{{End: 1, Start: 0, Text: "engine 3"}}
+
+	clients.EmitCaptions(&Call{Id: uint(7), System: 1, Talkgroup: 1}, segments, 0, true)
+
+	select {
+	case message := <-allowed.Send:
+		payload, ok := message.Payload.(map[string]any)
+		if message.Command != MessageCommandCaptions || !ok || payload["id"] != uint(7) {
+			t.Errorf("got %v", message)
+		}
+	default:
+		t.Error("no captions sent to the listener with access")
+	}
+
+	select {
+	case message := <-denied.Send:
+		t.Errorf("captions sent to the listener without access: %v", message)
+	default:
+	}
+}
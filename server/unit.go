@@ -16,18 +16,52 @@
 package main
 
 import (
+	"bytes"
 	"database/sql"
+	"encoding/csv"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
+// Unit is the alias of a radio id. The activity of the unit is kept apart
+// from the config, as it changes with every call.
 type Unit struct {
-	Id    uint   `json:"id"`
-	Label string `json:"label"`
-	Order uint   `json:"order"`
+	Id         uint       `json:"id"`
+	Label      string     `json:"label"`
+	Order      uint       `json:"order"`
+	Calls      uint       `json:"-"`
+	FirstHeard *time.Time `json:"-"`
+	LastHeard  *time.Time `json:"-"`
+	Talkgroups []uint     `json:"-"`
+}
+
+// UnitRecord is a unit with its activity, as listed to the admins.
+type UnitRecord struct {
+	Id         uint       `json:"id"`
+	Label      string     `json:"label"`
+	Calls      uint       `json:"calls"`
+	FirstHeard *time.Time `json:"firstHeard,omitempty"`
+	LastHeard  *time.Time `json:"lastHeard,omitempty"`
+	Learned    bool       `json:"learned"`
+	Talkgroups []uint     `json:"talkgroups"`
+}
+
+// UnitActivity is a call the unit transmitted on, as listed in its history.
+type UnitActivity struct {
+	Id             uint      `json:"id"`
+	DateTime       time.Time `json:"dateTime"`
+	Duration       float64   `json:"duration"`
+	Talkgroup      uint      `json:"talkgroup"`
+	TalkgroupLabel string    `json:"talkgroupLabel,omitempty"`
 }
 
 func (unit *Unit) FromMap(m map[string]any) *Unit {
@@ -49,6 +83,12 @@ func (unit *Unit) FromMap(m map[string]any) *Unit {
 	return unit
 }
 
+// IsLearned tells if the unit was learned from a call and still has its id
+// for label.
+func (unit *Unit) IsLearned() bool {
+	return unit.Label == strconv.FormatUint(uint64(unit.Id), 10)
+}
+
 type Units struct {
 	List  []*Unit
 	mutex sync.Mutex
@@ -67,6 +107,13 @@ func (units *Units) Add(id uint, label string) (*Units, bool) {
 	for _, u := range units.List {
 		if u.Id == id {
 			added = false
+
+			// the recorder knows better than our placeholder
+			if u.IsLearned() && len(label) > 0 && label != u.Label {
+				u.Label = label
+				added = true
+			}
+
 			break
 		}
 	}
@@ -78,6 +125,19 @@ func (units *Units) Add(id uint, label string) (*Units, bool) {
 	return units, added
 }
 
+func (units *Units) GetUnit(id uint) (*Unit, bool) {
+	units.mutex.Lock()
+	defer units.mutex.Unlock()
+
+	for _, unit := range units.List {
+		if unit.Id == id {
+			return unit, true
+		}
+	}
+
+	return nil, false
+}
+
 func (units *Units) FromMap(f []any) *Units {
 	units.mutex.Lock()
 	defer units.mutex.Unlock()
@@ -96,6 +156,109 @@ func (units *Units) FromMap(f []any) *Units {
 	return units
 }
 
+// Heard accounts for the units of the call, learning the unknown ones when
+// learn is set. It returns the ids of the units learned.
+func (units *Units) Heard(call *Call, learn bool, db *Database, systemId uint) ([]uint, error) {
+	var (
+		b   []byte
+		err error
+	)
+
+	units.mutex.Lock()
+	defer units.mutex.Unlock()
+
+	formatError := func(err error) error {
+		return fmt.Errorf("units.heard: %v", err)
+	}
+
+	learned := []uint{}
+
+	heard := call.DateTime.UTC()
+
+	for _, id := range callUnitIds(call) {
+		var unit *Unit
+
+		for _, u := range units.List {
+			if u.Id == id {
+				unit = u
+				break
+			}
+		}
+
+		if unit == nil {
+			if !learn {
+				continue
+			}
+
+			order := uint(0)
+			for _, u := range units.List {
+				if u.Order > order {
+					order = u.Order
+				}
+			}
+
+			unit = &Unit{
+				Id:         id,
+				Label:      strconv.FormatUint(uint64(id), 10),
+				Order:      order + 1,
+				Calls:      1,
+				FirstHeard: &heard,
+				LastHeard:  &heard,
+				Talkgroups: []uint{call.Talkgroup},
+			}
+
+			if b, err = json.Marshal(unit.Talkgroups); err != nil {
+				return learned, formatError(err)
+			}
+
+			if _, err = db.Sql.Exec("insert into `rdioScannerUnits` (`calls`, `firstHeard`, `id`, `label`, `lastHeard`, `order`, `systemId`, `talkgroups`) values (?, ?, ?, ?, ?, ?, ?, ?)", unit.Calls, unit.FirstHeard, unit.Id, unit.Label, unit.LastHeard, unit.Order, systemId, string(b)); err != nil {
+				return learned, formatError(err)
+			}
+
+			units.List = append(units.List, unit)
+
+			learned = append(learned, id)
+
+			continue
+		}
+
+		unit.Calls++
+
+		if unit.FirstHeard == nil || heard.Before(*unit.FirstHeard) {
+			unit.FirstHeard = &heard
+		}
+
+		if unit.LastHeard == nil || heard.After(*unit.LastHeard) {
+			unit.LastHeard = &heard
+		}
+
+		affiliated := false
+		for _, talkgroup := range unit.Talkgroups {
+			if talkgroup == call.Talkgroup {
+				affiliated = true
+				break
+			}
+		}
+		if !affiliated {
+			unit.Talkgroups = append(unit.Talkgroups, call.Talkgroup)
+			sort.Slice(unit.Talkgroups, func(i int, j int) bool {
+				return unit.Talkgroups[i] < unit.Talkgroups[j]
+			})
+		}
+
+		if b, err = json.Marshal(unit.Talkgroups); err != nil {
+			return learned, formatError(err)
+		}
+
+		// the count is incremented in place in case the config was just saved
+		if _, err = db.Sql.Exec("update `rdioScannerUnits` set `calls` = `calls` + 1, `firstHeard` = ?, `lastHeard` = ?, `talkgroups` = ? where `id` = ? and `systemId` = ?", unit.FirstHeard, unit.LastHeard, string(b), unit.Id, systemId); err != nil {
+			return learned, formatError(err)
+		}
+	}
+
+	return learned, nil
+}
+
 func (u *Units) Merge(units *Units) bool {
 	merged := false
 
@@ -115,8 +278,12 @@ func (u *Units) Merge(units *Units) bool {
 
 func (units *Units) Read(db *Database, systemId uint) error {
 	var (
-		err  error
-		rows *sql.Rows
+		calls      sql.NullFloat64
+		err        error
+		firstHeard any
+		lastHeard  any
+		rows       *sql.Rows
+		talkgroups sql.NullString
 	)
 
 	units.mutex.Lock()
@@ -128,17 +295,35 @@ func (units *Units) Read(db *Database, systemId uint) error {
 		return fmt.Errorf("units.read: %v", err)
 	}
 
-	if rows, err = db.Sql.Query("select `id`, `label`, `order` from `rdioScannerUnits` where `systemId` = ?", systemId); err != nil {
+	if rows, err = db.Sql.Query("select `calls`, `firstHeard`, `id`, `label`, `lastHeard`, `order`, `talkgroups` from `rdioScannerUnits` where `systemId` = ?", systemId); err != nil {
 		return formatError(err)
 	}
 
 	for rows.Next() {
 		unit := &Unit{}
 
-		if err = rows.Scan(&unit.Id, &unit.Label, &unit.Order); err != nil {
+		if err = rows.Scan(&calls, &firstHeard, &unit.Id, &unit.Label, &lastHeard, &unit.Order, &talkgroups); err != nil {
 			break
 		}
 
+		if calls.Valid && calls.Float64 > 0 {
+			unit.Calls = uint(calls.Float64)
+		}
+
+		if t, err := db.ParseDateTime(firstHeard); err == nil {
+			unit.FirstHeard = &t
+		}
+
+		if t, err := db.ParseDateTime(lastHeard); err == nil {
+			unit.LastHeard = &t
+		}
+
+		if talkgroups.Valid && len(talkgroups.String) > 0 {
+			if err := json.Unmarshal([]byte(talkgroups.String), &unit.Talkgroups); err != nil {
+				unit.Talkgroups = nil
+			}
+		}
+
 		units.List = append(units.List, unit)
 	}
 
@@ -198,17 +383,7 @@ func (units *Units) Write(db *Database, systemId uint) error {
 	}
 
 	if len(ids) > 0 {
-		// Build parameterized IN clause to prevent SQL injection
-		placeholders := make([]string, len(ids))
-		args := make([]any, len(ids))
-		for i, id := range ids {
-			placeholders[i] = "?"
-			args[i] = id
-		}
-		// Add systemId as final parameter
-		args = append(args, systemId)
-		q := fmt.Sprintf("delete from `rdioScannerUnits` where `id` in (%s) and `systemId` = ?", strings.Join(placeholders, ","))
-		if _, err = db.Sql.Exec(q, args...); err != nil {
+		if _, err = db.Delete("rdioScannerUnits").Where(SqlIn("id", ids), SqlWhere("`systemId` = ?", systemId)).Exec(); err != nil {
 			return formatError(err)
 		}
 	}
@@ -234,3 +409,557 @@ func (units *Units) Write(db *Database, systemId uint) error {
 
 	return nil
 }
+
+// UnitHistory returns the calls a unit transmitted on, most recent first,
+// and their count. The unit is found either as the source of the call or in
+// its sources.
+func (calls *Calls) UnitHistory(systemId uint, unitId uint, limit uint, offset uint, db *Database) ([]UnitActivity, uint, error) {
+	var (
+		count    uint
+		dateTime any
+		duration sql.NullFloat64
+		err      error
+		rows     *sql.Rows
+	)
+
+	formatError := func(err error) error {
+		return fmt.Errorf("calls.unithistory: %v", err)
+	}
+
+	where := SqlAnd(SqlWhere("`system` = ?", systemId), sqlUnit(unitId))
+
+	if err = db.Select("rdioScannerCalls", "count(*)").Where(where).QueryRow().Scan(&count); err != nil {
+		return nil, 0, formatError(err)
+	}
+
+	if rows, err = db.Select("rdioScannerCalls", "id", "dateTime", "duration", "talkgroup").Where(where).OrderBy("dateTime", true).Limit(limit, offset).Query(); err != nil {
+		return nil, 0, formatError(err)
+	}
+
+	history := []UnitActivity{}
+
+	for rows.Next() {
+		activity := UnitActivity{}
+
+		if err = rows.Scan(&activity.Id, &dateTime, &duration, &activity.Talkgroup); err != nil {
+			break
+		}
+
+		if t, err := db.ParseDateTime(dateTime); err == nil {
+			activity.DateTime = t
+		}
+
+		if duration.Valid {
+			activity.Duration = duration.Float64 / 1000
+		}
+
+		history = append(history, activity)
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return nil, 0, formatError(err)
+	}
+
+	return history, count, nil
+}
+
+// sqlUnit is the condition on the calls of which one of the units is the
+// source or transmits mid-call, as found in the json of their sources.
+func sqlUnit(ids ...uint) *SqlCondition {
+	a := []*SqlCondition{}
+
+	for _, id := range ids {
+		a = append(a,
+			SqlWhere("`source` = ?", id),
+			SqlWhere("`sources` like ?", fmt.Sprintf("%%\"src\":%d,%%", id)),
+			SqlWhere("`sources` like ?", fmt.Sprintf("%%\"src\":%d}%%", id)),
+		)
+	}
+
+	if len(a) == 0 {
+		return SqlFalse()
+	}
+
+	return SqlOr(a...)
+}
+
+// sqlUnitCondition is the condition on the calls of a unit, given by radio id
+// or by alias, of the system or of all the systems when 0. The aliases are
+// matched regardless of the case, an unknown one matching nothing.
+func (systems *Systems) sqlUnitCondition(unit any, systemId uint) *SqlCondition {
+	switch v := unit.(type) {
+	case uint:
+		return sqlUnit(v)
+
+	case string:
+		systems.mutex.Lock()
+		list := append([]*System{}, systems.List...)
+		systems.mutex.Unlock()
+
+		a := []*SqlCondition{}
+
+		for _, system := range list {
+			if systemId > 0 && system.Id != systemId {
+				continue
+			}
+
+			ids := []uint{}
+
+			system.Units.mutex.Lock()
+			for _, u := range system.Units.List {
+				if strings.EqualFold(u.Label, v) {
+					ids = append(ids, u.Id)
+				}
+			}
+			system.Units.mutex.Unlock()
+
+			if len(ids) > 0 {
+				a = append(a, SqlAnd(SqlWhere("`system` = ?", system.Id), sqlUnit(ids...)))
+			}
+		}
+
+		if len(a) == 0 {
+			return SqlFalse()
+		}
+
+		return SqlOr(a...)
+	}
+
+	return nil
+}
+
+// callUnitIds returns the radio ids of the call, its source first.
+func callUnitIds(call *Call) []uint {
+	ids := []uint{}
+
+	add := func(v any) {
+		var id uint
+
+		switch v := v.(type) {
+		case uint:
+			id = v
+		case int:
+			if v > 0 {
+				id = uint(v)
+			}
+		case float64:
+			if v > 0 {
+				id = uint(v)
+			}
+		}
+
+		if id == 0 {
+			return
+		}
+
+		for _, i := range ids {
+			if i == id {
+				return
+			}
+		}
+
+		ids = append(ids, id)
+	}
+
+	add(call.Source)
+
+	switch v := call.Sources.(type) {
+	case []map[string]any:
+		for _, source := range v {
+			add(source["src"])
+		}
+	case []any:
+		for _, source := range v {
+			if m, ok := source.(map[string]any); ok {
+				add(m["src"])
+			}
+		}
+	}
+
+	return ids
+}
+
+// ParseUnitAliases reads a list of aliases, either a csv file of radio ids
+// and labels like the unit tags of Trunk Recorder, or the radio aliases of a
+// SDRTrunk playlist.
+func ParseUnitAliases(b []byte) ([]*Unit, error) {
+	var (
+		err   error
+		units []*Unit
+	)
+
+	if GetFleetmapFormat(b) == FLEETMAP_SDRTRUNK {
+		units, err = parseUnitAliasesSdrTrunk(b)
+	} else {
+		units, err = parseUnitAliasesCsv(b)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("parseunitaliases: %v", err)
+	}
+
+	unique := []*Unit{}
+
+	for _, unit := range units {
+		duplicate := false
+		for _, u := range unique {
+			if u.Id == unit.Id {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate && len(unit.Label) > 0 {
+			unique = append(unique, unit)
+		}
+	}
+
+	if len(unique) == 0 {
+		return nil, errors.New("parseunitaliases: no units found")
+	}
+
+	return unique, nil
+}
+
+func parseUnitAliasesCsv(b []byte) ([]*Unit, error) {
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(b, []byte("\xef\xbb\xbf"))))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	columns := [2]int{0, 1}
+
+	if len(records) > 0 && len(records[0]) > 0 {
+		if _, err := strconv.ParseUint(strings.TrimSpace(records[0][0]), 10, 32); err != nil {
+			names := [2][]string{
+				{"id", "radio id", "radioid", "unit", "unit id", "dec"},
+				{"label", "alias", "alpha tag", "name", "tag"},
+			}
+
+			header := map[string]int{}
+			for i, name := range records[0] {
+				header[strings.ToLower(strings.TrimSpace(name))] = i
+			}
+
+			for i := range names {
+				columns[i] = -1
+				for _, name := range names[i] {
+					if c, ok := header[name]; ok {
+						columns[i] = c
+						break
+					}
+				}
+			}
+
+			if columns[0] < 0 || columns[1] < 0 {
+				return nil, errors.New("no radio id or label column")
+			}
+
+			records = records[1:]
+		}
+	}
+
+	units := []*Unit{}
+
+	for _, record := range records {
+		if columns[0] >= len(record) || columns[1] >= len(record) {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSpace(record[columns[0]]), 10, 32)
+		if err != nil || id == 0 {
+			continue
+		}
+
+		units = append(units, &Unit{Id: uint(id), Label: strings.TrimSpace(record[columns[1]])})
+	}
+
+	return units, nil
+}
+
+func parseUnitAliasesSdrTrunk(b []byte) ([]*Unit, error) {
+	playlist := fleetmapSdrTrunkPlaylist{}
+
+	if err := xml.Unmarshal(b, &playlist); err != nil {
+		return nil, err
+	}
+
+	units := []*Unit{}
+
+	for _, alias := range playlist.Aliases {
+		for _, id := range alias.Ids {
+			if id.Type != "radio" {
+				continue
+			}
+
+			i, err := strconv.ParseUint(strings.TrimSpace(id.Value), 10, 32)
+			if err != nil || i == 0 {
+				continue
+			}
+
+			units = append(units, &Unit{Id: uint(i), Label: strings.TrimSpace(alias.Name)})
+		}
+	}
+
+	return units, nil
+}
+
+// ImportUnits sets the aliases of the units of a system. Units already
+// aliased keep their label unless overwrite is set, the learned ones always
+// take the new alias.
+func (controller *Controller) ImportUnits(systemId uint, source []*Unit, overwrite bool) (imported []uint, skipped []uint, err error) {
+	formatError := func(err error) error {
+		return fmt.Errorf("controller.importunits: %v", err)
+	}
+
+	system, ok := controller.Systems.GetSystem(systemId)
+	if !ok {
+		return nil, nil, formatError(fmt.Errorf("no system %d", systemId))
+	}
+
+	imported = []uint{}
+	skipped = []uint{}
+
+	system.Units.mutex.Lock()
+
+	order := uint(0)
+	for _, unit := range system.Units.List {
+		if unit.Order > order {
+			order = unit.Order
+		}
+	}
+
+	for _, alias := range source {
+		var unit *Unit
+
+		for _, u := range system.Units.List {
+			if u.Id == alias.Id {
+				unit = u
+				break
+			}
+		}
+
+		if unit == nil {
+			order++
+			system.Units.List = append(system.Units.List, &Unit{Id: alias.Id, Label: alias.Label, Order: order})
+			imported = append(imported, alias.Id)
+
+		} else if unit.Label == alias.Label {
+			skipped = append(skipped, alias.Id)
+
+		} else if overwrite || unit.IsLearned() {
+			unit.Label = alias.Label
+			imported = append(imported, alias.Id)
+
+		} else {
+			skipped = append(skipped, alias.Id)
+		}
+	}
+
+	system.Units.mutex.Unlock()
+
+	if len(imported) == 0 {
+		return imported, skipped, nil
+	}
+
+	if err = controller.Systems.Write(controller.Database); err != nil {
+		return nil, nil, formatError(err)
+	}
+
+	if err = controller.Systems.Read(controller.Database); err != nil {
+		return nil, nil, formatError(err)
+	}
+
+	controller.EmitConfig()
+
+	return imported, skipped, nil
+}
+
+// UnitsHandler lists the units of a system with their activity, most
+// recently heard first, optionally filtered by a search on their id or
+// label or to the learned ones only. With a unit id it gives the history of
+// that unit instead, the calls it transmitted on. Posting a list of aliases
+// imports it.
+func (admin *Admin) UnitsHandler(w http.ResponseWriter, r *http.Request) {
+	if !admin.Authorize(w, r, adminWriteRole(r)) {
+		return
+	}
+
+	controller := admin.Controller
+
+	query := r.URL.Query()
+
+	id, err := strconv.ParseUint(query.Get("system"), 10, 32)
+	if err != nil || id == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	writeJson := func(v any) {
+		if b, err := json.Marshal(v); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		system, ok := controller.Systems.GetSystem(uint(id))
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		search := strings.ToLower(strings.TrimSpace(query.Get("search")))
+		learned, _ := strconv.ParseBool(query.Get("learned"))
+
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || limit < 1 {
+			limit = 100
+		}
+
+		offset, err := strconv.Atoi(query.Get("offset"))
+		if err != nil || offset < 0 {
+			offset = 0
+		}
+
+		if query.Has("unit") {
+			unitId, err := strconv.ParseUint(query.Get("unit"), 10, 32)
+			if err != nil || unitId == 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			record := UnitRecord{Id: uint(unitId), Label: strconv.FormatUint(unitId, 10), Learned: true, Talkgroups: []uint{}}
+
+			system.Units.mutex.Lock()
+			for _, unit := range system.Units.List {
+				if unit.Id == uint(unitId) {
+					record = UnitRecord{
+						Id:         unit.Id,
+						Label:      unit.Label,
+						Calls:      unit.Calls,
+						FirstHeard: unit.FirstHeard,
+						LastHeard:  unit.LastHeard,
+						Learned:    unit.IsLearned(),
+						Talkgroups: append([]uint{}, unit.Talkgroups...),
+					}
+					break
+				}
+			}
+			system.Units.mutex.Unlock()
+
+			history, count, err := controller.Calls.UnitHistory(system.Id, uint(unitId), uint(limit), uint(offset), controller.Database)
+			if err != nil {
+				controller.Logs.LogEvent(LogLevelError, err.Error())
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			for i := range history {
+				if talkgroup, ok := system.Talkgroups.GetTalkgroup(history[i].Talkgroup); ok {
+					history[i].TalkgroupLabel = talkgroup.Label
+				}
+			}
+
+			writeJson(map[string]any{"calls": history, "count": count, "unit": record})
+			return
+		}
+
+		records := []UnitRecord{}
+
+		system.Units.mutex.Lock()
+		for _, unit := range system.Units.List {
+			if learned && !unit.IsLearned() {
+				continue
+			}
+
+			if len(search) > 0 && !strings.Contains(strconv.FormatUint(uint64(unit.Id), 10), search) && !strings.Contains(strings.ToLower(unit.Label), search) {
+				continue
+			}
+
+			talkgroups := make([]uint, len(unit.Talkgroups))
+			copy(talkgroups, unit.Talkgroups)
+
+			records = append(records, UnitRecord{
+				Id:         unit.Id,
+				Label:      unit.Label,
+				Calls:      unit.Calls,
+				FirstHeard: unit.FirstHeard,
+				LastHeard:  unit.LastHeard,
+				Learned:    unit.IsLearned(),
+				Talkgroups: talkgroups,
+			})
+		}
+		system.Units.mutex.Unlock()
+
+		sort.Slice(records, func(i int, j int) bool {
+			a, b := records[i].LastHeard, records[j].LastHeard
+			if a == nil || b == nil {
+				if a == nil && b == nil {
+					return records[i].Id < records[j].Id
+				}
+				return b == nil
+			}
+			return a.After(*b)
+		})
+
+		count := len(records)
+
+		if offset > len(records) {
+			offset = len(records)
+		}
+		records = records[offset:]
+
+		if limit < len(records) {
+			records = records[:limit]
+		}
+
+		writeJson(map[string]any{"count": count, "units": records})
+
+	case http.MethodPost:
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		units, err := ParseUnitAliases(b)
+		if err != nil {
+			controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("units import: %v", err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		overwrite, _ := strconv.ParseBool(query.Get("overwrite"))
+
+		admin.mutex.Lock()
+		defer admin.mutex.Unlock()
+
+		imported, skipped, err := controller.ImportUnits(uint(id), units, overwrite)
+		if err != nil {
+			controller.Logs.LogEvent(LogLevelError, err.Error())
+			w.WriteHeader(http.StatusExpectationFailed)
+			return
+		}
+
+		controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("units import: %d aliases imported into system %d by admin from ip %s", len(imported), id, GetRemoteAddr(r)))
+
+		if _, err := controller.ConfigVersions.Snapshot(admin.author(r), fmt.Sprintf("units imported into system %d", id)); err != nil {
+			controller.Logs.LogEvent(LogLevelError, err.Error())
+		}
+
+		writeJson(map[string]any{"imported": imported, "skipped": skipped})
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,325 @@
+// Copyright (C) 2019-2022 Chrystian Huot <chrystian.huot@saubeo.solutions>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	AdminRoleConfigEditor = "config-editor"
+	AdminRoleSuperadmin   = "superadmin"
+	AdminRoleViewer       = "viewer"
+)
+
+// adminRoleRank orders the roles, each role having the permissions of the
+// roles below it.
+func adminRoleRank(role string) int {
+	switch role {
+	case AdminRoleViewer:
+		return 1
+	case AdminRoleConfigEditor:
+		return 2
+	case AdminRoleSuperadmin:
+		return 3
+	default:
+		return 0
+	}
+}
+
+// adminWriteRole is the role required by an endpoint that viewers may read
+// but only config editors may change.
+func adminWriteRole(r *http.Request) string {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return AdminRoleViewer
+	default:
+		return AdminRoleConfigEditor
+	}
+}
+
+// AdminUser is an admin account. The admin password of the options remains
+// as a superadmin without a username, used by the default login and openid
+// connect.
+type AdminUser struct {
+	Id       any    `json:"_id"`
+	Disabled bool   `json:"disabled"`
+	Role     string `json:"role"`
+	Username string `json:"username"`
+	password string
+}
+
+func (user *AdminUser) HasRole(role string) bool {
+	return user != nil && !user.Disabled && adminRoleRank(user.Role) >= adminRoleRank(role) && adminRoleRank(role) > 0
+}
+
+type AdminUsers struct {
+	List  []*AdminUser
+	mutex sync.Mutex
+}
+
+func NewAdminUsers() *AdminUsers {
+	return &AdminUsers{
+		List:  []*AdminUser{},
+		mutex: sync.Mutex{},
+	}
+}
+
+// Authenticate returns the enabled user matching the username and password.
+func (users *AdminUsers) Authenticate(username string, password string) (*AdminUser, bool) {
+	user, ok := users.GetUser(username)
+	if !ok || user.Disabled {
+		return nil, false
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.password), []byte(password)); err != nil {
+		return nil, false
+	}
+
+	return user, true
+}
+
+func (users *AdminUsers) GetUser(username string) (*AdminUser, bool) {
+	users.mutex.Lock()
+	defer users.mutex.Unlock()
+
+	for _, user := range users.List {
+		if strings.EqualFold(user.Username, username) {
+			return user, true
+		}
+	}
+
+	return nil, false
+}
+
+func (users *AdminUsers) Read(db *Database) error {
+	var (
+		err  error
+		id   sql.NullFloat64
+		rows *sql.Rows
+	)
+
+	users.mutex.Lock()
+	defer users.mutex.Unlock()
+
+	users.List = []*AdminUser{}
+
+	formatError := func(err error) error {
+		return fmt.Errorf("adminusers.read: %v", err)
+	}
+
+	if rows, err = db.Sql.Query("select `_id`, `disabled`, `password`, `role`, `username` from `rdioScannerUsers` order by `username`"); err != nil {
+		return formatError(err)
+	}
+
+	for rows.Next() {
+		user := &AdminUser{}
+
+		if err = rows.Scan(&id, &user.Disabled, &user.password, &user.Role, &user.Username); err != nil {
+			break
+		}
+
+		if id.Valid && id.Float64 > 0 {
+			user.Id = uint(id.Float64)
+		}
+
+		users.List = append(users.List, user)
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return formatError(err)
+	}
+
+	return nil
+}
+
+// Save creates the user when it has no id, or updates it. The password is
+// only changed when one is given.
+func (users *AdminUsers) Save(db *Database, user *AdminUser, password string) error {
+	var (
+		err  error
+		hash []byte
+	)
+
+	formatError := func(err error) error {
+		return fmt.Errorf("adminusers.save: %v", err)
+	}
+
+	if len(password) > 0 {
+		if hash, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost); err != nil {
+			return formatError(err)
+		}
+	}
+
+	if user.Id == nil {
+		if len(hash) == 0 {
+			return formatError(errors.New("password is required"))
+		}
+
+		if _, err = db.Sql.Exec("insert into `rdioScannerUsers` (`disabled`, `password`, `role`, `username`) values (?, ?, ?, ?)", user.Disabled, string(hash), user.Role, user.Username); err != nil {
+			return formatError(err)
+		}
+
+	} else if len(hash) > 0 {
+		if _, err = db.Sql.Exec("update `rdioScannerUsers` set `disabled` = ?, `password` = ?, `role` = ?, `username` = ? where `_id` = ?", user.Disabled, string(hash), user.Role, user.Username, user.Id); err != nil {
+			return formatError(err)
+		}
+
+	} else if _, err = db.Sql.Exec("update `rdioScannerUsers` set `disabled` = ?, `role` = ?, `username` = ? where `_id` = ?", user.Disabled, user.Role, user.Username, user.Id); err != nil {
+		return formatError(err)
+	}
+
+	return users.Read(db)
+}
+
+func (users *AdminUsers) Remove(db *Database, id uint) error {
+	formatError := func(err error) error {
+		return fmt.Errorf("adminusers.remove: %v", err)
+	}
+
+	if _, err := db.Sql.Exec("delete from `rdioScannerUsers` where `_id` = ?", id); err != nil {
+		return formatError(err)
+	}
+
+	return users.Read(db)
+}
+
+func (admin *Admin) UsersHandler(w http.ResponseWriter, r *http.Request) {
+	if !admin.Authorize(w, r, AdminRoleSuperadmin) {
+		return
+	}
+
+	logError := func(err error) {
+		admin.Controller.Logs.LogEvent(LogLevelError, fmt.Sprintf("admin.usershandler: %s", err.Error()))
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if b, err := json.Marshal(admin.Controller.Users.List); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusExpectationFailed)
+		}
+
+	case http.MethodPost, http.MethodPut:
+		var (
+			password string
+			user     = &AdminUser{}
+			m        = map[string]any{}
+		)
+
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if r.Method == http.MethodPut {
+			switch v := m["_id"].(type) {
+			case float64:
+				for _, u := range admin.Controller.Users.List {
+					if u.Id == uint(v) {
+						*user = *u
+					}
+				}
+			}
+
+			if user.Id == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+		}
+
+		switch v := m["disabled"].(type) {
+		case bool:
+			user.Disabled = v
+		}
+
+		switch v := m["password"].(type) {
+		case string:
+			password = v
+		}
+
+		switch v := m["role"].(type) {
+		case string:
+			user.Role = v
+		}
+
+		switch v := m["username"].(type) {
+		case string:
+			user.Username = strings.TrimSpace(v)
+		}
+
+		if len(user.Username) == 0 || adminRoleRank(user.Role) == 0 || (user.Id == nil && len(password) == 0) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if u, ok := admin.Controller.Users.GetUser(user.Username); ok && u.Id != user.Id {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+
+		if err := admin.Controller.Users.Save(admin.Controller.Database, user, password); err != nil {
+			logError(err)
+			w.WriteHeader(http.StatusExpectationFailed)
+			return
+		}
+
+		admin.Controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("admin: user %s saved with role %s", user.Username, user.Role))
+
+		if u, ok := admin.Controller.Users.GetUser(user.Username); ok {
+			if b, err := json.Marshal(u); err == nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write(b)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusExpectationFailed)
+
+	case http.MethodDelete:
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil || id <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if err := admin.Controller.Users.Remove(admin.Controller.Database, uint(id)); err != nil {
+			logError(err)
+			w.WriteHeader(http.StatusExpectationFailed)
+			return
+		}
+
+		admin.Controller.Logs.LogEvent(LogLevelWarn, fmt.Sprintf("admin: user %d removed", id))
+
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}